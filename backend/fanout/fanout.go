@@ -0,0 +1,205 @@
+// Package fanout provides independent readers over a single backend.Storage, so that an image can be
+// processed in parallel, e.g. each of its partitions in its own goroutine, without them sharing a position
+// in the storage underneath:
+//
+//	f := fanout.New(b, false)
+//	for _, p := range partitions {
+//		go func(r *fanout.Reader) {
+//			defer r.Close()
+//			// every Reader is a backend.Storage of its own, which can be read like any other
+//			fs, err := ext4.Read(r, p.GetSize(), p.GetStart(), 512)
+//			...
+//		}(f.Reader())
+//	}
+//
+// Each Reader keeps its own position for Read and Seek, and all reads are done with ReadAt on the
+// storage underneath. Each also counts what it has read, to find which of the goroutines does the most I/O.
+package fanout
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// Stats what has been read through one Reader, or through all of them
+type Stats struct {
+	// Reads how many reads there have been
+	Reads int64
+	// BytesRead how many bytes the reads returned
+	BytesRead int64
+	// Errors how many reads failed, not counting io.EOF
+	Errors int64
+	// ReadTime how long the reads took, all told
+	ReadTime time.Duration
+}
+
+// Fanout hands out Readers over a single storage
+type Fanout struct {
+	storage backend.Storage
+	// serialize whether reads of the storage must be done one at a time
+	serialize bool
+	// mu held for every read of the storage when serialize is set, and to change readers
+	mu      sync.Mutex
+	readers []*Reader
+}
+
+// New fan out reads of s. Unless serialize is set, reads from different Readers reach s at the same time,
+// which is safe for files, as they use pread, and for the mem and s3 backends. Set serialize for
+// storage that is not safe for concurrent ReadAt.
+func New(s backend.Storage, serialize bool) *Fanout {
+	return &Fanout{
+		storage:   s,
+		serialize: serialize,
+	}
+}
+
+// Reader returns a new Reader, positioned at the start of the storage
+func (f *Fanout) Reader() *Reader {
+	r := &Reader{fanout: f}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readers = append(f.readers, r)
+	return r
+}
+
+// Stats what has been read through all of the Readers, including those that have been closed
+func (f *Fanout) Stats() Stats {
+	f.mu.Lock()
+	readers := f.readers
+	f.mu.Unlock()
+	var total Stats
+	for _, r := range readers {
+		s := r.Stats()
+		total.Reads += s.Reads
+		total.BytesRead += s.BytesRead
+		total.Errors += s.Errors
+		total.ReadTime += s.ReadTime
+	}
+	return total
+}
+
+// readAt read from the storage, one at a time if it must be
+func (f *Fanout) readAt(p []byte, off int64) (int, error) {
+	if f.serialize {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	}
+	return f.storage.ReadAt(p, off)
+}
+
+// ErrClosed is returned by any operation on a Reader after it has been closed
+var ErrClosed = errors.New("fanout: reader is closed")
+
+// Reader is a read-only backend.Storage over the storage of its Fanout, with a position of its own.
+// It is safe for concurrent use, though concurrent Read and Seek are, as for any file, of little use.
+type Reader struct {
+	fanout *Fanout
+	// mu held to use or change offset
+	mu     sync.Mutex
+	offset int64
+	closed atomic.Bool
+
+	reads     atomic.Int64
+	bytesRead atomic.Int64
+	errors    atomic.Int64
+	readTime  atomic.Int64
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Reader)(nil)
+
+// Stats what has been read through this Reader
+func (r *Reader) Stats() Stats {
+	return Stats{
+		Reads:     r.reads.Load(),
+		BytesRead: r.bytesRead.Load(),
+		Errors:    r.errors.Load(),
+		ReadTime:  time.Duration(r.readTime.Load()),
+	}
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if r.closed.Load() {
+		return 0, ErrClosed
+	}
+	start := time.Now()
+	n, err := r.fanout.readAt(p, off)
+	r.readTime.Add(int64(time.Since(start)))
+	r.reads.Add(1)
+	r.bytesRead.Add(int64(n))
+	if err != nil && err != io.EOF {
+		r.errors.Add(1)
+	}
+	return n, err
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	// reading less than asked for at the end is io.EOF for ReadAt, but not for Read
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed.Load() {
+		return 0, ErrClosed
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		info, err := r.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("unable to get size to seek from the end: %w", err)
+		}
+		offset += info.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *Reader) Stat() (fs.FileInfo, error) {
+	if r.closed.Load() {
+		return nil, ErrClosed
+	}
+	return r.fanout.storage.Stat()
+}
+
+// Close close the Reader, but not the storage, which others may still be reading
+func (r *Reader) Close() error {
+	if r.closed.Swap(true) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// OS-specific file for ioctl calls via fd
+func (r *Reader) Sys() (*os.File, error) {
+	return r.fanout.storage.Sys()
+}
+
+// Writable always fails, as a Reader is only for reading
+func (r *Reader) Writable() (backend.WritableFile, error) {
+	return nil, backend.ErrIncorrectOpenMode
+}
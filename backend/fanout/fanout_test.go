@@ -0,0 +1,197 @@
+package fanout_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/fanout"
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestReaders(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	const readers = 8
+	region := len(data) / readers
+	for _, serialize := range []bool{false, true} {
+		t.Run(fmt.Sprintf("serialize %v", serialize), func(t *testing.T) {
+			b, err := mem.NewFromBytes(data, true)
+			if err != nil {
+				t.Fatalf("unexpected error creating buffer: %v", err)
+			}
+			f := fanout.New(b, serialize)
+			var (
+				wg  sync.WaitGroup
+				all []*fanout.Reader
+			)
+			for i := 0; i < readers; i++ {
+				r := f.Reader()
+				all = append(all, r)
+				wg.Add(1)
+				// each reads its own region in small pieces, interleaved with all the others
+				go func(i int) {
+					defer wg.Done()
+					if _, err := r.Seek(int64(i*region), io.SeekStart); err != nil {
+						t.Errorf("reader %d: unexpected error seeking: %v", i, err)
+						return
+					}
+					got := make([]byte, region)
+					for off := 0; off < region; off += 1000 {
+						n, err := r.Read(got[off:min(off+1000, region)])
+						if err != nil || n != min(1000, region-off) {
+							t.Errorf("reader %d: read %d bytes at %d, error %v", i, n, off, err)
+							return
+						}
+					}
+					if !bytes.Equal(got, data[i*region:(i+1)*region]) {
+						t.Errorf("reader %d: mismatched data", i)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			reads := int64((region + 999) / 1000)
+			for i, r := range all {
+				if s := r.Stats(); s.Reads != reads || s.BytesRead != int64(region) || s.Errors != 0 {
+					t.Errorf("reader %d: stats %+v, instead of %d reads of %d bytes", i, s, reads, region)
+				}
+			}
+			if s := f.Stats(); s.Reads != readers*reads || s.BytesRead != int64(len(data)) || s.Errors != 0 || s.ReadTime <= 0 {
+				t.Errorf("total stats %+v, instead of %d reads of %d bytes", s, readers*reads, len(data))
+			}
+		})
+	}
+}
+
+func TestReader(t *testing.T) {
+	b, err := mem.NewFromBytes([]byte("0123456789"), true)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	f := fanout.New(b, false)
+	r := f.Reader()
+
+	// seeking from the end uses the size of the storage
+	if pos, err := r.Seek(-4, io.SeekEnd); err != nil || pos != 6 {
+		t.Errorf("seek from end to %d, error %v", pos, err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "6789" {
+		t.Errorf("read %q, error %v", got, err)
+	}
+	// ReadAt past the end is an io.EOF, which is not counted as an error
+	p := make([]byte, 4)
+	if n, err := r.ReadAt(p, 8); n != 2 || err != io.EOF {
+		t.Errorf("read %d bytes at the end, error %v", n, err)
+	}
+	if s := r.Stats(); s.Errors != 0 || s.BytesRead != 6 {
+		t.Errorf("stats %+v", s)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("no error seeking before the start")
+	}
+	if _, err := r.Writable(); !errors.Is(err, backend.ErrIncorrectOpenMode) {
+		t.Errorf("mismatched error getting writable, %v", err)
+	}
+
+	// closing one reader leaves the others, and the storage, open
+	other := f.Reader()
+	if err := r.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	if _, err := r.ReadAt(p, 0); !errors.Is(err, fanout.ErrClosed) {
+		t.Errorf("mismatched error reading closed reader, %v", err)
+	}
+	if err := r.Close(); !errors.Is(err, fanout.ErrClosed) {
+		t.Errorf("mismatched error closing twice, %v", err)
+	}
+	if n, err := other.ReadAt(p, 0); err != nil || string(p[:n]) != "0123" {
+		t.Errorf("read %q from other reader, error %v", p[:n], err)
+	}
+	// io.ReadAll reads until it gets io.EOF, so that is two reads
+	if s := f.Stats(); s.Reads != 4 || s.BytesRead != 10 {
+		t.Errorf("total stats %+v", s)
+	}
+}
+
+func TestPartitionsInParallel(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	d, err := diskfs.OpenBackend(b, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatalf("unexpected error opening disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 2048 + 40960 - 1, Type: gpt.MicrosoftBasicData, Name: "one"},
+			{Start: 2048 + 40960, End: 2048 + 2*40960 - 1, Type: gpt.MicrosoftBasicData, Name: "two"},
+			{Start: 2048 + 2*40960, End: 2048 + 3*40960 - 1, Type: gpt.MicrosoftBasicData, Name: "three"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("unexpected error partitioning: %v", err)
+	}
+	for i := range table.Partitions {
+		fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: i + 1, FSType: filesystem.TypeFat32})
+		if err != nil {
+			t.Fatalf("unexpected error creating filesystem %d: %v", i+1, err)
+		}
+		for j := 0; j <= i; j++ {
+			if err := fs.Mkdir(fmt.Sprintf("/DIR%d", j)); err != nil {
+				t.Fatalf("unexpected error making directory: %v", err)
+			}
+		}
+	}
+
+	f := fanout.New(b, false)
+	var wg sync.WaitGroup
+	for i := range table.Partitions {
+		wg.Add(1)
+		go func(i int, r *fanout.Reader) {
+			defer wg.Done()
+			defer r.Close()
+			d, err := diskfs.OpenBackend(r)
+			if err != nil {
+				t.Errorf("partition %d: unexpected error opening disk: %v", i+1, err)
+				return
+			}
+			fs, err := d.GetFilesystem(i + 1)
+			if err != nil {
+				t.Errorf("partition %d: unexpected error reading filesystem: %v", i+1, err)
+				return
+			}
+			entries, err := fs.ReadDir("/")
+			if err != nil {
+				t.Errorf("partition %d: unexpected error reading directory: %v", i+1, err)
+				return
+			}
+			var dirs int
+			for _, e := range entries {
+				if e.IsDir() && e.Name() != "." && e.Name() != ".." {
+					dirs++
+				}
+			}
+			if dirs != i+1 {
+				t.Errorf("partition %d: %d directories instead of %d", i+1, dirs, i+1)
+			}
+			if r.Stats().Reads == 0 {
+				t.Errorf("partition %d: no reads counted", i+1)
+			}
+		}(i, f.Reader())
+	}
+	wg.Wait()
+}
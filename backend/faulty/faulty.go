@@ -0,0 +1,239 @@
+// Package faulty provides a backend.Storage that wraps another one and injects faults into it: errors at
+// given offsets, short reads, torn writes and latency. It is meant for tests, both of this library and of
+// anything that uses it, that need to exercise what happens when the disk underneath misbehaves.
+//
+// A fault applies to a range of bytes of the storage. An operation that touches any byte of the range
+// is hit by the fault, and one that does not is passed through unchanged:
+//
+//	s := faulty.New(b)
+//	// every read of the GPT header fails, as if the sector were unreadable
+//	s.Inject(faulty.Fault{Kind: faulty.ReadError, Offset: 512, Length: 512})
+//	// the next write to the first MiB stops part way through
+//	s.Inject(faulty.Fault{Kind: faulty.TornWrite, Offset: 4096, Length: 1024 * 1024, Count: 1})
+package faulty
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// ErrInjected is returned by an operation that is hit by a ReadError, WriteError or TornWrite fault.
+// It wraps syscall.EIO, which is what a failing disk returns.
+var ErrInjected = fmt.Errorf("faulty: injected fault: %w", syscall.EIO)
+
+// Kind what a fault does to an operation it hits
+type Kind int
+
+const (
+	// ReadError a read fails with ErrInjected, and reads nothing
+	ReadError Kind = iota
+	// WriteError a write fails with ErrInjected, and writes nothing
+	WriteError
+	// ShortRead a read returns only the bytes before the start of the fault, with io.EOF, as if the
+	// storage ended there
+	ShortRead
+	// TornWrite a write writes only the bytes before the start of the fault, then fails with ErrInjected,
+	// as if it were cut off by a crash or a loss of power
+	TornWrite
+)
+
+func (k Kind) String() string {
+	switch k {
+	case ReadError:
+		return "read error"
+	case WriteError:
+		return "write error"
+	case ShortRead:
+		return "short read"
+	case TornWrite:
+		return "torn write"
+	default:
+		return fmt.Sprintf("unknown fault %d", int(k))
+	}
+}
+
+// isRead whether the fault applies to reads, else it applies to writes
+func (k Kind) isRead() bool {
+	return k == ReadError || k == ShortRead
+}
+
+// Fault a single fault to inject into a Storage
+type Fault struct {
+	Kind Kind
+	// Offset the first byte of the storage that the fault covers
+	Offset int64
+	// Length how many bytes the fault covers. If 0, it covers everything from Offset to the end.
+	Length int64
+	// Count how many operations the fault hits before it is spent. If 0, it never is.
+	Count int
+}
+
+// overlaps whether an operation of size bytes at off touches any of the bytes the fault covers
+func (f *Fault) overlaps(off int64, size int) bool {
+	if size == 0 || off+int64(size) <= f.Offset {
+		return false
+	}
+	return f.Length == 0 || off < f.Offset+f.Length
+}
+
+// Storage is a backend.Storage that injects faults into the operations on another one.
+// It is safe for concurrent use, so long as the storage it wraps is.
+type Storage struct {
+	backend.Storage
+	mu       sync.Mutex
+	faults   []*Fault
+	latency  time.Duration
+	writable backend.WritableFile
+	// hits how many operations each kind of fault has hit
+	hits map[Kind]int
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Storage)(nil)
+
+// New wrap s in a Storage with no faults, which behaves exactly like s until faults are injected
+func New(s backend.Storage) *Storage {
+	return &Storage{
+		Storage: s,
+		hits:    map[Kind]int{},
+	}
+}
+
+// Inject add a fault. When more than one fault covers an operation, the one injected first applies.
+func (s *Storage) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// SetLatency delay every read and write by d, e.g. to expose timeouts or races
+func (s *Storage) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Reset remove all faults and the latency, and clear the count of hits
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+	s.latency = 0
+	s.hits = map[Kind]int{}
+}
+
+// Hits how many operations faults of the given kind have hit, to check that a test reached the path it meant to
+func (s *Storage) Hits(k Kind) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[k]
+}
+
+// hit find the fault, if any, that an operation hits, counting it as used, and wait for the latency
+func (s *Storage) hit(read bool, off int64, size int) *Fault {
+	s.mu.Lock()
+	latency := s.latency
+	var found *Fault
+	for i, f := range s.faults {
+		if f.Kind.isRead() != read || !f.overlaps(off, size) {
+			continue
+		}
+		found = f
+		s.hits[f.Kind]++
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		break
+	}
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return found
+}
+
+// before how many of the bytes of an operation at off come before the start of a fault
+func before(f *Fault, off int64, size int) int {
+	return int(max(0, min(f.Offset-off, int64(size))))
+}
+
+// ReadAt read from the wrapped storage, unless a fault says otherwise
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	f := s.hit(true, off, len(p))
+	switch {
+	case f == nil:
+		return s.Storage.ReadAt(p, off)
+	case f.Kind == ShortRead:
+		n, err := s.Storage.ReadAt(p[:before(f, off, len(p))], off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	default:
+		return 0, ErrInjected
+	}
+}
+
+// Read read from the current offset of the wrapped storage, unless a fault says otherwise
+func (s *Storage) Read(p []byte) (int, error) {
+	off, err := s.Storage.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	f := s.hit(true, off, len(p))
+	switch {
+	case f == nil:
+		return s.Storage.Read(p)
+	case f.Kind == ShortRead:
+		if n := before(f, off, len(p)); n > 0 {
+			return s.Storage.Read(p[:n])
+		}
+		return 0, io.EOF
+	default:
+		return 0, ErrInjected
+	}
+}
+
+// Writable get the wrapped storage for writing, with write faults injected into it
+func (s *Storage) Writable() (backend.WritableFile, error) {
+	w, err := s.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.writable = w
+	s.mu.Unlock()
+	return s, nil
+}
+
+// WriteAt write to the wrapped storage, unless a fault says otherwise. The storage must have been
+// opened for writing with Writable first.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	w := s.writable
+	s.mu.Unlock()
+	if w == nil {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	f := s.hit(false, off, len(p))
+	switch {
+	case f == nil:
+		return w.WriteAt(p, off)
+	case f.Kind == TornWrite:
+		n, err := w.WriteAt(p[:before(f, off, len(p))], off)
+		if err == nil {
+			err = ErrInjected
+		}
+		return n, err
+	default:
+		return 0, ErrInjected
+	}
+}
@@ -0,0 +1,129 @@
+package faulty_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/faulty"
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestFaults(t *testing.T) {
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		name     string
+		fault    faulty.Fault
+		write    bool
+		off      int64
+		size     int
+		n        int
+		err      error
+		expected []byte
+	}{
+		{"read outside fault", faulty.Fault{Kind: faulty.ReadError, Offset: 1024, Length: 512}, false, 0, 1024, 1024, nil, data[:1024]},
+		{"read error", faulty.Fault{Kind: faulty.ReadError, Offset: 1024, Length: 512}, false, 512, 1024, 0, syscall.EIO, nil},
+		{"read error to end", faulty.Fault{Kind: faulty.ReadError, Offset: 1024}, false, 3072, 512, 0, syscall.EIO, nil},
+		{"short read", faulty.Fault{Kind: faulty.ShortRead, Offset: 1024, Length: 512}, false, 512, 1024, 512, io.EOF, data[512:1024]},
+		{"write not affected by read fault", faulty.Fault{Kind: faulty.ReadError, Offset: 0}, true, 0, 1024, 1024, nil, make([]byte, 1024)},
+		{"write error", faulty.Fault{Kind: faulty.WriteError, Offset: 1024, Length: 512}, true, 512, 1024, 0, syscall.EIO, data[512:1536]},
+		{"torn write", faulty.Fault{Kind: faulty.TornWrite, Offset: 1024, Length: 512}, true, 512, 1024, 512, syscall.EIO, append(make([]byte, 512), data[1024:1536]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := mem.NewFromBytes(data, false)
+			if err != nil {
+				t.Fatalf("unexpected error creating buffer: %v", err)
+			}
+			s := faulty.New(b)
+			s.Inject(tt.fault)
+			var n int
+			if tt.write {
+				w, err := s.Writable()
+				if err != nil {
+					t.Fatalf("unexpected error getting writable: %v", err)
+				}
+				n, err = w.WriteAt(make([]byte, tt.size), tt.off)
+				if !errors.Is(err, tt.err) {
+					t.Errorf("mismatched error, expected %v got %v", tt.err, err)
+				}
+			} else {
+				p := make([]byte, tt.size)
+				n, err = s.ReadAt(p, tt.off)
+				if !errors.Is(err, tt.err) {
+					t.Errorf("mismatched error, expected %v got %v", tt.err, err)
+				}
+				if !bytes.Equal(p[:n], tt.expected) {
+					t.Errorf("mismatched data read")
+				}
+			}
+			if n != tt.n {
+				t.Errorf("mismatched count, expected %d got %d", tt.n, n)
+			}
+			if tt.write && !bytes.Equal(b.Bytes()[tt.off:int(tt.off)+tt.size], tt.expected) {
+				t.Errorf("mismatched data in storage after write")
+			}
+		})
+	}
+}
+
+func TestFaultCount(t *testing.T) {
+	b, err := mem.New(4096)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	s := faulty.New(b)
+	s.Inject(faulty.Fault{Kind: faulty.ReadError, Offset: 0, Count: 2})
+	s.SetLatency(time.Millisecond)
+	p := make([]byte, 512)
+	start := time.Now()
+	for i, expected := range []error{faulty.ErrInjected, faulty.ErrInjected, nil} {
+		if _, err := s.ReadAt(p, 0); !errors.Is(err, expected) {
+			t.Errorf("read %d: mismatched error, expected %v got %v", i, expected, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("3 reads took %v, less than the latency", elapsed)
+	}
+	if hits := s.Hits(faulty.ReadError); hits != 2 {
+		t.Errorf("mismatched hits, expected 2 got %d", hits)
+	}
+	s.Reset()
+	if hits := s.Hits(faulty.ReadError); hits != 0 {
+		t.Errorf("hits not cleared by reset, got %d", hits)
+	}
+}
+
+// writing a partition table must report a failure to write the secondary GPT header at the end of the disk
+func TestPartitionWriteError(t *testing.T) {
+	const size = 10 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	s := faulty.New(b)
+	s.Inject(faulty.Fault{Kind: faulty.WriteError, Offset: size - 512})
+	d, err := diskfs.OpenBackend(s, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err == nil {
+		t.Errorf("missing expected error writing partition table")
+	}
+	if s.Hits(faulty.WriteError) == 0 {
+		t.Errorf("write of the secondary header was never attempted")
+	}
+}
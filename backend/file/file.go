@@ -11,22 +11,45 @@ import (
 )
 
 type rawBackend struct {
-	storage  fs.File
-	readOnly bool
+	storage       fs.File
+	readOnly      bool
+	zeroBlockSize int64
 }
 
+// Option an option for a file backend, passed to New, OpenFromPath or CreateFromPath
+type Option func(*rawBackend)
+
+// WithWriteZeroes makes writes of whole aligned blocks of blockSize bytes, or of DefaultZeroBlockSize if 0, that
+// are all zeroes punch a hole in the file, as WriteZeroes does, rather than write the zeroes out, so that an image
+// file stays as sparse as it can be.
+func WithWriteZeroes(blockSize int64) Option {
+	return func(f *rawBackend) {
+		if blockSize <= 0 {
+			blockSize = DefaultZeroBlockSize
+		}
+		f.zeroBlockSize = blockSize
+	}
+}
+
+// DefaultZeroBlockSize the size of the blocks that WithWriteZeroes looks for zeroes in, if given 0
+const DefaultZeroBlockSize int64 = 4096
+
 // Create a backend.Storage from provided fs.File
-func New(f fs.File, readOnly bool) backend.Storage {
-	return rawBackend{
+func New(f fs.File, readOnly bool, opts ...Option) backend.Storage {
+	b := rawBackend{
 		storage:  f,
 		readOnly: readOnly,
 	}
+	for _, opt := range opts {
+		opt(&b)
+	}
+	return b
 }
 
 // Create a backend.Storage from a path to a device
 // Should pass a path to a block device e.g. /dev/sda or a path to a file /tmp/foo.img
 // The provided device/file must exist at the time you call OpenFromPath()
-func OpenFromPath(pathName string, readOnly bool) (backend.Storage, error) {
+func OpenFromPath(pathName string, readOnly bool, opts ...Option) (backend.Storage, error) {
 	if pathName == "" {
 		return nil, errors.New("must pass device of file name")
 	}
@@ -46,16 +69,13 @@ func OpenFromPath(pathName string, readOnly bool) (backend.Storage, error) {
 		return nil, fmt.Errorf("could not open device %s with mode %v: %w", pathName, openMode, err)
 	}
 
-	return rawBackend{
-		storage:  f,
-		readOnly: readOnly,
-	}, nil
+	return New(f, readOnly, opts...), nil
 }
 
 // Create a backend.Storage from a path to an image file.
 // Should pass a path to a file /tmp/foo.img
 // The provided file must not exist at the time you call CreateFromPath()
-func CreateFromPath(pathName string, size int64) (backend.Storage, error) {
+func CreateFromPath(pathName string, size int64, opts ...Option) (backend.Storage, error) {
 	if pathName == "" {
 		return nil, errors.New("must pass device name")
 	}
@@ -71,14 +91,16 @@ func CreateFromPath(pathName string, size int64) (backend.Storage, error) {
 		return nil, fmt.Errorf("could not expand device %s to size %d: %w", pathName, size, err)
 	}
 
-	return rawBackend{
-		storage:  f,
-		readOnly: false,
-	}, nil
+	return New(f, false, opts...), nil
 }
 
-// backend.Storage interface guard
-var _ backend.Storage = (*rawBackend)(nil)
+// interface guards
+var (
+	_ backend.Storage            = (*rawBackend)(nil)
+	_ backend.AllocationReporter = (*rawBackend)(nil)
+	_ backend.ZeroWriter         = (*rawBackend)(nil)
+	_ backend.Discarder          = (*rawBackend)(nil)
+)
 
 // OS-specific file for ioctl calls via fd
 func (f rawBackend) Sys() (*os.File, error) {
@@ -92,6 +114,9 @@ func (f rawBackend) Sys() (*os.File, error) {
 func (f rawBackend) Writable() (backend.WritableFile, error) {
 	if rwFile, ok := f.storage.(backend.WritableFile); ok {
 		if !f.readOnly {
+			if f.zeroBlockSize > 0 {
+				return zeroingFile{WritableFile: rwFile, raw: f}, nil
+			}
 			return rwFile, nil
 		}
 
@@ -125,3 +150,146 @@ func (f rawBackend) Seek(offset int64, whence int) (int64, error) {
 	}
 	return -1, backend.ErrNotSuitable
 }
+
+// Allocated reports whether any of the length bytes at off may hold data, which is those that are not in a hole
+// of a sparse file. Where holes cannot be found, such as for block devices, everything may hold data.
+func (f rawBackend) Allocated(off, length int64) (bool, error) {
+	osFile, ok := f.storage.(*os.File)
+	if !ok {
+		return true, nil
+	}
+	return allocated(osFile, off, length)
+}
+
+// WriteZeroes make the length bytes at off read as zeroes, by punching a hole in the file where it can, or by
+// writing zeroes otherwise. A file that ends before off+length is extended.
+func (f rawBackend) WriteZeroes(off, length int64) error {
+	if f.readOnly {
+		return backend.ErrIncorrectOpenMode
+	}
+	rwFile, ok := f.storage.(backend.WritableFile)
+	if !ok {
+		return backend.ErrNotSuitable
+	}
+	if osFile, ok := f.storage.(*os.File); ok {
+		info, err := osFile.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			// what is past the end of the file is a hole once the file is extended over it
+			if end := off + length; end > info.Size() {
+				if err := osFile.Truncate(end); err != nil {
+					return fmt.Errorf("could not extend file to %d: %w", end, err)
+				}
+				length = max(info.Size()-off, 0)
+			}
+		}
+		if length == 0 {
+			return nil
+		}
+		err = punchHole(osFile, off, length)
+		if err == nil || !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	zeroes := make([]byte, min(length, maxZeroWrite))
+	for written := int64(0); written < length; {
+		n := min(length-written, int64(len(zeroes)))
+		if _, err := rwFile.WriteAt(zeroes[:n], off+written); err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+// Discard tell the file or device that the length bytes at off are no longer used, by punching a hole in a file,
+// or by discarding them from a block device, as BLKDISCARD does on Linux, for the whole logical sectors of the
+// range. Where neither can be done, it returns an error wrapping errors.ErrUnsupported.
+func (f rawBackend) Discard(off, length int64) error {
+	if f.readOnly {
+		return backend.ErrIncorrectOpenMode
+	}
+	osFile, ok := f.storage.(*os.File)
+	if !ok {
+		return fmt.Errorf("cannot discard from %T: %w", f.storage, errors.ErrUnsupported)
+	}
+	info, err := osFile.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.Mode().IsRegular():
+		// what is past the end of the file is not there to discard
+		length = min(length, info.Size()-off)
+		if length <= 0 {
+			return nil
+		}
+		return punchHole(osFile, off, length)
+	case info.Mode()&os.ModeDevice != 0:
+		return discardDevice(osFile, off, length)
+	default:
+		return fmt.Errorf("cannot discard from %s: %w", info.Name(), errors.ErrUnsupported)
+	}
+}
+
+// maxZeroWrite the most zeroes WriteZeroes writes at once where it cannot punch a hole
+const maxZeroWrite int64 = 1024 * 1024
+
+// zeroingFile the file of a backend made WithWriteZeroes, whose writes of blocks of zeroes punch holes
+type zeroingFile struct {
+	backend.WritableFile
+	raw rawBackend
+}
+
+// WriteAt write p at off, punching holes for the whole blocks of it that are zeroes rather than writing them
+func (z zeroingFile) WriteAt(p []byte, off int64) (int, error) {
+	blockSize := z.raw.zeroBlockSize
+	var written int
+	// runs of data are written together, as are runs of blocks of zeroes
+	flush := func(end int, zero bool) error {
+		if end == written {
+			return nil
+		}
+		var err error
+		if zero {
+			err = z.raw.WriteZeroes(off+int64(written), int64(end-written))
+		} else {
+			_, err = z.WritableFile.WriteAt(p[written:end], off+int64(written))
+		}
+		if err != nil {
+			return err
+		}
+		written = end
+		return nil
+	}
+	runZero := false
+	for pos := 0; pos < len(p); {
+		// the part of a block at either end of p, which is not a whole block, is written as it is
+		next := ((off+int64(pos))/blockSize + 1) * blockSize
+		end := min(int(next-off), len(p))
+		zero := (off+int64(pos))%blockSize == 0 && int64(end-pos) == blockSize && isZero(p[pos:end])
+		if zero != runZero {
+			if err := flush(pos, runZero); err != nil {
+				return written, err
+			}
+			runZero = zero
+		}
+		pos = end
+	}
+	if err := flush(len(p), runZero); err != nil {
+		return written, err
+	}
+	return written, nil
+}
+
+// isZero whether b is all zeroes
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package file_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+const blockSize = 64 * 1024
+
+// holesSupported whether the filesystem of dir reports the holes of sparse files
+func holesSupported(t *testing.T, dir string) bool {
+	t.Helper()
+	b, err := file.CreateFromPath(filepath.Join(dir, "probe.img"), 4*blockSize)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	defer b.Close()
+	allocated, err := b.(backend.AllocationReporter).Allocated(0, 4*blockSize)
+	if err != nil {
+		t.Fatalf("error getting allocation: %v", err)
+	}
+	return !allocated
+}
+
+func TestWriteZeroes(t *testing.T) {
+	dir := t.TempDir()
+	holes := holesSupported(t, dir)
+	b, err := file.CreateFromPath(filepath.Join(dir, "disk.img"), 8*blockSize)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	defer b.Close()
+	w, err := b.Writable()
+	if err != nil {
+		t.Fatalf("error getting writable file: %v", err)
+	}
+	data := bytes.Repeat([]byte{0xaa}, 4*blockSize)
+	if _, err := w.WriteAt(data, 2*blockSize); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	zw := b.(backend.ZeroWriter)
+	if err := zw.WriteZeroes(3*blockSize, 2*blockSize); err != nil {
+		t.Fatalf("error writing zeroes: %v", err)
+	}
+	// past the end of the file, which extends it
+	if err := zw.WriteZeroes(7*blockSize, 3*blockSize); err != nil {
+		t.Fatalf("error writing zeroes past the end: %v", err)
+	}
+	info, err := b.Stat()
+	if err != nil {
+		t.Fatalf("error getting file info: %v", err)
+	}
+	if info.Size() != 10*blockSize {
+		t.Errorf("file size %d instead of %d", info.Size(), 10*blockSize)
+	}
+	expected := make([]byte, 10*blockSize)
+	copy(expected[2*blockSize:], data[:blockSize])
+	copy(expected[5*blockSize:], data[:blockSize])
+	actual := make([]byte, len(expected))
+	if _, err := b.ReadAt(actual, 0); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("zeroes were not written")
+	}
+
+	if !holes {
+		t.Skip("filesystem does not report holes")
+	}
+	allocation := b.(backend.AllocationReporter)
+	for _, tt := range []struct {
+		offset, length int64
+		allocated      bool
+	}{
+		{0, 2 * blockSize, false},
+		{0, 3 * blockSize, true},
+		{3 * blockSize, 2 * blockSize, false},
+		{4 * blockSize, 2 * blockSize, true},
+		{6 * blockSize, 4 * blockSize, false},
+		{20 * blockSize, blockSize, false},
+	} {
+		allocated, err := allocation.Allocated(tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("error getting allocation: %v", err)
+		}
+		if allocated != tt.allocated {
+			t.Errorf("%d bytes at %d allocated %v instead of %v", tt.length, tt.offset, allocated, tt.allocated)
+		}
+	}
+}
+
+func TestWithWriteZeroes(t *testing.T) {
+	dir := t.TempDir()
+	holes := holesSupported(t, dir)
+	p := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(p, bytes.Repeat([]byte{0xaa}, 8*blockSize), 0o600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	b, err := file.OpenFromPath(p, false, file.WithWriteZeroes(blockSize))
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer b.Close()
+	w, err := b.Writable()
+	if err != nil {
+		t.Fatalf("error getting writable file: %v", err)
+	}
+	// zeroes that cover the second and third blocks whole, and parts of the first and fourth
+	data := make([]byte, 3*blockSize)
+	data[0] = 1
+	n, err := w.WriteAt(data, blockSize-100)
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("wrote %d bytes instead of %d", n, len(data))
+	}
+	expected := bytes.Repeat([]byte{0xaa}, 8*blockSize)
+	copy(expected[blockSize-100:], data)
+	actual := make([]byte, len(expected))
+	if _, err := b.ReadAt(actual, 0); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("read data did not match written data")
+	}
+
+	if !holes {
+		t.Skip("filesystem does not report holes")
+	}
+	allocation := b.(backend.AllocationReporter)
+	for _, tt := range []struct {
+		offset, length int64
+		allocated      bool
+	}{
+		{0, blockSize, true},
+		{blockSize, 2 * blockSize, false},
+		{3 * blockSize, blockSize, true},
+	} {
+		allocated, err := allocation.Allocated(tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("error getting allocation: %v", err)
+		}
+		if allocated != tt.allocated {
+			t.Errorf("%d bytes at %d allocated %v instead of %v", tt.length, tt.offset, allocated, tt.allocated)
+		}
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	dir := t.TempDir()
+	holes := holesSupported(t, dir)
+	p := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(p, bytes.Repeat([]byte{0xaa}, 4*blockSize), 0o600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	b, err := file.OpenFromPath(p, false)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer b.Close()
+	discarder := b.(backend.Discarder)
+	// past the end of the file is left alone
+	if err := discarder.Discard(blockSize, 5*blockSize); err != nil {
+		t.Fatalf("error discarding: %v", err)
+	}
+	info, err := b.Stat()
+	if err != nil {
+		t.Fatalf("error getting file info: %v", err)
+	}
+	if info.Size() != 4*blockSize {
+		t.Errorf("file size %d instead of %d", info.Size(), 4*blockSize)
+	}
+
+	readOnly, err := file.OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer readOnly.Close()
+	if err := readOnly.(backend.Discarder).Discard(0, blockSize); !errors.Is(err, backend.ErrIncorrectOpenMode) {
+		t.Errorf("discard from read-only file returned %v instead of %v", err, backend.ErrIncorrectOpenMode)
+	}
+
+	if !holes {
+		t.Skip("filesystem does not report holes")
+	}
+	allocation := b.(backend.AllocationReporter)
+	for _, tt := range []struct {
+		offset, length int64
+		allocated      bool
+	}{
+		{0, blockSize, true},
+		{blockSize, 3 * blockSize, false},
+	} {
+		allocated, err := allocation.Allocated(tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("error getting allocation: %v", err)
+		}
+		if allocated != tt.allocated {
+			t.Errorf("%d bytes at %d allocated %v instead of %v", tt.length, tt.offset, allocated, tt.allocated)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocated whether any of the length bytes at off are not in a hole, by seeking to the next data
+func allocated(f *os.File, off, length int64) (bool, error) {
+	// seeking moves the offset that Read uses, so it is put back
+	current, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	data, err := unix.Seek(int(f.Fd()), off, unix.SEEK_DATA)
+	if _, seekErr := f.Seek(current, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	switch {
+	case errors.Is(err, unix.ENXIO):
+		// there is no data after off
+		return false, nil
+	case errors.Is(err, unix.EINVAL), errors.Is(err, unix.EOPNOTSUPP):
+		// holes cannot be found, so everything may be data
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return data < off+length, nil
+}
+
+// punchHole deallocate the length bytes at off, keeping the size of the file
+func punchHole(f *os.File, off, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.ENODEV) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
+
+// discardDevice discard the whole logical sectors within the length bytes at off of a block device
+func discardDevice(f *os.File, off, length int64) error {
+	fd := int(f.Fd())
+	sectorSize, err := unix.IoctlGetInt(fd, unix.BLKSSZGET)
+	if err != nil {
+		return fmt.Errorf("could not get logical sector size: %w", err)
+	}
+	size := int64(sectorSize)
+	start := (off + size - 1) / size * size
+	end := (off + length) / size * size
+	if end <= start {
+		return nil
+	}
+	r := [2]uint64{uint64(start), uint64(end - start)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		if errno == unix.EOPNOTSUPP {
+			return errors.ErrUnsupported
+		}
+		return errno
+	}
+	return nil
+}
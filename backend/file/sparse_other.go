@@ -0,0 +1,23 @@
+//go:build !linux && !windows
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+// allocated holes cannot be found, so everything may be data
+func allocated(_ *os.File, _, _ int64) (bool, error) {
+	return true, nil
+}
+
+// punchHole holes cannot be punched, so zeroes have to be written
+func punchHole(_ *os.File, _, _ int64) error {
+	return errors.ErrUnsupported
+}
+
+// discardDevice block devices cannot be discarded from
+func discardDevice(_ *os.File, _, _ int64) error {
+	return errors.ErrUnsupported
+}
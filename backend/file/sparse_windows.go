@@ -0,0 +1,62 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileAllocatedRangeBuffer a FILE_ALLOCATED_RANGE_BUFFER
+type fileAllocatedRangeBuffer struct {
+	FileOffset int64
+	Length     int64
+}
+
+// fileZeroDataInformation a FILE_ZERO_DATA_INFORMATION
+type fileZeroDataInformation struct {
+	FileOffset      int64
+	BeyondFinalZero int64
+}
+
+// allocated whether any of the length bytes at off are not in a hole, by querying the allocated ranges
+func allocated(f *os.File, off, length int64) (bool, error) {
+	in := fileAllocatedRangeBuffer{FileOffset: off, Length: length}
+	var out [1]fileAllocatedRangeBuffer
+	var returned uint32
+	err := windows.DeviceIoControl(windows.Handle(f.Fd()), windows.FSCTL_QUERY_ALLOCATED_RANGES,
+		(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)),
+		(*byte)(unsafe.Pointer(&out[0])), uint32(unsafe.Sizeof(out)), &returned, nil)
+	switch {
+	case errors.Is(err, windows.ERROR_MORE_DATA):
+		return true, nil
+	case errors.Is(err, windows.ERROR_INVALID_FUNCTION), errors.Is(err, windows.ERROR_INVALID_PARAMETER):
+		// holes cannot be found, so everything may be data
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return returned > 0, nil
+}
+
+// punchHole deallocate the length bytes at off, marking the file sparse first so that they are deallocated
+// rather than zeroed
+func punchHole(f *os.File, off, length int64) error {
+	var returned uint32
+	h := windows.Handle(f.Fd())
+	if err := windows.DeviceIoControl(h, windows.FSCTL_SET_SPARSE, nil, 0, nil, 0, &returned, nil); err != nil {
+		if errors.Is(err, windows.ERROR_INVALID_FUNCTION) {
+			return errors.ErrUnsupported
+		}
+		return err
+	}
+	in := fileZeroDataInformation{FileOffset: off, BeyondFinalZero: off + length}
+	return windows.DeviceIoControl(h, windows.FSCTL_SET_ZERO_DATA,
+		(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)), nil, 0, &returned, nil)
+}
+
+// discardDevice block devices cannot be discarded from
+func discardDevice(_ *os.File, _, _ int64) error {
+	return errors.ErrUnsupported
+}
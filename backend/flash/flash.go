@@ -0,0 +1,289 @@
+// Package flash provides a backend.Storage for writing to SD cards, USB sticks and other flash media, which
+// wraps another one and turns the writes to it into whole erase blocks, aligned to them, where it can.
+//
+// Flash media erase in blocks of several MiB, and a write of less than one, or one that straddles two, makes
+// the card read, erase and rewrite the whole of each block it touches. Writing an image in the small, unaligned
+// pieces that partition tables and filesystems are made of is then both slow and wears the card. Storage
+// buffers a partial erase block until it is complete, or until something else is written, and writes whole
+// blocks as they are:
+//
+//	s := flash.New(b, 0)
+//	d, err := diskfs.OpenBackend(s)
+//	...
+//	// write partitions and filesystems to d as with any other disk, then
+//	err = s.Close()
+//
+// Anything still buffered is written by Flush, and by Close, which must be called for the last block to reach
+// the card. A block that is flushed before it is complete is filled in with what the storage already holds.
+package flash
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// DefaultEraseBlockSize the erase block size New uses if given 0, of 4 MiB, which is that of most SD cards
+// and a multiple of that of the rest
+const DefaultEraseBlockSize int64 = 4 * 1024 * 1024
+
+// Stats what has been written through a Storage to the storage it wraps
+type Stats struct {
+	// Writes how many writes have been made to the storage
+	Writes int64
+	// BytesWritten how many bytes the writes wrote
+	BytesWritten int64
+	// PartialBlocks how many erase blocks were flushed before they were complete, so were filled in from
+	// the storage
+	PartialBlocks int64
+}
+
+// Storage is a backend.Storage that buffers writes to the storage it wraps into whole erase blocks.
+// It is safe for concurrent use, so long as the storage it wraps is.
+type Storage struct {
+	backend.Storage
+	eraseBlockSize int64
+	mu             sync.Mutex
+	writable       backend.WritableFile
+	// block the offset of the erase block that is buffered, or -1 if none is
+	block int64
+	// buffer the contents of the buffered block, and written the ranges of it that have been written,
+	// sorted and not overlapping
+	buffer  []byte
+	written [][2]int64
+	stats   Stats
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Storage)(nil)
+
+// New wrap s in a Storage that writes to it in erase blocks of eraseBlockSize bytes, or of
+// DefaultEraseBlockSize if it is 0
+func New(s backend.Storage, eraseBlockSize int64) *Storage {
+	if eraseBlockSize <= 0 {
+		eraseBlockSize = DefaultEraseBlockSize
+	}
+	return &Storage{
+		Storage:        s,
+		eraseBlockSize: eraseBlockSize,
+		block:          -1,
+	}
+}
+
+// EraseBlockSize the size of the erase blocks that writes are buffered into
+func (s *Storage) EraseBlockSize() int64 {
+	return s.eraseBlockSize
+}
+
+// Stats what has been written to the wrapped storage so far
+func (s *Storage) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Writable get the wrapped storage for writing, with writes to it buffered into erase blocks
+func (s *Storage) Writable() (backend.WritableFile, error) {
+	w, err := s.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.writable = w
+	s.mu.Unlock()
+	return s, nil
+}
+
+// WriteAt write to the wrapped storage: erase blocks that p covers whole are written at once, and the
+// parts of blocks at either end of it are buffered until they are complete or another block is written.
+// The storage must have been opened for writing with Writable first.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writable == nil {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("cannot write at negative offset %d", off)
+	}
+	end := off + int64(len(p))
+	// the whole blocks that p covers, if any
+	first := (off + s.eraseBlockSize - 1) / s.eraseBlockSize * s.eraseBlockSize
+	last := end / s.eraseBlockSize * s.eraseBlockSize
+	if first >= last {
+		first, last = end, end
+	}
+	n := 0
+	// the part of a block before the whole ones, or all of p if there are none
+	for n < int(first-off) {
+		written, err := s.buffered(p[n:first-off], off+int64(n))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	if first < last {
+		if s.block >= first && s.block < last {
+			// overwritten entirely, so nothing to keep
+			s.reset()
+		}
+		written, err := s.write(p[n:last-off], first)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	// the part of a block after them
+	for n < len(p) {
+		written, err := s.buffered(p[n:], off+int64(n))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// buffered copy as much of p as fits in the erase block of off into the buffer, flushing another block
+// that is buffered first, and the block itself once it is complete
+func (s *Storage) buffered(p []byte, off int64) (int, error) {
+	block := off / s.eraseBlockSize * s.eraseBlockSize
+	if block != s.block {
+		if err := s.flush(); err != nil {
+			return 0, err
+		}
+		if s.buffer == nil {
+			s.buffer = make([]byte, s.eraseBlockSize)
+		}
+		s.block = block
+	}
+	start := off - block
+	n := copy(s.buffer[start:], p)
+	s.cover(start, start+int64(n))
+	if len(s.written) == 1 && s.written[0] == [2]int64{0, s.eraseBlockSize} {
+		if err := s.flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// cover record that the bytes of the buffer from start to end have been written
+func (s *Storage) cover(start, end int64) {
+	s.written = append(s.written, [2]int64{start, end})
+	sort.Slice(s.written, func(i, j int) bool {
+		return s.written[i][0] < s.written[j][0]
+	})
+	merged := s.written[:1]
+	for _, r := range s.written[1:] {
+		if prev := &merged[len(merged)-1]; r[0] <= prev[1] {
+			prev[1] = max(prev[1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	s.written = merged
+}
+
+// reset forget the buffered block
+func (s *Storage) reset() {
+	s.block = -1
+	s.written = s.written[:0]
+}
+
+// write write p at off of the wrapped storage
+func (s *Storage) write(p []byte, off int64) (int, error) {
+	n, err := s.writable.WriteAt(p, off)
+	s.stats.Writes++
+	s.stats.BytesWritten += int64(n)
+	return n, err
+}
+
+// flush write the buffered block, if there is one. It is written from its start to the end of what has
+// been written of it, with any gaps before then filled in from the wrapped storage, so that it is a single
+// aligned write; it does not go past the end of what has been written, so as not to grow a file.
+func (s *Storage) flush() error {
+	if s.block < 0 || len(s.written) == 0 {
+		s.reset()
+		return nil
+	}
+	end := s.written[len(s.written)-1][1]
+	if len(s.written) > 1 || s.written[0][0] != 0 || end != s.eraseBlockSize {
+		s.stats.PartialBlocks++
+		gap := int64(0)
+		for _, r := range s.written {
+			if err := s.fill(gap, r[0]); err != nil {
+				return err
+			}
+			gap = r[1]
+		}
+	}
+	if _, err := s.write(s.buffer[:end], s.block); err != nil {
+		return fmt.Errorf("could not write erase block at %d: %w", s.block, err)
+	}
+	s.reset()
+	return nil
+}
+
+// fill read the bytes of the buffer from start to end from the wrapped storage; past its end, they are zeros
+func (s *Storage) fill(start, end int64) error {
+	if start >= end {
+		return nil
+	}
+	b := s.buffer[start:end]
+	n, err := s.Storage.ReadAt(b, s.block+start)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read erase block at %d to fill it in: %w", s.block, err)
+	}
+	clear(b[n:])
+	return nil
+}
+
+// Flush write the buffered erase block, if there is one, to the wrapped storage
+func (s *Storage) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// ReadAt read from the wrapped storage, flushing the buffered erase block first if the read overlaps it,
+// so that what is read is what has been written
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	if s.block >= 0 && off < s.block+s.eraseBlockSize && off+int64(len(p)) > s.block {
+		if err := s.flush(); err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+	}
+	s.mu.Unlock()
+	return s.Storage.ReadAt(p, off)
+}
+
+// Read read from the current offset of the wrapped storage, as ReadAt does
+func (s *Storage) Read(p []byte) (int, error) {
+	off, err := s.Storage.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.ReadAt(p, off)
+	if _, seekErr := s.Storage.Seek(off+int64(n), io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	// reading less than asked for at the end is io.EOF for ReadAt, but not for Read
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close flush the buffered erase block, then close the wrapped storage
+func (s *Storage) Close() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.Storage.Close()
+}
@@ -0,0 +1,193 @@
+package flash_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/flash"
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// recorder a backend.Storage that records the writes made to it
+type recorder struct {
+	backend.Storage
+	writable backend.WritableFile
+	writes   [][2]int64
+}
+
+func (r *recorder) Writable() (backend.WritableFile, error) {
+	w, err := r.Storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	r.writable = w
+	return r, nil
+}
+
+func (r *recorder) WriteAt(p []byte, off int64) (int, error) {
+	r.writes = append(r.writes, [2]int64{off, int64(len(p))})
+	return r.writable.WriteAt(p, off)
+}
+
+func TestWriteAt(t *testing.T) {
+	const (
+		eraseBlockSize = 4096
+		size           = 16 * eraseBlockSize
+	)
+	initial := make([]byte, size)
+	for i := range initial {
+		initial[i] = byte(i % 251)
+	}
+	tests := []struct {
+		name string
+		// writes the offsets and lengths of the writes to make
+		writes [][2]int64
+		// expected the offsets and lengths of the writes to reach the storage underneath
+		expected [][2]int64
+		partial  int64
+	}{
+		{"whole block", [][2]int64{{eraseBlockSize, eraseBlockSize}}, [][2]int64{{eraseBlockSize, eraseBlockSize}}, 0},
+		{"whole blocks", [][2]int64{{0, 3 * eraseBlockSize}}, [][2]int64{{0, 3 * eraseBlockSize}}, 0},
+		{"block in pieces", [][2]int64{{0, 512}, {512, 1000}, {1512, eraseBlockSize - 1512}}, [][2]int64{{0, eraseBlockSize}}, 0},
+		{"block in pieces out of order", [][2]int64{{2048, 2048}, {0, 2048}}, [][2]int64{{0, eraseBlockSize}}, 0},
+		{"unaligned run", [][2]int64{{100, 3 * eraseBlockSize}}, [][2]int64{{eraseBlockSize, 2 * eraseBlockSize}, {0, eraseBlockSize}, {3 * eraseBlockSize, 100}}, 2},
+		{"straddling", [][2]int64{{eraseBlockSize - 10, 20}}, [][2]int64{{0, eraseBlockSize}, {eraseBlockSize, 10}}, 2},
+		{"partial block", [][2]int64{{512, 512}, {2048, 100}}, [][2]int64{{0, 2148}}, 1},
+		{"sequential", [][2]int64{{0, 1000}, {1000, 5000}, {6000, 3000}, {9000, 3288}}, [][2]int64{{0, eraseBlockSize}, {eraseBlockSize, eraseBlockSize}, {2 * eraseBlockSize, eraseBlockSize}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := mem.NewFromBytes(bytes.Clone(initial), false)
+			if err != nil {
+				t.Fatalf("unexpected error creating buffer: %v", err)
+			}
+			r := &recorder{Storage: b}
+			s := flash.New(r, eraseBlockSize)
+			w, err := s.Writable()
+			if err != nil {
+				t.Fatalf("unexpected error getting writable: %v", err)
+			}
+			expected := bytes.Clone(initial)
+			rng := rand.New(rand.NewSource(1))
+			for _, write := range tt.writes {
+				p := make([]byte, write[1])
+				_, _ = rng.Read(p)
+				copy(expected[write[0]:], p)
+				if n, err := w.WriteAt(p, write[0]); err != nil || n != len(p) {
+					t.Fatalf("wrote %d of %d bytes, error %v", n, len(p), err)
+				}
+			}
+			// what is buffered is read back as written
+			got := make([]byte, size)
+			if _, err := s.ReadAt(got, 0); err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("read back different data from what was written")
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("unexpected error flushing: %v", err)
+			}
+			if !bytes.Equal(b.Bytes(), expected) {
+				t.Errorf("storage has different data from what was written")
+			}
+			if len(r.writes) != len(tt.expected) {
+				t.Fatalf("writes %v, expected %v", r.writes, tt.expected)
+			}
+			for i := range r.writes {
+				if r.writes[i] != tt.expected[i] {
+					t.Errorf("writes %v, expected %v", r.writes, tt.expected)
+					break
+				}
+			}
+			if stats := s.Stats(); stats.Writes != int64(len(tt.expected)) || stats.PartialBlocks != tt.partial {
+				t.Errorf("stats %+v, expected %d writes and %d partial blocks", stats, len(tt.expected), tt.partial)
+			}
+		})
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	b, err := mem.New(4096)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	s := flash.New(b, 0)
+	if s.EraseBlockSize() != flash.DefaultEraseBlockSize {
+		t.Errorf("erase block size %d, expected %d", s.EraseBlockSize(), flash.DefaultEraseBlockSize)
+	}
+	if _, err := s.WriteAt([]byte{1}, 0); err != backend.ErrIncorrectOpenMode {
+		t.Errorf("writing without Writable gave %v, expected %v", err, backend.ErrIncorrectOpenMode)
+	}
+}
+
+// a disk made through the Storage reads back the same from the storage underneath, once flushed
+func TestDisk(t *testing.T) {
+	const size = 32 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	s := flash.New(b, 1024*1024)
+	d, err := diskfs.OpenBackend(s, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatalf("unexpected error opening disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 2048 + 40960 - 1, Type: gpt.MicrosoftBasicData, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("unexpected error partitioning: %v", err)
+	}
+	fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "FLASH"})
+	if err != nil {
+		t.Fatalf("unexpected error creating filesystem: %v", err)
+	}
+	f, err := fs.OpenFile("/DATA.BIN", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("unexpected error creating file: %v", err)
+	}
+	data := bytes.Repeat([]byte("flash "), 100000)
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+	// read back before it is flushed
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error seeking: %v", err)
+	}
+	if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes that are not the %d written, error %v", len(got), len(data), err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if stats := s.Stats(); stats.Writes == 0 || stats.PartialBlocks > stats.Writes {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	d, err = diskfs.OpenBackend(b)
+	if err != nil {
+		t.Fatalf("unexpected error opening disk: %v", err)
+	}
+	fs, err = d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("unexpected error reading filesystem: %v", err)
+	}
+	f, err = fs.OpenFile("/DATA.BIN", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unexpected error opening file: %v", err)
+	}
+	if got, err := io.ReadAll(f); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes from the storage that are not the %d written, error %v", len(got), len(data), err)
+	}
+}
@@ -31,3 +31,26 @@ type Storage interface {
 	// file for read-write operations
 	Writable() (WritableFile, error)
 }
+
+// AllocationReporter is implemented by storage that knows which parts of it hold no data, such as a sparse file
+// or an image format, so that copying it can skip them without reading them
+type AllocationReporter interface {
+	// Allocated reports whether any of the length bytes at off may hold data. If not, they all read as zeroes.
+	Allocated(off, length int64) (bool, error)
+}
+
+// ZeroWriter is implemented by writable storage that can make a range read as zeroes without writing them out,
+// such as by punching a hole in a sparse file
+type ZeroWriter interface {
+	// WriteZeroes make the length bytes at off read as zeroes
+	WriteZeroes(off, length int64) error
+}
+
+// Discarder is implemented by writable storage that can be told that a range no longer holds anything that is
+// needed, so that what is beneath it can free the space, as TRIM does for an SSD or a thin provisioned volume.
+// What the range reads as afterwards is not defined; use ZeroWriter for a range that must read as zeroes.
+type Discarder interface {
+	// Discard tell the storage that the length bytes at off are no longer used. It returns an error wrapping
+	// errors.ErrUnsupported if the storage cannot discard them.
+	Discard(off, length int64) error
+}
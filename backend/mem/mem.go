@@ -0,0 +1,265 @@
+// Package mem provides a backend.Storage implementation held entirely in memory, for tests and for building
+// images that are streamed somewhere else, such as a small EFI partition served over HTTP, without a temporary file.
+//
+// Memory is allocated in pages as they are written, so a large image that is mostly empty takes little
+// memory. Pages that were never written read as zeroes.
+package mem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// PageSize is the unit in which memory is allocated
+const PageSize int64 = 64 * 1024
+
+// Buffer is an in-memory disk image. It implements backend.Storage, so it can be passed to
+// diskfs.OpenBackend. Closing it does not release the contents, which can still be read with Reader.
+type Buffer struct {
+	mu       sync.Mutex
+	size     int64
+	pages    map[int64][]byte
+	offset   int64 // for Read and Seek
+	readOnly bool
+	modTime  time.Time
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Buffer)(nil)
+
+// New create an empty, writable Buffer of the given size
+func New(size int64) (*Buffer, error) {
+	if size <= 0 {
+		return nil, errors.New("must pass valid device size to create")
+	}
+	return &Buffer{
+		size:    size,
+		pages:   map[int64][]byte{},
+		modTime: time.Now(),
+	}, nil
+}
+
+// NewFromBytes create a Buffer holding a copy of b, e.g. an existing image to inspect or modify
+func NewFromBytes(b []byte, readOnly bool) (*Buffer, error) {
+	buf, err := New(int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := buf.WriteAt(b, 0); err != nil {
+		return nil, err
+	}
+	buf.readOnly = readOnly
+	return buf, nil
+}
+
+// OS-specific file for ioctl calls via fd
+func (b *Buffer) Sys() (*os.File, error) {
+	return nil, backend.ErrNotSuitable
+}
+
+// file for read-write operations
+func (b *Buffer) Writable() (backend.WritableFile, error) {
+	if b.readOnly {
+		return nil, backend.ErrIncorrectOpenMode
+	}
+	return b, nil
+}
+
+// Stat returns the size of the buffer, as if it were a regular file
+func (b *Buffer) Stat() (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bufferInfo{size: b.size, modTime: b.modTime}, nil
+}
+
+// Size the current size of the buffer
+func (b *Buffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Allocated how many bytes of memory are used for the contents, which is less than Size when
+// parts of the buffer were never written
+func (b *Buffer) Allocated() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.pages)) * PageSize
+}
+
+// Truncate change the size of the buffer. Anything beyond a smaller size is discarded, and a larger
+// size reads as zeroes.
+func (b *Buffer) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("cannot truncate to negative size %d", size)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.readOnly {
+		return backend.ErrIncorrectOpenMode
+	}
+	for index, page := range b.pages {
+		start := index * PageSize
+		switch {
+		case start >= size:
+			delete(b.pages, index)
+		case start+PageSize > size:
+			// clear the tail, so that growing again reads zeroes
+			clear(page[size-start:])
+		}
+	}
+	b.size = size
+	b.modTime = time.Now()
+	return nil
+}
+
+// Reader returns the contents of the buffer, up to its current size, as an io.Reader, e.g. to stream
+// a finished image. It does not copy the contents, so should not be used while still writing.
+func (b *Buffer) Reader() io.Reader {
+	return io.NewSectionReader(b, 0, b.Size())
+}
+
+// Bytes returns a copy of the whole contents of the buffer
+func (b *Buffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p := make([]byte, b.size)
+	_, _ = b.readAt(p, 0)
+	return p
+}
+
+func (b *Buffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n, err := b.readAt(p, b.offset)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *Buffer) Seek(offset int64, whence int) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+// Close does nothing, the contents remain available
+func (b *Buffer) Close() error {
+	return nil
+}
+
+func (b *Buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("cannot read at negative offset %d", off)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.readAt(p, off)
+}
+
+// readAt read from the pages, with the lock held
+func (b *Buffer) readAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	for pos := off; pos < end; {
+		index := pos / PageSize
+		from := pos - index*PageSize
+		to := min(end-index*PageSize, PageSize)
+		dst := p[pos-off : pos-off+to-from]
+		if page, ok := b.pages[index]; ok {
+			copy(dst, page[from:to])
+		} else {
+			clear(dst)
+		}
+		pos += to - from
+	}
+	n := int(end - off)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the buffer, allocating pages as needed. Writing zeroes to a page that was never
+// written does not allocate it. Writes cannot go beyond the size of the buffer; use Truncate to grow it.
+func (b *Buffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("cannot write at negative offset %d", off)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.readOnly {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	if off+int64(len(p)) > b.size {
+		return 0, fmt.Errorf("cannot write %d bytes at offset %d beyond end of buffer of size %d", len(p), off, b.size)
+	}
+	end := off + int64(len(p))
+	for pos := off; pos < end; {
+		index := pos / PageSize
+		from := pos - index*PageSize
+		to := min(end-index*PageSize, PageSize)
+		src := p[pos-off : pos-off+to-from]
+		page, ok := b.pages[index]
+		if !ok {
+			if isZero(src) {
+				pos += to - from
+				continue
+			}
+			page = make([]byte, PageSize)
+			b.pages[index] = page
+		}
+		copy(page[from:to], src)
+		pos += to - from
+	}
+	b.modTime = time.Now()
+	return len(p), nil
+}
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), len(zeroes))
+		if !bytes.Equal(b[:n], zeroes[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+var zeroes = make([]byte, 4096)
+
+// bufferInfo implements fs.FileInfo for the buffer
+type bufferInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (i bufferInfo) Name() string       { return "memory" }
+func (i bufferInfo) Size() int64        { return i.size }
+func (i bufferInfo) Mode() fs.FileMode  { return 0o644 }
+func (i bufferInfo) ModTime() time.Time { return i.modTime }
+func (i bufferInfo) IsDir() bool        { return false }
+func (i bufferInfo) Sys() interface{}   { return nil }
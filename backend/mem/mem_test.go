@@ -0,0 +1,161 @@
+package mem_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestReadWrite(t *testing.T) {
+	const size = 1024 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	if _, err := mem.New(0); err == nil {
+		t.Errorf("zero size buffer did not return an error")
+	}
+
+	// a write across a page boundary allocates both pages
+	data := make([]byte, 1000)
+	_, _ = rand.Read(data)
+	off := 3*mem.PageSize - 500
+	if _, err := b.WriteAt(data, off); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	// zeroes do not allocate anything
+	if _, err := b.WriteAt(make([]byte, 10*mem.PageSize), 100*mem.PageSize); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if allocated := b.Allocated(); allocated != 2*mem.PageSize {
+		t.Errorf("allocated %d bytes instead of %d", allocated, 2*mem.PageSize)
+	}
+	read := make([]byte, 2000)
+	if _, err := b.ReadAt(read, off-500); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	expected := append(append(make([]byte, 500), data...), make([]byte, 500)...)
+	if !bytes.Equal(read, expected) {
+		t.Errorf("mismatched data read")
+	}
+	if _, err := b.WriteAt(data, size-10); err == nil {
+		t.Errorf("write beyond the end did not return an error")
+	}
+	n, err := b.ReadAt(read, size-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("mismatched read at end, %d bytes with error %v", n, err)
+	}
+
+	// Read and Seek
+	if _, err := b.Seek(off, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error seeking: %v", err)
+	}
+	if _, err := io.ReadFull(b, read[:len(data)]); err != nil || !bytes.Equal(read[:len(data)], data) {
+		t.Errorf("mismatched data read after seek, error %v", err)
+	}
+
+	// shrinking discards the data, and growing again reads zeroes
+	if err := b.Truncate(off + 100); err != nil {
+		t.Fatalf("unexpected error truncating: %v", err)
+	}
+	if b.Size() != off+100 || b.Allocated() != mem.PageSize {
+		t.Errorf("mismatched size %d and allocation %d after shrinking", b.Size(), b.Allocated())
+	}
+	if err := b.Truncate(size); err != nil {
+		t.Fatalf("unexpected error truncating: %v", err)
+	}
+	if _, err := b.ReadAt(read, off-500); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	expected = append(append(make([]byte, 500), data[:100]...), make([]byte, 1400)...)
+	if !bytes.Equal(read, expected) {
+		t.Errorf("mismatched data read after truncating")
+	}
+
+	// read-only buffers cannot be changed
+	ro, err := mem.NewFromBytes(data, true)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	if _, err := ro.Writable(); err == nil {
+		t.Errorf("read-only buffer was writable")
+	}
+	if _, err := ro.WriteAt(data, 0); err == nil {
+		t.Errorf("write to read-only buffer succeeded")
+	}
+	if !bytes.Equal(ro.Bytes(), data) {
+		t.Errorf("mismatched contents of buffer from bytes")
+	}
+}
+
+func TestDiskInMemory(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	d, err := diskfs.OpenBackend(b, diskfs.WithOpenMode(diskfs.ReadWrite))
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: size/512 - 2048, Type: gpt.EFISystemPartition, Name: "EFI"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("error partitioning disk: %v", err)
+	}
+	fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "EFI"})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing disk: %v", err)
+	}
+	if b.Allocated() >= size/2 {
+		t.Errorf("allocated %d bytes for a mostly empty %d byte image", b.Allocated(), size)
+	}
+
+	// stream the image out and read it back
+	image, err := io.ReadAll(b.Reader())
+	if err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+	if len(image) != size {
+		t.Fatalf("read %d bytes of image instead of %d", len(image), size)
+	}
+	copied, err := mem.NewFromBytes(image, true)
+	if err != nil {
+		t.Fatalf("unexpected error creating buffer: %v", err)
+	}
+	d, err = diskfs.OpenBackend(copied)
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	fs, err = d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	entries, err := fs.ReadDir("/EFI")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var found bool
+	for _, e := range entries {
+		found = found || e.Name() == "BOOT"
+	}
+	if !found {
+		t.Errorf("directory BOOT not found in /EFI")
+	}
+}
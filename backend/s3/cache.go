@@ -0,0 +1,46 @@
+package s3
+
+import "container/list"
+
+// blockCache a least recently used cache of blocks of the object, keyed by block number
+type blockCache struct {
+	capacity int
+	order    *list.List // front is most recently used
+	blocks   map[int64]*list.Element
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		blocks:   map[int64]*list.Element{},
+	}
+}
+
+func (c *blockCache) get(index int64) ([]byte, bool) {
+	e, ok := c.blocks[index]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) put(index int64, data []byte) {
+	if e, ok := c.blocks[index]; ok {
+		e.Value.(*cachedBlock).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.blocks[index] = c.order.PushFront(&cachedBlock{index: index, data: data})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.blocks, oldest.Value.(*cachedBlock).index)
+	}
+}
@@ -0,0 +1,652 @@
+// Package s3 provides a backend.Storage implementation for raw disk images stored as objects in S3 or a
+// compatible object store, such as MinIO or Ceph.
+//
+// Reads are made with ranged GETs of whole blocks, which are kept in a local cache, so a partition table or
+// filesystem can be inspected without downloading the whole image. Requests are signed with AWS Signature
+// Version 4, or not at all for public objects, using only the standard library.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+const (
+	// DefaultBlockSize is the size of each ranged read, and so the unit of caching, if none is specified
+	DefaultBlockSize int64 = 1024 * 1024
+	// DefaultCacheBlocks is how many blocks are kept in the read cache, if not specified
+	DefaultCacheBlocks = 64
+	// DefaultPartSize is the size of each part of a multipart upload, if none is specified
+	DefaultPartSize int64 = 8 * 1024 * 1024
+	// MinPartSize is the smallest part S3 allows in a multipart upload, other than the last one
+	MinPartSize int64 = 5 * 1024 * 1024
+	// MaxParts is the most parts S3 allows in a multipart upload
+	MaxParts = 10000
+	// DefaultRegion is the region used if none is specified
+	DefaultRegion = "us-east-1"
+)
+
+// Config describes where an object is and how to access it. Any zero values are replaced with the defaults.
+type Config struct {
+	// Bucket is the name of the bucket holding the object
+	Bucket string
+	// Key is the key of the object in the bucket
+	Key string
+	// Region is the region of the bucket, used for signing requests and for the default endpoint.
+	// Defaults to DefaultRegion.
+	Region string
+	// Endpoint is the URL of the service, e.g. http://localhost:9000 for a local MinIO.
+	// Defaults to https://s3.<Region>.amazonaws.com.
+	Endpoint string
+	// PathStyle puts the bucket in the path of the URL rather than in the host name, as most
+	// services other than AWS itself require
+	PathStyle bool
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials used to sign requests.
+	// If AccessKeyID is empty, requests are not signed, which works for publicly readable objects.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client is the HTTP client used for all requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// BlockSize is the size of each ranged read and the unit of caching. Defaults to DefaultBlockSize.
+	BlockSize int64
+	// CacheBlocks is how many blocks to keep in the read cache. Defaults to DefaultCacheBlocks.
+	CacheBlocks int
+	// PartSize is the size of each part when uploading changes, rounded up to a multiple of BlockSize.
+	// Must be at least MinPartSize. Defaults to DefaultPartSize. It is raised as needed for an object so
+	// large that it would take more than MaxParts parts.
+	PartSize int64
+}
+
+// Object is an object in S3 or a compatible object store. It implements backend.Storage, reading
+// with ranged GETs through a local block cache, so it can be passed to diskfs.OpenBackend to work
+// with a remote disk image without downloading it.
+//
+// An object opened for writing keeps changed blocks in memory, and uploads them on Sync or Close
+// with a multipart upload, in which the parts that did not change are copied within the object store
+// rather than uploaded again. The size of the object cannot change, so an empty object can only be read.
+type Object struct {
+	config    Config
+	client    *http.Client
+	creds     *credentials
+	objectURL *url.URL
+	size      int64
+	etag      string // of the object as last seen, so that changes by anyone else are detected
+	modTime   time.Time
+	readOnly  bool
+
+	mu     sync.Mutex
+	cache  *blockCache
+	dirty  map[int64][]byte // changed blocks that are not yet uploaded
+	offset int64            // for Read and Seek
+	closed bool
+	now    func() time.Time
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Object)(nil)
+
+// Open an object for use as a backend.Storage. The object must already exist.
+func Open(config *Config, readOnly bool) (*Object, error) {
+	if config == nil || config.Bucket == "" || config.Key == "" {
+		return nil, errors.New("must pass bucket and key of the object")
+	}
+	cfg := *config
+	if cfg.Region == "" {
+		cfg.Region = DefaultRegion
+	}
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = DefaultBlockSize
+	}
+	if cfg.CacheBlocks <= 0 {
+		cfg.CacheBlocks = DefaultCacheBlocks
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d is smaller than the minimum %d", cfg.PartSize, MinPartSize)
+	}
+	cfg.PartSize = (cfg.PartSize + cfg.BlockSize - 1) / cfg.BlockSize * cfg.BlockSize
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	objectURL, err := buildObjectURL(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{
+		config:    cfg,
+		client:    client,
+		objectURL: objectURL,
+		readOnly:  readOnly,
+		cache:     newBlockCache(cfg.CacheBlocks),
+		dirty:     map[int64][]byte{},
+		now:       time.Now,
+	}
+	if cfg.AccessKeyID != "" {
+		o.creds = &credentials{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		}
+	}
+	if err := o.head(); err != nil {
+		return nil, err
+	}
+	// S3 does not accept a multipart upload without parts, which is all an empty object would have
+	if !readOnly && o.size == 0 {
+		return nil, errors.New("cannot open an empty object for writing")
+	}
+	if minPartSize := (o.size + MaxParts - 1) / MaxParts; o.config.PartSize < minPartSize {
+		o.config.PartSize = (minPartSize + cfg.BlockSize - 1) / cfg.BlockSize * cfg.BlockSize
+	}
+	return o, nil
+}
+
+// buildObjectURL the URL of the object, in path or virtual-hosted style
+func buildObjectURL(cfg *Config) (*url.URL, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %v", endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %s, must include scheme and host", endpoint)
+	}
+	p := "/" + strings.TrimPrefix(cfg.Key, "/")
+	if cfg.PathStyle {
+		p = "/" + cfg.Bucket + p
+	} else {
+		u.Host = cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = uriEncode(u.Path, false)
+	return u, nil
+}
+
+// OS-specific file for ioctl calls via fd
+func (o *Object) Sys() (*os.File, error) {
+	return nil, backend.ErrNotSuitable
+}
+
+// file for read-write operations
+func (o *Object) Writable() (backend.WritableFile, error) {
+	if o.readOnly {
+		return nil, backend.ErrIncorrectOpenMode
+	}
+	return o, nil
+}
+
+// Stat returns the size and last modification time of the object
+func (o *Object) Stat() (fs.FileInfo, error) {
+	return objectInfo{name: path.Base(o.config.Key), size: o.size, modTime: o.modTime}, nil
+}
+
+func (o *Object) Read(b []byte) (int, error) {
+	o.mu.Lock()
+	offset := o.offset
+	o.mu.Unlock()
+	n, err := o.ReadAt(b, offset)
+	o.mu.Lock()
+	o.offset += int64(n)
+	o.mu.Unlock()
+	return n, err
+}
+
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// ReadAt reads from the object, fetching any blocks that are not cached with ranged GETs
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("cannot read at negative offset %d", off)
+	}
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), o.size)
+	bs := o.config.BlockSize
+	var n int
+	for index := off / bs; index*bs < end; {
+		blocks, err := o.blocks(index, (end-1)/bs)
+		if err != nil {
+			return n, err
+		}
+		for _, data := range blocks {
+			start := index * bs
+			from := max(off, start) - start
+			to := min(end, start+int64(len(data))) - start
+			n += copy(p[n:], data[from:to])
+			index++
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blocks get the block at index, and as many following ones up to last as can be had with the same request
+func (o *Object) blocks(index, last int64) ([][]byte, error) {
+	if data, ok := o.dirty[index]; ok {
+		return [][]byte{data}, nil
+	}
+	if data, ok := o.cache.get(index); ok {
+		return [][]byte{data}, nil
+	}
+	// fetch the run of blocks that are neither changed nor cached in one request
+	count := int64(1)
+	for index+count <= last {
+		if _, ok := o.dirty[index+count]; ok {
+			break
+		}
+		if _, ok := o.cache.blocks[index+count]; ok {
+			break
+		}
+		count++
+	}
+	return o.fetch(index, count)
+}
+
+// fetch read count blocks starting at index from the object store, and cache them
+func (o *Object) fetch(index, count int64) ([][]byte, error) {
+	bs := o.config.BlockSize
+	start := index * bs
+	end := min(start+count*bs, o.size)
+	req, err := o.newRequest(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if o.etag != "" {
+		req.Header.Set("If-Match", o.etag)
+	}
+	resp, err := o.do(req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bytes %d-%d: %w", start, end-1, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || start != 0 || end != o.size) {
+		return nil, fmt.Errorf("unable to read bytes %d-%d: server does not support range requests", start, end-1)
+	}
+	buf := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("unable to read bytes %d-%d: %v", start, end-1, err)
+	}
+	blocks := make([][]byte, 0, count)
+	for i := int64(0); i < count; i++ {
+		data := buf[i*bs : min((i+1)*bs, int64(len(buf)))]
+		o.cache.put(index+i, data)
+		blocks = append(blocks, data)
+	}
+	return blocks, nil
+}
+
+// WriteAt writes to the object. The changes are kept in memory until Sync or Close.
+func (o *Object) WriteAt(p []byte, off int64) (int, error) {
+	if o.readOnly {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, fs.ErrClosed
+	}
+	if off < 0 || off+int64(len(p)) > o.size {
+		return 0, fmt.Errorf("cannot write %d bytes at offset %d beyond the end of the object at %d", len(p), off, o.size)
+	}
+	bs := o.config.BlockSize
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		index := pos / bs
+		start := index * bs
+		length := min(bs, o.size-start)
+		from := pos - start
+		to := min(length, from+int64(len(p)-n))
+
+		data, ok := o.dirty[index]
+		if !ok {
+			if from == 0 && to == length {
+				// completely overwritten, so no need to read what is there
+				data = make([]byte, length)
+			} else {
+				blocks, err := o.blocks(index, index)
+				if err != nil {
+					return n, err
+				}
+				data = bytes.Clone(blocks[0])
+			}
+		}
+		n += copy(data[from:to], p[n:])
+		o.dirty[index] = data
+	}
+	return n, nil
+}
+
+// Sync uploads any changes to the object store
+func (o *Object) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return fs.ErrClosed
+	}
+	return o.upload()
+}
+
+// Close uploads any changes to the object store and releases the cache
+func (o *Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	err := o.upload()
+	o.closed = true
+	o.cache = newBlockCache(o.config.CacheBlocks)
+	return err
+}
+
+// upload replace the object with one that includes the changed blocks, using a multipart upload
+// in which the unchanged parts are copied from the current object
+func (o *Object) upload() error {
+	if len(o.dirty) == 0 {
+		return nil
+	}
+	uploadID, err := o.createMultipartUpload()
+	if err != nil {
+		return err
+	}
+	var parts []completedPart
+	bs := o.config.BlockSize
+	partSize := o.config.PartSize
+	for start, number := int64(0), 1; start < o.size; start, number = start+partSize, number+1 {
+		end := min(start+partSize, o.size)
+		var changed bool
+		for index := start / bs; index*bs < end; index++ {
+			if _, ok := o.dirty[index]; ok {
+				changed = true
+				break
+			}
+		}
+		var etag string
+		if changed {
+			etag, err = o.uploadPart(uploadID, number, start, end)
+		} else {
+			etag, err = o.uploadPartCopy(uploadID, number, start, end)
+		}
+		if err != nil {
+			o.abortMultipartUpload(uploadID)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+	}
+	etag, err := o.completeMultipartUpload(uploadID, parts)
+	if err != nil {
+		o.abortMultipartUpload(uploadID)
+		return err
+	}
+	// the changed blocks are now what is in the object store
+	for index, data := range o.dirty {
+		o.cache.put(index, data)
+	}
+	o.dirty = map[int64][]byte{}
+	o.etag = etag
+	o.modTime = o.now()
+	return nil
+}
+
+// uploadPart upload the bytes from start to end, reading any that did not change
+func (o *Object) uploadPart(uploadID string, number int, start, end int64) (string, error) {
+	bs := o.config.BlockSize
+	buf := make([]byte, 0, end-start)
+	for index := start / bs; index*bs < end; {
+		blocks, err := o.blocks(index, (end-1)/bs)
+		if err != nil {
+			return "", err
+		}
+		for _, data := range blocks {
+			buf = append(buf, data...)
+			index++
+		}
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := o.newRequest(http.MethodPut, query, buf)
+	if err != nil {
+		return "", err
+	}
+	resp, err := o.do(req, buf)
+	if err != nil {
+		return "", fmt.Errorf("unable to upload part %d: %w", number, err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// uploadPartCopy copy the bytes from start to end from the current object as a part
+func (o *Object) uploadPartCopy(uploadID string, number int, start, end int64) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	req, err := o.newRequest(http.MethodPut, query, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Amz-Copy-Source", uriEncode("/"+o.config.Bucket+"/"+strings.TrimPrefix(o.config.Key, "/"), false))
+	req.Header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if o.etag != "" {
+		req.Header.Set("X-Amz-Copy-Source-If-Match", o.etag)
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := o.doXML(req, nil, &result); err != nil {
+		return "", fmt.Errorf("unable to copy part %d: %w", number, err)
+	}
+	return result.ETag, nil
+}
+
+func (o *Object) createMultipartUpload() (string, error) {
+	req, err := o.newRequest(http.MethodPost, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := o.doXML(req, nil, &result); err != nil {
+		return "", fmt.Errorf("unable to start upload: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", errors.New("unable to start upload: no upload ID returned")
+	}
+	return result.UploadID, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (o *Object) completeMultipartUpload(uploadID string, parts []completedPart) (string, error) {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", fmt.Errorf("unable to build upload completion: %v", err)
+	}
+	req, err := o.newRequest(http.MethodPost, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := o.doXML(req, body, &result); err != nil {
+		return "", fmt.Errorf("unable to complete upload: %w", err)
+	}
+	return result.ETag, nil
+}
+
+// abortMultipartUpload clean up after a failed upload, so the parts are not kept, and charged for.
+// This is best effort, as there is already an error to report.
+func (o *Object) abortMultipartUpload(uploadID string) {
+	req, err := o.newRequest(http.MethodDelete, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return
+	}
+	if resp, err := o.do(req, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// head read the size, ETag and modification time of the object
+func (o *Object) head() error {
+	req, err := o.newRequest(http.MethodHead, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(req, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get object %s: %w", o.objectURL, err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return fmt.Errorf("unable to get size of object %s", o.objectURL)
+	}
+	o.size = resp.ContentLength
+	o.etag = resp.Header.Get("ETag")
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		o.modTime = t
+	}
+	return nil
+}
+
+func (o *Object) newRequest(method string, query url.Values, body []byte) (*http.Request, error) {
+	u := *o.objectURL
+	u.RawQuery = query.Encode()
+	var r io.Reader = http.NoBody
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %v", err)
+	}
+	return req, nil
+}
+
+// do sign and send the request, returning an error for any response other than success
+func (o *Object) do(req *http.Request, body []byte) (*http.Response, error) {
+	if o.creds != nil {
+		hash := emptyPayloadHash
+		if body != nil {
+			hash = sha256Hex(body)
+		}
+		o.creds.sign(req, hash, o.now())
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// doXML send the request and decode the XML response into result
+func (o *Object) doXML(req *http.Request, body []byte, result interface{}) error {
+	resp, err := o.do(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %v", err)
+	}
+	// some operations report an error in the body of a successful response
+	if bytes.Contains(b, []byte("<Error>")) {
+		return xmlError(resp.StatusCode, b)
+	}
+	if err := xml.Unmarshal(b, result); err != nil {
+		return fmt.Errorf("unable to parse response: %v", err)
+	}
+	return nil
+}
+
+func responseError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return xmlError(resp.StatusCode, b)
+}
+
+func xmlError(status int, b []byte) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(b, &e) != nil || e.Code == "" {
+		e.Code = http.StatusText(status)
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", e.Code, e.Message, fs.ErrNotExist)
+	}
+	return fmt.Errorf("%d %s %s", status, e.Code, e.Message)
+}
+
+// objectInfo implements fs.FileInfo for the object
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i objectInfo) Name() string       { return i.name }
+func (i objectInfo) Size() int64        { return i.size }
+func (i objectInfo) Mode() fs.FileMode  { return 0o644 }
+func (i objectInfo) ModTime() time.Time { return i.modTime }
+func (i objectInfo) IsDir() bool        { return false }
+func (i objectInfo) Sys() interface{}   { return nil }
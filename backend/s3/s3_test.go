@@ -0,0 +1,409 @@
+package s3_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/s3"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// fakeS3 just enough of the S3 API, for a single object, to exercise the backend
+type fakeS3 struct {
+	t      *testing.T
+	mu     sync.Mutex
+	bucket string
+	key    string
+	object []byte
+	parts  map[int][]byte
+	// counts of requests by operation
+	ops map[string]int
+	// bytes sent in response to GET requests
+	bytesRead int
+}
+
+func newFakeS3(t *testing.T, bucket, key string, object []byte) *fakeS3 {
+	return &fakeS3{t: t, bucket: bucket, key: key, object: object, ops: map[string]int{}}
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=KEY/") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if r.URL.Path != "/"+f.bucket+"/"+f.key {
+		http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodHead:
+		f.ops["head"]++
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.object)))
+		w.Header().Set("ETag", etag(f.object))
+	case r.Method == http.MethodGet:
+		f.ops["get"]++
+		if m := r.Header.Get("If-Match"); m != "" && m != etag(f.object) {
+			http.Error(w, "<Error><Code>PreconditionFailed</Code></Error>", http.StatusPreconditionFailed)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+			f.t.Errorf("GET without a valid range: %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.object)))
+		w.WriteHeader(http.StatusPartialContent)
+		n, _ := w.Write(f.object[start : end+1])
+		f.bytesRead += n
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.ops["create"]++
+		f.parts = map[int][]byte{}
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && query.Get("uploadId") == "upload-1":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			f.ops["copy"]++
+			if source != "/"+f.bucket+"/"+f.key {
+				f.t.Errorf("copy from unexpected source %s", source)
+			}
+			var start, end int
+			_, _ = fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end)
+			f.parts[number] = bytes.Clone(f.object[start : end+1])
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", etag(f.parts[number]))
+			return
+		}
+		f.ops["upload"]++
+		b, _ := io.ReadAll(r.Body)
+		f.parts[number] = b
+		w.Header().Set("ETag", etag(b))
+	case r.Method == http.MethodPost && query.Get("uploadId") == "upload-1":
+		f.ops["complete"]++
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		b, _ := io.ReadAll(r.Body)
+		if err := xml.Unmarshal(b, &complete); err != nil {
+			f.t.Errorf("invalid completion: %v", err)
+		}
+		var object []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != etag(f.parts[p.PartNumber]) {
+				f.t.Errorf("mismatched part %d %s", p.PartNumber, p.ETag)
+			}
+			object = append(object, f.parts[p.PartNumber]...)
+		}
+		f.object = object
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><ETag>%s</ETag></CompleteMultipartUploadResult>", etag(object))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) opCounts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := map[string]int{}
+	for k, v := range f.ops {
+		counts[k] = v
+	}
+	return counts
+}
+
+func config(server *httptest.Server) *s3.Config {
+	return &s3.Config{
+		Bucket:          "images",
+		Key:             "disks/disk.img",
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     "KEY",
+		SecretAccessKey: "SECRET",
+		Client:          server.Client(),
+		BlockSize:       64 * 1024,
+		CacheBlocks:     16,
+		PartSize:        s3.MinPartSize,
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	const size = 12*1024*1024 + 1000
+	object := make([]byte, size)
+	_, _ = rand.Read(object)
+	fake := newFakeS3(t, "images", "disks/disk.img", bytes.Clone(object))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	o, err := s3.Open(config(server), false)
+	if err != nil {
+		t.Fatalf("unexpected error opening object: %v", err)
+	}
+	info, err := o.Stat()
+	if err != nil {
+		t.Fatalf("unexpected error getting info: %v", err)
+	}
+	if info.Size() != size || info.Name() != "disk.img" {
+		t.Errorf("mismatched info, size %d name %s", info.Size(), info.Name())
+	}
+
+	// a read across blocks fetches them in one request, and reading again uses the cache
+	b := make([]byte, 200*1024)
+	for i := 0; i < 2; i++ {
+		if _, err := o.ReadAt(b, 100*1024); err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if !bytes.Equal(b, object[100*1024:300*1024]) {
+			t.Fatalf("mismatched data read")
+		}
+	}
+	if gets := fake.opCounts()["get"]; gets != 1 {
+		t.Errorf("read with %d requests instead of 1", gets)
+	}
+	// reading off the end returns what there is
+	n, err := o.ReadAt(b, size-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("mismatched read at end, %d bytes with error %v", n, err)
+	}
+
+	// write into the second part and the short last one, leaving the first to be copied
+	data := make([]byte, 3000)
+	_, _ = rand.Read(data)
+	for _, off := range []int64{s3.MinPartSize + 65000, size - 3000} {
+		if _, err := o.WriteAt(data, off); err != nil {
+			t.Fatalf("unexpected error writing at %d: %v", off, err)
+		}
+		copy(object[off:], data)
+	}
+	if _, err := o.WriteAt(data, size-10); err == nil {
+		t.Errorf("write beyond the end did not return an error")
+	}
+	// changes are seen before they are uploaded
+	read := make([]byte, len(data))
+	if _, err := o.ReadAt(read, size-3000); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("did not read back data before upload, error %v", err)
+	}
+	if fake.opCounts()["create"] != 0 {
+		t.Errorf("uploaded before sync")
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("unexpected error closing: %v", err)
+	}
+	ops := fake.opCounts()
+	if ops["copy"] != 1 || ops["upload"] != 2 || ops["complete"] != 1 {
+		t.Errorf("unexpected operations for upload: %v", ops)
+	}
+	if !bytes.Equal(fake.object, object) {
+		t.Errorf("uploaded object did not match written data")
+	}
+
+	// read-only objects cannot be written
+	o, err = s3.Open(config(server), true)
+	if err != nil {
+		t.Fatalf("unexpected error opening object: %v", err)
+	}
+	defer o.Close()
+	if _, err := o.Writable(); err == nil {
+		t.Errorf("read-only object was writable")
+	}
+	if _, err := o.WriteAt(data, 0); err == nil {
+		t.Errorf("write to read-only object succeeded")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	fake := newFakeS3(t, "images", "disks/disk.img", make([]byte, 1024))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	cfg := config(server)
+	cfg.Key = "disks/missing.img"
+	if _, err := s3.Open(cfg, true); err == nil || !strings.Contains(err.Error(), "file does not exist") {
+		t.Errorf("missing object returned error %v", err)
+	}
+	cfg = config(server)
+	cfg.AccessKeyID = ""
+	if _, err := s3.Open(cfg, true); err == nil {
+		t.Errorf("unsigned request to private object did not return an error")
+	}
+	cfg = config(server)
+	cfg.PartSize = 1024 * 1024
+	if _, err := s3.Open(cfg, true); err == nil {
+		t.Errorf("small part size did not return an error")
+	}
+}
+
+// TestLargeObjectParts upload a change to an object too large for the default part size, to a server that only
+// keeps track of the parts, as it could not hold the object
+func TestLargeObjectParts(t *testing.T) {
+	const size = 100 * 1024 * 1024 * 1024
+	var (
+		mu    sync.Mutex
+		parts int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			w.Header().Set("ETag", `"large"`)
+		case r.Method == http.MethodGet:
+			var start, end int
+			_, _ = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(make([]byte, end+1-start))
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut:
+			if number, _ := strconv.Atoi(query.Get("partNumber")); number < 1 || number > s3.MaxParts {
+				t.Errorf("part number %d out of range", number)
+			}
+			parts++
+			_, _ = io.Copy(io.Discard, r.Body)
+			if r.Header.Get("X-Amz-Copy-Source") != "" {
+				fmt.Fprint(w, `<CopyPartResult><ETag>"part"</ETag></CopyPartResult>`)
+				return
+			}
+			w.Header().Set("ETag", `"part"`)
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"large-2"</ETag></CompleteMultipartUploadResult>`)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config(server)
+	cfg.PartSize = 0
+	o, err := s3.Open(cfg, false)
+	if err != nil {
+		t.Fatalf("error opening object: %v", err)
+	}
+	if _, err := o.WriteAt([]byte("changed"), size-100); err != nil {
+		t.Fatalf("error writing object: %v", err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatalf("error closing object: %v", err)
+	}
+	if parts == 0 || parts > s3.MaxParts {
+		t.Errorf("uploaded %d parts, expected between 1 and %d", parts, s3.MaxParts)
+	}
+}
+
+func TestOpenEmptyForWriting(t *testing.T) {
+	fake := newFakeS3(t, "images", "disks/disk.img", nil)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	if _, err := s3.Open(config(server), false); err == nil {
+		t.Errorf("opening an empty object for writing did not return an error")
+	}
+	o, err := s3.Open(config(server), true)
+	if err != nil {
+		t.Fatalf("error opening empty object read-only: %v", err)
+	}
+	_ = o.Close()
+}
+
+func TestDiskOnObject(t *testing.T) {
+	// build a disk image locally, then work with it remotely
+	p := filepath.Join(t.TempDir(), "disk.img")
+	d, err := diskfs.Create(p, 20*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 40000, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("error partitioning disk: %v", err)
+	}
+	if _, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32}); err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	_ = d.Close()
+	image, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+
+	fake := newFakeS3(t, "images", "disks/disk.img", image)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	o, err := s3.Open(config(server), false)
+	if err != nil {
+		t.Fatalf("unexpected error opening object: %v", err)
+	}
+	d, err = diskfs.OpenBackend(o)
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	fs, err := d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/remote"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing disk: %v", err)
+	}
+	if fake.bytesRead >= len(image) {
+		t.Errorf("read %d bytes of a %d byte image", fake.bytesRead, len(image))
+	}
+
+	// the change made it to the object store
+	if err := os.WriteFile(p, fake.object, 0o600); err != nil {
+		t.Fatalf("error writing image: %v", err)
+	}
+	d, err = diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	defer d.Close()
+	fs, err = d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "remote" {
+		t.Errorf("mismatched root directory entries %v", names)
+	}
+}
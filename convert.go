@@ -0,0 +1,137 @@
+package diskfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	// DefaultConvertChunkSize how much Convert copies at a time, unless ConvertOptions.ChunkSize is set
+	DefaultConvertChunkSize int64 = 1024 * 1024
+	// convertZeroBlockSize the smallest part of the disk that Convert skips when it is zeroes
+	convertZeroBlockSize int64 = 4096
+)
+
+// ConvertOptions options for Convert. The zero value copies the disk uncompressed, skipping what is zeroes.
+type ConvertOptions struct {
+	// Compress writes dst compressed, which only some formats can do, such as qcow2. It is an error for the rest.
+	Compress bool
+	// WriteZeroes writes the parts of src that are zeroes to dst too, for a dst that does not already read as
+	// zeroes, such as a block device that was used before. Otherwise they are skipped, so that they stay
+	// unallocated in an image.
+	WriteZeroes bool
+	// ChunkSize how much is copied at a time, rounded up to whole clusters when compressing.
+	// Defaults to DefaultConvertChunkSize.
+	ChunkSize int64
+}
+
+// compressedWriter a backend that can write whole clusters compressed, such as a qcow2 image
+type compressedWriter interface {
+	ClusterSize() int64
+	WriteCompressed(p []byte, off int64) (int, error)
+}
+
+// Convert copies the contents of the disk src to the disk dst, which are usually in different image formats,
+// e.g. a raw image to a qcow2 image opened or created with WithFormat, or the other way around, as qemu-img
+// convert does. dst must be at least as large as src, and is expected to be new, so that it reads as zeroes:
+// the parts of src that are zeroes, or that are not allocated in its image, are not written to dst, unless
+// opts.WriteZeroes is set. The partition table of dst is read again once it is written.
+func Convert(src, dst *disk.Disk, opts ConvertOptions) error {
+	if src == nil || dst == nil {
+		return errors.New("must pass source and destination disks")
+	}
+	size := src.Size
+	if dst.Size < size {
+		return fmt.Errorf("destination of %d bytes is smaller than source of %d bytes", dst.Size, size)
+	}
+	writable, err := dst.Backend.Writable()
+	if err != nil {
+		return fmt.Errorf("destination is not writable: %w", err)
+	}
+	chunk := opts.ChunkSize
+	if chunk <= 0 {
+		chunk = DefaultConvertChunkSize
+	}
+	var compressed compressedWriter
+	if opts.Compress {
+		var ok bool
+		if compressed, ok = dst.Backend.(compressedWriter); !ok {
+			return errors.New("format of destination does not support compression")
+		}
+		chunk = alignUp(chunk, compressed.ClusterSize())
+	}
+	allocation, _ := src.Backend.(backend.AllocationReporter)
+
+	buf := make([]byte, chunk)
+	zeroes := make([]byte, chunk)
+	for off := int64(0); off < size; off += chunk {
+		n := min(chunk, size-off)
+		b := buf[:n]
+		if allocation != nil && !opts.WriteZeroes {
+			allocated, err := allocation.Allocated(off, n)
+			if err != nil {
+				return fmt.Errorf("could not get allocation of source at %d: %w", off, err)
+			}
+			if !allocated {
+				continue
+			}
+		}
+		if read, err := src.Backend.ReadAt(b, off); err != nil && (!errors.Is(err, io.EOF) || int64(read) != n) {
+			return fmt.Errorf("could not read source at %d: %w", off, err)
+		}
+		if !opts.WriteZeroes && bytes.Equal(b, zeroes[:n]) {
+			continue
+		}
+		if compressed != nil {
+			// the last clusters of a source that ends within a cluster are filled out with the zeroes dst has,
+			// and clusters of zeroes are left out by WriteCompressed itself
+			if padded := min(alignUp(n, compressed.ClusterSize()), dst.Size-off); padded > n {
+				b = buf[:padded]
+				clear(b[n:])
+			}
+			if _, err := compressed.WriteCompressed(b, off); err != nil {
+				return fmt.Errorf("could not write destination at %d: %w", off, err)
+			}
+			continue
+		}
+		if opts.WriteZeroes {
+			if _, err := writable.WriteAt(b, off); err != nil {
+				return fmt.Errorf("could not write destination at %d: %w", off, err)
+			}
+			continue
+		}
+		// write the runs of the chunk between its blocks of zeroes
+		start := int64(-1)
+		for pos := int64(0); pos < n || start >= 0; pos += convertZeroBlockSize {
+			end := min(pos+convertZeroBlockSize, n)
+			if pos < n && !bytes.Equal(b[pos:end], zeroes[:end-pos]) {
+				if start < 0 {
+					start = pos
+				}
+				continue
+			}
+			if start >= 0 {
+				if _, err := writable.WriteAt(b[start:min(pos, n)], off+start); err != nil {
+					return fmt.Errorf("could not write destination at %d: %w", off+start, err)
+				}
+				start = -1
+			}
+		}
+	}
+
+	dst.Table = nil
+	if table, err := dst.GetPartitionTable(); err == nil {
+		dst.Table = table
+	}
+	return nil
+}
+
+// alignUp round n up to a multiple of align
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
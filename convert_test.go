@@ -0,0 +1,120 @@
+package diskfs_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestConvert(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "disk.img")
+	src, err := diskfs.Create(rawPath, size, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 100000, Type: gpt.LinuxFilesystem, Name: "data"},
+		},
+	}
+	if err := src.Partition(table); err != nil {
+		t.Fatalf("error partitioning disk: %v", err)
+	}
+	random := make([]byte, 300*1024)
+	_, _ = rand.Read(random)
+	compressible := bytes.Repeat([]byte("compressible "), 100*1024)
+	w, err := src.Backend.Writable()
+	if err != nil {
+		t.Fatalf("error getting writable disk: %v", err)
+	}
+	for offset, data := range map[int64][]byte{2 * 1024 * 1024: random, 20 * 1024 * 1024: compressible, size - 1000: random[:1000]} {
+		if _, err := w.WriteAt(data, offset); err != nil {
+			t.Fatalf("error writing disk: %v", err)
+		}
+	}
+	expected, err := os.ReadFile(rawPath)
+	if err != nil {
+		t.Fatalf("error reading disk: %v", err)
+	}
+
+	// convert converts, and converts back
+	convert := func(t *testing.T, src *disk.Disk, name string, format diskfs.Format, opts diskfs.ConvertOptions) (*disk.Disk, int64) {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		dst, err := diskfs.Create(p, size, diskfs.SectorSizeDefault, diskfs.WithFormat(format))
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		if err := diskfs.Convert(src, dst, opts); err != nil {
+			t.Fatalf("error converting to %v: %v", format, err)
+		}
+		if dst.Table == nil || dst.Table.Type() != "gpt" {
+			t.Errorf("did not find gpt partition table in converted %v disk", format)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("error getting image info: %v", err)
+		}
+		return dst, info.Size()
+	}
+	// the holes of the raw disk are not allocated in the image, but for the large blocks of VHDX
+	tests := []struct {
+		format  diskfs.Format
+		opts    diskfs.ConvertOptions
+		maxSize int64
+	}{
+		{diskfs.FormatQCOW2, diskfs.ConvertOptions{}, 3 * 1024 * 1024},
+		{diskfs.FormatQCOW2, diskfs.ConvertOptions{Compress: true}, 1024 * 1024},
+		{diskfs.FormatVMDK, diskfs.ConvertOptions{ChunkSize: 100 * 1000}, 3 * 1024 * 1024},
+		{diskfs.FormatVHDX, diskfs.ConvertOptions{}, size + 8*1024*1024},
+	}
+	var sizes []int64
+	for i, tt := range tests {
+		image, imageSize := convert(t, src, fmt.Sprintf("image%d", i), tt.format, tt.opts)
+		sizes = append(sizes, imageSize)
+		if imageSize > tt.maxSize {
+			t.Errorf("%v image of %d bytes is larger than %d", tt.format, imageSize, tt.maxSize)
+		}
+		raw, _ := convert(t, image, fmt.Sprintf("raw%d", i), diskfs.FormatRaw, diskfs.ConvertOptions{})
+		_ = image.Close()
+		_ = raw.Close()
+		actual, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("raw%d", i)))
+		if err != nil {
+			t.Fatalf("error reading disk: %v", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("disk converted to %v and back did not match", tt.format)
+		}
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("compressed qcow2 image of %d bytes is not smaller than uncompressed one of %d bytes", sizes[1], sizes[0])
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		small, err := diskfs.Create(filepath.Join(dir, "small.img"), size/2, diskfs.SectorSizeDefault)
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		defer small.Close()
+		if err := diskfs.Convert(src, small, diskfs.ConvertOptions{}); err == nil {
+			t.Errorf("conversion to a smaller disk succeeded")
+		}
+		raw, err := diskfs.Create(filepath.Join(dir, "compressed.img"), size, diskfs.SectorSizeDefault)
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		defer raw.Close()
+		if err := diskfs.Convert(src, raw, diskfs.ConvertOptions{Compress: true}); err == nil {
+			t.Errorf("compressed conversion to a raw disk succeeded")
+		}
+	})
+}
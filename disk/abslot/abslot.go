@@ -0,0 +1,209 @@
+// Package abslot keeps track of which slot of an A/B update layout boots. Such a disk has two copies of the root
+// filesystem, slot A and slot B: an updater writes the new system to the slot that is not running, and marks it to
+// be tried on the next boot, so that a bad update falls back to the slot that worked.
+//
+// A Scheme names the partitions of the two slots, and where the bootloader reads their states from: either the
+// GPT attributes of the slot partitions themselves, as ChromeOS does, or the bootloader_control block of a metadata
+// partition, as Android and bootloaders that follow it do in their misc partition.
+//
+//	s := &abslot.Scheme{Disk: d, Slots: [2]int{2, 3}, Metadata: 1, MetadataOffset: abslot.MiscOffset}
+//	active, err := s.Active()
+//	...
+//	// after writing the update to the other slot
+//	err = s.SetActive(active.Other(), abslot.DefaultTries)
+package abslot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/disk"
+)
+
+const (
+	// MaxPriority the highest priority of a slot
+	MaxPriority = 15
+	// DefaultTries how many times SetActive lets a slot be tried when told 0, as Android does
+	DefaultTries = 6
+)
+
+// ErrNoBootableSlot is returned by Active when neither slot can be booted
+var ErrNoBootableSlot = errors.New("no bootable slot")
+
+// Slot one of the two slots, A or B
+type Slot int
+
+const (
+	SlotA Slot = iota
+	SlotB
+)
+
+// String the name of the slot, A or B
+func (s Slot) String() string {
+	switch s {
+	case SlotA:
+		return "A"
+	case SlotB:
+		return "B"
+	default:
+		return fmt.Sprintf("Slot(%d)", int(s))
+	}
+}
+
+// Suffix the suffix of the names of the partitions of the slot, as Android names them, _a or _b
+func (s Slot) Suffix() string {
+	if s == SlotB {
+		return "_b"
+	}
+	return "_a"
+}
+
+// Other the other slot
+func (s Slot) Other() Slot {
+	return 1 - s
+}
+
+// State the boot state of a slot, as the bootloader reads it
+type State struct {
+	// Priority which slot boots, the bootable one with the higher; 0 for a slot that is not to be booted
+	Priority uint8
+	// Tries how many more times the slot may be tried, while it has not booted successfully
+	Tries uint8
+	// Successful the slot has booted successfully, so that it is booted without using up tries
+	Successful bool
+}
+
+// Bootable whether the bootloader may boot the slot
+func (s State) Bootable() bool {
+	return s.Priority > 0 && (s.Successful || s.Tries > 0)
+}
+
+// Scheme an A/B layout of a disk: the partitions of the two slots, and where their states are kept
+type Scheme struct {
+	Disk *disk.Disk
+	// Slots the partitions of slot A and slot B, counted from 1
+	Slots [2]int
+	// Metadata the partition, counted from 1, whose Android bootloader_control block at MetadataOffset holds the
+	// states of the slots. If it is 0, they are in the GPT attributes of the partitions of the slots, as in ChromeOS.
+	Metadata       int
+	MetadataOffset int64
+}
+
+// States read the states of slot A and slot B. With a metadata partition, it returns an error wrapping
+// ErrNoMetadata if there is no bootloader_control block yet, which SetStates writes.
+func (s *Scheme) States() ([2]State, error) {
+	if err := s.validate(); err != nil {
+		return [2]State{}, err
+	}
+	if s.Metadata != 0 {
+		return s.readMetadata()
+	}
+	return s.readAttributes()
+}
+
+// SetStates write the states of slot A and slot B
+func (s *Scheme) SetStates(states [2]State) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Metadata != 0 {
+		return s.writeMetadata(states)
+	}
+	return s.writeAttributes(states)
+}
+
+// Active the slot that the bootloader boots: the bootable one with the higher priority, or A if they are equal.
+// Returns ErrNoBootableSlot if neither is bootable.
+func (s *Scheme) Active() (Slot, error) {
+	states, err := s.States()
+	if err != nil {
+		return 0, err
+	}
+	return active(states)
+}
+
+// SetActive make slot the one to boot next, with tries tries, or DefaultTries if 0, before the bootloader gives up
+// on it and falls back to the other, as an updater does once it has written slot. The other slot keeps its state,
+// but for its priority, which is lowered below that of slot if it was as high.
+func (s *Scheme) SetActive(slot Slot, tries uint8) error {
+	if slot != SlotA && slot != SlotB {
+		return fmt.Errorf("invalid slot %v", slot)
+	}
+	if tries == 0 {
+		tries = DefaultTries
+	}
+	states, err := s.States()
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return err
+	}
+	states[slot] = State{Priority: MaxPriority, Tries: tries}
+	if other := &states[slot.Other()]; other.Priority >= MaxPriority {
+		other.Priority = MaxPriority - 1
+	}
+	return s.SetStates(states)
+}
+
+// Flip make the slot that is not active the one to boot next, as SetActive does, and return it
+func (s *Scheme) Flip(tries uint8) (Slot, error) {
+	current, err := s.Active()
+	if err != nil {
+		return 0, err
+	}
+	next := current.Other()
+	return next, s.SetActive(next, tries)
+}
+
+// MarkSuccessful record that slot has booted successfully, as the system does once it is up, so that it keeps
+// being booted without using up its tries
+func (s *Scheme) MarkSuccessful(slot Slot) error {
+	if slot != SlotA && slot != SlotB {
+		return fmt.Errorf("invalid slot %v", slot)
+	}
+	states, err := s.States()
+	if err != nil {
+		return err
+	}
+	if states[slot].Priority == 0 {
+		return fmt.Errorf("slot %v is not bootable", slot)
+	}
+	states[slot].Successful = true
+	return s.SetStates(states)
+}
+
+// active the slot that boots with states
+func active(states [2]State) (Slot, error) {
+	a, b := states[SlotA], states[SlotB]
+	switch {
+	case a.Bootable() && (!b.Bootable() || a.Priority >= b.Priority):
+		return SlotA, nil
+	case b.Bootable():
+		return SlotB, nil
+	default:
+		return 0, ErrNoBootableSlot
+	}
+}
+
+// validate check that the partitions of the scheme are on its disk
+func (s *Scheme) validate() error {
+	if s.Disk == nil {
+		return errors.New("scheme has no disk")
+	}
+	if s.Disk.Table == nil {
+		return errors.New("disk has no partition table")
+	}
+	count := len(s.Disk.Table.GetPartitions())
+	for _, p := range []int{s.Slots[SlotA], s.Slots[SlotB], s.Metadata} {
+		if p < 0 || p > count {
+			return fmt.Errorf("partition %d is not on the disk, which has %d", p, count)
+		}
+	}
+	switch {
+	case s.Slots[SlotA] == 0 || s.Slots[SlotB] == 0:
+		return errors.New("scheme needs a partition for each slot")
+	case s.Slots[SlotA] == s.Slots[SlotB]:
+		return fmt.Errorf("slots A and B are both partition %d", s.Slots[SlotA])
+	case s.Metadata != 0 && (s.Metadata == s.Slots[SlotA] || s.Metadata == s.Slots[SlotB]):
+		return fmt.Errorf("metadata partition %d is also a slot", s.Metadata)
+	}
+	return nil
+}
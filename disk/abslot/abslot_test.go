@@ -0,0 +1,155 @@
+package abslot_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/abslot"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// testDisk a disk with a misc partition and the partitions of slots A and B, with the lowest attribute set on A
+func testDisk(t *testing.T) *disk.Disk {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "disk.img")
+	d, err := diskfs.Create(p, 10*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatalf("unable to create disk: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	table := &gpt.Table{Partitions: []*gpt.Partition{
+		{Start: 2048, Size: 1024 * 1024, Type: gpt.LinuxFilesystem, Name: "misc"},
+		{Start: 4096, Size: 2 * 1024 * 1024, Type: gpt.LinuxFilesystem, Name: "system_a", Attributes: 1},
+		{Start: 8192, Size: 2 * 1024 * 1024, Type: gpt.LinuxFilesystem, Name: "system_b"},
+	}}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("unable to partition disk: %v", err)
+	}
+	return d
+}
+
+// testUpdate go through an update: A is made active and boots, B is written and flipped to
+func testUpdate(t *testing.T, s *abslot.Scheme) {
+	t.Helper()
+	if _, err := s.Active(); !errors.Is(err, abslot.ErrNoBootableSlot) && !errors.Is(err, abslot.ErrNoMetadata) {
+		t.Fatalf("expected no active slot on a new disk, got %v", err)
+	}
+	if err := s.SetActive(abslot.SlotA, 0); err != nil {
+		t.Fatalf("unable to set active slot: %v", err)
+	}
+	if err := s.MarkSuccessful(abslot.SlotA); err != nil {
+		t.Fatalf("unable to mark slot successful: %v", err)
+	}
+	next, err := s.Flip(3)
+	if err != nil {
+		t.Fatalf("unable to flip slot: %v", err)
+	}
+	if next != abslot.SlotB {
+		t.Errorf("flipped to slot %v instead of B", next)
+	}
+	if active, err := s.Active(); err != nil || active != abslot.SlotB {
+		t.Errorf("active slot %v (%v) instead of B", active, err)
+	}
+	states, err := s.States()
+	if err != nil {
+		t.Fatalf("unable to read states: %v", err)
+	}
+	expected := [2]abslot.State{
+		{Priority: abslot.MaxPriority - 1, Tries: abslot.DefaultTries, Successful: true},
+		{Priority: abslot.MaxPriority, Tries: 3},
+	}
+	if states != expected {
+		t.Errorf("states %+v instead of %+v", states, expected)
+	}
+
+	// with B out of tries, as a bootloader leaves it after it failed to boot, A is active again
+	states[abslot.SlotB].Tries = 0
+	if err := s.SetStates(states); err != nil {
+		t.Fatalf("unable to write states: %v", err)
+	}
+	if active, err := s.Active(); err != nil || active != abslot.SlotA {
+		t.Errorf("active slot %v (%v) instead of A after B failed", active, err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	d := testDisk(t)
+	s := &abslot.Scheme{Disk: d, Slots: [2]int{2, 3}}
+	testUpdate(t, s)
+
+	// the attributes are as ChromeOS has them, and the others are kept
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatalf("unable to read partition table: %v", err)
+	}
+	parts := table.(*gpt.Table).Partitions
+	if expected := uint64(1) | 14<<48 | abslot.DefaultTries<<52 | 1<<56; parts[1].Attributes != expected {
+		t.Errorf("attributes of slot A %#x instead of %#x", parts[1].Attributes, expected)
+	}
+	if expected := uint64(15) << 48; parts[2].Attributes != expected {
+		t.Errorf("attributes of slot B %#x instead of %#x", parts[2].Attributes, expected)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	d := testDisk(t)
+	s := &abslot.Scheme{Disk: d, Slots: [2]int{2, 3}, Metadata: 1, MetadataOffset: abslot.MiscOffset}
+	testUpdate(t, s)
+
+	// the block is as Android has it
+	b := make([]byte, 32)
+	location := 2048*512 + int64(abslot.MiscOffset)
+	if _, err := d.Backend.ReadAt(b, location); err != nil {
+		t.Fatalf("unable to read block: %v", err)
+	}
+	switch {
+	case string(b[0:4]) != "_a\x00\x00":
+		t.Errorf("slot suffix %q instead of _a", b[0:4])
+	case binary.LittleEndian.Uint32(b[4:8]) != 0x42414342 || b[8] != 1 || b[9] != 2:
+		t.Errorf("wrong magic, version or slot count in % x", b[4:10])
+	case b[12] != 0xee || b[14] != 0x0f:
+		t.Errorf("slot info % x instead of ee and 0f", []byte{b[12], b[14]})
+	case binary.LittleEndian.Uint32(b[28:]) != crc32.ChecksumIEEE(b[:28]):
+		t.Errorf("wrong checksum")
+	}
+
+	// a corrupt block is not read, but is replaced when the states are written
+	w, err := d.Backend.Writable()
+	if err != nil {
+		t.Fatalf("unable to get writable backend: %v", err)
+	}
+	if _, err := w.WriteAt([]byte{0xff}, location+12); err != nil {
+		t.Fatalf("unable to corrupt block: %v", err)
+	}
+	if _, err := s.States(); !errors.Is(err, abslot.ErrNoMetadata) {
+		t.Errorf("expected ErrNoMetadata reading corrupt block, got %v", err)
+	}
+	if err := s.SetActive(abslot.SlotB, abslot.MaxPriority); err == nil {
+		t.Errorf("expected error setting more tries than the block holds")
+	}
+	if err := s.SetActive(abslot.SlotB, 7); err != nil {
+		t.Fatalf("unable to set active slot: %v", err)
+	}
+	if active, err := s.Active(); err != nil || active != abslot.SlotB {
+		t.Errorf("active slot %v (%v) instead of B", active, err)
+	}
+}
+
+func TestSchemeValidate(t *testing.T) {
+	d := testDisk(t)
+	for _, s := range []*abslot.Scheme{
+		{Disk: d, Slots: [2]int{2, 2}},
+		{Disk: d, Slots: [2]int{2, 4}},
+		{Disk: d, Slots: [2]int{2, 3}, Metadata: 3},
+		{Disk: d, Slots: [2]int{2, 3}, Metadata: 1, MetadataOffset: 1024 * 1024},
+	} {
+		if _, err := s.States(); err == nil {
+			t.Errorf("expected error with slots %v and metadata %d at %d", s.Slots, s.Metadata, s.MetadataOffset)
+		}
+	}
+}
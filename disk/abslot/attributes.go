@@ -0,0 +1,70 @@
+package abslot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+// the bits of the GPT attributes of a partition that ChromeOS keeps the state of its slot in
+const (
+	priorityShift            = 48
+	triesShift               = 52
+	successfulShift          = 56
+	attributeMask     uint64 = 0xf
+	maxAttributeTries        = 15
+	stateAttributes          = attributeMask<<priorityShift | attributeMask<<triesShift | 1<<successfulShift
+)
+
+// gptPartitions the partitions of the slots in the GPT of the disk
+func (s *Scheme) gptPartitions() (*gpt.Table, [2]*gpt.Partition, error) {
+	table, ok := s.Disk.Table.(*gpt.Table)
+	if !ok {
+		return nil, [2]*gpt.Partition{}, errors.New("slot states in partition attributes need a GPT")
+	}
+	return table, [2]*gpt.Partition{table.Partitions[s.Slots[SlotA]-1], table.Partitions[s.Slots[SlotB]-1]}, nil
+}
+
+// readAttributes read the states of the slots from the GPT attributes of their partitions
+func (s *Scheme) readAttributes() ([2]State, error) {
+	var states [2]State
+	_, parts, err := s.gptPartitions()
+	if err != nil {
+		return states, err
+	}
+	for i, p := range parts {
+		states[i] = State{
+			Priority:   uint8(p.Attributes >> priorityShift & attributeMask),
+			Tries:      uint8(p.Attributes >> triesShift & attributeMask),
+			Successful: p.Attributes&(1<<successfulShift) != 0,
+		}
+	}
+	return states, nil
+}
+
+// writeAttributes write the states of the slots to the GPT attributes of their partitions, keeping their other
+// attributes, and write the table
+func (s *Scheme) writeAttributes(states [2]State) error {
+	table, parts, err := s.gptPartitions()
+	if err != nil {
+		return err
+	}
+	for i, st := range states {
+		if st.Priority > MaxPriority || st.Tries > maxAttributeTries {
+			return fmt.Errorf("slot %v: priority %d above %d or tries %d above %d", Slot(i), st.Priority, MaxPriority, st.Tries, maxAttributeTries)
+		}
+	}
+	for i, p := range parts {
+		st := states[i]
+		p.Attributes &^= stateAttributes
+		p.Attributes |= uint64(st.Priority)<<priorityShift | uint64(st.Tries)<<triesShift
+		if st.Successful {
+			p.Attributes |= 1 << successfulShift
+		}
+	}
+	if err := s.Disk.Partition(table); err != nil {
+		return fmt.Errorf("could not write partition table: %w", err)
+	}
+	return nil
+}
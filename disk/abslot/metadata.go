@@ -0,0 +1,131 @@
+package abslot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// the bootloader_control block of Android, in the boot_control_definition.h of AOSP
+const (
+	// MiscOffset where Android keeps the bootloader_control block in its misc partition, after the
+	// bootloader_message
+	MiscOffset            = 2048
+	metadataSize          = 32
+	metadataMagic         = 0x42414342
+	metadataVersion       = 1
+	metadataSlots         = 2
+	metadataSlotInfo      = 12
+	metadataCRC           = 28
+	maxMetadataTries      = 7
+	metadataSlotCountMask = 0x7
+	// the bits of the first byte of the slot_metadata of a slot
+	metadataPriorityMask   = 0x0f
+	metadataTriesShift     = 4
+	metadataTriesMask      = 0x7
+	metadataSuccessfulFlag = 0x80
+)
+
+// ErrNoMetadata is returned by Scheme.States when the metadata partition has no valid bootloader_control block,
+// such as before one was first written, or when its checksum is wrong. Writing the states makes a new one.
+var ErrNoMetadata = errors.New("no valid bootloader_control block")
+
+// metadataLocation where the block is on the disk
+func (s *Scheme) metadataLocation() (int64, error) {
+	p := s.Disk.Table.GetPartitions()[s.Metadata-1]
+	if s.MetadataOffset < 0 || s.MetadataOffset+metadataSize > p.GetSize() {
+		return 0, fmt.Errorf("metadata at %d does not fit in partition %d of %d bytes", s.MetadataOffset, s.Metadata, p.GetSize())
+	}
+	return p.GetStart() + s.MetadataOffset, nil
+}
+
+// readMetadataBlock read the bootloader_control block, returning ErrNoMetadata if it is not there
+func (s *Scheme) readMetadataBlock() ([]byte, error) {
+	location, err := s.metadataLocation()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, metadataSize)
+	if n, err := s.Disk.Backend.ReadAt(b, location); err != nil && n != len(b) {
+		return nil, fmt.Errorf("could not read metadata at %d: %w", location, err)
+	}
+	if binary.LittleEndian.Uint32(b[4:8]) != metadataMagic {
+		return nil, fmt.Errorf("partition %d at offset %d: %w", s.Metadata, s.MetadataOffset, ErrNoMetadata)
+	}
+	if checksum := crc32.ChecksumIEEE(b[:metadataCRC]); checksum != binary.LittleEndian.Uint32(b[metadataCRC:]) {
+		return nil, fmt.Errorf("checksum %08x instead of %08x: %w", binary.LittleEndian.Uint32(b[metadataCRC:]), checksum, ErrNoMetadata)
+	}
+	if b[8] != metadataVersion {
+		return nil, fmt.Errorf("unsupported version %d: %w", b[8], ErrNoMetadata)
+	}
+	if slots := b[9] & metadataSlotCountMask; slots < metadataSlots {
+		return nil, fmt.Errorf("%d slots instead of %d: %w", slots, metadataSlots, ErrNoMetadata)
+	}
+	return b, nil
+}
+
+// readMetadata read the states of the slots from the bootloader_control block
+func (s *Scheme) readMetadata() ([2]State, error) {
+	var states [2]State
+	b, err := s.readMetadataBlock()
+	if err != nil {
+		return states, err
+	}
+	for i := range states {
+		info := b[metadataSlotInfo+2*i]
+		states[i] = State{
+			Priority:   info & metadataPriorityMask,
+			Tries:      info >> metadataTriesShift & metadataTriesMask,
+			Successful: info&metadataSuccessfulFlag != 0,
+		}
+	}
+	return states, nil
+}
+
+// writeMetadata write the states of the slots to the bootloader_control block, keeping the rest of it if there
+// already is a valid one, or making a new one otherwise
+func (s *Scheme) writeMetadata(states [2]State) error {
+	for i, st := range states {
+		if st.Priority > MaxPriority || st.Tries > maxMetadataTries {
+			return fmt.Errorf("slot %v: priority %d above %d or tries %d above %d", Slot(i), st.Priority, MaxPriority, st.Tries, maxMetadataTries)
+		}
+	}
+	b, err := s.readMetadataBlock()
+	switch {
+	case errors.Is(err, ErrNoMetadata):
+		b = make([]byte, metadataSize)
+		binary.LittleEndian.PutUint32(b[4:8], metadataMagic)
+		b[8] = metadataVersion
+		b[9] = metadataSlots
+	case err != nil:
+		return err
+	}
+	for i, st := range states {
+		info := st.Priority | st.Tries<<metadataTriesShift
+		if st.Successful {
+			info |= metadataSuccessfulFlag
+		}
+		b[metadataSlotInfo+2*i] = info
+	}
+	// the suffix of the slot that boots, which bootloaders read rather than working it out
+	suffix := make([]byte, 4)
+	if slot, err := active(states); err == nil {
+		copy(suffix, slot.Suffix())
+	}
+	copy(b[0:4], suffix)
+	binary.LittleEndian.PutUint32(b[metadataCRC:], crc32.ChecksumIEEE(b[:metadataCRC]))
+
+	location, err := s.metadataLocation()
+	if err != nil {
+		return err
+	}
+	w, err := s.Disk.Backend.Writable()
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(b, location); err != nil {
+		return fmt.Errorf("could not write metadata at %d: %w", location, err)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package disk
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// BenchmarkPattern how a benchmark reads or writes the disk
+type BenchmarkPattern int
+
+const (
+	// SequentialRead read the region in order, one block after another
+	SequentialRead BenchmarkPattern = iota
+	// RandomRead read blocks at random places in the region
+	RandomRead
+	// SequentialWrite write the region in order, one block after another
+	SequentialWrite
+	// RandomWrite write blocks at random places in the region
+	RandomWrite
+)
+
+func (p BenchmarkPattern) String() string {
+	switch p {
+	case SequentialRead:
+		return "sequential read"
+	case RandomRead:
+		return "random read"
+	case SequentialWrite:
+		return "sequential write"
+	case RandomWrite:
+		return "random write"
+	default:
+		return fmt.Sprintf("unknown pattern %d", int(p))
+	}
+}
+
+// isWrite whether the pattern writes, else it reads
+func (p BenchmarkPattern) isWrite() bool {
+	return p == SequentialWrite || p == RandomWrite
+}
+
+const (
+	// defaultBenchmarkSize how much of the disk a benchmark covers by default
+	defaultBenchmarkSize int64 = 64 * 1024 * 1024
+)
+
+// defaultBenchmarkBlockSizes the block sizes a benchmark tries by default, every power of 2 from 4 KiB to 4 MiB
+var defaultBenchmarkBlockSizes = []int64{
+	4 * 1024, 8 * 1024, 16 * 1024, 32 * 1024, 64 * 1024, 128 * 1024, 256 * 1024, 512 * 1024,
+	1024 * 1024, 2 * 1024 * 1024, 4 * 1024 * 1024,
+}
+
+// BenchmarkOptions what Benchmark measures, and where on the disk
+type BenchmarkOptions struct {
+	// Offset where the region of the disk to benchmark starts, in bytes. It must be a multiple of the logical
+	// block size.
+	Offset int64
+	// Size how many bytes of the region each pattern reads or writes at each block size. If 0, it is 64 MiB, or
+	// what is left of the disk after Offset if that is less.
+	Size int64
+	// BlockSizes the sizes of the reads and writes to try, each a multiple of the logical block size and no more
+	// than Size. If empty, it is every power of 2 from 4 KiB to 4 MiB that fits.
+	BlockSizes []int64
+	// Patterns the patterns to try. If empty, it is SequentialRead and RandomRead; the write patterns overwrite
+	// the region with random data, so must be asked for.
+	Patterns []BenchmarkPattern
+}
+
+// BenchmarkResult what one pattern at one block size measured
+type BenchmarkResult struct {
+	Pattern   BenchmarkPattern
+	BlockSize int64
+	// Operations how many reads or writes there were, each of BlockSize bytes
+	Operations int
+	Duration   time.Duration
+}
+
+// Throughput the bytes per second read or written
+func (r BenchmarkResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.BlockSize) * float64(r.Operations) / r.Duration.Seconds()
+}
+
+// IOPS the reads or writes per second
+func (r BenchmarkResult) IOPS() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Operations) / r.Duration.Seconds()
+}
+
+// Benchmark time reads and writes of the disk with each of the patterns and block sizes in options, one at a time,
+// i.e. at a queue depth of 1, as a tool that writes an image does. The results are in the order of the patterns,
+// then of the block sizes, so that the tool can pick the block size that suits the disk best, see BestBlockSize.
+//
+// Reads may be served from the cache of the operating system, rather than the device, unless it was opened for
+// direct I/O. Writes are synced to the device before their time is taken, where the backend has a file to sync;
+// they destroy what was in the region, so only ask for them on a disk that is about to be written anyway.
+func (d *Disk) Benchmark(options BenchmarkOptions) ([]BenchmarkResult, error) {
+	blocksize := d.LogicalBlocksize
+	if blocksize <= 0 {
+		blocksize = 512
+	}
+	if options.Offset < 0 || options.Offset%blocksize != 0 {
+		return nil, fmt.Errorf("offset %d is not a multiple of the logical block size %d", options.Offset, blocksize)
+	}
+	if options.Offset >= d.Size {
+		return nil, fmt.Errorf("offset %d is beyond the end of the disk of %d bytes", options.Offset, d.Size)
+	}
+	size := options.Size
+	if size == 0 {
+		size = min(defaultBenchmarkSize, d.Size-options.Offset)
+	}
+	if size < 0 || options.Offset+size > d.Size {
+		return nil, fmt.Errorf("region of %d bytes at offset %d does not fit on the disk of %d bytes", size, options.Offset, d.Size)
+	}
+	blockSizes := options.BlockSizes
+	if len(blockSizes) == 0 {
+		for _, bs := range defaultBenchmarkBlockSizes {
+			if bs <= size && bs%blocksize == 0 {
+				blockSizes = append(blockSizes, bs)
+			}
+		}
+		if len(blockSizes) == 0 {
+			return nil, fmt.Errorf("region of %d bytes is too small to benchmark", size)
+		}
+	}
+	for _, bs := range blockSizes {
+		if bs <= 0 || bs%blocksize != 0 {
+			return nil, fmt.Errorf("block size %d is not a multiple of the logical block size %d", bs, blocksize)
+		}
+		if bs > size {
+			return nil, fmt.Errorf("block size %d is larger than the region of %d bytes", bs, size)
+		}
+	}
+	patterns := options.Patterns
+	if len(patterns) == 0 {
+		patterns = []BenchmarkPattern{SequentialRead, RandomRead}
+	}
+
+	results := make([]BenchmarkResult, 0, len(patterns)*len(blockSizes))
+	for _, p := range patterns {
+		for _, bs := range blockSizes {
+			r, err := d.benchmark(p, options.Offset, size, bs)
+			if err != nil {
+				return nil, fmt.Errorf("error benchmarking %s of %d byte blocks: %v", p, bs, err)
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// benchmark time a single pattern at a single block size, over size bytes at offset
+func (d *Disk) benchmark(p BenchmarkPattern, offset, size, blockSize int64) (BenchmarkResult, error) {
+	r := BenchmarkResult{Pattern: p, BlockSize: blockSize, Operations: int(size / blockSize)}
+	b := make([]byte, blockSize)
+	// the same places every time, so that runs can be compared
+	rng := rand.New(rand.NewPCG(uint64(blockSize), uint64(p)))
+	at := func(i int) int64 {
+		if p == RandomRead || p == RandomWrite {
+			return offset + rng.Int64N(size/blockSize)*blockSize
+		}
+		return offset + int64(i)*blockSize
+	}
+
+	if !p.isWrite() {
+		start := time.Now()
+		for i := 0; i < r.Operations; i++ {
+			if _, err := d.Backend.ReadAt(b, at(i)); err != nil {
+				return r, err
+			}
+		}
+		r.Duration = time.Since(start)
+		return r, nil
+	}
+
+	w, err := d.Backend.Writable()
+	if err != nil {
+		return r, err
+	}
+	// random, so that a device that compresses or deduplicates cannot take a shortcut
+	for i := range b {
+		b[i] = byte(rng.Uint32())
+	}
+	start := time.Now()
+	for i := 0; i < r.Operations; i++ {
+		if _, err := w.WriteAt(b, at(i)); err != nil {
+			return r, err
+		}
+	}
+	if f, err := d.Backend.Sys(); err == nil && f != nil {
+		if err := f.Sync(); err != nil {
+			return r, err
+		}
+	}
+	r.Duration = time.Since(start)
+	return r, nil
+}
+
+// BestBlockSize the block size with the highest throughput for the pattern in results, or 0 if there is no
+// result for it
+func BestBlockSize(results []BenchmarkResult, p BenchmarkPattern) int64 {
+	var (
+		best       int64
+		throughput float64
+	)
+	for _, r := range results {
+		if r.Pattern == p && (best == 0 || r.Throughput() > throughput) {
+			best, throughput = r.BlockSize, r.Throughput()
+		}
+	}
+	return best
+}
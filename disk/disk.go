@@ -10,12 +10,20 @@ import (
 	"io"
 
 	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/disk/formats/luks"
 	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/erofs"
+	"github.com/diskfs/go-diskfs/filesystem/exfat"
 	"github.com/diskfs/go-diskfs/filesystem/ext4"
 	"github.com/diskfs/go-diskfs/filesystem/fat32"
 	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/diskfs/go-diskfs/filesystem/ntfs"
 	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+	"github.com/diskfs/go-diskfs/filesystem/udf"
+	"github.com/diskfs/go-diskfs/filesystem/xfs"
 	"github.com/diskfs/go-diskfs/partition"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -29,6 +37,10 @@ type Disk struct {
 	DefaultBlocks     bool
 }
 
+// ErrEncrypted is returned by GetFilesystem for a partition that is encrypted, such as a LUKS volume, whose
+// filesystem can only be read once it is unlocked, e.g. with luks.Open
+var ErrEncrypted = errors.New("partition is encrypted")
+
 // Type represents the type of disk this is
 type Type int
 
@@ -75,6 +87,57 @@ func (d *Disk) Partition(table partition.Table) error {
 	return d.ReReadPartitionTable()
 }
 
+// ConvertTable converts the partition table of the Disk to one of type to, as gdisk does, keeping the number,
+// start and size of every partition, and writes it in place of the old one
+//
+// Converting an MBR to a GPT replaces the MBR with a protective one, and needs room for the GPT at the start
+// and end of the disk. Converting a GPT to an MBR erases both copies of the GPT, and only works if it has at most
+// 4 partitions, all within the first 2^32 sectors. See gpt.FromMBR and gpt.Table.ToMBR for how types are mapped.
+// The boot code of the MBR is kept either way. Converting to the type the table already has does nothing.
+func (d *Disk) ConvertTable(to partition.Type) error {
+	table := d.Table
+	if table == nil {
+		var err error
+		if table, err = d.GetPartitionTable(); err != nil {
+			return fmt.Errorf("cannot convert partition table: %w", err)
+		}
+	}
+	if partition.Type(table.Type()) == to {
+		return nil
+	}
+	var converted partition.Table
+	switch t := table.(type) {
+	case *mbr.Table:
+		if to != partition.TypeGPT {
+			return fmt.Errorf("cannot convert partition table to unknown type %s", to)
+		}
+		g, err := gpt.FromMBR(t)
+		if err != nil {
+			return fmt.Errorf("cannot convert MBR to GPT: %w", err)
+		}
+		converted = g
+	case *gpt.Table:
+		if to != partition.TypeMBR {
+			return fmt.Errorf("cannot convert partition table to unknown type %s", to)
+		}
+		m, err := t.ToMBR()
+		if err != nil {
+			return fmt.Errorf("cannot convert GPT to MBR: %w", err)
+		}
+		rwBackingFile, err := d.Backend.Writable()
+		if err != nil {
+			return err
+		}
+		if err := t.Erase(rwBackingFile); err != nil {
+			return fmt.Errorf("failed to erase GPT: %w", err)
+		}
+		converted = m
+	default:
+		return fmt.Errorf("cannot convert partition table of type %s", table.Type())
+	}
+	return d.Partition(converted)
+}
+
 // WritePartitionContents writes the contents of an io.Reader to a given partition
 //
 // if successful, returns the number of bytes written
@@ -176,8 +239,10 @@ func (d *Disk) CreateFilesystem(spec FilesystemSpec) (filesystem.FileSystem, err
 		return iso9660.Create(d.Backend, size, start, d.LogicalBlocksize, spec.WorkDir)
 	case filesystem.TypeExt4:
 		return ext4.Create(d.Backend, size, start, d.LogicalBlocksize, nil)
-	case filesystem.TypeSquashfs:
+	case filesystem.TypeSquashfs, filesystem.TypeErofs:
 		return nil, filesystem.ErrReadonlyFilesystem
+	case filesystem.TypeExFAT:
+		return exfat.Create(d.Backend, size, start, d.LogicalBlocksize, spec.VolumeLabel)
 	default:
 		return nil, errors.New("unknown filesystem type requested")
 	}
@@ -190,7 +255,7 @@ func (d *Disk) CreateFilesystem(spec FilesystemSpec) (filesystem.FileSystem, err
 // if successful, returns a filesystem-implementing structure for the given filesystem type
 //
 // returns error if there was an error reading the filesystem, or the partition table is invalid and did not
-// request the entire disk.
+// request the entire disk, and one wrapping ErrEncrypted if the partition is an encrypted volume.
 func (d *Disk) GetFilesystem(part int) (filesystem.FileSystem, error) {
 	// find out where the partition starts and ends, or if it is the entire disk
 	var (
@@ -214,6 +279,11 @@ func (d *Disk) GetFilesystem(part int) (filesystem.FileSystem, error) {
 		start = partitions[part-1].GetStart()
 	}
 
+	// no filesystem is recognizable in an encrypted volume
+	if h, err := luks.ReadHeader(d.Backend, start); err == nil {
+		return nil, fmt.Errorf("partition %d is a LUKS%d volume %s: %w", part, h.Version, h.UUID, ErrEncrypted)
+	}
+
 	// just try each type
 	log.Debug("trying fat32")
 	fat32FS, err := fat32.Read(d.Backend, size, start, d.LogicalBlocksize)
@@ -221,26 +291,61 @@ func (d *Disk) GetFilesystem(part int) (filesystem.FileSystem, error) {
 		return fat32FS, nil
 	}
 	log.Debugf("fat32 failed: %v", err)
+	log.Debug("trying exfat")
+	exfatFS, err := exfat.Read(d.Backend, size, start, d.LogicalBlocksize)
+	if err == nil {
+		return exfatFS, nil
+	}
+	log.Debugf("exfat failed: %v", err)
 	pbs := d.PhysicalBlocksize
 	if d.DefaultBlocks {
 		pbs = 0
 	}
+	// a UDF bridge image is an ISO9660 one as well, so try UDF first, as blkid does
+	log.Debugf("trying udf with physical block size %d", pbs)
+	udfFS, err := udf.Read(d.Backend, size, start, pbs)
+	if err == nil {
+		return udfFS, nil
+	}
+	log.Debugf("udf failed: %v", err)
 	log.Debugf("trying iso9660 with physical block size %d", pbs)
 	iso9660FS, err := iso9660.Read(d.Backend, size, start, pbs)
 	if err == nil {
 		return iso9660FS, nil
 	}
 	log.Debugf("iso9660 failed: %v", err)
-	squashFS, err := squashfs.Read(d.Backend, size, start, d.LogicalBlocksize)
+	// the squashfs block size is in its superblock, and is never as small as a disk sector
+	log.Debug("trying squashfs")
+	squashFS, err := squashfs.Read(d.Backend, size, start, 0)
 	if err == nil {
 		return squashFS, nil
 	}
+	log.Debugf("squashfs failed: %v", err)
+	// as is the erofs one
+	log.Debug("trying erofs")
+	erofsFS, err := erofs.Read(d.Backend, size, start, 0)
+	if err == nil {
+		return erofsFS, nil
+	}
+	log.Debugf("erofs failed: %v", err)
 	log.Debug("trying ext4")
 	ext4FS, err := ext4.Read(d.Backend, size, start, d.LogicalBlocksize)
 	if err == nil {
 		return ext4FS, nil
 	}
 	log.Debugf("ext4 failed: %v", err)
+	log.Debug("trying xfs")
+	xfsFS, err := xfs.Read(d.Backend, size, start, d.LogicalBlocksize)
+	if err == nil {
+		return xfsFS, nil
+	}
+	log.Debugf("xfs failed: %v", err)
+	log.Debug("trying ntfs")
+	ntfsFS, err := ntfs.Read(d.Backend, size, start, d.LogicalBlocksize)
+	if err == nil {
+		return ntfsFS, nil
+	}
+	log.Debugf("ntfs failed: %v", err)
 	return nil, fmt.Errorf("unknown filesystem on partition %d", part)
 }
 
@@ -12,9 +12,11 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
@@ -178,6 +180,101 @@ func TestPartition(t *testing.T) {
 	})
 }
 
+func TestConvertTable(t *testing.T) {
+	f, err := tmpDisk("")
+	if err != nil {
+		t.Fatalf("error creating new temporary disk: %v", err)
+	}
+	defer f.Close()
+	if keepTmpFiles {
+		defer os.Remove(f.Name())
+	} else {
+		fmt.Println(f.Name())
+	}
+	// boot code, which is kept through both conversions
+	bootCode := bytes.Repeat([]byte{0x90}, 440)
+	if _, err := f.WriteAt(bootCode, 0); err != nil {
+		t.Fatalf("error writing boot code: %v", err)
+	}
+
+	d := &disk.Disk{
+		Backend:           file.New(f, false),
+		LogicalBlocksize:  512,
+		PhysicalBlocksize: 512,
+		Size:              10 * 1024 * 1024,
+	}
+	original := &mbr.Table{
+		Partitions: []*mbr.Partition{
+			{Bootable: true, Type: mbr.Fat32LBA, Start: 2048, Size: 4096},
+			{Type: mbr.Empty},
+			{Type: mbr.Linux, Start: 6144, Size: 8192},
+		},
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+	}
+	if err := d.Partition(original); err != nil {
+		t.Fatalf("error writing MBR: %v", err)
+	}
+
+	if err := d.ConvertTable(partition.TypeGPT); err != nil {
+		t.Fatalf("error converting to GPT: %v", err)
+	}
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		t.Fatalf("error reading converted table: %v", err)
+	}
+	g, ok := table.(*gpt.Table)
+	if !ok {
+		t.Fatalf("converted table is %s instead of gpt", table.Type())
+	}
+	// the empty entry is not read
+	if len(g.Partitions) != 2 || g.Partitions[0].Type != gpt.MicrosoftBasicData || g.Partitions[0].Attributes != gpt.LegacyBIOSBootable ||
+		g.Partitions[1].Type != gpt.LinuxFilesystem || g.Partitions[1].Start != 6144 || g.Partitions[1].End != 6144+8192-1 {
+		t.Errorf("unexpected partitions of converted GPT %v", g.Partitions)
+	}
+	if err := d.ConvertTable(partition.TypeGPT); err != nil {
+		t.Errorf("error converting to the type it already has: %v", err)
+	}
+
+	if err := d.ConvertTable(partition.TypeMBR); err != nil {
+		t.Fatalf("error converting back to MBR: %v", err)
+	}
+	table, err = d.GetPartitionTable()
+	if err != nil {
+		t.Fatalf("error reading converted table: %v", err)
+	}
+	m, ok := table.(*mbr.Table)
+	if !ok {
+		t.Fatalf("converted table is %s instead of mbr", table.Type())
+	}
+	original.Partitions = append(original.Partitions, &mbr.Partition{Type: mbr.Empty})
+	if !m.Equal(original) {
+		t.Errorf("converting to GPT and back gave partitions %v instead of %v", m.Partitions, original.Partitions)
+	}
+	b := make([]byte, 440)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading boot code: %v", err)
+	}
+	if !bytes.Equal(b, bootCode) {
+		t.Errorf("boot code was not kept")
+	}
+
+	// a GPT with more partitions than an MBR has cannot be converted, and is left as it is
+	many := &gpt.Table{LogicalSectorSize: 512, PhysicalSectorSize: 512, ProtectiveMBR: true}
+	for i := range 5 {
+		many.Partitions = append(many.Partitions, &gpt.Partition{Start: uint64(2048 + i*2048), Size: 1024 * 1024, Type: gpt.LinuxFilesystem})
+	}
+	if err := d.Partition(many); err != nil {
+		t.Fatalf("error writing GPT: %v", err)
+	}
+	if err := d.ConvertTable(partition.TypeMBR); err == nil {
+		t.Errorf("no error converting GPT with 5 partitions to MBR")
+	}
+	if table, err := d.GetPartitionTable(); err != nil || table.Type() != "gpt" {
+		t.Errorf("GPT was not left as it was after failed conversion: %v", err)
+	}
+}
+
 func TestWritePartitionContents(t *testing.T) {
 	t.Run("gpt", func(t *testing.T) {
 		oneMB := uint64(1024 * 1024)
@@ -490,6 +587,48 @@ func TestCreateFilesystem(t *testing.T) {
 			t.Errorf("returned filesystem was unexpectedly nil")
 		}
 	})
+	t.Run("exfat partition", func(t *testing.T) {
+		f, err := tmpDisk("../partition/mbr/testdata/mbr.img")
+		if err != nil {
+			t.Fatalf("error creating new temporary disk: %v", err)
+		}
+		defer f.Close()
+
+		if keepTmpFiles {
+			defer os.Remove(f.Name())
+		} else {
+			fmt.Println(f.Name())
+		}
+
+		fileInfo, err := f.Stat()
+		if err != nil {
+			t.Fatalf("error reading info on temporary disk: %v", err)
+		}
+
+		table := &mbr.Table{
+			Partitions: []*mbr.Partition{
+				{Start: 2048, Size: 20480},
+			},
+			LogicalSectorSize: 512,
+		}
+		d := &disk.Disk{
+			Backend:           file.New(f, false),
+			LogicalBlocksize:  512,
+			PhysicalBlocksize: 512,
+			Size:              fileInfo.Size(),
+			Table:             table,
+		}
+		if _, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeExFAT, VolumeLabel: "DATA"}); err != nil {
+			t.Fatalf("error unexpectedly not nil:  %v", err)
+		}
+		fs, err := d.GetFilesystem(1)
+		if err != nil {
+			t.Fatalf("error reading filesystem: %v", err)
+		}
+		if fs.Type() != filesystem.TypeExFAT || fs.Label() != "DATA" {
+			t.Errorf("read filesystem of type %v with label %q instead of exFAT with label %q", fs.Type(), fs.Label(), "DATA")
+		}
+	})
 	t.Run("readonly", func(t *testing.T) {
 		d := &disk.Disk{
 			Backend: file.New(&testhelper.FileImpl{}, true),
@@ -616,3 +755,265 @@ func TestGetFilesystem(t *testing.T) {
 		}
 	})
 }
+
+func TestSummary(t *testing.T) {
+	const mb = 1024 * 1024
+	t.Run("partitions", func(t *testing.T) {
+		f, err := os.CreateTemp("", "disk_test")
+		if err != nil {
+			t.Fatalf("error creating new temporary disk: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size := int64(40 * mb)
+		if err := f.Truncate(size); err != nil {
+			t.Fatalf("error sizing temporary disk: %v", err)
+		}
+
+		d := &disk.Disk{
+			Backend:           file.New(f, false),
+			LogicalBlocksize:  512,
+			PhysicalBlocksize: 512,
+			Size:              size,
+		}
+		table := &gpt.Table{
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+			Partitions: []*gpt.Partition{
+				{Start: 2048, End: 2048 + 20*2048 - 1, Type: gpt.EFISystemPartition, Name: "EFI"},
+				// exactly the size of the squashfs image
+				{Start: 2048 + 20*2048, End: 2048 + 20*2048 + 10256 - 1, Type: gpt.LinuxFilesystem, Name: "squash"},
+				{Start: 2048 + 28*2048, End: 2048 + 30*2048 - 1, Type: gpt.LinuxFilesystem, Name: "blank"},
+			},
+		}
+		if err := d.Partition(table); err != nil {
+			t.Fatalf("error partitioning disk: %v", err)
+		}
+		fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "SUMMARY"})
+		if err != nil {
+			t.Fatalf("error creating filesystem: %v", err)
+		}
+		if err := fs.Mkdir("/data"); err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		squashfsImage, err := os.ReadFile("../filesystem/squashfs/testdata/file.sqs")
+		if err != nil {
+			t.Fatalf("error reading squashfs image: %v", err)
+		}
+		if _, err := d.WritePartitionContents(2, bytes.NewReader(squashfsImage)); err != nil {
+			t.Fatalf("error writing squashfs partition: %v", err)
+		}
+
+		summaries := d.Summary()
+		if len(summaries) != 3 {
+			t.Fatalf("mismatched number of summaries, actual %d expected 3", len(summaries))
+		}
+		efi, squash, blank := summaries[0], summaries[1], summaries[2]
+		if efi.Partition != 1 || efi.Start != 2048*512 || efi.Size != 20*mb || efi.PartitionUUID != table.Partitions[0].GUID {
+			t.Errorf("mismatched partition details for partition 1: %+v", efi)
+		}
+		if !efi.HasFilesystem || efi.FSType != filesystem.TypeFat32 || efi.Label != "SUMMARY" {
+			t.Errorf("mismatched filesystem details for partition 1: %+v", efi)
+		}
+		if !regexp.MustCompile(`^[0-9A-F]{4}-[0-9A-F]{4}$`).MatchString(efi.UUID) {
+			t.Errorf("invalid FAT32 volume serial %q", efi.UUID)
+		}
+		if efi.Usage.Size != efi.Size || efi.Usage.Free <= 0 || efi.Usage.Free >= efi.Size {
+			t.Errorf("invalid usage for partition 1: %+v", efi.Usage)
+		}
+		if !squash.HasFilesystem || squash.FSType != filesystem.TypeSquashfs || squash.Usage.Size > int64(len(squashfsImage)) || squash.Usage.Free != 0 {
+			t.Errorf("mismatched filesystem details for partition 2: %+v", squash)
+		}
+		if blank.Partition != 3 || blank.HasFilesystem || blank.FSType.String() != "vfat" {
+			t.Errorf("mismatched details for partition 3 without filesystem: %+v", blank)
+		}
+	})
+	t.Run("whole disk", func(t *testing.T) {
+		f, err := tmpDisk("")
+		if err != nil {
+			t.Fatalf("error creating new temporary disk: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		fileInfo, err := f.Stat()
+		if err != nil {
+			t.Fatalf("error reading info on temporary disk: %v", err)
+		}
+		d := &disk.Disk{
+			Backend:           file.New(f, false),
+			LogicalBlocksize:  512,
+			PhysicalBlocksize: 512,
+			Size:              fileInfo.Size(),
+		}
+		if _, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeFat32}); err != nil {
+			t.Fatalf("error creating filesystem: %v", err)
+		}
+		summaries := d.Summary()
+		if len(summaries) != 1 || summaries[0].Partition != 0 || !summaries[0].HasFilesystem || summaries[0].Size != fileInfo.Size() {
+			t.Errorf("mismatched summary of whole disk: %+v", summaries)
+		}
+	})
+}
+
+func TestBenchmark(t *testing.T) {
+	f, err := tmpDisk("")
+	if err != nil {
+		t.Fatalf("error creating new temporary disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	d := &disk.Disk{
+		Backend:           file.New(f, false),
+		LogicalBlocksize:  512,
+		PhysicalBlocksize: 512,
+		Size:              10 * 1024 * 1024,
+	}
+	region := make([]byte, 1024*1024)
+	readRegion := func() []byte {
+		t.Helper()
+		b := make([]byte, len(region))
+		if _, err := f.ReadAt(b, 1024*1024); err != nil {
+			t.Fatalf("error reading disk: %v", err)
+		}
+		return b
+	}
+
+	t.Run("read", func(t *testing.T) {
+		results, err := d.Benchmark(disk.BenchmarkOptions{Offset: 1024 * 1024, Size: 1024 * 1024})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// 4 KiB to 1 MiB, for each of the two read patterns
+		if len(results) != 2*9 {
+			t.Fatalf("%d results instead of %d", len(results), 2*9)
+		}
+		for i, r := range results {
+			pattern := disk.SequentialRead
+			if i >= 9 {
+				pattern = disk.RandomRead
+			}
+			blockSize := int64(4096) << (i % 9)
+			if r.Pattern != pattern || r.BlockSize != blockSize || int64(r.Operations)*r.BlockSize != 1024*1024 {
+				t.Errorf("mismatched result %d: %+v", i, r)
+			}
+		}
+		if best := disk.BestBlockSize(results, disk.RandomRead); best == 0 {
+			t.Errorf("no best block size for random reads")
+		}
+		if best := disk.BestBlockSize(results, disk.SequentialWrite); best != 0 {
+			t.Errorf("best block size %d for writes that were not benchmarked", best)
+		}
+		if !bytes.Equal(readRegion(), region) {
+			t.Errorf("read benchmark changed the disk")
+		}
+	})
+	t.Run("write", func(t *testing.T) {
+		options := disk.BenchmarkOptions{
+			Offset:     1024 * 1024,
+			Size:       1024 * 1024,
+			BlockSizes: []int64{512, 64 * 1024},
+			Patterns:   []disk.BenchmarkPattern{disk.SequentialWrite, disk.RandomWrite},
+		}
+		results, err := d.Benchmark(options)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(results) != 4 || results[0].Operations != 2048 || results[3].Operations != 16 {
+			t.Errorf("mismatched results: %+v", results)
+		}
+		if bytes.Equal(readRegion(), region) {
+			t.Errorf("write benchmark did not write to the disk")
+		}
+		// nothing outside the region
+		b := make([]byte, 1024*1024)
+		for _, off := range []int64{0, 2 * 1024 * 1024} {
+			if _, err := f.ReadAt(b, off); err != nil {
+				t.Fatalf("error reading disk: %v", err)
+			}
+			if !bytes.Equal(b, region) {
+				t.Errorf("write benchmark wrote outside the region at %d", off)
+			}
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, options := range []disk.BenchmarkOptions{
+			{Offset: 100},
+			{Offset: 10 * 1024 * 1024},
+			{Offset: 9 * 1024 * 1024, Size: 2 * 1024 * 1024},
+			{BlockSizes: []int64{1000}},
+			{Size: 4096, BlockSizes: []int64{8192}},
+		} {
+			if _, err := d.Benchmark(options); err == nil {
+				t.Errorf("no error for options %+v", options)
+			}
+		}
+	})
+}
+
+func TestCopySparse(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	dir := t.TempDir()
+	src, err := file.CreateFromPath(path.Join(dir, "src.img"), size)
+	if err != nil {
+		t.Fatalf("error creating source: %v", err)
+	}
+	defer src.Close()
+	w, err := src.Writable()
+	if err != nil {
+		t.Fatalf("error getting writable source: %v", err)
+	}
+	data := make([]byte, 100*1024)
+	_, _ = rand.Read(data)
+	// data, written zeroes that are copied as a hole, and data at the very end
+	for off, b := range map[int64][]byte{1024*1024 + 10: data, 3 * 1024 * 1024: make([]byte, 1024*1024), size - 1000: data[:1000]} {
+		if _, err := w.WriteAt(b, off); err != nil {
+			t.Fatalf("error writing source: %v", err)
+		}
+	}
+	d := &disk.Disk{Backend: src, Size: size, LogicalBlocksize: 512, PhysicalBlocksize: 512}
+
+	// an empty file, which is extended, and one full of data, whose holes are punched
+	for name, contents := range map[string][]byte{"empty": nil, "full": bytes.Repeat([]byte{0xaa}, size)} {
+		t.Run(name, func(t *testing.T) {
+			p := path.Join(dir, name+".img")
+			if err := os.WriteFile(p, contents, 0o600); err != nil {
+				t.Fatalf("error writing destination: %v", err)
+			}
+			dst, err := file.OpenFromPath(p, false)
+			if err != nil {
+				t.Fatalf("error opening destination: %v", err)
+			}
+			defer dst.Close()
+			written, err := d.CopySparse(dst)
+			if err != nil {
+				t.Fatalf("error copying: %v", err)
+			}
+			// the blocks that hold the data, but not the zeroes
+			if written < int64(len(data)+1000) || written > int64(len(data)+1000+3*4096) {
+				t.Errorf("wrote %d bytes of data, not just the %d bytes of data", written, len(data)+1000)
+			}
+			expected, err := os.ReadFile(path.Join(dir, "src.img"))
+			if err != nil {
+				t.Fatalf("error reading source: %v", err)
+			}
+			actual, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatalf("error reading destination: %v", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("copy did not match source")
+			}
+			// where the filesystem has holes, the zeroes that were written to the source are a hole in the copy
+			if allocated, _ := src.(backend.AllocationReporter).Allocated(5*1024*1024, 1024*1024); allocated {
+				t.Skip("filesystem does not report holes")
+			}
+			allocated, err := dst.(backend.AllocationReporter).Allocated(3*1024*1024, 1024*1024)
+			if err != nil {
+				t.Fatalf("error getting allocation: %v", err)
+			}
+			if allocated {
+				t.Errorf("zeroes were copied as data rather than as a hole")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package luks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/xts"
+)
+
+// sectorCipher decrypts sectors, each with the IV that its number gives it
+type sectorCipher interface {
+	decrypt(dst, src []byte, sector uint64)
+}
+
+// hashFunc the hash that LUKS names name
+func hashFunc(name string) (func() hash.Hash, error) {
+	switch strings.ToLower(name) {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported hash %s", name)
+	}
+}
+
+// newSectorCipher a cipher for the cryptsetup cipher spec, e.g. aes-xts-plain64, with the given key
+func newSectorCipher(spec string, key []byte) (sectorCipher, error) {
+	parts := strings.SplitN(spec, "-", 3)
+	if len(parts) != 3 || parts[0] != "aes" {
+		return nil, fmt.Errorf("unsupported cipher %s", spec)
+	}
+	mode, iv := parts[1], parts[2]
+	switch mode {
+	case "xts":
+		if iv != "plain64" && iv != "plain" {
+			return nil, fmt.Errorf("unsupported IV %s for cipher %s", iv, spec)
+		}
+		c, err := xts.NewCipher(aes.NewCipher, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for cipher %s: %w", spec, err)
+		}
+		return &xtsCipher{c: c, plain32: iv == "plain"}, nil
+	case "cbc":
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for cipher %s: %w", spec, err)
+		}
+		c := &cbcCipher{block: block}
+		switch iv {
+		case "plain64":
+		case "plain":
+			c.plain32 = true
+		case "essiv:sha256":
+			salt := sha256.Sum256(key)
+			if c.essiv, err = aes.NewCipher(salt[:]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported IV %s for cipher %s", iv, spec)
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", spec)
+	}
+}
+
+// xtsCipher AES in XTS mode, whose tweak is the sector number, as the plain64 IV is, or its lower 32 bits for plain
+type xtsCipher struct {
+	c       *xts.Cipher
+	plain32 bool
+}
+
+func (x *xtsCipher) decrypt(dst, src []byte, sector uint64) {
+	if x.plain32 {
+		sector = uint64(uint32(sector))
+	}
+	x.c.Decrypt(dst, src, sector)
+}
+
+// cbcCipher AES in CBC mode, whose IV is the little-endian sector number, or its lower 32 bits for plain, or, for
+// essiv, that encrypted with the hash of the key
+type cbcCipher struct {
+	block   cipher.Block
+	plain32 bool
+	essiv   cipher.Block
+}
+
+func (c *cbcCipher) decrypt(dst, src []byte, sector uint64) {
+	iv := make([]byte, aes.BlockSize)
+	if c.plain32 {
+		binary.LittleEndian.PutUint32(iv, uint32(sector))
+	} else {
+		binary.LittleEndian.PutUint64(iv, sector)
+	}
+	if c.essiv != nil {
+		c.essiv.Encrypt(iv, iv)
+	}
+	cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(dst, src)
+}
@@ -0,0 +1,24 @@
+// Package luks reads LUKS volumes, the format that cryptsetup uses for dm-crypt encrypted partitions and disks.
+//
+// ReadHeader recognizes a LUKS1 or LUKS2 header, and returns its metadata: the version, UUID, label, cipher and
+// key slots, and where the encrypted payload is. It returns ErrNotLUKS for anything else, so it can be used
+// to detect LUKS before trying to read a filesystem.
+//
+// Open unlocks a volume with a passphrase, or with the contents of a keyfile, which cryptsetup uses in the same
+// way. The Volume it returns is a read-only backend.Storage of the decrypted payload, so the filesystem in it can be
+// read with the filesystem packages as any other:
+//
+//	v, err := luks.Open(d.Backend, size, start, []byte("passphrase"))
+//	...
+//	fs, err := ext4.Read(v, v.Size(), 0, 512)
+//
+// Key slots derive their keys with PBKDF2, argon2i or argon2id, with SHA-1, SHA-256 or SHA-512. The payload may be
+// encrypted with AES in XTS mode with plain64 or plain IVs, the default of cryptsetup for both versions, or in CBC
+// mode with plain64, plain or essiv:sha256 IVs, the default of older LUKS1 volumes. LUKS2 volumes with more than one
+// segment, such as those that are being reencrypted, and those with integrity protection are not supported.
+//
+// references:
+//
+//	https://gitlab.com/cryptsetup/cryptsetup/-/wikis/LUKS-standard/on-disk-format.pdf
+//	https://gitlab.com/cryptsetup/LUKS2-docs/-/blob/main/luks2_doc_wip.pdf
+package luks
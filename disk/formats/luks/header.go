@@ -0,0 +1,454 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+const (
+	headerMagic          = "LUKS\xba\xbe"
+	secondaryHeaderMagic = "SKUL\xba\xbe"
+	// luks1HeaderSize the size of a LUKS1 header, with its key slots, but not their key material
+	luks1HeaderSize = 592
+	luks1Keyslots   = 8
+	// luks1KeyslotEnabled the value of the active field of a key slot that holds a key
+	luks1KeyslotEnabled = 0x00ac71f3
+	// luks2BinaryHeaderSize the size of the binary header of LUKS2, which the JSON area follows
+	luks2BinaryHeaderSize = 4096
+	// maxLUKS2HeaderSize the largest size of a LUKS2 header, binary header and JSON area, that the specification allows
+	maxLUKS2HeaderSize = 4 * 1024 * 1024
+	// luks2ChecksumOffset where the checksum of the header is in the binary header, and luks2ChecksumSize its size
+	luks2ChecksumOffset = 448
+	luks2ChecksumSize   = 64
+	// sectorSize the size of the sectors that key material is encrypted in, and of the payload of LUKS1
+	sectorSize = 512
+)
+
+// ErrNotLUKS is returned by ReadHeader and Open for storage that does not start with a LUKS header
+var ErrNotLUKS = errors.New("not a LUKS volume")
+
+// ErrWrongKey is returned by Open when the passphrase or keyfile unlocks none of the key slots
+var ErrWrongKey = errors.New("no key slot can be unlocked with this key")
+
+// luks2SecondaryOffsets where the secondary header of LUKS2 may be, as it is after the primary one, whose size may be
+// any of these, and which is what is left to find it by when the primary one is damaged
+var luks2SecondaryOffsets = []int64{
+	0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000,
+}
+
+// Header the metadata of a LUKS volume, as ReadHeader reads it
+type Header struct {
+	// Version 1 or 2
+	Version int
+	UUID    string
+	// Label and Subsystem, which only LUKS2 has
+	Label     string
+	Subsystem string
+	// Cipher what the payload is encrypted with, as cryptsetup names it, e.g. aes-xts-plain64
+	Cipher string
+	// KeySize the size of the volume key, in bytes, e.g. 64 for aes-xts with a 256 bit key for each of its two halves
+	KeySize int
+	// PayloadOffset where the encrypted payload starts, in bytes from the start of the header
+	PayloadOffset int64
+	// PayloadSize the size of the payload in bytes, or 0 if it extends to the end of the partition or disk
+	PayloadSize int64
+	// SectorSize the size of the sectors the payload is encrypted in, 512 for LUKS1 and 512 to 4096 for LUKS2
+	SectorSize int
+	// Keyslots the key slots that hold a key, in order of their index
+	Keyslots []Keyslot
+	digests  []digest
+	ivTweak  uint64
+}
+
+// Keyslot a key slot of a LUKS volume, which holds the volume key encrypted with a key derived from a passphrase
+type Keyslot struct {
+	Index int
+	// KDF how the key is derived from the passphrase: pbkdf2, argon2i or argon2id
+	KDF string
+	// Hash the hash of PBKDF2
+	Hash string
+	// Iterations the iterations of PBKDF2, or the time cost of argon2
+	Iterations int
+	// Memory the memory cost of argon2, in KiB
+	Memory int
+	// Parallelism the number of threads of argon2
+	Parallelism int
+	salt        []byte
+	// keySize the size of the volume key that the slot holds
+	keySize int
+	// where the encrypted key material is, and what it is encrypted with
+	areaOffset  int64
+	areaCipher  string
+	areaKeySize int
+	// stripes and afHash of the anti-forensic split of the key material
+	stripes int
+	afHash  string
+	// priority 0 for a slot that is only tried when asked for, as cryptsetup ignores it otherwise
+	priority int
+}
+
+// digest checks that a volume key unlocked from any of keyslots is the right one
+type digest struct {
+	hash       string
+	iterations int
+	salt       []byte
+	digest     []byte
+	keyslots   []int
+}
+
+// covers whether the digest checks keys from the slot index
+func (d *digest) covers(index int) bool {
+	for _, k := range d.keyslots {
+		if k == index {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadHeader read the LUKS header at start in b, or return ErrNotLUKS if there is none. For LUKS2, the primary and
+// secondary headers are both read, and the one that was written last is used, so either may be damaged.
+func ReadHeader(b backend.File, start int64) (*Header, error) {
+	buf := make([]byte, luks2BinaryHeaderSize)
+	if _, err := b.ReadAt(buf, start); err != nil {
+		return nil, fmt.Errorf("could not read LUKS header: %w", err)
+	}
+	if string(buf[:6]) != headerMagic {
+		// the primary header of LUKS2 may be damaged, with the secondary one intact
+		return readLUKS2Header(b, start, nil)
+	}
+	switch version := binary.BigEndian.Uint16(buf[6:8]); version {
+	case 1:
+		return luks1HeaderFromBytes(buf[:luks1HeaderSize])
+	case 2:
+		return readLUKS2Header(b, start, buf)
+	default:
+		return nil, fmt.Errorf("unsupported LUKS version %d", version)
+	}
+}
+
+// cString a NUL-terminated string in a fixed-size field
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func luks1HeaderFromBytes(b []byte) (*Header, error) {
+	h := &Header{
+		Version:       1,
+		Cipher:        cString(b[8:40]) + "-" + cString(b[40:72]),
+		PayloadOffset: int64(binary.BigEndian.Uint32(b[104:108])) * sectorSize,
+		KeySize:       int(binary.BigEndian.Uint32(b[108:112])),
+		UUID:          cString(b[168:208]),
+		SectorSize:    sectorSize,
+	}
+	hash := cString(b[72:104])
+	h.digests = []digest{{
+		hash:       hash,
+		digest:     bytes.Clone(b[112:132]),
+		salt:       bytes.Clone(b[132:164]),
+		iterations: int(binary.BigEndian.Uint32(b[164:168])),
+	}}
+	for i := 0; i < luks1Keyslots; i++ {
+		s := b[208+i*48 : 208+(i+1)*48]
+		if binary.BigEndian.Uint32(s[0:4]) != luks1KeyslotEnabled {
+			continue
+		}
+		h.Keyslots = append(h.Keyslots, Keyslot{
+			Index:       i,
+			KDF:         "pbkdf2",
+			Hash:        hash,
+			Iterations:  int(binary.BigEndian.Uint32(s[4:8])),
+			salt:        bytes.Clone(s[8:40]),
+			keySize:     h.KeySize,
+			areaOffset:  int64(binary.BigEndian.Uint32(s[40:44])) * sectorSize,
+			areaCipher:  h.Cipher,
+			areaKeySize: h.KeySize,
+			stripes:     int(binary.BigEndian.Uint32(s[44:48])),
+			afHash:      hash,
+			priority:    1,
+		})
+		h.digests[0].keyslots = append(h.digests[0].keyslots, i)
+	}
+	return h, nil
+}
+
+// luks2Header a LUKS2 binary header and its JSON area, as read from disk
+type luks2Header struct {
+	size     int64
+	seqid    uint64
+	label    string
+	uuid     string
+	subsys   string
+	metadata []byte
+}
+
+// readLUKS2Header read the primary LUKS2 header at start, whose first bytes are primary if they have been read, and
+// the secondary one after it, and return the valid one with the highest sequence number. Without a primary header,
+// the secondary one is looked for where the specification allows it to be.
+func readLUKS2Header(b backend.File, start int64, primary []byte) (*Header, error) {
+	var candidates []*luks2Header
+	offsets := luks2SecondaryOffsets
+	if primary != nil {
+		h, err := luks2HeaderFromBytes(b, start, 0, primary)
+		if err == nil {
+			candidates = append(candidates, h)
+		}
+		if size := int64(binary.BigEndian.Uint64(primary[8:16])); validLUKS2HeaderSize(size) {
+			offsets = []int64{size}
+		}
+	}
+	for _, offset := range offsets {
+		buf := make([]byte, luks2BinaryHeaderSize)
+		if _, err := b.ReadAt(buf, start+offset); err != nil || string(buf[:6]) != secondaryHeaderMagic {
+			continue
+		}
+		if h, err := luks2HeaderFromBytes(b, start, offset, buf); err == nil {
+			candidates = append(candidates, h)
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		if primary == nil {
+			return nil, ErrNotLUKS
+		}
+		return nil, errors.New("neither the primary nor the secondary LUKS2 header is valid")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].seqid > candidates[j].seqid })
+	return candidates[0].toHeader()
+}
+
+func validLUKS2HeaderSize(size int64) bool {
+	return size >= luks2SecondaryOffsets[0] && size <= maxLUKS2HeaderSize && size&(size-1) == 0
+}
+
+// luks2HeaderFromBytes check the LUKS2 binary header b at offset, read its JSON area, and check the checksum of both
+func luks2HeaderFromBytes(b backend.File, start, offset int64, buf []byte) (*luks2Header, error) {
+	if binary.BigEndian.Uint16(buf[6:8]) != 2 {
+		return nil, fmt.Errorf("LUKS2 header at %d has version %d", offset, binary.BigEndian.Uint16(buf[6:8]))
+	}
+	size := int64(binary.BigEndian.Uint64(buf[8:16]))
+	if !validLUKS2HeaderSize(size) {
+		return nil, fmt.Errorf("LUKS2 header at %d has invalid size %d", offset, size)
+	}
+	if hdrOffset := int64(binary.BigEndian.Uint64(buf[256:264])); hdrOffset != offset {
+		return nil, fmt.Errorf("LUKS2 header at %d records its offset as %d", offset, hdrOffset)
+	}
+	full := make([]byte, size)
+	copy(full, buf)
+	if _, err := b.ReadAt(full[luks2BinaryHeaderSize:], start+offset+luks2BinaryHeaderSize); err != nil {
+		return nil, fmt.Errorf("could not read JSON area of LUKS2 header at %d: %w", offset, err)
+	}
+	alg := cString(buf[72:104])
+	newHash, err := hashFunc(alg)
+	if err != nil {
+		return nil, fmt.Errorf("LUKS2 header at %d: %w", offset, err)
+	}
+	checksum := bytes.Clone(full[luks2ChecksumOffset : luks2ChecksumOffset+luks2ChecksumSize])
+	clear(full[luks2ChecksumOffset : luks2ChecksumOffset+luks2ChecksumSize])
+	h := newHash()
+	h.Write(full)
+	if !bytes.Equal(h.Sum(nil), checksum[:h.Size()]) {
+		return nil, fmt.Errorf("LUKS2 header at %d has an invalid checksum", offset)
+	}
+	metadata := full[luks2BinaryHeaderSize:]
+	if i := bytes.IndexByte(metadata, 0); i >= 0 {
+		metadata = metadata[:i]
+	}
+	return &luks2Header{
+		size:     size,
+		seqid:    binary.BigEndian.Uint64(buf[16:24]),
+		label:    cString(buf[24:72]),
+		uuid:     cString(buf[168:208]),
+		subsys:   cString(buf[208:256]),
+		metadata: metadata,
+	}, nil
+}
+
+// luks2Metadata the parts of the JSON metadata of LUKS2 that are needed to read a volume
+type luks2Metadata struct {
+	Keyslots map[string]luks2Keyslot `json:"keyslots"`
+	Segments map[string]luks2Segment `json:"segments"`
+	Digests  map[string]luks2Digest  `json:"digests"`
+}
+
+type luks2Keyslot struct {
+	Type     string `json:"type"`
+	KeySize  int    `json:"key_size"`
+	Priority *int   `json:"priority"`
+	AF       struct {
+		Type    string `json:"type"`
+		Stripes int    `json:"stripes"`
+		Hash    string `json:"hash"`
+	} `json:"af"`
+	Area struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Encryption string `json:"encryption"`
+		KeySize    int    `json:"key_size"`
+	} `json:"area"`
+	KDF struct {
+		Type       string `json:"type"`
+		Hash       string `json:"hash"`
+		Iterations int    `json:"iterations"`
+		Time       int    `json:"time"`
+		Memory     int    `json:"memory"`
+		CPUs       int    `json:"cpus"`
+		Salt       string `json:"salt"`
+	} `json:"kdf"`
+}
+
+type luks2Segment struct {
+	Type       string           `json:"type"`
+	Offset     string           `json:"offset"`
+	Size       string           `json:"size"`
+	IVTweak    string           `json:"iv_tweak"`
+	Encryption string           `json:"encryption"`
+	SectorSize int              `json:"sector_size"`
+	Integrity  *json.RawMessage `json:"integrity"`
+}
+
+type luks2Digest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       string   `json:"salt"`
+	Digest     string   `json:"digest"`
+}
+
+func (l *luks2Header) toHeader() (*Header, error) {
+	var m luks2Metadata
+	if err := json.Unmarshal(l.metadata, &m); err != nil {
+		return nil, fmt.Errorf("could not parse LUKS2 metadata: %w", err)
+	}
+	h := &Header{
+		Version:   2,
+		UUID:      l.uuid,
+		Label:     l.label,
+		Subsystem: l.subsys,
+	}
+	if len(m.Segments) != 1 {
+		return nil, fmt.Errorf("LUKS2 volumes with %d segments are not supported", len(m.Segments))
+	}
+	for _, s := range m.Segments {
+		if s.Type != "crypt" {
+			return nil, fmt.Errorf("LUKS2 segments of type %s are not supported", s.Type)
+		}
+		if s.Integrity != nil {
+			return nil, errors.New("LUKS2 volumes with integrity protection are not supported")
+		}
+		offset, err := strconv.ParseInt(s.Offset, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 segment offset %q", s.Offset)
+		}
+		if s.Size != "dynamic" {
+			if h.PayloadSize, err = strconv.ParseInt(s.Size, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid LUKS2 segment size %q", s.Size)
+			}
+		}
+		if s.IVTweak != "" {
+			if h.ivTweak, err = strconv.ParseUint(s.IVTweak, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid LUKS2 segment IV tweak %q", s.IVTweak)
+			}
+		}
+		if s.SectorSize < sectorSize || s.SectorSize > 4096 || s.SectorSize&(s.SectorSize-1) != 0 {
+			return nil, fmt.Errorf("invalid LUKS2 segment sector size %d", s.SectorSize)
+		}
+		h.PayloadOffset = offset
+		h.Cipher = s.Encryption
+		h.SectorSize = s.SectorSize
+	}
+	for id, d := range m.Digests {
+		if d.Type != "pbkdf2" {
+			return nil, fmt.Errorf("LUKS2 digest %s of type %s is not supported", id, d.Type)
+		}
+		salt, err := base64.StdEncoding.DecodeString(d.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt of LUKS2 digest %s: %w", id, err)
+		}
+		sum, err := base64.StdEncoding.DecodeString(d.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 digest %s: %w", id, err)
+		}
+		dg := digest{hash: d.Hash, iterations: d.Iterations, salt: salt, digest: sum}
+		for _, k := range d.Keyslots {
+			index, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key slot %q of LUKS2 digest %s", k, id)
+			}
+			dg.keyslots = append(dg.keyslots, index)
+		}
+		h.digests = append(h.digests, dg)
+	}
+	for id, k := range m.Keyslots {
+		// other types, such as those of reencryption, hold no volume key
+		if k.Type != "luks2" {
+			continue
+		}
+		slot, err := k.toKeyslot(id)
+		if err != nil {
+			return nil, err
+		}
+		h.Keyslots = append(h.Keyslots, *slot)
+		if h.KeySize == 0 {
+			h.KeySize = slot.keySize
+		}
+	}
+	sort.Slice(h.Keyslots, func(i, j int) bool { return h.Keyslots[i].Index < h.Keyslots[j].Index })
+	return h, nil
+}
+
+func (k *luks2Keyslot) toKeyslot(id string) (*Keyslot, error) {
+	index, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 key slot %q", id)
+	}
+	if k.AF.Type != "luks1" || k.Area.Type != "raw" {
+		return nil, fmt.Errorf("LUKS2 key slot %s with anti-forensic split %s in area %s is not supported", id, k.AF.Type, k.Area.Type)
+	}
+	offset, err := strconv.ParseInt(k.Area.Offset, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid area offset %q of LUKS2 key slot %s", k.Area.Offset, id)
+	}
+	salt, err := base64.StdEncoding.DecodeString(k.KDF.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt of LUKS2 key slot %s: %w", id, err)
+	}
+	slot := &Keyslot{
+		Index:       index,
+		KDF:         k.KDF.Type,
+		salt:        salt,
+		keySize:     k.KeySize,
+		areaOffset:  offset,
+		areaCipher:  k.Area.Encryption,
+		areaKeySize: k.Area.KeySize,
+		stripes:     k.AF.Stripes,
+		afHash:      k.AF.Hash,
+		priority:    1,
+	}
+	if k.Priority != nil {
+		slot.priority = *k.Priority
+	}
+	switch {
+	case k.KDF.Type == "pbkdf2":
+		slot.Hash = k.KDF.Hash
+		slot.Iterations = k.KDF.Iterations
+	case strings.HasPrefix(k.KDF.Type, "argon2"):
+		slot.Iterations = k.KDF.Time
+		slot.Memory = k.KDF.Memory
+		slot.Parallelism = k.KDF.CPUs
+	}
+	return slot, nil
+}
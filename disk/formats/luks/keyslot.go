@@ -0,0 +1,170 @@
+package luks
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// maxKeySize the largest volume key that cryptsetup creates, in bytes
+	maxKeySize = 512
+	// maxKeyMaterialSize a limit on the key material of a key slot, far above the 4000 stripes that cryptsetup
+	// writes, so that a corrupt header cannot make Open allocate gigabytes
+	maxKeyMaterialSize = 16 * 1024 * 1024
+	// maxArgon2Memory the most memory that argon2 may use, in KiB, which is also the limit of cryptsetup
+	maxArgon2Memory = 4 * 1024 * 1024
+)
+
+// errDigestMismatch a key slot was unlocked, but not with the right key
+var errDigestMismatch = errors.New("key does not match digest")
+
+// unlock the volume key with key, trying the key slots with a high priority first, and those with the default
+// one after, as cryptsetup does. Slots whose priority is to be ignored are not tried.
+func (h *Header) unlock(b backend.File, start int64, key []byte) ([]byte, error) {
+	var lastErr error
+	for _, priority := range []int{2, 1} {
+		for i := range h.Keyslots {
+			k := &h.Keyslots[i]
+			if k.priority != priority {
+				continue
+			}
+			volumeKey, err := h.unlockKeyslot(b, start, k, key)
+			if err == nil {
+				return volumeKey, nil
+			}
+			if !errors.Is(err, errDigestMismatch) {
+				lastErr = fmt.Errorf("key slot %d: %w", k.Index, err)
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w (%v)", ErrWrongKey, lastErr)
+	}
+	return nil, ErrWrongKey
+}
+
+// unlockKeyslot the volume key from the slot k, if key unlocks it and the digest of the slot matches it
+func (h *Header) unlockKeyslot(b backend.File, start int64, k *Keyslot, key []byte) ([]byte, error) {
+	var d *digest
+	for i := range h.digests {
+		if h.digests[i].covers(k.Index) {
+			d = &h.digests[i]
+			break
+		}
+	}
+	if d == nil {
+		return nil, errors.New("no digest to check the key against")
+	}
+	volumeKey, err := k.unlock(b, start, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.check(volumeKey); err != nil {
+		return nil, err
+	}
+	return volumeKey, nil
+}
+
+// check whether the digest is that of volumeKey
+func (d *digest) check(volumeKey []byte) error {
+	newHash, err := hashFunc(d.hash)
+	if err != nil {
+		return err
+	}
+	sum := pbkdf2.Key(volumeKey, d.salt, d.iterations, len(d.digest), newHash)
+	if subtle.ConstantTimeCompare(sum, d.digest) != 1 {
+		return errDigestMismatch
+	}
+	return nil
+}
+
+// unlock decrypt the key material of the slot with the key derived from key, and merge its stripes into the
+// volume key
+func (k *Keyslot) unlock(b backend.File, start int64, key []byte) ([]byte, error) {
+	if k.keySize <= 0 || k.keySize > maxKeySize || k.stripes <= 0 || k.keySize*k.stripes > maxKeyMaterialSize {
+		return nil, fmt.Errorf("invalid key size %d with %d stripes", k.keySize, k.stripes)
+	}
+	if k.areaKeySize <= 0 || k.areaKeySize > maxKeySize {
+		return nil, fmt.Errorf("invalid key size %d of key material", k.areaKeySize)
+	}
+	derived, err := k.deriveKey(key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newSectorCipher(k.areaCipher, derived)
+	if err != nil {
+		return nil, err
+	}
+	size := k.keySize * k.stripes
+	material := make([]byte, (size+sectorSize-1)/sectorSize*sectorSize)
+	if n, err := b.ReadAt(material, start+k.areaOffset); err != nil && n != len(material) {
+		return nil, fmt.Errorf("could not read key material: %w", err)
+	}
+	// the key material is encrypted as sectors numbered from its start
+	for i := 0; i < len(material)/sectorSize; i++ {
+		s := material[i*sectorSize : (i+1)*sectorSize]
+		c.decrypt(s, s, uint64(i))
+	}
+	return afMerge(material[:size], k.keySize, k.stripes, k.afHash)
+}
+
+// deriveKey the key that the key material of the slot is encrypted with, from key
+func (k *Keyslot) deriveKey(key []byte) ([]byte, error) {
+	switch k.KDF {
+	case "pbkdf2":
+		newHash, err := hashFunc(k.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(key, k.salt, k.Iterations, k.areaKeySize, newHash), nil
+	case "argon2i", "argon2id":
+		if k.Iterations < 1 || k.Memory < 1 || k.Memory > maxArgon2Memory || k.Parallelism < 1 || k.Parallelism > 255 {
+			return nil, fmt.Errorf("invalid %s parameters: time %d, memory %d, threads %d", k.KDF, k.Iterations, k.Memory, k.Parallelism)
+		}
+		derive := argon2.Key
+		if k.KDF == "argon2id" {
+			derive = argon2.IDKey
+		}
+		return derive(key, k.salt, uint32(k.Iterations), uint32(k.Memory), uint8(k.Parallelism), uint32(k.areaKeySize)), nil
+	default:
+		return nil, fmt.Errorf("unsupported key derivation function %s", k.KDF)
+	}
+}
+
+// afMerge merge the stripes of the anti-forensic split of a key of keySize bytes, as in AF_merge of cryptsetup: each
+// stripe but the last is XORed into a buffer that is then diffused, and the last one XORed into that is the key
+func afMerge(material []byte, keySize, stripes int, hashName string) ([]byte, error) {
+	newHash, err := hashFunc(hashName)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, keySize)
+	for i := 0; i < stripes-1; i++ {
+		subtle.XORBytes(buf, buf, material[i*keySize:(i+1)*keySize])
+		diffuse(buf, newHash)
+	}
+	key := make([]byte, keySize)
+	subtle.XORBytes(key, buf, material[(stripes-1)*keySize:])
+	return key, nil
+}
+
+// diffuse replace each block of b, of the size of the digest, with the hash of its index and itself, cut to its size
+func diffuse(b []byte, newHash func() hash.Hash) {
+	h := newHash()
+	index := make([]byte, 4)
+	for i := 0; i*h.Size() < len(b); i++ {
+		block := b[i*h.Size() : min((i+1)*h.Size(), len(b))]
+		binary.BigEndian.PutUint32(index, uint32(i))
+		h.Reset()
+		h.Write(index)
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
@@ -0,0 +1,180 @@
+package luks
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// maxReadSize how much of the payload ReadAt reads from the storage at once, so that a large read does not
+// need a buffer as large as itself
+const maxReadSize = 1024 * 1024
+
+// Volume is an unlocked LUKS volume. It implements backend.Storage for the decrypted payload, so the filesystem in
+// it can be read with the filesystem packages. It is read-only.
+type Volume struct {
+	storage    backend.File
+	header     *Header
+	cipher     sectorCipher
+	payload    int64 // where the payload starts in storage
+	size       int64
+	sectorSize int64
+	offset     int64 // for Read and Seek
+}
+
+// backend.Storage interface guard
+var _ backend.Storage = (*Volume)(nil)
+
+// Open unlock the LUKS volume at start in b, of size bytes, with key, which is a passphrase or the contents of a
+// keyfile. It returns ErrNotLUKS if there is no LUKS volume at start, and an error wrapping ErrWrongKey if key
+// unlocks none of its key slots.
+func Open(b backend.Storage, size, start int64, key []byte) (*Volume, error) {
+	h, err := ReadHeader(b, start)
+	if err != nil {
+		return nil, err
+	}
+	payloadSize := h.PayloadSize
+	if payloadSize == 0 {
+		payloadSize = size - h.PayloadOffset
+	}
+	if payloadSize <= 0 || h.PayloadOffset+payloadSize > size {
+		return nil, fmt.Errorf("payload of %d bytes at %d does not fit in the volume of %d bytes", payloadSize, h.PayloadOffset, size)
+	}
+	volumeKey, err := h.unlock(b, start, key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newSectorCipher(h.Cipher, volumeKey)
+	if err != nil {
+		return nil, err
+	}
+	sectors := int64(h.SectorSize)
+	return &Volume{
+		storage:    b,
+		header:     h,
+		cipher:     c,
+		payload:    start + h.PayloadOffset,
+		size:       payloadSize / sectors * sectors,
+		sectorSize: sectors,
+	}, nil
+}
+
+// Header returns the header of the volume
+func (v *Volume) Header() *Header {
+	return v.header
+}
+
+// Size returns the size of the decrypted payload in bytes
+func (v *Volume) Size() int64 {
+	return v.size
+}
+
+// ReadAt reads from the decrypted payload at the given offset
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	var err error
+	if off+int64(len(p)) > v.size {
+		p = p[:v.size-off]
+		err = io.EOF
+	}
+	var n int
+	buf := make([]byte, min(maxReadSize, (int64(len(p))/v.sectorSize+2)*v.sectorSize))
+	for n < len(p) {
+		pos := off + int64(n)
+		first := pos / v.sectorSize * v.sectorSize
+		end := min(first+int64(len(buf)), (off+int64(len(p))+v.sectorSize-1)/v.sectorSize*v.sectorSize)
+		raw := buf[:end-first]
+		if read, err := v.storage.ReadAt(raw, v.payload+first); err != nil && read != len(raw) {
+			return n, fmt.Errorf("unable to read encrypted payload at %d: %w", first, err)
+		}
+		for s := int64(0); s < int64(len(raw)); s += v.sectorSize {
+			sector := raw[s : s+v.sectorSize]
+			v.cipher.decrypt(sector, sector, v.iv(first+s))
+		}
+		n += copy(p[n:], raw[pos-first:])
+	}
+	return n, err
+}
+
+// iv the number that the IV of the sector at offset in the payload is made from: that of its sector, counted in the
+// sectors of the payload, after the IV tweak, which is counted in 512-byte ones, is added, as dm-crypt does
+func (v *Volume) iv(offset int64) uint64 {
+	return (uint64(offset/sectorSize) + v.header.ivTweak) / uint64(v.sectorSize/sectorSize)
+}
+
+// Sys returns an error, as a LUKS volume cannot be used for ioctl calls
+func (v *Volume) Sys() (*os.File, error) {
+	return nil, backend.ErrNotSuitable
+}
+
+// Writable returns an error, as the volume is read-only
+func (v *Volume) Writable() (backend.WritableFile, error) {
+	return nil, backend.ErrIncorrectOpenMode
+}
+
+// Stat returns information about the decrypted payload, whose size is that of the payload and not of the volume
+func (v *Volume) Stat() (fs.FileInfo, error) {
+	info, err := v.storage.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: info.Name(), size: v.size, mode: info.Mode(), modTime: info.ModTime()}, nil
+}
+
+// Read reads from the decrypted payload at the current offset
+func (v *Volume) Read(b []byte) (int, error) {
+	n, err := v.ReadAt(b, v.offset)
+	v.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (v *Volume) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = v.offset + offset
+	case io.SeekEnd:
+		newOffset = v.size + offset
+	default:
+		return v.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return v.offset, errors.New("cannot seek to negative offset")
+	}
+	v.offset = newOffset
+	return v.offset, nil
+}
+
+// Close does nothing. The storage the volume was opened from is not closed, as it is usually that of a whole disk,
+// which is closed with it.
+func (v *Volume) Close() error {
+	return nil
+}
+
+// fileInfo information about the decrypted payload
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() fs.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return false }
+func (f *fileInfo) Sys() any           { return nil }
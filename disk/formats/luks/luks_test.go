@@ -0,0 +1,368 @@
+package luks_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/luks"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const (
+	testPassphrase = "correct horse battery staple"
+	testUUID       = "3e8ae5b5-8d0a-4d5c-9a8b-6f1f0a3d2c71"
+	testStripes    = 4000
+)
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("unable to generate random bytes: %v", err)
+	}
+	return b
+}
+
+// encryptSectors encrypt b in place as dm-crypt does with aes in mode, e.g. xts-plain64, in sectors of sectorSize,
+// whose IVs are their numbers from the start of b
+func encryptSectors(t *testing.T, mode string, key, b []byte, sectorSize int) {
+	for i := 0; i*sectorSize < len(b); i++ {
+		s := b[i*sectorSize : (i+1)*sectorSize]
+		switch mode {
+		case "xts-plain64":
+			c, err := xts.NewCipher(aes.NewCipher, key)
+			if err != nil {
+				t.Fatalf("unable to create cipher: %v", err)
+			}
+			c.Encrypt(s, s, uint64(i))
+		case "cbc-essiv:sha256":
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				t.Fatalf("unable to create cipher: %v", err)
+			}
+			salt := sha256.Sum256(key)
+			essiv, err := aes.NewCipher(salt[:])
+			if err != nil {
+				t.Fatalf("unable to create cipher: %v", err)
+			}
+			iv := make([]byte, aes.BlockSize)
+			binary.LittleEndian.PutUint64(iv, uint64(i))
+			essiv.Encrypt(iv, iv)
+			cipher.NewCBCEncrypter(block, iv).CryptBlocks(s, s)
+		default:
+			t.Fatalf("unknown cipher mode %s", mode)
+		}
+	}
+}
+
+// afSplit split key into stripes as AF_split of cryptsetup does: random stripes, and a last one that, XORed with
+// the diffused XOR of all of them, is the key
+func afSplit(t *testing.T, key []byte, stripes int) []byte {
+	out := randomBytes(t, len(key)*stripes)
+	buf := make([]byte, len(key))
+	for i := 0; i < stripes-1; i++ {
+		for j := range buf {
+			buf[j] ^= out[i*len(key)+j]
+		}
+		// diffuse each digest-sized block with the hash of its big-endian index and itself
+		for block := 0; block*sha256.Size < len(buf); block++ {
+			end := min((block+1)*sha256.Size, len(buf))
+			h := sha256.New()
+			_ = binary.Write(h, binary.BigEndian, uint32(block))
+			h.Write(buf[block*sha256.Size : end])
+			copy(buf[block*sha256.Size:end], h.Sum(nil))
+		}
+	}
+	last := out[(stripes-1)*len(key):]
+	for j := range last {
+		last[j] = buf[j] ^ key[j]
+	}
+	return out
+}
+
+// keyMaterial the key material of a key slot that holds volumeKey, encrypted with areaKey
+func keyMaterial(t *testing.T, mode string, volumeKey, areaKey []byte) []byte {
+	material := afSplit(t, volumeKey, testStripes)
+	material = append(material, make([]byte, (512-len(material)%512)%512)...)
+	encryptSectors(t, mode, areaKey, material, 512)
+	return material
+}
+
+// formatLUKS1 a LUKS1 volume with the payload, encrypted with aes in mode, with key slot 1 unlocked by the passphrase
+func formatLUKS1(t *testing.T, mode string, keySize int, payload []byte) []byte {
+	const (
+		iterations      = 1000
+		materialSector  = 8
+		payloadSector   = 1024
+		keyslotEnabled  = 0x00ac71f3
+		keyslotDisabled = 0x0000dead
+	)
+	volumeKey := randomBytes(t, keySize)
+	keySalt, digestSalt := randomBytes(t, 32), randomBytes(t, 32)
+	areaKey := pbkdf2.Key([]byte(testPassphrase), keySalt, iterations, keySize, sha256.New)
+
+	b := make([]byte, payloadSector*512+len(payload))
+	copy(b, "LUKS\xba\xbe")
+	binary.BigEndian.PutUint16(b[6:], 1)
+	copy(b[8:], "aes")
+	copy(b[40:], mode)
+	copy(b[72:], "sha256")
+	binary.BigEndian.PutUint32(b[104:], payloadSector)
+	binary.BigEndian.PutUint32(b[108:], uint32(keySize))
+	copy(b[112:132], pbkdf2.Key(volumeKey, digestSalt, iterations, 20, sha256.New))
+	copy(b[132:164], digestSalt)
+	binary.BigEndian.PutUint32(b[164:], iterations)
+	copy(b[168:], testUUID)
+	for i := 0; i < 8; i++ {
+		s := b[208+i*48 : 208+(i+1)*48]
+		binary.BigEndian.PutUint32(s[0:], keyslotDisabled)
+		binary.BigEndian.PutUint32(s[44:], testStripes)
+	}
+	slot := b[208+48 : 208+2*48]
+	binary.BigEndian.PutUint32(slot[0:], keyslotEnabled)
+	binary.BigEndian.PutUint32(slot[4:], iterations)
+	copy(slot[8:40], keySalt)
+	binary.BigEndian.PutUint32(slot[40:], materialSector)
+	copy(b[materialSector*512:], keyMaterial(t, mode, volumeKey, areaKey))
+
+	encrypted := bytes.Clone(payload)
+	encryptSectors(t, mode, volumeKey, encrypted, 512)
+	copy(b[payloadSector*512:], encrypted)
+	return b
+}
+
+// formatLUKS2 a LUKS2 volume with the payload, encrypted with aes-xts-plain64 in sectors of sectorSize, with key
+// slot 0 unlocked by the passphrase with argon2id
+func formatLUKS2(t *testing.T, sectorSize int, payload []byte) []byte {
+	const (
+		headerSize    = 16384
+		areaOffset    = 32768
+		payloadOffset = 1024 * 1024
+		keySize       = 64
+		iterations    = 1000
+	)
+	volumeKey := randomBytes(t, keySize)
+	keySalt, digestSalt := randomBytes(t, 32), randomBytes(t, 32)
+	areaKey := argon2.IDKey([]byte(testPassphrase), keySalt, 1, 64, 1, keySize)
+	material := keyMaterial(t, "xts-plain64", volumeKey, areaKey)
+
+	encode := base64.StdEncoding.EncodeToString
+	metadata, err := json.Marshal(map[string]any{
+		"keyslots": map[string]any{
+			"0": map[string]any{
+				"type":     "luks2",
+				"key_size": keySize,
+				"af":       map[string]any{"type": "luks1", "stripes": testStripes, "hash": "sha256"},
+				"area": map[string]any{
+					"type": "raw", "offset": fmt.Sprint(areaOffset), "size": fmt.Sprint(len(material)),
+					"encryption": "aes-xts-plain64", "key_size": keySize,
+				},
+				"kdf": map[string]any{"type": "argon2id", "time": 1, "memory": 64, "cpus": 1, "salt": encode(keySalt)},
+			},
+		},
+		"tokens": map[string]any{},
+		"segments": map[string]any{
+			"0": map[string]any{
+				"type": "crypt", "offset": fmt.Sprint(payloadOffset), "size": "dynamic", "iv_tweak": "0",
+				"encryption": "aes-xts-plain64", "sector_size": sectorSize,
+			},
+		},
+		"digests": map[string]any{
+			"0": map[string]any{
+				"type": "pbkdf2", "keyslots": []string{"0"}, "segments": []string{"0"}, "hash": "sha256",
+				"iterations": iterations, "salt": encode(digestSalt),
+				"digest": encode(pbkdf2.Key(volumeKey, digestSalt, iterations, 32, sha256.New)),
+			},
+		},
+		"config": map[string]any{"json_size": fmt.Sprint(headerSize - 4096), "keyslots_size": fmt.Sprint(payloadOffset - areaOffset)},
+	})
+	if err != nil {
+		t.Fatalf("unable to encode metadata: %v", err)
+	}
+
+	b := make([]byte, payloadOffset+len(payload))
+	for i, magic := range []string{"LUKS\xba\xbe", "SKUL\xba\xbe"} {
+		h := b[i*headerSize : (i+1)*headerSize]
+		copy(h, magic)
+		binary.BigEndian.PutUint16(h[6:], 2)
+		binary.BigEndian.PutUint64(h[8:], headerSize)
+		binary.BigEndian.PutUint64(h[16:], 1)
+		copy(h[24:], "encrypted")
+		copy(h[72:], "sha256")
+		copy(h[104:168], randomBytes(t, 64))
+		copy(h[168:], testUUID)
+		binary.BigEndian.PutUint64(h[256:], uint64(i*headerSize))
+		copy(h[4096:], metadata)
+		sum := sha256.Sum256(h)
+		copy(h[448:], sum[:])
+	}
+	copy(b[areaOffset:], material)
+
+	encrypted := bytes.Clone(payload)
+	encryptSectors(t, "xts-plain64", volumeKey, encrypted, sectorSize)
+	copy(b[payloadOffset:], encrypted)
+	return b
+}
+
+// storage the volume in a read-only mem backend
+func storage(t *testing.T, b []byte) *mem.Buffer {
+	s, err := mem.NewFromBytes(b, true)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	return s
+}
+
+func TestOpen(t *testing.T) {
+	payload := randomBytes(t, 256*1024)
+	tests := []struct {
+		name       string
+		volume     []byte
+		version    int
+		cipher     string
+		sectorSize int
+	}{
+		{"LUKS1 aes-xts-plain64", formatLUKS1(t, "xts-plain64", 64, payload), 1, "aes-xts-plain64", 512},
+		{"LUKS1 aes-cbc-essiv:sha256", formatLUKS1(t, "cbc-essiv:sha256", 32, payload), 1, "aes-cbc-essiv:sha256", 512},
+		{"LUKS2 512 byte sectors", formatLUKS2(t, 512, payload), 2, "aes-xts-plain64", 512},
+		{"LUKS2 4096 byte sectors", formatLUKS2(t, 4096, payload), 2, "aes-xts-plain64", 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := storage(t, tt.volume)
+			h, err := luks.ReadHeader(s, 0)
+			if err != nil {
+				t.Fatalf("unexpected error reading header: %v", err)
+			}
+			if h.Version != tt.version || h.Cipher != tt.cipher || h.UUID != testUUID || h.SectorSize != tt.sectorSize {
+				t.Errorf("header has version %d, cipher %s, UUID %s and sector size %d", h.Version, h.Cipher, h.UUID, h.SectorSize)
+			}
+			if len(h.Keyslots) != 1 {
+				t.Fatalf("header has %d key slots instead of 1", len(h.Keyslots))
+			}
+
+			if _, err := luks.Open(s, int64(len(tt.volume)), 0, []byte("wrong")); !errors.Is(err, luks.ErrWrongKey) {
+				t.Errorf("opening with the wrong passphrase gave error %v instead of %v", err, luks.ErrWrongKey)
+			}
+			v, err := luks.Open(s, int64(len(tt.volume)), 0, []byte(testPassphrase))
+			if err != nil {
+				t.Fatalf("unexpected error opening volume: %v", err)
+			}
+			if v.Size() != int64(len(payload)) {
+				t.Errorf("volume has size %d instead of %d", v.Size(), len(payload))
+			}
+			all, err := io.ReadAll(v)
+			if err != nil {
+				t.Fatalf("unexpected error reading volume: %v", err)
+			}
+			if !bytes.Equal(all, payload) {
+				t.Errorf("decrypted payload does not match")
+			}
+			// a read that starts and ends part way through sectors
+			b := make([]byte, 10000)
+			if _, err := v.ReadAt(b, 4097); err != nil {
+				t.Fatalf("unexpected error reading volume: %v", err)
+			}
+			if !bytes.Equal(b, payload[4097:4097+len(b)]) {
+				t.Errorf("decrypted payload at an offset does not match")
+			}
+			if _, err := v.Writable(); err == nil {
+				t.Errorf("volume is writable")
+			}
+		})
+	}
+
+	t.Run("damaged primary LUKS2 header", func(t *testing.T) {
+		volume := formatLUKS2(t, 512, payload)
+		clear(volume[:4096])
+		v, err := luks.Open(storage(t, volume), int64(len(volume)), 0, []byte(testPassphrase))
+		if err != nil {
+			t.Fatalf("unexpected error opening volume: %v", err)
+		}
+		b := make([]byte, 512)
+		if _, err := v.ReadAt(b, 0); err != nil || !bytes.Equal(b, payload[:512]) {
+			t.Errorf("decrypted payload does not match, error %v", err)
+		}
+	})
+	t.Run("not LUKS", func(t *testing.T) {
+		if _, err := luks.ReadHeader(storage(t, payload), 0); !errors.Is(err, luks.ErrNotLUKS) {
+			t.Errorf("reading random data gave error %v instead of %v", err, luks.ErrNotLUKS)
+		}
+	})
+}
+
+func TestFilesystemInVolume(t *testing.T) {
+	const fsSize = 16 * 1024 * 1024
+	fsImage, err := mem.New(fsSize)
+	if err != nil {
+		t.Fatalf("unable to create backend: %v", err)
+	}
+	fs, err := ext4.Create(fsImage, fsSize, 0, 512, &ext4.Params{})
+	if err != nil {
+		t.Fatalf("unable to create filesystem: %v", err)
+	}
+	f, err := fs.OpenFile("/secret.txt", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	if _, err := f.Write([]byte("hidden")); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	plain := make([]byte, fsSize)
+	if _, err := fsImage.ReadAt(plain, 0); err != nil {
+		t.Fatalf("unable to read filesystem: %v", err)
+	}
+	volume := formatLUKS2(t, 4096, plain)
+
+	// on a partition, the volume is recognized, and its filesystem read once it is unlocked
+	d, err := diskfs.Create(filepath.Join(t.TempDir(), "disk.img"), 32*1024*1024, diskfs.SectorSizeDefault)
+	if err != nil {
+		t.Fatalf("unable to create disk: %v", err)
+	}
+	defer d.Close()
+	table := &gpt.Table{Partitions: []*gpt.Partition{{Start: 2048, Size: uint64(len(volume)), Type: gpt.LinuxFilesystem}}}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("unable to partition disk: %v", err)
+	}
+	if _, err := d.WritePartitionContents(1, bytes.NewReader(volume)); err != nil {
+		t.Fatalf("unable to write volume: %v", err)
+	}
+	if _, err := d.GetFilesystem(1); !errors.Is(err, disk.ErrEncrypted) {
+		t.Errorf("reading the filesystem of the locked volume gave error %v instead of %v", err, disk.ErrEncrypted)
+	}
+	partition := d.Table.GetPartitions()[0]
+	v, err := luks.Open(d.Backend, partition.GetSize(), partition.GetStart(), []byte(testPassphrase))
+	if err != nil {
+		t.Fatalf("unexpected error opening volume: %v", err)
+	}
+	fs, err = ext4.Read(v, v.Size(), 0, 512)
+	if err != nil {
+		t.Fatalf("unable to read filesystem in volume: %v", err)
+	}
+	f, err = fs.OpenFile("/secret.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unable to open file in volume: %v", err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil || string(b) != "hidden" {
+		t.Errorf("file in volume has contents %q, error %v", b, err)
+	}
+}
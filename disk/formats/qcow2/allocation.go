@@ -0,0 +1,135 @@
+package qcow2
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ClusterState is the state of the clusters of an Extent of the virtual disk
+type ClusterState int
+
+const (
+	// ClusterUnallocated clusters are not stored in the image, and read from its backing file, or as zeroes if
+	// it has none
+	ClusterUnallocated ClusterState = iota
+	// ClusterData clusters are stored in the image as they are
+	ClusterData
+	// ClusterCompressed clusters are stored in the image compressed
+	ClusterCompressed
+	// ClusterZero clusters read as zeroes, whatever the backing file holds, without taking any space for data
+	ClusterZero
+)
+
+func (s ClusterState) String() string {
+	switch s {
+	case ClusterUnallocated:
+		return "unallocated"
+	case ClusterData:
+		return "data"
+	case ClusterCompressed:
+		return "compressed"
+	case ClusterZero:
+		return "zero"
+	default:
+		return fmt.Sprintf("ClusterState(%d)", int(s))
+	}
+}
+
+// Extent is a run of consecutive clusters of the virtual disk that are all in the same state
+type Extent struct {
+	Offset int64
+	Length int64
+	State  ClusterState
+}
+
+// Stats are counters of the I/O done through an Image since it was opened or created
+type Stats struct {
+	// ReadOps and ReadBytes count the reads of the virtual disk and the bytes they returned
+	ReadOps   int64
+	ReadBytes int64
+	// WriteOps and WriteBytes count the writes to the virtual disk, compressed or not, and the bytes they wrote
+	WriteOps   int64
+	WriteBytes int64
+	// BackingReadBytes counts the bytes of those reads and writes that were read from the backing file
+	BackingReadBytes int64
+	// ClustersDecompressed counts the compressed clusters that were read and decompressed
+	ClustersDecompressed int64
+	// ClustersAllocated counts the clusters added to the image, for data and metadata alike
+	ClustersAllocated int64
+}
+
+// counters the counters behind Stats, which reads that run at the same time add to
+type counters struct {
+	readOps, readBytes, writeOps, writeBytes                  atomic.Int64
+	backingReadBytes, clustersDecompressed, clustersAllocated atomic.Int64
+}
+
+// Stats returns the counters of the I/O done through the image so far. It waits for the reads and writes under
+// way, so that none of them is only partly counted.
+func (i *Image) Stats() Stats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	c := &i.stats
+	return Stats{
+		ReadOps:              c.readOps.Load(),
+		ReadBytes:            c.readBytes.Load(),
+		WriteOps:             c.writeOps.Load(),
+		WriteBytes:           c.writeBytes.Load(),
+		BackingReadBytes:     c.backingReadBytes.Load(),
+		ClustersDecompressed: c.clustersDecompressed.Load(),
+		ClustersAllocated:    c.clustersAllocated.Load(),
+	}
+}
+
+// clusterState the state of the cluster of an L2 entry
+func (i *Image) clusterState(entry uint64) ClusterState {
+	switch {
+	case entry&flagCompressed != 0:
+		return ClusterCompressed
+	case i.header.version >= 3 && entry&flagZero != 0:
+		return ClusterZero
+	case entry&offsetMask != 0:
+		return ClusterData
+	default:
+		return ClusterUnallocated
+	}
+}
+
+// AllocationMap returns the state of every cluster of the virtual disk, as qemu-img map does, so that tools can
+// plan what to copy or check how sparse the image is without reading the disk. The extents are in order of
+// offset and cover the whole disk, each as long as possible. Only the L2 tables are read; the backing file is
+// not looked at, and the clusters read from it are reported as ClusterUnallocated.
+func (i *Image) AllocationMap() ([]Extent, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	cs := i.header.clusterSize()
+	coverage := i.header.l2Coverage()
+	size := i.Size()
+	var extents []Extent
+	add := func(pos, length int64, state ClusterState) {
+		length = min(length, size-pos)
+		if n := len(extents); n > 0 && extents[n-1].State == state {
+			extents[n-1].Length += length
+			return
+		}
+		extents = append(extents, Extent{Offset: pos, Length: length, State: state})
+	}
+	for l1Index := int64(0); l1Index*coverage < size; l1Index++ {
+		l2, err := i.l2Table(l1Index)
+		if err != nil {
+			return nil, err
+		}
+		if l2 == nil {
+			add(l1Index*coverage, coverage, ClusterUnallocated)
+			continue
+		}
+		for l2Index, entry := range l2 {
+			pos := l1Index*coverage + int64(l2Index)*cs
+			if pos >= size {
+				break
+			}
+			add(pos, cs, i.clusterState(entry))
+		}
+	}
+	return extents, nil
+}
@@ -0,0 +1,409 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+const (
+	// BackingFormatQCOW2 is the format of a backing file that is itself a qcow2 image
+	BackingFormatQCOW2 = "qcow2"
+	// BackingFormatRaw is the format of a backing file that is a raw disk image
+	BackingFormatRaw = "raw"
+)
+
+// backingFile the backing file of an image, whose contents show through the clusters the image does not store.
+// A nil backingFile reads as zeroes, as an image without one does.
+type backingFile struct {
+	storage backend.Storage
+	name    string // as recorded in the image
+	format  string
+	size    int64
+}
+
+// readAt read from the backing file at off, where it reads as zeroes past its end
+func (b *backingFile) readAt(p []byte, off int64) error {
+	clear(p)
+	if b == nil || off >= b.size {
+		return nil
+	}
+	p = p[:min(int64(len(p)), b.size-off)]
+	if n, err := b.storage.ReadAt(p, off); err != nil && n != len(p) {
+		return fmt.Errorf("unable to read backing file %s at %d: %w", b.name, off, err)
+	}
+	return nil
+}
+
+// allocated whether any of the length bytes of the backing file at off may hold data
+func (b *backingFile) allocated(off, length int64) (bool, error) {
+	if b == nil || off >= b.size {
+		return false, nil
+	}
+	if r, ok := b.storage.(backend.AllocationReporter); ok {
+		return r.Allocated(off, min(length, b.size-off))
+	}
+	return true, nil
+}
+
+// close close the backing file, and any backing files of its own
+func (b *backingFile) close() error {
+	if b == nil {
+		return nil
+	}
+	return b.storage.Close()
+}
+
+// BackingFile returns the name of the backing file of the image as recorded in it, or "" if it has none
+func (i *Image) BackingFile() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.backing == nil {
+		return ""
+	}
+	return i.backing.name
+}
+
+// setChain record the image as the backing file of the images in chain, which must not hold it already, and
+// must leave room for it
+func (i *Image) setChain(chain []fs.FileInfo) error {
+	if len(chain) >= maxBackingChain {
+		return fmt.Errorf("chain of backing files is longer than the maximum of %d", maxBackingChain)
+	}
+	info, err := i.storage.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat image: %w", err)
+	}
+	i.chain = append(slices.Clone(chain), info)
+	return nil
+}
+
+// openBacking open the backing file of the given name and format, relative to the directory of the image if
+// it is not absolute. If format is empty, it is detected. A backing file that is already in the chain of the
+// image, such as the image itself, is refused.
+func (i *Image) openBacking(name, format string, readOnly bool) (*backingFile, error) {
+	p := name
+	if !filepath.IsAbs(p) {
+		f, err := i.storage.Sys()
+		if err != nil {
+			return nil, fmt.Errorf("backing file %s is relative, and the image has no path to resolve it against: %w", name, err)
+		}
+		p = filepath.Join(filepath.Dir(f.Name()), name)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open backing file %s: %w", name, err)
+	}
+	for _, c := range i.chain {
+		if os.SameFile(info, c) {
+			return nil, fmt.Errorf("backing file %s is already in the chain of backing files", name)
+		}
+	}
+	b, err := file.OpenFromPath(p, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open backing file %s: %w", name, err)
+	}
+	if format == "" {
+		m := make([]byte, 4)
+		if n, _ := b.ReadAt(m, 0); n == len(m) && binary.BigEndian.Uint32(m) == magic {
+			format = BackingFormatQCOW2
+		} else {
+			format = BackingFormatRaw
+		}
+	}
+	var storage backend.Storage
+	switch format {
+	case BackingFormatQCOW2:
+		if storage, err = New(b, withChain(i.chain)); err != nil {
+			_ = b.Close()
+			return nil, fmt.Errorf("unable to open backing file %s: %w", name, err)
+		}
+	case BackingFormatRaw:
+		storage = b
+	default:
+		_ = b.Close()
+		return nil, fmt.Errorf("unsupported backing file format %q", format)
+	}
+	info, err = storage.Stat()
+	if err != nil {
+		_ = storage.Close()
+		return nil, fmt.Errorf("unable to stat backing file %s: %w", name, err)
+	}
+	return &backingFile{storage: storage, name: name, format: format, size: info.Size()}, nil
+}
+
+// loadBacking read the name and format of the backing file from the first cluster of the image, and open it
+// if open is set, or fail if it is not
+func (i *Image) loadBacking(open bool) error {
+	h := i.header
+	if h.backingFileOffset == 0 {
+		return nil
+	}
+	name := make([]byte, h.backingFileSize)
+	if n, err := i.storage.ReadAt(name, int64(h.backingFileOffset)); err != nil && n != len(name) {
+		return fmt.Errorf("unable to read backing file name: %w", err)
+	}
+	if !open {
+		return fmt.Errorf("image has backing file %s, which is only opened WithBackingFiles", name)
+	}
+	var format string
+	for _, e := range i.extensions {
+		if e.kind == extensionBackingFormat {
+			format = string(e.data)
+		}
+	}
+	backing, err := i.openBacking(string(name), format, true)
+	if err != nil {
+		return err
+	}
+	i.backing = backing
+	return nil
+}
+
+// headerBytes the header, its extensions and the name of the backing file, as they are stored at the start of
+// the first cluster, updating the offset and size of the name in the header to match
+func (i *Image) headerBytes() ([]byte, error) {
+	h := i.header
+	var extensions []extension
+	for _, e := range i.extensions {
+		if e.kind != extensionBackingFormat {
+			extensions = append(extensions, e)
+		}
+	}
+	var name []byte
+	if i.backing != nil {
+		name = []byte(i.backing.name)
+		if len(name) > maxBackingFileSize {
+			return nil, fmt.Errorf("backing file name of %d bytes is longer than the maximum of %d", len(name), maxBackingFileSize)
+		}
+		extensions = append(extensions, extension{kind: extensionBackingFormat, data: []byte(i.backing.format)})
+	}
+	rest := extensionsToBytes(extensions)
+	h.backingFileOffset, h.backingFileSize = 0, uint32(len(name))
+	if len(name) > 0 {
+		h.backingFileOffset = uint64(h.headerLength) + uint64(len(rest))
+	}
+	b := append(h.toBytes(), rest...)
+	b = append(b, name...)
+	if int64(len(b)) > h.clusterSize() {
+		return nil, fmt.Errorf("header of %d bytes does not fit in the first cluster of %d bytes", len(b), h.clusterSize())
+	}
+	i.extensions = extensions
+	return b, nil
+}
+
+// writeHeader write the header, its extensions and the name of the backing file to the first cluster
+func (i *Image) writeHeader() error {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	b, err := i.headerBytes()
+	if err != nil {
+		return err
+	}
+	if _, err := writable.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("unable to write qcow2 header: %w", err)
+	}
+	return nil
+}
+
+// stored whether the cluster of an L2 entry is stored in the image, as data, compressed or zero, rather than
+// read from the backing file
+func (i *Image) stored(entry uint64) bool {
+	return i.clusterState(entry) != ClusterUnallocated
+}
+
+// Commit writes every cluster stored in the image to its backing file, as qemu-img commit does, and then empties
+// the image, which reads the same as before, from the backing file. The backing file is opened read-write for
+// the duration, so must not be in use elsewhere, and must be at least as large as the image.
+func (i *Image) Commit() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.readOnly {
+		return backend.ErrIncorrectOpenMode
+	}
+	if i.backing == nil {
+		return errors.New("image has no backing file to commit to")
+	}
+	if i.backing.size < i.Size() {
+		return fmt.Errorf("backing file of %d bytes is smaller than the image of %d bytes", i.backing.size, i.Size())
+	}
+	name, format := i.backing.name, i.backing.format
+	target, err := i.openBacking(name, format, false)
+	if err != nil {
+		return err
+	}
+	// clusters of the backing file cached by the read-only handle would be out of date once committed to, so it
+	// is opened again afterwards
+	_ = i.backing.close()
+	i.backing = nil
+	err = i.commitTo(target)
+	if closeErr := target.close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("unable to close backing file %s: %w", name, closeErr)
+	}
+	backing, openErr := i.openBacking(name, format, true)
+	if openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	i.backing = backing
+	return err
+}
+
+// commitTo write every cluster stored in the image to the writable backing file target, then empty the image
+func (i *Image) commitTo(target *backingFile) error {
+	writable, err := target.storage.Writable()
+	if err != nil {
+		return err
+	}
+	cs := i.header.clusterSize()
+	cluster := make([]byte, cs)
+	var committed []int64
+	err = i.walkStored(func(pos int64, entry uint64) error {
+		data := cluster[:min(cs, i.Size()-pos)]
+		if _, err := i.readAt(data, pos); err != nil {
+			return err
+		}
+		committed = append(committed, pos)
+		// zero clusters need not be written where the backing file has nothing already
+		if bytes.Equal(data, make([]byte, len(data))) {
+			allocated, err := target.allocated(pos, int64(len(data)))
+			if err != nil || !allocated {
+				return err
+			}
+		}
+		if _, err := writable.WriteAt(data, pos); err != nil {
+			return fmt.Errorf("unable to write backing file %s at %d: %w", target.name, pos, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, pos := range committed {
+		if err := i.discardCluster(pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkStored call fn with the offset and L2 entry of every cluster of the virtual disk that is stored in the image
+func (i *Image) walkStored(fn func(pos int64, entry uint64) error) error {
+	cs := i.header.clusterSize()
+	coverage := i.header.l2Coverage()
+	for l1Index := int64(0); l1Index*coverage < i.Size(); l1Index++ {
+		l2, err := i.l2Table(l1Index)
+		if err != nil {
+			return err
+		}
+		for l2Index, entry := range l2 {
+			pos := l1Index*coverage + int64(l2Index)*cs
+			if pos >= i.Size() {
+				break
+			}
+			if !i.stored(entry) {
+				continue
+			}
+			if err := fn(pos, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discardCluster make the cluster of the virtual disk at pos read from the backing file again, releasing the
+// cluster it was stored in, if any
+func (i *Image) discardCluster(pos int64) error {
+	entry, err := i.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+	if err := i.setL2Entry(pos, 0); err != nil {
+		return err
+	}
+	if entry&flagCompressed != 0 {
+		return i.releaseCompressed(entry)
+	}
+	if host := int64(entry & offsetMask); host != 0 {
+		return i.addRefcount(host/i.header.clusterSize(), -1)
+	}
+	return nil
+}
+
+// Rebase changes the backing file of the image to name, as qemu-img rebase does, first copying into the image
+// every cluster that it does not store and that differs between the old and new backing files, so that the image
+// reads the same as before. A relative name is relative to the directory of the image, and the format of the new
+// backing file is detected. An empty name removes the backing file, copying all of its contents into the image.
+func (i *Image) Rebase(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.readOnly {
+		return backend.ErrIncorrectOpenMode
+	}
+	var backing *backingFile
+	if name != "" {
+		var err error
+		if backing, err = i.openBacking(name, "", true); err != nil {
+			return err
+		}
+	}
+	cs := i.header.clusterSize()
+	oldData, newData := make([]byte, cs), make([]byte, cs)
+	for pos := int64(0); pos < i.Size(); pos += cs {
+		if err := i.rebaseCluster(pos, backing, oldData, newData); err != nil {
+			_ = backing.close()
+			return err
+		}
+	}
+	old := i.backing
+	i.backing = backing
+	if err := i.writeHeader(); err != nil {
+		i.backing = old
+		_ = backing.close()
+		return err
+	}
+	return old.close()
+}
+
+// rebaseCluster copy the cluster of the virtual disk at pos from the backing file into the image, if the image
+// does not store it and it differs in backing, using oldData and newData, of a cluster each, to compare them
+func (i *Image) rebaseCluster(pos int64, backing *backingFile, oldData, newData []byte) error {
+	entry, err := i.l2Entry(pos)
+	if err != nil || i.stored(entry) {
+		return err
+	}
+	length := min(i.header.clusterSize(), i.Size()-pos)
+	oldAllocated, err := i.backing.allocated(pos, length)
+	if err != nil {
+		return err
+	}
+	newAllocated, err := backing.allocated(pos, length)
+	if err != nil || !oldAllocated && !newAllocated {
+		return err
+	}
+	if err := i.backing.readAt(oldData[:length], pos); err != nil {
+		return err
+	}
+	if err := backing.readAt(newData[:length], pos); err != nil {
+		return err
+	}
+	if bytes.Equal(oldData[:length], newData[:length]) {
+		return nil
+	}
+	if i.header.version >= 3 && bytes.Equal(oldData[:length], make([]byte, length)) {
+		return i.setL2Entry(pos, flagZero)
+	}
+	// what is past the end of the virtual disk in a short last cluster is written as zeroes
+	clear(oldData[length:])
+	return i.writeCluster(pos, entry, oldData)
+}
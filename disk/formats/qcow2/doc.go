@@ -0,0 +1,28 @@
+// Package qcow2 provides a backend.Storage implementation for qcow2 disk images, the format used by QEMU.
+//
+// The Image returned by New, OpenFromPath, Create or CreateFromPath translates reads and writes of the virtual
+// disk into reads and writes of the clusters in the image, via the L1 and L2 tables, allocating clusters at the
+// end of the image as they are first written, and keeping their refcounts up to date as it goes. It can be
+// passed directly to diskfs.OpenBackend to work with the partitions and filesystems of the virtual disk.
+//
+// Images of version 2 and 3 can be read, including compressed and zero clusters. They can be written in place,
+// except for those with internal snapshots, which are read-only. Compressed clusters can be written with
+// WriteCompressed to clusters that are not allocated yet, as when converting a disk to a new image, and are
+// replaced with uncompressed ones when written to with WriteAt. Space that is freed is not reused, so an image
+// can be compacted by converting it, as with qemu-img convert.
+//
+// An image may have a backing file, a qcow2 or raw image that the clusters it does not store are read from,
+// and that is opened read-only alongside it, relative to its directory. As its name comes from the image, it is
+// only opened WithBackingFiles, and a chain of backing files that loops or is too long is refused. Writing part of such a cluster copies
+// the rest of it from the backing file first. Commit writes the clusters of an image to its backing file, and
+// Rebase changes the backing file, or removes it, as qemu-img commit and rebase do.
+//
+// AllocationMap reports which clusters are stored in the image, and how, as qemu-img map does, and Stats counts
+// the I/O done through an image, for tools that plan transfers or check how sparse an image is.
+//
+// Images with an external data file, extended L2 entries, zstd compression, or encryption are not supported.
+//
+// references:
+//
+//	https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+package qcow2
@@ -0,0 +1,267 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// SectorSize is the unit in which compressed clusters are addressed, and of which the virtual size of a new
+	// image must be a multiple
+	SectorSize int64 = 512
+
+	magic            uint32 = 0x514649fb // "QFI\xfb"
+	headerSizeV2            = 72
+	headerSizeV3            = 104
+	minClusterBits          = 9
+	maxClusterBits          = 21
+	entrySize               = 8
+	maxRefcountOrder        = 6
+	// maxBackingFileSize the longest name of a backing file that QEMU accepts
+	maxBackingFileSize = 1023
+	// maxL1Size and maxRefcountTableSize the largest L1 and refcount tables that QEMU accepts, in bytes
+	maxL1Size            = 32 * 1024 * 1024
+	maxRefcountTableSize = 8 * 1024 * 1024
+
+	// header extension types; the extensions follow the header, each padded to a multiple of 8 bytes
+	extensionEnd           uint32 = 0
+	extensionBackingFormat uint32 = 0xe2792aca
+
+	// incompatible feature bits, of version 3 headers
+	featureDirty            uint64 = 1 << 0
+	featureCorrupt          uint64 = 1 << 1
+	featureExternalDataFile uint64 = 1 << 2
+	featureCompressionType  uint64 = 1 << 3
+	featureExtendedL2       uint64 = 1 << 4
+
+	// offsetMask the host offset of an L1 entry, an uncompressed L2 entry or a refcount table entry
+	offsetMask uint64 = 0x00fffffffffffe00
+	// flagCopied an L1 or L2 entry whose cluster has a refcount of exactly 1, so can be written in place
+	flagCopied uint64 = 1 << 63
+	// flagCompressed an L2 entry whose cluster is compressed
+	flagCompressed uint64 = 1 << 62
+	// flagZero an L2 entry whose cluster reads as zeroes, in version 3 images
+	flagZero uint64 = 1 << 0
+)
+
+// header the header of a qcow2 image, in its first cluster
+type header struct {
+	version               uint32
+	backingFileOffset     uint64
+	backingFileSize       uint32
+	clusterBits           uint32
+	size                  uint64
+	cryptMethod           uint32
+	l1Size                uint32
+	l1TableOffset         uint64
+	refcountTableOffset   uint64
+	refcountTableClusters uint32
+	nbSnapshots           uint32
+	snapshotsOffset       uint64
+	incompatibleFeatures  uint64
+	compatibleFeatures    uint64
+	autoclearFeatures     uint64
+	refcountOrder         uint32
+	headerLength          uint32
+	compressionType       uint8
+}
+
+func headerFromBytes(b []byte) (*header, error) {
+	if len(b) < headerSizeV2 {
+		return nil, fmt.Errorf("header had %d bytes instead of at least %d", len(b), headerSizeV2)
+	}
+	if m := binary.BigEndian.Uint32(b[0:4]); m != magic {
+		return nil, fmt.Errorf("invalid qcow2 magic %x", m)
+	}
+	h := &header{
+		version:               binary.BigEndian.Uint32(b[4:8]),
+		backingFileOffset:     binary.BigEndian.Uint64(b[8:16]),
+		backingFileSize:       binary.BigEndian.Uint32(b[16:20]),
+		clusterBits:           binary.BigEndian.Uint32(b[20:24]),
+		size:                  binary.BigEndian.Uint64(b[24:32]),
+		cryptMethod:           binary.BigEndian.Uint32(b[32:36]),
+		l1Size:                binary.BigEndian.Uint32(b[36:40]),
+		l1TableOffset:         binary.BigEndian.Uint64(b[40:48]),
+		refcountTableOffset:   binary.BigEndian.Uint64(b[48:56]),
+		refcountTableClusters: binary.BigEndian.Uint32(b[56:60]),
+		nbSnapshots:           binary.BigEndian.Uint32(b[60:64]),
+		snapshotsOffset:       binary.BigEndian.Uint64(b[64:72]),
+		// version 2 has none of the fields that follow, and their defaults
+		refcountOrder: 4,
+		headerLength:  headerSizeV2,
+	}
+	switch h.version {
+	case 2:
+	case 3:
+		if len(b) < headerSizeV3 {
+			return nil, fmt.Errorf("version 3 header had %d bytes instead of at least %d", len(b), headerSizeV3)
+		}
+		h.incompatibleFeatures = binary.BigEndian.Uint64(b[72:80])
+		h.compatibleFeatures = binary.BigEndian.Uint64(b[80:88])
+		h.autoclearFeatures = binary.BigEndian.Uint64(b[88:96])
+		h.refcountOrder = binary.BigEndian.Uint32(b[96:100])
+		h.headerLength = binary.BigEndian.Uint32(b[100:104])
+		if h.headerLength < headerSizeV3 {
+			return nil, fmt.Errorf("version 3 header length %d is less than %d", h.headerLength, headerSizeV3)
+		}
+		if h.headerLength > headerSizeV3 && len(b) > headerSizeV3 {
+			h.compressionType = b[104]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 version %d", h.version)
+	}
+	if h.clusterBits < minClusterBits || h.clusterBits > maxClusterBits {
+		return nil, fmt.Errorf("invalid cluster bits %d, must be between %d and %d", h.clusterBits, minClusterBits, maxClusterBits)
+	}
+	if h.refcountOrder > maxRefcountOrder {
+		return nil, fmt.Errorf("invalid refcount order %d, must be at most %d", h.refcountOrder, maxRefcountOrder)
+	}
+	if h.backingFileSize > maxBackingFileSize {
+		return nil, fmt.Errorf("backing file name of %d bytes is longer than the maximum of %d", h.backingFileSize, maxBackingFileSize)
+	}
+	if h.cryptMethod != 0 {
+		return nil, errors.New("encrypted qcow2 images are not supported")
+	}
+	switch unknown := h.incompatibleFeatures &^ (featureDirty | featureCorrupt | featureCompressionType); {
+	case unknown&featureExternalDataFile != 0:
+		return nil, errors.New("qcow2 images with an external data file are not supported")
+	case unknown&featureExtendedL2 != 0:
+		return nil, errors.New("qcow2 images with extended L2 entries are not supported")
+	case unknown != 0:
+		return nil, fmt.Errorf("unsupported incompatible features %#x", unknown)
+	}
+	// the compression type is only set with its feature bit, and 0 is deflate, the only one supported
+	if h.compressionType != 0 {
+		return nil, fmt.Errorf("unsupported compression type %d", h.compressionType)
+	}
+	if uint64(h.l1Size)*entrySize > maxL1Size {
+		return nil, fmt.Errorf("L1 table of %d entries is larger than the maximum of %d bytes", h.l1Size, maxL1Size)
+	}
+	if uint64(h.refcountTableClusters)*uint64(h.clusterSize()) > maxRefcountTableSize {
+		return nil, fmt.Errorf("refcount table of %d clusters is larger than the maximum of %d bytes", h.refcountTableClusters, maxRefcountTableSize)
+	}
+	if h.l1Size < h.l1Entries() {
+		return nil, fmt.Errorf("L1 table of %d entries too small for virtual size %d, needs %d", h.l1Size, h.size, h.l1Entries())
+	}
+	return h, nil
+}
+
+// checkBounds check that the L1 and refcount tables are within an image of size bytes, before they are read
+func (h *header) checkBounds(size int64) error {
+	tables := []struct {
+		name           string
+		offset, length uint64
+	}{
+		{"L1 table", h.l1TableOffset, uint64(h.l1Size) * entrySize},
+		{"refcount table", h.refcountTableOffset, uint64(h.refcountTableClusters) * uint64(h.clusterSize())},
+	}
+	for _, t := range tables {
+		if t.length != 0 && (t.offset > uint64(size) || t.length > uint64(size)-t.offset) {
+			return fmt.Errorf("%s at %d of %d bytes is beyond the end of the image of %d bytes", t.name, t.offset, t.length, size)
+		}
+	}
+	return nil
+}
+
+// toBytes the header as it is stored, of headerLength bytes
+func (h *header) toBytes() []byte {
+	b := make([]byte, max(h.headerLength, headerSizeV3))
+	binary.BigEndian.PutUint32(b[0:4], magic)
+	binary.BigEndian.PutUint32(b[4:8], h.version)
+	binary.BigEndian.PutUint64(b[8:16], h.backingFileOffset)
+	binary.BigEndian.PutUint32(b[16:20], h.backingFileSize)
+	binary.BigEndian.PutUint32(b[20:24], h.clusterBits)
+	binary.BigEndian.PutUint64(b[24:32], h.size)
+	binary.BigEndian.PutUint32(b[32:36], h.cryptMethod)
+	binary.BigEndian.PutUint32(b[36:40], h.l1Size)
+	binary.BigEndian.PutUint64(b[40:48], h.l1TableOffset)
+	binary.BigEndian.PutUint64(b[48:56], h.refcountTableOffset)
+	binary.BigEndian.PutUint32(b[56:60], h.refcountTableClusters)
+	binary.BigEndian.PutUint32(b[60:64], h.nbSnapshots)
+	binary.BigEndian.PutUint64(b[64:72], h.snapshotsOffset)
+	binary.BigEndian.PutUint64(b[72:80], h.incompatibleFeatures)
+	binary.BigEndian.PutUint64(b[80:88], h.compatibleFeatures)
+	binary.BigEndian.PutUint64(b[88:96], h.autoclearFeatures)
+	binary.BigEndian.PutUint32(b[96:100], h.refcountOrder)
+	binary.BigEndian.PutUint32(b[100:104], h.headerLength)
+	if h.headerLength > headerSizeV3 {
+		b[104] = h.compressionType
+	}
+	return b[:h.headerLength]
+}
+
+// extension a header extension, kept as it is when the header is rewritten, unless it is one this package
+// manages itself
+type extension struct {
+	kind uint32
+	data []byte
+}
+
+// extensionsFromBytes the header extensions at the start of b, which follows the header, up to the end marker
+func extensionsFromBytes(b []byte) ([]extension, error) {
+	var extensions []extension
+	for pos := 0; pos+8 <= len(b); {
+		kind := binary.BigEndian.Uint32(b[pos:])
+		length := binary.BigEndian.Uint32(b[pos+4:])
+		if kind == extensionEnd {
+			return extensions, nil
+		}
+		pos += 8
+		if length > uint32(len(b)-pos) {
+			return nil, fmt.Errorf("header extension %#x of %d bytes goes past the end of the first cluster", kind, length)
+		}
+		extensions = append(extensions, extension{kind: kind, data: b[pos : pos+int(length)]})
+		pos += int(alignUp(int64(length), 8))
+	}
+	return nil, errors.New("header extensions have no end marker in the first cluster")
+}
+
+// extensionsToBytes the header extensions as they are stored, with the end marker
+func extensionsToBytes(extensions []extension) []byte {
+	var b []byte
+	for _, e := range extensions {
+		b = binary.BigEndian.AppendUint32(b, e.kind)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(e.data)))
+		b = append(b, e.data...)
+		b = append(b, make([]byte, alignUp(int64(len(e.data)), 8)-int64(len(e.data)))...)
+	}
+	return append(b, make([]byte, 8)...)
+}
+
+// clusterSize the size of a cluster in bytes
+func (h *header) clusterSize() int64 {
+	return 1 << h.clusterBits
+}
+
+// l2Entries the number of entries in an L2 table, which takes a single cluster
+func (h *header) l2Entries() int64 {
+	return h.clusterSize() / entrySize
+}
+
+// l2Coverage the number of bytes of the virtual disk covered by a single L2 table
+func (h *header) l2Coverage() int64 {
+	return h.l2Entries() * h.clusterSize()
+}
+
+// l1Entries the number of L1 entries needed to cover the virtual disk
+func (h *header) l1Entries() uint32 {
+	coverage := uint64(h.l2Coverage())
+	return uint32((h.size + coverage - 1) / coverage)
+}
+
+// refcountBits the width of a refcount
+func (h *header) refcountBits() int64 {
+	return 1 << h.refcountOrder
+}
+
+// refcountBlockEntries the number of clusters whose refcounts a single refcount block holds
+func (h *header) refcountBlockEntries() int64 {
+	return h.clusterSize() * 8 / h.refcountBits()
+}
+
+// compressedOffsetBits the number of bits of a compressed L2 entry that hold the host offset; the bits above,
+// up to the flags, hold the number of additional sectors the compressed data takes
+func (h *header) compressedOffsetBits() uint32 {
+	return 62 - (h.clusterBits - 8)
+}
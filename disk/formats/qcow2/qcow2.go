@@ -0,0 +1,859 @@
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// DefaultClusterSize is the cluster size used when creating an image, if none is specified
+	DefaultClusterSize uint32 = 64 * 1024
+	// MinClusterSize is the smallest allowed cluster size
+	MinClusterSize uint32 = 1 << minClusterBits
+	// MaxClusterSize is the largest allowed cluster size
+	MaxClusterSize uint32 = 1 << maxClusterBits
+
+	// compressionWindow the deflate window of compressed clusters; QEMU inflates them with a window of 4KiB,
+	// so they must not refer further back than that
+	compressionWindow = 4096
+
+	// maxBackingChain the most images a chain of backing files may hold, counting the image at the top
+	maxBackingChain = 16
+)
+
+// Option is an option for opening an image with New or OpenFromPath
+type Option func(*options)
+
+type options struct {
+	backingFiles bool
+	chain        []fs.FileInfo // the images above this one in the chain of backing files
+}
+
+// WithBackingFiles opens the backing file of the image, and any backing files of its own, alongside it. The
+// name of the backing file comes from the image, which may have been made by anyone, so they are only opened
+// when the caller asks for it. Without it, an image that has a backing file cannot be opened.
+func WithBackingFiles(enable bool) Option {
+	return func(o *options) {
+		o.backingFiles = enable
+	}
+}
+
+// withChain the option that opens an image as the backing file of the images in chain
+func withChain(chain []fs.FileInfo) Option {
+	return func(o *options) {
+		o.backingFiles = true
+		o.chain = chain
+	}
+}
+
+// CreateOptions options for creating a new qcow2 image. Any zero values are replaced with the defaults.
+type CreateOptions struct {
+	// ClusterSize is the size of each cluster, which is the unit of allocation. Must be a power of 2
+	// between MinClusterSize and MaxClusterSize. Defaults to DefaultClusterSize.
+	ClusterSize uint32
+	// BackingFile is the path of an image whose contents show through the clusters of the new image that have
+	// not been written, as with qemu-img create -b. A relative path is relative to the directory of the new image,
+	// and is recorded as it is. If the size passed to Create is 0, the virtual disk is the size of the backing file.
+	BackingFile string
+	// BackingFormat is the format of the backing file, BackingFormatQCOW2 or BackingFormatRaw. If empty, it is
+	// detected.
+	BackingFormat string
+}
+
+// Image is a qcow2 image. It implements backend.Storage for the virtual disk contained in the image,
+// so it can be passed to diskfs.OpenBackend like any other backend. ReadAt and WriteAt, and the other methods
+// but Read and Seek, which share an offset, are safe for concurrent use; reads run in parallel, and writes
+// one at a time.
+type Image struct {
+	// mu is held for reading by reads of the image, and for writing by anything that changes it
+	mu sync.RWMutex
+	// cacheMu guards l2s and clusterCache, which reads fill in while holding mu only for reading
+	cacheMu        sync.Mutex
+	storage        backend.Storage
+	readOnly       bool
+	header         *header
+	extensions     []extension   // the header extensions
+	backing        *backingFile  // nil if the image has no backing file
+	chain          []fs.FileInfo // the images above this one in the chain of backing files, and this one
+	l1             []uint64
+	l2s            map[int64][]uint64 // L2 tables by L1 index, read as needed
+	refcountTable  []uint64
+	refcountBlocks map[uint64][]byte // refcount blocks by their offset, read as needed, only by writes
+	fileEnd        int64             // where the next cluster will be allocated
+	compressedEnd  int64             // where the next compressed cluster goes, if in the last cluster allocated
+	clusterCache   []byte            // the last compressed cluster that was read, decompressed
+	cachedCluster  uint64            // the L2 entry of the cluster in clusterCache
+	offset         int64             // for Read and Seek
+	stats          counters
+}
+
+// interface guards
+var (
+	_ backend.Storage            = (*Image)(nil)
+	_ backend.AllocationReporter = (*Image)(nil)
+)
+
+// New opens a qcow2 image from an existing backend.Storage, usually a file backend. The image is writable
+// if the provided storage is writable, unless it has internal snapshots, or was not closed cleanly after
+// being opened with lazy refcounts, or is marked corrupt, in which case it is read-only. An image that has a
+// backing file can only be opened WithBackingFiles.
+func New(b backend.Storage, opts ...Option) (*Image, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	_, err := b.Writable()
+	img := &Image{
+		storage:        b,
+		readOnly:       err != nil,
+		l2s:            map[int64][]uint64{},
+		refcountBlocks: map[uint64][]byte{},
+	}
+	if err := img.setChain(o.chain); err != nil {
+		return nil, err
+	}
+	if err := img.load(); err != nil {
+		return nil, err
+	}
+	if err := img.loadBacking(o.backingFiles); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// OpenFromPath opens a qcow2 image from a path to a file, which must exist.
+func OpenFromPath(pathName string, readOnly bool, opts ...Option) (*Image, error) {
+	b, err := file.OpenFromPath(pathName, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	img, err := New(b, opts...)
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// CreateFromPath creates a new qcow2 image at the given path, containing a virtual disk of size bytes.
+// The provided path must not exist.
+func CreateFromPath(pathName string, size int64, opts *CreateOptions) (*Image, error) {
+	if pathName == "" {
+		return nil, errors.New("must pass image path name")
+	}
+	f, err := os.OpenFile(pathName, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("could not create image %s: %w", pathName, err)
+	}
+	img, err := Create(file.New(f, false), size, opts)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// Create creates a new version 3 qcow2 image in the provided writable backend.Storage, containing a virtual
+// disk of size bytes, which must be a multiple of SectorSize. Clusters start out unallocated, reading as
+// zeroes or from the backing file, and are allocated as they are written.
+func Create(b backend.Storage, size int64, opts *CreateOptions) (*Image, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	clusterSize := opts.ClusterSize
+	if clusterSize == 0 {
+		clusterSize = DefaultClusterSize
+	}
+	img := &Image{
+		storage:        b,
+		l2s:            map[int64][]uint64{},
+		refcountBlocks: map[uint64][]byte{},
+	}
+	if err := img.setChain(nil); err != nil {
+		return nil, err
+	}
+	if opts.BackingFile != "" {
+		backing, err := img.openBacking(opts.BackingFile, opts.BackingFormat, true)
+		if err != nil {
+			return nil, err
+		}
+		img.backing = backing
+		if size == 0 {
+			size = alignUp(backing.size, SectorSize)
+		}
+	}
+	if err := img.create(size, clusterSize); err != nil {
+		_ = img.backing.close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// create write the metadata of a new image of size bytes with clusters of clusterSize bytes
+func (i *Image) create(size int64, clusterSize uint32) error {
+	if size <= 0 || size%SectorSize != 0 {
+		return fmt.Errorf("must pass valid virtual disk size to create, a positive multiple of %d", SectorSize)
+	}
+	if clusterSize < MinClusterSize || clusterSize > MaxClusterSize || clusterSize&(clusterSize-1) != 0 {
+		return fmt.Errorf("invalid cluster size %d, must be a power of 2 between %d and %d", clusterSize, MinClusterSize, MaxClusterSize)
+	}
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+
+	h := &header{
+		version:       3,
+		size:          uint64(size),
+		refcountOrder: 4,
+		headerLength:  headerSizeV3,
+	}
+	for 1<<h.clusterBits < clusterSize {
+		h.clusterBits++
+	}
+	cs := h.clusterSize()
+	h.l1Size = h.l1Entries()
+	l1Clusters := divUp(int64(h.l1Size)*entrySize, cs)
+	// the refcount table cannot grow, so it is made large enough for every cluster the image could ever have:
+	// the metadata and data clusters, with as many again to spare for the space of compressed clusters that
+	// are rewritten, which is not reused
+	maxClusters := 2 * (1 + l1Clusters + int64(h.l1Size) + divUp(size, cs))
+	refcountBlocks := divUp(maxClusters, h.refcountBlockEntries()) + 1
+	h.refcountTableClusters = uint32(divUp(refcountBlocks*entrySize, cs))
+	h.refcountTableOffset = uint64(cs)
+	h.l1TableOffset = uint64(cs * (1 + int64(h.refcountTableClusters)))
+
+	i.header = h
+	i.l1 = make([]uint64, h.l1Size)
+	i.refcountTable = make([]uint64, h.refcountTableClusters*uint32(cs/entrySize))
+	i.fileEnd = int64(h.l1TableOffset) + l1Clusters*cs
+	// the header, refcount table and L1 table, all empty but for the header itself
+	hb, err := i.headerBytes()
+	if err != nil {
+		return err
+	}
+	metadata := make([]byte, i.fileEnd)
+	copy(metadata, hb)
+	if _, err := writable.WriteAt(metadata, 0); err != nil {
+		return fmt.Errorf("unable to write qcow2 structures: %w", err)
+	}
+	// which are counted like any other clusters, allocating the first refcount block
+	for c, end := int64(0), i.fileEnd/cs; c < end; c++ {
+		if err := i.addRefcount(c, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load read the header, L1 table and refcount table from the storage
+func (i *Image) load() error {
+	hb := make([]byte, SectorSize)
+	if n, err := i.storage.ReadAt(hb, 0); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to read qcow2 header: %w", err)
+	} else if n < len(hb) {
+		hb = hb[:n]
+	}
+	h, err := headerFromBytes(hb)
+	if err != nil {
+		return fmt.Errorf("not a qcow2 image: %w", err)
+	}
+	i.header = h
+	// the header extensions follow the header, in the rest of the first cluster
+	cluster := make([]byte, h.clusterSize())
+	n, err := i.storage.ReadAt(cluster, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to read qcow2 header: %w", err)
+	}
+	if n > int(h.headerLength) {
+		if i.extensions, err = extensionsFromBytes(cluster[h.headerLength:n]); err != nil {
+			return fmt.Errorf("invalid qcow2 header extensions: %w", err)
+		}
+	}
+	info, err := i.storage.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat qcow2 image: %w", err)
+	}
+	if err := h.checkBounds(info.Size()); err != nil {
+		return fmt.Errorf("invalid qcow2 header: %w", err)
+	}
+
+	// snapshots share clusters with the active image, which would have to be copied before being written;
+	// a dirty image may have refcounts that are out of date, and a corrupt one anything
+	if h.nbSnapshots != 0 || h.incompatibleFeatures&(featureDirty|featureCorrupt) != 0 {
+		i.readOnly = true
+	}
+	if i.l1, err = i.readTable(int64(h.l1TableOffset), int64(h.l1Size)); err != nil {
+		return fmt.Errorf("unable to read qcow2 L1 table: %w", err)
+	}
+	if !i.readOnly {
+		entries := int64(h.refcountTableClusters) * h.clusterSize() / entrySize
+		if i.refcountTable, err = i.readTable(int64(h.refcountTableOffset), entries); err != nil {
+			return fmt.Errorf("unable to read qcow2 refcount table: %w", err)
+		}
+	}
+	i.fileEnd = alignUp(info.Size(), h.clusterSize())
+	return nil
+}
+
+// readTable read a table of count big-endian entries at the given offset
+func (i *Image) readTable(offset, count int64) ([]uint64, error) {
+	b := make([]byte, count*entrySize)
+	if n, err := i.storage.ReadAt(b, offset); err != nil && n != len(b) {
+		return nil, fmt.Errorf("unable to read %d entries at %d: %w", count, offset, err)
+	}
+	entries := make([]uint64, count)
+	for j := range entries {
+		entries[j] = binary.BigEndian.Uint64(b[j*entrySize:])
+	}
+	return entries, nil
+}
+
+// l2Table get the L2 table for the given L1 index, or nil if it is not allocated
+func (i *Image) l2Table(l1Index int64) ([]uint64, error) {
+	i.cacheMu.Lock()
+	l2, ok := i.l2s[l1Index]
+	i.cacheMu.Unlock()
+	if ok {
+		return l2, nil
+	}
+	offset := i.l1[l1Index] & offsetMask
+	if offset == 0 {
+		return nil, nil
+	}
+	l2, err := i.readTable(int64(offset), i.header.l2Entries())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read qcow2 L2 table: %w", err)
+	}
+	// another read may have got there first, and only one copy can be kept up to date by writes
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	if cached, ok := i.l2s[l1Index]; ok {
+		return cached, nil
+	}
+	i.l2s[l1Index] = l2
+	return l2, nil
+}
+
+// l2Entry the L2 entry of the cluster holding the given offset of the virtual disk, or 0 if its L2 table
+// is not allocated
+func (i *Image) l2Entry(offset int64) (uint64, error) {
+	l2, err := i.l2Table(offset / i.header.l2Coverage())
+	if err != nil || l2 == nil {
+		return 0, err
+	}
+	return l2[offset%i.header.l2Coverage()/i.header.clusterSize()], nil
+}
+
+// dataOffset the host offset of the uncompressed cluster of an L2 entry, or 0 if it reads as zeroes
+func (i *Image) dataOffset(entry uint64) int64 {
+	if entry&flagCompressed != 0 || (i.header.version >= 3 && entry&flagZero != 0) {
+		return 0
+	}
+	return int64(entry & offsetMask)
+}
+
+// Size returns the size of the virtual disk in bytes
+func (i *Image) Size() int64 {
+	return int64(i.header.size)
+}
+
+// ClusterSize returns the size of the clusters in bytes
+func (i *Image) ClusterSize() int64 {
+	return i.header.clusterSize()
+}
+
+// Allocated reports whether any of the length bytes of the virtual disk at off are stored in the image, or
+// in its backing file where the image does not store them. If not, they all read as zeroes, and copying the
+// disk can skip them.
+func (i *Image) Allocated(off, length int64) (bool, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	cs := i.header.clusterSize()
+	end := min(off+length, i.Size())
+	for pos := off - off%cs; pos < end; pos += cs {
+		l1Index := pos / i.header.l2Coverage()
+		l2, err := i.l2Table(l1Index)
+		if err != nil {
+			return false, err
+		}
+		if l2 == nil && i.backing == nil {
+			// skip to the start of the next L2 table
+			pos = (l1Index+1)*i.header.l2Coverage() - cs
+			continue
+		}
+		var entry uint64
+		if l2 != nil {
+			entry = l2[pos%i.header.l2Coverage()/cs]
+		}
+		if entry&flagCompressed != 0 || i.dataOffset(entry) != 0 {
+			return true, nil
+		}
+		if !i.stored(entry) {
+			start := max(pos, off)
+			if allocated, err := i.backing.allocated(start, min(pos+cs, end)-start); err != nil || allocated {
+				return allocated, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// ReadAt reads from the virtual disk at the given offset. Zero clusters read as zeroes, as do unallocated ones,
+// unless the image has a backing file, which they are read from.
+func (i *Image) ReadAt(p []byte, off int64) (int, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	n, err := i.readAt(p, off)
+	i.stats.readOps.Add(1)
+	i.stats.readBytes.Add(int64(n))
+	return n, err
+}
+
+// readAt read from the virtual disk at the given offset, without counting it
+func (i *Image) readAt(p []byte, off int64) (int, error) {
+	size := i.Size()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	var err error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	cs := i.header.clusterSize()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		inCluster := pos % cs
+		count := min(int64(len(p)-n), cs-inCluster)
+		target := p[n : n+int(count)]
+		entry, err := i.l2Entry(pos)
+		if err != nil {
+			return n, err
+		}
+		if entry&flagCompressed != 0 {
+			cluster, err := i.readCompressedCluster(entry)
+			if err != nil {
+				return n, err
+			}
+			copy(target, cluster[inCluster:])
+		} else if !i.stored(entry) {
+			if err := i.backing.readAt(target, pos); err != nil {
+				return n, err
+			}
+			if i.backing != nil {
+				i.stats.backingReadBytes.Add(count)
+			}
+		} else if host := i.dataOffset(entry); host == 0 {
+			clear(target)
+		} else if read, err := i.storage.ReadAt(target, host+inCluster); err != nil && read != len(target) {
+			return n + read, fmt.Errorf("unable to read cluster at %d: %w", host, err)
+		}
+		n += int(count)
+	}
+	return n, err
+}
+
+// compressedLocation the host offset and size of the data of a compressed cluster
+func (i *Image) compressedLocation(entry uint64) (offset, size int64) {
+	bits := i.header.compressedOffsetBits()
+	offset = int64(entry & (1<<bits - 1))
+	sectors := int64((entry&^(flagCopied|flagCompressed))>>bits) + 1
+	return offset, sectors*SectorSize - offset%SectorSize
+}
+
+// readCompressedCluster read and decompress the compressed cluster of an L2 entry
+func (i *Image) readCompressedCluster(entry uint64) ([]byte, error) {
+	i.cacheMu.Lock()
+	cached, cachedEntry := i.clusterCache, i.cachedCluster
+	i.cacheMu.Unlock()
+	if cached != nil && cachedEntry == entry {
+		return cached, nil
+	}
+	offset, size := i.compressedLocation(entry)
+	// the sectors of the last compressed cluster may go past the end of the file
+	compressed := make([]byte, size)
+	n, err := i.storage.ReadAt(compressed, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to read compressed cluster at %d: %w", offset, err)
+	}
+	cluster := make([]byte, i.header.clusterSize())
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(compressed[:n])), cluster); err != nil {
+		return nil, fmt.Errorf("unable to decompress cluster at %d: %w", offset, err)
+	}
+	i.stats.clustersDecompressed.Add(1)
+	i.cacheMu.Lock()
+	i.clusterCache, i.cachedCluster = cluster, entry
+	i.cacheMu.Unlock()
+	return cluster, nil
+}
+
+// WriteAt writes to the virtual disk at the given offset, allocating clusters as needed. A compressed cluster
+// that is written to is replaced by an uncompressed one.
+func (i *Image) WriteAt(p []byte, off int64) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n, err := i.writeAt(p, off)
+	i.stats.writeOps.Add(1)
+	i.stats.writeBytes.Add(int64(n))
+	return n, err
+}
+
+// writeAt write to the virtual disk at the given offset, without counting it
+func (i *Image) writeAt(p []byte, off int64) (int, error) {
+	if i.readOnly {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	size := i.Size()
+	if off < 0 || off+int64(len(p)) > size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of virtual disk of size %d", len(p), off, size)
+	}
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return 0, err
+	}
+	cs := i.header.clusterSize()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		inCluster := pos % cs
+		count := min(int64(len(p)-n), cs-inCluster)
+		data := p[n : n+int(count)]
+		entry, err := i.l2Entry(pos)
+		if err != nil {
+			return n, err
+		}
+		if host := i.dataOffset(entry); host != 0 {
+			if entry&flagCopied == 0 {
+				return n, fmt.Errorf("cluster at %d is shared, and cannot be written in place", host)
+			}
+			if _, err := writable.WriteAt(data, host+inCluster); err != nil {
+				return n, fmt.Errorf("unable to write cluster at %d: %w", host, err)
+			}
+			n += int(count)
+			continue
+		}
+		// a new cluster gets all of the contents of the one it replaces, so that what is not written stays
+		cluster := make([]byte, cs)
+		if entry&flagCompressed != 0 {
+			old, err := i.readCompressedCluster(entry)
+			if err != nil {
+				return n, err
+			}
+			copy(cluster, old)
+		} else if !i.stored(entry) && count < cs && i.backing != nil {
+			if err := i.backing.readAt(cluster, pos-inCluster); err != nil {
+				return n, err
+			}
+			i.stats.backingReadBytes.Add(cs - count)
+		}
+		copy(cluster[inCluster:], data)
+		if err := i.writeCluster(pos, entry, cluster); err != nil {
+			return n, err
+		}
+		n += int(count)
+	}
+	return n, nil
+}
+
+// writeCluster write a whole cluster of the virtual disk at pos, whose L2 entry was entry, to a cluster of
+// its own, and point its L2 entry at it. A zero cluster keeps the cluster preallocated for it, if any.
+func (i *Image) writeCluster(pos int64, entry uint64, cluster []byte) error {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	host := int64(entry & offsetMask)
+	if entry&flagCompressed != 0 || host == 0 {
+		if host, err = i.allocateClusters(1); err != nil {
+			return fmt.Errorf("unable to allocate cluster for offset %d: %w", pos, err)
+		}
+	}
+	if _, err := writable.WriteAt(cluster, host); err != nil {
+		return fmt.Errorf("unable to write cluster at %d: %w", host, err)
+	}
+	if err := i.setL2Entry(pos, uint64(host)|flagCopied); err != nil {
+		return err
+	}
+	if entry&flagCompressed != 0 {
+		return i.releaseCompressed(entry)
+	}
+	return nil
+}
+
+// WriteCompressed writes whole clusters to the virtual disk at off, which must be at the start of a cluster,
+// compressing each of them. p must be a whole number of clusters, except at the end of the virtual disk, and
+// the clusters must not be allocated yet, as for a new image that is written once. Clusters that are all
+// zeroes are left unallocated, or made zero clusters if the image has a backing file, and those that do not
+// get smaller are written uncompressed.
+func (i *Image) WriteCompressed(p []byte, off int64) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n, err := i.writeCompressed(p, off)
+	i.stats.writeOps.Add(1)
+	i.stats.writeBytes.Add(int64(n))
+	return n, err
+}
+
+// writeCompressed write whole clusters to the virtual disk at off compressed, without counting it
+func (i *Image) writeCompressed(p []byte, off int64) (int, error) {
+	if i.readOnly {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	size := i.Size()
+	cs := i.header.clusterSize()
+	if off < 0 || off+int64(len(p)) > size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of virtual disk of size %d", len(p), off, size)
+	}
+	if off%cs != 0 || (int64(len(p))%cs != 0 && off+int64(len(p)) != size) {
+		return 0, fmt.Errorf("compressed write of %d bytes at %d is not of whole clusters of %d bytes", len(p), off, cs)
+	}
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		count := min(int64(len(p)-n), cs)
+		data := p[n : n+int(count)]
+		entry, err := i.l2Entry(pos)
+		if err != nil {
+			return n, err
+		}
+		if entry&flagCompressed != 0 || i.dataOffset(entry) != 0 {
+			return n, fmt.Errorf("cluster for offset %d is already allocated", pos)
+		}
+		switch {
+		case !bytes.Equal(data, make([]byte, len(data))):
+			err = i.writeCompressedCluster(pos, entry, data)
+		case i.backing != nil && i.header.version >= 3:
+			err = i.setL2Entry(pos, flagZero)
+		case i.backing != nil:
+			err = i.writeCluster(pos, entry, make([]byte, cs))
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int(count)
+	}
+	return n, nil
+}
+
+// writeCompressedCluster compress a cluster of the virtual disk at pos, whose L2 entry was entry, and write it
+// after the last compressed cluster if it fits in the rest of its cluster, or to new clusters otherwise
+func (i *Image) writeCompressedCluster(pos int64, entry uint64, data []byte) error {
+	cs := i.header.clusterSize()
+	var buf bytes.Buffer
+	w, err := flate.NewWriterWindow(&buf, compressionWindow)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("unable to compress cluster for offset %d: %w", pos, err)
+	}
+	// a short last cluster is padded with zeroes, as the whole cluster is decompressed
+	if _, err := w.Write(make([]byte, cs-int64(len(data)))); err != nil {
+		return fmt.Errorf("unable to compress cluster for offset %d: %w", pos, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to compress cluster for offset %d: %w", pos, err)
+	}
+	compressed := buf.Bytes()
+	if int64(len(compressed)) >= cs {
+		cluster := make([]byte, cs)
+		copy(cluster, data)
+		return i.writeCluster(pos, entry, cluster)
+	}
+
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	length := int64(len(compressed))
+	// the cluster the last compressed cluster ended in, which may still be the last one allocated
+	start := i.compressedEnd
+	if start%cs == 0 || alignUp(start, cs) != i.fileEnd {
+		if start, err = i.allocateClusters(divUp(length, cs)); err != nil {
+			return fmt.Errorf("unable to allocate clusters for offset %d: %w", pos, err)
+		}
+	} else {
+		// each compressed cluster counts once for every cluster its data is in
+		if err := i.addRefcount(start/cs, 1); err != nil {
+			return err
+		}
+		if rest := length - (i.fileEnd - start); rest > 0 {
+			if _, err := i.allocateClusters(divUp(rest, cs)); err != nil {
+				return fmt.Errorf("unable to allocate clusters for offset %d: %w", pos, err)
+			}
+		}
+	}
+	if _, err := writable.WriteAt(compressed, start); err != nil {
+		return fmt.Errorf("unable to write compressed cluster at %d: %w", start, err)
+	}
+	i.compressedEnd = start + length
+	sectors := uint64((start+length-1)/SectorSize - start/SectorSize)
+	return i.setL2Entry(pos, flagCompressed|sectors<<i.header.compressedOffsetBits()|uint64(start))
+}
+
+// releaseCompressed drop the references of a compressed cluster that has been replaced to the clusters its
+// data is in
+func (i *Image) releaseCompressed(entry uint64) error {
+	cs := i.header.clusterSize()
+	offset, size := i.compressedLocation(entry)
+	for c := offset / cs; c <= (offset+size-1)/cs; c++ {
+		if err := i.addRefcount(c, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setL2Entry save the L2 entry of the cluster holding the given offset of the virtual disk, allocating its
+// L2 table if needed
+func (i *Image) setL2Entry(offset int64, entry uint64) error {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	l1Index := offset / i.header.l2Coverage()
+	l2Index := offset % i.header.l2Coverage() / i.header.clusterSize()
+	l2, err := i.l2Table(l1Index)
+	if err != nil {
+		return err
+	}
+	if l2 == nil {
+		if l2, err = i.allocateL2Table(l1Index); err != nil {
+			return err
+		}
+	}
+	b := binary.BigEndian.AppendUint64(nil, entry)
+	if _, err := writable.WriteAt(b, int64(i.l1[l1Index]&offsetMask)+l2Index*entrySize); err != nil {
+		return fmt.Errorf("unable to write L2 entry: %w", err)
+	}
+	l2[l2Index] = entry
+	return nil
+}
+
+// allocateL2Table allocate a new L2 table for the given L1 index, and save it in the L1 table
+func (i *Image) allocateL2Table(l1Index int64) ([]uint64, error) {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	offset, err := i.allocateClusters(1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to allocate L2 table: %w", err)
+	}
+	if _, err := writable.WriteAt(make([]byte, i.header.clusterSize()), offset); err != nil {
+		return nil, fmt.Errorf("unable to write L2 table: %w", err)
+	}
+	entry := uint64(offset) | flagCopied
+	b := binary.BigEndian.AppendUint64(nil, entry)
+	if _, err := writable.WriteAt(b, int64(i.header.l1TableOffset)+l1Index*entrySize); err != nil {
+		return nil, fmt.Errorf("unable to write L1 entry: %w", err)
+	}
+	i.l1[l1Index] = entry
+	l2 := make([]uint64, i.header.l2Entries())
+	i.cacheMu.Lock()
+	i.l2s[l1Index] = l2
+	i.cacheMu.Unlock()
+	return l2, nil
+}
+
+// Sys returns an error, as a qcow2 image cannot be used for ioctl calls
+func (i *Image) Sys() (*os.File, error) {
+	return nil, backend.ErrNotSuitable
+}
+
+// Writable returns the image for read-write operations, if it was opened read-write
+func (i *Image) Writable() (backend.WritableFile, error) {
+	if i.readOnly {
+		return nil, backend.ErrIncorrectOpenMode
+	}
+	return i, nil
+}
+
+// Stat returns information about the virtual disk, whose size is the virtual size and not the size of the image
+func (i *Image) Stat() (fs.FileInfo, error) {
+	info, err := i.storage.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: info.Name(), size: i.Size(), mode: info.Mode(), modTime: info.ModTime()}, nil
+}
+
+// Read reads from the virtual disk at the current offset
+func (i *Image) Read(b []byte) (int, error) {
+	n, err := i.ReadAt(b, i.offset)
+	i.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (i *Image) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = i.offset + offset
+	case io.SeekEnd:
+		newOffset = i.Size() + offset
+	default:
+		return i.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return i.offset, errors.New("cannot seek to negative offset")
+	}
+	i.offset = newOffset
+	return i.offset, nil
+}
+
+// Close closes the underlying storage, and the backing file if any. Every write is already in the image,
+// metadata included.
+func (i *Image) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.backing.close(); err != nil {
+		_ = i.storage.Close()
+		return err
+	}
+	return i.storage.Close()
+}
+
+// fileInfo information about the virtual disk
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() fs.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return false }
+func (f *fileInfo) Sys() any           { return nil }
+
+// alignUp round n up to a multiple of align, which must be a power of 2
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// divUp the number of whole units of size needed to hold n
+func divUp(n, size int64) int64 {
+	return (n + size - 1) / size
+}
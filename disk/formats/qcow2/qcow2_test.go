@@ -0,0 +1,637 @@
+package qcow2_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/qcow2"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestCreateReadWrite(t *testing.T) {
+	const (
+		size        = 1024 * 1024 * 1024
+		clusterSize = 64 * 1024
+	)
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.CreateFromPath(p, size, &qcow2.CreateOptions{ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	info, err := img.Stat()
+	if err != nil {
+		t.Fatalf("error getting image info: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("mismatched size, actual %d expected %d", info.Size(), size)
+	}
+
+	// unallocated clusters read as zeroes
+	b := make([]byte, 4096)
+	if _, err := img.ReadAt(b, 10*clusterSize); err != nil {
+		t.Fatalf("error reading unallocated cluster: %v", err)
+	}
+	if !bytes.Equal(b, make([]byte, len(b))) {
+		t.Errorf("unallocated cluster did not read as zeroes")
+	}
+
+	// write across a cluster boundary, across an L2 table boundary, and at the end of the disk
+	data := make([]byte, 3*4096)
+	_, _ = rand.Read(data)
+	offsets := []int64{5*clusterSize - 4096, 8192*clusterSize - 4096, size - int64(len(data))}
+	for _, offset := range offsets {
+		n, err := img.WriteAt(data, offset)
+		if err != nil {
+			t.Fatalf("error writing at %d: %v", offset, err)
+		}
+		if n != len(data) {
+			t.Fatalf("wrote %d bytes instead of %d", n, len(data))
+		}
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		img, err = qcow2.OpenFromPath(p, readOnly)
+		if err != nil {
+			t.Fatalf("error opening image: %v", err)
+		}
+		for _, offset := range offsets[:2] {
+			read := make([]byte, len(data)+2*4096)
+			if _, err := img.ReadAt(read, offset-4096); err != nil {
+				t.Fatalf("error reading at %d: %v", offset, err)
+			}
+			if !bytes.Equal(read[4096:4096+len(data)], data) {
+				t.Errorf("read data at %d did not match written data", offset)
+			}
+			if !bytes.Equal(read[:4096], make([]byte, 4096)) || !bytes.Equal(read[4096+len(data):], make([]byte, 4096)) {
+				t.Errorf("data around the written data at %d was not zeroes", offset)
+			}
+		}
+		read := make([]byte, len(data))
+		if _, err := img.ReadAt(read, offsets[2]); err != nil {
+			t.Fatalf("error reading end of disk: %v", err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("read data at end of disk did not match written data")
+		}
+		for _, tt := range []struct {
+			offset, length int64
+			allocated      bool
+		}{
+			{0, 4 * clusterSize, false},
+			{0, 5 * clusterSize, true},
+			{6 * clusterSize, 8000 * clusterSize, false},
+			{size - 1, 1, true},
+		} {
+			allocated, err := img.Allocated(tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("error getting allocation: %v", err)
+			}
+			if allocated != tt.allocated {
+				t.Errorf("%d bytes at %d allocated %v instead of %v", tt.length, tt.offset, allocated, tt.allocated)
+			}
+		}
+		_, err = img.WriteAt(data, 0)
+		if readOnly && err == nil {
+			t.Errorf("write to read-only image succeeded")
+		}
+		if !readOnly && err != nil {
+			t.Errorf("write to read-write image failed: %v", err)
+		}
+		_ = img.Close()
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	const (
+		size        = 10 * 1024 * 1024
+		clusterSize = 64 * 1024
+	)
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.CreateFromPath(p, size, nil)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	data := bytes.Repeat([]byte("a compressible cluster "), 4*clusterSize/23+1)[:4*clusterSize]
+	// a cluster of zeroes in the middle is left unallocated
+	clear(data[clusterSize : 2*clusterSize])
+	if _, err := img.WriteCompressed(data, clusterSize); err != nil {
+		t.Fatalf("error writing compressed: %v", err)
+	}
+	if _, err := img.WriteCompressed(data[:100], 0); err == nil {
+		t.Errorf("compressed write of part of a cluster succeeded")
+	}
+	if _, err := img.WriteCompressed(data[:clusterSize], clusterSize); err == nil {
+		t.Errorf("compressed write to an allocated cluster succeeded")
+	}
+	allocated, err := img.Allocated(2*clusterSize, clusterSize)
+	if err != nil {
+		t.Fatalf("error getting allocation: %v", err)
+	}
+	if allocated {
+		t.Errorf("cluster of zeroes was allocated")
+	}
+	// rewriting part of a compressed cluster keeps the rest of it
+	patch := []byte("patched")
+	if _, err := img.WriteAt(patch, 3*clusterSize+10); err != nil {
+		t.Fatalf("error writing to compressed cluster: %v", err)
+	}
+	copy(data[2*clusterSize+10:], patch)
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+
+	img, err = qcow2.OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer img.Close()
+	read := make([]byte, len(data))
+	if _, err := img.ReadAt(read, clusterSize); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("read data did not match compressed data")
+	}
+	info, err := img.Stat()
+	if err != nil {
+		t.Fatalf("error getting image info: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("mismatched size, actual %d expected %d", info.Size(), size)
+	}
+}
+
+// TestParallelReadAt reads an image from many goroutines at once, while another writes to it, which is meant to
+// be run with -race
+func TestParallelReadAt(t *testing.T) {
+	const (
+		// small clusters, so that the disk spans several L2 tables
+		clusterSize = 4096
+		clusters    = 2048
+		size        = clusters * clusterSize
+		readers     = 8
+	)
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.CreateFromPath(p, size, &qcow2.CreateOptions{ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	// the first half alternates between plain and compressed clusters, each with contents of its own, so that
+	// readers keep replacing the cached decompressed cluster
+	data := make([]byte, size/2)
+	for c := 0; c < clusters/2; c++ {
+		cluster := data[c*clusterSize : (c+1)*clusterSize]
+		copy(cluster, bytes.Repeat([]byte(fmt.Sprintf("cluster %d ", c)), clusterSize))
+		write := img.WriteAt
+		if c%2 == 1 {
+			write = img.WriteCompressed
+		}
+		if _, err := write(cluster, int64(c*clusterSize)); err != nil {
+			t.Fatalf("error writing cluster %d: %v", c, err)
+		}
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+	// opened again, so that the L2 tables are read by the readers
+	img, err = qcow2.OpenFromPath(p, false)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer img.Close()
+
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			b := make([]byte, clusterSize)
+			for j := 0; j < clusters/2; j++ {
+				c := (j*7 + r*131) % (clusters / 2)
+				if _, err := img.ReadAt(b, int64(c*clusterSize)); err != nil {
+					t.Errorf("error reading cluster %d: %v", c, err)
+					return
+				}
+				if !bytes.Equal(b, data[c*clusterSize:(c+1)*clusterSize]) {
+					t.Errorf("cluster %d did not match what was written", c)
+					return
+				}
+			}
+		}(r)
+	}
+	// the second half is written meanwhile, allocating clusters and L2 tables
+	written := make([]byte, size/2)
+	_, _ = rand.Read(written)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for off := 0; off < len(written); off += 3 * clusterSize {
+			end := min(off+3*clusterSize, len(written))
+			if _, err := img.WriteAt(written[off:end], size/2+int64(off)); err != nil {
+				t.Errorf("error writing at %d: %v", size/2+off, err)
+				return
+			}
+			_ = img.Stats()
+		}
+	}()
+	wg.Wait()
+
+	if got := readAll(t, img); !bytes.Equal(got[:size/2], data) || !bytes.Equal(got[size/2:], written) {
+		t.Errorf("disk did not read back as written")
+	}
+	if stats := img.Stats(); stats.ReadOps < readers*clusters/2 || stats.WriteBytes != size/2 {
+		t.Errorf("%d reads and %d bytes written instead of at least %d and %d", stats.ReadOps, stats.WriteBytes, readers*clusters/2, size/2)
+	}
+}
+
+func TestPartitionAndFilesystem(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	d, err := diskfs.Create(p, 64*1024*1024, diskfs.SectorSizeDefault, diskfs.WithFormat(diskfs.FormatQCOW2))
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 100000, Type: gpt.EFISystemPartition, Name: "EFI System"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("error partitioning disk: %v", err)
+	}
+	fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "EFI"})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing disk: %v", err)
+	}
+
+	img, err := qcow2.OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	d, err = diskfs.OpenBackend(img)
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	defer d.Close()
+	if d.Table == nil || d.Table.Type() != "gpt" {
+		t.Fatalf("did not find gpt partition table")
+	}
+	fs, err = d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	entries, err := fs.ReadDir("/EFI")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var found bool
+	for _, e := range entries {
+		if e.Name() == "BOOT" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("did not find directory /EFI/BOOT")
+	}
+}
+
+// readAll read the whole virtual disk of an image
+func readAll(t *testing.T, img *qcow2.Image) []byte {
+	t.Helper()
+	b := make([]byte, img.Size())
+	if _, err := img.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+	return b
+}
+
+func TestBackingFileCommit(t *testing.T) {
+	const (
+		size        = 4 * 1024 * 1024
+		clusterSize = 64 * 1024
+	)
+	dir := t.TempDir()
+	base, err := qcow2.CreateFromPath(filepath.Join(dir, "base.qcow2"), size, nil)
+	if err != nil {
+		t.Fatalf("error creating base image: %v", err)
+	}
+	data := make([]byte, 2*clusterSize)
+	_, _ = rand.Read(data)
+	if _, err := base.WriteAt(data, 0); err != nil {
+		t.Fatalf("error writing base image: %v", err)
+	}
+	if err := base.Close(); err != nil {
+		t.Fatalf("error closing base image: %v", err)
+	}
+
+	// the size comes from the backing file, which shows through until written
+	p := filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.CreateFromPath(p, 0, &qcow2.CreateOptions{BackingFile: "base.qcow2"})
+	if err != nil {
+		t.Fatalf("error creating overlay: %v", err)
+	}
+	if img.Size() != size {
+		t.Errorf("overlay size %d instead of the size of its backing file %d", img.Size(), size)
+	}
+	expected := make([]byte, size)
+	copy(expected, data)
+	if !bytes.Equal(readAll(t, img), expected) {
+		t.Errorf("overlay did not read as its backing file")
+	}
+	// writing part of a cluster keeps the rest of it from the backing file
+	patch := []byte("patched")
+	for _, offset := range []int64{clusterSize + 10, 3 * clusterSize} {
+		if _, err := img.WriteAt(patch, offset); err != nil {
+			t.Fatalf("error writing overlay: %v", err)
+		}
+		copy(expected[offset:], patch)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing overlay: %v", err)
+	}
+
+	if _, err := qcow2.OpenFromPath(p, true); err == nil {
+		t.Errorf("opened overlay without WithBackingFiles")
+	}
+	img, err = qcow2.OpenFromPath(p, false, qcow2.WithBackingFiles(true))
+	if err != nil {
+		t.Fatalf("error opening overlay: %v", err)
+	}
+	defer img.Close()
+	if img.BackingFile() != "base.qcow2" {
+		t.Errorf("backing file %q instead of %q", img.BackingFile(), "base.qcow2")
+	}
+	if !bytes.Equal(readAll(t, img), expected) {
+		t.Errorf("overlay did not read as written after reopening")
+	}
+	if err := img.Commit(); err != nil {
+		t.Fatalf("error committing overlay: %v", err)
+	}
+	if !bytes.Equal(readAll(t, img), expected) {
+		t.Errorf("overlay did not read the same after committing")
+	}
+	base, err = qcow2.OpenFromPath(filepath.Join(dir, "base.qcow2"), true)
+	if err != nil {
+		t.Fatalf("error opening base image: %v", err)
+	}
+	defer base.Close()
+	if !bytes.Equal(readAll(t, base), expected) {
+		t.Errorf("base image did not have the committed clusters")
+	}
+
+	noBacking, err := qcow2.CreateFromPath(filepath.Join(dir, "alone.qcow2"), size, nil)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	defer noBacking.Close()
+	if err := noBacking.Commit(); err == nil {
+		t.Errorf("commit of an image without a backing file succeeded")
+	}
+}
+
+func TestRebase(t *testing.T) {
+	const (
+		size        = 1024 * 1024
+		clusterSize = 4096
+	)
+	dir := t.TempDir()
+	old := make([]byte, size)
+	_, _ = rand.Read(old)
+	// the new backing file differs from the old one in a few clusters, and is shorter
+	backing := bytes.Clone(old[:size-clusterSize])
+	_, _ = rand.Read(backing[10*clusterSize : 12*clusterSize])
+	clear(backing[20*clusterSize : 21*clusterSize])
+	if err := os.WriteFile(filepath.Join(dir, "old.img"), old, 0o600); err != nil {
+		t.Fatalf("error writing old backing file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new.img"), backing, 0o600); err != nil {
+		t.Fatalf("error writing new backing file: %v", err)
+	}
+
+	p := filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.CreateFromPath(p, size, &qcow2.CreateOptions{ClusterSize: clusterSize, BackingFile: "old.img", BackingFormat: qcow2.BackingFormatRaw})
+	if err != nil {
+		t.Fatalf("error creating overlay: %v", err)
+	}
+	expected := bytes.Clone(old)
+	patch := []byte("patched")
+	if _, err := img.WriteAt(patch, 11*clusterSize); err != nil {
+		t.Fatalf("error writing overlay: %v", err)
+	}
+	copy(expected[11*clusterSize:], patch)
+
+	if err := img.Rebase("new.img"); err != nil {
+		t.Fatalf("error rebasing: %v", err)
+	}
+	if img.BackingFile() != "new.img" {
+		t.Errorf("backing file %q instead of %q", img.BackingFile(), "new.img")
+	}
+	if !bytes.Equal(readAll(t, img), expected) {
+		t.Errorf("image did not read the same after rebasing")
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing overlay: %v", err)
+	}
+
+	img, err = qcow2.OpenFromPath(p, false, qcow2.WithBackingFiles(true))
+	if err != nil {
+		t.Fatalf("error opening overlay: %v", err)
+	}
+	defer img.Close()
+	if img.BackingFile() != "new.img" {
+		t.Errorf("backing file %q instead of %q after reopening", img.BackingFile(), "new.img")
+	}
+	if !bytes.Equal(readAll(t, img), expected) {
+		t.Errorf("image did not read the same after reopening")
+	}
+	// without a backing file, everything is copied in
+	if err := img.Rebase(""); err != nil {
+		t.Fatalf("error removing backing file: %v", err)
+	}
+	if img.BackingFile() != "" {
+		t.Errorf("backing file %q after removing it", img.BackingFile())
+	}
+	if err := os.Remove(filepath.Join(dir, "new.img")); err != nil {
+		t.Fatalf("error removing backing file: %v", err)
+	}
+	flat, err := qcow2.OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image without backing file: %v", err)
+	}
+	defer flat.Close()
+	if !bytes.Equal(readAll(t, flat), expected) {
+		t.Errorf("image did not read the same without a backing file")
+	}
+}
+
+func TestBackingFileLoop(t *testing.T) {
+	const size = 1024 * 1024
+	dir := t.TempDir()
+	// an image made with a backing file of its own name, which it then takes the place of
+	p := filepath.Join(dir, "loop.qcow2")
+	if err := os.WriteFile(p, make([]byte, size), 0o600); err != nil {
+		t.Fatalf("error writing backing file: %v", err)
+	}
+	top := filepath.Join(dir, "top.qcow2")
+	img, err := qcow2.CreateFromPath(top, size, &qcow2.CreateOptions{BackingFile: "loop.qcow2", BackingFormat: qcow2.BackingFormatRaw})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+	if err := os.Rename(top, p); err != nil {
+		t.Fatalf("error renaming image: %v", err)
+	}
+	if _, err := qcow2.OpenFromPath(p, true, qcow2.WithBackingFiles(true)); err == nil {
+		t.Errorf("opened image that is its own backing file")
+	}
+
+	// a chain longer than the maximum
+	base := filepath.Join(dir, "0.qcow2")
+	img, err = qcow2.CreateFromPath(base, size, nil)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	_ = img.Close()
+	for n := 1; n <= 16; n++ {
+		img, err = qcow2.CreateFromPath(filepath.Join(dir, fmt.Sprintf("%d.qcow2", n)), size, &qcow2.CreateOptions{BackingFile: fmt.Sprintf("%d.qcow2", n-1)})
+		if n < 16 && err != nil {
+			t.Fatalf("error creating image %d of the chain: %v", n, err)
+		}
+		if n == 16 {
+			if err == nil {
+				t.Errorf("created image with a chain of %d backing files", n)
+			}
+			break
+		}
+		_ = img.Close()
+	}
+	img, err = qcow2.OpenFromPath(filepath.Join(dir, "15.qcow2"), true, qcow2.WithBackingFiles(true))
+	if err != nil {
+		t.Fatalf("error opening image at the end of the longest chain: %v", err)
+	}
+	_ = img.Close()
+}
+
+func TestCraftedHeader(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := qcow2.CreateFromPath(p, 1024*1024, nil)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+	valid, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+	tests := map[string]func(b []byte){
+		"refcount table clusters": func(b []byte) { binary.BigEndian.PutUint32(b[56:60], 0xffffffff) },
+		"L1 size":                 func(b []byte) { binary.BigEndian.PutUint32(b[36:40], 0xffffffff) },
+		"L1 table offset":         func(b []byte) { binary.BigEndian.PutUint64(b[40:48], 1<<40) },
+		"refcount table offset":   func(b []byte) { binary.BigEndian.PutUint64(b[48:56], uint64(len(b))) },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := bytes.Clone(valid)
+			modify(b)
+			crafted := filepath.Join(t.TempDir(), "crafted.qcow2")
+			if err := os.WriteFile(crafted, b, 0o600); err != nil {
+				t.Fatalf("error writing image: %v", err)
+			}
+			for _, readOnly := range []bool{true, false} {
+				if img, err := qcow2.OpenFromPath(crafted, readOnly); err == nil {
+					_ = img.Close()
+					t.Errorf("opened image with crafted header, read-only %v", readOnly)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocationMapStats(t *testing.T) {
+	const (
+		size        = 1024 * 1024
+		clusterSize = 64 * 1024
+	)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.img"), bytes.Repeat([]byte{1}, size), 0o600); err != nil {
+		t.Fatalf("error writing backing file: %v", err)
+	}
+	img, err := qcow2.CreateFromPath(filepath.Join(dir, "disk.qcow2"), size, &qcow2.CreateOptions{BackingFile: "base.img"})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("data"), clusterSize+10); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	// with a backing file, a cluster of zeroes becomes a zero cluster
+	compressed := make([]byte, 2*clusterSize)
+	copy(compressed, bytes.Repeat([]byte("compressible "), clusterSize/13))
+	if _, err := img.WriteCompressed(compressed, 4*clusterSize); err != nil {
+		t.Fatalf("error writing compressed: %v", err)
+	}
+
+	extents, err := img.AllocationMap()
+	if err != nil {
+		t.Fatalf("error getting allocation map: %v", err)
+	}
+	expected := []qcow2.Extent{
+		{Offset: 0, Length: clusterSize, State: qcow2.ClusterUnallocated},
+		{Offset: clusterSize, Length: clusterSize, State: qcow2.ClusterData},
+		{Offset: 2 * clusterSize, Length: 2 * clusterSize, State: qcow2.ClusterUnallocated},
+		{Offset: 4 * clusterSize, Length: clusterSize, State: qcow2.ClusterCompressed},
+		{Offset: 5 * clusterSize, Length: clusterSize, State: qcow2.ClusterZero},
+		{Offset: 6 * clusterSize, Length: size - 6*clusterSize, State: qcow2.ClusterUnallocated},
+	}
+	if len(extents) != len(expected) {
+		t.Fatalf("allocation map %v instead of %v", extents, expected)
+	}
+	for j := range expected {
+		if extents[j] != expected[j] {
+			t.Errorf("extent %d is %v instead of %v", j, extents[j], expected[j])
+		}
+	}
+
+	b := make([]byte, 3*clusterSize)
+	if _, err := img.ReadAt(b, 3*clusterSize); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	stats := img.Stats()
+	if stats.WriteOps != 2 || stats.WriteBytes != 4+2*clusterSize {
+		t.Errorf("%d writes of %d bytes instead of 2 of %d", stats.WriteOps, stats.WriteBytes, 4+2*clusterSize)
+	}
+	if stats.ReadOps != 1 || stats.ReadBytes != int64(len(b)) {
+		t.Errorf("%d reads of %d bytes instead of 1 of %d", stats.ReadOps, stats.ReadBytes, len(b))
+	}
+	// the rest of the cluster that was written to, and the unallocated cluster that was read
+	if stats.BackingReadBytes != 2*clusterSize-4 {
+		t.Errorf("%d bytes read from the backing file instead of %d", stats.BackingReadBytes, 2*clusterSize-4)
+	}
+	if stats.ClustersDecompressed != 1 {
+		t.Errorf("%d clusters decompressed instead of 1", stats.ClustersDecompressed)
+	}
+	if stats.ClustersAllocated == 0 {
+		t.Errorf("no clusters counted as allocated")
+	}
+}
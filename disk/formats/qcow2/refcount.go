@@ -0,0 +1,118 @@
+package qcow2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// allocateClusters allocate n contiguous clusters at the end of the file, counting a reference to each,
+// and return the offset of the first
+func (i *Image) allocateClusters(n int64) (int64, error) {
+	cs := i.header.clusterSize()
+	offset := i.fileEnd
+	i.fileEnd += n * cs
+	i.stats.clustersAllocated.Add(n)
+	// counting may allocate refcount blocks after them, which count themselves
+	for c := offset / cs; c < offset/cs+n; c++ {
+		if err := i.addRefcount(c, 1); err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// refcountBlock get the refcount block at the given offset
+func (i *Image) refcountBlock(offset uint64) ([]byte, error) {
+	if block, ok := i.refcountBlocks[offset]; ok {
+		return block, nil
+	}
+	block := make([]byte, i.header.clusterSize())
+	if n, err := i.storage.ReadAt(block, int64(offset)); err != nil && n != len(block) {
+		return nil, fmt.Errorf("unable to read refcount block at %d: %w", offset, err)
+	}
+	i.refcountBlocks[offset] = block
+	return block, nil
+}
+
+// addRefcount add delta to the refcount of the given cluster, allocating a refcount block for it if needed
+func (i *Image) addRefcount(cluster, delta int64) error {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	cs := i.header.clusterSize()
+	tableIndex := cluster / i.header.refcountBlockEntries()
+	if tableIndex >= int64(len(i.refcountTable)) {
+		return fmt.Errorf("refcount table is full, image cannot grow beyond %d bytes", int64(len(i.refcountTable))*i.header.refcountBlockEntries()*cs)
+	}
+	blockOffset := i.refcountTable[tableIndex] & offsetMask
+	if blockOffset == 0 {
+		// the new block is the last cluster allocated, which is counted once the block is in the table,
+		// most likely by the block itself
+		blockOffset = uint64(i.fileEnd)
+		i.fileEnd += cs
+		i.stats.clustersAllocated.Add(1)
+		if _, err := writable.WriteAt(make([]byte, cs), int64(blockOffset)); err != nil {
+			return fmt.Errorf("unable to write refcount block: %w", err)
+		}
+		b := binary.BigEndian.AppendUint64(nil, blockOffset)
+		if _, err := writable.WriteAt(b, int64(i.header.refcountTableOffset)+tableIndex*entrySize); err != nil {
+			return fmt.Errorf("unable to write refcount table entry: %w", err)
+		}
+		i.refcountTable[tableIndex] = blockOffset
+		i.refcountBlocks[blockOffset] = make([]byte, cs)
+		if err := i.addRefcount(int64(blockOffset)/cs, 1); err != nil {
+			return err
+		}
+	}
+	block, err := i.refcountBlock(blockOffset)
+	if err != nil {
+		return err
+	}
+	bits := i.header.refcountBits()
+	index := cluster % i.header.refcountBlockEntries()
+	value := getRefcount(block, index, bits)
+	switch {
+	case delta < 0 && value < uint64(-delta):
+		return fmt.Errorf("refcount of cluster %d would drop below 0", cluster)
+	case delta > 0 && (bits < 64 && value+uint64(delta) >= 1<<bits || value+uint64(delta) < value):
+		return fmt.Errorf("refcount of cluster %d would overflow %d bits", cluster, bits)
+	}
+	start, end := setRefcount(block, index, bits, value+uint64(delta))
+	if _, err := writable.WriteAt(block[start:end], int64(blockOffset)+start); err != nil {
+		return fmt.Errorf("unable to write refcount block: %w", err)
+	}
+	return nil
+}
+
+// getRefcount the refcount at index of a refcount block whose refcounts are bits wide. Those of less than
+// a byte are packed from the least significant bit.
+func getRefcount(block []byte, index, bits int64) uint64 {
+	if bits < 8 {
+		shift := index * bits % 8
+		return uint64(block[index*bits/8]>>shift) & (1<<bits - 1)
+	}
+	var value uint64
+	for _, b := range block[index*bits/8 : (index+1)*bits/8] {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// setRefcount set the refcount at index of a refcount block whose refcounts are bits wide, and return the range
+// of bytes of the block that changed
+func setRefcount(block []byte, index, bits int64, value uint64) (start, end int64) {
+	if bits < 8 {
+		start = index * bits / 8
+		shift := index * bits % 8
+		mask := byte(1<<bits-1) << shift
+		block[start] = block[start]&^mask | byte(value)<<shift&mask
+		return start, start + 1
+	}
+	start, end = index*bits/8, (index+1)*bits/8
+	for j := end - 1; j >= start; j-- {
+		block[j] = byte(value)
+		value >>= 8
+	}
+	return start, end
+}
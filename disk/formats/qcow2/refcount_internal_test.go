@@ -0,0 +1,205 @@
+package qcow2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkRefcounts compare the refcount of every cluster of the image with the references to it, as qemu-img
+// check does, and that no cluster is used by both metadata and data
+func checkRefcounts(t *testing.T, img *Image) {
+	t.Helper()
+	h := img.header
+	cs := h.clusterSize()
+	expected := map[int64]uint64{}
+	ref := func(offset, length int64) {
+		for c := offset / cs; c <= (offset+length-1)/cs; c++ {
+			expected[c]++
+		}
+	}
+	ref(0, cs)
+	ref(int64(h.refcountTableOffset), int64(h.refcountTableClusters)*cs)
+	ref(int64(h.l1TableOffset), int64(h.l1Size)*entrySize)
+	for _, block := range img.refcountTable {
+		if block != 0 {
+			ref(int64(block&offsetMask), cs)
+		}
+	}
+	for l1Index, l1Entry := range img.l1 {
+		if l1Entry == 0 {
+			continue
+		}
+		if l1Entry&flagCopied == 0 {
+			t.Errorf("L1 entry %d is not marked copied", l1Index)
+		}
+		ref(int64(l1Entry&offsetMask), cs)
+		l2, err := img.l2Table(int64(l1Index))
+		if err != nil {
+			t.Fatalf("error reading L2 table: %v", err)
+		}
+		for _, entry := range l2 {
+			switch {
+			case entry&flagCompressed != 0:
+				ref(img.compressedLocation(entry))
+			case entry&offsetMask != 0:
+				if entry&flagCopied == 0 {
+					t.Errorf("L2 entry %x is not marked copied", entry)
+				}
+				ref(int64(entry&offsetMask), cs)
+			}
+		}
+	}
+	for c := int64(0); c < img.fileEnd/cs; c++ {
+		block := img.refcountTable[c/h.refcountBlockEntries()] & offsetMask
+		var actual uint64
+		if block != 0 {
+			b, err := img.refcountBlock(block)
+			if err != nil {
+				t.Fatalf("error reading refcount block: %v", err)
+			}
+			actual = getRefcount(b, c%h.refcountBlockEntries(), h.refcountBits())
+		}
+		// compressed clusters may share a cluster, but nothing else may
+		if actual != expected[c] {
+			t.Errorf("cluster %d has refcount %d instead of %d", c, actual, expected[c])
+		}
+	}
+}
+
+func TestRefcounts(t *testing.T) {
+	// small clusters, so that the image needs several refcount blocks
+	const (
+		clusterSize = 512
+		size        = 4 * 1024 * 1024
+	)
+	p := filepath.Join(t.TempDir(), "disk.qcow2")
+	img, err := CreateFromPath(p, size, &CreateOptions{ClusterSize: clusterSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	checkRefcounts(t, img)
+
+	random := make([]byte, 64*1024)
+	_, _ = rand.Read(random)
+	compressible := bytes.Repeat([]byte("compressible "), 8*1024)[:64*1024]
+	if _, err := img.WriteAt(random, 0); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if _, err := img.WriteCompressed(compressible, size/2); err != nil {
+		t.Fatalf("error writing compressed: %v", err)
+	}
+	// random data does not compress, so is written as it is
+	if _, err := img.WriteCompressed(random[:4*clusterSize], size/4); err != nil {
+		t.Fatalf("error writing compressed: %v", err)
+	}
+	// replaces compressed clusters, some of which shared the clusters of their data
+	if _, err := img.WriteAt(random[:100], size/2+3*clusterSize+10); err != nil {
+		t.Fatalf("error writing over compressed clusters: %v", err)
+	}
+	if _, err := img.WriteAt(random[:3*clusterSize], size-3*clusterSize); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	checkRefcounts(t, img)
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+
+	img, err = OpenFromPath(p, false)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer img.Close()
+	checkRefcounts(t, img)
+	if _, err := img.WriteAt(random, size/8); err != nil {
+		t.Fatalf("error writing after reopening: %v", err)
+	}
+	checkRefcounts(t, img)
+}
+
+func TestRefcountWidths(t *testing.T) {
+	for order := int64(0); order <= maxRefcountOrder; order++ {
+		bits := int64(1) << order
+		block := make([]byte, 64)
+		entries := int64(len(block)) * 8 / bits
+		max := uint64(1)<<bits - 1
+		if bits == 64 {
+			max = ^uint64(0)
+		}
+		for j := int64(0); j < entries; j++ {
+			setRefcount(block, j, bits, uint64(j)&max)
+		}
+		// the neighbours of each refcount are left alone
+		setRefcount(block, 1, bits, max)
+		for j := int64(0); j < entries; j++ {
+			expected := uint64(j) & max
+			if j == 1 {
+				expected = max
+			}
+			if actual := getRefcount(block, j, bits); actual != expected {
+				t.Errorf("%d bits: refcount %d is %d instead of %d", bits, j, actual, expected)
+			}
+		}
+	}
+	// refcounts narrower than a byte start from the least significant bit
+	block := []byte{0}
+	setRefcount(block, 1, 2, 3)
+	if block[0] != 0x0c {
+		t.Errorf("2 bit refcount 1 set byte to %#x instead of 0x0c", block[0])
+	}
+}
+
+func TestBackingRefcounts(t *testing.T) {
+	const (
+		clusterSize = 512
+		size        = 64 * 1024
+	)
+	dir := t.TempDir()
+	old := make([]byte, size)
+	_, _ = rand.Read(old)
+	clear(old[20*clusterSize : 21*clusterSize])
+	backing := bytes.Clone(old)
+	_, _ = rand.Read(backing[10*clusterSize : 12*clusterSize])
+	_, _ = rand.Read(backing[20*clusterSize : 21*clusterSize])
+	if err := os.WriteFile(filepath.Join(dir, "old.img"), old, 0o600); err != nil {
+		t.Fatalf("error writing old backing file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "new.img"), backing, 0o600); err != nil {
+		t.Fatalf("error writing new backing file: %v", err)
+	}
+	img, err := CreateFromPath(filepath.Join(dir, "overlay.qcow2"), 0, &CreateOptions{ClusterSize: clusterSize, BackingFile: "old.img"})
+	if err != nil {
+		t.Fatalf("error creating overlay: %v", err)
+	}
+	defer img.Close()
+	if _, err := img.WriteAt([]byte("patched"), 11*clusterSize+10); err != nil {
+		t.Fatalf("error writing overlay: %v", err)
+	}
+	if err := img.Rebase("new.img"); err != nil {
+		t.Fatalf("error rebasing: %v", err)
+	}
+	checkRefcounts(t, img)
+	// only the clusters that differ are copied, the one that was zero as a zero cluster
+	stored := map[int64]uint64{}
+	if err := img.walkStored(func(pos int64, entry uint64) error {
+		stored[pos/clusterSize] = entry
+		return nil
+	}); err != nil {
+		t.Fatalf("error walking clusters: %v", err)
+	}
+	if len(stored) != 3 || stored[10]&offsetMask == 0 || stored[11]&offsetMask == 0 || stored[20] != flagZero {
+		t.Errorf("stored clusters %v instead of 10 and 11 with data, and 20 zero", stored)
+	}
+	if err := img.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	checkRefcounts(t, img)
+	if err := img.walkStored(func(pos int64, _ uint64) error {
+		t.Errorf("cluster at %d still stored after commit", pos)
+		return nil
+	}); err != nil {
+		t.Fatalf("error walking clusters: %v", err)
+	}
+}
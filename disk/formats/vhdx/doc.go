@@ -0,0 +1,16 @@
+// Package vhdx provides a backend.Storage implementation for VHDX disk images, the format used by Hyper-V.
+//
+// A VHDX image is a container file that holds a virtual disk. The Image returned by New, OpenFromPath, Create or
+// CreateFromPath translates reads and writes of the virtual disk into reads and writes of the payload blocks within
+// the container, allocating blocks as they are written. It can be passed directly to diskfs.OpenBackend
+// to work with the partitions and filesystems of the virtual disk.
+//
+// When an image is opened, any pending entries in its log are replayed, as required by the specification. If the
+// image is opened read-only, the replay is kept in memory and the underlying file is not changed.
+//
+// Differencing images, i.e. those with a parent, are not supported.
+//
+// references:
+//
+//	https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx/83e061f8-f6e2-4de1-91bd-5d518a43d477
+package vhdx
@@ -0,0 +1,33 @@
+package vhdx
+
+import (
+	uuid "github.com/google/uuid"
+)
+
+// VHDX stores GUIDs in the Windows mixed-endian format: the first 3 sections (4 bytes, 2 bytes, 2 bytes)
+// are little-endian, the last 2 sections are big-endian. uuid.UUID is entirely big-endian, so swap the first 3.
+func guidFromBytes(b []byte) uuid.UUID {
+	var u uuid.UUID
+	copy(u[:], b[:16])
+	swapGUIDBytes(u[:])
+	return u
+}
+
+func guidToBytes(u uuid.UUID) []byte {
+	b := make([]byte, 16)
+	copy(b, u[:])
+	swapGUIDBytes(b)
+	return b
+}
+
+func swapGUIDBytes(b []byte) {
+	reverse(b[0:4])
+	reverse(b[4:6])
+	reverse(b[6:8])
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
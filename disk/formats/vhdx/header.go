@@ -0,0 +1,199 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"unicode/utf16"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	// KB represents one KB
+	KB int64 = 1024
+	// MB represents one MB
+	MB int64 = 1024 * KB
+
+	fileIdentifierSize  = 64 * KB
+	headerSize          = 4 * KB
+	header1Offset       = 64 * KB
+	header2Offset       = 128 * KB
+	regionTableSize     = 64 * KB
+	regionTable1Offset  = 192 * KB
+	regionTable2Offset  = 256 * KB
+	headerSectionLength = 1 * MB
+	// all structures outside of the header section, including payload blocks, are aligned to 1MB
+	alignment = 1 * MB
+
+	maxRegionEntries = 2047
+	regionEntrySize  = 32
+	headerVersion    = 1
+	logVersion       = 0
+	creator          = "go-diskfs"
+
+	// limits on the regions that are read whole, far above the 1MB that Hyper-V and QEMU make them
+	maxMetadataRegionLength = 32 * MB
+	maxLogLength            = 64 * MB
+)
+
+var (
+	fileSignature        = []byte("vhdxfile")
+	headerSignature      = []byte("head")
+	regionTableSignature = []byte("regi")
+
+	// region GUIDs
+	batRegionGUID      = uuid.MustParse("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegionGUID = uuid.MustParse("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// checksum calculates the crc32c of b with the 4-byte checksum field at offset treated as zero,
+// which is how every checksummed VHDX structure is calculated.
+func checksum(b []byte, offset int) uint32 {
+	crc := crc32.Update(0, crc32cTable, b[:offset])
+	crc = crc32.Update(crc, crc32cTable, []byte{0, 0, 0, 0})
+	return crc32.Update(crc, crc32cTable, b[offset+4:])
+}
+
+// fileIdentifierToBytes returns the bytes for the file type identifier at the start of the file
+func fileIdentifierToBytes() []byte {
+	b := make([]byte, fileIdentifierSize)
+	copy(b[0:8], fileSignature)
+	for i, r := range utf16.Encode([]rune(creator)) {
+		binary.LittleEndian.PutUint16(b[8+2*i:10+2*i], r)
+	}
+	return b
+}
+
+// header one of the two headers that identify the current state of the image
+type header struct {
+	sequenceNumber uint64
+	fileWriteGUID  uuid.UUID
+	dataWriteGUID  uuid.UUID
+	logGUID        uuid.UUID
+	logVersion     uint16
+	version        uint16
+	logLength      uint32
+	logOffset      uint64
+}
+
+func headerFromBytes(b []byte) (*header, error) {
+	if len(b) < int(headerSize) {
+		return nil, fmt.Errorf("header had %d bytes instead of expected %d", len(b), headerSize)
+	}
+	if !bytes.Equal(b[0:4], headerSignature) {
+		return nil, errors.New("invalid header signature")
+	}
+	b = b[:headerSize]
+	expected := binary.LittleEndian.Uint32(b[4:8])
+	if actual := checksum(b, 4); actual != expected {
+		return nil, fmt.Errorf("invalid header checksum, stored %x calculated %x", expected, actual)
+	}
+	h := &header{
+		sequenceNumber: binary.LittleEndian.Uint64(b[8:16]),
+		fileWriteGUID:  guidFromBytes(b[16:32]),
+		dataWriteGUID:  guidFromBytes(b[32:48]),
+		logGUID:        guidFromBytes(b[48:64]),
+		logVersion:     binary.LittleEndian.Uint16(b[64:66]),
+		version:        binary.LittleEndian.Uint16(b[66:68]),
+		logLength:      binary.LittleEndian.Uint32(b[68:72]),
+		logOffset:      binary.LittleEndian.Uint64(b[72:80]),
+	}
+	if h.version != headerVersion {
+		return nil, fmt.Errorf("unsupported header version %d", h.version)
+	}
+	if h.logVersion != logVersion {
+		return nil, fmt.Errorf("unsupported log version %d", h.logVersion)
+	}
+	return h, nil
+}
+
+func (h *header) toBytes() []byte {
+	b := make([]byte, headerSize)
+	copy(b[0:4], headerSignature)
+	binary.LittleEndian.PutUint64(b[8:16], h.sequenceNumber)
+	copy(b[16:32], guidToBytes(h.fileWriteGUID))
+	copy(b[32:48], guidToBytes(h.dataWriteGUID))
+	copy(b[48:64], guidToBytes(h.logGUID))
+	binary.LittleEndian.PutUint16(b[64:66], h.logVersion)
+	binary.LittleEndian.PutUint16(b[66:68], h.version)
+	binary.LittleEndian.PutUint32(b[68:72], h.logLength)
+	binary.LittleEndian.PutUint64(b[72:80], h.logOffset)
+	binary.LittleEndian.PutUint32(b[4:8], checksum(b, 4))
+	return b
+}
+
+// regionEntry a single entry in the region table, describing where a region lives in the file
+type regionEntry struct {
+	guid       uuid.UUID
+	fileOffset uint64
+	length     uint32
+	required   bool
+}
+
+// regionTable the table that lists all of the regions in the file
+type regionTable struct {
+	entries []regionEntry
+}
+
+func regionTableFromBytes(b []byte) (*regionTable, error) {
+	if len(b) < int(regionTableSize) {
+		return nil, fmt.Errorf("region table had %d bytes instead of expected %d", len(b), regionTableSize)
+	}
+	if !bytes.Equal(b[0:4], regionTableSignature) {
+		return nil, errors.New("invalid region table signature")
+	}
+	b = b[:regionTableSize]
+	expected := binary.LittleEndian.Uint32(b[4:8])
+	if actual := checksum(b, 4); actual != expected {
+		return nil, fmt.Errorf("invalid region table checksum, stored %x calculated %x", expected, actual)
+	}
+	count := binary.LittleEndian.Uint32(b[8:12])
+	if count > maxRegionEntries {
+		return nil, fmt.Errorf("region table has %d entries, more than maximum %d", count, maxRegionEntries)
+	}
+	rt := &regionTable{}
+	for i := 0; i < int(count); i++ {
+		start := 16 + i*regionEntrySize
+		eb := b[start : start+regionEntrySize]
+		rt.entries = append(rt.entries, regionEntry{
+			guid:       guidFromBytes(eb[0:16]),
+			fileOffset: binary.LittleEndian.Uint64(eb[16:24]),
+			length:     binary.LittleEndian.Uint32(eb[24:28]),
+			required:   binary.LittleEndian.Uint32(eb[28:32])&0x1 == 0x1,
+		})
+	}
+	return rt, nil
+}
+
+func (rt *regionTable) toBytes() []byte {
+	b := make([]byte, regionTableSize)
+	copy(b[0:4], regionTableSignature)
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(rt.entries)))
+	for i, e := range rt.entries {
+		start := 16 + i*regionEntrySize
+		eb := b[start : start+regionEntrySize]
+		copy(eb[0:16], guidToBytes(e.guid))
+		binary.LittleEndian.PutUint64(eb[16:24], e.fileOffset)
+		binary.LittleEndian.PutUint32(eb[24:28], e.length)
+		if e.required {
+			binary.LittleEndian.PutUint32(eb[28:32], 0x1)
+		}
+	}
+	binary.LittleEndian.PutUint32(b[4:8], checksum(b, 4))
+	return b
+}
+
+// find the entry for a given region, or nil if it does not exist
+func (rt *regionTable) find(guid uuid.UUID) *regionEntry {
+	for i := range rt.entries {
+		if rt.entries[i].guid == guid {
+			return &rt.entries[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	logSectorSize         = 4 * KB
+	logEntryHeaderSize    = 64
+	logDescriptorSize     = 32
+	logDataSectorDataSize = 4084
+)
+
+var (
+	logEntrySignature      = []byte("loge")
+	logZeroDescSignature   = []byte("zero")
+	logDataDescSignature   = []byte("desc")
+	logDataSectorSignature = []byte("data")
+)
+
+// logDescriptor a single update within a log entry, either zeroing a range of the file
+// or writing a single 4KB sector to the file
+type logDescriptor struct {
+	zero       bool
+	fileOffset uint64
+	// for zero descriptors
+	zeroLength uint64
+	// for data descriptors, the full 4KB sector assembled from the descriptor and data sector
+	data []byte
+}
+
+// logEntry a single entry in the log
+type logEntry struct {
+	offset            uint64 // offset of the entry relative to the start of the log
+	entryLength       uint32
+	tail              uint32
+	sequenceNumber    uint64
+	flushedFileOffset uint64
+	lastFileOffset    uint64
+	descriptors       []logDescriptor
+}
+
+// logWrite a single write to be applied to the file, in the order it was replayed
+type logWrite struct {
+	offset int64
+	length int64
+	// data is nil for a write of zeroes
+	data []byte
+}
+
+// readLogEntry try to read a valid log entry starting at offset within the log, which is a circular buffer.
+// Returns nil if there is no valid entry for the given log GUID at the offset.
+func readLogEntry(logData []byte, offset uint64, logGUID uuid.UUID) *logEntry {
+	logLength := uint64(len(logData))
+	// read a range of the circular log
+	read := func(start, length uint64) []byte {
+		b := make([]byte, length)
+		for i := uint64(0); i < length; {
+			pos := (start + i) % logLength
+			n := copy(b[i:], logData[pos:])
+			i += uint64(n)
+		}
+		return b
+	}
+	h := read(offset, logEntryHeaderSize)
+	if !bytes.Equal(h[0:4], logEntrySignature) {
+		return nil
+	}
+	entryLength := binary.LittleEndian.Uint32(h[8:12])
+	if entryLength == 0 || uint64(entryLength)%uint64(logSectorSize) != 0 || uint64(entryLength) > logLength {
+		return nil
+	}
+	if guidFromBytes(h[32:48]) != logGUID {
+		return nil
+	}
+	b := read(offset, uint64(entryLength))
+	if binary.LittleEndian.Uint32(b[4:8]) != checksum(b, 4) {
+		return nil
+	}
+	entry := &logEntry{
+		offset:            offset,
+		entryLength:       entryLength,
+		tail:              binary.LittleEndian.Uint32(b[12:16]),
+		sequenceNumber:    binary.LittleEndian.Uint64(b[16:24]),
+		flushedFileOffset: binary.LittleEndian.Uint64(b[48:56]),
+		lastFileOffset:    binary.LittleEndian.Uint64(b[56:64]),
+	}
+	descriptorCount := binary.LittleEndian.Uint32(b[24:28])
+	// descriptors are padded out to a full sector, followed by data sectors in the order of the data descriptors
+	descriptorSectors := (uint64(logEntryHeaderSize) + uint64(descriptorCount)*logDescriptorSize + uint64(logSectorSize) - 1) / uint64(logSectorSize)
+	dataOffset := descriptorSectors * uint64(logSectorSize)
+	if dataOffset > uint64(entryLength) {
+		return nil
+	}
+	for i := uint64(0); i < uint64(descriptorCount); i++ {
+		start := logEntryHeaderSize + i*logDescriptorSize
+		db := b[start : start+logDescriptorSize]
+		if binary.LittleEndian.Uint64(db[24:32]) != entry.sequenceNumber {
+			return nil
+		}
+		switch {
+		case bytes.Equal(db[0:4], logZeroDescSignature):
+			// zeroed ranges are whole sectors, and cannot be larger than the largest possible disk
+			zeroLength := binary.LittleEndian.Uint64(db[8:16])
+			if zeroLength == 0 || zeroLength%uint64(logSectorSize) != 0 || zeroLength > uint64(MaxVirtualSize) {
+				return nil
+			}
+			entry.descriptors = append(entry.descriptors, logDescriptor{
+				zero:       true,
+				zeroLength: zeroLength,
+				fileOffset: binary.LittleEndian.Uint64(db[16:24]),
+			})
+		case bytes.Equal(db[0:4], logDataDescSignature):
+			if dataOffset+uint64(logSectorSize) > uint64(entryLength) {
+				return nil
+			}
+			ds := b[dataOffset : dataOffset+uint64(logSectorSize)]
+			dataOffset += uint64(logSectorSize)
+			if !bytes.Equal(ds[0:4], logDataSectorSignature) {
+				return nil
+			}
+			seq := uint64(binary.LittleEndian.Uint32(ds[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(ds[4092:4096]))
+			if seq != entry.sequenceNumber {
+				return nil
+			}
+			// the signature and sequence fields of the data sector are replaced by the leading and
+			// trailing bytes saved in the descriptor
+			data := make([]byte, logSectorSize)
+			copy(data[0:8], db[8:16])
+			copy(data[8:8+logDataSectorDataSize], ds[8:8+logDataSectorDataSize])
+			copy(data[4092:4096], db[4:8])
+			entry.descriptors = append(entry.descriptors, logDescriptor{
+				fileOffset: binary.LittleEndian.Uint64(db[16:24]),
+				data:       data,
+			})
+		default:
+			return nil
+		}
+	}
+	return entry
+}
+
+// activeLogSequence find the sequence of log entries to replay, per the specification: the valid sequence
+// with the highest sequence number, whose head entry has a tail that points to the first entry in the sequence.
+// Returns nil if the log contains no valid sequence.
+func activeLogSequence(logData []byte, logGUID uuid.UUID) []*logEntry {
+	logLength := uint64(len(logData))
+	var (
+		active  []*logEntry
+		headSeq uint64
+	)
+	for start := uint64(0); start < logLength; start += uint64(logSectorSize) {
+		entry := readLogEntry(logData, start, logGUID)
+		if entry == nil {
+			continue
+		}
+		chain := []*logEntry{entry}
+		for len(chain) < int(logLength/uint64(logSectorSize)) {
+			last := chain[len(chain)-1]
+			next := readLogEntry(logData, (last.offset+uint64(last.entryLength))%logLength, logGUID)
+			if next == nil || next.sequenceNumber != last.sequenceNumber+1 {
+				break
+			}
+			chain = append(chain, next)
+		}
+		head := chain[len(chain)-1]
+		// the sequence only is valid if it begins at the tail of its head
+		if uint64(head.tail) != chain[0].offset {
+			continue
+		}
+		if active == nil || head.sequenceNumber > headSeq {
+			active = chain
+			headSeq = head.sequenceNumber
+		}
+	}
+	return active
+}
+
+// logWrites convert a sequence of log entries into the writes needed to replay it
+func logWrites(entries []*logEntry) []logWrite {
+	var writes []logWrite
+	for _, e := range entries {
+		for _, d := range e.descriptors {
+			if d.zero {
+				writes = append(writes, logWrite{offset: int64(d.fileOffset), length: int64(d.zeroLength)})
+				continue
+			}
+			writes = append(writes, logWrite{offset: int64(d.fileOffset), length: int64(len(d.data)), data: d.data})
+		}
+	}
+	return writes
+}
+
+// apply overlay the write onto b, which was read from the file at offset
+func (w *logWrite) apply(b []byte, offset int64) {
+	start := max(w.offset, offset)
+	end := min(w.offset+w.length, offset+int64(len(b)))
+	if start >= end {
+		return
+	}
+	target := b[start-offset : end-offset]
+	if w.data == nil {
+		clear(target)
+		return
+	}
+	copy(target, w.data[start-w.offset:end-w.offset])
+}
@@ -0,0 +1,197 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	uuid "github.com/google/uuid"
+)
+
+// testLogEntry build a log entry with a single data descriptor that writes sector to fileOffset
+func testLogEntry(logGUID uuid.UUID, seq uint64, tail uint32, fileOffset uint64, sector []byte) []byte {
+	b := make([]byte, 2*logSectorSize)
+	copy(b[0:4], logEntrySignature)
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[12:16], tail)
+	binary.LittleEndian.PutUint64(b[16:24], seq)
+	binary.LittleEndian.PutUint32(b[24:28], 1)
+	copy(b[32:48], guidToBytes(logGUID))
+	binary.LittleEndian.PutUint64(b[48:56], uint64(8*MB))
+	binary.LittleEndian.PutUint64(b[56:64], uint64(8*MB))
+	// data descriptor
+	db := b[logEntryHeaderSize : logEntryHeaderSize+logDescriptorSize]
+	copy(db[0:4], logDataDescSignature)
+	copy(db[4:8], sector[4092:4096])
+	copy(db[8:16], sector[0:8])
+	binary.LittleEndian.PutUint64(db[16:24], fileOffset)
+	binary.LittleEndian.PutUint64(db[24:32], seq)
+	// data sector
+	ds := b[logSectorSize:]
+	copy(ds[0:4], logDataSectorSignature)
+	binary.LittleEndian.PutUint32(ds[4:8], uint32(seq>>32))
+	copy(ds[8:4092], sector[8:4092])
+	binary.LittleEndian.PutUint32(ds[4092:4096], uint32(seq))
+	binary.LittleEndian.PutUint32(b[4:8], checksum(b, 4))
+	return b
+}
+
+func TestActiveLogSequence(t *testing.T) {
+	logGUID := uuid.New()
+	sector := bytes.Repeat([]byte{0xab}, int(logSectorSize))
+	logData := make([]byte, 1*MB)
+	// an old, complete sequence followed by the active one, which starts at its own tail
+	copy(logData[0:], testLogEntry(logGUID, 10, 0, 0, sector))
+	copy(logData[2*logSectorSize:], testLogEntry(logGUID, 11, uint32(2*logSectorSize), 4096, sector))
+	copy(logData[4*logSectorSize:], testLogEntry(logGUID, 12, uint32(2*logSectorSize), 8192, sector))
+	// an entry for a different log GUID is ignored
+	copy(logData[6*logSectorSize:], testLogEntry(uuid.New(), 13, uint32(6*logSectorSize), 8192, sector))
+
+	sequence := activeLogSequence(logData, logGUID)
+	if len(sequence) != 2 {
+		t.Fatalf("found %d entries in the active sequence instead of 2", len(sequence))
+	}
+	if sequence[0].sequenceNumber != 11 || sequence[1].sequenceNumber != 12 {
+		t.Errorf("wrong entries in active sequence: %d, %d", sequence[0].sequenceNumber, sequence[1].sequenceNumber)
+	}
+	writes := logWrites(sequence)
+	if len(writes) != 2 || writes[0].offset != 4096 || !bytes.Equal(writes[0].data, sector) {
+		t.Errorf("unexpected writes from replaying the active sequence")
+	}
+}
+
+func TestZeroDescriptor(t *testing.T) {
+	// zeroEntry build a log entry with a single zero descriptor for length bytes
+	zeroEntry := func(logGUID uuid.UUID, length uint64) []byte {
+		b := make([]byte, logSectorSize)
+		copy(b[0:4], logEntrySignature)
+		binary.LittleEndian.PutUint32(b[8:12], uint32(len(b)))
+		binary.LittleEndian.PutUint64(b[16:24], 1)
+		binary.LittleEndian.PutUint32(b[24:28], 1)
+		copy(b[32:48], guidToBytes(logGUID))
+		binary.LittleEndian.PutUint64(b[48:56], uint64(8*MB))
+		binary.LittleEndian.PutUint64(b[56:64], uint64(8*MB))
+		db := b[logEntryHeaderSize : logEntryHeaderSize+logDescriptorSize]
+		copy(db[0:4], logZeroDescSignature)
+		binary.LittleEndian.PutUint64(db[8:16], length)
+		binary.LittleEndian.PutUint64(db[16:24], uint64(4*MB))
+		binary.LittleEndian.PutUint64(db[24:32], 1)
+		binary.LittleEndian.PutUint32(b[4:8], checksum(b, 4))
+		return b
+	}
+	tests := []struct {
+		name   string
+		length uint64
+		valid  bool
+	}{
+		{"valid", 8192, true},
+		{"zero", 0, false},
+		{"unaligned", 1000, false},
+		{"larger than any disk", uint64(MaxVirtualSize + logSectorSize), false},
+		{"huge", 1 << 63, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logGUID := uuid.New()
+			logData := make([]byte, 1*MB)
+			copy(logData, zeroEntry(logGUID, tt.length))
+			entry := readLogEntry(logData, 0, logGUID)
+			switch {
+			case tt.valid && (entry == nil || len(entry.descriptors) != 1 || entry.descriptors[0].zeroLength != tt.length):
+				t.Errorf("valid zero descriptor was not read")
+			case !tt.valid && entry != nil:
+				t.Errorf("log entry with zero length %d was not rejected", tt.length)
+			}
+		})
+	}
+}
+
+func TestLogReplay(t *testing.T) {
+	const blockSize = 1024 * 1024
+	p := filepath.Join(t.TempDir(), "disk.vhdx")
+	img, err := CreateFromPath(p, 16*blockSize, &CreateOptions{BlockSize: blockSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	// allocate a block, and then change its contents and its BAT entry via the log only
+	data := bytes.Repeat([]byte{0x11}, int(logSectorSize))
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	entry := img.bat[0]
+	blockOffset := int64(entry>>batFileOffsetShift) * MB
+	logged := bytes.Repeat([]byte{0x22}, int(logSectorSize))
+	batSector := make([]byte, logSectorSize)
+	// move the first block to be the second block
+	binary.LittleEndian.PutUint64(batSector[8:16], entry)
+	_ = img.Close()
+
+	logGUID := uuid.New()
+	logData := make([]byte, img.header.logLength)
+	copy(logData, testLogEntry(logGUID, 1, 0, uint64(blockOffset), logged))
+	copy(logData[2*logSectorSize:], testLogEntry(logGUID, 2, 0, uint64(img.batOffset), batSector))
+	f, err := os.OpenFile(p, os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatalf("error opening image file: %v", err)
+	}
+	if _, err := f.WriteAt(logData, int64(img.header.logOffset)); err != nil {
+		t.Fatalf("error writing log: %v", err)
+	}
+	img.header.logGUID = logGUID
+	img.storage = file.New(f, false)
+	if err := img.writeHeaders(); err != nil {
+		t.Fatalf("error writing headers: %v", err)
+	}
+	_ = f.Close()
+
+	check := func(img *Image) {
+		t.Helper()
+		b := make([]byte, logSectorSize)
+		if _, err := img.ReadAt(b, 0); err != nil {
+			t.Fatalf("error reading: %v", err)
+		}
+		if !bytes.Equal(b, make([]byte, logSectorSize)) {
+			t.Errorf("first block was not unallocated after log replay")
+		}
+		if _, err := img.ReadAt(b, blockSize); err != nil {
+			t.Fatalf("error reading: %v", err)
+		}
+		if !bytes.Equal(b, logged) {
+			t.Errorf("second block did not have logged contents after log replay")
+		}
+	}
+
+	// read-only replays in memory, leaving the log in place
+	img, err = OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image read-only: %v", err)
+	}
+	check(img)
+	if img.header.logGUID != logGUID {
+		t.Errorf("read-only open cleared the log")
+	}
+	_ = img.Close()
+
+	// read-write replays to the file, and clears the log
+	img, err = OpenFromPath(p, false)
+	if err != nil {
+		t.Fatalf("error opening image read-write: %v", err)
+	}
+	check(img)
+	_ = img.Close()
+	img, err = OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image read-only: %v", err)
+	}
+	defer img.Close()
+	if img.header.logGUID != uuid.Nil {
+		t.Errorf("log was not cleared after replay")
+	}
+	if img.overlay != nil {
+		t.Errorf("log was replayed again after being cleared")
+	}
+	check(img)
+}
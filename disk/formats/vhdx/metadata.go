@@ -0,0 +1,211 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	uuid "github.com/google/uuid"
+)
+
+const (
+	metadataTableSize      = 64 * KB
+	metadataEntrySize      = 32
+	maxMetadataEntries     = 2047
+	metadataFlagIsUser     = 0x1
+	metadataFlagIsVirtual  = 0x2
+	metadataFlagIsRequired = 0x4
+
+	fileParametersLeaveBlocksAllocated = 0x1
+	fileParametersHasParent            = 0x2
+)
+
+var (
+	metadataSignature = []byte("metadata")
+
+	// metadata item GUIDs
+	fileParametersGUID     = uuid.MustParse("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeGUID    = uuid.MustParse("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDGUID      = uuid.MustParse("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSizeGUID  = uuid.MustParse("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSizeGUID = uuid.MustParse("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocatorGUID      = uuid.MustParse("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+)
+
+// metadata the known system metadata items describing the virtual disk
+type metadata struct {
+	blockSize            uint32
+	leaveBlocksAllocated bool
+	hasParent            bool
+	virtualDiskSize      uint64
+	virtualDiskID        uuid.UUID
+	logicalSectorSize    uint32
+	physicalSectorSize   uint32
+}
+
+// metadataFromBytes parse the metadata region, which must be passed in its entirety
+func metadataFromBytes(b []byte) (*metadata, error) {
+	if len(b) < int(metadataTableSize) {
+		return nil, fmt.Errorf("metadata region had %d bytes, less than minimum %d", len(b), metadataTableSize)
+	}
+	if !bytes.Equal(b[0:8], metadataSignature) {
+		return nil, errors.New("invalid metadata table signature")
+	}
+	count := binary.LittleEndian.Uint16(b[10:12])
+	if count > maxMetadataEntries {
+		return nil, fmt.Errorf("metadata table has %d entries, more than maximum %d", count, maxMetadataEntries)
+	}
+	m := &metadata{}
+	found := map[uuid.UUID]bool{}
+	for i := 0; i < int(count); i++ {
+		start := 32 + i*metadataEntrySize
+		eb := b[start : start+metadataEntrySize]
+		itemID := guidFromBytes(eb[0:16])
+		offset := binary.LittleEndian.Uint32(eb[16:20])
+		length := binary.LittleEndian.Uint32(eb[20:24])
+		flags := binary.LittleEndian.Uint32(eb[24:28])
+		if uint64(offset)+uint64(length) > uint64(len(b)) {
+			return nil, fmt.Errorf("metadata item %s at offset %d length %d is outside of the metadata region", itemID, offset, length)
+		}
+		data := b[offset : offset+length]
+		switch itemID {
+		case fileParametersGUID:
+			if length < 8 {
+				return nil, fmt.Errorf("file parameters item has invalid length %d", length)
+			}
+			m.blockSize = binary.LittleEndian.Uint32(data[0:4])
+			params := binary.LittleEndian.Uint32(data[4:8])
+			m.leaveBlocksAllocated = params&fileParametersLeaveBlocksAllocated != 0
+			m.hasParent = params&fileParametersHasParent != 0
+		case virtualDiskSizeGUID:
+			if length < 8 {
+				return nil, fmt.Errorf("virtual disk size item has invalid length %d", length)
+			}
+			m.virtualDiskSize = binary.LittleEndian.Uint64(data[0:8])
+		case virtualDiskIDGUID:
+			if length < 16 {
+				return nil, fmt.Errorf("virtual disk ID item has invalid length %d", length)
+			}
+			m.virtualDiskID = guidFromBytes(data[0:16])
+		case logicalSectorSizeGUID:
+			if length < 4 {
+				return nil, fmt.Errorf("logical sector size item has invalid length %d", length)
+			}
+			m.logicalSectorSize = binary.LittleEndian.Uint32(data[0:4])
+		case physicalSectorSizeGUID:
+			if length < 4 {
+				return nil, fmt.Errorf("physical sector size item has invalid length %d", length)
+			}
+			m.physicalSectorSize = binary.LittleEndian.Uint32(data[0:4])
+		case parentLocatorGUID:
+			// only relevant for differencing disks, which hasParent already rejects
+		default:
+			if flags&metadataFlagIsRequired != 0 {
+				return nil, fmt.Errorf("unsupported required metadata item %s", itemID)
+			}
+		}
+		found[itemID] = true
+	}
+	for _, required := range []uuid.UUID{fileParametersGUID, virtualDiskSizeGUID, logicalSectorSizeGUID, physicalSectorSizeGUID} {
+		if !found[required] {
+			return nil, fmt.Errorf("missing required metadata item %s", required)
+		}
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// validate check that the metadata values are within the limits of the specification
+func (m *metadata) validate() error {
+	if m.blockSize < uint32(MinBlockSize) || m.blockSize > uint32(MaxBlockSize) || m.blockSize&(m.blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d, must be a power of 2 between %d and %d", m.blockSize, MinBlockSize, MaxBlockSize)
+	}
+	if m.logicalSectorSize != 512 && m.logicalSectorSize != 4096 {
+		return fmt.Errorf("invalid logical sector size %d, must be 512 or 4096", m.logicalSectorSize)
+	}
+	if m.physicalSectorSize != 512 && m.physicalSectorSize != 4096 {
+		return fmt.Errorf("invalid physical sector size %d, must be 512 or 4096", m.physicalSectorSize)
+	}
+	if m.virtualDiskSize == 0 || m.virtualDiskSize%uint64(m.logicalSectorSize) != 0 {
+		return fmt.Errorf("invalid virtual disk size %d, must be a non-zero multiple of logical sector size %d", m.virtualDiskSize, m.logicalSectorSize)
+	}
+	if m.virtualDiskSize > uint64(MaxVirtualSize) {
+		return fmt.Errorf("virtual disk size %d is larger than maximum %d", m.virtualDiskSize, MaxVirtualSize)
+	}
+	return nil
+}
+
+// toBytes returns the bytes for the entire metadata region of the given length
+func (m *metadata) toBytes(length uint32) []byte {
+	b := make([]byte, length)
+	copy(b[0:8], metadataSignature)
+
+	type item struct {
+		guid  uuid.UUID
+		flags uint32
+		data  []byte
+	}
+	fileParameters := make([]byte, 8)
+	binary.LittleEndian.PutUint32(fileParameters[0:4], m.blockSize)
+	var params uint32
+	if m.leaveBlocksAllocated {
+		params |= fileParametersLeaveBlocksAllocated
+	}
+	if m.hasParent {
+		params |= fileParametersHasParent
+	}
+	binary.LittleEndian.PutUint32(fileParameters[4:8], params)
+	virtualDiskSize := make([]byte, 8)
+	binary.LittleEndian.PutUint64(virtualDiskSize, m.virtualDiskSize)
+	logicalSectorSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(logicalSectorSize, m.logicalSectorSize)
+	physicalSectorSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(physicalSectorSize, m.physicalSectorSize)
+
+	items := []item{
+		{fileParametersGUID, metadataFlagIsRequired, fileParameters},
+		{virtualDiskSizeGUID, metadataFlagIsVirtual | metadataFlagIsRequired, virtualDiskSize},
+		{virtualDiskIDGUID, metadataFlagIsVirtual | metadataFlagIsRequired, guidToBytes(m.virtualDiskID)},
+		{logicalSectorSizeGUID, metadataFlagIsVirtual | metadataFlagIsRequired, logicalSectorSize},
+		{physicalSectorSizeGUID, metadataFlagIsVirtual | metadataFlagIsRequired, physicalSectorSize},
+	}
+	binary.LittleEndian.PutUint16(b[10:12], uint16(len(items)))
+
+	// items are placed one after the other, immediately after the table
+	offset := uint32(metadataTableSize)
+	for i, it := range items {
+		start := 32 + i*metadataEntrySize
+		eb := b[start : start+metadataEntrySize]
+		copy(eb[0:16], guidToBytes(it.guid))
+		binary.LittleEndian.PutUint32(eb[16:20], offset)
+		binary.LittleEndian.PutUint32(eb[20:24], uint32(len(it.data)))
+		binary.LittleEndian.PutUint32(eb[24:28], it.flags)
+		copy(b[offset:], it.data)
+		offset += uint32(len(it.data))
+	}
+	return b
+}
+
+// chunkRatio the number of payload blocks covered by a single sector bitmap block
+func (m *metadata) chunkRatio() uint64 {
+	return (uint64(1) << 23) * uint64(m.logicalSectorSize) / uint64(m.blockSize)
+}
+
+// payloadBlocks the number of payload blocks needed to hold the entire virtual disk
+func (m *metadata) payloadBlocks() uint64 {
+	return (m.virtualDiskSize + uint64(m.blockSize) - 1) / uint64(m.blockSize)
+}
+
+// batEntries the total number of entries in the BAT, including the interleaved sector bitmap entries
+func (m *metadata) batEntries() uint64 {
+	payload := m.payloadBlocks()
+	chunkRatio := m.chunkRatio()
+	if m.hasParent {
+		// differencing disks always have a sector bitmap entry after every chunk
+		return ((payload + chunkRatio - 1) / chunkRatio) * (chunkRatio + 1)
+	}
+	return payload + (payload-1)/chunkRatio
+}
@@ -0,0 +1,214 @@
+package vhdx_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/vhdx"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestCreateReadWrite(t *testing.T) {
+	const (
+		size      = 100 * 1024 * 1024
+		blockSize = 1024 * 1024
+	)
+	p := filepath.Join(t.TempDir(), "disk.vhdx")
+	img, err := vhdx.CreateFromPath(p, size, &vhdx.CreateOptions{BlockSize: blockSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	info, err := img.Stat()
+	if err != nil {
+		t.Fatalf("error getting image info: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("mismatched size, actual %d expected %d", info.Size(), size)
+	}
+
+	// unallocated blocks read as zeroes
+	b := make([]byte, 4096)
+	if _, err := img.ReadAt(b, 10*blockSize); err != nil {
+		t.Fatalf("error reading unallocated block: %v", err)
+	}
+	if !bytes.Equal(b, make([]byte, len(b))) {
+		t.Errorf("unallocated block did not read as zeroes")
+	}
+
+	// write across a block boundary, so two blocks are allocated
+	data := make([]byte, 3*4096)
+	_, _ = rand.Read(data)
+	offset := int64(5*blockSize - 4096)
+	n, err := img.WriteAt(data, offset)
+	if err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if n != len(data) {
+		t.Fatalf("wrote %d bytes instead of %d", n, len(data))
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing image: %v", err)
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		img, err = vhdx.OpenFromPath(p, readOnly)
+		if err != nil {
+			t.Fatalf("error opening image: %v", err)
+		}
+		read := make([]byte, len(data)+2*4096)
+		if _, err := img.ReadAt(read, offset-4096); err != nil {
+			t.Fatalf("error reading: %v", err)
+		}
+		if !bytes.Equal(read[4096:4096+len(data)], data) {
+			t.Errorf("read data did not match written data")
+		}
+		if !bytes.Equal(read[:4096], make([]byte, 4096)) || !bytes.Equal(read[4096+len(data):], make([]byte, 4096)) {
+			t.Errorf("data around the written data was not zeroes")
+		}
+		_, err = img.WriteAt(data, 0)
+		if readOnly && err == nil {
+			t.Errorf("write to read-only image succeeded")
+		}
+		if !readOnly && err != nil {
+			t.Errorf("write to read-write image failed: %v", err)
+		}
+		_ = img.Close()
+	}
+}
+
+// TestParallelReadAt reads an image from many goroutines at once, while another writes to it, which is meant to
+// be run with -race
+func TestParallelReadAt(t *testing.T) {
+	const (
+		blockSize = 1024 * 1024
+		blocks    = 16
+		size      = blocks * blockSize
+		chunk     = 64 * 1024
+		readers   = 8
+	)
+	p := filepath.Join(t.TempDir(), "disk.vhdx")
+	img, err := vhdx.CreateFromPath(p, size, &vhdx.CreateOptions{BlockSize: blockSize})
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	defer img.Close()
+	data := make([]byte, size/2)
+	_, _ = rand.Read(data)
+	if _, err := img.WriteAt(data, 0); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+
+	// the second half is written meanwhile, allocating payload blocks, and reads there get either zeroes or
+	// what was written
+	written := make([]byte, size/2)
+	_, _ = rand.Read(written)
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			b := make([]byte, chunk)
+			for j := 0; j < size/chunk; j++ {
+				off := (j*7 + r*13) % (size / chunk) * chunk
+				if _, err := img.ReadAt(b, int64(off)); err != nil {
+					t.Errorf("error reading at %d: %v", off, err)
+					return
+				}
+				if off < len(data) && !bytes.Equal(b, data[off:off+chunk]) {
+					t.Errorf("data at %d did not match what was written", off)
+					return
+				}
+				if off >= len(data) && !bytes.Equal(b, make([]byte, chunk)) && !bytes.Equal(b, written[off-len(data):off-len(data)+chunk]) {
+					t.Errorf("data at %d was neither zeroes nor what is being written", off)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for off := 0; off < len(written); off += 3 * chunk {
+			end := min(off+3*chunk, len(written))
+			if _, err := img.WriteAt(written[off:end], size/2+int64(off)); err != nil {
+				t.Errorf("error writing at %d: %v", size/2+off, err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	b := make([]byte, size)
+	if _, err := img.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading image: %v", err)
+	}
+	if !bytes.Equal(b[:size/2], data) || !bytes.Equal(b[size/2:], written) {
+		t.Errorf("disk did not read back as written")
+	}
+}
+
+func TestPartitionAndFilesystem(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "disk.vhdx")
+	img, err := vhdx.CreateFromPath(p, 64*1024*1024, nil)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	d, err := diskfs.OpenBackend(img)
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Start: 2048, End: 100000, Type: gpt.EFISystemPartition, Name: "EFI System"},
+		},
+	}
+	if err := d.Partition(table); err != nil {
+		t.Fatalf("error partitioning disk: %v", err)
+	}
+	fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "EFI"})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("error closing disk: %v", err)
+	}
+
+	img, err = vhdx.OpenFromPath(p, true)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	d, err = diskfs.OpenBackend(img)
+	if err != nil {
+		t.Fatalf("error opening disk: %v", err)
+	}
+	defer d.Close()
+	if d.Table == nil || d.Table.Type() != "gpt" {
+		t.Fatalf("did not find gpt partition table")
+	}
+	fs, err = d.GetFilesystem(1)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	entries, err := fs.ReadDir("/EFI")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var found bool
+	for _, e := range entries {
+		if e.Name() == "BOOT" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("did not find directory /EFI/BOOT")
+	}
+}
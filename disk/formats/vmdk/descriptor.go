@@ -0,0 +1,127 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	createTypeMonolithicSparse        = "monolithicSparse"
+	createTypeStreamOptimized         = "streamOptimized"
+	extentTypeSparse                  = "SPARSE"
+	noParentCID                uint32 = 0xffffffff
+)
+
+// extentDescription a single extent line of the descriptor, e.g. RW 2097152 SPARSE "disk.vmdk"
+type extentDescription struct {
+	access   string
+	sectors  uint64
+	kind     string
+	filename string
+}
+
+// descriptor the text descriptor embedded in a sparse extent, which describes the disk as a whole
+type descriptor struct {
+	cid        uint32
+	parentCID  uint32
+	createType string
+	extents    []extentDescription
+	// ddb the disk database entries, in the order they appear
+	ddb [][2]string
+}
+
+func descriptorFromBytes(b []byte) (*descriptor, error) {
+	// the descriptor is padded with NUL bytes to fill its sectors
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	d := &descriptor{parentCID: noParentCID}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("invalid extent description %q", line)
+			}
+			sectors, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in extent description %q: %v", line, err)
+			}
+			e := extentDescription{access: fields[0], sectors: sectors, kind: fields[2]}
+			if start := strings.IndexByte(line, '"'); start >= 0 {
+				if end := strings.IndexByte(line[start+1:], '"'); end >= 0 {
+					e.filename = line[start+1 : start+1+end]
+				}
+			}
+			d.extents = append(d.extents, e)
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid descriptor line %q", line)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch {
+		case key == "CID":
+			cid, err := strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CID %q: %v", value, err)
+			}
+			d.cid = uint32(cid)
+		case key == "parentCID":
+			cid, err := strconv.ParseUint(value, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid parentCID %q: %v", value, err)
+			}
+			d.parentCID = uint32(cid)
+		case key == "createType":
+			d.createType = value
+		case strings.HasPrefix(key, "ddb."):
+			d.ddb = append(d.ddb, [2]string{key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read descriptor: %v", err)
+	}
+	return d, nil
+}
+
+func (d *descriptor) toBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Disk DescriptorFile\n")
+	buf.WriteString("version=1\n")
+	fmt.Fprintf(&buf, "CID=%08x\n", d.cid)
+	fmt.Fprintf(&buf, "parentCID=%08x\n", d.parentCID)
+	fmt.Fprintf(&buf, "createType=%q\n", d.createType)
+	buf.WriteString("\n# Extent description\n")
+	for _, e := range d.extents {
+		fmt.Fprintf(&buf, "%s %d %s %q\n", e.access, e.sectors, e.kind, e.filename)
+	}
+	buf.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	for _, kv := range d.ddb {
+		fmt.Fprintf(&buf, "%s = %q\n", kv[0], kv[1])
+	}
+	return buf.Bytes()
+}
+
+// geometry the legacy CHS geometry for a disk of the given number of sectors, as VMware calculates it
+func geometry(sectors uint64, adapterType string) (cylinders uint64, heads, sectorsPerTrack int) {
+	heads, sectorsPerTrack = 16, 63
+	if adapterType != "ide" {
+		heads, sectorsPerTrack = 255, 63
+	}
+	cylinders = sectors / uint64(heads*sectorsPerTrack)
+	if adapterType == "ide" && cylinders > 16383 {
+		cylinders = 16383
+	}
+	return cylinders, heads, sectorsPerTrack
+}
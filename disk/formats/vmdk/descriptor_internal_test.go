@@ -0,0 +1,115 @@
+package vmdk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDescriptorFromBytes(t *testing.T) {
+	// as written by VMware, with CRLF line endings and padding
+	input := "# Disk DescriptorFile\r\nversion=1\r\nencoding=\"UTF-8\"\r\nCID=6c9e2b1d\r\nparentCID=ffffffff\r\n" +
+		"createType=\"streamOptimized\"\r\n\r\n# Extent description\r\nRDONLY 41943040 SPARSE \"appliance disk1.vmdk\"\r\n\r\n" +
+		"# The Disk Data Base\r\n#DDB\r\n\r\nddb.adapterType = \"lsilogic\"\r\nddb.geometry.cylinders = \"2610\"\r\n" +
+		"ddb.geometry.heads = \"255\"\r\nddb.geometry.sectors = \"63\"\r\nddb.virtualHWVersion = \"7\"\r\n"
+	b := make([]byte, 10*512)
+	copy(b, input)
+	d, err := descriptorFromBytes(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &descriptor{
+		cid:        0x6c9e2b1d,
+		parentCID:  noParentCID,
+		createType: createTypeStreamOptimized,
+		extents: []extentDescription{
+			{access: "RDONLY", sectors: 41943040, kind: extentTypeSparse, filename: "appliance disk1.vmdk"},
+		},
+		ddb: [][2]string{
+			{"ddb.adapterType", "lsilogic"},
+			{"ddb.geometry.cylinders", "2610"},
+			{"ddb.geometry.heads", "255"},
+			{"ddb.geometry.sectors", "63"},
+			{"ddb.virtualHWVersion", "7"},
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("mismatched descriptor\nactual   %#v\nexpected %#v", d, expected)
+	}
+
+	// what we write, we can read back
+	roundTrip, err := descriptorFromBytes(d.toBytes())
+	if err != nil {
+		t.Fatalf("unexpected error reading written descriptor: %v", err)
+	}
+	if !reflect.DeepEqual(roundTrip, d) {
+		t.Errorf("mismatched descriptor after round trip\nactual   %#v\nexpected %#v", roundTrip, d)
+	}
+}
+
+func TestSparseHeader(t *testing.T) {
+	h := &sparseHeader{
+		version:           3,
+		flags:             flagValidNewLineDetection | flagCompressedGrains | flagMarkers,
+		capacity:          2 * 1024 * 1024,
+		grainSize:         128,
+		descriptorOffset:  1,
+		descriptorSize:    descriptorSectors,
+		numGTEsPerGT:      defaultGTEsPerGT,
+		gdOffset:          gdAtEnd,
+		overHead:          128,
+		compressAlgorithm: compressionDeflate,
+	}
+	b := h.toBytes()
+	actual, err := sparseHeaderFromBytes(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *actual != *h {
+		t.Errorf("mismatched header\nactual   %#v\nexpected %#v", actual, h)
+	}
+	if entries := h.grainDirEntries(); entries != 32 {
+		t.Errorf("mismatched grain directory entries, actual %d expected %d", entries, 32)
+	}
+
+	// end of line characters changed by a text mode transfer
+	b[75] = '\n'
+	if _, err := sparseHeaderFromBytes(b); err == nil {
+		t.Errorf("corrupted header did not return an error")
+	}
+}
+
+func TestSparseHeaderCheckBounds(t *testing.T) {
+	const size = 10 * 1024 * 1024
+	valid := sparseHeader{
+		capacity:         2 * 1024 * 1024,
+		grainSize:        128,
+		descriptorOffset: 1,
+		descriptorSize:   descriptorSectors,
+		numGTEsPerGT:     defaultGTEsPerGT,
+		flags:            flagRedundantGrainTable,
+		rgdOffset:        21,
+		gdOffset:         100,
+	}
+	if err := valid.checkBounds(size); err != nil {
+		t.Fatalf("unexpected error for valid header: %v", err)
+	}
+	tests := map[string]func(h *sparseHeader){
+		"capacity":                 func(h *sparseHeader) { h.capacity = 1 << 62 },
+		"grain size":               func(h *sparseHeader) { h.grainSize = 1 << 20 },
+		"grain table entries":      func(h *sparseHeader) { h.numGTEsPerGT = 1 << 30 },
+		"descriptor size":          func(h *sparseHeader) { h.descriptorSize = 1 << 40 },
+		"descriptor offset":        func(h *sparseHeader) { h.descriptorOffset = uint64(size / SectorSize) },
+		"grain directory offset":   func(h *sparseHeader) { h.gdOffset = 1 << 40 },
+		"redundant grain dir":      func(h *sparseHeader) { h.rgdOffset = uint64(size / SectorSize) },
+		"grain directory too long": func(h *sparseHeader) { h.numGTEsPerGT, h.grainSize, h.capacity = 1, 1, 1<<40 },
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := valid
+			mutate(&h)
+			if err := h.checkBounds(size); err == nil {
+				t.Errorf("header out of bounds did not return an error")
+			}
+		})
+	}
+}
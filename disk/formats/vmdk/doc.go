@@ -0,0 +1,20 @@
+// Package vmdk provides a backend.Storage implementation for VMDK disk images, the format used by VMware.
+//
+// Two kinds of VMDK image are supported, both of which hold the whole virtual disk in a single sparse extent
+// with an embedded descriptor:
+//
+//   - monolithicSparse, whose grains are allocated as they are written. It can be read and written in place.
+//   - streamOptimized, whose grains are compressed, as used for the disks in OVA/OVF appliances. It can be
+//     read, and it can be created, but an existing image cannot be changed. As the image must be written
+//     in order, a new image is kept in a temporary file until it is closed, and only then written out.
+//
+// The Image returned by New, OpenFromPath, Create or CreateFromPath translates reads and writes of the virtual
+// disk into reads and writes of the grains in the image, via the grain directory and grain tables. It can be
+// passed directly to diskfs.OpenBackend to work with the partitions and filesystems of the virtual disk.
+//
+// Images split across several files, flat extents and images with a parent are not supported.
+//
+// references:
+//
+//	https://github.com/libyal/libvmdk/blob/main/documentation/VMWare%20Virtual%20Disk%20Format%20(VMDK).asciidoc
+package vmdk
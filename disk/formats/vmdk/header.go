@@ -0,0 +1,204 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	// SectorSize is the size of a sector, the unit in which all offsets and sizes in a VMDK image are given
+	SectorSize int64 = 512
+
+	sparseMagic      uint32 = 0x564d444b // "KDMV"
+	headerSize              = 512
+	markerHeaderSize        = 12 // uint64 value and uint32 size that start every marker
+	// gdAtEnd is the gdOffset in the header of a streamOptimized image, whose grain directory is
+	// only known once the whole stream is written, and so is found via the footer instead
+	gdAtEnd uint64 = 0xffffffffffffffff
+
+	flagValidNewLineDetection uint32 = 1 << 0
+	flagRedundantGrainTable   uint32 = 1 << 1
+	flagZeroedGrainGTE        uint32 = 1 << 2
+	flagCompressedGrains      uint32 = 1 << 16
+	flagMarkers               uint32 = 1 << 17
+
+	compressionDeflate uint16 = 1
+
+	// metadata marker types
+	markerEndOfStream  uint32 = 0
+	markerGrainTable   uint32 = 1
+	markerGrainDir     uint32 = 2
+	markerFooter       uint32 = 3
+	gteSize                   = 4
+	defaultGTEsPerGT   uint32 = 512
+	descriptorSectors  uint64 = 20
+	zeroedGrainGTEMark uint32 = 1
+
+	// maxGTEsPerGT a limit on the entries of a grain table, far above the 512 that every image uses
+	maxGTEsPerGT uint32 = 64 * 1024
+	// maxDescriptorSectors a limit on the size of the embedded descriptor, far above what it needs
+	maxDescriptorSectors uint64 = 2048
+)
+
+// sparseHeader the header of a hosted sparse extent, which appears in the first sector of the image,
+// and for streamOptimized images, again as the footer at the end
+type sparseHeader struct {
+	version           uint32
+	flags             uint32
+	capacity          uint64 // sectors
+	grainSize         uint64 // sectors
+	descriptorOffset  uint64 // sectors
+	descriptorSize    uint64 // sectors
+	numGTEsPerGT      uint32
+	rgdOffset         uint64 // sectors
+	gdOffset          uint64 // sectors
+	overHead          uint64 // sectors
+	uncleanShutdown   bool
+	compressAlgorithm uint16
+}
+
+func sparseHeaderFromBytes(b []byte) (*sparseHeader, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("header had %d bytes instead of expected %d", len(b), headerSize)
+	}
+	if magic := binary.LittleEndian.Uint32(b[0:4]); magic != sparseMagic {
+		return nil, fmt.Errorf("invalid sparse extent header signature %x", magic)
+	}
+	h := &sparseHeader{
+		version:           binary.LittleEndian.Uint32(b[4:8]),
+		flags:             binary.LittleEndian.Uint32(b[8:12]),
+		capacity:          binary.LittleEndian.Uint64(b[12:20]),
+		grainSize:         binary.LittleEndian.Uint64(b[20:28]),
+		descriptorOffset:  binary.LittleEndian.Uint64(b[28:36]),
+		descriptorSize:    binary.LittleEndian.Uint64(b[36:44]),
+		numGTEsPerGT:      binary.LittleEndian.Uint32(b[44:48]),
+		rgdOffset:         binary.LittleEndian.Uint64(b[48:56]),
+		gdOffset:          binary.LittleEndian.Uint64(b[56:64]),
+		overHead:          binary.LittleEndian.Uint64(b[64:72]),
+		uncleanShutdown:   b[72] != 0,
+		compressAlgorithm: binary.LittleEndian.Uint16(b[77:79]),
+	}
+	if h.version < 1 || h.version > 3 {
+		return nil, fmt.Errorf("unsupported sparse extent version %d", h.version)
+	}
+	// the end of line characters are there to detect an image corrupted by an FTP transfer in text mode
+	if h.flags&flagValidNewLineDetection != 0 && (b[73] != '\n' || b[74] != ' ' || b[75] != '\r' || b[76] != '\n') {
+		return nil, errors.New("sparse extent header is corrupted, end of line characters have been changed")
+	}
+	if h.grainSize == 0 || h.grainSize&(h.grainSize-1) != 0 {
+		return nil, fmt.Errorf("invalid grain size of %d sectors, must be a power of 2", h.grainSize)
+	}
+	if h.numGTEsPerGT == 0 {
+		return nil, errors.New("invalid number of grain table entries per grain table 0")
+	}
+	if h.flags&flagCompressedGrains != 0 && h.compressAlgorithm != compressionDeflate {
+		return nil, fmt.Errorf("unsupported compression algorithm %d", h.compressAlgorithm)
+	}
+	return h, nil
+}
+
+// checkBounds check that the sizes and locations in the header fit the limits of the format and an image of
+// size bytes, before anything is allocated from them
+func (h *sparseHeader) checkBounds(size int64) error {
+	sectors := uint64(size / SectorSize)
+	if h.capacity > uint64(math.MaxInt64/SectorSize) {
+		return fmt.Errorf("invalid capacity of %d sectors", h.capacity)
+	}
+	if h.grainBytes() > int64(MaxGrainSize) {
+		return fmt.Errorf("grain size of %d sectors is larger than the maximum of %d bytes", h.grainSize, MaxGrainSize)
+	}
+	if h.numGTEsPerGT > maxGTEsPerGT {
+		return fmt.Errorf("%d grain table entries per grain table is more than the maximum of %d", h.numGTEsPerGT, maxGTEsPerGT)
+	}
+	if h.descriptorOffset != 0 && h.descriptorSize != 0 {
+		if h.descriptorSize > maxDescriptorSectors {
+			return fmt.Errorf("descriptor of %d sectors is larger than the maximum of %d", h.descriptorSize, maxDescriptorSectors)
+		}
+		if h.descriptorOffset > sectors || h.descriptorSize > sectors-h.descriptorOffset {
+			return fmt.Errorf("descriptor at sector %d of %d sectors is beyond the end of the image", h.descriptorOffset, h.descriptorSize)
+		}
+	}
+	// the grain directories are stored in the image, so cannot be larger than it
+	gdSectors := h.grainDirSectors()
+	if h.gdOffset > sectors || gdSectors > sectors-h.gdOffset {
+		return fmt.Errorf("grain directory at sector %d of %d sectors is beyond the end of the image", h.gdOffset, gdSectors)
+	}
+	if h.hasFlag(flagRedundantGrainTable) && h.rgdOffset != 0 && (h.rgdOffset > sectors || gdSectors > sectors-h.rgdOffset) {
+		return fmt.Errorf("redundant grain directory at sector %d of %d sectors is beyond the end of the image", h.rgdOffset, gdSectors)
+	}
+	return nil
+}
+
+func (h *sparseHeader) toBytes() []byte {
+	b := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(b[0:4], sparseMagic)
+	binary.LittleEndian.PutUint32(b[4:8], h.version)
+	binary.LittleEndian.PutUint32(b[8:12], h.flags)
+	binary.LittleEndian.PutUint64(b[12:20], h.capacity)
+	binary.LittleEndian.PutUint64(b[20:28], h.grainSize)
+	binary.LittleEndian.PutUint64(b[28:36], h.descriptorOffset)
+	binary.LittleEndian.PutUint64(b[36:44], h.descriptorSize)
+	binary.LittleEndian.PutUint32(b[44:48], h.numGTEsPerGT)
+	binary.LittleEndian.PutUint64(b[48:56], h.rgdOffset)
+	binary.LittleEndian.PutUint64(b[56:64], h.gdOffset)
+	binary.LittleEndian.PutUint64(b[64:72], h.overHead)
+	if h.uncleanShutdown {
+		b[72] = 1
+	}
+	b[73], b[74], b[75], b[76] = '\n', ' ', '\r', '\n'
+	binary.LittleEndian.PutUint16(b[77:79], h.compressAlgorithm)
+	return b
+}
+
+// grainBytes the size of a grain in bytes
+func (h *sparseHeader) grainBytes() int64 {
+	return int64(h.grainSize) * SectorSize
+}
+
+// grainTableCoverage the number of bytes of the virtual disk covered by a single grain table
+func (h *sparseHeader) grainTableCoverage() int64 {
+	return int64(h.numGTEsPerGT) * h.grainBytes()
+}
+
+// grainDirEntries the number of entries in the grain directory, one for each grain table
+func (h *sparseHeader) grainDirEntries() uint64 {
+	coverage := uint64(h.numGTEsPerGT) * h.grainSize
+	return (h.capacity + coverage - 1) / coverage
+}
+
+// grainTableSectors the number of sectors taken by a single grain table
+func (h *sparseHeader) grainTableSectors() uint64 {
+	return sectorsFor(uint64(h.numGTEsPerGT) * gteSize)
+}
+
+// grainDirSectors the number of sectors taken by the grain directory
+func (h *sparseHeader) grainDirSectors() uint64 {
+	return sectorsFor(h.grainDirEntries() * gteSize)
+}
+
+func (h *sparseHeader) hasFlag(flag uint32) bool {
+	return h.flags&flag == flag
+}
+
+// metadataMarker a marker preceding metadata in a streamOptimized image, padded to a full sector
+func metadataMarker(markerType uint32, sectors uint64) []byte {
+	b := make([]byte, SectorSize)
+	binary.LittleEndian.PutUint64(b[0:8], sectors)
+	binary.LittleEndian.PutUint32(b[12:16], markerType)
+	return b
+}
+
+// grainMarker the header of a compressed grain in a streamOptimized image, which is followed by the data
+func grainMarker(lba uint64, size uint32) []byte {
+	b := make([]byte, markerHeaderSize)
+	binary.LittleEndian.PutUint64(b[0:8], lba)
+	binary.LittleEndian.PutUint32(b[8:12], size)
+	return b
+}
+
+// sectorsFor the number of whole sectors needed to hold size bytes
+func sectorsFor(size uint64) uint64 {
+	return (size + uint64(SectorSize) - 1) / uint64(SectorSize)
+}
@@ -0,0 +1,144 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// streamWriter holds the contents of a new streamOptimized image until it is written out. The grains of a
+// streamOptimized image are compressed and must appear in order, so they cannot be written as they arrive.
+type streamWriter struct {
+	staging    *os.File
+	written    *util.Bitmap // grains that have been written to
+	grainBytes int64
+}
+
+func newStreamWriter(size, grainBytes int64) (*streamWriter, error) {
+	staging, err := os.CreateTemp("", "go-diskfs-vmdk-stream-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create staging file for streamOptimized image: %w", err)
+	}
+	if err := staging.Truncate(size); err != nil {
+		_ = staging.Close()
+		_ = os.Remove(staging.Name())
+		return nil, fmt.Errorf("unable to size staging file for streamOptimized image: %w", err)
+	}
+	grains := (size + grainBytes - 1) / grainBytes
+	return &streamWriter{
+		staging:    staging,
+		written:    util.NewBitmap(int((grains + 7) / 8)),
+		grainBytes: grainBytes,
+	}, nil
+}
+
+func (s *streamWriter) writeAt(p []byte, off int64) (int, error) {
+	n, err := s.staging.WriteAt(p, off)
+	for grain := off / s.grainBytes; grain*s.grainBytes < off+int64(n); grain++ {
+		_ = s.written.Set(int(grain))
+	}
+	return n, err
+}
+
+// remove close and delete the staging file
+func (s *streamWriter) remove() {
+	_ = s.staging.Close()
+	_ = os.Remove(s.staging.Name())
+}
+
+// writeStream write out the grains, grain tables, grain directory and footer of a new streamOptimized image,
+// after the header and descriptor that were written when it was created
+func (i *Image) writeStream() error {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return err
+	}
+	h := i.header
+	offset := int64(h.overHead) * SectorSize
+	write := func(b []byte) error {
+		if _, err := writable.WriteAt(b, offset); err != nil {
+			return fmt.Errorf("unable to write streamOptimized image at %d: %w", offset, err)
+		}
+		offset += int64(len(b))
+		return nil
+	}
+
+	entries := h.grainDirEntries()
+	gts := make([][]uint32, entries)
+	for j := range gts {
+		gts[j] = make([]uint32, h.numGTEsPerGT)
+	}
+	grainBytes := h.grainBytes()
+	grains := (i.Size() + grainBytes - 1) / grainBytes
+	grain := make([]byte, grainBytes)
+	zeroes := make([]byte, grainBytes)
+	var compressed bytes.Buffer
+	for g := int64(0); g < grains; g++ {
+		if written, _ := i.stream.written.IsSet(int(g)); !written {
+			continue
+		}
+		n, err := i.stream.staging.ReadAt(grain, g*grainBytes)
+		if n < len(grain) && err != nil {
+			// the last grain may be short
+			if g != grains-1 {
+				return fmt.Errorf("unable to read grain %d from staging file: %w", g, err)
+			}
+			clear(grain[n:])
+		}
+		// a grain of all zeroes reads the same whether it is there or not
+		if bytes.Equal(grain, zeroes) {
+			continue
+		}
+		compressed.Reset()
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(grain); err != nil {
+			return fmt.Errorf("unable to compress grain %d: %w", g, err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("unable to compress grain %d: %w", g, err)
+		}
+		lba := uint64(g) * h.grainSize
+		b := append(grainMarker(lba, uint32(compressed.Len())), compressed.Bytes()...)
+		b = append(b, make([]byte, alignUp(int64(len(b)), SectorSize)-int64(len(b)))...)
+		gts[uint64(g)/uint64(h.numGTEsPerGT)][uint64(g)%uint64(h.numGTEsPerGT)] = uint32(offset / SectorSize)
+		if err := write(b); err != nil {
+			return err
+		}
+	}
+
+	// every grain table, each preceded by its marker, then the grain directory
+	gd := make([]uint32, entries)
+	for j, gt := range gts {
+		if err := write(metadataMarker(markerGrainTable, h.grainTableSectors())); err != nil {
+			return err
+		}
+		gd[j] = uint32(offset / SectorSize)
+		if err := write(grainDirToBytes(gt)); err != nil {
+			return err
+		}
+	}
+	if err := write(metadataMarker(markerGrainDir, h.grainDirSectors())); err != nil {
+		return err
+	}
+	gdOffset := uint64(offset / SectorSize)
+	if err := write(grainDirToBytes(gd)); err != nil {
+		return err
+	}
+
+	// the footer is a copy of the header, but with the location of the grain directory
+	footer := *h
+	footer.gdOffset = gdOffset
+	if err := write(metadataMarker(markerFooter, 1)); err != nil {
+		return err
+	}
+	if err := write(footer.toBytes()); err != nil {
+		return err
+	}
+	if err := write(metadataMarker(markerEndOfStream, 0)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,768 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// Subformat the layout of a VMDK image
+type Subformat int
+
+const (
+	// MonolithicSparse a single sparse extent, with the descriptor embedded, whose grains are allocated as
+	// they are written. It can be read and written in place.
+	MonolithicSparse Subformat = iota
+	// StreamOptimized a single sparse extent with compressed grains, laid out so that it can be
+	// written and read as a stream. It is the format used for disks in OVA/OVF appliances.
+	StreamOptimized
+)
+
+// Subformat.String()
+func (s Subformat) String() string {
+	switch s {
+	case MonolithicSparse:
+		return createTypeMonolithicSparse
+	case StreamOptimized:
+		return createTypeStreamOptimized
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// DefaultGrainSize is the grain size used when creating an image, if none is specified
+	DefaultGrainSize uint32 = 64 * 1024
+	// MinGrainSize is the smallest allowed grain size
+	MinGrainSize uint32 = 4 * 1024
+	// MaxGrainSize is the largest allowed grain size
+	MaxGrainSize uint32 = 16 * 1024 * 1024
+	// DefaultAdapterType is the adapter type recorded in the descriptor, if none is specified
+	DefaultAdapterType = "ide"
+)
+
+// CreateOptions options for creating a new VMDK image. Any zero values are replaced with the defaults.
+type CreateOptions struct {
+	// Subformat is the layout of the image. Defaults to MonolithicSparse.
+	Subformat Subformat
+	// GrainSize is the size of each grain, which is the unit of allocation. Must be a power of 2
+	// between MinGrainSize and MaxGrainSize. Defaults to DefaultGrainSize.
+	GrainSize uint32
+	// AdapterType is the disk adapter the virtual disk is attached to, one of ide, buslogic, lsilogic
+	// or legacyESX. Defaults to DefaultAdapterType.
+	AdapterType string
+}
+
+// Image is a VMDK image. It implements backend.Storage for the virtual disk contained in the image,
+// so it can be passed to diskfs.OpenBackend like any other backend. ReadAt and WriteAt, and the other methods
+// but Read and Seek, which share an offset, are safe for concurrent use; reads run in parallel, and writes
+// one at a time.
+type Image struct {
+	// mu is held for reading by reads of the image, and for writing by anything that changes it
+	mu sync.RWMutex
+	// cacheMu guards gts and grainCache, which reads fill in while holding mu only for reading
+	cacheMu      sync.Mutex
+	storage      backend.Storage
+	readOnly     bool
+	header       *sparseHeader
+	descriptor   *descriptor
+	gd           []uint32
+	rgd          []uint32
+	gts          map[uint64][]uint32 // grain tables by grain directory index, read as needed
+	fileEnd      int64               // where the next grain will be allocated
+	writeStarted bool                // whether the header was marked unclean for the first write since opening
+	stream       *streamWriter       // set while a new streamOptimized image is being written
+	grainCache   []byte              // the last compressed grain that was read, decompressed
+	cachedGrain  uint32              // the sector of the grain in grainCache
+	offset       int64               // for Read and Seek
+}
+
+// pendingWrite a structure to be written to the image when it is created
+type pendingWrite struct {
+	b      []byte
+	offset int64
+}
+
+// interface guards
+var (
+	_ backend.Storage            = (*Image)(nil)
+	_ backend.AllocationReporter = (*Image)(nil)
+)
+
+// New opens a VMDK image from an existing backend.Storage, usually a file backend. Monolithic sparse images
+// are writable if the provided storage is writable. StreamOptimized images are always read-only, as their
+// compressed grains cannot be rewritten in place.
+func New(b backend.Storage) (*Image, error) {
+	_, err := b.Writable()
+	img := &Image{
+		storage:  b,
+		readOnly: err != nil,
+		gts:      map[uint64][]uint32{},
+	}
+	if err := img.load(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// OpenFromPath opens a VMDK image from a path to a file, which must exist.
+func OpenFromPath(pathName string, readOnly bool) (*Image, error) {
+	b, err := file.OpenFromPath(pathName, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	img, err := New(b)
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// CreateFromPath creates a new VMDK image at the given path, containing a virtual disk of size bytes.
+// The provided path must not exist.
+func CreateFromPath(pathName string, size int64, opts *CreateOptions) (*Image, error) {
+	if pathName == "" {
+		return nil, errors.New("must pass image path name")
+	}
+	f, err := os.OpenFile(pathName, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("could not create image %s: %w", pathName, err)
+	}
+	img, err := Create(file.New(f, false), size, opts)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+// Create creates a new VMDK image in the provided writable backend.Storage, containing a virtual disk
+// of size bytes, which must be a multiple of SectorSize.
+//
+// For a MonolithicSparse image, grains start out unallocated, and are allocated as they are written.
+//
+// A StreamOptimized image must be written sequentially, so writes are kept in a temporary file, and the
+// image itself is only written out when the Image is closed.
+func Create(b backend.Storage, size int64, opts *CreateOptions) (*Image, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	grainSize := opts.GrainSize
+	if grainSize == 0 {
+		grainSize = DefaultGrainSize
+	}
+	adapterType := opts.AdapterType
+	if adapterType == "" {
+		adapterType = DefaultAdapterType
+	}
+	if size <= 0 || size%SectorSize != 0 {
+		return nil, fmt.Errorf("must pass valid virtual disk size to create, a positive multiple of %d", SectorSize)
+	}
+	if grainSize < MinGrainSize || grainSize > MaxGrainSize || grainSize&(grainSize-1) != 0 {
+		return nil, fmt.Errorf("invalid grain size %d, must be a power of 2 between %d and %d", grainSize, MinGrainSize, MaxGrainSize)
+	}
+	switch adapterType {
+	case "ide", "buslogic", "lsilogic", "legacyESX":
+	default:
+		return nil, fmt.Errorf("unsupported adapter type %s", adapterType)
+	}
+	writable, err := b.Writable()
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat storage: %w", err)
+	}
+
+	capacity := uint64(size / SectorSize)
+	cylinders, heads, sectors := geometry(capacity, adapterType)
+	d := &descriptor{
+		cid:        rand.Uint32(),
+		parentCID:  noParentCID,
+		createType: opts.Subformat.String(),
+		extents: []extentDescription{
+			{access: "RW", sectors: capacity, kind: extentTypeSparse, filename: filepath.Base(info.Name())},
+		},
+		ddb: [][2]string{
+			{"ddb.virtualHWVersion", "4"},
+			{"ddb.geometry.cylinders", strconv.FormatUint(cylinders, 10)},
+			{"ddb.geometry.heads", strconv.Itoa(heads)},
+			{"ddb.geometry.sectors", strconv.Itoa(sectors)},
+			{"ddb.adapterType", adapterType},
+		},
+	}
+	h := &sparseHeader{
+		version:          1,
+		flags:            flagValidNewLineDetection,
+		capacity:         capacity,
+		grainSize:        uint64(grainSize) / uint64(SectorSize),
+		descriptorOffset: 1,
+		descriptorSize:   descriptorSectors,
+		numGTEsPerGT:     defaultGTEsPerGT,
+	}
+	img := &Image{
+		storage:    b,
+		header:     h,
+		descriptor: d,
+		gts:        map[uint64][]uint32{},
+		// the header is new, so there is no need to update it again on the first write
+		writeStarted: true,
+	}
+
+	var writes []pendingWrite
+	switch opts.Subformat {
+	case MonolithicSparse:
+		// header, descriptor, then the redundant grain directory and its tables, then the grain directory
+		// and its tables, all of which are allocated up front
+		h.flags |= flagRedundantGrainTable
+		entries := h.grainDirEntries()
+		tablesSectors := h.grainDirSectors() + entries*h.grainTableSectors()
+		h.rgdOffset = h.descriptorOffset + h.descriptorSize
+		h.gdOffset = h.rgdOffset + tablesSectors
+		h.overHead = alignUp(h.gdOffset+tablesSectors, h.grainSize)
+		img.gd = make([]uint32, entries)
+		img.rgd = make([]uint32, entries)
+		for j := uint64(0); j < entries; j++ {
+			img.rgd[j] = uint32(h.rgdOffset + h.grainDirSectors() + j*h.grainTableSectors())
+			img.gd[j] = uint32(h.gdOffset + h.grainDirSectors() + j*h.grainTableSectors())
+		}
+		writes = append(writes,
+			pendingWrite{make([]byte, int64(h.overHead)*SectorSize), 0},
+			pendingWrite{grainDirToBytes(img.rgd), int64(h.rgdOffset) * SectorSize},
+			pendingWrite{grainDirToBytes(img.gd), int64(h.gdOffset) * SectorSize},
+		)
+	case StreamOptimized:
+		h.version = 3
+		h.flags |= flagCompressedGrains | flagMarkers
+		h.compressAlgorithm = compressionDeflate
+		h.gdOffset = gdAtEnd
+		h.overHead = alignUp(h.descriptorOffset+h.descriptorSize, h.grainSize)
+		stream, err := newStreamWriter(size, h.grainBytes())
+		if err != nil {
+			return nil, err
+		}
+		img.stream = stream
+	default:
+		return nil, fmt.Errorf("unsupported subformat %d", opts.Subformat)
+	}
+	descriptorBytes := d.toBytes()
+	if uint64(len(descriptorBytes)) > h.descriptorSize*uint64(SectorSize) {
+		return nil, fmt.Errorf("descriptor of %d bytes does not fit in %d sectors", len(descriptorBytes), h.descriptorSize)
+	}
+	writes = append(writes,
+		pendingWrite{h.toBytes(), 0},
+		pendingWrite{descriptorBytes, int64(h.descriptorOffset) * SectorSize},
+	)
+	for _, w := range writes {
+		if _, err := writable.WriteAt(w.b, w.offset); err != nil {
+			if img.stream != nil {
+				img.stream.remove()
+			}
+			return nil, fmt.Errorf("unable to write VMDK structures at %d: %w", w.offset, err)
+		}
+	}
+	img.fileEnd = int64(h.overHead) * SectorSize
+	return img, nil
+}
+
+// load read the header, descriptor and grain directories from the storage
+func (i *Image) load() error {
+	hb := make([]byte, headerSize)
+	if _, err := i.storage.ReadAt(hb, 0); err != nil {
+		return fmt.Errorf("unable to read VMDK header: %w", err)
+	}
+	h, err := sparseHeaderFromBytes(hb)
+	if err != nil {
+		return fmt.Errorf("not a sparse VMDK image: %w", err)
+	}
+	info, err := i.storage.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat VMDK image: %w", err)
+	}
+	// a streamOptimized image only has the location of the grain directory in the footer,
+	// which is followed by the end-of-stream marker
+	if h.gdOffset == gdAtEnd {
+		footerOffset := info.Size() - 2*SectorSize
+		if footerOffset < SectorSize {
+			return errors.New("VMDK image too small to have a footer")
+		}
+		if _, err := i.storage.ReadAt(hb, footerOffset); err != nil {
+			return fmt.Errorf("unable to read VMDK footer: %w", err)
+		}
+		if h, err = sparseHeaderFromBytes(hb); err != nil {
+			return fmt.Errorf("invalid VMDK footer: %w", err)
+		}
+		if h.gdOffset == gdAtEnd {
+			return errors.New("VMDK footer does not have the grain directory location")
+		}
+	}
+	if err := h.checkBounds(info.Size()); err != nil {
+		return fmt.Errorf("invalid VMDK header: %w", err)
+	}
+	i.header = h
+
+	if h.descriptorOffset != 0 && h.descriptorSize != 0 {
+		db := make([]byte, int64(h.descriptorSize)*SectorSize)
+		if _, err := i.storage.ReadAt(db, int64(h.descriptorOffset)*SectorSize); err != nil {
+			return fmt.Errorf("unable to read VMDK descriptor: %w", err)
+		}
+		d, err := descriptorFromBytes(db)
+		if err != nil {
+			return fmt.Errorf("invalid VMDK descriptor: %w", err)
+		}
+		switch d.createType {
+		case createTypeMonolithicSparse, createTypeStreamOptimized:
+		default:
+			return fmt.Errorf("unsupported VMDK type %s", d.createType)
+		}
+		if d.parentCID != noParentCID {
+			return errors.New("VMDK images with a parent are not supported")
+		}
+		if len(d.extents) != 1 || d.extents[0].kind != extentTypeSparse {
+			return errors.New("VMDK images with anything but a single sparse extent are not supported")
+		}
+		i.descriptor = d
+	}
+
+	// compressed grains cannot be rewritten in place
+	if h.hasFlag(flagCompressedGrains) {
+		i.readOnly = true
+	}
+	if i.gd, err = i.readGrainDir(h.gdOffset); err != nil {
+		return err
+	}
+	if h.hasFlag(flagRedundantGrainTable) && h.rgdOffset != 0 {
+		if i.rgd, err = i.readGrainDir(h.rgdOffset); err != nil {
+			return err
+		}
+	}
+	i.fileEnd = alignUp(info.Size(), SectorSize)
+	return nil
+}
+
+func (i *Image) readGrainDir(sector uint64) ([]uint32, error) {
+	b := make([]byte, i.header.grainDirEntries()*gteSize)
+	if _, err := i.storage.ReadAt(b, int64(sector)*SectorSize); err != nil {
+		return nil, fmt.Errorf("unable to read VMDK grain directory at sector %d: %w", sector, err)
+	}
+	return grainTableFromBytes(b), nil
+}
+
+// grainTable get the grain table for the given grain directory entry, or nil if it is not allocated
+func (i *Image) grainTable(gdIndex uint64) ([]uint32, error) {
+	i.cacheMu.Lock()
+	gt, ok := i.gts[gdIndex]
+	i.cacheMu.Unlock()
+	if ok {
+		return gt, nil
+	}
+	sector := i.gd[gdIndex]
+	if sector == 0 {
+		return nil, nil
+	}
+	b := make([]byte, i.header.numGTEsPerGT*gteSize)
+	if _, err := i.storage.ReadAt(b, int64(sector)*SectorSize); err != nil {
+		return nil, fmt.Errorf("unable to read VMDK grain table at sector %d: %w", sector, err)
+	}
+	gt = grainTableFromBytes(b)
+	// another read may have got there first, and only one copy can be kept up to date by writes
+	i.cacheMu.Lock()
+	defer i.cacheMu.Unlock()
+	if cached, ok := i.gts[gdIndex]; ok {
+		return cached, nil
+	}
+	i.gts[gdIndex] = gt
+	return gt, nil
+}
+
+// grainSector the sector where the grain holding the given offset of the virtual disk is stored,
+// or 0 if it is not allocated
+func (i *Image) grainSector(offset int64) (uint32, error) {
+	gdIndex := uint64(offset / i.header.grainTableCoverage())
+	gt, err := i.grainTable(gdIndex)
+	if err != nil || gt == nil {
+		return 0, err
+	}
+	sector := gt[(offset%i.header.grainTableCoverage())/i.header.grainBytes()]
+	// a grain marked as zeroed reads as zeroes, like one that is not allocated
+	if sector == zeroedGrainGTEMark && i.header.hasFlag(flagZeroedGrainGTE) {
+		return 0, nil
+	}
+	return sector, nil
+}
+
+// Size returns the size of the virtual disk in bytes
+func (i *Image) Size() int64 {
+	return int64(i.header.capacity) * SectorSize
+}
+
+// GrainSize returns the size of the grains in bytes
+func (i *Image) GrainSize() int64 {
+	return i.header.grainBytes()
+}
+
+// Subformat returns the layout of the image
+func (i *Image) Subformat() Subformat {
+	if i.header.hasFlag(flagCompressedGrains) {
+		return StreamOptimized
+	}
+	return MonolithicSparse
+}
+
+// Allocated reports whether any of the length bytes of the virtual disk at off are stored in the image.
+// If not, they all read as zeroes, and copying the disk can skip them.
+func (i *Image) Allocated(off, length int64) (bool, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	// a new streamOptimized image is kept as a whole until it is written out
+	if i.stream != nil {
+		return true, nil
+	}
+	grainBytes := i.header.grainBytes()
+	end := min(off+length, i.Size())
+	for pos := off - off%grainBytes; pos < end; pos += grainBytes {
+		sector, err := i.grainSector(pos)
+		if err != nil {
+			return false, err
+		}
+		if sector != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadAt reads from the virtual disk at the given offset. Unallocated grains read as zeroes.
+func (i *Image) ReadAt(p []byte, off int64) (int, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	size := i.Size()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	var err error
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		err = io.EOF
+	}
+	if i.stream != nil {
+		if _, err := i.stream.staging.ReadAt(p, off); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		return len(p), err
+	}
+	grainBytes := i.header.grainBytes()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		inGrain := pos % grainBytes
+		count := min(int64(len(p)-n), grainBytes-inGrain)
+		target := p[n : n+int(count)]
+		sector, err := i.grainSector(pos)
+		if err != nil {
+			return n, err
+		}
+		switch {
+		case sector == 0:
+			clear(target)
+		case i.header.hasFlag(flagCompressedGrains):
+			grain, err := i.readCompressedGrain(sector)
+			if err != nil {
+				return n, err
+			}
+			copy(target, grain[inGrain:])
+		default:
+			if read, err := i.storage.ReadAt(target, int64(sector)*SectorSize+inGrain); err != nil && read != len(target) {
+				return n + read, fmt.Errorf("unable to read grain at sector %d: %w", sector, err)
+			}
+		}
+		n += int(count)
+	}
+	return n, err
+}
+
+// readCompressedGrain read and decompress the grain whose marker is at the given sector
+func (i *Image) readCompressedGrain(sector uint32) ([]byte, error) {
+	i.cacheMu.Lock()
+	cached, cachedSector := i.grainCache, i.cachedGrain
+	i.cacheMu.Unlock()
+	if cached != nil && cachedSector == sector {
+		return cached, nil
+	}
+	marker := make([]byte, markerHeaderSize)
+	offset := int64(sector) * SectorSize
+	if _, err := i.storage.ReadAt(marker, offset); err != nil {
+		return nil, fmt.Errorf("unable to read grain marker at sector %d: %w", sector, err)
+	}
+	size := int64(binary.LittleEndian.Uint32(marker[8:12]))
+	if size > i.fileEnd-offset-markerHeaderSize {
+		return nil, fmt.Errorf("compressed grain at sector %d of %d bytes is beyond the end of the image", sector, size)
+	}
+	compressed := make([]byte, size)
+	if _, err := i.storage.ReadAt(compressed, offset+markerHeaderSize); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to read compressed grain at sector %d: %w", sector, err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress grain at sector %d: %w", sector, err)
+	}
+	// the last grain of the disk may be short, the rest reads as zeroes
+	grain := make([]byte, i.header.grainBytes())
+	if _, err := io.ReadFull(r, grain); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to decompress grain at sector %d: %w", sector, err)
+	}
+	i.cacheMu.Lock()
+	i.grainCache, i.cachedGrain = grain, sector
+	i.cacheMu.Unlock()
+	return grain, nil
+}
+
+// WriteAt writes to the virtual disk at the given offset, allocating grains as needed
+func (i *Image) WriteAt(p []byte, off int64) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.readOnly {
+		return 0, backend.ErrIncorrectOpenMode
+	}
+	size := i.Size()
+	if off < 0 || off+int64(len(p)) > size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside of virtual disk of size %d", len(p), off, size)
+	}
+	if i.stream != nil {
+		return i.stream.writeAt(p, off)
+	}
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return 0, err
+	}
+	// mark the image as in use, so that an interrupted write can be detected
+	if !i.writeStarted {
+		i.header.uncleanShutdown = true
+		if _, err := writable.WriteAt(i.header.toBytes(), 0); err != nil {
+			return 0, fmt.Errorf("unable to write VMDK header: %w", err)
+		}
+		i.writeStarted = true
+	}
+	grainBytes := i.header.grainBytes()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		inGrain := pos % grainBytes
+		count := min(int64(len(p)-n), grainBytes-inGrain)
+		sector, err := i.grainSector(pos)
+		if err != nil {
+			return n, err
+		}
+		if sector == 0 {
+			if sector, err = i.allocateGrain(pos); err != nil {
+				return n, fmt.Errorf("unable to allocate grain for offset %d: %w", pos, err)
+			}
+		}
+		if _, err := writable.WriteAt(p[n:n+int(count)], int64(sector)*SectorSize+inGrain); err != nil {
+			return n, fmt.Errorf("unable to write grain at sector %d: %w", sector, err)
+		}
+		n += int(count)
+	}
+	return n, nil
+}
+
+// allocateGrain allocate a new grain at the end of the file for the given offset of the virtual disk,
+// and save its grain table entries, allocating the grain tables if needed
+func (i *Image) allocateGrain(offset int64) (uint32, error) {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return 0, err
+	}
+	gdIndex := uint64(offset / i.header.grainTableCoverage())
+	gtIndex := (offset % i.header.grainTableCoverage()) / i.header.grainBytes()
+	gt, err := i.grainTable(gdIndex)
+	if err != nil {
+		return 0, err
+	}
+	if gt == nil {
+		if gt, err = i.allocateGrainTable(gdIndex); err != nil {
+			return 0, err
+		}
+	}
+	grainOffset := i.fileEnd
+	// the grain must read as zeroes; writing its last byte extends the file, sparsely where supported
+	if _, err := writable.WriteAt([]byte{0}, grainOffset+i.header.grainBytes()-1); err != nil {
+		return 0, err
+	}
+	i.fileEnd = grainOffset + i.header.grainBytes()
+	sector := uint32(grainOffset / SectorSize)
+	b := binary.LittleEndian.AppendUint32(nil, sector)
+	for _, dir := range [][]uint32{i.gd, i.rgd} {
+		if dir == nil {
+			continue
+		}
+		if _, err := writable.WriteAt(b, int64(dir[gdIndex])*SectorSize+gtIndex*gteSize); err != nil {
+			return 0, fmt.Errorf("unable to write grain table entry: %w", err)
+		}
+	}
+	gt[gtIndex] = sector
+	return sector, nil
+}
+
+// allocateGrainTable allocate new grain tables at the end of the file for the given grain directory entry,
+// and save them in the grain directories
+func (i *Image) allocateGrainTable(gdIndex uint64) ([]uint32, error) {
+	writable, err := i.storage.Writable()
+	if err != nil {
+		return nil, err
+	}
+	tableBytes := int64(i.header.grainTableSectors()) * SectorSize
+	for _, dir := range []struct {
+		entries []uint32
+		sector  uint64
+	}{{i.gd, i.header.gdOffset}, {i.rgd, i.header.rgdOffset}} {
+		if dir.entries == nil {
+			continue
+		}
+		tableOffset := i.fileEnd
+		if _, err := writable.WriteAt(make([]byte, tableBytes), tableOffset); err != nil {
+			return nil, fmt.Errorf("unable to write grain table: %w", err)
+		}
+		i.fileEnd += tableBytes
+		sector := uint32(tableOffset / SectorSize)
+		b := binary.LittleEndian.AppendUint32(nil, sector)
+		if _, err := writable.WriteAt(b, int64(dir.sector)*SectorSize+int64(gdIndex)*gteSize); err != nil {
+			return nil, fmt.Errorf("unable to write grain directory entry: %w", err)
+		}
+		dir.entries[gdIndex] = sector
+	}
+	gt := make([]uint32, i.header.numGTEsPerGT)
+	i.cacheMu.Lock()
+	i.gts[gdIndex] = gt
+	i.cacheMu.Unlock()
+	return gt, nil
+}
+
+// Sys returns an error, as a VMDK image cannot be used for ioctl calls
+func (i *Image) Sys() (*os.File, error) {
+	return nil, backend.ErrNotSuitable
+}
+
+// Writable returns the image for read-write operations, if it was opened read-write
+func (i *Image) Writable() (backend.WritableFile, error) {
+	if i.readOnly {
+		return nil, backend.ErrIncorrectOpenMode
+	}
+	return i, nil
+}
+
+// Stat returns information about the virtual disk, whose size is the virtual size and not the size of the image
+func (i *Image) Stat() (fs.FileInfo, error) {
+	info, err := i.storage.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: info.Name(), size: i.Size(), mode: info.Mode(), modTime: info.ModTime()}, nil
+}
+
+// Read reads from the virtual disk at the current offset
+func (i *Image) Read(b []byte) (int, error) {
+	n, err := i.ReadAt(b, i.offset)
+	i.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (i *Image) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = i.offset + offset
+	case io.SeekEnd:
+		newOffset = i.Size() + offset
+	default:
+		return i.offset, fmt.Errorf("invalid whence %d", whence)
+	}
+	if newOffset < 0 {
+		return i.offset, errors.New("cannot seek to negative offset")
+	}
+	i.offset = newOffset
+	return i.offset, nil
+}
+
+// Close finishes writing the image and closes the underlying storage. For a new StreamOptimized image, this
+// is when the image is actually written.
+func (i *Image) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.stream != nil {
+		err := i.writeStream()
+		i.stream.remove()
+		i.stream = nil
+		if err != nil {
+			_ = i.storage.Close()
+			return err
+		}
+	}
+	if !i.readOnly && i.header.uncleanShutdown {
+		writable, err := i.storage.Writable()
+		if err != nil {
+			return err
+		}
+		i.header.uncleanShutdown = false
+		if _, err := writable.WriteAt(i.header.toBytes(), 0); err != nil {
+			return fmt.Errorf("unable to write VMDK header: %w", err)
+		}
+	}
+	return i.storage.Close()
+}
+
+func grainTableFromBytes(b []byte) []uint32 {
+	entries := make([]uint32, len(b)/gteSize)
+	for j := range entries {
+		entries[j] = binary.LittleEndian.Uint32(b[j*gteSize : (j+1)*gteSize])
+	}
+	return entries
+}
+
+func grainDirToBytes(entries []uint32) []byte {
+	b := make([]byte, sectorsFor(uint64(len(entries))*gteSize)*uint64(SectorSize))
+	for j, e := range entries {
+		binary.LittleEndian.PutUint32(b[j*gteSize:(j+1)*gteSize], e)
+	}
+	return b
+}
+
+// fileInfo information about the virtual disk
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() fs.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return f.modTime }
+func (f *fileInfo) IsDir() bool        { return false }
+func (f *fileInfo) Sys() any           { return nil }
+
+func alignUp[T int64 | uint64](n, align T) T {
+	return (n + align - 1) / align * align
+}
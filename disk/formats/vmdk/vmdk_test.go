@@ -0,0 +1,253 @@
+package vmdk_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/vmdk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+)
+
+func TestCreateReadWrite(t *testing.T) {
+	const (
+		size      = 100 * 1024 * 1024
+		grainSize = 64 * 1024
+	)
+	tests := []struct {
+		subformat vmdk.Subformat
+		writable  bool
+	}{
+		{vmdk.MonolithicSparse, true},
+		{vmdk.StreamOptimized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subformat.String(), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "disk.vmdk")
+			img, err := vmdk.CreateFromPath(p, size, &vmdk.CreateOptions{Subformat: tt.subformat, GrainSize: grainSize})
+			if err != nil {
+				t.Fatalf("error creating image: %v", err)
+			}
+			info, err := img.Stat()
+			if err != nil {
+				t.Fatalf("error getting image info: %v", err)
+			}
+			if info.Size() != size {
+				t.Errorf("mismatched size, actual %d expected %d", info.Size(), size)
+			}
+
+			// unallocated grains read as zeroes
+			b := make([]byte, 4096)
+			if _, err := img.ReadAt(b, 10*grainSize); err != nil {
+				t.Fatalf("error reading unallocated grain: %v", err)
+			}
+			if !bytes.Equal(b, make([]byte, len(b))) {
+				t.Errorf("unallocated grain did not read as zeroes")
+			}
+
+			// write across a grain boundary and, for the last grain, across a grain table boundary
+			data := make([]byte, 3*4096)
+			_, _ = rand.Read(data)
+			offsets := []int64{5*grainSize - 4096, 512*grainSize - 4096, size - int64(len(data))}
+			for _, offset := range offsets {
+				n, err := img.WriteAt(data, offset)
+				if err != nil {
+					t.Fatalf("error writing at %d: %v", offset, err)
+				}
+				if n != len(data) {
+					t.Fatalf("wrote %d bytes instead of %d", n, len(data))
+				}
+			}
+			if err := img.Close(); err != nil {
+				t.Fatalf("error closing image: %v", err)
+			}
+
+			for _, readOnly := range []bool{true, false} {
+				img, err = vmdk.OpenFromPath(p, readOnly)
+				if err != nil {
+					t.Fatalf("error opening image: %v", err)
+				}
+				if img.Subformat() != tt.subformat {
+					t.Errorf("mismatched subformat, actual %v expected %v", img.Subformat(), tt.subformat)
+				}
+				for _, offset := range offsets[:2] {
+					read := make([]byte, len(data)+2*4096)
+					if _, err := img.ReadAt(read, offset-4096); err != nil {
+						t.Fatalf("error reading at %d: %v", offset, err)
+					}
+					if !bytes.Equal(read[4096:4096+len(data)], data) {
+						t.Errorf("read data at %d did not match written data", offset)
+					}
+					if !bytes.Equal(read[:4096], make([]byte, 4096)) || !bytes.Equal(read[4096+len(data):], make([]byte, 4096)) {
+						t.Errorf("data around the written data at %d was not zeroes", offset)
+					}
+				}
+				read := make([]byte, len(data))
+				if _, err := img.ReadAt(read, offsets[2]); err != nil {
+					t.Fatalf("error reading end of disk: %v", err)
+				}
+				if !bytes.Equal(read, data) {
+					t.Errorf("read data at end of disk did not match written data")
+				}
+				_, err = img.WriteAt(data, 0)
+				if (readOnly || !tt.writable) && err == nil {
+					t.Errorf("write to read-only image succeeded")
+				}
+				if !readOnly && tt.writable && err != nil {
+					t.Errorf("write to read-write image failed: %v", err)
+				}
+				_ = img.Close()
+			}
+		})
+	}
+}
+
+// TestParallelReadAt reads images from many goroutines at once, while another writes to the writable one, which is
+// meant to be run with -race
+func TestParallelReadAt(t *testing.T) {
+	const (
+		// small grains, so that the disk spans several grain tables
+		grainSize = 4096
+		grains    = 2048
+		size      = grains * grainSize
+		readers   = 8
+	)
+	for _, subformat := range []vmdk.Subformat{vmdk.MonolithicSparse, vmdk.StreamOptimized} {
+		t.Run(subformat.String(), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "disk.vmdk")
+			img, err := vmdk.CreateFromPath(p, size, &vmdk.CreateOptions{Subformat: subformat, GrainSize: grainSize})
+			if err != nil {
+				t.Fatalf("error creating image: %v", err)
+			}
+			// each grain has contents of its own, so that readers of compressed grains keep replacing the
+			// cached one
+			data := make([]byte, size/2)
+			for g := 0; g < grains/2; g++ {
+				copy(data[g*grainSize:(g+1)*grainSize], bytes.Repeat([]byte(fmt.Sprintf("grain %d ", g)), grainSize))
+			}
+			if _, err := img.WriteAt(data, 0); err != nil {
+				t.Fatalf("error writing: %v", err)
+			}
+			if err := img.Close(); err != nil {
+				t.Fatalf("error closing image: %v", err)
+			}
+			// opened again, so that the grain tables are read by the readers
+			img, err = vmdk.OpenFromPath(p, subformat == vmdk.StreamOptimized)
+			if err != nil {
+				t.Fatalf("error opening image: %v", err)
+			}
+			defer img.Close()
+
+			var wg sync.WaitGroup
+			for r := 0; r < readers; r++ {
+				wg.Add(1)
+				go func(r int) {
+					defer wg.Done()
+					b := make([]byte, grainSize)
+					for j := 0; j < grains/2; j++ {
+						g := (j*7 + r*131) % (grains / 2)
+						if _, err := img.ReadAt(b, int64(g*grainSize)); err != nil {
+							t.Errorf("error reading grain %d: %v", g, err)
+							return
+						}
+						if !bytes.Equal(b, data[g*grainSize:(g+1)*grainSize]) {
+							t.Errorf("grain %d did not match what was written", g)
+							return
+						}
+					}
+				}(r)
+			}
+			// the second half of a writable image is written meanwhile, allocating grains and grain tables
+			written := make([]byte, size/2)
+			if subformat == vmdk.MonolithicSparse {
+				_, _ = rand.Read(written)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for off := 0; off < len(written); off += 3 * grainSize {
+						end := min(off+3*grainSize, len(written))
+						if _, err := img.WriteAt(written[off:end], size/2+int64(off)); err != nil {
+							t.Errorf("error writing at %d: %v", size/2+off, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			b := make([]byte, size)
+			if _, err := img.ReadAt(b, 0); err != nil {
+				t.Fatalf("error reading image: %v", err)
+			}
+			if !bytes.Equal(b[:size/2], data) || !bytes.Equal(b[size/2:], written) {
+				t.Errorf("disk did not read back as written")
+			}
+		})
+	}
+}
+
+func TestPartitionAndFilesystem(t *testing.T) {
+	for _, format := range []diskfs.Format{diskfs.FormatVMDK, diskfs.FormatVMDKStreamOptimized} {
+		t.Run(format.String(), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "disk.vmdk")
+			d, err := diskfs.Create(p, 64*1024*1024, diskfs.SectorSizeDefault, diskfs.WithFormat(format))
+			if err != nil {
+				t.Fatalf("error creating disk: %v", err)
+			}
+			table := &gpt.Table{
+				Partitions: []*gpt.Partition{
+					{Start: 2048, End: 100000, Type: gpt.EFISystemPartition, Name: "EFI System"},
+				},
+			}
+			if err := d.Partition(table); err != nil {
+				t.Fatalf("error partitioning disk: %v", err)
+			}
+			fs, err := d.CreateFilesystem(disk.FilesystemSpec{Partition: 1, FSType: filesystem.TypeFat32, VolumeLabel: "EFI"})
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+				t.Fatalf("error creating directory: %v", err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatalf("error closing disk: %v", err)
+			}
+
+			img, err := vmdk.OpenFromPath(p, true)
+			if err != nil {
+				t.Fatalf("error opening image: %v", err)
+			}
+			d, err = diskfs.OpenBackend(img)
+			if err != nil {
+				t.Fatalf("error opening disk: %v", err)
+			}
+			defer d.Close()
+			if d.Table == nil || d.Table.Type() != "gpt" {
+				t.Fatalf("did not find gpt partition table")
+			}
+			fs, err = d.GetFilesystem(1)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			entries, err := fs.ReadDir("/EFI")
+			if err != nil {
+				t.Fatalf("error reading directory: %v", err)
+			}
+			var found bool
+			for _, e := range entries {
+				if e.Name() == "BOOT" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("did not find directory /EFI/BOOT")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+const (
+	// sparseChunkSize how much CopySparse reads at a time
+	sparseChunkSize int64 = 1024 * 1024
+	// sparseBlockSize the smallest part of the disk that CopySparse leaves as a hole when it is zeroes
+	sparseBlockSize int64 = 4096
+)
+
+// CopySparse copies the whole disk to dst, such as a file backend, keeping it sparse: the holes of the disk,
+// which its backend reports if it can, as a file backend or an image format does, and the blocks of it that are
+// zeroes are not written to dst. Where dst can write zeroes without storing them, as a file backend can by
+// punching a hole, it does so for them; otherwise dst must already read as zeroes, as a new file does. A dst
+// that is a regular file shorter than the disk is extended to its size.
+//
+// Returns the number of bytes of data written to dst, which does not count the holes.
+func (d *Disk) CopySparse(dst backend.Storage) (int64, error) {
+	writable, err := dst.Writable()
+	if err != nil {
+		return 0, fmt.Errorf("destination is not writable: %w", err)
+	}
+	if f, err := dst.Sys(); err == nil {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("could not get destination info: %w", err)
+		}
+		if info.Mode().IsRegular() && info.Size() < d.Size {
+			if err := f.Truncate(d.Size); err != nil {
+				return 0, fmt.Errorf("could not extend destination to %d bytes: %w", d.Size, err)
+			}
+		}
+	}
+	zeroWriter, _ := dst.(backend.ZeroWriter)
+	allocation, _ := d.Backend.(backend.AllocationReporter)
+
+	var (
+		written   int64
+		holeStart int64 = -1
+	)
+	// holes are made as late as possible, so that those next to each other are made at once
+	hole := func(off int64) {
+		if holeStart < 0 {
+			holeStart = off
+		}
+	}
+	data := func(b []byte, off int64) error {
+		if holeStart >= 0 && zeroWriter != nil {
+			if err := zeroWriter.WriteZeroes(holeStart, off-holeStart); err != nil {
+				return fmt.Errorf("could not write zeroes to destination at %d: %w", holeStart, err)
+			}
+		}
+		holeStart = -1
+		if _, err := writable.WriteAt(b, off); err != nil {
+			return fmt.Errorf("could not write destination at %d: %w", off, err)
+		}
+		written += int64(len(b))
+		return nil
+	}
+
+	buf := make([]byte, sparseChunkSize)
+	zeroes := make([]byte, sparseBlockSize)
+	for off := int64(0); off < d.Size; off += sparseChunkSize {
+		n := min(sparseChunkSize, d.Size-off)
+		if allocation != nil {
+			allocated, err := allocation.Allocated(off, n)
+			if err != nil {
+				return written, fmt.Errorf("could not get allocation of disk at %d: %w", off, err)
+			}
+			if !allocated {
+				hole(off)
+				continue
+			}
+		}
+		b := buf[:n]
+		if read, err := d.Backend.ReadAt(b, off); err != nil && (!errors.Is(err, io.EOF) || int64(read) != n) {
+			return written, fmt.Errorf("could not read disk at %d: %w", off, err)
+		}
+		// write the runs of the chunk between its blocks of zeroes
+		start := int64(-1)
+		for pos := int64(0); pos < n || start >= 0; pos += sparseBlockSize {
+			end := min(pos+sparseBlockSize, n)
+			if pos < n && !bytes.Equal(b[pos:end], zeroes[:end-pos]) {
+				if start < 0 {
+					start = pos
+				}
+				continue
+			}
+			if start >= 0 {
+				if err := data(b[start:min(pos, n)], off+start); err != nil {
+					return written, err
+				}
+				start = -1
+			}
+			if pos < n {
+				hole(off + pos)
+			}
+		}
+	}
+	if holeStart >= 0 && zeroWriter != nil {
+		if err := zeroWriter.WriteZeroes(holeStart, d.Size-holeStart); err != nil {
+			return written, fmt.Errorf("could not write zeroes to destination at %d: %w", holeStart, err)
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,69 @@
+package disk
+
+import (
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// PartitionSummary describes what is on a single partition, or on the whole disk if it has no partition table
+type PartitionSummary struct {
+	// Partition is the number of the partition, starting at 1, or 0 for the whole disk
+	Partition int
+	// Start is where the partition starts on the disk, in bytes
+	Start int64
+	// Size is the size of the partition in bytes
+	Size int64
+	// PartitionUUID is the identifier of the partition in the partition table, if it has one
+	PartitionUUID string
+	// HasFilesystem is whether a known filesystem was found. If not, none of the fields below are set.
+	HasFilesystem bool
+	// FSType is the type of the filesystem
+	FSType filesystem.Type
+	// Label is the label of the filesystem, with any padding removed
+	Label string
+	// UUID is the identifier of the filesystem, in the same form as blkid reports it, if it is a
+	// filesystem.UsageReporter, as all of those of this module are
+	UUID string
+	// Usage is the size of the filesystem and how much of it is free, if it is a filesystem.UsageReporter
+	Usage filesystem.Usage
+}
+
+// Summary describes the filesystem on each partition of the disk, much like `lsblk -f`. If the disk
+// has no partition table, it describes the filesystem on the whole disk instead. Partitions that are
+// empty slots in the table are skipped, while partitions without a known filesystem are included with
+// HasFilesystem false.
+func (d *Disk) Summary() []PartitionSummary {
+	if d.Table == nil {
+		return []PartitionSummary{d.summarize(0, 0, d.Size, "")}
+	}
+	var summaries []PartitionSummary
+	for i, p := range d.Table.GetPartitions() {
+		if p.GetSize() == 0 {
+			continue
+		}
+		summaries = append(summaries, d.summarize(i+1, p.GetStart(), p.GetSize(), p.UUID()))
+	}
+	return summaries
+}
+
+func (d *Disk) summarize(part int, start, size int64, partUUID string) PartitionSummary {
+	s := PartitionSummary{
+		Partition:     part,
+		Start:         start,
+		Size:          size,
+		PartitionUUID: partUUID,
+	}
+	fs, err := d.GetFilesystem(part)
+	if err != nil {
+		return s
+	}
+	s.HasFilesystem = true
+	s.FSType = fs.Type()
+	s.Label = strings.TrimSpace(fs.Label())
+	if u, ok := fs.(filesystem.UsageReporter); ok {
+		s.UUID = u.UUID()
+		s.Usage = u.Usage()
+	}
+	return s
+}
@@ -0,0 +1,21 @@
+// Package verity builds and checks dm-verity hash trees, with which the Linux kernel verifies every block of a
+// read-only partition against a single root hash as it reads it, as for verified boot.
+//
+// Format hashes the data, such as a partition of a disk or a filesystem image, and writes the hash tree, after a
+// superblock as veritysetup writes it, to a hash device, which may be another partition, a separate file, or the
+// same storage after the data. It returns the root hash, which is what the data is trusted by, usually by putting
+// it on the kernel command line or in a signed image:
+//
+//	tree, err := verity.Format(d.Backend, dataStart, dataSize, hash, 0, &verity.Params{})
+//	...
+//	fmt.Printf("roothash=%x\n", tree.RootHash)
+//
+// HashDeviceSize tells how large the hash device must be, so that a partition can be made for it first. Verify
+// checks existing data and hash tree against a root hash, and tells which block does not match. The trees are the
+// same as those of veritysetup format, with either hash type, and the hashes SHA-1, SHA-256 or SHA-512.
+//
+// references:
+//
+//	https://docs.kernel.org/admin-guide/device-mapper/verity.html
+//	https://gitlab.com/cryptsetup/cryptsetup/-/wikis/DMVerity
+package verity
@@ -0,0 +1,80 @@
+package verity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+const (
+	superblockSignature = "verity\x00\x00"
+	// superblockSize the size of the superblock, which the hash tree follows at the next hash block
+	superblockSize    = 512
+	superblockVersion = 1
+	maxAlgorithmName  = 32
+	maxSaltSize       = 256
+)
+
+// ErrNoSuperblock is returned by ReadSuperblock when there is no verity superblock at the offset
+var ErrNoSuperblock = errors.New("no verity superblock")
+
+// superblockBytes the superblock of a hash tree with the parameters p, which have their defaults filled in
+func superblockBytes(p *Params) ([]byte, error) {
+	id, err := uuid.Parse(p.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UUID %s: %w", p.UUID, err)
+	}
+	b := make([]byte, superblockSize)
+	copy(b[0:8], superblockSignature)
+	binary.LittleEndian.PutUint32(b[8:12], superblockVersion)
+	binary.LittleEndian.PutUint32(b[12:16], p.hashType())
+	copy(b[16:32], id[:])
+	copy(b[32:64], p.Algorithm)
+	binary.LittleEndian.PutUint32(b[64:68], p.DataBlockSize)
+	binary.LittleEndian.PutUint32(b[68:72], p.HashBlockSize)
+	binary.LittleEndian.PutUint64(b[72:80], p.DataBlocks)
+	binary.LittleEndian.PutUint16(b[80:82], uint16(len(p.Salt)))
+	copy(b[88:88+maxSaltSize], p.Salt)
+	return b, nil
+}
+
+// ReadSuperblock read the parameters of a hash tree from the superblock at offset in hash, where Format writes it
+// unless told not to. It returns ErrNoSuperblock if there is none.
+func ReadSuperblock(hash io.ReaderAt, offset int64) (*Params, error) {
+	b := make([]byte, superblockSize)
+	if n, err := hash.ReadAt(b, offset); err != nil && n != len(b) {
+		return nil, fmt.Errorf("could not read verity superblock at %d: %w", offset, err)
+	}
+	if string(b[0:8]) != superblockSignature {
+		return nil, ErrNoSuperblock
+	}
+	if version := binary.LittleEndian.Uint32(b[8:12]); version != superblockVersion {
+		return nil, fmt.Errorf("unsupported verity superblock version %d", version)
+	}
+	hashType := binary.LittleEndian.Uint32(b[12:16])
+	if hashType > 1 {
+		return nil, fmt.Errorf("unsupported verity hash type %d", hashType)
+	}
+	saltSize := binary.LittleEndian.Uint16(b[80:82])
+	if saltSize > maxSaltSize {
+		return nil, fmt.Errorf("invalid salt size %d in verity superblock", saltSize)
+	}
+	id, err := uuid.FromBytes(b[16:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid UUID in verity superblock: %w", err)
+	}
+	algorithm, _, _ := bytes.Cut(b[32:64], []byte{0})
+	return &Params{
+		DataBlockSize:  binary.LittleEndian.Uint32(b[64:68]),
+		HashBlockSize:  binary.LittleEndian.Uint32(b[68:72]),
+		DataBlocks:     binary.LittleEndian.Uint64(b[72:80]),
+		Algorithm:      string(algorithm),
+		Salt:           bytes.Clone(b[88 : 88+int(saltSize)]),
+		OriginalFormat: hashType == 0,
+		UUID:           id.String(),
+	}, nil
+}
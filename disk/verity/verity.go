@@ -0,0 +1,413 @@
+package verity
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBlockSize = 4096
+	defaultAlgorithm = "sha256"
+	// defaultSaltSize the size of the random salt that Format makes, as veritysetup does
+	defaultSaltSize = 32
+	minBlockSize    = 512
+	maxBlockSize    = 1024 * 1024
+	// maxLevels the most levels a hash tree may have, as for the kernel
+	maxLevels = 63
+	// chunkSize how much of the data or of a level of the tree is read, and how much of the level above it
+	// written, at once
+	chunkSize = 1024 * 1024
+)
+
+// ErrCorrupt is returned by Verify when the data or the hash tree does not match the root hash
+var ErrCorrupt = errors.New("does not match the verity hash tree")
+
+// Params the parameters of a hash tree. The zero value is the default of veritysetup, but for the salt, which
+// Format makes at random.
+type Params struct {
+	// DataBlockSize and HashBlockSize the sizes of the blocks of the data and of the hash tree, 4096 if 0
+	DataBlockSize uint32
+	HashBlockSize uint32
+	// DataBlocks how many blocks of the data are hashed, or, if 0, as many as fit in its size
+	DataBlocks uint64
+	// Algorithm the hash: sha1, sha256 or sha512, sha256 if empty
+	Algorithm string
+	// Salt that is hashed with each block. If it is nil, Format makes a random one of 32 bytes; an empty one is
+	// no salt. It may be at most 256 bytes.
+	Salt []byte
+	// OriginalFormat use hash type 0, the original format of Chrome OS, in which the salt follows each block
+	// instead of coming before it, and the hashes are not padded to a power of two
+	OriginalFormat bool
+	// NoSuperblock do not write a superblock before the hash tree, so that it starts at the hash offset, as with
+	// veritysetup --no-superblock
+	NoSuperblock bool
+	// UUID of the superblock, random if empty
+	UUID string
+}
+
+// Tree a hash tree that Format wrote
+type Tree struct {
+	// Params those the tree was made with, with the defaults, salt, UUID and number of data blocks filled in
+	Params Params
+	// RootHash the hash of the top block of the tree, which the data is verified with
+	RootHash []byte
+	// HashStartBlock where the tree starts on the hash device, in hash blocks, as the dm-verity table needs it
+	HashStartBlock uint64
+	// HashSize the bytes from the hash offset that the superblock and the tree take
+	HashSize int64
+}
+
+// layout where the levels of a hash tree are, and how its blocks are hashed
+type layout struct {
+	p       Params
+	newHash func() hash.Hash
+	// digestSize the size of each hash in the tree, with its padding
+	digestSize int
+	perBlock   uint64
+	// start where the tree starts on the hash device, in bytes
+	start int64
+	// levels from the one with the hashes of the data blocks up; the top one is first on the hash device
+	levels []level
+}
+
+// level a level of the hash tree, at offset on the hash device
+type level struct {
+	offset int64
+	blocks uint64
+}
+
+// withDefaults a copy of p with the zero values replaced by the defaults, and the data blocks set from size if
+// they are not
+func (p *Params) withDefaults(size int64) (Params, error) {
+	q := *p
+	if q.DataBlockSize == 0 {
+		q.DataBlockSize = defaultBlockSize
+	}
+	if q.HashBlockSize == 0 {
+		q.HashBlockSize = defaultBlockSize
+	}
+	if q.Algorithm == "" {
+		q.Algorithm = defaultAlgorithm
+	}
+	for _, blockSize := range []uint32{q.DataBlockSize, q.HashBlockSize} {
+		if blockSize < minBlockSize || blockSize > maxBlockSize || blockSize&(blockSize-1) != 0 {
+			return q, fmt.Errorf("invalid block size %d, must be a power of 2 from %d to %d", blockSize, minBlockSize, maxBlockSize)
+		}
+	}
+	if len(q.Salt) > maxSaltSize {
+		return q, fmt.Errorf("salt of %d bytes is longer than the maximum of %d", len(q.Salt), maxSaltSize)
+	}
+	if len(q.Algorithm) >= maxAlgorithmName {
+		return q, fmt.Errorf("invalid hash algorithm %s", q.Algorithm)
+	}
+	available := uint64(size) / uint64(q.DataBlockSize)
+	switch {
+	case size < 0:
+		return q, fmt.Errorf("invalid data size %d", size)
+	case q.DataBlocks == 0:
+		q.DataBlocks = available
+	case q.DataBlocks > available:
+		return q, fmt.Errorf("%d data blocks of %d bytes do not fit in %d bytes", q.DataBlocks, q.DataBlockSize, size)
+	}
+	if q.DataBlocks == 0 {
+		return q, fmt.Errorf("data of %d bytes is smaller than a block of %d", size, q.DataBlockSize)
+	}
+	return q, nil
+}
+
+// hashType the hash type of the format, as in the superblock and the dm-verity table
+func (p *Params) hashType() uint32 {
+	if p.OriginalFormat {
+		return 0
+	}
+	return 1
+}
+
+// newLayout the layout of the tree with the parameters p, which have their defaults filled in, for a hash device
+// where the tree, or its superblock, is at hashOffset. The levels are worked out as by veritysetup.
+func newLayout(p Params, hashOffset int64) (*layout, error) {
+	var newHash func() hash.Hash
+	switch p.Algorithm {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %s", p.Algorithm)
+	}
+	l := &layout{p: p, newHash: newHash, digestSize: newHash().Size()}
+	if !p.OriginalFormat {
+		l.digestSize = 1 << bits.Len(uint(l.digestSize-1))
+	}
+	perBlockBits := bits.Len(uint(p.HashBlockSize)/uint(l.digestSize)) - 1
+	if perBlockBits < 1 {
+		return nil, fmt.Errorf("hash block size %d is too small for %s", p.HashBlockSize, p.Algorithm)
+	}
+	l.perBlock = 1 << perBlockBits
+
+	hashBlockSize := int64(p.HashBlockSize)
+	switch {
+	case hashOffset < 0:
+		return nil, fmt.Errorf("invalid hash offset %d", hashOffset)
+	case p.NoSuperblock && hashOffset%hashBlockSize != 0:
+		return nil, fmt.Errorf("hash offset %d is not a multiple of the hash block size %d", hashOffset, hashBlockSize)
+	case p.NoSuperblock:
+		l.start = hashOffset
+	default:
+		l.start = (hashOffset + superblockSize + hashBlockSize - 1) / hashBlockSize * hashBlockSize
+	}
+
+	var levels int
+	for perBlockBits*levels < 64 && (p.DataBlocks-1)>>(perBlockBits*levels) != 0 {
+		levels++
+	}
+	if levels > maxLevels {
+		return nil, fmt.Errorf("hash tree of %d levels is too deep", levels)
+	}
+	l.levels = make([]level, levels)
+	offset := l.start
+	for i := levels - 1; i >= 0; i-- {
+		shift := uint(perBlockBits * (i + 1))
+		blocks := uint64(1)
+		if shift < 64 {
+			blocks = (p.DataBlocks-1)>>shift + 1
+		}
+		l.levels[i] = level{offset: offset, blocks: blocks}
+		offset += int64(blocks) * hashBlockSize
+	}
+	return l, nil
+}
+
+// end where the tree ends on the hash device, in bytes
+func (l *layout) end() int64 {
+	if len(l.levels) == 0 {
+		return l.start
+	}
+	last := l.levels[0]
+	return last.offset + int64(last.blocks)*int64(l.p.HashBlockSize)
+}
+
+// hash the hash of a block, with the salt
+func (l *layout) hash(h hash.Hash, block []byte) []byte {
+	h.Reset()
+	if l.p.OriginalFormat {
+		h.Write(block)
+		h.Write(l.p.Salt)
+	} else {
+		h.Write(l.p.Salt)
+		h.Write(block)
+	}
+	return h.Sum(nil)
+}
+
+// HashDeviceSize the size that a hash device needs, from hashOffset, for the hash tree of size bytes of data with
+// the parameters p, including the superblock unless p.NoSuperblock
+func HashDeviceSize(size, hashOffset int64, p *Params) (int64, error) {
+	if p == nil {
+		p = &Params{}
+	}
+	q, err := p.withDefaults(size)
+	if err != nil {
+		return 0, err
+	}
+	l, err := newLayout(q, hashOffset)
+	if err != nil {
+		return 0, err
+	}
+	return l.end() - hashOffset, nil
+}
+
+// Format compute the hash tree of size bytes of data, starting at start in data, with the parameters p, and write
+// it to hash at hashOffset, after a superblock unless p.NoSuperblock. Returns the tree, with its root hash.
+//
+// hash may be the same storage as data, if the tree is put after it.
+func Format(data backend.File, start, size int64, hash backend.WritableFile, hashOffset int64, p *Params) (*Tree, error) {
+	if p == nil {
+		p = &Params{}
+	}
+	q, err := p.withDefaults(size)
+	if err != nil {
+		return nil, err
+	}
+	if q.Salt == nil {
+		q.Salt = make([]byte, defaultSaltSize)
+		if _, err := rand.Read(q.Salt); err != nil {
+			return nil, fmt.Errorf("could not make salt: %w", err)
+		}
+	}
+	if q.UUID == "" {
+		q.UUID = uuid.NewString()
+	}
+	l, err := newLayout(q, hashOffset)
+	if err != nil {
+		return nil, err
+	}
+	if !q.NoSuperblock {
+		sb, err := superblockBytes(&q)
+		if err != nil {
+			return nil, err
+		}
+		// the rest of the block is zeros, so that nothing that was there is taken for part of the superblock
+		b := make([]byte, l.start-hashOffset)
+		copy(b, sb)
+		if _, err := hash.WriteAt(b, hashOffset); err != nil {
+			return nil, fmt.Errorf("could not write verity superblock: %w", err)
+		}
+	}
+	rootHash, err := l.build(data, start, hash, hash)
+	if err != nil {
+		return nil, err
+	}
+	return &Tree{
+		Params:         q,
+		RootHash:       rootHash,
+		HashStartBlock: uint64(l.start / int64(q.HashBlockSize)),
+		HashSize:       l.end() - hashOffset,
+	}, nil
+}
+
+// Verify check size bytes of data, starting at start in data, and the hash tree at hashOffset in hash against
+// rootHash. If p is nil, the parameters are read from the superblock at hashOffset; otherwise, they must be
+// those the tree was made with. Returns an error wrapping ErrCorrupt if a block does not match its hash, which
+// tells the first one that does not.
+func Verify(data backend.File, start, size int64, hash backend.File, hashOffset int64, rootHash []byte, p *Params) error {
+	if p == nil {
+		var err error
+		if p, err = ReadSuperblock(hash, hashOffset); err != nil {
+			return err
+		}
+	}
+	q, err := p.withDefaults(size)
+	if err != nil {
+		return err
+	}
+	l, err := newLayout(q, hashOffset)
+	if err != nil {
+		return err
+	}
+	actual, err := l.build(data, start, hash, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(actual, rootHash) {
+		return fmt.Errorf("root hash %x: %w", actual, ErrCorrupt)
+	}
+	return nil
+}
+
+// build hash each level of the tree from the level below it, the lowest from the data, and write it to w, or, if
+// w is nil, compare it with that already in hash. Returns the root hash.
+func (l *layout) build(data io.ReaderAt, start int64, hash io.ReaderAt, w io.WriterAt) ([]byte, error) {
+	h := l.newHash()
+	if len(l.levels) == 0 {
+		// a single data block is its own root
+		b := make([]byte, l.p.DataBlockSize)
+		if n, err := data.ReadAt(b, start); err != nil && n != len(b) {
+			return nil, fmt.Errorf("could not read data block 0: %w", err)
+		}
+		return l.hash(h, b), nil
+	}
+	for i, lvl := range l.levels {
+		var err error
+		if i == 0 {
+			err = l.hashLevel(h, data, start, int64(l.p.DataBlockSize), l.p.DataBlocks, hash, w, lvl, i)
+		} else {
+			below := l.levels[i-1]
+			err = l.hashLevel(h, hash, below.offset, int64(l.p.HashBlockSize), below.blocks, hash, w, lvl, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	top := make([]byte, l.p.HashBlockSize)
+	if n, err := hash.ReadAt(top, l.levels[len(l.levels)-1].offset); err != nil && n != len(top) {
+		return nil, fmt.Errorf("could not read top block of hash tree: %w", err)
+	}
+	return l.hash(h, top), nil
+}
+
+// hashLevel hash the blocks blocks of blockSize at offset in src, and write their hashes as the level dst of the
+// tree, the index-th from the bottom, to w, or, if w is nil, compare them with those already in hash
+func (l *layout) hashLevel(h hash.Hash, src io.ReaderAt, offset, blockSize int64, blocks uint64, hash io.ReaderAt, w io.WriterAt, dst level, index int) error {
+	var (
+		hashBlockSize = int64(l.p.HashBlockSize)
+		perChunk      = uint64(max(chunkSize/blockSize, 1))
+		in            = make([]byte, int64(perChunk)*blockSize)
+		out           []byte
+		// written how many blocks of the level were written or compared before those in out
+		written uint64
+	)
+	for block := uint64(0); block < blocks; {
+		n := min(blocks-block, perChunk)
+		b := in[:int64(n)*blockSize]
+		if read, err := src.ReadAt(b, offset+int64(block)*blockSize); err != nil && read != len(b) {
+			if index == 0 {
+				return fmt.Errorf("could not read data blocks %d to %d: %w", block, block+n-1, err)
+			}
+			return fmt.Errorf("could not read level %d of hash tree: %w", index-1, err)
+		}
+		for i := range n {
+			entry := (block + i) % l.perBlock
+			if entry == 0 {
+				out = append(out, make([]byte, hashBlockSize)...)
+			}
+			pos := int64(len(out)) - hashBlockSize + int64(entry)*int64(l.digestSize)
+			copy(out[pos:], l.hash(h, b[int64(i)*blockSize:int64(i+1)*blockSize]))
+		}
+		block += n
+		if (len(out) < chunkSize || block%l.perBlock != 0) && block < blocks {
+			continue
+		}
+		if err := l.flushLevel(out, hash, w, dst, written, index); err != nil {
+			return err
+		}
+		written += uint64(int64(len(out)) / hashBlockSize)
+		out = out[:0]
+	}
+	return nil
+}
+
+// flushLevel write the blocks of a level in out, which are after the first written ones of it, to w, or, if w is
+// nil, compare them with those in hash
+func (l *layout) flushLevel(out []byte, hash io.ReaderAt, w io.WriterAt, dst level, written uint64, index int) error {
+	hashBlockSize := int64(l.p.HashBlockSize)
+	pos := dst.offset + int64(written)*hashBlockSize
+	if w != nil {
+		if _, err := w.WriteAt(out, pos); err != nil {
+			return fmt.Errorf("could not write level %d of hash tree: %w", index, err)
+		}
+		return nil
+	}
+	stored := make([]byte, len(out))
+	if n, err := hash.ReadAt(stored, pos); err != nil && n != len(stored) {
+		return fmt.Errorf("could not read level %d of hash tree: %w", index, err)
+	}
+	for i := range out {
+		if out[i] == stored[i] {
+			continue
+		}
+		block := written + uint64(int64(i)/hashBlockSize)
+		entry := int64(i) % hashBlockSize / int64(l.digestSize)
+		if uint64(entry) >= l.perBlock {
+			return fmt.Errorf("padding of block %d of level %d of hash tree: %w", block, index, ErrCorrupt)
+		}
+		if index == 0 {
+			return fmt.Errorf("data block %d: %w", block*l.perBlock+uint64(entry), ErrCorrupt)
+		}
+		return fmt.Errorf("block %d of level %d of hash tree: %w", block*l.perBlock+uint64(entry), index-1, ErrCorrupt)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package verity_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/disk/verity"
+)
+
+const testUUID = "6d0b2fc9-0c2f-4bb9-9d4e-7c1b6c3a9e5f"
+
+var testSalt = []byte{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+}
+
+// testData data whose blocks all differ
+func testData(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i*7 + i/4096)
+	}
+	return b
+}
+
+func testBuffer(t *testing.T, b []byte) *mem.Buffer {
+	t.Helper()
+	buf, err := mem.NewFromBytes(b, false)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	return buf
+}
+
+func TestFormatVerify(t *testing.T) {
+	// the root hashes and the SHA-256 of the hash devices, from the hash offset, as veritysetup makes them
+	tests := []struct {
+		name       string
+		size       int
+		hashOffset int64
+		params     verity.Params
+		rootHash   string
+		hashSize   int64
+		hashSum    string
+		startBlock uint64
+	}{
+		{"sha256 two levels", 1000 * 4096, 0, verity.Params{Salt: testSalt, UUID: testUUID},
+			"32a0c3453d350ec4b69947af615782454df89bebb4265647f84fdc2111aed3f1", 40960,
+			"712be91b6c67d0abcc322c9f22cb2421dbc3c236dc82be484b634e3d22e62d93", 1},
+		{"original format without superblock", 300 * 1024, 0,
+			verity.Params{DataBlockSize: 1024, HashBlockSize: 512, Algorithm: "sha1", Salt: []byte("abc"), OriginalFormat: true, NoSuperblock: true},
+			"f2ad441560e6a04395f8162014de182aa36c5527", 11264,
+			"7616533135833f05c65eef383cc903e72b50c0e07f4a6ddb06b167b6ac1dfe25", 0},
+		{"single block without salt", 4096, 0, verity.Params{Salt: []byte{}, UUID: testUUID},
+			"d010f6d76d0eb4dce5d5b5b34014a8a157ec4380a66c24d7d455a9bf652db14a", 4096,
+			"7adf504c0a7ca4b50b97811bf89a6f07088691b9dc79025669fbd83035d5ff6a", 1},
+		{"sha512 at an offset", 20000 * 4096, 1000, verity.Params{Algorithm: "sha512", Salt: testSalt, UUID: testUUID},
+			"a68ec51dff83a2aa49cf521bb22c28ce71af60dea2944f5d519358134886f4968f0c8a9f5e93183c328ed4b4ad62b5dca07495d4de302efff3b22175031cc6cf", 1309720,
+			"c00dbf9f017df5832e39bb9792e1498f3e50e2cd4eec508de3279d506375aac0", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testBuffer(t, testData(tt.size))
+			size, err := verity.HashDeviceSize(int64(tt.size), tt.hashOffset, &tt.params)
+			if err != nil {
+				t.Fatalf("unable to get hash device size: %v", err)
+			}
+			if size != tt.hashSize {
+				t.Errorf("hash device size %d instead of %d", size, tt.hashSize)
+			}
+			hash, err := mem.New(tt.hashOffset + size)
+			if err != nil {
+				t.Fatalf("unable to create hash device: %v", err)
+			}
+			tree, err := verity.Format(data, 0, int64(tt.size), hash, tt.hashOffset, &tt.params)
+			if err != nil {
+				t.Fatalf("unable to format: %v", err)
+			}
+			if hex.EncodeToString(tree.RootHash) != tt.rootHash {
+				t.Errorf("root hash %x instead of %s", tree.RootHash, tt.rootHash)
+			}
+			if tree.HashSize != tt.hashSize || tree.HashStartBlock != tt.startBlock {
+				t.Errorf("hash size %d and start block %d instead of %d and %d", tree.HashSize, tree.HashStartBlock, tt.hashSize, tt.startBlock)
+			}
+			if sum := sha256.Sum256(hash.Bytes()[tt.hashOffset:]); hex.EncodeToString(sum[:]) != tt.hashSum {
+				t.Errorf("hash device does not match, SHA-256 %x instead of %s", sum, tt.hashSum)
+			}
+
+			params := &tt.params
+			if !tt.params.NoSuperblock {
+				sb, err := verity.ReadSuperblock(hash, tt.hashOffset)
+				if err != nil {
+					t.Fatalf("unable to read superblock: %v", err)
+				}
+				if sb.UUID != testUUID || !bytes.Equal(sb.Salt, tt.params.Salt) || sb.DataBlocks != tree.Params.DataBlocks || sb.Algorithm != tree.Params.Algorithm {
+					t.Errorf("superblock has parameters %+v instead of %+v", sb, tree.Params)
+				}
+				params = nil
+			}
+			if err := verity.Verify(data, 0, int64(tt.size), hash, tt.hashOffset, tree.RootHash, params); err != nil {
+				t.Errorf("unable to verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	const (
+		blocks    = 1000
+		blockSize = 4096
+	)
+	// the hash tree after the data on the same storage, as with a single partition for both
+	size := int64(blocks * blockSize)
+	hashSize, err := verity.HashDeviceSize(size, size, nil)
+	if err != nil {
+		t.Fatalf("unable to get hash device size: %v", err)
+	}
+	b := append(testData(int(size)), make([]byte, hashSize)...)
+	storage := testBuffer(t, b)
+	tree, err := verity.Format(storage, 0, size, storage, size, nil)
+	if err != nil {
+		t.Fatalf("unable to format: %v", err)
+	}
+	if len(tree.Params.Salt) != 32 || tree.Params.UUID == "" {
+		t.Errorf("expected random salt and UUID, got %x and %q", tree.Params.Salt, tree.Params.UUID)
+	}
+	if err := verity.Verify(storage, 0, size, storage, size, tree.RootHash, nil); err != nil {
+		t.Fatalf("unable to verify: %v", err)
+	}
+	image := storage.Bytes()
+
+	tests := []struct {
+		name   string
+		offset int64
+		root   []byte
+		msg    string
+	}{
+		{"data block", 517*blockSize + 100, tree.RootHash, "data block 517"},
+		{"hash of data block", size + 6*blockSize + 5*32, tree.RootHash, "data block 517"},
+		{"top of tree", size + blockSize + 2, tree.RootHash, "level 0 of hash tree"},
+		{"root hash", -1, make([]byte, 32), "root hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := bytes.Clone(image)
+			if tt.offset >= 0 {
+				corrupt[tt.offset] ^= 0xff
+			}
+			s := testBuffer(t, corrupt)
+			err := verity.Verify(s, 0, size, s, size, tt.root, nil)
+			if !errors.Is(err, verity.ErrCorrupt) || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("expected error about %s wrapping ErrCorrupt, got %v", tt.msg, err)
+			}
+		})
+	}
+
+	if _, err := verity.ReadSuperblock(storage, 0); !errors.Is(err, verity.ErrNoSuperblock) {
+		t.Errorf("expected ErrNoSuperblock reading data, got %v", err)
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/qcow2"
+	"github.com/diskfs/go-diskfs/disk/formats/vhdx"
+	"github.com/diskfs/go-diskfs/disk/formats/vmdk"
 )
 
 // when we use a disk image with a GPT, we cannot get the logical sector size from the disk via the kernel
@@ -172,14 +175,19 @@ func checkDevice(device string) error {
 }
 
 type openOpts struct {
-	mode       OpenModeOption
-	sectorSize SectorSize
+	mode         OpenModeOption
+	sectorSize   SectorSize
+	format       Format
+	writeZeroes  bool
+	backingFiles bool
+	openOnly     string // the last option given that only applies to Open, which Create rejects
 }
 
 func openOptsDefaults() *openOpts {
 	return &openOpts{
 		mode:       ReadWriteExclusive,
 		sectorSize: SectorSizeDefault,
+		format:     formatDetect,
 	}
 }
 
@@ -191,6 +199,7 @@ type OpenOpt func(o *openOpts) error
 func WithOpenMode(mode OpenModeOption) OpenOpt {
 	return func(o *openOpts) error {
 		o.mode = mode
+		o.openOnly = "WithOpenMode"
 		return nil
 	}
 }
@@ -200,15 +209,47 @@ func WithOpenMode(mode OpenModeOption) OpenOpt {
 func WithSectorSize(sectorSize SectorSize) OpenOpt {
 	return func(o *openOpts) error {
 		o.sectorSize = sectorSize
+		o.openOnly = "WithSectorSize"
 		return nil
 	}
 }
 
+// WithWriteZeroes makes writes of blocks that are all zeroes to a raw image file punch holes in it rather than
+// write the zeroes out, so that the image stays sparse, see file.WithWriteZeroes. For Create, it only applies to
+// FormatRaw; for Open, it applies to the file that holds the image, whatever its format.
+func WithWriteZeroes(enable bool) OpenOpt {
+	return func(o *openOpts) error {
+		o.writeZeroes = enable
+		return nil
+	}
+}
+
+// WithBackingFiles opens the backing files of a qcow2 image alongside it, see qcow2.WithBackingFiles. Their names
+// come from the image, so this is only honored together with WithFormat(FormatQCOW2), and never for a format
+// that was detected. Without it, a qcow2 image that has a backing file cannot be opened.
+func WithBackingFiles(enable bool) OpenOpt {
+	return func(o *openOpts) error {
+		o.backingFiles = enable
+		o.openOnly = "WithBackingFiles"
+		return nil
+	}
+}
+
+// fileOptions the options of the file backend for the disk
+func (o *openOpts) fileOptions() []file.Option {
+	if o.writeZeroes {
+		return []file.Option{file.WithWriteZeroes(0)}
+	}
+	return nil
+}
+
 // Might be deprecated in future: use <backend>.New + diskfs.OpenBackend
 // Open a Disk from a path to a device in read-write exclusive mode
 // Should pass a path to a block device e.g. /dev/sda or a path to a file /tmp/foo.img
 // The provided device must exist at the time you call Open().
 // Use OpenOpt to control options, such as sector size or open mode.
+// The format of the image, such as VMDK or VHDX, is detected from its contents, see DetectFormat,
+// unless it is set with WithFormat. A block device is not detected, and is always opened as FormatRaw.
 func Open(device string, opts ...OpenOpt) (*disk.Disk, error) {
 	err := checkDevice(device)
 	if err != nil {
@@ -232,16 +273,25 @@ func Open(device string, opts ...OpenOpt) (*disk.Disk, error) {
 		return nil, fmt.Errorf("could not open device %s with mode %v: %w", device, m, err)
 	}
 
+	b, err := openFormat(file.New(f, !writableMode(opt.mode), opt.fileOptions()...), opt)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("could not open image %s: %w", device, err)
+	}
+
 	// return our disk
-	return initDisk(file.New(f, !writableMode(opt.mode)), opt.sectorSize)
+	return initDisk(b, opt.sectorSize)
 }
 
 // Open a Disk using provided fs.File to a device in read-only mode
 // Use OpenOpt to control options, such as sector size or open mode.
+// As with Open, the format of the image is detected from its contents, unless it is set with WithFormat or b
+// is a block device.
 func OpenBackend(b backend.Storage, opts ...OpenOpt) (*disk.Disk, error) {
 	opt := &openOpts{
 		mode:       ReadOnly,
 		sectorSize: SectorSizeDefault,
+		format:     formatDetect,
 	}
 
 	for _, o := range opts {
@@ -250,18 +300,100 @@ func OpenBackend(b backend.Storage, opts ...OpenOpt) (*disk.Disk, error) {
 		}
 	}
 
+	b, err := openFormat(b, opt)
+	if err != nil {
+		return nil, err
+	}
 	return initDisk(b, opt.sectorSize)
 }
 
+// Format represents the format of a disk image
+type Format int
+
+const (
+	// FormatRaw a raw image, in which the file is the disk, byte for byte
+	FormatRaw Format = iota
+	// FormatVMDK a monolithic sparse VMDK image, see disk/formats/vmdk
+	FormatVMDK
+	// FormatVMDKStreamOptimized a streamOptimized VMDK image, as used by OVA/OVF appliances, see disk/formats/vmdk.
+	// The image is only written out when the disk is closed.
+	FormatVMDKStreamOptimized
+	// FormatVHDX a dynamic VHDX image, see disk/formats/vhdx
+	FormatVHDX
+	// FormatQCOW2 a qcow2 image, as used by QEMU, see disk/formats/qcow2
+	FormatQCOW2
+)
+
+// Format.String()
+func (f Format) String() string {
+	switch f {
+	case FormatRaw:
+		return "raw"
+	case FormatVMDK:
+		return "vmdk"
+	case FormatVMDKStreamOptimized:
+		return "vmdk-streamOptimized"
+	case FormatVHDX:
+		return "vhdx"
+	case FormatQCOW2:
+		return "qcow2"
+	default:
+		return "unknown"
+	}
+}
+
+// CreateOpt func that process Create options. It is the same as OpenOpt, so that WithFormat and WithWriteZeroes
+// work with both; Create returns an error for WithOpenMode, WithSectorSize and WithBackingFiles, which only
+// apply to Open.
+type CreateOpt = OpenOpt
+
+// WithFormat sets the format of the disk image. For Create, the default is FormatRaw. For Open and OpenBackend,
+// the default is to detect the format from the contents of the image; WithFormat overrides that, e.g. to open
+// an image that is not to be translated as the raw disk it is.
+func WithFormat(format Format) OpenOpt {
+	return func(o *openOpts) error {
+		o.format = format
+		return nil
+	}
+}
+
 // Might be deprecated in future: use <backend>.CreateFromPath + diskfs.OpenBackend
 // Create a Disk from a path to a device
 // Should pass a path to a block device e.g. /dev/sda or a path to a file /tmp/foo.img
 // The provided device must not exist at the time you call Create()
-func Create(device string, size int64, sectorSize SectorSize) (*disk.Disk, error) {
-	rawBackend, err := file.CreateFromPath(device, size)
+// Use CreateOpt to control options, such as the image format.
+func Create(device string, size int64, sectorSize SectorSize, opts ...CreateOpt) (*disk.Disk, error) {
+	opt := &openOpts{format: FormatRaw}
+	for _, o := range opts {
+		if err := o(opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.openOnly != "" {
+		return nil, fmt.Errorf("option %s does not apply to Create", opt.openOnly)
+	}
+
+	var (
+		b   backend.Storage
+		err error
+	)
+	switch opt.format {
+	case FormatRaw:
+		b, err = file.CreateFromPath(device, size, opt.fileOptions()...)
+	case FormatVMDK:
+		b, err = vmdk.CreateFromPath(device, size, &vmdk.CreateOptions{Subformat: vmdk.MonolithicSparse})
+	case FormatVMDKStreamOptimized:
+		b, err = vmdk.CreateFromPath(device, size, &vmdk.CreateOptions{Subformat: vmdk.StreamOptimized})
+	case FormatVHDX:
+		b, err = vhdx.CreateFromPath(device, size, nil)
+	case FormatQCOW2:
+		b, err = qcow2.CreateFromPath(device, size, nil)
+	default:
+		return nil, fmt.Errorf("unsupported image format %v", opt.format)
+	}
 	if err != nil {
 		return nil, err
 	}
 	// return our disk
-	return initDisk(rawBackend, sectorSize)
+	return initDisk(b, sectorSize)
 }
@@ -0,0 +1,21 @@
+//go:build freebsd || netbsd || openbsd
+
+package diskfs
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ioctlPtr issue an ioctl on f that fills in whatever arg points to, as the size of what
+// the BSD disk ioctls return varies, and golang.org/x/sys/unix only reads back ints.
+//
+// SYS_IOCTL through unix.Syscall is still supported on OpenBSD, which routes it through libc.
+func ioctlPtr(f *os.File, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
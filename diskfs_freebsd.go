@@ -0,0 +1,41 @@
+package diskfs
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// getBlockDeviceSize get the size of an opened block device in Bytes.
+func getBlockDeviceSize(f *os.File) (int64, error) {
+	var mediaSize int64
+	if err := ioctlPtr(f, unix.DIOCGMEDIASIZE, unsafe.Pointer(&mediaSize)); err != nil {
+		return 0, fmt.Errorf("unable to get block device size: %v", err)
+	}
+	return mediaSize, nil
+}
+
+// getSectorSizes get the logical and physical sector sizes for a block device
+//
+// FreeBSD has no separate physical sector size, but reports it as the stripe size, as diskinfo(8) does,
+// e.g. for drives with 4K physical sectors that emulate 512 byte logical sectors.
+func getSectorSizes(f *os.File) (logicalSectorSize, physicalSectorSize int64, err error) {
+	var (
+		sectorSize uint32
+		stripeSize int64
+	)
+	if err := ioctlPtr(f, unix.DIOCGSECTORSIZE, unsafe.Pointer(&sectorSize)); err != nil {
+		return 0, 0, fmt.Errorf("unable to get device logical sector size: %v", err)
+	}
+	if err := ioctlPtr(f, unix.DIOCGSTRIPESIZE, unsafe.Pointer(&stripeSize)); err != nil {
+		return 0, 0, fmt.Errorf("unable to get device physical sector size: %v", err)
+	}
+	logicalSectorSize = int64(sectorSize)
+	physicalSectorSize = logicalSectorSize
+	if stripeSize > logicalSectorSize && stripeSize%logicalSectorSize == 0 {
+		physicalSectorSize = stripeSize
+	}
+	return logicalSectorSize, physicalSectorSize, nil
+}
@@ -0,0 +1,33 @@
+package diskfs
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// this constants should be part of "golang.org/x/sys/unix", but aren't, yet
+const (
+	DIOCGMEDIASIZE  = 0x40086484 // _IOR('d', 132, off_t)
+	DIOCGSECTORSIZE = 0x40046485 // _IOR('d', 133, u_int)
+)
+
+// getBlockDeviceSize get the size of an opened block device in Bytes.
+func getBlockDeviceSize(f *os.File) (int64, error) {
+	var mediaSize int64
+	if err := ioctlPtr(f, DIOCGMEDIASIZE, unsafe.Pointer(&mediaSize)); err != nil {
+		return 0, fmt.Errorf("unable to get block device size: %v", err)
+	}
+	return mediaSize, nil
+}
+
+// getSectorSizes get the logical and physical sector sizes for a block device
+//
+// NetBSD does not report a separate physical sector size, so both are the same.
+func getSectorSizes(f *os.File) (logicalSectorSize, physicalSectorSize int64, err error) {
+	var sectorSize uint32
+	if err := ioctlPtr(f, DIOCGSECTORSIZE, unsafe.Pointer(&sectorSize)); err != nil {
+		return 0, 0, fmt.Errorf("unable to get device logical sector size: %v", err)
+	}
+	return int64(sectorSize), int64(sectorSize), nil
+}
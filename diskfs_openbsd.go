@@ -0,0 +1,57 @@
+package diskfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// this constants should be part of "golang.org/x/sys/unix", but aren't, yet
+const (
+	// DIOCGPDINFO gets the physical disklabel of the device, i.e. not the one written on the disk,
+	// _IOR('d', 114, struct disklabel)
+	DIOCGPDINFO = 0x41946472
+)
+
+// offsets into struct disklabel from <sys/disklabel.h>, 404 bytes in all
+const (
+	disklabelSize           = 404
+	disklabelSecSize        = 40  // d_secsize, uint32
+	disklabelSecPerUnit     = 60  // d_secperunit, low 32 bits of the sector count
+	disklabelSecPerUnitHigh = 112 // d_secperunith, high 16 bits of the sector count
+)
+
+// getDisklabel get the physical disklabel for a block device, which has its sector size and count
+func getDisklabel(f *os.File) ([]byte, error) {
+	b := make([]byte, disklabelSize)
+	if err := ioctlPtr(f, DIOCGPDINFO, unsafe.Pointer(&b[0])); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// getBlockDeviceSize get the size of an opened block device in Bytes.
+//
+// This is the size of the whole disk, which is what the raw 'c' partition, e.g. /dev/rsd0c, covers.
+func getBlockDeviceSize(f *os.File) (int64, error) {
+	label, err := getDisklabel(f)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get block device size: %v", err)
+	}
+	sectorSize := binary.NativeEndian.Uint32(label[disklabelSecSize:])
+	sectors := uint64(binary.NativeEndian.Uint16(label[disklabelSecPerUnitHigh:]))<<32 | uint64(binary.NativeEndian.Uint32(label[disklabelSecPerUnit:]))
+	return int64(sectors) * int64(sectorSize), nil
+}
+
+// getSectorSizes get the logical and physical sector sizes for a block device
+//
+// OpenBSD does not report a separate physical sector size, so both are the same.
+func getSectorSizes(f *os.File) (logicalSectorSize, physicalSectorSize int64, err error) {
+	label, err := getDisklabel(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get device logical sector size: %v", err)
+	}
+	sectorSize := int64(binary.NativeEndian.Uint32(label[disklabelSecSize:]))
+	return sectorSize, sectorSize, nil
+}
@@ -0,0 +1,61 @@
+package diskfs
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// this constants should be part of "golang.org/x/sys/unix", but aren't, yet
+const (
+	// DKIOCGMEDIAINFOEXT gets struct dk_minfo_ext from <sys/dkio.h>, (DKIOC|48)
+	DKIOCGMEDIAINFOEXT = 0x0430
+	// SYS_IOCTL is SYS_ioctl from <sys/syscall.h>, the same on illumos and Solaris
+	SYS_IOCTL = 54
+)
+
+// dkMinfoExt is struct dk_minfo_ext from <sys/dkio.h>, which is 24 bytes with the padding after
+// dki_pbsize that aligns dki_capacity in an array of them, as Go lays it out as well
+type dkMinfoExt struct {
+	mediaType uint32 // dki_media_type
+	lbsize    uint32 // dki_lbsize
+	capacity  uint64 // dki_capacity, a diskaddr_t
+	pbsize    uint32 // dki_pbsize
+}
+
+// getMediaInfo get the logical block size, capacity in logical blocks and physical block size of
+// a block device. This covers both illumos and Solaris.
+//
+// golang.org/x/sys/unix only exposes ioctls on solaris that read into one of its own types, so the
+// ioctl is issued through unix.Syscall, which the runtime routes through the syscall function of libc.
+func getMediaInfo(f *os.File) (logicalBlockSize uint32, capacity uint64, physicalBlockSize uint32, err error) {
+	var m dkMinfoExt
+	if _, _, errno := unix.Syscall(SYS_IOCTL, f.Fd(), DKIOCGMEDIAINFOEXT, uintptr(unsafe.Pointer(&m))); errno != 0 {
+		return 0, 0, 0, errno
+	}
+	return m.lbsize, m.capacity, m.pbsize, nil
+}
+
+// getBlockDeviceSize get the size of an opened block device in Bytes.
+func getBlockDeviceSize(f *os.File) (int64, error) {
+	logicalBlockSize, capacity, _, err := getMediaInfo(f)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get block device size: %v", err)
+	}
+	return int64(capacity) * int64(logicalBlockSize), nil
+}
+
+// getSectorSizes get the logical and physical sector sizes for a block device
+func getSectorSizes(f *os.File) (logicalSectorSize, physicalSectorSize int64, err error) {
+	logicalBlockSize, _, physicalBlockSize, err := getMediaInfo(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get device sector sizes: %v", err)
+	}
+	logicalSectorSize, physicalSectorSize = int64(logicalBlockSize), int64(physicalBlockSize)
+	if physicalSectorSize == 0 {
+		physicalSectorSize = logicalSectorSize
+	}
+	return logicalSectorSize, physicalSectorSize, nil
+}
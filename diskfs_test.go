@@ -11,6 +11,8 @@ import (
 
 	diskfs "github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/disk/formats/qcow2"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 )
 
 const oneMB = 10 * 1024 * 1024
@@ -229,9 +231,152 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateOpenOnlyOptions(t *testing.T) {
+	for name, opt := range map[string]diskfs.CreateOpt{
+		"WithOpenMode":     diskfs.WithOpenMode(diskfs.ReadOnly),
+		"WithSectorSize":   diskfs.WithSectorSize(diskfs.SectorSize4k),
+		"WithBackingFiles": diskfs.WithBackingFiles(true),
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "disk.img")
+			_, err := diskfs.Create(p, 10*oneMB, diskfs.SectorSizeDefault, diskfs.WithFormat(diskfs.FormatRaw), opt)
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("disk was created despite the error")
+			}
+		})
+	}
+}
+
+func TestOpenBackingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "base.img"), make([]byte, oneMB), 0o600); err != nil {
+		t.Fatalf("error writing backing file: %v", err)
+	}
+	p := filepath.Join(dir, "overlay.qcow2")
+	img, err := qcow2.CreateFromPath(p, 0, &qcow2.CreateOptions{BackingFile: "base.img", BackingFormat: qcow2.BackingFormatRaw})
+	if err != nil {
+		t.Fatalf("error creating overlay: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("error closing overlay: %v", err)
+	}
+
+	// the backing file is not followed for a detected format, nor without asking for it
+	for _, opts := range [][]diskfs.OpenOpt{
+		nil,
+		{diskfs.WithFormat(diskfs.FormatQCOW2)},
+		{diskfs.WithBackingFiles(true)},
+	} {
+		opts = append(opts, diskfs.WithOpenMode(diskfs.ReadOnly))
+		if d, err := diskfs.Open(p, opts...); err == nil {
+			_ = d.Close()
+			t.Errorf("opened overlay with %d options", len(opts))
+		}
+	}
+	d, err := diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly), diskfs.WithFormat(diskfs.FormatQCOW2), diskfs.WithBackingFiles(true))
+	if err != nil {
+		t.Fatalf("error opening overlay with its backing file: %v", err)
+	}
+	defer d.Close()
+	if d.Size != oneMB {
+		t.Errorf("disk size %d instead of %d", d.Size, oneMB)
+	}
+}
+
 func testTmpFilename(t *testing.T, prefix, suffix string) string {
 	t.Helper()
 	randBytes := make([]byte, 16)
 	_, _ = rand.Read(randBytes)
 	return filepath.Join(os.TempDir(), prefix+hex.EncodeToString(randBytes)+suffix)
 }
+
+func TestOpenDetectFormat(t *testing.T) {
+	for _, format := range []diskfs.Format{diskfs.FormatRaw, diskfs.FormatVMDK, diskfs.FormatVMDKStreamOptimized, diskfs.FormatVHDX, diskfs.FormatQCOW2} {
+		t.Run(format.String(), func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "disk.img")
+			d, err := diskfs.Create(p, 10*oneMB, diskfs.SectorSizeDefault, diskfs.WithFormat(format))
+			if err != nil {
+				t.Fatalf("error creating disk: %v", err)
+			}
+			table := &gpt.Table{
+				Partitions: []*gpt.Partition{
+					{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem, Name: "data"},
+				},
+			}
+			if err := d.Partition(table); err != nil {
+				t.Fatalf("error partitioning disk: %v", err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatalf("error closing disk: %v", err)
+			}
+
+			d, err = diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly))
+			if err != nil {
+				t.Fatalf("error opening disk: %v", err)
+			}
+			defer d.Close()
+			if d.Size != 10*oneMB {
+				t.Errorf("disk size %d instead of %d", d.Size, 10*oneMB)
+			}
+			if d.Table == nil || d.Table.Type() != "gpt" {
+				t.Errorf("did not find gpt partition table")
+			}
+
+			// the image is not translated when its format is overridden
+			if format == diskfs.FormatRaw {
+				return
+			}
+			raw, err := diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly), diskfs.WithFormat(diskfs.FormatRaw))
+			if err != nil {
+				t.Fatalf("error opening disk as raw: %v", err)
+			}
+			defer raw.Close()
+			if raw.Table != nil {
+				t.Errorf("found partition table in untranslated image")
+			}
+		})
+	}
+
+	// the start of a raw disk that looks like a format that is not supported is just what was written to it
+	t.Run("unsupported", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			magic    string
+			detected bool
+		}{
+			{"vhd", "conectix", false},
+			{"vmdk descriptor", "# Disk DescriptorFile", true},
+		}
+		for _, tt := range tests {
+			p := filepath.Join(t.TempDir(), "disk.img")
+			b := make([]byte, oneMB)
+			copy(b, tt.magic)
+			if err := os.WriteFile(p, b, 0o600); err != nil {
+				t.Fatalf("error writing image: %v", err)
+			}
+			d, err := diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly))
+			switch {
+			case !tt.detected && err == nil:
+				_ = d.Close()
+				t.Errorf("%s: opened unsupported image without error", tt.name)
+			case tt.detected && err != nil:
+				t.Errorf("%s: error opening raw disk: %v", tt.name, err)
+			case tt.detected:
+				_ = d.Close()
+			}
+			// it can always be opened as raw when asked for
+			d, err = diskfs.Open(p, diskfs.WithOpenMode(diskfs.ReadOnly), diskfs.WithFormat(diskfs.FormatRaw))
+			if err != nil {
+				t.Errorf("%s: error opening raw disk: %v", tt.name, err)
+				continue
+			}
+			if d.Size != oneMB {
+				t.Errorf("%s: disk size %d instead of %d", tt.name, d.Size, oneMB)
+			}
+			_ = d.Close()
+		}
+	})
+}
@@ -2,14 +2,12 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"path/filepath"
 
 	diskfs "github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/fscopy"
 	"github.com/diskfs/go-diskfs/filesystem/iso9660"
 )
 
@@ -21,84 +19,43 @@ func check(err error) {
 	log.Fatal(err)
 }
 
-func FolderSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return err
-	})
-	return size, err
-}
-
 func CreateIsoFromFolder(srcFolder string, outputFileName string) {
-	// We need to know the size of the folder before we can create a disk image
-	// TODO: Are we able to create a disk image with a dynamic size?
-	folderSize, err := FolderSize(srcFolder)
-	check(err)
-
 	// TODO: Explain why we need to set the logical block size and which values should be used
 	var LogicalBlocksize diskfs.SectorSize = 2048
 
+	// The size of the image is not known until all of the files are in place, so first build the
+	// filesystem in a workspace that is not yet attached to any disk image
+	staging, err := iso9660.Create(nil, 0, 0, int64(LogicalBlocksize), "")
+	check(err)
+
+	// Copy all files and folders of the source folder into the ISO filesystem
+	err = fscopy.CopyTreeIn(staging, srcFolder)
+	check(err)
+
+	// Now that everything is in place, we know exactly how big the image will be
+	options := iso9660.FinalizeOptions{}
+	size, err := staging.EstimateSize(options)
+	check(err)
+
 	// Create the disk image
-	mydisk, err := diskfs.Create(outputFileName, folderSize, LogicalBlocksize)
+	mydisk, err := diskfs.Create(outputFileName, size, LogicalBlocksize)
 	check(err)
 
-	// Create the ISO filesystem on the disk image
+	// Create the ISO filesystem on the disk image, reusing the workspace we already filled
 	fspec := disk.FilesystemSpec{
 		Partition:   0,
 		FSType:      filesystem.TypeISO9660,
 		VolumeLabel: "label",
+		WorkDir:     staging.Workspace(),
 	}
 	fs, err := mydisk.CreateFilesystem(fspec)
 	check(err)
 
-	// Walk the source folder to copy all files and folders to the ISO filesystem
-	err = filepath.Walk(srcFolder, func(path string, info os.FileInfo, err error) error {
-		check(err)
-
-		relPath, err := filepath.Rel(srcFolder, path)
-		check(err)
-
-		// If the current path is a folder, create the folder in the ISO filesystem
-		if info.IsDir() {
-			// Create the directory in the ISO file
-			err = fs.Mkdir(relPath)
-			check(err)
-			return nil
-		}
-
-		// If the current path is a file, copy the file to the ISO filesystem
-		if !info.IsDir() {
-			// Open the file in the ISO file for writing
-			rw, err := fs.OpenFile(relPath, os.O_CREATE|os.O_RDWR)
-			check(err)
-
-			// Open the source file for reading
-			in, errorOpeningFile := os.Open(path)
-			if errorOpeningFile != nil {
-				return errorOpeningFile
-			}
-			defer in.Close()
-
-			// Copy the contents of the source file to the ISO file
-			_, err = io.Copy(rw, in)
-			check(err)
-		}
-
-		return nil
-	})
-	check(err)
-
 	iso, ok := fs.(*iso9660.FileSystem)
 	if !ok {
 		check(fmt.Errorf("not an iso9660 filesystem"))
 	}
-	err = iso.Finalize(iso9660.FinalizeOptions{})
+	err = iso.Finalize(options)
 	check(err)
 }
 
@@ -0,0 +1,23 @@
+package filesystem_test
+
+import (
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+)
+
+// createFat32 create an empty FAT32 filesystem in memory, for tests of what works on any filesystem
+func createFat32(t *testing.T, label string) *fat32.FileSystem {
+	t.Helper()
+	size := int64(10 * fat32.MB)
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("error creating backend: %v", err)
+	}
+	fs, err := fat32.Create(b, size, 0, 512, label)
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	return fs
+}
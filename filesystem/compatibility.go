@@ -1,14 +1,23 @@
 package filesystem
 
 import (
+	"errors"
+	"io"
 	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
+// maxSymlinks how many symlinks are followed to resolve a name before giving up, as Linux does
+const maxSymlinks = 40
+
 type fsCompatible struct {
 	fs FileSystem
+	// root the directory of fs that is the root of the fs.FS, "/" unless it was made by Sub
+	root string
 }
 
 type fsFileWrapper struct {
@@ -20,15 +29,35 @@ type fakeRootDir struct{}
 
 func (d *fakeRootDir) Name() string       { return "/" }
 func (d *fakeRootDir) Size() int64        { return 0 }
-func (d *fakeRootDir) Mode() fs.FileMode  { return 0 }
-func (d *fakeRootDir) ModTime() time.Time { return time.Now() }
+func (d *fakeRootDir) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (d *fakeRootDir) ModTime() time.Time { return time.Time{} }
 func (d *fakeRootDir) IsDir() bool        { return true }
 func (d *fakeRootDir) Sys() any           { return nil }
 
+// dirInfo a FileInfo of a directory whose Mode does not have fs.ModeDir, as some filesystems, such as FAT32,
+// report it, and io/fs expects
+type dirInfo struct {
+	os.FileInfo
+}
+
+func (d dirInfo) Mode() fs.FileMode { return d.FileInfo.Mode() | fs.ModeDir }
+
+// namedInfo a FileInfo under the name it was looked up by, e.g. that of a symlink to it, or "." for the root
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (n namedInfo) Name() string { return n.name }
+
 type fsDirWrapper struct {
 	name   string
+	full   string
 	compat *fsCompatible
 	stat   os.FileInfo
+	// entries of the directory, read on the first call to ReadDir, of which offset have been returned
+	entries []fs.DirEntry
+	offset  int
 }
 
 func (f *fsDirWrapper) Close() error {
@@ -36,18 +65,32 @@ func (f *fsDirWrapper) Close() error {
 }
 
 func (f *fsDirWrapper) Read([]byte) (int, error) {
-	return 0, fs.ErrInvalid
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
 }
 
+// ReadDir read the next n entries of the directory, as fs.ReadDirFile does: with n > 0, io.EOF once there are
+// no more, otherwise all of those that are left
 func (f *fsDirWrapper) ReadDir(n int) ([]fs.DirEntry, error) {
-	entries, err := f.compat.ReadDir(f.name)
-	if err != nil {
-		return nil, err
+	if f.entries == nil {
+		entries, err := f.compat.readDir(f.full)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		f.entries = entries
 	}
-	if n < 0 || n >= len(entries) {
-		n = len(entries)
+	rest := f.entries[f.offset:]
+	if n <= 0 {
+		f.offset = len(f.entries)
+		return rest, nil
 	}
-	return entries[:n], nil
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	f.offset += n
+	return rest[:n], nil
 }
 
 func (f *fsDirWrapper) Stat() (fs.FileInfo, error) {
@@ -58,59 +101,206 @@ func (f *fsFileWrapper) Stat() (fs.FileInfo, error) {
 	return f.stat, nil
 }
 
-// Converts the relative path name to an absolute one
-func absoluteName(name string) string {
-	if name == "." {
-		name = "/"
+// fullPath the path in the filesystem of name, which must be valid
+func (f *fsCompatible) fullPath(name string) string {
+	return path.Join(f.root, name)
+}
+
+// check whether name is valid, and could exist. FAT32, exFAT, ISO9660 and squashfs take a backslash as a separator,
+// as io/fs does not, so no name in them can have one, and looking it up would find another file.
+func (f *fsCompatible) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
 	}
-	if name[0] != '/' {
-		name = "/" + name
+	switch f.fs.Type() {
+	case TypeFat32, TypeExFAT, TypeISO9660, TypeSquashfs:
+		if strings.Contains(name, `\`) {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
 	}
-	return name
+	return nil
 }
 
-func (f *fsCompatible) Open(name string) (fs.File, error) {
-	var stat os.FileInfo
-	name = absoluteName(name)
-	if name == "/" {
-		return &fsDirWrapper{name: name, compat: f, stat: &fakeRootDir{}}, nil
-	}
-	dirname := path.Dir(name)
-	if info, err := f.fs.ReadDir(dirname); err == nil {
-		for i := range info {
-			if info[i].Name() == path.Base(name) {
-				stat = info[i]
-				break
+// lookup the FileInfo of the path full in the filesystem, as the directory that holds it lists it
+func (f *fsCompatible) lookup(full string) (os.FileInfo, error) {
+	if full == "/" {
+		return &fakeRootDir{}, nil
+	}
+	infos, err := f.fs.ReadDir(path.Dir(full))
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	for _, info := range infos {
+		if info.Name() == path.Base(full) {
+			return info, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// resolve the path in the filesystem of name, and its FileInfo, following symlinks as io/fs does: any of the
+// directories on the way may be one, as may name itself. Targets are resolved within the root, so that an absolute
+// one is relative to it, and .. does not go above it, as for a chroot.
+func (f *fsCompatible) resolve(op, name string) (string, fs.FileInfo, error) {
+	if err := f.check(op, name); err != nil {
+		return "", nil, err
+	}
+	var (
+		full  = f.root
+		rest  = splitPath(name)
+		info  os.FileInfo
+		links int
+	)
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if full != f.root {
+				full = path.Dir(full)
+			}
+			info = nil
+			continue
+		}
+		next := path.Join(full, part)
+		var err error
+		if info, err = f.lookup(next); err != nil {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if links == maxSymlinks {
+				return "", nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+			}
+			links++
+			target, err := Readlink(f.fs, next)
+			if err != nil {
+				return "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			if path.IsAbs(target) {
+				full = f.root
 			}
+			rest = append(splitPath(target), rest...)
+			info = nil
+			continue
 		}
+		if len(rest) > 0 && !info.IsDir() {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+		}
+		full = next
 	}
-	if stat == nil {
-		return nil, fs.ErrNotExist
+	if info == nil {
+		// name is the root, or a symlink or .. led back to a directory
+		var err error
+		if info, err = f.lookup(full); err != nil {
+			return "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
 	}
-	if stat.IsDir() {
-		return &fsDirWrapper{name: name, compat: f, stat: stat}, nil
+	if info.IsDir() && !info.Mode().IsDir() {
+		info = dirInfo{info}
 	}
-	file, err := f.fs.OpenFile(name, os.O_RDONLY)
+	if info.Name() != path.Base(name) {
+		info = namedInfo{FileInfo: info, name: path.Base(name)}
+	}
+	return full, info, nil
+}
+
+// splitPath the components of a path, or of a symlink target, in order
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+func (f *fsCompatible) Open(name string) (fs.File, error) {
+	full, stat, err := f.resolve("open", name)
 	if err != nil {
 		return nil, err
 	}
+	if stat.IsDir() {
+		return &fsDirWrapper{name: name, full: full, compat: f, stat: stat}, nil
+	}
+	file, err := f.fs.OpenFile(full, os.O_RDONLY)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
 	return &fsFileWrapper{File: file, stat: stat}, nil
 }
 
-func (f *fsCompatible) ReadDir(name string) ([]fs.DirEntry, error) {
-	entries, err := f.fs.ReadDir(name)
+// readDir the entries of the directory full in the filesystem, sorted by name, without . and ..
+func (f *fsCompatible) readDir(full string) ([]fs.DirEntry, error) {
+	entries, err := f.fs.ReadDir(full)
 	if err != nil {
 		return nil, err
 	}
-	direntries := make([]fs.DirEntry, len(entries))
-	for i := range entries {
-		direntries[i] = fs.FileInfoToDirEntry(entries[i])
+	direntries := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Name() == "." || e.Name() == ".." {
+			continue
+		}
+		if e.IsDir() && !e.Mode().IsDir() {
+			e = dirInfo{e}
+		}
+		direntries = append(direntries, fs.FileInfoToDirEntry(e))
 	}
+	sort.Slice(direntries, func(i, j int) bool { return direntries[i].Name() < direntries[j].Name() })
 	return direntries, nil
 }
 
+// ReadDir read the entries of the directory name, sorted by name, without . and ..
+func (f *fsCompatible) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, _, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.readDir(full)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Stat the FileInfo of name, without opening it
+func (f *fsCompatible) Stat(name string) (fs.FileInfo, error) {
+	_, info, err := f.resolve("stat", name)
+	return info, err
+}
+
+// ReadFile read the whole of the file name
+func (f *fsCompatible) ReadFile(name string) ([]byte, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b, nil
+}
+
+// Sub an fs.FS of the directory dir, which keeps the other interfaces that this one has
+func (f *fsCompatible) Sub(dir string) (fs.FS, error) {
+	full, stat, err := f.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: errors.New("not a directory")}
+	}
+	return &fsCompatible{fs: f.fs, root: full}, nil
+}
+
+// Glob the names of the files that match pattern, as fs.Glob finds them with ReadDir
+func (f *fsCompatible) Glob(pattern string) ([]string, error) {
+	// fs.Glob would call this Glob again, so give it only Open and ReadDir
+	return fs.Glob(struct{ fs.ReadDirFS }{f}, pattern)
+}
+
 // FS converts a diskfs FileSystem to a fs.FS for compatibility with
-// other utilities
+// other utilities. Names are those of io/fs, relative to the root, e.g. "." or "boot/vmlinuz".
+// Besides fs.ReadDirFS, it is an fs.StatFS, fs.ReadFileFS, fs.SubFS and fs.GlobFS, and the directories it
+// opens are fs.ReadDirFile, so that fs.WalkDir and http.FileServer, with its directory listings, work on it.
 func FS(f FileSystem) fs.ReadDirFS {
-	return &fsCompatible{f}
+	return &fsCompatible{fs: f, root: "/"}
 }
@@ -0,0 +1,90 @@
+package filesystem_test
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+)
+
+func TestFSSymlinks(t *testing.T) {
+	const size = 16 * 1024 * 1024
+	b, err := mem.New(size)
+	if err != nil {
+		t.Fatalf("error creating backend: %v", err)
+	}
+	e, err := ext4.Create(b, size, 0, 512, &ext4.Params{})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	for _, dir := range []string{"/a/b", "/b"} {
+		if err := e.Mkdir(dir); err != nil {
+			t.Fatalf("error creating directory %s: %v", dir, err)
+		}
+	}
+	for p, content := range map[string]string{"/a/b/file.txt": "inside", "/b/file.txt": "outside"} {
+		f, err := e.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("error creating %s: %v", p, err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatalf("error writing %s: %v", p, err)
+		}
+		_ = f.Close()
+	}
+	for link, target := range map[string]string{
+		// a directory on the way to a file
+		"/a/dir": "b",
+		// absolute, which within a Sub of /a is /a/b
+		"/a/abs": "/b",
+		// absolute, to a file
+		"/a/absfile": "/b/file.txt",
+		// up and out of the root of a Sub of /a, which stops at it
+		"/a/up": "../../b",
+	} {
+		if err := e.Symlink(target, link); err != nil {
+			t.Fatalf("error creating symlink %s: %v", link, err)
+		}
+	}
+
+	fsys := filesystem.FS(e)
+	sub, err := fs.Sub(fsys, "a")
+	if err != nil {
+		t.Fatalf("error getting sub filesystem: %v", err)
+	}
+	for _, tt := range []struct {
+		fsys     fs.FS
+		name     string
+		expected string
+	}{
+		{fsys, "a/dir/file.txt", "inside"},
+		{fsys, "a/abs/file.txt", "outside"},
+		{fsys, "a/up/file.txt", "outside"},
+		{sub, "dir/file.txt", "inside"},
+		{sub, "abs/file.txt", "inside"},
+		{sub, "up/file.txt", "inside"},
+		{sub, "absfile", "inside"},
+	} {
+		b, err := fs.ReadFile(tt.fsys, tt.name)
+		if err != nil {
+			t.Errorf("error reading %s: %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.expected {
+			t.Errorf("%s has %q instead of %q", tt.name, b, tt.expected)
+		}
+	}
+	entries, err := fs.ReadDir(sub, "dir")
+	if err != nil {
+		t.Fatalf("error reading directory through symlink: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" {
+		t.Errorf("directory through symlink has %v instead of file.txt", entries)
+	}
+	if _, err := fs.Stat(sub, "dir/file.txt/more"); err == nil {
+		t.Errorf("no error for a path through a file")
+	}
+}
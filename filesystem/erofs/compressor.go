@@ -0,0 +1,237 @@
+package erofs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4/v4"
+)
+
+// compressionAlgorithm the algorithms of compressed files, as numbered in the map header of each
+type compressionAlgorithm uint8
+
+const (
+	algorithmLz4     compressionAlgorithm = 0
+	algorithmLzma    compressionAlgorithm = 1
+	algorithmDeflate compressionAlgorithm = 2
+	algorithmZstd    compressionAlgorithm = 3
+	algorithmMax     compressionAlgorithm = 4
+)
+
+func (a compressionAlgorithm) String() string {
+	switch a {
+	case algorithmLz4:
+		return "lz4"
+	case algorithmLzma:
+		return "lzma"
+	case algorithmDeflate:
+		return "deflate"
+	case algorithmZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(a))
+	}
+}
+
+// Compressor defines a compressor. Fulfilled by various implementations in this package
+type Compressor interface {
+	algorithm() compressionAlgorithm
+	// encoder make what compresses each extent, of up to window bytes
+	encoder(window int) (encoder, error)
+	// config the configuration of the algorithm, for after the superblock, or nil if it needs none
+	config(window int) []byte
+}
+
+// encoder compress extents, one at a time
+type encoder interface {
+	// compress in, returning nil if it does not compress to limit bytes or less
+	compress(in []byte, limit int) ([]byte, error)
+	close()
+}
+
+// CompressorLz4 lz4 compression, of each pcluster in the lz4 block format, as mkfs.erofs does
+type CompressorLz4 struct {
+	// HighCompression compress with the slower lz4hc, which compresses more
+	HighCompression bool
+}
+
+func (c *CompressorLz4) algorithm() compressionAlgorithm {
+	return algorithmLz4
+}
+
+func (c *CompressorLz4) encoder(_ int) (encoder, error) {
+	return &lz4Encoder{high: c.HighCompression}, nil
+}
+
+// config lz4 needs none, with the default distance of 64KB
+func (c *CompressorLz4) config(_ int) []byte {
+	return nil
+}
+
+type lz4Encoder struct {
+	high bool
+	out  []byte
+}
+
+func (e *lz4Encoder) compress(in []byte, limit int) ([]byte, error) {
+	if bound := lz4.CompressBlockBound(len(in)); len(e.out) < bound {
+		e.out = make([]byte, bound)
+	}
+	var (
+		n   int
+		err error
+	)
+	if e.high {
+		n, err = lz4.CompressBlockHC(in, e.out, lz4.Level9, nil, nil)
+	} else {
+		n, err = lz4.CompressBlock(in, e.out, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error compressing: %v", err)
+	}
+	// 0 is incompressible
+	if n == 0 || n > limit {
+		return nil, nil
+	}
+	return e.out[:n], nil
+}
+
+func (e *lz4Encoder) close() {}
+
+// CompressorZstd zstd compression
+type CompressorZstd struct {
+	// CompressionLevel from 1 to 22; 0 is the default of mkfs.erofs, 3
+	CompressionLevel uint32
+}
+
+const (
+	zstdMinLevel     uint32 = 1
+	zstdMaxLevel     uint32 = 22
+	zstdDefaultLevel uint32 = 3
+	// zstdMinWindowLog the window log that is 0 in the configuration
+	zstdMinWindowLog = 10
+	// zstdConfigSize the size of the configuration of zstd
+	zstdConfigSize = 6
+)
+
+func (c *CompressorZstd) algorithm() compressionAlgorithm {
+	return algorithmZstd
+}
+
+// level the compression level, with the default for 0
+func (c *CompressorZstd) level() uint32 {
+	if c.CompressionLevel == 0 {
+		return zstdDefaultLevel
+	}
+	return c.CompressionLevel
+}
+
+func (c *CompressorZstd) encoder(window int) (encoder, error) {
+	if level := c.level(); level < zstdMinLevel || level > zstdMaxLevel {
+		return nil, fmt.Errorf("zstd compression level %d, must be at least %d and not more than %d", level, zstdMinLevel, zstdMaxLevel)
+	}
+	// every frame has a window no larger than the configuration gives, which is all the kernel has room for
+	z, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(c.level()))), zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(window), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd compressor: %w", err)
+	}
+	return &zstdEncoder{z: z}, nil
+}
+
+// config the format, 0, and the window log, from 1KB
+func (c *CompressorZstd) config(window int) []byte {
+	b := make([]byte, zstdConfigSize)
+	b[1] = byte(bits.Len(uint(window)) - 1 - zstdMinWindowLog)
+	return b
+}
+
+type zstdEncoder struct {
+	z   *zstd.Encoder
+	out []byte
+}
+
+func (e *zstdEncoder) compress(in []byte, limit int) ([]byte, error) {
+	e.out = e.z.EncodeAll(in, e.out[:0])
+	if len(e.out) > limit {
+		return nil, nil
+	}
+	return e.out, nil
+}
+
+func (e *zstdEncoder) close() {
+	e.z.Close()
+}
+
+// decompressor decompress pclusters of any of the algorithms that can be read, keeping a decoder for zstd
+type decompressor struct {
+	zstd *zstd.Decoder
+}
+
+// decompress the pcluster in, which has had any padding removed, to size bytes of output. The pcluster of a
+// partial reference decompresses to more than size, which is the start of it.
+func (d *decompressor) decompress(algorithm compressionAlgorithm, in []byte, size int, partial bool) ([]byte, error) {
+	switch algorithm {
+	case algorithmLz4:
+		outSize := size
+		if partial {
+			// the most that an lz4 block can hold
+			outSize = max(size, min(255*len(in), maxExtentLength))
+		}
+		out := make([]byte, outSize)
+		n, err := lz4.UncompressBlock(in, out)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing lz4: %v", err)
+		}
+		out = out[:n]
+		if len(out) < size || (!partial && len(out) != size) {
+			return nil, fmt.Errorf("lz4 decompressed to %d bytes instead of expected %d", len(out), size)
+		}
+		return out[:size], nil
+	case algorithmZstd:
+		if d.zstd == nil {
+			z, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxExtentLength))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create zstd decompressor: %w", err)
+			}
+			d.zstd = z
+		}
+		out, err := d.zstd.DecodeAll(in, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing zstd: %w", err)
+		}
+		if len(out) < size {
+			return nil, fmt.Errorf("zstd decompressed to %d bytes instead of expected %d", len(out), size)
+		}
+		return out[:size], nil
+	case algorithmDeflate:
+		// raw deflate, which can be stopped once there is enough
+		r := flate.NewReader(bytes.NewReader(in))
+		defer r.Close()
+		out := make([]byte, size)
+		if _, err := io.ReadFull(r, out); err != nil {
+			return nil, fmt.Errorf("error decompressing deflate: %v", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("%v compression is not supported", algorithm)
+	}
+}
+
+// close release the decoder of zstd, if there is one
+func (d *decompressor) close() {
+	if d.zstd != nil {
+		d.zstd.Close()
+		d.zstd = nil
+	}
+}
+
+// configRecord a configuration of an algorithm, as it is after the superblock: its length and then itself
+func configRecord(b []byte) []byte {
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
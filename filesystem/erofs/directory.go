@@ -0,0 +1,105 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// direntSize the size of each entry of a directory, before the names
+const direntSize = 12
+
+// file types of the entries of a directory
+const (
+	fileTypeUnknown   uint8 = 0
+	fileTypeRegular   uint8 = 1
+	fileTypeDirectory uint8 = 2
+	fileTypeCharacter uint8 = 3
+	fileTypeBlock     uint8 = 4
+	fileTypeFifo      uint8 = 5
+	fileTypeSocket    uint8 = 6
+	fileTypeSymlink   uint8 = 7
+)
+
+// directoryEntry a single entry of a directory
+type directoryEntry struct {
+	nid      uint64
+	name     string
+	fileType uint8
+}
+
+// parseDirectory parse the entries of a directory from its data, which is in blocks of blockSize, each with the
+// entries first and then their names, in the same order, with the offset of the first name giving how many entries
+// the block has
+func parseDirectory(b []byte, blockSize int) ([]*directoryEntry, error) {
+	var entries []*directoryEntry
+	for start := 0; start < len(b); start += blockSize {
+		block := b[start:min(start+blockSize, len(b))]
+		if len(block) < direntSize {
+			return nil, fmt.Errorf("directory block at %d of %d bytes is too short for an entry", start, len(block))
+		}
+		first := int(binary.LittleEndian.Uint16(block[8:10]))
+		if first < direntSize || first%direntSize != 0 || first > len(block) {
+			return nil, fmt.Errorf("directory block at %d has invalid offset of names %d", start, first)
+		}
+		count := first / direntSize
+		for i := 0; i < count; i++ {
+			d := block[i*direntSize : (i+1)*direntSize]
+			nameoff := int(binary.LittleEndian.Uint16(d[8:10]))
+			end := len(block)
+			if i+1 < count {
+				end = int(binary.LittleEndian.Uint16(block[(i+1)*direntSize+8 : (i+1)*direntSize+10]))
+			}
+			if nameoff < first || end < nameoff || end > len(block) {
+				return nil, fmt.Errorf("directory block at %d has entry %d with invalid name from %d to %d", start, i, nameoff, end)
+			}
+			name := block[nameoff:end]
+			// the last name of a block runs to its end, or to the zeros after it
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if len(name) == 0 {
+				return nil, fmt.Errorf("directory block at %d has entry %d with an empty name", start, i)
+			}
+			entries = append(entries, &directoryEntry{
+				nid:      binary.LittleEndian.Uint64(d[0:8]),
+				name:     string(name),
+				fileType: d[10],
+			})
+		}
+	}
+	return entries, nil
+}
+
+// directoryBytes lay out entries in blocks of blockSize, sorting them by name, as the kernel looks them up by
+// binary search. The last block is only as long as its entries and names.
+func directoryBytes(entries []*directoryEntry, blockSize int) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	var b []byte
+	for len(entries) > 0 {
+		// as many as fit in the block
+		count, used := 0, 0
+		for count < len(entries) && used+direntSize+len(entries[count].name) <= blockSize {
+			used += direntSize + len(entries[count].name)
+			count++
+		}
+		block := make([]byte, used, blockSize)
+		nameoff := count * direntSize
+		for i, e := range entries[:count] {
+			d := block[i*direntSize : (i+1)*direntSize]
+			binary.LittleEndian.PutUint64(d[0:8], e.nid)
+			binary.LittleEndian.PutUint16(d[8:10], uint16(nameoff))
+			d[10] = e.fileType
+			nameoff += copy(block[nameoff:], e.name)
+		}
+		entries = entries[count:]
+		if len(entries) > 0 {
+			block = block[:blockSize]
+		}
+		b = append(b, block...)
+	}
+	return b
+}
@@ -0,0 +1,20 @@
+// Package erofs provides support for reading and creating EROFS filesystems, the Enhanced Read-Only File System of
+// Linux, which containers and Android use in place of squashfs.
+// references:
+//
+//	https://docs.kernel.org/filesystems/erofs.html
+//	https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/fs/erofs/erofs_fs.h
+//	https://git.kernel.org/pub/scm/linux/kernel/git/xiang/erofs-utils.git
+//
+// Reading supports the flat, inline and chunk-based layouts of data, and files compressed with lz4, zstd or deflate,
+// with either full or compact indexes and with pclusters of one block or of many (big pclusters). Files whose tails
+// are packed inline with their compressed indexes (ztailpacking), or kept in the packed inode as fragments, and files
+// compressed with lzma, cannot be read. Extended attributes are skipped.
+//
+// As with squashfs, Create makes a workspace on the host, in which files are added, and Finalize writes an image of
+// it. Uncompressed files are written as a run of blocks with the tail, where it fits, inline after the inode, as
+// mkfs.erofs does. With FinalizeOptions.Compression, regular files are compressed into pclusters of one block each,
+// taking as much of the file for each as fits in it once compressed, and blocks that do not compress are stored as
+// they are. With FinalizeOptions.ModTime and UUID set, the same contents, with the same times, and options give the
+// same image byte for byte.
+package erofs
@@ -0,0 +1,472 @@
+package erofs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBlockSize = 4096
+	minBlockSize     = 512
+	maxBlockSize     = 65536
+)
+
+// FileSystem implements the FileSystem interface
+type FileSystem struct {
+	workspace  string
+	superblock *superblock
+	size       int64
+	start      int64
+	backend    backend.Storage
+	blocksize  int64
+	// label the volume name to give the image when it is finalized
+	label string
+}
+
+// Equal compare if two filesystems are equal
+func (fs *FileSystem) Equal(a *FileSystem) bool {
+	localMatch := fs.backend == a.backend && fs.size == a.size && fs.start == a.start
+	return localMatch && fs.superblock.equal(a.superblock)
+}
+
+// Label return the filesystem label, which is the volume name of the superblock, or, in the workspace, the one
+// that Finalize gives it
+func (fs *FileSystem) Label() string {
+	if fs.superblock == nil {
+		return fs.label
+	}
+	return fs.superblock.volumeName
+}
+
+// UUID return the filesystem UUID, in the same form as blkid reports it, or "" if it has none
+func (fs *FileSystem) UUID() string {
+	if fs.superblock == nil || fs.superblock.uuid == uuid.Nil {
+		return ""
+	}
+	return fs.superblock.uuid.String()
+}
+
+// Usage returns the size of the filesystem. It is read-only, so none of it is free.
+func (fs *FileSystem) Usage() filesystem.Usage {
+	if fs.superblock == nil {
+		return filesystem.Usage{}
+	}
+	return filesystem.Usage{Size: int64(fs.superblock.blocks) * fs.superblock.blockSize()}
+}
+
+// SetLabel set the label that Finalize gives the image, of up to 16 bytes. Once finalized, it cannot be changed.
+func (fs *FileSystem) SetLabel(label string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if len(label) > volumeNameSize {
+		return fmt.Errorf("label %q is longer than %d bytes", label, volumeNameSize)
+	}
+	fs.label = label
+	return nil
+}
+
+// Workspace get the workspace path
+func (fs *FileSystem) Workspace() string {
+	return fs.workspace
+}
+
+// Create creates an EROFS filesystem in a given directory
+//
+// requires the backend.Storage where to create the filesystem, size is the size of the filesystem in bytes,
+// start is how far in bytes from the beginning of the backend.Storage to create the filesystem,
+// and blocksize is is the blocksize to use for creating the filesystem
+//
+// note that you are *not* required to create the filesystem on the entire disk. You could have a disk of size
+// 20GB, and create a small filesystem of size 50MB that begins 2GB into the disk.
+// This is extremely useful for creating filesystems on disk partitions.
+//
+// Note, however, that it is much easier to do this using the higher-level APIs at github.com/diskfs/go-diskfs
+// which allow you to work directly with partitions, rather than having to calculate (and hopefully not make any errors)
+// where a partition starts and ends.
+//
+// If the provided blocksize is 0, it will use the default of 4 KB, which is the largest that the kernel mounts on
+// most architectures, as it reads blocks of no more than a page.
+func Create(b backend.Storage, size, start, blocksize int64) (*FileSystem, error) {
+	if blocksize == 0 {
+		blocksize = defaultBlockSize
+	}
+	if err := validateBlocksize(blocksize); err != nil {
+		return nil, err
+	}
+
+	// create a temporary working area where we can create the filesystem.
+	//  It is only on `Finalize()` that we write it out to the actual disk file
+	tmpdir, err := os.MkdirTemp("", "diskfs_erofs")
+	if err != nil {
+		return nil, fmt.Errorf("could not create working directory: %v", err)
+	}
+
+	return &FileSystem{
+		workspace: tmpdir,
+		start:     start,
+		size:      size,
+		backend:   b,
+		blocksize: blocksize,
+	}, nil
+}
+
+// Read reads a filesystem from a given disk.
+//
+// requires the backend.Storage where to read the filesystem, size is the size of the filesystem in bytes,
+// and start is how far in bytes from the beginning of the backend.Storage the filesystem is expected to begin.
+// The block size is in the superblock, so the last argument is ignored.
+//
+// note that you are *not* required to read a filesystem on the entire disk. You could have a disk of size
+// 20GB, and a small filesystem of size 50MB that begins 2GB into the disk.
+// This is extremely useful for working with filesystems on disk partitions.
+func Read(b backend.Storage, size, start, _ int64) (*FileSystem, error) {
+	fs := &FileSystem{
+		backend: b,
+		size:    size,
+		start:   start,
+	}
+	if err := fs.readSuperblock(); err != nil {
+		return nil, err
+	}
+	root, err := fs.readInode(uint64(fs.superblock.rootNid))
+	if err != nil {
+		return nil, fmt.Errorf("could not read root directory: %v", err)
+	}
+	if !root.isDir() {
+		return nil, fmt.Errorf("root directory is not a directory")
+	}
+	return fs, nil
+}
+
+// readSuperblock read the superblock, with the rest of its block for the checksum
+func (fs *FileSystem) readSuperblock() error {
+	b, err := fs.readBytes(superblockOffset, superblockSize)
+	if err != nil {
+		return fmt.Errorf("could not read superblock: %v", err)
+	}
+	// the checksum is over the rest of the block, whose size the superblock gives
+	if blockBits := b[0x0c]; blockBits >= 9 && blockBits <= 16 {
+		length := int64(1) << blockBits
+		if length > superblockOffset {
+			length -= superblockOffset
+		}
+		length = min(length, fs.size-superblockOffset)
+		if length > superblockSize {
+			if b, err = fs.readBytes(superblockOffset, int(length)); err != nil {
+				return fmt.Errorf("could not read superblock: %v", err)
+			}
+		}
+	}
+	s, err := parseSuperblock(b)
+	if err != nil {
+		return fmt.Errorf("error parsing superblock: %v", err)
+	}
+	if fsSize := int64(s.blocks) * s.blockSize(); fsSize > fs.size {
+		return fmt.Errorf("filesystem of %d blocks of %d bytes is larger than %d bytes", s.blocks, s.blockSize(), fs.size)
+	}
+	fs.superblock = s
+	fs.blocksize = s.blockSize()
+	return nil
+}
+
+// validateBlocksize check that the block size is a power of 2 that EROFS allows
+func validateBlocksize(blocksize int64) error {
+	if blocksize < minBlockSize || blocksize > maxBlockSize || blocksize&(blocksize-1) != 0 {
+		return fmt.Errorf("blocksize %d must be a power of 2 from %d to %d", blocksize, minBlockSize, maxBlockSize)
+	}
+	return nil
+}
+
+// readBytes read count bytes at the given offset in the filesystem
+func (fs *FileSystem) readBytes(off int64, count int) ([]byte, error) {
+	if off < 0 || off+int64(count) > fs.size {
+		return nil, fmt.Errorf("%d bytes at %d are beyond the end of the filesystem", count, off)
+	}
+	b := make([]byte, count)
+	if _, err := fs.backend.ReadAt(b, fs.start+off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// inodeOffset where the inode of a nid is, in bytes from the start of the filesystem
+func (fs *FileSystem) inodeOffset(nid uint64) int64 {
+	return int64(fs.superblock.metaBlkAddr)*fs.superblock.blockSize() + int64(nid)<<slotBits
+}
+
+// readInode read the inode of a nid
+func (fs *FileSystem) readInode(nid uint64) (*inode, error) {
+	off := fs.inodeOffset(nid)
+	b, err := fs.readBytes(off, inodeCompactSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d: %v", nid, err)
+	}
+	// an extended inode is twice as long
+	if b[0]&0x1 != 0 {
+		if b, err = fs.readBytes(off, inodeExtendedSize); err != nil {
+			return nil, fmt.Errorf("could not read inode %d: %v", nid, err)
+		}
+	}
+	return parseInode(b, nid, fs.superblock.buildTime)
+}
+
+// readDirectory read the entries of a directory, including . and ..
+func (fs *FileSystem) readDirectory(in *inode) ([]*directoryEntry, error) {
+	b, err := fs.readAll(in)
+	if err != nil {
+		return nil, err
+	}
+	return parseDirectory(b, int(fs.superblock.blockSize()))
+}
+
+// interface guard
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
+
+// Type returns the type code for the filesystem. Always returns filesystem.TypeErofs
+func (fs *FileSystem) Type() filesystem.Type {
+	return filesystem.TypeErofs
+}
+
+// Mkdir make a directory at the given path. It is equivalent to `mkdir -p`, i.e. idempotent, in that:
+//
+// * It will make the entire tree path if it does not exist
+// * It will not return an error if the path already exists
+//
+// if readonly and not in workspace, will return an error
+func (fs *FileSystem) Mkdir(p string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.MkdirAll(path.Join(fs.workspace, p), 0o755)
+}
+
+// Mknod make a special file. Devices, fifos and sockets of the workspace are written to the image, but cannot be
+// made here.
+func (fs *FileSystem) Mknod(_ string, _ uint32, _ int) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return filesystem.ErrNotImplemented
+}
+
+// Link make a hard link in the workspace
+func (fs *FileSystem) Link(oldpath, newpath string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Link(path.Join(fs.workspace, oldpath), path.Join(fs.workspace, newpath))
+}
+
+// Symlink make a symbolic link in the workspace, at newpath with the target oldpath
+func (fs *FileSystem) Symlink(oldpath, newpath string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Symlink(oldpath, path.Join(fs.workspace, newpath))
+}
+
+// Chmod changes the mode of the named file in the workspace to mode
+func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Chmod(path.Join(fs.workspace, name), mode)
+}
+
+// Chown changes the numeric uid and gid of the named file in the workspace, which needs the privileges to do so
+// on the host; FinalizeOptions.FileUID and FileGID set the owner of every file without them
+func (fs *FileSystem) Chown(name string, uid, gid int) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Lchown(path.Join(fs.workspace, name), uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file in the workspace, as os.Chtimes does.
+// A zero time.Time leaves that time unchanged. EROFS keeps only the modification time.
+func (fs *FileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Chtimes(path.Join(fs.workspace, name), atime, mtime)
+}
+
+// Readlink returns the target of the named symbolic link, from the workspace if there is one, else the image
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	if fs.workspace != "" {
+		return os.Readlink(path.Join(fs.workspace, name))
+	}
+	in, base, err := fs.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := fs.newFileInfo(in, base)
+	if err != nil {
+		return "", err
+	}
+	target, err := fi.Readlink()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	return target, nil
+}
+
+// ReadDir return the contents of a given directory in a given filesystem.
+//
+// Returns a slice of os.FileInfo with all of the entries in the directory, in the order of their names.
+//
+// Will return an error if the directory does not exist or is a regular file and not a directory
+func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	if fs.workspace != "" {
+		dirEntries, err := os.ReadDir(path.Join(fs.workspace, p))
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+		}
+		fi := make([]os.FileInfo, 0, len(dirEntries))
+		for _, e := range dirEntries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+			}
+			fi = append(fi, info)
+		}
+		return fi, nil
+	}
+	dir, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	entries, err := fs.readDirectory(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, de := range entries {
+		if de.name == "." || de.name == ".." {
+			continue
+		}
+		in, err := fs.readInode(de.nid)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", path.Join(p, de.name), err)
+		}
+		fi, err := fs.newFileInfo(in, de.name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", path.Join(p, de.name), err)
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+// Stat return os.FileInfo about a file or directory. Its Sys() returns the *FileInfo itself, which also gives
+// its owner, link target and the rest of its metadata.
+func (fs *FileSystem) Stat(p string) (os.FileInfo, error) {
+	if fs.workspace != "" {
+		return os.Lstat(path.Join(fs.workspace, p))
+	}
+	in, name, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.newFileInfo(in, name)
+}
+
+// OpenFile returns an io.ReadWriter from which you can read the contents of a file
+// or write contents to the file
+//
+// accepts normal os.OpenFile flags
+//
+// returns an error if the file does not exist
+func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	if fs.workspace != "" {
+		f, err := os.OpenFile(path.Join(fs.workspace, p), flag, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("target file %s does not exist: %v", p, err)
+		}
+		return f, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_EXCL) != 0 {
+		return nil, filesystem.ErrReadonlyFilesystem
+	}
+	in, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if in.isDir() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	r, err := fs.newDataReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %v", p, err)
+	}
+	return &File{dataReader: r}, nil
+}
+
+// Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it.
+func (fs *FileSystem) Rename(oldpath, newpath string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Rename(path.Join(fs.workspace, oldpath), path.Join(fs.workspace, newpath))
+}
+
+// Remove removes the named file or (empty) directory from the workspace
+func (fs *FileSystem) Remove(p string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Remove(path.Join(fs.workspace, p))
+}
+
+// lookup the inode of a file or directory by its path, and its name
+func (fs *FileSystem) lookup(p string) (*inode, string, error) {
+	in, err := fs.readInode(uint64(fs.superblock.rootNid))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read root directory: %v", err)
+	}
+	walked, name := "/", "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !in.isDir() {
+			return nil, "", fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := fs.readDirectory(in)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read directory %s: %v", walked, err)
+		}
+		walked = path.Join(walked, part)
+		var found *directoryEntry
+		for _, de := range entries {
+			if de.name == part {
+				found = de
+				break
+			}
+		}
+		if found == nil {
+			return nil, "", fmt.Errorf("%s does not exist", walked)
+		}
+		if in, err = fs.readInode(found.nid); err != nil {
+			return nil, "", fmt.Errorf("could not read %s: %v", walked, err)
+		}
+		name = part
+	}
+	return in, name, nil
+}
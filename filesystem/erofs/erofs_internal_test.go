@@ -0,0 +1,211 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/google/uuid"
+)
+
+func TestSuperblock(t *testing.T) {
+	sb := &superblock{
+		compat:      featureCompatSbChksum,
+		blockBits:   12,
+		inodes:      42,
+		buildTime:   time.Unix(1700000000, 500),
+		blocks:      100,
+		metaBlkAddr: 1,
+		uuid:        uuid.MustParse("0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0"),
+		volumeName:  "label",
+		incompat:    featureIncompatZeroPadding | featureIncompatComprCfgs,
+		algorithms:  1 << algorithmZstd,
+	}
+	// the rest of the block after the superblock, with the configurations of the algorithms
+	b := make([]byte, sb.blockSize()-superblockOffset)
+	copy(b, sb.toBytes())
+	copy(b[superblockSize:], configRecord([]byte{0, 2, 0, 0, 0, 0}))
+	sb.checksum = superblockChecksum(b)
+	binary.LittleEndian.PutUint32(b[0x04:0x08], sb.checksum)
+
+	parsed, err := parseSuperblock(b)
+	if err != nil {
+		t.Fatalf("error parsing superblock: %v", err)
+	}
+	if !parsed.equal(sb) {
+		t.Errorf("parsed superblock %#v, expected %#v", parsed, sb)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b []byte)
+		err    string
+	}{
+		{"magic", func(b []byte) { b[0] ^= 0xff }, "magic"},
+		{"checksum of superblock", func(b []byte) { b[0x24]++ }, "checksum"},
+		{"checksum of configurations", func(b []byte) { b[superblockSize+3]++ }, "checksum"},
+		{"block size", func(b []byte) { b[0x0c] = 17 }, "block size"},
+		{"features", func(b []byte) { b[0x53] = 0x80 }, "incompatible features"},
+		{"short", nil, "bytes instead of expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := append([]byte{}, b...)
+			if tt.modify == nil {
+				c = c[:superblockSize+10]
+			} else {
+				tt.modify(c)
+			}
+			_, err := parseSuperblock(c)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, expected one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestInode(t *testing.T) {
+	buildTime := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		in   *inode
+	}{
+		{"compact", &inode{layout: layoutFlatInline, mode: modeRegular | 0o644, nlink: 1, size: 5000, raw: 7, ino: 3, uid: 10, gid: 20, mtime: buildTime}},
+		{"extended", &inode{extended: true, layout: layoutCompressedFull, mode: modeDirectory | 0o755, nlink: 70000, size: 1 << 33, raw: 9, ino: 4, uid: 100000, gid: 200000, mtime: time.Unix(5, 6)}},
+		{"device", &inode{layout: layoutFlatPlain, mode: modeCharacter | 0o600, nlink: 1, raw: encodeDevice(1, 3), ino: 5, mtime: buildTime}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.in.nid = 12
+			parsed, err := parseInode(tt.in.toBytes(), 12, buildTime)
+			if err != nil {
+				t.Fatalf("error parsing inode: %v", err)
+			}
+			if !parsed.mtime.Equal(tt.in.mtime) {
+				t.Errorf("mtime %v, expected %v", parsed.mtime, tt.in.mtime)
+			}
+			parsed.mtime = tt.in.mtime
+			if *parsed != *tt.in {
+				t.Errorf("parsed inode %+v, expected %+v", parsed, tt.in)
+			}
+		})
+	}
+	if major, minor := decodeDevice(encodeDevice(259, 70000)); major != 259 || minor != 70000 {
+		t.Errorf("device %d:%d, expected 259:70000", major, minor)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	var entries []*directoryEntry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, &directoryEntry{nid: uint64(i * 3), name: fmt.Sprintf("entry with a long name %03d", 99-i), fileType: fileTypeRegular})
+	}
+	b := directoryBytes(entries, 512)
+	if len(b) <= 512*4 || len(b)%512 == 0 {
+		t.Errorf("directory of %d bytes, expected more than 4 blocks and a short last one", len(b))
+	}
+	parsed, err := parseDirectory(b, 512)
+	if err != nil {
+		t.Fatalf("error parsing directory: %v", err)
+	}
+	if len(parsed) != len(entries) {
+		t.Fatalf("directory had %d entries, expected %d", len(parsed), len(entries))
+	}
+	for i, e := range parsed {
+		// sorted by name
+		if expected := fmt.Sprintf("entry with a long name %03d", i); e.name != expected || e.nid != uint64((99-i)*3) {
+			t.Errorf("entry %d is %q with nid %d, expected %q with nid %d", i, e.name, e.nid, expected, (99-i)*3)
+		}
+	}
+
+	// the offset of the names of the first block past its end
+	binary.LittleEndian.PutUint16(b[8:10], 600)
+	if _, err := parseDirectory(b, 512); err == nil {
+		t.Errorf("parsing invalid directory did not fail")
+	}
+}
+
+// TestCompactIndexes read the map of a file with compact indexes, as mkfs.erofs writes them, which Finalize does not
+func TestCompactIndexes(t *testing.T) {
+	const blockSize = 4096
+	// six logical clusters, all of 4 bytes, as the first start 8 bytes into 32: the first 2 of 1 pcluster, then 3
+	// of another that starts 100 bytes into the third, then a plain one 50 bytes into the last, to the end of the file
+	size := uint64(6*blockSize - 100)
+	b := make([]byte, 2*blockSize)
+	in := &inode{layout: layoutCompressedCompact, mode: modeRegular | 0o644, nlink: 1, size: size}
+	copy(b, in.toBytes())
+	// the map header, of lz4
+	b[inodeCompactSize+6] = byte(algorithmLz4)
+	packs := [][2]uint16{
+		{uint16(lclusterHead1) << 12, uint16(lclusterNonHead)<<12 | 1},
+		// the last of a pack is the distance to the next head
+		{uint16(lclusterHead1)<<12 | 100, uint16(lclusterNonHead)<<12 | 2},
+		{uint16(lclusterNonHead)<<12 | 2, uint16(lclusterPlain)<<12 | 50},
+	}
+	for i, p := range packs {
+		pack := b[inodeCompactSize+mapHeaderSize+i*8:]
+		binary.LittleEndian.PutUint16(pack[0:2], p[0])
+		binary.LittleEndian.PutUint16(pack[2:4], p[1])
+		// the block before that of the first head of the pack
+		binary.LittleEndian.PutUint32(pack[4:8], uint32(10*(i+1)))
+	}
+	backend, err := mem.NewFromBytes(b, true)
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	fs := &FileSystem{
+		backend:    backend,
+		size:       int64(len(b)),
+		superblock: &superblock{blockBits: 12},
+	}
+	parsed, err := fs.readInode(0)
+	if err != nil {
+		t.Fatalf("error reading inode: %v", err)
+	}
+	z, err := fs.newZmap(parsed)
+	if err != nil {
+		t.Fatalf("error reading map: %v", err)
+	}
+	tests := []struct {
+		off      int64
+		expected extent
+	}{
+		{0, extent{logical: 0, length: 2*blockSize + 100, physical: 11 * blockSize, size: blockSize}},
+		{2*blockSize + 99, extent{logical: 0, length: 2*blockSize + 100, physical: 11 * blockSize, size: blockSize}},
+		{2*blockSize + 100, extent{logical: 2*blockSize + 100, length: 3*blockSize - 50, physical: 21 * blockSize, size: blockSize}},
+		{4 * blockSize, extent{logical: 2*blockSize + 100, length: 3*blockSize - 50, physical: 21 * blockSize, size: blockSize}},
+		{5*blockSize + 60, extent{logical: 5*blockSize + 50, length: blockSize - 150, physical: 31 * blockSize, size: blockSize, plain: true}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.off), func(t *testing.T) {
+			e, err := z.mapExtent(tt.off)
+			if err != nil {
+				t.Fatalf("error mapping extent: %v", err)
+			}
+			if *e != tt.expected {
+				t.Errorf("extent %+v, expected %+v", *e, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadAllTooLarge(t *testing.T) {
+	backend, err := mem.New(2 * 4096)
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	fs := &FileSystem{
+		backend:    backend,
+		size:       2 * 4096,
+		superblock: &superblock{blockBits: 12, blocks: 2},
+	}
+	for _, mode := range []uint16{modeDirectory | 0o755, modeSymlink | 0o777} {
+		in := &inode{layout: layoutFlatPlain, mode: mode, nlink: 1, size: 1 << 46}
+		if _, err := fs.readAll(in); err == nil || !strings.Contains(err.Error(), "larger than the filesystem") {
+			t.Errorf("reading inode of mode %o larger than the filesystem gave %v", mode, err)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package erofs_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/erofs"
+	"github.com/diskfs/go-diskfs/testhelper"
+	"github.com/google/uuid"
+)
+
+const (
+	testImageSize  = 4 << 20
+	imgFile        = "testdata/dist/erofs.img"
+	randomDataFile = "testdata/dist/random.dat"
+)
+
+var (
+	testModTime = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	testUUID    = uuid.MustParse("0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0")
+)
+
+// TestMain sets up the test environment and runs the tests
+func TestMain(m *testing.M) {
+	// Check and generate the image made by mkfs.erofs if necessary
+	if err := testhelper.BuildImage(imgFile); err != nil {
+		println("error generating test artifacts for erofs", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testContents the regular files of the test tree, by path
+func testContents() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 50000)
+	_, _ = r.Read(random)
+	var mixed []byte
+	for i := 0; len(mixed) < 70000; i++ {
+		if i%3 == 0 {
+			mixed = append(mixed, random[i*100:i*100+1500]...)
+		} else {
+			mixed = append(mixed, []byte(fmt.Sprintf("line %d of a file that compresses well\n", i))...)
+		}
+	}
+	return map[string][]byte{
+		"/empty":             {},
+		"/small.txt":         []byte("hello erofs\n"),
+		"/dir/random.bin":    random,
+		"/dir/text.txt":      bytes.Repeat([]byte("the same line, over and over again\n"), 3000),
+		"/dir/sub/mixed.dat": mixed,
+		"/dir/sub/block":     bytes.Repeat([]byte{0xa5}, 4096),
+	}
+}
+
+// createTestFilesystem create a filesystem with the test tree in its workspace
+func createTestFilesystem(t *testing.T, blocksize int64) (*erofs.FileSystem, *mem.Buffer) {
+	t.Helper()
+	b, err := mem.New(testImageSize)
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	fs, err := erofs.Create(b, testImageSize, 0, blocksize)
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	t.Cleanup(func() {
+		if ws := fs.Workspace(); ws != "" {
+			os.RemoveAll(ws)
+		}
+	})
+	if err := fs.Mkdir("/dir/sub"); err != nil {
+		t.Fatalf("error making directory: %v", err)
+	}
+	for p, content := range testContents() {
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("error creating %s: %v", p, err)
+		}
+		if _, err := f.Write(content); err != nil {
+			t.Fatalf("error writing %s: %v", p, err)
+		}
+		f.Close()
+	}
+	if err := fs.Symlink("dir/text.txt", "/link"); err != nil {
+		t.Fatalf("error making symlink: %v", err)
+	}
+	if err := fs.Link("/small.txt", "/dir/hardlink"); err != nil {
+		t.Fatalf("error making hard link: %v", err)
+	}
+	if err := fs.Chmod("/small.txt", 0o600); err != nil {
+		t.Fatalf("error changing mode: %v", err)
+	}
+	if err := fs.SetLabel("testerofs"); err != nil {
+		t.Fatalf("error setting label: %v", err)
+	}
+	return fs, b
+}
+
+func TestFinalize(t *testing.T) {
+	uid, gid := uint32(1000), uint32(70000)
+	tests := []struct {
+		name       string
+		blocksize  int64
+		compressor erofs.Compressor
+	}{
+		{"uncompressed", 4096, nil},
+		{"lz4", 4096, &erofs.CompressorLz4{}},
+		{"lz4hc", 4096, &erofs.CompressorLz4{HighCompression: true}},
+		{"zstd", 4096, &erofs.CompressorZstd{}},
+		{"uncompressed 512", 512, nil},
+		{"lz4 1024", 1024, &erofs.CompressorLz4{}},
+		{"zstd 512", 512, &erofs.CompressorZstd{CompressionLevel: 19}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, b := createTestFilesystem(t, tt.blocksize)
+			options := erofs.FinalizeOptions{
+				Compression: tt.compressor,
+				FileUID:     &uid,
+				FileGID:     &gid,
+				ModTime:     testModTime,
+				UUID:        testUUID,
+			}
+			estimate, err := fs.EstimateSize(options)
+			if err != nil {
+				t.Fatalf("error estimating size: %v", err)
+			}
+			if err := fs.Finalize(options); err != nil {
+				t.Fatalf("error finalizing: %v", err)
+			}
+			if fs.Workspace() != "" {
+				t.Errorf("workspace still set after finalizing")
+			}
+			if used := fs.Usage().Size; used != estimate {
+				t.Errorf("image is %d bytes, estimated %d", used, estimate)
+			}
+			if err := fs.Finalize(options); err == nil {
+				t.Errorf("finalizing twice did not fail")
+			}
+
+			// read it back, both through the same FileSystem and afresh
+			read, err := erofs.Read(b, testImageSize, 0, 0)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			if !read.Equal(fs) {
+				t.Errorf("filesystem read back is not the one finalized")
+			}
+			if read.Label() != "testerofs" {
+				t.Errorf("label %q, expected %q", read.Label(), "testerofs")
+			}
+			if read.UUID() != testUUID.String() {
+				t.Errorf("UUID %q, expected %q", read.UUID(), testUUID.String())
+			}
+			if read.Type() != filesystem.TypeErofs {
+				t.Errorf("type %v, expected %v", read.Type(), filesystem.TypeErofs)
+			}
+			checkTestFilesystem(t, read, uid, gid)
+		})
+	}
+}
+
+// checkTestFilesystem check that fs has the test tree
+func checkTestFilesystem(t *testing.T, fs *erofs.FileSystem, uid, gid uint32) {
+	t.Helper()
+	for p, content := range testContents() {
+		f, err := fs.OpenFile(p, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", p, err)
+		}
+		got, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", p, err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s has %d bytes that do not match the %d written", p, len(got), len(content))
+		}
+		// and part of the way in
+		if len(content) > 10000 {
+			if _, err := f.Seek(9000, io.SeekStart); err != nil {
+				t.Fatalf("error seeking %s: %v", p, err)
+			}
+			part := make([]byte, 1000)
+			if _, err := io.ReadFull(f, part); err != nil {
+				t.Fatalf("error reading %s after seeking: %v", p, err)
+			}
+			if !bytes.Equal(part, content[9000:10000]) {
+				t.Errorf("%s does not match after seeking", p)
+			}
+		}
+		f.Close()
+	}
+
+	entries, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if expected := []string{"hardlink", "random.bin", "sub", "text.txt"}; fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Errorf("directory has %v, expected %v", names, expected)
+	}
+
+	fi, err := fs.Stat("/small.txt")
+	if err != nil {
+		t.Fatalf("error getting information of file: %v", err)
+	}
+	info, ok := fi.Sys().(*erofs.FileInfo)
+	if !ok {
+		t.Fatalf("Sys() is %T, not *erofs.FileInfo", fi.Sys())
+	}
+	if fi.Mode() != 0o600 {
+		t.Errorf("mode %v, expected %v", fi.Mode(), os.FileMode(0o600))
+	}
+	if info.UID() != uid || info.GID() != gid {
+		t.Errorf("owner %d:%d, expected %d:%d", info.UID(), info.GID(), uid, gid)
+	}
+	if info.Nlink() != 2 {
+		t.Errorf("%d links, expected 2", info.Nlink())
+	}
+	if !fi.ModTime().Equal(testModTime) && fi.ModTime().Before(testModTime) {
+		t.Errorf("modification time %v is before that of the image %v", fi.ModTime(), testModTime)
+	}
+	hardlink, err := fs.Stat("/dir/hardlink")
+	if err != nil {
+		t.Fatalf("error getting information of hard link: %v", err)
+	}
+	if hardlink.Sys().(*erofs.FileInfo).Inode() != info.Inode() {
+		t.Errorf("hard link has a different inode")
+	}
+
+	fi, err = fs.Stat("/link")
+	if err != nil {
+		t.Fatalf("error getting information of symlink: %v", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("mode %v is not of a symlink", fi.Mode())
+	}
+	if target, err := fi.Sys().(*erofs.FileInfo).Readlink(); err != nil || target != "dir/text.txt" {
+		t.Errorf("symlink to %q (%v), expected %q", target, err, "dir/text.txt")
+	}
+
+	fi, err = fs.Stat("/dir/sub")
+	if err != nil {
+		t.Fatalf("error getting information of directory: %v", err)
+	}
+	if !fi.IsDir() {
+		t.Errorf("mode %v is not of a directory", fi.Mode())
+	}
+	if _, err := fs.Stat("/dir/missing"); err == nil {
+		t.Errorf("information of missing file did not fail")
+	}
+}
+
+func TestFinalizeReproducible(t *testing.T) {
+	images := make([][]byte, 2)
+	for i := range images {
+		fs, b := createTestFilesystem(t, 4096)
+		// the same times in the workspace as well, which cannot be set for a symlink
+		if err := fs.Remove("/link"); err != nil {
+			t.Fatalf("error removing symlink: %v", err)
+		}
+		err := filepath.Walk(fs.Workspace(), func(p string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(p, testModTime, testModTime)
+		})
+		if err != nil {
+			t.Fatalf("error setting times: %v", err)
+		}
+		if err := fs.Finalize(erofs.FinalizeOptions{Compression: &erofs.CompressorLz4{}, ModTime: testModTime, UUID: testUUID}); err != nil {
+			t.Fatalf("error finalizing: %v", err)
+		}
+		images[i] = b.Bytes()
+	}
+	if !bytes.Equal(images[0], images[1]) {
+		t.Errorf("images of the same contents are not the same")
+	}
+}
+
+func TestFinalizeTooSmall(t *testing.T) {
+	b, err := mem.New(testImageSize)
+	if err != nil {
+		t.Fatalf("could not create backend: %v", err)
+	}
+	fs, err := erofs.Create(b, 8192, 0, 4096)
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	defer os.RemoveAll(fs.Workspace())
+	if err := os.WriteFile(filepath.Join(fs.Workspace(), "big"), make([]byte, 10000), 0o644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := fs.Finalize(erofs.FinalizeOptions{}); err == nil {
+		t.Errorf("finalizing into too small a filesystem did not fail")
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	fs, _ := createTestFilesystem(t, 4096)
+	if err := fs.Finalize(erofs.FinalizeOptions{}); err != nil {
+		t.Fatalf("error finalizing: %v", err)
+	}
+	if _, err := fs.OpenFile("/small.txt", os.O_RDWR); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("opening for writing gave %v, expected %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+	f, err := fs.OpenFile("/small.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("writing gave %v, expected %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+	for name, op := range map[string]func() error{
+		"Mkdir":    func() error { return fs.Mkdir("/new") },
+		"Remove":   func() error { return fs.Remove("/small.txt") },
+		"Rename":   func() error { return fs.Rename("/small.txt", "/other.txt") },
+		"Symlink":  func() error { return fs.Symlink("small.txt", "/other") },
+		"Chmod":    func() error { return fs.Chmod("/small.txt", 0o644) },
+		"SetLabel": func() error { return fs.SetLabel("other") },
+	} {
+		if err := op(); err == nil {
+			t.Errorf("%s on a finalized filesystem did not fail", name)
+		}
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	fs := testhelper.ReadImage(t, imgFile, erofs.Read)
+	if label := fs.Label(); label != "diskfs" {
+		t.Errorf("label %q instead of %q", label, "diskfs")
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	for _, name := range []string{"shortfile.txt", "foo", "random.dat", "compressible.txt", "symlink.dat"} {
+		if !found[name] {
+			t.Errorf("root directory does not have %s", name)
+		}
+	}
+	entries, err = fs.ReadDir("/foo")
+	if err != nil {
+		t.Fatalf("error reading /foo: %v", err)
+	}
+	if len(entries) != 1001 {
+		t.Errorf("/foo has %d entries instead of 1001", len(entries))
+	}
+
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("error reading random data file %s: %v", randomDataFile, err)
+	}
+	// as yes and head make it in buildimg.sh
+	compressible := bytes.Repeat([]byte("This is a compressible line\n"), 1000000/28+1)[:1000000]
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{"/shortfile.txt", []byte("This is a short file\n")},
+		{"/foo/subdirfile.txt", []byte("This is a subdir file\n")},
+		{"/random.dat", randomData},
+		{"/compressible.txt", compressible},
+	} {
+		f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", tt.path, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", tt.path, err)
+		}
+		if !bytes.Equal(b, tt.content) {
+			t.Errorf("%s has %d bytes that do not match the %d expected", tt.path, len(b), len(tt.content))
+		}
+	}
+	target, err := fs.Readlink("/symlink.dat")
+	if err != nil {
+		t.Fatalf("error reading link: %v", err)
+	}
+	if target != "random.dat" {
+		t.Errorf("link target %q instead of %q", target, "random.dat")
+	}
+}
@@ -0,0 +1,248 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// dataReader read the data of an inode, whatever its layout, keeping the last extent of a compressed one, as reads
+// are most often in order
+type dataReader struct {
+	fs *FileSystem
+	in *inode
+	// zmap the extents of a compressed inode
+	zmap         *zmap
+	decompressor decompressor
+	extent       *extent
+	extentData   []byte
+}
+
+// newDataReader make a reader of the data of an inode, checking that its layout can be read
+func (fs *FileSystem) newDataReader(in *inode) (*dataReader, error) {
+	r := &dataReader{fs: fs, in: in}
+	switch {
+	case in.size == 0:
+	case in.isCompressed():
+		z, err := fs.newZmap(in)
+		if err != nil {
+			return nil, err
+		}
+		r.zmap = z
+	case in.layout == layoutFlatInline:
+		// the tail is after the inode, in the same block
+		blockSize := fs.superblock.blockSize()
+		tail := int64(in.size) - (int64(in.size)-1)/blockSize*blockSize
+		if pos := r.tailOffset(); pos%blockSize+tail > blockSize {
+			return nil, fmt.Errorf("inline data of inode %d crosses a block", in.nid)
+		}
+	case in.layout == layoutChunkBased:
+		if in.raw&chunkFormatIndexes == 0 && in.raw&^chunkFormatBlkBitsMask != 0 {
+			return nil, fmt.Errorf("unknown chunk format %#x of inode %d", in.raw, in.nid)
+		}
+	}
+	return r, nil
+}
+
+// tailOffset where the data after the inode is, its inline tail or chunk indexes
+func (r *dataReader) tailOffset() int64 {
+	return r.fs.inodeOffset(r.in.nid) + r.in.inodeSize() + r.in.xattrSize()
+}
+
+// readAt read the data at off into b, as io.ReaderAt
+func (r *dataReader) readAt(b []byte, off int64) (int, error) {
+	size := int64(r.in.size)
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if int64(n) > size-off {
+		n = int(size - off)
+	}
+	var err error
+	switch {
+	case r.zmap != nil:
+		err = r.readCompressed(b[:n], off)
+	case r.in.layout == layoutChunkBased:
+		err = r.readChunks(b[:n], off)
+	case r.in.layout == layoutFlatPlain || r.in.layout == layoutFlatInline:
+		err = r.readFlat(b[:n], off)
+	default:
+		err = fmt.Errorf("data layout %v of inode %d", r.in.layout, r.in.nid)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readFlat read the data of a flat inode, from its blocks, and the tail after the inode if it is inline
+func (r *dataReader) readFlat(b []byte, off int64) error {
+	blockSize := r.fs.superblock.blockSize()
+	size := int64(r.in.size)
+	tailStart := size
+	if r.in.layout == layoutFlatInline {
+		tailStart = (size - 1) / blockSize * blockSize
+	}
+	if off < tailStart {
+		n := int(min(int64(len(b)), tailStart-off))
+		p, err := r.fs.readBytes(int64(r.in.raw)*blockSize+off, n)
+		if err != nil {
+			return err
+		}
+		copy(b, p)
+		b, off = b[n:], off+int64(n)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	p, err := r.fs.readBytes(r.tailOffset()+off-tailStart, len(b))
+	if err != nil {
+		return err
+	}
+	copy(b, p)
+	return nil
+}
+
+// readChunks read the data of a chunk-based inode, chunk by chunk; a chunk without blocks is a hole, of zeros
+func (r *dataReader) readChunks(b []byte, off int64) error {
+	blockBits := uint(r.fs.superblock.blockBits)
+	chunkBits := blockBits + uint(r.in.raw&chunkFormatBlkBitsMask)
+	chunkSize := int64(1) << chunkBits
+	for len(b) > 0 {
+		chunk := off >> chunkBits
+		within := off & (chunkSize - 1)
+		n := int(min(int64(len(b)), chunkSize-within))
+		var blk uint64
+		if r.in.raw&chunkFormatIndexes != 0 {
+			idx, err := r.fs.readBytes((r.tailOffset()+7)&^7+chunk*chunkIndexSize, chunkIndexSize)
+			if err != nil {
+				return err
+			}
+			blk = uint64(binary.LittleEndian.Uint32(idx[4:8]))
+			if r.in.raw&chunkFormat48Bit != 0 && blk != uint64(nullAddr) {
+				blk |= uint64(binary.LittleEndian.Uint16(idx[0:2])) << 32
+			}
+		} else {
+			idx, err := r.fs.readBytes(r.tailOffset()+chunk*chunkBlockMapSize, chunkBlockMapSize)
+			if err != nil {
+				return err
+			}
+			blk = uint64(binary.LittleEndian.Uint32(idx))
+		}
+		if blk == uint64(nullAddr) {
+			clear(b[:n])
+		} else {
+			p, err := r.fs.readBytes(int64(blk<<blockBits)+within, n)
+			if err != nil {
+				return err
+			}
+			copy(b, p)
+		}
+		b, off = b[n:], off+int64(n)
+	}
+	return nil
+}
+
+// readCompressed read the data of a compressed inode, extent by extent
+func (r *dataReader) readCompressed(b []byte, off int64) error {
+	for len(b) > 0 {
+		if r.extent == nil || off < r.extent.logical || off >= r.extent.logical+r.extent.length {
+			e, err := r.zmap.mapExtent(off)
+			if err != nil {
+				return err
+			}
+			data, err := r.zmap.readExtent(e, &r.decompressor)
+			if err != nil {
+				return err
+			}
+			r.extent, r.extentData = e, data
+		}
+		n := copy(b, r.extentData[off-r.extent.logical:])
+		b, off = b[n:], off+int64(n)
+	}
+	return nil
+}
+
+// readAll read all of the data of an inode, as for a directory or symbolic link, which cannot be larger than
+// the filesystem
+func (fs *FileSystem) readAll(in *inode) ([]byte, error) {
+	if fsSize := uint64(fs.superblock.blocks) * uint64(fs.superblock.blockSize()); in.size > fsSize {
+		return nil, fmt.Errorf("inode %d of %d bytes is larger than the filesystem of %d bytes", in.nid, in.size, fsSize)
+	}
+	r, err := fs.newDataReader(in)
+	if err != nil {
+		return nil, err
+	}
+	defer r.decompressor.close()
+	b := make([]byte, in.size)
+	if _, err := r.readAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// File represents a single file in an EROFS filesystem
+type File struct {
+	*dataReader
+	offset int64
+	closed bool
+}
+
+// Read reads up to len(b) bytes from the File.
+// It returns the number of bytes read and any error encountered.
+// At end of file, Read returns 0, io.EOF
+// reads from the last known offset in the file from last read
+// use Seek() to set at a particular point
+func (fl *File) Read(b []byte) (int, error) {
+	if fl == nil || fl.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := fl.readAt(b, fl.offset)
+	fl.offset += int64(n)
+	return n, err
+}
+
+// Write writes len(b) bytes to the File.
+//
+//	EROFS is read-only once finalized, so this returns an error
+func (fl *File) Write(_ []byte) (int, error) {
+	return 0, filesystem.ErrReadonlyFilesystem
+}
+
+// Seek set the offset to a particular point in the file
+func (fl *File) Seek(offset int64, whence int) (int64, error) {
+	if fl == nil || fl.closed {
+		return 0, os.ErrClosed
+	}
+	newOffset := int64(0)
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekEnd:
+		newOffset = int64(fl.in.size) + offset
+	case io.SeekCurrent:
+		newOffset = fl.offset + offset
+	}
+	if newOffset < 0 {
+		return fl.offset, fmt.Errorf("cannot set offset %d before start of file", offset)
+	}
+	fl.offset = newOffset
+	return fl.offset, nil
+}
+
+// Close close the file
+func (fl *File) Close() error {
+	if fl != nil && !fl.closed {
+		fl.decompressor.close()
+		fl.extent, fl.extentData = nil, nil
+	}
+	fl.closed = true
+	return nil
+}
@@ -0,0 +1,113 @@
+package erofs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileInfo represents the information for an individual file
+// it fulfills os.FileInfo interface
+type FileInfo struct {
+	modTime    time.Time
+	mode       os.FileMode
+	name       string
+	size       int64
+	uid        uint32
+	gid        uint32
+	linkTarget string
+	nid        uint64
+	hardLinks  uint32
+	rdev       uint32
+}
+
+// newFileInfo create the FileInfo for a file with the given name, from its inode
+func (fs *FileSystem) newFileInfo(in *inode, name string) (*FileInfo, error) {
+	fi := &FileInfo{
+		modTime:   in.mtime,
+		mode:      in.fileMode(),
+		name:      name,
+		size:      int64(in.size),
+		uid:       in.uid,
+		gid:       in.gid,
+		nid:       in.nid,
+		hardLinks: in.nlink,
+	}
+	if in.hasDevice() {
+		fi.rdev = in.raw
+	}
+	if fi.mode&os.ModeSymlink != 0 {
+		target, err := fs.readAll(in)
+		if err != nil {
+			return nil, err
+		}
+		fi.linkTarget = string(target)
+	}
+	return fi, nil
+}
+
+// IsDir abbreviation for Mode().IsDir()
+func (fi *FileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+// ModTime modification time, which is also the time of access and of change, as EROFS keeps only the one
+func (fi *FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// Mode returns file mode
+func (fi *FileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// Name base name of the file
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+// Size length in bytes for regular files
+func (fi *FileInfo) Size() int64 {
+	return fi.size
+}
+
+// Sys underlying data source, which is the *FileInfo itself, for its owner, link target and the rest of the
+// metadata of its inode
+func (fi *FileInfo) Sys() interface{} {
+	return fi
+}
+
+// UID get uid of file
+func (fi *FileInfo) UID() uint32 {
+	return fi.uid
+}
+
+// GID get gid of file
+func (fi *FileInfo) GID() uint32 {
+	return fi.gid
+}
+
+// Readlink returns the destination of the symbolic link if this entry is a symbolic link.
+//
+// If this entry is not a symbolic link then it will return fs.ErrNotExist
+func (fi *FileInfo) Readlink() (string, error) {
+	if fi.mode&os.ModeSymlink == 0 {
+		return "", fs.ErrNotExist
+	}
+	return fi.linkTarget, nil
+}
+
+// Inode get the number of the inode of the file, which is its nid, as the kernel gives it
+func (fi *FileInfo) Inode() uint64 {
+	return fi.nid
+}
+
+// Nlink get the number of hard links to the file
+func (fi *FileInfo) Nlink() uint64 {
+	return uint64(fi.hardLinks)
+}
+
+// Device get the major and minor numbers of a block or character device; 0 for other files
+func (fi *FileInfo) Device() (major, minor uint32) {
+	return decodeDevice(fi.rdev)
+}
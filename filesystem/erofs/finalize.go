@@ -0,0 +1,615 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxExtentBlocks the most blocks of a file that are compressed into each pcluster, so the window of compression
+const maxExtentBlocks = 16
+
+// copyBufferSize how much of a file is copied into the image at once
+const copyBufferSize = 1 << 20
+
+// FinalizeOptions options to pass to finalize
+type FinalizeOptions struct {
+	// Compression compress regular files larger than a block with it, CompressorLz4 or CompressorZstd, including
+	// their options. Defaults to nil, which leaves the data uncompressed, as mkfs.erofs does without -z.
+	Compression Compressor
+	// FileUID set all files to be owned by the UID provided, default is to leave as in filesystem
+	FileUID *uint32
+	// FileGID set all files to be owned by the GID provided, default is to leave as in filesystem
+	FileGID *uint32
+	// ModTime the time the image is made, kept in the superblock, which is also the mtime of each file that has the
+	// same, as its inode can then be compact. Defaults to now.
+	ModTime time.Time
+	// UUID the UUID of the filesystem. Defaults to a random one; set it, and ModTime, for the same contents to give
+	// the same image byte for byte each time.
+	UUID uuid.UUID
+}
+
+// Finalize finalize a read-only filesystem by writing it out to a read-only format. Once finalized, the image
+// can be read through the same FileSystem.
+func (fs *FileSystem) Finalize(options FinalizeOptions) error {
+	if fs.workspace == "" {
+		return fmt.Errorf("cannot finalize an already finalized filesystem")
+	}
+	f, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	if _, err := fs.finalize(&offsetWriter{w: f, start: fs.start, size: fs.size}, options); err != nil {
+		return err
+	}
+
+	// finish by setting as finalized
+	fs.workspace = ""
+	return fs.readSuperblock()
+}
+
+// EstimateSize returns the size in bytes of the image that Finalize would write, given the current contents
+// of the workspace and the same options, so that the backing storage can be sized before calling Finalize.
+// As the size depends on how well everything compresses, this does all of the work of Finalize, including
+// the compression, but discards the output.
+func (fs *FileSystem) EstimateSize(options FinalizeOptions) (int64, error) {
+	if fs.workspace == "" {
+		return 0, fmt.Errorf("cannot estimate the size of an already finalized filesystem")
+	}
+	return fs.finalize(discardWriter{}, options)
+}
+
+// discardWriter an io.WriterAt that discards everything written to it
+type discardWriter struct{}
+
+func (discardWriter) WriteAt(p []byte, _ int64) (int, error) {
+	return len(p), nil
+}
+
+// offsetWriter an io.WriterAt for a filesystem that starts at start of w, and must not go past size
+type offsetWriter struct {
+	w     io.WriterAt
+	start int64
+	size  int64
+}
+
+func (o *offsetWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > o.size {
+		return 0, fmt.Errorf("image is larger than the filesystem of %d bytes", o.size)
+	}
+	return o.w.WriteAt(p, o.start+off)
+}
+
+// finalize write the filesystem in the workspace out to f, returning the size of the image in bytes
+func (fs *FileSystem) finalize(f io.WriterAt, options FinalizeOptions) (int64, error) {
+	modTime := options.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	id := options.UUID
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
+	nodes, err := walkTree(fs.workspace, options)
+	if err != nil {
+		return 0, err
+	}
+	w := &imageWriter{
+		f:          f,
+		blockSize:  fs.blocksize,
+		buildTime:  modTime,
+		compressor: options.Compression,
+	}
+	sb := &superblock{
+		compat:     featureCompatSbChksum,
+		buildTime:  modTime,
+		uuid:       id,
+		volumeName: fs.label,
+		inodes:     uint64(len(nodes)),
+	}
+	for sb.blockSize() < fs.blocksize {
+		sb.blockBits++
+	}
+	return w.write(sb, nodes)
+}
+
+// finalizeNode a file or directory of the workspace, as it is written to the image
+type finalizeNode struct {
+	hostPath string
+	name     string
+	mode     uint16
+	uid      uint32
+	gid      uint32
+	mtime    time.Time
+	size     int64
+	rdev     uint32
+	parent   *finalizeNode
+	children []*finalizeNode
+	// link the node of the first name of a file that has more than one, whose inode this name shares
+	link  *finalizeNode
+	nlink uint32
+	in    *inode
+	// data the entries of a directory, or the target of a symbolic link
+	data []byte
+	// inline whether the last block of the data is after the inode, and tail that block
+	inline bool
+	tail   []byte
+	// indexes the map header and indexes of a compressed file
+	indexes []byte
+}
+
+// walkTree walk the workspace, returning its files and directories in the order they are written, the root first,
+// as the superblock has only 16 bits for its nid, and the rest breadth first, each directory by name. A file with
+// more than one name is listed once, under the first of them.
+func walkTree(workspace string, options FinalizeOptions) ([]*finalizeNode, error) {
+	fi, err := os.Lstat(workspace)
+	if err != nil {
+		return nil, fmt.Errorf("could not read workspace: %v", err)
+	}
+	root := newFinalizeNode(workspace, "", fi, options)
+	root.parent = root
+	nodes := []*finalizeNode{root}
+	type fileID struct{ dev, ino uint64 }
+	links := map[fileID]*finalizeNode{}
+	for i := 0; i < len(nodes); i++ {
+		dir := nodes[i]
+		if dir.mode&modeTypeMask != modeDirectory {
+			continue
+		}
+		entries, err := os.ReadDir(dir.hostPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %v", dir.hostPath, err)
+		}
+		for _, e := range entries {
+			hostPath := filepath.Join(dir.hostPath, e.Name())
+			fi, err := e.Info()
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %v", hostPath, err)
+			}
+			n := newFinalizeNode(hostPath, e.Name(), fi, options)
+			n.parent = dir
+			dir.children = append(dir.children, n)
+			if n.mode&modeTypeMask == modeDirectory {
+				dir.nlink++
+			} else if _, _, dev, ino, _ := getFileProperties(fi); ino != 0 {
+				id := fileID{dev: dev, ino: ino}
+				if first, ok := links[id]; ok {
+					n.link = first
+					first.nlink++
+					continue
+				}
+				links[id] = n
+			}
+			if n.mode&modeTypeMask == modeSymlink {
+				target, err := os.Readlink(hostPath)
+				if err != nil {
+					return nil, fmt.Errorf("could not read symbolic link %s: %v", hostPath, err)
+				}
+				n.data = []byte(target)
+				n.size = int64(len(target))
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// newFinalizeNode a node for a file or directory of the workspace
+func newFinalizeNode(hostPath, name string, fi os.FileInfo, options FinalizeOptions) *finalizeNode {
+	uid, gid, _, _, rdev := getFileProperties(fi)
+	if options.FileUID != nil {
+		uid = *options.FileUID
+	}
+	if options.FileGID != nil {
+		gid = *options.FileGID
+	}
+	n := &finalizeNode{
+		hostPath: hostPath,
+		name:     name,
+		mode:     unixMode(fi.Mode()),
+		uid:      uid,
+		gid:      gid,
+		mtime:    fi.ModTime(),
+		nlink:    1,
+	}
+	switch n.mode & modeTypeMask {
+	case modeRegular:
+		n.size = fi.Size()
+	case modeDirectory:
+		n.nlink = 2
+	case modeBlock, modeCharacter:
+		n.rdev = rdev
+	}
+	return n
+}
+
+// unixMode the mode of a file as unix has it, with its type
+func unixMode(m os.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= modeDirectory
+	case m&os.ModeSymlink != 0:
+		mode |= modeSymlink
+	case m&os.ModeCharDevice != 0:
+		mode |= modeCharacter
+	case m&os.ModeDevice != 0:
+		mode |= modeBlock
+	case m&os.ModeNamedPipe != 0:
+		mode |= modeFifo
+	case m&os.ModeSocket != 0:
+		mode |= modeSocket
+	default:
+		mode |= modeRegular
+	}
+	if m&os.ModeSetuid != 0 {
+		mode |= modeSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= modeSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= modeSticky
+	}
+	return mode
+}
+
+// fileType the file type of the node, for its entry in its directory
+func (n *finalizeNode) fileType() uint8 {
+	switch n.mode & modeTypeMask {
+	case modeRegular:
+		return fileTypeRegular
+	case modeDirectory:
+		return fileTypeDirectory
+	case modeCharacter:
+		return fileTypeCharacter
+	case modeBlock:
+		return fileTypeBlock
+	case modeFifo:
+		return fileTypeFifo
+	case modeSocket:
+		return fileTypeSocket
+	case modeSymlink:
+		return fileTypeSymlink
+	default:
+		return fileTypeUnknown
+	}
+}
+
+// nid the nid of the inode of the node, which is that of the first name of a file with more than one
+func (n *finalizeNode) nid() uint64 {
+	if n.link != nil {
+		return n.link.in.nid
+	}
+	return n.in.nid
+}
+
+// directoryEntries the entries of a directory, with . and ..
+func (n *finalizeNode) directoryEntries() []*directoryEntry {
+	entries := []*directoryEntry{
+		{name: ".", nid: n.in.nid, fileType: fileTypeDirectory},
+		{name: "..", nid: n.parent.in.nid, fileType: fileTypeDirectory},
+	}
+	for _, c := range n.children {
+		target := c
+		if c.link != nil {
+			target = c.link
+		}
+		entries = append(entries, &directoryEntry{name: c.name, nid: c.nid(), fileType: target.fileType()})
+	}
+	return entries
+}
+
+// compressed whether the data of the node is compressed, which is only worth it for regular files of more than
+// a block
+func (w *imageWriter) compressed(n *finalizeNode) bool {
+	return w.compressor != nil && n.mode&modeTypeMask == modeRegular && n.size > w.blockSize
+}
+
+// imageWriter write the nodes of a tree out as an image
+type imageWriter struct {
+	f          io.WriterAt
+	blockSize  int64
+	buildTime  time.Time
+	compressor Compressor
+}
+
+// write the image, with the superblock and any configuration of the compression in the first block, then the
+// inodes, then the data, returning the size of the image in bytes
+func (w *imageWriter) write(sb *superblock, nodes []*finalizeNode) (int64, error) {
+	bs := w.blockSize
+	var configs []byte
+	window := int(bs) * maxExtentBlocks
+	if w.compressor != nil {
+		sb.incompat |= featureIncompatZeroPadding
+		if cfg := w.compressor.config(window); cfg != nil {
+			sb.incompat |= featureIncompatComprCfgs
+			sb.algorithms = 1 << w.compressor.algorithm()
+			configs = configRecord(cfg)
+		}
+	}
+	sb.metaBlkAddr = uint32((superblockOffset + superblockSize + int64(len(configs)) + bs - 1) / bs)
+	metaStart := int64(sb.metaBlkAddr) * bs
+
+	// the inodes, each with its inline tail or compressed indexes; directories are laid out with nids of 0 for
+	// their sizes, and again once the nids are known
+	for i, n := range nodes {
+		n.in = &inode{mode: n.mode, nlink: n.nlink, size: uint64(n.size), ino: uint32(i + 1), uid: n.uid, gid: n.gid, mtime: n.mtime}
+	}
+	for _, n := range nodes {
+		if n.in.isDir() {
+			n.data = directoryBytes(n.directoryEntries(), int(bs))
+			n.in.size = uint64(len(n.data))
+		}
+	}
+	pos := metaStart
+	for _, n := range nodes {
+		in := n.in
+		in.extended = !in.mtime.Equal(w.buildTime) || in.uid > 0xffff || in.gid > 0xffff || in.nlink > 0xffff || in.size > 0xffffffff
+		pos = (pos + slotSize - 1) &^ (slotSize - 1)
+		length := in.inodeSize()
+		switch {
+		case w.compressed(n):
+			in.layout = layoutCompressedFull
+			clusters := (in.size + uint64(bs) - 1) / uint64(bs)
+			length += mapHeaderSize + 8 + int64(clusters)*fullIndexSize
+		case in.size > 0:
+			in.layout = layoutFlatPlain
+			tail := int64(in.size) - (int64(in.size)-1)/bs*bs
+			// the tail is inline where it fits in the block after the inode, or in the next block if that wastes
+			// less than a block of its own would
+			if in.inodeSize()+tail <= bs {
+				if used := pos % bs; used+in.inodeSize()+tail > bs && bs-used <= bs-tail {
+					pos += bs - used
+				}
+				if pos%bs+in.inodeSize()+tail <= bs {
+					in.layout = layoutFlatInline
+					n.inline = true
+					length += tail
+				}
+			}
+		}
+		in.nid = uint64(pos-metaStart) >> slotBits
+		pos += length
+	}
+	if nodes[0].in.nid > 0xffff {
+		return 0, fmt.Errorf("root directory has nid %d, which does not fit in the superblock", nodes[0].in.nid)
+	}
+	for _, n := range nodes {
+		if n.in.isDir() {
+			n.data = directoryBytes(n.directoryEntries(), int(bs))
+		}
+	}
+
+	// the data, after the inodes
+	next := (pos + bs - 1) / bs
+	var enc encoder
+	if w.compressor != nil {
+		var err error
+		if enc, err = w.compressor.encoder(window); err != nil {
+			return 0, err
+		}
+		defer enc.close()
+	}
+	for _, n := range nodes {
+		var err error
+		switch {
+		case n.in.hasDevice():
+			n.in.raw = n.rdev
+		case n.in.layout == layoutCompressedFull:
+			next, err = w.writeCompressed(n, enc, next)
+		case n.in.size > 0:
+			next, err = w.writeFlat(n, next)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if next > int64(nullAddr) {
+			return 0, fmt.Errorf("image of %d blocks is larger than EROFS allows", next)
+		}
+	}
+
+	meta := make([]byte, pos-metaStart)
+	for _, n := range nodes {
+		off := n.in.nid << slotBits
+		off += uint64(copy(meta[off:], n.in.toBytes()))
+		switch {
+		case n.inline:
+			copy(meta[off:], n.tail)
+		case n.indexes != nil:
+			copy(meta[off:], n.indexes)
+		}
+	}
+	if _, err := w.f.WriteAt(meta, metaStart); err != nil {
+		return 0, fmt.Errorf("could not write inodes: %v", err)
+	}
+
+	sb.rootNid = uint16(nodes[0].in.nid)
+	sb.blocks = uint32(next)
+	head := make([]byte, metaStart)
+	copy(head[superblockOffset:], sb.toBytes())
+	copy(head[superblockOffset+superblockSize:], configs)
+	end := bs
+	if end > superblockOffset {
+		end -= superblockOffset
+	}
+	binary.LittleEndian.PutUint32(head[superblockOffset+4:], superblockChecksum(head[superblockOffset:superblockOffset+end]))
+	if _, err := w.f.WriteAt(head, 0); err != nil {
+		return 0, fmt.Errorf("could not write superblock: %v", err)
+	}
+	return next * bs, nil
+}
+
+// openData open the data of a node, the file on the host for a regular file, or what it holds for the rest
+func openData(n *finalizeNode) (r io.ReaderAt, closer func(), err error) {
+	if n.mode&modeTypeMask != modeRegular {
+		return bytes.NewReader(n.data), func() {}, nil
+	}
+	f, err := os.Open(n.hostPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open %s: %v", n.hostPath, err)
+	}
+	return f, func() { _ = f.Close() }, nil
+}
+
+// readData read len(b) bytes of the data of a node at off, all of which must be there
+func readData(r io.ReaderAt, n *finalizeNode, b []byte, off int64) error {
+	if _, err := r.ReadAt(b, off); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s changed while it was written", n.hostPath)
+		}
+		return fmt.Errorf("could not read %s: %v", n.hostPath, err)
+	}
+	return nil
+}
+
+// writeFlat write the data of a node in blocks from next, keeping back the tail if it is inline, returning the
+// block after them
+func (w *imageWriter) writeFlat(n *finalizeNode, next int64) (int64, error) {
+	r, closer, err := openData(n)
+	if err != nil {
+		return 0, err
+	}
+	defer closer()
+	bs := w.blockSize
+	size := int64(n.in.size)
+	inBlocks := size
+	if n.inline {
+		inBlocks = (size - 1) / bs * bs
+		n.tail = make([]byte, size-inBlocks)
+		if err := readData(r, n, n.tail, inBlocks); err != nil {
+			return 0, err
+		}
+	}
+	if inBlocks == 0 {
+		return next, nil
+	}
+	n.in.raw = uint32(next)
+	buf := make([]byte, min(copyBufferSize, (inBlocks+bs-1)/bs*bs))
+	for off := int64(0); off < inBlocks; off += int64(len(buf)) {
+		chunk := buf[:min(int64(len(buf)), inBlocks-off)]
+		if err := readData(r, n, chunk, off); err != nil {
+			return 0, err
+		}
+		// the last block is padded with zeros
+		if rem := int64(len(chunk)) % bs; rem != 0 {
+			chunk = buf[:int64(len(chunk))+bs-rem]
+			clear(chunk[len(chunk)-int(bs-rem):])
+		}
+		if _, err := w.f.WriteAt(chunk, next*bs+off); err != nil {
+			return 0, fmt.Errorf("could not write data of %s: %v", n.hostPath, err)
+		}
+	}
+	return next + (inBlocks+bs-1)/bs, nil
+}
+
+// writeCompressed compress the data of a regular file into pclusters of a block each, from next, returning the
+// block after them. Each extent starts where the one before it ends, and takes as much of the file, up to
+// maxExtentBlocks blocks, as fits in a block once compressed, or a block of it as it is, if compressing it gains
+// nothing. Its index says where in its logical cluster it starts, and those of the logical clusters it covers
+// after that how far back its head is, and how far forward the next one.
+func (w *imageWriter) writeCompressed(n *finalizeNode, enc encoder, next int64) (int64, error) {
+	r, closer, err := openData(n)
+	if err != nil {
+		return 0, err
+	}
+	defer closer()
+	bs := w.blockSize
+	size := int64(n.in.size)
+	clusters := (size + bs - 1) / bs
+	n.indexes = make([]byte, mapHeaderSize+8+clusters*fullIndexSize)
+	n.indexes[6] = byte(w.compressor.algorithm())
+	indexes := n.indexes[mapHeaderSize+8:]
+	first := next
+	window := make([]byte, bs*maxExtentBlocks)
+	block := make([]byte, bs)
+	for start := int64(0); start < size; {
+		lcn, ofs := start/bs, start%bs
+		data := window[:min(size-start, int64(len(window)))]
+		if err := readData(r, n, data, start); err != nil {
+			return 0, err
+		}
+		// only worth compressing if it is more than fits in a block as it is
+		plainLength := min(int64(len(data)), bs)
+		length, compressed, err := compressLongest(enc, data, int(plainLength)+1, int(bs))
+		if err != nil {
+			return 0, fmt.Errorf("could not compress %s: %v", n.hostPath, err)
+		}
+		typ := lclusterHead1
+		clear(block)
+		if compressed == nil {
+			typ = lclusterPlain
+			length = int(plainLength)
+			// the kernel takes the last extent to run to the end of its last lcluster, which must not be more
+			// than the block a plain extent has, so it ends at the first if it would cross into the next
+			if start+int64(length) == size && ofs+int64(length) > bs {
+				length = int(bs - ofs)
+			}
+			copy(block, data[:length])
+		} else {
+			// at the end of the block, after zeros
+			copy(block[bs-int64(len(compressed)):], compressed)
+		}
+		if _, err := w.f.WriteAt(block, next*bs); err != nil {
+			return 0, fmt.Errorf("could not write data of %s: %v", n.hostPath, err)
+		}
+		idx := indexes[lcn*fullIndexSize:]
+		binary.LittleEndian.PutUint16(idx[0:2], uint16(typ))
+		binary.LittleEndian.PutUint16(idx[2:4], uint16(ofs))
+		binary.LittleEndian.PutUint32(idx[4:8], uint32(next))
+		next++
+
+		end := start + int64(length)
+		nextHead := clusters
+		if end < size {
+			nextHead = end / bs
+		}
+		for k := lcn + 1; k < nextHead; k++ {
+			idx := indexes[k*fullIndexSize:]
+			binary.LittleEndian.PutUint16(idx[0:2], uint16(lclusterNonHead))
+			binary.LittleEndian.PutUint16(idx[4:6], uint16(k-lcn))
+			binary.LittleEndian.PutUint16(idx[6:8], uint16(nextHead-k))
+		}
+		start = end
+	}
+	n.in.raw = uint32(next - first)
+	return next, nil
+}
+
+// compressLongest find the longest start of data, of at least minLength bytes, that compresses to no more than limit
+// bytes, returning its length and it compressed, or nil if not even minLength bytes do
+func compressLongest(enc encoder, data []byte, minLength, limit int) (int, []byte, error) {
+	if minLength > len(data) {
+		return 0, nil, nil
+	}
+	c, err := enc.compress(data, limit)
+	if err != nil || c != nil {
+		return len(data), bytes.Clone(c), err
+	}
+	// as little as possible first, as data that does not compress does not at any length
+	if c, err = enc.compress(data[:minLength], limit); err != nil || c == nil {
+		return 0, nil, err
+	}
+	best, bestCompressed := minLength, bytes.Clone(c)
+	lo, hi := minLength+1, len(data)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		c, err := enc.compress(data[:mid], limit)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c == nil {
+			hi = mid - 1
+			continue
+		}
+		best, bestCompressed = mid, bytes.Clone(c)
+		lo = mid + 1
+	}
+	return best, bestCompressed, nil
+}
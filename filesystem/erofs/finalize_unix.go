@@ -0,0 +1,27 @@
+//go:build aix || darwin || dragonfly || freebsd || (js && wasm) || linux || nacl || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd js,wasm linux nacl netbsd openbsd solaris
+
+//nolint:unconvert // linter gets confused in this file
+package erofs
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// getFileProperties the owner of a file on the host, the device and inode that tell its hard links apart, and the
+// number of the device it is, if it is one. os.FileInfo from os.Lstat and os.DirEntry carry a *syscall.Stat_t.
+func getFileProperties(fi os.FileInfo) (uid, gid uint32, dev, ino uint64, rdev uint32) {
+	if sys := fi.Sys(); sys != nil {
+		if stat, ok := sys.(*syscall.Stat_t); ok {
+			uid = stat.Uid
+			gid = stat.Gid
+			dev = uint64(stat.Dev)
+			ino = uint64(stat.Ino)
+			rdev = encodeDevice(unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+		}
+	}
+	return uid, gid, dev, ino, rdev
+}
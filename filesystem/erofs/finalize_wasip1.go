@@ -0,0 +1,12 @@
+//go:build wasip1
+// +build wasip1
+
+package erofs
+
+import (
+	"os"
+)
+
+func getFileProperties(fi os.FileInfo) (uid, gid uint32, dev, ino uint64, rdev uint32) {
+	return 0, 0, 0, 0, 0
+}
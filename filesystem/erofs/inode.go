@@ -0,0 +1,230 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	inodeCompactSize  = 32
+	inodeExtendedSize = 64
+)
+
+// dataLayout how the data of an inode is laid out
+type dataLayout uint8
+
+const (
+	// layoutFlatPlain the data is in consecutive blocks from the block address of the inode
+	layoutFlatPlain dataLayout = 0
+	// layoutCompressedFull the data is compressed, with an index of 8 bytes for each logical cluster
+	layoutCompressedFull dataLayout = 1
+	// layoutFlatInline as layoutFlatPlain, but with the last block, the tail, after the inode
+	layoutFlatInline dataLayout = 2
+	// layoutCompressedCompact the data is compressed, with its indexes packed
+	layoutCompressedCompact dataLayout = 3
+	// layoutChunkBased the data is in chunks, each with a block address of its own
+	layoutChunkBased dataLayout = 4
+)
+
+func (l dataLayout) String() string {
+	switch l {
+	case layoutFlatPlain:
+		return "flat plain"
+	case layoutCompressedFull:
+		return "compressed full"
+	case layoutFlatInline:
+		return "flat inline"
+	case layoutCompressedCompact:
+		return "compressed compact"
+	case layoutChunkBased:
+		return "chunk based"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(l))
+	}
+}
+
+// chunk formats of the chunk-based layout, from the i_u of the inode
+const (
+	chunkFormatBlkBitsMask uint32 = 0x1f
+	chunkFormatIndexes     uint32 = 0x20
+	chunkFormat48Bit       uint32 = 0x40
+	chunkIndexSize                = 8
+	chunkBlockMapSize             = 4
+)
+
+// unix file types, in the mode of an inode
+const (
+	modeTypeMask   = 0o170000
+	modeSocket     = 0o140000
+	modeSymlink    = 0o120000
+	modeRegular    = 0o100000
+	modeBlock      = 0o060000
+	modeDirectory  = 0o040000
+	modeCharacter  = 0o020000
+	modeFifo       = 0o010000
+	modeSetuid     = 0o4000
+	modeSetgid     = 0o2000
+	modeSticky     = 0o1000
+	modePermission = 0o777
+)
+
+// inode a single inode, compact or extended
+type inode struct {
+	nid      uint64
+	extended bool
+	layout   dataLayout
+	// xattrCount the number of 4 byte slots of inline extended attributes, for their size
+	xattrCount uint16
+	mode       uint16
+	nlink      uint32
+	size       uint64
+	// raw the union of the inode: the block address of the data, the device number, the number of compressed
+	// blocks, or the chunk format, depending on the type of file and layout of its data
+	raw   uint32
+	ino   uint32
+	uid   uint32
+	gid   uint32
+	mtime time.Time
+}
+
+// inodeSize the size of the inode on disk, without its extended attributes
+func (i *inode) inodeSize() int64 {
+	if i.extended {
+		return inodeExtendedSize
+	}
+	return inodeCompactSize
+}
+
+// xattrSize the size of the extended attributes inline after the inode
+func (i *inode) xattrSize() int64 {
+	if i.xattrCount == 0 {
+		return 0
+	}
+	return 12 + 4*int64(i.xattrCount-1)
+}
+
+// parseInode parse an inode from b, which holds all of it, 32 bytes for a compact one and 64 for an extended one;
+// the build time of the filesystem is the mtime of a compact inode
+func parseInode(b []byte, nid uint64, buildTime time.Time) (*inode, error) {
+	if len(b) < inodeCompactSize {
+		return nil, fmt.Errorf("inode had %d bytes instead of expected %d", len(b), inodeCompactSize)
+	}
+	format := binary.LittleEndian.Uint16(b[0x00:0x02])
+	in := &inode{
+		nid:        nid,
+		extended:   format&0x1 != 0,
+		layout:     dataLayout(format >> 1 & 0x7),
+		xattrCount: binary.LittleEndian.Uint16(b[0x02:0x04]),
+		mode:       binary.LittleEndian.Uint16(b[0x04:0x06]),
+	}
+	if in.layout > layoutChunkBased {
+		return nil, fmt.Errorf("inode %d has unknown data layout %d", nid, in.layout)
+	}
+	if !in.extended {
+		in.nlink = uint32(binary.LittleEndian.Uint16(b[0x06:0x08]))
+		in.size = uint64(binary.LittleEndian.Uint32(b[0x08:0x0c]))
+		in.raw = binary.LittleEndian.Uint32(b[0x10:0x14])
+		in.ino = binary.LittleEndian.Uint32(b[0x14:0x18])
+		in.uid = uint32(binary.LittleEndian.Uint16(b[0x18:0x1a]))
+		in.gid = uint32(binary.LittleEndian.Uint16(b[0x1a:0x1c]))
+		in.mtime = buildTime
+		return in, nil
+	}
+	if len(b) < inodeExtendedSize {
+		return nil, fmt.Errorf("extended inode had %d bytes instead of expected %d", len(b), inodeExtendedSize)
+	}
+	in.size = binary.LittleEndian.Uint64(b[0x08:0x10])
+	in.raw = binary.LittleEndian.Uint32(b[0x10:0x14])
+	in.ino = binary.LittleEndian.Uint32(b[0x14:0x18])
+	in.uid = binary.LittleEndian.Uint32(b[0x18:0x1c])
+	in.gid = binary.LittleEndian.Uint32(b[0x1c:0x20])
+	in.mtime = time.Unix(int64(binary.LittleEndian.Uint64(b[0x20:0x28])), int64(binary.LittleEndian.Uint32(b[0x28:0x2c])))
+	in.nlink = binary.LittleEndian.Uint32(b[0x2c:0x30])
+	return in, nil
+}
+
+// toBytes the inode as it is on disk, compact or extended; the build time of the filesystem is the mtime
+// of a compact inode, so is not written
+func (i *inode) toBytes() []byte {
+	b := make([]byte, i.inodeSize())
+	format := uint16(i.layout) << 1
+	if i.extended {
+		format |= 0x1
+	}
+	binary.LittleEndian.PutUint16(b[0x00:0x02], format)
+	binary.LittleEndian.PutUint16(b[0x02:0x04], i.xattrCount)
+	binary.LittleEndian.PutUint16(b[0x04:0x06], i.mode)
+	binary.LittleEndian.PutUint32(b[0x10:0x14], i.raw)
+	binary.LittleEndian.PutUint32(b[0x14:0x18], i.ino)
+	if !i.extended {
+		binary.LittleEndian.PutUint16(b[0x06:0x08], uint16(i.nlink))
+		binary.LittleEndian.PutUint32(b[0x08:0x0c], uint32(i.size))
+		binary.LittleEndian.PutUint16(b[0x18:0x1a], uint16(i.uid))
+		binary.LittleEndian.PutUint16(b[0x1a:0x1c], uint16(i.gid))
+		return b
+	}
+	binary.LittleEndian.PutUint64(b[0x08:0x10], i.size)
+	binary.LittleEndian.PutUint32(b[0x18:0x1c], i.uid)
+	binary.LittleEndian.PutUint32(b[0x1c:0x20], i.gid)
+	binary.LittleEndian.PutUint64(b[0x20:0x28], uint64(i.mtime.Unix()))
+	binary.LittleEndian.PutUint32(b[0x28:0x2c], uint32(i.mtime.Nanosecond()))
+	binary.LittleEndian.PutUint32(b[0x2c:0x30], i.nlink)
+	return b
+}
+
+// isDir whether the inode is a directory
+func (i *inode) isDir() bool {
+	return i.mode&modeTypeMask == modeDirectory
+}
+
+// isCompressed whether the data of the inode is compressed
+func (i *inode) isCompressed() bool {
+	return i.layout == layoutCompressedFull || i.layout == layoutCompressedCompact
+}
+
+// fileMode the mode of the inode as an os.FileMode
+func (i *inode) fileMode() os.FileMode {
+	m := os.FileMode(i.mode & modePermission)
+	switch i.mode & modeTypeMask {
+	case modeDirectory:
+		m |= os.ModeDir
+	case modeSymlink:
+		m |= os.ModeSymlink
+	case modeBlock:
+		m |= os.ModeDevice
+	case modeCharacter:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case modeFifo:
+		m |= os.ModeNamedPipe
+	case modeSocket:
+		m |= os.ModeSocket
+	}
+	if i.mode&modeSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if i.mode&modeSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if i.mode&modeSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// hasDevice whether the raw union of the inode is a device number
+func (i *inode) hasDevice() bool {
+	t := i.mode & modeTypeMask
+	return t == modeBlock || t == modeCharacter
+}
+
+// decodeDevice the major and minor numbers of a device, as the kernel encodes them in 32 bits
+func decodeDevice(dev uint32) (major, minor uint32) {
+	return (dev & 0xfff00) >> 8, (dev & 0xff) | (dev>>12)&0xfff00
+}
+
+// encodeDevice the device number of major and minor, as the kernel encodes them in 32 bits
+func encodeDevice(major, minor uint32) uint32 {
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
@@ -0,0 +1,189 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	superblockOffset int64  = 1024
+	superblockSize          = 128
+	superblockMagic  uint32 = 0xe0f5e1e2
+	// volumeNameSize the most bytes of the volume name, which is the label
+	volumeNameSize = 16
+	// slotSize the unit of the inodes, and of the extension slots of the superblock
+	slotSize = 32
+	// slotBits the number of bits of slotSize
+	slotBits = 5
+	// extSlotSize the size of each extension slot of the superblock
+	extSlotSize = 16
+	// nullAddr the block address of a chunk that has no blocks, a hole
+	nullAddr uint32 = 0xffffffff
+)
+
+// compatible features, which can be ignored if unknown
+const (
+	featureCompatSbChksum uint32 = 0x1
+	featureCompatMtime    uint32 = 0x2
+)
+
+// incompatible features, without support for which an image cannot be read
+const (
+	featureIncompatZeroPadding   uint32 = 0x1
+	featureIncompatComprCfgs     uint32 = 0x2 // also big pclusters, which came with it
+	featureIncompatChunkedFile   uint32 = 0x4
+	featureIncompatDeviceTable   uint32 = 0x8 // also the second head of compressed indexes
+	featureIncompatZtailpacking  uint32 = 0x10
+	featureIncompatFragments     uint32 = 0x20 // also dedupe
+	featureIncompatXattrPrefixes uint32 = 0x40
+
+	featureIncompatSupported = featureIncompatZeroPadding | featureIncompatComprCfgs | featureIncompatChunkedFile |
+		featureIncompatDeviceTable | featureIncompatZtailpacking | featureIncompatFragments | featureIncompatXattrPrefixes
+)
+
+// crc32c the table of the checksum of the superblock
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// superblock the superblock of an EROFS filesystem, at byte 1024
+type superblock struct {
+	checksum  uint32
+	compat    uint32
+	blockBits uint8
+	extSlots  uint8
+	rootNid   uint16
+	inodes    uint64
+	buildTime time.Time
+	blocks    uint32
+	// metaBlkAddr the block from which inodes are numbered, in slots of 32 bytes
+	metaBlkAddr  uint32
+	xattrBlkAddr uint32
+	uuid         uuid.UUID
+	volumeName   string
+	incompat     uint32
+	// algorithms the compression algorithms in use, with featureIncompatComprCfgs, as a bit for each
+	algorithms uint16
+	// lz4MaxDistance the farthest back that lz4 refers, in 64KB pages, without featureIncompatComprCfgs
+	lz4MaxDistance uint16
+	extraDevices   uint16
+	dirBlockBits   uint8
+	packedNid      uint64
+}
+
+// blockSize the size of a block in bytes
+func (s *superblock) blockSize() int64 {
+	return 1 << s.blockBits
+}
+
+func (s *superblock) equal(a *superblock) bool {
+	if (s == nil && a != nil) || (a == nil && s != nil) {
+		return false
+	}
+	if s == nil && a == nil {
+		return true
+	}
+	c := *a
+	c.buildTime = s.buildTime
+	return *s == c && s.buildTime.Equal(a.buildTime)
+}
+
+// superblockChecksum the checksum of the superblock, over the rest of the block that holds it from the superblock on,
+// with the checksum as 0, as the kernel calculates it, which is without the final inversion of crc32c
+func superblockChecksum(b []byte) uint32 {
+	c := make([]byte, len(b))
+	copy(c, b)
+	binary.LittleEndian.PutUint32(c[0x04:0x08], 0)
+	return ^crc32.Checksum(c, crc32c)
+}
+
+// parseSuperblock parse the superblock from b, which holds it and the rest of its block, for the checksum
+func parseSuperblock(b []byte) (*superblock, error) {
+	if len(b) < superblockSize {
+		return nil, fmt.Errorf("superblock had %d bytes instead of expected %d", len(b), superblockSize)
+	}
+	if magic := binary.LittleEndian.Uint32(b[0x00:0x04]); magic != superblockMagic {
+		return nil, fmt.Errorf("superblock had magic of %#x instead of expected %#x", magic, superblockMagic)
+	}
+	s := &superblock{
+		checksum:     binary.LittleEndian.Uint32(b[0x04:0x08]),
+		compat:       binary.LittleEndian.Uint32(b[0x08:0x0c]),
+		blockBits:    b[0x0c],
+		extSlots:     b[0x0d],
+		rootNid:      binary.LittleEndian.Uint16(b[0x0e:0x10]),
+		inodes:       binary.LittleEndian.Uint64(b[0x10:0x18]),
+		buildTime:    time.Unix(int64(binary.LittleEndian.Uint64(b[0x18:0x20])), int64(binary.LittleEndian.Uint32(b[0x20:0x24]))),
+		blocks:       binary.LittleEndian.Uint32(b[0x24:0x28]),
+		metaBlkAddr:  binary.LittleEndian.Uint32(b[0x28:0x2c]),
+		xattrBlkAddr: binary.LittleEndian.Uint32(b[0x2c:0x30]),
+		volumeName:   string(bytes.TrimRight(b[0x40:0x50], "\x00")),
+		incompat:     binary.LittleEndian.Uint32(b[0x50:0x54]),
+		extraDevices: binary.LittleEndian.Uint16(b[0x56:0x58]),
+		dirBlockBits: b[0x5a],
+		packedNid:    binary.LittleEndian.Uint64(b[0x60:0x68]),
+	}
+	copy(s.uuid[:], b[0x30:0x40])
+	if s.incompat&featureIncompatComprCfgs != 0 {
+		s.algorithms = binary.LittleEndian.Uint16(b[0x54:0x56])
+	} else {
+		s.lz4MaxDistance = binary.LittleEndian.Uint16(b[0x54:0x56])
+	}
+	// the kernel only reads blocks of up to a page, which is 64KB at the most
+	if s.blockBits < 9 || s.blockBits > 16 {
+		return nil, fmt.Errorf("block size of 2^%d bytes is not supported", s.blockBits)
+	}
+	if unknown := s.incompat &^ featureIncompatSupported; unknown != 0 {
+		return nil, fmt.Errorf("unsupported incompatible features %#x", unknown)
+	}
+	if s.extraDevices != 0 {
+		return nil, fmt.Errorf("images of %d extra devices are not supported", s.extraDevices)
+	}
+	if s.dirBlockBits != 0 {
+		return nil, fmt.Errorf("directory blocks of 2^%d blocks are not supported", s.dirBlockBits)
+	}
+	if s.compat&featureCompatSbChksum != 0 {
+		// the rest of the block from the superblock on, or the whole of a block of 1KB or less
+		end := s.blockSize()
+		if end > superblockOffset {
+			end -= superblockOffset
+		}
+		if int64(len(b)) < end {
+			return nil, fmt.Errorf("superblock had %d bytes instead of expected %d to check its checksum", len(b), end)
+		}
+		if sum := superblockChecksum(b[:end]); sum != s.checksum {
+			return nil, fmt.Errorf("superblock checksum %#08x does not match calculated %#08x", s.checksum, sum)
+		}
+	}
+	return s, nil
+}
+
+// toBytes the superblock as it is on disk, without the checksum, which is over the block that holds it
+func (s *superblock) toBytes() []byte {
+	b := make([]byte, superblockSize)
+	binary.LittleEndian.PutUint32(b[0x00:0x04], superblockMagic)
+	binary.LittleEndian.PutUint32(b[0x08:0x0c], s.compat)
+	b[0x0c] = s.blockBits
+	b[0x0d] = s.extSlots
+	binary.LittleEndian.PutUint16(b[0x0e:0x10], s.rootNid)
+	binary.LittleEndian.PutUint64(b[0x10:0x18], s.inodes)
+	binary.LittleEndian.PutUint64(b[0x18:0x20], uint64(s.buildTime.Unix()))
+	binary.LittleEndian.PutUint32(b[0x20:0x24], uint32(s.buildTime.Nanosecond()))
+	binary.LittleEndian.PutUint32(b[0x24:0x28], s.blocks)
+	binary.LittleEndian.PutUint32(b[0x28:0x2c], s.metaBlkAddr)
+	binary.LittleEndian.PutUint32(b[0x2c:0x30], s.xattrBlkAddr)
+	copy(b[0x30:0x40], s.uuid[:])
+	copy(b[0x40:0x50], s.volumeName)
+	binary.LittleEndian.PutUint32(b[0x50:0x54], s.incompat)
+	if s.incompat&featureIncompatComprCfgs != 0 {
+		binary.LittleEndian.PutUint16(b[0x54:0x56], s.algorithms)
+	} else {
+		binary.LittleEndian.PutUint16(b[0x54:0x56], s.lz4MaxDistance)
+	}
+	binary.LittleEndian.PutUint16(b[0x56:0x58], s.extraDevices)
+	b[0x5a] = s.dirBlockBits
+	binary.LittleEndian.PutUint64(b[0x60:0x68], s.packedNid)
+	return b
+}
@@ -0,0 +1,26 @@
+#!/bin/sh
+set -e
+mkdir -p dist
+cat << "EOF" | docker run -i --rm -v $PWD/dist:/data -w /data alpine:3.20
+set -e
+set -x
+apk --update add erofs-utils
+rm -rf src
+mkdir -p src/foo
+cd src
+echo "This is a short file" > shortfile.txt
+echo "This is a subdir file" > foo/subdirfile.txt
+# enough entries that /foo takes many blocks
+set +x
+i=0; until [ $i -ge 1000 ]; do touch foo/file${i}; i=$(( $i+1 )); done
+set -x
+# a file with known content, which does not compress
+dd if=/dev/random of=/data/random.dat bs=1024 count=20
+cp /data/random.dat random.dat
+# a file that compresses, over many pclusters
+yes "This is a compressible line" | head -c 1000000 > compressible.txt
+ln -s random.dat symlink.dat
+cd /data
+mkfs.erofs -L diskfs -zlz4hc erofs.img src
+rm -rf src
+EOF
@@ -0,0 +1,455 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// mapHeaderSize the size of the header before the indexes of a compressed file
+	mapHeaderSize = 8
+	// fullIndexSize the size of each index of layoutCompressedFull
+	fullIndexSize = 8
+	// fragmentInodeBit the bit of the cluster bits of the map header that says the whole file is a fragment
+	fragmentInodeBit = 7
+	// maxPclusterSize the largest pcluster that the kernel reads
+	maxPclusterSize = 1 << 20
+	// maxExtentLength a limit on what an extent decompresses to, far above what mkfs.erofs makes
+	maxExtentLength = 16 << 20
+)
+
+// the advice of the map header
+const (
+	adviseCompacted2B      uint16 = 0x0001
+	adviseBigPcluster1     uint16 = 0x0002
+	adviseBigPcluster2     uint16 = 0x0004
+	adviseInlinePcluster   uint16 = 0x0008
+	adviseInterlaced       uint16 = 0x0010
+	adviseFragmentPcluster uint16 = 0x0020
+	adviseKnown                   = adviseCompacted2B | adviseBigPcluster1 | adviseBigPcluster2 | adviseInlinePcluster |
+		adviseInterlaced | adviseFragmentPcluster
+)
+
+// lclusterType the type of a logical cluster, from its index
+type lclusterType uint8
+
+const (
+	// lclusterPlain the head of an extent that is stored uncompressed
+	lclusterPlain lclusterType = 0
+	// lclusterHead1 the head of an extent compressed with the first algorithm
+	lclusterHead1 lclusterType = 1
+	// lclusterNonHead a logical cluster in the middle of an extent
+	lclusterNonHead lclusterType = 2
+	// lclusterHead2 the head of an extent compressed with the second algorithm
+	lclusterHead2 lclusterType = 3
+)
+
+const (
+	lclusterTypeMask uint16 = 0x3
+	// partialRef the extent uses only the start of what its pcluster decompresses to
+	partialRef uint16 = 0x8000
+	// d0CompressedBlocks the delta of the first non-head of a big pcluster holds the number of its blocks
+	d0CompressedBlocks uint16 = 0x800
+)
+
+// lcluster what the index of a logical cluster gives
+type lcluster struct {
+	typ        lclusterType
+	clusterofs uint32
+	// pblk the first block of the pcluster, for a head
+	pblk uint64
+	// delta how far back the head is, and how far forward the next one, for a non-head
+	delta [2]uint32
+	// compressedBlocks the number of blocks of a big pcluster, from the first non-head after its head
+	compressedBlocks uint32
+	partial          bool
+}
+
+// extent a range of a compressed file, and where it is on disk
+type extent struct {
+	// logical the offset in the file where the extent starts, and length how many bytes of the file it has
+	logical int64
+	length  int64
+	// physical where the pcluster of the extent is, in bytes, and size its size
+	physical int64
+	size     int64
+	plain    bool
+	// algorithm for a compressed pcluster
+	algorithm compressionAlgorithm
+	partial   bool
+}
+
+// zmap the map of the extents of a compressed file, from its map header and indexes
+type zmap struct {
+	fs     *FileSystem
+	in     *inode
+	advise uint16
+	// algorithms for the first and second type of head
+	algorithms    [2]compressionAlgorithm
+	lclusterBits  uint
+	totalClusters uint64
+	// base where the map header is, and the indexes start after it
+	base int64
+}
+
+// newZmap read the map header of a compressed inode
+func (fs *FileSystem) newZmap(in *inode) (*zmap, error) {
+	end := fs.inodeOffset(in.nid) + in.inodeSize() + in.xattrSize()
+	base := (end + 7) &^ 7
+	b, err := fs.readBytes(base, mapHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read map header: %v", err)
+	}
+	clusterBits := b[7]
+	if clusterBits>>fragmentInodeBit != 0 {
+		return nil, fmt.Errorf("files kept whole in the packed inode are not supported")
+	}
+	z := &zmap{
+		fs:         fs,
+		in:         in,
+		advise:     binary.LittleEndian.Uint16(b[4:6]),
+		algorithms: [2]compressionAlgorithm{compressionAlgorithm(b[6] & 0xf), compressionAlgorithm(b[6] >> 4)},
+		base:       base,
+	}
+	z.lclusterBits = uint(fs.superblock.blockBits) + uint(clusterBits&0x7)
+	z.totalClusters = (in.size + 1<<z.lclusterBits - 1) >> z.lclusterBits
+	for _, a := range z.algorithms {
+		if a >= algorithmMax {
+			return nil, fmt.Errorf("unknown compression algorithm %d", a)
+		}
+	}
+	if unknown := z.advise &^ adviseKnown; unknown != 0 {
+		return nil, fmt.Errorf("unknown advice %#x of compressed indexes", unknown)
+	}
+	if z.advise&(adviseInlinePcluster|adviseFragmentPcluster) != 0 {
+		return nil, fmt.Errorf("tails packed inline or in fragments are not supported")
+	}
+	if in.layout == layoutCompressedCompact && (z.advise&adviseBigPcluster1 == 0) != (z.advise&adviseBigPcluster2 == 0) {
+		return nil, fmt.Errorf("big pclusters of the first and second heads of compact indexes are not the same")
+	}
+	return z, nil
+}
+
+// load the index of logical cluster lcn; with lookahead, the distance to the next head of a non-head is needed
+func (z *zmap) load(lcn uint64, lookahead bool) (*lcluster, error) {
+	if lcn >= z.totalClusters {
+		return nil, fmt.Errorf("logical cluster %d is beyond the %d of the file", lcn, z.totalClusters)
+	}
+	if z.in.layout == layoutCompressedFull {
+		return z.loadFull(lcn)
+	}
+	return z.loadCompact(lcn, lookahead)
+}
+
+// loadFull the index of a logical cluster of layoutCompressedFull, where each has 8 bytes of its own
+func (z *zmap) loadFull(lcn uint64) (*lcluster, error) {
+	// the map header is followed by 8 reserved bytes
+	b, err := z.fs.readBytes(z.base+mapHeaderSize+8+int64(lcn)*fullIndexSize, fullIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	advise := binary.LittleEndian.Uint16(b[0:2])
+	m := &lcluster{typ: lclusterType(advise & lclusterTypeMask)}
+	if m.typ == lclusterNonHead {
+		m.clusterofs = 1 << z.lclusterBits
+		d0 := binary.LittleEndian.Uint16(b[4:6])
+		if d0&d0CompressedBlocks != 0 {
+			if z.advise&(adviseBigPcluster1|adviseBigPcluster2) == 0 {
+				return nil, fmt.Errorf("logical cluster %d has a count of blocks without big pclusters", lcn)
+			}
+			m.compressedBlocks = uint32(d0 &^ d0CompressedBlocks)
+			d0 = 1
+		}
+		m.delta = [2]uint32{uint32(d0), uint32(binary.LittleEndian.Uint16(b[6:8]))}
+		return m, nil
+	}
+	m.partial = advise&partialRef != 0
+	m.clusterofs = uint32(binary.LittleEndian.Uint16(b[2:4]))
+	if m.clusterofs >= 1<<z.lclusterBits {
+		return nil, fmt.Errorf("logical cluster %d has offset %d beyond its size", lcn, m.clusterofs)
+	}
+	m.pblk = uint64(binary.LittleEndian.Uint32(b[4:8]))
+	return m, nil
+}
+
+// loadCompact the index of a logical cluster of layoutCompressedCompact, which are packed a few or many together
+// with the block address of the first of each pack, as the kernel reads them
+func (z *zmap) loadCompact(lcn uint64, lookahead bool) (*lcluster, error) {
+	ebase := z.base + mapHeaderSize
+	// packs of 4 bytes an index up to an alignment of 32 bytes, then of 2 bytes an index, if advised, then of 4 again
+	initial4B := uint64((32 - ebase%32) / 4)
+	if initial4B == 32/4 {
+		initial4B = 0
+	}
+	var compacted2B uint64
+	if z.advise&adviseCompacted2B != 0 && initial4B < z.totalClusters {
+		compacted2B = (z.totalClusters - initial4B) / 16 * 16
+	}
+	pos := ebase
+	amortizedShift := uint(2)
+	switch {
+	case lcn < initial4B:
+	case lcn-initial4B < compacted2B:
+		pos += int64(initial4B) * 4
+		lcn -= initial4B
+		amortizedShift = 1
+	default:
+		pos += int64(initial4B)*4 + int64(compacted2B)*2
+		lcn -= initial4B + compacted2B
+	}
+	pos += int64(lcn) << amortizedShift
+
+	var vcnt int
+	switch {
+	case amortizedShift == 2 && z.lclusterBits <= 14:
+		vcnt = 2
+	case amortizedShift == 1 && z.lclusterBits <= 12:
+		vcnt = 16
+	default:
+		return nil, fmt.Errorf("compact indexes of %d bytes are not supported for logical clusters of 2^%d bytes", 1<<amortizedShift, z.lclusterBits)
+	}
+	packSize := int64(vcnt) << amortizedShift
+	packStart := pos &^ (packSize - 1)
+	pack, err := z.fs.readBytes(packStart, int(packSize))
+	if err != nil {
+		return nil, err
+	}
+	bigPcluster := z.advise&adviseBigPcluster1 != 0
+	lobits := max(z.lclusterBits, 12)
+	encodebits := uint((packSize - 4) * 8 / int64(vcnt))
+	i := int((pos - packStart) >> amortizedShift)
+	decode := func(i int) (uint32, lclusterType) {
+		bit := encodebits * uint(i)
+		var v [4]byte
+		copy(v[:], pack[bit/8:])
+		value := binary.LittleEndian.Uint32(v[:]) >> (bit & 7)
+		return value & (1<<lobits - 1), lclusterType(value >> lobits & 3)
+	}
+
+	lo, typ := decode(i)
+	m := &lcluster{typ: typ}
+	if typ == lclusterNonHead {
+		m.clusterofs = 1 << z.lclusterBits
+		if lookahead {
+			// the distance to the next head, which is where the non-heads after this one end, or from the last
+			// of the pack, which holds it
+			var d1 uint32
+			j := i
+			for ; j < vcnt; j++ {
+				l, t := decode(j)
+				if t != lclusterNonHead {
+					break
+				}
+				d1++
+				lo = l
+			}
+			if j == vcnt && lo&uint32(d0CompressedBlocks) == 0 {
+				d1 += lo - 1
+			}
+			m.delta[1] = d1
+			lo, _ = decode(i)
+		}
+		switch {
+		case lo&uint32(d0CompressedBlocks) != 0:
+			if !bigPcluster {
+				return nil, fmt.Errorf("logical cluster %d has a count of blocks without big pclusters", lcn)
+			}
+			m.compressedBlocks = lo &^ uint32(d0CompressedBlocks)
+			m.delta[0] = 1
+		case i+1 != vcnt:
+			m.delta[0] = lo
+		default:
+			// the last of a pack holds the distance to the next head, so the one to the head is from the one before
+			prev, prevType := decode(i - 1)
+			switch {
+			case prevType != lclusterNonHead:
+				prev = 0
+			case prev&uint32(d0CompressedBlocks) != 0:
+				prev = 1
+			}
+			m.delta[0] = prev + 1
+		}
+		return m, nil
+	}
+	m.clusterofs = lo
+	if m.clusterofs >= 1<<z.lclusterBits {
+		return nil, fmt.Errorf("logical cluster %d has offset %d beyond its size", lcn, m.clusterofs)
+	}
+	// the block of a head is that of the pack after those of the heads before it in the pack
+	var nblk uint64
+	if !bigPcluster {
+		nblk = 1
+		for i > 0 {
+			i--
+			l, t := decode(i)
+			if t == lclusterNonHead {
+				i -= int(l)
+			}
+			if i >= 0 {
+				nblk++
+			}
+		}
+	} else {
+		for i > 0 {
+			i--
+			l, t := decode(i)
+			if t == lclusterNonHead {
+				if l&uint32(d0CompressedBlocks) != 0 {
+					i--
+					nblk += uint64(l &^ uint32(d0CompressedBlocks))
+					continue
+				}
+				if l <= 1 {
+					return nil, fmt.Errorf("logical cluster %d of a big pcluster has a delta of %d", lcn, l)
+				}
+				i -= int(l) - 2
+				continue
+			}
+			nblk++
+		}
+	}
+	m.pblk = uint64(binary.LittleEndian.Uint32(pack[packSize-4:])) + nblk
+	return m, nil
+}
+
+// lookback find the head of the extent that lcn is in, distance before it
+func (z *zmap) lookback(lcn uint64, distance uint32) (*lcluster, uint64, error) {
+	for {
+		if uint64(distance) > lcn {
+			return nil, 0, fmt.Errorf("logical cluster %d has a head %d before the start of the file", lcn, distance)
+		}
+		lcn -= uint64(distance)
+		m, err := z.load(lcn, false)
+		if err != nil {
+			return nil, 0, err
+		}
+		if m.typ != lclusterNonHead {
+			return m, lcn, nil
+		}
+		if m.delta[0] == 0 {
+			return nil, 0, fmt.Errorf("logical cluster %d is a non-head with no head", lcn)
+		}
+		distance = m.delta[0]
+	}
+}
+
+// mapExtent find the extent that the offset off of the file is in, as the kernel does
+func (z *zmap) mapExtent(off int64) (*extent, error) {
+	lcn := uint64(off) >> z.lclusterBits
+	endoff := uint32(off & (1<<z.lclusterBits - 1))
+	m, err := z.load(lcn, false)
+	if err != nil {
+		return nil, err
+	}
+	head, headLcn := m, lcn
+	switch {
+	case m.typ == lclusterNonHead:
+		if head, headLcn, err = z.lookback(lcn, m.delta[0]); err != nil {
+			return nil, err
+		}
+	case endoff < m.clusterofs:
+		// the offset is in the extent before the one that starts in this logical cluster
+		if lcn == 0 {
+			return nil, fmt.Errorf("logical cluster 0 has offset %d", m.clusterofs)
+		}
+		if head, headLcn, err = z.lookback(lcn, 1); err != nil {
+			return nil, err
+		}
+	}
+	e := &extent{
+		logical:  int64(headLcn<<z.lclusterBits) + int64(head.clusterofs),
+		physical: int64(head.pblk) << z.fs.superblock.blockBits,
+		plain:    head.typ == lclusterPlain,
+		partial:  head.partial,
+	}
+	switch head.typ {
+	case lclusterHead1:
+		e.algorithm = z.algorithms[0]
+	case lclusterHead2:
+		e.algorithm = z.algorithms[1]
+	}
+
+	// the size of the pcluster, from the first non-head after the head for a big one
+	blocks := uint32(1)
+	if headLcn+1 < z.totalClusters {
+		next, err := z.load(headLcn+1, false)
+		if err != nil {
+			return nil, err
+		}
+		if next.typ == lclusterNonHead && next.compressedBlocks != 0 {
+			blocks = next.compressedBlocks
+		}
+	}
+	e.size = int64(blocks) << z.fs.superblock.blockBits
+
+	// the length of the extent, which is up to the next head, or the end of the file
+	for next := headLcn; ; {
+		if next<<z.lclusterBits >= z.in.size {
+			e.length = int64(z.in.size) - e.logical
+			break
+		}
+		n, err := z.load(next, true)
+		if err != nil {
+			return nil, err
+		}
+		d1 := n.delta[1]
+		if n.typ != lclusterNonHead {
+			if next != headLcn {
+				e.length = int64(next<<z.lclusterBits) + int64(n.clusterofs) - e.logical
+				break
+			}
+			d1 = 1
+		}
+		if d1 == 0 {
+			// as made by mkfs.erofs before 1.0
+			d1 = 1
+		}
+		next += uint64(d1)
+	}
+	if e.length <= 0 || e.logical+e.length <= off {
+		return nil, fmt.Errorf("extent at %d of %d bytes does not hold offset %d", e.logical, e.length, off)
+	}
+	if e.size > maxPclusterSize {
+		return nil, fmt.Errorf("pcluster of extent at %d of %d bytes is larger than the maximum of %d", e.logical, e.size, maxPclusterSize)
+	}
+	if e.length > maxExtentLength {
+		return nil, fmt.Errorf("extent at %d of %d bytes is larger than the maximum of %d", e.logical, e.length, maxExtentLength)
+	}
+	if e.plain && e.length > e.size {
+		return nil, fmt.Errorf("uncompressed extent at %d of %d bytes is larger than its pcluster of %d", e.logical, e.length, e.size)
+	}
+	return e, nil
+}
+
+// readExtent read the data of an extent, decompressing it
+func (z *zmap) readExtent(e *extent, d *decompressor) ([]byte, error) {
+	raw, err := z.fs.readBytes(e.physical, int(e.size))
+	if err != nil {
+		return nil, fmt.Errorf("could not read pcluster at %d: %v", e.physical, err)
+	}
+	if e.plain {
+		if z.advise&adviseInterlaced == 0 {
+			return raw[:e.length], nil
+		}
+		// the data starts where the extent does in its block, and wraps around
+		out := make([]byte, e.length)
+		shift := e.logical & (z.fs.superblock.blockSize() - 1)
+		for i := range out {
+			out[i] = raw[(shift+int64(i))%e.size]
+		}
+		return out, nil
+	}
+	if z.fs.superblock.incompat&featureIncompatZeroPadding != 0 {
+		// the compressed data is at the end of the pcluster, after zeros
+		i := 0
+		for i < len(raw) && raw[i] == 0 {
+			i++
+		}
+		raw = raw[i:]
+	}
+	out, err := d.decompress(e.algorithm, raw, int(e.length), e.partial)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress extent at %d: %v", e.logical, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,181 @@
+package exfat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	fileSystemName     string = "EXFAT   "
+	fileSystemRevision uint16 = 0x0100
+	// the main and backup boot regions are 12 sectors each: the boot sector, 8 extended boot sectors,
+	// the OEM parameters, a reserved sector and the checksum
+	bootRegionSectors  int64 = 12
+	bootChecksumSector int64 = 11
+	bootSectorSize     int   = 512
+	minSectorShift     uint8 = 9
+	maxSectorShift     uint8 = 12
+	// clusters are at most 32MB
+	maxClusterShift uint8 = 25
+	driveSelect     uint8 = 0x80
+)
+
+// volumeFlagActiveFat is set in the volume flags when the second FAT and allocation bitmap are the active ones
+const volumeFlagActiveFat uint16 = 0x1
+
+var jumpBoot = [3]byte{0xeb, 0x76, 0x90}
+
+// bootSector the exFAT boot sector, which is the first sector of the main and backup boot regions
+type bootSector struct {
+	partitionOffset        uint64
+	volumeLength           uint64
+	fatOffset              uint32
+	fatLength              uint32
+	clusterHeapOffset      uint32
+	clusterCount           uint32
+	rootDirectoryCluster   uint32
+	volumeSerialNumber     uint32
+	fileSystemRevision     uint16
+	volumeFlags            uint16
+	bytesPerSectorShift    uint8
+	sectorsPerClusterShift uint8
+	numberOfFats           uint8
+	driveSelect            uint8
+	percentInUse           uint8
+	bootCode               []byte
+}
+
+// bootSectorFromBytes read the boot sector from the first 512 bytes of a boot region
+func bootSectorFromBytes(b []byte) (*bootSector, error) {
+	if len(b) < bootSectorSize {
+		return nil, fmt.Errorf("cannot read exFAT boot sector from %d bytes, must be at least %d", len(b), bootSectorSize)
+	}
+	if !bytes.Equal(b[0:3], jumpBoot[:]) {
+		return nil, fmt.Errorf("invalid jump instruction % x", b[0:3])
+	}
+	if string(b[3:11]) != fileSystemName {
+		return nil, fmt.Errorf("invalid filesystem name %q", b[3:11])
+	}
+	// the BIOS parameter block of FAT is all zeros, so nothing mistakes exFAT for FAT
+	for _, c := range b[11:64] {
+		if c != 0 {
+			return nil, errors.New("bytes 11 to 63 of exFAT boot sector are not all 0")
+		}
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		return nil, fmt.Errorf("invalid boot signature % x", b[510:512])
+	}
+	bs := bootSector{
+		partitionOffset:        binary.LittleEndian.Uint64(b[64:72]),
+		volumeLength:           binary.LittleEndian.Uint64(b[72:80]),
+		fatOffset:              binary.LittleEndian.Uint32(b[80:84]),
+		fatLength:              binary.LittleEndian.Uint32(b[84:88]),
+		clusterHeapOffset:      binary.LittleEndian.Uint32(b[88:92]),
+		clusterCount:           binary.LittleEndian.Uint32(b[92:96]),
+		rootDirectoryCluster:   binary.LittleEndian.Uint32(b[96:100]),
+		volumeSerialNumber:     binary.LittleEndian.Uint32(b[100:104]),
+		fileSystemRevision:     binary.LittleEndian.Uint16(b[104:106]),
+		volumeFlags:            binary.LittleEndian.Uint16(b[106:108]),
+		bytesPerSectorShift:    b[108],
+		sectorsPerClusterShift: b[109],
+		numberOfFats:           b[110],
+		driveSelect:            b[111],
+		percentInUse:           b[112],
+		bootCode:               make([]byte, 390),
+	}
+	copy(bs.bootCode, b[120:510])
+
+	if bs.fileSystemRevision>>8 != fileSystemRevision>>8 {
+		return nil, fmt.Errorf("unsupported exFAT revision %d.%02d", bs.fileSystemRevision>>8, bs.fileSystemRevision&0xff)
+	}
+	if bs.bytesPerSectorShift < minSectorShift || bs.bytesPerSectorShift > maxSectorShift {
+		return nil, fmt.Errorf("invalid bytes per sector shift %d, must be between %d and %d", bs.bytesPerSectorShift, minSectorShift, maxSectorShift)
+	}
+	if bs.bytesPerSectorShift+bs.sectorsPerClusterShift > maxClusterShift {
+		return nil, fmt.Errorf("invalid sectors per cluster shift %d, clusters cannot be larger than 32MB", bs.sectorsPerClusterShift)
+	}
+	if bs.numberOfFats != 1 && bs.numberOfFats != 2 {
+		return nil, fmt.Errorf("invalid number of FATs %d, must be 1 or 2", bs.numberOfFats)
+	}
+	if bs.rootDirectoryCluster < 2 || bs.rootDirectoryCluster > bs.clusterCount+1 {
+		return nil, fmt.Errorf("invalid root directory cluster %d", bs.rootDirectoryCluster)
+	}
+	if uint64(bs.clusterHeapOffset)+uint64(bs.clusterCount)<<bs.sectorsPerClusterShift > bs.volumeLength {
+		return nil, fmt.Errorf("cluster heap of %d clusters at sector %d does not fit in volume of %d sectors", bs.clusterCount, bs.clusterHeapOffset, bs.volumeLength)
+	}
+	if uint64(bs.fatLength)<<bs.bytesPerSectorShift < (uint64(bs.clusterCount)+2)*4 {
+		return nil, fmt.Errorf("FAT of %d sectors is too small for %d clusters", bs.fatLength, bs.clusterCount)
+	}
+	return &bs, nil
+}
+
+// toBytes the boot sector as the 512 bytes ready to write to disk
+func (bs *bootSector) toBytes() []byte {
+	b := make([]byte, bootSectorSize)
+	copy(b[0:3], jumpBoot[:])
+	copy(b[3:11], fileSystemName)
+	binary.LittleEndian.PutUint64(b[64:72], bs.partitionOffset)
+	binary.LittleEndian.PutUint64(b[72:80], bs.volumeLength)
+	binary.LittleEndian.PutUint32(b[80:84], bs.fatOffset)
+	binary.LittleEndian.PutUint32(b[84:88], bs.fatLength)
+	binary.LittleEndian.PutUint32(b[88:92], bs.clusterHeapOffset)
+	binary.LittleEndian.PutUint32(b[92:96], bs.clusterCount)
+	binary.LittleEndian.PutUint32(b[96:100], bs.rootDirectoryCluster)
+	binary.LittleEndian.PutUint32(b[100:104], bs.volumeSerialNumber)
+	binary.LittleEndian.PutUint16(b[104:106], bs.fileSystemRevision)
+	binary.LittleEndian.PutUint16(b[106:108], bs.volumeFlags)
+	b[108] = bs.bytesPerSectorShift
+	b[109] = bs.sectorsPerClusterShift
+	b[110] = bs.numberOfFats
+	b[111] = bs.driveSelect
+	b[112] = bs.percentInUse
+	copy(b[120:510], bs.bootCode)
+	b[510] = 0x55
+	b[511] = 0xaa
+	return b
+}
+
+// bootRegionToBytes the whole boot region with bs as its boot sector, including the checksum sector
+func (bs *bootSector) bootRegionToBytes() []byte {
+	sectorSize := 1 << bs.bytesPerSectorShift
+	b := make([]byte, bootRegionSectors*int64(sectorSize))
+	copy(b, bs.toBytes())
+	// the extended boot sectors are empty, apart from their signature
+	for i := 1; i <= 8; i++ {
+		binary.LittleEndian.PutUint32(b[(i+1)*sectorSize-4:], 0xaa550000)
+	}
+	checksum := bootChecksum(b[:bootChecksumSector*int64(sectorSize)])
+	for i := bootChecksumSector * int64(sectorSize); i < int64(len(b)); i += 4 {
+		binary.LittleEndian.PutUint32(b[i:], checksum)
+	}
+	return b
+}
+
+// bootChecksum the checksum of the first 11 sectors of a boot region, which leaves out the volume flags and
+// percent in use, so that those can change without rewriting the checksum
+func bootChecksum(b []byte) uint32 {
+	var checksum uint32
+	for i, c := range b {
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+		checksum = (checksum&1)<<31 + checksum>>1 + uint32(c)
+	}
+	return checksum
+}
+
+// validBootRegion check that the checksum sector at the end of the boot region b matches the rest of it
+func validBootRegion(b []byte, sectorSize int64) bool {
+	if int64(len(b)) != bootRegionSectors*sectorSize {
+		return false
+	}
+	checksum := bootChecksum(b[:bootChecksumSector*sectorSize])
+	for i := bootChecksumSector * sectorSize; i < int64(len(b)); i += 4 {
+		if binary.LittleEndian.Uint32(b[i:]) != checksum {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package exfat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func getValidBootSector() *bootSector {
+	return &bootSector{
+		volumeLength:           16384,
+		fatOffset:              24,
+		fatLength:              16,
+		clusterHeapOffset:      40,
+		clusterCount:           2040,
+		rootDirectoryCluster:   5,
+		volumeSerialNumber:     0x12345678,
+		fileSystemRevision:     0x0100,
+		bytesPerSectorShift:    9,
+		sectorsPerClusterShift: 3,
+		numberOfFats:           1,
+		driveSelect:            driveSelect,
+	}
+}
+
+func TestBootSectorRoundTrip(t *testing.T) {
+	bs := getValidBootSector()
+	b := bs.toBytes()
+	if len(b) != bootSectorSize {
+		t.Fatalf("boot sector is %d bytes instead of %d", len(b), bootSectorSize)
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		t.Errorf("missing boot signature, got % x", b[510:512])
+	}
+	read, err := bootSectorFromBytes(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(read.toBytes(), b) {
+		t.Errorf("boot sector changed on the way through bytes")
+	}
+}
+
+func TestBootSectorFromBytesInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(b []byte)
+	}{
+		{"jump", func(b []byte) { b[0] = 0 }},
+		{"name", func(b []byte) { copy(b[3:11], "NTFS    ") }},
+		{"must be zero", func(b []byte) { b[20] = 1 }},
+		{"sector shift", func(b []byte) { b[108] = 13 }},
+		{"signature", func(b []byte) { b[511] = 0 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := getValidBootSector().toBytes()
+			tt.modify(b)
+			if _, err := bootSectorFromBytes(b); err == nil {
+				t.Errorf("did not return expected error")
+			}
+		})
+	}
+	if _, err := bootSectorFromBytes(make([]byte, 100)); err == nil {
+		t.Errorf("did not return error for short boot sector")
+	}
+}
+
+func TestBootChecksum(t *testing.T) {
+	b := make([]byte, 512)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	// checked against an independent implementation
+	if sum := bootChecksum(b); sum != 0xfffb841b {
+		t.Errorf("checksum %#x instead of %#x", sum, uint32(0xfffb841b))
+	}
+	// the volume flags and percent in use change without the checksum changing
+	b[106], b[107], b[112] = 0xff, 0xff, 0xff
+	if sum := bootChecksum(b); sum != 0xfffb841b {
+		t.Errorf("checksum changed with volume flags and percent in use, %#x", sum)
+	}
+}
+
+func TestBootRegion(t *testing.T) {
+	bs := getValidBootSector()
+	b := bs.bootRegionToBytes()
+	if !validBootRegion(b, 512) {
+		t.Fatalf("boot region is not valid")
+	}
+	// the flags and percent in use are left out of the checksum
+	b[106], b[112] = 1, 50
+	if !validBootRegion(b, 512) {
+		t.Errorf("boot region not valid after changing flags")
+	}
+	b[bootSectorSize+10] = 1
+	if validBootRegion(b, 512) {
+		t.Errorf("boot region valid after changing an extended boot sector")
+	}
+}
@@ -0,0 +1,95 @@
+package exfat
+
+import (
+	"fmt"
+	"time"
+)
+
+// Directory represents a single directory in an exFAT filesystem
+type Directory struct {
+	// directoryEntry is the entry for the directory in its parent, shared with the entries of the parent, so that a
+	// change in its size is written with the parent. The root directory has none, so gets one made up for it.
+	*directoryEntry
+	parent  *Directory
+	entries []*directoryEntry
+}
+
+// entriesFromBytes loads the entries of the directory from its bytes
+func (d *Directory) entriesFromBytes(b []byte) error {
+	entries, err := directoryEntriesFromBytes(b)
+	if err != nil {
+		return fmt.Errorf("could not parse directory entries: %w", err)
+	}
+	d.entries = entries
+	return nil
+}
+
+// entriesToBytes the entries of the directory, ready to write to disk. They are written one after another,
+// without the deleted entries, and the caller pads them with zeros, which mark the end of the directory.
+func (d *Directory) entriesToBytes(upcase upcaseTable) ([]byte, error) {
+	var b []byte
+	for _, de := range d.entries {
+		eb, err := de.toBytes(upcase)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert entry %q to bytes: %w", de.name, err)
+		}
+		b = append(b, eb...)
+	}
+	return b, nil
+}
+
+// findEntry the file or subdirectory called name in the directory, ignoring case, or nil if there is none
+func (d *Directory) findEntry(name string, upcase upcaseTable) *directoryEntry {
+	for _, de := range d.entries {
+		if de.entryType == entryTypeFile && upcase.equalFold(de.name, name) {
+			return de
+		}
+	}
+	return nil
+}
+
+// labelEntry the volume label entry of the directory, or nil if there is none
+func (d *Directory) labelEntry() *directoryEntry {
+	for _, de := range d.entries {
+		if de.entryType == entryTypeVolumeLabel {
+			return de
+		}
+	}
+	return nil
+}
+
+// createEntry creates an entry in the directory for a file or subdirectory called name, which holds
+// dataLength bytes in the clusters starting at firstCluster
+func (d *Directory) createEntry(name string, firstCluster uint32, dataLength uint64, isDir bool) (*directoryEntry, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	de := &directoryEntry{
+		entryType:       entryTypeFile,
+		name:            name,
+		attributes:      attrArchive,
+		createTime:      now,
+		modifyTime:      now,
+		accessTime:      now,
+		flags:           flagAllocationPossible,
+		firstCluster:    firstCluster,
+		validDataLength: dataLength,
+		dataLength:      dataLength,
+	}
+	if isDir {
+		de.attributes = attrDirectory
+	}
+	d.entries = append(d.entries, de)
+	return de, nil
+}
+
+// removeEntry removes the entry de from the directory
+func (d *Directory) removeEntry(de *directoryEntry) {
+	for i, e := range d.entries {
+		if e == de {
+			d.entries = append(d.entries[:i], d.entries[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	entryTypeEndOfDirectory   uint8 = 0x00
+	entryTypeAllocationBitmap uint8 = 0x81
+	entryTypeUpcaseTable      uint8 = 0x82
+	entryTypeVolumeLabel      uint8 = 0x83
+	entryTypeFile             uint8 = 0x85
+	entryTypeStreamExtension  uint8 = 0xc0
+	entryTypeFileName         uint8 = 0xc1
+	// entryInUse is clear in the type of deleted entries
+	entryInUse uint8 = 0x80
+	// entrySecondary is set in the type of secondary entries, which follow a primary one in a set
+	entrySecondary uint8 = 0x40
+)
+
+const (
+	attrReadOnly  uint16 = 0x01
+	attrDirectory uint16 = 0x10
+	attrArchive   uint16 = 0x20
+)
+
+const (
+	// flagAllocationPossible is set in the stream extension of every file and directory
+	flagAllocationPossible uint8 = 0x01
+	// flagNoFatChain is set when the clusters of a file are contiguous, and not in the FAT
+	flagNoFatChain uint8 = 0x02
+)
+
+const (
+	bytesPerEntry     int = 32
+	charsPerNameEntry int = 15
+	maxNameLength     int = 255
+	maxLabelLength    int = 11
+	// invalidNameChars are not allowed in file names, nor is any control character
+	invalidNameChars string = "\"*/:<>?\\|"
+)
+
+// directoryEntry a single entry in a directory: a file or subdirectory with its stream extension and file names,
+// the volume label, or any other primary entry, such as the allocation bitmap and up-case table in the root
+// directory, which is kept as it was read
+type directoryEntry struct {
+	entryType       uint8
+	raw             []byte
+	name            string
+	attributes      uint16
+	createTime      time.Time
+	modifyTime      time.Time
+	accessTime      time.Time
+	flags           uint8
+	firstCluster    uint32
+	validDataLength uint64
+	dataLength      uint64
+	// extra are any secondary entries in a file set after the file names, such as vendor extensions
+	extra []byte
+}
+
+func (de *directoryEntry) isSubdirectory() bool {
+	return de.attributes&attrDirectory != 0
+}
+
+// directoryEntriesFromBytes read all of the entries of a directory from its bytes, skipping deleted ones,
+// up to the end of the directory
+func directoryEntriesFromBytes(b []byte) ([]*directoryEntry, error) {
+	var entries []*directoryEntry
+	for i := 0; i+bytesPerEntry <= len(b); {
+		entryType := b[i]
+		switch {
+		case entryType == entryTypeEndOfDirectory:
+			return entries, nil
+		case entryType&entryInUse == 0, entryType&entrySecondary != 0:
+			// deleted entries, and secondary ones left over from a set that was not in use
+			i += bytesPerEntry
+		case entryType == entryTypeFile:
+			count := 1 + int(b[i+1])
+			if i+count*bytesPerEntry > len(b) {
+				return nil, fmt.Errorf("file entry at %d has %d secondary entries past the end of the directory", i, count-1)
+			}
+			de, err := fileEntryFromBytes(b[i : i+count*bytesPerEntry])
+			if err != nil {
+				return nil, fmt.Errorf("invalid file entry at %d: %w", i, err)
+			}
+			entries = append(entries, de)
+			i += count * bytesPerEntry
+		case entryType == entryTypeVolumeLabel:
+			count := int(b[i+1])
+			if count > maxLabelLength {
+				return nil, fmt.Errorf("volume label of %d characters, maximum is %d", count, maxLabelLength)
+			}
+			label := make([]uint16, count)
+			for j := range label {
+				label[j] = binary.LittleEndian.Uint16(b[i+2+2*j:])
+			}
+			entries = append(entries, &directoryEntry{entryType: entryType, name: string(utf16.Decode(label))})
+			i += bytesPerEntry
+		default:
+			// the allocation bitmap and up-case table have no secondary entries, any other primary one says how many it has
+			count := 1
+			if entryType != entryTypeAllocationBitmap && entryType != entryTypeUpcaseTable {
+				count += int(b[i+1])
+			}
+			end := min(i+count*bytesPerEntry, len(b))
+			de := &directoryEntry{entryType: entryType, raw: append([]byte{}, b[i:end]...)}
+			if entryType == entryTypeAllocationBitmap || entryType == entryTypeUpcaseTable {
+				de.firstCluster = binary.LittleEndian.Uint32(b[i+20:])
+				de.dataLength = binary.LittleEndian.Uint64(b[i+24:])
+			}
+			entries = append(entries, de)
+			i = end
+		}
+	}
+	return entries, nil
+}
+
+// newTableEntry an allocation bitmap or up-case table entry for the root directory, for a table of dataLength bytes
+// in the clusters from firstCluster. Only the up-case table has a checksum.
+func newTableEntry(entryType uint8, firstCluster uint32, dataLength uint64, checksum uint32) *directoryEntry {
+	b := make([]byte, bytesPerEntry)
+	b[0] = entryType
+	if entryType == entryTypeUpcaseTable {
+		binary.LittleEndian.PutUint32(b[4:8], checksum)
+	}
+	binary.LittleEndian.PutUint32(b[20:24], firstCluster)
+	binary.LittleEndian.PutUint64(b[24:32], dataLength)
+	return &directoryEntry{entryType: entryType, raw: b, firstCluster: firstCluster, dataLength: dataLength}
+}
+
+// tableChecksum the checksum in an up-case table entry
+func (de *directoryEntry) tableChecksum() uint32 {
+	return binary.LittleEndian.Uint32(de.raw[4:8])
+}
+
+// fileEntryFromBytes read a file or subdirectory from the bytes of its whole entry set
+func fileEntryFromBytes(b []byte) (*directoryEntry, error) {
+	if checksum := binary.LittleEndian.Uint16(b[2:4]); checksum != entrySetChecksum(b) {
+		return nil, fmt.Errorf("set checksum %#04x does not match the calculated %#04x", checksum, entrySetChecksum(b))
+	}
+	if len(b) < 3*bytesPerEntry || b[bytesPerEntry] != entryTypeStreamExtension {
+		return nil, errors.New("missing stream extension entry")
+	}
+	stream := b[bytesPerEntry : 2*bytesPerEntry]
+	de := &directoryEntry{
+		entryType:       entryTypeFile,
+		attributes:      binary.LittleEndian.Uint16(b[4:6]),
+		createTime:      timeFromTimestamp(binary.LittleEndian.Uint32(b[8:12]), b[20], b[22]),
+		modifyTime:      timeFromTimestamp(binary.LittleEndian.Uint32(b[12:16]), b[21], b[23]),
+		accessTime:      timeFromTimestamp(binary.LittleEndian.Uint32(b[16:20]), 0, b[24]),
+		flags:           stream[1],
+		validDataLength: binary.LittleEndian.Uint64(stream[8:16]),
+		firstCluster:    binary.LittleEndian.Uint32(stream[20:24]),
+		dataLength:      binary.LittleEndian.Uint64(stream[24:32]),
+	}
+	if de.validDataLength > de.dataLength {
+		return nil, fmt.Errorf("valid data length %d is more than the data length %d", de.validDataLength, de.dataLength)
+	}
+	nameLength := int(stream[3])
+	nameEntries := (nameLength + charsPerNameEntry - 1) / charsPerNameEntry
+	if nameLength == 0 || len(b) < (2+nameEntries)*bytesPerEntry {
+		return nil, fmt.Errorf("not enough file name entries for a name of %d characters", nameLength)
+	}
+	name := make([]uint16, 0, nameEntries*charsPerNameEntry)
+	for i := 2; i < 2+nameEntries; i++ {
+		entry := b[i*bytesPerEntry : (i+1)*bytesPerEntry]
+		if entry[0] != entryTypeFileName {
+			return nil, fmt.Errorf("entry %d of the set has type %#02x instead of a file name", i, entry[0])
+		}
+		for j := 2; j < bytesPerEntry; j += 2 {
+			name = append(name, binary.LittleEndian.Uint16(entry[j:]))
+		}
+	}
+	de.name = string(utf16.Decode(name[:nameLength]))
+	if rest := b[(2+nameEntries)*bytesPerEntry:]; len(rest) > 0 {
+		de.extra = append([]byte{}, rest...)
+	}
+	return de, nil
+}
+
+// toBytes the entry, or the whole entry set of a file or subdirectory, ready to write to disk. Files need the
+// up-case table for the hash of their name.
+func (de *directoryEntry) toBytes(upcase upcaseTable) ([]byte, error) {
+	switch de.entryType {
+	case entryTypeFile:
+		return de.fileEntryToBytes(upcase)
+	case entryTypeVolumeLabel:
+		label := utf16.Encode([]rune(de.name))
+		if len(label) > maxLabelLength {
+			return nil, fmt.Errorf("volume label %q is longer than %d characters", de.name, maxLabelLength)
+		}
+		b := make([]byte, bytesPerEntry)
+		b[0] = entryTypeVolumeLabel
+		b[1] = uint8(len(label))
+		for i, c := range label {
+			binary.LittleEndian.PutUint16(b[2+2*i:], c)
+		}
+		return b, nil
+	default:
+		return de.raw, nil
+	}
+}
+
+func (de *directoryEntry) fileEntryToBytes(upcase upcaseTable) ([]byte, error) {
+	if err := validateName(de.name); err != nil {
+		return nil, err
+	}
+	name := utf16.Encode([]rune(de.name))
+	nameEntries := (len(name) + charsPerNameEntry - 1) / charsPerNameEntry
+	count := 2 + nameEntries + len(de.extra)/bytesPerEntry
+	b := make([]byte, count*bytesPerEntry)
+
+	b[0] = entryTypeFile
+	b[1] = uint8(count - 1)
+	binary.LittleEndian.PutUint16(b[4:6], de.attributes)
+	ts, ms, offset := timestampFromTime(de.createTime)
+	binary.LittleEndian.PutUint32(b[8:12], ts)
+	b[20], b[22] = ms, offset
+	ts, ms, offset = timestampFromTime(de.modifyTime)
+	binary.LittleEndian.PutUint32(b[12:16], ts)
+	b[21], b[23] = ms, offset
+	ts, _, offset = timestampFromTime(de.accessTime)
+	binary.LittleEndian.PutUint32(b[16:20], ts)
+	b[24] = offset
+
+	stream := b[bytesPerEntry : 2*bytesPerEntry]
+	stream[0] = entryTypeStreamExtension
+	stream[1] = de.flags
+	stream[3] = uint8(len(name))
+	binary.LittleEndian.PutUint16(stream[4:6], nameHash(upcase.upcase(de.name)))
+	binary.LittleEndian.PutUint64(stream[8:16], de.validDataLength)
+	binary.LittleEndian.PutUint32(stream[20:24], de.firstCluster)
+	binary.LittleEndian.PutUint64(stream[24:32], de.dataLength)
+
+	for i, c := range name {
+		entry := b[(2+i/charsPerNameEntry)*bytesPerEntry:]
+		entry[0] = entryTypeFileName
+		binary.LittleEndian.PutUint16(entry[2+2*(i%charsPerNameEntry):], c)
+	}
+	copy(b[(2+nameEntries)*bytesPerEntry:], de.extra)
+
+	binary.LittleEndian.PutUint16(b[2:4], entrySetChecksum(b))
+	return b, nil
+}
+
+// entrySetChecksum the checksum of a whole entry set, which leaves out the checksum itself in the primary entry
+func entrySetChecksum(b []byte) uint16 {
+	var checksum uint16
+	for i, c := range b {
+		if i == 2 || i == 3 {
+			continue
+		}
+		checksum = (checksum&1)<<15 + checksum>>1 + uint16(c)
+	}
+	return checksum
+}
+
+// nameHash the hash of a name in upper case, which lets a lookup skip the entries whose hash does not match
+func nameHash(name []uint16) uint16 {
+	var hash uint16
+	for _, c := range name {
+		hash = (hash&1)<<15 + hash>>1 + c&0xff
+		hash = (hash&1)<<15 + hash>>1 + c>>8
+	}
+	return hash
+}
+
+// validateName check that name can be used for a file or directory in exFAT
+func validateName(name string) error {
+	length := len(utf16.Encode([]rune(name)))
+	if length == 0 || length > maxNameLength {
+		return fmt.Errorf("invalid name %q, must be between 1 and %d characters", name, maxNameLength)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(invalidNameChars, r) {
+			return fmt.Errorf("invalid character %q in name %q", r, name)
+		}
+	}
+	return nil
+}
+
+// timestampFromTime the exFAT timestamp, 10ms increments and UTC offset of t, which is clamped to the years
+// that exFAT can hold, from 1980 to 2107
+func timestampFromTime(t time.Time) (timestamp uint32, increment, utcOffset uint8) {
+	_, offset := t.Zone()
+	switch {
+	case t.Year() < 1980:
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	case t.Year() > 2107:
+		t = time.Date(2107, 12, 31, 23, 59, 59, 990000000, t.Location())
+	}
+	timestamp = uint32(t.Year()-1980)<<25 | uint32(t.Month())<<21 | uint32(t.Day())<<16 |
+		uint32(t.Hour())<<11 | uint32(t.Minute())<<5 | uint32(t.Second()/2)
+	increment = uint8(t.Second()%2*100 + t.Nanosecond()/10000000)
+	// the offset is in 15 minute steps, as a 7-bit signed number, with the top bit set to say it is valid
+	utcOffset = 0x80 | uint8(offset/900)&0x7f
+	return timestamp, increment, utcOffset
+}
+
+// timeFromTimestamp the time of an exFAT timestamp, 10ms increments and UTC offset, which is local time if the
+// offset is not valid
+func timeFromTimestamp(timestamp uint32, increment, utcOffset uint8) time.Time {
+	loc := time.Local
+	if utcOffset&0x80 != 0 {
+		quarters := int(utcOffset & 0x7f)
+		if quarters >= 0x40 {
+			quarters -= 0x80
+		}
+		loc = time.FixedZone("", quarters*900)
+	}
+	return time.Date(
+		int(timestamp>>25)+1980, time.Month(timestamp>>21&0xf), int(timestamp>>16&0x1f),
+		int(timestamp>>11&0x1f), int(timestamp>>5&0x3f), int(timestamp&0x1f)*2+int(increment)/100,
+		int(increment)%100*10000000, loc)
+}
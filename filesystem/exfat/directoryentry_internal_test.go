@@ -0,0 +1,159 @@
+package exfat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileEntryRoundTrip(t *testing.T) {
+	upcase := defaultUpcaseTable()
+	when := time.Date(2024, 3, 15, 10, 20, 31, 450000000, time.FixedZone("", -5*3600))
+	tests := []struct {
+		name  string
+		entry *directoryEntry
+		count int
+	}{
+		{"short name", &directoryEntry{name: "a.txt", attributes: attrArchive, flags: flagAllocationPossible, firstCluster: 7, validDataLength: 100, dataLength: 4096}, 3},
+		{"long name", &directoryEntry{name: strings.Repeat("long name ", 10), attributes: attrDirectory, flags: flagAllocationPossible | flagNoFatChain, firstCluster: 12, validDataLength: 8192, dataLength: 8192}, 9},
+		{"unicode name", &directoryEntry{name: "日本語のファイル", attributes: attrArchive | attrReadOnly}, 3},
+		{"extra entries", &directoryEntry{name: "vendor", attributes: attrArchive, extra: append([]byte{0xe0}, make([]byte, 31)...)}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			de := tt.entry
+			de.entryType = entryTypeFile
+			de.createTime, de.modifyTime, de.accessTime = when, when, when
+			b, err := de.toBytes(upcase)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(b) != tt.count*bytesPerEntry {
+				t.Fatalf("entry set is %d entries instead of %d", len(b)/bytesPerEntry, tt.count)
+			}
+			read, err := fileEntryFromBytes(b)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if read.name != de.name || read.attributes != de.attributes || read.flags != de.flags ||
+				read.firstCluster != de.firstCluster || read.validDataLength != de.validDataLength ||
+				read.dataLength != de.dataLength || !bytes.Equal(read.extra, de.extra) {
+				t.Errorf("entry changed on the way through bytes, %+v instead of %+v", read, de)
+			}
+			if !read.modifyTime.Equal(when) {
+				t.Errorf("modify time %v instead of %v", read.modifyTime, when)
+			}
+			// the access time has no 10ms increments, so is to the nearest 2 seconds
+			if !read.accessTime.Equal(when.Truncate(2 * time.Second)) {
+				t.Errorf("access time %v instead of %v", read.accessTime, when.Truncate(2*time.Second))
+			}
+		})
+	}
+}
+
+func TestFileEntryFromBytesInvalid(t *testing.T) {
+	de := &directoryEntry{entryType: entryTypeFile, name: "file", modifyTime: time.Now()}
+	valid, err := de.toBytes(defaultUpcaseTable())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Run("checksum", func(t *testing.T) {
+		b := bytes.Clone(valid)
+		b[bytesPerEntry+8]++
+		if _, err := fileEntryFromBytes(b); err == nil {
+			t.Errorf("did not return expected error")
+		}
+	})
+	t.Run("missing name", func(t *testing.T) {
+		b := bytes.Clone(valid[:2*bytesPerEntry])
+		b[1] = 1
+		putChecksum(b)
+		if _, err := fileEntryFromBytes(b); err == nil {
+			t.Errorf("did not return expected error")
+		}
+	})
+	t.Run("valid data past the end", func(t *testing.T) {
+		b := bytes.Clone(valid)
+		b[bytesPerEntry+8] = 1
+		putChecksum(b)
+		if _, err := fileEntryFromBytes(b); err == nil {
+			t.Errorf("did not return expected error")
+		}
+	})
+}
+
+func putChecksum(b []byte) {
+	checksum := entrySetChecksum(b)
+	b[2], b[3] = byte(checksum), byte(checksum>>8)
+}
+
+func TestNameHash(t *testing.T) {
+	upcase := defaultUpcaseTable()
+	// checked against an independent implementation
+	tests := []struct {
+		name string
+		hash uint16
+	}{
+		{"Hello.TXT", 0x3046},
+		{"hello.txt", 0x3046},
+		{"a", 0x8020},
+	}
+	for _, tt := range tests {
+		if hash := nameHash(upcase.upcase(tt.name)); hash != tt.hash {
+			t.Errorf("hash of %q is %#04x instead of %#04x", tt.name, hash, tt.hash)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"file.txt", true},
+		{"with space", true},
+		{"ünïcödé", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{"a:b", false},
+		{"tab\there", false},
+		{strings.Repeat("a", 255), true},
+		{strings.Repeat("a", 256), false},
+	}
+	for _, tt := range tests {
+		err := validateName(tt.name)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateName(%q) returned %v, expected valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       time.Time
+		expected time.Time
+	}{
+		{"utc", time.Date(2020, 2, 29, 23, 59, 59, 990000000, time.UTC), time.Date(2020, 2, 29, 23, 59, 59, 990000000, time.UTC)},
+		{"ahead", time.Date(2001, 9, 9, 1, 46, 40, 0, time.FixedZone("", 5*3600+45*60)), time.Date(2001, 9, 9, 1, 46, 40, 0, time.FixedZone("", 5*3600+45*60))},
+		{"behind", time.Date(1999, 12, 31, 12, 0, 1, 0, time.FixedZone("", -9*3600-30*60)), time.Date(1999, 12, 31, 12, 0, 1, 0, time.FixedZone("", -9*3600-30*60))},
+		{"too early", time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"too late", time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2107, 12, 31, 23, 59, 59, 990000000, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := timeFromTimestamp(timestampFromTime(tt.in))
+			if !out.Equal(tt.expected) {
+				t.Errorf("time %v instead of %v", out, tt.expected)
+			}
+			_, offset := out.Zone()
+			_, expectedOffset := tt.expected.Zone()
+			if offset != expectedOffset {
+				t.Errorf("UTC offset %d instead of %d", offset, expectedOffset)
+			}
+		})
+	}
+}
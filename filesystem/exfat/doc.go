@@ -0,0 +1,13 @@
+// Package exfat provides utilities to interact with, manipulate and create an exFAT filesystem on a block device or
+// a disk image.
+//
+// exFAT is the filesystem of SD cards larger than 32GB, and of removable media that need files larger than the
+// 4GB that FAT32 allows. It keeps the cluster allocation in a bitmap, rather than in the allocation table, which
+// only holds the chains of fragmented files, and compares file names case-insensitively with an up-case table
+// stored in the filesystem.
+//
+// references:
+//
+//	https://learn.microsoft.com/en-us/windows/win32/fileio/exfat-specification
+//	https://en.wikipedia.org/wiki/ExFAT
+package exfat
@@ -0,0 +1,1076 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/util"
+)
+
+const (
+	fatMediaType   uint32 = 0xfffffff8
+	fatEndOfChain  uint32 = 0xffffffff
+	fatFreeCluster uint32 = 0
+	// maxClusterCount leaves room for the markers at the top of the range of FAT entries
+	maxClusterCount uint64 = 0xfffffff5
+)
+
+// FileSystem implements the FileSystem interface
+type FileSystem struct {
+	bootSector      bootSector
+	fat             []uint32
+	bitmap          *util.Bitmap
+	bitmapClusters  []uint32
+	freeClusters    uint32
+	upcase          upcaseTable
+	bytesPerCluster int64
+	// dirtyFrom and dirtyTo are the range of clusters whose FAT entries and allocation bitmap bits have changed
+	// since they were last written, with dirtyTo 0 when there are none
+	dirtyFrom uint32
+	dirtyTo   uint32
+	size      int64
+	start     int64
+	backend   backend.Storage
+}
+
+// Create creates an exFAT filesystem in a given file or device
+//
+// requires the backend.Storage where to create the filesystem, size is the size of the filesystem in bytes,
+// start is how far in bytes from the beginning of the backend.Storage to create the filesystem,
+// and blocksize is is the logical blocksize to use for creating the filesystem
+//
+// note that you are *not* required to create the filesystem on the entire disk. You could have a disk of size
+// 20GB, and create a small filesystem of size 50MB that begins 2GB into the disk.
+// This is extremely useful for creating filesystems on disk partitions.
+//
+// Note, however, that it is much easier to do this using the higher-level APIs at github.com/diskfs/go-diskfs
+// which allow you to work directly with partitions, rather than having to calculate (and hopefully not make any errors)
+// where a partition starts and ends.
+//
+// The blocksize is the size of the logical sectors of the filesystem, which should match the logical
+// sector size of the disk: 512, 1024, 2048 or 4096 bytes. If it is 0, it will use the default of 512 bytes.
+// The clusters are the sizes that Windows picks by default: 4KB up to 256MB, 32KB up to 32GB, and 128KB above that.
+func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string) (*FileSystem, error) {
+	sectorShift, err := sectorShiftForBlocksize(blocksize)
+	if err != nil {
+		return nil, err
+	}
+	if size < MinSize {
+		return nil, fmt.Errorf("requested size is smaller than minimum allowed exFAT, requested %d minimum %d", size, MinSize)
+	}
+	if len(utf16.Encode([]rune(volumeLabel))) > maxLabelLength {
+		return nil, fmt.Errorf("invalid volume label %q, maximum is %d characters", volumeLabel, maxLabelLength)
+	}
+	writableFile, err := b.Writable()
+	if err != nil {
+		return nil, err
+	}
+	sectorSize := int64(1) << sectorShift
+	clusterShift := uint8(bits.TrailingZeros64(uint64(clusterSizeForSize(size) / sectorSize)))
+	totalSectors := uint64(size / sectorSize)
+	fatOffset, fatLength, clusterHeapOffset, clusterCount, err := layout(totalSectors, clusterShift, sectorShift)
+	if err != nil {
+		return nil, err
+	}
+
+	// exFAT uses time-of-day of creation as a volume ID, as FAT does
+	now := time.Now()
+	fs := &FileSystem{
+		bootSector: bootSector{
+			partitionOffset:        uint64(start / sectorSize),
+			volumeLength:           totalSectors,
+			fatOffset:              fatOffset,
+			fatLength:              fatLength,
+			clusterHeapOffset:      clusterHeapOffset,
+			clusterCount:           clusterCount,
+			volumeSerialNumber:     uint32(now.Unix()<<20 | (now.UnixNano() / 1000000)),
+			fileSystemRevision:     fileSystemRevision,
+			bytesPerSectorShift:    sectorShift,
+			sectorsPerClusterShift: clusterShift,
+			numberOfFats:           1,
+			driveSelect:            driveSelect,
+			bootCode:               []byte{},
+		},
+		fat:             make([]uint32, clusterCount+2),
+		bitmap:          util.NewBitmap(int(clusterCount+7) / 8),
+		freeClusters:    clusterCount,
+		upcase:          defaultUpcaseTable(),
+		bytesPerCluster: sectorSize << clusterShift,
+		size:            size,
+		start:           start,
+		backend:         b,
+	}
+	fs.fat[0] = fatMediaType
+	fs.fat[1] = fatEndOfChain
+
+	// the allocation bitmap, up-case table and root directory are at the start of the cluster heap,
+	// one after the other, and all have chains in the FAT
+	upcaseBytes := fs.upcase.toBytes()
+	bitmapEntry := &directoryEntry{dataLength: uint64(clusterCount+7) / 8}
+	upcaseEntry := &directoryEntry{dataLength: uint64(len(upcaseBytes))}
+	rootEntry := &directoryEntry{entryType: entryTypeFile, attributes: attrDirectory, dataLength: uint64(fs.bytesPerCluster)}
+	for _, de := range []*directoryEntry{bitmapEntry, upcaseEntry, rootEntry} {
+		if _, err := fs.resizeChain(de, de.dataLength); err != nil {
+			return nil, fmt.Errorf("could not allocate clusters for the allocation bitmap, up-case table and root directory: %w", err)
+		}
+	}
+	fs.bootSector.rootDirectoryCluster = rootEntry.firstCluster
+	if fs.bitmapClusters, err = fs.clusterList(bitmapEntry); err != nil {
+		return nil, fmt.Errorf("could not get clusters of the allocation bitmap: %w", err)
+	}
+
+	// write the main and backup boot regions
+	region := fs.bootSector.bootRegionToBytes()
+	for _, offset := range []int64{0, int64(len(region))} {
+		if _, err := writableFile.WriteAt(region, fs.start+offset); err != nil {
+			return nil, fmt.Errorf("failed to write the boot region: %w", err)
+		}
+	}
+
+	// write the whole of the FAT and allocation bitmap
+	fs.markDirty(0)
+	fs.markDirty(clusterCount + 1)
+	if err := fs.writeAllocation(); err != nil {
+		return nil, err
+	}
+
+	upcaseClusters, err := fs.clusterList(upcaseEntry)
+	if err != nil {
+		return nil, fmt.Errorf("could not get clusters of the up-case table: %w", err)
+	}
+	padded := make([]byte, int64(len(upcaseClusters))*fs.bytesPerCluster)
+	copy(padded, upcaseBytes)
+	if err := fs.writeAt(upcaseClusters, padded, 0); err != nil {
+		return nil, fmt.Errorf("failed to write the up-case table: %w", err)
+	}
+
+	root := &Directory{
+		directoryEntry: rootEntry,
+		entries: []*directoryEntry{
+			{entryType: entryTypeVolumeLabel, name: volumeLabel},
+			newTableEntry(entryTypeAllocationBitmap, bitmapEntry.firstCluster, bitmapEntry.dataLength, 0),
+			newTableEntry(entryTypeUpcaseTable, upcaseEntry.firstCluster, upcaseEntry.dataLength, upcaseChecksum(upcaseBytes)),
+		},
+	}
+	if err := fs.writeDirectoryEntries(root); err != nil {
+		return nil, fmt.Errorf("error writing root directory to disk: %w", err)
+	}
+
+	return fs, nil
+}
+
+// clusterSizeForSize the size of clusters that Create uses for a filesystem of size bytes
+func clusterSizeForSize(size int64) int64 {
+	switch {
+	case size <= 256*MB:
+		return 4 * KB
+	case size <= 32*GB:
+		return 32 * KB
+	default:
+		return 128 * KB
+	}
+}
+
+// layout where the FAT and cluster heap go, all in sectors, and how many clusters fit, in a filesystem of totalSectors
+// sectors. The FAT follows the main and backup boot regions, and both it and the cluster heap start on a cluster
+// boundary, so that clusters line up with the erase blocks of flash media.
+func layout(totalSectors uint64, clusterShift, sectorShift uint8) (fatOffset, fatLength, clusterHeapOffset, clusterCount uint32, err error) {
+	sectorsPerCluster := uint64(1) << clusterShift
+	roundUp := func(sectors uint64) uint64 {
+		return (sectors + sectorsPerCluster - 1) &^ (sectorsPerCluster - 1)
+	}
+	offset := roundUp(uint64(2 * bootRegionSectors))
+	if totalSectors <= offset {
+		return 0, 0, 0, 0, fmt.Errorf("requested size of %d sectors is too small for exFAT", totalSectors)
+	}
+	// size the FAT for the clusters there would be without it, which leaves it large enough
+	clusters := min((totalSectors-offset)/sectorsPerCluster, maxClusterCount)
+	length := ((clusters+2)*4 + 1<<sectorShift - 1) >> sectorShift
+	heap := roundUp(offset + length)
+	if totalSectors <= heap+sectorsPerCluster {
+		return 0, 0, 0, 0, fmt.Errorf("requested size of %d sectors is too small for exFAT", totalSectors)
+	}
+	clusters = min((totalSectors-heap)/sectorsPerCluster, maxClusterCount)
+	if heap > 0xffffffff {
+		return 0, 0, 0, 0, fmt.Errorf("requested size of %d sectors is too large for exFAT", totalSectors)
+	}
+	return uint32(offset), uint32(length), uint32(heap), uint32(clusters), nil
+}
+
+// sectorShiftForBlocksize the power of 2 of blocksize, which must be a sector size exFAT supports,
+// or 0 for the default of 512
+func sectorShiftForBlocksize(blocksize int64) (uint8, error) {
+	switch blocksize {
+	case 0:
+		return minSectorShift, nil
+	case 512, 1024, 2048, 4096:
+		return uint8(bits.TrailingZeros64(uint64(blocksize))), nil
+	default:
+		return 0, fmt.Errorf("blocksize for exFAT must be 0 or one of 512, 1024, 2048 or 4096 bytes, not %d", blocksize)
+	}
+}
+
+// Read reads a filesystem from a given disk.
+//
+// requires the backend.Storage where to read the filesystem, size is the size of the filesystem in bytes,
+// start is how far in bytes from the beginning of the backend.Storage the filesystem is expected to begin,
+// and blocksize is is the logical blocksize to use for creating the filesystem
+//
+// note that you are *not* required to read a filesystem on the entire disk. You could have a disk of size
+// 20GB, and a small filesystem of size 50MB that begins 2GB into the disk.
+// This is extremely useful for working with filesystems on disk partitions.
+//
+// Note, however, that it is much easier to do this using the higher-level APIs at github.com/diskfs/go-diskfs
+// which allow you to work directly with partitions, rather than having to calculate (and hopefully not make any errors)
+// where a partition starts and ends.
+//
+// The blocksize must be 0 or one of the sector sizes that Create accepts, else it will return an error.
+// The filesystem is always read with the sector size in its boot sector, which need not match the blocksize.
+// If the checksum of the main boot region does not match, Read falls back to the backup boot region.
+func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error) {
+	if _, err := sectorShiftForBlocksize(blocksize); err != nil {
+		return nil, err
+	}
+	if size < MinSize {
+		return nil, fmt.Errorf("requested size is smaller than minimum allowed exFAT size %d", MinSize)
+	}
+	bs, err := readBootRegion(b, start)
+	if err != nil {
+		// the backup boot region follows the main one, which may be too damaged to say how large the sectors are
+		for shift := minSectorShift; shift <= maxSectorShift && bs == nil; shift++ {
+			if backup, backupErr := readBootRegion(b, start+bootRegionSectors<<shift); backupErr == nil && backup.bytesPerSectorShift == shift {
+				bs = backup
+			}
+		}
+		if bs == nil {
+			return nil, err
+		}
+	}
+	sectorSize := int64(1) << bs.bytesPerSectorShift
+	if int64(bs.volumeLength) > size/sectorSize {
+		return nil, fmt.Errorf("volume of %d sectors is larger than the requested size %d", bs.volumeLength, size)
+	}
+
+	fs := &FileSystem{
+		bootSector:      *bs,
+		bytesPerCluster: sectorSize << bs.sectorsPerClusterShift,
+		size:            size,
+		start:           start,
+		backend:         b,
+	}
+
+	// the active FAT, which is the second one only if there are two and the volume flags say so
+	fatBytes := make([]byte, (int64(bs.clusterCount)+2)*4)
+	if _, err := b.ReadAt(fatBytes, fs.start+fs.fatStart()); err != nil {
+		return nil, fmt.Errorf("unable to read FAT: %w", err)
+	}
+	fs.fat = make([]uint32, bs.clusterCount+2)
+	for i := range fs.fat {
+		fs.fat[i] = binary.LittleEndian.Uint32(fatBytes[4*i:])
+	}
+
+	// the up-case table and allocation bitmap are in the root directory, which can be read without either
+	fs.upcase = defaultUpcaseTable()
+	root, err := fs.rootDirectory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read root directory: %w", err)
+	}
+	var bitmapEntry, upcaseEntry *directoryEntry
+	for _, de := range root.entries {
+		switch {
+		case de.entryType == entryTypeAllocationBitmap && uint16(de.raw[1]&1) == fs.activeFat():
+			bitmapEntry = de
+		case de.entryType == entryTypeUpcaseTable:
+			upcaseEntry = de
+		}
+	}
+	if bitmapEntry == nil || upcaseEntry == nil {
+		return nil, errors.New("root directory is missing the allocation bitmap or up-case table")
+	}
+
+	upcaseBytes, err := fs.readTable(upcaseEntry)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read up-case table: %w", err)
+	}
+	if checksum := upcaseChecksum(upcaseBytes); checksum != upcaseEntry.tableChecksum() {
+		return nil, fmt.Errorf("up-case table checksum %#08x does not match the calculated %#08x", upcaseEntry.tableChecksum(), checksum)
+	}
+	if fs.upcase, err = upcaseTableFromBytes(upcaseBytes); err != nil {
+		return nil, fmt.Errorf("invalid up-case table: %w", err)
+	}
+
+	if bitmapEntry.dataLength < uint64(bs.clusterCount+7)/8 {
+		return nil, fmt.Errorf("allocation bitmap of %d bytes is too small for %d clusters", bitmapEntry.dataLength, bs.clusterCount)
+	}
+	bitmapBytes, err := fs.readTable(bitmapEntry)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read allocation bitmap: %w", err)
+	}
+	fs.bitmap = util.BitmapFromBytes(bitmapBytes)
+	if fs.bitmapClusters, err = fs.clusterList(bitmapEntry); err != nil {
+		return nil, fmt.Errorf("could not get clusters of the allocation bitmap: %w", err)
+	}
+	for _, free := range fs.bitmap.FreeList() {
+		if free.Position < int(bs.clusterCount) {
+			fs.freeClusters += uint32(min(free.Position+free.Count, int(bs.clusterCount)) - free.Position)
+		}
+	}
+
+	return fs, nil
+}
+
+// readBootRegion read and check the boot region at offset, returning its boot sector
+func readBootRegion(b backend.Storage, offset int64) (*bootSector, error) {
+	// the boot sector is in the first 512 bytes, whatever the size of the sectors
+	bsb := make([]byte, bootSectorSize)
+	if _, err := b.ReadAt(bsb, offset); err != nil {
+		return nil, fmt.Errorf("could not read bytes from file: %w", err)
+	}
+	bs, err := bootSectorFromBytes(bsb)
+	if err != nil {
+		return nil, fmt.Errorf("error reading exFAT boot sector: %w", err)
+	}
+	sectorSize := int64(1) << bs.bytesPerSectorShift
+	region := make([]byte, bootRegionSectors*sectorSize)
+	if _, err := b.ReadAt(region, offset); err != nil {
+		return nil, fmt.Errorf("could not read boot region: %w", err)
+	}
+	if !validBootRegion(region, sectorSize) {
+		return nil, errors.New("boot region checksum does not match")
+	}
+	return bs, nil
+}
+
+// readTable read the whole of the allocation bitmap or up-case table in the entry de
+func (fs *FileSystem) readTable(de *directoryEntry) ([]byte, error) {
+	clusters, err := fs.clusterList(de)
+	if err != nil {
+		return nil, err
+	}
+	if de.dataLength > uint64(len(clusters))*uint64(fs.bytesPerCluster) {
+		return nil, fmt.Errorf("%d bytes do not fit in %d clusters", de.dataLength, len(clusters))
+	}
+	b := make([]byte, de.dataLength)
+	if err := fs.readAt(clusters, b, 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// sectorSize the size in bytes of the logical sectors of the filesystem
+func (fs *FileSystem) sectorSize() int64 {
+	return int64(1) << fs.bootSector.bytesPerSectorShift
+}
+
+// activeFat which of the FATs and allocation bitmaps is in use, 0 or 1
+func (fs *FileSystem) activeFat() uint16 {
+	if fs.bootSector.numberOfFats < 2 {
+		return 0
+	}
+	return fs.bootSector.volumeFlags & volumeFlagActiveFat
+}
+
+// fatStart the offset in bytes of the active FAT from the start of the filesystem
+func (fs *FileSystem) fatStart() int64 {
+	return (int64(fs.bootSector.fatOffset) + int64(fs.activeFat())*int64(fs.bootSector.fatLength)) * fs.sectorSize()
+}
+
+// clusterStart the offset in bytes of cluster in the backend
+func (fs *FileSystem) clusterStart(cluster uint32) int64 {
+	return fs.start + int64(fs.bootSector.clusterHeapOffset)*fs.sectorSize() + int64(cluster-2)*fs.bytesPerCluster
+}
+
+func (fs *FileSystem) validCluster(cluster uint32) bool {
+	return cluster >= 2 && cluster < fs.bootSector.clusterCount+2
+}
+
+// interface guard
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
+
+// Type returns the type code for the filesystem. Always returns filesystem.TypeExFAT
+func (fs *FileSystem) Type() filesystem.Type {
+	return filesystem.TypeExFAT
+}
+
+// Mkdir make a directory at the given path. It is equivalent to `mkdir -p`, i.e. idempotent, in that:
+//
+// * It will make the entire tree path if it does not exist
+// * It will not return an error if the path already exists
+func (fs *FileSystem) Mkdir(p string) error {
+	_, _, err := fs.readDirWithMkdir(p, true)
+	// we are not interesting in returning the entries
+	return err
+}
+
+// creates a filesystem node (file, device special file, or named pipe) named pathname,
+// with attributes specified by mode and dev
+func (fs *FileSystem) Mknod(_ string, _ uint32, _ int) error {
+	return filesystem.ErrNotSupported
+}
+
+// creates a new link (also known as a hard link) to an existing file.
+func (fs *FileSystem) Link(_, _ string) error {
+	return filesystem.ErrNotSupported
+}
+
+// creates a symbolic link named linkpath which contains the string target.
+func (fs *FileSystem) Symlink(_, _ string) error {
+	return filesystem.ErrNotSupported
+}
+
+// Chmod changes the mode of the named file to mode. If the file is a symbolic link,
+// it changes the mode of the link's target.
+func (fs *FileSystem) Chmod(_ string, _ os.FileMode) error {
+	return filesystem.ErrNotSupported
+}
+
+// Chown changes the numeric uid and gid of the named file. If the file is a symbolic link,
+// it changes the uid and gid of the link's target. A uid or gid of -1 means to not change that value
+func (fs *FileSystem) Chown(_ string, _, _ int) error {
+	return filesystem.ErrNotSupported
+}
+
+// Chtimes change the access and modification times of the file or directory at p, as os.Chtimes does.
+// A zero time.Time leaves that time unchanged. exFAT keeps modification times to 10 milliseconds, and access
+// times to 2 seconds. The root directory has no entry, and so no times.
+func (fs *FileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	dir := path.Dir(p)
+	filename := path.Base(p)
+	// if the dir == filename, then it is just /
+	if dir == filename {
+		return fmt.Errorf("root directory %s has no times to change", p)
+	}
+	parentDir, _, err := fs.readDirWithMkdir(dir, false)
+	if err != nil {
+		return fmt.Errorf("could not read directory entries for %s: %w", dir, err)
+	}
+	targetEntry := parentDir.findEntry(filename, fs.upcase)
+	if targetEntry == nil {
+		return fmt.Errorf("target file %s does not exist", p)
+	}
+	if !atime.IsZero() {
+		targetEntry.accessTime = atime
+	}
+	if !mtime.IsZero() {
+		targetEntry.modifyTime = mtime
+	}
+	if err := fs.writeDirectoryEntries(parentDir); err != nil {
+		return fmt.Errorf("error writing directory file %s to disk: %w", dir, err)
+	}
+	return nil
+}
+
+// Readlink returns the target of the named symbolic link. exFAT has no symbolic links.
+func (fs *FileSystem) Readlink(_ string) (string, error) {
+	return "", filesystem.ErrNotSupported
+}
+
+// ReadDir return the contents of a given directory in a given filesystem.
+//
+// Returns a slice of os.FileInfo with all of the entries in the directory.
+//
+// Will return an error if the directory does not exist or is a regular file and not a directory
+func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	_, entries, err := fs.readDirWithMkdir(p, false)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", p, err)
+	}
+	//nolint:prealloc // because the following loop omits everything but files and directories
+	var ret []os.FileInfo
+	for _, e := range entries {
+		if e.entryType != entryTypeFile {
+			continue
+		}
+		ret = append(ret, newFileInfo(e))
+	}
+	return ret, nil
+}
+
+// OpenFile returns an io.ReadWriter from which you can read the contents of a file
+// or write contents to the file
+//
+// accepts normal os.OpenFile flags
+//
+// returns an error if the file does not exist
+func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	// get the path
+	dir := path.Dir(p)
+	filename := path.Base(p)
+	// if the dir == filename, then it is just /
+	if dir == filename {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	// get the directory entries
+	parentDir, _, err := fs.readDirWithMkdir(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory entries for %s: %w", dir, err)
+	}
+	targetEntry := parentDir.findEntry(filename, fs.upcase)
+	if targetEntry != nil && targetEntry.isSubdirectory() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+
+	// if the file does not exist, and is not opened for os.O_CREATE, return an error
+	if targetEntry == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, fmt.Errorf("target file %s does not exist and was not asked to create", p)
+		}
+		// empty files have no clusters at all
+		targetEntry, err = parentDir.createEntry(filename, 0, 0, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file %s: %w", p, err)
+		}
+		if err := fs.writeDirectoryEntries(parentDir); err != nil {
+			return nil, fmt.Errorf("error writing directory file %s to disk: %w", p, err)
+		}
+	}
+
+	// what if we were asked to truncate the file?
+	if flag&os.O_TRUNC == os.O_TRUNC && targetEntry.dataLength != 0 {
+		if _, err := fs.allocateSpace(targetEntry, 0); err != nil {
+			return nil, fmt.Errorf("unable to free clusters of %s: %w", p, err)
+		}
+		targetEntry.dataLength = 0
+		targetEntry.validDataLength = 0
+		if err := fs.writeDirectoryEntries(parentDir); err != nil {
+			return nil, fmt.Errorf("error writing directory file %s to disk: %w", p, err)
+		}
+	}
+	offset := int64(0)
+	if flag&os.O_APPEND == os.O_APPEND {
+		offset = int64(targetEntry.dataLength)
+	}
+	return &File{
+		directoryEntry: targetEntry,
+		isReadWrite:    flag&(os.O_RDWR|os.O_WRONLY) != 0,
+		isAppend:       flag&os.O_APPEND != 0,
+		offset:         offset,
+		dir:            dir,
+		filesystem:     fs,
+	}, nil
+}
+
+// Remove removes the named file or (empty) directory, and frees its clusters.
+func (fs *FileSystem) Remove(pathname string) error {
+	dir := path.Dir(pathname)
+	filename := path.Base(pathname)
+	// if the dir == filename, then it is just /
+	if dir == filename {
+		return fmt.Errorf("cannot remove root directory %s", pathname)
+	}
+	parentDir, _, err := fs.readDirWithMkdir(dir, false)
+	if err != nil {
+		return fmt.Errorf("could not read directory entries for %s: %w", dir, err)
+	}
+	targetEntry := parentDir.findEntry(filename, fs.upcase)
+	if targetEntry == nil {
+		return fmt.Errorf("target file %s does not exist", pathname)
+	}
+	if targetEntry.isSubdirectory() {
+		entries, err := fs.readDirectory(&Directory{directoryEntry: targetEntry, parent: parentDir})
+		if err != nil {
+			return fmt.Errorf("error while checking if directory to remove is empty: %w", err)
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("cannot remove non-empty directory %s", pathname)
+		}
+	}
+
+	// remove the entry before freeing its clusters, so a failure between the two only leaks them
+	parentDir.removeEntry(targetEntry)
+	if err := fs.writeDirectoryEntries(parentDir); err != nil {
+		return fmt.Errorf("error writing directory file %s to disk: %w", pathname, err)
+	}
+	if err := fs.freeChain(targetEntry); err != nil {
+		return fmt.Errorf("failed to free clusters of %s: %w", pathname, err)
+	}
+	return nil
+}
+
+// Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it.
+// Unlike FAT32, exFAT directories have no entry for their parent, so files and directories can be moved between
+// directories.
+func (fs *FileSystem) Rename(oldpath, newpath string) error {
+	oldDir, oldName := path.Dir(oldpath), path.Base(oldpath)
+	newDir, newName := path.Dir(newpath), path.Base(newpath)
+	if oldDir == oldName || newDir == newName {
+		return errors.New("cannot rename the root directory")
+	}
+	if err := validateName(newName); err != nil {
+		return err
+	}
+	oldParent, _, err := fs.readDirWithMkdir(oldDir, false)
+	if err != nil {
+		return fmt.Errorf("could not read directory entries for %s: %w", oldDir, err)
+	}
+	targetEntry := oldParent.findEntry(oldName, fs.upcase)
+	if targetEntry == nil {
+		return fmt.Errorf("target file %s does not exist", oldpath)
+	}
+
+	newParent := oldParent
+	if !fs.upcase.equalFold(path.Clean(oldDir), path.Clean(newDir)) {
+		// a directory cannot be moved inside itself
+		cleanOld := path.Clean(oldpath) + "/"
+		if cleanNew := path.Clean(newDir) + "/"; len(cleanNew) >= len(cleanOld) && fs.upcase.equalFold(cleanNew[:len(cleanOld)], cleanOld) {
+			return fmt.Errorf("cannot move %s inside itself", oldpath)
+		}
+		if newParent, _, err = fs.readDirWithMkdir(newDir, false); err != nil {
+			return fmt.Errorf("could not read directory entries for %s: %w", newDir, err)
+		}
+	}
+	replaced := newParent.findEntry(newName, fs.upcase)
+	if replaced != nil && replaced != targetEntry {
+		if replaced.isSubdirectory() {
+			return fmt.Errorf("cannot replace directory %s", newpath)
+		}
+		newParent.removeEntry(replaced)
+	}
+
+	targetEntry.name = newName
+	if newParent != oldParent {
+		oldParent.removeEntry(targetEntry)
+		newParent.entries = append(newParent.entries, targetEntry)
+	}
+	if err := fs.writeDirectoryEntries(newParent); err != nil {
+		return fmt.Errorf("error writing directory file %s to disk: %w", newpath, err)
+	}
+	if newParent != oldParent {
+		if err := fs.writeDirectoryEntries(oldParent); err != nil {
+			return fmt.Errorf("error writing directory file %s to disk: %w", oldpath, err)
+		}
+	}
+	if replaced != nil && replaced != targetEntry {
+		if err := fs.freeChain(replaced); err != nil {
+			return fmt.Errorf("failed to free clusters of %s: %w", newpath, err)
+		}
+	}
+	return nil
+}
+
+// Label get the label of the filesystem from the volume label entry in the root directory, or "" if there is none
+func (fs *FileSystem) Label() string {
+	root, err := fs.rootDirectory()
+	if err != nil {
+		return ""
+	}
+	if labelEntry := root.labelEntry(); labelEntry != nil {
+		return labelEntry.name
+	}
+	return ""
+}
+
+// SetLabel changes the filesystem label, which can be up to 11 UTF-16 characters
+func (fs *FileSystem) SetLabel(volumeLabel string) error {
+	if len(utf16.Encode([]rune(volumeLabel))) > maxLabelLength {
+		return fmt.Errorf("invalid volume label %q, maximum is %d characters", volumeLabel, maxLabelLength)
+	}
+	root, err := fs.rootDirectory()
+	if err != nil {
+		return fmt.Errorf("failed to locate root directory: %w", err)
+	}
+	labelEntry := root.labelEntry()
+	if labelEntry == nil {
+		labelEntry = &directoryEntry{entryType: entryTypeVolumeLabel}
+		root.entries = append([]*directoryEntry{labelEntry}, root.entries...)
+	}
+	labelEntry.name = volumeLabel
+	if err := fs.writeDirectoryEntries(root); err != nil {
+		return fmt.Errorf("failed to save the root directory to disk: %w", err)
+	}
+	return nil
+}
+
+// UUID returns the volume serial number, formatted as XXXX-XXXX, as blkid reports it
+func (fs *FileSystem) UUID() string {
+	serial := fs.bootSector.volumeSerialNumber
+	return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+}
+
+// Usage returns the size of the filesystem, and the space in the free clusters
+func (fs *FileSystem) Usage() filesystem.Usage {
+	return filesystem.Usage{
+		Size: fs.size,
+		Free: int64(fs.freeClusters) * fs.bytesPerCluster,
+	}
+}
+
+// rootDirectory read the root directory, with an entry made up for it from its chain of clusters
+func (fs *FileSystem) rootDirectory() (*Directory, error) {
+	de := &directoryEntry{
+		entryType:    entryTypeFile,
+		attributes:   attrDirectory,
+		flags:        flagAllocationPossible,
+		firstCluster: fs.bootSector.rootDirectoryCluster,
+	}
+	clusters, err := fs.clusterList(de)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cluster list: %w", err)
+	}
+	de.dataLength = uint64(len(clusters)) * uint64(fs.bytesPerCluster)
+	de.validDataLength = de.dataLength
+	dir := &Directory{directoryEntry: de}
+	if _, err := fs.readDirectory(dir); err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// readDirectory read the entries of a directory
+func (fs *FileSystem) readDirectory(dir *Directory) ([]*directoryEntry, error) {
+	clusters, err := fs.clusterList(dir.directoryEntry)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cluster list: %w", err)
+	}
+	if dir.dataLength > uint64(len(clusters))*uint64(fs.bytesPerCluster) {
+		return nil, fmt.Errorf("directory of %d bytes does not fit in its %d clusters", dir.dataLength, len(clusters))
+	}
+	b := make([]byte, dir.dataLength)
+	if err := fs.readAt(clusters, b, 0); err != nil {
+		return nil, fmt.Errorf("could not read directory: %w", err)
+	}
+	if err := dir.entriesFromBytes(b); err != nil {
+		return nil, err
+	}
+	return dir.entries, nil
+}
+
+// writeDirectoryEntries write all of the entries of dir to disk, growing it by whole clusters if they do not fit,
+// in which case the parent is written as well, since it holds the size of dir
+func (fs *FileSystem) writeDirectoryEntries(dir *Directory) error {
+	b, err := dir.entriesToBytes(fs.upcase)
+	if err != nil {
+		return fmt.Errorf("could not create a valid byte stream for exFAT entries: %w", err)
+	}
+	// directories are always whole clusters, and are never shrunk
+	bytesPerCluster := uint64(fs.bytesPerCluster)
+	size := max(dir.dataLength, (uint64(len(b))+bytesPerCluster-1)/bytesPerCluster*bytesPerCluster, bytesPerCluster)
+	clusters, err := fs.allocateSpace(dir.directoryEntry, size)
+	if err != nil {
+		return fmt.Errorf("unable to allocate space for directory entries: %w", err)
+	}
+	grown := size != dir.dataLength
+	dir.dataLength = size
+	dir.validDataLength = size
+
+	// the zeros after the entries mark the end of the directory
+	padded := make([]byte, size)
+	copy(padded, b)
+	if err := fs.writeAt(clusters, padded, 0); err != nil {
+		return fmt.Errorf("error writing directory entries: %w", err)
+	}
+	if grown && dir.parent != nil {
+		return fs.writeDirectoryEntries(dir.parent)
+	}
+	return nil
+}
+
+// mkSubdir make a subdirectory, with a single empty cluster
+func (fs *FileSystem) mkSubdir(parent *Directory, name string) (*directoryEntry, error) {
+	de, err := parent.createEntry(name, 0, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	clusters, err := fs.allocateSpace(de, uint64(fs.bytesPerCluster))
+	if err != nil {
+		parent.removeEntry(de)
+		return nil, fmt.Errorf("could not allocate disk space for directory %s: %w", name, err)
+	}
+	de.dataLength = uint64(fs.bytesPerCluster)
+	de.validDataLength = de.dataLength
+	if err := fs.writeAt(clusters, make([]byte, fs.bytesPerCluster), 0); err != nil {
+		return nil, fmt.Errorf("could not zero out directory %s: %w", name, err)
+	}
+	if err := fs.writeDirectoryEntries(parent); err != nil {
+		return nil, fmt.Errorf("error writing directory entries to disk: %w", err)
+	}
+	return de, nil
+}
+
+// readDirWithMkdir - walks down a directory tree to the last entry
+// if it does not exist, it may or may not make it
+func (fs *FileSystem) readDirWithMkdir(p string, doMake bool) (*Directory, []*directoryEntry, error) {
+	paths, err := splitPath(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentDir, err := fs.rootDirectory()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read directory %s: %w", "/", err)
+	}
+	for i, subp := range paths {
+		subpath := "/" + strings.Join(paths[0:i+1], "/")
+		e := currentDir.findEntry(subp, fs.upcase)
+		switch {
+		case e != nil && !e.isSubdirectory():
+			return nil, nil, fmt.Errorf("%s is a file, not a directory", subpath)
+		case e == nil && !doMake:
+			return nil, nil, fmt.Errorf("path %s not found", subpath)
+		case e == nil:
+			if e, err = fs.mkSubdir(currentDir, subp); err != nil {
+				return nil, nil, fmt.Errorf("failed to create subdirectory %s: %w", subpath, err)
+			}
+		}
+		currentDir = &Directory{directoryEntry: e, parent: currentDir}
+		if _, err := fs.readDirectory(currentDir); err != nil {
+			return nil, nil, fmt.Errorf("failed to read directory %s: %w", subpath, err)
+		}
+	}
+	return currentDir, currentDir.entries, nil
+}
+
+// clusterList the clusters holding the data of de in order, from the FAT, or for a file without a chain in the FAT,
+// the contiguous clusters its data fills
+func (fs *FileSystem) clusterList(de *directoryEntry) ([]uint32, error) {
+	if de.firstCluster == 0 {
+		return nil, nil
+	}
+	if !fs.validCluster(de.firstCluster) {
+		return nil, fmt.Errorf("invalid start cluster: %d", de.firstCluster)
+	}
+	if de.flags&flagNoFatChain != 0 {
+		count := (de.dataLength + uint64(fs.bytesPerCluster) - 1) / uint64(fs.bytesPerCluster)
+		if uint64(de.firstCluster)+count > uint64(fs.bootSector.clusterCount)+2 {
+			return nil, fmt.Errorf("%d contiguous clusters at %d run past the end of the filesystem", count, de.firstCluster)
+		}
+		clusters := make([]uint32, count)
+		for i := range clusters {
+			clusters[i] = de.firstCluster + uint32(i)
+		}
+		return clusters, nil
+	}
+	var clusters []uint32
+	for cluster := de.firstCluster; ; {
+		clusters = append(clusters, cluster)
+		next := fs.fat[cluster]
+		if next == fatEndOfChain {
+			return clusters, nil
+		}
+		if !fs.validCluster(next) || len(clusters) > int(fs.bootSector.clusterCount) {
+			return nil, fmt.Errorf("invalid cluster chain at %d", cluster)
+		}
+		cluster = next
+	}
+}
+
+// allocateSpace resize the chain of clusters of de to hold size bytes, and write the FAT and allocation bitmap.
+// Returns the clusters of the chain in order.
+func (fs *FileSystem) allocateSpace(de *directoryEntry, size uint64) ([]uint32, error) {
+	clusters, err := fs.resizeChain(de, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.writeAllocation(); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
+
+// freeChain free all of the clusters of de, which is no longer in any directory, write the FAT and allocation
+// bitmap, and tell the backend that the clusters are no longer used, if it is a backend.Discarder, so that the
+// space they took on an SSD, a thin volume or a sparse image is freed too. Discarding is only a hint, so failing
+// to does not fail freeing them.
+func (fs *FileSystem) freeChain(de *directoryEntry) error {
+	clusters, err := fs.clusterList(de)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.allocateSpace(de, 0); err != nil {
+		return err
+	}
+	discarder, ok := fs.backend.(backend.Discarder)
+	if !ok {
+		return nil
+	}
+	return fs.clusterRuns(clusters, 0, int64(len(clusters))*fs.bytesPerCluster, func(diskOffset, _, n int64) error {
+		_ = discarder.Discard(diskOffset, n)
+		return nil
+	})
+}
+
+// resizeChain allocate or free clusters at the end of the chain of de so that it holds size bytes, preferring
+// the clusters right after it to keep it contiguous. The chain is always kept in the FAT, so one that was only
+// implied by being contiguous is written to it first. Only changes the FAT and allocation bitmap in memory.
+func (fs *FileSystem) resizeChain(de *directoryEntry, size uint64) ([]uint32, error) {
+	clusters, err := fs.clusterList(de)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get cluster list: %w", err)
+	}
+	count := int((size + uint64(fs.bytesPerCluster) - 1) / uint64(fs.bytesPerCluster))
+	if count == len(clusters) {
+		return clusters, nil
+	}
+
+	var free []uint32
+	if count > len(clusters) {
+		from := uint32(0)
+		if len(clusters) > 0 {
+			from = clusters[len(clusters)-1] - 1
+		}
+		if free = fs.findFreeClusters(from, count-len(clusters)); len(free) < count-len(clusters) {
+			return nil, errors.New("no space left on device")
+		}
+	}
+
+	if de.flags&flagNoFatChain != 0 {
+		for i, cluster := range clusters {
+			next := fatEndOfChain
+			if i+1 < len(clusters) {
+				next = clusters[i+1]
+			}
+			fs.setCluster(cluster, next, true)
+		}
+		de.flags &^= flagNoFatChain
+	}
+	kept := min(count, len(clusters))
+	for _, cluster := range clusters[kept:] {
+		fs.setCluster(cluster, fatFreeCluster, false)
+	}
+	clusters = append(clusters[:kept], free...)
+	// link the chain from its last kept cluster onwards
+	for i := max(kept-1, 0); i < len(clusters); i++ {
+		next := fatEndOfChain
+		if i+1 < len(clusters) {
+			next = clusters[i+1]
+		}
+		fs.setCluster(clusters[i], next, true)
+	}
+	de.firstCluster = 0
+	if len(clusters) > 0 {
+		de.firstCluster = clusters[0]
+	}
+	de.flags |= flagAllocationPossible
+	return clusters, nil
+}
+
+// findFreeClusters up to count free clusters, searching from the bit for cluster from+2 in the allocation bitmap,
+// then from the start of it
+func (fs *FileSystem) findFreeClusters(from uint32, count int) []uint32 {
+	var free []uint32
+	total := int(fs.bootSector.clusterCount)
+	for _, r := range [][2]int{{int(from), total}, {0, int(from)}} {
+		for i := fs.bitmap.FirstFree(r[0]); i >= 0 && i < r[1] && len(free) < count; i = fs.bitmap.FirstFree(i + 1) {
+			free = append(free, uint32(i)+2)
+		}
+	}
+	return free
+}
+
+// setCluster set the FAT entry for cluster to next, and its bit in the allocation bitmap to used
+func (fs *FileSystem) setCluster(cluster, next uint32, used bool) {
+	fs.fat[cluster] = next
+	wasUsed, _ := fs.bitmap.IsSet(int(cluster - 2))
+	switch {
+	case used && !wasUsed:
+		_ = fs.bitmap.Set(int(cluster - 2))
+		fs.freeClusters--
+	case !used && wasUsed:
+		_ = fs.bitmap.Clear(int(cluster - 2))
+		fs.freeClusters++
+	}
+	fs.markDirty(cluster)
+}
+
+// markDirty add cluster to the range of clusters whose FAT entries and allocation bitmap bits need writing
+func (fs *FileSystem) markDirty(cluster uint32) {
+	if fs.dirtyTo == 0 {
+		fs.dirtyFrom, fs.dirtyTo = cluster, cluster+1
+		return
+	}
+	fs.dirtyFrom = min(fs.dirtyFrom, cluster)
+	fs.dirtyTo = max(fs.dirtyTo, cluster+1)
+}
+
+// writeAllocation write the parts of the FAT and allocation bitmap that changed, and the percentage of
+// clusters in use in the boot sector
+func (fs *FileSystem) writeAllocation() error {
+	if fs.dirtyTo == 0 {
+		return nil
+	}
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	from, to := fs.dirtyFrom, fs.dirtyTo
+	fatBytes := make([]byte, 4*(to-from))
+	for i, entry := range fs.fat[from:to] {
+		binary.LittleEndian.PutUint32(fatBytes[4*i:], entry)
+	}
+	if _, err := writableFile.WriteAt(fatBytes, fs.start+fs.fatStart()+4*int64(from)); err != nil {
+		return fmt.Errorf("unable to write FAT: %w", err)
+	}
+
+	// the allocation bitmap starts at cluster 2
+	bitmapFrom, bitmapTo := int64(max(from, 2)-2)/8, (int64(max(to, 2)-2)+7)/8
+	if bitmapTo > bitmapFrom {
+		if err := fs.writeAt(fs.bitmapClusters, fs.bitmap.ToBytes()[bitmapFrom:bitmapTo], bitmapFrom); err != nil {
+			return fmt.Errorf("unable to write allocation bitmap: %w", err)
+		}
+	}
+	fs.dirtyFrom, fs.dirtyTo = 0, 0
+
+	// the percentage in use is left out of the boot region checksum, so can be written on its own
+	clusterCount := uint64(fs.bootSector.clusterCount)
+	if percent := uint8((clusterCount - uint64(fs.freeClusters)) * 100 / clusterCount); percent != fs.bootSector.percentInUse {
+		fs.bootSector.percentInUse = percent
+		if _, err := writableFile.WriteAt([]byte{percent}, fs.start+112); err != nil {
+			return fmt.Errorf("unable to write percentage in use: %w", err)
+		}
+	}
+	return nil
+}
+
+// readAt read len(b) bytes at offset off in the data held in clusters
+func (fs *FileSystem) readAt(clusters []uint32, b []byte, off int64) error {
+	return fs.clusterRuns(clusters, off, int64(len(b)), func(diskOffset, bufOffset, n int64) error {
+		_, err := fs.backend.ReadAt(b[bufOffset:bufOffset+n], diskOffset)
+		return err
+	})
+}
+
+// writeAt write b at offset off in the data held in clusters
+func (fs *FileSystem) writeAt(clusters []uint32, b []byte, off int64) error {
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	return fs.clusterRuns(clusters, off, int64(len(b)), func(diskOffset, bufOffset, n int64) error {
+		_, err := writableFile.WriteAt(b[bufOffset:bufOffset+n], diskOffset)
+		return err
+	})
+}
+
+// clusterRuns call fn for each run of contiguous clusters that holds part of the length bytes at offset off
+// in the data held in clusters, with where the run is on disk, how far it is into the length, and how long it is
+func (fs *FileSystem) clusterRuns(clusters []uint32, off, length int64, fn func(diskOffset, bufOffset, n int64) error) error {
+	for done := int64(0); done < length; {
+		pos := off + done
+		i := pos / fs.bytesPerCluster
+		if i >= int64(len(clusters)) {
+			return fmt.Errorf("offset %d is past the end of %d clusters", pos, len(clusters))
+		}
+		n := min(fs.bytesPerCluster-pos%fs.bytesPerCluster, length-done)
+		for j := i + 1; j < int64(len(clusters)) && clusters[j] == clusters[j-1]+1 && done+n < length; j++ {
+			n = min(n+fs.bytesPerCluster, length-done)
+		}
+		if err := fn(fs.clusterStart(clusters[i])+pos%fs.bytesPerCluster, done, n); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
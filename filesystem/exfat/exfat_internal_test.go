@@ -0,0 +1,142 @@
+package exfat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name         string
+		totalSectors uint64
+		clusterShift uint8
+		sectorShift  uint8
+		fatOffset    uint32
+		fatLength    uint32
+		heapOffset   uint32
+		clusterCount uint32
+	}{
+		// 1MB of 512 byte sectors and 4KB clusters
+		{"minimum", 2048, 3, 9, 24, 2, 32, 252},
+		// 64MB of 512 byte sectors and 4KB clusters
+		{"64MB", 131072, 3, 9, 24, 128, 152, 16365},
+		// 64MB of 4KB sectors and clusters
+		{"4K sectors", 16384, 0, 12, 24, 16, 40, 16344},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fatOffset, fatLength, heapOffset, clusterCount, err := layout(tt.totalSectors, tt.clusterShift, tt.sectorShift)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fatOffset != tt.fatOffset || fatLength != tt.fatLength || heapOffset != tt.heapOffset || clusterCount != tt.clusterCount {
+				t.Errorf("layout %d, %d, %d, %d instead of %d, %d, %d, %d", fatOffset, fatLength, heapOffset, clusterCount,
+					tt.fatOffset, tt.fatLength, tt.heapOffset, tt.clusterCount)
+			}
+		})
+	}
+	if _, _, _, _, err := layout(24, 3, 9); err == nil {
+		t.Errorf("did not return error for a filesystem too small for its boot regions")
+	}
+}
+
+// TestNoFatChain check that a file whose contiguous clusters are not in the FAT, as other implementations write,
+// can be read, and gets a chain in the FAT when it grows
+func TestNoFatChain(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "exfat.img"))
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	fs, err := Create(file.New(f, false), 16*MB, 0, 0, "")
+	if err != nil {
+		t.Fatalf("Error creating exFAT filesystem: %v", err)
+	}
+	content := make([]byte, 3*fs.bytesPerCluster+100)
+	_, _ = rand.Read(content)
+	fl, err := fs.OpenFile("/contiguous", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	if _, err := fl.Write(content); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+
+	// take the chain of the file out of the FAT, leaving its clusters allocated in the bitmap
+	root, _, err := fs.readDirWithMkdir("/", false)
+	if err != nil {
+		t.Fatalf("Error reading root directory: %v", err)
+	}
+	de := root.findEntry("contiguous", fs.upcase)
+	clusters, err := fs.clusterList(de)
+	if err != nil {
+		t.Fatalf("Error reading cluster list: %v", err)
+	}
+	for i, cluster := range clusters {
+		if i > 0 && cluster != clusters[i-1]+1 {
+			t.Fatalf("clusters of new file are not contiguous: %v", clusters)
+		}
+		fs.fat[cluster] = fatFreeCluster
+		fs.markDirty(cluster)
+	}
+	de.flags |= flagNoFatChain
+	if err := fs.writeAllocation(); err != nil {
+		t.Fatalf("Error writing FAT: %v", err)
+	}
+	if err := fs.writeDirectoryEntries(root); err != nil {
+		t.Fatalf("Error writing root directory: %v", err)
+	}
+
+	fs, err = Read(file.New(f, false), 16*MB, 0, 0)
+	if err != nil {
+		t.Fatalf("Error reading exFAT filesystem: %v", err)
+	}
+	fl, err = fs.OpenFile("/contiguous", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	read, err := io.ReadAll(fl)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Fatalf("contents of file without a FAT chain do not match")
+	}
+
+	// growing the file needs a chain in the FAT
+	more := make([]byte, 2*fs.bytesPerCluster)
+	_, _ = rand.Read(more)
+	if _, err := fl.Write(more); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	content = append(content, more...)
+
+	fs, err = Read(file.New(f, false), 16*MB, 0, 0)
+	if err != nil {
+		t.Fatalf("Error reading exFAT filesystem: %v", err)
+	}
+	root, _, err = fs.readDirWithMkdir("/", false)
+	if err != nil {
+		t.Fatalf("Error reading root directory: %v", err)
+	}
+	de = root.findEntry("contiguous", fs.upcase)
+	if de.flags&flagNoFatChain != 0 {
+		t.Errorf("file still has no FAT chain after growing")
+	}
+	if clusters, err = fs.clusterList(de); err != nil || len(clusters) != 6 {
+		t.Errorf("chain of %d clusters instead of 6, error %v", len(clusters), err)
+	}
+	fl, err = fs.OpenFile("/contiguous", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	if read, err = io.ReadAll(fl); err != nil || !bytes.Equal(read, content) {
+		t.Errorf("contents of grown file do not match, error %v", err)
+	}
+}
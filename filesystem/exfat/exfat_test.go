@@ -0,0 +1,502 @@
+package exfat_test
+
+/*
+ These tests the exported functions
+ We want to do full-in tests with files
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/exfat"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+const (
+	testSize       = 64 * exfat.MB
+	imgFile        = "testdata/dist/exfat.img"
+	randomDataFile = "testdata/dist/random.dat"
+)
+
+// TestMain sets up the test environment and runs the tests
+func TestMain(m *testing.M) {
+	// Check and generate the image made by mkfs.exfat if necessary
+	if err := testhelper.BuildImage(imgFile); err != nil {
+		println("error generating test artifacts for exfat", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func tmpExfat(t *testing.T, size int64, label string) (*os.File, *exfat.FileSystem) {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "exfat.img"))
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	fs, err := exfat.Create(file.New(f, false), size, 0, 0, label)
+	if err != nil {
+		t.Fatalf("Error creating exFAT filesystem: %v", err)
+	}
+	return f, fs
+}
+
+func reread(t *testing.T, f *os.File, size int64) *exfat.FileSystem {
+	t.Helper()
+	fs, err := exfat.Read(file.New(f, false), size, 0, 0)
+	if err != nil {
+		t.Fatalf("Error reading exFAT filesystem: %v", err)
+	}
+	return fs
+}
+
+func names(t *testing.T, fs filesystem.FileSystem, p string) []string {
+	t.Helper()
+	infos, err := fs.ReadDir(p)
+	if err != nil {
+		t.Fatalf("Error reading directory %s: %v", p, err)
+	}
+	ret := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		ret = append(ret, fi.Name())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func writeFile(t *testing.T, fs filesystem.FileSystem, p string, content []byte) {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", p, err)
+	}
+	if n, err := f.Write(content); err != nil || n != len(content) {
+		t.Fatalf("Error writing %s, wrote %d of %d bytes: %v", p, n, len(content), err)
+	}
+}
+
+func readFile(t *testing.T, fs filesystem.FileSystem, p string) []byte {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", p, err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", p, err)
+	}
+	return b
+}
+
+func TestExfatType(t *testing.T) {
+	_, fs := tmpExfat(t, testSize, "")
+	if fs.Type() != filesystem.TypeExFAT {
+		t.Errorf("Type() returned %v instead of %v", fs.Type(), filesystem.TypeExFAT)
+	}
+	if fs.Type().String() != "exfat" {
+		t.Errorf("mismatched type name %s", fs.Type())
+	}
+}
+
+func TestExfatCreate(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		blocksize int64
+		label     string
+		err       *regexp.Regexp
+	}{
+		{"too small", exfat.MB - 512, 512, "", regexp.MustCompile("smaller than minimum")},
+		{"invalid blocksize", testSize, 513, "", regexp.MustCompile("blocksize for exFAT must be")},
+		{"label too long", testSize, 512, "123456789012", regexp.MustCompile("invalid volume label")},
+		{"minimum", exfat.MB, 512, "MIN", nil},
+		{"4K sectors", testSize, 4096, "", nil},
+		{"32K clusters", 300 * exfat.MB, 512, "LARGER", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "exfat.img"))
+			if err != nil {
+				t.Fatalf("Error creating image file: %v", err)
+			}
+			defer f.Close()
+			fs, err := exfat.Create(file.New(f, false), tt.size, 0, tt.blocksize, tt.label)
+			switch {
+			case tt.err != nil && (err == nil || !tt.err.MatchString(err.Error())):
+				t.Fatalf("mismatched error, actual %v expected %v", err, tt.err)
+			case tt.err == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != nil:
+				return
+			}
+			read := reread(t, f, tt.size)
+			if read.Label() != tt.label {
+				t.Errorf("mismatched label, actual %q expected %q", read.Label(), tt.label)
+			}
+			if read.UUID() != fs.UUID() || !regexp.MustCompile(`^[0-9A-F]{4}-[0-9A-F]{4}$`).MatchString(read.UUID()) {
+				t.Errorf("mismatched UUID %q, created with %q", read.UUID(), fs.UUID())
+			}
+			usage := read.Usage()
+			if usage != fs.Usage() || usage.Size != tt.size || usage.Free <= 0 || usage.Free >= tt.size {
+				t.Errorf("mismatched usage %+v, created with %+v", usage, fs.Usage())
+			}
+			if entries := names(t, read, "/"); len(entries) != 0 {
+				t.Errorf("new filesystem has entries %v", entries)
+			}
+		})
+	}
+}
+
+func TestExfatReadWrite(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "DATA")
+	// larger than a cluster, and not a multiple of one
+	large := make([]byte, 3*4096+100)
+	_, _ = rand.Read(large)
+
+	if err := fs.Mkdir("/a/b/c"); err != nil {
+		t.Fatalf("Error making directories: %v", err)
+	}
+	writeFile(t, fs, "/a/b/c/large.bin", large)
+	writeFile(t, fs, "/empty", nil)
+	writeFile(t, fs, "/a/A file with a name longer than fifteen characters.txt", []byte("long name"))
+	writeFile(t, fs, "/a/ünïcödé ✓", []byte("unicode"))
+	free := fs.Usage().Free
+
+	read := reread(t, f, testSize)
+	if read.Usage().Free != free {
+		t.Errorf("mismatched free space, actual %d expected %d", read.Usage().Free, free)
+	}
+	tests := map[string][]byte{
+		"/a/b/c/large.bin": large,
+		"/empty":           {},
+		"/a/A file with a name longer than fifteen characters.txt": []byte("long name"),
+		"/a/ünïcödé ✓": []byte("unicode"),
+		// names are compared without case, using the up-case table
+		"/A/B/C/LARGE.BIN": large,
+		"/A/ÜNÏCÖDÉ ✓":     []byte("unicode"),
+	}
+	for p, expected := range tests {
+		if b := readFile(t, read, p); !bytes.Equal(b, expected) {
+			t.Errorf("%s: mismatched contents, %d bytes instead of %d", p, len(b), len(expected))
+		}
+	}
+	if n := names(t, read, "/a"); len(n) != 3 || n[0] != "A file with a name longer than fifteen characters.txt" || n[1] != "b" || n[2] != "ünïcödé ✓" {
+		t.Errorf("mismatched entries of /a: %v", n)
+	}
+	infos, _ := read.ReadDir("/a/b/c")
+	if len(infos) != 1 || infos[0].Size() != int64(len(large)) || infos[0].IsDir() || infos[0].ModTime().IsZero() {
+		t.Errorf("mismatched file info %+v", infos)
+	}
+
+	t.Run("overwrite and append", func(t *testing.T) {
+		fl, err := read.OpenFile("/a/b/c/large.bin", os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		if _, err := fl.Seek(4090, io.SeekStart); err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+		if _, err := fl.Write([]byte("across a cluster boundary")); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		copy(large[4090:], "across a cluster boundary")
+		fl, err = read.OpenFile("/a/b/c/large.bin", os.O_RDWR|os.O_APPEND)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		if _, err := fl.Write([]byte("appended")); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		large = append(large, "appended"...)
+		if b := readFile(t, reread(t, f, testSize), "/a/b/c/large.bin"); !bytes.Equal(b, large) {
+			t.Errorf("mismatched contents after overwriting and appending")
+		}
+	})
+	t.Run("write past the end", func(t *testing.T) {
+		fl, err := read.OpenFile("/empty", os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		if _, err := fl.Seek(5000, io.SeekStart); err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+		if _, err := fl.Write([]byte("end")); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		expected := append(make([]byte, 5000), "end"...)
+		if b := readFile(t, reread(t, f, testSize), "/empty"); !bytes.Equal(b, expected) {
+			t.Errorf("mismatched contents after writing past the end")
+		}
+	})
+	t.Run("truncate", func(t *testing.T) {
+		before := read.Usage().Free
+		if _, err := read.OpenFile("/a/b/c/large.bin", os.O_RDWR|os.O_TRUNC); err != nil {
+			t.Fatalf("Error truncating: %v", err)
+		}
+		if b := readFile(t, read, "/a/b/c/large.bin"); len(b) != 0 {
+			t.Errorf("%d bytes left after truncating", len(b))
+		}
+		if after := read.Usage().Free; after != before+4*4096 {
+			t.Errorf("truncating freed %d bytes instead of %d", after-before, 4*4096)
+		}
+	})
+	t.Run("read only", func(t *testing.T) {
+		fl, err := read.OpenFile("/empty", os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("Error opening file: %v", err)
+		}
+		if _, err := fl.Write([]byte("x")); err == nil {
+			t.Errorf("no error writing to a file opened read-only")
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		if _, err := read.OpenFile("/a/missing", os.O_RDONLY); err == nil {
+			t.Errorf("no error opening a missing file")
+		}
+		if _, err := read.OpenFile("/a/b", os.O_RDONLY); err == nil {
+			t.Errorf("no error opening a directory as a file")
+		}
+		if _, err := read.ReadDir("/empty"); err == nil {
+			t.Errorf("no error reading a file as a directory")
+		}
+	})
+}
+
+func TestExfatLargeDirectory(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "")
+	if err := fs.Mkdir("/many"); err != nil {
+		t.Fatalf("Error making directory: %v", err)
+	}
+	// each of these takes 3 entries, so 200 of them are more than 4 clusters of 4096 bytes
+	for i := range 200 {
+		writeFile(t, fs, filepath.Join("/many", "file-with-longer-name-"+string(rune('a'+i%26))+string(rune('a'+i/26))), []byte{byte(i)})
+	}
+	read := reread(t, f, testSize)
+	if n := names(t, read, "/many"); len(n) != 200 {
+		t.Errorf("read %d entries instead of 200", len(n))
+	}
+	if b := readFile(t, read, "/many/file-with-longer-name-zg"); !bytes.Equal(b, []byte{181}) {
+		t.Errorf("mismatched contents %v", b)
+	}
+}
+
+func TestExfatRemove(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "")
+	free := fs.Usage().Free
+	if err := fs.Mkdir("/dir/sub"); err != nil {
+		t.Fatalf("Error making directories: %v", err)
+	}
+	writeFile(t, fs, "/dir/file", make([]byte, 10000))
+
+	if err := fs.Remove("/dir"); err == nil {
+		t.Errorf("no error removing a non-empty directory")
+	}
+	if err := fs.Remove("/dir/missing"); err == nil {
+		t.Errorf("no error removing a missing file")
+	}
+	for _, p := range []string{"/dir/FILE", "/dir/sub", "/dir"} {
+		if err := fs.Remove(p); err != nil {
+			t.Fatalf("Error removing %s: %v", p, err)
+		}
+	}
+	read := reread(t, f, testSize)
+	if n := names(t, read, "/"); len(n) != 0 {
+		t.Errorf("entries left after removing: %v", n)
+	}
+	if read.Usage().Free != free {
+		t.Errorf("free space after removing is %d instead of %d", read.Usage().Free, free)
+	}
+}
+
+// discardRecorder a backend that records the ranges it is told to discard, without discarding them
+type discardRecorder struct {
+	backend.Storage
+	discarded [][2]int64
+}
+
+func (d *discardRecorder) Discard(off, length int64) error {
+	d.discarded = append(d.discarded, [2]int64{off, length})
+	return nil
+}
+
+func TestExfatRemoveDiscards(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "exfat.img"))
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	b := &discardRecorder{Storage: file.New(f, false)}
+	fs, err := exfat.Create(b, testSize, 0, 0, "")
+	if err != nil {
+		t.Fatalf("Error creating exFAT filesystem: %v", err)
+	}
+	content := make([]byte, 100000)
+	_, _ = rand.Read(content)
+	writeFile(t, fs, "/file", content)
+	writeFile(t, fs, "/other", content[:5000])
+	if len(b.discarded) != 0 {
+		t.Errorf("writing files discarded %v", b.discarded)
+	}
+
+	// what was discarded, which is still there to read, is the content of the file, and the rest of its last cluster
+	if err := fs.Remove("/file"); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+	var discarded []byte
+	for _, r := range b.discarded {
+		d := make([]byte, r[1])
+		if _, err := f.ReadAt(d, r[0]); err != nil {
+			t.Fatalf("Error reading discarded range: %v", err)
+		}
+		discarded = append(discarded, d...)
+	}
+	if len(discarded) < len(content) || int64(len(discarded)) > int64(len(content))+exfat.MB || !bytes.Equal(discarded[:len(content)], content) {
+		t.Errorf("discarded %v instead of the clusters of the file", b.discarded)
+	}
+
+	// replacing a file by renaming another over it discards the clusters of the one it replaces
+	b.discarded = nil
+	writeFile(t, fs, "/file", content)
+	if err := fs.Rename("/other", "/file"); err != nil {
+		t.Fatalf("Error renaming file: %v", err)
+	}
+	if len(b.discarded) == 0 {
+		t.Errorf("replacing a file discarded nothing")
+	}
+	if !bytes.Equal(readFile(t, fs, "/file"), content[:5000]) {
+		t.Errorf("renamed file does not hold its content")
+	}
+}
+
+func TestExfatRename(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "")
+	if err := fs.Mkdir("/from/inner"); err != nil {
+		t.Fatalf("Error making directories: %v", err)
+	}
+	if err := fs.Mkdir("/to"); err != nil {
+		t.Fatalf("Error making directories: %v", err)
+	}
+	writeFile(t, fs, "/from/file", []byte("moved"))
+	writeFile(t, fs, "/from/other", []byte("replaced"))
+	writeFile(t, fs, "/to/existing", []byte("replaced"))
+	free := fs.Usage().Free
+
+	if err := fs.Rename("/from/file", "/from/renamed"); err != nil {
+		t.Fatalf("Error renaming within a directory: %v", err)
+	}
+	if err := fs.Rename("/from/renamed", "/to/existing"); err != nil {
+		t.Fatalf("Error moving over an existing file: %v", err)
+	}
+	if err := fs.Rename("/from/inner", "/to/inner"); err != nil {
+		t.Fatalf("Error moving a directory: %v", err)
+	}
+	if err := fs.Rename("/to", "/to/inner/to"); err == nil {
+		t.Errorf("no error moving a directory inside itself")
+	}
+	if err := fs.Rename("/from/other", "/to/inner"); err == nil {
+		t.Errorf("no error replacing a directory with a file")
+	}
+	if err := fs.Rename("/from/missing", "/to/missing"); err == nil {
+		t.Errorf("no error moving a missing file")
+	}
+
+	read := reread(t, f, testSize)
+	if n := names(t, read, "/from"); len(n) != 1 || n[0] != "other" {
+		t.Errorf("mismatched entries of /from: %v", n)
+	}
+	if n := names(t, read, "/to"); len(n) != 2 || n[0] != "existing" || n[1] != "inner" {
+		t.Errorf("mismatched entries of /to: %v", n)
+	}
+	if b := readFile(t, read, "/to/existing"); string(b) != "moved" {
+		t.Errorf("mismatched contents %q", b)
+	}
+	// the replaced file had a cluster of its own
+	if read.Usage().Free != free+4096 {
+		t.Errorf("free space after renaming is %d instead of %d", read.Usage().Free, free+4096)
+	}
+}
+
+func TestExfatLabel(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "")
+	if label := fs.Label(); label != "" {
+		t.Errorf("mismatched label %q", label)
+	}
+	for _, label := range []string{"Ünïcödé", "ELEVENCHARS", ""} {
+		if err := fs.SetLabel(label); err != nil {
+			t.Fatalf("Error setting label %q: %v", label, err)
+		}
+		if actual := reread(t, f, testSize).Label(); actual != label {
+			t.Errorf("mismatched label, actual %q expected %q", actual, label)
+		}
+	}
+	if err := fs.SetLabel("TWELVE CHARS"); err == nil {
+		t.Errorf("no error setting a label that is too long")
+	}
+}
+
+func TestExfatBackupBootRegion(t *testing.T) {
+	f, fs := tmpExfat(t, testSize, "BACKUP")
+	writeFile(t, fs, "/file", []byte("still there"))
+	// break the checksum of the main boot region
+	if _, err := f.WriteAt([]byte{0xff}, 200); err != nil {
+		t.Fatalf("Error corrupting boot region: %v", err)
+	}
+	read := reread(t, f, testSize)
+	if b := readFile(t, read, "/file"); string(b) != "still there" {
+		t.Errorf("mismatched contents %q", b)
+	}
+	if _, err := f.WriteAt(make([]byte, 512), 12*512); err != nil {
+		t.Fatalf("Error corrupting backup boot region: %v", err)
+	}
+	if _, err := exfat.Read(file.New(f, false), testSize, 0, 0); err == nil {
+		t.Errorf("no error reading with both boot regions corrupt")
+	}
+}
+
+func TestExfatImageFile(t *testing.T) {
+	fs := testhelper.ReadImage(t, imgFile, exfat.Read)
+	if label := fs.Label(); label != "diskfs" {
+		t.Errorf("label %q instead of %q", label, "diskfs")
+	}
+	longName := "A file with a long name, longer than fits in one entry.txt"
+	want := []string{longName, "foo", "fragmented.dat", "random.dat", "shortfile.txt", "zeroes.dat"}
+	sort.Strings(want)
+	if got := names(t, fs, "/"); !slices.Equal(got, want) {
+		t.Errorf("root directory has %v instead of %v", got, want)
+	}
+	if got := names(t, fs, "/foo"); len(got) != 1001 {
+		t.Errorf("/foo has %d entries instead of 1001", len(got))
+	}
+
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("Error reading random data file %s: %v", randomDataFile, err)
+	}
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{"/shortfile.txt", []byte("This is a short file\n")},
+		{"/" + longName, []byte("This file has a long name\n")},
+		{"/foo/subdirfile.txt", []byte("This is a subdir file\n")},
+		{"/random.dat", randomData},
+		{"/fragmented.dat", randomData},
+		{"/zeroes.dat", make([]byte, len(randomData))},
+	} {
+		if b := readFile(t, fs, tt.path); !bytes.Equal(b, tt.content) {
+			t.Errorf("%s has %d bytes that do not match the %d expected", tt.path, len(b), len(tt.content))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package exfat
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// File represents a single file in an exFAT filesystem
+type File struct {
+	*directoryEntry
+	isReadWrite bool
+	isAppend    bool
+	offset      int64
+	// dir is the path of the directory the file is in
+	dir        string
+	filesystem *FileSystem
+}
+
+// Read reads up to len(b) bytes from the File.
+// It returns the number of bytes read and any error encountered.
+// At end of file, Read returns 0, io.EOF
+// reads from the last known offset in the file from last read or write
+// and increments the offset by the number of bytes read.
+// Use Seek() to set at a particular point
+func (fl *File) Read(b []byte) (int, error) {
+	if fl == nil || fl.filesystem == nil {
+		return 0, os.ErrClosed
+	}
+	fs := fl.filesystem
+	size := int64(fl.dataLength)
+	if fl.offset >= size {
+		return 0, io.EOF
+	}
+	toRead := min(int64(len(b)), size-fl.offset)
+	// only the data up to the valid data length is on disk, the rest of the file reads as zeros
+	onDisk := max(0, min(toRead, int64(fl.validDataLength)-fl.offset))
+	if onDisk > 0 {
+		clusters, err := fs.clusterList(fl.directoryEntry)
+		if err != nil {
+			return 0, fmt.Errorf("unable to get list of clusters for file: %w", err)
+		}
+		if err := fs.readAt(clusters, b[:onDisk], fl.offset); err != nil {
+			return 0, fmt.Errorf("unable to read file: %w", err)
+		}
+	}
+	clear(b[onDisk:toRead])
+
+	fl.offset += toRead
+	var retErr error
+	if fl.offset >= size {
+		retErr = io.EOF
+	}
+	return int(toRead), retErr
+}
+
+// Write writes len(b) bytes to the File.
+// It returns the number of bytes written and an error, if any.
+// returns a non-nil error when n != len(b)
+// writes to the last known offset in the file from last read or write
+// and increments the offset by the number of bytes read.
+// Use Seek() to set at a particular point
+func (fl *File) Write(p []byte) (int, error) {
+	if fl == nil || fl.filesystem == nil {
+		return 0, os.ErrClosed
+	}
+	// if the file was not opened for writing, nothing we can do
+	if !fl.isReadWrite {
+		return 0, filesystem.ErrReadonlyFilesystem
+	}
+	fs := fl.filesystem
+	if fl.isAppend {
+		fl.offset = int64(fl.dataLength)
+	}
+	end := fl.offset + int64(len(p))
+	newSize := max(int64(fl.dataLength), end)
+	clusters, err := fs.allocateSpace(fl.directoryEntry, uint64(newSize))
+	if err != nil {
+		return 0, fmt.Errorf("unable to allocate clusters for file: %w", err)
+	}
+
+	// nothing past the valid data length is on disk, so any gap up to where this write starts must be zeroed
+	if valid := int64(fl.validDataLength); fl.offset > valid {
+		zeros := make([]byte, min(fl.offset-valid, fs.bytesPerCluster))
+		for pos := valid; pos < fl.offset; pos += int64(len(zeros)) {
+			if err := fs.writeAt(clusters, zeros[:min(int64(len(zeros)), fl.offset-pos)], pos); err != nil {
+				return 0, fmt.Errorf("unable to write to file: %w", err)
+			}
+		}
+	}
+	if err := fs.writeAt(clusters, p, fl.offset); err != nil {
+		return 0, fmt.Errorf("unable to write to file: %w", err)
+	}
+
+	fl.dataLength = uint64(newSize)
+	fl.validDataLength = max(fl.validDataLength, uint64(end))
+	fl.modifyTime = time.Now()
+	fl.attributes |= attrArchive
+	fl.offset = end
+
+	// update the parent that we have changed the file size
+	if err := fl.writeEntry(); err != nil {
+		return 0, fmt.Errorf("error writing directory entries to disk: %w", err)
+	}
+	return len(p), nil
+}
+
+// writeEntry write the entry of the file to the directory it is in. The directory is read again, since other
+// files in it may have been created or changed since this one was opened.
+func (fl *File) writeEntry() error {
+	fs := fl.filesystem
+	parent, _, err := fs.readDirWithMkdir(fl.dir, false)
+	if err != nil {
+		return err
+	}
+	de := parent.findEntry(fl.name, fs.upcase)
+	if de == nil {
+		return fmt.Errorf("file %s is no longer in %s", fl.name, fl.dir)
+	}
+	*de = *fl.directoryEntry
+	return fs.writeDirectoryEntries(parent)
+}
+
+// Seek set the offset to a particular point in the file
+func (fl *File) Seek(offset int64, whence int) (int64, error) {
+	if fl == nil || fl.filesystem == nil {
+		return 0, os.ErrClosed
+	}
+	newOffset := int64(0)
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekEnd:
+		newOffset = int64(fl.dataLength) + offset
+	case io.SeekCurrent:
+		newOffset = fl.offset + offset
+	}
+	if newOffset < 0 {
+		return fl.offset, fmt.Errorf("cannot set offset %d before start of file", offset)
+	}
+	fl.offset = newOffset
+	return fl.offset, nil
+}
+
+// Close close the file
+func (fl *File) Close() error {
+	fl.filesystem = nil
+	return nil
+}
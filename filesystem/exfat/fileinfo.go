@@ -0,0 +1,77 @@
+package exfat
+
+import (
+	"os"
+	"time"
+)
+
+// FileInfo represents the information for an individual file
+// it fulfills os.FileInfo interface
+type FileInfo struct {
+	modTime time.Time
+	mode    os.FileMode
+	name    string
+	size    int64
+	isDir   bool
+}
+
+// newFileInfo the FileInfo for a file or subdirectory entry. exFAT has no permissions, only a read-only
+// attribute, so the mode is what Linux shows by default.
+func newFileInfo(de *directoryEntry) FileInfo {
+	mode := os.FileMode(0o644)
+	if de.isSubdirectory() {
+		mode = os.ModeDir | 0o755
+	}
+	if de.attributes&attrReadOnly != 0 {
+		mode &^= 0o222
+	}
+	return FileInfo{
+		modTime: de.modifyTime,
+		mode:    mode,
+		name:    de.name,
+		size:    int64(de.dataLength),
+		isDir:   de.isSubdirectory(),
+	}
+}
+
+// IsDir abbreviation for Mode().IsDir()
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) IsDir() bool {
+	return fi.isDir
+}
+
+// ModTime modification time
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// Mode returns file mode
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// Name base name of the file
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) Name() string {
+	return fi.name
+}
+
+// Size length in bytes for regular files
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) Size() int64 {
+	return fi.size
+}
+
+// Sys underlying data source - not supported yet and so will return nil
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,33 @@
+#!/bin/sh
+set -e
+mkdir -p dist
+cat << "EOF" | docker run -i --rm -v $PWD/dist:/data -w /data --privileged alpine:3.20
+set -e
+set -x
+apk --update add exfatprogs
+dd if=/dev/zero of=exfat.img bs=1M count=64
+mkfs.exfat -L diskfs exfat.img
+mount exfat.img /mnt
+cd /mnt
+mkdir foo
+echo "This is a short file" > shortfile.txt
+echo "This is a subdir file" > foo/subdirfile.txt
+echo "This file has a long name" > "A file with a long name, longer than fits in one entry.txt"
+# enough entries that /foo takes many clusters
+set +x
+i=0; until [ $i -ge 1000 ]; do touch foo/file${i}; i=$(( $i+1 )); done
+set -x
+# a file with known content
+dd if=/dev/random of=/data/random.dat bs=1024 count=20
+cp /data/random.dat random.dat
+# the same content again, written a cluster at a time in turn with another file, so that neither is contiguous
+# and both need a FAT chain
+i=0; until [ $i -ge 5 ]; do
+  dd if=/data/random.dat of=fragmented.dat bs=4096 skip=$i seek=$i count=1 conv=notrunc
+  dd if=/dev/zero of=zeroes.dat bs=4096 seek=$i count=1 conv=notrunc
+  sync
+  i=$(( $i+1 ))
+done
+cd /data
+umount /mnt
+EOF
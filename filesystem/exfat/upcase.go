@@ -0,0 +1,112 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode"
+	"unicode/utf16"
+)
+
+// upcaseTable maps every UTF-16 code unit to its upper case, which is what exFAT compares and hashes names with
+type upcaseTable []uint16
+
+const (
+	upcaseTableSize = 1 << 16
+	// upcaseIdentityRun marks a run of code units that map to themselves in a compressed up-case table,
+	// followed by the count of them
+	upcaseIdentityRun uint16 = 0xffff
+)
+
+// defaultUpcaseTable the simple upper case mappings of the Basic Multilingual Plane, as Go knows them
+func defaultUpcaseTable() upcaseTable {
+	t := make(upcaseTable, upcaseTableSize)
+	for i := range t {
+		t[i] = uint16(i)
+		if r := unicode.ToUpper(rune(i)); r < upcaseTableSize && !utf16.IsSurrogate(r) {
+			t[i] = uint16(r)
+		}
+	}
+	return t
+}
+
+// upcaseTableFromBytes read an up-case table, compressed or not, as it is stored on disk. Any code units past the
+// end of the table map to themselves.
+func upcaseTableFromBytes(b []byte) (upcaseTable, error) {
+	if len(b)%2 != 0 {
+		return nil, fmt.Errorf("up-case table has odd length %d", len(b))
+	}
+	t := make(upcaseTable, 0, upcaseTableSize)
+	for i := 0; i < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		// an uncompressed table has 0xffff as the mapping of 0xffff, right at its end
+		if c == upcaseIdentityRun && i+2 < len(b) {
+			count := int(binary.LittleEndian.Uint16(b[i+2:]))
+			for range count {
+				t = append(t, uint16(len(t)))
+			}
+			i += 2
+		} else {
+			t = append(t, c)
+		}
+		if len(t) > upcaseTableSize {
+			return nil, fmt.Errorf("up-case table maps more than %d code units", upcaseTableSize)
+		}
+	}
+	for len(t) < upcaseTableSize {
+		t = append(t, uint16(len(t)))
+	}
+	return t, nil
+}
+
+// toBytes the up-case table compressed, with runs of code units that map to themselves replaced by their count
+func (t upcaseTable) toBytes() []byte {
+	var b []byte
+	for i := 0; i < len(t); {
+		run := 0
+		for i+run < len(t) && run < 0xffff && t[i+run] == uint16(i+run) {
+			run++
+		}
+		// a run at the very end must always be compressed, so a final 0xffff is not mistaken for one
+		if run > 2 || (run > 0 && i+run == len(t)) {
+			b = binary.LittleEndian.AppendUint16(b, upcaseIdentityRun)
+			b = binary.LittleEndian.AppendUint16(b, uint16(run))
+			i += run
+			continue
+		}
+		b = binary.LittleEndian.AppendUint16(b, t[i])
+		i++
+	}
+	return b
+}
+
+// upcase the name in upper case UTF-16 code units
+func (t upcaseTable) upcase(name string) []uint16 {
+	u := utf16.Encode([]rune(name))
+	for i, c := range u {
+		u[i] = t[c]
+	}
+	return u
+}
+
+// equalFold whether the names a and b are the same, ignoring case as exFAT does
+func (t upcaseTable) equalFold(a, b string) bool {
+	ua, ub := t.upcase(a), t.upcase(b)
+	if len(ua) != len(ub) {
+		return false
+	}
+	for i := range ua {
+		if ua[i] != ub[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// upcaseChecksum the checksum of an up-case table as stored on disk
+func upcaseChecksum(b []byte) uint32 {
+	var checksum uint32
+	for _, c := range b {
+		checksum = (checksum&1)<<31 + checksum>>1 + uint32(c)
+	}
+	return checksum
+}
@@ -0,0 +1,88 @@
+package exfat
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestUpcaseTableRoundTrip(t *testing.T) {
+	table := defaultUpcaseTable()
+	b := table.toBytes()
+	// nearly all of the table maps to itself, so compresses down to a few KB
+	if int64(len(b)) > 8*KB {
+		t.Errorf("compressed up-case table is %d bytes", len(b))
+	}
+	read, err := upcaseTableFromBytes(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(read, table) {
+		t.Errorf("up-case table changed on the way through bytes")
+	}
+}
+
+func TestUpcaseTableFromBytes(t *testing.T) {
+	t.Run("uncompressed", func(t *testing.T) {
+		table := defaultUpcaseTable()
+		b := make([]byte, 0, 2*len(table))
+		for _, c := range table {
+			b = binary.LittleEndian.AppendUint16(b, c)
+		}
+		read, err := upcaseTableFromBytes(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !slices.Equal(read, table) {
+			t.Errorf("uncompressed up-case table read incorrectly")
+		}
+	})
+	t.Run("short", func(t *testing.T) {
+		// only the first 128 code units, with a through z mapped to upper case
+		var b []byte
+		for i := range 128 {
+			c := uint16(i)
+			if c >= 'a' && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			b = binary.LittleEndian.AppendUint16(b, c)
+		}
+		read, err := upcaseTableFromBytes(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if read['q'] != 'Q' || read[0xe9] != 0xe9 || len(read) != upcaseTableSize {
+			t.Errorf("short up-case table read incorrectly")
+		}
+	})
+	t.Run("odd length", func(t *testing.T) {
+		if _, err := upcaseTableFromBytes(make([]byte, 3)); err == nil {
+			t.Errorf("did not return expected error")
+		}
+	})
+	t.Run("too long", func(t *testing.T) {
+		b := make([]byte, 2*upcaseTableSize+2)
+		if _, err := upcaseTableFromBytes(b); err == nil {
+			t.Errorf("did not return expected error")
+		}
+	})
+}
+
+func TestUpcaseEqualFold(t *testing.T) {
+	table := defaultUpcaseTable()
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"readme.txt", "README.TXT", true},
+		{"straße", "STRAßE", true},
+		{"élan", "ÉLAN", true},
+		{"abc", "abcd", false},
+		{"abc", "abd", false},
+	}
+	for _, tt := range tests {
+		if equal := table.equalFold(tt.a, tt.b); equal != tt.equal {
+			t.Errorf("equalFold(%q, %q) = %v, expected %v", tt.a, tt.b, equal, tt.equal)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package exfat
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// KB represents one KB
+	KB int64 = 1024
+	// MB represents one MB
+	MB int64 = 1024 * KB
+	// GB represents one GB
+	GB int64 = 1024 * MB
+	// TB represents one TB
+	TB int64 = 1024 * GB
+	// MinSize is the minimum size of an exFAT filesystem in bytes
+	MinSize int64 = 1 * MB
+)
+
+func splitPath(p string) ([]string, error) {
+	// globalize the separator
+	ps := strings.ReplaceAll(p, "\\", "/")
+	if ps == "" || ps[0] != '/' {
+		return nil, errors.New("must use absolute paths")
+	}
+	// eliminate empty parts
+	ret := make([]string, 0)
+	for _, sub := range strings.Split(ps, "/") {
+		if sub != "" {
+			ret = append(ret, sub)
+		}
+	}
+	return ret, nil
+}
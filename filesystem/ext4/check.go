@@ -0,0 +1,432 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// checker the state of a consistency check of a filesystem
+type checker struct {
+	fs       *FileSystem
+	problems []error
+	// used the blocks that the filesystem metadata and the inodes in use actually use
+	used *util.Bitmap
+	// sharedBlocks extended attribute blocks, which may be shared by many inodes, with how many use each
+	sharedBlocks map[uint64]uint32
+	// inodes the inodes in use, by number
+	inodes map[uint32]*inode
+	// refs how many directory entries there are for each inode
+	refs map[uint32]uint32
+	// special the inodes that the superblock points to, like the journal, which are in no directory
+	special map[uint32]bool
+}
+
+func (c *checker) problem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Errorf(format, args...))
+}
+
+// Check verify that the filesystem is consistent, as e2fsck would. It checks that:
+//   - every block that the filesystem metadata or an inode in use needs is marked as used in the block bitmaps,
+//     no other block is, and no block is used twice
+//   - the free block, free inode and directory counts of the group descriptors and superblock match the bitmaps
+//   - i_blocks of every inode in use matches the blocks it uses
+//   - every directory entry is for an inode in use, and the link count of every inode matches its entries
+//   - the file type of every directory entry matches the mode of its inode, or, without the filetype feature,
+//     that it has none
+//   - every directory can be reached from the root directory
+//   - the orphan list only holds inodes in use, and has no loops
+//   - the reference count of every extended attribute block is how many inodes share it
+//
+// With repair, it fixes the file types of directory entries, as e2fsck does; it repairs nothing else.
+//
+// It returns all of the problems found and not repaired, joined, or nil if there are none.
+func (fs *FileSystem) Check(repair bool) error {
+	sb := fs.superblock
+	// every block group is checked, so read the whole GDT up front
+	if err := fs.groupDescriptors.loadAll(); err != nil {
+		return fmt.Errorf("could not read group descriptors: %w", err)
+	}
+	c := &checker{
+		fs:           fs,
+		used:         util.NewBitmap(int((sb.blockCount + 7) / 8)),
+		sharedBlocks: map[uint64]uint32{},
+		inodes:       map[uint32]*inode{},
+		refs:         map[uint32]uint32{},
+		special:      map[uint32]bool{},
+	}
+	c.checkMetadata()
+	if err := c.checkInodes(); err != nil {
+		return err
+	}
+	if err := c.checkDirectories(repair); err != nil {
+		return err
+	}
+	c.checkOrphans()
+	c.checkXattrBlocks()
+	if err := c.checkBitmaps(); err != nil {
+		return err
+	}
+	return errors.Join(c.problems...)
+}
+
+// use mark count blocks from start as used by what, which is a problem if any of them already are
+func (c *checker) use(start, count uint64, what string) {
+	sb := c.fs.superblock
+	if start+count > sb.blockCount || start < uint64(sb.firstDataBlock) {
+		c.problem("%s uses blocks %d-%d, outside of the filesystem", what, start, start+count-1)
+		return
+	}
+	for block := start; block < start+count; block++ {
+		if isSet, _ := c.used.IsSet(int(block)); isSet {
+			c.problem("%s uses block %d, which already is in use", what, block)
+			continue
+		}
+		_ = c.used.Set(int(block))
+	}
+}
+
+// checkXattrBlocks check that the reference count of every extended attribute block is how many inodes use it
+func (c *checker) checkXattrBlocks() {
+	for block, count := range c.sharedBlocks {
+		x, err := c.fs.readXattrBlock(block)
+		if err != nil {
+			c.problem("could not read extended attribute block %d: %v", block, err)
+			continue
+		}
+		if x.refCount != count {
+			c.problem("extended attribute block %d has a reference count of %d, but is used by %d inodes", block, x.refCount, count)
+		}
+	}
+}
+
+// checkMetadata mark the blocks of the filesystem metadata as used
+func (c *checker) checkMetadata() {
+	sb := c.fs.superblock
+	inodeTableBlocks := (uint64(sb.inodesPerGroup)*uint64(sb.inodeSize) + uint64(sb.blockSize) - 1) / uint64(sb.blockSize)
+	for bg, gd := range c.fs.groupDescriptors.descriptors {
+		if count := sb.groupMetadataBlocks(uint64(bg)); count > 0 {
+			c.use(sb.groupStart(uint64(bg)), count, fmt.Sprintf("superblock and GDT of block group %d", bg))
+		}
+		c.use(gd.blockBitmapLocation, 1, fmt.Sprintf("block bitmap of block group %d", bg))
+		c.use(gd.inodeBitmapLocation, 1, fmt.Sprintf("inode bitmap of block group %d", bg))
+		c.use(gd.inodeTableLocation, inodeTableBlocks, fmt.Sprintf("inode table of block group %d", bg))
+	}
+}
+
+// checkInodes read every inode in use, and mark the blocks each uses
+func (c *checker) checkInodes() error {
+	sb := c.fs.superblock
+	for _, n := range []uint32{sb.journalInode, sb.userQuotaInode, sb.groupQuotaInode, sb.projectQuotaInode, sb.orphanedInodeInodeNumber} {
+		if n != 0 {
+			c.special[n] = true
+		}
+	}
+	if sb.features.reservedGDTBlocksForExpansion {
+		c.special[resizeInode] = true
+	}
+	for bg := range c.fs.groupDescriptors.descriptors {
+		bm, err := c.fs.readInodeBitmap(bg)
+		if err != nil {
+			return fmt.Errorf("could not read inode bitmap of block group %d: %w", bg, err)
+		}
+		for bit := 0; bit < int(sb.inodesPerGroup); bit++ {
+			if isSet, _ := bm.IsSet(bit); !isSet {
+				continue
+			}
+			number := uint32(bg)*sb.inodesPerGroup + uint32(bit) + 1
+			// the other reserved inodes might be in use without ever having been initialized
+			if number < sb.firstNonReservedInode && number != rootInode && !c.special[number] {
+				continue
+			}
+			in, err := c.fs.readInode(number)
+			if err != nil {
+				c.problem("could not read inode %d: %v", number, err)
+				continue
+			}
+			c.inodes[number] = in
+			c.checkInodeBlocks(in)
+		}
+	}
+	return nil
+}
+
+// checkInodeBlocks mark the blocks an inode uses, and check that its block count matches them
+func (c *checker) checkInodeBlocks(in *inode) {
+	sb := c.fs.superblock
+	what := fmt.Sprintf("inode %d", in.number)
+	var count uint64
+	switch {
+	case in.flags.inlineData:
+		// the data is in the inode itself
+	case in.extents != nil:
+		exts, err := in.extents.blocks(c.fs)
+		if err != nil {
+			c.problem("could not read extents of inode %d: %v", in.number, err)
+			return
+		}
+		for _, e := range exts {
+			c.use(e.startingBlock, uint64(e.count), what)
+			count += uint64(e.count)
+		}
+		index, err := extentTreeIndexBlocks(in.extents, c.fs)
+		if err != nil {
+			c.problem("could not read extent tree of inode %d: %v", in.number, err)
+			return
+		}
+		for _, block := range index {
+			c.use(block, 1, what)
+		}
+		count += uint64(len(index))
+	case in.number == resizeInode:
+		// its indirect blocks are the reserved GDT blocks, which are counted with the metadata
+		if dind := uint64(in.blockMap[inodeDoubleIndirectBlock]); dind != 0 {
+			c.use(dind, 1, what)
+		}
+		count = 1 + uint64(sb.reservedGDTBlocks)
+		for bg := int64(1); bg < int64(len(c.fs.groupDescriptors.descriptors)); bg++ {
+			if groupHasSuperblock(bg, sb.features, sb.backupSuperblockBlockGroups) {
+				count += uint64(sb.reservedGDTBlocks)
+			}
+		}
+	default:
+		blocks, err := c.blockMapBlocks(in)
+		if err != nil {
+			c.problem("could not read block map of inode %d: %v", in.number, err)
+			return
+		}
+		for _, block := range blocks {
+			c.use(block, 1, what)
+		}
+		count = uint64(len(blocks))
+	}
+	if block := in.extendedAttributeBlock; block != 0 {
+		if c.sharedBlocks[block] == 0 {
+			c.use(block, 1, what+" extended attributes")
+		}
+		c.sharedBlocks[block]++
+		count++
+	}
+	expected := count * uint64(sb.blockSize/512)
+	if in.filesystemBlocks {
+		expected = count
+	}
+	if in.blocks != expected {
+		c.problem("inode %d has a block count of %d, but uses %d", in.number, in.blocks, expected)
+	}
+}
+
+// blockMapBlocks all of the blocks of an inode without extents, including its indirect blocks
+func (c *checker) blockMapBlocks(in *inode) ([]uint64, error) {
+	var (
+		blocks []uint64
+		walk   func(block uint32, depth int) error
+	)
+	walk = func(block uint32, depth int) error {
+		if block == 0 {
+			return nil
+		}
+		blocks = append(blocks, uint64(block))
+		if depth == 0 {
+			return nil
+		}
+		b, err := c.fs.readBlock(uint64(block))
+		if err != nil {
+			return err
+		}
+		for i := 0; i+4 <= len(b); i += 4 {
+			if err := walk(binary.LittleEndian.Uint32(b[i:i+4]), depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, block := range in.blockMap {
+		depth := max(0, i-inodeDirectBlocks+1)
+		if err := walk(block, depth); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// checkDirectories count the entries for every inode, and check that they match the link counts, that the file
+// types of the entries match their inodes, and that every directory can be reached from the root. With repair,
+// the file types of entries are fixed.
+func (c *checker) checkDirectories(repair bool) error {
+	sb := c.fs.superblock
+	subdirectories := map[uint32][]uint32{}
+	for number, in := range c.inodes {
+		if in.fileType != fileTypeDirectory {
+			continue
+		}
+		// as they are on disk, which without the filetype feature have no file types
+		entries, err := c.fs.readDirectoryAsStored(number, false)
+		if err != nil {
+			c.problem("could not read directory inode %d: %v", number, err)
+			continue
+		}
+		var fixed bool
+		for _, de := range entries {
+			c.refs[de.inode]++
+			target, ok := c.inodes[de.inode]
+			if !ok {
+				c.problem("directory inode %d has entry %q for inode %d, which is not in use", number, de.filename, de.inode)
+				continue
+			}
+			if de.filename != "." && de.filename != ".." && target.fileType == fileTypeDirectory {
+				subdirectories[number] = append(subdirectories[number], de.inode)
+			}
+			expected := dirFileTypeUnknown
+			if sb.features.directoryEntriesRecordFileType {
+				expected = directoryFileTypeForInode(target.fileType)
+			}
+			switch {
+			case de.fileType == expected:
+			case repair:
+				de.fileType = expected
+				fixed = true
+			default:
+				c.problem("directory inode %d has entry %q with file type %d, but inode %d has file type %d", number, de.filename, de.fileType, de.inode, expected)
+			}
+		}
+		if fixed {
+			dir := &Directory{directoryEntry: directoryEntry{inode: number, fileType: dirFileTypeDirectory}, root: number == rootInode, entries: entries}
+			if err := c.fs.writeDirectory(dir); err != nil {
+				return fmt.Errorf("could not fix the file types of the entries of directory inode %d: %w", number, err)
+			}
+		}
+	}
+
+	for number, in := range c.inodes {
+		if c.special[number] || (number < sb.firstNonReservedInode && number != rootInode) {
+			continue
+		}
+		refs := c.refs[number]
+		switch {
+		case in.fileType == fileTypeDirectory && in.hardLinks == 1 && refs > maxHardLinks:
+			// with dir_nlink, a directory with too many subdirectories to count has a link count of 1
+		case in.hardLinks == 0 && refs == 0:
+			// an orphan, which is freed when the filesystem next is mounted
+		case refs == 0:
+			c.problem("inode %d is in use, but is not in any directory", number)
+		case uint32(in.hardLinks) != refs:
+			c.problem("inode %d has a link count of %d, but %d directory entries", number, in.hardLinks, refs)
+		}
+	}
+
+	reached := map[uint32]bool{rootInode: true}
+	queue := []uint32{rootInode}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		for _, sub := range subdirectories[dir] {
+			if !reached[sub] {
+				reached[sub] = true
+				queue = append(queue, sub)
+			}
+		}
+	}
+	for number, in := range c.inodes {
+		if in.fileType == fileTypeDirectory && !reached[number] {
+			c.problem("directory inode %d cannot be reached from the root directory", number)
+		}
+	}
+	return nil
+}
+
+// checkOrphans check the list of orphan inodes, which are linked through their deletion time
+func (c *checker) checkOrphans() {
+	seen := map[uint32]bool{}
+	for number := c.fs.superblock.orphanedInodesStart; number != 0; {
+		if seen[number] {
+			c.problem("orphan list has a loop at inode %d", number)
+			return
+		}
+		seen[number] = true
+		in, ok := c.inodes[number]
+		if !ok {
+			c.problem("orphan list has inode %d, which is not in use", number)
+			return
+		}
+		number = in.deletionTime
+	}
+}
+
+// checkBitmaps compare the bitmaps and the counts in the group descriptors and superblock with what is in use
+func (c *checker) checkBitmaps() error {
+	sb := c.fs.superblock
+	var freeBlocks uint64
+	var freeInodes uint32
+	directories := map[int]uint32{}
+	for number, in := range c.inodes {
+		if in.fileType == fileTypeDirectory {
+			directories[blockGroupForInode(int(number), sb.inodesPerGroup)]++
+		}
+	}
+	for bg, gd := range c.fs.groupDescriptors.descriptors {
+		bm, err := c.fs.readBlockBitmap(bg)
+		if err != nil {
+			return fmt.Errorf("could not read block bitmap of block group %d: %w", bg, err)
+		}
+		groupStart := uint64(sb.firstDataBlock) + uint64(bg)*uint64(sb.blocksPerGroup)
+		groupEnd := min(groupStart+uint64(sb.blocksPerGroup), sb.blockCount)
+		var free, unused, unmarked uint32
+		for block := groupStart; block < groupEnd; block++ {
+			marked, _ := bm.IsSet(int(block - groupStart))
+			used, _ := c.used.IsSet(int(block))
+			switch {
+			case !marked && used:
+				unmarked++
+			case marked && !used:
+				unused++
+			}
+			if !marked {
+				free++
+			}
+		}
+		if unused > 0 {
+			c.problem("block group %d has %d blocks marked as used that are not in use", bg, unused)
+		}
+		if unmarked > 0 {
+			c.problem("block group %d has %d blocks in use that are not marked as used", bg, unmarked)
+		}
+		if free != gd.freeBlocks {
+			c.problem("block group %d has %d free blocks, but its group descriptor has %d", bg, free, gd.freeBlocks)
+		}
+		freeBlocks += uint64(free)
+
+		im, err := c.fs.readInodeBitmap(bg)
+		if err != nil {
+			return fmt.Errorf("could not read inode bitmap of block group %d: %w", bg, err)
+		}
+		free = 0
+		lastUsed := -1
+		for bit := 0; bit < int(sb.inodesPerGroup); bit++ {
+			if isSet, _ := im.IsSet(bit); isSet {
+				lastUsed = bit
+			} else {
+				free++
+			}
+		}
+		if free != gd.freeInodes {
+			c.problem("block group %d has %d free inodes, but its group descriptor has %d", bg, free, gd.freeInodes)
+		}
+		if gd.unusedInodes > 0 && lastUsed >= int(sb.inodesPerGroup-gd.unusedInodes) {
+			c.problem("block group %d has inode %d in use, in the part of the inode table marked unused", bg, uint32(bg)*sb.inodesPerGroup+uint32(lastUsed)+1)
+		}
+		if directories[bg] != gd.usedDirectories {
+			c.problem("block group %d has %d directories, but its group descriptor has %d", bg, directories[bg], gd.usedDirectories)
+		}
+		freeInodes += free
+	}
+	if freeBlocks != sb.freeBlocks {
+		c.problem("filesystem has %d free blocks, but its superblock has %d", freeBlocks, sb.freeBlocks)
+	}
+	if freeInodes != sb.freeInodes {
+		c.problem("filesystem has %d free inodes, but its superblock has %d", freeInodes, sb.freeInodes)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package ext4
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// Convert creates a new ext4 filesystem, exactly as Create does, and copies the whole tree of src into it in one
+// call, e.g. to move the contents of an ISO or a FAT32 partition onto a writable root partition.
+//
+// Directories, regular files and symlinks are copied. Permissions, ownership and modification times are copied
+// where src reports them, otherwise new files keep the defaults they are created with. Hard links in src become
+// separate copies. Any other type of file, such as a device, is an error.
+//
+// size must be large enough to hold everything in src; allow some space beyond what EstimateSize returns for it.
+func Convert(src filesystem.FileSystem, b backend.Storage, size, start, sectorsize int64, p *Params) (*FileSystem, error) {
+	if src == nil {
+		return nil, fmt.Errorf("must pass a source filesystem to convert")
+	}
+	fs, err := Create(b, size, start, sectorsize, p)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ext4 filesystem: %w", err)
+	}
+	if err := fs.copyTree(src, "/"); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// copyTree copy the contents of the directory dir in src to the same path in fs, depth first
+func (fs *FileSystem) copyTree(src filesystem.FileSystem, dir string) error {
+	entries, err := src.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read source directory %s: %w", dir, err)
+	}
+	for _, fi := range entries {
+		name := fi.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		p := path.Join(dir, name)
+		switch {
+		case fi.IsDir():
+			if err := fs.Mkdir(p); err != nil {
+				return fmt.Errorf("could not create directory %s: %w", p, err)
+			}
+			if err := fs.copyTree(src, p); err != nil {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := filesystem.Readlink(src, p)
+			if err != nil {
+				return fmt.Errorf("could not read symlink %s: %w", p, err)
+			}
+			if err := fs.Symlink(target, p); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if err := fs.copyFile(src, p); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot copy %s: unsupported file type %s", p, fi.Mode().Type())
+		}
+		// set last, as adding entries to a directory changes it
+		if err := fs.copyAttributes(p, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystem) copyFile(src filesystem.FileSystem, p string) error {
+	in, err := src.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("could not open source file %s: %w", p, err)
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("could not create file %s: %w", p, err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("could not copy file %s: %w", p, err)
+	}
+	return nil
+}
+
+// copyAttributes set the permissions, owner and modification time of p from fi, as far as fi has them
+func (fs *FileSystem) copyAttributes(p string, fi os.FileInfo) error {
+	_, entry, err := fs.getEntryAndParent(p)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("file %s was not created", p)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		return fmt.Errorf("could not read inode %d for %s: %w", entry.inode, p, err)
+	}
+	// symlinks keep their permissions, which are never used
+	if perm := uint16(fi.Mode().Perm()); perm != 0 && in.fileType != fileTypeSymbolicLink {
+		in.permissionsOwner = parseOwnerPermissions(perm)
+		in.permissionsGroup = parseGroupPermissions(perm)
+		in.permissionsOther = parseOtherPermissions(perm)
+	}
+	if o, ok := fileOwner(fi); ok {
+		in.owner, in.group = o.UID(), o.GID()
+	}
+	if t := fi.ModTime(); !t.IsZero() {
+		in.modifyTime = t
+		in.accessTime = t
+	}
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d for %s: %w", entry.inode, p, err)
+	}
+	return nil
+}
+
+type owner interface {
+	UID() uint32
+	GID() uint32
+}
+
+// fileOwner get the owner of a file in another filesystem, if it has one, either from the
+// os.FileInfo itself or from what its Sys() returns
+func fileOwner(fi os.FileInfo) (owner, bool) {
+	if o, ok := fi.Sys().(owner); ok {
+		return o, true
+	}
+	o, ok := fi.(owner)
+	return o, ok
+}
@@ -0,0 +1,146 @@
+package ext4
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+)
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		read   func(f *os.File, size int64) (filesystem.FileSystem, error)
+	}{
+		{"squashfs", "../squashfs/testdata/file.sqs", func(f *os.File, size int64) (filesystem.FileSystem, error) {
+			return squashfs.Read(file.New(f, true), size, 0, 0)
+		}},
+		{"iso9660 with rock ridge", "../iso9660/testdata/rockridge.iso", func(f *os.File, size int64) (filesystem.FileSystem, error) {
+			return iso9660.Read(file.New(f, true), size, 0, 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(tt.source)
+			if err != nil {
+				t.Fatalf("Error opening source image: %v", err)
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatalf("Error getting size of source image: %v", err)
+			}
+			src, err := tt.read(f, fi.Size())
+			if err != nil {
+				t.Fatalf("Error reading source filesystem: %v", err)
+			}
+
+			outfile := filepath.Join(t.TempDir(), "converted.img")
+			out, err := os.Create(outfile)
+			if err != nil {
+				t.Fatalf("Error creating image file: %v", err)
+			}
+			defer out.Close()
+			size := int64(100 * MB)
+			if err := out.Truncate(size); err != nil {
+				t.Fatalf("Error sizing image file: %v", err)
+			}
+			if _, err := Convert(src, file.New(out, false), size, 0, 512, nil); err != nil {
+				t.Fatalf("Error converting filesystem: %v", err)
+			}
+
+			// read it back from scratch, and compare everything
+			dst, err := Read(file.New(out, true), size, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading converted filesystem: %v", err)
+			}
+			compareConverted(t, src, dst, "/")
+		})
+	}
+}
+
+func compareConverted(t *testing.T, src filesystem.FileSystem, dst *FileSystem, dir string) {
+	t.Helper()
+	entries, err := src.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading source directory %s: %v", dir, err)
+	}
+	for _, srcInfo := range entries {
+		if srcInfo.Name() == "." || srcInfo.Name() == ".." {
+			continue
+		}
+		p := path.Join(dir, srcInfo.Name())
+		dstInfo, err := dst.Stat(p)
+		if err != nil {
+			t.Errorf("%s: missing from converted filesystem: %v", p, err)
+			continue
+		}
+		if srcInfo.IsDir() != dstInfo.IsDir() {
+			t.Errorf("%s: mismatched directory, source %v converted %v", p, srcInfo.IsDir(), dstInfo.IsDir())
+			continue
+		}
+		if srcType, dstType := srcInfo.Mode().Type()&^os.ModeDir, dstInfo.Mode().Type()&^os.ModeDir; srcType != dstType {
+			t.Errorf("%s: mismatched type, source %v converted %v", p, srcType, dstType)
+			continue
+		}
+		if !srcInfo.ModTime().Equal(dstInfo.ModTime()) {
+			t.Errorf("%s: mismatched modification time, source %v converted %v", p, srcInfo.ModTime(), dstInfo.ModTime())
+		}
+		if o, ok := fileOwner(srcInfo); ok {
+			dstOwner := dstInfo.Sys().(owner)
+			if o.UID() != dstOwner.UID() || o.GID() != dstOwner.GID() {
+				t.Errorf("%s: mismatched owner, source %d:%d converted %d:%d", p, o.UID(), o.GID(), dstOwner.UID(), dstOwner.GID())
+			}
+		}
+		switch {
+		case srcInfo.IsDir():
+			if srcInfo.Mode().Perm() != dstInfo.Mode().Perm() {
+				t.Errorf("%s: mismatched permissions, source %v converted %v", p, srcInfo.Mode().Perm(), dstInfo.Mode().Perm())
+			}
+			compareConverted(t, src, dst, p)
+		case srcInfo.Mode()&os.ModeSymlink != 0:
+			srcTarget, err := filesystem.Readlink(src, p)
+			if err != nil {
+				t.Fatalf("%s: error reading source symlink: %v", p, err)
+			}
+			dstTarget, err := dst.Readlink(p)
+			if err != nil {
+				t.Fatalf("%s: error reading converted symlink: %v", p, err)
+			}
+			if srcTarget != dstTarget {
+				t.Errorf("%s: mismatched symlink target, source %q converted %q", p, srcTarget, dstTarget)
+			}
+		default:
+			if srcInfo.Mode().Perm() != dstInfo.Mode().Perm() {
+				t.Errorf("%s: mismatched permissions, source %v converted %v", p, srcInfo.Mode().Perm(), dstInfo.Mode().Perm())
+			}
+			srcData := readAllFile(t, src, p)
+			dstData := readAllFile(t, dst, p)
+			if !bytes.Equal(srcData, dstData) {
+				t.Errorf("%s: mismatched contents, source %d bytes converted %d bytes", p, len(srcData), len(dstData))
+			}
+		}
+	}
+}
+
+func readAllFile(t *testing.T, fs filesystem.FileSystem, p string) []byte {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Error opening %s: %v", p, err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Error reading %s: %v", p, err)
+	}
+	return b
+}
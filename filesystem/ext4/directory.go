@@ -3,12 +3,21 @@ package ext4
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 )
 
 const (
 	directoryHashTreeRootMinSize = 0x28
 	directoryHashTreeNodeMinSize = 0x12
+	// where the count and limit of the index entries start in a dx_root and a dx_node block
+	directoryHashTreeRootCountOffset = 0x20
+	directoryHashTreeNodeCountOffset = 0x8
+	directoryHashTreeInfoLength      = 8
+	directoryHashEntrySize           = 8
+	// directoryHashTreeTailSize size of the dx_tail with the checksum at the end of index blocks, with metadata_csum
+	directoryHashTreeTailSize = 8
 )
 
 // Directory represents a single directory in an ext4 filesystem
@@ -18,6 +27,16 @@ type Directory struct {
 	entries []*directoryEntry
 }
 
+// withoutFileTypes a copy of the directory whose entries have no file types, to write to a filesystem without the
+// filetype feature, where the byte of an entry that holds its file type is the high byte of the length of its name
+func (d *Directory) withoutFileTypes() *Directory {
+	dir := &Directory{directoryEntry: d.directoryEntry, root: d.root, entries: make([]*directoryEntry, 0, len(d.entries))}
+	for _, de := range d.entries {
+		dir.entries = append(dir.entries, &directoryEntry{inode: de.inode, filename: de.filename, fileType: dirFileTypeUnknown})
+	}
+	return dir
+}
+
 // toBytes convert our entries to raw bytes. Provides checksum as well. Final returned byte slice will be a multiple of bytesPerBlock.
 func (d *Directory) toBytes(bytesPerBlock uint32, checksumFunc checksumAppender) []byte {
 	b := make([]byte, 0)
@@ -33,8 +52,7 @@ func (d *Directory) toBytes(bytesPerBlock uint32, checksumFunc checksumAppender)
 	lastEntryCount = len(d.entries) - 1
 	for i, de := range d.entries {
 		b2 := de.toBytes(0)
-		switch {
-		case len(block)+len(b2) > int(bytesPerBlock)-minDirEntryLength:
+		if len(block)+len(b2) > int(bytesPerBlock)-minDirEntryLength {
 			// if adding this one will go past the end of the block, pad out the previous
 			block = block[:len(block)-previousLength]
 			previousB := previousEntry.toBytes(uint16(int(bytesPerBlock) - len(block) - minDirEntryLength))
@@ -42,20 +60,19 @@ func (d *Directory) toBytes(bytesPerBlock uint32, checksumFunc checksumAppender)
 			// add the checksum
 			block = checksumFunc(block)
 			b = append(b, block...)
-			// start a new block
+			// start a new block, beginning with this entry
 			block = make([]byte, 0)
-		case i == lastEntryCount:
+		}
+		if i == lastEntryCount {
 			// if this is the last one, pad it out
 			b2 = de.toBytes(uint16(int(bytesPerBlock) - len(block) - minDirEntryLength))
 			block = append(block, b2...)
 			// add the checksum
 			block = checksumFunc(block)
 			b = append(b, block...)
-			// start a new block
-			block = make([]byte, 0)
-		default:
-			block = append(block, b2...)
+			break
 		}
+		block = append(block, b2...)
 		previousLength = len(b2)
 		previousEntry = de
 	}
@@ -68,6 +85,195 @@ func (d *Directory) toBytes(bytesPerBlock uint32, checksumFunc checksumAppender)
 	return b
 }
 
+// hashTreeParams how to build the hash tree index of a directory
+type hashTreeParams struct {
+	blockSize uint32
+	// hashVersion the default hash version from the superblock, which is the one recorded in the dx_root
+	hashVersion hashAlgorithm
+	// unsigned if names are hashed with unsigned chars, per the superblock flags
+	unsigned bool
+	seed     []uint32
+	// largeDirectory if the tree can have 3 levels, rather than 2
+	largeDirectory bool
+	// minBlocks the minimum number of blocks for the directory, as directories never shrink
+	minBlocks int
+	// checksumFunc adds the checksum entry to each leaf block
+	checksumFunc checksumAppender
+	// dxChecksum calculates the checksum of index blocks, nil if there are no metadata checksums
+	dxChecksum checksummer
+}
+
+// hashedLeaf a leaf block of a hash tree, with the hash recorded for it in the index
+type hashedLeaf struct {
+	hash    uint32
+	entries []*directoryEntry
+}
+
+// toHashedBytes convert our entries to raw bytes of a directory indexed by a hash tree, as the kernel creates
+// for large directories. The first block is the dx_root, followed by the dx_node blocks of a 2- or 3-level tree,
+// followed by the leaves, which are linear blocks of entries sorted by hash.
+func (d *Directory) toHashedBytes(p hashTreeParams) ([]byte, error) {
+	var dot, dotdot *directoryEntry
+	entries := make([]*directoryEntry, 0, len(d.entries))
+	for _, de := range d.entries {
+		switch de.filename {
+		case ".":
+			dot = de
+		case "..":
+			dotdot = de
+		default:
+			entries = append(entries, de)
+		}
+	}
+	if dot == nil || dotdot == nil {
+		return nil, errors.New("directory with hash tree must have . and .. entries")
+	}
+
+	version := hashVersion(p.hashVersion)
+	if p.unsigned {
+		version += HashVersionLegacyUnsigned
+	}
+	hashes := make(map[*directoryEntry][2]uint32, len(entries))
+	for _, de := range entries {
+		hash, minor := ext4fsDirhash(de.filename, version, p.seed)
+		hashes[de] = [2]uint32{hash, minor}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		hi, hj := hashes[entries[i]], hashes[entries[j]]
+		if hi[0] != hj[0] {
+			return hi[0] < hj[0]
+		}
+		return hi[1] < hj[1]
+	})
+
+	// pack the entries into leaves, leaving room for the checksum entry, just like linear blocks
+	leafSize := int(p.blockSize) - minDirEntryLength
+	leaves := []hashedLeaf{{}}
+	var used int
+	for _, de := range entries {
+		size := len(de.toBytes(0))
+		leaf := &leaves[len(leaves)-1]
+		if used+size > leafSize {
+			hash := hashes[de][0]
+			// the hash continues from the previous leaf, so lookups for it must check both
+			if hash == hashes[leaf.entries[len(leaf.entries)-1]][0] {
+				hash |= 1
+			}
+			leaves = append(leaves, hashedLeaf{hash: hash})
+			leaf = &leaves[len(leaves)-1]
+			used = 0
+		}
+		leaf.entries = append(leaf.entries, de)
+		used += size
+	}
+
+	var tailSize int
+	if p.dxChecksum != nil {
+		tailSize = directoryHashTreeTailSize
+	}
+	rootLimit := (int(p.blockSize) - directoryHashTreeRootCountOffset - tailSize) / directoryHashEntrySize
+	nodeLimit := (int(p.blockSize) - directoryHashTreeNodeCountOffset - tailSize) / directoryHashEntrySize
+	maxLevels := 1
+	if p.largeDirectory {
+		maxLevels = 2
+	}
+
+	nodeCounts, numNodes, err := hashTreeNodeCounts(len(leaves), rootLimit, nodeLimit, maxLevels)
+	// pad with empty leaves for the blocks the directory already had
+	for err == nil && 1+numNodes+len(leaves) < p.minBlocks {
+		last := leaves[len(leaves)-1]
+		hash := last.hash
+		if len(last.entries) > 0 {
+			hash = hashes[last.entries[len(last.entries)-1]][0]
+		}
+		leaves = append(leaves, hashedLeaf{hash: hash | 1})
+		nodeCounts, numNodes, err = hashTreeNodeCounts(len(leaves), rootLimit, nodeLimit, maxLevels)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("directory with %d entries is too large: %w", len(entries), err)
+	}
+
+	// block numbers: the root, then the dx_node blocks level by level, then the leaves
+	firstLeaf := 1 + numNodes
+	b := make([]byte, int(p.blockSize)*(firstLeaf+len(leaves)))
+
+	// the leaves, and the index entries that point at them
+	level := make([]directoryHashEntry, 0, len(leaves))
+	for i, leaf := range leaves {
+		block := uint32(firstLeaf + i)
+		var lb []byte
+		if len(leaf.entries) == 0 {
+			lb = p.checksumFunc((&directoryEntry{}).toBytes(uint16(leafSize)))
+		} else {
+			lb = (&Directory{entries: leaf.entries}).toBytes(p.blockSize, p.checksumFunc)
+		}
+		copy(b[int(block)*int(p.blockSize):], lb)
+		level = append(level, directoryHashEntry{hash: leaf.hash, block: block})
+	}
+
+	// the dx_node blocks, from the bottom up, each indexing the level below it
+	nextNode := firstLeaf
+	for l := len(nodeCounts) - 1; l >= 0; l-- {
+		nextNode -= nodeCounts[l]
+		parents := make([]directoryHashEntry, 0, nodeCounts[l])
+		for i := 0; i < nodeCounts[l]; i++ {
+			children := level[i*nodeLimit : min((i+1)*nodeLimit, len(level))]
+			block := uint32(nextNode + i)
+			nb := b[int(block)*int(p.blockSize) : int(block+1)*int(p.blockSize)]
+			// a fake empty directory entry that covers the whole block
+			binary.LittleEndian.PutUint16(nb[0x4:0x6], uint16(p.blockSize))
+			writeDirectoryHashEntries(nb, directoryHashTreeNodeCountOffset, nodeLimit, children, p.dxChecksum)
+			parents = append(parents, directoryHashEntry{hash: children[0].hash, block: block})
+		}
+		level = parents
+	}
+
+	// the root
+	rb := b[:p.blockSize]
+	copy(rb, dot.toBytes(uint16(minDirEntryLength)))
+	copy(rb[minDirEntryLength:], dotdot.toBytes(uint16(int(p.blockSize)-minDirEntryLength)))
+	rb[0x1c] = byte(p.hashVersion)
+	rb[0x1d] = directoryHashTreeInfoLength
+	rb[0x1e] = uint8(len(nodeCounts))
+	writeDirectoryHashEntries(rb, directoryHashTreeRootCountOffset, rootLimit, level, p.dxChecksum)
+	return b, nil
+}
+
+// hashTreeNodeCounts how many levels of dx_node blocks a hash tree with the given number of leaves needs below
+// its root, how many blocks there are in each level, from the top down, and how many there are in total
+func hashTreeNodeCounts(leaves, rootLimit, nodeLimit, maxLevels int) (nodeCounts []int, total int, err error) {
+	for children := leaves; children > rootLimit; children = nodeCounts[0] {
+		if len(nodeCounts) == maxLevels {
+			return nil, 0, fmt.Errorf("%d leaf blocks need more than %d levels of index nodes", leaves, maxLevels)
+		}
+		nodeCounts = append([]int{(children + nodeLimit - 1) / nodeLimit}, nodeCounts...)
+		total += nodeCounts[0]
+	}
+	return nodeCounts, total, nil
+}
+
+// writeDirectoryHashEntries write the limit, count and entries of a dx_root or dx_node block, which start at offset,
+// and the dx_tail with its checksum if there is a checksummer. The first entry has no hash, as it is the one for
+// all hashes lower than that of the second one.
+func writeDirectoryHashEntries(b []byte, offset, limit int, entries []directoryHashEntry, checksumFunc checksummer) {
+	binary.LittleEndian.PutUint16(b[offset:offset+2], uint16(limit))
+	binary.LittleEndian.PutUint16(b[offset+2:offset+4], uint16(len(entries)))
+	binary.LittleEndian.PutUint32(b[offset+4:offset+8], entries[0].block)
+	for i, e := range entries[1:] {
+		entryOffset := offset + (i+1)*directoryHashEntrySize
+		binary.LittleEndian.PutUint32(b[entryOffset:entryOffset+4], e.hash)
+		binary.LittleEndian.PutUint32(b[entryOffset+4:entryOffset+8], e.block)
+	}
+	if checksumFunc == nil {
+		return
+	}
+	// the checksum covers the entries in use and the dx_tail with a zero checksum
+	size := offset + len(entries)*directoryHashEntrySize
+	tailOffset := offset + limit*directoryHashEntrySize
+	checksum := checksumFunc(append(b[:size:size], make([]byte, directoryHashTreeTailSize)...))
+	binary.LittleEndian.PutUint32(b[tailOffset+4:tailOffset+8], checksum)
+}
+
 type directoryHashEntry struct {
 	hash  uint32
 	block uint32
@@ -118,7 +324,8 @@ func parseDirectoryTreeRoot(b []byte, largeDir bool) (node *directoryHashRoot, e
 		return nil, fmt.Errorf("directory hash tree root dot name length is %d and not 1", dotNameSize)
 	}
 	dotFileType := directoryFileType(b[0x7])
-	if dotFileType != dirFileTypeDirectory {
+	// without the filetype feature, entries have no file type
+	if dotFileType != dirFileTypeDirectory && dotFileType != dirFileTypeUnknown {
 		return nil, fmt.Errorf("directory hash tree root dot file type is %d and not %v", dotFileType, dirFileTypeDirectory)
 	}
 	dotName := b[0x8:0xc]
@@ -133,7 +340,8 @@ func parseDirectoryTreeRoot(b []byte, largeDir bool) (node *directoryHashRoot, e
 		return nil, fmt.Errorf("directory hash tree root dotdot name length is %d and not 2", dotdotNameSize)
 	}
 	dotdotFileType := directoryFileType(b[0x13])
-	if dotdotFileType != dirFileTypeDirectory {
+	// without the filetype feature, entries have no file type
+	if dotdotFileType != dirFileTypeDirectory && dotdotFileType != dirFileTypeUnknown {
 		return nil, fmt.Errorf("directory hash tree root dotdot file type is %d and not %v", dotdotFileType, dirFileTypeDirectory)
 	}
 	dotdotName := b[0x14:0x18]
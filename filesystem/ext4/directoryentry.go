@@ -3,6 +3,7 @@ package ext4
 import (
 	"encoding/binary"
 	"fmt"
+	"slices"
 )
 
 // directoryFileType uses different constants than the file type property in the inode
@@ -136,7 +137,10 @@ func parseDirEntriesLinear(b []byte, withChecksums bool, blocksize, inodeNumber,
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse directory entry %d: %v", count, err)
 		}
-		entries = append(entries, de)
+		// inode 0 marks an unused entry, such as a deleted one or the checksum at the end of a block
+		if de.inode != 0 {
+			entries = append(entries, de)
+		}
 		i += int(length)
 	}
 	return entries, nil
@@ -174,3 +178,48 @@ func parseDirEntriesHashed(b []byte, depth uint8, node dxNode, blocksize uint32,
 	}
 	return dirEntries, nil
 }
+
+// parseDirEntriesLeaves parse the leaf blocks of a hash tree index in the order they are in the directory, rather
+// than that of the hashes of the names in them
+func parseDirEntriesLeaves(b []byte, depth uint8, node dxNode, blocksize uint32, withChecksums bool, inodeNumber, inodeGeneration, checksumSeed uint32) ([]*directoryEntry, error) {
+	leaves, err := dxLeafBlocks(b, depth, node, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(leaves)
+	var dirEntries []*directoryEntry
+	for _, block := range leaves {
+		start := block * blocksize
+		entries, err := parseDirEntriesLinear(b[start:start+blocksize], withChecksums, blocksize, inodeNumber, inodeGeneration, checksumSeed)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing linear directory entries: %w", err)
+		}
+		dirEntries = append(dirEntries, entries...)
+	}
+	return dirEntries, nil
+}
+
+// dxLeafBlocks the blocks of the directory that are leaves of its hash tree index, in the order of their hashes
+func dxLeafBlocks(b []byte, depth uint8, node dxNode, blocksize uint32) ([]uint32, error) {
+	var leaves []uint32
+	for _, entry := range node.entries() {
+		start := entry.block * blocksize
+		if uint64(start)+uint64(blocksize) > uint64(len(b)) {
+			return nil, fmt.Errorf("hash tree points to block %d, beyond the end of the directory", entry.block)
+		}
+		if depth == 0 {
+			leaves = append(leaves, entry.block)
+			continue
+		}
+		child, err := parseDirectoryTreeNode(b[start : start+blocksize])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing directory tree node: %w", err)
+		}
+		childLeaves, err := dxLeafBlocks(b, depth-1, child, blocksize)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, childLeaves...)
+	}
+	return leaves, nil
+}
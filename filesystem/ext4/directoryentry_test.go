@@ -22,3 +22,38 @@ func TestDirectoryEntriesFromBytes(t *testing.T) {
 		t.Errorf("directoryFromBytes() = %v", diff)
 	}
 }
+
+func TestParseDirEntriesLeaves(t *testing.T) {
+	const blocksize = 1024
+	// block 0 would be the root of the tree; the leaf with the lower hashes is in block 2
+	b := make([]byte, 3*blocksize)
+	copy(b[2*blocksize:], (&directoryEntry{inode: 12, filename: "low", fileType: dirFileTypeRegular}).toBytes(blocksize))
+	copy(b[blocksize:], (&directoryEntry{inode: 13, filename: "high", fileType: dirFileTypeRegular}).toBytes(blocksize))
+	root := &directoryHashNode{childEntries: []directoryHashEntry{{hash: 0, block: 2}, {hash: 0x80000000, block: 1}}}
+
+	for _, tt := range []struct {
+		name  string
+		parse func([]byte, uint8, dxNode, uint32, bool, uint32, uint32, uint32) ([]*directoryEntry, error)
+		names []string
+	}{
+		{"hashed", parseDirEntriesHashed, []string{"low", "high"}},
+		{"on disk", parseDirEntriesLeaves, []string{"high", "low"}},
+	} {
+		entries, err := tt.parse(b, 0, root, blocksize, false, 2, 0, 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.filename)
+		}
+		if diff := deep.Equal(names, tt.names); diff != nil {
+			t.Errorf("%s: %v", tt.name, diff)
+		}
+	}
+	// a tree that points past the end of the directory
+	root.childEntries = append(root.childEntries, directoryHashEntry{hash: 0xc0000000, block: 3})
+	if _, err := parseDirEntriesLeaves(b, 0, root, blocksize, false, 2, 0, 0); err == nil {
+		t.Errorf("no error for leaf beyond the end of the directory")
+	}
+}
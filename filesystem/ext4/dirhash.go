@@ -42,19 +42,22 @@ func TEATransform(buf [4]uint32, in []uint32) [4]uint32 {
 	return buf
 }
 
+// hashChar the value of a single byte of a name, which depends on if chars are signed or not
+func hashChar(c byte, signed bool) uint32 {
+	if signed {
+		return uint32(int32(int8(c)))
+	}
+	return uint32(c)
+}
+
 // the old legacy hash
-//
-//nolint:unparam,revive // we do not used signed, but we probably should, so leaving until we are sure
 func dxHackHash(name string, signed bool) uint32 {
 	var hash uint32
 	var hash0, hash1 uint32 = 0x12a3fe2d, 0x37abe8f9
 	b := []byte(name)
 
-	for i := len(b); i > 0; i-- {
-		// get the specific character
-		c := int(b[i-1])
-		// the value of the individual character depends on if it is signed or not
-		hash = hash1 + (hash0 ^ uint32(c*7152373))
+	for i := 0; i < len(b); i++ {
+		hash = hash1 + (hash0 ^ (hashChar(b[i], signed) * 7152373))
 
 		if hash&0x80000000 != 0 {
 			hash -= 0x7fffffff
@@ -65,7 +68,8 @@ func dxHackHash(name string, signed bool) uint32 {
 	return hash0 << 1
 }
 
-//nolint:unparam,revive // we do not used signed, but we probably should, so leaving until we are sure
+// str2hashbuf convert the first num*4 bytes of msg into num words of input for a hash transform,
+// padded with a value that depends on the length of all of msg
 func str2hashbuf(msg string, num int, signed bool) []uint32 {
 	var buf [8]uint32
 	var pad, val uint32
@@ -81,8 +85,7 @@ func str2hashbuf(msg string, num int, signed bool) []uint32 {
 	}
 	var j int
 	for i := 0; i < size; i++ {
-		c := int(b[i])
-		val = uint32(c) + (val << 8)
+		val = hashChar(b[i], signed) + (val << 8)
 		if (i % 4) == 3 {
 			buf[j] = val
 			val = pad
@@ -121,14 +124,14 @@ func ext4fsDirhash(name string, version hashVersion, seed []uint32) (hash, minor
 	case HashVersionHalfMD4Unsigned:
 		for i := 0; i < len(name); i += 32 {
 			in := str2hashbuf(name[i:], 8, false)
-			buf[1] = md4.HalfMD4Transform(buf, in)
+			buf = md4.HalfMD4TransformBuffer(buf, in)
 		}
 		minorHash = buf[2]
 		hash = buf[1]
 	case HashVersionHalfMD4:
 		for i := 0; i < len(name); i += 32 {
 			in := str2hashbuf(name[i:], 8, true)
-			buf[1] = md4.HalfMD4Transform(buf, in)
+			buf = md4.HalfMD4TransformBuffer(buf, in)
 		}
 		minorHash = buf[2]
 		hash = buf[1]
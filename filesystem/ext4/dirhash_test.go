@@ -1 +1,36 @@
 package ext4
+
+import (
+	"testing"
+)
+
+func TestExt4fsDirhash(t *testing.T) {
+	// expected values are from debugfs "dx_hash -h <version> -s 44332211-8877-6655-ccbb-aa9900ffeedd <name>"
+	seed := []uint32{0x11223344, 0x55667788, 0x99aabbcc, 0xddeeff00}
+	longName := "a-very-long-file-name-that-is-longer-than-32-bytes.dat"
+	tests := []struct {
+		name    string
+		version hashVersion
+		hash    uint32
+		minor   uint32
+	}{
+		{"a", HashVersionLegacy, 0xe74b53e2, 0},
+		{"hello.txt", HashVersionLegacy, 0x65a05776, 0},
+		{longName, HashVersionLegacy, 0x6a216d2a, 0},
+		{"café", HashVersionLegacy, 0x96ca5a2c, 0},
+		{"a", HashVersionHalfMD4, 0xf96a38be, 0xef674a9f},
+		{"hello.txt", HashVersionHalfMD4, 0x2bbaeaaa, 0x49a28e37},
+		{longName, HashVersionHalfMD4, 0x4404b7dc, 0x002ff4ec},
+		{"café", HashVersionHalfMD4, 0xaea31032, 0x00ae8712},
+		{"a", HashVersionTEA, 0x4059fc3e, 0xb1183f24},
+		{"hello.txt", HashVersionTEA, 0x25f56798, 0xb9037ffc},
+		{longName, HashVersionTEA, 0x944f5860, 0x3b522810},
+		{"café", HashVersionTEA, 0xcdf368ea, 0x520a67f4},
+	}
+	for _, tt := range tests {
+		hash, minor := ext4fsDirhash(tt.name, tt.version, seed)
+		if hash != tt.hash || minor != tt.minor {
+			t.Errorf("version %d name %q: got hash %#08x minor %#08x, expected %#08x %#08x", tt.version, tt.name, hash, minor, tt.hash, tt.minor)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package ext4
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+const (
+	// lostFoundSize the size mke2fs expands lost+found to, so that e2fsck need not allocate while repairing
+	lostFoundSize int64 = 16 * 1024
+	// fastSymlinkMax the longest symlink target stored in the inode itself rather than in a data block
+	fastSymlinkMax int64 = 59
+	// maxReservedGDTGrowth how many times larger the filesystem may grow online, which sizes the reserved GDT blocks
+	maxReservedGDTGrowth uint64 = 1024
+)
+
+// EstimateSize returns the size in bytes of the smallest filesystem, with the given parameters, that can hold
+// everything in the manifest. The calculation follows the layout mke2fs uses: superblock and group descriptor
+// backups, reserved GDT blocks, bitmaps and inode tables in every group, the journal, extent tree blocks,
+// directory blocks and the reserved blocks percentage. The result leaves no free space beyond those
+// reserved blocks, so add some if anything more is to be written later.
+//
+// p may be nil, in which case the same defaults as Create are used.
+func EstimateSize(m filesystem.Manifest, p *Params) (int64, error) {
+	if p == nil {
+		p = &Params{}
+	}
+	blocksize := uint32(2 * SectorSize512)
+	if p.SectorsPerBlock != 0 {
+		if p.SectorsPerBlock > 128 || p.SectorsPerBlock < 2 {
+			return 0, fmt.Errorf("invalid sectors per block %d, must be between %d and %d sectors", p.SectorsPerBlock, 2, 128)
+		}
+		blocksize = uint32(p.SectorsPerBlock) * uint32(SectorSize512)
+	}
+	blocksPerGroup := p.BlocksPerGroup
+	if blocksPerGroup == 0 {
+		blocksPerGroup = 8 * blocksize
+	}
+	if blocksPerGroup < minBlocksPerGroup || blocksPerGroup > 8*blocksize || blocksPerGroup%8 != 0 {
+		return 0, fmt.Errorf("invalid number of blocks per group %d", blocksPerGroup)
+	}
+	inodeRatio := p.InodeRatio
+	if inodeRatio <= 0 {
+		inodeRatio = DefaultInodeRatio
+	}
+	inodeRatio = max(inodeRatio, int64(blocksize), p.ClusterSize)
+	reservedPercent := p.ReservedBlocksPercent
+	if reservedPercent == 0 {
+		reservedPercent = DefaultReservedBlocksPercent
+	}
+	fflags := defaultFeatureFlags
+	for _, flagopt := range p.Features {
+		flagopt(&fflags)
+	}
+	// an external journal takes no space in the filesystem
+	if p.ExternalJournal != nil {
+		fflags.separateJournalDevice = true
+	}
+	if fflags.metaBlockGroups {
+		return 0, fmt.Errorf("meta block groups not yet supported")
+	}
+
+	dataBlocks, inodes := manifestBlocks(m.Directories(), int64(blocksize), fflags)
+	// the reserved inodes below the first non-reserved one, which is lost+found
+	inodes += int64(firstNonReservedInode)
+	if p.InodeCount != 0 && int64(p.InodeCount) < inodes {
+		return 0, fmt.Errorf("manifest needs %d inodes, more than the requested %d", inodes, p.InodeCount)
+	}
+
+	maxBlocks := uint64(max32Num)
+	if fflags.fs64Bit {
+		maxBlocks = maxFilesystemSize64Bit / uint64(blocksize)
+	}
+
+	// everything depends on the number of blocks, so grow it until the layout fits
+	numblocks := uint64(dataBlocks)
+	for {
+		if numblocks > maxBlocks {
+			return 0, fmt.Errorf("manifest needs %d blocks, more than the maximum %d", numblocks, maxBlocks)
+		}
+		inodeCount := uint64(p.InodeCount)
+		if inodeCount == 0 {
+			inodeCount = numblocks * uint64(blocksize) / uint64(inodeRatio)
+			if inodeCount < uint64(inodes) {
+				numblocks = (uint64(inodes)*uint64(inodeRatio) + uint64(blocksize) - 1) / uint64(blocksize)
+				continue
+			}
+		}
+		required := uint64(dataBlocks) + layoutOverhead(numblocks, inodeCount, blocksize, blocksPerGroup, p.SparseSuperVersion, fflags)
+		required += numblocks * uint64(reservedPercent) / 100
+		if required <= numblocks {
+			return int64(numblocks) * int64(blocksize), nil
+		}
+		numblocks = required
+	}
+}
+
+// reservedGDTBlockCount how many blocks mke2fs reserves after each copy of the GDT, for the GDT of a filesystem
+// grown online to up to 1024 times its size, but no more than the resize inode can point at
+func reservedGDTBlockCount(numblocks, gdtBlocks uint64, firstDataBlock, blocksize, blocksPerGroup uint32, gdSize uint64) uint64 {
+	maxBlocks := min(numblocks*maxReservedGDTGrowth, max32Num)
+	maxGroups := (maxBlocks - uint64(firstDataBlock) + uint64(blocksPerGroup) - 1) / uint64(blocksPerGroup)
+	maxGDTBlocks := (maxGroups*gdSize + uint64(blocksize) - 1) / uint64(blocksize)
+	if maxGDTBlocks <= gdtBlocks {
+		return 0
+	}
+	return min(maxGDTBlocks-gdtBlocks, uint64(blocksize)/4)
+}
+
+// layoutOverhead the number of blocks in a filesystem of numblocks blocks that go to metadata rather than files
+func layoutOverhead(numblocks, inodeCount uint64, blocksize, blocksPerGroup uint32, sparseSuperVersion uint8, fflags featureFlags) uint64 {
+	groups := (numblocks + uint64(blocksPerGroup) - 1) / uint64(blocksPerGroup)
+	gdSize := uint64(groupDescriptorSize)
+	if fflags.fs64Bit {
+		gdSize = uint64(groupDescriptorSize64Bit)
+	}
+	gdtBlocks := (groups*gdSize + uint64(blocksize) - 1) / uint64(blocksize)
+
+	// reserved GDT blocks allow the filesystem to grow online, and are kept with every copy of the GDT
+	var reservedGDT uint64
+	if fflags.reservedGDTBlocksForExpansion {
+		var firstDataBlock uint32
+		if blocksize == 1024 {
+			firstDataBlock = 1
+		}
+		reservedGDT = reservedGDTBlockCount(numblocks, gdtBlocks, firstDataBlock, blocksize, blocksPerGroup, gdSize)
+	}
+
+	// groups that hold a copy of the superblock and GDT
+	copies := groups
+	switch {
+	case sparseSuperVersion == 2:
+		copies = min(groups, 3)
+	case fflags.sparseSuperblock:
+		copies = 1 + uint64(len(calculateBackupSuperblockGroups(int64(groups))))
+	}
+
+	inodesPerBlock := uint64(blocksize) / uint64(DefaultInodeSize)
+	inodesPerGroup := (inodeCount + groups - 1) / groups
+	inodeTableBlocks := (inodesPerGroup + inodesPerBlock - 1) / inodesPerBlock
+
+	overhead := copies*(1+gdtBlocks+reservedGDT) + groups*(2+inodeTableBlocks)
+	// with 1K blocks, block 0 holds the boot sector and the superblock is in block 1
+	if blocksize == 1024 {
+		overhead++
+	}
+	if fflags.hasJournal && !fflags.separateJournalDevice {
+		journal := journalBlocks(numblocks)
+		overhead += journal + uint64(extentTreeBlocks(int64(journal), int64(blocksize)))
+	}
+	return overhead
+}
+
+// journalBlocks the default journal size mke2fs picks for a filesystem of numblocks blocks
+func journalBlocks(numblocks uint64) uint64 {
+	switch {
+	case numblocks < 2048:
+		return 0
+	case numblocks < 32768:
+		return 1024
+	case numblocks < 256*1024:
+		return 4096
+	case numblocks < 512*1024:
+		return 8192
+	case numblocks < 4096*1024:
+		return 16384
+	case numblocks < 8192*1024:
+		return 32768
+	case numblocks < 16384*1024:
+		return 65536
+	case numblocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+// manifestBlocks the number of data blocks and inodes needed for everything in the manifest, including
+// the root directory and lost+found
+func manifestBlocks(dirs map[string][]filesystem.ManifestEntry, blocksize int64, fflags featureFlags) (blocks, inodes int64) {
+	for dir, entries := range dirs {
+		// every directory has the . and .. entries
+		names := []string{".", ".."}
+		if dir == "/" {
+			names = append(names, "lost+found")
+		}
+		for _, e := range entries {
+			names = append(names, path.Base(e.Path))
+			inodes++
+			switch {
+			case e.Mode.IsDir():
+			case e.Mode&os.ModeSymlink != 0:
+				if e.Size > fastSymlinkMax {
+					blocks++
+				}
+			default:
+				fileBlocks := (e.Size + blocksize - 1) / blocksize
+				blocks += fileBlocks + fileMapBlocks(fileBlocks, blocksize, fflags)
+			}
+		}
+		blocks += directoryBlocks(names, blocksize, fflags)
+	}
+	// lost+found is created larger than it needs to be, and never smaller than 2 blocks
+	blocks += max(2, lostFoundSize/blocksize)
+	return blocks, inodes
+}
+
+// directoryBlocks the number of blocks for a linear directory holding the given names, plus the
+// index block if it is large enough for dir_index to turn it into a hash tree
+func directoryBlocks(names []string, blocksize int64, fflags featureFlags) int64 {
+	usable := blocksize
+	if fflags.metadataChecksums {
+		// each block ends with a fake entry holding the checksum
+		usable -= int64(minDirEntryLength)
+	}
+	blocks, used := int64(1), int64(0)
+	for _, name := range names {
+		// 8 bytes of header, then the name, padded to a multiple of 4 bytes
+		size := (8 + int64(len(name)) + 3) &^ 3
+		if used+size > usable {
+			blocks++
+			used = 0
+		}
+		used += size
+	}
+	if blocks > 1 && fflags.directoryIndices {
+		// entries are spread across hash buckets, so leave room for blocks that are not full
+		blocks += 1 + blocks/2
+	}
+	return blocks
+}
+
+// fileMapBlocks the number of blocks, beyond the data itself, to map a file of fileBlocks blocks
+func fileMapBlocks(fileBlocks, blocksize int64, fflags featureFlags) int64 {
+	if fflags.extents {
+		return extentTreeBlocks(fileBlocks, blocksize)
+	}
+	// 12 direct blocks in the inode, then single, double and triple indirect blocks, each of which
+	// needs its own block plus the blocks of pointers beneath it
+	perBlock := blocksize / 4
+	remaining := fileBlocks - 12
+	var blocks int64
+	for span := perBlock; remaining > 0 && span <= perBlock*perBlock*perBlock; span *= perBlock {
+		used := min(remaining, span)
+		for level := span / perBlock; level >= 1; level /= perBlock {
+			blocks += (used + level*perBlock - 1) / (level * perBlock)
+		}
+		remaining -= used
+	}
+	return blocks
+}
+
+// extentTreeBlocks the number of blocks for the extent tree of a file of fileBlocks contiguous blocks,
+// where the inode holds up to 4 extents itself
+func extentTreeBlocks(fileBlocks, blocksize int64) int64 {
+	extents := (fileBlocks + int64(maxBlocksPerExtent) - 1) / int64(maxBlocksPerExtent)
+	return extentIndexBlocks(extents, blocksize)
+}
@@ -0,0 +1,117 @@
+package ext4
+
+import (
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+func TestFileMapBlocks(t *testing.T) {
+	extents := defaultFeatureFlags
+	indirect := defaultFeatureFlags
+	indirect.extents = false
+	tests := []struct {
+		fileBlocks int64
+		blocksize  int64
+		fflags     featureFlags
+		expected   int64
+	}{
+		{0, 1024, extents, 0},
+		// up to 4 extents of 32768 blocks fit in the inode
+		{4 * 32768, 1024, extents, 0},
+		{4*32768 + 1, 1024, extents, 1},
+		{12, 1024, indirect, 0},
+		// single indirect
+		{13, 1024, indirect, 1},
+		{12 + 256, 1024, indirect, 1},
+		// double indirect: the block of pointers to blocks, and one block of pointers
+		{12 + 256 + 1, 1024, indirect, 3},
+		{12 + 256 + 256*256, 1024, indirect, 1 + 1 + 256},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d blocks extents %v", tt.fileBlocks, tt.fflags.extents), func(t *testing.T) {
+			actual := fileMapBlocks(tt.fileBlocks, tt.blocksize, tt.fflags)
+			if actual != tt.expected {
+				t.Errorf("mismatched map blocks, actual %d expected %d", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDirectoryBlocks(t *testing.T) {
+	// ., .. and lost+found
+	if actual := directoryBlocks([]string{".", "..", "lost+found"}, 1024, defaultFeatureFlags); actual != 1 {
+		t.Errorf("mismatched blocks for empty root, actual %d expected %d", actual, 1)
+	}
+	// 100 entries of 20 bytes each fill two 1K blocks
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("file%08d", i)
+	}
+	linear := defaultFeatureFlags
+	linear.directoryIndices = false
+	if actual := directoryBlocks(names, 1024, linear); actual != 2 {
+		t.Errorf("mismatched blocks for linear directory, actual %d expected %d", actual, 2)
+	}
+	// a hash tree index adds the dx_root, and room for leaves that are not full
+	if actual := directoryBlocks(names, 1024, defaultFeatureFlags); actual != 4 {
+		t.Errorf("mismatched blocks for indexed directory, actual %d expected %d", actual, 4)
+	}
+	// the checksum tail takes space from every block
+	fflags := linear
+	fflags.metadataChecksums = true
+	names = names[:51]
+	if actual := directoryBlocks(names, 1024, fflags); actual != 2 {
+		t.Errorf("mismatched blocks with checksums, actual %d expected %d", actual, 2)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	m := filesystem.Manifest{
+		{Path: "/etc", Mode: fs.ModeDir},
+		{Path: "/etc/hostname", Size: 10},
+		{Path: "/usr/bin/busybox", Size: 1024 * 1024},
+		{Path: "/bin", Size: 7, Mode: fs.ModeSymlink},
+		{Path: "/var/lib/image.bin", Size: 200 * 1024 * 1024},
+	}
+	var dataSize int64
+	for _, e := range m {
+		dataSize += e.Size
+	}
+	tests := []struct {
+		name string
+		p    *Params
+	}{
+		{"defaults", nil},
+		{"4K blocks", &Params{SectorsPerBlock: 8}},
+		{"no journal", &Params{Features: []FeatureOpt{WithFeatureHasJournal(false)}}},
+		{"resize inode", &Params{Features: []FeatureOpt{WithFeatureReservedGDTBlocksForExpansion(true)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, err := EstimateSize(m, tt.p)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// at least the data and the reserved blocks, but not absurdly more
+			if size < dataSize*105/100 || size > dataSize*120/100 {
+				t.Errorf("estimate %d out of range for %d bytes of data", size, dataSize)
+			}
+			blocksize := int64(1024)
+			if tt.p != nil && tt.p.SectorsPerBlock != 0 {
+				blocksize = int64(tt.p.SectorsPerBlock) * int64(SectorSize512)
+			}
+			if size%blocksize != 0 {
+				t.Errorf("estimate %d is not a multiple of the block size %d", size, blocksize)
+			}
+		})
+	}
+
+	t.Run("too few inodes", func(t *testing.T) {
+		if _, err := EstimateSize(m, &Params{InodeCount: 12}); err == nil {
+			t.Errorf("did not return an error with too few inodes")
+		}
+	})
+}
@@ -9,7 +9,7 @@ import (
 	"math"
 	"os"
 	"path"
-	"sort"
+	"slices"
 	"strings"
 	"time"
 
@@ -68,8 +68,17 @@ const (
 	rootInode       uint32 = 2
 	userQuotaInode  uint32 = 3
 	groupQuotaInode uint32 = 4
+	resizeInode     uint32 = 7
 	journalInode    uint32 = 8
 	lostFoundInode         = 11 // traditional
+	lostFoundName          = "lost+found"
+	lostFoundMode          = 0o700
+	defaultRootMode        = 0o755
+
+	// maxHardLinks the most links an inode other than a directory can have, as for Linux
+	maxHardLinks = 65000
+	// maxSymlinks the most symlinks followed to get to a file, as for Linux
+	maxSymlinks = 40
 )
 
 type Params struct {
@@ -83,11 +92,21 @@ type Params struct {
 	ClusterSize           int64
 	ReservedBlocksPercent uint8
 	VolumeName            string
-	// JournalDevice external journal device, only checked if WithFeatureSeparateJournalDevice(true) is set
-	JournalDevice      string
+	// JournalDevice path to the external journal device, used only to record its device number in the superblock,
+	// which is how Linux finds it, if ExternalJournal is set
+	JournalDevice string
+	// ExternalJournal the journal device, created with CreateJournalDevice, to hold the journal of the filesystem
+	// instead of an internal journal. Its block size is used for the filesystem. Setting it is the same as
+	// WithFeatureSeparateJournalDevice(true), which requires it.
+	ExternalJournal    *JournalDevice
 	LogFlexBlockGroups int
 	Features           []FeatureOpt
 	DefaultMountOpts   []MountOpt
+	// RootUID and RootGID the owner of the root directory, like the root_owner extended option of mke2fs
+	RootUID uint32
+	RootGID uint32
+	// RootMode the permissions of the root directory. Only the permission bits are used. If 0, it is 0755.
+	RootMode os.FileMode
 }
 
 // FileSystem implememnts the FileSystem interface
@@ -99,8 +118,32 @@ type FileSystem struct {
 	size             int64
 	start            int64
 	backend          backend.Storage
+	// journalDevice the external journal device, if the filesystem has one and it was given
+	journalDevice *JournalDevice
+	// readDirOrder the order ReadDir returns entries in
+	readDirOrder ReadDirOrder
+	// extentRecovery whether OpenFile salvages files with a corrupt extent tree
+	extentRecovery bool
+	// xattrBlocks the blocks of extended attributes read or written, for sharing them
+	xattrBlocks xattrBlockCache
 }
 
+// ReadDirOrder the order in which ReadDir returns the entries of a directory
+type ReadDirOrder int
+
+const (
+	// ReadDirOrderDefault the order that reading the directory in Linux gives: the order of the entries on disk,
+	// or for a directory with a hash tree index, the order of the hashes of their names, which depends on the
+	// hash seed of the filesystem. This is the default.
+	ReadDirOrderDefault ReadDirOrder = iota
+	// ReadDirOrderDisk the order of the entries on disk, block by block of the directory, even where it has a hash
+	// tree index, as a forensic tool would list them
+	ReadDirOrderDisk
+	// ReadDirOrderName sorted by name, byte by byte, after "." and "..", so that the same directory is listed
+	// the same way in any image
+	ReadDirOrderName
+)
+
 // Equal compare if two filesystems are equal
 func (fs *FileSystem) Equal(a *FileSystem) bool {
 	localMatch := fs.backend == a.backend
@@ -170,6 +213,10 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 	// if they did not, then we are free to calculate it
 	var userProvidedBlocksize bool
 	switch {
+	case sectorsPerBlock == 0 && p.ExternalJournal != nil:
+		// the filesystem must have the same block size as its journal
+		sectorsPerBlock = uint8(p.ExternalJournal.superblock.blockSize / sectorsize32)
+		userProvidedBlocksize = true
 	case sectorsPerBlock == 0:
 		sectorsPerBlock = 2
 		userProvidedBlocksize = false
@@ -203,11 +250,13 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		return nil, fmt.Errorf("invalid number of blocks per group %d, must be divisible by 8", blocksPerGroup)
 	}
 
-	// how many block groups do we have?
-	blockGroups := numblocks / int64(blocksPerGroup)
+	var firstDataBlock uint32
+	if blocksize == 1024 {
+		firstDataBlock = 1
+	}
 
-	// track how many free blocks we have
-	freeBlocks := numblocks
+	// how many block groups do we have? With 1K blocks, block 0 is not part of any of them.
+	blockGroups := (numblocks - int64(firstDataBlock) + int64(blocksPerGroup) - 1) / int64(blocksPerGroup)
 
 	clusterSize := p.ClusterSize
 
@@ -236,36 +285,43 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		return nil, fmt.Errorf("requested %d inodes, greater than max %d", inodeCount, max32Num)
 	}
 
-	inodesPerGroup := int64(inodeCount) / blockGroups
-
-	// track how many free inodes we have
-	freeInodes := inodeCount
-
-	// which blocks have superblock and GDT?
-	var (
-		backupSuperblocks            []int64
-		backupSuperblockGroupsSparse [2]uint32
-	)
-	//  0 - primary
-	//  ?? - backups
-	switch p.SparseSuperVersion {
-	case 2:
-		// backups in first and last block group
-		backupSuperblockGroupsSparse = [2]uint32{0, uint32(blockGroups) - 1}
-		backupSuperblocks = []int64{0, 1, blockGroups - 1}
-	default:
-		backupSuperblockGroups := calculateBackupSuperblockGroups(blockGroups)
-		backupSuperblocks = []int64{0}
-		for _, bg := range backupSuperblockGroups {
-			backupSuperblocks = append(backupSuperblocks, bg*int64(blocksPerGroup))
+	fflags := defaultFeatureFlags
+	for _, flagopt := range p.Features {
+		flagopt(&fflags)
+	}
+	// are checksums enabled?
+	if p.Checksum {
+		fflags.metadataChecksums = true
+	}
+	if p.SparseSuperVersion == 2 {
+		fflags.sparseSuperBlockV2 = true
+	}
+	if fflags.metaBlockGroups {
+		return nil, fmt.Errorf("meta block groups not yet supported")
+	}
+	// on a filesystem, the journal_dev feature would make it a journal device, so it only means that
+	// the journal is on the external one
+	if fflags.separateJournalDevice && p.ExternalJournal == nil {
+		return nil, fmt.Errorf("a separate journal device requires Params.ExternalJournal")
+	}
+	fflags.separateJournalDevice = false
+	if p.ExternalJournal != nil {
+		if p.ExternalJournal.superblock.blockSize != blocksize {
+			return nil, fmt.Errorf("journal device block size %d does not match filesystem block size %d", p.ExternalJournal.superblock.blockSize, blocksize)
 		}
+		if len(p.ExternalJournal.users) > 0 {
+			return nil, fmt.Errorf("journal device %s already is used by filesystem %s", p.ExternalJournal.UUID(), p.ExternalJournal.users[0])
+		}
+		fflags.hasJournal = true
+	}
+	if fflags.reservedGDTBlocksForExpansion && uint64(numblocks) > max32Num {
+		return nil, fmt.Errorf("reserved GDT blocks for expansion need block numbers of at most 32 bits, but the filesystem has %d blocks", numblocks)
 	}
 
-	freeBlocks -= int64(len(backupSuperblocks))
-
-	var firstDataBlock uint32
-	if blocksize == 1024 {
-		firstDataBlock = 1
+	// group descriptor size could be 32 or 64, depending on option
+	gdSize := groupDescriptorSize
+	if fflags.fs64Bit {
+		gdSize = groupDescriptorSize64Bit
 	}
 
 	/*
@@ -284,64 +340,114 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 				- number of blocks in inode table
 				- number of data blocks
 
-		config info:
-
-		[defaults]
-			base_features = sparse_super,large_file,filetype,resize_inode,dir_index,ext_attr
-			default_mntopts = acl,user_xattr
-			enable_periodic_fsck = 0
-			blocksize = 4096
-			inode_size = 256
-			inode_ratio = 16384
-
-		[fs_types]
-			ext3 = {
-				features = has_journal
-			}
-			ext4 = {
-				features = has_journal,extent,huge_file,flex_bg,uninit_bg,64bit,dir_nlink,extra_isize
-				inode_size = 256
-			}
-			ext4dev = {
-				features = has_journal,extent,huge_file,flex_bg,uninit_bg,inline_data,64bit,dir_nlink,extra_isize
-				inode_size = 256
-				options = test_fs=1
-			}
-			small = {
-				blocksize = 1024
-				inode_size = 128
-				inode_ratio = 4096
-			}
-			floppy = {
-				blocksize = 1024
-				inode_size = 128
-				inode_ratio = 8192
-			}
-			big = {
-				inode_ratio = 32768
-			}
-			huge = {
-				inode_ratio = 65536
-			}
-			news = {
-				inode_ratio = 4096
-			}
-			largefile = {
-				inode_ratio = 1048576
-				blocksize = -1
-			}
-			largefile4 = {
-				inode_ratio = 4194304
-				blocksize = -1
-			}
-			hurd = {
-			     blocksize = 4096
-			     inode_size = 128
-			}
+		every block group is laid out as:
+		- superblock and GDT, if the group has a copy of them
+		- block bitmap, one block
+		- inode bitmap, one block
+		- inode table
+		- data blocks
 	*/
+	var (
+		backupSuperblockGroupsSparse [2]uint32
+		inodesPerBlock               = blocksize / uint32(DefaultInodeSize)
+		inodesPerGroup               uint32
+		inodeTableBlocks             uint32
+		gdtBlocks                    uint32
+		reservedGDTBlocks            uint32
+	)
+	layout := func() {
+		// sparse_super2 keeps backups in the second and last block groups only, if there are any
+		backupSuperblockGroupsSparse = [2]uint32{}
+		if blockGroups > 1 {
+			backupSuperblockGroupsSparse[0] = 1
+		}
+		if blockGroups > 2 {
+			backupSuperblockGroupsSparse[1] = uint32(blockGroups) - 1
+		}
+		// inodes per group must fill whole bytes of the inode bitmap and whole blocks of the inode table
+		align := max(8, inodesPerBlock)
+		perGroup := (int64(inodeCount) + blockGroups - 1) / blockGroups
+		perGroup = (perGroup + int64(align) - 1) / int64(align) * int64(align)
+		perGroup = max(perGroup, int64(align)*((int64(firstNonReservedInode)+int64(align)-1)/int64(align)))
+		perGroup = min(perGroup, int64(blocksize)*8)
+		inodesPerGroup = uint32(perGroup)
+		inodeTableBlocks = inodesPerGroup / inodesPerBlock
+		gdtBlocks = uint32((blockGroups*int64(gdSize) + int64(blocksize) - 1) / int64(blocksize))
+		if fflags.reservedGDTBlocksForExpansion {
+			reservedGDTBlocks = uint32(reservedGDTBlockCount(uint64(numblocks), uint64(gdtBlocks), firstDataBlock, blocksize, blocksPerGroup, uint64(gdSize)))
+		}
+	}
+	// overhead how many blocks at the start of the block group are used by the filesystem itself
+	overhead := func(bg int64) int64 {
+		blocks := int64(2 + inodeTableBlocks)
+		if groupHasSuperblock(bg, fflags, backupSuperblockGroupsSparse) {
+			blocks += 1 + int64(gdtBlocks) + int64(reservedGDTBlocks)
+		}
+		return blocks
+	}
+	layout()
+	// a last group too small to hold more than its own metadata is left off, as mke2fs does
+	if last := blockGroups - 1; last > 0 {
+		lastBlocks := numblocks - int64(firstDataBlock) - last*int64(blocksPerGroup)
+		if lastBlocks < overhead(last)+50 {
+			blockGroups--
+			numblocks = int64(firstDataBlock) + blockGroups*int64(blocksPerGroup)
+			layout()
+		}
+	}
+	if numblocks-int64(firstDataBlock) <= overhead(0) {
+		return nil, fmt.Errorf("requested size %d is too small for an ext4 filesystem with the given parameters", size)
+	}
+	if uint64(inodesPerGroup)*uint64(blockGroups) > max32Num {
+		return nil, fmt.Errorf("requested %d inodes, greater than max %d", uint64(inodesPerGroup)*uint64(blockGroups), max32Num)
+	}
+	inodeCount = inodesPerGroup * uint32(blockGroups)
+
+	// the journal, if any, is created inside the filesystem, unless it is too small for one
+	var journalSize uint64
+	if fflags.hasJournal && p.ExternalJournal == nil {
+		journalSize = journalBlocks(uint64(numblocks))
+		if journalSize == 0 {
+			fflags.hasJournal = false
+		}
+	}
 
-	// allocate root directory, single inode
-	freeInodes--
+	// lay out each block group
+	gds := make([]groupDescriptor, blockGroups)
+	csumGroups := fflags.gdtChecksum || fflags.metadataChecksums
+	var freeBlocks uint64
+	for i := range gds {
+		bg := int64(i)
+		groupStart := uint64(firstDataBlock) + uint64(bg)*uint64(blocksPerGroup)
+		groupBlocks := min(uint64(blocksPerGroup), uint64(numblocks)-groupStart)
+		metadataStart := groupStart + uint64(overhead(bg)) - uint64(2+inodeTableBlocks)
+		gds[i] = groupDescriptor{
+			size:                gdSize,
+			number:              uint32(bg),
+			blockBitmapLocation: metadataStart,
+			inodeBitmapLocation: metadataStart + 1,
+			inodeTableLocation:  metadataStart + 2,
+			freeBlocks:          uint32(groupBlocks - uint64(overhead(bg))),
+			freeInodes:          inodesPerGroup,
+		}
+		// how much of the inode table is unused only is tracked along with group descriptor checksums, as are
+		// bitmaps that are left for the kernel to fill in. Like mke2fs, only the last group always has its
+		// block bitmap, and the first has its inode bitmap for the reserved inodes.
+		if csumGroups {
+			gds[i].unusedInodes = inodesPerGroup
+			gds[i].flags.inodeTableZeroed = true
+			gds[i].flags.inodesUninitialized = i > 0
+			gds[i].flags.blockBitmapUninitialized = i < len(gds)-1
+		}
+		freeBlocks += uint64(gds[i].freeBlocks)
+	}
+	// the reserved inodes all are in the first group
+	reservedInodes := firstNonReservedInode - 1
+	gds[0].freeInodes -= reservedInodes
+	if csumGroups {
+		gds[0].unusedInodes -= reservedInodes
+	}
+	freeInodes := inodeCount - reservedInodes
 
 	// how many reserved blocks?
 	reservedBlocksPercent := p.ReservedBlocksPercent
@@ -349,28 +455,14 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		reservedBlocksPercent = DefaultReservedBlocksPercent
 	}
 
-	// are checksums enabled?
-	gdtChecksumType := gdtChecksumNone
-	if p.Checksum {
-		gdtChecksumType = gdtChecksumMetadata
-	}
-
 	// we do not yet support bigalloc
 	var clustersPerGroup = blocksPerGroup
 
-	// inodesPerGroup: once we know how many inodes per group, and how many groups
-	//   we will have the total inode count
-
 	volumeName := p.VolumeName
 	if volumeName == "" {
 		volumeName = DefaultVolumeName
 	}
 
-	fflags := defaultFeatureFlags
-	for _, flagopt := range p.Features {
-		flagopt(&fflags)
-	}
-
 	mflags := defaultMiscFlags
 
 	// generate hash seed
@@ -384,44 +476,20 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		binary.LittleEndian.Uint32(hashSeedBytes[12:16]),
 	)
 
-	// create a UUID for the journal
-	journalSuperblockUUID, _ := uuid.NewRandom()
-
-	// group descriptor size could be 32 or 64, depending on option
-	var gdSize uint16
-	if fflags.fs64Bit {
-		gdSize = groupDescriptorSize64Bit
-	}
-
-	var firstMetaBG uint32
-	if fflags.metaBlockGroups {
-		return nil, fmt.Errorf("meta block groups not yet supported")
-	}
-
-	// calculate the maximum number of block groups
-	// maxBlockGroups = (maxFSSize) / (blocksPerGroup * blocksize)
 	var (
-		maxBlockGroups uint64
+		journalDeviceNumber   uint32
+		journalSuperblockUUID *uuid.UUID
+		err                   error
 	)
-	if fflags.fs64Bit {
-		maxBlockGroups = maxFilesystemSize64Bit / (uint64(blocksPerGroup) * uint64(blocksize))
-	} else {
-		maxBlockGroups = maxFilesystemSize32Bit / (uint64(blocksPerGroup) * uint64(blocksize))
-	}
-	reservedGDTBlocks := maxBlockGroups * 32 / maxBlockGroups
-	if reservedGDTBlocks > math.MaxUint16 {
-		return nil, fmt.Errorf("too many reserved blocks calculated for group descriptor table")
-	}
-
-	var (
-		journalDeviceNumber uint32
-		err                 error
-	)
-	if fflags.separateJournalDevice && p.JournalDevice != "" {
-		journalDeviceNumber, err = journalDevice(p.JournalDevice)
-		if err != nil {
-			return nil, fmt.Errorf("unable to get journal device: %w", err)
+	if p.ExternalJournal != nil {
+		if p.JournalDevice != "" {
+			journalDeviceNumber, err = journalDevice(p.JournalDevice)
+			if err != nil {
+				return nil, fmt.Errorf("unable to get journal device: %w", err)
+			}
 		}
+		// an internal journal has no UUID
+		journalSuperblockUUID = p.ExternalJournal.superblock.uuid
 	}
 
 	// get default mount options
@@ -438,8 +506,13 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 	// for now, we just make it 1024 = 1 KB
 	initialKB := 1024
 
-	// only set a project quota inode if the feature was enabled
-	var projectQuotaInode uint32
+	// only set quota inodes if the features were enabled
+	var (
+		userQuota, groupQuota, projectQuotaInode uint32
+	)
+	if fflags.quota {
+		userQuota, groupQuota = userQuotaInode, groupQuotaInode
+	}
 	if fflags.projectQuotas {
 		projectQuotaInode = lostFoundInode + 1
 		freeInodes--
@@ -457,17 +530,18 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 	// create the superblock - MUST ADD IN OPTIONS
 	now, epoch := time.Now(), time.Unix(0, 0)
 	sb := superblock{
-		inodeCount:                   inodeCount,
-		blockCount:                   uint64(numblocks),
-		reservedBlocks:               uint64(reservedBlocksPercent) / 100 * uint64(numblocks),
-		freeBlocks:                   uint64(freeBlocks),
-		freeInodes:                   freeInodes,
-		firstDataBlock:               firstDataBlock,
-		blockSize:                    blocksize,
-		clusterSize:                  uint64(clusterSize),
+		inodeCount:     inodeCount,
+		blockCount:     uint64(numblocks),
+		reservedBlocks: uint64(numblocks) * uint64(reservedBlocksPercent) / 100,
+		freeBlocks:     freeBlocks,
+		freeInodes:     freeInodes,
+		firstDataBlock: firstDataBlock,
+		blockSize:      blocksize,
+		// stored as log2 of the size in KB, like the block size, and without bigalloc clusters are blocks
+		clusterSize:                  uint64(max(clusterSize, int64(blocksize)) / 1024),
 		blocksPerGroup:               blocksPerGroup,
 		clustersPerGroup:             clustersPerGroup,
-		inodesPerGroup:               uint32(inodesPerGroup),
+		inodesPerGroup:               inodesPerGroup,
 		mountTime:                    now,
 		writeTime:                    now,
 		mountCount:                   0,
@@ -492,20 +566,19 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		preallocationBlocks:          0, // not used in Linux e2fsprogs
 		preallocationDirectoryBlocks: 0, // not used in Linux e2fsprogs
 		reservedGDTBlocks:            uint16(reservedGDTBlocks),
-		journalSuperblockUUID:        &journalSuperblockUUID,
-		journalInode:                 journalInode,
+		journalSuperblockUUID:        journalSuperblockUUID,
 		journalDeviceNumber:          journalDeviceNumber,
 		orphanedInodesStart:          0,
 		hashTreeSeed:                 htreeSeed,
 		hashVersion:                  hashHalfMD4,
 		groupDescriptorSize:          gdSize,
 		defaultMountOptions:          *mountOptions,
-		firstMetablockGroup:          firstMetaBG,
+		firstMetablockGroup:          0,
 		mkfsTime:                     now,
 		journalBackup:                nil,
 		// 64-bit mode features
 		inodeMinBytes:                minInodeExtraSize,
-		inodeReserveBytes:            wantInodeExtraSize,
+		inodeReserveBytes:            minInodeExtraSize,
 		miscFlags:                    mflags,
 		raidStride:                   0,
 		multiMountPreventionInterval: 0,
@@ -526,77 +599,403 @@ func Create(b backend.Storage, size, start, sectorsize int64, p *Params) (*FileS
 		errorLastFunction:            "",
 		mountOptions:                 "", // no mount options until it is mounted
 		backupSuperblockBlockGroups:  backupSuperblockGroupsSparse,
-		lostFoundInode:               lostFoundInode,
 		overheadBlocks:               0,
-		checksumSeed:                 crc.CRC32c(0, fsuuid[:]), // according to docs, this should be crc32c(~0, $orig_fs_uuid)
+		checksumSeed:                 crc.CRC32c(0xffffffff, fsuuid[:]), // according to docs, this should be crc32c(~0, $orig_fs_uuid)
 		snapshotInodeNumber:          0,
 		snapshotID:                   0,
 		snapshotReservedBlocks:       0,
 		snapshotStartInode:           0,
-		userQuotaInode:               userQuotaInode,
-		groupQuotaInode:              groupQuotaInode,
+		userQuotaInode:               userQuota,
+		groupQuotaInode:              groupQuota,
 		projectQuotaInode:            projectQuotaInode,
 		logGroupsPerFlex:             uint64(logGroupsPerFlex),
 	}
-	gdt := groupDescriptors{}
+	if fflags.hasJournal && p.ExternalJournal == nil {
+		sb.journalInode = journalInode
+	}
 
-	superblockBytes, err := sb.toBytes()
+	fs := &FileSystem{
+		bootSector:       []byte{},
+		superblock:       &sb,
+		groupDescriptors: &groupDescriptors{descriptors: gds},
+		blockGroups:      blockGroups,
+		size:             size,
+		start:            start,
+		backend:          b,
+	}
+
+	writable, err := b.Writable()
 	if err != nil {
-		return nil, fmt.Errorf("error converting Superblock to bytes: %v", err)
+		return nil, err
+	}
+	// write the bitmaps and the empty inode table of each block group. Bits beyond the end of the group are
+	// set in both bitmaps, as they never can be used.
+	zeroes := make([]byte, int64(inodeTableBlocks)*int64(blocksize))
+	for i := range gds {
+		gd := &gds[i]
+		groupStart := uint64(firstDataBlock) + uint64(i)*uint64(blocksPerGroup)
+		groupBlocks := min(uint64(blocksPerGroup), uint64(numblocks)-groupStart)
+		blockBitmap := util.NewBitmap(int(blocksize))
+		inodeBitmap := util.NewBitmap(int(blocksize))
+		for bit := 0; bit < int(blocksize)*8; bit++ {
+			if uint64(bit) < gd.inodeTableLocation+uint64(inodeTableBlocks)-groupStart || uint64(bit) >= groupBlocks {
+				_ = blockBitmap.Set(bit)
+			}
+			if (i == 0 && bit < int(reservedInodes)) || bit >= int(inodesPerGroup) {
+				_ = inodeBitmap.Set(bit)
+			}
+		}
+		if fflags.metadataChecksums {
+			gd.blockBitmapChecksum = gd.bitmapChecksum(crc.CRC32c(sb.checksumSeed, blockBitmap.ToBytes()[:clustersPerGroup/8]))
+			gd.inodeBitmapChecksum = gd.bitmapChecksum(crc.CRC32c(sb.checksumSeed, inodeBitmap.ToBytes()[:inodesPerGroup/8]))
+		}
+		for _, w := range []struct {
+			name     string
+			location uint64
+			b        []byte
+		}{
+			{"block bitmap", gd.blockBitmapLocation, blockBitmap.ToBytes()},
+			{"inode bitmap", gd.inodeBitmapLocation, inodeBitmap.ToBytes()},
+			{"inode table", gd.inodeTableLocation, zeroes},
+		} {
+			if _, err := writable.WriteAt(w.b, start+int64(w.location)*int64(blocksize)); err != nil {
+				return nil, fmt.Errorf("error writing %s for block group %d to disk: %v", w.name, i, err)
+			}
+		}
+	}
+	// clear the last block, which is free, so that a sparse file holding the filesystem is as large as it is
+	if _, err := writable.WriteAt(make([]byte, blocksize), start+(numblocks-1)*int64(blocksize)); err != nil {
+		return nil, fmt.Errorf("error clearing last block: %v", err)
 	}
 
-	g := gdt.toBytes(gdtChecksumType, sb.checksumSeed)
-	// how big should the GDT be?
-	gdSize = groupDescriptorSize
-	if sb.features.fs64Bit {
-		gdSize = groupDescriptorSize64Bit
+	rootMode := p.RootMode.Perm()
+	if rootMode == 0 {
+		rootMode = defaultRootMode
+	}
+	if err := fs.createRootDirectory(now, p.RootUID, p.RootGID, rootMode); err != nil {
+		return nil, fmt.Errorf("could not create root directory: %w", err)
+	}
+	if err := fs.createLostFound(); err != nil {
+		return nil, fmt.Errorf("could not create lost+found directory: %w", err)
+	}
+	if fflags.reservedGDTBlocksForExpansion {
+		if err := fs.createResizeInode(now); err != nil {
+			return nil, fmt.Errorf("could not create resize inode: %w", err)
+		}
+	}
+	if journalSize > 0 {
+		if err := fs.createJournal(journalSize, now); err != nil {
+			return nil, fmt.Errorf("could not create journal: %w", err)
+		}
 	}
-	gdtSize := int64(gdSize) * numblocks
+
 	// write the superblock and GDT to the various locations on disk
-	for _, bg := range backupSuperblocks {
-		block := bg * int64(blocksPerGroup)
-		blockStart := block * int64(blocksize)
-		// allow that the first one requires an offset
-		incr := int64(0)
-		if block == 0 {
-			incr = int64(SectorSize512) * 2
+	if err := fs.writeSuperblockCopies(); err != nil {
+		return nil, err
+	}
+	if p.ExternalJournal != nil {
+		if err := p.ExternalJournal.addUser(*fsuuid); err != nil {
+			return nil, fmt.Errorf("could not add filesystem to journal device: %w", err)
 		}
+		fs.journalDevice = p.ExternalJournal
+	}
+	return fs, nil
+}
 
-		writable, err := b.Writable()
-		if err != nil {
-			return nil, err
+// createRootDirectory create the root directory of a new filesystem, holding only its . and .. entries
+func (fs *FileSystem) createRootDirectory(now time.Time, uid, gid uint32, mode os.FileMode) error {
+	sb := fs.superblock
+	newExtents, err := fs.allocateExtents(uint64(sb.blockSize), nil)
+	if err != nil {
+		return fmt.Errorf("could not allocate disk space: %w", err)
+	}
+	extentTree, _, err := fs.writeExtentTree(*newExtents, nil, rootInode, 0)
+	if err != nil {
+		return fmt.Errorf("could not convert extents into tree: %w", err)
+	}
+	root := Directory{
+		directoryEntry: directoryEntry{inode: rootInode, fileType: dirFileTypeDirectory},
+		root:           true,
+		entries: []*directoryEntry{
+			{inode: rootInode, filename: ".", fileType: dirFileTypeDirectory},
+			{inode: rootInode, filename: "..", fileType: dirFileTypeDirectory},
+		},
+	}
+	if !sb.features.directoryEntriesRecordFileType {
+		root = *root.withoutFileTypes()
+	}
+	dirBytes := root.toBytes(sb.blockSize, directoryChecksumAppender(sb.checksumSeed, rootInode, 0))
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	if _, err := writableFile.WriteAt(dirBytes, fs.start+int64((*newExtents)[0].startingBlock)*int64(sb.blockSize)); err != nil {
+		return fmt.Errorf("could not write directory entries: %w", err)
+	}
+	in := inode{
+		number:           rootInode,
+		permissionsOwner: parseOwnerPermissions(uint16(mode)),
+		permissionsGroup: parseGroupPermissions(uint16(mode)),
+		permissionsOther: parseOtherPermissions(uint16(mode)),
+		owner:            uid,
+		group:            gid,
+		fileType:         fileTypeDirectory,
+		size:             uint64(len(dirBytes)),
+		hardLinks:        2,
+		flags:            &inodeFlags{usesExtents: true},
+		inodeSize:        minInodeSize + minInodeExtraSize,
+		accessTime:       now,
+		changeTime:       now,
+		createTime:       now,
+		modifyTime:       now,
+		extents:          extentTree,
+	}
+	in.setBlockCount(newExtents.blockCount(), sb.blockSize)
+	if err := fs.writeInode(&in); err != nil {
+		return fmt.Errorf("could not write inode: %w", err)
+	}
+	gd, err := fs.groupDescriptors.get(0)
+	if err != nil {
+		return err
+	}
+	gd.usedDirectories++
+	return fs.writeGroupDescriptor(gd)
+}
+
+// createLostFound create the lost+found directory of a new filesystem, where e2fsck puts the files it recovers.
+// As with mke2fs, it is owned by root with mode 0700, and is made big enough up front for e2fsck to add
+// entries to it without allocating any blocks.
+func (fs *FileSystem) createLostFound() error {
+	root := &Directory{
+		directoryEntry: directoryEntry{inode: rootInode, fileType: dirFileTypeDirectory},
+		root:           true,
+	}
+	entries, err := fs.readDirectory(rootInode)
+	if err != nil {
+		return fmt.Errorf("could not read root directory: %w", err)
+	}
+	root.entries = entries
+	de, err := fs.mkSubdir(root, lostFoundName)
+	if err != nil {
+		return err
+	}
+	in, err := fs.readInode(de.inode)
+	if err != nil {
+		return fmt.Errorf("could not read inode %d: %w", de.inode, err)
+	}
+	in.owner, in.group = 0, 0
+	in.permissionsOwner = parseOwnerPermissions(uint16(lostFoundMode))
+	in.permissionsGroup = parseGroupPermissions(uint16(lostFoundMode))
+	in.permissionsOther = parseOtherPermissions(uint16(lostFoundMode))
+	// writeDirectory fills the directory with empty blocks up to its size
+	in.size = uint64(max(lostFoundSize, 2*int64(fs.superblock.blockSize)))
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d: %w", de.inode, err)
+	}
+	return fs.writeDirectory(&Directory{
+		directoryEntry: *de,
+		entries: []*directoryEntry{
+			{inode: de.inode, filename: ".", fileType: dirFileTypeDirectory},
+			{inode: rootInode, filename: "..", fileType: dirFileTypeDirectory},
+		},
+	})
+}
+
+// createResizeInode create the resize inode of a new filesystem, which owns the reserved GDT blocks after every
+// copy of the GDT, so that the filesystem can grow online. As with mke2fs, its double indirect block points at
+// the reserved blocks after the primary GDT, and each of those points at its copies in the backup groups.
+func (fs *FileSystem) createResizeInode(now time.Time) error {
+	sb := fs.superblock
+	newExtents, err := fs.allocateExtents(uint64(sb.blockSize), nil)
+	if err != nil {
+		return fmt.Errorf("could not allocate disk space: %w", err)
+	}
+	doubleIndirect := (*newExtents)[0].startingBlock
+	pointersPerBlock := uint64(sb.blockSize / 4)
+	gdtBlocks := sb.gdtBlockCount()
+	var backups []uint64
+	for bg := int64(1); bg < fs.blockGroups; bg++ {
+		if groupHasSuperblock(bg, sb.features, sb.backupSuperblockBlockGroups) {
+			backups = append(backups, uint64(bg))
+		}
+	}
+
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	dind := make([]byte, sb.blockSize)
+	for i := uint64(0); i < uint64(sb.reservedGDTBlocks); i++ {
+		block := uint64(sb.firstDataBlock) + 1 + gdtBlocks + i
+		offset := ((gdtBlocks + i) % pointersPerBlock) * 4
+		binary.LittleEndian.PutUint32(dind[offset:offset+4], uint32(block))
+		ind := make([]byte, sb.blockSize)
+		for j, bg := range backups {
+			binary.LittleEndian.PutUint32(ind[j*4:j*4+4], uint32(block+bg*uint64(sb.blocksPerGroup)))
+			// the copies are empty until the filesystem grows
+			if _, err := writableFile.WriteAt(make([]byte, sb.blockSize), fs.start+int64(block+bg*uint64(sb.blocksPerGroup))*int64(sb.blockSize)); err != nil {
+				return fmt.Errorf("could not clear reserved GDT block: %w", err)
+			}
+		}
+		if _, err := writableFile.WriteAt(ind, fs.start+int64(block)*int64(sb.blockSize)); err != nil {
+			return fmt.Errorf("could not write reserved GDT block: %w", err)
+		}
+	}
+	if _, err := writableFile.WriteAt(dind, fs.start+int64(doubleIndirect)*int64(sb.blockSize)); err != nil {
+		return fmt.Errorf("could not write double indirect block: %w", err)
+	}
+
+	in := inode{
+		number:           resizeInode,
+		permissionsOwner: parseOwnerPermissions(0o600),
+		permissionsGroup: parseGroupPermissions(0o600),
+		permissionsOther: parseOtherPermissions(0o600),
+		fileType:         fileTypeRegularFile,
+		// the size covers every block the double indirect block can address
+		size:       (pointersPerBlock*pointersPerBlock + pointersPerBlock + inodeDirectBlocks) * uint64(sb.blockSize),
+		hardLinks:  1,
+		flags:      &inodeFlags{},
+		inodeSize:  minInodeSize + minInodeExtraSize,
+		accessTime: now,
+		changeTime: now,
+		createTime: now,
+		modifyTime: now,
+	}
+	in.blockMap[inodeDoubleIndirectBlock] = uint32(doubleIndirect)
+	in.setBlockCount(1+uint64(sb.reservedGDTBlocks)*uint64(1+len(backups)), sb.blockSize)
+	return fs.writeInode(&in)
+}
+
+// createJournal create an empty internal journal of the given number of blocks in a new filesystem
+func (fs *FileSystem) createJournal(blocks uint64, now time.Time) error {
+	sb := fs.superblock
+	newExtents, err := fs.allocateExtents(blocks*uint64(sb.blockSize), nil)
+	if err != nil {
+		return fmt.Errorf("could not allocate disk space: %w", err)
+	}
+	extentTree, treeBlocks, err := fs.writeExtentTree(*newExtents, nil, journalInode, 0)
+	if err != nil {
+		return fmt.Errorf("could not convert extents into tree: %w", err)
+	}
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	// the journal starts out empty, so nothing in it ever is mistaken for a transaction
+	zeroes := make([]byte, 256*sb.blockSize)
+	for _, e := range *newExtents {
+		for done := uint64(0); done < uint64(e.count); {
+			count := min(uint64(e.count)-done, 256)
+			if _, err := writableFile.WriteAt(zeroes[:count*uint64(sb.blockSize)], fs.start+int64(e.startingBlock+done)*int64(sb.blockSize)); err != nil {
+				return fmt.Errorf("could not clear journal blocks: %w", err)
+			}
+			done += count
 		}
+	}
+	jsb := journalSuperblock{
+		blockType: journalBlockTypeSuperblockV2,
+		blockSize: sb.blockSize,
+		maxLen:    uint32(blocks),
+		first:     1,
+		sequence:  1,
+	}
+	if sb.features.fs64Bit {
+		jsb.incompatFeatures |= journalFeatureIncompat64Bit
+	}
+	if _, err := writableFile.WriteAt(jsb.toBytes(sb.uuid[:]), fs.start+int64((*newExtents)[0].startingBlock)*int64(sb.blockSize)); err != nil {
+		return fmt.Errorf("could not write journal superblock: %w", err)
+	}
+	in := inode{
+		number:           journalInode,
+		permissionsOwner: filePermissions{read: true, write: true},
+		fileType:         fileTypeRegularFile,
+		size:             blocks * uint64(sb.blockSize),
+		hardLinks:        1,
+		flags:            &inodeFlags{usesExtents: true},
+		inodeSize:        minInodeSize + minInodeExtraSize,
+		accessTime:       now,
+		changeTime:       now,
+		createTime:       now,
+		modifyTime:       now,
+		extents:          extentTree,
+	}
+	in.setBlockCount(newExtents.blockCount()+treeBlocks, sb.blockSize)
+	if err := fs.writeInode(&in); err != nil {
+		return fmt.Errorf("could not write inode: %w", err)
+	}
+	// the superblock keeps a copy of where to find the journal
+	backup := journalBackup{iSize: in.size}
+	treeBytes := extentTree.toBytes()
+	for i := range backup.iBlocks {
+		backup.iBlocks[i] = binary.LittleEndian.Uint32(treeBytes[4*i : 4*i+4])
+	}
+	sb.journalBackup = &backup
+	return nil
+}
 
-		// write the superblock
-		count, err := writable.WriteAt(superblockBytes, incr+blockStart+start)
+// writeSuperblockCopies write the superblock and the whole group descriptor table to each block group that holds
+// a copy of them, the primary included
+func (fs *FileSystem) writeSuperblockCopies() error {
+	writable, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	sb := *fs.superblock
+	if err := fs.groupDescriptors.loadAll(); err != nil {
+		return err
+	}
+	gdt := fs.groupDescriptors.toBytes(sb.gdtChecksumType(), sb.checksumSeed)
+	// pad out to whole blocks
+	if remainder := len(gdt) % int(sb.blockSize); remainder > 0 {
+		gdt = append(gdt, make([]byte, int(sb.blockSize)-remainder)...)
+	}
+	for bg := int64(0); bg < fs.blockGroups; bg++ {
+		if !groupHasSuperblock(bg, sb.features, sb.backupSuperblockBlockGroups) {
+			continue
+		}
+		groupStart := (int64(sb.firstDataBlock) + bg*int64(sb.blocksPerGroup)) * int64(sb.blockSize)
+		// the primary superblock is 1024 bytes in, whatever the block size
+		superblockStart := groupStart
+		if bg == 0 {
+			superblockStart = int64(BootSectorSize)
+		}
+		sb.blockGroup = uint16(bg)
+		superblockBytes, err := sb.toBytes()
 		if err != nil {
-			return nil, fmt.Errorf("error writing Superblock for block %d to disk: %v", block, err)
+			return fmt.Errorf("error converting Superblock to bytes: %v", err)
+		}
+		count, err := writable.WriteAt(superblockBytes, fs.start+superblockStart)
+		if err != nil {
+			return fmt.Errorf("error writing Superblock for block group %d to disk: %v", bg, err)
 		}
 		if count != int(SuperblockSize) {
-			return nil, fmt.Errorf("wrote %d bytes of Superblock for block %d to disk instead of expected %d", count, block, SuperblockSize)
+			return fmt.Errorf("wrote %d bytes of Superblock for block group %d to disk instead of expected %d", count, bg, SuperblockSize)
 		}
-
-		// write the GDT
-		count, err = writable.WriteAt(g, incr+blockStart+int64(SuperblockSize)+start)
+		// the GDT is in the blocks right after the superblock, except for any in meta block groups
+		gdtStart := (int64(sb.firstDataBlock) + bg*int64(sb.blocksPerGroup) + 1) * int64(sb.blockSize)
+		primary := gdt[:sb.primaryGDTBlocks()*uint64(sb.blockSize)]
+		count, err = writable.WriteAt(primary, fs.start+gdtStart)
 		if err != nil {
-			return nil, fmt.Errorf("error writing GDT for block %d to disk: %v", block, err)
+			return fmt.Errorf("error writing GDT for block group %d to disk: %v", bg, err)
 		}
-		if count != int(gdtSize) {
-			return nil, fmt.Errorf("wrote %d bytes of GDT for block %d to disk instead of expected %d", count, block, gdtSize)
+		if count != len(primary) {
+			return fmt.Errorf("wrote %d bytes of GDT for block group %d to disk instead of expected %d", count, bg, len(primary))
 		}
 	}
-
-	// create root directory
-	// there is nothing in there
-	return &FileSystem{
-		bootSector:       []byte{},
-		superblock:       &sb,
-		groupDescriptors: &gdt,
-		blockGroups:      blockGroups,
-		size:             size,
-		start:            start,
-		backend:          b,
-	}, nil
+	// with meta_bg, each meta block group keeps its block of the GDT in its first, second and last groups
+	for block := sb.primaryGDTBlocks(); block < sb.gdtBlockCount(); block++ {
+		b := gdt[block*uint64(sb.blockSize) : (block+1)*uint64(sb.blockSize)]
+		for _, bg := range sb.metaGroupGDTGroups(block) {
+			location := sb.groupStart(bg)
+			if groupHasSuperblock(int64(bg), sb.features, sb.backupSuperblockBlockGroups) {
+				location++
+			}
+			if _, err := writable.WriteAt(b, fs.start+int64(location)*int64(sb.blockSize)); err != nil {
+				return fmt.Errorf("error writing block %d of GDT to block group %d: %v", block, bg, err)
+			}
+		}
+	}
+	return nil
 }
 
 // Read reads a filesystem from a given disk.
@@ -652,30 +1051,20 @@ func Read(b backend.Storage, size, start, sectorsize int64) (*FileSystem, error)
 	if err != nil {
 		return nil, fmt.Errorf("could not interpret superblock data: %v", err)
 	}
-
-	// now read the GDT
-	// how big should the GDT be?
-	gdtSize := uint64(sb.groupDescriptorSize) * sb.blockGroupCount()
-
-	gdtBytes := make([]byte, gdtSize)
-	// where do we find the GDT?
-	// - if blocksize is 1024, then 1024 padding for BootSector is block 0, 1024 for superblock is block 1
-	//   and then the GDT starts at block 2
-	// - if blocksize is larger than 1024, then 1024 padding for BootSector followed by 1024 for superblock
-	//   is block 0, and then the GDT starts at block 1
-	gdtBlock := 1
-	if sb.blockSize == 1024 {
-		gdtBlock = 2
+	if sb.features.separateJournalDevice {
+		return nil, fmt.Errorf("superblock is of an external journal device, which can be read with ReadJournalDevice")
 	}
-	n, err = b.ReadAt(gdtBytes, start+int64(gdtBlock)*int64(sb.blockSize))
-	if err != nil {
-		return nil, fmt.Errorf("could not read Group Descriptor Table bytes from file: %v", err)
+	if err := sb.validateGeometry(); err != nil {
+		return nil, fmt.Errorf("invalid superblock: %w", err)
 	}
-	if uint64(n) < gdtSize {
-		return nil, fmt.Errorf("only could read %d Group Descriptor Table bytes from file instead of %d", n, gdtSize)
+
+	// now the GDT, which is only read as it is needed, since it is large for a huge filesystem
+	locate := func(block int) int64 {
+		return start + int64(sb.gdtBlockLocation(uint64(block)))*int64(sb.blockSize)
 	}
-	gdt, err := groupDescriptorsFromBytes(gdtBytes, sb.groupDescriptorSize, sb.checksumSeed, sb.gdtChecksumType())
-	if err != nil {
+	gdt := newLazyGroupDescriptors(b, locate, int(sb.blockGroupCount()), sb.blockSize, sb.descriptorSize(), sb.checksumSeed, sb.gdtChecksumType())
+	// the first block group holds the root directory, so is always needed
+	if _, err := gdt.get(0); err != nil {
 		return nil, fmt.Errorf("could not interpret Group Descriptor Table data: %v", err)
 	}
 
@@ -691,7 +1080,12 @@ func Read(b backend.Storage, size, start, sectorsize int64) (*FileSystem, error)
 }
 
 // interface guard
-var _ filesystem.FileSystem = (*FileSystem)(nil)
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
 
 // Type returns the type code for the filesystem. Always returns filesystem.TypeExt4
 func (fs *FileSystem) Type() filesystem.Type {
@@ -708,42 +1102,216 @@ func (fs *FileSystem) Mkdir(p string) error {
 	return err
 }
 
-// creates a filesystem node (file, device special file, or named pipe) named pathname,
-// with attributes specified by mode and dev
+// Mknod creates a filesystem node (file, device special file, or named pipe) named pathname,
+// with attributes specified by mode and dev.
 //
-//nolint:revive // parameters will be used eventually
+// mode is the type and permissions as in mknod(2), e.g. unix.S_IFCHR|0o600; a type of 0 is a regular file.
+// dev is the device number of a character or block device, as a Linux dev_t, e.g. from unix.Mkdev,
+// and is ignored for the other types. The directory holding pathname must already exist.
 func (fs *FileSystem) Mknod(pathname string, mode uint32, dev int) error {
-	return filesystem.ErrNotImplemented
+	ft := fileType(mode & 0xf000)
+	switch ft {
+	case 0:
+		ft = fileTypeRegularFile
+	case fileTypeRegularFile, fileTypeFifo, fileTypeSocket:
+	case fileTypeCharacterDevice, fileTypeBlockDevice:
+		if dev < 0 || uint64(dev) > math.MaxUint32 {
+			return fmt.Errorf("cannot create %s: device number %d does not fit in 32 bits", pathname, dev)
+		}
+	default:
+		return fmt.Errorf("cannot create %s: unsupported file type %#o", pathname, mode&0xf000)
+	}
+	parentDir, entry, err := fs.getEntryAndParent(pathname)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return fmt.Errorf("cannot create %s: file exists", pathname)
+	}
+	entry, err = fs.mkDirEntry(parentDir, path.Base(pathname), ft, "")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", pathname, err)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		return fmt.Errorf("could not read inode %d for %s: %w", entry.inode, pathname, err)
+	}
+	in.permissionsOwner = parseOwnerPermissions(uint16(mode))
+	in.permissionsGroup = parseGroupPermissions(uint16(mode))
+	in.permissionsOther = parseOtherPermissions(uint16(mode))
+	in.setUID = uint16(mode)&fileModeSetUID != 0
+	in.setGID = uint16(mode)&fileModeSetGID != 0
+	in.sticky = uint16(mode)&fileModeSticky != 0
+	if ft == fileTypeCharacterDevice || ft == fileTypeBlockDevice {
+		in.device = uint32(dev)
+	}
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d for %s: %w", entry.inode, pathname, err)
+	}
+	return nil
 }
 
-// creates a new link (also known as a hard link) to an existing file.
-//
-//nolint:revive // parameters will be used eventually
+// Link creates newpath as a new link (also known as a hard link) to the existing file oldpath.
+// oldpath may not be a directory, and the directory holding newpath must already exist.
 func (fs *FileSystem) Link(oldpath, newpath string) error {
-	return filesystem.ErrNotImplemented
+	_, oldEntry, err := fs.getEntryAndParent(oldpath)
+	if err != nil {
+		return err
+	}
+	if oldEntry == nil {
+		return fmt.Errorf("cannot link %s: file does not exist", oldpath)
+	}
+	if oldEntry.fileType == dirFileTypeDirectory {
+		return fmt.Errorf("cannot link %s: is a directory", oldpath)
+	}
+	parentDir, entry, err := fs.getEntryAndParent(newpath)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return fmt.Errorf("cannot link %s: file exists", newpath)
+	}
+	in, err := fs.readInode(oldEntry.inode)
+	if err != nil {
+		return fmt.Errorf("could not read inode %d for %s: %w", oldEntry.inode, oldpath, err)
+	}
+	if in.hardLinks >= maxHardLinks {
+		return fmt.Errorf("cannot link %s: too many links", oldpath)
+	}
+	parentDir.entries = append(parentDir.entries, &directoryEntry{
+		inode:    oldEntry.inode,
+		filename: path.Base(newpath),
+		fileType: oldEntry.fileType,
+	})
+	if err := fs.writeDirectory(parentDir); err != nil {
+		return fmt.Errorf("could not write directory for %s: %w", newpath, err)
+	}
+	return fs.changeLinks(oldEntry.inode, 1)
 }
 
-// creates a symbolic link named linkpath which contains the string target.
-//
-//nolint:revive // parameters will be used eventually
+// Symlink creates a symbolic link named newpath which contains the string oldpath.
+// The directory holding newpath must already exist.
 func (fs *FileSystem) Symlink(oldpath, newpath string) error {
-	return filesystem.ErrNotImplemented
+	parentDir, entry, err := fs.getEntryAndParent(newpath)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return fmt.Errorf("cannot create symlink %s: file exists", newpath)
+	}
+	if _, err := fs.mkSymlink(parentDir, path.Base(newpath), oldpath); err != nil {
+		return fmt.Errorf("failed to create symlink %s: %w", newpath, err)
+	}
+	return nil
 }
 
 // Chmod changes the mode of the named file to mode. If the file is a symbolic link,
 // it changes the mode of the link's target.
 //
-//nolint:revive // parameters will be used eventually
+// The permission bits and os.ModeSetuid, os.ModeSetgid and os.ModeSticky are used; the type of the file
+// cannot be changed, so the other bits are ignored.
 func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
-	return filesystem.ErrNotImplemented
+	in, err := fs.followSymlinks(name)
+	if err != nil {
+		return err
+	}
+	in.setFileMode(mode)
+	in.changeTime = time.Now()
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d for %s: %w", in.number, name, err)
+	}
+	return nil
 }
 
 // Chown changes the numeric uid and gid of the named file. If the file is a symbolic link,
 // it changes the uid and gid of the link's target. A uid or gid of -1 means to not change that value
-//
-//nolint:revive // parameters will be used eventually
 func (fs *FileSystem) Chown(name string, uid, gid int) error {
-	return filesystem.ErrNotImplemented
+	for _, id := range []int{uid, gid} {
+		if id < -1 || int64(id) > math.MaxUint32 {
+			return fmt.Errorf("invalid uid or gid %d, must be -1 or fit in 32 bits", id)
+		}
+	}
+	in, err := fs.followSymlinks(name)
+	if err != nil {
+		return err
+	}
+	if uid != -1 {
+		in.owner = uint32(uid)
+	}
+	if gid != -1 {
+		in.group = uint32(gid)
+	}
+	in.changeTime = time.Now()
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d for %s: %w", in.number, name, err)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file, as os.Chtimes does. If the file is
+// a symbolic link, it changes the times of the link's target. A zero time.Time leaves that time unchanged.
+func (fs *FileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	in, err := fs.followSymlinks(name)
+	if err != nil {
+		return err
+	}
+	if !atime.IsZero() {
+		in.accessTime = atime
+	}
+	if !mtime.IsZero() {
+		in.modifyTime = mtime
+	}
+	in.changeTime = time.Now()
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d for %s: %w", in.number, name, err)
+	}
+	return nil
+}
+
+// Readlink returns the target of the named symbolic link
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	_, entry, err := fs.getEntryAndParent(name)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", fmt.Errorf("file does not exist: %s", name)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		return "", fmt.Errorf("could not read inode %d for %s: %w", entry.inode, name, err)
+	}
+	if in.fileType != fileTypeSymbolicLink {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	return in.linkTarget, nil
+}
+
+// followSymlinks read the inode of the file at p, or of the target of p if it is a symlink,
+// following as many symlinks as Linux does
+func (fs *FileSystem) followSymlinks(p string) (*inode, error) {
+	for range maxSymlinks + 1 {
+		_, entry, err := fs.getEntryAndParent(p)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("file does not exist: %s", p)
+		}
+		in, err := fs.readInode(entry.inode)
+		if err != nil {
+			return nil, fmt.Errorf("could not read inode %d for %s: %w", entry.inode, p, err)
+		}
+		if in.fileType != fileTypeSymbolicLink {
+			return in, nil
+		}
+		target := in.linkTarget
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = path.Clean(target)
+	}
+	return nil, fmt.Errorf("too many levels of symbolic links at %s", p)
 }
 
 // ReadDir return the contents of a given directory in a given filesystem.
@@ -756,21 +1324,39 @@ func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading directory %s: %v", p, err)
 	}
+	entries := dir.entries
+	switch fs.readDirOrder {
+	case ReadDirOrderDisk:
+		entries, err = fs.readDirectoryOnDisk(dir.inode)
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory %s: %v", p, err)
+		}
+	case ReadDirOrderName:
+		entries = slices.Clone(entries)
+		slices.SortStableFunc(entries, func(a, b *directoryEntry) int {
+			aDot, bDot := a.filename == "." || a.filename == "..", b.filename == "." || b.filename == ".."
+			switch {
+			case aDot && !bDot:
+				return -1
+			case bDot && !aDot:
+				return 1
+			}
+			return strings.Compare(a.filename, b.filename)
+		})
+	}
 	// once we have made it here, looping is done. We have found the final entry
 	// we need to return all of the file info
-	count := len(dir.entries)
-	ret := make([]os.FileInfo, count)
-	for i, e := range dir.entries {
+	ret := make([]os.FileInfo, 0, len(entries))
+	for i, e := range entries {
+		// unused entries, e.g. the empty blocks of lost+found, have no inode
+		if e.inode == 0 {
+			continue
+		}
 		in, err := fs.readInode(e.inode)
 		if err != nil {
 			return nil, fmt.Errorf("could not read inode %d at position %d in directory: %v", e.inode, i, err)
 		}
-		ret[i] = &FileInfo{
-			modTime: in.modifyTime,
-			name:    e.filename,
-			size:    int64(in.size),
-			isDir:   e.fileType == dirFileTypeDirectory,
-		}
+		ret = append(ret, fs.newFileInfo(in, e.filename, e.fileType == dirFileTypeDirectory))
 	}
 
 	return ret, nil
@@ -827,15 +1413,22 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		}
 		return fs.OpenFile(linkTarget, flag)
 	}
+	if inode.extents == nil {
+		return nil, fmt.Errorf("cannot open %s: not a regular file", p)
+	}
 	offset := int64(0)
 	if flag&os.O_APPEND == os.O_APPEND {
 		offset = int64(inode.size)
 	}
 	// when we open a file, we load the inode but also all of the extents
-	extents, err := inode.extents.blocks(fs)
+	extents, damaged, err := fs.fileExtents(inode)
 	if err != nil {
 		return nil, fmt.Errorf("could not read extent tree for inode %d: %v", inodeNumber, err)
 	}
+	// writing would rebuild the extent tree from what was salvaged, losing whatever could not be
+	if damaged && flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, fmt.Errorf("cannot open %s for writing: its extent tree is corrupt", p)
+	}
 	return &File{
 		directoryEntry: entry,
 		inode:          inode,
@@ -855,11 +1448,25 @@ func (fs *FileSystem) Label() string {
 	return fs.superblock.volumeLabel
 }
 
-// Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it.
-//
-//nolint:revive // parameters will be used eventually
-func (fs *FileSystem) Rename(oldpath, newpath string) error {
-	return filesystem.ErrNotImplemented
+// UUID returns the filesystem UUID from the superblock
+func (fs *FileSystem) UUID() string {
+	if fs.superblock == nil || fs.superblock.uuid == nil {
+		return ""
+	}
+	return fs.superblock.uuid.String()
+}
+
+// Usage returns the size of the filesystem and the space in its free blocks, including
+// the blocks reserved for the superuser
+func (fs *FileSystem) Usage() filesystem.Usage {
+	if fs.superblock == nil {
+		return filesystem.Usage{}
+	}
+	blocksize := int64(fs.superblock.blockSize)
+	return filesystem.Usage{
+		Size: int64(fs.superblock.blockCount) * blocksize,
+		Free: int64(fs.superblock.freeBlocks) * blocksize,
+	}
 }
 
 // Deprecated: use filesystem.Remove(p string) instead
@@ -883,133 +1490,239 @@ func (fs *FileSystem) Remove(p string) error {
 	if entry == nil {
 		return fmt.Errorf("file does not exist: %s", p)
 	}
-
-	writableFile, err := fs.backend.Writable()
-
-	if err != nil {
-		return err
+	if entry.filename == "." || entry.filename == ".." {
+		return fmt.Errorf("cannot remove %s", p)
 	}
 	// if it is a directory, it must be empty
 	if entry.fileType == dirFileTypeDirectory {
-		// read the directory
 		entries, err := fs.readDirectory(entry.inode)
 		if err != nil {
 			return fmt.Errorf("could not read directory %s: %v", p, err)
 		}
-		if len(entries) > 2 {
-			return fmt.Errorf("directory not empty: %s", p)
+		for _, e := range entries {
+			if e.filename != "." && e.filename != ".." {
+				return fmt.Errorf("directory not empty: %s", p)
+			}
 		}
 	}
-	// at this point, it is either a file or an empty directory, so remove it
 
-	// free up the blocks
-	// read the inode to find the blocks
-	removedInode, err := fs.readInode(entry.inode)
-	if err != nil {
-		return fmt.Errorf("could not read inode %d for %s: %v", entry.inode, p, err)
-	}
-	extents, err := removedInode.extents.blocks(fs)
-	if err != nil {
-		return fmt.Errorf("could not read extents for inode %d for %s: %v", entry.inode, p, err)
+	// remove the directory entry from the parent
+	if err := fs.removeDirEntry(parentDir, entry); err != nil {
+		return fmt.Errorf("could not remove %s from its directory: %w", p, err)
 	}
-	// clear the inode from the inode bitmap
-	inodeBG := blockGroupForInode(int(entry.inode), fs.superblock.inodesPerGroup)
-	inodeBitmap, err := fs.readInodeBitmap(inodeBG)
+	in, err := fs.readInode(entry.inode)
 	if err != nil {
-		return fmt.Errorf("could not read inode bitmap: %v", err)
+		return fmt.Errorf("could not read inode %d for %s: %v", entry.inode, p, err)
 	}
-	// clear up the blocks from the block bitmap. We are not clearing the block content, just the bitmap.
-	// keep a cache of bitmaps, so we do not have to read them again and again
-	blockBitmaps := make(map[int]*util.Bitmap)
-	for _, e := range extents {
-		for i := e.startingBlock; i < e.startingBlock+uint64(e.count); i++ {
-			// determine what block group this block is in, and read the bitmap for that blockgroup
-			bg := blockGroupForBlock(int(i), fs.superblock.blocksPerGroup)
-			dataBlockBitmap, ok := blockBitmaps[bg]
-			if !ok {
-				dataBlockBitmap, err = fs.readBlockBitmap(bg)
-				if err != nil {
-					return fmt.Errorf("could not read block bitmap: %v", err)
-				}
-				blockBitmaps[bg] = dataBlockBitmap
-			}
-			// the extent lists the absolute block number, but the bitmap is relative to the block group
-			blockInBG := int(i) - int(fs.superblock.blocksPerGroup)*bg
-			if err := dataBlockBitmap.Clear(blockInBG); err != nil {
-				return fmt.Errorf("could not clear block bitmap for block %d: %v", i, err)
-			}
+	if in.fileType == fileTypeDirectory {
+		// the .. entry of the directory was a link to the parent
+		if err := fs.changeLinks(parentDir.inode, -1); err != nil {
+			return err
 		}
-	}
-	for bg, dataBlockBitmap := range blockBitmaps {
-		if err := fs.writeBlockBitmap(dataBlockBitmap, bg); err != nil {
-			return fmt.Errorf("could not write block bitmap back to disk: %v", err)
+		gd, err := fs.groupDescriptors.get(blockGroupForInode(int(in.number), fs.superblock.inodesPerGroup))
+		if err != nil {
+			return err
+		}
+		gd.usedDirectories--
+		if err := fs.writeGroupDescriptor(gd); err != nil {
+			return err
 		}
+		// its own . entry is the other link
+		in.hardLinks = 0
+	} else if in.hardLinks > 0 {
+		in.hardLinks--
 	}
+	// other hard links still use it
+	if in.hardLinks > 0 {
+		in.changeTime = time.Now()
+		return fs.writeInode(in)
+	}
+	return fs.freeInode(in)
+}
 
-	// remove the directory entry from the parent
-	newEntries := make([]*directoryEntry, 0, len(parentDir.entries)-1)
-	for _, e := range parentDir.entries {
-		if e.inode == entry.inode {
+// removeDirEntry remove a single entry from a directory, and write the directory
+func (fs *FileSystem) removeDirEntry(dir *Directory, entry *directoryEntry) error {
+	newEntries := make([]*directoryEntry, 0, len(dir.entries))
+	for _, e := range dir.entries {
+		if e == entry || (e.inode == entry.inode && e.filename == entry.filename) {
 			continue
 		}
 		newEntries = append(newEntries, e)
 	}
-	parentDir.entries = newEntries
-	// write the parent directory back
-	dirBytes := parentDir.toBytes(fs.superblock.blockSize, directoryChecksumAppender(fs.superblock.checksumSeed, parentDir.inode, 0))
-	parentInode, err := fs.readInode(parentDir.inode)
+	dir.entries = newEntries
+	return fs.writeDirectory(dir)
+}
+
+// changeLinks change the count of hard links of an inode by delta
+func (fs *FileSystem) changeLinks(inodeNumber uint32, delta int) error {
+	in, err := fs.readInode(inodeNumber)
 	if err != nil {
-		return fmt.Errorf("could not read inode %d for %s: %v", entry.inode, path.Base(p), err)
+		return fmt.Errorf("could not read inode %d: %w", inodeNumber, err)
 	}
-	extents, err = parentInode.extents.blocks(fs)
-	if err != nil {
-		return fmt.Errorf("could not read extents for inode %d for %s: %v", entry.inode, path.Base(p), err)
+	in.hardLinks = uint16(int(in.hardLinks) + delta)
+	in.changeTime = time.Now()
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d: %w", inodeNumber, err)
 	}
-	for _, e := range extents {
-		for i := 0; i < int(e.count); i++ {
-			b := dirBytes[i:fs.superblock.blockSize]
-			if _, err := writableFile.WriteAt(b, (int64(i)+int64(e.startingBlock))*int64(fs.superblock.blockSize)); err != nil {
-				return fmt.Errorf("could not write inode bitmap back to disk: %v", err)
+	return nil
+}
+
+// freeInode release an inode that nothing links to any more, along with all of its blocks,
+// both data and extent tree. Once the inode is released, the blocks are discarded, see discardBlocks.
+func (fs *FileSystem) freeInode(in *inode) error {
+	var (
+		exts       extents
+		treeBlocks []uint64
+		err        error
+	)
+	if in.flags.usesExtents && in.extents != nil {
+		exts, err = in.extents.blocks(fs)
+		if err != nil {
+			return fmt.Errorf("could not read extents for inode %d: %w", in.number, err)
+		}
+		treeBlocks, err = extentTreeIndexBlocks(in.extents, fs)
+		if err != nil {
+			return fmt.Errorf("could not read extent tree for inode %d: %w", in.number, err)
+		}
+		for _, e := range exts {
+			if err := fs.setBlocksInUse(e.startingBlock, uint64(e.count), false); err != nil {
+				return fmt.Errorf("could not free blocks of inode %d: %w", in.number, err)
+			}
+		}
+		for _, block := range treeBlocks {
+			if err := fs.setBlocksInUse(block, 1, false); err != nil {
+				return fmt.Errorf("could not free extent tree block of inode %d: %w", in.number, err)
 			}
 		}
 	}
-
-	// remove the inode from the bitmap and write the inode bitmap back
-	// inode is absolute, but bitmap is relative to block group
-	inodeInBG := int(entry.inode) - int(fs.superblock.inodesPerGroup)*inodeBG
-	if err := inodeBitmap.Clear(inodeInBG); err != nil {
-		return fmt.Errorf("could not clear inode bitmap for inode %d: %v", entry.inode, err)
+	if in.extendedAttributeBlock != 0 {
+		if err := fs.writeXattrs(in, &xattrBlock{}, ""); err != nil {
+			return fmt.Errorf("could not free extended attribute block of inode %d: %w", in.number, err)
+		}
 	}
+	in.hardLinks = 0
+	in.size = 0
+	in.extents = &extentLeafNode{extentNodeHeader: extentNodeHeader{max: uint16(extentInodeMaxEntries), blockSize: fs.superblock.blockSize}}
+	in.setBlockCount(0, fs.superblock.blockSize)
+	in.deletionTime = uint32(time.Now().Unix())
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d: %w", in.number, err)
+	}
+	if err := fs.setInodeInUse(in.number, false); err != nil {
+		return err
+	}
+	for _, e := range exts {
+		fs.discardBlocks(e.startingBlock, uint64(e.count))
+	}
+	for _, block := range treeBlocks {
+		fs.discardBlocks(block, 1)
+	}
+	return nil
+}
 
-	// write the inode bitmap back
-	if err := fs.writeInodeBitmap(inodeBitmap, inodeBG); err != nil {
-		return fmt.Errorf("could not write inode bitmap back to disk: %v", err)
+// discardBlocks tell the backend that count blocks from start, which were freed, are no longer used, if it is a
+// backend.Discarder, so that the space they took on an SSD, a thin volume or a sparse image is freed too. It is
+// only a hint, so failing to discard them does not fail freeing them.
+func (fs *FileSystem) discardBlocks(start, count uint64) {
+	if discarder, ok := fs.backend.(backend.Discarder); ok {
+		blocksize := int64(fs.superblock.blockSize)
+		_ = discarder.Discard(fs.start+int64(start)*blocksize, int64(count)*blocksize)
 	}
-	// update the group descriptor
-	gd := fs.groupDescriptors.descriptors[inodeBG]
+}
 
-	// update the group descriptor inodes and blocks
-	gd.freeInodes++
-	gd.freeBlocks += uint32(removedInode.blocks)
-	// write the group descriptor back
-	gdBytes := gd.toBytes(fs.superblock.gdtChecksumType(), fs.superblock.uuid.ID())
-	gdtBlock := 1
-	if fs.superblock.blockSize == 1024 {
-		gdtBlock = 2
+// Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it.
+// A directory cannot be moved into itself or one of its own subdirectories.
+func (fs *FileSystem) Rename(oldpath, newpath string) error {
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	if oldpath == newpath {
+		return nil
+	}
+	_, entry, err := fs.getEntryAndParent(oldpath)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("file does not exist: %s", oldpath)
 	}
-	if _, err := writableFile.WriteAt(gdBytes, fs.start+int64(gdtBlock)*int64(fs.superblock.blockSize)+int64(gd.number)*int64(fs.superblock.groupDescriptorSize)); err != nil {
-		return fmt.Errorf("could not write Group Descriptor bytes to file: %v", err)
+	if oldpath == "/" || entry.filename == "." || entry.filename == ".." {
+		return fmt.Errorf("cannot rename %s", oldpath)
+	}
+	isDir := entry.fileType == dirFileTypeDirectory
+	if isDir && strings.HasPrefix(newpath, oldpath+"/") {
+		return fmt.Errorf("cannot move directory %s into itself", oldpath)
+	}
+	_, existing, err := fs.getEntryAndParent(newpath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		switch {
+		case existing.fileType == dirFileTypeDirectory:
+			return fmt.Errorf("cannot replace directory %s", newpath)
+		case isDir:
+			return fmt.Errorf("cannot replace file %s with directory %s", newpath, oldpath)
+		}
+		if err := fs.Remove(newpath); err != nil {
+			return fmt.Errorf("could not replace %s: %w", newpath, err)
+		}
 	}
 
-	// we could remove the inode from the inode table in the group descriptor,
-	// but we do not need to do so. Since we are not reusing the inode, we can just leave it there,
-	// the bitmap always is checked before reusing an inode location.
-	fs.superblock.freeInodes++
-	fs.superblock.freeBlocks += removedInode.blocks
-	return fs.writeSuperblock()
+	// read both directories again, as removing the existing file may have changed either of them
+	oldParent, entry, err := fs.getEntryAndParent(oldpath)
+	if err != nil {
+		return err
+	}
+	moved := *entry
+	moved.filename = path.Base(newpath)
+	if path.Dir(oldpath) == path.Dir(newpath) {
+		entry.filename = moved.filename
+		if err := fs.writeDirectory(oldParent); err != nil {
+			return fmt.Errorf("could not rename %s: %w", oldpath, err)
+		}
+	} else {
+		newParent, err := fs.readDirWithMkdir(path.Dir(newpath), false)
+		if err != nil {
+			return fmt.Errorf("could not read directory entries for %s: %w", path.Dir(newpath), err)
+		}
+		// add it to the new directory before removing it from the old one, so it never is lost
+		newParent.entries = append(newParent.entries, &moved)
+		if err := fs.writeDirectory(newParent); err != nil {
+			return fmt.Errorf("could not add %s to its new directory: %w", newpath, err)
+		}
+		if err := fs.removeDirEntry(oldParent, entry); err != nil {
+			return fmt.Errorf("could not remove %s from its old directory: %w", oldpath, err)
+		}
+		if isDir {
+			// point .. at the new parent, and move the link it counts as
+			dir, err := fs.readDirWithMkdir(newpath, false)
+			if err != nil {
+				return fmt.Errorf("could not read directory %s: %w", newpath, err)
+			}
+			for _, e := range dir.entries {
+				if e.filename == ".." {
+					e.inode = newParent.inode
+				}
+			}
+			if err := fs.writeDirectory(dir); err != nil {
+				return fmt.Errorf("could not write directory %s: %w", newpath, err)
+			}
+			if err := fs.changeLinks(oldParent.inode, -1); err != nil {
+				return err
+			}
+			if err := fs.changeLinks(newParent.inode, 1); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.changeLinks(moved.inode, 0)
 }
 
+// Truncate change the size of the file at p. A file that shrinks gives up the blocks it no longer needs;
+// one that grows is filled with zeroes.
 func (fs *FileSystem) Truncate(p string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("cannot truncate %s to negative size %d", p, size)
+	}
 	_, entry, err := fs.getEntryAndParent(p)
 	if err != nil {
 		return err
@@ -1020,19 +1733,93 @@ func (fs *FileSystem) Truncate(p string, size int64) error {
 	if entry.fileType == dirFileTypeDirectory {
 		return fmt.Errorf("cannot truncate directory %s", p)
 	}
-	// it is not a directory, and it exists, so truncate it
-	inode, err := fs.readInode(entry.inode)
+	if entry.fileType != dirFileTypeRegular {
+		return fmt.Errorf("cannot truncate %s, not a regular file", p)
+	}
+	in, err := fs.readInode(entry.inode)
 	if err != nil {
 		return fmt.Errorf("could not read inode %d in directory: %v", entry.inode, err)
 	}
-	// change the file size
-	inode.size = uint64(size)
-
-	// free used blocks if shrank, or reserve new blocks if grew
-	// both of which mean updating the superblock, and the extents tree in the inode
-
-	// write the inode back
-	return fs.writeInode(inode)
+	var exts extents
+	if in.extents != nil {
+		if exts, err = in.extents.blocks(fs); err != nil {
+			return fmt.Errorf("could not read extents for inode %d: %w", in.number, err)
+		}
+	}
+	f := &File{
+		directoryEntry: entry,
+		inode:          in,
+		isReadWrite:    true,
+		filesystem:     fs,
+		extents:        exts,
+	}
+	oldSize := int64(in.size)
+	if size > oldSize {
+		// write the zeroes in pieces, so a large file does not need all of them in memory
+		zeroes := make([]byte, fs.superblock.blockSize*256)
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		for left := size - oldSize; left > 0; {
+			chunk := zeroes
+			if left < int64(len(chunk)) {
+				chunk = chunk[:left]
+			}
+			if _, err := f.Write(chunk); err != nil {
+				return fmt.Errorf("could not grow %s: %w", p, err)
+			}
+			left -= int64(len(chunk))
+		}
+		return nil
+	}
+
+	blocksize := uint64(fs.superblock.blockSize)
+	keepBlocks := (uint64(size) + blocksize - 1) / blocksize
+	var kept extents
+	for _, e := range exts {
+		switch {
+		case uint64(e.fileBlock) >= keepBlocks:
+			err = fs.setBlocksInUse(e.startingBlock, uint64(e.count), false)
+		case uint64(e.fileBlock)+uint64(e.count) > keepBlocks:
+			keep := keepBlocks - uint64(e.fileBlock)
+			err = fs.setBlocksInUse(e.startingBlock+keep, uint64(e.count)-keep, false)
+			e.count = uint16(keep)
+			kept = append(kept, e)
+		default:
+			kept = append(kept, e)
+		}
+		if err != nil {
+			return fmt.Errorf("could not free blocks of %s: %w", p, err)
+		}
+	}
+	root, treeBlocks, err := fs.writeExtentTree(kept, in.extents, in.number, in.nfsFileVersion)
+	if err != nil {
+		return fmt.Errorf("could not rebuild extent tree for %s: %w", p, err)
+	}
+	in.extents = root
+	in.flags.usesExtents = true
+	in.size = uint64(size)
+	in.setBlockCount(kept.blockCount()+treeBlocks, fs.superblock.blockSize)
+	now := time.Now()
+	in.modifyTime, in.changeTime = now, now
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d: %w", in.number, err)
+	}
+	// zero the rest of the last block, so that growing the file again does not bring back old data
+	if partial := uint64(size) % blocksize; partial != 0 {
+		f.extents = kept
+		if _, err := f.Seek(size, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := f.Write(make([]byte, blocksize-partial)); err != nil {
+			return fmt.Errorf("could not clear end of %s: %w", p, err)
+		}
+		in.size = uint64(size)
+		if err := fs.writeInode(in); err != nil {
+			return fmt.Errorf("could not write inode %d: %w", in.number, err)
+		}
+	}
+	return nil
 }
 
 // getEntryAndParent given a path, get the Directory for the parent and the directory entry for the file.
@@ -1064,32 +1851,109 @@ func (fs *FileSystem) getEntryAndParent(p string) (parent *Directory, entry *dir
 	return parentDir, targetEntry, nil
 }
 
-// Stat return fs.FileInfo about a specific file path.
+// Stat return fs.FileInfo about a specific file path. Its Sys() returns the *FileInfo itself,
+// which also gives the rest of the metadata in the inode, such as its number, links and timestamps.
 func (fs *FileSystem) Stat(p string) (iofs.FileInfo, error) {
 	_, entry, err := fs.getEntryAndParent(p)
 	if err != nil {
 		return nil, err
 	}
-	if entry == nil {
-		return nil, fmt.Errorf("file does not exist: %s", p)
+	if entry == nil {
+		return nil, fmt.Errorf("file does not exist: %s", p)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d in directory: %v", entry.inode, err)
+	}
+	return fs.newFileInfo(in, entry.filename, entry.fileType == dirFileTypeDirectory), nil
+}
+
+// SetReadDirOrder set the order in which ReadDir returns the entries of a directory
+func (fs *FileSystem) SetReadDirOrder(order ReadDirOrder) {
+	fs.readDirOrder = order
+}
+
+// SetLabel changes the label on the writable filesystem. Different file system may hav different
+// length constraints.
+func (fs *FileSystem) SetLabel(label string) error {
+	fs.superblock.volumeLabel = label
+	return fs.writeSuperblock()
+}
+
+// Info the superblock fields that record where the filesystem was last mounted, and when
+// e2fsck next should check it, as shown by tune2fs -l
+type Info struct {
+	// LastMounted the directory where the filesystem was last mounted
+	LastMounted string
+	// MountCount how many times the filesystem has been mounted since it last was checked
+	MountCount uint16
+	// MaxMountCount how many mounts there may be before it must be checked, or -1 or 0 for no limit
+	MaxMountCount int16
+	// LastCheck when the filesystem last was checked
+	LastCheck time.Time
+	// CheckInterval how long there may be between checks, or 0 for no limit
+	CheckInterval time.Duration
+}
+
+// Info returns where the filesystem was last mounted, and when it next should be checked
+func (fs *FileSystem) Info() Info {
+	sb := fs.superblock
+	return Info{
+		LastMounted:   sb.lastMountedDirectory,
+		MountCount:    sb.mountCount,
+		MaxMountCount: int16(sb.mountsToFsck),
+		LastCheck:     sb.lastCheck,
+		CheckInterval: time.Duration(sb.checkInterval) * time.Second,
+	}
+}
+
+// TuneOptions the superblock fields to change with Tune, like tune2fs does. Fields that are nil
+// are left as they are.
+type TuneOptions struct {
+	LastMounted   *string
+	MountCount    *uint16
+	MaxMountCount *int16
+	LastCheck     *time.Time
+	CheckInterval *time.Duration
+}
+
+// Tune changes where the filesystem was last mounted, and when it next should be checked, on the
+// writable filesystem, e.g. to reset the mount count of an image before it is copied to many machines
+func (fs *FileSystem) Tune(opts TuneOptions) error {
+	sb := *fs.superblock
+	if opts.LastMounted != nil {
+		if len(*opts.LastMounted) > 64 {
+			return fmt.Errorf("last mounted directory %q is longer than 64 bytes", *opts.LastMounted)
+		}
+		sb.lastMountedDirectory = *opts.LastMounted
+	}
+	if opts.MountCount != nil {
+		sb.mountCount = *opts.MountCount
+	}
+	if opts.MaxMountCount != nil {
+		sb.mountsToFsck = uint16(*opts.MaxMountCount)
+	}
+	if opts.LastCheck != nil {
+		sb.lastCheck = *opts.LastCheck
 	}
-	in, err := fs.readInode(entry.inode)
-	if err != nil {
-		return nil, fmt.Errorf("could not read inode %d in directory: %v", entry.inode, err)
+	if opts.CheckInterval != nil {
+		interval := *opts.CheckInterval / time.Second
+		if interval < 0 || interval > math.MaxUint32 {
+			return fmt.Errorf("check interval %v is out of range", *opts.CheckInterval)
+		}
+		sb.checkInterval = uint32(interval)
 	}
-	return &FileInfo{
-		modTime: in.modifyTime,
-		name:    entry.filename,
-		size:    int64(in.size),
-		isDir:   entry.fileType == dirFileTypeDirectory,
-	}, nil
-}
-
-// SetLabel changes the label on the writable filesystem. Different file system may hav different
-// length constraints.
-func (fs *FileSystem) SetLabel(label string) error {
-	fs.superblock.volumeLabel = label
-	return fs.writeSuperblock()
+	// only change the superblock in memory once it is known to be good
+	if _, err := sb.toBytes(); err != nil {
+		return fmt.Errorf("could not convert superblock to bytes: %v", err)
+	}
+	previous := fs.superblock
+	fs.superblock = &sb
+	if err := fs.writeSuperblock(); err != nil {
+		fs.superblock = previous
+		return err
+	}
+	return nil
 }
 
 // readInode read a single inode from disk
@@ -1103,7 +1967,10 @@ func (fs *FileSystem) readInode(inodeNumber uint32) (*inode, error) {
 	// figure out which block group the inode is on
 	bg := (inodeNumber - 1) / inodesPerGroup
 	// read the group descriptor to find out the location of the inode table
-	gd := fs.groupDescriptors.descriptors[bg]
+	gd, err := fs.groupDescriptors.get(int(bg))
+	if err != nil {
+		return nil, fmt.Errorf("could not find inode %d: %w", inodeNumber, err)
+	}
 	inodeTableBlock := gd.inodeTableLocation
 	inodeBytes := make([]byte, inodeSize)
 	// bytesStart is beginning byte for the inodeTableBlock
@@ -1112,7 +1979,7 @@ func (fs *FileSystem) readInode(inodeNumber uint32) (*inode, error) {
 	offsetInode := (inodeNumber - 1) % inodesPerGroup
 	// offset is how many bytes in our inode is
 	offset := offsetInode * uint32(inodeSize)
-	read, err := fs.backend.ReadAt(inodeBytes, int64(byteStart)+int64(offset))
+	read, err := fs.backend.ReadAt(inodeBytes, fs.start+int64(byteStart)+int64(offset))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read inode %d from offset %d of block %d from block group %d: %v", inodeNumber, offset, inodeTableBlock, bg, err)
 	}
@@ -1153,7 +2020,10 @@ func (fs *FileSystem) writeInode(i *inode) error {
 	// figure out which block group the inode is on
 	bg := (i.number - 1) / inodesPerGroup
 	// read the group descriptor to find out the location of the inode table
-	gd := fs.groupDescriptors.descriptors[bg]
+	gd, err := fs.groupDescriptors.get(int(bg))
+	if err != nil {
+		return fmt.Errorf("could not find inode %d: %w", i.number, err)
+	}
 	inodeTableBlock := gd.inodeTableLocation
 	// bytesStart is beginning byte for the inodeTableBlock
 	//   byteStart := inodeTableBlock * sb.blockSize
@@ -1165,7 +2035,7 @@ func (fs *FileSystem) writeInode(i *inode) error {
 	// offset is how many bytes in our inode is
 	offset := int64(offsetInode) * int64(inodeSize)
 	inodeBytes := i.toBytes(sb)
-	wrote, err := writableFile.WriteAt(inodeBytes, int64(byteStart)+offset)
+	wrote, err := writableFile.WriteAt(inodeBytes, fs.start+int64(byteStart)+offset)
 	if err != nil {
 		return fmt.Errorf("failed to write inode %d at offset %d of block %d from block group %d: %v", i.number, offset, inodeTableBlock, bg, err)
 	}
@@ -1177,6 +2047,35 @@ func (fs *FileSystem) writeInode(i *inode) error {
 
 // read directory entries for a given directory
 func (fs *FileSystem) readDirectory(inodeNumber uint32) ([]*directoryEntry, error) {
+	return fs.readDirectoryEntries(inodeNumber, false)
+}
+
+// readDirectoryOnDisk read the entries of a directory in the order they are on disk, even if it has a hash tree
+// index
+func (fs *FileSystem) readDirectoryOnDisk(inodeNumber uint32) ([]*directoryEntry, error) {
+	return fs.readDirectoryEntries(inodeNumber, true)
+}
+
+// readDirectoryEntries read the entries of a directory, in the order of their hashes if it has a hash tree index,
+// unless onDisk. Without the filetype feature, the file type of each entry is taken from its inode.
+func (fs *FileSystem) readDirectoryEntries(inodeNumber uint32, onDisk bool) ([]*directoryEntry, error) {
+	entries, err := fs.readDirectoryAsStored(inodeNumber, onDisk)
+	if err != nil || fs.superblock.features.directoryEntriesRecordFileType {
+		return entries, err
+	}
+	for _, de := range entries {
+		in, err := fs.readInode(de.inode)
+		if err != nil {
+			return nil, fmt.Errorf("could not read inode %d for the type of %q in directory %d: %w", de.inode, de.filename, inodeNumber, err)
+		}
+		de.fileType = directoryFileTypeForInode(in.fileType)
+	}
+	return entries, nil
+}
+
+// readDirectoryAsStored read the entries of a directory as readDirectoryEntries does, but with their file types
+// as they are stored in them
+func (fs *FileSystem) readDirectoryAsStored(inodeNumber uint32, onDisk bool) ([]*directoryEntry, error) {
 	// read the inode for the directory
 	in, err := fs.readInode(inodeNumber)
 	if err != nil {
@@ -1194,13 +2093,17 @@ func (fs *FileSystem) readDirectory(inodeNumber uint32) ([]*directoryEntry, erro
 	}
 
 	var dirEntries []*directoryEntry
-	// TODO: none of this works for hashed dir entries, indicated by in.flags.hashedDirectoryIndexes == true
 	if in.flags.hashedDirectoryIndexes {
 		treeRoot, err := parseDirectoryTreeRoot(b[:fs.superblock.blockSize], fs.superblock.features.largeDirectory)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse directory tree root: %v", err)
 		}
-		subDirEntries, err := parseDirEntriesHashed(b, treeRoot.depth, treeRoot, fs.superblock.blockSize, fs.superblock.features.metadataChecksums, in.number, in.nfsFileVersion, fs.superblock.checksumSeed)
+		var subDirEntries []*directoryEntry
+		if onDisk {
+			subDirEntries, err = parseDirEntriesLeaves(b, treeRoot.depth, treeRoot, fs.superblock.blockSize, fs.superblock.features.metadataChecksums, in.number, in.nfsFileVersion, fs.superblock.checksumSeed)
+		} else {
+			subDirEntries, err = parseDirEntriesHashed(b, treeRoot.depth, treeRoot, fs.superblock.blockSize, fs.superblock.features.metadataChecksums, in.number, in.nfsFileVersion, fs.superblock.checksumSeed)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse hashed directory entries: %v", err)
 		}
@@ -1227,7 +2130,7 @@ func (fs *FileSystem) readFileBytes(extents extents, filesize uint64) ([]byte, e
 			count = filesize - uint64(len(b))
 		}
 		b2 := make([]byte, count)
-		read, err := fs.backend.ReadAt(b2, int64(start))
+		read, err := fs.backend.ReadAt(b2, fs.start+int64(start))
 		if err != nil {
 			return nil, fmt.Errorf("failed to read bytes for extent %d: %v", i, err)
 		}
@@ -1242,9 +2145,72 @@ func (fs *FileSystem) readFileBytes(extents extents, filesize uint64) ([]byte, e
 	return b, nil
 }
 
+// writeDirectory write all of the entries of a directory to its blocks, growing it if they no longer fit.
+// A directory never shrinks; blocks it no longer needs are left holding no entries.
+// The entries always are written as a linear directory, so a hash tree index, if the directory had one, is dropped.
+func (fs *FileSystem) writeDirectory(dir *Directory) error {
+	sb := fs.superblock
+	in, err := fs.readInode(dir.inode)
+	if err != nil {
+		return fmt.Errorf("could not read inode %d for directory: %w", dir.inode, err)
+	}
+	if !sb.features.directoryEntriesRecordFileType {
+		dir = dir.withoutFileTypes()
+	}
+	checksumFunc := directoryChecksumAppender(sb.checksumSeed, dir.inode, in.nfsFileVersion)
+	b := dir.toBytes(sb.blockSize, checksumFunc)
+	// like the kernel, index a directory with a hash tree once it no longer fits in a single block,
+	// and keep the index once it has one
+	hashed := sb.features.directoryIndices && (in.flags.hashedDirectoryIndexes || len(b) > int(sb.blockSize))
+	if hashed {
+		params := hashTreeParams{
+			blockSize:      sb.blockSize,
+			hashVersion:    sb.hashVersion,
+			unsigned:       sb.miscFlags.unsignedDirectoryHash,
+			seed:           sb.hashTreeSeed,
+			largeDirectory: sb.features.largeDirectory,
+			minBlocks:      int(in.size / uint64(sb.blockSize)),
+			checksumFunc:   checksumFunc,
+		}
+		if sb.features.metadataChecksums {
+			params.dxChecksum = directoryChecksummer(sb.checksumSeed, dir.inode, in.nfsFileVersion)
+		}
+		b, err = dir.toHashedBytes(params)
+		if err != nil {
+			return fmt.Errorf("could not build hash tree for directory inode %d: %w", dir.inode, err)
+		}
+	}
+	for uint64(len(b)) < in.size {
+		empty := (&directoryEntry{}).toBytes(uint16(int(sb.blockSize) - minDirEntryLength))
+		b = append(b, checksumFunc(empty)...)
+	}
+	extents, err := in.extents.blocks(fs)
+	if err != nil {
+		return fmt.Errorf("could not read extents for directory inode %d: %w", dir.inode, err)
+	}
+	now := time.Now()
+	in.flags.hashedDirectoryIndexes = hashed
+	in.modifyTime, in.changeTime = now, now
+	dirFile := &File{
+		inode:          in,
+		directoryEntry: &dir.directoryEntry,
+		filesystem:     fs,
+		isReadWrite:    true,
+		extents:        extents,
+	}
+	wrote, err := dirFile.Write(b)
+	if err != nil {
+		return fmt.Errorf("unable to write directory inode %d: %w", dir.inode, err)
+	}
+	if wrote != len(b) {
+		return fmt.Errorf("wrote only %d bytes instead of expected %d for directory inode %d", wrote, len(b), dir.inode)
+	}
+	return fs.writeInode(in)
+}
+
 // mkFile make a file with a given name in the given directory.
 func (fs *FileSystem) mkFile(parent *Directory, name string) (*directoryEntry, error) {
-	return fs.mkDirEntry(parent, name, false)
+	return fs.mkDirEntry(parent, name, fileTypeRegularFile, "")
 }
 
 // readDirWithMkdir - walks down a directory tree to the last entry in p.
@@ -1323,7 +2289,7 @@ func (fs *FileSystem) readBlock(blockNumber uint64) ([]byte, error) {
 	// bytesStart is beginning byte for the inodeTableBlock
 	byteStart := blockNumber * uint64(sb.blockSize)
 	blockBytes := make([]byte, sb.blockSize)
-	read, err := fs.backend.ReadAt(blockBytes, int64(byteStart))
+	read, err := fs.backend.ReadAt(blockBytes, fs.start+int64(byteStart))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read block %d: %v", blockNumber, err)
 	}
@@ -1373,40 +2339,58 @@ func recalculateBlocksize(numblocks, size int64) (sectorsPerBlock int, blocksize
 // 4- mark the data block in the data block bitmap
 // 5- create a directory entry in the parent directory data blocks
 func (fs *FileSystem) mkSubdir(parent *Directory, name string) (*directoryEntry, error) {
-	return fs.mkDirEntry(parent, name, true)
+	return fs.mkDirEntry(parent, name, fileTypeDirectory, "")
 }
 
-func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*directoryEntry, error) {
-	// still to do:
-	//  - write directory entry in parent
-	//  - write inode to disk
+func (fs *FileSystem) mkSymlink(parent *Directory, name, target string) (*directoryEntry, error) {
+	return fs.mkDirEntry(parent, name, fileTypeSymbolicLink, target)
+}
 
+// mkDirEntry create a new regular file, directory, symlink or special file in the parent directory.
+// linkTarget is used only for symlinks; a target shorter than 60 bytes is kept in the inode itself
+// as a fast symlink, a longer one in a data block. Special files have no extent tree at all, as with Linux.
+func (fs *FileSystem) mkDirEntry(parent *Directory, name string, ft fileType, linkTarget string) (*directoryEntry, error) {
+	fastSymlink := ft == fileTypeSymbolicLink && int64(len(linkTarget)) <= fastSymlinkMax
+	if ft == fileTypeSymbolicLink && len(linkTarget) > int(fs.superblock.blockSize) {
+		return nil, fmt.Errorf("symlink target of %d bytes is longer than the block size %d", len(linkTarget), fs.superblock.blockSize)
+	}
 	// create an inode
 	inodeNumber, err := fs.allocateInode(parent.inode)
 	if err != nil {
 		return nil, fmt.Errorf("could not allocate inode for file %s: %w", name, err)
 	}
-	// get extents for the file - prefer in the same block group as the inode, if possible
-	newExtents, err := fs.allocateExtents(1, nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not allocate disk space for file %s: %w", name, err)
+	// get extents for the file - prefer in the same block group as the inode, if possible.
+	// A regular file starts with no blocks at all, and gets them as it is written; a directory needs one
+	// for its . and .. entries, and a symlink too long for the inode one for its target.
+	newExtents := &extents{}
+	if ft == fileTypeDirectory || (ft == fileTypeSymbolicLink && !fastSymlink) {
+		newExtents, err = fs.allocateExtents(uint64(fs.superblock.blockSize), nil)
+		if err != nil {
+			return nil, fmt.Errorf("could not allocate disk space for file %s: %w", name, err)
+		}
 	}
-	extentTreeParsed, err := extendExtentTree(nil, newExtents, fs, nil)
-	if err != nil {
-		return nil, fmt.Errorf("could not convert extents into tree: %w", err)
+	// a single extent always fits in the inode itself, so this never needs blocks for the tree
+	var extentTreeParsed extentBlockFinder
+	special := ft == fileTypeFifo || ft == fileTypeCharacterDevice || ft == fileTypeBlockDevice || ft == fileTypeSocket
+	if !fastSymlink && !special {
+		extentTreeParsed, _, err = fs.writeExtentTree(*newExtents, nil, inodeNumber, 0)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert extents into tree: %w", err)
+		}
 	}
-	// normally, after getting a tree from extents, you would need to then allocate all of the blocks
-	//    in the extent tree - leafs and intermediate. However, because we are allocating a new directory
-	//    with a single extent, we *know* it can fit in the inode itself (which has a max of 4), so no need
 
 	// create a directory entry for the file
-	deFileType := dirFileTypeRegular
-	fileType := fileTypeRegularFile
-	var contentSize uint64
-	if isDir {
-		deFileType = dirFileTypeDirectory
-		fileType = fileTypeDirectory
+	deFileType := directoryFileTypeForInode(ft)
+	var (
+		contentSize uint64
+		hardLinks   uint16 = 1
+	)
+	switch ft {
+	case fileTypeDirectory:
 		contentSize = uint64(fs.superblock.blockSize)
+		hardLinks = 2
+	case fileTypeSymbolicLink:
+		contentSize = uint64(len(linkTarget))
 	}
 	de := directoryEntry{
 		inode:    inodeNumber,
@@ -1414,40 +2398,27 @@ func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*d
 		fileType: deFileType,
 	}
 	parent.entries = append(parent.entries, &de)
-	// write the parent out to disk
-	bytesPerBlock := fs.superblock.blockSize
-	parentDirBytes := parent.toBytes(bytesPerBlock, directoryChecksumAppender(fs.superblock.checksumSeed, parent.inode, 0))
-	// check if parent has increased in size beyond allocated blocks
+	if err := fs.writeDirectory(parent); err != nil {
+		return nil, fmt.Errorf("could not write parent directory: %w", err)
+	}
 	parentInode, err := fs.readInode(parent.inode)
 	if err != nil {
 		return nil, fmt.Errorf("could not read inode %d of parent directory: %w", parent.inode, err)
 	}
-
-	// write the directory entry in the parent
-	// figure out which block it goes into, and possibly rebalance the directory entries hash tree
-	parentExtents, err := parentInode.extents.blocks(fs)
-	if err != nil {
-		return nil, fmt.Errorf("could not read parent extents for directory: %w", err)
-	}
-	dirFile := &File{
-		inode: parentInode,
-		directoryEntry: &directoryEntry{
-			inode:    parent.inode,
-			filename: name,
-			fileType: dirFileTypeDirectory,
-		},
-		filesystem:  fs,
-		isReadWrite: true,
-		isAppend:    true,
-		offset:      0,
-		extents:     parentExtents,
-	}
-	wrote, err := dirFile.Write(parentDirBytes)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("unable to write new directory: %w", err)
-	}
-	if wrote != len(parentDirBytes) {
-		return nil, fmt.Errorf("wrote only %d bytes instead of expected %d for new directory", wrote, len(parentDirBytes))
+	// the .. entry of a new subdirectory is another link to the parent
+	if ft == fileTypeDirectory {
+		parentInode.hardLinks++
+		if err := fs.writeInode(parentInode); err != nil {
+			return nil, fmt.Errorf("could not write inode %d of parent directory: %w", parent.inode, err)
+		}
+		gd, err := fs.groupDescriptors.get(blockGroupForInode(int(inodeNumber), fs.superblock.inodesPerGroup))
+		if err != nil {
+			return nil, err
+		}
+		gd.usedDirectories++
+		if err := fs.writeGroupDescriptor(gd); err != nil {
+			return nil, err
+		}
 	}
 
 	// write the inode for the new entry out
@@ -1457,13 +2428,12 @@ func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*d
 		permissionsGroup:       parentInode.permissionsGroup,
 		permissionsOwner:       parentInode.permissionsOwner,
 		permissionsOther:       parentInode.permissionsOther,
-		fileType:               fileType,
+		fileType:               ft,
 		owner:                  parentInode.owner,
 		group:                  parentInode.group,
 		size:                   contentSize,
-		hardLinks:              2,
-		blocks:                 newExtents.blockCount(),
-		flags:                  &inodeFlags{},
+		hardLinks:              hardLinks,
+		flags:                  &inodeFlags{usesExtents: extentTreeParsed != nil},
 		nfsFileVersion:         0,
 		version:                0,
 		inodeSize:              parentInode.inodeSize,
@@ -1475,13 +2445,20 @@ func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*d
 		extendedAttributeBlock: 0,
 		project:                0,
 		extents:                extentTreeParsed,
+		linkTarget:             linkTarget,
+	}
+	in.setBlockCount(newExtents.blockCount(), fs.superblock.blockSize)
+	// symlinks always have all permissions, which are never checked
+	if ft == fileTypeSymbolicLink {
+		all := filePermissions{read: true, write: true, execute: true}
+		in.permissionsOwner, in.permissionsGroup, in.permissionsOther = all, all, all
 	}
 	// write the inode to disk
 	if err := fs.writeInode(&in); err != nil {
 		return nil, fmt.Errorf("could not write inode for new directory: %w", err)
 	}
 	// if a directory, put entries for . and .. in the first block for the new directory
-	if isDir {
+	if ft == fileTypeDirectory {
 		initialEntries := []*directoryEntry{
 			{
 				inode:    inodeNumber,
@@ -1494,32 +2471,31 @@ func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*d
 				fileType: dirFileTypeDirectory,
 			},
 		}
-		newDir := Directory{
+		newDir := &Directory{
 			directoryEntry: de,
 			root:           false,
 			entries:        initialEntries,
 		}
-		dirBytes := newDir.toBytes(fs.superblock.blockSize, directoryChecksumAppender(fs.superblock.checksumSeed, inodeNumber, 0))
-		// write the bytes out to disk
-		dirFile = &File{
-			inode: &in,
-			directoryEntry: &directoryEntry{
-				inode:    inodeNumber,
-				filename: name,
-				fileType: dirFileTypeDirectory,
-			},
-			filesystem:  fs,
-			isReadWrite: true,
-			isAppend:    true,
-			offset:      0,
-			extents:     *newExtents,
-		}
-		wrote, err := dirFile.Write(dirBytes)
-		if err != nil && err != io.EOF {
+		if err := fs.writeDirectory(newDir); err != nil {
 			return nil, fmt.Errorf("unable to write new directory: %w", err)
 		}
-		if wrote != len(dirBytes) {
-			return nil, fmt.Errorf("wrote only %d bytes instead of expected %d for new entry", wrote, len(dirBytes))
+	}
+	// a symlink too long for the inode holds its target in its data block
+	if ft == fileTypeSymbolicLink && !fastSymlink {
+		linkFile := &File{
+			inode:          &in,
+			directoryEntry: &de,
+			filesystem:     fs,
+			isReadWrite:    true,
+			offset:         0,
+			extents:        *newExtents,
+		}
+		wrote, err := linkFile.Write([]byte(linkTarget))
+		if err != nil {
+			return nil, fmt.Errorf("unable to write symlink target: %w", err)
+		}
+		if wrote != len(linkTarget) {
+			return nil, fmt.Errorf("wrote only %d bytes instead of expected %d for symlink target", wrote, len(linkTarget))
 		}
 	}
 
@@ -1530,217 +2506,172 @@ func (fs *FileSystem) mkDirEntry(parent *Directory, name string, isDir bool) (*d
 // allocateInode allocate a single inode
 // passed the parent, so it can know where to allocate it
 // logic:
-//   - parent is  0 : root inode, will allocate at 2
-//   - parent is  2 : child of root, will try to spread out
-//   - else         : try to collocate with parent, if possible
+//   - parent is  0 : no preference, take the first free inode
+//   - else         : try to collocate with parent, if possible, otherwise take the first free inode after it
 func (fs *FileSystem) allocateInode(parent uint32) (uint32, error) {
-	var (
-		inodeNumber = -1
-	)
-	if parent == 0 {
-		inodeNumber = 2
-	}
-	// load the inode bitmap
-	var (
-		bg int
-		gd groupDescriptor
-	)
-
-	writableFile, err := fs.backend.Writable()
-	if err != nil {
-		return 0, err
-	}
-
-	for _, gd = range fs.groupDescriptors.descriptors {
-		if inodeNumber != -1 {
-			break
-		}
-		bg := int(gd.number)
-		bm, err := fs.readInodeBitmap(bg)
+	sb := fs.superblock
+	groups := fs.groupDescriptors.count()
+	first := 0
+	if parent != 0 {
+		first = blockGroupForInode(int(parent), sb.inodesPerGroup)
+	}
+	for i := 0; i < groups; i++ {
+		bg := (first + i) % groups
+		gd, err := fs.groupDescriptors.get(bg)
 		if err != nil {
-			return 0, fmt.Errorf("could not read inode bitmap: %w", err)
+			return 0, err
 		}
-		// get first free inode
-		inodeNumber = bm.FirstFree(0)
-		// if we found a
-		if inodeNumber == -1 {
+		if gd.freeInodes == 0 {
 			continue
 		}
-		// set it as marked
-		if err := bm.Set(inodeNumber); err != nil {
-			return 0, fmt.Errorf("could not set inode bitmap: %w", err)
+		bm, err := fs.readInodeBitmap(bg)
+		if err != nil {
+			return 0, fmt.Errorf("could not read inode bitmap: %w", err)
 		}
-		// write the inode bitmap bytes
-		if err := fs.writeInodeBitmap(bm, bg); err != nil {
-			return 0, fmt.Errorf("could not write inode bitmap: %w", err)
+		for bit := bm.FirstFree(0); bit != -1 && bit < int(sb.inodesPerGroup); bit = bm.FirstFree(bit + 1) {
+			inodeNumber := uint32(bg)*sb.inodesPerGroup + uint32(bit) + 1
+			// never hand out the reserved inodes, even if they are not marked as used
+			if inodeNumber < sb.firstNonReservedInode {
+				continue
+			}
+			if err := fs.setInodeInUse(inodeNumber, true); err != nil {
+				return 0, fmt.Errorf("could not mark inode %d as used: %w", inodeNumber, err)
+			}
+			return inodeNumber, nil
 		}
 	}
-	if inodeNumber == -1 {
-		return 0, errors.New("no free inodes available")
-	}
-
-	// reduce number of free inodes in that descriptor in the group descriptor table
-	gd.freeInodes--
-
-	// get the group descriptor as bytes
-	gdBytes := gd.toBytes(fs.superblock.gdtChecksumType(), fs.superblock.uuid.ID())
-
-	// write the group descriptor bytes
-	// gdt starts in block 1 of any redundant copies, specifically in BG 0
-	gdtBlock := 1
-	blockByteLocation := gdtBlock * int(fs.superblock.blockSize)
-	gdOffset := fs.start + int64(blockByteLocation) + int64(bg)*int64(fs.superblock.groupDescriptorSize)
-	wrote, err := writableFile.WriteAt(gdBytes, gdOffset)
-	if err != nil {
-		return 0, fmt.Errorf("unable to write group descriptor bytes for blockgroup %d: %v", bg, err)
-	}
-	if wrote != len(gdBytes) {
-		return 0, fmt.Errorf("wrote only %d bytes instead of expected %d for group descriptor of block group %d", wrote, len(gdBytes), bg)
-	}
-
-	return uint32(inodeNumber), nil
+	return 0, errors.New("no free inodes available")
 }
 
 // allocateExtents allocate the data blocks in extents that are
 // to be used for a file of a given size
 // arguments are file size in bytes and existing extents
 // if previous is nil, then we are not (re)sizing an existing file but creating a new one
-// returns the extents to be used in order
+// returns only the newly allocated extents, in order, continuing in the file from previous.
+// Blocks right after the end of previous are preferred, so that the file stays contiguous.
 func (fs *FileSystem) allocateExtents(size uint64, previous *extents) (*extents, error) {
+	sb := fs.superblock
 	// 1- calculate how many blocks are needed
-	required := size / uint64(fs.superblock.blockSize)
-	remainder := size % uint64(fs.superblock.blockSize)
+	required := size / uint64(sb.blockSize)
+	remainder := size % uint64(sb.blockSize)
 	if remainder > 0 {
 		required++
 	}
 	// 2- see how many blocks already are allocated
-	var allocated uint64
-	if previous != nil {
+	var (
+		allocated uint64
+		fileBlock uint32
+		goal      uint64
+	)
+	if previous != nil && len(*previous) > 0 {
 		allocated = previous.blockCount()
+		last := (*previous)[len(*previous)-1]
+		fileBlock = last.fileBlock + uint32(last.count)
+		goal = last.startingBlock + uint64(last.count)
 	}
 	// 3- if needed, allocate new blocks in extents
-	extraBlockCount := required - allocated
+	newExtents := extents{}
 	// if we have enough, do not add anything
-	if extraBlockCount <= 0 {
-		return previous, nil
+	if required <= allocated {
+		return &newExtents, nil
 	}
+	extraBlockCount := required - allocated
 
 	// if there are not enough blocks left on the filesystem, return an error
-	if fs.superblock.freeBlocks < extraBlockCount {
-		return nil, fmt.Errorf("only %d blocks free, requires additional %d", fs.superblock.freeBlocks, extraBlockCount)
+	if sb.freeBlocks < extraBlockCount {
+		return nil, fmt.Errorf("only %d blocks free, requires additional %d", sb.freeBlocks, extraBlockCount)
 	}
 
-	// now we need to look for as many contiguous blocks as possible
-	// first calculate the minimum number of extents needed
-
-	// if all of the extents, except possibly the last, are maximum size, then we need minExtents extents
-	// we loop through, trying to allocate an extent as large as our remaining blocks or maxBlocksPerExtent,
-	//   whichever is smaller
-	blockGroupCount := fs.blockGroups
-	// TODO: instead of starting with BG 0, should start with BG where the inode for this file/dir is located
+	// look through the block groups, starting with the one holding the goal, for free runs of blocks
 	var (
-		newExtents       []extent
-		datablockBitmaps = map[int]*util.Bitmap{}
-		blocksPerGroup   = fs.superblock.blocksPerGroup
+		groups     = fs.groupDescriptors.count()
+		firstGroup int
 	)
-
-	var i int64
-	for i = 0; i < blockGroupCount && allocated < extraBlockCount; i++ {
-		// keep track if we allocated anything in this blockgroup
-		// 1- read the GDT for this blockgroup to find the location of the block bitmap
-		//    and total free blocks
-		// 2- read the block bitmap from disk
-		// 3- find the maximum contiguous space available
-		bs, err := fs.readBlockBitmap(int(i))
+	if goal >= uint64(sb.firstDataBlock) && goal < sb.blockCount {
+		firstGroup = int((goal - uint64(sb.firstDataBlock)) / uint64(sb.blocksPerGroup))
+	}
+	for i := 0; i < groups && extraBlockCount > 0; i++ {
+		bg := (firstGroup + i) % groups
+		gd, err := fs.groupDescriptors.get(bg)
+		if err != nil {
+			return nil, err
+		}
+		if gd.freeBlocks == 0 {
+			continue
+		}
+		bs, err := fs.readBlockBitmap(bg)
 		if err != nil {
-			return nil, fmt.Errorf("could not read block bitmap for block group %d: %v", i, err)
-		}
-		// now find our unused blocks and how many there are in a row as potential extents
-		if extraBlockCount > maxUint16 {
-			return nil, fmt.Errorf("cannot allocate more than %d blocks in a single extent", maxUint16)
-		}
-		// get the list of free blocks
-		blockList := bs.FreeList()
-
-		// create possible extents by size
-		// Step 3: Group contiguous blocks into extents
-		var extents []extent
-		for _, freeBlock := range blockList {
-			start, length := freeBlock.Position, freeBlock.Count
-			for length > 0 {
-				extentLength := min(length, int(maxBlocksPerExtent))
-				extents = append(extents, extent{startingBlock: uint64(start) + uint64(i)*uint64(blocksPerGroup), count: uint16(extentLength)})
-				start += extentLength
-				length -= extentLength
+			return nil, fmt.Errorf("could not read block bitmap for block group %d: %v", bg, err)
+		}
+		groupStart := uint64(sb.firstDataBlock) + uint64(bg)*uint64(sb.blocksPerGroup)
+		groupEnd := min(groupStart+uint64(sb.blocksPerGroup), sb.blockCount)
+		// absolute positions of the free runs, with the one holding the goal first, starting at the goal
+		var runs []extent
+		for _, free := range bs.FreeList() {
+			start := groupStart + uint64(free.Position)
+			end := min(start+uint64(free.Count), groupEnd)
+			if start >= end {
+				continue
+			}
+			if goal > start && goal < end {
+				runs = append([]extent{{startingBlock: goal, count: uint16(min(end-goal, uint64(maxBlocksPerExtent)))}}, runs...)
+				end = goal
+			}
+			for start < end {
+				count := min(end-start, uint64(maxBlocksPerExtent))
+				run := extent{startingBlock: start, count: uint16(count)}
+				if start == goal {
+					runs = append([]extent{run}, runs...)
+				} else {
+					runs = append(runs, run)
+				}
+				start += count
 			}
 		}
-
-		// sort in descending order
-		sort.Slice(extents, func(i, j int) bool {
-			return extents[i].count > extents[j].count
-		})
-
-		var allocatedBlocks uint64
-		for _, ext := range extents {
-			if extraBlockCount <= 0 {
+		for _, run := range runs {
+			if extraBlockCount == 0 {
 				break
 			}
-			extentToAdd := ext
-			if uint64(ext.count) >= extraBlockCount {
-				extentToAdd = extent{startingBlock: ext.startingBlock, count: uint16(extraBlockCount)}
+			count := min(uint64(run.count), extraBlockCount)
+			if err := fs.setBlocksInUse(run.startingBlock, count, true); err != nil {
+				return nil, fmt.Errorf("could not mark blocks as used: %w", err)
 			}
-			newExtents = append(newExtents, extentToAdd)
-			allocatedBlocks += uint64(extentToAdd.count)
-			extraBlockCount -= uint64(extentToAdd.count)
-			// set the marked blocks in the bitmap, and save the bitmap
-			for block := extentToAdd.startingBlock; block < extentToAdd.startingBlock+uint64(extentToAdd.count); block++ {
-				// determine what block group this block is in, and read the bitmap for that blockgroup
-				// the extent lists the absolute block number, but the bitmap is relative to the block group
-				blockInGroup := block - uint64(i)*uint64(blocksPerGroup)
-				if err := bs.Set(int(blockInGroup)); err != nil {
-					return nil, fmt.Errorf("could not clear block bitmap for block %d: %v", i, err)
+			// continue the previous extent if it is contiguous and has room
+			if n := len(newExtents); n > 0 {
+				last := &newExtents[n-1]
+				if last.startingBlock+uint64(last.count) == run.startingBlock && uint64(last.count)+count <= uint64(maxBlocksPerExtent) {
+					last.count += uint16(count)
+					fileBlock += uint32(count)
+					extraBlockCount -= count
+					continue
 				}
 			}
-
-			// do *not* write the bitmap back yet, as we do not yet know if we will be able to fulfill the entire request.
-			// instead save it for later
-			datablockBitmaps[int(i)] = bs
+			newExtents = append(newExtents, extent{fileBlock: fileBlock, startingBlock: run.startingBlock, count: uint16(count)})
+			fileBlock += uint32(count)
+			extraBlockCount -= count
 		}
 	}
 	if extraBlockCount > 0 {
 		return nil, fmt.Errorf("could not allocate %d blocks", extraBlockCount)
 	}
-
-	// write the block bitmaps back to disk
-	for bg, bs := range datablockBitmaps {
-		if err := fs.writeBlockBitmap(bs, bg); err != nil {
-			return nil, fmt.Errorf("could not write block bitmap for block group %d: %v", bg, err)
-		}
-	}
-
-	// need to update the total blocks used/free in superblock
-	fs.superblock.freeBlocks -= allocated
-	// update the blockBitmapChecksum for any updated block groups in GDT
-	// write updated superblock and GDT to disk
-	if err := fs.writeSuperblock(); err != nil {
-		return nil, fmt.Errorf("could not write superblock: %w", err)
-	}
-	// write backup copies
-	var exten extents = newExtents
-	return &exten, nil
+	return &newExtents, nil
 }
 
 // readInodeBitmap read the inode bitmap off the disk.
 // This would be more efficient if we just read one group descriptor's bitmap
 // but for now we are about functionality, not efficiency, so it will read the whole thing.
 func (fs *FileSystem) readInodeBitmap(group int) (*util.Bitmap, error) {
-	if group >= len(fs.groupDescriptors.descriptors) {
-		return nil, fmt.Errorf("block group %d does not exist", group)
+	gd, err := fs.groupDescriptors.get(group)
+	if err != nil {
+		return nil, err
 	}
-	gd := fs.groupDescriptors.descriptors[group]
 	bitmapLocation := gd.inodeBitmapLocation
 	bitmapByteCount := fs.superblock.inodesPerGroup / 8
 	b := make([]byte, bitmapByteCount)
+	// an uninitialized inode bitmap need not have been written, and has no inodes in use
+	if gd.flags.inodesUninitialized {
+		return util.BitmapFromBytes(b), nil
+	}
 	offset := int64(bitmapLocation*uint64(fs.superblock.blockSize) + uint64(fs.start))
 	read, err := fs.backend.ReadAt(b, offset)
 	if err != nil {
@@ -1752,41 +2683,49 @@ func (fs *FileSystem) readInodeBitmap(group int) (*util.Bitmap, error) {
 	// only take bytes corresponding to the number of inodes per group
 
 	// create a bitmap
-	bs := util.NewBitmap(int(fs.superblock.blockSize) * len(fs.groupDescriptors.descriptors))
+	bs := util.NewBitmap(int(fs.superblock.blockSize) * fs.groupDescriptors.count())
 	bs.FromBytes(b)
 	return bs, nil
 }
 
 // writeInodeBitmap write the inode bitmap to the disk.
 func (fs *FileSystem) writeInodeBitmap(bm *util.Bitmap, group int) error {
-	if group >= len(fs.groupDescriptors.descriptors) {
-		return fmt.Errorf("block group %d does not exist", group)
+	gd, err := fs.groupDescriptors.get(group)
+	if err != nil {
+		return err
 	}
 	writableFile, err := fs.backend.Writable()
 	if err != nil {
 		return err
 	}
-	b := bm.ToBytes()
-	gd := fs.groupDescriptors.descriptors[group]
 	bitmapByteCount := fs.superblock.inodesPerGroup / 8
+	// the rest of the block is padding with all bits set, which an uninitialized bitmap might not have had
+	b := make([]byte, fs.superblock.blockSize)
+	for i := range b {
+		b[i] = 0xff
+	}
+	copy(b, bm.ToBytes()[:bitmapByteCount])
 	bitmapLocation := gd.inodeBitmapLocation
 	offset := int64(bitmapLocation*uint64(fs.superblock.blockSize) + uint64(fs.start))
 	wrote, err := writableFile.WriteAt(b, offset)
 	if err != nil {
 		return fmt.Errorf("unable to write inode bitmap for blockgroup %d: %w", gd.number, err)
 	}
-	if wrote != int(bitmapByteCount) {
-		return fmt.Errorf("wrote %d bytes instead of expected %d for inode bitmap of block group %d", wrote, bitmapByteCount, gd.number)
+	if wrote != len(b) {
+		return fmt.Errorf("wrote %d bytes instead of expected %d for inode bitmap of block group %d", wrote, len(b), gd.number)
 	}
 
 	return nil
 }
 
 func (fs *FileSystem) readBlockBitmap(group int) (*util.Bitmap, error) {
-	if group >= len(fs.groupDescriptors.descriptors) {
-		return nil, fmt.Errorf("block group %d does not exist", group)
+	gd, err := fs.groupDescriptors.get(group)
+	if err != nil {
+		return nil, err
+	}
+	if gd.flags.blockBitmapUninitialized {
+		return fs.uninitializedBlockBitmap(group)
 	}
-	gd := fs.groupDescriptors.descriptors[group]
 	bitmapLocation := gd.blockBitmapLocation
 	b := make([]byte, fs.superblock.blockSize)
 	offset := int64(bitmapLocation*uint64(fs.superblock.blockSize) + uint64(fs.start))
@@ -1798,22 +2737,52 @@ func (fs *FileSystem) readBlockBitmap(group int) (*util.Bitmap, error) {
 		return nil, fmt.Errorf("Read %d bytes instead of expected %d for block bitmap of block group %d", read, fs.superblock.blockSize, gd.number)
 	}
 	// create a bitmap
-	bs := util.NewBitmap(int(fs.superblock.blockSize) * len(fs.groupDescriptors.descriptors))
+	bs := util.NewBitmap(int(fs.superblock.blockSize) * fs.groupDescriptors.count())
 	bs.FromBytes(b)
 	return bs, nil
 }
 
+// uninitializedBlockBitmap the block bitmap of a block group whose bitmap is uninitialized, which need not have been
+// written. As the kernel does, it is made up of the blocks of the filesystem metadata in the group, which are its
+// copy of the superblock and GDT, and any bitmaps and inode tables, along with the bits beyond the end of the group.
+func (fs *FileSystem) uninitializedBlockBitmap(group int) (*util.Bitmap, error) {
+	sb := fs.superblock
+	// with flex_bg, the metadata of a group can be in any other group
+	if err := fs.groupDescriptors.loadAll(); err != nil {
+		return nil, err
+	}
+	bm := util.NewBitmap(int(sb.blockSize))
+	groupStart := uint64(sb.firstDataBlock) + uint64(group)*uint64(sb.blocksPerGroup)
+	groupEnd := min(groupStart+uint64(sb.blocksPerGroup), sb.blockCount)
+	set := func(start, count uint64) {
+		for block := max(start, groupStart); block < min(start+count, groupEnd); block++ {
+			_ = bm.Set(int(block - groupStart))
+		}
+	}
+	set(groupStart, sb.groupMetadataBlocks(uint64(group)))
+	inodeTableBlocks := (uint64(sb.inodesPerGroup)*uint64(sb.inodeSize) + uint64(sb.blockSize) - 1) / uint64(sb.blockSize)
+	for _, gd := range fs.groupDescriptors.descriptors {
+		set(gd.blockBitmapLocation, 1)
+		set(gd.inodeBitmapLocation, 1)
+		set(gd.inodeTableLocation, inodeTableBlocks)
+	}
+	for bit := int(groupEnd - groupStart); bit < int(sb.blockSize)*8; bit++ {
+		_ = bm.Set(bit)
+	}
+	return bm, nil
+}
+
 // writeBlockBitmap write the inode bitmap to the disk.
 func (fs *FileSystem) writeBlockBitmap(bm *util.Bitmap, group int) error {
-	if group >= len(fs.groupDescriptors.descriptors) {
-		return fmt.Errorf("block group %d does not exist", group)
+	gd, err := fs.groupDescriptors.get(group)
+	if err != nil {
+		return err
 	}
 	writableFile, err := fs.backend.Writable()
 	if err != nil {
 		return err
 	}
 	b := bm.ToBytes()
-	gd := fs.groupDescriptors.descriptors[group]
 	bitmapLocation := gd.blockBitmapLocation
 	offset := int64(bitmapLocation*uint64(fs.superblock.blockSize) + uint64(fs.start))
 	wrote, err := writableFile.WriteAt(b, offset)
@@ -1846,3 +2815,201 @@ func blockGroupForInode(inodeNumber int, inodesPerGroup uint32) int {
 func blockGroupForBlock(blockNumber int, blocksPerGroup uint32) int {
 	return (blockNumber - 1) / int(blocksPerGroup)
 }
+
+// inodeOffset the byte offset of an inode in the inode table, relative to the start of the filesystem
+func (fs *FileSystem) inodeOffset(inodeNumber uint32) (int64, error) {
+	sb := fs.superblock
+	if inodeNumber == 0 || inodeNumber > sb.inodeCount {
+		return 0, fmt.Errorf("invalid inode number %d", inodeNumber)
+	}
+	bg := (inodeNumber - 1) / sb.inodesPerGroup
+	gd, err := fs.groupDescriptors.get(int(bg))
+	if err != nil {
+		return 0, fmt.Errorf("block group for inode %d: %w", inodeNumber, err)
+	}
+	offsetInode := (inodeNumber - 1) % sb.inodesPerGroup
+	return int64(gd.inodeTableLocation)*int64(sb.blockSize) + int64(offsetInode)*int64(sb.inodeSize), nil
+}
+
+// readRawInode read the bytes of a single inode from disk, without interpreting them
+func (fs *FileSystem) readRawInode(inodeNumber uint32) ([]byte, error) {
+	offset, err := fs.inodeOffset(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fs.superblock.inodeSize)
+	read, err := fs.backend.ReadAt(b, fs.start+offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", inodeNumber, err)
+	}
+	if read != len(b) {
+		return nil, fmt.Errorf("read %d bytes for inode %d instead of inode size of %d", read, inodeNumber, len(b))
+	}
+	return b, nil
+}
+
+// writeRawInode write the bytes of a single inode to disk, updating its checksum
+func (fs *FileSystem) writeRawInode(inodeNumber uint32, b []byte) error {
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	offset, err := fs.inodeOffset(inodeNumber)
+	if err != nil {
+		return err
+	}
+	if fs.superblock.features.metadataChecksums {
+		b[0x7c], b[0x7d], b[0x82], b[0x83] = 0, 0, 0, 0
+		checksum := inodeChecksum(b, fs.superblock.checksumSeed, inodeNumber, binary.LittleEndian.Uint32(b[0x64:0x68]))
+		binary.LittleEndian.PutUint16(b[0x7c:0x7e], uint16(checksum))
+		binary.LittleEndian.PutUint16(b[0x82:0x84], uint16(checksum>>16))
+	}
+	wrote, err := writableFile.WriteAt(b, fs.start+offset)
+	if err != nil {
+		return fmt.Errorf("failed to write inode %d: %w", inodeNumber, err)
+	}
+	if wrote != len(b) {
+		return fmt.Errorf("wrote %d bytes for inode %d instead of inode size of %d", wrote, inodeNumber, len(b))
+	}
+	return nil
+}
+
+// writeGroupDescriptor write a single group descriptor to the primary group descriptor table
+func (fs *FileSystem) writeGroupDescriptor(gd *groupDescriptor) error {
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	sb := fs.superblock
+	gdBytes := gd.toBytes(sb.gdtChecksumType(), sb.checksumSeed)
+	perBlock := sb.descriptorsPerBlock()
+	block := uint64(gd.number) / perBlock
+	offset := fs.start + int64(sb.gdtBlockLocation(block))*int64(sb.blockSize) + int64(uint64(gd.number)%perBlock)*int64(len(gdBytes))
+	if _, err := writableFile.WriteAt(gdBytes, offset); err != nil {
+		return fmt.Errorf("could not write group descriptor for block group %d: %w", gd.number, err)
+	}
+	return nil
+}
+
+// setBlocksInUse mark a range of blocks as used or free in the block bitmaps, updating
+// the free block counts in the group descriptors and superblock.
+// Blocks that already are in the requested state are left alone.
+func (fs *FileSystem) setBlocksInUse(start uint64, count uint64, used bool) error {
+	sb := fs.superblock
+	var (
+		bitmaps = map[int]*util.Bitmap{}
+		changed = map[int]int64{}
+	)
+	for block := start; block < start+count; block++ {
+		if block < uint64(sb.firstDataBlock) || block >= sb.blockCount {
+			return fmt.Errorf("block %d is outside of the filesystem", block)
+		}
+		relative := block - uint64(sb.firstDataBlock)
+		bg := int(relative / uint64(sb.blocksPerGroup))
+		bm, ok := bitmaps[bg]
+		if !ok {
+			var err error
+			bm, err = fs.readBlockBitmap(bg)
+			if err != nil {
+				return err
+			}
+			bitmaps[bg] = bm
+		}
+		bit := int(relative % uint64(sb.blocksPerGroup))
+		isSet, err := bm.IsSet(bit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case used && !isSet:
+			err = bm.Set(bit)
+			changed[bg]--
+		case !used && isSet:
+			err = bm.Clear(bit)
+			changed[bg]++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for bg, bm := range bitmaps {
+		if changed[bg] == 0 {
+			continue
+		}
+		if err := fs.writeBlockBitmap(bm, bg); err != nil {
+			return err
+		}
+		gd, err := fs.groupDescriptors.get(bg)
+		if err != nil {
+			return err
+		}
+		gd.freeBlocks = uint32(int64(gd.freeBlocks) + changed[bg])
+		gd.flags.blockBitmapUninitialized = false
+		if sb.features.metadataChecksums {
+			// without bigalloc, clusters are blocks
+			clustersPerGroup := sb.clustersPerGroup
+			if clustersPerGroup == 0 {
+				clustersPerGroup = sb.blocksPerGroup
+			}
+			gd.blockBitmapChecksum = gd.bitmapChecksum(crc.CRC32c(sb.checksumSeed, bm.ToBytes()[:clustersPerGroup/8]))
+		}
+		if err := fs.writeGroupDescriptor(gd); err != nil {
+			return err
+		}
+		sb.freeBlocks = uint64(int64(sb.freeBlocks) + changed[bg])
+	}
+	return fs.writeSuperblock()
+}
+
+// setInodeInUse mark a single inode as used or free in the inode bitmap, updating the free inode
+// counts in the group descriptor and superblock.
+func (fs *FileSystem) setInodeInUse(inodeNumber uint32, used bool) error {
+	sb := fs.superblock
+	if inodeNumber == 0 || inodeNumber > sb.inodeCount {
+		return fmt.Errorf("invalid inode number %d", inodeNumber)
+	}
+	bg := blockGroupForInode(int(inodeNumber), sb.inodesPerGroup)
+	bm, err := fs.readInodeBitmap(bg)
+	if err != nil {
+		return err
+	}
+	bit := int(inodeNumber-1) % int(sb.inodesPerGroup)
+	isSet, err := bm.IsSet(bit)
+	if err != nil {
+		return err
+	}
+	if isSet == used {
+		return nil
+	}
+	gd, err := fs.groupDescriptors.get(bg)
+	if err != nil {
+		return err
+	}
+	if used {
+		err = bm.Set(bit)
+		gd.freeInodes--
+		sb.freeInodes--
+		// inodes beyond the used part of the inode table are not looked at
+		gd.flags.inodesUninitialized = false
+		if inUse := sb.inodesPerGroup - gd.unusedInodes; uint32(bit) >= inUse && gd.unusedInodes > 0 {
+			gd.unusedInodes = sb.inodesPerGroup - uint32(bit) - 1
+		}
+	} else {
+		err = bm.Clear(bit)
+		gd.freeInodes++
+		sb.freeInodes++
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.writeInodeBitmap(bm, bg); err != nil {
+		return err
+	}
+	if sb.features.metadataChecksums {
+		gd.inodeBitmapChecksum = gd.bitmapChecksum(crc.CRC32c(sb.checksumSeed, bm.ToBytes()[:sb.inodesPerGroup/8]))
+	}
+	if err := fs.writeGroupDescriptor(gd); err != nil {
+		return err
+	}
+	return fs.writeSuperblock()
+}
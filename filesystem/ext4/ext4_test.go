@@ -3,6 +3,8 @@ package ext4
 import (
 	"bytes"
 	"cmp"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -12,7 +14,9 @@ import (
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/go-test/deep"
 )
@@ -154,6 +158,468 @@ func TestReadFile(t *testing.T) {
 	}
 }
 
+func TestStat(t *testing.T) {
+	f, err := os.Open(imgFile)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, true)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	info := func(p string) *FileInfo {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			t.Fatalf("Error getting file info for %s: %v", p, err)
+		}
+		sys, ok := fi.Sys().(*FileInfo)
+		if !ok {
+			t.Fatalf("Sys() for %s returned %T instead of *FileInfo", p, fi.Sys())
+		}
+		return sys
+	}
+	target, link := info("/random.dat"), info("/hardlink.dat")
+	if target.Inode() != link.Inode() {
+		t.Errorf("hard links have different inodes %d and %d", target.Inode(), link.Inode())
+	}
+	if target.Nlink() != 2 {
+		t.Errorf("expected 2 links, got %d", target.Nlink())
+	}
+	if target.Flags()&uint32(inodeFlagUsesExtents) == 0 {
+		t.Errorf("expected the extents flag, got flags %#x", target.Flags())
+	}
+	if minBlocks := uint64(target.Size() / 512); target.Blocks() < minBlocks {
+		t.Errorf("expected at least %d blocks, got %d", minBlocks, target.Blocks())
+	}
+	if target.CreateTime().IsZero() || target.ChangeTime().IsZero() || target.AccessTime().IsZero() {
+		t.Errorf("missing timestamps, created %v changed %v accessed %v", target.CreateTime(), target.ChangeTime(), target.AccessTime())
+	}
+	if root := info("/"); root.Inode() != rootInode {
+		t.Errorf("expected root directory at inode %d, got %d", rootInode, root.Inode())
+	}
+}
+
+func TestCreate(t *testing.T) {
+	outfile := filepath.Join(t.TempDir(), "created.img")
+	out, err := os.Create(outfile)
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer out.Close()
+	size := int64(100 * MB)
+	if err := out.Truncate(size); err != nil {
+		t.Fatalf("Error sizing image file: %v", err)
+	}
+	params := &Params{RootUID: 1000, RootGID: 100, RootMode: 0o750}
+	if _, err := Create(file.New(out, false), size, 0, 512, params); err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	fs, err := Read(file.New(out, true), size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	tests := []struct {
+		path     string
+		uid, gid uint32
+		mode     os.FileMode
+		size     int64
+	}{
+		{"/", 1000, 100, os.ModeDir | 0o750, 1024},
+		{"/lost+found", 0, 0, os.ModeDir | 0o700, 16 * 1024},
+	}
+	for _, tt := range tests {
+		fi, err := fs.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Error getting file info for %s: %v", tt.path, err)
+		}
+		fileInfo := fi.Sys().(*FileInfo)
+		if fileInfo.UID() != tt.uid || fileInfo.GID() != tt.gid {
+			t.Errorf("%s: mismatched owner, expected %d:%d got %d:%d", tt.path, tt.uid, tt.gid, fileInfo.UID(), fileInfo.GID())
+		}
+		if fi.Mode() != tt.mode {
+			t.Errorf("%s: mismatched mode, expected %v got %v", tt.path, tt.mode, fi.Mode())
+		}
+		if fi.Size() != tt.size {
+			t.Errorf("%s: mismatched size, expected %d got %d", tt.path, tt.size, fi.Size())
+		}
+	}
+	// the empty blocks of lost+found hold no entries
+	entries, err := fs.ReadDir("/lost+found")
+	if err != nil {
+		t.Fatalf("Error reading lost+found: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != "." && e.Name() != ".." {
+			t.Errorf("unexpected entry %s in lost+found", e.Name())
+		}
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("new filesystem is not consistent: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(fs *FileSystem) error
+		err     string
+		// repaired whether Check repairs it
+		repaired bool
+	}{
+		{"consistent", func(*FileSystem) error { return nil }, "", false},
+		{"unused block marked used", func(fs *FileSystem) error {
+			return fs.setBlocksInUse(fs.superblock.blockCount-10, 1, true)
+		}, "blocks marked as used that are not in use", false},
+		{"wrong link count", func(fs *FileSystem) error {
+			fi, err := fs.Stat("/dir/file-0")
+			if err != nil {
+				return err
+			}
+			in, err := fs.readInode(fi.Sys().(*FileInfo).Inode())
+			if err != nil {
+				return err
+			}
+			in.hardLinks = 2
+			return fs.writeInode(in)
+		}, "has a link count of 2, but 1 directory entries", false},
+		{"wrong file type", func(fs *FileSystem) error {
+			dir, err := fs.readDirWithMkdir("/dir", false)
+			if err != nil {
+				return err
+			}
+			for _, de := range dir.entries {
+				if de.filename == "file-3" {
+					de.fileType = dirFileTypeSymlink
+				}
+			}
+			return fs.writeDirectory(dir)
+		}, `entry "file-3" with file type 7, but inode`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outfile := filepath.Join(t.TempDir(), "created.img")
+			f, err := os.Create(outfile)
+			if err != nil {
+				t.Fatalf("Error creating image file: %v", err)
+			}
+			defer f.Close()
+			size := int64(20 * MB)
+			fs, err := Create(file.New(f, false), size, 0, 512, &Params{Checksum: true})
+			if err != nil {
+				t.Fatalf("Error creating filesystem: %v", err)
+			}
+			if err := fs.Mkdir("/dir"); err != nil {
+				t.Fatalf("Error creating directory: %v", err)
+			}
+			for i := range 10 {
+				fh, err := fs.OpenFile(fmt.Sprintf("/dir/file-%d", i), os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("Error creating file: %v", err)
+				}
+				if _, err := fh.Write(make([]byte, 5000*i)); err != nil {
+					t.Fatalf("Error writing file: %v", err)
+				}
+			}
+			if err := tt.corrupt(fs); err != nil {
+				t.Fatalf("Error corrupting filesystem: %v", err)
+			}
+			err = fs.Check(false)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("expected error containing %q, got none", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+			if !tt.repaired {
+				return
+			}
+			if err := fs.Check(true); err != nil {
+				t.Errorf("unexpected error repairing: %v", err)
+			}
+			if err := fs.Check(false); err != nil {
+				t.Errorf("repaired filesystem is not consistent: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithoutFileType(t *testing.T) {
+	outfile := filepath.Join(t.TempDir(), "created.img")
+	f, err := os.Create(outfile)
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	size := int64(20 * MB)
+	fs, err := Create(file.New(f, false), size, 0, 512, &Params{Features: []FeatureOpt{WithFeatureDirectoryEntriesRecordFileType(false)}})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/dir/sub"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	// enough files for the directory to need a hash tree index
+	for i := range 200 {
+		fh, err := fs.OpenFile(fmt.Sprintf("/dir/file-with-a-long-name-%d", i), os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Error creating file: %v", err)
+		}
+		if _, err := fh.Write([]byte("data")); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+	}
+	if err := fs.Symlink("/dir/file-with-a-long-name-0", "/dir/link"); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	fs, err = Read(file.New(f, false), size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	if fs.superblock.features.directoryEntriesRecordFileType {
+		t.Fatalf("filesystem has the filetype feature")
+	}
+	// none of the entries on disk have a file type
+	entries, err := fs.readDirectoryAsStored(rootInode, false)
+	if err != nil {
+		t.Fatalf("Error reading root directory: %v", err)
+	}
+	for _, de := range entries {
+		if de.fileType != dirFileTypeUnknown {
+			t.Errorf("entry %q has file type %d", de.filename, de.fileType)
+		}
+	}
+	// but they are known from the inodes
+	infos, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, fi := range infos {
+		modes[fi.Name()] = fi.Mode().Type()
+	}
+	if len(modes) != 204 || modes["sub"] != os.ModeDir || modes["link"] != os.ModeSymlink || modes["file-with-a-long-name-7"] != 0 {
+		t.Errorf("unexpected entries, %d of them, with sub %v, link %v and file %v", len(modes), modes["sub"], modes["link"], modes["file-with-a-long-name-7"])
+	}
+	if _, err := fs.OpenFile("/dir/sub", os.O_RDONLY); err == nil {
+		t.Errorf("opened a directory as a file")
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent: %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	// where on disk the metadata to corrupt is
+	inodeOffset := func(fs *FileSystem, p string) (int64, error) {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			return 0, err
+		}
+		number := fi.Sys().(*FileInfo).Inode()
+		gd, err := fs.groupDescriptors.get(int((number - 1) / fs.superblock.inodesPerGroup))
+		if err != nil {
+			return 0, err
+		}
+		return int64(gd.inodeTableLocation)*int64(fs.superblock.blockSize) + int64((number-1)%fs.superblock.inodesPerGroup)*int64(fs.superblock.inodeSize), nil
+	}
+	// flip the bits of a byte
+	flip := func(f *os.File, offset int64) error {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			return err
+		}
+		b[0] ^= 0xff
+		_, err := f.WriteAt(b, offset)
+		return err
+	}
+	tests := []struct {
+		name    string
+		corrupt func(fs *FileSystem, f *os.File) error
+		err     string
+	}{
+		{"consistent", func(*FileSystem, *os.File) error { return nil }, ""},
+		{"inode", func(fs *FileSystem, f *os.File) error {
+			offset, err := inodeOffset(fs, "/large/file-00010.txt")
+			if err != nil {
+				return err
+			}
+			// the access time
+			return flip(f, offset+0x8)
+		}, "checksum mismatch"},
+		{"directory block", func(fs *FileSystem, f *os.File) error {
+			fi, err := fs.Stat("/large")
+			if err != nil {
+				return err
+			}
+			in, err := fs.readInode(fi.Sys().(*FileInfo).Inode())
+			if err != nil {
+				return err
+			}
+			exts, err := in.extents.blocks(fs)
+			if err != nil {
+				return err
+			}
+			// a block of entries, after the hash tree root
+			return flip(f, int64(exts[len(exts)-1].startingBlock)*int64(fs.superblock.blockSize)+20)
+		}, "of directory inode"},
+		{"xattr block", func(fs *FileSystem, f *os.File) error {
+			offset, err := inodeOffset(fs, "/random.dat")
+			if err != nil {
+				return err
+			}
+			b := make([]byte, 4)
+			if _, err := f.ReadAt(b, offset+0x68); err != nil {
+				return err
+			}
+			return flip(f, int64(binary.LittleEndian.Uint32(b))*int64(fs.superblock.blockSize)+100)
+		}, "extended attribute block"},
+		{"inode bitmap", func(fs *FileSystem, f *os.File) error {
+			gd, err := fs.groupDescriptors.get(0)
+			if err != nil {
+				return err
+			}
+			return flip(f, int64(gd.inodeBitmapLocation)*int64(fs.superblock.blockSize)+int64(fs.superblock.inodesPerGroup/8)-1)
+		}, "inode bitmap of block group 0 has checksum"},
+		{"group descriptor", func(fs *FileSystem, f *os.File) error {
+			// the free inodes count of block group 1
+			return flip(f, int64(fs.superblock.gdtBlockLocation(0))*int64(fs.superblock.blockSize)+int64(fs.superblock.descriptorSize())+0xe)
+		}, "group descriptor of block group 1 has checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outfile := testCreateImgCopy(t)
+			f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Error opening test image: %v", err)
+			}
+			defer f.Close()
+			fs, err := Read(file.New(f, false), 100*MB, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading filesystem: %v", err)
+			}
+			// a directory with a hash tree, and a file with an extended attribute block
+			if err := fs.Mkdir("/large"); err != nil {
+				t.Fatalf("Error creating directory: %v", err)
+			}
+			for i := range 500 {
+				if _, err := fs.OpenFile(fmt.Sprintf("/large/file-%05d.txt", i), os.O_CREATE|os.O_RDWR); err != nil {
+					t.Fatalf("Error creating file %d: %v", i, err)
+				}
+			}
+			if err := fs.Setxattr("/random.dat", "user.large", bytes.Repeat([]byte{0xab}, 900)); err != nil {
+				t.Fatalf("Error setting extended attribute: %v", err)
+			}
+			if err := tt.corrupt(fs, f); err != nil {
+				t.Fatalf("Error corrupting filesystem: %v", err)
+			}
+
+			report, err := fs.Scrub(context.Background(), 3)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if report.GroupDescriptors != int(fs.superblock.blockGroupCount()) || report.Inodes < 500 || report.DirectoryBlocks == 0 || report.XattrBlocks != 1 {
+				t.Errorf("checked too little: %+v", report)
+			}
+			err = report.Err()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected problems: %v", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("expected problem containing %q, got none", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("expected problem containing %q, got %v", tt.err, err)
+			case tt.err != "" && len(report.Problems) != 1:
+				t.Errorf("expected a single problem, got %v", err)
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		f, err := os.Open(imgFile)
+		if err != nil {
+			t.Fatalf("Error opening test image: %v", err)
+		}
+		defer f.Close()
+		fs, err := Read(file.New(f, true), 100*MB, 0, 512)
+		if err != nil {
+			t.Fatalf("Error reading filesystem: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := fs.Scrub(ctx, 0); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled error, got %v", err)
+		}
+	})
+}
+
+func TestTune(t *testing.T) {
+	outfile := filepath.Join(t.TempDir(), "created.img")
+	f, err := os.Create(outfile)
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	size := int64(20 * MB)
+	fs, err := Create(file.New(f, false), size, 0, 512, &Params{Checksum: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	// as if the image had been mounted and used
+	fs.superblock.mountCount = 17
+	fs.superblock.lastMountedDirectory = "/mnt/golden"
+	if err := fs.writeSuperblock(); err != nil {
+		t.Fatalf("Error writing superblock: %v", err)
+	}
+
+	var (
+		lastMounted   = ""
+		mountCount    = uint16(0)
+		maxMountCount = int16(-1)
+		lastCheck     = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+		checkInterval = 180 * 24 * time.Hour
+	)
+	if err := fs.Tune(TuneOptions{LastMounted: &lastMounted, MountCount: &mountCount, MaxMountCount: &maxMountCount}); err != nil {
+		t.Fatalf("Error tuning filesystem: %v", err)
+	}
+	// fields that are not given stay as they are
+	if err := fs.Tune(TuneOptions{LastCheck: &lastCheck, CheckInterval: &checkInterval}); err != nil {
+		t.Fatalf("Error tuning filesystem: %v", err)
+	}
+	tooLong := strings.Repeat("a", 65)
+	if err := fs.Tune(TuneOptions{LastMounted: &tooLong, MountCount: &mountCount}); err == nil {
+		t.Errorf("no error for last mounted directory that is too long")
+	}
+
+	fs, err = Read(file.New(f, true), size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	expected := Info{
+		LastMounted:   lastMounted,
+		MountCount:    mountCount,
+		MaxMountCount: maxMountCount,
+		LastCheck:     lastCheck,
+		CheckInterval: checkInterval,
+	}
+	info := fs.Info()
+	if !info.LastCheck.Equal(expected.LastCheck) {
+		t.Errorf("mismatched last check, expected %v got %v", expected.LastCheck, info.LastCheck)
+	}
+	info.LastCheck = expected.LastCheck
+	if diff := deep.Equal(info, expected); diff != nil {
+		t.Errorf("mismatched info: %v", diff)
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("tuned filesystem is not consistent: %v", err)
+	}
+}
+
 // copy infile to outfile
 func testCopyFile(infile, outfile string) error {
 	in, err := os.Open(infile)
@@ -308,6 +774,134 @@ func TestRm(t *testing.T) {
 	}
 }
 
+// discardRecorder a backend that records the ranges it is told to discard, without discarding them
+type discardRecorder struct {
+	backend.Storage
+	discarded [][2]int64
+}
+
+func (d *discardRecorder) Discard(off, length int64) error {
+	d.discarded = append(d.discarded, [2]int64{off, length})
+	return nil
+}
+
+func TestRmDiscards(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := &discardRecorder{Storage: file.New(f, false)}
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	_, entry, err := fs.getEntryAndParent("/random.dat")
+	if err != nil {
+		t.Fatalf("Error finding file: %v", err)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		t.Fatalf("Error reading inode: %v", err)
+	}
+	exts, err := in.extents.blocks(fs)
+	if err != nil {
+		t.Fatalf("Error reading extents: %v", err)
+	}
+	blocksize := int64(fs.superblock.blockSize)
+	var expected [][2]int64
+	for _, e := range exts {
+		expected = append(expected, [2]int64{int64(e.startingBlock) * blocksize, int64(e.count) * blocksize})
+	}
+
+	// the blocks are still used by the hard link to the file, until it is removed too
+	if err := fs.Remove("/random.dat"); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+	if len(b.discarded) != 0 {
+		t.Errorf("removing a file that has another link discarded %v", b.discarded)
+	}
+	if err := fs.Remove("/hardlink.dat"); err != nil {
+		t.Fatalf("Error removing hard link: %v", err)
+	}
+	for _, r := range expected {
+		if !slices.Contains(b.discarded, r) {
+			t.Errorf("blocks of %d bytes at %d were not discarded, discarded %v", r[1], r[0], b.discarded)
+		}
+	}
+
+	// a removal that fails discards nothing
+	b.discarded = nil
+	if err := fs.Remove("/foo"); err == nil {
+		t.Fatalf("Removing non-empty directory succeeded")
+	}
+	if len(b.discarded) != 0 {
+		t.Errorf("failed removal discarded %v", b.discarded)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		oldpath string
+		newpath string
+		err     error
+	}{
+		{"nonexistent file", "/foo/nonexistent.dat", "/foo/other.dat", errors.New("file does not exist")},
+		{"root dir", "/", "/bar", errors.New("cannot rename /")},
+		{"file in same dir", "/random.dat", "/renamed.dat", nil},
+		{"file to subdir", "/random.dat", "/foo/random.dat", nil},
+		{"file over existing file", "/foo/subdirfile.txt", "/random.dat", nil},
+		{"file over existing dir", "/random.dat", "/foo", errors.New("cannot replace directory /foo")},
+		{"dir to other dir", "/foo/dir1", "/dir1", nil},
+		{"dir into itself", "/foo", "/foo/dir1/foo", errors.New("cannot move directory /foo into itself")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outfile := testCreateImgCopy(t)
+			f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Error opening test image: %v", err)
+			}
+			defer f.Close()
+
+			b := file.New(f, false)
+			fs, err := Read(b, 100*MB, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading filesystem: %v", err)
+			}
+			var before os.FileInfo
+			if tt.err == nil {
+				if before, err = fs.Stat(tt.oldpath); err != nil {
+					t.Fatalf("Error getting file info before rename: %v", err)
+				}
+			}
+			err = fs.Rename(tt.oldpath, tt.newpath)
+			switch {
+			case err != nil && tt.err == nil:
+				t.Fatalf("unexpected error renaming file: %v", err)
+			case err == nil && tt.err != nil:
+				t.Fatalf("missing expected error renaming file: %v", tt.err)
+			case err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error()):
+				t.Fatalf("mismatched error renaming file, expected '%v' got '%v'", tt.err, err)
+			case err == nil:
+				if _, err := fs.Stat(tt.oldpath); err == nil {
+					t.Errorf("expected %s to be gone after rename", tt.oldpath)
+				}
+				after, err := fs.Stat(tt.newpath)
+				if err != nil {
+					t.Fatalf("Error getting file info after rename: %v", err)
+				}
+				if after.Size() != before.Size() || after.IsDir() != before.IsDir() {
+					t.Errorf("mismatched file after rename, expected size %d dir %v, got size %d dir %v", before.Size(), before.IsDir(), after.Size(), after.IsDir())
+				}
+			}
+		})
+	}
+}
+
 func TestTruncateFile(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -371,29 +965,442 @@ func TestTruncateFile(t *testing.T) {
 	}
 }
 
-func TestMkdir(t *testing.T) {
-	tests := []struct {
-		name string
-		path string
-		err  error
-	}{
-		{"parent exists", "/foo/bar", nil},
-		{"parent does not exist", "/baz/bar", nil},
-		{"parent is file", "/random.dat/bar", errors.New("cannot create directory at")},
-		{"path exists", "/foo", nil},
+func TestXattr(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			outfile := testCreateImgCopy(t)
-			f, err := os.OpenFile(outfile, os.O_RDWR, 0)
-			if err != nil {
-				t.Fatalf("Error opening test image: %v", err)
-			}
-			defer f.Close()
+	defer f.Close()
 
-			b := file.New(f, false)
-			fs, err := Read(b, 100*MB, 0, 512)
-			if err != nil {
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	const p = "/random.dat"
+	// small ones fit in the inode, the large one needs the block
+	attrs := map[string][]byte{
+		"security.selinux": []byte("system_u:object_r:bin_t:s0\x00"),
+		"user.comment":     []byte("hello"),
+		"user.large":       bytes.Repeat([]byte{0xab}, 900),
+		"trusted.empty":    {},
+	}
+	for name, value := range attrs {
+		if err := fs.Setxattr(p, name, value); err != nil {
+			t.Fatalf("Error setting %s: %v", name, err)
+		}
+	}
+	if err := fs.Setxattr(p, "user.comment", []byte("replaced")); err != nil {
+		t.Fatalf("Error replacing user.comment: %v", err)
+	}
+	attrs["user.comment"] = []byte("replaced")
+	if err := fs.Setxattr(p, "unknown.name", nil); err == nil {
+		t.Errorf("missing expected error setting attribute in unknown namespace")
+	}
+
+	// read them back from a fresh copy of the filesystem
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	names, err := fs.Listxattr(p)
+	if err != nil {
+		t.Fatalf("Error listing attributes: %v", err)
+	}
+	slices.Sort(names)
+	expected := make([]string, 0, len(attrs))
+	for name := range attrs {
+		expected = append(expected, name)
+	}
+	slices.Sort(expected)
+	if !slices.Equal(names, expected) {
+		t.Errorf("mismatched attributes, expected %v got %v", expected, names)
+	}
+	for name, value := range attrs {
+		got, err := fs.Getxattr(p, name)
+		if err != nil {
+			t.Fatalf("Error getting %s: %v", name, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("mismatched value of %s, expected %q got %q", name, value, got)
+		}
+	}
+
+	if err := fs.Removexattr(p, "user.large"); err != nil {
+		t.Fatalf("Error removing user.large: %v", err)
+	}
+	if _, err := fs.Getxattr(p, "user.large"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("expected ErrNoXattr for removed attribute, got %v", err)
+	}
+	if err := fs.Removexattr(p, "user.large"); !errors.Is(err, ErrNoXattr) {
+		t.Errorf("expected ErrNoXattr removing missing attribute, got %v", err)
+	}
+	if got, err := fs.Getxattr(p, "user.comment"); err != nil || !bytes.Equal(got, attrs["user.comment"]) {
+		t.Errorf("mismatched user.comment after removing another attribute, got %q, %v", got, err)
+	}
+}
+
+func TestXattrSharing(t *testing.T) {
+	outfile := filepath.Join(t.TempDir(), "ext4.img")
+	f, err := os.Create(outfile)
+	if err != nil {
+		t.Fatalf("Error creating image: %v", err)
+	}
+	defer f.Close()
+	const size = 20 * MB
+	b := file.New(f, false)
+	fs, err := Create(b, size, 0, 512, &Params{Checksum: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	paths := []string{"/a", "/b", "/c"}
+	label := []byte("system_u:object_r:bin_t:s0\x00")
+	large := bytes.Repeat([]byte{0xcd}, 900)
+	for _, p := range paths {
+		if _, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Error creating %s: %v", p, err)
+		}
+		if err := fs.Setxattr(p, "security.selinux", label); err != nil {
+			t.Fatalf("Error setting label of %s: %v", p, err)
+		}
+	}
+	xattrBlock := func(p string) uint64 {
+		t.Helper()
+		in, err := fs.xattrInode(p)
+		if err != nil {
+			t.Fatalf("Error reading inode of %s: %v", p, err)
+		}
+		return in.extendedAttributeBlock
+	}
+	// a label fits in the inode
+	if block := xattrBlock("/a"); block != 0 {
+		t.Errorf("label was put in block %d rather than the inode", block)
+	}
+	free := fs.Usage().Free
+
+	// the same attributes in the block share it
+	for _, p := range paths {
+		if err := fs.Setxattr(p, "user.large", large); err != nil {
+			t.Fatalf("Error setting large attribute of %s: %v", p, err)
+		}
+	}
+	shared := xattrBlock("/a")
+	if shared == 0 || xattrBlock("/b") != shared || xattrBlock("/c") != shared {
+		t.Errorf("files with the same attributes do not share a block: %d, %d, %d", shared, xattrBlock("/b"), xattrBlock("/c"))
+	}
+	if used := free - fs.Usage().Free; used != int64(fs.superblock.blockSize) {
+		t.Errorf("shared attributes used %d bytes instead of a block of %d", used, fs.superblock.blockSize)
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent with a shared block: %v", err)
+	}
+
+	// changing one of them gives it a copy, which the others do not see
+	if err := fs.Setxattr("/b", "user.large", large[:800]); err != nil {
+		t.Fatalf("Error changing large attribute of /b: %v", err)
+	}
+	if block := xattrBlock("/b"); block == shared || block == 0 {
+		t.Errorf("changed attributes are in block %d, not a copy of %d", block, shared)
+	}
+	for p, expected := range map[string][]byte{"/a": large, "/b": large[:800], "/c": large} {
+		if value, err := fs.Getxattr(p, "user.large"); err != nil || !bytes.Equal(value, expected) {
+			t.Errorf("large attribute of %s is %d bytes instead of %d, error %v", p, len(value), len(expected), err)
+		}
+	}
+	// changing it back shares the block again
+	if err := fs.Setxattr("/b", "user.large", large); err != nil {
+		t.Fatalf("Error changing large attribute of /b back: %v", err)
+	}
+	if block := xattrBlock("/b"); block != shared {
+		t.Errorf("attributes changed back are in block %d rather than shared %d", block, shared)
+	}
+	if used := free - fs.Usage().Free; used != int64(fs.superblock.blockSize) {
+		t.Errorf("copy of the block was not freed, %d bytes used", used)
+	}
+
+	// removing the files lets go of the block, and only the last frees it
+	for _, p := range paths[:2] {
+		if err := fs.Remove(p); err != nil {
+			t.Fatalf("Error removing %s: %v", p, err)
+		}
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent after removing files: %v", err)
+	}
+	if value, err := fs.Getxattr("/c", "user.large"); err != nil || !bytes.Equal(value, large) {
+		t.Errorf("large attribute of /c lost after removing the others, error %v", err)
+	}
+	if err := fs.Removexattr("/c", "user.large"); err != nil {
+		t.Fatalf("Error removing large attribute of /c: %v", err)
+	}
+	if block := xattrBlock("/c"); block != 0 {
+		t.Errorf("file without attributes in a block still has block %d", block)
+	}
+
+	// a fresh read of the filesystem finds the block to share on disk
+	if err := fs.Setxattr("/c", "user.large", large); err != nil {
+		t.Fatalf("Error setting large attribute of /c: %v", err)
+	}
+	fs, err = Read(b, size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	if _, err := fs.Getxattr("/c", "user.large"); err != nil {
+		t.Fatalf("Error getting large attribute of /c: %v", err)
+	}
+	if _, err := fs.OpenFile("/d", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatalf("Error creating /d: %v", err)
+	}
+	if err := fs.Setxattr("/d", "user.large", large); err != nil {
+		t.Fatalf("Error setting large attribute of /d: %v", err)
+	}
+	if xattrBlock("/d") != xattrBlock("/c") {
+		t.Errorf("block read from disk was not shared")
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent: %v", err)
+	}
+}
+
+func TestMknodLink(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	tests := []struct {
+		path         string
+		mode         uint32
+		dev          int
+		ft           fileType
+		device       uint32
+		major, minor uint32
+	}{
+		// /dev/null is 1:3, /dev/sda 8:0 and /dev/nvme0n1 259:0, which needs the new encoding
+		{"/null", 0o20666, 0x103, fileTypeCharacterDevice, 0x103, 1, 3},
+		{"/sda", 0o60660, 0x800, fileTypeBlockDevice, 0x800, 8, 0},
+		{"/nvme0n1", 0o60660, 0x10300, fileTypeBlockDevice, 0x10300, 259, 0},
+		{"/fifo", 0o10644, 0, fileTypeFifo, 0, 0, 0},
+		{"/socket", 0o140755, 0, fileTypeSocket, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if err := fs.Mknod(tt.path, tt.mode, tt.dev); err != nil {
+			t.Fatalf("Error creating %s: %v", tt.path, err)
+		}
+	}
+	if err := fs.Mknod("/null", 0o20666, 0x103); err == nil {
+		t.Errorf("missing expected error creating node that exists")
+	}
+	if err := fs.Link("/random.dat", "/foo/link.dat"); err != nil {
+		t.Fatalf("Error linking file: %v", err)
+	}
+	if err := fs.Link("/foo", "/foolink"); err == nil {
+		t.Errorf("missing expected error linking directory")
+	}
+
+	// read them back from a fresh copy of the filesystem
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	for _, tt := range tests {
+		fi, err := fs.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Error getting info of %s: %v", tt.path, err)
+		}
+		in, err := fs.readInode(fi.Sys().(*FileInfo).Inode())
+		if err != nil {
+			t.Fatalf("Error reading inode of %s: %v", tt.path, err)
+		}
+		if in.fileType != tt.ft || in.device != tt.device {
+			t.Errorf("%s: mismatched type and device, expected %#x %#x got %#x %#x", tt.path, tt.ft, tt.device, in.fileType, in.device)
+		}
+		if major, minor := fi.Sys().(*FileInfo).Device(); major != tt.major || minor != tt.minor {
+			t.Errorf("%s: mismatched device numbers, expected %d:%d got %d:%d", tt.path, tt.major, tt.minor, major, minor)
+		}
+		if perm := uint32(fi.Mode().Perm()); perm != tt.mode&0o777 {
+			t.Errorf("%s: mismatched permissions, expected %o got %o", tt.path, tt.mode&0o777, perm)
+		}
+		if _, err := fs.OpenFile(tt.path, os.O_RDONLY); err == nil {
+			t.Errorf("%s: missing expected error opening special file", tt.path)
+		}
+	}
+	original, err := fs.Stat("/random.dat")
+	if err != nil {
+		t.Fatalf("Error getting info of original file: %v", err)
+	}
+	link, err := fs.Stat("/foo/link.dat")
+	if err != nil {
+		t.Fatalf("Error getting info of link: %v", err)
+	}
+	if original.Sys().(*FileInfo).Inode() != link.Sys().(*FileInfo).Inode() {
+		t.Errorf("link does not share the inode of the original file")
+	}
+	// random.dat already had a hard link in the fixture
+	if nlink := link.Sys().(*FileInfo).Nlink(); nlink != 3 {
+		t.Errorf("mismatched links, expected 3 got %d", nlink)
+	}
+}
+
+func TestChmodChown(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	if err := fs.Chmod("/foo", 0o1777|os.ModeSticky); err != nil {
+		t.Fatalf("Error changing mode of directory: %v", err)
+	}
+	// through the symlink, to random.dat
+	if err := fs.Chmod("/symlink.dat", 0o4750|os.ModeSetuid|os.ModeSetgid); err != nil {
+		t.Fatalf("Error changing mode of file: %v", err)
+	}
+	if err := fs.Chown("/symlink.dat", 1000, -1); err != nil {
+		t.Fatalf("Error changing owner of file: %v", err)
+	}
+	if err := fs.Chown("/random.dat", -1, 100); err != nil {
+		t.Fatalf("Error changing group of file: %v", err)
+	}
+	if err := fs.Chown("/random.dat", -2, 0); err == nil {
+		t.Errorf("missing expected error changing owner to invalid uid")
+	}
+	if err := fs.Chmod("/deadlink", 0o644); err == nil {
+		t.Errorf("missing expected error changing mode of dead symlink")
+	}
+
+	// read them back from a fresh copy of the filesystem
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	tests := []struct {
+		path     string
+		mode     os.FileMode
+		uid, gid uint32
+	}{
+		{"/foo", os.ModeDir | os.ModeSticky | 0o777, 0, 0},
+		{"/random.dat", os.ModeSetuid | os.ModeSetgid | 0o750, 1000, 100},
+	}
+	for _, tt := range tests {
+		fi, err := fs.Stat(tt.path)
+		if err != nil {
+			t.Fatalf("Error getting info of %s: %v", tt.path, err)
+		}
+		if fi.Mode() != tt.mode {
+			t.Errorf("%s: mismatched mode, expected %v got %v", tt.path, tt.mode, fi.Mode())
+		}
+		info := fi.Sys().(*FileInfo)
+		if info.UID() != tt.uid || info.GID() != tt.gid {
+			t.Errorf("%s: mismatched owner, expected %d:%d got %d:%d", tt.path, tt.uid, tt.gid, info.UID(), info.GID())
+		}
+	}
+	// the symlink itself is unchanged
+	fi, err := fs.Stat("/symlink.dat")
+	if err != nil {
+		t.Fatalf("Error getting info of symlink: %v", err)
+	}
+	if fi.Mode() != os.ModeSymlink|0o777 || fi.Sys().(*FileInfo).UID() != 0 {
+		t.Errorf("symlink was changed, mode %v uid %d", fi.Mode(), fi.Sys().(*FileInfo).UID())
+	}
+}
+
+func TestChtimesReadlink(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	atime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 0, time.UTC)
+	// through the symlink, to random.dat
+	if err := fs.Chtimes("/symlink.dat", atime, mtime); err != nil {
+		t.Fatalf("Error changing times of file: %v", err)
+	}
+	// a zero time is left as it is
+	if err := fs.Chtimes("/foo", time.Time{}, mtime); err != nil {
+		t.Fatalf("Error changing times of directory: %v", err)
+	}
+	if err := fs.Chtimes("/deadlink", atime, mtime); err == nil {
+		t.Errorf("missing expected error changing times of dead symlink")
+	}
+
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	fi, err := fs.Stat("/random.dat")
+	if err != nil {
+		t.Fatalf("Error getting info of file: %v", err)
+	}
+	if info := fi.Sys().(*FileInfo); !info.AccessTime().Equal(atime) || !info.ModTime().Equal(mtime) {
+		t.Errorf("mismatched times, expected %v and %v got %v and %v", atime, mtime, info.AccessTime(), info.ModTime())
+	}
+	fi, err = fs.Stat("/foo")
+	if err != nil {
+		t.Fatalf("Error getting info of directory: %v", err)
+	}
+	if info := fi.Sys().(*FileInfo); info.AccessTime().Equal(atime) || !info.ModTime().Equal(mtime) {
+		t.Errorf("mismatched times, expected modification time %v got %v and access time %v", mtime, info.ModTime(), info.AccessTime())
+	}
+
+	for p, target := range map[string]string{"/symlink.dat": "random.dat", "/deadlink": "nonexistent"} {
+		if got, err := fs.Readlink(p); err != nil || got != target {
+			t.Errorf("%s: expected target %q got %q with error %v", p, target, got, err)
+		}
+	}
+	if _, err := fs.Readlink("/random.dat"); err == nil {
+		t.Errorf("missing expected error reading link of regular file")
+	}
+	if _, err := fs.Readlink("/missing"); err == nil {
+		t.Errorf("missing expected error reading link of missing file")
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		err  error
+	}{
+		{"parent exists", "/foo/bar", nil},
+		{"parent does not exist", "/baz/bar", nil},
+		{"parent is file", "/random.dat/bar", errors.New("cannot create directory at")},
+		{"path exists", "/foo", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outfile := testCreateImgCopy(t)
+			f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Error opening test image: %v", err)
+			}
+			defer f.Close()
+
+			b := file.New(f, false)
+			fs, err := Read(b, 100*MB, 0, 512)
+			if err != nil {
 				t.Fatalf("Error reading filesystem: %v", err)
 			}
 			err = fs.Mkdir(tt.path)
@@ -429,3 +1436,386 @@ func TestMkdir(t *testing.T) {
 		})
 	}
 }
+
+func TestLargeDirectory(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/large"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	// enough entries for many blocks, so that the directory gets a hash tree
+	count := 1000
+	for i := range count {
+		if _, err := fs.OpenFile(fmt.Sprintf("/large/file-%05d.txt", i), os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Error creating file %d: %v", i, err)
+		}
+	}
+	removed := "/large/file-00500.txt"
+	if err := fs.Remove(removed); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+
+	// read it back from a fresh copy of the filesystem
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	fi, err := fs.Stat("/large")
+	if err != nil {
+		t.Fatalf("Error getting info of directory: %v", err)
+	}
+	in, err := fs.readInode(fi.Sys().(*FileInfo).Inode())
+	if err != nil {
+		t.Fatalf("Error reading directory inode: %v", err)
+	}
+	if !in.flags.hashedDirectoryIndexes {
+		t.Errorf("large directory does not have a hash tree index")
+	}
+	entries, err := fs.ReadDir("/large")
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	// all but the removed one, plus . and ..
+	if len(entries) != count+1 {
+		t.Errorf("expected %d entries in directory, got %d", count+1, len(entries))
+	}
+	if _, err := fs.Stat("/large/file-00999.txt"); err != nil {
+		t.Errorf("Error getting info of file: %v", err)
+	}
+	if _, err := fs.Stat(removed); err == nil {
+		t.Errorf("removed file %s still exists", removed)
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent: %v", err)
+	}
+}
+
+func TestDefaultDirectoryIndex(t *testing.T) {
+	outfile := filepath.Join(t.TempDir(), "created.img")
+	f, err := os.Create(outfile)
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	size := int64(100 * MB)
+	fs, err := Create(file.New(f, false), size, 0, 512, nil)
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	if !fs.superblock.features.directoryIndices {
+		t.Fatalf("filesystem created with default options does not have dir_index")
+	}
+	if err := fs.Mkdir("/large"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	count := 5000
+	for i := range count {
+		if _, err := fs.OpenFile(fmt.Sprintf("/large/file-%05d.txt", i), os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Error creating file %d: %v", i, err)
+		}
+	}
+
+	fs, err = Read(file.New(f, false), size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	fi, err := fs.Stat("/large")
+	if err != nil {
+		t.Fatalf("Error getting info of directory: %v", err)
+	}
+	in, err := fs.readInode(fi.Sys().(*FileInfo).Inode())
+	if err != nil {
+		t.Fatalf("Error reading directory inode: %v", err)
+	}
+	if !in.flags.hashedDirectoryIndexes {
+		t.Fatalf("large directory does not have a hash tree index")
+	}
+	// the first block of the directory is the dx_root
+	extents, err := in.extents.blocks(fs)
+	if err != nil {
+		t.Fatalf("Error getting blocks of directory: %v", err)
+	}
+	b, err := fs.readFileBytes(extents, in.size)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	root, err := parseDirectoryTreeRoot(b[:fs.superblock.blockSize], fs.superblock.features.largeDirectory)
+	if err != nil {
+		t.Fatalf("first block of directory is not a dx_root: %v", err)
+	}
+	if len(root.entries()) < 2 {
+		t.Errorf("dx_root has %d entries, expected the directory to be split across more leaves", len(root.entries()))
+	}
+	entries, err := fs.ReadDir("/large")
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	// plus . and ..
+	if len(entries) != count+2 {
+		t.Errorf("expected %d entries in directory, got %d", count+2, len(entries))
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("filesystem is not consistent: %v", err)
+	}
+}
+
+func TestReadDirOrder(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/large"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	// enough entries for a hash tree, created out of name order
+	count := 300
+	for i := range count {
+		name := fmt.Sprintf("/large/file-%05d.txt", (i*7919)%count)
+		if _, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Error creating file %s: %v", name, err)
+		}
+	}
+	names := func(order ReadDirOrder) []string {
+		fs.SetReadDirOrder(order)
+		entries, err := fs.ReadDir("/large")
+		if err != nil {
+			t.Fatalf("Error reading directory in order %d: %v", order, err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	hashed, disk, byName := names(ReadDirOrderDefault), names(ReadDirOrderDisk), names(ReadDirOrderName)
+
+	// the same entries in each order
+	for _, n := range [][]string{hashed, disk} {
+		sorted := slices.Clone(n)
+		slices.Sort(sorted)
+		if !slices.Equal(sorted, byName) {
+			t.Fatalf("entries differ between orders")
+		}
+	}
+	if len(byName) != count+2 || byName[0] != "." || byName[1] != ".." || !slices.IsSorted(byName) {
+		t.Errorf("entries by name are not . and .. then the %d files in order: %v", count, byName)
+	}
+}
+
+func TestExtentRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		// leaves the indexes of the leaves of the tree to corrupt, besides the node above them
+		leaves []int
+	}{
+		{"interior node", nil},
+		{"interior node and leaf", []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outfile := testCreateImgCopy(t)
+			f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatalf("Error opening test image: %v", err)
+			}
+			defer f.Close()
+			fs, err := Read(file.New(f, false), 100*MB, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading filesystem: %v", err)
+			}
+			// a file with an extent per block, enough of them that the tree has leaves below an interior node
+			var (
+				blocksize = int64(fs.superblock.blockSize)
+				perLeaf   = (blocksize - int64(extentTreeHeaderLength)) / int64(extentTreeEntryLength)
+				content   = make([]byte, (4*perLeaf+10)*blocksize)
+			)
+			for i := range content {
+				content[i] = byte(i/int(blocksize) + 1)
+			}
+			fl, err := fs.OpenFile("/fragmented.dat", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Error creating file: %v", err)
+			}
+			if _, err := fl.Write(content); err != nil {
+				t.Fatalf("Error writing file: %v", err)
+			}
+			in := fl.(*File).inode
+			exts, err := in.extents.blocks(fs)
+			if err != nil {
+				t.Fatalf("Error reading extents: %v", err)
+			}
+			var split extents
+			for _, e := range exts {
+				for i := range uint64(e.count) {
+					split = append(split, extent{fileBlock: e.fileBlock + uint32(i), startingBlock: e.startingBlock + i, count: 1})
+				}
+			}
+			root, treeBlocks, err := fs.writeExtentTree(split, in.extents, in.number, in.nfsFileVersion)
+			if err != nil {
+				t.Fatalf("Error writing extent tree: %v", err)
+			}
+			in.extents = root
+			in.setBlockCount(split.blockCount()+treeBlocks, fs.superblock.blockSize)
+			if err := fs.writeInode(in); err != nil {
+				t.Fatalf("Error writing inode: %v", err)
+			}
+			if root.getDepth() != 2 {
+				t.Fatalf("extent tree has depth %d instead of 2", root.getDepth())
+			}
+
+			// corrupt the interior node, and any leaves, whose blocks of the file then read as zeros
+			interior := root.(*extentInternalNode).children[0].diskBlock
+			b, err := fs.readBlock(interior)
+			if err != nil {
+				t.Fatalf("Error reading interior node: %v", err)
+			}
+			node, err := parseExtents(b, fs.superblock.blockSize, 0, 0)
+			if err != nil {
+				t.Fatalf("Error parsing interior node: %v", err)
+			}
+			expected := slices.Clone(content)
+			for _, leaf := range tt.leaves {
+				child := node.(*extentInternalNode).children[leaf]
+				// the disk block of the first extent, which breaks the checksum
+				if _, err := f.WriteAt([]byte{0xff}, int64(child.diskBlock)*blocksize+int64(extentTreeHeaderLength)+8); err != nil {
+					t.Fatalf("Error corrupting leaf: %v", err)
+				}
+				clear(expected[int64(child.fileBlock)*blocksize : int64(child.fileBlock)*blocksize+perLeaf*blocksize])
+			}
+			if _, err := f.WriteAt(make([]byte, blocksize), int64(interior)*blocksize); err != nil {
+				t.Fatalf("Error corrupting interior node: %v", err)
+			}
+
+			if _, err := fs.OpenFile("/fragmented.dat", os.O_RDONLY); err == nil {
+				t.Fatalf("expected error opening file with corrupt extent tree without recovery")
+			}
+			fs.SetExtentRecovery(true)
+			if _, err := fs.OpenFile("/fragmented.dat", os.O_RDWR); err == nil || !strings.Contains(err.Error(), "extent tree is corrupt") {
+				t.Errorf("expected error opening salvaged file for writing, got %v", err)
+			}
+			fl, err = fs.OpenFile("/fragmented.dat", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("Error opening file with recovery: %v", err)
+			}
+			actual, err := io.ReadAll(fl)
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("salvaged file does not match, %d bytes instead of %d", len(actual), len(expected))
+			}
+		})
+	}
+}
+
+func TestExtractPaths(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening test image: %v", err)
+	}
+	defer f.Close()
+	fs, err := Read(file.New(f, false), 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	// many small files, one larger than a single read, and one with a hole
+	expected := map[string][]byte{}
+	if err := fs.Mkdir("/extract/sub"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	for i := range 40 {
+		p := fmt.Sprintf("/extract/sub/file%d", i)
+		content := bytes.Repeat([]byte{byte(i + 1)}, i*317)
+		testWriteExt4File(t, fs, p, content)
+		expected[p] = content
+	}
+	large := make([]byte, 3*maxExtractRead+100)
+	for i := range large {
+		large[i] = byte(i / 1000)
+	}
+	testWriteExt4File(t, fs, "/extract/large.dat", large)
+	expected["/extract/large.dat"] = large
+	testWriteExt4File(t, fs, "/extract/sparse.dat", []byte("start"))
+	if err := fs.Truncate("/extract/sparse.dat", 100000); err != nil {
+		t.Fatalf("Error growing file: %v", err)
+	}
+	expected["/extract/sparse.dat"] = append([]byte("start"), make([]byte, 100000-5)...)
+	if err := fs.Symlink("sub/file3", "/extract/link"); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+	if err := fs.Chmod("/extract/sub/file1", 0o640); err != nil {
+		t.Fatalf("Error changing mode: %v", err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := fs.Chtimes("/extract/sub/file2", mtime, mtime); err != nil {
+		t.Fatalf("Error changing times: %v", err)
+	}
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("Error reading random data: %v", err)
+	}
+	expected["/random.dat"] = randomData
+
+	dest := t.TempDir()
+	if err := fs.ExtractPaths(context.Background(), []string{"/extract", "random.dat", "/extract/sub/file5"}, dest, 4); err != nil {
+		t.Fatalf("Error extracting: %v", err)
+	}
+	for p, content := range expected {
+		actual, err := os.ReadFile(filepath.Join(dest, p))
+		if err != nil {
+			t.Errorf("Error reading extracted %s: %v", p, err)
+			continue
+		}
+		if !bytes.Equal(actual, content) {
+			t.Errorf("extracted %s does not match, %d bytes instead of %d", p, len(actual), len(content))
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "extract/link")); err != nil || target != "sub/file3" {
+		t.Errorf("extracted symlink points to %q (%v) instead of sub/file3", target, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "extract/sub/file1")); err != nil || info.Mode().Perm() != 0o640 {
+		t.Errorf("extracted file has mode %v (%v) instead of 0640", info.Mode(), err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "extract/sub/file2")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("extracted file has modification time %v (%v) instead of %v", info.ModTime(), err, mtime)
+	}
+
+	if err := fs.ExtractPaths(context.Background(), []string{"/does/not/exist"}, t.TempDir(), 0); err == nil {
+		t.Errorf("expected error extracting a path that does not exist")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fs.ExtractPaths(ctx, []string{"/extract"}, t.TempDir(), 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled extracting with a cancelled context, got %v", err)
+	}
+}
+
+func testWriteExt4File(t *testing.T, fs *FileSystem, p string, content []byte) {
+	t.Helper()
+	fl, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error creating %s: %v", p, err)
+	}
+	if _, err := fl.Write(content); err != nil {
+		t.Fatalf("Error writing %s: %v", p, err)
+	}
+}
@@ -3,7 +3,6 @@ package ext4
 import (
 	"encoding/binary"
 	"fmt"
-	"sort"
 )
 
 const (
@@ -366,373 +365,187 @@ func parseExtents(b []byte, blocksize, start, count uint32) (extentBlockFinder,
 	return ret, nil
 }
 
-// extendExtentTree extends extent tree with a slice of new extents
-// if the existing tree is nil, create a new one.
-// For example, if the input is an extent tree - like the kind found in an inode - and you want to add more extents to it,
-// you add the provided extents, and it expands the tree, including creating new internal nodes and writing them to disk, as needed.
-
-func extendExtentTree(existing extentBlockFinder, added *extents, fs *FileSystem, parent *extentInternalNode) (extentBlockFinder, error) {
-	// Check if existing is a leaf or internal node
-	switch node := existing.(type) {
-	case *extentLeafNode:
-		return extendLeafNode(node, added, fs, parent)
-	case *extentInternalNode:
-		return extendInternalNode(node, added, fs, parent)
-	case nil:
-		// brand new extent tree. The root is in the inode, which has a max of 4 extents.
-		return createRootExtentTree(added, fs)
-	default:
-		return nil, fmt.Errorf("unsupported extentBlockFinder type")
+// extentIndexBlocks the number of blocks outside of the inode needed to hold an extent tree with count extents,
+// where the root in the inode holds up to 4 entries and every other node fills a block
+func extentIndexBlocks(count, blocksize int64) int64 {
+	perBlock := (blocksize - int64(extentTreeHeaderLength)) / int64(extentTreeEntryLength)
+	var blocks int64
+	for count > 4 {
+		count = (count + perBlock - 1) / perBlock
+		blocks += count
 	}
+	return blocks
 }
 
-func createRootExtentTree(added *extents, fs *FileSystem) (extentBlockFinder, error) {
-	// the root always is in the inode, which has a maximum of 4 extents. If it fits within that, we can just create a leaf node.
-	if len(*added) <= 4 {
+// buildExtentTree build a complete extent tree for the given extents, which must be in order in the file.
+// The root is returned, to be stored in the inode. Any other nodes go into the given blocks, which must number
+// exactly extentIndexBlocks(len(exts), blocksize); the bytes to write to each of those blocks are returned as well.
+func buildExtentTree(exts extents, blocks []uint64, blocksize uint32) (extentBlockFinder, map[uint64][]byte, error) {
+	if need := extentIndexBlocks(int64(len(exts)), int64(blocksize)); int64(len(blocks)) != need {
+		return nil, nil, fmt.Errorf("extent tree for %d extents needs %d blocks, given %d", len(exts), need, len(blocks))
+	}
+	if len(exts) <= 4 {
 		return &extentLeafNode{
 			extentNodeHeader: extentNodeHeader{
 				depth:     0,
-				entries:   uint16(len(*added)),
+				entries:   uint16(len(exts)),
 				max:       4,
-				blockSize: fs.superblock.blockSize,
+				blockSize: blocksize,
 			},
-			extents: *added,
-		}, nil
-	}
-	// in theory, we never should be creating a root internal node. We always should be starting with an extent or two,
-	// and later expanding the file.
-	// It might be theoretically possible, though, so we will handle it in the future.
-	return nil, fmt.Errorf("cannot create root internal node")
-}
-
-func extendLeafNode(node *extentLeafNode, added *extents, fs *FileSystem, parent *extentInternalNode) (extentBlockFinder, error) {
-	// Check if the leaf node has enough space for the added extents
-	if len(node.extents)+len(*added) <= int(node.max) {
-		// Simply append the extents if there's enough space
-		node.extents = append(node.extents, *added...)
-		node.entries = uint16(len(node.extents))
-
-		// Write the updated node back to the disk
-		err := writeNodeToDisk(node, fs, parent)
-		if err != nil {
-			return nil, err
+			extents: exts,
+		}, nil, nil
+	}
+	var (
+		perBlock = (int(blocksize) - extentTreeHeaderLength) / extentTreeEntryLength
+		written  = map[uint64][]byte{}
+		children []*extentChildPtr
+		depth    uint16
+	)
+	// the bottom level of leaves
+	for i := 0; i < len(exts); i += perBlock {
+		leafExtents := exts[i:min(i+perBlock, len(exts))]
+		leaf := &extentLeafNode{
+			extentNodeHeader: extentNodeHeader{
+				depth:     0,
+				entries:   uint16(len(leafExtents)),
+				max:       uint16(perBlock),
+				blockSize: blocksize,
+			},
+			extents: leafExtents,
 		}
-
-		return node, nil
-	}
-
-	// If not enough space, split the node
-	newNodes, err := splitLeafNode(node, added, fs, parent)
-	if err != nil {
-		return nil, err
-	}
-
-	// Check if the original node was the root
-	if parent == nil {
-		// Create a new internal node to reference the split leaf nodes
-		var newNodesAsBlockFinder []extentBlockFinder
-		for _, n := range newNodes {
-			newNodesAsBlockFinder = append(newNodesAsBlockFinder, n)
+		last := leafExtents[len(leafExtents)-1]
+		children = append(children, &extentChildPtr{
+			fileBlock: leafExtents[0].fileBlock,
+			count:     last.fileBlock + uint32(last.count) - leafExtents[0].fileBlock,
+			diskBlock: blocks[0],
+		})
+		written[blocks[0]] = leaf.toBytes()
+		blocks = blocks[1:]
+	}
+	// internal levels, until the top one fits in the inode
+	for depth = 1; len(children) > 4; depth++ {
+		var parents []*extentChildPtr
+		for i := 0; i < len(children); i += perBlock {
+			nodeChildren := children[i:min(i+perBlock, len(children))]
+			node := &extentInternalNode{
+				extentNodeHeader: extentNodeHeader{
+					depth:     depth,
+					entries:   uint16(len(nodeChildren)),
+					max:       uint16(perBlock),
+					blockSize: blocksize,
+				},
+				children: nodeChildren,
+			}
+			last := nodeChildren[len(nodeChildren)-1]
+			parents = append(parents, &extentChildPtr{
+				fileBlock: nodeChildren[0].fileBlock,
+				count:     last.fileBlock + last.count - nodeChildren[0].fileBlock,
+				diskBlock: blocks[0],
+			})
+			written[blocks[0]] = node.toBytes()
+			blocks = blocks[1:]
 		}
-		newRoot := createInternalNode(newNodesAsBlockFinder, nil, fs)
-		return newRoot, nil
-	}
-
-	// If the original node was not the root, handle the parent internal node
-	parentNode, err := getParentNode(node, fs)
-	if err != nil {
-		return nil, err
-	}
-
-	return extendInternalNode(parentNode, added, fs, parent)
-}
-
-func splitLeafNode(node *extentLeafNode, added *extents, fs *FileSystem, parent *extentInternalNode) ([]*extentLeafNode, error) {
-	// Combine existing and new extents
-	allExtents := node.extents
-	allExtents = append(allExtents, *added...)
-	// Sort extents by fileBlock to maintain order
-	sort.Slice(allExtents, func(i, j int) bool {
-		return allExtents[i].fileBlock < allExtents[j].fileBlock
-	})
-
-	// Calculate the midpoint to split the extents
-	mid := len(allExtents) / 2
-
-	// Create the first new leaf node
-	firstLeaf := &extentLeafNode{
-		extentNodeHeader: extentNodeHeader{
-			depth:     0,
-			entries:   uint16(mid),
-			max:       node.max,
-			blockSize: node.blockSize,
-		},
-		extents: allExtents[:mid],
-	}
-
-	// Create the second new leaf node
-	secondLeaf := &extentLeafNode{
-		extentNodeHeader: extentNodeHeader{
-			depth:     0,
-			entries:   uint16(len(allExtents) - mid),
-			max:       node.max,
-			blockSize: node.blockSize,
-		},
-		extents: allExtents[mid:],
-	}
-
-	// Write new leaf nodes to the disk
-	err := writeNodeToDisk(firstLeaf, fs, parent)
-	if err != nil {
-		return nil, err
+		children = parents
 	}
-	err = writeNodeToDisk(secondLeaf, fs, parent)
-	if err != nil {
-		return nil, err
+	if int(depth) > extentTreeMaxDepth {
+		return nil, nil, fmt.Errorf("extent tree for %d extents is deeper than the maximum %d", len(exts), extentTreeMaxDepth)
 	}
-
-	return []*extentLeafNode{firstLeaf, secondLeaf}, nil
-}
-
-func createInternalNode(nodes []extentBlockFinder, parent *extentInternalNode, fs *FileSystem) *extentInternalNode {
-	internalNode := &extentInternalNode{
+	return &extentInternalNode{
 		extentNodeHeader: extentNodeHeader{
-			depth:     nodes[0].getDepth() + 1, // Depth is 1 more than the children
-			entries:   uint16(len(nodes)),
-			max:       nodes[0].getMax(), // Assuming uniform max for all nodes
-			blockSize: nodes[0].getBlockSize(),
+			depth:     depth,
+			entries:   uint16(len(children)),
+			max:       4,
+			blockSize: blocksize,
 		},
-		children: make([]*extentChildPtr, len(nodes)),
-	}
-
-	for i, node := range nodes {
-		internalNode.children[i] = &extentChildPtr{
-			fileBlock: node.getFileBlock(),
-			count:     node.getCount(),
-			diskBlock: getBlockNumberFromNode(node, parent),
+		children: children,
+	}, written, nil
+}
+
+// extentTreeIndexBlocks the blocks below the root of an extent tree, i.e. the ones that hold the nodes other than
+// the root, but not the file data itself
+func extentTreeIndexBlocks(node extentBlockFinder, fs *FileSystem) ([]uint64, error) {
+	internal, ok := node.(*extentInternalNode)
+	if !ok {
+		return nil, nil
+	}
+	var blocks []uint64
+	for _, child := range internal.children {
+		blocks = append(blocks, child.diskBlock)
+		// the children of depth 1 nodes are leaves, which hold no further blocks of the tree
+		if internal.depth == 1 {
+			continue
 		}
-	}
-
-	// Write the new internal node to the disk
-	err := writeNodeToDisk(internalNode, fs, parent)
-	if err != nil {
-		return nil
-	}
-
-	return internalNode
-}
-
-func getBlockNumberFromNode(node extentBlockFinder, parent *extentInternalNode) uint64 {
-	for _, childPtr := range parent.children {
-		if childPtrMatchesNode(childPtr, node) {
-			return childPtr.diskBlock
+		b, err := fs.readBlock(child.diskBlock)
+		if err != nil {
+			return nil, err
 		}
+		childNode, err := parseExtents(b, internal.blockSize, child.fileBlock, child.count)
+		if err != nil {
+			return nil, err
+		}
+		childBlocks, err := extentTreeIndexBlocks(childNode, fs)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, childBlocks...)
 	}
-	return 0 // Return 0 or an appropriate error value if the block number is not found
-}
-
-// Helper function to match a child pointer to a node
-func childPtrMatchesNode(childPtr *extentChildPtr, node extentBlockFinder) bool {
-	switch n := node.(type) {
-	case *extentLeafNode:
-		return childPtr.fileBlock == n.extents[0].fileBlock
-	case *extentInternalNode:
-		// Logic to determine if the childPtr matches the internal node
-		// Placeholder: Implement based on your specific matching criteria
-		return true
-	default:
-		return false
-	}
+	return blocks, nil
 }
 
-func extendInternalNode(node *extentInternalNode, added *extents, fs *FileSystem, parent *extentInternalNode) (extentBlockFinder, error) {
-	// Find the appropriate child node to extend
-	childIndex := findChildNode(node, added)
-	childPtr := node.children[childIndex]
-
-	// Load the actual child node from the disk
-	childNode, err := loadChildNode(childPtr, fs)
-	if err != nil {
-		return nil, err
-	}
-
-	// Recursively extend the child node
-	updatedChild, err := extendExtentTree(childNode, added, fs, node)
-	if err != nil {
-		return nil, err
-	}
-
-	// Update the current internal node to reference the updated child
-	switch updatedChild := updatedChild.(type) {
-	case *extentLeafNode:
-		node.children[childIndex] = &extentChildPtr{
-			fileBlock: updatedChild.extents[0].fileBlock,
-			count:     uint32(len(updatedChild.extents)),
-			diskBlock: getBlockNumberFromNode(updatedChild, node),
+// writeExtentTree replace the extent tree previous, which may be nil, with a new one for all of the extents of a file,
+// allocating and writing whatever blocks it needs beyond the root, which the caller stores in the inode.
+// The tree always is rebuilt whole, so the blocks of the previous tree are freed first.
+// Returns the new root and how many blocks the tree uses outside of the inode.
+// inodeNumber and inodeGeneration are those of the inode the tree is for, which seed the checksums of its blocks.
+func (fs *FileSystem) writeExtentTree(exts extents, previous extentBlockFinder, inodeNumber, inodeGeneration uint32) (extentBlockFinder, uint64, error) {
+	blocksize := fs.superblock.blockSize
+	if previous != nil {
+		oldBlocks, err := extentTreeIndexBlocks(previous, fs)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not read existing extent tree: %w", err)
 		}
-	case *extentInternalNode:
-		node.children[childIndex] = &extentChildPtr{
-			fileBlock: updatedChild.children[0].fileBlock,
-			count:     uint32(len(updatedChild.children)),
-			diskBlock: getBlockNumberFromNode(updatedChild, node),
+		for _, block := range oldBlocks {
+			if err := fs.setBlocksInUse(block, 1, false); err != nil {
+				return nil, 0, fmt.Errorf("could not free extent tree block %d: %w", block, err)
+			}
 		}
-	default:
-		return nil, fmt.Errorf("unsupported updatedChild type")
 	}
-
-	// Check if the internal node is at capacity
-	if len(node.children) > int(node.max) {
-		// Split the internal node if it's at capacity
-		newInternalNodes, err := splitInternalNode(node, node.children[childIndex], fs, parent)
+	var blocks []uint64
+	if count := extentIndexBlocks(int64(len(exts)), int64(blocksize)); count > 0 {
+		allocated, err := fs.allocateExtents(uint64(count)*uint64(blocksize), nil)
 		if err != nil {
-			return nil, err
+			return nil, 0, fmt.Errorf("could not allocate blocks for extent tree: %w", err)
 		}
-
-		// Check if the original node was the root
-		if parent == nil {
-			// Create a new internal node as the new root
-			var newNodesAsBlockFinder []extentBlockFinder
-			for _, n := range newInternalNodes {
-				newNodesAsBlockFinder = append(newNodesAsBlockFinder, n)
+		for _, e := range *allocated {
+			for i := uint64(0); i < uint64(e.count); i++ {
+				blocks = append(blocks, e.startingBlock+i)
 			}
-			newRoot := createInternalNode(newNodesAsBlockFinder, nil, fs)
-			return newRoot, nil
 		}
-
-		// If the original node was not the root, handle the parent internal node
-		return extendInternalNode(parent, added, fs, parent)
-	}
-
-	// Write the updated node back to the disk
-	err = writeNodeToDisk(node, fs, parent)
-	if err != nil {
-		return nil, err
-	}
-
-	return node, nil
-}
-
-// Helper function to get the parent node of a given internal node
-//
-//nolint:revive // this parameter will be used eventually
-func getParentNode(node extentBlockFinder, fs *FileSystem) (*extentInternalNode, error) {
-	// Logic to find and return the parent node of the given node
-	// This is a placeholder and needs to be implemented based on your specific tree structure
-	return nil, fmt.Errorf("getParentNode not implemented")
-}
-
-func splitInternalNode(node *extentInternalNode, newChild *extentChildPtr, fs *FileSystem, parent *extentInternalNode) ([]*extentInternalNode, error) {
-	// Combine existing children with the new child
-	allChildren := node.children
-	allChildren = append(allChildren, newChild)
-	// Sort children by fileBlock to maintain order
-	sort.Slice(allChildren, func(i, j int) bool {
-		return allChildren[i].fileBlock < allChildren[j].fileBlock
-	})
-
-	// Calculate the midpoint to split the children
-	mid := len(allChildren) / 2
-
-	// Create the first new internal node
-	firstInternal := &extentInternalNode{
-		extentNodeHeader: extentNodeHeader{
-			depth:     node.depth,
-			entries:   uint16(mid),
-			max:       node.max,
-			blockSize: node.blockSize,
-		},
-		children: allChildren[:mid],
-	}
-
-	// Create the second new internal node
-	secondInternal := &extentInternalNode{
-		extentNodeHeader: extentNodeHeader{
-			depth:     node.depth,
-			entries:   uint16(len(allChildren) - mid),
-			max:       node.max,
-			blockSize: node.blockSize,
-		},
-		children: allChildren[mid:],
-	}
-
-	// Write new internal nodes to the disk
-	err := writeNodeToDisk(firstInternal, fs, parent)
-	if err != nil {
-		return nil, err
 	}
-	err = writeNodeToDisk(secondInternal, fs, parent)
+	root, nodes, err := buildExtentTree(exts, blocks, blocksize)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-
-	return []*extentInternalNode{firstInternal, secondInternal}, nil
-}
-
-func writeNodeToDisk(node extentBlockFinder, fs *FileSystem, parent *extentInternalNode) error {
-	var blockNumber uint64
-	if parent != nil {
-		blockNumber = getBlockNumberFromNode(node, parent)
-	} else {
-		blockNumber = getNewBlockNumber(fs)
-	}
-
-	if blockNumber == 0 {
-		return fmt.Errorf("block number not found for node")
-	}
-
 	writableFile, err := fs.backend.Writable()
 	if err != nil {
-		return err
-	}
-
-	data := node.toBytes()
-	_, err = writableFile.WriteAt(data, int64(blockNumber)*int64(fs.superblock.blockSize))
-	return err
-}
-
-// Helper function to get a new block number when there is no parent
-//
-//nolint:revive // this parameter will be used eventually
-func getNewBlockNumber(fs *FileSystem) uint64 {
-	// Logic to allocate a new block
-	// This is a placeholder and needs to be implemented based on your specific filesystem structure
-	return 0 // Placeholder: Replace with actual implementation
-}
-
-// Helper function to find the block number of a child node from its parent
-func findChildBlockNumber(parent *extentInternalNode, child extentBlockFinder) uint64 {
-	for _, childPtr := range parent.children {
-		if childPtrMatchesNode(childPtr, child) {
-			return childPtr.diskBlock
+		return nil, 0, err
+	}
+	// with metadata checksums, each block ends in a tail with the checksum of the node, right after its
+	// maximum number of entries
+	var checksumFunc checksummer
+	if fs.superblock.features.metadataChecksums {
+		checksumFunc = directoryChecksummer(fs.superblock.checksumSeed, inodeNumber, inodeGeneration)
+	}
+	tailOffset := extentTreeHeaderLength + (int(blocksize)-extentTreeHeaderLength)/extentTreeEntryLength*extentTreeEntryLength
+	for block, b := range nodes {
+		data := make([]byte, blocksize)
+		copy(data, b)
+		if checksumFunc != nil {
+			binary.LittleEndian.PutUint32(data[tailOffset:tailOffset+4], checksumFunc(data[:tailOffset]))
 		}
-	}
-	return 0
-}
-
-func findChildNode(node *extentInternalNode, added *extents) int {
-	// Assuming added extents are sorted, find the correct child node to extend
-	addedSlice := *added
-	for i, child := range node.children {
-		if addedSlice[0].fileBlock < child.fileBlock {
-			return i - 1
+		if _, err := writableFile.WriteAt(data, fs.start+int64(block)*int64(blocksize)); err != nil {
+			return nil, 0, fmt.Errorf("could not write extent tree block %d: %w", block, err)
 		}
 	}
-	return len(node.children) - 1
-}
-
-// loadChildNode load up a child node from the disk
-//
-//nolint:unparam // this parameter will be used eventually
-func loadChildNode(childPtr *extentChildPtr, fs *FileSystem) (extentBlockFinder, error) {
-	data := make([]byte, fs.superblock.blockSize)
-	_, err := fs.backend.ReadAt(data, int64(childPtr.diskBlock)*int64(fs.superblock.blockSize))
-	if err != nil {
-		return nil, err
-	}
-
-	// Logic to decode data into an extentBlockFinder (extentLeafNode or extentInternalNode)
-	// This is a placeholder and needs to be implemented based on your specific encoding scheme
-	var node extentBlockFinder
-	// Implement the logic to decode the node from the data
-	return node, nil
+	return root, uint64(len(blocks)), nil
 }
@@ -0,0 +1,210 @@
+package ext4
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// extentScanBlocks how many blocks to read at a time when scanning the filesystem for extent tree leaves
+const extentScanBlocks = 256
+
+// fileRange a range of blocks in a file, from start up to but not including end
+type fileRange struct {
+	start, end uint64
+}
+
+// SetExtentRecovery set whether OpenFile salvages files whose extent tree has a corrupt node below the root in the
+// inode, one with a bad signature, depth or checksum, instead of failing to open them.
+//
+// The parts of the file under the intact nodes are read as usual. For the parts under a corrupt node, the filesystem
+// is scanned for leaves of the extent tree whose checksum shows they belong to the file, which needs the filesystem
+// to have metadata checksums. Anything that still cannot be found, or that more than one leaf claims, reads as zeros.
+// A file that needed salvaging can only be opened read-only.
+func (fs *FileSystem) SetExtentRecovery(enable bool) {
+	fs.extentRecovery = enable
+}
+
+// fileExtents all of the extents of the file with the given inode, salvaging what it can from a corrupt extent tree
+// if extent recovery is enabled, in which case damaged is whether it had to.
+func (fs *FileSystem) fileExtents(in *inode) (exts extents, damaged bool, err error) {
+	if !fs.extentRecovery {
+		exts, err = in.extents.blocks(fs)
+		return exts, false, err
+	}
+	var checksumFunc checksummer
+	if fs.superblock.features.metadataChecksums {
+		checksumFunc = directoryChecksummer(fs.superblock.checksumSeed, in.number, in.nfsFileVersion)
+	}
+	exts, missing := fs.salvageExtentNode(in.extents, fileRange{0, math.MaxUint32}, checksumFunc)
+	if len(missing) == 0 {
+		return exts, false, nil
+	}
+	if checksumFunc == nil {
+		return nil, true, fmt.Errorf("extent tree of inode %d is corrupt, and finding its leaves needs metadata checksums", in.number)
+	}
+	found, err := fs.scanExtentLeaves(missing, checksumFunc)
+	if err != nil {
+		return nil, true, err
+	}
+	exts = append(exts, found...)
+	slices.SortFunc(exts, func(a, b extent) int {
+		return cmp.Compare(a.fileBlock, b.fileBlock)
+	})
+	return exts, true, nil
+}
+
+// salvageExtentNode the extents below a node of an extent tree that covers the blocks of the file in r, skipping
+// any child nodes that are not valid. Returns the extents it found, and the ranges of the file that were under
+// the nodes it skipped.
+func (fs *FileSystem) salvageExtentNode(node extentBlockFinder, r fileRange, checksumFunc checksummer) (extents, []fileRange) {
+	internal, ok := node.(*extentInternalNode)
+	if !ok {
+		return node.(*extentLeafNode).extents, nil
+	}
+	var (
+		exts    extents
+		missing []fileRange
+	)
+	for i, child := range internal.children {
+		// a child covers from its first block up to the first block of the next one
+		childRange := fileRange{uint64(child.fileBlock), r.end}
+		if i+1 < len(internal.children) {
+			childRange.end = uint64(internal.children[i+1].fileBlock)
+		}
+		childNode, err := fs.readExtentNode(child.diskBlock, internal.depth-1, childRange, checksumFunc)
+		if err != nil {
+			missing = append(missing, childRange)
+			continue
+		}
+		childExtents, childMissing := fs.salvageExtentNode(childNode, childRange, checksumFunc)
+		exts = append(exts, childExtents...)
+		missing = append(missing, childMissing...)
+	}
+	return exts, missing
+}
+
+// readExtentNode read the node of an extent tree in the given block, which should be at the given depth and cover
+// blocks of the file within r, checking that it is valid
+func (fs *FileSystem) readExtentNode(block uint64, depth uint16, r fileRange, checksumFunc checksummer) (extentBlockFinder, error) {
+	if block >= fs.superblock.blockCount {
+		return nil, fmt.Errorf("extent tree block %d is beyond the end of the filesystem", block)
+	}
+	b, err := fs.readBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	node, err := validExtentNode(b, fs.superblock.blockSize, checksumFunc)
+	if err != nil {
+		return nil, fmt.Errorf("extent tree block %d: %w", block, err)
+	}
+	if node.getDepth() != depth {
+		return nil, fmt.Errorf("extent tree block %d has depth %d instead of %d", block, node.getDepth(), depth)
+	}
+	// the entries must be in order, and within the part of the file that the parent says the node covers
+	next := r.start
+	switch n := node.(type) {
+	case *extentLeafNode:
+		for _, e := range n.extents {
+			if uint64(e.fileBlock) < next || uint64(e.fileBlock)+uint64(e.count) > r.end {
+				return nil, fmt.Errorf("extent tree block %d has extents out of order or outside of its range", block)
+			}
+			next = uint64(e.fileBlock) + uint64(e.count)
+		}
+	case *extentInternalNode:
+		for _, child := range n.children {
+			if uint64(child.fileBlock) < next || uint64(child.fileBlock) >= r.end {
+				return nil, fmt.Errorf("extent tree block %d has children out of order or outside of its range", block)
+			}
+			next = uint64(child.fileBlock) + 1
+		}
+	}
+	return node, nil
+}
+
+// validExtentNode parse the node of an extent tree that fills a block, if it has a valid header, and with metadata
+// checksums, the checksum in its tail matches
+func validExtentNode(b []byte, blocksize uint32, checksumFunc checksummer) (extentBlockFinder, error) {
+	if binary.LittleEndian.Uint16(b[0:2]) != extentHeaderSignature {
+		return nil, fmt.Errorf("invalid extent tree signature: %x", b[0:2])
+	}
+	var (
+		entries  = int(binary.LittleEndian.Uint16(b[2:4]))
+		maxCount = int(binary.LittleEndian.Uint16(b[4:6]))
+		depth    = int(binary.LittleEndian.Uint16(b[6:8]))
+	)
+	if maxCount != (int(blocksize)-extentTreeHeaderLength)/extentTreeEntryLength || entries == 0 || entries > maxCount || depth > extentTreeMaxDepth {
+		return nil, fmt.Errorf("invalid extent tree header with %d of %d entries at depth %d", entries, maxCount, depth)
+	}
+	if checksumFunc != nil {
+		// the tail with the checksum is right after the maximum number of entries of the node
+		tailOffset := extentTreeHeaderLength + maxCount*extentTreeEntryLength
+		if checksum, actual := binary.LittleEndian.Uint32(b[tailOffset:tailOffset+4]), checksumFunc(b[:tailOffset]); checksum != actual {
+			return nil, fmt.Errorf("extent tree checksum %x instead of %x", checksum, actual)
+		}
+	}
+	// the range is checked by the caller, so it does not matter here
+	return parseExtents(b, blocksize, 0, 0)
+}
+
+// scanExtentLeaves scan the blocks in use in the filesystem for leaves of an extent tree with a checksum that
+// matches checksumFunc, which is that of the inode whose tree they are in, and return their extents that are within
+// the missing ranges of the file. Where extents from different leaves overlap, none of them can be trusted, so all
+// of them are left out.
+func (fs *FileSystem) scanExtentLeaves(missing []fileRange, checksumFunc checksummer) (extents, error) {
+	var (
+		sb        = fs.superblock
+		blocksize = int64(sb.blockSize)
+		found     extents
+		buf       = make([]byte, extentScanBlocks*blocksize)
+	)
+	for group := 0; group < int(sb.blockGroupCount()); group++ {
+		bitmap, err := fs.readBlockBitmap(group)
+		if err != nil {
+			return nil, fmt.Errorf("could not read block bitmap of block group %d: %w", group, err)
+		}
+		groupStart := uint64(sb.firstDataBlock) + uint64(group)*uint64(sb.blocksPerGroup)
+		groupEnd := min(groupStart+uint64(sb.blocksPerGroup), sb.blockCount)
+		for chunk := groupStart; chunk < groupEnd; chunk += extentScanBlocks {
+			count := min(extentScanBlocks, groupEnd-chunk)
+			if _, err := fs.backend.ReadAt(buf[:int64(count)*blocksize], fs.start+int64(chunk)*blocksize); err != nil {
+				return nil, fmt.Errorf("could not read blocks %d to %d: %w", chunk, chunk+count-1, err)
+			}
+			for i := uint64(0); i < count; i++ {
+				if inUse, err := bitmap.IsSet(int(chunk + i - groupStart)); err != nil || !inUse {
+					continue
+				}
+				node, err := validExtentNode(buf[int64(i)*blocksize:int64(i+1)*blocksize], sb.blockSize, checksumFunc)
+				if err != nil || node.getDepth() != 0 {
+					continue
+				}
+				for _, e := range node.(*extentLeafNode).extents {
+					start, end := uint64(e.fileBlock), uint64(e.fileBlock)+uint64(e.count)
+					if slices.ContainsFunc(missing, func(r fileRange) bool { return start >= r.start && end <= r.end }) {
+						found = append(found, e)
+					}
+				}
+			}
+		}
+	}
+	slices.SortFunc(found, func(a, b extent) int {
+		return cmp.Compare(a.fileBlock, b.fileBlock)
+	})
+	found = slices.Compact(found)
+	// drop all of the extents that overlap another one
+	var (
+		kept    extents
+		prevEnd uint64
+	)
+	for i, e := range found {
+		overlapsPrevious := i > 0 && uint64(e.fileBlock) < prevEnd
+		overlapsNext := i+1 < len(found) && uint64(found[i+1].fileBlock) < uint64(e.fileBlock)+uint64(e.count)
+		prevEnd = max(prevEnd, uint64(e.fileBlock)+uint64(e.count))
+		if !overlapsPrevious && !overlapsNext {
+			kept = append(kept, e)
+		}
+	}
+	return kept, nil
+}
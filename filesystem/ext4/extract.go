@@ -0,0 +1,382 @@
+package ext4
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// maxExtractRead the most bytes that ExtractPaths reads from the backend at once. Runs of blocks that are next to
+// each other on disk are read together up to this size, and larger extents are split into pieces of it, so that
+// the workers share the reading of a large file too.
+const maxExtractRead = 1024 * 1024
+
+// extractor the state of a single ExtractPaths. It caches the inodes and directories it has read, so that paths
+// in the same directories are resolved without reading their parents again.
+type extractor struct {
+	fs      *FileSystem
+	dest    string
+	inodes  map[uint32]*inode
+	dirs    map[uint32][]*directoryEntry
+	seen    map[string]bool
+	files   []*extractFile
+	dirList []*extractFile
+	links   []extractLink
+}
+
+// extractFile a regular file or directory to create under the destination
+type extractFile struct {
+	dest  string
+	inode *inode
+}
+
+// extractLink a symlink to create under the destination
+type extractLink struct {
+	dest   string
+	target string
+}
+
+// extractPiece a run of blocks on disk that holds the data of a file at offset, of which size bytes are wanted
+type extractPiece struct {
+	file   *extractFile
+	offset int64
+	block  uint64
+	blocks uint64
+	size   int64
+}
+
+// ExtractPaths copy the files at paths in the filesystem to the directory dest on the host, each to the same path
+// under dest, creating the directories above it. A directory is extracted with everything in it, and a symlink is
+// created as a symlink, rather than followed; other types of files, such as devices, are skipped.
+//
+// The paths are resolved first, reading each inode and directory only once, and the data of all of the files is
+// then read by workers goroutines at once, or as many as there are CPUs if it is 0 or less, in the order it is on
+// disk, with the blocks of files that are next to each other read together. This makes extracting many small files
+// from a large image much faster than opening and reading them one by one.
+//
+// Files get the permissions and modification times that they have in the filesystem once all of them are written.
+// If ctx is cancelled, it stops and returns ctx.Err(), leaving whatever was extracted so far.
+func (fs *FileSystem) ExtractPaths(ctx context.Context, paths []string, dest string, workers int) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	x := &extractor{
+		fs:     fs,
+		dest:   dest,
+		inodes: map[uint32]*inode{},
+		dirs:   map[uint32][]*directoryEntry{},
+		seen:   map[string]bool{},
+	}
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p = path.Join("/", p)
+		entry, err := x.lookup(p)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(x.destPath(p)), 0o755); err != nil {
+			return fmt.Errorf("could not create directory for %s: %w", p, err)
+		}
+		if err := x.add(ctx, p, entry.inode); err != nil {
+			return err
+		}
+	}
+
+	// the links and empty files come first, so that the workers only have to open files to write into them
+	for _, l := range x.links {
+		if err := os.Symlink(l.target, l.dest); err != nil {
+			return fmt.Errorf("could not create symlink %s: %w", l.dest, err)
+		}
+	}
+	var pieces []extractPiece
+	for _, f := range x.files {
+		out, err := os.OpenFile(f.dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("could not create %s: %w", f.dest, err)
+		}
+		// blocks in no extent are holes, which stay zeros, as the file is made its full size here
+		err = out.Truncate(int64(f.inode.size))
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("could not set size of %s: %w", f.dest, err)
+		}
+		filePieces, err := x.pieces(f)
+		if err != nil {
+			return err
+		}
+		pieces = append(pieces, filePieces...)
+	}
+	if err := x.read(ctx, pieces, workers); err != nil {
+		return err
+	}
+
+	for _, f := range x.files {
+		if err := setExtractedAttributes(f); err != nil {
+			return err
+		}
+	}
+	// deepest first, so that a directory without write permission is only made so once all below it is done
+	for i := len(x.dirList) - 1; i >= 0; i-- {
+		if err := setExtractedAttributes(x.dirList[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destPath where the file at p in the filesystem is extracted to
+func (x *extractor) destPath(p string) string {
+	return filepath.Join(x.dest, filepath.FromSlash(p))
+}
+
+// readInode read an inode, or return it from the cache
+func (x *extractor) readInode(number uint32) (*inode, error) {
+	if in, ok := x.inodes[number]; ok {
+		return in, nil
+	}
+	in, err := x.fs.readInode(number)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d: %w", number, err)
+	}
+	x.inodes[number] = in
+	return in, nil
+}
+
+// readDirectory read the entries of a directory, or return them from the cache
+func (x *extractor) readDirectory(number uint32) ([]*directoryEntry, error) {
+	if entries, ok := x.dirs[number]; ok {
+		return entries, nil
+	}
+	entries, err := x.fs.readDirectory(number)
+	if err != nil {
+		return nil, err
+	}
+	x.dirs[number] = entries
+	return entries, nil
+}
+
+// lookup the directory entry of the clean, absolute path p
+func (x *extractor) lookup(p string) (*directoryEntry, error) {
+	entry := &directoryEntry{inode: rootInode, fileType: dirFileTypeDirectory}
+	for i, name := range splitPath(p) {
+		if entry.fileType != dirFileTypeDirectory {
+			return nil, fmt.Errorf("%s is not a directory", "/"+path.Join(splitPath(p)[:i]...))
+		}
+		entries, err := x.readDirectory(entry.inode)
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %w", "/"+path.Join(splitPath(p)[:i]...), err)
+		}
+		found := false
+		for _, e := range entries {
+			if e.filename == name {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("file does not exist: %s", p)
+		}
+	}
+	return entry, nil
+}
+
+// add the file at p, whose inode is number, to what is to be extracted, and everything in it if it is a directory
+func (x *extractor) add(ctx context.Context, p string, number uint32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dest := x.destPath(p)
+	if x.seen[dest] {
+		return nil
+	}
+	x.seen[dest] = true
+	in, err := x.readInode(number)
+	if err != nil {
+		return err
+	}
+	switch in.fileType {
+	case fileTypeRegularFile:
+		if in.flags.inlineData || in.extents == nil {
+			return fmt.Errorf("cannot extract %s: its data is not in extents", p)
+		}
+		x.files = append(x.files, &extractFile{dest: dest, inode: in})
+	case fileTypeSymbolicLink:
+		x.links = append(x.links, extractLink{dest: dest, target: in.linkTarget})
+	case fileTypeDirectory:
+		// writable until all in it is extracted, see ExtractPaths
+		if err := os.MkdirAll(dest, 0o700); err != nil {
+			return fmt.Errorf("could not create directory %s: %w", dest, err)
+		}
+		x.dirList = append(x.dirList, &extractFile{dest: dest, inode: in})
+		entries, err := x.readDirectory(number)
+		if err != nil {
+			return fmt.Errorf("could not read directory %s: %w", p, err)
+		}
+		for _, e := range entries {
+			if e.filename == "." || e.filename == ".." {
+				continue
+			}
+			if err := x.add(ctx, path.Join(p, e.filename), e.inode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pieces the runs of blocks that hold the data of f, with extents that follow each other both in the file and on
+// disk joined, and split to at most maxExtractRead bytes
+func (x *extractor) pieces(f *extractFile) ([]extractPiece, error) {
+	exts, _, err := x.fs.fileExtents(f.inode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read extent tree for inode %d: %w", f.inode.number, err)
+	}
+	var (
+		blocksize = int64(x.fs.superblock.blockSize)
+		size      = int64(f.inode.size)
+		perPiece  = uint64(maxExtractRead / blocksize)
+		pieces    []extractPiece
+	)
+	for i := 0; i < len(exts); {
+		e := exts[i]
+		blocks := uint64(e.count)
+		for i++; i < len(exts); i++ {
+			next := exts[i]
+			if uint64(next.fileBlock) != uint64(e.fileBlock)+blocks || next.startingBlock != e.startingBlock+blocks {
+				break
+			}
+			blocks += uint64(next.count)
+		}
+		for done := uint64(0); done < blocks; done += perPiece {
+			offset := (int64(e.fileBlock) + int64(done)) * blocksize
+			if offset >= size {
+				break
+			}
+			n := min(perPiece, blocks-done)
+			pieces = append(pieces, extractPiece{
+				file:   f,
+				offset: offset,
+				block:  e.startingBlock + done,
+				blocks: n,
+				size:   min(int64(n)*blocksize, size-offset),
+			})
+		}
+	}
+	return pieces, nil
+}
+
+// read the pieces in the order they are on disk with workers goroutines, reading those next to each other on disk
+// at once, and write each to its file
+func (x *extractor) read(ctx context.Context, pieces []extractPiece, workers int) error {
+	slices.SortFunc(pieces, func(a, b extractPiece) int {
+		return cmp.Compare(a.block, b.block)
+	})
+	var (
+		blocksize = int64(x.fs.superblock.blockSize)
+		batches   [][]extractPiece
+	)
+	for i := 0; i < len(pieces); {
+		j := i + 1
+		for size := pieces[i].blocks; j < len(pieces); j++ {
+			prev, next := pieces[j-1], pieces[j]
+			if next.block != prev.block+prev.blocks || int64(size+next.blocks)*blocksize > maxExtractRead {
+				break
+			}
+			size += next.blocks
+		}
+		batches = append(batches, pieces[i:j])
+		i = j
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	work := make(chan []extractPiece)
+	for i := 0; i < min(workers, len(batches)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range work {
+				if err := x.readBatch(batch); err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	for _, batch := range batches {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case work <- batch:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// readBatch read the pieces in batch, which are next to each other on disk, from the backend at once, and write
+// each to its file
+func (x *extractor) readBatch(batch []extractPiece) error {
+	var (
+		blocksize = int64(x.fs.superblock.blockSize)
+		first     = batch[0]
+		last      = batch[len(batch)-1]
+		start     = int64(first.block) * blocksize
+		b         = make([]byte, int64(last.block)*blocksize+last.size-start)
+	)
+	n, err := x.fs.backend.ReadAt(b, x.fs.start+start)
+	if err != nil && n < len(b) {
+		return fmt.Errorf("could not read blocks %d to %d: %w", first.block, last.block+last.blocks-1, err)
+	}
+	for _, p := range batch {
+		out, err := os.OpenFile(p.file.dest, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %w", p.file.dest, err)
+		}
+		pos := int64(p.block)*blocksize - start
+		_, err = out.WriteAt(b[pos:pos+p.size], p.offset)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("could not write %s: %w", p.file.dest, err)
+		}
+	}
+	return nil
+}
+
+// setExtractedAttributes give an extracted file or directory the permissions and modification time of its inode
+func setExtractedAttributes(f *extractFile) error {
+	if err := os.Chmod(f.dest, f.inode.fileMode().Perm()); err != nil {
+		return fmt.Errorf("could not set permissions of %s: %w", f.dest, err)
+	}
+	if err := os.Chtimes(f.dest, f.inode.accessTime, f.inode.modifyTime); err != nil {
+		return fmt.Errorf("could not set times of %s: %w", f.dest, err)
+	}
+	return nil
+}
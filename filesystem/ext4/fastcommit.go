@@ -0,0 +1,515 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+)
+
+// fast commits are a compact log of metadata changes, written to a separate area at the end of the journal,
+// that the kernel replays after the regular journal transactions.
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/journal.html#fast-commits
+type fastCommitTag uint16
+
+const (
+	fastCommitTagAddRange fastCommitTag = 0x1
+	fastCommitTagDelRange fastCommitTag = 0x2
+	fastCommitTagCreate   fastCommitTag = 0x3
+	fastCommitTagLink     fastCommitTag = 0x4
+	fastCommitTagUnlink   fastCommitTag = 0x5
+	fastCommitTagInode    fastCommitTag = 0x6
+	fastCommitTagPad      fastCommitTag = 0x7
+	fastCommitTagTail     fastCommitTag = 0x8
+	fastCommitTagHead     fastCommitTag = 0x9
+
+	fastCommitTagHeaderLength   int    = 4
+	fastCommitDentryInfoLength  int    = 8
+	fastCommitMaxNameLength     int    = 255
+	fastCommitSupportedFeatures uint32 = 0
+	// extents longer than this are unwritten, i.e. preallocated
+	maxInitializedExtentLength uint32 = 32768
+)
+
+func (t fastCommitTag) String() string {
+	switch t {
+	case fastCommitTagAddRange:
+		return "add_range"
+	case fastCommitTagDelRange:
+		return "del_range"
+	case fastCommitTagCreate:
+		return "create"
+	case fastCommitTagLink:
+		return "link"
+	case fastCommitTagUnlink:
+		return "unlink"
+	case fastCommitTagInode:
+		return "inode"
+	case fastCommitTagPad:
+		return "pad"
+	case fastCommitTagTail:
+		return "tail"
+	case fastCommitTagHead:
+		return "head"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint16(t))
+	}
+}
+
+// fastCommitRecord a single change recorded in the fast commit area
+type fastCommitRecord struct {
+	tag   fastCommitTag
+	inode uint32
+	// for create, link and unlink
+	parent uint32
+	name   string
+	// for add_range and del_range
+	fileBlock     uint32
+	count         uint32
+	startingBlock uint64
+	unwritten     bool
+	// for inode, the raw on-disk inode
+	rawInode []byte
+}
+
+// fastCommitScanner scan the fast commit area block by block, the same way as the kernel does.
+// Records only are valid once a tail with the expected transaction and a matching checksum follows them.
+type fastCommitScanner struct {
+	sequence  uint32
+	inodeSize int
+	crc       uint32
+	pending   []fastCommitRecord
+	valid     []fastCommitRecord
+	done      bool
+}
+
+// validLength whether the length of a tag's value is valid for the tag
+func (s *fastCommitScanner) validLength(tag fastCommitTag, length int) bool {
+	switch tag {
+	case fastCommitTagAddRange:
+		return length == 16
+	case fastCommitTagDelRange:
+		return length == 12
+	case fastCommitTagCreate, fastCommitTagLink, fastCommitTagUnlink:
+		nameLength := length - fastCommitDentryInfoLength
+		return nameLength >= 1 && nameLength <= fastCommitMaxNameLength
+	case fastCommitTagInode:
+		inodeLength := length - 4
+		return inodeLength >= int(ext2InodeSize) && inodeLength <= s.inodeSize
+	case fastCommitTagPad:
+		return true
+	case fastCommitTagTail:
+		return length >= 8
+	case fastCommitTagHead:
+		return length == 8
+	default:
+		return false
+	}
+}
+
+// scan process a single block of the fast commit area. Sets done when there is nothing further to replay.
+func (s *fastCommitScanner) scan(b []byte) error {
+	for offset := 0; offset+fastCommitTagHeaderLength <= len(b) && !s.done; {
+		tag := fastCommitTag(binary.LittleEndian.Uint16(b[offset : offset+2]))
+		length := int(binary.LittleEndian.Uint16(b[offset+2 : offset+4]))
+		valueStart := offset + fastCommitTagHeaderLength
+		if length > len(b)-valueStart || !s.validLength(tag, length) {
+			s.done = true
+			break
+		}
+		value := b[valueStart : valueStart+length]
+		record := fastCommitRecord{tag: tag}
+		switch tag {
+		case fastCommitTagHead:
+			if features := binary.LittleEndian.Uint32(value[0:4]); features&^fastCommitSupportedFeatures != 0 {
+				return fmt.Errorf("fast commit area has unsupported features %#x: %w", features, filesystem.ErrNotSupported)
+			}
+			// a head from an older transaction means the fast commit area is stale
+			if binary.LittleEndian.Uint32(value[4:8]) != s.sequence {
+				s.done = true
+				continue
+			}
+		case fastCommitTagTail:
+			s.crc = crc.CRC32c(s.crc, b[offset:valueStart+4])
+			if binary.LittleEndian.Uint32(value[0:4]) != s.sequence || binary.LittleEndian.Uint32(value[4:8]) != s.crc {
+				s.done = true
+				continue
+			}
+			s.valid = append(s.valid, s.pending...)
+			s.pending = nil
+			s.crc = 0
+			offset = valueStart + length
+			continue
+		case fastCommitTagAddRange:
+			record.inode = binary.LittleEndian.Uint32(value[0:4])
+			record.fileBlock = binary.LittleEndian.Uint32(value[4:8])
+			record.count = uint32(binary.LittleEndian.Uint16(value[8:10]))
+			if record.count > maxInitializedExtentLength {
+				record.count -= maxInitializedExtentLength
+				record.unwritten = true
+			}
+			record.startingBlock = uint64(binary.LittleEndian.Uint16(value[10:12]))<<32 | uint64(binary.LittleEndian.Uint32(value[12:16]))
+		case fastCommitTagDelRange:
+			record.inode = binary.LittleEndian.Uint32(value[0:4])
+			record.fileBlock = binary.LittleEndian.Uint32(value[4:8])
+			record.count = binary.LittleEndian.Uint32(value[8:12])
+		case fastCommitTagCreate, fastCommitTagLink, fastCommitTagUnlink:
+			record.parent = binary.LittleEndian.Uint32(value[0:4])
+			record.inode = binary.LittleEndian.Uint32(value[4:8])
+			record.name = string(value[fastCommitDentryInfoLength:])
+		case fastCommitTagInode:
+			record.inode = binary.LittleEndian.Uint32(value[0:4])
+			record.rawInode = make([]byte, length-4)
+			copy(record.rawInode, value[4:])
+		}
+		s.crc = crc.CRC32c(s.crc, b[offset:valueStart+length])
+		if tag != fastCommitTagHead && tag != fastCommitTagPad {
+			s.pending = append(s.pending, record)
+		}
+		offset = valueStart + length
+	}
+	return nil
+}
+
+// fastCommits read the valid fast commit records for the transaction with the given sequence number,
+// which is the one following the last committed transaction in the log.
+func (j *journal) fastCommits(sequence uint32) ([]fastCommitRecord, error) {
+	first, last := j.superblock.fastCommitArea()
+	s := &fastCommitScanner{sequence: sequence, inodeSize: int(j.fs.superblock.inodeSize)}
+	for block := first; block < last && !s.done; block++ {
+		b, err := j.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.scan(b); err != nil {
+			return nil, err
+		}
+	}
+	return s.valid, nil
+}
+
+// FastCommitInfo information about fast commits in the journal that have not been replayed
+type FastCommitInfo struct {
+	// Transaction the journal transaction to which the fast commits belong
+	Transaction uint32
+	// Records how many changes are recorded, by type of change
+	Records map[string]int
+	// Inodes the inodes that are changed
+	Inodes []uint32
+}
+
+// FastCommits returns information about fast commit records in the journal that still need to be
+// replayed, or nil if there are none. Fast commits only are left behind by kernels that had the
+// fast_commit feature enabled and did not unmount the filesystem cleanly, e.g. an image taken
+// of a live system. Until they are replayed with ReplayJournal, the directory tree and file contents
+// that are read may be out of date.
+func (fs *FileSystem) FastCommits() (*FastCommitInfo, error) {
+	if !fs.superblock.features.hasJournal || !fs.superblock.features.fastCommit {
+		return nil, nil
+	}
+	j, err := fs.readJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j.superblock.start == 0 || !j.superblock.hasFeature(journalFeatureIncompatFastCommit) {
+		return nil, nil
+	}
+	_, sequence, err := j.transactions()
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal transactions: %w", err)
+	}
+	records, err := j.fastCommits(sequence)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	info := &FastCommitInfo{
+		Transaction: sequence,
+		Records:     map[string]int{},
+	}
+	inodes := map[uint32]bool{}
+	for _, r := range records {
+		info.Records[r.tag.String()]++
+		if !inodes[r.inode] {
+			inodes[r.inode] = true
+			info.Inodes = append(info.Inodes, r.inode)
+		}
+	}
+	sort.Slice(info.Inodes, func(i, j int) bool { return info.Inodes[i] < info.Inodes[j] })
+	return info, nil
+}
+
+// replayFastCommits apply fast commit records to the filesystem, in order
+func (fs *FileSystem) replayFastCommits(records []fastCommitRecord) error {
+	for i, r := range records {
+		var err error
+		switch r.tag {
+		case fastCommitTagInode:
+			err = fs.replayFastCommitInode(r)
+		case fastCommitTagAddRange:
+			err = fs.replayFastCommitRange(r, true)
+		case fastCommitTagDelRange:
+			err = fs.replayFastCommitRange(r, false)
+		case fastCommitTagCreate, fastCommitTagLink:
+			err = fs.replayFastCommitLink(r)
+		case fastCommitTagUnlink:
+			err = fs.replayFastCommitUnlink(r)
+		}
+		if err != nil {
+			return fmt.Errorf("could not replay fast commit record %d (%s) for inode %d: %w", i, r.tag, r.inode, err)
+		}
+	}
+	return nil
+}
+
+// replayFastCommitInode overwrite an inode with the one recorded, keeping the extent tree on disk,
+// which is maintained by the add_range and del_range records.
+func (fs *FileSystem) replayFastCommitInode(r fastCommitRecord) error {
+	b, err := fs.readRawInode(r.inode)
+	if err != nil {
+		return err
+	}
+	const (
+		iBlockStart = 0x28
+		iBlockEnd   = 0x64
+	)
+	copy(b[:iBlockStart], r.rawInode[:iBlockStart])
+	copy(b[iBlockEnd:], r.rawInode[iBlockEnd:])
+	flags := binary.LittleEndian.Uint32(b[0x20:0x24])
+	switch {
+	case inodeFlagUsesExtents.included(flags):
+		if binary.LittleEndian.Uint16(b[iBlockStart:iBlockStart+2]) != extentHeaderSignature {
+			root := extentLeafNode{extentNodeHeader: extentNodeHeader{max: uint16(extentInodeMaxEntries), blockSize: fs.superblock.blockSize}}
+			copy(b[iBlockStart:iBlockEnd], root.toBytes())
+		}
+	case inodeFlagInlineData.included(flags):
+		copy(b[iBlockStart:iBlockEnd], r.rawInode[iBlockStart:iBlockEnd])
+	}
+	if err := fs.writeRawInode(r.inode, b); err != nil {
+		return err
+	}
+	return fs.setInodeInUse(r.inode, true)
+}
+
+// replayFastCommitRange map a range of the file to the recorded blocks, or unmap it.
+// Only extent trees that fit entirely in the inode are supported.
+func (fs *FileSystem) replayFastCommitRange(r fastCommitRecord, add bool) error {
+	b, err := fs.readRawInode(r.inode)
+	if err != nil {
+		return err
+	}
+	iBlock := b[0x28:0x64]
+	tree, err := parseExtents(iBlock, fs.superblock.blockSize, 0, 0)
+	if err != nil {
+		return err
+	}
+	leaf, ok := tree.(*extentLeafNode)
+	if !ok {
+		return fmt.Errorf("extent tree with depth %d: %w", tree.getDepth(), filesystem.ErrNotSupported)
+	}
+	// expand the mapping and the change into single blocks, which is simple, if not efficient
+	mapping := map[uint32]uint64{}
+	for _, e := range leaf.extents {
+		for i := uint32(0); i < uint32(e.count); i++ {
+			mapping[e.fileBlock+i] = e.startingBlock + uint64(i)
+		}
+	}
+	var freed, allocated []uint64
+	for i := uint32(0); i < r.count; i++ {
+		old, mapped := mapping[r.fileBlock+i]
+		if add {
+			target := r.startingBlock + uint64(i)
+			if mapped && old == target {
+				continue
+			}
+			mapping[r.fileBlock+i] = target
+			allocated = append(allocated, target)
+		} else if mapped {
+			delete(mapping, r.fileBlock+i)
+		}
+		if mapped {
+			freed = append(freed, old)
+		}
+	}
+	// collapse back into extents
+	fileBlocks := make([]uint32, 0, len(mapping))
+	for fb := range mapping {
+		fileBlocks = append(fileBlocks, fb)
+	}
+	sort.Slice(fileBlocks, func(i, j int) bool { return fileBlocks[i] < fileBlocks[j] })
+	var newExtents extents
+	for _, fb := range fileBlocks {
+		if n := len(newExtents); n > 0 {
+			last := &newExtents[n-1]
+			if last.fileBlock+uint32(last.count) == fb && last.startingBlock+uint64(last.count) == mapping[fb] && uint32(last.count) < maxInitializedExtentLength {
+				last.count++
+				continue
+			}
+		}
+		newExtents = append(newExtents, extent{fileBlock: fb, startingBlock: mapping[fb], count: 1})
+	}
+	if len(newExtents) > extentInodeMaxEntries {
+		return fmt.Errorf("%d extents do not fit in the inode: %w", len(newExtents), filesystem.ErrNotSupported)
+	}
+	leaf.extents = newExtents
+	leaf.entries = uint16(len(newExtents))
+	copy(iBlock, leaf.toBytes())
+	// i_blocks is in 512-byte sectors, unless the inode is a huge file
+	blocks := newExtents.blockCount()
+	if !(fs.superblock.features.hugeFile && inodeFlagHugeFile.included(binary.LittleEndian.Uint32(b[0x20:0x24]))) {
+		blocks *= uint64(fs.superblock.blockSize) / uint64(SectorSize512)
+	}
+	binary.LittleEndian.PutUint32(b[0x1c:0x20], uint32(blocks))
+	binary.LittleEndian.PutUint16(b[0x74:0x76], uint16(blocks>>32))
+	if err := fs.writeRawInode(r.inode, b); err != nil {
+		return err
+	}
+	for _, block := range freed {
+		if err := fs.setBlocksInUse(block, 1, false); err != nil {
+			return err
+		}
+	}
+	for _, block := range allocated {
+		if err := fs.setBlocksInUse(block, 1, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayFastCommitLink add a directory entry, if it does not exist already. For a newly created
+// directory, also write its "." and ".." entries, which are not recorded.
+func (fs *FileSystem) replayFastCommitLink(r fastCommitRecord) error {
+	entries, err := fs.readLinearDirectory(r.parent)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.filename == r.name {
+			return nil
+		}
+	}
+	b, err := fs.readRawInode(r.inode)
+	if err != nil {
+		return err
+	}
+	deFileType := directoryFileTypeForInode(parseFileType(binary.LittleEndian.Uint16(b[0:2])))
+	entries = append(entries, &directoryEntry{inode: r.inode, filename: r.name, fileType: deFileType})
+	if err := fs.writeLinearDirectory(r.parent, entries); err != nil {
+		return err
+	}
+	if r.tag != fastCommitTagCreate || deFileType != dirFileTypeDirectory {
+		return nil
+	}
+	return fs.writeLinearDirectory(r.inode, []*directoryEntry{
+		{inode: r.inode, filename: ".", fileType: dirFileTypeDirectory},
+		{inode: r.parent, filename: "..", fileType: dirFileTypeDirectory},
+	})
+}
+
+// replayFastCommitUnlink remove a directory entry, if it still exists
+func (fs *FileSystem) replayFastCommitUnlink(r fastCommitRecord) error {
+	entries, err := fs.readLinearDirectory(r.parent)
+	if err != nil {
+		return err
+	}
+	newEntries := make([]*directoryEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.filename == r.name && e.inode == r.inode {
+			continue
+		}
+		newEntries = append(newEntries, e)
+	}
+	if len(newEntries) == len(entries) {
+		return nil
+	}
+	return fs.writeLinearDirectory(r.parent, newEntries)
+}
+
+// readLinearDirectory read the entries of a directory without a hash tree index, skipping unused entries
+func (fs *FileSystem) readLinearDirectory(inodeNumber uint32) ([]*directoryEntry, error) {
+	in, err := fs.readInode(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	if in.flags.hashedDirectoryIndexes {
+		return nil, fmt.Errorf("directory %d has a hash tree index: %w", inodeNumber, filesystem.ErrNotSupported)
+	}
+	entries, err := fs.readDirectory(inodeNumber)
+	if err != nil {
+		return nil, err
+	}
+	used := make([]*directoryEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.inode != 0 {
+			used = append(used, e)
+		}
+	}
+	return used, nil
+}
+
+// writeLinearDirectory write the entries of a directory without a hash tree index into the
+// blocks already allocated to it. Blocks that no longer are needed are left empty.
+func (fs *FileSystem) writeLinearDirectory(inodeNumber uint32, entries []*directoryEntry) error {
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	in, err := fs.readInode(inodeNumber)
+	if err != nil {
+		return err
+	}
+	dirExtents, err := in.extents.blocks(fs)
+	if err != nil {
+		return fmt.Errorf("could not read extents for directory %d: %w", inodeNumber, err)
+	}
+	blockSize := fs.superblock.blockSize
+	checksumFunc := directoryChecksumAppender(fs.superblock.checksumSeed, inodeNumber, in.nfsFileVersion)
+	dir := &Directory{directoryEntry: directoryEntry{inode: inodeNumber}, entries: entries}
+	if !fs.superblock.features.directoryEntriesRecordFileType {
+		dir = dir.withoutFileTypes()
+	}
+	b := dir.toBytes(blockSize, checksumFunc)
+	allocated := dirExtents.blockCount() * uint64(blockSize)
+	if uint64(len(b)) > allocated {
+		return fmt.Errorf("entries for directory %d need %d bytes, only %d allocated: %w", inodeNumber, len(b), allocated, filesystem.ErrNotSupported)
+	}
+	emptyEntry := &directoryEntry{}
+	for uint64(len(b)) < allocated {
+		b = append(b, checksumFunc(emptyEntry.toBytes(uint16(int(blockSize)-minDirEntryLength)))...)
+	}
+	for _, e := range dirExtents {
+		count := int64(e.count) * int64(blockSize)
+		if _, err := writableFile.WriteAt(b[:count], fs.start+int64(e.startingBlock)*int64(blockSize)); err != nil {
+			return fmt.Errorf("could not write entries for directory %d: %w", inodeNumber, err)
+		}
+		b = b[count:]
+	}
+	return nil
+}
+
+// directoryFileTypeForInode the directory entry file type for an inode file type
+func directoryFileTypeForInode(ft fileType) directoryFileType {
+	switch ft {
+	case fileTypeRegularFile:
+		return dirFileTypeRegular
+	case fileTypeDirectory:
+		return dirFileTypeDirectory
+	case fileTypeCharacterDevice:
+		return dirFileTypeCharacter
+	case fileTypeBlockDevice:
+		return dirFileTypeBlock
+	case fileTypeFifo:
+		return dirFileTypeFifo
+	case fileTypeSocket:
+		return dirFileTypeSocket
+	case fileTypeSymbolicLink:
+		return dirFileTypeSymlink
+	default:
+		return dirFileTypeUnknown
+	}
+}
@@ -41,18 +41,27 @@ func (fl *File) Read(b []byte) (int, error) {
 	b = b[:bytesToRead]
 
 	// the offset given for reading is relative to the file, so we need to calculate
-	// where these are in the extents relative to the file
-	readStartBlock := uint64(fl.offset) / blocksize
+	// where these are in the extents relative to the file. Blocks of the file that are in no extent
+	// are holes, which read as zeros.
 	for _, e := range fl.extents {
-		// if the last block of the extent is before the first block we want to read, skip it
-		if uint64(e.fileBlock)+uint64(e.count) < readStartBlock {
+		extentStart := int64(e.fileBlock) * int64(blocksize)
+		extentEnd := extentStart + int64(e.count)*int64(blocksize)
+		// if the extent ends before where we want to read, skip it
+		if extentEnd <= fl.offset {
 			continue
 		}
-		// extentSize is the number of bytes on the disk for the extent
-		extentSize := int64(e.count) * int64(blocksize)
+		if fl.offset < extentStart {
+			hole := min(extentStart-fl.offset, bytesToRead-readBytes)
+			clear(b[readBytes : readBytes+hole])
+			readBytes += hole
+			fl.offset += hole
+			if readBytes >= bytesToRead {
+				break
+			}
+		}
 		// where do we start and end in the extent?
-		startPositionInExtent := fl.offset - int64(e.fileBlock)*int64(blocksize)
-		leftInExtent := extentSize - startPositionInExtent
+		startPositionInExtent := fl.offset - extentStart
+		leftInExtent := extentEnd - fl.offset
 		// how many bytes are left to read
 		toReadInOffset := bytesToRead - readBytes
 		if toReadInOffset > leftInExtent {
@@ -60,12 +69,10 @@ func (fl *File) Read(b []byte) (int, error) {
 		}
 		// read those bytes
 		startPosOnDisk := e.startingBlock*blocksize + uint64(startPositionInExtent)
-		b2 := make([]byte, toReadInOffset)
-		read, err := fl.filesystem.backend.ReadAt(b2, int64(startPosOnDisk))
+		read, err := fl.filesystem.backend.ReadAt(b[readBytes:readBytes+toReadInOffset], fl.filesystem.start+int64(startPosOnDisk))
 		if err != nil {
 			return int(readBytes), fmt.Errorf("failed to read bytes: %v", err)
 		}
-		copy(b[readBytes:], b2[:read])
 		readBytes += int64(read)
 		fl.offset += int64(read)
 
@@ -73,6 +80,12 @@ func (fl *File) Read(b []byte) (int, error) {
 			break
 		}
 	}
+	// anything after the last extent, up to the size of the file, is a hole too
+	if readBytes < bytesToRead {
+		clear(b[readBytes:bytesToRead])
+		fl.offset += bytesToRead - readBytes
+		readBytes = bytesToRead
+	}
 	var err error
 	if fl.offset >= fileSize {
 		err = io.EOF
@@ -88,11 +101,8 @@ func (fl *File) Read(b []byte) (int, error) {
 // use Seek() to set at a particular point
 func (fl *File) Write(b []byte) (int, error) {
 	var (
-		fileSize           = int64(fl.size)
-		originalFileSize   = int64(fl.size)
-		blockCount         = fl.blocks
-		originalBlockCount = fl.blocks
-		blocksize          = uint64(fl.filesystem.superblock.blockSize)
+		originalFileSize = int64(fl.size)
+		blocksize        = uint64(fl.filesystem.superblock.blockSize)
 	)
 	if !fl.isReadWrite {
 		return 0, fmt.Errorf("file is not open for writing")
@@ -101,7 +111,7 @@ func (fl *File) Write(b []byte) (int, error) {
 	// if adding these bytes goes past the filesize, update the inode filesize to the new size and write the inode
 	// if adding these bytes goes past the total number of blocks, add more blocks, update the inode block count and write the inode
 	// if the offset is greater than the filesize, update the inode filesize to the offset
-	if fl.offset >= fileSize {
+	if fl.offset >= originalFileSize {
 		fl.size = uint64(fl.offset)
 	}
 
@@ -113,27 +123,25 @@ func (fl *File) Write(b []byte) (int, error) {
 		fl.size = uint64(fl.offset + bytesToWrite)
 	}
 
-	// calculate the number of blocks in the file post-write
-	newBlockCount := fl.size / blocksize
-	if fl.size%blocksize > 0 {
-		newBlockCount++
+	// allocate any more blocks needed for the file post-write, and rebuild the extent tree to include them
+	newExtents, err := fl.filesystem.allocateExtents(fl.size, &fl.extents)
+	if err != nil {
+		return 0, fmt.Errorf("could not allocate disk space for file %w", err)
 	}
-	blocksNeeded := newBlockCount - blockCount
-	bytesNeeded := blocksNeeded * blocksize
-	if newBlockCount > blockCount {
-		newExtents, err := fl.filesystem.allocateExtents(bytesNeeded, &fl.extents)
-		if err != nil {
-			return 0, fmt.Errorf("could not allocate disk space for file %w", err)
-		}
-		extentTreeParsed, err := extendExtentTree(fl.inode.extents, newExtents, fl.filesystem, nil)
+	changed := originalFileSize != int64(fl.size)
+	if len(*newExtents) > 0 {
+		fl.extents = appendExtents(fl.extents, *newExtents)
+		extentTreeParsed, treeBlocks, err := fl.filesystem.writeExtentTree(fl.extents, fl.inode.extents, fl.inode.number, fl.inode.nfsFileVersion)
 		if err != nil {
 			return 0, fmt.Errorf("could not convert extents into tree: %w", err)
 		}
 		fl.inode.extents = extentTreeParsed
-		fl.blocks = newBlockCount
+		fl.inode.flags.usesExtents = true
+		fl.inode.setBlockCount(fl.extents.blockCount()+treeBlocks, fl.filesystem.superblock.blockSize)
+		changed = true
 	}
 
-	if originalFileSize != int64(fl.size) || originalBlockCount != fl.blocks {
+	if changed {
 		err := fl.filesystem.writeInode(fl.inode)
 		if err != nil {
 			return 0, fmt.Errorf("could not write inode: %w", err)
@@ -153,7 +161,7 @@ func (fl *File) Write(b []byte) (int, error) {
 
 	for _, e := range fl.extents {
 		// if the last block of the extent is before the first block we want to write, skip it
-		if uint64(e.fileBlock)+uint64(e.count) < writeStartBlock {
+		if uint64(e.fileBlock)+uint64(e.count) <= writeStartBlock {
 			continue
 		}
 		// extentSize is the number of bytes on the disk for the extent
@@ -166,27 +174,35 @@ func (fl *File) Write(b []byte) (int, error) {
 		if toWriteInOffset > leftInExtent {
 			toWriteInOffset = leftInExtent
 		}
-		// read those bytes
+		// write those bytes
 		startPosOnDisk := e.startingBlock*blocksize + uint64(startPositionInExtent)
-		b2 := make([]byte, toWriteInOffset)
-		copy(b2, b[writtenBytes:])
-		written, err := writableFile.WriteAt(b2, int64(startPosOnDisk))
+		written, err := writableFile.WriteAt(b[writtenBytes:writtenBytes+toWriteInOffset], fl.filesystem.start+int64(startPosOnDisk))
 		if err != nil {
-			return int(writtenBytes), fmt.Errorf("failed to read bytes: %v", err)
+			return int(writtenBytes), fmt.Errorf("failed to write bytes: %v", err)
 		}
 		writtenBytes += int64(written)
 		fl.offset += int64(written)
 
-		if written >= len(b) {
+		if writtenBytes >= bytesToWrite {
 			break
 		}
 	}
 
-	if fl.offset >= fileSize {
-		err = io.EOF
-	}
+	return int(writtenBytes), nil
+}
 
-	return int(writtenBytes), err
+// appendExtents add newly allocated extents to the end of the existing ones, merging the first
+// into the last existing one when it directly follows it on disk
+func appendExtents(existing, added extents) extents {
+	if len(existing) > 0 && len(added) > 0 {
+		last := &existing[len(existing)-1]
+		first := added[0]
+		if last.startingBlock+uint64(last.count) == first.startingBlock && int(last.count)+int(first.count) <= int(maxBlocksPerExtent) {
+			last.count += first.count
+			added = added[1:]
+		}
+	}
+	return append(existing, added...)
 }
 
 // Seek set the offset to a particular point in the file
@@ -1,6 +1,7 @@
 package ext4
 
 import (
+	"io/fs"
 	"os"
 	"time"
 )
@@ -8,11 +9,50 @@ import (
 // FileInfo represents the information for an individual file
 // it fulfills os.FileInfo interface
 type FileInfo struct {
-	modTime time.Time
-	mode    os.FileMode
-	name    string
-	size    int64
-	isDir   bool
+	modTime    time.Time
+	mode       os.FileMode
+	name       string
+	size       int64
+	isDir      bool
+	uid        uint32
+	gid        uint32
+	linkTarget string
+	inode      uint32
+	hardLinks  uint16
+	accessTime time.Time
+	changeTime time.Time
+	createTime time.Time
+	flags      uint32
+	generation uint32
+	blocks     uint64
+	device     uint32
+}
+
+// newFileInfo create the FileInfo for a file with the given name, from its inode
+func (fs *FileSystem) newFileInfo(in *inode, name string, isDir bool) *FileInfo {
+	blocks := in.blocks
+	if in.filesystemBlocks {
+		blocks *= uint64(fs.superblock.blockSize / 512)
+	}
+	return &FileInfo{
+		modTime:    in.modifyTime,
+		mode:       in.fileMode(),
+		name:       name,
+		size:       int64(in.size),
+		isDir:      isDir,
+		uid:        in.owner,
+		gid:        in.group,
+		linkTarget: in.linkTarget,
+		inode:      in.number,
+		hardLinks:  in.hardLinks,
+		accessTime: in.accessTime,
+		changeTime: in.changeTime,
+		createTime: in.createTime,
+		flags:      in.flags.toInt(),
+		generation: in.nfsFileVersion,
+		blocks:     blocks,
+		device:     in.device,
+	}
 }
 
 // IsDir abbreviation for Mode().IsDir()
@@ -42,7 +82,76 @@ func (fi *FileInfo) Size() int64 {
 	return fi.size
 }
 
-// Sys underlying data source - not supported yet and so will return nil
+// Sys underlying data source, which is the *FileInfo itself, for its owner, symlink target
+// and the rest of the metadata in its inode
 func (fi *FileInfo) Sys() interface{} {
-	return nil
+	return fi
+}
+
+// UID get uid of file
+func (fi *FileInfo) UID() uint32 {
+	return fi.uid
+}
+
+// GID get gid of file
+func (fi *FileInfo) GID() uint32 {
+	return fi.gid
+}
+
+// Readlink returns the destination of the symbolic link if this entry is a symbolic link.
+//
+// If this entry is not a symbolic link then it will return fs.ErrNotExist
+func (fi *FileInfo) Readlink() (string, error) {
+	if fi.mode&os.ModeSymlink == 0 {
+		return "", fs.ErrNotExist
+	}
+	return fi.linkTarget, nil
+}
+
+// Inode get the number of the inode of the file
+func (fi *FileInfo) Inode() uint32 {
+	return fi.inode
+}
+
+// Nlink get the number of hard links to the file
+func (fi *FileInfo) Nlink() uint64 {
+	return uint64(fi.hardLinks)
+}
+
+// AccessTime get the time the file was last accessed, to the nanosecond
+func (fi *FileInfo) AccessTime() time.Time {
+	return fi.accessTime
+}
+
+// ChangeTime get the time the inode of the file was last changed, to the nanosecond
+func (fi *FileInfo) ChangeTime() time.Time {
+	return fi.changeTime
+}
+
+// CreateTime get the time the file was created, to the nanosecond
+func (fi *FileInfo) CreateTime() time.Time {
+	return fi.createTime
+}
+
+// Flags get the inode flags of the file, with the same values as the EXT4_*_FL flags
+// that lsattr and chattr show, e.g. 0x10 for immutable or 0x80000 for extents
+func (fi *FileInfo) Flags() uint32 {
+	return fi.flags
+}
+
+// Generation get the generation number of the inode, as used by NFS
+func (fi *FileInfo) Generation() uint32 {
+	return fi.generation
+}
+
+// Blocks get the number of 512-byte blocks the file uses, including its extent tree
+// and extended attribute blocks, as in stat
+func (fi *FileInfo) Blocks() uint64 {
+	return fi.blocks
+}
+
+// Device get the major and minor numbers of a block or character device; 0 for other files
+func (fi *FileInfo) Device() (major, minor uint32) {
+	// the lower 32 bits of a Linux dev_t: the minor is split around the 12 bits of the major
+	return (fi.device >> 8) & 0xfff, (fi.device & 0xff) | ((fi.device >> 12) & 0xfff00)
 }
@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"slices"
 
 	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
@@ -24,6 +25,7 @@ func (g gdtChecksumType) included(a uint8) bool {
 const (
 	groupDescriptorSize                    uint16          = 32
 	groupDescriptorSize64Bit               uint16          = 64
+	maxGroupDescriptorSize                 uint16          = 1024
 	blockGroupFlagInodesUninitialized      blockGroupFlag  = 0x1
 	blockGroupFlagBlockBitmapUninitialized blockGroupFlag  = 0x2
 	blockGroupFlagInodeTableZeroed         blockGroupFlag  = 0x4
@@ -41,6 +43,23 @@ type blockGroupFlags struct {
 // groupdescriptors is a structure holding all of the group descriptors for all of the block groups
 type groupDescriptors struct {
 	descriptors []groupDescriptor
+	// lazy is set instead of descriptors for a filesystem that was read, until all of them are needed
+	lazy *lazyGroupDescriptors
+}
+
+// lazyGroupDescriptors the group descriptors of a filesystem that was read. A huge filesystem can have hundreds
+// of thousands of block groups, so they are read from disk a block of the GDT at a time, as they are needed.
+type lazyGroupDescriptors struct {
+	count        int
+	perBlock     int
+	gdSize       uint16
+	hashSeed     uint32
+	checksumType gdtChecksumType
+	// reader and locate where each block of the GDT is in it, which with meta_bg are not all together
+	reader io.ReaderAt
+	locate func(block int) int64
+	// blocks the descriptors read so far, by the block of the GDT holding them
+	blocks map[int][]groupDescriptor
 }
 
 // groupDescriptor is a structure holding the data about a single block group
@@ -57,7 +76,7 @@ type groupDescriptor struct {
 	inodeBitmapChecksum             uint32
 	unusedInodes                    uint32
 	size                            uint16
-	number                          uint16
+	number                          uint32
 }
 
 func (gd *groupDescriptor) equal(other *groupDescriptor) bool {
@@ -71,7 +90,10 @@ func (gds *groupDescriptors) equal(a *groupDescriptors) bool {
 	if gds == nil && a == nil {
 		return true
 	}
-	if (gds == nil && a != nil) || (a == nil && gds != nil) || len(gds.descriptors) != len(a.descriptors) {
+	if (gds == nil && a != nil) || (a == nil && gds != nil) {
+		return false
+	}
+	if gds.loadAll() != nil || a.loadAll() != nil || len(gds.descriptors) != len(a.descriptors) {
 		return false
 	}
 
@@ -107,7 +129,91 @@ func groupDescriptorsFromBytes(b []byte, gdSize uint16, hashSeed uint32, checksu
 	return &gds, nil
 }
 
-// toBytes returns groupDescriptors ready to be written to disk
+// newLazyGroupDescriptors the count group descriptors in the GDT in r, with each block of it where locate
+// says, none of which are read yet
+func newLazyGroupDescriptors(r io.ReaderAt, locate func(block int) int64, count int, blockSize uint32, gdSize uint16, hashSeed uint32, checksumType gdtChecksumType) *groupDescriptors {
+	return &groupDescriptors{
+		lazy: &lazyGroupDescriptors{
+			count:        count,
+			perBlock:     int(blockSize) / int(gdSize),
+			gdSize:       gdSize,
+			hashSeed:     hashSeed,
+			checksumType: checksumType,
+			reader:       r,
+			locate:       locate,
+			blocks:       map[int][]groupDescriptor{},
+		},
+	}
+}
+
+// count the number of group descriptors, whether or not they are read yet
+func (gds *groupDescriptors) count() int {
+	if gds.lazy != nil {
+		return gds.lazy.count
+	}
+	return len(gds.descriptors)
+}
+
+// get the descriptor for block group bg, reading its block of the GDT if it was not yet
+func (gds *groupDescriptors) get(bg int) (*groupDescriptor, error) {
+	if bg < 0 || bg >= gds.count() {
+		return nil, fmt.Errorf("block group %d does not exist", bg)
+	}
+	if gds.lazy == nil {
+		return &gds.descriptors[bg], nil
+	}
+	descriptors, err := gds.lazy.block(bg / gds.lazy.perBlock)
+	if err != nil {
+		return nil, err
+	}
+	return &descriptors[bg%gds.lazy.perBlock], nil
+}
+
+// loadAll read every group descriptor that was not yet, so that descriptors holds all of them.
+// Any descriptor returned by get before is no longer part of the table afterwards.
+func (gds *groupDescriptors) loadAll() error {
+	if gds.lazy == nil {
+		return nil
+	}
+	descriptors := make([]groupDescriptor, 0, gds.lazy.count)
+	for block := 0; block*gds.lazy.perBlock < gds.lazy.count; block++ {
+		b, err := gds.lazy.block(block)
+		if err != nil {
+			return err
+		}
+		descriptors = append(descriptors, b...)
+	}
+	gds.descriptors = descriptors
+	gds.lazy = nil
+	return nil
+}
+
+// block the descriptors in a single block of the GDT, reading them from disk the first time
+func (l *lazyGroupDescriptors) block(block int) ([]groupDescriptor, error) {
+	if descriptors, ok := l.blocks[block]; ok {
+		return descriptors, nil
+	}
+	first := block * l.perBlock
+	count := min(l.perBlock, l.count-first)
+	b := make([]byte, count*int(l.gdSize))
+	n, err := l.reader.ReadAt(b, l.locate(block))
+	if err != nil && n < len(b) {
+		return nil, fmt.Errorf("could not read block %d of Group Descriptor Table: %w", block, err)
+	}
+	descriptors := make([]groupDescriptor, 0, count)
+	for i := range count {
+		start := i * int(l.gdSize)
+		gd, err := groupDescriptorFromBytes(b[start:start+int(l.gdSize)], l.gdSize, first+i, l.checksumType, l.hashSeed)
+		if err != nil {
+			return nil, fmt.Errorf("error creating group descriptor from bytes: %w", err)
+		}
+		descriptors = append(descriptors, *gd)
+	}
+	l.blocks[block] = descriptors
+	return descriptors, nil
+}
+
+// toBytes returns groupDescriptors ready to be written to disk. They must all have been read, see loadAll.
 func (gds *groupDescriptors) toBytes(checksumType gdtChecksumType, hashSeed uint32) []byte {
 	b := make([]byte, 0, 10*groupDescriptorSize)
 	for _, gd := range gds.descriptors {
@@ -121,6 +227,9 @@ func (gds *groupDescriptors) toBytes(checksumType gdtChecksumType, hashSeed uint
 // byFreeBlocks provides a sorted list of groupDescriptors by free blocks, descending.
 // If you want them ascending, sort if.
 func (gds *groupDescriptors) byFreeBlocks() []groupDescriptor {
+	if err := gds.loadAll(); err != nil {
+		return nil
+	}
 	// make a copy of the slice
 	gdSlice := make([]groupDescriptor, len(gds.descriptors))
 	copy(gdSlice, gds.descriptors)
@@ -133,6 +242,15 @@ func (gds *groupDescriptors) byFreeBlocks() []groupDescriptor {
 	return gdSlice
 }
 
+// bitmapChecksum the part of the checksum of a bitmap that the descriptor holds: a 32-byte descriptor only has
+// room for the low 16 bits
+func (gd *groupDescriptor) bitmapChecksum(sum uint32) uint32 {
+	if gd.size < groupDescriptorSize64Bit {
+		return sum & 0xffff
+	}
+	return sum
+}
+
 // groupDescriptorFromBytes create a groupDescriptor struct from bytes
 func groupDescriptorFromBytes(b []byte, gdSize uint16, number int, checksumType gdtChecksumType, hashSeed uint32) (*groupDescriptor, error) {
 	// block count, reserved block count and free blocks depends on whether the fs is 64-bit or not
@@ -158,7 +276,8 @@ func groupDescriptorFromBytes(b []byte, gdSize uint16, number int, checksumType
 	copy(inodeBitmapChecksum[0:2], b[0x1a:0x1c])
 	copy(unusedInodes[0:2], b[0x1c:0x1e])
 
-	if gdSize == 64 {
+	// larger descriptors only add to the end of the 64-byte one
+	if gdSize >= groupDescriptorSize64Bit {
 		copy(blockBitmapLocation[4:8], b[0x20:0x24])
 		copy(inodeBitmapLocation[4:8], b[0x24:0x28])
 		copy(inodeTableLocation[4:8], b[0x28:0x2c])
@@ -171,11 +290,11 @@ func groupDescriptorFromBytes(b []byte, gdSize uint16, number int, checksumType
 		copy(inodeBitmapChecksum[2:4], b[0x3a:0x3c])
 	}
 
-	gdNumber := uint16(number)
+	gdNumber := uint32(number)
 	// only bother with checking the checksum if it was not type none (pre-checksums)
 	if checksumType != gdtChecksumNone {
 		checksum := binary.LittleEndian.Uint16(b[0x1e:0x20])
-		actualChecksum := groupDescriptorChecksum(b[0x0:0x40], hashSeed, gdNumber, checksumType)
+		actualChecksum := groupDescriptorChecksum(b[:gdSize], hashSeed, gdNumber, checksumType)
 		if checksum != actualChecksum {
 			return nil, fmt.Errorf("checksum mismatch, passed %x, actual %x", checksum, actualChecksum)
 		}
@@ -242,7 +361,7 @@ func (gd *groupDescriptor) toBytes(checksumType gdtChecksumType, hashSeed uint32
 	copy(b[0x1c:0x1e], unusedInodes[0:2])
 
 	// now for the upper 32 bytes
-	if gd.size == 64 {
+	if gd.size >= groupDescriptorSize64Bit {
 		copy(b[0x20:0x24], blockBitmapLocation[4:8])
 		copy(b[0x24:0x28], inodeBitmapLocation[4:8])
 		copy(b[0x28:0x2c], inodeTableLocation[4:8])
@@ -255,7 +374,7 @@ func (gd *groupDescriptor) toBytes(checksumType gdtChecksumType, hashSeed uint32
 		copy(b[0x3a:0x3c], inodeBitmapChecksum[2:4])
 	}
 
-	checksum := groupDescriptorChecksum(b[0x0:0x40], hashSeed, gd.number, checksumType)
+	checksum := groupDescriptorChecksum(b, hashSeed, gd.number, checksumType)
 	binary.LittleEndian.PutUint16(b[0x1e:0x20], checksum)
 
 	return b
@@ -297,11 +416,11 @@ func (f *blockGroupFlags) toInt() uint16 {
 //	we do know that the maximum number of block groups in 32-bit mode is 2^19, which must be uint32
 //	and in 64-bit mode it is 2^51 which must be uint64
 //	So we start with uint32 = [4]byte{} for regular mode and [8]byte{} for mod32
-func groupDescriptorChecksum(b []byte, hashSeed uint32, groupNumber uint16, checksumType gdtChecksumType) uint16 {
+func groupDescriptorChecksum(b []byte, hashSeed uint32, groupNumber uint32, checksumType gdtChecksumType) uint16 {
 	var checksum uint16
 
 	numBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint16(numBytes, groupNumber)
+	binary.LittleEndian.PutUint32(numBytes, groupNumber)
 	switch checksumType {
 	case gdtChecksumNone:
 		checksum = 0
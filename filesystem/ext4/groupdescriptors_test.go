@@ -1,10 +1,14 @@
 package ext4
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/go-test/deep"
 )
 
@@ -99,3 +103,163 @@ func TestGroupDescriptorsToBytes(t *testing.T) {
 		t.Errorf("groupDescriptors.toBytes() mismatched, actual then expected\n%s", diffString)
 	}
 }
+
+func TestGroupDescriptorsLazy(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "lazy.img"))
+	if err != nil {
+		t.Fatalf("Error creating image file: %v", err)
+	}
+	defer f.Close()
+	// small block groups of 1K blocks, so the GDT spans several blocks
+	size := int64(20 * MB)
+	created, err := Create(file.New(f, false), size, 0, 512, &Params{SectorsPerBlock: 2, BlocksPerGroup: 256, Checksum: true})
+	if err != nil {
+		t.Fatalf("Error creating filesystem: %v", err)
+	}
+	content := []byte("read through the first block group only")
+	fh, err := created.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	if _, err := fh.Write(content); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	fs, err := Read(file.New(f, true), size, 0, 512)
+	if err != nil {
+		t.Fatalf("Error reading filesystem: %v", err)
+	}
+	gds := fs.groupDescriptors
+	if gds.lazy == nil {
+		t.Fatalf("group descriptors were all read up front")
+	}
+	if gds.count() <= 2*gds.lazy.perBlock {
+		t.Fatalf("only %d block groups, too few to span several GDT blocks", gds.count())
+	}
+	fh, err = fs.OpenFile("/file", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	b, err := io.ReadAll(fh)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("mismatched contents %q", b)
+	}
+	if len(gds.lazy.blocks) != 1 {
+		t.Errorf("read %d blocks of the GDT instead of 1", len(gds.lazy.blocks))
+	}
+
+	// the last one is read on its own, and all of them match those created
+	last := gds.count() - 1
+	gd, err := gds.get(last)
+	if err != nil {
+		t.Fatalf("Error getting last group descriptor: %v", err)
+	}
+	if *gd != created.groupDescriptors.descriptors[last] {
+		t.Errorf("mismatched last group descriptor %+v", *gd)
+	}
+	if len(gds.lazy.blocks) != 2 {
+		t.Errorf("read %d blocks of the GDT instead of 2", len(gds.lazy.blocks))
+	}
+	if _, err := gds.get(gds.count()); err == nil {
+		t.Errorf("no error getting a block group beyond the end")
+	}
+	if !gds.equal(created.groupDescriptors) {
+		t.Errorf("group descriptors read do not match those created")
+	}
+	if gds.lazy != nil {
+		t.Errorf("group descriptors not all read after comparing them")
+	}
+}
+
+func TestGroupDescriptorsMetaBlockGroups(t *testing.T) {
+	for _, wide := range []bool{false, true} {
+		t.Run(fmt.Sprintf("64bit=%v", wide), func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "meta_bg.img"))
+			if err != nil {
+				t.Fatalf("Error creating image file: %v", err)
+			}
+			defer f.Close()
+			// every group has a copy of the superblock and GDT, so that moving blocks of the GDT to the start of
+			// the meta block groups, after the copy of the superblock, only overwrites copies
+			size := int64(20 * MB)
+			params := &Params{SectorsPerBlock: 2, BlocksPerGroup: 256, Checksum: true, Features: []FeatureOpt{
+				WithFeatureFS64Bit(wide), WithFeatureSparseSuperblock(false), WithFeatureReservedGDTBlocksForExpansion(false),
+			}}
+			created, err := Create(file.New(f, false), size, 0, 512, params)
+			if err != nil {
+				t.Fatalf("Error creating filesystem: %v", err)
+			}
+			content := []byte("found through a meta block group")
+			fh, err := created.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Error creating file: %v", err)
+			}
+			if _, err := fh.Write(content); err != nil {
+				t.Fatalf("Error writing file: %v", err)
+			}
+
+			// turn on meta_bg after the first block of the GDT, moving the rest where it keeps them
+			sb := *created.superblock
+			sb.features.metaBlockGroups = true
+			sb.firstMetablockGroup = 1
+			if sb.gdtBlockCount() < 3 {
+				t.Fatalf("only %d blocks of GDT, too few to span several meta block groups", sb.gdtBlockCount())
+			}
+			blockSize := int64(sb.blockSize)
+			for block := uint64(1); block < sb.gdtBlockCount(); block++ {
+				b := make([]byte, blockSize)
+				primary := int64(created.superblock.gdtBlockLocation(block)) * blockSize
+				if _, err := f.ReadAt(b, primary); err != nil {
+					t.Fatalf("Error reading GDT block %d: %v", block, err)
+				}
+				if _, err := f.WriteAt(b, int64(sb.gdtBlockLocation(block))*blockSize); err != nil {
+					t.Fatalf("Error moving GDT block %d: %v", block, err)
+				}
+				// the old place is not read any more
+				if _, err := f.WriteAt(make([]byte, blockSize), primary); err != nil {
+					t.Fatalf("Error clearing GDT block %d: %v", block, err)
+				}
+			}
+			b, err := sb.toBytes()
+			if err != nil {
+				t.Fatalf("Error converting superblock to bytes: %v", err)
+			}
+			if _, err := f.WriteAt(b, int64(BootSectorSize)); err != nil {
+				t.Fatalf("Error writing superblock: %v", err)
+			}
+
+			fs, err := Read(file.New(f, false), size, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading filesystem: %v", err)
+			}
+			if !fs.groupDescriptors.equal(created.groupDescriptors) {
+				t.Fatalf("group descriptors read do not match those created")
+			}
+			fh, err = fs.OpenFile("/file", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("Error opening file: %v", err)
+			}
+			if b, err := io.ReadAll(fh); err != nil || !bytes.Equal(b, content) {
+				t.Errorf("mismatched contents %q, error %v", b, err)
+			}
+
+			// descriptors changed by writing are written back where they are read from
+			fh, err = fs.OpenFile("/other", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Error creating file: %v", err)
+			}
+			if _, err := fh.Write(bytes.Repeat(content, 1000)); err != nil {
+				t.Fatalf("Error writing file: %v", err)
+			}
+			reread, err := Read(file.New(f, true), size, 0, 512)
+			if err != nil {
+				t.Fatalf("Error reading filesystem again: %v", err)
+			}
+			if !reread.groupDescriptors.equal(fs.groupDescriptors) {
+				t.Errorf("group descriptors read again do not match those written")
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package ext4
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
+	"reflect"
 	"time"
 
 	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
@@ -67,6 +69,17 @@ const (
 	filePermissionsOtherExecute uint16 = 0x1
 	filePermissionsOtherWrite   uint16 = 0x2
 	filePermissionsOtherRead    uint16 = 0x4
+
+	// the special bits of the mode
+	fileModeSetUID uint16 = 0x800
+	fileModeSetGID uint16 = 0x400
+	fileModeSticky uint16 = 0x200
+
+	// the block map of an inode without extents: 12 direct blocks, then an indirect, double indirect
+	// and triple indirect block
+	inodeBlockMapSize        = 15
+	inodeDoubleIndirectBlock = 13
+	inodeDirectBlocks        = 12
 )
 
 // mountOptions is a structure holding flags for an inode
@@ -112,6 +125,9 @@ type inode struct {
 	permissionsOther       filePermissions
 	permissionsGroup       filePermissions
 	permissionsOwner       filePermissions
+	setUID                 bool
+	setGID                 bool
+	sticky                 bool
 	fileType               fileType
 	owner                  uint32
 	group                  uint32
@@ -132,6 +148,13 @@ type inode struct {
 	project                uint32
 	extents                extentBlockFinder
 	linkTarget             string
+	// device the number of a character or block device, encoded as a Linux dev_t
+	device uint32
+	// blockMap the direct and indirect block pointers of an inode without extents, such as the resize inode
+	blockMap [inodeBlockMapSize]uint32
+	// inlineXattrs the raw extended attribute area in the inode, between the extra fields and the end of the inode,
+	// kept so that writing the inode back does not lose the attributes stored there
+	inlineXattrs []byte
 }
 
 //nolint:unused // will be used in the future, not yet
@@ -142,7 +165,7 @@ func (i *inode) equal(a *inode) bool {
 	if i == nil && a == nil {
 		return true
 	}
-	return *i == *a
+	return reflect.DeepEqual(*i, *a)
 }
 
 // inodeFromBytes create an inode struct from bytes
@@ -168,10 +191,6 @@ func inodeFromBytes(b []byte, sb *superblock, number uint32) (*inode, error) {
 	owner := make([]byte, 4)
 	fileSize := make([]byte, 8)
 	group := make([]byte, 4)
-	accessTime := make([]byte, 8)
-	changeTime := make([]byte, 8)
-	modifyTime := make([]byte, 8)
-	createTime := make([]byte, 8)
 	version := make([]byte, 8)
 	extendedAttributeBlock := make([]byte, 8)
 
@@ -185,34 +204,9 @@ func inodeFromBytes(b []byte, sb *superblock, number uint32) (*inode, error) {
 	copy(fileSize[4:8], b[0x6c:0x70])
 	copy(version[0:4], b[0x24:0x28])
 	copy(version[4:8], b[0x98:0x9c])
-	copy(extendedAttributeBlock[0:4], b[0x88:0x8c])
+	copy(extendedAttributeBlock[0:4], b[0x68:0x6c])
 	copy(extendedAttributeBlock[4:6], b[0x76:0x78])
 
-	// get the the times
-	// the structure is as follows:
-	//  original 32 bits (0:4) are seconds. Add (to the left) 2 more bits from the 32
-	//  the remaining 30 bites are nanoseconds
-	copy(accessTime[0:4], b[0x8:0xc])
-	// take the two bits relevant and add to fifth byte
-	accessTime[4] = b[0x8c] & 0x3
-	copy(changeTime[0:4], b[0xc:0x10])
-	changeTime[4] = b[0x84] & 0x3
-	copy(modifyTime[0:4], b[0x10:0x14])
-	modifyTime[4] = b[0x88] & 0x3
-	copy(createTime[0:4], b[0x90:0x94])
-	createTime[4] = b[0x94] & 0x3
-
-	accessTimeSeconds := binary.LittleEndian.Uint64(accessTime)
-	changeTimeSeconds := binary.LittleEndian.Uint64(changeTime)
-	modifyTimeSeconds := binary.LittleEndian.Uint64(modifyTime)
-	createTimeSeconds := binary.LittleEndian.Uint64(createTime)
-
-	// now get the nanoseconds by using the upper 30 bites
-	accessTimeNanoseconds := binary.LittleEndian.Uint32(b[0x8c:0x90]) >> 2
-	changeTimeNanoseconds := binary.LittleEndian.Uint32(b[0x84:0x88]) >> 2
-	modifyTimeNanoseconds := binary.LittleEndian.Uint32(b[0x88:0x8c]) >> 2
-	createTimeNanoseconds := binary.LittleEndian.Uint32(b[0x94:0x98]) >> 2
-
 	flagsNum := binary.LittleEndian.Uint32(b[0x20:0x24])
 
 	flags := parseInodeFlags(flagsNum)
@@ -247,12 +241,22 @@ func inodeFromBytes(b []byte, sb *superblock, number uint32) (*inode, error) {
 	// symlinks might store link target in extentInfo, or might store them elsewhere
 	var (
 		linkTarget string
+		device     uint32
+		blockMap   [inodeBlockMapSize]uint32
 		allExtents extentBlockFinder
 		err        error
 	)
-	if fileType == fileTypeSymbolicLink && fileSizeNum < 60 {
+	switch {
+	case fileType == fileTypeSymbolicLink && fileSizeNum < 60:
 		linkTarget = string(extentInfo[:fileSizeNum])
-	} else {
+	case fileType == fileTypeCharacterDevice || fileType == fileTypeBlockDevice:
+		device = decodeDevice(extentInfo)
+	case !flags.usesExtents:
+		// a block map, which is empty for fifos and sockets
+		for j := range blockMap {
+			blockMap[j] = binary.LittleEndian.Uint32(extentInfo[j*4 : j*4+4])
+		}
+	default:
 		// parse the extent information in the inode to get the root of the extents tree
 		// we do not walk the entire tree, to get a slice of blocks for the file.
 		// If we want to do that, we call the extentBlockFinder.blocks() method
@@ -267,6 +271,9 @@ func inodeFromBytes(b []byte, sb *superblock, number uint32) (*inode, error) {
 		permissionsGroup:       parseGroupPermissions(mode),
 		permissionsOwner:       parseOwnerPermissions(mode),
 		permissionsOther:       parseOtherPermissions(mode),
+		setUID:                 mode&fileModeSetUID != 0,
+		setGID:                 mode&fileModeSetGID != 0,
+		sticky:                 mode&fileModeSticky != 0,
 		fileType:               fileType,
 		owner:                  binary.LittleEndian.Uint32(owner),
 		group:                  binary.LittleEndian.Uint32(group),
@@ -279,20 +286,28 @@ func inodeFromBytes(b []byte, sb *superblock, number uint32) (*inode, error) {
 		version:                binary.LittleEndian.Uint64(version),
 		inodeSize:              binary.LittleEndian.Uint16(b[0x80:0x82]) + minInodeSize,
 		deletionTime:           binary.LittleEndian.Uint32(b[0x14:0x18]),
-		accessTime:             time.Unix(int64(accessTimeSeconds), int64(accessTimeNanoseconds)),
-		changeTime:             time.Unix(int64(changeTimeSeconds), int64(changeTimeNanoseconds)),
-		modifyTime:             time.Unix(int64(modifyTimeSeconds), int64(modifyTimeNanoseconds)),
-		createTime:             time.Unix(int64(createTimeSeconds), int64(createTimeNanoseconds)),
+		accessTime:             inodeTime(b[0x8:0xc], b[0x8c:0x90]),
+		changeTime:             inodeTime(b[0xc:0x10], b[0x84:0x88]),
+		modifyTime:             inodeTime(b[0x10:0x14], b[0x88:0x8c]),
+		createTime:             inodeTime(b[0x90:0x94], b[0x94:0x98]),
 		extendedAttributeBlock: binary.LittleEndian.Uint64(extendedAttributeBlock),
 		project:                binary.LittleEndian.Uint32(b[0x9c:0x100]),
 		extents:                allExtents,
 		linkTarget:             linkTarget,
+		device:                 device,
+		blockMap:               blockMap,
+	}
+	if start := i.xattrOffset(); start < len(b) {
+		i.inlineXattrs = make([]byte, len(b)-start)
+		copy(i.inlineXattrs, b[start:])
 	}
-	checksum := binary.LittleEndian.Uint32(checksumBytes)
-	actualChecksum := inodeChecksum(b, sb.checksumSeed, number, i.nfsFileVersion)
+	if sb.features.metadataChecksums {
+		checksum := binary.LittleEndian.Uint32(checksumBytes)
+		actualChecksum := inodeChecksum(b, sb.checksumSeed, number, i.nfsFileVersion)
 
-	if actualChecksum != checksum {
-		return nil, fmt.Errorf("checksum mismatch, on-disk %x vs calculated %x", checksum, actualChecksum)
+		if actualChecksum != checksum {
+			return nil, fmt.Errorf("checksum mismatch, on-disk %x vs calculated %x", checksum, actualChecksum)
+		}
 	}
 
 	return &i, nil
@@ -317,24 +332,18 @@ func (i *inode) toBytes(sb *superblock) []byte {
 	version := make([]byte, 8)
 	extendedAttributeBlock := make([]byte, 8)
 
-	binary.LittleEndian.PutUint16(mode, i.permissionsGroup.toGroupInt()|i.permissionsOther.toOtherInt()|i.permissionsOwner.toOwnerInt()|uint16(i.fileType))
+	binary.LittleEndian.PutUint16(mode, i.permissionsGroup.toGroupInt()|i.permissionsOther.toOtherInt()|i.permissionsOwner.toOwnerInt()|i.specialModeInt()|uint16(i.fileType))
 	binary.LittleEndian.PutUint32(owner, i.owner)
 	binary.LittleEndian.PutUint32(group, i.group)
 	binary.LittleEndian.PutUint64(fileSize, i.size)
 	binary.LittleEndian.PutUint64(version, i.version)
 	binary.LittleEndian.PutUint64(extendedAttributeBlock, i.extendedAttributeBlock)
 
-	// there is some odd stuff that ext4 does with nanoseconds. We might need this in the future.
-	// See https://ext4.wiki.kernel.org/index.php/Ext4_Disk_Layout#Inode_Timestamps
-	// binary.LittleEndian.PutUint32(accessTime[4:8], (i.accessTimeNanoseconds<<2)&accessTime[4])
-	binary.LittleEndian.PutUint64(accessTime, uint64(i.accessTime.Unix()))
-	binary.LittleEndian.PutUint32(accessTime[4:8], uint32(i.accessTime.Nanosecond()))
-	binary.LittleEndian.PutUint64(createTime, uint64(i.createTime.Unix()))
-	binary.LittleEndian.PutUint32(createTime[4:8], uint32(i.createTime.Nanosecond()))
-	binary.LittleEndian.PutUint64(changeTime, uint64(i.changeTime.Unix()))
-	binary.LittleEndian.PutUint32(changeTime[4:8], uint32(i.changeTime.Nanosecond()))
-	binary.LittleEndian.PutUint64(modifyTime, uint64(i.modifyTime.Unix()))
-	binary.LittleEndian.PutUint32(modifyTime[4:8], uint32(i.modifyTime.Nanosecond()))
+	// See https://www.kernel.org/doc/html/latest/filesystems/ext4/dynamic.html#inode-timestamps
+	putInodeTime(accessTime, i.accessTime)
+	putInodeTime(createTime, i.createTime)
+	putInodeTime(changeTime, i.changeTime)
+	putInodeTime(modifyTime, i.modifyTime)
 
 	blocks := make([]byte, 8)
 	binary.LittleEndian.PutUint64(blocks, i.blocks)
@@ -352,7 +361,19 @@ func (i *inode) toBytes(sb *superblock) []byte {
 	copy(b[0x1c:0x20], blocks[0:4])
 	binary.LittleEndian.PutUint32(b[0x20:0x24], i.flags.toInt())
 	copy(b[0x24:0x28], version[0:4])
-	copy(b[0x28:0x64], i.extents.toBytes())
+	// a fast symlink keeps its target where the extent tree would be, and a device its number
+	switch {
+	case i.fileType == fileTypeSymbolicLink && i.size < 60:
+		copy(b[0x28:0x64], i.linkTarget)
+	case i.fileType == fileTypeCharacterDevice || i.fileType == fileTypeBlockDevice:
+		encodeDevice(b[0x28:0x64], i.device)
+	case i.extents != nil:
+		copy(b[0x28:0x64], i.extents.toBytes())
+	default:
+		for j, block := range i.blockMap {
+			binary.LittleEndian.PutUint32(b[0x28+j*4:0x2c+j*4], block)
+		}
+	}
 	binary.LittleEndian.PutUint32(b[0x64:0x68], i.nfsFileVersion)
 	copy(b[0x68:0x6c], extendedAttributeBlock[0:4])
 	copy(b[0x6c:0x70], fileSize[4:8])
@@ -370,16 +391,38 @@ func (i *inode) toBytes(sb *superblock) []byte {
 	copy(b[0x8c:0x90], accessTime[4:8])
 	copy(b[0x90:0x94], createTime[0:4])
 	copy(b[0x94:0x98], createTime[4:8])
+	if start := i.xattrOffset(); start < len(b) {
+		copy(b[start:], i.inlineXattrs)
+	}
 
-	actualChecksum := inodeChecksum(b, sb.checksumSeed, i.number, i.nfsFileVersion)
-	checksum := make([]byte, 4)
-	binary.LittleEndian.PutUint32(checksum, actualChecksum)
-	copy(b[0x7c:0x7e], checksum[0:2])
-	copy(b[0x82:0x84], checksum[2:4])
+	if sb.features.metadataChecksums {
+		actualChecksum := inodeChecksum(b, sb.checksumSeed, i.number, i.nfsFileVersion)
+		checksum := make([]byte, 4)
+		binary.LittleEndian.PutUint32(checksum, actualChecksum)
+		copy(b[0x7c:0x7e], checksum[0:2])
+		copy(b[0x82:0x84], checksum[2:4])
+	}
 
 	return b
 }
 
+// inodeTime decode a timestamp from the 32-bit seconds that every inode has and the 32 extra bits of larger inodes,
+// whose lowest 2 bits extend the seconds beyond 2038, and the rest are nanoseconds
+func inodeTime(seconds, extra []byte) time.Time {
+	lo := binary.LittleEndian.Uint32(seconds)
+	ex := binary.LittleEndian.Uint32(extra)
+	return time.Unix(int64(int32(lo))+int64(ex&0x3)<<32, int64(ex>>2))
+}
+
+// putInodeTime encode a timestamp into 8 bytes, the first 4 for the seconds and the last 4 for the extra bits,
+// the reverse of inodeTime
+func putInodeTime(b []byte, t time.Time) {
+	sec := t.Unix()
+	binary.LittleEndian.PutUint32(b[0:4], uint32(sec))
+	epoch := uint32((sec-int64(int32(sec)))>>32) & 0x3
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Nanosecond())<<2|epoch)
+}
+
 func parseOwnerPermissions(mode uint16) filePermissions {
 	return filePermissions{
 		execute: mode&filePermissionsOwnerExecute == filePermissionsOwnerExecute,
@@ -447,6 +490,63 @@ func (fp *filePermissions) toGroupInt() uint16 {
 	return mode
 }
 
+// fileMode the permissions and type of the inode, as an os.FileMode
+// specialModeInt the setuid, setgid and sticky bits of the mode
+func (i *inode) specialModeInt() uint16 {
+	var mode uint16
+	if i.setUID {
+		mode |= fileModeSetUID
+	}
+	if i.setGID {
+		mode |= fileModeSetGID
+	}
+	if i.sticky {
+		mode |= fileModeSticky
+	}
+	return mode
+}
+
+// setFileMode set the permissions and the setuid, setgid and sticky bits from an os.FileMode.
+// The type of the file is not changed.
+func (i *inode) setFileMode(mode os.FileMode) {
+	perm := uint16(mode.Perm())
+	i.permissionsOwner = parseOwnerPermissions(perm)
+	i.permissionsGroup = parseGroupPermissions(perm)
+	i.permissionsOther = parseOtherPermissions(perm)
+	i.setUID = mode&os.ModeSetuid != 0
+	i.setGID = mode&os.ModeSetgid != 0
+	i.sticky = mode&os.ModeSticky != 0
+}
+
+func (i *inode) fileMode() os.FileMode {
+	mode := os.FileMode(i.permissionsOwner.toOwnerInt() | i.permissionsGroup.toGroupInt() | i.permissionsOther.toOtherInt())
+	if i.setUID {
+		mode |= os.ModeSetuid
+	}
+	if i.setGID {
+		mode |= os.ModeSetgid
+	}
+	if i.sticky {
+		mode |= os.ModeSticky
+	}
+	switch i.fileType {
+	case fileTypeDirectory:
+		mode |= os.ModeDir
+	case fileTypeSymbolicLink:
+		mode |= os.ModeSymlink
+	case fileTypeCharacterDevice:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case fileTypeBlockDevice:
+		mode |= os.ModeDevice
+	case fileTypeFifo:
+		mode |= os.ModeNamedPipe
+	case fileTypeSocket:
+		mode |= os.ModeSocket
+	case fileTypeRegularFile:
+	}
+	return mode
+}
+
 // parseFileType from the uint16 mode. The mode is built of bottom 12 bits
 // being "any of" several permissions, and thus resolved via AND,
 // while the top 4 bits are "only one of" several types, and thus resolved via just equal.
@@ -586,3 +686,41 @@ func inodeChecksum(b []byte, checksumSeed, inodeNumber, inodeGeneration uint32)
 	checksum := crc.CRC32c(crcResult, b)
 	return checksum
 }
+
+// decodeDevice get the number of a device from where the extent tree would be. Numbers with a major and minor
+// below 256 are in the first word, in the old 16-bit encoding, which is the same as the dev_t for them;
+// larger ones are in the second word, in the same encoding as the lower 32 bits of a dev_t.
+func decodeDevice(b []byte) uint32 {
+	if old := binary.LittleEndian.Uint32(b[0:4]); old != 0 {
+		return old & 0xffff
+	}
+	return binary.LittleEndian.Uint32(b[4:8])
+}
+
+// encodeDevice put the number of a device where the extent tree would be, as decodeDevice reads it
+func encodeDevice(b []byte, device uint32) {
+	if device <= 0xffff {
+		binary.LittleEndian.PutUint32(b[0:4], device)
+		return
+	}
+	binary.LittleEndian.PutUint32(b[4:8], device)
+}
+
+// xattrOffset where the extended attribute area starts in the inode, right after the extra fields
+func (i *inode) xattrOffset() int {
+	return int(ext2InodeSize) + int(i.inodeSize-minInodeSize)
+}
+
+// setBlockCount set i_blocks for an inode that uses count filesystem blocks, including those of its extent tree.
+// It is kept in 512-byte units, unless the inode has the huge file flag.
+func (i *inode) setBlockCount(count uint64, blocksize uint32) {
+	// the extended attribute block counts too
+	if i.extendedAttributeBlock != 0 {
+		count++
+	}
+	if i.filesystemBlocks {
+		i.blocks = count
+		return
+	}
+	i.blocks = count * uint64(blocksize/512)
+}
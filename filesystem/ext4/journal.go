@@ -0,0 +1,538 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+)
+
+// the journal is a jbd2 journal, all of whose fields are stored big-endian.
+// See https://www.kernel.org/doc/html/latest/filesystems/ext4/journal.html
+const (
+	journalMagic                 uint32 = 0xc03b3998
+	journalHeaderSize            int    = 12
+	journalSuperblockSize        int    = 1024
+	journalRevokeHeaderSize      int    = 16
+	journalDescriptorTailSize    int    = 4
+	journalUUIDSize              int    = 16
+	journalMinBlocks             uint32 = 1024
+	journalDefaultFastCommitSize uint32 = 256
+
+	journalBlockTypeDescriptor   uint32 = 1
+	journalBlockTypeCommit       uint32 = 2
+	journalBlockTypeSuperblockV1 uint32 = 3
+	journalBlockTypeSuperblockV2 uint32 = 4
+	journalBlockTypeRevoke       uint32 = 5
+
+	journalFeatureIncompatRevoke      uint32 = 0x1
+	journalFeatureIncompat64Bit       uint32 = 0x2
+	journalFeatureIncompatAsyncCommit uint32 = 0x4
+	journalFeatureIncompatCsumV2      uint32 = 0x8
+	journalFeatureIncompatCsumV3      uint32 = 0x10
+	journalFeatureIncompatFastCommit  uint32 = 0x20
+
+	journalTagFlagEscape   uint32 = 0x1
+	journalTagFlagSameUUID uint32 = 0x2
+	journalTagFlagLastTag  uint32 = 0x8
+)
+
+// journalSuperblock the parts of the journal superblock that we need to find and replay the log
+type journalSuperblock struct {
+	blockType        uint32
+	blockSize        uint32
+	maxLen           uint32
+	first            uint32
+	sequence         uint32
+	start            uint32
+	incompatFeatures uint32
+	fastCommitBlocks uint32
+}
+
+func journalSuperblockFromBytes(b []byte) (*journalSuperblock, error) {
+	if len(b) < journalSuperblockSize {
+		return nil, fmt.Errorf("cannot read journal superblock from %d bytes, need %d", len(b), journalSuperblockSize)
+	}
+	if magic := binary.BigEndian.Uint32(b[0x0:0x4]); magic != journalMagic {
+		return nil, fmt.Errorf("invalid journal superblock signature %x", magic)
+	}
+	sb := journalSuperblock{
+		blockType: binary.BigEndian.Uint32(b[0x4:0x8]),
+		blockSize: binary.BigEndian.Uint32(b[0xc:0x10]),
+		maxLen:    binary.BigEndian.Uint32(b[0x10:0x14]),
+		first:     binary.BigEndian.Uint32(b[0x14:0x18]),
+		sequence:  binary.BigEndian.Uint32(b[0x18:0x1c]),
+		start:     binary.BigEndian.Uint32(b[0x1c:0x20]),
+	}
+	switch sb.blockType {
+	case journalBlockTypeSuperblockV1:
+	case journalBlockTypeSuperblockV2:
+		// feature flags and fast commits only exist from v2
+		sb.incompatFeatures = binary.BigEndian.Uint32(b[0x28:0x2c])
+		sb.fastCommitBlocks = binary.BigEndian.Uint32(b[0x54:0x58])
+	default:
+		return nil, fmt.Errorf("invalid journal superblock block type %d", sb.blockType)
+	}
+	if sb.first == 0 || sb.first >= sb.maxLen {
+		return nil, fmt.Errorf("invalid journal first block %d for journal of %d blocks", sb.first, sb.maxLen)
+	}
+	return &sb, nil
+}
+
+// toBytes a v2 journal superblock, for a journal inside the filesystem with the given UUID,
+// padded to journalSuperblockSize
+func (j *journalSuperblock) toBytes(fsUUID []byte) []byte {
+	b := make([]byte, journalSuperblockSize)
+	binary.BigEndian.PutUint32(b[0x0:0x4], journalMagic)
+	binary.BigEndian.PutUint32(b[0x4:0x8], j.blockType)
+	binary.BigEndian.PutUint32(b[0xc:0x10], j.blockSize)
+	binary.BigEndian.PutUint32(b[0x10:0x14], j.maxLen)
+	binary.BigEndian.PutUint32(b[0x14:0x18], j.first)
+	binary.BigEndian.PutUint32(b[0x18:0x1c], j.sequence)
+	binary.BigEndian.PutUint32(b[0x1c:0x20], j.start)
+	binary.BigEndian.PutUint32(b[0x28:0x2c], j.incompatFeatures)
+	copy(b[0x30:0x30+journalUUIDSize], fsUUID)
+	// the filesystem is the single user of its own journal
+	binary.BigEndian.PutUint32(b[0x40:0x44], 1)
+	binary.BigEndian.PutUint32(b[0x54:0x58], j.fastCommitBlocks)
+	return b
+}
+
+func (j *journalSuperblock) hasFeature(feature uint32) bool {
+	return j.incompatFeatures&feature == feature
+}
+
+// lastBlock the block one beyond the last usable block of the log. When fast commits are enabled,
+// the fast commit area is carved out of the end of the journal.
+func (j *journalSuperblock) lastBlock() uint32 {
+	if !j.hasFeature(journalFeatureIncompatFastCommit) {
+		return j.maxLen
+	}
+	fcBlocks := j.fastCommitBlocks
+	if fcBlocks == 0 {
+		fcBlocks = journalDefaultFastCommitSize
+	}
+	if j.maxLen-fcBlocks < journalMinBlocks {
+		return j.maxLen
+	}
+	return j.maxLen - fcBlocks
+}
+
+// fastCommitArea the range of journal blocks [first, last) that make up the fast commit area,
+// or 0, 0 if the journal does not have one
+func (j *journalSuperblock) fastCommitArea() (first, last uint32) {
+	if !j.hasFeature(journalFeatureIncompatFastCommit) {
+		return 0, 0
+	}
+	return j.lastBlock() + 1, j.maxLen
+}
+
+// tagBytes the size of a single block tag in a descriptor block
+func (j *journalSuperblock) tagBytes() int {
+	if j.hasFeature(journalFeatureIncompatCsumV3) {
+		return 16
+	}
+	size := 12
+	if j.hasFeature(journalFeatureIncompatCsumV2) {
+		size += 2
+	}
+	if j.hasFeature(journalFeatureIncompat64Bit) {
+		return size
+	}
+	return size - 4
+}
+
+// journalWrite a single block in the log that is to be written to the filesystem
+type journalWrite struct {
+	target  uint64 // filesystem block
+	source  uint32 // journal block holding the data
+	escaped bool   // data began with the journal magic, which was zeroed out in the log
+}
+
+// journalTransaction a single committed transaction in the log
+type journalTransaction struct {
+	sequence uint32
+	writes   []journalWrite
+	revoked  []uint64
+}
+
+// journal a jbd2 journal, either internal, stored in the journal inode, or on an external journal device
+type journal struct {
+	fs         *FileSystem
+	superblock *journalSuperblock
+	// blockMap maps each journal block to its filesystem block, for an internal journal
+	blockMap []uint64
+	// device the external journal device, whose blocks are the journal blocks
+	device *JournalDevice
+	// superblockBlock the journal block that holds the journal superblock
+	superblockBlock uint32
+}
+
+// readJournal read the journal of the filesystem
+func (fs *FileSystem) readJournal() (*journal, error) {
+	sb := fs.superblock
+	if !sb.features.hasJournal {
+		return nil, errors.New("filesystem does not have a journal")
+	}
+	if sb.journalInode == 0 {
+		return fs.readExternalJournal()
+	}
+	in, err := fs.readInode(sb.journalInode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal inode %d: %w", sb.journalInode, err)
+	}
+	extents, err := in.extents.blocks(fs)
+	if err != nil {
+		return nil, fmt.Errorf("could not read extents for journal inode %d: %w", sb.journalInode, err)
+	}
+	var blockMap []uint64
+	for _, e := range extents {
+		for i := uint64(0); i < uint64(e.count); i++ {
+			fileBlock := uint64(e.fileBlock) + i
+			if fileBlock != uint64(len(blockMap)) {
+				return nil, fmt.Errorf("journal inode %d is not contiguous at journal block %d", sb.journalInode, fileBlock)
+			}
+			blockMap = append(blockMap, e.startingBlock+i)
+		}
+	}
+	if len(blockMap) == 0 {
+		return nil, fmt.Errorf("journal inode %d has no blocks", sb.journalInode)
+	}
+	j := &journal{fs: fs, blockMap: blockMap}
+	if err := j.readSuperblock(); err != nil {
+		return nil, err
+	}
+	if uint64(j.superblock.maxLen) > uint64(len(blockMap)) {
+		return nil, fmt.Errorf("journal has %d blocks, but its inode only has %d", j.superblock.maxLen, len(blockMap))
+	}
+	return j, nil
+}
+
+// readExternalJournal read the journal of the filesystem from its external journal device
+func (fs *FileSystem) readExternalJournal() (*journal, error) {
+	if fs.journalDevice == nil {
+		return nil, errors.New("journal is on an external device, which must be given with SetJournalDevice")
+	}
+	j := &journal{
+		fs:              fs,
+		device:          fs.journalDevice,
+		superblockBlock: journalDeviceSuperblockBlock(fs.superblock.blockSize),
+	}
+	if err := j.readSuperblock(); err != nil {
+		return nil, err
+	}
+	if uint64(j.superblock.maxLen) > fs.journalDevice.superblock.blockCount {
+		return nil, fmt.Errorf("journal has %d blocks, but its device only has %d", j.superblock.maxLen, fs.journalDevice.superblock.blockCount)
+	}
+	return j, nil
+}
+
+// readSuperblock read the journal superblock
+func (j *journal) readSuperblock() error {
+	b, err := j.readBlock(j.superblockBlock)
+	if err != nil {
+		return err
+	}
+	jsb, err := journalSuperblockFromBytes(b)
+	if err != nil {
+		return fmt.Errorf("could not interpret journal superblock: %w", err)
+	}
+	if jsb.blockSize != j.fs.superblock.blockSize {
+		return fmt.Errorf("journal block size %d does not match filesystem block size %d", jsb.blockSize, j.fs.superblock.blockSize)
+	}
+	j.superblock = jsb
+	return nil
+}
+
+// location the storage and offset in it of a single block of the journal
+func (j *journal) location(block uint32) (backend.Storage, int64, error) {
+	blockSize := int64(j.fs.superblock.blockSize)
+	if j.device != nil {
+		if uint64(block) >= j.device.superblock.blockCount {
+			return nil, 0, fmt.Errorf("journal block %d is beyond the end of the journal device", block)
+		}
+		return j.device.backend, j.device.start + int64(block)*blockSize, nil
+	}
+	if uint64(block) >= uint64(len(j.blockMap)) {
+		return nil, 0, fmt.Errorf("journal block %d is beyond the end of the journal", block)
+	}
+	return j.fs.backend, j.fs.start + int64(j.blockMap[block])*blockSize, nil
+}
+
+// readBlock read a single block of the journal
+func (j *journal) readBlock(block uint32) ([]byte, error) {
+	storage, offset, err := j.location(block)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := j.fs.superblock.blockSize
+	b := make([]byte, blockSize)
+	read, err := storage.ReadAt(b, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal block %d: %w", block, err)
+	}
+	if read != int(blockSize) {
+		return nil, fmt.Errorf("read %d bytes for journal block %d instead of %d", read, block, blockSize)
+	}
+	return b, nil
+}
+
+// next the block after the given one in the circular log
+func (j *journal) next(block uint32) uint32 {
+	block++
+	if block >= j.superblock.lastBlock() {
+		block = j.superblock.first
+	}
+	return block
+}
+
+// transactions find all of the committed transactions in the log that have not yet been checkpointed
+// to the filesystem. Also returns the sequence number of the next transaction, which is where the
+// fast commit area continues from.
+//
+// Like the kernel, a transaction only is replayed if its commit block made it to the log.
+// Block checksums are not verified.
+func (j *journal) transactions() ([]*journalTransaction, uint32, error) {
+	jsb := j.superblock
+	sequence := jsb.sequence
+	if jsb.start == 0 {
+		// the log is empty
+		return nil, sequence, nil
+	}
+	var (
+		committed []*journalTransaction
+		current   = &journalTransaction{sequence: sequence}
+		block     = jsb.start
+		// every block in the log can be visited at most once
+		remaining = jsb.lastBlock() - jsb.first
+	)
+	for ; remaining > 0; remaining-- {
+		b, err := j.readBlock(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		if binary.BigEndian.Uint32(b[0:4]) != journalMagic || binary.BigEndian.Uint32(b[8:12]) != sequence {
+			break
+		}
+		blockType := binary.BigEndian.Uint32(b[4:8])
+		if blockType == journalBlockTypeCommit {
+			committed = append(committed, current)
+			sequence++
+			current = &journalTransaction{sequence: sequence}
+			block = j.next(block)
+			continue
+		}
+		if blockType == journalBlockTypeRevoke {
+			current.revoked = append(current.revoked, j.revokedBlocks(b)...)
+			block = j.next(block)
+			continue
+		}
+		if blockType != journalBlockTypeDescriptor {
+			break
+		}
+		// each tag in the descriptor is followed by its data block in the log
+		for _, tag := range j.descriptorTags(b) {
+			block = j.next(block)
+			tag.source = block
+			current.writes = append(current.writes, tag)
+		}
+		block = j.next(block)
+	}
+	return committed, sequence, nil
+}
+
+// descriptorTags parse the block tags in a descriptor block. The source is not filled in.
+func (j *journal) descriptorTags(b []byte) []journalWrite {
+	jsb := j.superblock
+	var (
+		tags     []journalWrite
+		tagBytes = jsb.tagBytes()
+		end      = len(b)
+		csumV3   = jsb.hasFeature(journalFeatureIncompatCsumV3)
+		is64Bit  = jsb.hasFeature(journalFeatureIncompat64Bit)
+	)
+	if csumV3 || jsb.hasFeature(journalFeatureIncompatCsumV2) {
+		end -= journalDescriptorTailSize
+	}
+	for offset := journalHeaderSize; offset+tagBytes <= end; {
+		tb := b[offset : offset+tagBytes]
+		target := uint64(binary.BigEndian.Uint32(tb[0:4]))
+		var flags uint32
+		if csumV3 {
+			flags = binary.BigEndian.Uint32(tb[4:8])
+		} else {
+			flags = uint32(binary.BigEndian.Uint16(tb[6:8]))
+		}
+		if is64Bit {
+			target |= uint64(binary.BigEndian.Uint32(tb[8:12])) << 32
+		}
+		tags = append(tags, journalWrite{target: target, escaped: flags&journalTagFlagEscape != 0})
+		offset += tagBytes
+		if flags&journalTagFlagSameUUID == 0 {
+			offset += journalUUIDSize
+		}
+		if flags&journalTagFlagLastTag != 0 {
+			break
+		}
+	}
+	return tags
+}
+
+// revokedBlocks parse the filesystem blocks listed in a revoke block
+func (j *journal) revokedBlocks(b []byte) []uint64 {
+	recordSize := 4
+	if j.superblock.hasFeature(journalFeatureIncompat64Bit) {
+		recordSize = 8
+	}
+	count := int(binary.BigEndian.Uint32(b[12:16]))
+	if count > len(b) {
+		count = len(b)
+	}
+	var blocks []uint64
+	for offset := journalRevokeHeaderSize; offset+recordSize <= count; offset += recordSize {
+		if recordSize == 8 {
+			blocks = append(blocks, binary.BigEndian.Uint64(b[offset:offset+8]))
+		} else {
+			blocks = append(blocks, uint64(binary.BigEndian.Uint32(b[offset:offset+4])))
+		}
+	}
+	return blocks
+}
+
+// replay write the committed transactions to the filesystem, skipping any block that was revoked
+// by the same or a later transaction.
+func (j *journal) replay(transactions []*journalTransaction) error {
+	revoked := map[uint64]uint32{}
+	for _, t := range transactions {
+		for _, block := range t.revoked {
+			revoked[block] = t.sequence
+		}
+	}
+	writableFile, err := j.fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	blockSize := int64(j.fs.superblock.blockSize)
+	for _, t := range transactions {
+		for _, w := range t.writes {
+			if seq, ok := revoked[w.target]; ok && seq >= t.sequence {
+				continue
+			}
+			b, err := j.readBlock(w.source)
+			if err != nil {
+				return err
+			}
+			if w.escaped {
+				binary.BigEndian.PutUint32(b[0:4], journalMagic)
+			}
+			if _, err := writableFile.WriteAt(b, j.fs.start+int64(w.target)*blockSize); err != nil {
+				return fmt.Errorf("could not write block %d from journal transaction %d: %w", w.target, t.sequence, err)
+			}
+		}
+	}
+	return nil
+}
+
+// markEmpty mark the log as empty, with the next transaction to be written having the given sequence number
+func (j *journal) markEmpty(sequence uint32) error {
+	storage, offset, err := j.location(j.superblockBlock)
+	if err != nil {
+		return err
+	}
+	writableFile, err := storage.Writable()
+	if err != nil {
+		return err
+	}
+	b, err := j.readBlock(j.superblockBlock)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(b[0x18:0x1c], sequence)
+	binary.BigEndian.PutUint32(b[0x1c:0x20], 0)
+	if j.superblock.hasFeature(journalFeatureIncompatCsumV2) || j.superblock.hasFeature(journalFeatureIncompatCsumV3) {
+		binary.BigEndian.PutUint32(b[0xfc:0x100], 0)
+		binary.BigEndian.PutUint32(b[0xfc:0x100], crc.CRC32c(0xffffffff, b[:journalSuperblockSize]))
+	}
+	if _, err := writableFile.WriteAt(b, offset); err != nil {
+		return fmt.Errorf("could not write journal superblock: %w", err)
+	}
+	j.superblock.sequence = sequence
+	j.superblock.start = 0
+	return nil
+}
+
+// NeedsRecovery reports whether the filesystem was not cleanly unmounted and its journal has
+// to be replayed, e.g. an image taken of a live system. Until it is replayed with ReplayJournal,
+// what is read from the filesystem may be out of date or inconsistent.
+func (fs *FileSystem) NeedsRecovery() bool {
+	return fs.superblock != nil && fs.superblock.features.recoveryNeeded
+}
+
+// ReplayJournal replays the journal into the filesystem, as the kernel does when mounting a
+// filesystem that needs recovery: first the committed transactions in the log, then any
+// fast commit records that follow them. Afterwards the journal is marked empty and the filesystem
+// no longer needs recovery. The backend must be writable.
+//
+// Not all fast commit records can be replayed; if one cannot, an error wrapping filesystem.ErrNotSupported
+// is returned. Replay is idempotent, so nothing is lost by retrying with a later version of this library.
+func (fs *FileSystem) ReplayJournal() error {
+	j, err := fs.readJournal()
+	if err != nil {
+		return err
+	}
+	transactions, sequence, err := j.transactions()
+	if err != nil {
+		return fmt.Errorf("could not read journal transactions: %w", err)
+	}
+	var records []fastCommitRecord
+	if j.superblock.start != 0 {
+		records, err = j.fastCommits(sequence)
+		if err != nil {
+			return err
+		}
+	}
+	if err := j.replay(transactions); err != nil {
+		return err
+	}
+	// the transactions may have changed the superblock and group descriptors, so reload them
+	if len(transactions) > 0 {
+		if err := fs.reload(); err != nil {
+			return fmt.Errorf("could not reload filesystem after replaying journal: %w", err)
+		}
+	}
+	if err := fs.replayFastCommits(records); err != nil {
+		return err
+	}
+	// like the kernel, skip the sequence number used by the fast commits
+	if err := j.markEmpty(sequence + 1); err != nil {
+		return err
+	}
+	// the kernel does not keep the free counts in the superblock up to date, but recalculates
+	// them from the group descriptors when mounting, so do the same
+	if err := fs.groupDescriptors.loadAll(); err != nil {
+		return err
+	}
+	var freeBlocks, freeInodes uint64
+	for _, gd := range fs.groupDescriptors.descriptors {
+		freeBlocks += uint64(gd.freeBlocks)
+		freeInodes += uint64(gd.freeInodes)
+	}
+	fs.superblock.freeBlocks = freeBlocks
+	fs.superblock.freeInodes = uint32(freeInodes)
+	fs.superblock.features.recoveryNeeded = false
+	return fs.writeSuperblock()
+}
+
+// reload re-read the superblock and group descriptors from disk
+func (fs *FileSystem) reload() error {
+	newfs, err := Read(fs.backend, fs.size, fs.start, int64(SectorSize512))
+	if err != nil {
+		return err
+	}
+	fs.superblock = newfs.superblock
+	fs.groupDescriptors = newfs.groupDescriptors
+	fs.blockGroups = newfs.blockGroups
+	return nil
+}
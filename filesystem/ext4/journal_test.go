@@ -0,0 +1,339 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+)
+
+// testJournalBlock a journal block with the given header
+func testJournalBlock(blockSize uint32, blockType, sequence uint32) []byte {
+	b := make([]byte, blockSize)
+	binary.BigEndian.PutUint32(b[0:4], journalMagic)
+	binary.BigEndian.PutUint32(b[4:8], blockType)
+	binary.BigEndian.PutUint32(b[8:12], sequence)
+	return b
+}
+
+// testFastCommitTag append a single fast commit tag to b, updating the running checksum
+func testFastCommitTag(b []byte, tag fastCommitTag, value []byte, checksum *uint32) []byte {
+	tl := make([]byte, fastCommitTagHeaderLength)
+	binary.LittleEndian.PutUint16(tl[0:2], uint16(tag))
+	binary.LittleEndian.PutUint16(tl[2:4], uint16(len(value)))
+	start := len(b)
+	b = append(b, tl...)
+	b = append(b, value...)
+	if tag == fastCommitTagTail {
+		*checksum = crc.CRC32c(*checksum, b[start:start+fastCommitTagHeaderLength+4])
+		binary.LittleEndian.PutUint32(b[start+fastCommitTagHeaderLength+4:], *checksum)
+		*checksum = 0
+		return b
+	}
+	*checksum = crc.CRC32c(*checksum, b[start:])
+	return b
+}
+
+func TestReplayJournal(t *testing.T) {
+	outfile := testCreateImgCopy(t)
+	f, err := os.OpenFile(outfile, os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatalf("error opening image: %v", err)
+	}
+	defer f.Close()
+	b := file.New(f, false)
+	fs, err := Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	if fs.NeedsRecovery() {
+		t.Fatalf("clean filesystem needs recovery")
+	}
+	blockSize := fs.superblock.blockSize
+	j, err := fs.readJournal()
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	if j.superblock.start != 0 {
+		t.Fatalf("clean filesystem has journal start %d", j.superblock.start)
+	}
+
+	fileBlock := func(p string) (uint64, *inode) {
+		t.Helper()
+		_, entry, err := fs.getEntryAndParent(p)
+		if err != nil || entry == nil {
+			t.Fatalf("could not find %s: %v", p, err)
+		}
+		in, err := fs.readInode(entry.inode)
+		if err != nil {
+			t.Fatalf("could not read inode for %s: %v", p, err)
+		}
+		extents, err := in.extents.blocks(fs)
+		if err != nil {
+			t.Fatalf("could not read extents for %s: %v", p, err)
+		}
+		return extents[0].startingBlock, in
+	}
+	shortBlock, _ := fileBlock("/shortfile.txt")
+	revokedBlock, _ := fileBlock("/two-k-file.dat")
+	_, randomInode := fileBlock("/random.dat")
+
+	writeJournalBlock := func(block uint32, data []byte) {
+		t.Helper()
+		if _, err := f.WriteAt(data, int64(j.blockMap[block])*int64(blockSize)); err != nil {
+			t.Fatalf("error writing journal block %d: %v", block, err)
+		}
+	}
+
+	// transaction 15 writes two blocks, the first of which begins with the journal magic, so is escaped
+	journaled := append(binary.BigEndian.AppendUint32(nil, journalMagic), []byte("journaled\n")...)
+	desc := testJournalBlock(blockSize, journalBlockTypeDescriptor, 15)
+	binary.BigEndian.PutUint32(desc[12:16], uint32(shortBlock))
+	binary.BigEndian.PutUint32(desc[16:20], journalTagFlagEscape)
+	// tag is followed by the uuid
+	binary.BigEndian.PutUint32(desc[12+16+16:12+16+20], uint32(revokedBlock))
+	binary.BigEndian.PutUint32(desc[12+16+20:12+16+24], journalTagFlagSameUUID|journalTagFlagLastTag)
+	writeJournalBlock(1, desc)
+	data := make([]byte, blockSize)
+	copy(data[4:], journaled[4:])
+	writeJournalBlock(2, data)
+	writeJournalBlock(3, bytes.Repeat([]byte{0xff}, int(blockSize)))
+	writeJournalBlock(4, testJournalBlock(blockSize, journalBlockTypeCommit, 15))
+	// transaction 16 revokes the second block
+	revoke := testJournalBlock(blockSize, journalBlockTypeRevoke, 16)
+	binary.BigEndian.PutUint32(revoke[12:16], uint32(journalRevokeHeaderSize+8))
+	binary.BigEndian.PutUint64(revoke[16:24], revokedBlock)
+	writeJournalBlock(5, revoke)
+	writeJournalBlock(6, testJournalBlock(blockSize, journalBlockTypeCommit, 16))
+	// transaction 17 never was committed
+	desc = testJournalBlock(blockSize, journalBlockTypeDescriptor, 17)
+	binary.BigEndian.PutUint32(desc[12:16], uint32(shortBlock))
+	binary.BigEndian.PutUint32(desc[16:20], journalTagFlagSameUUID|journalTagFlagLastTag)
+	writeJournalBlock(7, desc)
+	writeJournalBlock(8, bytes.Repeat([]byte{0xee}, int(blockSize)))
+
+	// fast commits for transaction 17: a hard link to random.dat, and its updated inode
+	var checksum uint32
+	fc := testFastCommitTag(nil, fastCommitTagHead, binary.LittleEndian.AppendUint32(make([]byte, 4), 17), &checksum)
+	dentry := binary.LittleEndian.AppendUint32(nil, rootInode)
+	dentry = binary.LittleEndian.AppendUint32(dentry, randomInode.number)
+	fc = testFastCommitTag(fc, fastCommitTagLink, append(dentry, []byte("fclink")...), &checksum)
+	rawInode, err := fs.readRawInode(randomInode.number)
+	if err != nil {
+		t.Fatalf("error reading inode: %v", err)
+	}
+	binary.LittleEndian.PutUint16(rawInode[0x1a:0x1c], randomInode.hardLinks+1)
+	fc = testFastCommitTag(fc, fastCommitTagInode, append(binary.LittleEndian.AppendUint32(nil, randomInode.number), rawInode...), &checksum)
+	tail := make([]byte, 8)
+	binary.LittleEndian.PutUint32(tail[0:4], 17)
+	fc = testFastCommitTag(fc, fastCommitTagTail, tail, &checksum)
+	// a stale fast commit from an older transaction ends the area
+	fc = testFastCommitTag(fc, fastCommitTagHead, binary.LittleEndian.AppendUint32(make([]byte, 4), 12), &checksum)
+	fcBlock := make([]byte, blockSize)
+	copy(fcBlock, fc)
+	fcFirst := j.superblock.maxLen - journalDefaultFastCommitSize + 1
+	writeJournalBlock(fcFirst, fcBlock)
+
+	// mark the journal and filesystem as needing recovery
+	jsb, err := j.readBlock(0)
+	if err != nil {
+		t.Fatalf("error reading journal superblock: %v", err)
+	}
+	binary.BigEndian.PutUint32(jsb[0x18:0x1c], 15)
+	binary.BigEndian.PutUint32(jsb[0x1c:0x20], 1)
+	binary.BigEndian.PutUint32(jsb[0x28:0x2c], j.superblock.incompatFeatures|journalFeatureIncompatFastCommit)
+	writeJournalBlock(0, jsb)
+	fs.superblock.features.fastCommit = true
+	fs.superblock.features.recoveryNeeded = true
+	if err := fs.writeSuperblock(); err != nil {
+		t.Fatalf("error writing superblock: %v", err)
+	}
+	originalRevoked := make([]byte, blockSize)
+	_, _ = f.ReadAt(originalRevoked, int64(revokedBlock)*int64(blockSize))
+
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	if !fs.NeedsRecovery() {
+		t.Errorf("filesystem does not need recovery")
+	}
+	info, err := fs.FastCommits()
+	if err != nil {
+		t.Fatalf("error reading fast commits: %v", err)
+	}
+	if info == nil {
+		t.Fatalf("did not find fast commits")
+	}
+	if info.Transaction != 17 || info.Records["link"] != 1 || info.Records["inode"] != 1 || len(info.Inodes) != 1 || info.Inodes[0] != randomInode.number {
+		t.Errorf("unexpected fast commit info %#v", info)
+	}
+
+	if err := fs.ReplayJournal(); err != nil {
+		t.Fatalf("error replaying journal: %v", err)
+	}
+
+	fs, err = Read(b, 100*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("error reading filesystem after replay: %v", err)
+	}
+	if fs.NeedsRecovery() {
+		t.Errorf("filesystem still needs recovery after replay")
+	}
+	if info, err := fs.FastCommits(); err != nil || info != nil {
+		t.Errorf("fast commits still pending after replay: %#v %v", info, err)
+	}
+	j, err = fs.readJournal()
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	if j.superblock.start != 0 || j.superblock.sequence != 18 {
+		t.Errorf("journal not marked empty, start %d sequence %d", j.superblock.start, j.superblock.sequence)
+	}
+	actual := make([]byte, blockSize)
+	_, _ = f.ReadAt(actual, int64(shortBlock)*int64(blockSize))
+	expected := make([]byte, blockSize)
+	copy(expected, journaled)
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("escaped block was not replayed correctly, got %q", actual[:len(journaled)])
+	}
+	_, _ = f.ReadAt(actual, int64(revokedBlock)*int64(blockSize))
+	if !bytes.Equal(actual, originalRevoked) {
+		t.Errorf("revoked block was replayed")
+	}
+
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	var found bool
+	for _, e := range entries {
+		if e.Name() == "fclink" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("did not find fast commit link in root directory")
+	}
+	linked, err := fs.readInode(randomInode.number)
+	if err != nil {
+		t.Fatalf("error reading inode after replay: %v", err)
+	}
+	if linked.hardLinks != randomInode.hardLinks+1 {
+		t.Errorf("inode has %d links instead of %d", linked.hardLinks, randomInode.hardLinks+1)
+	}
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("error reading random data file: %v", err)
+	}
+	fsFile, err := fs.OpenFile("/fclink", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening fast commit link: %v", err)
+	}
+	read := make([]byte, len(randomData))
+	if n, err := fsFile.Read(read); (err != nil && err != io.EOF) || n != len(randomData) {
+		t.Fatalf("error reading fast commit link: read %d bytes, %v", n, err)
+	}
+	if !bytes.Equal(read, randomData) {
+		t.Errorf("fast commit link contents do not match")
+	}
+}
+
+func TestExternalJournal(t *testing.T) {
+	dir := t.TempDir()
+	openImage := func(name string, size int64) *os.File {
+		t.Helper()
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("error creating image: %v", err)
+		}
+		if err := f.Truncate(size); err != nil {
+			t.Fatalf("error sizing image: %v", err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	jf := openImage("journal.img", 8*MB)
+	jd, err := CreateJournalDevice(file.New(jf, false), 8*MB, 0, 1024, nil)
+	if err != nil {
+		t.Fatalf("error creating journal device: %v", err)
+	}
+	ff := openImage("fs.img", 64*MB)
+	fs, err := Create(file.New(ff, false), 64*MB, 0, 512, &Params{ExternalJournal: jd})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if fs.superblock.journalInode != 0 || fs.superblock.features.separateJournalDevice {
+		t.Errorf("filesystem has journal inode %d or journal_dev feature", fs.superblock.journalInode)
+	}
+	// a journal device has a single user
+	if _, err := Create(file.New(openImage("other.img", 64*MB), false), 64*MB, 0, 512, &Params{ExternalJournal: jd}); err == nil {
+		t.Errorf("missing expected error creating second filesystem on journal device")
+	}
+	if _, err := Read(file.New(jf, false), 8*MB, 0, 512); err == nil {
+		t.Errorf("missing expected error reading journal device as a filesystem")
+	}
+
+	// a committed transaction in the log that writes a free block of the filesystem
+	const target = 60000
+	blockSize := fs.superblock.blockSize
+	first := journalDeviceSuperblockBlock(blockSize) + 1
+	desc := testJournalBlock(blockSize, journalBlockTypeDescriptor, 1)
+	binary.BigEndian.PutUint32(desc[12:16], target)
+	binary.BigEndian.PutUint32(desc[16:20], journalTagFlagLastTag)
+	data := bytes.Repeat([]byte("external"), int(blockSize)/8)
+	for i, b := range [][]byte{desc, data, testJournalBlock(blockSize, journalBlockTypeCommit, 1)} {
+		if _, err := jf.WriteAt(b, int64(first+uint32(i))*int64(blockSize)); err != nil {
+			t.Fatalf("error writing journal block: %v", err)
+		}
+	}
+	start := make([]byte, 4)
+	binary.BigEndian.PutUint32(start, first)
+	if _, err := jf.WriteAt(start, int64(first-1)*int64(blockSize)+0x1c); err != nil {
+		t.Fatalf("error writing journal start: %v", err)
+	}
+
+	fs, err = Read(file.New(ff, false), 64*MB, 0, 512)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	if err := fs.ReplayJournal(); err == nil {
+		t.Errorf("missing expected error replaying journal without its device")
+	}
+	other, err := CreateJournalDevice(file.New(openImage("otherjournal.img", 8*MB), false), 8*MB, 0, 1024, nil)
+	if err != nil {
+		t.Fatalf("error creating journal device: %v", err)
+	}
+	if err := fs.SetJournalDevice(other); err == nil {
+		t.Errorf("missing expected error setting journal device with another UUID")
+	}
+	jd, err = ReadJournalDevice(file.New(jf, false), 8*MB, 0)
+	if err != nil {
+		t.Fatalf("error reading journal device: %v", err)
+	}
+	if err := fs.SetJournalDevice(jd); err != nil {
+		t.Fatalf("error setting journal device: %v", err)
+	}
+	if err := fs.ReplayJournal(); err != nil {
+		t.Fatalf("error replaying journal: %v", err)
+	}
+	b, err := fs.readBlock(target)
+	if err != nil {
+		t.Fatalf("error reading block: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("journaled block was not replayed")
+	}
+	j, err := fs.readJournal()
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	if j.superblock.start != 0 || j.superblock.sequence != 3 {
+		t.Errorf("journal not marked empty after replay, start %d sequence %d", j.superblock.start, j.superblock.sequence)
+	}
+}
@@ -0,0 +1,263 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+	"github.com/google/uuid"
+)
+
+// An external journal device holds the journal of a filesystem on a separate disk or partition, as created by
+// mke2fs -O journal_dev. It starts with an ext4 superblock with only the journal_dev feature, and no block groups,
+// followed in the next block by the journal superblock. The journal blocks are the blocks of the device itself,
+// so the log starts right after the journal superblock.
+//
+// A filesystem that uses one has a journal, but no journal inode. Instead, its superblock has the UUID of the
+// journal device, and the journal superblock lists the UUID of the filesystem as its user.
+const (
+	journalNrUsersOffset int = 0x40
+	journalUsersOffset   int = 0x100
+	// journalMaxUsers how many filesystems a journal superblock can list, although Linux only supports one
+	journalMaxUsers int = 48
+)
+
+// JournalDevice an external journal device, which holds the journal of a single filesystem
+type JournalDevice struct {
+	backend    backend.Storage
+	size       int64
+	start      int64
+	superblock *superblock
+	// users the UUIDs of the filesystems that use the journal
+	users []uuid.UUID
+}
+
+// journalDeviceSuperblockBlock the block of a journal device that holds the journal superblock, which
+// comes right after the block that holds the ext4 superblock
+func journalDeviceSuperblockBlock(blockSize uint32) uint32 {
+	if blockSize == 1024 {
+		return 2
+	}
+	return 1
+}
+
+// CreateJournalDevice creates an external journal device in a given file or device, like mke2fs -O journal_dev.
+// A filesystem then is created to use it by giving it as Params.ExternalJournal.
+//
+// requires the backend.Storage where to create the journal device, size is the size of the journal device in bytes,
+// start is how far in bytes from the beginning of the backend.Storage to create it, and blocksize is the size of
+// its blocks, which must be the same as those of the filesystem that is to use it. If journalUUID is nil,
+// a random one is used.
+func CreateJournalDevice(b backend.Storage, size, start int64, blocksize uint32, journalUUID *uuid.UUID) (*JournalDevice, error) {
+	if blocksize < 1024 || blocksize > uint32(64*KB) || blocksize&(blocksize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d for journal device, must be a power of 2 between 1024 and %d", blocksize, 64*KB)
+	}
+	numblocks := size / int64(blocksize)
+	sbBlock := journalDeviceSuperblockBlock(blocksize)
+	if numblocks < int64(journalMinBlocks+sbBlock+1) {
+		return nil, fmt.Errorf("requested size %d is too small for a journal device, must be at least %d blocks of %d bytes", size, journalMinBlocks+sbBlock+1, blocksize)
+	}
+	if numblocks > int64(max32Num) {
+		return nil, fmt.Errorf("requested size %d is too large for a journal device, must be at most %d blocks of %d bytes", size, max32Num, blocksize)
+	}
+	if journalUUID == nil {
+		u, _ := uuid.NewRandom()
+		journalUUID = &u
+	}
+	writableFile, err := b.Writable()
+	if err != nil {
+		return nil, err
+	}
+	// the journal starts out empty, so nothing in it ever is mistaken for a transaction
+	zeroes := make([]byte, 256*int64(blocksize))
+	for done := int64(0); done < numblocks; {
+		count := min(numblocks-done, 256)
+		if _, err := writableFile.WriteAt(zeroes[:count*int64(blocksize)], start+done*int64(blocksize)); err != nil {
+			return nil, fmt.Errorf("could not clear journal device: %w", err)
+		}
+		done += count
+	}
+
+	var firstDataBlock uint32
+	if blocksize == 1024 {
+		firstDataBlock = 1
+	}
+	hashSeed, _ := uuid.NewRandom()
+	now := time.Now()
+	sb := superblock{
+		blockCount:     uint64(numblocks),
+		firstDataBlock: firstDataBlock,
+		blockSize:      blocksize,
+		// stored as log2 of the size in KB, like the block size, as there is no bigalloc
+		clusterSize:           uint64(blocksize / 1024),
+		blocksPerGroup:        blocksize * 8,
+		clustersPerGroup:      blocksize * 8,
+		writeTime:             now,
+		lastCheck:             now,
+		mkfsTime:              now,
+		filesystemState:       fsStateCleanlyUnmounted,
+		errorBehaviour:        errorsContinue,
+		creatorOS:             osLinux,
+		revisionLevel:         1,
+		firstNonReservedInode: firstNonReservedInode,
+		inodeSize:             uint16(DefaultInodeSize),
+		features:              featureFlags{separateJournalDevice: true},
+		uuid:                  journalUUID,
+		hashTreeSeed: []uint32{
+			binary.LittleEndian.Uint32(hashSeed[0:4]),
+			binary.LittleEndian.Uint32(hashSeed[4:8]),
+			binary.LittleEndian.Uint32(hashSeed[8:12]),
+			binary.LittleEndian.Uint32(hashSeed[12:16]),
+		},
+		hashVersion:         hashHalfMD4,
+		defaultMountOptions: *defaultMountOptionsFromOpts(nil),
+		inodeMinBytes:       minInodeExtraSize,
+		inodeReserveBytes:   minInodeExtraSize,
+		checksumSeed:        crc.CRC32c(0xffffffff, journalUUID[:]),
+	}
+	sbBytes, err := sb.toBytes()
+	if err != nil {
+		return nil, fmt.Errorf("could not convert superblock to bytes: %w", err)
+	}
+	if _, err := writableFile.WriteAt(sbBytes, start+int64(BootSectorSize)); err != nil {
+		return nil, fmt.Errorf("could not write superblock: %w", err)
+	}
+
+	jsb := journalSuperblock{
+		blockType: journalBlockTypeSuperblockV2,
+		blockSize: blocksize,
+		maxLen:    uint32(numblocks),
+		first:     sbBlock + 1,
+		sequence:  1,
+	}
+	jsbBytes := jsb.toBytes(journalUUID[:])
+	// unlike an internal journal, it has no users until a filesystem is created on it
+	binary.BigEndian.PutUint32(jsbBytes[journalNrUsersOffset:journalNrUsersOffset+4], 0)
+	if _, err := writableFile.WriteAt(jsbBytes, start+int64(sbBlock)*int64(blocksize)); err != nil {
+		return nil, fmt.Errorf("could not write journal superblock: %w", err)
+	}
+	return &JournalDevice{
+		backend:    b,
+		size:       size,
+		start:      start,
+		superblock: &sb,
+	}, nil
+}
+
+// ReadJournalDevice reads an external journal device from a given file or device, so that it can be given to
+// the filesystem that uses it with FileSystem.SetJournalDevice.
+//
+// requires the backend.Storage where the journal device is, size is its size in bytes,
+// and start is how far in bytes from the beginning of the backend.Storage it starts.
+func ReadJournalDevice(b backend.Storage, size, start int64) (*JournalDevice, error) {
+	superblockBytes := make([]byte, SuperblockSize)
+	n, err := b.ReadAt(superblockBytes, start+int64(BootSectorSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read superblock bytes from file: %v", err)
+	}
+	if n < len(superblockBytes) {
+		return nil, fmt.Errorf("only could read %d superblock bytes from file", n)
+	}
+	sb, err := superblockFromBytes(superblockBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not interpret superblock data: %v", err)
+	}
+	if !sb.features.separateJournalDevice {
+		return nil, errors.New("not an external journal device, it does not have the journal_dev feature")
+	}
+	if sb.blockCount*uint64(sb.blockSize) > uint64(size) {
+		return nil, fmt.Errorf("journal device has %d blocks of %d bytes, more than its size %d", sb.blockCount, sb.blockSize, size)
+	}
+	jsbBytes := make([]byte, journalSuperblockSize)
+	n, err = b.ReadAt(jsbBytes, start+int64(journalDeviceSuperblockBlock(sb.blockSize))*int64(sb.blockSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal superblock bytes from file: %v", err)
+	}
+	if n < len(jsbBytes) {
+		return nil, fmt.Errorf("only could read %d journal superblock bytes from file", n)
+	}
+	jsb, err := journalSuperblockFromBytes(jsbBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not interpret journal superblock: %w", err)
+	}
+	if jsb.blockSize != sb.blockSize {
+		return nil, fmt.Errorf("journal block size %d does not match journal device block size %d", jsb.blockSize, sb.blockSize)
+	}
+	if jsb.blockType != journalBlockTypeSuperblockV2 {
+		return nil, fmt.Errorf("journal device has a v%d journal superblock, which has no users", jsb.blockType-journalBlockTypeSuperblockV1+1)
+	}
+	nrUsers := int(binary.BigEndian.Uint32(jsbBytes[journalNrUsersOffset : journalNrUsersOffset+4]))
+	if nrUsers > journalMaxUsers {
+		return nil, fmt.Errorf("journal superblock has %d users, more than the maximum %d", nrUsers, journalMaxUsers)
+	}
+	users := make([]uuid.UUID, nrUsers)
+	for i := range users {
+		offset := journalUsersOffset + i*journalUUIDSize
+		copy(users[i][:], jsbBytes[offset:offset+journalUUIDSize])
+	}
+	return &JournalDevice{
+		backend:    b,
+		size:       size,
+		start:      start,
+		superblock: sb,
+		users:      users,
+	}, nil
+}
+
+// UUID get the UUID of the journal device, which a filesystem that uses it records in its superblock
+func (j *JournalDevice) UUID() string {
+	return j.superblock.uuid.String()
+}
+
+// addUser add a filesystem to the users of the journal device. Like Linux, only a single user is supported.
+func (j *JournalDevice) addUser(fsUUID uuid.UUID) error {
+	if len(j.users) > 0 {
+		return fmt.Errorf("journal device %s already is used by filesystem %s", j.UUID(), j.users[0])
+	}
+	writableFile, err := j.backend.Writable()
+	if err != nil {
+		return err
+	}
+	blockSize := j.superblock.blockSize
+	offset := j.start + int64(journalDeviceSuperblockBlock(blockSize))*int64(blockSize)
+	b := make([]byte, journalSuperblockSize)
+	if _, err := j.backend.ReadAt(b, offset); err != nil {
+		return fmt.Errorf("could not read journal superblock: %w", err)
+	}
+	users := append(j.users, fsUUID)
+	binary.BigEndian.PutUint32(b[journalNrUsersOffset:journalNrUsersOffset+4], uint32(len(users)))
+	for i, u := range users {
+		copy(b[journalUsersOffset+i*journalUUIDSize:], u[:])
+	}
+	if _, err := writableFile.WriteAt(b, offset); err != nil {
+		return fmt.Errorf("could not write journal superblock: %w", err)
+	}
+	j.users = users
+	return nil
+}
+
+// SetJournalDevice give the filesystem its external journal device, which is needed to replay its journal.
+// The journal device must be the one that the filesystem was created to use: its UUID must be the journal UUID
+// in the superblock of the filesystem, and it must list the filesystem as its user.
+func (fs *FileSystem) SetJournalDevice(j *JournalDevice) error {
+	sb := fs.superblock
+	if !sb.features.hasJournal || sb.journalInode != 0 {
+		return errors.New("filesystem does not have an external journal")
+	}
+	if sb.journalSuperblockUUID == nil || *sb.journalSuperblockUUID != *j.superblock.uuid {
+		return fmt.Errorf("journal device %s is not the journal of the filesystem, which is %v", j.UUID(), sb.journalSuperblockUUID)
+	}
+	if j.superblock.blockSize != sb.blockSize {
+		return fmt.Errorf("journal device block size %d does not match filesystem block size %d", j.superblock.blockSize, sb.blockSize)
+	}
+	for _, u := range j.users {
+		if u == *sb.uuid {
+			fs.journalDevice = j
+			return nil
+		}
+	}
+	return fmt.Errorf("journal device %s does not list filesystem %s as its user", j.UUID(), sb.uuid)
+}
@@ -32,6 +32,12 @@ func round(f func(uint32, uint32, uint32) uint32, a, b, c, d, x uint32, s uint)
 
 // halfMD4Transform basic cut-down MD4 transform.  Returns only 32 bits of result.
 func HalfMD4Transform(buf [4]uint32, in []uint32) uint32 {
+	return HalfMD4TransformBuffer(buf, in)[1]
+}
+
+// HalfMD4TransformBuffer basic cut-down MD4 transform. Returns the whole updated buffer, which is the input
+// to the transform of the next part of a longer message.
+func HalfMD4TransformBuffer(buf [4]uint32, in []uint32) [4]uint32 {
 	var a, b, c, d = buf[0], buf[1], buf[2], buf[3]
 
 	/* Round 1 */
@@ -69,5 +75,5 @@ func HalfMD4Transform(buf [4]uint32, in []uint32) uint32 {
 	buf[2] += c
 	buf[3] += d
 
-	return buf[1]
+	return buf
 }
@@ -0,0 +1,337 @@
+package ext4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// ScrubReport what Scrub checked, and what it found wrong
+type ScrubReport struct {
+	GroupDescriptors int // group descriptors whose checksum was checked
+	Bitmaps          int // block and inode bitmaps whose checksum was checked
+	Inodes           int // inodes in use whose checksum was checked
+	ExtentBlocks     int // blocks of extent trees, other than the root in the inode, whose checksum was checked
+	DirectoryBlocks  int // directory blocks whose checksum was checked
+	XattrBlocks      int // extended attribute blocks whose checksum was checked
+	// Problems the checksums that do not match, and the metadata that could not be read, in order of block group
+	Problems []error
+}
+
+// Err the problems joined, or nil if there are none
+func (r *ScrubReport) Err() error {
+	return errors.Join(r.Problems...)
+}
+
+func (r *ScrubReport) add(o *ScrubReport) {
+	r.GroupDescriptors += o.GroupDescriptors
+	r.Bitmaps += o.Bitmaps
+	r.Inodes += o.Inodes
+	r.ExtentBlocks += o.ExtentBlocks
+	r.DirectoryBlocks += o.DirectoryBlocks
+	r.XattrBlocks += o.XattrBlocks
+	r.Problems = append(r.Problems, o.Problems...)
+}
+
+func (r *ScrubReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Errorf(format, args...))
+}
+
+// scrubber the state shared by the workers of a scrub
+type scrubber struct {
+	fs *FileSystem
+	// special the reserved inodes that the superblock points to, which are in use, unlike the others
+	special map[uint32]bool
+	// xattrBlocks the extended attribute blocks already checked, as many inodes may share one
+	xattrMu     sync.Mutex
+	xattrBlocks map[uint64]bool
+}
+
+// Scrub verify the checksums of all of the metadata of the filesystem: the group descriptors, the block and inode
+// bitmaps, the inodes in use, the blocks of their extent trees and of directories with extents, and extended
+// attribute blocks. Unlike Check, it does not cross-check which blocks are in use or the counts, so it only reads
+// each piece of metadata once, and it checks concurrency block groups at once, or as many as there are CPUs if it
+// is 0 or less.
+//
+// Without metadata_csum, only the group descriptors have checksums, if the filesystem has gdt_csum, and it
+// returns an error if it has neither. Problems with the metadata are in the report; the error is only for the
+// scrub itself failing, such as ctx being cancelled, in which case there is no report.
+func (fs *FileSystem) Scrub(ctx context.Context, concurrency int) (*ScrubReport, error) {
+	sb := fs.superblock
+	if sb.gdtChecksumType() == gdtChecksumNone {
+		return nil, fmt.Errorf("filesystem has no metadata checksums")
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	s := &scrubber{fs: fs, special: map[uint32]bool{rootInode: true}, xattrBlocks: map[uint64]bool{}}
+	for _, n := range []uint32{sb.journalInode, sb.userQuotaInode, sb.groupQuotaInode, sb.projectQuotaInode, sb.orphanedInodeInodeNumber} {
+		if n != 0 {
+			s.special[n] = true
+		}
+	}
+	if sb.features.reservedGDTBlocksForExpansion {
+		s.special[resizeInode] = true
+	}
+	groups := int(sb.blockGroupCount())
+	reports := make([]*ScrubReport, groups)
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(concurrency, groups); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bg := range work {
+				reports[bg] = s.scrubGroup(ctx, bg)
+			}
+		}()
+	}
+	for bg := 0; bg < groups && ctx.Err() == nil; bg++ {
+		select {
+		case work <- bg:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &ScrubReport{}
+	for _, r := range reports {
+		report.add(r)
+	}
+	return report, nil
+}
+
+// scrubGroup verify the checksums of the metadata of block group bg, and of the inodes in it. It reads
+// everything itself, rather than through the group descriptors of the filesystem, which are not safe to read
+// from several goroutines at once, and which stop at the first bad checksum.
+func (s *scrubber) scrubGroup(ctx context.Context, bg int) *ScrubReport {
+	fs := s.fs
+	sb := fs.superblock
+	r := &ScrubReport{}
+
+	gd, ok := s.scrubGroupDescriptor(bg, r)
+	if !ok || !sb.features.metadataChecksums {
+		return r
+	}
+
+	// without bigalloc, clusters are blocks
+	clustersPerGroup := sb.clustersPerGroup
+	if clustersPerGroup == 0 {
+		clustersPerGroup = sb.blocksPerGroup
+	}
+	if !gd.flags.blockBitmapUninitialized {
+		s.scrubBitmap(gd.blockBitmapLocation, clustersPerGroup/8, gd.blockBitmapChecksum, gd, "block", r)
+	}
+	if gd.flags.inodesUninitialized {
+		return r
+	}
+	bitmap := s.scrubBitmap(gd.inodeBitmapLocation, sb.inodesPerGroup/8, gd.inodeBitmapChecksum, gd, "inode", r)
+	if bitmap == nil {
+		return r
+	}
+
+	// read the inode table up to the last inode in use in one go
+	last := -1
+	for bit := 0; bit < int(sb.inodesPerGroup); bit++ {
+		if isSet, _ := bitmap.IsSet(bit); isSet {
+			last = bit
+		}
+	}
+	if last < 0 {
+		return r
+	}
+	table := make([]byte, (last+1)*int(sb.inodeSize))
+	if _, err := fs.backend.ReadAt(table, fs.start+int64(gd.inodeTableLocation)*int64(sb.blockSize)); err != nil {
+		r.problem("could not read inode table of block group %d: %v", bg, err)
+		return r
+	}
+	for bit := 0; bit <= last && ctx.Err() == nil; bit++ {
+		if isSet, _ := bitmap.IsSet(bit); !isSet {
+			continue
+		}
+		number := uint32(bg)*sb.inodesPerGroup + uint32(bit) + 1
+		// the other reserved inodes might be in use without ever having been initialized
+		if number < sb.firstNonReservedInode && !s.special[number] {
+			continue
+		}
+		r.Inodes++
+		in, err := inodeFromBytes(table[bit*int(sb.inodeSize):(bit+1)*int(sb.inodeSize)], sb, number)
+		if err != nil {
+			r.problem("inode %d: %v", number, err)
+			continue
+		}
+		s.scrubInode(in, r)
+	}
+	return r
+}
+
+// scrubGroupDescriptor verify the checksum of the descriptor of block group bg, and return it. It is returned even
+// if the checksum does not match, as it still is the best guess of where the rest of the metadata of the group is.
+func (s *scrubber) scrubGroupDescriptor(bg int, r *ScrubReport) (*groupDescriptor, bool) {
+	fs := s.fs
+	sb := fs.superblock
+	gdSize := int64(sb.descriptorSize())
+	perBlock := int64(sb.blockSize) / gdSize
+	b := make([]byte, gdSize)
+	offset := fs.start + int64(sb.gdtBlockLocation(uint64(int64(bg)/perBlock)))*int64(sb.blockSize) + int64(bg)%perBlock*gdSize
+	if _, err := fs.backend.ReadAt(b, offset); err != nil {
+		r.problem("could not read group descriptor of block group %d: %v", bg, err)
+		return nil, false
+	}
+	r.GroupDescriptors++
+	checksum := binary.LittleEndian.Uint16(b[0x1e:0x20])
+	if actual := groupDescriptorChecksum(b, sb.checksumSeed, uint32(bg), sb.gdtChecksumType()); actual != checksum {
+		r.problem("group descriptor of block group %d has checksum %x instead of %x", bg, checksum, actual)
+	}
+	gd, err := groupDescriptorFromBytes(b, uint16(gdSize), bg, gdtChecksumNone, sb.checksumSeed)
+	if err != nil {
+		r.problem("could not read group descriptor of block group %d: %v", bg, err)
+		return nil, false
+	}
+	return gd, true
+}
+
+// scrubBitmap verify the checksum of the first size bytes of the bitmap in block, which the group descriptor gd
+// has as checksum, and return the bitmap
+func (s *scrubber) scrubBitmap(block uint64, size, checksum uint32, gd *groupDescriptor, what string, r *ScrubReport) *util.Bitmap {
+	b, err := s.fs.readBlock(block)
+	if err != nil {
+		r.problem("could not read %s bitmap of block group %d: %v", what, gd.number, err)
+		return nil
+	}
+	r.Bitmaps++
+	if actual := gd.bitmapChecksum(crc.CRC32c(s.fs.superblock.checksumSeed, b[:size])); actual != checksum {
+		r.problem("%s bitmap of block group %d has checksum %x instead of %x", what, gd.number, checksum, actual)
+	}
+	return util.BitmapFromBytes(b[:size])
+}
+
+// scrubInode verify the checksums of the blocks of metadata an inode has outside of itself
+func (s *scrubber) scrubInode(in *inode, r *ScrubReport) {
+	fs := s.fs
+	if block := in.extendedAttributeBlock; block != 0 && s.firstXattrBlock(block) {
+		if b, err := fs.readBlock(block); err != nil {
+			r.problem("could not read extended attribute block %d of inode %d: %v", block, in.number, err)
+		} else {
+			r.XattrBlocks++
+			checksum := binary.LittleEndian.Uint32(b[0x10:0x14])
+			if actual := fs.xattrBlockChecksum(b, block); actual != checksum {
+				r.problem("extended attribute block %d of inode %d has checksum %x instead of %x", block, in.number, checksum, actual)
+			}
+		}
+	}
+	if in.flags.inlineData || in.extents == nil {
+		return
+	}
+
+	checksummer := directoryChecksummer(fs.superblock.checksumSeed, in.number, in.nfsFileVersion)
+	index, err := extentTreeIndexBlocks(in.extents, fs)
+	if err != nil {
+		r.problem("could not read extent tree of inode %d: %v", in.number, err)
+		return
+	}
+	for _, block := range index {
+		b, err := fs.readBlock(block)
+		if err != nil {
+			r.problem("could not read extent tree block %d of inode %d: %v", block, in.number, err)
+			continue
+		}
+		r.ExtentBlocks++
+		// the tail with the checksum is right after the maximum number of entries of the node
+		tailOffset := extentTreeHeaderLength + int(binary.LittleEndian.Uint16(b[4:6]))*extentTreeEntryLength
+		if tailOffset+4 > len(b) {
+			r.problem("extent tree block %d of inode %d has no room for its checksum", block, in.number)
+			continue
+		}
+		checksum := binary.LittleEndian.Uint32(b[tailOffset : tailOffset+4])
+		if actual := checksummer(b[:tailOffset]); actual != checksum {
+			r.problem("extent tree block %d of inode %d has checksum %x instead of %x", block, in.number, checksum, actual)
+		}
+	}
+
+	if in.fileType != fileTypeDirectory {
+		return
+	}
+	exts, err := in.extents.blocks(fs)
+	if err != nil {
+		r.problem("could not read extents of directory inode %d: %v", in.number, err)
+		return
+	}
+	for _, e := range exts {
+		for i := uint64(0); i < uint64(e.count); i++ {
+			block := e.startingBlock + i
+			b, err := fs.readBlock(block)
+			if err != nil {
+				r.problem("could not read block %d of directory inode %d: %v", block, in.number, err)
+				continue
+			}
+			r.DirectoryBlocks++
+			if err := scrubDirectoryBlock(b, uint64(e.fileBlock)+i, in.flags.hashedDirectoryIndexes, checksummer); err != nil {
+				r.problem("block %d of directory inode %d: %v", block, in.number, err)
+			}
+		}
+	}
+}
+
+// firstXattrBlock whether block is an extended attribute block that was not checked yet
+func (s *scrubber) firstXattrBlock(block uint64) bool {
+	s.xattrMu.Lock()
+	defer s.xattrMu.Unlock()
+	if s.xattrBlocks[block] {
+		return false
+	}
+	s.xattrBlocks[block] = true
+	return true
+}
+
+// scrubDirectoryBlock verify the checksum of block fileBlock of a directory. A block of entries ends in a fake entry
+// with the checksum; with a hash tree index, the first block is the dx_root, and others may be dx_node blocks,
+// whose dx_tail has the checksum of the count, limit and index entries in use.
+func scrubDirectoryBlock(b []byte, fileBlock uint64, hashed bool, checksummer checksummer) error {
+	blocksize := len(b)
+	countOffset := -1
+	switch {
+	case hashed && fileBlock == 0:
+		countOffset = directoryHashTreeRootCountOffset
+	case hashed && binary.LittleEndian.Uint32(b[0:4]) == 0 && int(binary.LittleEndian.Uint16(b[4:6])) == blocksize:
+		// a dx_node is a single empty entry for the whole block, so that it looks like one without index
+		countOffset = directoryHashTreeNodeCountOffset
+	}
+	if countOffset < 0 {
+		tail := b[blocksize-minDirEntryLength:]
+		checksum, err := directoryEntriesChecksumFromBytes(tail)
+		if err != nil {
+			return fmt.Errorf("no checksum at the end of the block: %v", err)
+		}
+		if actual := checksummer(b[:blocksize-minDirEntryLength]); actual != checksum {
+			return fmt.Errorf("checksum %x instead of %x", checksum, actual)
+		}
+		return nil
+	}
+
+	limit := int(binary.LittleEndian.Uint16(b[countOffset : countOffset+2]))
+	count := int(binary.LittleEndian.Uint16(b[countOffset+2 : countOffset+4]))
+	tailOffset := countOffset + limit*directoryHashEntrySize
+	if count > limit || tailOffset+directoryHashTreeTailSize > blocksize {
+		return fmt.Errorf("hash tree index of %d entries with a limit of %d has no room for its checksum", count, limit)
+	}
+	size := countOffset + count*directoryHashEntrySize
+	checksum := binary.LittleEndian.Uint32(b[tailOffset+4 : tailOffset+8])
+	// the checksum covers the dx_tail, with the checksum itself as zeroes
+	data := append(b[:size:size], b[tailOffset:tailOffset+4]...)
+	data = append(data, 0, 0, 0, 0)
+	if actual := checksummer(data); actual != checksum {
+		return fmt.Errorf("hash tree index checksum %x instead of %x", checksum, actual)
+	}
+	return nil
+}
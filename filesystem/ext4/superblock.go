@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"slices"
 	"sort"
 	"time"
 
@@ -384,8 +385,8 @@ func superblockFromBytes(b []byte) (*superblock, error) {
 
 	sb.logGroupsPerFlex = uint64(math.Exp2(float64(b[0x174])))
 
-	sb.checksumType = b[0x175] // only valid one is 1
-	if sb.checksumType != checkSumTypeCRC32c {
+	sb.checksumType = b[0x175] // only valid one is 1, and only set with metadata checksums
+	if sb.features.metadataChecksums && sb.checksumType != checkSumTypeCRC32c {
 		return nil, fmt.Errorf("cannot read superblock: invalid checksum type %d, only valid is %d", sb.checksumType, checkSumTypeCRC32c)
 	}
 
@@ -669,7 +670,10 @@ func (sb *superblock) toBytes() ([]byte, error) {
 	binary.LittleEndian.PutUint32(b[0x268:0x26c], sb.lostFoundInode)
 	binary.LittleEndian.PutUint32(b[0x26c:0x270], sb.projectQuotaInode)
 
-	binary.LittleEndian.PutUint32(b[0x270:0x274], sb.checksumSeed)
+	// the seed only is stored when the feature says so, otherwise it always is calculated from the UUID
+	if sb.features.metadataChecksumSeedInSuperblock {
+		binary.LittleEndian.PutUint32(b[0x270:0x274], sb.checksumSeed)
+	}
 
 	binary.LittleEndian.PutUint16(b[0x27c:0x27e], sb.filenameCharsetEncoding)
 	binary.LittleEndian.PutUint16(b[0x27e:0x280], sb.filenameCharsetEncodingFlags)
@@ -700,14 +704,173 @@ func (sb *superblock) gdtChecksumType() gdtChecksumType {
 }
 
 func (sb *superblock) blockGroupCount() uint64 {
-	whole := sb.blockCount / uint64(sb.blocksPerGroup)
-	part := sb.blockCount % uint64(sb.blocksPerGroup)
+	// with 1K blocks, block 0 is not part of any block group
+	if sb.blocksPerGroup == 0 || sb.blockCount <= uint64(sb.firstDataBlock) {
+		return 0
+	}
+	blocks := sb.blockCount - uint64(sb.firstDataBlock)
+	whole := blocks / uint64(sb.blocksPerGroup)
+	part := blocks % uint64(sb.blocksPerGroup)
 	if part > 0 {
 		whole++
 	}
 	return whole
 }
 
+// descriptorSize the size of a group descriptor. Without 64bit the size in the superblock is not used,
+// and usually is 0.
+func (sb *superblock) descriptorSize() uint16 {
+	if sb.features.fs64Bit {
+		return sb.groupDescriptorSize
+	}
+	return groupDescriptorSize
+}
+
+// descriptorsPerBlock how many group descriptors fit in a block, which also is how many block groups are in
+// a meta block group
+func (sb *superblock) descriptorsPerBlock() uint64 {
+	return uint64(sb.blockSize) / uint64(sb.descriptorSize())
+}
+
+// gdtBlockCount how many blocks the group descriptor table takes, not counting the reserved GDT blocks after it
+func (sb *superblock) gdtBlockCount() uint64 {
+	perBlock := sb.descriptorsPerBlock()
+	return (sb.blockGroupCount() + perBlock - 1) / perBlock
+}
+
+// primaryGDTBlocks how many blocks of the GDT are right after the superblock, and after each copy of it: all
+// of them, except with meta_bg, where only those before the first meta block group are
+func (sb *superblock) primaryGDTBlocks() uint64 {
+	if sb.features.metaBlockGroups {
+		return min(uint64(sb.firstMetablockGroup), sb.gdtBlockCount())
+	}
+	return sb.gdtBlockCount()
+}
+
+// groupStart the first block of block group bg
+func (sb *superblock) groupStart(bg uint64) uint64 {
+	return uint64(sb.firstDataBlock) + bg*uint64(sb.blocksPerGroup)
+}
+
+// metaGroupGDTGroups the block groups that hold a copy of block of the GDT with meta_bg: the first, second and
+// last groups of its meta block group, those that exist
+func (sb *superblock) metaGroupGDTGroups(block uint64) []uint64 {
+	perBlock := sb.descriptorsPerBlock()
+	first := block * perBlock
+	groups := make([]uint64, 0, 3)
+	for _, bg := range []uint64{first, first + 1, first + perBlock - 1} {
+		if bg < sb.blockGroupCount() && !slices.Contains(groups, bg) {
+			groups = append(groups, bg)
+		}
+	}
+	return groups
+}
+
+// gdtBlockLocation the block number of block of the primary copy of the GDT. Without meta_bg, the GDT is
+// in the blocks right after the superblock; with it, every block from the first meta block group on is at
+// the start of the first group of its meta block group, after the copy of the superblock if there is one.
+func (sb *superblock) gdtBlockLocation(block uint64) uint64 {
+	// the superblock is 1024 bytes in, so in block 1 with 1K blocks, and block 0 otherwise
+	gdtStart := uint64(1)
+	if sb.blockSize == 1024 {
+		gdtStart = 2
+	}
+	if !sb.features.metaBlockGroups || block < uint64(sb.firstMetablockGroup) {
+		return gdtStart + block
+	}
+	bg := block * sb.descriptorsPerBlock()
+	if bg == 0 {
+		return gdtStart
+	}
+	location := sb.groupStart(bg)
+	if groupHasSuperblock(int64(bg), sb.features, sb.backupSuperblockBlockGroups) {
+		location++
+	}
+	return location
+}
+
+// groupMetadataBlocks how many blocks at the start of block group bg hold a copy of the superblock and of the
+// GDT, as the kernel counts them: the superblock, the primary GDT blocks and the reserved GDT blocks in groups
+// with a copy of the superblock, and with meta_bg, the block of the GDT of the meta block group in each group
+// that keeps a copy of it.
+func (sb *superblock) groupMetadataBlocks(bg uint64) uint64 {
+	var count uint64
+	hasSuperblock := groupHasSuperblock(int64(bg), sb.features, sb.backupSuperblockBlockGroups)
+	if hasSuperblock {
+		count++
+	}
+	block := bg / sb.descriptorsPerBlock()
+	if !sb.features.metaBlockGroups || block < uint64(sb.firstMetablockGroup) {
+		if hasSuperblock {
+			count += sb.primaryGDTBlocks() + uint64(sb.reservedGDTBlocks)
+		}
+		return count
+	}
+	if slices.Contains(sb.metaGroupGDTGroups(block), bg) {
+		count++
+	}
+	return count
+}
+
+// validateGeometry check that the block group layout the superblock describes is one that can be read, so that
+// a corrupt or unusual superblock gives an error rather than a wrong block group count, or a panic
+func (sb *superblock) validateGeometry() error {
+	if sb.blockSize < 1024 || sb.blockSize > 65536 {
+		return fmt.Errorf("unsupported block size %d", sb.blockSize)
+	}
+	if sb.blocksPerGroup == 0 || uint64(sb.blocksPerGroup) > 8*uint64(sb.blockSize) {
+		return fmt.Errorf("invalid %d blocks per group for a block size of %d", sb.blocksPerGroup, sb.blockSize)
+	}
+	if uint64(sb.firstDataBlock) >= sb.blockCount {
+		return fmt.Errorf("first data block %d is beyond the %d blocks of the filesystem", sb.firstDataBlock, sb.blockCount)
+	}
+	if sb.features.fs64Bit {
+		size := sb.groupDescriptorSize
+		if size < groupDescriptorSize64Bit || size > maxGroupDescriptorSize || size&(size-1) != 0 {
+			return fmt.Errorf("unsupported group descriptor size %d for a 64-bit filesystem", size)
+		}
+	}
+	groups := sb.blockGroupCount()
+	if groups*uint64(sb.inodesPerGroup) != uint64(sb.inodeCount) {
+		return fmt.Errorf("%d block groups of %d inodes do not make the %d inodes of the filesystem", groups, sb.inodesPerGroup, sb.inodeCount)
+	}
+	if sb.features.metaBlockGroups {
+		if uint64(sb.firstMetablockGroup) > sb.gdtBlockCount() {
+			return fmt.Errorf("first meta block group %d is beyond the %d blocks of the GDT", sb.firstMetablockGroup, sb.gdtBlockCount())
+		}
+	}
+	// the superblock and the GDT that is not in meta block groups must fit in the first block group
+	if metadata := sb.groupMetadataBlocks(0); metadata > uint64(sb.blocksPerGroup) {
+		return fmt.Errorf("superblock and %d GDT blocks do not fit in a block group of %d blocks", metadata-1, sb.blocksPerGroup)
+	}
+	return nil
+}
+
+// groupHasSuperblock whether block group bg holds a copy of the superblock and GDT: the first group always does,
+// with sparse_super2 only the (up to) two groups listed in the superblock, with sparse_super only groups 1 and
+// powers of 3, 5 and 7, otherwise every group.
+func groupHasSuperblock(bg int64, f featureFlags, backups [2]uint32) bool {
+	switch {
+	case bg == 0:
+		return true
+	case f.sparseSuperBlockV2:
+		return bg == int64(backups[0]) || bg == int64(backups[1])
+	case f.sparseSuperblock:
+		for _, base := range []int64{3, 5, 7} {
+			n := int64(1)
+			for n < bg {
+				n *= base
+			}
+			if n == bg {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
 // calculateBackupSuperblocks calculate which block groups should have backup superblocks.
 func calculateBackupSuperblockGroups(bgs int64) []int64 {
 	// calculate which block groups should have backup superblocks
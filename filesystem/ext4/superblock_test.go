@@ -63,3 +63,121 @@ func TestCalculateBackupSuperblocks(t *testing.T) {
 		})
 	}
 }
+
+// testGeometrySuperblock a superblock with just the fields that describe the block group layout, with 8 inodes
+// in each group
+func testGeometrySuperblock(blockSize, blocksPerGroup uint32, blockCount uint64, f featureFlags, gdSize uint16, firstMetaBG uint32) *superblock {
+	sb := &superblock{
+		blockSize:           blockSize,
+		blocksPerGroup:      blocksPerGroup,
+		blockCount:          blockCount,
+		features:            f,
+		groupDescriptorSize: gdSize,
+		firstMetablockGroup: firstMetaBG,
+		inodesPerGroup:      8,
+	}
+	if blockSize == 1024 {
+		sb.firstDataBlock = 1
+	}
+	sb.inodeCount = uint32(sb.blockGroupCount()) * sb.inodesPerGroup
+	return sb
+}
+
+func TestSuperblockGeometry(t *testing.T) {
+	plain := featureFlags{sparseSuperblock: true, flexBlockGroups: true}
+	wide := featureFlags{sparseSuperblock: true, flexBlockGroups: true, fs64Bit: true}
+	metaBG := featureFlags{sparseSuperblock: true, flexBlockGroups: true, metaBlockGroups: true}
+	wideMetaBG := featureFlags{sparseSuperblock: true, fs64Bit: true, metaBlockGroups: true}
+	tests := []struct {
+		name      string
+		sb        *superblock
+		groups    uint64
+		gdSize    uint16
+		gdtBlocks uint64
+		// locations of blocks of the GDT, by block
+		locations map[uint64]uint64
+		// blocks of superblock and GDT at the start of groups, by group
+		metadata map[uint64]uint64
+	}{
+		{"32-bit", testGeometrySuperblock(4096, 32768, 1000*32768-5, plain, 0, 0), 1000, 32, 8,
+			map[uint64]uint64{0: 1, 7: 8}, map[uint64]uint64{0: 9, 1: 9, 2: 0, 3: 9}},
+		{"1K blocks", testGeometrySuperblock(1024, 8192, 100*8192+1, plain, 0, 0), 100, 32, 4,
+			map[uint64]uint64{0: 2, 3: 5}, map[uint64]uint64{0: 5, 9: 5, 10: 0}},
+		// 64-bit with the descriptor size of 32-bit in the superblock, which is not used
+		{"32-bit with descriptor size", testGeometrySuperblock(4096, 32768, 129*32768, plain, 64, 0), 129, 32, 2,
+			map[uint64]uint64{1: 2}, map[uint64]uint64{0: 3}},
+		{"64-bit", testGeometrySuperblock(4096, 32768, 129*32768, wide, 64, 0), 129, 64, 3,
+			map[uint64]uint64{2: 3}, map[uint64]uint64{0: 4}},
+		{"64-bit large descriptors", testGeometrySuperblock(4096, 32768, 129*32768, wide, 128, 0), 129, 128, 5,
+			map[uint64]uint64{4: 5}, map[uint64]uint64{0: 6}},
+		// 64K blocks make 256TB addressable with 32 bits
+		{"32-bit 64K blocks", testGeometrySuperblock(65536, 524288, 1<<32-1, plain, 0, 0), 8192, 32, 4,
+			map[uint64]uint64{3: 4}, map[uint64]uint64{0: 5, 8191: 0}},
+		// meta block groups of 128 groups; the first block of the GDT stays after the superblock
+		{"meta_bg", testGeometrySuperblock(4096, 32768, 1000*32768, metaBG, 0, 1), 1000, 32, 8,
+			map[uint64]uint64{0: 1, 1: 128 * 32768, 7: 896 * 32768},
+			map[uint64]uint64{0: 2, 1: 2, 3: 2, 127: 0, 128: 1, 129: 1, 130: 0, 255: 1, 256: 1, 343: 1, 999: 0}},
+		{"meta_bg from the start", testGeometrySuperblock(1024, 8192, 100*8192+1, wideMetaBG, 64, 0), 100, 64, 7,
+			map[uint64]uint64{0: 2, 1: 16*8192 + 1, 2: 32*8192 + 1, 6: 96*8192 + 1},
+			map[uint64]uint64{0: 2, 1: 2, 2: 0, 15: 1, 16: 1, 17: 1, 25: 1, 27: 1, 31: 1, 49: 2, 96: 1, 97: 1, 99: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sb.validateGeometry(); err != nil {
+				t.Fatalf("unexpected error validating: %v", err)
+			}
+			if groups := tt.sb.blockGroupCount(); groups != tt.groups {
+				t.Errorf("%d block groups instead of %d", groups, tt.groups)
+			}
+			if gdSize := tt.sb.descriptorSize(); gdSize != tt.gdSize {
+				t.Errorf("descriptor size %d instead of %d", gdSize, tt.gdSize)
+			}
+			if gdtBlocks := tt.sb.gdtBlockCount(); gdtBlocks != tt.gdtBlocks {
+				t.Errorf("%d GDT blocks instead of %d", gdtBlocks, tt.gdtBlocks)
+			}
+			for block, expected := range tt.locations {
+				if location := tt.sb.gdtBlockLocation(block); location != expected {
+					t.Errorf("block %d of the GDT at %d instead of %d", block, location, expected)
+				}
+			}
+			for bg, expected := range tt.metadata {
+				if count := tt.sb.groupMetadataBlocks(bg); count != expected {
+					t.Errorf("%d metadata blocks in block group %d instead of %d", count, bg, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSuperblockValidateGeometry(t *testing.T) {
+	wide := featureFlags{sparseSuperblock: true, fs64Bit: true}
+	wrongInodes := testGeometrySuperblock(4096, 32768, 100*32768, wide, 64, 0)
+	wrongInodes.inodeCount--
+	tests := []struct {
+		name string
+		sb   *superblock
+	}{
+		{"no blocks per group", testGeometrySuperblock(4096, 0, 100*32768, wide, 64, 0)},
+		{"more blocks per group than a bitmap holds", testGeometrySuperblock(4096, 32769, 100*32768, wide, 64, 0)},
+		{"64-bit without descriptor size", testGeometrySuperblock(4096, 32768, 100*32768, wide, 0, 0)},
+		{"64-bit with 32-byte descriptors", testGeometrySuperblock(4096, 32768, 100*32768, wide, 32, 0)},
+		{"descriptor size not a power of 2", testGeometrySuperblock(4096, 32768, 100*32768, wide, 96, 0)},
+		{"descriptor size too large", testGeometrySuperblock(4096, 32768, 100*32768, wide, 2048, 0)},
+		{"inode count", wrongInodes},
+		{"first meta block group beyond the GDT", testGeometrySuperblock(4096, 32768, 100*32768, featureFlags{metaBlockGroups: true}, 0, 2)},
+		// 524288 groups need 16384 blocks of GDT, more than fit in a group, so need meta_bg
+		{"GDT larger than a block group", testGeometrySuperblock(1024, 8192, 1<<32-1, featureFlags{sparseSuperblock: true}, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.sb.validateGeometry(); err == nil {
+				t.Errorf("no error for invalid geometry")
+			}
+		})
+	}
+	// the same with meta_bg is fine
+	sb := testGeometrySuperblock(1024, 8192, 1<<32-1, featureFlags{sparseSuperblock: true, metaBlockGroups: true}, 0, 0)
+	if err := sb.validateGeometry(); err != nil {
+		t.Errorf("unexpected error for meta_bg: %v", err)
+	}
+}
@@ -0,0 +1,649 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem/ext4/crc"
+)
+
+/*
+	Extended attributes are stored in two places: in the space at the end of the inode, after the extra fields,
+	and in a single block that the inode points to with i_file_acl. Both hold a list of entries, ending with
+	4 zero bytes, followed by free space, with the values packed at the end.
+
+	In the inode, the entries follow a 4-byte magic, and the offsets of the values are from the first entry.
+	In the block, they follow a 32-byte header, and the offsets are from the start of the block.
+
+	The names are stored without their namespace prefix, which is replaced by an index.
+	See https://www.kernel.org/doc/html/latest/filesystems/ext4/attributes.html
+
+	Inodes whose attributes in the block are the same share the block, which counts how many do. Linux finds
+	a block to share among those it has recently used, by the hash of the block; so does xattrBlockCache.
+*/
+
+const (
+	xattrMagic             uint32 = 0xea020000
+	xattrBlockHeaderSize          = 32
+	xattrEntryHeaderSize          = 16
+	xattrMaxNameLength            = 255
+	xattrNameHashShift            = 5
+	xattrValueHashShift           = 16
+	xattrBlockHashShift           = 16
+	xattrInodeHeaderSize          = 4
+	xattrEntriesTerminator        = 4
+	// xattrRefcountMax how many inodes may share a block of extended attributes, as in Linux
+	xattrRefcountMax = 1024
+)
+
+// ErrNoXattr is returned when reading or removing an extended attribute that a file does not have
+var ErrNoXattr = errors.New("no such extended attribute")
+
+// xattrPrefixes the namespace prefix of each name index. Those that are a whole name, and not a prefix,
+// are matched before the others.
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{2, "system.posix_acl_access"},
+	{3, "system.posix_acl_default"},
+	{8, "system.richacl"},
+	{1, "user."},
+	{4, "trusted."},
+	{6, "security."},
+	{7, "system."},
+}
+
+// xattr a single extended attribute
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// splitXattrName split the full name of an extended attribute into the index of its namespace and the rest of it
+func splitXattrName(name string) (uint8, string, error) {
+	for _, p := range xattrPrefixes {
+		if !strings.HasPrefix(name, p.prefix) {
+			continue
+		}
+		suffix := name[len(p.prefix):]
+		// a prefix that is a whole name must be the whole name; the others must have something after them
+		if strings.HasSuffix(p.prefix, ".") == (suffix == "") {
+			continue
+		}
+		if len(suffix) > xattrMaxNameLength {
+			return 0, "", fmt.Errorf("extended attribute name %s is longer than %d characters", name, xattrMaxNameLength)
+		}
+		return p.index, suffix, nil
+	}
+	return 0, "", fmt.Errorf("unsupported namespace for extended attribute %s", name)
+}
+
+// fullName the name of the extended attribute, including its namespace prefix
+func (x *xattr) fullName() string {
+	for _, p := range xattrPrefixes {
+		if p.index == x.index {
+			return p.prefix + x.name
+		}
+	}
+	return fmt.Sprintf("unknown%d.%s", x.index, x.name)
+}
+
+// entrySize how many bytes the entry for the extended attribute takes, not including its value
+func (x *xattr) entrySize() int {
+	return (xattrEntryHeaderSize + len(x.name) + 3) &^ 3
+}
+
+// valueSize how many bytes the value of the extended attribute takes, padded to 4 bytes
+func (x *xattr) valueSize() int {
+	return (len(x.value) + 3) &^ 3
+}
+
+// hash the hash of the entry, over its name and value
+func (x *xattr) hash() uint32 {
+	var hash uint32
+	for _, c := range []byte(x.name) {
+		hash = (hash << xattrNameHashShift) ^ (hash >> (32 - xattrNameHashShift)) ^ uint32(c)
+	}
+	value := make([]byte, x.valueSize())
+	copy(value, x.value)
+	for i := 0; i < len(value); i += 4 {
+		hash = (hash << xattrValueHashShift) ^ (hash >> (32 - xattrValueHashShift)) ^ binary.LittleEndian.Uint32(value[i:i+4])
+	}
+	return hash
+}
+
+// parseXattrEntries parse the entries starting at b[start:], whose values are at offsets from the start of b
+func parseXattrEntries(b []byte, start int) ([]xattr, error) {
+	var attrs []xattr
+	for pos := start; pos+xattrEntriesTerminator <= len(b) && binary.LittleEndian.Uint32(b[pos:pos+4]) != 0; {
+		if pos+xattrEntryHeaderSize > len(b) {
+			return nil, fmt.Errorf("extended attribute entry at %d runs past the end", pos)
+		}
+		nameLength := int(b[pos])
+		index := b[pos+1]
+		valueOffset := int(binary.LittleEndian.Uint16(b[pos+0x2 : pos+0x4]))
+		valueInode := binary.LittleEndian.Uint32(b[pos+0x4 : pos+0x8])
+		valueSize := int(binary.LittleEndian.Uint32(b[pos+0x8 : pos+0xc]))
+		if pos+xattrEntryHeaderSize+nameLength > len(b) {
+			return nil, fmt.Errorf("extended attribute name at %d runs past the end", pos)
+		}
+		x := xattr{
+			index: index,
+			name:  string(b[pos+xattrEntryHeaderSize : pos+xattrEntryHeaderSize+nameLength]),
+		}
+		if valueInode != 0 {
+			return nil, fmt.Errorf("extended attribute %s has its value in inode %d, which is not supported", x.fullName(), valueInode)
+		}
+		if valueOffset+valueSize > len(b) {
+			return nil, fmt.Errorf("value of extended attribute %s runs past the end", x.fullName())
+		}
+		x.value = make([]byte, valueSize)
+		copy(x.value, b[valueOffset:valueOffset+valueSize])
+		attrs = append(attrs, x)
+		pos += x.entrySize()
+	}
+	return attrs, nil
+}
+
+// xattrsToBytes lay out the entries starting at start in b, with the values packed at the end of it,
+// and their offsets from the start of b. Returns an error if they do not fit.
+func xattrsToBytes(attrs []xattr, b []byte, start int) error {
+	size := start + xattrEntriesTerminator
+	for i := range attrs {
+		size += attrs[i].entrySize() + attrs[i].valueSize()
+	}
+	if size > len(b) {
+		return fmt.Errorf("extended attributes need %d bytes, only %d available", size, len(b))
+	}
+	pos, valueEnd := start, len(b)
+	for i := range attrs {
+		x := &attrs[i]
+		var valueOffset int
+		if len(x.value) > 0 {
+			valueEnd -= x.valueSize()
+			valueOffset = valueEnd
+			copy(b[valueOffset:], x.value)
+		}
+		b[pos] = uint8(len(x.name))
+		b[pos+1] = x.index
+		binary.LittleEndian.PutUint16(b[pos+0x2:pos+0x4], uint16(valueOffset))
+		binary.LittleEndian.PutUint32(b[pos+0x4:pos+0x8], 0)
+		binary.LittleEndian.PutUint32(b[pos+0x8:pos+0xc], uint32(len(x.value)))
+		binary.LittleEndian.PutUint32(b[pos+0xc:pos+0x10], x.hash())
+		copy(b[pos+xattrEntryHeaderSize:], x.name)
+		pos += x.entrySize()
+	}
+	return nil
+}
+
+// sortXattrs sort extended attributes the way the kernel keeps them in a block: by index, then length of name, then name
+func sortXattrs(attrs []xattr) {
+	sort.Slice(attrs, func(i, j int) bool {
+		a, b := attrs[i], attrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+}
+
+// parseInlineXattrs the extended attributes in the inode itself
+func (i *inode) parseInlineXattrs() ([]xattr, error) {
+	b := i.inlineXattrs
+	if len(b) < xattrInodeHeaderSize || binary.LittleEndian.Uint32(b[0:4]) != xattrMagic {
+		return nil, nil
+	}
+	return parseXattrEntries(b[xattrInodeHeaderSize:], 0)
+}
+
+// setInlineXattrs replace the extended attributes in the inode itself. Returns an error if they do not fit.
+func (i *inode) setInlineXattrs(attrs []xattr, inodeSize uint16) error {
+	size := int(inodeSize) - i.xattrOffset()
+	if len(attrs) == 0 {
+		i.inlineXattrs = nil
+		return nil
+	}
+	if size < xattrInodeHeaderSize {
+		return fmt.Errorf("inode has no room for extended attributes")
+	}
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint32(b[0:4], xattrMagic)
+	if err := xattrsToBytes(attrs, b[xattrInodeHeaderSize:], 0); err != nil {
+		return err
+	}
+	i.inlineXattrs = b
+	return nil
+}
+
+// xattrBlock an external block of extended attributes
+type xattrBlock struct {
+	refCount uint32
+	attrs    []xattr
+}
+
+// readXattrBlock read the block of extended attributes at the given block number
+func (fs *FileSystem) readXattrBlock(blockNumber uint64) (*xattrBlock, error) {
+	b, err := fs.readBlock(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if magic := binary.LittleEndian.Uint32(b[0x0:0x4]); magic != xattrMagic {
+		return nil, fmt.Errorf("invalid extended attribute block %d, magic %x instead of %x", blockNumber, magic, xattrMagic)
+	}
+	if fs.superblock.features.metadataChecksums {
+		checksum := binary.LittleEndian.Uint32(b[0x10:0x14])
+		if actual := fs.xattrBlockChecksum(b, blockNumber); actual != checksum {
+			return nil, fmt.Errorf("checksum mismatch for extended attribute block %d, on-disk %x vs calculated %x", blockNumber, checksum, actual)
+		}
+	}
+	attrs, err := parseXattrEntries(b, xattrBlockHeaderSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse extended attribute block %d: %w", blockNumber, err)
+	}
+	fs.xattrBlocks.add(blockNumber, binary.LittleEndian.Uint32(b[0xc:0x10]))
+	return &xattrBlock{
+		refCount: binary.LittleEndian.Uint32(b[0x4:0x8]),
+		attrs:    attrs,
+	}, nil
+}
+
+// xattrBlockToBytes lay out a block of extended attributes for writing at the given block number
+func (fs *FileSystem) xattrBlockToBytes(x *xattrBlock, blockNumber uint64) ([]byte, error) {
+	b := make([]byte, fs.superblock.blockSize)
+	sortXattrs(x.attrs)
+	if err := xattrsToBytes(x.attrs, b, xattrBlockHeaderSize); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(b[0x0:0x4], xattrMagic)
+	binary.LittleEndian.PutUint32(b[0x4:0x8], x.refCount)
+	binary.LittleEndian.PutUint32(b[0x8:0xc], 1)
+	binary.LittleEndian.PutUint32(b[0xc:0x10], x.hash())
+	if fs.superblock.features.metadataChecksums {
+		binary.LittleEndian.PutUint32(b[0x10:0x14], fs.xattrBlockChecksum(b, blockNumber))
+	}
+	return b, nil
+}
+
+// hash the hash of the block, over the hashes of its entries, which is 0 if any of them is
+func (x *xattrBlock) hash() uint32 {
+	var hash uint32
+	for i := range x.attrs {
+		entryHash := x.attrs[i].hash()
+		if entryHash == 0 {
+			return 0
+		}
+		hash = (hash << xattrBlockHashShift) ^ (hash >> (32 - xattrBlockHashShift)) ^ entryHash
+	}
+	return hash
+}
+
+// sameAttrs whether the block holds the same extended attributes as attrs, which are sorted
+func (x *xattrBlock) sameAttrs(attrs []xattr) bool {
+	sortXattrs(x.attrs)
+	return slices.EqualFunc(x.attrs, attrs, func(a, b xattr) bool {
+		return a.index == b.index && a.name == b.name && slices.Equal(a.value, b.value)
+	})
+}
+
+// xattrBlockCache the blocks of extended attributes that a filesystem has read or written, by their hash, so that
+// an inode whose attributes are the same as those of one of them can share it, as the mbcache of Linux does.
+// Blocks with a hash of 0 are never shared.
+type xattrBlockCache struct {
+	mu     sync.Mutex
+	byHash map[uint32][]uint64
+	hashes map[uint64]uint32
+}
+
+// add the block at blockNumber, with its hash
+func (c *xattrBlockCache) add(blockNumber uint64, hash uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.hashes[blockNumber]; ok {
+		if old == hash {
+			return
+		}
+		c.removeLocked(blockNumber)
+	}
+	if hash == 0 {
+		return
+	}
+	if c.byHash == nil {
+		c.byHash = map[uint32][]uint64{}
+		c.hashes = map[uint64]uint32{}
+	}
+	c.byHash[hash] = append(c.byHash[hash], blockNumber)
+	c.hashes[blockNumber] = hash
+}
+
+// remove the block at blockNumber, which is freed, or about to change
+func (c *xattrBlockCache) remove(blockNumber uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(blockNumber)
+}
+
+func (c *xattrBlockCache) removeLocked(blockNumber uint64) {
+	hash, ok := c.hashes[blockNumber]
+	if !ok {
+		return
+	}
+	delete(c.hashes, blockNumber)
+	c.byHash[hash] = slices.DeleteFunc(c.byHash[hash], func(b uint64) bool { return b == blockNumber })
+	if len(c.byHash[hash]) == 0 {
+		delete(c.byHash, hash)
+	}
+}
+
+// candidates the blocks with the given hash
+func (c *xattrBlockCache) candidates(hash uint32) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.byHash[hash])
+}
+
+// findSharedXattrBlock find a block of extended attributes, other than exclude, that holds the same ones as block,
+// and that another inode can share, or 0 if there is none
+func (fs *FileSystem) findSharedXattrBlock(block *xattrBlock, exclude uint64) (uint64, *xattrBlock) {
+	hash := block.hash()
+	if hash == 0 {
+		return 0, nil
+	}
+	for _, candidate := range fs.xattrBlocks.candidates(hash) {
+		if candidate == exclude {
+			continue
+		}
+		shared, err := fs.readXattrBlock(candidate)
+		if err != nil {
+			// not what it was, so it is not looked at again
+			fs.xattrBlocks.remove(candidate)
+			continue
+		}
+		if shared.refCount < xattrRefcountMax && shared.sameAttrs(block.attrs) {
+			return candidate, shared
+		}
+	}
+	return 0, nil
+}
+
+// xattrBlockChecksum the checksum of a block of extended attributes, over the block number and the block,
+// with the checksum itself as zeroes
+func (fs *FileSystem) xattrBlockChecksum(b []byte, blockNumber uint64) uint32 {
+	numBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(numBytes, blockNumber)
+	crcResult := crc.CRC32c(fs.superblock.checksumSeed, numBytes)
+	crcResult = crc.CRC32c(crcResult, b[:0x10])
+	crcResult = crc.CRC32c(crcResult, make([]byte, 4))
+	return crc.CRC32c(crcResult, b[0x14:])
+}
+
+// writeXattrBlock write a block of extended attributes
+func (fs *FileSystem) writeXattrBlock(x *xattrBlock, blockNumber uint64) error {
+	b, err := fs.xattrBlockToBytes(x, blockNumber)
+	if err != nil {
+		return err
+	}
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	if _, err := writableFile.WriteAt(b, fs.start+int64(blockNumber)*int64(fs.superblock.blockSize)); err != nil {
+		fs.xattrBlocks.remove(blockNumber)
+		return fmt.Errorf("could not write extended attribute block %d: %w", blockNumber, err)
+	}
+	fs.xattrBlocks.add(blockNumber, x.hash())
+	return nil
+}
+
+// readXattrs read all of the extended attributes of an inode, both those in the inode and those in its block
+func (fs *FileSystem) readXattrs(in *inode) (inline []xattr, block *xattrBlock, err error) {
+	inline, err = in.parseInlineXattrs()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse extended attributes in inode %d: %w", in.number, err)
+	}
+	if in.extendedAttributeBlock != 0 {
+		block, err = fs.readXattrBlock(in.extendedAttributeBlock)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return inline, block, nil
+}
+
+// xattrInode read the inode of the file at p, for its extended attributes
+func (fs *FileSystem) xattrInode(p string) (*inode, error) {
+	_, entry, err := fs.getEntryAndParent(p)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("file does not exist: %s", p)
+	}
+	in, err := fs.readInode(entry.inode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d for %s: %w", entry.inode, p, err)
+	}
+	return in, nil
+}
+
+// Listxattr list the names of the extended attributes of the file at p, with their namespace prefixes,
+// e.g. security.selinux or user.comment. Symlinks are not followed.
+func (fs *FileSystem) Listxattr(p string) ([]string, error) {
+	in, err := fs.xattrInode(p)
+	if err != nil {
+		return nil, err
+	}
+	inline, block, err := fs.readXattrs(in)
+	if err != nil {
+		return nil, err
+	}
+	attrs := inline
+	if block != nil {
+		attrs = append(attrs, block.attrs...)
+	}
+	names := make([]string, 0, len(attrs))
+	for i := range attrs {
+		names = append(names, attrs[i].fullName())
+	}
+	return names, nil
+}
+
+// Getxattr get the value of the extended attribute name of the file at p. Symlinks are not followed.
+// Returns an error wrapping ErrNoXattr if the file does not have it.
+func (fs *FileSystem) Getxattr(p, name string) ([]byte, error) {
+	index, suffix, err := splitXattrName(name)
+	if err != nil {
+		return nil, err
+	}
+	in, err := fs.xattrInode(p)
+	if err != nil {
+		return nil, err
+	}
+	inline, block, err := fs.readXattrs(in)
+	if err != nil {
+		return nil, err
+	}
+	attrs := inline
+	if block != nil {
+		attrs = append(attrs, block.attrs...)
+	}
+	for i := range attrs {
+		if attrs[i].index == index && attrs[i].name == suffix {
+			return attrs[i].value, nil
+		}
+	}
+	return nil, fmt.Errorf("%s of %s: %w", name, p, ErrNoXattr)
+}
+
+// Setxattr set the extended attribute name of the file at p to value, adding it if the file does not have it.
+// Symlinks are not followed. As in Linux, an attribute is kept in the inode if there is room,
+// else in the block of extended attributes of the file, which is shared with other files whose attributes
+// in their blocks are the same, as many files of a root filesystem may be.
+//
+// The filesystem must have the extended attributes feature, which it does by default.
+func (fs *FileSystem) Setxattr(p, name string, value []byte) error {
+	index, suffix, err := splitXattrName(name)
+	if err != nil {
+		return err
+	}
+	if !fs.superblock.features.extendedAttributes {
+		return fmt.Errorf("cannot set extended attribute %s: filesystem does not have the extended attributes feature", name)
+	}
+	in, err := fs.xattrInode(p)
+	if err != nil {
+		return err
+	}
+	inline, block, err := fs.readXattrs(in)
+	if err != nil {
+		return err
+	}
+	x := xattr{index: index, name: suffix, value: value}
+	inline = removeXattr(inline, index, suffix)
+	if block != nil {
+		block.attrs = removeXattr(block.attrs, index, suffix)
+	}
+	if err := in.setInlineXattrs(append(inline, x), fs.superblock.inodeSize); err != nil {
+		// does not fit in the inode, so goes in the block
+		if err := in.setInlineXattrs(inline, fs.superblock.inodeSize); err != nil {
+			return err
+		}
+		if block == nil {
+			block = &xattrBlock{}
+		}
+		block.attrs = append(block.attrs, x)
+	}
+	return fs.writeXattrs(in, block, name)
+}
+
+// Removexattr remove the extended attribute name from the file at p. Symlinks are not followed.
+// Returns an error wrapping ErrNoXattr if the file does not have it.
+func (fs *FileSystem) Removexattr(p, name string) error {
+	index, suffix, err := splitXattrName(name)
+	if err != nil {
+		return err
+	}
+	in, err := fs.xattrInode(p)
+	if err != nil {
+		return err
+	}
+	inline, block, err := fs.readXattrs(in)
+	if err != nil {
+		return err
+	}
+	count := len(inline)
+	inline = removeXattr(inline, index, suffix)
+	found := len(inline) != count
+	if block != nil {
+		count = len(block.attrs)
+		block.attrs = removeXattr(block.attrs, index, suffix)
+		found = found || len(block.attrs) != count
+	}
+	if !found {
+		return fmt.Errorf("%s of %s: %w", name, p, ErrNoXattr)
+	}
+	if err := in.setInlineXattrs(inline, fs.superblock.inodeSize); err != nil {
+		return err
+	}
+	return fs.writeXattrs(in, block, name)
+}
+
+// removeXattr remove an extended attribute from a list, if it is in it
+func removeXattr(attrs []xattr, index uint8, name string) []xattr {
+	kept := attrs[:0]
+	for _, x := range attrs {
+		if x.index != index || x.name != name {
+			kept = append(kept, x)
+		}
+	}
+	return kept
+}
+
+// writeXattrs write the block of extended attributes of an inode, then the inode itself. The inode shares a block
+// that holds the same attributes if there is one, else the block is allocated if the inode does not yet have one.
+// It is freed if it is empty. A block shared with other inodes is never changed, the inode gets a copy of it
+// instead.
+func (fs *FileSystem) writeXattrs(in *inode, block *xattrBlock, name string) error {
+	blockNumber := in.extendedAttributeBlock
+	// let go of the old block if it is shared, or no longer needed
+	release := func() error {
+		old, err := fs.readXattrBlock(blockNumber)
+		if err != nil {
+			return err
+		}
+		if old.refCount > 1 {
+			old.refCount--
+			if err := fs.writeXattrBlock(old, blockNumber); err != nil {
+				return err
+			}
+		} else {
+			fs.xattrBlocks.remove(blockNumber)
+			if err := fs.setBlocksInUse(blockNumber, 1, false); err != nil {
+				return fmt.Errorf("could not free extended attribute block %d: %w", blockNumber, err)
+			}
+		}
+		blockNumber = 0
+		return nil
+	}
+	if block != nil && blockNumber != 0 && (block.refCount > 1 || len(block.attrs) == 0) {
+		if err := release(); err != nil {
+			return err
+		}
+	}
+	if block != nil && len(block.attrs) > 0 {
+		// check that it fits before allocating anything
+		if _, err := fs.xattrBlockToBytes(block, 0); err != nil {
+			return fmt.Errorf("no room for extended attribute %s: %w", name, err)
+		}
+		if sharedNumber, shared := fs.findSharedXattrBlock(block, blockNumber); shared != nil {
+			// the block the inode has is its own, as a shared one was let go of
+			if blockNumber != 0 {
+				if err := release(); err != nil {
+					return err
+				}
+			}
+			shared.refCount++
+			if err := fs.writeXattrBlock(shared, sharedNumber); err != nil {
+				return err
+			}
+			blockNumber = sharedNumber
+		} else {
+			if blockNumber == 0 {
+				exts, err := fs.allocateExtents(uint64(fs.superblock.blockSize), nil)
+				if err != nil {
+					return fmt.Errorf("could not allocate extended attribute block: %w", err)
+				}
+				blockNumber = (*exts)[0].startingBlock
+			}
+			block.refCount = 1
+			if err := fs.writeXattrBlock(block, blockNumber); err != nil {
+				return err
+			}
+		}
+	}
+	if blockNumber != in.extendedAttributeBlock {
+		blocks := in.blocks
+		if !in.filesystemBlocks {
+			blocks /= uint64(fs.superblock.blockSize / 512)
+		}
+		if in.extendedAttributeBlock != 0 {
+			blocks--
+		}
+		in.extendedAttributeBlock = blockNumber
+		in.setBlockCount(blocks, fs.superblock.blockSize)
+	}
+	in.changeTime = time.Now()
+	if err := fs.writeInode(in); err != nil {
+		return fmt.Errorf("could not write inode %d: %w", in.number, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package fat32
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// ArchiveFormat is the format of an archive passed to ImportArchive
+type ArchiveFormat int
+
+const (
+	// ArchiveTar an uncompressed tar archive. For a compressed one, e.g. a .tar.gz, wrap the
+	// reader in a decompressor such as gzip.NewReader first.
+	ArchiveTar ArchiveFormat = iota
+	// ArchiveZip a zip archive
+	ArchiveZip
+)
+
+// ImportArchive populate the filesystem from a tar or zip archive, e.g. to fill a boot partition
+// from a release archive, creating every directory and regular file in it under the root of the filesystem.
+// Files that already exist are overwritten.
+//
+// Names are changed where FAT32 cannot hold them: characters that long filenames may not contain are
+// replaced with _, and trailing spaces and periods are removed. Short names are generated from the long
+// ones, as when creating any other file. Modification times are kept.
+//
+// FAT32 has no permissions, owners or links. Hard links in a tar archive become separate copies of the
+// file they link to. Symlinks and special files, such as devices, return an error wrapping
+// filesystem.ErrNotSupported.
+//
+// A zip archive must be read from its end, so unless r is also an io.ReaderAt and an io.Seeker,
+// such as an *os.File, the whole archive is read into memory first.
+func (fs *FileSystem) ImportArchive(r io.Reader, format ArchiveFormat) error {
+	switch format {
+	case ArchiveTar:
+		return fs.importTar(tar.NewReader(r))
+	case ArchiveZip:
+		zr, err := newZipReader(r)
+		if err != nil {
+			return fmt.Errorf("could not read zip archive: %w", err)
+		}
+		return fs.importZip(zr)
+	default:
+		return fmt.Errorf("unknown archive format %d", format)
+	}
+}
+
+func (fs *FileSystem) importTar(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read tar archive: %w", err)
+		}
+		p, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fs.importDir(p, hdr.ModTime)
+		case tar.TypeReg:
+			err = fs.importFile(p, tr, hdr.ModTime)
+		case tar.TypeLink:
+			err = fs.importHardLink(p, hdr.Linkname, hdr.ModTime)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			err = fmt.Errorf("cannot import %s of tar type %q: %w", hdr.Name, hdr.Typeflag, filesystem.ErrNotSupported)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (fs *FileSystem) importZip(zr *zip.Reader) error {
+	for _, f := range zr.File {
+		p, err := archivePath(f.Name)
+		if err != nil {
+			return err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = fs.importDir(p, f.Modified)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			if err != nil {
+				return fmt.Errorf("could not open %s in zip archive: %w", f.Name, err)
+			}
+			err = fs.importFile(p, rc, f.Modified)
+			rc.Close()
+		default:
+			err = fmt.Errorf("cannot import %s of type %s: %w", f.Name, mode.Type(), filesystem.ErrNotSupported)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newZipReader get a zip.Reader for r, reading it into memory if it cannot be read at random
+func newZipReader(r io.Reader) (*zip.Reader, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		if s, ok := r.(io.Seeker); ok {
+			size, err := s.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, err
+			}
+			return zip.NewReader(ra, size)
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(b), int64(len(b)))
+}
+
+// archivePath convert the name of an entry in an archive to an absolute path in the filesystem that FAT32
+// can hold. Archives are always unpacked under the root, so a name cannot escape it with ..
+func archivePath(name string) (string, error) {
+	parts := strings.Split(path.Clean("/"+name), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		parts[i] = longFilename(part)
+		if len(utf16.Encode([]rune(parts[i]))) > maxLongFilenameLength {
+			return "", fmt.Errorf("cannot import %s: name %s is longer than %d characters: %w", name, part, maxLongFilenameLength, ErrNameTooLong)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// longFilename change a name to one that is valid as a long filename, replacing every character that is
+// not allowed with _, and removing trailing spaces and periods, as Windows ignores them
+func longFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`"*/:<>?\|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(name, " .")
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+func (fs *FileSystem) importDir(p string, modTime time.Time) error {
+	if err := fs.Mkdir(p); err != nil {
+		return fmt.Errorf("could not create directory %s: %w", p, err)
+	}
+	if p == "/" {
+		return nil
+	}
+	return fs.setModTime(p, modTime)
+}
+
+func (fs *FileSystem) importFile(p string, r io.Reader, modTime time.Time) error {
+	if err := fs.Mkdir(path.Dir(p)); err != nil {
+		return fmt.Errorf("could not create directory %s: %w", path.Dir(p), err)
+	}
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("could not create file %s: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("could not write file %s: %w", p, err)
+	}
+	return fs.setModTime(p, modTime)
+}
+
+// importHardLink copy a file already imported to p, as FAT32 has no links
+func (fs *FileSystem) importHardLink(p, target string, modTime time.Time) error {
+	targetPath, err := archivePath(target)
+	if err != nil {
+		return err
+	}
+	in, err := fs.OpenFile(targetPath, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("could not open %s, the target of hard link %s: %w", targetPath, p, err)
+	}
+	defer in.Close()
+	return fs.importFile(p, in, modTime)
+}
+
+// setModTime set the modification and access times of the file or directory at p
+func (fs *FileSystem) setModTime(p string, modTime time.Time) error {
+	return fs.Chtimes(p, modTime, modTime)
+}
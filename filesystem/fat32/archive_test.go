@@ -0,0 +1,180 @@
+package fat32_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+)
+
+type archiveEntry struct {
+	name    string
+	content string
+	dir     bool
+	link    string
+}
+
+func createArchive(t *testing.T, format fat32.ArchiveFormat, entries []archiveEntry, modTime time.Time) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	switch format {
+	case fat32.ArchiveTar:
+		tw := tar.NewWriter(buf)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0o644, ModTime: modTime, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+			switch {
+			case e.dir:
+				hdr.Typeflag, hdr.Mode = tar.TypeDir, 0o755
+			case e.link != "":
+				hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("error writing tar header: %v", err)
+			}
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("error writing tar content: %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("error closing tar archive: %v", err)
+		}
+	case fat32.ArchiveZip:
+		zw := zip.NewWriter(buf)
+		for _, e := range entries {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Modified: modTime, Method: zip.Deflate})
+			if err != nil {
+				t.Fatalf("error writing zip header: %v", err)
+			}
+			if _, err := w.Write([]byte(e.content)); err != nil {
+				t.Fatalf("error writing zip content: %v", err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("error closing zip archive: %v", err)
+		}
+	}
+	return buf
+}
+
+func TestImportArchive(t *testing.T) {
+	// FAT stores times in local time, to 2 second precision
+	modTime := time.Date(2023, 5, 6, 7, 8, 10, 0, time.Local)
+	entries := []archiveEntry{
+		{name: "boot/", dir: true},
+		{name: "boot/overlays/", dir: true},
+		{name: "boot/bcm2711-rpi-4-b.dtb", content: "rpi 4"},
+		{name: "boot/bcm2711-rpi-400.dtb", content: "rpi 400"},
+		{name: "boot/overlays/README", content: "overlays"},
+		{name: "./config.txt", content: "arm_64bit=1"},
+		{name: "implicit/dir/file.txt", content: "parents created"},
+		{name: "what: is this?.txt", content: "mangled"},
+	}
+	expected := map[string]string{
+		"/boot/bcm2711-rpi-4-b.dtb": "rpi 4",
+		"/boot/bcm2711-rpi-400.dtb": "rpi 400",
+		"/boot/overlays/README":     "overlays",
+		"/config.txt":               "arm_64bit=1",
+		"/implicit/dir/file.txt":    "parents created",
+		"/what_ is this_.txt":       "mangled",
+	}
+	tests := []struct {
+		name   string
+		format fat32.ArchiveFormat
+		extra  []archiveEntry
+	}{
+		{"tar", fat32.ArchiveTar, []archiveEntry{{name: "config-link.txt", link: "config.txt"}}},
+		{"zip", fat32.ArchiveZip, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := createArchive(t, tt.format, append(entries, tt.extra...), modTime)
+			f, err := os.Create(filepath.Join(t.TempDir(), "fat32.img"))
+			if err != nil {
+				t.Fatalf("error creating image file: %v", err)
+			}
+			defer f.Close()
+			size := int64(10 * fat32.MB)
+			fs, err := fat32.Create(file.New(f, false), size, 0, 512, "")
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if err := fs.ImportArchive(archive, tt.format); err != nil {
+				t.Fatalf("error importing archive: %v", err)
+			}
+
+			// read it back from scratch
+			fs, err = fat32.Read(file.New(f, true), size, 0, 512)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			want := expected
+			if len(tt.extra) > 0 {
+				want = map[string]string{"/config-link.txt": "arm_64bit=1"}
+				for k, v := range expected {
+					want[k] = v
+				}
+			}
+			for p, content := range want {
+				in, err := fs.OpenFile(p, os.O_RDONLY)
+				if err != nil {
+					t.Errorf("error opening %s: %v", p, err)
+					continue
+				}
+				b, err := io.ReadAll(in)
+				if err != nil {
+					t.Errorf("error reading %s: %v", p, err)
+				}
+				if string(b) != content {
+					t.Errorf("%s: content %q instead of %q", p, b, content)
+				}
+			}
+			infos, err := fs.ReadDir("/boot")
+			if err != nil {
+				t.Fatalf("error reading directory: %v", err)
+			}
+			shortNames := map[string]bool{}
+			for _, fi := range infos {
+				if fi.Name() == "." || fi.Name() == ".." {
+					continue
+				}
+				if !fi.ModTime().Equal(modTime) {
+					t.Errorf("/boot/%s: modification time %v instead of %v", fi.Name(), fi.ModTime(), modTime)
+				}
+				shortName := fi.(fat32.FileInfo).ShortName()
+				if shortNames[shortName] {
+					t.Errorf("/boot/%s: duplicate short name %s", fi.Name(), shortName)
+				}
+				shortNames[shortName] = true
+			}
+		})
+	}
+	t.Run("symlink", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target"}); err != nil {
+			t.Fatalf("error writing tar header: %v", err)
+		}
+		tw.Close()
+		f, err := os.Create(filepath.Join(t.TempDir(), "fat32.img"))
+		if err != nil {
+			t.Fatalf("error creating image file: %v", err)
+		}
+		defer f.Close()
+		fs, err := fat32.Create(file.New(f, false), 10*fat32.MB, 0, 512, "")
+		if err != nil {
+			t.Fatalf("error creating filesystem: %v", err)
+		}
+		if err := fs.ImportArchive(buf, fat32.ArchiveTar); !errors.Is(err, filesystem.ErrNotSupported) {
+			t.Errorf("error %v instead of %v", err, filesystem.ErrNotSupported)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package fat32
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Attributes the DOS attribute bits of a file or directory, that can be set with SetAttrs
+type Attributes uint8
+
+const (
+	// AttrReadOnly the file must not be written or removed
+	AttrReadOnly Attributes = 0x01
+	// AttrHidden the file is not listed by default
+	AttrHidden Attributes = 0x02
+	// AttrSystem the file belongs to the operating system, and should not be moved, e.g. by a defragmenter
+	AttrSystem Attributes = 0x04
+	// AttrArchive the file was changed since it was last backed up
+	AttrArchive Attributes = 0x20
+
+	settableAttributes = AttrReadOnly | AttrHidden | AttrSystem | AttrArchive
+)
+
+// String the attributes as the letters that the DOS attrib command shows for them, e.g. ASHR
+func (a Attributes) String() string {
+	var sb strings.Builder
+	for _, attr := range []struct {
+		bit  Attributes
+		name byte
+	}{{AttrArchive, 'A'}, {AttrSystem, 'S'}, {AttrHidden, 'H'}, {AttrReadOnly, 'R'}} {
+		if a&attr.bit != 0 {
+			sb.WriteByte(attr.name)
+		}
+	}
+	return sb.String()
+}
+
+// attributes the settable attribute bits of the entry
+func (de *directoryEntry) attributes() Attributes {
+	var a Attributes
+	if de.isReadOnly {
+		a |= AttrReadOnly
+	}
+	if de.isHidden {
+		a |= AttrHidden
+	}
+	if de.isSystem {
+		a |= AttrSystem
+	}
+	if de.isArchiveDirty {
+		a |= AttrArchive
+	}
+	return a
+}
+
+// setAttributes set the settable attribute bits of the entry
+func (de *directoryEntry) setAttributes(a Attributes) {
+	de.isReadOnly = a&AttrReadOnly != 0
+	de.isHidden = a&AttrHidden != 0
+	de.isSystem = a&AttrSystem != 0
+	de.isArchiveDirty = a&AttrArchive != 0
+}
+
+// SetAttrs set the read-only, hidden, system and archive attributes of the file or directory at p to attrs,
+// clearing any of them that are not in attrs. The root directory has no attributes.
+func (fs *FileSystem) SetAttrs(p string, attrs Attributes) error {
+	if attrs&^settableAttributes != 0 {
+		return fmt.Errorf("invalid attributes %#02x, only read-only, hidden, system and archive can be set", uint8(attrs))
+	}
+	return fs.updateEntry(p, func(e *directoryEntry) {
+		e.setAttributes(attrs)
+	})
+}
+
+// Chtimes change the access and modification times of the file or directory at p, as os.Chtimes does.
+// A zero time.Time leaves that time unchanged. FAT keeps modification times to 2 seconds, and access
+// times only as dates, so both are truncated.
+func (fs *FileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	return fs.updateEntry(p, func(e *directoryEntry) {
+		if !atime.IsZero() {
+			e.accessTime = atime
+		}
+		if !mtime.IsZero() {
+			e.modifyTime = mtime
+		}
+	})
+}
+
+// SetCreateTime change the creation time of the file or directory at p, which FAT keeps to 2 seconds
+func (fs *FileSystem) SetCreateTime(p string, ctime time.Time) error {
+	return fs.updateEntry(p, func(e *directoryEntry) {
+		e.createTime = ctime
+	})
+}
+
+// updateEntry apply update to the entry of the file or directory at p, and write its directory to disk
+func (fs *FileSystem) updateEntry(p string, update func(e *directoryEntry)) error {
+	dir := path.Dir(p)
+	name := path.Base(p)
+	// if the dir == name, then it is just /
+	if dir == name {
+		return fmt.Errorf("root directory %s has no entry to update", p)
+	}
+	parentDir, entries, err := fs.readDirWithMkdir(dir, false)
+	if err != nil {
+		return fmt.Errorf("could not read directory entries for %s: %w", dir, err)
+	}
+	e, err := fs.findEntry(entries, name, true)
+	if err != nil {
+		return fmt.Errorf("could not find %s: %w", p, err)
+	}
+	if e == nil {
+		return fmt.Errorf("target file %s does not exist", p)
+	}
+	update(e)
+	if err := fs.writeDirectoryEntries(parentDir); err != nil {
+		return fmt.Errorf("error writing directory entries for %s to disk: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,483 @@
+package fat32
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// checker the state of a consistency check of a filesystem
+type checker struct {
+	fs       *FileSystem
+	problems []error
+	// visited the first clusters of the directories already checked, so that a loop in the tree is only walked once
+	visited map[uint32]bool
+	// used the clusters of every file and directory in the tree, by cluster number
+	used []bool
+	// fixes the entries of files and directories that are wrong in ways that can be repaired, in the order found
+	fixes []*entryFix
+}
+
+// entryFix a repair of the entry of a file or directory: its size, and how much of its chain of clusters to keep
+type entryFix struct {
+	problem string
+	// dir the directory that holds entry, to be written once it is fixed
+	dir   *Directory
+	entry *directoryEntry
+	size  uint32
+	// chain the clusters of the chain of a file that are its own, of which the first keep are kept and the rest
+	// freed, with the last kept ending the chain; nil to leave the chain as it is
+	chain []uint32
+	keep  int
+}
+
+func (c *checker) problem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Errorf(format, args...))
+}
+
+// Check verify the directory entries and cluster chains of the filesystem, as Windows reads them.
+// It checks, in every directory, that:
+//   - every run of long filename entries is complete, in order, and followed by a short name entry
+//   - the checksum in every long filename entry matches the short name entry that follows it; Windows silently
+//     ignores a long filename whose checksum does not match, and shows the short name instead
+//   - no two entries have the same short name
+//
+// that the chain of clusters of every file and directory is valid and shares no cluster with another, or with
+// itself, that the size of every file fits its chain, which holds no more clusters than it needs, bar the single
+// cluster of an empty file, and that the size of every directory is 0, and that every cluster that the FAT marks
+// as allocated belongs to a file or directory in the tree. Clusters that do not, e.g. after a crash between
+// allocating them and writing the directory entry, are lost chains.
+//
+// With repair, it fixes files as fsck.fat does: a chain that is invalid, or is cross-linked, sharing a cluster
+// with one found before it, is cut short before that cluster, the size of a file is cut to what its chain holds,
+// and the clusters of a chain past those its size needs are freed; the size of a directory is set to 0. It
+// recovers from lost chains as scandisk does after a dirty shutdown: every lost chain becomes a file
+// FILE0000.CHK, FILE0001.CHK and so on, in a new directory FOUND.000 in the root, or FOUND.001 if that is taken,
+// holding all of the clusters of the chain. It also writes the copy of the FAT anew if it differs from the first,
+// which Read uses, as after a crash between writing the two. If nothing else is wrong, a filesystem that was not
+// cleanly closed is then marked as clean. The chains of directories, and their entries, are not repaired.
+//
+// It returns all of the problems found and not repaired, joined, or nil if there are none.
+func (fs *FileSystem) Check(repair bool) error {
+	c := &checker{
+		fs:      fs,
+		visited: map[uint32]bool{},
+		used:    make([]bool, len(fs.table.clusters)),
+	}
+	root := &Directory{
+		directoryEntry: directoryEntry{
+			clusterLocation: fs.table.rootDirCluster,
+			isSubdirectory:  true,
+			filesystem:      fs,
+		},
+	}
+	if err := c.checkDirectory("/", root); err != nil {
+		return err
+	}
+	lost := c.lostChains()
+	if !repair {
+		for _, f := range c.fixes {
+			c.problems = append(c.problems, errors.New(f.problem))
+		}
+		for _, chain := range lost {
+			c.problem("lost chain of %d clusters starting at cluster %d", len(chain), chain[0])
+		}
+		if fs.fatsDiffer {
+			c.problem("the copies of the FAT differ")
+		}
+		return errors.Join(c.problems...)
+	}
+	if len(c.fixes) > 0 {
+		if err := c.applyFixes(); err != nil {
+			return fmt.Errorf("could not repair files: %w", err)
+		}
+	}
+	if len(lost) > 0 {
+		if err := c.collectLostChains(lost); err != nil {
+			return fmt.Errorf("could not recover lost chains: %w", err)
+		}
+	}
+	if fs.fatsDiffer {
+		if err := fs.writeFat(); err != nil {
+			return fmt.Errorf("could not write the copy of the FAT: %w", err)
+		}
+	}
+	if len(c.problems) == 0 && fs.dirtyWhenRead {
+		fs.dirtyWhenRead = false
+		// so that Close brings the count of free clusters up to date as well
+		fs.modified = true
+		if err := fs.Close(); err != nil {
+			return fmt.Errorf("could not mark the filesystem as clean: %w", err)
+		}
+	}
+	return errors.Join(c.problems...)
+}
+
+// checkDirectory check the entries of the directory dir at path p, and then of all of its subdirectories
+func (c *checker) checkDirectory(p string, dir *Directory) error {
+	c.visited[dir.clusterLocation] = true
+	// the root directory of FAT12 and FAT16 is not in a cluster
+	if dir.clusterLocation >= 2 {
+		if _, problem := c.useChain("directory "+p, dir.clusterLocation); problem != "" {
+			c.problem("%s", problem)
+		}
+	}
+	b, err := c.fs.readDirectoryBytes(dir)
+	if err != nil {
+		c.problem("could not read directory %s: %v", p, err)
+		return nil
+	}
+	for _, msg := range verifyDirectoryEntries(b, c.fs.codePage) {
+		c.problem("directory %s: %s", p, msg)
+	}
+	entries, err := parseDirEntries(b, c.fs.codePage)
+	if err != nil {
+		return fmt.Errorf("could not parse directory %s: %w", p, err)
+	}
+	// for writing the entries back, once fixed
+	parent := &Directory{directoryEntry: dir.directoryEntry, entries: entries}
+	for _, e := range entries {
+		if e.isVolumeLabel || e.filenameShort == "." || e.filenameShort == ".." {
+			continue
+		}
+		name := e.filenameLong
+		if name == "" {
+			name = e.filenameShort
+			if e.fileExtension != "" {
+				name += "." + e.fileExtension
+			}
+		}
+		subp := path.Join(p, name)
+		if !e.isSubdirectory {
+			c.checkFile(parent, subp, e)
+			continue
+		}
+		if e.fileSize != 0 {
+			c.fixes = append(c.fixes, &entryFix{
+				problem: fmt.Sprintf("directory %s has size %d instead of 0", subp, e.fileSize),
+				dir:     parent,
+				entry:   e,
+			})
+		}
+		if e.clusterLocation < 2 || e.clusterLocation == c.fs.table.rootDirCluster {
+			c.problem("directory %s starts at invalid cluster %d", subp, e.clusterLocation)
+			continue
+		}
+		if c.visited[e.clusterLocation] {
+			c.problem("directory %s at cluster %d already is in the tree", subp, e.clusterLocation)
+			continue
+		}
+		if err := c.checkDirectory(subp, &Directory{directoryEntry: *e}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterLimit one more than the highest cluster in the data region
+func (c *checker) clusterLimit() uint32 {
+	return min(c.fs.table.maxCluster, c.fs.dataClusters()+2)
+}
+
+// useChain mark the clusters of the chain starting at first as used by what, up to the end of the chain, or to
+// the first cluster that is invalid or already used, returning those it marked, and what is wrong with the chain
+// if it is cut short
+func (c *checker) useChain(what string, first uint32) (chain []uint32, problem string) {
+	t := c.fs.table
+	for cluster := first; ; {
+		switch {
+		case cluster < 2 || cluster >= c.clusterLimit():
+			return chain, fmt.Sprintf("%s has invalid cluster %d in its chain", what, cluster)
+		case c.used[cluster]:
+			return chain, fmt.Sprintf("%s shares cluster %d with another chain, or its chain loops", what, cluster)
+		}
+		c.used[cluster] = true
+		chain = append(chain, cluster)
+		next := t.clusters[cluster]
+		if t.isEoc(next) {
+			return chain, ""
+		}
+		cluster = next
+	}
+}
+
+// checkFile check the chain of clusters of the file with entry e, at path p in dir, and that its size fits it
+func (c *checker) checkFile(dir *Directory, p string, e *directoryEntry) {
+	if e.clusterLocation == 0 {
+		if e.fileSize != 0 {
+			c.fixes = append(c.fixes, &entryFix{
+				problem: fmt.Sprintf("file %s has size %d but no clusters", p, e.fileSize),
+				dir:     dir,
+				entry:   e,
+			})
+		}
+		return
+	}
+	chain, problem := c.useChain("file "+p, e.clusterLocation)
+	bytesPerCluster := uint64(c.fs.bytesPerCluster)
+	held := uint64(len(chain)) * bytesPerCluster
+	// an empty file is made with a cluster, which it keeps
+	needed := max(int((uint64(e.fileSize)+bytesPerCluster-1)/bytesPerCluster), 1)
+	f := &entryFix{
+		dir:   dir,
+		entry: e,
+		size:  uint32(min(uint64(e.fileSize), held)),
+		chain: chain,
+		keep:  min(len(chain), needed),
+	}
+	var problems []string
+	if problem != "" {
+		problems = append(problems, problem)
+	}
+	if uint64(e.fileSize) > held {
+		problems = append(problems, fmt.Sprintf("file %s has size %d, more than the %d bytes of its %d clusters", p, e.fileSize, held, len(chain)))
+	}
+	if needed < len(chain) {
+		problems = append(problems, fmt.Sprintf("file %s has size %d, which needs %d clusters, but its chain has %d", p, e.fileSize, needed, len(chain)))
+	}
+	if len(problems) > 0 {
+		f.problem = strings.Join(problems, "; ")
+		c.fixes = append(c.fixes, f)
+	}
+}
+
+// applyFixes repair the entries of files and directories, writing the directories that hold them before the
+// FAT, so that no entry leads to a cluster that is freed before it is written. See the package documentation.
+func (c *checker) applyFixes() error {
+	fs := c.fs
+	if err := fs.markModified(); err != nil {
+		return err
+	}
+	var dirs []*Directory
+	written := map[*Directory]bool{}
+	for _, f := range c.fixes {
+		f.entry.fileSize = f.size
+		if f.chain != nil && f.keep == 0 {
+			f.entry.clusterLocation = 0
+		}
+		if !written[f.dir] {
+			written[f.dir] = true
+			dirs = append(dirs, f.dir)
+		}
+	}
+	for _, dir := range dirs {
+		if err := fs.writeDirectoryEntries(dir); err != nil {
+			return fmt.Errorf("could not write directory entries: %w", err)
+		}
+	}
+	for _, f := range c.fixes {
+		if f.chain == nil {
+			continue
+		}
+		if f.keep > 0 {
+			fs.table.clusters[f.chain[f.keep-1]] = fs.table.endOfChain()
+		}
+		for _, cluster := range f.chain[f.keep:] {
+			fs.table.clusters[cluster] = fs.table.unusedMarker
+			c.used[cluster] = false
+		}
+	}
+	if err := fs.writeFat(); err != nil {
+		return fmt.Errorf("failed to write the file allocation table: %w", err)
+	}
+	return nil
+}
+
+// lostChains the chains of clusters that are allocated in the FAT, but are not used by any file or directory in
+// the tree, each in order from its first cluster. A chain that leads to a cluster that is used, free or bad, or
+// loops, is cut short there.
+func (c *checker) lostChains() [][]uint32 {
+	t := c.fs.table
+	limit := c.clusterLimit()
+	lost := func(cluster uint32) bool {
+		if cluster < 2 || cluster >= limit || c.used[cluster] {
+			return false
+		}
+		next := t.clusters[cluster]
+		return next != t.unusedMarker && next != t.badCluster()
+	}
+	// a chain starts at every lost cluster that no other lost cluster leads to
+	pointedTo := make([]bool, limit)
+	for cluster := uint32(2); cluster < limit; cluster++ {
+		if next := t.clusters[cluster]; lost(cluster) && next < limit {
+			pointedTo[next] = true
+		}
+	}
+	var (
+		chains [][]uint32
+		taken  = make([]bool, limit)
+	)
+	follow := func(first uint32) {
+		var chain []uint32
+		for cluster := first; lost(cluster) && !taken[cluster]; cluster = t.clusters[cluster] {
+			taken[cluster] = true
+			chain = append(chain, cluster)
+			if t.isEoc(t.clusters[cluster]) {
+				break
+			}
+		}
+		chains = append(chains, chain)
+	}
+	for cluster := uint32(2); cluster < limit; cluster++ {
+		if lost(cluster) && !pointedTo[cluster] {
+			follow(cluster)
+		}
+	}
+	// what is left are loops, which have no start, so start each at its lowest cluster
+	for cluster := uint32(2); cluster < limit; cluster++ {
+		if lost(cluster) && !taken[cluster] {
+			follow(cluster)
+		}
+	}
+	return chains
+}
+
+// collectLostChains make each of the lost chains a file in a new FOUND.NNN directory in the root, ending every
+// chain that does not end properly at its last cluster
+func (c *checker) collectLostChains(chains [][]uint32) error {
+	fs := c.fs
+	if len(chains) > 10000 {
+		return fmt.Errorf("%d lost chains, more than the 10000 files FILE0000.CHK to FILE9999.CHK", len(chains))
+	}
+	_, rootEntries, err := fs.readDirWithMkdir("/", false)
+	if err != nil {
+		return fmt.Errorf("could not read root directory: %w", err)
+	}
+	var found string
+	for n := 0; n < 1000 && found == ""; n++ {
+		found = fmt.Sprintf("FOUND.%03d", n)
+		for _, e := range rootEntries {
+			if !e.isVolumeLabel && strings.EqualFold(e.filenameShort+"."+e.fileExtension, found) {
+				found = ""
+				break
+			}
+		}
+	}
+	if found == "" {
+		return errors.New("FOUND.000 to FOUND.999 are all taken")
+	}
+
+	if err := fs.markModified(); err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		last := chain[len(chain)-1]
+		fs.table.clusters[last] = fs.table.endOfChain()
+	}
+	if err := fs.writeFat(); err != nil {
+		return fmt.Errorf("failed to write the file allocation table: %w", err)
+	}
+	dir, _, err := fs.readDirWithMkdir("/"+found, true)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %w", found, err)
+	}
+	for i, chain := range chains {
+		name := fmt.Sprintf("FILE%04d.CHK", i)
+		e, err := dir.createEntry(name, chain[0], false, fs.codePage)
+		if err != nil {
+			return fmt.Errorf("could not create %s: %w", name, err)
+		}
+		e.fileSize = uint32(min(uint64(len(chain))*uint64(fs.bytesPerCluster), math.MaxUint32))
+	}
+	if err := fs.writeDirectoryEntries(dir); err != nil {
+		return fmt.Errorf("could not write directory %s: %w", found, err)
+	}
+	return nil
+}
+
+// verifyDirectoryEntries check the raw entries b of a single directory: that every long filename is complete and
+// in order, belongs to the short name entry right after it, as its checksum says, and that no two entries have the
+// same short name. Short names are in the code page cp. Returns a description of each problem found.
+func verifyDirectoryEntries(b []byte, cp CodePage) []string {
+	var (
+		problems []string
+		// the UTF-16 units of the long filename being read, with the sequence number and checksum of its last entry read
+		lfn      []uint16
+		lfnSeq   byte
+		checksum byte
+		inLFN    bool
+		names    = map[string]bool{}
+	)
+	for i := 0; i+bytesPerSlot <= len(b); i += bytesPerSlot {
+		entry := b[i : i+bytesPerSlot]
+		if entry[0] == 0x00 {
+			break
+		}
+		if entry[0] == 0xe5 {
+			// a deleted entry in the middle of a long filename leaves the rest of it without a short name
+			if inLFN {
+				problems = append(problems, fmt.Sprintf("long filename %q at entry %d is cut short by a deleted entry", utf16String(lfn), i/bytesPerSlot))
+				inLFN = false
+			}
+			continue
+		}
+		if entry[11]&0x3f == 0x0f {
+			seq := entry[0] & 0x1f
+			units := longFilenameEntryUnits(entry)
+			switch {
+			case entry[0]&0x40 == 0x40:
+				if inLFN {
+					problems = append(problems, fmt.Sprintf("long filename %q at entry %d has no short name entry", utf16String(lfn), i/bytesPerSlot))
+				}
+				lfn, checksum, inLFN = units, entry[13], true
+			case !inLFN:
+				problems = append(problems, fmt.Sprintf("long filename entry %d with sequence number %d has no first entry", i/bytesPerSlot, seq))
+				continue
+			case seq != lfnSeq-1:
+				problems = append(problems, fmt.Sprintf("long filename %q has sequence number %d at entry %d after %d", utf16String(lfn), seq, i/bytesPerSlot, lfnSeq))
+				inLFN = false
+				continue
+			case entry[13] != checksum:
+				lfn = append(units, lfn...)
+				problems = append(problems, fmt.Sprintf("long filename %q has checksums %#02x and %#02x in its entries", utf16String(lfn), checksum, entry[13]))
+			default:
+				lfn = append(units, lfn...)
+			}
+			lfnSeq = seq
+			continue
+		}
+
+		shortName := entry[0:11]
+		display := shortNameString(shortName, cp)
+		if inLFN {
+			sum := shortNameChecksum(shortName)
+			switch {
+			case lfnSeq != 1:
+				problems = append(problems, fmt.Sprintf("long filename %q for short name %q is missing entries %d to 1", utf16String(lfn), display, lfnSeq-1))
+			case sum != checksum:
+				problems = append(problems, fmt.Sprintf("long filename %q has checksum %#02x but short name %q has %#02x, so Windows shows the short name", utf16String(lfn), checksum, display, sum))
+			}
+			inLFN = false
+		}
+		// the volume label, "." and ".." are not names of files
+		if entry[11]&0x08 == 0x08 || display == "." || display == ".." {
+			continue
+		}
+		key := strings.ToUpper(display)
+		if names[key] {
+			problems = append(problems, fmt.Sprintf("short name %q is used by more than one entry", display))
+		}
+		names[key] = true
+	}
+	if inLFN {
+		problems = append(problems, fmt.Sprintf("long filename %q at the end of the directory has no short name entry", utf16String(lfn)))
+	}
+	return problems
+}
+
+// shortNameString the short name and extension in the code page cp as they are usually shown, as NAME.EXT
+func shortNameString(b []byte, cp CodePage) string {
+	name := cp.decodeShortName(b[0:8])
+	if ext := cp.decodeShortName(b[8:11]); ext != "" {
+		name += "." + ext
+	}
+	return name
+}
+
+// utf16String the string of the UTF-16 units u
+func utf16String(u []uint16) string {
+	return string(utf16.Decode(u))
+}
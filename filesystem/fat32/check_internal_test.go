@@ -0,0 +1,414 @@
+package fat32
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// entryBytes the raw bytes of the entries, one after another, as they are in a directory
+func entryBytes(t *testing.T, entries ...*directoryEntry) []byte {
+	t.Helper()
+	var b []byte
+	for _, de := range entries {
+		eb, err := de.toBytes(CodePage437)
+		if err != nil {
+			t.Fatalf("error converting entry to bytes: %v", err)
+		}
+		b = append(b, eb...)
+	}
+	return b
+}
+
+func TestVerifyDirectoryEntries(t *testing.T) {
+	long := &directoryEntry{filenameLong: "a rather long file name.txt", filenameShort: "ARATHE~1", fileExtension: "TXT"}
+	short := &directoryEntry{filenameShort: "README", fileExtension: "MD"}
+	label := &directoryEntry{filenameShort: "README", fileExtension: "MD", isVolumeLabel: true}
+	// a long name of 3 entries, followed by its short name entry
+	longBytes := func(t *testing.T) []byte {
+		b := entryBytes(t, long)
+		if len(b) != 4*bytesPerSlot {
+			t.Fatalf("long name is %d entries instead of 4", len(b)/bytesPerSlot)
+		}
+		return b
+	}
+	tests := []struct {
+		name     string
+		b        func(t *testing.T) []byte
+		expected []string
+	}{
+		{"valid", func(t *testing.T) []byte {
+			return entryBytes(t, long, short, label)
+		}, nil},
+		{"checksum mismatch", func(t *testing.T) []byte {
+			b := longBytes(t)
+			// rename the short name without updating the long filename
+			b[3*bytesPerSlot+6] = '2'
+			return b
+		}, []string{`long filename "a rather long file name.txt" has checksum`}},
+		{"duplicate short name", func(t *testing.T) []byte {
+			lower := &directoryEntry{filenameShort: "readme", fileExtension: "md"}
+			return entryBytes(t, short, long, lower)
+		}, []string{`short name "readme.md" is used by more than one entry`}},
+		{"missing first entry", func(t *testing.T) []byte {
+			return longBytes(t)[bytesPerSlot:]
+		}, []string{"long filename entry 0 with sequence number 2 has no first entry", "long filename entry 1 with sequence number 1 has no first entry"}},
+		{"missing middle entry", func(t *testing.T) []byte {
+			b := longBytes(t)
+			return append(b[:bytesPerSlot:bytesPerSlot], b[2*bytesPerSlot:]...)
+		}, []string{"has sequence number 1 at entry 1 after 3"}},
+		{"no short name", func(t *testing.T) []byte {
+			b := longBytes(t)
+			return append(b[:3*bytesPerSlot:3*bytesPerSlot], longBytes(t)...)
+		}, []string{`long filename "a rather long file name.txt" at entry 3 has no short name entry`}},
+		{"deleted short name", func(t *testing.T) []byte {
+			b := longBytes(t)
+			b[3*bytesPerSlot] = 0xe5
+			return b
+		}, []string{"is cut short by a deleted entry"}},
+		{"end of directory", func(t *testing.T) []byte {
+			return longBytes(t)[:3*bytesPerSlot]
+		}, []string{"at the end of the directory has no short name entry"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := verifyDirectoryEntries(tt.b(t), CodePage437)
+			if len(problems) != len(tt.expected) {
+				t.Fatalf("found problems %q, expected %q", problems, tt.expected)
+			}
+			for i, expected := range tt.expected {
+				if !strings.Contains(problems[i], expected) {
+					t.Errorf("problem %q does not contain %q", problems[i], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, fatType := range []FatType{FatType16, FatType32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat32_check")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			size := int64(40 * MB)
+			fs, err := CreateWithType(file.New(f, false), size, 0, 512, "CHECK", fatType)
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			// long names whose short names collide, so need numeric tails
+			for _, p := range []string{"/long directory name", "/long directory name/long file name one.txt", "/long directory name/long file name two.txt", "/short.txt"} {
+				if strings.HasSuffix(p, "name") {
+					if err := fs.Mkdir(p); err != nil {
+						t.Fatalf("error making directory %s: %v", p, err)
+					}
+					continue
+				}
+				if _, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR); err != nil {
+					t.Fatalf("error creating file %s: %v", p, err)
+				}
+			}
+			if err := fs.Check(false); err != nil {
+				t.Fatalf("unexpected problems in new filesystem: %v", err)
+			}
+
+			// change the short name of the second file without its long filename
+			dir, _, err := fs.readDirWithMkdir("/long directory name", false)
+			if err != nil {
+				t.Fatalf("error reading directory: %v", err)
+			}
+			b, err := fs.readDirectoryBytes(dir)
+			if err != nil {
+				t.Fatalf("error reading directory bytes: %v", err)
+			}
+			offset := strings.Index(string(b), "LONGFI~2TXT")
+			if offset < 0 {
+				t.Fatalf("could not find short name of second file")
+			}
+			b[offset+6] = '3'
+			clusterStart := int64(fs.dataStart) + int64(dir.clusterLocation-2)*int64(fs.bytesPerCluster)
+			if _, err := f.WriteAt(b[:fs.bytesPerCluster], clusterStart); err != nil {
+				t.Fatalf("error writing directory: %v", err)
+			}
+			err = fs.Check(false)
+			if err == nil || !strings.Contains(err.Error(), `directory /long directory name: long filename "long file name two.txt" has checksum`) {
+				t.Errorf("unexpected error for mismatched checksum: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckLostChains(t *testing.T) {
+	for _, fatType := range []FatType{FatType16, FatType32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat32_check")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			size := int64(40 * MB)
+			fs, err := CreateWithType(file.New(f, false), size, 0, 512, "CHECK", fatType)
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if err := fs.Mkdir("/dir"); err != nil {
+				t.Fatalf("error making directory: %v", err)
+			}
+			fl, err := fs.OpenFile("/dir/file.txt", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			if _, err := fl.Write(bytes.Repeat([]byte("file"), fs.bytesPerCluster)); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("error closing filesystem: %v", err)
+			}
+			if err := fs.Check(false); err != nil {
+				t.Fatalf("unexpected problems in new filesystem: %v", err)
+			}
+
+			// as if the filesystem crashed after allocating clusters for files, and before writing their entries:
+			// a chain with data in it, a chain that loops, and a chain that leads into the file
+			data := bytes.Repeat([]byte("lost"), fs.bytesPerCluster/2)
+			chain, err := fs.allocateSpace(uint64(len(data)), 0)
+			if err != nil {
+				t.Fatalf("error allocating chain: %v", err)
+			}
+			for i, cluster := range chain {
+				clusterStart := int64(fs.dataStart) + int64(cluster-2)*int64(fs.bytesPerCluster)
+				if _, err := f.WriteAt(data[i*fs.bytesPerCluster:(i+1)*fs.bytesPerCluster], clusterStart); err != nil {
+					t.Fatalf("error writing lost data: %v", err)
+				}
+			}
+			loop, err := fs.allocateSpace(uint64(3*fs.bytesPerCluster), 0)
+			if err != nil {
+				t.Fatalf("error allocating chain: %v", err)
+			}
+			fs.table.clusters[loop[2]] = loop[0]
+			into, err := fs.allocateSpace(uint64(fs.bytesPerCluster), 0)
+			if err != nil {
+				t.Fatalf("error allocating chain: %v", err)
+			}
+			fileClusters, err := fl.(*File).GetClusterChain()
+			if err != nil {
+				t.Fatalf("error getting file clusters: %v", err)
+			}
+			fs.table.clusters[into[0]] = fileClusters[1]
+			if err := fs.writeFat(); err != nil {
+				t.Fatalf("error writing FAT: %v", err)
+			}
+
+			err = fs.Check(false)
+			for _, expected := range []string{
+				fmt.Sprintf("lost chain of 2 clusters starting at cluster %d", chain[0]),
+				fmt.Sprintf("lost chain of 3 clusters starting at cluster %d", loop[0]),
+				fmt.Sprintf("lost chain of 1 clusters starting at cluster %d", into[0]),
+			} {
+				if err == nil || !strings.Contains(err.Error(), expected) {
+					t.Errorf("problems %v do not include %q", err, expected)
+				}
+			}
+
+			// read it as a filesystem that was not cleanly closed, which is marked clean once repaired
+			fs, err = Read(file.New(f, false), size, 0, 512)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			if !fs.IsDirty() {
+				t.Fatalf("filesystem is not marked as not cleanly closed")
+			}
+			if err := fs.Check(true); err != nil {
+				t.Fatalf("unexpected problems repairing: %v", err)
+			}
+			if fs.IsDirty() {
+				t.Errorf("filesystem still is marked as not cleanly closed after repair")
+			}
+			if err := fs.Check(false); err != nil {
+				t.Errorf("unexpected problems after repair: %v", err)
+			}
+			// the chain that loops has no start, so comes after the others
+			expected := map[string]int64{
+				"FILE0000.CHK": int64(2 * fs.bytesPerCluster),
+				"FILE0001.CHK": int64(fs.bytesPerCluster),
+				"FILE0002.CHK": int64(3 * fs.bytesPerCluster),
+			}
+			infos, err := fs.ReadDir("/FOUND.000")
+			if err != nil {
+				t.Fatalf("error reading FOUND.000: %v", err)
+			}
+			found := 0
+			for _, info := range infos {
+				if info.Name() == "." || info.Name() == ".." {
+					continue
+				}
+				found++
+				if info.Size() != expected[info.Name()] {
+					t.Errorf("%s has size %d instead of %d", info.Name(), info.Size(), expected[info.Name()])
+				}
+			}
+			if found != len(expected) {
+				t.Errorf("FOUND.000 has %d files instead of %d", found, len(expected))
+			}
+			recovered, err := fs.OpenFile("/FOUND.000/FILE0000.CHK", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("error opening recovered file: %v", err)
+			}
+			b, err := io.ReadAll(recovered)
+			if err != nil {
+				t.Fatalf("error reading recovered file: %v", err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Errorf("recovered file does not hold the lost data")
+			}
+
+			// another repair goes in a directory of its own
+			if _, err := fs.allocateSpace(uint64(fs.bytesPerCluster), 0); err != nil {
+				t.Fatalf("error allocating chain: %v", err)
+			}
+			if err := fs.Check(true); err != nil {
+				t.Fatalf("unexpected problems repairing: %v", err)
+			}
+			if _, err := fs.ReadDir("/FOUND.001"); err != nil {
+				t.Errorf("error reading FOUND.001: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	for _, fatType := range []FatType{FatType16, FatType32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat32_check")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			size := int64(40 * MB)
+			fs, err := CreateWithType(file.New(f, false), size, 0, 512, "CHECK", fatType)
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if err := fs.Mkdir("/dir"); err != nil {
+				t.Fatalf("error making directory: %v", err)
+			}
+			contents := map[string][]byte{}
+			chains := map[string][]uint32{}
+			// in order, as the first file in the directory keeps a cluster that it shares
+			for _, spec := range []struct {
+				name     string
+				clusters int
+			}{{"/first.txt", 3}, {"/second.txt", 2}, {"/short.txt", 1}, {"/long.txt", 3}, {"/empty.txt", 0}} {
+				name, clusters := spec.name, spec.clusters
+				fl, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("error creating file %s: %v", name, err)
+				}
+				contents[name] = bytes.Repeat([]byte(name[1:2]), clusters*fs.bytesPerCluster)
+				if _, err := fl.Write(contents[name]); err != nil {
+					t.Fatalf("error writing file %s: %v", name, err)
+				}
+				if chains[name], err = fl.(*File).GetClusterChain(); err != nil {
+					t.Fatalf("error getting clusters of %s: %v", name, err)
+				}
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("error closing filesystem: %v", err)
+			}
+			if err := fs.Check(false); err != nil {
+				t.Fatalf("unexpected problems in new filesystem: %v", err)
+			}
+
+			// cross-link the second file into the first, leaving its own second cluster lost, and give the others
+			// sizes that do not fit their chains
+			fs.table.clusters[chains["/second.txt"][0]] = chains["/first.txt"][1]
+			if err := fs.writeFat(); err != nil {
+				t.Fatalf("error writing FAT: %v", err)
+			}
+			root, entries, err := fs.readDirWithMkdir("/", false)
+			if err != nil {
+				t.Fatalf("error reading root directory: %v", err)
+			}
+			sizes := map[string]uint32{
+				"short.txt": uint32(3 * fs.bytesPerCluster),
+				"long.txt":  10,
+				"dir":       100,
+			}
+			for _, e := range entries {
+				if size, ok := sizes[strings.ToLower(e.filenameShort+"."+e.fileExtension)]; ok {
+					e.fileSize = size
+				}
+				if size, ok := sizes[strings.ToLower(e.filenameShort)]; ok && e.isSubdirectory {
+					e.fileSize = size
+				}
+			}
+			if err := fs.writeDirectoryEntries(root); err != nil {
+				t.Fatalf("error writing root directory: %v", err)
+			}
+
+			err = fs.Check(false)
+			for _, expected := range []string{
+				fmt.Sprintf("file /second.txt shares cluster %d with another chain", chains["/first.txt"][1]),
+				fmt.Sprintf("file /second.txt has size %d, more than the %d bytes of its 1 clusters", 2*fs.bytesPerCluster, fs.bytesPerCluster),
+				fmt.Sprintf("file /short.txt has size %d, more than the %d bytes of its 1 clusters", 3*fs.bytesPerCluster, fs.bytesPerCluster),
+				"file /long.txt has size 10, which needs 1 clusters, but its chain has 3",
+				"directory /dir has size 100 instead of 0",
+				fmt.Sprintf("lost chain of 1 clusters starting at cluster %d", chains["/second.txt"][1]),
+			} {
+				if err == nil || !strings.Contains(err.Error(), expected) {
+					t.Errorf("problems %v do not include %q", err, expected)
+				}
+			}
+
+			if err := fs.Check(true); err != nil {
+				t.Fatalf("unexpected problems repairing: %v", err)
+			}
+			if err := fs.Check(false); err != nil {
+				t.Errorf("unexpected problems after repair: %v", err)
+			}
+			// the first file keeps the cluster it shared, and the rest are what fits their chains
+			expected := map[string][]byte{
+				"/first.txt":  contents["/first.txt"],
+				"/second.txt": contents["/second.txt"][:fs.bytesPerCluster],
+				"/short.txt":  contents["/short.txt"],
+				"/long.txt":   contents["/long.txt"][:10],
+				"/empty.txt":  {},
+			}
+			for name, content := range expected {
+				fl, err := fs.OpenFile(name, os.O_RDONLY)
+				if err != nil {
+					t.Fatalf("error opening %s: %v", name, err)
+				}
+				b, err := io.ReadAll(fl)
+				if err != nil {
+					t.Fatalf("error reading %s: %v", name, err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Errorf("%s has %d bytes that are not the %d expected", name, len(b), len(content))
+				}
+			}
+			// its clusters past its size are freed, so may since have been taken by FOUND.000
+			if next := fs.table.clusters[chains["/long.txt"][0]]; !fs.table.isEoc(next) {
+				t.Errorf("chain of /long.txt goes on to cluster %d past its size", next)
+			}
+			if _, entries, err = fs.readDirWithMkdir("/", false); err != nil {
+				t.Fatalf("error reading root directory: %v", err)
+			}
+			for _, e := range entries {
+				if e.isSubdirectory && e.filenameShort == "DIR" && e.fileSize != 0 {
+					t.Errorf("directory has size %d after repair", e.fileSize)
+				}
+			}
+			if _, err := fs.ReadDir("/FOUND.000"); err != nil {
+				t.Errorf("error reading FOUND.000: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package fat32
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// CodePage is the OEM code page of the short 8.3 names in a filesystem, as MS-DOS and Windows keep them.
+// Long filenames are always UCS-2, so do not depend on it. It is not stored in the filesystem, so has to match
+// what the systems that use the filesystem expect; the zero value is CodePage437, which Windows in the US,
+// Linux and mtools use by default.
+type CodePage int
+
+// the OEM code pages that short names can be in
+const (
+	// CodePage437 is the original IBM PC code page, for the US
+	CodePage437 CodePage = 437
+	// CodePage850 is for Western Europe
+	CodePage850 CodePage = 850
+	// CodePage852 is for Central Europe
+	CodePage852 CodePage = 852
+	// CodePage855 is for Cyrillic
+	CodePage855 CodePage = 855
+	// CodePage858 is for Western Europe, with the euro sign
+	CodePage858 CodePage = 858
+	// CodePage860 is for Portuguese
+	CodePage860 CodePage = 860
+	// CodePage862 is for Hebrew
+	CodePage862 CodePage = 862
+	// CodePage863 is for Canadian French
+	CodePage863 CodePage = 863
+	// CodePage865 is for the Nordic languages
+	CodePage865 CodePage = 865
+	// CodePage866 is for Russian
+	CodePage866 CodePage = 866
+	// CodePage874 is for Thai
+	CodePage874 CodePage = 874
+	// CodePage932 is Shift JIS, for Japanese
+	CodePage932 CodePage = 932
+	// CodePage936 is GBK, for Simplified Chinese
+	CodePage936 CodePage = 936
+	// CodePage949 is Unified Hangul Code, for Korean
+	CodePage949 CodePage = 949
+	// CodePage950 is Big5, for Traditional Chinese
+	CodePage950 CodePage = 950
+)
+
+var codePageEncodings = map[CodePage]encoding.Encoding{
+	CodePage437: charmap.CodePage437,
+	CodePage850: charmap.CodePage850,
+	CodePage852: charmap.CodePage852,
+	CodePage855: charmap.CodePage855,
+	CodePage858: charmap.CodePage858,
+	CodePage860: charmap.CodePage860,
+	CodePage862: charmap.CodePage862,
+	CodePage863: charmap.CodePage863,
+	CodePage865: charmap.CodePage865,
+	CodePage866: charmap.CodePage866,
+	CodePage874: charmap.Windows874,
+	CodePage932: japanese.ShiftJIS,
+	CodePage936: simplifiedchinese.GBK,
+	CodePage949: korean.EUCKR,
+	CodePage950: traditionalchinese.Big5,
+}
+
+func (cp CodePage) String() string {
+	return fmt.Sprintf("CP%d", int(cp.orDefault()))
+}
+
+func (cp CodePage) orDefault() CodePage {
+	if cp == 0 {
+		return CodePage437
+	}
+	return cp
+}
+
+// validate check that the code page is one that is supported
+func (cp CodePage) validate() error {
+	if _, ok := codePageEncodings[cp.orDefault()]; !ok {
+		return fmt.Errorf("unsupported code page %d", int(cp))
+	}
+	return nil
+}
+
+func (cp CodePage) encoding() encoding.Encoding {
+	if enc, ok := codePageEncodings[cp.orDefault()]; ok {
+		return enc
+	}
+	return codePageEncodings[CodePage437]
+}
+
+// encodeRune the bytes of r in the code page, or false if the code page cannot hold it
+func (cp CodePage) encodeRune(r rune) ([]byte, bool) {
+	if r < utf8.RuneSelf {
+		return []byte{byte(r)}, true
+	}
+	if r == utf8.RuneError {
+		return nil, false
+	}
+	b, err := cp.encoding().NewEncoder().Bytes([]byte(string(r)))
+	if err != nil || len(b) == 0 {
+		return nil, false
+	}
+	return b, true
+}
+
+// encode s in the code page, or return an error if the code page cannot hold it
+func (cp CodePage) encode(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		rb, ok := cp.encodeRune(r)
+		if !ok {
+			return nil, fmt.Errorf("character %q cannot be represented in code page %d", r, int(cp.orDefault()))
+		}
+		b = append(b, rb...)
+	}
+	return b, nil
+}
+
+// encodeShortName encode s, a short name or extension, in the code page, padded with spaces to length bytes.
+// A first byte of 0xe5, which marks a deleted entry, is stored as 0x05, as in Shift JIS it can start a character.
+func (cp CodePage) encodeShortName(s string, length int) ([]byte, error) {
+	b, err := cp.encode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > length {
+		return nil, fmt.Errorf("%q is %d bytes in code page %d, longer than allowed %d bytes", s, len(b), int(cp.orDefault()), length)
+	}
+	for len(b) < length {
+		b = append(b, ' ')
+	}
+	if b[0] == 0xe5 {
+		b[0] = 0x05
+	}
+	return b, nil
+}
+
+// decodeShortName decode b, a short name or extension as stored on disk, from the code page, without the spaces
+// that pad it
+func (cp CodePage) decodeShortName(b []byte) string {
+	b = []byte(strings.TrimRight(string(b), " "))
+	if len(b) > 0 && b[0] == 0x05 {
+		b[0] = 0xe5
+	}
+	s, err := cp.encoding().NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(s)
+}
+
+// shortNameLength how many bytes s takes in the code page, counting any character it cannot hold as 1
+func (cp CodePage) shortNameLength(s string) int {
+	length := 0
+	for _, r := range s {
+		rb, ok := cp.encodeRune(r)
+		if !ok {
+			length++
+			continue
+		}
+		length += len(rb)
+	}
+	return length
+}
+
+// truncateShortName the longest start of s that fits in length bytes in the code page, without splitting
+// a character of more than one byte
+func (cp CodePage) truncateShortName(s string, length int) string {
+	n := 0
+	for i, r := range s {
+		rb, ok := cp.encodeRune(r)
+		size := len(rb)
+		if !ok {
+			size = 1
+		}
+		if n+size > length {
+			return s[:i]
+		}
+		n += size
+	}
+	return s
+}
@@ -15,6 +15,8 @@ import (
 
 const (
 	Fat32File           = "./testdata/dist/fat32.img"
+	Fat32File1K         = "./testdata/dist/fat32-1024.img"
+	Fat32File2K         = "./testdata/dist/fat32-2048.img"
 	fsckFile            = "./testdata/dist/fsck.txt"
 	rootdirFile         = "./testdata/dist/root_dir.txt"
 	rootdirFileFLS      = "./testdata/dist/root_dir_fls.txt"
@@ -462,6 +464,7 @@ func testReadFilesystemData() (info *testFSInfo, err error) {
 			sizeInBytes := sectorsPerFat * info.bytesPerSector
 			numClusters := sizeInBytes / 4
 			info.table = &table{
+				fatType:        FatType32,
 				fatID:          268435448, // 0x0ffffff8
 				eocMarker:      eoc,       // 0x0fffffff
 				rootDirCluster: 2,         // root is at cluster 2
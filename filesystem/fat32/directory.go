@@ -2,6 +2,7 @@ package fat32
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,9 +12,9 @@ type Directory struct {
 	entries []*directoryEntry
 }
 
-// dirEntriesFromBytes loads the directory entries from the raw bytes
-func (d *Directory) entriesFromBytes(b []byte) error {
-	entries, err := parseDirEntries(b)
+// dirEntriesFromBytes loads the directory entries from the raw bytes, with short names in the code page cp
+func (d *Directory) entriesFromBytes(b []byte, cp CodePage) error {
+	entries, err := parseDirEntries(b, cp)
 	if err != nil {
 		return err
 	}
@@ -21,11 +22,11 @@ func (d *Directory) entriesFromBytes(b []byte) error {
 	return nil
 }
 
-// entriesToBytes convert our entries to raw bytes
-func (d *Directory) entriesToBytes(bytesPerCluster int) ([]byte, error) {
+// entriesToBytes convert our entries to raw bytes, with short names in the code page cp
+func (d *Directory) entriesToBytes(bytesPerCluster int, cp CodePage) ([]byte, error) {
 	b := make([]byte, 0)
 	for _, de := range d.entries {
-		b2, err := de.toBytes()
+		b2, err := de.toBytes(cp)
 		if err != nil {
 			return nil, err
 		}
@@ -38,16 +39,15 @@ func (d *Directory) entriesToBytes(bytesPerCluster int) ([]byte, error) {
 	return b, nil
 }
 
-// createEntry creates an entry in the given directory, and returns the handle to it
-func (d *Directory) createEntry(name string, cluster uint32, dir bool) (*directoryEntry, error) {
+// createEntry creates an entry in the given directory, with a short name in the code page cp,
+// and returns the handle to it
+func (d *Directory) createEntry(name string, cluster uint32, dir bool, cp CodePage) (*directoryEntry, error) {
 	// is it a long filename or a short filename?
-	var isLFN bool
-	// TODO: convertLfnSfn does not calculate if the short name conflicts and thus should increment the last character
-	//       that should happen here, once we can look in the directory entry
-	shortName, extension, isLFN, _ := convertLfnSfn(name)
+	shortName, extension, isLFN, isTruncated := convertLfnSfn(name, cp)
 	lfn := ""
 	if isLFN {
 		lfn = name
+		shortName = d.uniqueShortName(shortName, extension, isTruncated, cp)
 	}
 
 	// allocate a slot for the new filename in the existing directory
@@ -71,6 +71,38 @@ func (d *Directory) createEntry(name string, cluster uint32, dir bool) (*directo
 	return &entry, nil
 }
 
+// uniqueShortName make a short name generated from a long filename unique in the directory, by
+// giving it the lowest numeric tail ~N that is not taken, as Windows does, e.g. LONGFI~1, LONGFI~2 ... LONGF~10.
+// A short name that is not truncated keeps its name unless it is taken. The 8 characters are bytes in
+// the code page cp, so the name is cut short by whole characters to make room for the tail.
+func (d *Directory) uniqueShortName(shortName, extension string, isTruncated bool, cp CodePage) string {
+	taken := func(name string) bool {
+		for _, e := range d.entries {
+			if e.isVolumeLabel {
+				continue
+			}
+			if strings.EqualFold(e.filenameShort, name) && strings.EqualFold(e.fileExtension, extension) {
+				return true
+			}
+		}
+		return false
+	}
+	base := shortName
+	if isTruncated {
+		// convertLfnSfn always gives ~1
+		base = strings.TrimSuffix(shortName, "~1")
+	} else if !taken(shortName) {
+		return shortName
+	}
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		candidate := cp.truncateShortName(base, 8-len(tail)) + tail
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
 // removeEntry removes an entry in the given directory
 func (d *Directory) removeEntry(name string) error {
 	// TODO implement check for long/short filename after increment of sfn is correctly implemented
@@ -92,8 +124,8 @@ func (d *Directory) removeEntry(name string) error {
 	return nil
 }
 
-// renameEntry renames an entry in the given directory, and returns the handle to it
-func (d *Directory) renameEntry(oldFileName, newFileName string) error {
+// renameEntry renames an entry in the given directory, with a short name in the code page cp
+func (d *Directory) renameEntry(oldFileName, newFileName string, cp CodePage) error {
 	// TODO implement check for long/short filename after increment of sfn is correctly implemented
 
 	newEntries := make([]*directoryEntry, 0, len(d.entries))
@@ -104,9 +136,12 @@ func (d *Directory) renameEntry(oldFileName, newFileName string) error {
 		}
 		if entry.filenameLong == oldFileName { //  || entry.filenameShort == shortName  do not compare SFN, since it is not incremented correctly
 			var lfn string
-			shortName, extension, isLFN, _ := convertLfnSfn(newFileName)
+			shortName, extension, isLFN, isTruncated := convertLfnSfn(newFileName, cp)
 			if isLFN {
 				lfn = newFileName
+				// the entry's own short name is about to go, so must not count as taken
+				entry.filenameShort, entry.fileExtension = "", ""
+				shortName = d.uniqueShortName(shortName, extension, isTruncated, cp)
 			}
 			entry.filenameLong = lfn
 			entry.filenameShort = shortName
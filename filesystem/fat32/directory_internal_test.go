@@ -19,7 +19,7 @@ func TestDirectoryEntriesFromBytes(t *testing.T) {
 	}
 
 	d := &Directory{}
-	err = d.entriesFromBytes(b)
+	err = d.entriesFromBytes(b, CodePage437)
 	switch {
 	case err != nil:
 		t.Errorf("unexpected non-nil error: %v", err)
@@ -52,7 +52,7 @@ func TestDirectoryEntriesToBytes(t *testing.T) {
 			},
 		},
 	}
-	output, err := d.entriesToBytes(bytesPerCluster)
+	output, err := d.entriesToBytes(bytesPerCluster, CodePage437)
 	switch {
 	case err != nil:
 		t.Errorf("unexpected non-nil error: %v", err)
@@ -103,7 +103,7 @@ func TestDirectoryCreateEntry(t *testing.T) {
 	d := &Directory{}
 	now := time.Now()
 	for _, tt := range tests {
-		output, err := d.createEntry(tt.name, tt.cluster, tt.dir)
+		output, err := d.createEntry(tt.name, tt.cluster, tt.dir, CodePage437)
 		msg := fmt.Sprintf("createEntry(%s, %d, %t)", tt.name, tt.cluster, tt.dir)
 		switch {
 		case err != nil:
@@ -130,3 +130,65 @@ func TestDirectoryCreateEntry(t *testing.T) {
 		}
 	}
 }
+
+func TestDirectoryUniqueShortName(t *testing.T) {
+	d := &Directory{}
+	tests := []struct {
+		name      string
+		shortName string
+		extension string
+	}{
+		{"longfilename1.txt", "LONGFI~1", "TXT"},
+		{"longfilename2.txt", "LONGFI~2", "TXT"},
+		{"longfilename3.dat", "LONGFI~1", "DAT"},
+		{"a b.txt", "AB", "TXT"},
+		{"a+b.txt", "A_B", "TXT"},
+		{"a,b.txt", "A_B~1", "TXT"},
+	}
+	for i := 3; i <= 10; i++ {
+		tests = append(tests, struct {
+			name      string
+			shortName string
+			extension string
+		}{fmt.Sprintf("longfilename%d.txt", i+10), fmt.Sprintf("LONGFI~%d", i), "TXT"})
+	}
+	// 2 digits leave room for only 5 characters of the name
+	tests[len(tests)-1].shortName = "LONGF~10"
+	for _, tt := range tests {
+		de, err := d.createEntry(tt.name, 2, false, CodePage437)
+		if err != nil {
+			t.Fatalf("createEntry(%s) returned error: %v", tt.name, err)
+		}
+		if de.filenameShort != tt.shortName || de.fileExtension != tt.extension {
+			t.Errorf("createEntry(%s) short name %s.%s instead of %s.%s", tt.name, de.filenameShort, de.fileExtension, tt.shortName, tt.extension)
+		}
+	}
+}
+
+func TestDirectoryUniqueShortNameCodePage(t *testing.T) {
+	d := &Directory{}
+	// in Shift JIS each of these characters takes 2 of the 8 bytes of the short name
+	for i, expected := range []string{"日本語~1", "日本語~2"} {
+		de, err := d.createEntry(fmt.Sprintf("日本語のファイル%d.txt", i), 2, false, CodePage932)
+		if err != nil {
+			t.Fatalf("createEntry returned error: %v", err)
+		}
+		if de.filenameShort != expected {
+			t.Errorf("short name %s instead of %s", de.filenameShort, expected)
+		}
+	}
+	for i := 3; i <= 10; i++ {
+		de, err := d.createEntry(fmt.Sprintf("日本語のファイル%d.txt", i), 2, false, CodePage932)
+		if err != nil {
+			t.Fatalf("createEntry returned error: %v", err)
+		}
+		// 2 digits leave room for only 5 bytes, so 2 characters, of the name
+		expected := fmt.Sprintf("日本語~%d", i)
+		if i == 10 {
+			expected = "日本~10"
+		}
+		if de.filenameShort != expected {
+			t.Errorf("short name %s instead of %s", de.filenameShort, expected)
+		}
+	}
+}
@@ -3,9 +3,10 @@ package fat32
 import (
 	"encoding/binary"
 	"fmt"
-	"regexp"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf16"
 
 	"github.com/elliotwutingfeng/asciiset"
 )
@@ -49,12 +50,14 @@ type directoryEntry struct {
 	isNew              bool
 }
 
-func (de *directoryEntry) toBytes() ([]byte, error) {
+// toBytes the entry, with any long filename entries before it, ready to write to disk, with the short name
+// in the code page cp
+func (de *directoryEntry) toBytes(cp CodePage) ([]byte, error) {
 	b := make([]byte, 0, bytesPerSlot)
 
 	// do we have a long filename?
 	if de.filenameLong != "" {
-		lfnBytes, err := longFilenameBytes(de.filenameLong, de.filenameShort, de.fileExtension)
+		lfnBytes, err := longFilenameBytes(de.filenameLong, de.filenameShort, de.fileExtension, cp)
 		if err != nil {
 			return nil, fmt.Errorf("could not convert long filename to directory entries: %v", err)
 		}
@@ -71,13 +74,12 @@ func (de *directoryEntry) toBytes() ([]byte, error) {
 	binary.LittleEndian.PutUint16(dosBytes[18:20], accessDate)
 	binary.LittleEndian.PutUint16(dosBytes[22:24], modifyTime)
 	binary.LittleEndian.PutUint16(dosBytes[24:26], modifyDate)
-	// convert the short filename and extension to ascii bytes
-	shortName, err := stringToASCIIBytes(fmt.Sprintf("% -8s", de.filenameShort))
+	// convert the short filename and extension to bytes in the code page
+	shortName, err := cp.encodeShortName(de.filenameShort, 8)
 	if err != nil {
 		return nil, fmt.Errorf("error converting short filename to bytes: %v", err)
 	}
-	// convert the short filename and extension to ascii bytes
-	extension, err := stringToASCIIBytes(fmt.Sprintf("% -3s", de.fileExtension))
+	extension, err := cp.encodeShortName(de.fileExtension, 3)
 	if err != nil {
 		return nil, fmt.Errorf("error converting file extension to bytes: %v", err)
 	}
@@ -92,6 +94,15 @@ func (de *directoryEntry) toBytes() ([]byte, error) {
 	dosBytes[21] = clusterLocation[3]
 
 	// set the flags
+	if de.isReadOnly {
+		dosBytes[11] |= 0x01
+	}
+	if de.isHidden {
+		dosBytes[11] |= 0x02
+	}
+	if de.isSystem {
+		dosBytes[11] |= 0x04
+	}
 	if de.isVolumeLabel {
 		dosBytes[11] |= 0x08
 	}
@@ -115,12 +126,13 @@ func (de *directoryEntry) toBytes() ([]byte, error) {
 }
 
 // parseDirEntries takes all of the bytes in a special file (i.e. a directory)
-// and gets all of the DirectoryEntry for that directory
+// and gets all of the DirectoryEntry for that directory, with the short names in the code page cp
 // this is, essentially, the equivalent of `ls -l` or if you prefer `dir`
-func parseDirEntries(b []byte) ([]*directoryEntry, error) {
+func parseDirEntries(b []byte, cp CodePage) ([]*directoryEntry, error) {
 	dirEntries := make([]*directoryEntry, 0, 20)
-	// parse the data into Fat32DirectoryEntry
-	lfn := ""
+	// parse the data into Fat32DirectoryEntry; the long filename is UTF-16, and a character of it can be split
+	// across two entries, so it only is decoded once all of its entries are read
+	var lfn []uint16
 	// this should be used to count the LFN entries and that they make sense
 	//     lfnCount := 0
 byteLoop:
@@ -137,15 +149,10 @@ byteLoop:
 		if b[i+11] == 0x0f {
 			// check if this is the last logical / first physical and how many there are
 			if b[i]&0x40 == 0x40 {
-				lfn = ""
+				lfn = nil
 			}
 			// parse the long filename
-			tmpLfn, err := longFilenameEntryFromBytes(b[i : i+32])
-			// an error is impossible since we pass exactly 32, but we leave the handler here anyways
-			if err != nil {
-				return nil, fmt.Errorf("error parsing long filename at position %d: %v", i, err)
-			}
-			lfn = tmpLfn + lfn
+			lfn = append(longFilenameEntryUnits(b[i:i+32]), lfn...)
 			continue
 		}
 		// not LFN, so parse regularly
@@ -154,9 +161,12 @@ byteLoop:
 		accessDate := binary.LittleEndian.Uint16(b[i+18 : i+20])
 		modifyTime := binary.LittleEndian.Uint16(b[i+22 : i+24])
 		modifyDate := binary.LittleEndian.Uint16(b[i+24 : i+26])
-		re := regexp.MustCompile(" +$")
-		sfn := re.ReplaceAllString(string(b[i:i+8]), "")
-		extension := re.ReplaceAllString(string(b[i+8:i+11]), "")
+		sfn := cp.decodeShortName(b[i : i+8])
+		extension := cp.decodeShortName(b[i+8 : i+11])
+		longName := string(utf16.Decode(lfn))
+		isReadOnly := b[i+11]&0x01 == 0x01
+		isHidden := b[i+11]&0x02 == 0x02
+		isSystem := b[i+11]&0x04 == 0x04
 		isSubdirectory := b[i+11]&0x10 == 0x10
 		isArchiveDirty := b[i+11]&0x20 == 0x20
 		isVolumeLabel := b[i+11]&0x08 == 0x08
@@ -164,8 +174,8 @@ byteLoop:
 		lowercaseExtension := b[i+12]&0x10 == 0x10
 
 		entry := directoryEntry{
-			filenameLong:       lfn,
-			longFilenameSlots:  calculateSlots(lfn),
+			filenameLong:       longName,
+			longFilenameSlots:  calculateSlots(longName),
 			filenameShort:      sfn,
 			fileExtension:      extension,
 			fileSize:           binary.LittleEndian.Uint32(b[i+28 : i+32]),
@@ -173,13 +183,16 @@ byteLoop:
 			createTime:         dateTimeToTime(createDate, createTime),
 			modifyTime:         dateTimeToTime(modifyDate, modifyTime),
 			accessTime:         dateTimeToTime(accessDate, 0),
+			isReadOnly:         isReadOnly,
+			isHidden:           isHidden,
+			isSystem:           isSystem,
 			isSubdirectory:     isSubdirectory,
 			isArchiveDirty:     isArchiveDirty,
 			isVolumeLabel:      isVolumeLabel,
 			lowercaseShortname: lowercaseShortname,
 			lowercaseExtension: lowercaseExtension,
 		}
-		lfn = ""
+		lfn = nil
 		dirEntries = append(dirEntries, &entry)
 	}
 	return dirEntries, nil
@@ -206,24 +219,25 @@ func timeToDateTime(t time.Time) (datePart, timePart uint16) {
 	return uint16(retDate), uint16(retTime)
 }
 
-func longFilenameBytes(s, shortName, extension string) ([]byte, error) {
+// longFilenameBytes the long filename entries for the long filename s, of the short name and extension in
+// the code page cp, last entry first, as they go on disk
+func longFilenameBytes(s, shortName, extension string, cp CodePage) ([]byte, error) {
 	// we need the checksum of the short name
-	checksum, err := lfnChecksum(shortName, extension)
+	checksum, err := lfnChecksum(shortName, extension, cp)
 	if err != nil {
 		return nil, fmt.Errorf("could not calculate checksum for 8.3 filename: %v", err)
 	}
 	// should be multiple of exactly 32 bytes
 	slots := calculateSlots(s)
-	// convert our string into runes
-	r := []rune(s)
+	// vfat long filenames are UCS-2, which Windows extends to UTF-16, with characters outside the
+	// Basic Multilingual Plane as surrogate pairs
+	r := utf16.Encode([]rune(s))
 	b2SlotLength := maxCharsLongFilename * 2
 	maxChars := slots * maxCharsLongFilename
 	b2 := make([]byte, 0, maxChars*2)
-	// convert the rune slice into a byte slice with 2 bytes per rune
-	// vfat long filenames support UCS-2 *only*
-	// so it is *very* important we do not try to parse them otherwise
+	// convert the UTF-16 slice into a byte slice with 2 bytes per code unit
 	for i := 0; i < maxChars; i++ {
-		// do we have a rune at this point?
+		// do we have a code unit at this point?
 		var tmpb []byte
 		switch {
 		case i == len(r):
@@ -231,7 +245,7 @@ func longFilenameBytes(s, shortName, extension string) ([]byte, error) {
 		case i > len(r):
 			tmpb = []byte{0xff, 0xff}
 		default:
-			val := uint16(r[i])
+			val := r[i]
 			// little endian
 			tmpb = []byte{byte(val & 0x00ff), byte(val >> 8)}
 		}
@@ -278,37 +292,42 @@ func longFilenameEntryFromBytes(b []byte) (string, error) {
 	if bLen != 32 {
 		return "", fmt.Errorf("longFilenameEntryFromBytes only can parse byte of length 32, not %d", bLen)
 	}
+	return string(utf16.Decode(longFilenameEntryUnits(b))), nil
+}
+
+// longFilenameEntryUnits the UTF-16 code units of the part of a long filename in the 32 bytes of a single entry
+func longFilenameEntryUnits(b []byte) []uint16 {
 	b2 := make([]byte, 0, maxCharsLongFilename*2)
 	// strip out the unused ones
 	b2 = append(b2, b[1:11]...)
 	b2 = append(b2, b[14:26]...)
 	b2 = append(b2, b[28:32]...)
 	// parse the bytes of the long filename
-	// vfat long filenames support UCS-2 *only*
-	// so it is *very* important we do not try to parse them otherwise
-	r := make([]rune, 0, maxCharsLongFilename)
+	// vfat long filenames are UCS-2, or UTF-16 with surrogate pairs as Windows writes them, and never
+	// anything else, so it is *very* important we do not try to parse them otherwise
+	u := make([]uint16, 0, maxCharsLongFilename)
 	// now we can iterate
 	for i := 0; i < maxCharsLongFilename; i++ {
 		// little endian
-		val := uint16(b2[2*i+1])<<8 + uint16(b2[2*i])
+		val := binary.LittleEndian.Uint16(b2[2*i:])
 		// stop at all 0
 		if val == 0 {
 			break
 		}
-		r = append(r, rune(val))
+		u = append(u, val)
 	}
-	return string(r), nil
+	return u
 }
 
-// takes the short form of the name and checksums it
+// takes the short form of the name and checksums it, as it is in the code page cp
 // the period between the 8 characters and the 3 character extension is dropped
 // any unused chars are replaced by space ASCII 0x20
-func lfnChecksum(name, extension string) (byte, error) {
-	nameBytes, err := stringToValidASCIIBytes(name)
+func lfnChecksum(name, extension string, cp CodePage) (byte, error) {
+	nameBytes, err := validShortNameBytes(name, cp)
 	if err != nil {
 		return 0x00, fmt.Errorf("invalid shortname character in filename: %s", name)
 	}
-	extensionBytes, err := stringToValidASCIIBytes(extension)
+	extensionBytes, err := validShortNameBytes(extension, cp)
 	if err != nil {
 		return 0x00, fmt.Errorf("invalid shortname character in extension: %s", extension)
 	}
@@ -332,54 +351,39 @@ func lfnChecksum(name, extension string) (byte, error) {
 	b := make([]byte, len(nameBytes))
 	copy(b, nameBytes)
 	b = append(b, extensionBytes...)
+	// the checksum is of the bytes on disk, where a first byte of 0xe5 is stored as 0x05
+	if b[0] == 0xe5 {
+		b[0] = 0x05
+	}
 
-	// calculate the checksum
+	return shortNameChecksum(b), nil
+}
+
+// shortNameChecksum the checksum of the 11 bytes of a short name and extension, as they are on disk,
+// which every long filename entry for it holds
+func shortNameChecksum(b []byte) byte {
 	var sum byte = 0x00
 	for i := 11; i > 0; i-- {
 		sum = ((sum & 0x01) << 7) + (sum >> 1) + b[11-i]
 	}
-	return sum, nil
-}
-
-// convert a string to ascii bytes, but only accept valid 8.3 bytes
-func stringToValidASCIIBytes(s string) ([]byte, error) {
-	b, err := stringToASCIIBytes(s)
-	if err != nil {
-		return b, err
-	}
-	// now make sure every byte is valid
-	for _, b2 := range b {
-		// only valid chars - 0-9, A-Z, _, ~
-		if validShortNameCharacters.Contains(b2) {
-			continue
-		}
-		return nil, fmt.Errorf("invalid 8.3 character")
-	}
-	return b, nil
+	return sum
 }
 
-// convert a string to a byte array, if all characters are valid ascii
-func stringToASCIIBytes(s string) ([]byte, error) {
-	length := len(s)
-	b := make([]byte, length)
-	// convert the name into 11 bytes
-	r := []rune(s)
-	// take the first 8 characters
-	for i := 0; i < length; i++ {
-		val := int(r[i])
-		// we only can handle values less than max byte = 255
-		if val > 255 {
-			return nil, fmt.Errorf("non-ASCII character in name: %s", s)
+// validShortNameBytes convert a short name or extension to bytes in the code page cp, but only accept
+// characters that are valid in 8.3 names: those of the code page beyond ASCII, and only some of ASCII
+func validShortNameBytes(s string, cp CodePage) ([]byte, error) {
+	for _, r := range s {
+		if r < 0x80 && !validShortNameCharacters.Contains(byte(r)) {
+			return nil, fmt.Errorf("invalid 8.3 character %q", r)
 		}
-		b[i] = byte(val)
 	}
-	return b, nil
+	return cp.encode(s)
 }
 
-// calculate how many vfat slots a long filename takes up
+// calculate how many vfat slots a long filename takes up, for its UTF-16 code units
 // this does NOT include the slot for the true DOS 8.3 entry
 func calculateSlots(s string) int {
-	sLen := len(s)
+	sLen := len(utf16.Encode([]rune(s)))
 	slots := sLen / charsPerSlot
 	if sLen%charsPerSlot != 0 {
 		slots++
@@ -387,12 +391,12 @@ func calculateSlots(s string) int {
 	return slots
 }
 
-// convert LFN to short name
+// convert LFN to short name, in the code page cp
 // returns shortName, extension, isLFN, isTruncated
 //
 //	isLFN : was there an LFN that had to be converted
-//	isTruncated : was the shortname longer than 8 chars and had to be converted?
-func convertLfnSfn(name string) (shortName, extension string, isLFN, isTruncated bool) {
+//	isTruncated : was the shortname longer than 8 bytes and had to be converted?
+func convertLfnSfn(name string, cp CodePage) (shortName, extension string, isLFN, isTruncated bool) {
 	// get last period in name
 	lastDot := strings.LastIndex(name, ".")
 	// now convert it
@@ -401,13 +405,9 @@ func convertLfnSfn(name string) (shortName, extension string, isLFN, isTruncated
 	// get the extension
 	if lastDot > -1 {
 		rawExtension = name[lastDot+1:]
-		// too long?
-		if len(rawExtension) > 3 {
-			rawExtension = rawExtension[0:3]
-			isLFN = true
-		}
-		// convert the extension
-		extension = uCaseValid(rawExtension)
+		// convert the extension, and cut it to 3 bytes, which can be fewer characters in a double byte code page
+		extension = uCaseValid(rawExtension, cp)
+		extension = cp.truncateShortName(extension, 3)
 	}
 	if extension != rawExtension {
 		isLFN = true
@@ -417,28 +417,29 @@ func convertLfnSfn(name string) (shortName, extension string, isLFN, isTruncated
 	if lastDot > -1 {
 		rawShortName = name[:lastDot]
 	}
-	shortName = uCaseValid(rawShortName)
+	shortName = uCaseValid(rawShortName, cp)
 	if rawShortName != shortName {
 		isLFN = true
 	}
 
-	// convert shortName to 8 chars
-	if len(shortName) > 8 {
+	// convert shortName to 8 bytes
+	if cp.shortNameLength(shortName) > 8 {
 		isLFN = true
 		isTruncated = true
-		shortName = shortName[:6] + "~" + "1"
+		shortName = cp.truncateShortName(shortName, 6) + "~" + "1"
 	}
 	return shortName, extension, isLFN, isTruncated
 }
 
-// converts a string into upper-case with only valid characters
-func uCaseValid(name string) string {
+// converts a string into upper-case with only valid characters, those of ASCII that are valid in short names,
+// and those beyond ASCII that the code page cp has
+func uCaseValid(name string, cp CodePage) string {
 	// easiest way to do this is to go through the name one char at a time
 	r := []rune(name)
 	r2 := make([]rune, 0, len(r))
 	for _, val := range r {
 		switch {
-		case validShortNameCharacters.Contains(byte(val)):
+		case val < 0x80 && validShortNameCharacters.Contains(byte(val)):
 			r2 = append(r2, val)
 		case (0x61 <= val && val <= 0x7a):
 			// lower-case characters should be upper-cased
@@ -446,6 +447,14 @@ func uCaseValid(name string) string {
 		case val == ' ' || val == '.':
 			// remove spaces and periods
 			continue
+		case val >= 0x80:
+			// upper-case it as Windows does, if the code page has the upper-case character
+			upper := unicode.ToUpper(val)
+			if _, ok := cp.encodeRune(upper); ok {
+				r2 = append(r2, upper)
+			} else {
+				r2 = append(r2, '_')
+			}
 		default:
 			// replace the rest with _
 			r2 = append(r2, '_')
@@ -87,7 +87,7 @@ func compareDirectoryEntriesIgnoreDates(a, b *directoryEntry) bool {
 
 func TestDirectoryEntryLongFilenameBytes(t *testing.T) {
 	for _, tt := range sfnBytesTests {
-		output, err := longFilenameBytes(tt.lfn, tt.shortName, tt.extension)
+		output, err := longFilenameBytes(tt.lfn, tt.shortName, tt.extension, CodePage437)
 		if (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
 			t.Log(err)
 			t.Log(tt.err)
@@ -169,7 +169,7 @@ func TestDirectoryEntryLfnChecksum(t *testing.T) {
 		{"ABCDEF", "T", 0xcf, nil},
 	}
 	for _, tt := range tests {
-		output, err := lfnChecksum(tt.name, tt.extension)
+		output, err := lfnChecksum(tt.name, tt.extension, CodePage437)
 		if output != tt.output {
 			t.Errorf("lfnChecksum(%s,%s) expected output %v, actual %v", tt.name, tt.extension, tt.output, output)
 		}
@@ -179,20 +179,26 @@ func TestDirectoryEntryLfnChecksum(t *testing.T) {
 	}
 }
 
-func TestDirectoryEntryStringToASCIIBytes(t *testing.T) {
+func TestDirectoryEntryValidShortNameBytes(t *testing.T) {
 	tests := []struct {
 		input  string
+		cp     CodePage
 		output []byte
 		err    error
 	}{
-		{"abc", []byte{0x61, 0x62, 0x63}, nil},
-		{"abcdefg", []byte{0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67}, nil},
-		{"abcdef\u2318", nil, fmt.Errorf("non-ASCII character in name: %s", "abcdef\u2318")},
+		{"ABC", CodePage437, []byte{0x41, 0x42, 0x43}, nil},
+		{"AB~1", CodePage437, []byte{0x41, 0x42, 0x7e, 0x31}, nil},
+		{"CAFÉ", CodePage437, []byte{0x43, 0x41, 0x46, 0x90}, nil},
+		{"ÇA", CodePage850, []byte{0x80, 0x41}, nil},
+		{"日本", CodePage932, []byte{0x93, 0xfa, 0x96, 0x7b}, nil},
+		{"abc", CodePage437, nil, fmt.Errorf("invalid 8.3 character 'a'")},
+		{"AB\u2318", CodePage437, nil, fmt.Errorf("character '\u2318' cannot be represented in code page 437")},
+		{"日本", CodePage437, nil, fmt.Errorf("character '日' cannot be represented in code page 437")},
 	}
 	for _, tt := range tests {
-		output, err := stringToASCIIBytes(tt.input)
+		output, err := validShortNameBytes(tt.input, tt.cp)
 		if !bytes.Equal(output, tt.output) {
-			t.Errorf("stringToASCIIBytes(%s) expected output %v, actual %v", tt.input, tt.output, output)
+			t.Errorf("validShortNameBytes(%s, %v) expected output %v, actual %v", tt.input, tt.cp, tt.output, output)
 		}
 		if (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())) {
 			t.Errorf("mismatched err expected, actual: %v, %v", tt.err, err)
@@ -211,6 +217,9 @@ func TestDirectoryEntryCalculateSlots(t *testing.T) {
 		{"abcdefghijklmn", 2},
 		{"abcdefghijklmnopqrstuvwxyz", 2},
 		{"abcdefghijklmnopqrstuvwxyz1", 3},
+		// characters outside the Basic Multilingual Plane take 2 UTF-16 code units
+		{"abcdefghijk\U0001F600", 1},
+		{"abcdefghijkl\U0001F600", 2},
 	}
 	for _, tt := range tests {
 		slots := calculateSlots(tt.input)
@@ -236,9 +245,11 @@ func TestDirectoryEntryConvertLfnSfn(t *testing.T) {
 		{"aBC.q", "ABC", "Q", true, false},
 		{"ABC.q.rt", "ABCQ", "RT", true, false},
 		{"VeryLongName.ft", "VERYLO~1", "FT", true, true},
+		{"café.txt", "CAF\u00c9", "TXT", true, false},
+		{"\U0001F600.txt", "_", "TXT", true, false},
 	}
 	for _, tt := range tests {
-		sfn, extension, isLfn, isTruncated := convertLfnSfn(tt.input)
+		sfn, extension, isLfn, isTruncated := convertLfnSfn(tt.input, CodePage437)
 		if sfn != tt.sfn || extension != tt.extension || isLfn != tt.isLfn || isTruncated != tt.isTruncated {
 			t.Errorf("convertLfnSfn(%s) expected %s / %s / %t / %t ; actual %s / %s / %t / %t", tt.input, tt.sfn, tt.extension, tt.isLfn, tt.isTruncated, sfn, extension, isLfn, isTruncated)
 		}
@@ -256,9 +267,11 @@ func TestDirectoryEntryUCaseValid(t *testing.T) {
 		{"a15D", "A15D"},
 		{"A BC", "ABC"},
 		{"A..-a*)82y12112bb", "A-A_)82Y12112BB"},
+		{"straße", "STRA\u00dfE"},
+		{"日本", "__"},
 	}
 	for _, tt := range tests {
-		output := uCaseValid(tt.input)
+		output := uCaseValid(tt.input, CodePage437)
 		if output != tt.output {
 			t.Errorf("uCaseValid(%s) expected %s actual %s", tt.input, tt.output, output)
 		}
@@ -279,7 +292,7 @@ func TestDirectoryEntryParseDirEntries(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		output, err := parseDirEntries(tt.b)
+		output, err := parseDirEntries(tt.b, CodePage437)
 		switch {
 		case (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
 			t.Log(err)
@@ -308,7 +321,7 @@ func TestDirectoryEntryToBytes(t *testing.T) {
 	}
 	i := 0
 	for _, de := range validDe {
-		b, err := de.toBytes()
+		b, err := de.toBytes(CodePage437)
 		expected := validBytes[i*32 : (i+1+de.longFilenameSlots)*32]
 		if err != nil {
 			t.Errorf("error converting directory entry to bytes: %v", err)
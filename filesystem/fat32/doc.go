@@ -1,6 +1,26 @@
 // Package fat32 provides utilities to interact with, manipulate and create a FAT32 filesystem on a block device or
 // a disk image.
 //
+// Despite the name, it also creates and reads FAT12 and FAT16, as used for floppies and small boot partitions,
+// see CreateWithType.
+//
+// There is no journal, so writes are ordered for a crash, or a loss of power, at any point to leave the
+// filesystem in a state that chkdsk or fsck.fat can recover from, with no directory entry that leads to clusters
+// that are not allocated to it:
+//
+//  1. clusters are allocated in the FAT in memory
+//  2. the data of a file, or the entries of a directory, are written to the new clusters
+//  3. the FAT is written, linking the new clusters into the chain
+//  4. the directory entry is written, with the size of the file or the entry for a new file or directory
+//
+// Clusters are only freed after that: the FAT is written without a chain once the directory no longer has the
+// entry for it, or a chain is cut short once the data that fitted in it no longer needs it. The worst that a crash
+// leaves is clusters that are allocated but belong to no file, lost chains that Check reports and can recover, or
+// that are linked onto the chain of a file whose size does not yet need them, which Check reports and can free.
+// This holds so long as each write reaches the disk whole, as the FAT is written at once. A directory is rewritten
+// whole when an entry is removed from it, so a crash part way through a directory of more than one cluster can
+// leave one of the entries after it twice, which Check reports.
+//
 // references:
 //
 //	https://en.wikipedia.org/wiki/Design_of_the_FAT_file_system
@@ -8,7 +8,7 @@ import (
 
 // Dos20BPB is a DOS 2.0 BIOS Parameter Block structure
 type dos20BPB struct {
-	bytesPerSector       SectorSize // BytesPerSector is bytes in each sector - always should be 512
+	bytesPerSector       SectorSize // BytesPerSector is bytes in each sector - 512, 1024, 2048 or 4096
 	sectorsPerCluster    uint8      // SectorsPerCluster is number of sectors per cluster
 	reservedSectors      uint16     // ReservedSectors is number of reserved sectors
 	fatCount             uint8      // FatCount is total number of FAT tables in the filesystem
@@ -26,10 +26,10 @@ func dos20BPBFromBytes(b []byte) (*dos20BPB, error) {
 	bpb := dos20BPB{}
 	// make sure we have a valid sector size
 	sectorSize := binary.LittleEndian.Uint16(b[0:2])
-	if sectorSize != uint16(SectorSize512) {
-		return nil, fmt.Errorf("invalid sector size %d provided in DOS 2.0 BPB. Must be %d", sectorSize, SectorSize512)
+	if _, err := validateSectorSize(int64(sectorSize)); err != nil || sectorSize == 0 {
+		return nil, fmt.Errorf("invalid sector size %d provided in DOS 2.0 BPB. Must be one of 512, 1024, 2048 or 4096", sectorSize)
 	}
-	bpb.bytesPerSector = SectorSize512
+	bpb.bytesPerSector = SectorSize(sectorSize)
 	bpb.sectorsPerCluster = b[2]
 	bpb.reservedSectors = binary.LittleEndian.Uint16(b[3:5])
 	bpb.fatCount = b[5]
@@ -0,0 +1,101 @@
+package fat32
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// FileSystemTypeFAT12 is the fixed string representation for the FAT12 filesystem type
+	fileSystemTypeFAT12 string = "FAT12   "
+	// FileSystemTypeFAT16 is the fixed string representation for the FAT16 filesystem type
+	fileSystemTypeFAT16 string = "FAT16   "
+)
+
+/*
+FAT12 and FAT16 use the DOS 4.0 EBPB, which is the DOS 3.31 BPB followed directly by the drive number, flags,
+signature, serial number, label and filesystem type. These are the same fields as at the end of the DOS 7.1 EBPB,
+without the FAT32-only fields before them, so both are held in a dos71EBPB, with the FAT32-only fields left at 0.
+The sectors per FAT are in the embedded DOS 2.0 BPB, which is always 0 for FAT32, and is how the two are told apart.
+*/
+
+// dos40EBPBFromBytes reads the FAT12 or FAT16 DOS 4.0 Extended BIOS Parameter Block from a slice of bytes,
+// which must be 32 or 51 bytes long for the short and long formats
+func dos40EBPBFromBytes(b []byte) (*dos71EBPB, int, error) {
+	if b == nil || (len(b) != 32 && len(b) != 51) {
+		return nil, 0, errors.New("cannot read DOS 4.0 EBPB from invalid byte slice, must be precisely 32 or 51 bytes ")
+	}
+	bpb := dos71EBPB{}
+	size := 0
+
+	// extract the embedded DOS 3.31 BPB
+	dos331bpb, err := dos331BPBFromBytes(b[0:25])
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read embedded DOS 3.31 BPB: %v", err)
+	}
+	bpb.dos331BPB = dos331bpb
+
+	bpb.driveNumber = b[25]
+	bpb.reservedFlags = b[26]
+	extendedSignature := b[27]
+	bpb.extendedBootSignature = extendedSignature
+	bpb.volumeSerialNumber = binary.BigEndian.Uint32(b[28:32])
+
+	switch extendedSignature {
+	case shortDos71EBPB:
+		size = 32
+	case longDos71EBPB:
+		if len(b) < 51 {
+			return nil, 0, errors.New("cannot read long DOS 4.0 EBPB from fewer than 51 bytes")
+		}
+		size = 51
+		// remove padding from each
+		re := regexp.MustCompile(" +$")
+		bpb.volumeLabel = re.ReplaceAllString(string(b[32:43]), "")
+		bpb.fileSystemType = re.ReplaceAllString(string(b[43:51]), "")
+	default:
+		return nil, size, fmt.Errorf("unknown DOS 4.0 EBPB Signature: %v", extendedSignature)
+	}
+
+	return &bpb, size, nil
+}
+
+// dos40Bytes returns the FAT12 or FAT16 DOS 4.0 Extended BIOS Parameter Block in a slice of bytes
+// directly ready to write to disk
+func (bpb *dos71EBPB) dos40Bytes() ([]byte, error) {
+	var b []byte
+	switch bpb.extendedBootSignature {
+	case shortDos71EBPB:
+		b = make([]byte, 32)
+	case longDos71EBPB:
+		b = make([]byte, 51)
+		label := bpb.volumeLabel
+		if len(label) > 11 {
+			return nil, fmt.Errorf("invalid volume label: too long at %d characters, maximum is %d", len(label), 11)
+		}
+		if len(label) != len([]rune(label)) {
+			return nil, fmt.Errorf("invalid volume label: non-ascii characters")
+		}
+		// pad with 0x20 = " "
+		copy(b[32:43], fmt.Sprintf("%-11s", label))
+		fstype := bpb.fileSystemType
+		if len(fstype) > 8 {
+			return nil, fmt.Errorf("invalid filesystem type: too long at %d characters, maximum is %d", len(fstype), 8)
+		}
+		if len(fstype) != len([]rune(fstype)) {
+			return nil, fmt.Errorf("invalid filesystem type: non-ascii characters")
+		}
+		copy(b[43:51], fmt.Sprintf("%-8s", fstype))
+	default:
+		return nil, fmt.Errorf("unknown DOS 4.0 EBPB Signature: %v", bpb.extendedBootSignature)
+	}
+	copy(b[0:25], bpb.dos331BPB.toBytes())
+	b[25] = bpb.driveNumber
+	b[26] = bpb.reservedFlags
+	b[27] = bpb.extendedBootSignature
+	binary.BigEndian.PutUint32(b[28:32], bpb.volumeSerialNumber)
+
+	return b, nil
+}
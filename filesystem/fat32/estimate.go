@@ -0,0 +1,85 @@
+package fat32
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// EstimateSize returns the size in bytes of the smallest filesystem, as laid out by Create, that can hold
+// everything in the manifest. This includes the reserved sectors, both allocation tables and the clusters
+// for every directory, but leaves no free space, so add some if anything more is to be written later.
+//
+// FAT32 cannot hold symlinks, so a manifest with any returns an error.
+func EstimateSize(m filesystem.Manifest) (int64, error) {
+	dirs := m.Directories()
+	// the cluster size depends on the size of the filesystem, so try each in turn, smallest first
+	var lowest int64
+	for _, row := range fat32ClusterSizes {
+		upper := row.upTo
+		sectorsPerCluster, _ := clusterLayout(upper, SectorSize512, 0)
+		clusters, err := clustersForManifest(dirs, int64(sectorsPerCluster)*int64(SectorSize512))
+		if err != nil {
+			return 0, err
+		}
+		// start from the data and tables, and grow until the layout is big enough
+		sectors := int64(fat32ReservedSectors) + int64(clusters)*int64(sectorsPerCluster) + 2*(int64(clusters)+2+127)/128
+		size := max(sectors*int64(SectorSize512), lowest+int64(SectorSize512))
+		for size <= upper && usableClusters(size) < clusters {
+			size += int64(sectorsPerCluster) * int64(SectorSize512)
+		}
+		if size <= upper {
+			return size, nil
+		}
+		lowest = upper
+	}
+	return 0, fmt.Errorf("manifest does not fit in the maximum FAT32 size %d", Fat32MaxSize)
+}
+
+// usableClusters the number of data clusters that can be allocated in a filesystem of size bytes
+func usableClusters(size int64) uint32 {
+	sectorsPerCluster, sectorsPerFat := clusterLayout(size, SectorSize512, 0)
+	totalSectors := uint32(size / int64(SectorSize512))
+	dataStart := fat32ReservedSectors + 2*sectorsPerFat
+	if totalSectors <= dataStart || sectorsPerFat == 0 {
+		return 0
+	}
+	// clusters 0 and 1 are reserved, and allocation stops short of the last entry in the table
+	tableClusters := sectorsPerFat*128 - 2
+	return min(tableClusters, (totalSectors-dataStart)/uint32(sectorsPerCluster))
+}
+
+// clustersForManifest the number of clusters needed for every file and directory in the manifest
+func clustersForManifest(dirs map[string][]filesystem.ManifestEntry, bytesPerCluster int64) (uint32, error) {
+	var clusters int64
+	for dir, entries := range dirs {
+		// the root directory has the volume label, all others have the . and .. entries
+		slots := 2
+		if dir == "/" {
+			slots = 1
+		}
+		for _, e := range entries {
+			if e.Mode&os.ModeSymlink != 0 {
+				return 0, fmt.Errorf("cannot store symlink %s in FAT32: %w", e.Path, filesystem.ErrNotSupported)
+			}
+			name := path.Base(e.Path)
+			slots++
+			if _, _, isLFN, _ := convertLfnSfn(name, CodePage437); isLFN {
+				slots += calculateSlots(name)
+			}
+			if e.Mode.IsDir() {
+				continue
+			}
+			// every file gets at least one cluster, even when empty
+			clusters += max(1, (e.Size+bytesPerCluster-1)/bytesPerCluster)
+		}
+		// directory entries are always followed by at least one empty slot, which may take another cluster
+		clusters += int64(slots*bytesPerSlot)/bytesPerCluster + 1
+	}
+	if clusters > int64(^uint32(0)) {
+		return 0, fmt.Errorf("manifest needs %d clusters, more than FAT32 can address", clusters)
+	}
+	return uint32(clusters), nil
+}
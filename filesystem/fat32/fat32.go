@@ -1,8 +1,10 @@
 package fat32
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/bits"
 	"os"
 	"path"
 	"strings"
@@ -38,10 +40,22 @@ const (
 type SectorSize uint16
 
 const (
-	// SectorSize512 is a sector size of 512 bytes, used as the logical size for all FAT filesystems
-	SectorSize512        SectorSize = 512
-	bytesPerSlot         int        = 32
-	maxCharsLongFilename int        = 13
+	// SectorSize512 is a sector size of 512 bytes, the default logical size for FAT filesystems
+	SectorSize512 SectorSize = 512
+	// SectorSize1024 is a sector size of 1024 bytes, used by some magneto-optical drives
+	SectorSize1024 SectorSize = 1024
+	// SectorSize2048 is a sector size of 2048 bytes, used by some magneto-optical drives and SD cards
+	SectorSize2048 SectorSize = 2048
+	// SectorSize4096 is a sector size of 4096 bytes, used by 4Kn disks
+	SectorSize4096 SectorSize = 4096
+)
+
+const (
+	bytesPerSlot         int    = 32
+	maxCharsLongFilename int    = 13
+	fat32ReservedSectors uint32 = 32
+	fat16ReservedSectors uint32 = 1
+	fat16RootDirEntries  uint16 = 512
 )
 
 //nolint:deadcode,varcheck,unused // we need these references in the future
@@ -50,6 +64,78 @@ const (
 	maxClusterSize int = 65529
 )
 
+// fat32ClusterSizes the cluster size in bytes that Microsoft's format uses for a FAT32 volume of up to each size,
+// as in https://support.microsoft.com/kb/140365
+var fat32ClusterSizes = []struct{ upTo, clusterSize int64 }{
+	{64 * MB, 512},
+	{128 * MB, 1 * KB},
+	{256 * MB, 2 * KB},
+	{8 * GB, 4 * KB},
+	{16 * GB, 8 * KB},
+	{32 * GB, 16 * KB},
+	{Fat32MaxSize, 32 * KB},
+}
+
+// fat16ClusterSizes the cluster size in bytes that Microsoft's format uses for a FAT16 volume of up to each size,
+// from the same table. A volume too small for the cluster size gets smaller clusters, down to a single sector.
+var fat16ClusterSizes = []struct{ upTo, clusterSize int64 }{
+	{32 * MB, 512},
+	{64 * MB, 1 * KB},
+	{128 * MB, 2 * KB},
+	{256 * MB, 4 * KB},
+	{512 * MB, 8 * KB},
+	{1 * GB, 16 * KB},
+	{2 * GB, 32 * KB},
+	{4 * GB, 64 * KB},
+}
+
+// defaultClusterSize the cluster size from table for a volume of size bytes, or that of the largest volumes
+func defaultClusterSize(table []struct{ upTo, clusterSize int64 }, size int64) int64 {
+	for _, row := range table {
+		if size <= row.upTo {
+			return row.clusterSize
+		}
+	}
+	return table[len(table)-1].clusterSize
+}
+
+// Params optional parameters for creating a filesystem with CreateWithParams
+type Params struct {
+	// VolumeLabel the label of the volume, up to 11 characters
+	VolumeLabel string
+	// FatType the variant of FAT; if 0, it is the one that FatTypeForSize picks for the size
+	FatType FatType
+	// ClusterSize the size of a cluster in bytes, which must be a power of 2 multiple of the sector size of up
+	// to 64KB. If 0, it is the size that Microsoft's format picks for the size of the volume.
+	ClusterSize int64
+	// Progress if set, is called as the FATs are written, which is most of the time it takes to create a large
+	// filesystem, with how many of their bytes have been written so far, and how many there are in all
+	Progress func(written, total int64)
+}
+
+// Info the geometry of a filesystem, as chosen when it was created
+type Info struct {
+	FatType         FatType
+	SectorSize      int64 // bytes per sector
+	ClusterSize     int64 // bytes per cluster
+	ReservedSectors int   // sectors before the first FAT
+	FatCount        int   // copies of the FAT
+	SectorsPerFat   int   // sectors in each FAT
+	RootDirEntries  int   // entries in the fixed root directory of FAT12 and FAT16, 0 for FAT32
+	DataStart       int64 // offset in bytes of the first cluster from the start of the filesystem
+	Clusters        int   // data clusters
+}
+
+// String describe the geometry in a single line, as for a log
+func (i Info) String() string {
+	s := fmt.Sprintf("%s, %d clusters of %d bytes, %d-byte sectors, %d reserved sectors, %d FATs of %d sectors",
+		i.FatType, i.Clusters, i.ClusterSize, i.SectorSize, i.ReservedSectors, i.FatCount, i.SectorsPerFat)
+	if i.RootDirEntries > 0 {
+		s += fmt.Sprintf(", %d root directory entries", i.RootDirEntries)
+	}
+	return s
+}
+
 // FileSystem implememnts the FileSystem interface
 type FileSystem struct {
 	bootSector      msDosBootSector
@@ -60,6 +146,21 @@ type FileSystem struct {
 	size            int64
 	start           int64
 	backend         backend.Storage
+	// dirty whether FAT[1] on disk says the filesystem was not cleanly closed
+	dirty bool
+	// dirtyWhenRead whether the filesystem already was not cleanly closed when it was read, so should stay marked
+	// as such for a filesystem check
+	dirtyWhenRead bool
+	// modified whether anything was written since the filesystem was read, created or last closed
+	modified bool
+	// fatsDiffer whether the copies of the FAT on disk differ, as after a crash between writing one and the other
+	fatsDiffer bool
+	// codePage the OEM code page of the short names; the zero value is CodePage437
+	codePage CodePage
+	// normalization how long names are normalized when written and looked up, see SetNameNormalization
+	normalization filesystem.NameNormalization
+	// tracer called after each operation, if set, see SetTracer
+	tracer Tracer
 }
 
 // Equal compare if two filesystems are equal
@@ -91,12 +192,56 @@ func (fs *FileSystem) Equal(a *FileSystem) bool {
 // which allow you to work directly with partitions, rather than having to calculate (and hopefully not make any errors)
 // where a partition starts and ends.
 //
-// If the provided blocksize is 0, it will use the default of 512 bytes. If it is any number other than 0
-// or 512, it will return an error.
+// The blocksize is the size of the logical sectors of the filesystem, which should match the logical
+// sector size of the disk: 512, 1024, 2048 or 4096 bytes. If it is 0, it will use the default of 512 bytes.
+// If it is any other number, it will return an error.
+//
+// Create always makes a FAT32 filesystem, whatever its size. Use CreateWithType for FAT12 or FAT16.
 func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string) (*FileSystem, error) {
-	// blocksize must be <=0 or exactly SectorSize512 or error
-	if blocksize != int64(SectorSize512) && blocksize > 0 {
-		return nil, fmt.Errorf("blocksize for FAT32 must be either 512 bytes or 0, not %d", blocksize)
+	return CreateWithType(b, size, start, blocksize, volumeLabel, FatType32)
+}
+
+// CreateWithType creates a FAT12, FAT16 or FAT32 filesystem in a given file or device, with the same arguments as
+// Create. If fatType is 0, it uses the type that FatTypeForSize picks for size, as Microsoft's format does.
+//
+// FAT12 and FAT16 have a fixed root directory of 512 entries between the tables and the data, and one reserved sector.
+// Their clusters are the smallest that keep the count of clusters within the limits of the type, which is what
+// identifies the type on disk, so it returns an error if size is too small or too large for fatType.
+// Remember to use the matching MBR partition type, from FatType.MBRType, when the filesystem is in a partition.
+func CreateWithType(b backend.Storage, size, start, blocksize int64, volumeLabel string, fatType FatType) (*FileSystem, error) {
+	return CreateWithParams(b, size, start, blocksize, &Params{VolumeLabel: volumeLabel, FatType: fatType})
+}
+
+// CreateWithParams creates a FAT12, FAT16 or FAT32 filesystem in a given file or device, with the same arguments as
+// Create, and the optional parameters in p, which may be nil.
+//
+// Unless p sets the cluster size, it is the one that Microsoft's format picks for the size of the volume: for FAT32,
+// from 512 bytes up to 64MB, to 32KB over 32GB; for FAT16, from 512 bytes up to 32MB, to 64KB over 2GB, or smaller
+// if the volume is too small to be FAT16 with that size; and for FAT12, the smallest that fits. Info reports the
+// geometry that was chosen.
+func CreateWithParams(b backend.Storage, size, start, blocksize int64, p *Params) (*FileSystem, error) {
+	return CreateContext(context.Background(), b, size, start, blocksize, p)
+}
+
+// CreateContext creates a filesystem as CreateWithParams does, stopping with an error wrapping ctx.Err() if ctx is
+// done before it is finished, which for a filesystem of hundreds of GB, with FATs of hundreds of MB, can take a
+// while. A filesystem that was not finished is not valid, and must be created again.
+func CreateContext(ctx context.Context, b backend.Storage, size, start, blocksize int64, p *Params) (*FileSystem, error) {
+	if p == nil {
+		p = &Params{}
+	}
+	volumeLabel, fatType, clusterSize := p.VolumeLabel, p.FatType, p.ClusterSize
+	if fatType == 0 {
+		fatType = FatTypeForSize(size)
+	}
+	switch fatType {
+	case FatType12, FatType16, FatType32:
+	default:
+		return nil, fmt.Errorf("invalid FAT type %d, must be 0, 12, 16 or 32", fatType)
+	}
+	sectorSize, err := validateSectorSize(blocksize)
+	if err != nil {
+		return nil, err
 	}
 	if size > Fat32MaxSize {
 		return nil, fmt.Errorf("requested size is larger than maximum allowed FAT32, requested %d, maximum %d", size, Fat32MaxSize)
@@ -104,6 +249,13 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 	if size < blocksize*4 {
 		return nil, fmt.Errorf("requested size is smaller than minimum allowed FAT32, requested %d minimum %d", size, blocksize*4)
 	}
+	blocksize = int64(sectorSize)
+	if clusterSize != 0 {
+		sectors := clusterSize / blocksize
+		if clusterSize < blocksize || clusterSize%blocksize != 0 || sectors&(sectors-1) != 0 || clusterSize > 64*KB {
+			return nil, fmt.Errorf("invalid cluster size %d, must be a power of 2 multiple of the sector size %d of up to %d", clusterSize, blocksize, 64*KB)
+		}
+	}
 	// FAT filesystems use time-of-day of creation as a volume ID
 	now := time.Now()
 	// because we like the fudges other people did for uniqueness
@@ -120,8 +272,8 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 	/*
 		size calculations
 		we have the total size of the disk from `size uint64`
-		we have the blocksize fixed at SectorSize512
-		    so we can calculate diskSectors = size/512
+		we have the blocksize, which is the sector size, e.g. SectorSize512
+		    so we can calculate diskSectors = size/sectorSize
 		we know the number of reserved sectors is 32
 		so the number of non-reserved sectors: data + FAT = diskSectos - 32
 		now we need to figure out cluster size. The allowed number of:
@@ -134,45 +286,62 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 		       a potential 268,435,444 pointer entries
 		    the maximum size of a disk for FAT32 is 16 sectors per cluster = 8KB/cluster * 268435444 = ~2TB
 
-		Follow Microsoft's `format` commad as per http://www.win.tue.nl/~aeb/linux/fs/fat/fatgen103.pdf p. 20.
-		Thanks to github.com/dosfstools/dosfstools for the link
+		Follow Microsoft's `format` command, as in its table of default cluster sizes at
+		https://support.microsoft.com/kb/140365, in fat32ClusterSizes, unless the cluster size is given.
 		Filesystem size / cluster size
-		   <= 260M      /   1 sector =   512 bytes
-			 <=   8G      /   8 sector =  4096 bytes
-			 <=  16G      /  32 sector = 16384 bytes
-			 <=  32G      /  64 sector = 32768 bytes
-			  >  32G      / 128 sector = 65536 bytes
+		   <=  64M      /   512 bytes
+		   <= 128M      /  1024 bytes
+		   <= 256M      /  2048 bytes
+		   <=   8G      /  4096 bytes
+		   <=  16G      /  8192 bytes
+		   <=  32G      / 16384 bytes
+		    >  32G      / 32768 bytes
+		The table is in bytes, so for larger sectors we keep the same cluster size in bytes,
+		but never less than a single sector.
 	*/
 
-	var sectorsPerCluster uint8
-	switch {
-	case size <= 260*MB:
-		sectorsPerCluster = 1
-	case size <= 8*GB:
-		sectorsPerCluster = 8
-	case size <= 16*GB:
-		sectorsPerCluster = 32
-	case size <= 32*GB:
-		sectorsPerCluster = 64
-	case size <= Fat32MaxSize:
-		sectorsPerCluster = 128
-	}
-
 	// stick with uint32 and round down
-	totalSectors := uint32(size / int64(SectorSize512))
-	reservedSectors := uint16(32)
-	dataSectors := totalSectors - uint32(reservedSectors)
-	totalClusters := dataSectors / uint32(sectorsPerCluster)
-	// FAT uses 4 bytes per cluster pointer
-	//   so a 512 byte sector can store 512/4 = 128 pointer entries
-	//   therefore sectors per FAT = totalClusters / 128
-	sectorsPerFat := uint16(totalClusters / 128)
+	totalSectors := uint32(size / blocksize)
+
+	var (
+		sectorsPerCluster uint8
+		sectorsPerFat     uint32
+		reservedSectors   uint16
+		rootDirEntries    uint16
+		dataClusters      uint32
+	)
+	if fatType == FatType32 {
+		if clusterSize != 0 && size/clusterSize > 0x0ffffff5 {
+			return nil, fmt.Errorf("requested size %d cannot be laid out as %s with clusters of %d bytes, which would be too many", size, fatType, clusterSize)
+		}
+		sectorsPerCluster, sectorsPerFat = clusterLayout(size, sectorSize, clusterSize)
+		reservedSectors = uint16(fat32ReservedSectors)
+	} else {
+		reservedSectors = uint16(fat16ReservedSectors)
+		rootDirEntries = fat16RootDirEntries
+		sectorsPerCluster, sectorsPerFat, dataClusters, err = smallFatLayout(totalSectors, sectorSize, fatType, clusterSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rootDirSectors := rootDirSectorCount(rootDirEntries, sectorSize)
 
 	// what is our FAT ID / Media Type?
 	mediaType := uint8(MediaFixedDisk)
 
-	fatIDbase := uint32(0x0f << 24)
-	fatID := fatIDbase + 0xffff00 + uint32(mediaType)
+	var fatID, eocMarker uint32
+	switch fatType {
+	case FatType12:
+		fatID = 0xf00 + uint32(mediaType)
+		eocMarker = 0xfff
+	case FatType16:
+		fatID = 0xff00 + uint32(mediaType)
+		eocMarker = 0xffff
+	default:
+		fatIDbase := uint32(0x0f << 24)
+		fatID = fatIDbase + 0xffff00 + uint32(mediaType)
+		eocMarker = 0x0fffffff
+	}
 
 	// we need an Extended BIOS Parameter Block
 	dos20bpb := dos20BPB{
@@ -181,8 +350,8 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 		fatCount:             2,
 		totalSectors:         0,
 		mediaType:            mediaType,
-		bytesPerSector:       SectorSize512,
-		rootDirectoryEntries: 0,
+		bytesPerSector:       sectorSize,
+		rootDirectoryEntries: rootDirEntries,
 		sectorsPerFat:        0,
 	}
 
@@ -209,33 +378,68 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 		mirrorFlags:           0,
 		reservedFlags:         0,
 		driveNumber:           128,
-		sectorsPerFat:         uint32(sectorsPerFat),
+		sectorsPerFat:         sectorsPerFat,
+	}
+	if fatType != FatType32 {
+		// FAT12 and FAT16 have the sectors per FAT in the DOS 2.0 BPB, and none of the FAT32-only fields
+		dos20bpb.sectorsPerFat = uint16(sectorsPerFat)
+		if totalSectors < 1<<16 {
+			dos20bpb.totalSectors = uint16(totalSectors)
+			dos331bpb.totalSectors = 0
+		}
+		ebpb = dos71EBPB{
+			dos331BPB:             &dos331bpb,
+			extendedBootSignature: longDos71EBPB,
+			volumeSerialNumber:    volid,
+			volumeLabel:           "NO NAME    ",
+			fileSystemType:        fileSystemTypeFAT16,
+			driveNumber:           128,
+		}
+		if fatType == FatType12 {
+			ebpb.fileSystemType = fileSystemTypeFAT12
+		}
+	}
+	// the boot code follows the EBPB, which is shorter for FAT12 and FAT16
+	jumpInstruction := [3]byte{0xeb, 0x58, 0x90}
+	if fatType != FatType32 {
+		jumpInstruction = [3]byte{0xeb, 0x3c, 0x90}
 	}
 	// we need a new boot sector
 	bs := msDosBootSector{
 		oemName:            "godiskfs",
-		jumpInstruction:    [3]byte{0xeb, 0x58, 0x90},
+		jumpInstruction:    jumpInstruction,
 		bootCode:           []byte{},
 		biosParameterBlock: &ebpb,
 	}
 
 	// create and allocate FAT32 FSInformationSector
-	fsis := FSInformationSector{
-		lastAllocatedCluster:  0xffffffff,
-		freeDataClustersCount: 0xffffffff,
+	var fsis FSInformationSector
+	if fatType == FatType32 {
+		fsis = FSInformationSector{
+			lastAllocatedCluster:  0xffffffff,
+			freeDataClustersCount: 0xffffffff,
+		}
 	}
 
 	// create and allocate the FAT tables
-	eocMarker := uint32(0x0fffffff)
 	unusedMarker := uint32(0x00000000)
-	fatPrimaryStart := reservedSectors * uint16(SectorSize512)
-	fatSize := uint32(sectorsPerFat) * uint32(SectorSize512)
+	fatPrimaryStart := uint32(reservedSectors) * uint32(sectorSize)
+	fatSize := sectorsPerFat * uint32(sectorSize)
 	fatSecondaryStart := uint64(fatPrimaryStart) + uint64(fatSize)
 	maxCluster := fatSize / 4
-	rootDirCluster := uint32(2)
+	// the root directory of FAT12 and FAT16 is not in a cluster, and is referred to as cluster 0
+	rootDirCluster := uint32(0)
+	if fatType == FatType32 {
+		rootDirCluster = 2
+	} else {
+		maxCluster = dataClusters + 2
+	}
 	clusters := make([]uint32, maxCluster+1)
-	clusters[rootDirCluster] = eocMarker
+	if rootDirCluster != 0 {
+		clusters[rootDirCluster] = eocMarker
+	}
 	fat := table{
+		fatType:        fatType,
 		fatID:          fatID,
 		eocMarker:      eocMarker,
 		unusedMarker:   unusedMarker,
@@ -246,7 +450,7 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 	}
 
 	// where does our data start?
-	dataStart := uint32(fatSecondaryStart) + fatSize
+	dataStart := uint32(fatSecondaryStart) + fatSize + rootDirSectors*uint32(sectorSize)
 
 	// create the filesystem
 	fs := &FileSystem{
@@ -254,7 +458,7 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 		fsis:            fsis,
 		table:           fat,
 		dataStart:       dataStart,
-		bytesPerCluster: int(sectorsPerCluster) * int(SectorSize512),
+		bytesPerCluster: int(sectorsPerCluster) * int(sectorSize),
 		start:           start,
 		size:            size,
 		backend:         b,
@@ -271,22 +475,26 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 	}
 
 	// write the FAT tables
-	if err := fs.writeFat(); err != nil {
+	if err := fs.writeFatContext(ctx, p.Progress); err != nil {
 		return nil, fmt.Errorf("failed to write the file allocation table: %w", err)
 	}
 
 	// create root directory
-	// be sure to zero out the root cluster, so we do not pick up phantom
-	// entries.
+	// be sure to zero out the root cluster, or the fixed root directory of FAT12 and FAT16,
+	// so we do not pick up phantom entries.
 	clusterStart := fs.start + int64(fs.dataStart)
 	// length of cluster in bytes
 	tmpb := make([]byte, fs.bytesPerCluster)
+	if offset, rootSize := fs.rootDirRegion(); rootSize > 0 {
+		clusterStart = fs.start + offset
+		tmpb = make([]byte, rootSize)
+	}
 	// zero out the root directory cluster
 	written, err := writableFile.WriteAt(tmpb, clusterStart)
 	if err != nil {
 		return nil, fmt.Errorf("failed to zero out root directory: %w", err)
 	}
-	if written != len(tmpb) || written != fs.bytesPerCluster {
+	if written != len(tmpb) {
 		return nil, fmt.Errorf("incomplete zero out of root directory, wrote %d bytes instead of expected %d for cluster size %d", written, len(tmpb), fs.bytesPerCluster)
 	}
 
@@ -310,9 +518,113 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 		return nil, fmt.Errorf("failed to set volume label to '%s': %w", volumeLabel, err)
 	}
 
+	// a new filesystem is cleanly closed, until it is first written to
+	if err := fs.Close(); err != nil {
+		return nil, fmt.Errorf("failed to mark the filesystem as cleanly closed: %w", err)
+	}
+
 	return fs, nil
 }
 
+// clusterLayout the sectors per cluster and sectors per FAT that Create uses for a FAT32 filesystem of size bytes
+// with sectors of sectorSize bytes, and clusters of clusterSize bytes, or the default for the size if it is 0
+func clusterLayout(size int64, sectorSize SectorSize, clusterSize int64) (sectorsPerCluster uint8, sectorsPerFat uint32) {
+	if clusterSize == 0 {
+		clusterSize = defaultClusterSize(fat32ClusterSizes, size)
+	}
+	sectorsPerCluster = uint8(max(1, clusterSize/int64(sectorSize)))
+
+	// stick with uint32 and round down
+	totalSectors := uint32(size / int64(sectorSize))
+	dataSectors := totalSectors - fat32ReservedSectors
+	totalClusters := dataSectors / uint32(sectorsPerCluster)
+	// FAT uses 4 bytes per cluster pointer
+	//   so a 512 byte sector can store 512/4 = 128 pointer entries
+	//   therefore sectors per FAT = totalClusters / (sectorSize/4)
+	sectorsPerFat = totalClusters / (uint32(sectorSize) / 4)
+	return sectorsPerCluster, sectorsPerFat
+}
+
+// smallFatLayout the sectors per cluster, sectors per FAT and count of data clusters that CreateWithType uses for a
+// FAT12 or FAT16 filesystem of totalSectors sectors of sectorSize bytes, with clusters of clusterSize bytes if it is
+// not 0. Otherwise they are the smallest that keep the count of clusters within the limits of fatType, and for FAT16,
+// no smaller than those of Microsoft's format.
+func smallFatLayout(totalSectors uint32, sectorSize SectorSize, fatType FatType, clusterSize int64) (sectorsPerCluster uint8, sectorsPerFat uint32, clusters uint32, err error) {
+	overhead := fat16ReservedSectors + rootDirSectorCount(fat16RootDirEntries, sectorSize)
+	if totalSectors <= overhead {
+		return 0, 0, 0, fmt.Errorf("requested size is too small for %s, needs more than %d sectors", fatType, overhead)
+	}
+	first, last := uint32(1), uint32(128)
+	switch {
+	case clusterSize != 0:
+		first = uint32(clusterSize / int64(sectorSize))
+		last = first
+	case fatType == FatType16:
+		first = uint32(max(1, defaultClusterSize(fat16ClusterSizes, int64(totalSectors)*int64(sectorSize))/int64(sectorSize)))
+	}
+	for spc := first; spc <= last && int64(spc)*int64(sectorSize) <= 64*KB; spc *= 2 {
+		// size the tables for the clusters there would be without them, which leaves them large enough
+		estimate := (totalSectors - overhead) / spc
+		fatBytes := (estimate + 2) * 2
+		if fatType == FatType12 {
+			fatBytes = ((estimate+2)*3 + 1) / 2
+		}
+		spf := (fatBytes + uint32(sectorSize) - 1) / uint32(sectorSize)
+		if totalSectors <= overhead+2*spf {
+			break
+		}
+		clusters = (totalSectors - overhead - 2*spf) / spc
+		if fatTypeForClusters(clusters) != fatType {
+			// larger clusters only make fewer of them
+			if fatType == FatType16 && clusters <= fat12MaxClusters {
+				break
+			}
+			continue
+		}
+		if clusters > fat16MaxClusters {
+			continue
+		}
+		return uint8(spc), spf, clusters, nil
+	}
+	if clusterSize != 0 {
+		return 0, 0, 0, fmt.Errorf("requested size of %d sectors cannot be laid out as %s with clusters of %d bytes", totalSectors, fatType, clusterSize)
+	}
+	return 0, 0, 0, fmt.Errorf("requested size of %d sectors cannot be laid out as %s", totalSectors, fatType)
+}
+
+// rootDirSectorCount the sectors taken by a fixed root directory with entries entries
+func rootDirSectorCount(entries uint16, sectorSize SectorSize) uint32 {
+	return (uint32(entries)*uint32(bytesPerSlot) + uint32(sectorSize) - 1) / uint32(sectorSize)
+}
+
+// rootDirRegion the offset from the start of the filesystem and the size in bytes of the fixed root directory of
+// FAT12 and FAT16, which is between the tables and the data; the size is 0 for FAT32, which has it in a cluster
+func (fs *FileSystem) rootDirRegion() (offset, size int64) {
+	if fs.table.entryBits() == 32 {
+		return 0, 0
+	}
+	entries := fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.rootDirectoryEntries
+	sectors := int64(rootDirSectorCount(entries, SectorSize(fs.sectorSize())))
+	return int64(fs.dataStart) - sectors*fs.sectorSize(), int64(entries) * int64(bytesPerSlot)
+}
+
+// validateSectorSize check that blocksize is a sector size FAT supports, returning the default of 512 for 0
+func validateSectorSize(blocksize int64) (SectorSize, error) {
+	switch blocksize {
+	case 0:
+		return SectorSize512, nil
+	case int64(SectorSize512), int64(SectorSize1024), int64(SectorSize2048), int64(SectorSize4096):
+		return SectorSize(blocksize), nil
+	default:
+		return 0, fmt.Errorf("blocksize for FAT32 must be 0 or one of 512, 1024, 2048 or 4096 bytes, not %d", blocksize)
+	}
+}
+
+// sectorSize the size in bytes of the logical sectors of the filesystem
+func (fs *FileSystem) sectorSize() int64 {
+	return int64(fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.bytesPerSector)
+}
+
 // Read reads a filesystem from a given disk.
 //
 // requires the backend.Storage where to read the filesystem, size is the size of the filesystem in bytes,
@@ -327,12 +639,15 @@ func Create(b backend.Storage, size, start, blocksize int64, volumeLabel string)
 // which allow you to work directly with partitions, rather than having to calculate (and hopefully not make any errors)
 // where a partition starts and ends.
 //
-// If the provided blocksize is 0, it will use the default of 512 bytes. If it is any number other than 0
-// or 512, it will return an error.
+// The blocksize must be 0 or one of the sector sizes that Create accepts, else it will return an error.
+// The filesystem is always read with the sector size in its boot sector, which need not match the blocksize,
+// e.g. an image with 2048-byte sectors in a file opened with the default of 512.
+//
+// Read handles FAT12 and FAT16 as well as FAT32, telling them apart as every FAT driver does, and FatType
+// reports which it found.
 func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error) {
-	// blocksize must be <=0 or exactly SectorSize512 or error
-	if blocksize != int64(SectorSize512) && blocksize > 0 {
-		return nil, fmt.Errorf("blocksize for FAT32 must be either 512 bytes or 0, not %d", blocksize)
+	if _, err := validateSectorSize(blocksize); err != nil {
+		return nil, err
 	}
 	if size > Fat32MaxSize {
 		return nil, fmt.Errorf("requested size is larger than maximum allowed FAT32 size %d", Fat32MaxSize)
@@ -341,7 +656,7 @@ func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error)
 		return nil, fmt.Errorf("requested size is smaller than minimum allowed FAT32 size %d", blocksize*4)
 	}
 	// load the information from the disk
-	// read first 512 bytes from the file
+	// read first 512 bytes from the file, which hold the boot sector whatever the size of the sectors
 	bsb := make([]byte, SectorSize512)
 	n, err := b.ReadAt(bsb, start)
 	if err != nil {
@@ -356,47 +671,90 @@ func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error)
 		return nil, fmt.Errorf("error reading MS-DOS Boot Sector: %w", err)
 	}
 
+	dos20bpb := bs.biosParameterBlock.dos331BPB.dos20BPB
+	sectorSize := dos20bpb.bytesPerSector
 	sectorsPerFat := bs.biosParameterBlock.sectorsPerFat
-	fatSize := sectorsPerFat * uint32(SectorSize512)
-	reservedSectors := bs.biosParameterBlock.dos331BPB.dos20BPB.reservedSectors
-	sectorsPerCluster := bs.biosParameterBlock.dos331BPB.dos20BPB.sectorsPerCluster
-	fatPrimaryStart := uint64(reservedSectors) * uint64(SectorSize512)
+	reservedSectors := dos20bpb.reservedSectors
+	sectorsPerCluster := dos20bpb.sectorsPerCluster
+	rootDirSectors := rootDirSectorCount(dos20bpb.rootDirectoryEntries, sectorSize)
+
+	// only FAT12 and FAT16 have the sectors per FAT in the DOS 2.0 BPB, and which of them it is depends
+	// only on the count of data clusters
+	fatType := FatType32
+	var dataClusters uint32
+	if dos20bpb.sectorsPerFat != 0 {
+		sectorsPerFat = uint32(dos20bpb.sectorsPerFat)
+		totalSectors := uint32(dos20bpb.totalSectors)
+		if totalSectors == 0 {
+			totalSectors = bs.biosParameterBlock.dos331BPB.totalSectors
+		}
+		overhead := uint32(reservedSectors) + uint32(dos20bpb.fatCount)*sectorsPerFat + rootDirSectors
+		if totalSectors <= overhead || sectorsPerCluster == 0 {
+			return nil, fmt.Errorf("invalid FAT12/FAT16 layout: %d total sectors, with %d before the data", totalSectors, overhead)
+		}
+		dataClusters = (totalSectors - overhead) / uint32(sectorsPerCluster)
+		fatType = fatTypeForClusters(dataClusters)
+	}
+
+	fatSize := sectorsPerFat * uint32(sectorSize)
+	fatPrimaryStart := uint64(reservedSectors) * uint64(sectorSize)
 	fatSecondaryStart := fatPrimaryStart + uint64(fatSize)
 
-	fsisBytes := make([]byte, 512)
-	read, err := b.ReadAt(fsisBytes, int64(bs.biosParameterBlock.fsInformationSector)*blocksize+start)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read bytes for FSInformationSector: %w", err)
-	}
-	if read != 512 {
-		return nil, fmt.Errorf("read %d bytes instead of expected %d for FS Information Sector", read, 512)
-	}
-	fsis, err := fsInformationSectorFromBytes(fsisBytes)
-	if err != nil {
-		return nil, fmt.Errorf("error reading FileSystem Information Sector: %w", err)
+	// FAT12 and FAT16 have no FS Information Sector
+	var fsis FSInformationSector
+	if fatType == FatType32 {
+		// the FS Information Sector is 512 bytes at the start of its sector, whatever the size of the sectors
+		fsisBytes := make([]byte, 512)
+		read, err := b.ReadAt(fsisBytes, int64(bs.biosParameterBlock.fsInformationSector)*int64(sectorSize)+start)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bytes for FSInformationSector: %w", err)
+		}
+		if read != 512 {
+			return nil, fmt.Errorf("read %d bytes instead of expected %d for FS Information Sector", read, 512)
+		}
+		fsisRead, err := fsInformationSectorFromBytes(fsisBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error reading FileSystem Information Sector: %w", err)
+		}
+		fsis = *fsisRead
 	}
 
 	partitionTableBytes := make([]byte, fatSize)
 	_, _ = b.ReadAt(partitionTableBytes, int64(fatPrimaryStart)+start)
-	fat := tableFromBytes(partitionTableBytes)
+	fat := tableFromBytes(partitionTableBytes, fatType)
 
 	_, _ = b.ReadAt(partitionTableBytes, int64(fatSecondaryStart)+start)
-	fat2 := tableFromBytes(partitionTableBytes)
-	if !fat.equal(fat2) {
+	fat2 := tableFromBytes(partitionTableBytes, fatType)
+	if fatType != FatType32 {
+		fat.truncate(dataClusters)
+		fat2.truncate(dataClusters)
+	}
+	// a crash between writing the FAT and its copy leaves them different, so, as fsck.fat does, the first is used
+	// when either says the filesystem was not cleanly closed; FAT12 cannot say whether it was
+	fatsDiffer := !fat.equal(fat2)
+	if fatsDiffer && fat.cleanShutdownBit() != 0 && !fat.isDirty() && !fat2.isDirty() {
 		return nil, errors.New("fat tables did not match")
 	}
-	dataStart := uint32(fatSecondaryStart) + fat.size
+	dataStart := uint32(fatSecondaryStart) + fat.size + rootDirSectors*uint32(sectorSize)
 
-	return &FileSystem{
+	fs := &FileSystem{
 		bootSector:      *bs,
-		fsis:            *fsis,
+		fsis:            fsis,
 		table:           *fat,
 		dataStart:       dataStart,
-		bytesPerCluster: int(sectorsPerCluster) * int(SectorSize512),
+		bytesPerCluster: int(sectorsPerCluster) * int(sectorSize),
 		start:           start,
 		size:            size,
 		backend:         b,
-	}, nil
+		dirty:           fat.isDirty(),
+		dirtyWhenRead:   fat.isDirty(),
+		fatsDiffer:      fatsDiffer,
+	}
+	// the free cluster count is only a hint, which often is stale, so count them, and write the count on the next change
+	if fatType == FatType32 {
+		fs.fsis.freeDataClustersCount = fs.freeClusterCount()
+	}
+	return fs, nil
 }
 
 func (fs *FileSystem) writeBootSector() error {
@@ -428,7 +786,7 @@ func (fs *FileSystem) writeBootSector() error {
 
 	// write backup boot sector to the file
 	if fs.bootSector.biosParameterBlock.backupBootSector > 0 {
-		count, err = writableFile.WriteAt(b, int64(fs.bootSector.biosParameterBlock.backupBootSector)*int64(SectorSize512)+fs.start)
+		count, err = writableFile.WriteAt(b, int64(fs.bootSector.biosParameterBlock.backupBootSector)*fs.sectorSize()+fs.start)
 		if err != nil {
 			return fmt.Errorf("error writing MS-DOS Boot Sector to disk: %w", err)
 		}
@@ -443,7 +801,11 @@ func (fs *FileSystem) writeBootSector() error {
 func (fs *FileSystem) writeFsis() error {
 	fsInformationSector := fs.bootSector.biosParameterBlock.fsInformationSector
 	backupBootSector := fs.bootSector.biosParameterBlock.backupBootSector
-	fsisPrimary := int64(fsInformationSector * uint16(SectorSize512))
+	// FAT12 and FAT16 have no FS Information Sector
+	if fsInformationSector == 0 {
+		return nil
+	}
+	fsisPrimary := int64(fsInformationSector) * fs.sectorSize()
 
 	fsisBytes := fs.fsis.toBytes()
 	writableFile, err := fs.backend.Writable()
@@ -451,12 +813,12 @@ func (fs *FileSystem) writeFsis() error {
 		return err
 	}
 
-	if _, err := writableFile.WriteAt(fsisBytes, fsisPrimary+fs.start); err != nil {
+	if err := fs.traceWrite(writableFile, TraceFsisWrite, fsisBytes, fsisPrimary+fs.start, 0); err != nil {
 		return fmt.Errorf("unable to write primary Fsis: %w", err)
 	}
 
 	if backupBootSector > 0 {
-		if _, err := writableFile.WriteAt(fsisBytes, int64(backupBootSector+1)*int64(SectorSize512)+fs.start); err != nil {
+		if err := fs.traceWrite(writableFile, TraceFsisWrite, fsisBytes, int64(backupBootSector+1)*fs.sectorSize()+fs.start, 0); err != nil {
 			return fmt.Errorf("unable to write backup Fsis: %w", err)
 		}
 	}
@@ -464,41 +826,105 @@ func (fs *FileSystem) writeFsis() error {
 	return nil
 }
 
+// writeFat write both copies of the FAT
 func (fs *FileSystem) writeFat() error {
+	return fs.writeFatContext(context.Background(), nil)
+}
+
+// fatWriteChunkSize how much of a FAT is written at a time, which is a whole number of pairs of FAT12 entries, of
+// 3 bytes, and of sectors of any size, so that each part starts with a whole entry
+const fatWriteChunkSize = 3 * 1024 * 1024
+
+// writeFatContext write the primary, then the backup FAT, a part of fatWriteChunkSize at a time, so that a large
+// FAT is never all in memory as bytes. It stops if ctx is done, and calls progress, if set, after each part.
+func (fs *FileSystem) writeFatContext(ctx context.Context, progress func(written, total int64)) error {
 	reservedSectors := fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.reservedSectors
-	fatPrimaryStart := uint64(reservedSectors) * uint64(SectorSize512)
-	fatSecondaryStart := fatPrimaryStart + uint64(fs.table.size)
+	fatPrimaryStart := int64(reservedSectors) * fs.sectorSize()
+	fatSecondaryStart := fatPrimaryStart + int64(fs.table.size)
 
-	fatBytes := fs.table.bytes()
 	writableFile, err := fs.backend.Writable()
 	if err != nil {
 		return err
 	}
 
-	if _, err := writableFile.WriteAt(fatBytes, int64(fatPrimaryStart)+fs.start); err != nil {
-		return fmt.Errorf("unable to write primary FAT table: %w", err)
-	}
-
-	if _, err := writableFile.WriteAt(fatBytes, int64(fatSecondaryStart)+fs.start); err != nil {
-		return fmt.Errorf("unable to write backup FAT table: %w", err)
+	size := fs.table.size
+	total := 2 * int64(size)
+	var written int64
+	b := make([]byte, min(size, fatWriteChunkSize))
+	for _, fat := range []struct {
+		name  string
+		start int64
+	}{{"primary", fatPrimaryStart}, {"backup", fatSecondaryStart}} {
+		for off := uint32(0); off < size; off += fatWriteChunkSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			part := b[:min(size-off, fatWriteChunkSize)]
+			fs.table.bytesAt(part, off)
+			if err := fs.traceWrite(writableFile, TraceFatWrite, part, fat.start+int64(off)+fs.start, 0); err != nil {
+				return fmt.Errorf("unable to write %s FAT table: %w", fat.name, err)
+			}
+			written += int64(len(part))
+			if progress != nil {
+				progress(written, total)
+			}
+		}
 	}
+	fs.fatsDiffer = false
 
 	return nil
 }
 
 // interface guard
-var _ filesystem.FileSystem = (*FileSystem)(nil)
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
 
-// Type returns the type code for the filesystem. Always returns filesystem.TypeFat32
+// Type returns the type code for the filesystem. Always returns filesystem.TypeFat32, even for FAT12 and FAT16,
+// see FatType for which it is
 func (fs *FileSystem) Type() filesystem.Type {
 	return filesystem.TypeFat32
 }
 
+// FatType returns the variant of FAT of the filesystem
+func (fs *FileSystem) FatType() FatType {
+	return FatType(fs.table.entryBits())
+}
+
+// Info returns the geometry of the filesystem
+func (fs *FileSystem) Info() Info {
+	bpb := fs.bootSector.biosParameterBlock.dos331BPB
+	sectorsPerFat := int(bpb.dos20BPB.sectorsPerFat)
+	if sectorsPerFat == 0 {
+		sectorsPerFat = int(fs.bootSector.biosParameterBlock.sectorsPerFat)
+	}
+	return Info{
+		FatType:         fs.FatType(),
+		SectorSize:      fs.sectorSize(),
+		ClusterSize:     int64(fs.bytesPerCluster),
+		ReservedSectors: int(bpb.dos20BPB.reservedSectors),
+		FatCount:        int(bpb.dos20BPB.fatCount),
+		SectorsPerFat:   sectorsPerFat,
+		RootDirEntries:  int(bpb.dos20BPB.rootDirectoryEntries),
+		DataStart:       int64(fs.dataStart),
+		Clusters:        int(fs.dataClusters()),
+	}
+}
+
 // Mkdir make a directory at the given path. It is equivalent to `mkdir -p`, i.e. idempotent, in that:
 //
 // * It will make the entire tree path if it does not exist
 // * It will not return an error if the path already exists
+//
+// A path with a name longer than 255 characters returns an error wrapping ErrNameTooLong, and one longer
+// than 259 characters, which Windows cannot open, an error wrapping ErrPathTooLong, before anything is created.
 func (fs *FileSystem) Mkdir(p string) error {
+	if err := checkPath(p, true); err != nil {
+		return fmt.Errorf("cannot create directory %s: %w", p, err)
+	}
 	_, _, err := fs.readDirWithMkdir(p, true)
 	// we are not interesting in returning the entries
 	return err
@@ -532,6 +958,11 @@ func (fs *FileSystem) Chown(_ string, _, _ int) error {
 	return filesystem.ErrNotSupported
 }
 
+// Readlink returns the target of the named symbolic link. FAT has no symbolic links.
+func (fs *FileSystem) Readlink(_ string) (string, error) {
+	return "", filesystem.ErrNotSupported
+}
+
 // ReadDir return the contents of a given directory in a given filesystem.
 //
 // Returns a slice of os.FileInfo with all of the entries in the directory.
@@ -567,6 +998,7 @@ func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
 			shortName: shortName,
 			size:      int64(e.fileSize),
 			isDir:     e.isSubdirectory,
+			attrs:     e.attributes(),
 		})
 	}
 	return ret, nil
@@ -577,8 +1009,12 @@ func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
 //
 // accepts normal os.OpenFile flags
 //
-// returns an error if the file does not exist
+// returns an error if the file does not exist, one wrapping ErrNameTooLong if a name in p is longer than 255
+// characters, and, for a file that would be created, one wrapping ErrPathTooLong if p is longer than 259
 func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	if err := checkPath(p, false); err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", p, err)
+	}
 	// get the path
 	dir := path.Dir(p)
 	filename := path.Base(p)
@@ -592,21 +1028,13 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		return nil, fmt.Errorf("could not read directory entries for %s: %w", dir, err)
 	}
 	// we now know that the directory exists, see if the file exists
-	var targetEntry *directoryEntry
-	for _, e := range entries {
-		shortName := e.filenameShort
-		if e.fileExtension != "" {
-			shortName += "." + e.fileExtension
-		}
-		if !strings.EqualFold(e.filenameLong, filename) && !strings.EqualFold(shortName, filename) {
-			continue
-		}
-		// cannot do anything with directories
-		if e.isSubdirectory {
-			return nil, fmt.Errorf("cannot open directory %s as file", p)
-		}
-		// if we got this far, we have found the file
-		targetEntry = e
+	targetEntry, err := fs.findEntry(entries, filename, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", p, err)
+	}
+	// cannot do anything with directories
+	if targetEntry != nil && targetEntry.isSubdirectory {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
 	}
 
 	// see if the file exists
@@ -615,6 +1043,9 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		if flag&os.O_CREATE == 0 {
 			return nil, fmt.Errorf("target file %s does not exist and was not asked to create", p)
 		}
+		if err := checkPath(p, true); err != nil {
+			return nil, fmt.Errorf("cannot create %s: %w", p, err)
+		}
 		// else create it
 		targetEntry, err = fs.mkFile(parentDir, filename)
 		if err != nil {
@@ -668,28 +1099,9 @@ func (fs *FileSystem) Remove(pathname string) error {
 		return fmt.Errorf("could not read directory entries for %s", dir)
 	}
 	// we now know that the directory exists, see if the file exists
-	var targetEntry *directoryEntry
-	for _, e := range entries {
-		shortName := e.filenameShort
-		if e.fileExtension != "" {
-			shortName += "." + e.fileExtension
-		}
-		if e.filenameLong != filename && shortName != filename {
-			continue
-		}
-		// cannot do anything with directories
-		if e.isSubdirectory {
-			content, err := fs.ReadDir(pathname)
-			if err != nil {
-				return fmt.Errorf("error while checking if file to delete is empty: %+v", err)
-			}
-			// '.' & '..' are always present in directory
-			if len(content) > 2 {
-				return fmt.Errorf("cannot remove non-empty directory %s", pathname)
-			}
-		}
-		// if we got this far, we have found the file
-		targetEntry = e
+	targetEntry, err := fs.findEntry(entries, filename, false)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %w", pathname, err)
 	}
 
 	// see if the file exists
@@ -697,28 +1109,51 @@ func (fs *FileSystem) Remove(pathname string) error {
 	if targetEntry == nil {
 		return fmt.Errorf("target file %s does not exist", pathname)
 	}
+	// cannot do anything with directories
+	if targetEntry.isSubdirectory {
+		content, err := fs.ReadDir(pathname)
+		if err != nil {
+			return fmt.Errorf("error while checking if file to delete is empty: %+v", err)
+		}
+		// '.' & '..' are always present in directory
+		if len(content) > 2 {
+			return fmt.Errorf("cannot remove non-empty directory %s", pathname)
+		}
+	}
+	// it may have been found by a name that is only the same once normalized
+	if targetEntry.filenameLong != "" {
+		filename = targetEntry.filenameLong
+	}
 	err = parentDir.removeEntry(filename)
 	if err != nil {
 		return fmt.Errorf("failed to remove file %s: %v", pathname, err)
 	}
 
-	// we need to make sure that clusters are removed which may not be used anymore
-	_, err = fs.allocateSpace(uint64(parentDir.fileSize), parentDir.clusterLocation)
-	if err != nil {
-		return fmt.Errorf("failed to allocate clusters: %v", err)
-	}
-
 	// write the directory entries to disk
 	err = fs.writeDirectoryEntries(parentDir)
 	if err != nil {
 		return fmt.Errorf("error writing directory file %s to disk: %v", pathname, err)
 	}
 
+	// only once nothing leads to them can the clusters be freed
+	if targetEntry.clusterLocation >= 2 {
+		if err := fs.freeChain(targetEntry.clusterLocation); err != nil {
+			return fmt.Errorf("failed to free clusters of %s: %v", pathname, err)
+		}
+	}
+
 	return nil
 }
 
 // Rename renames (moves) oldpath to newpath. If newpath already exists and is not a directory, Rename replaces it.
+// Names and paths are limited as they are for OpenFile, with newpath taken as one that is created.
 func (fs *FileSystem) Rename(oldpath, newpath string) error {
+	if err := checkPath(oldpath, false); err != nil {
+		return fmt.Errorf("cannot rename %s: %w", oldpath, err)
+	}
+	if err := checkPath(newpath, true); err != nil {
+		return fmt.Errorf("cannot rename %s to %s: %w", oldpath, newpath, err)
+	}
 	// get the path
 	dir := path.Dir(oldpath)
 	filename := path.Base(oldpath)
@@ -739,17 +1174,9 @@ func (fs *FileSystem) Rename(oldpath, newpath string) error {
 		return fmt.Errorf("could not read directory entries for %s", dir)
 	}
 	// we now know that the directory exists, see if the file exists
-	var targetEntry *directoryEntry
-	for _, e := range entries {
-		shortName := e.filenameShort
-		if e.fileExtension != "" {
-			shortName += "." + e.fileExtension
-		}
-		if e.filenameLong != filename && shortName != filename {
-			continue
-		}
-		// if we got this far, we have found the file
-		targetEntry = e
+	targetEntry, err := fs.findEntry(entries, filename, false)
+	if err != nil {
+		return fmt.Errorf("could not rename %s: %w", oldpath, err)
 	}
 
 	// see if the file exists
@@ -757,15 +1184,27 @@ func (fs *FileSystem) Rename(oldpath, newpath string) error {
 	if targetEntry == nil {
 		return fmt.Errorf("target file %s does not exist", oldpath)
 	}
-	err = parentDir.renameEntry(filename, newname)
+	// it may have been found by a name that is only the same once normalized
+	if targetEntry.filenameLong != "" {
+		filename = targetEntry.filenameLong
+	}
+	// the file that is replaced may have been written in another form than the new name
+	newname = fs.normalization.Normalize(newname)
+	existing, err := fs.findEntry(entries, newname, false)
 	if err != nil {
-		return fmt.Errorf("failed to rename file %s: %v", oldpath, err)
+		return fmt.Errorf("could not rename %s to %s: %w", oldpath, newpath, err)
 	}
-
-	// we need to make sure that clusters are removed which may not be used anymore
-	_, err = fs.allocateSpace(uint64(parentDir.fileSize), parentDir.clusterLocation)
+	if existing != nil && existing != targetEntry && existing.filenameLong != "" && existing.filenameLong != newname {
+		if fs.normalization.Strict {
+			return fmt.Errorf("could not rename %s to %s, which matches %s: %w", oldpath, newpath, existing.filenameLong, filesystem.ErrAmbiguousName)
+		}
+		if err := parentDir.removeEntry(existing.filenameLong); err != nil {
+			return fmt.Errorf("failed to replace file %s: %v", newpath, err)
+		}
+	}
+	err = parentDir.renameEntry(filename, newname, fs.codePage)
 	if err != nil {
-		return fmt.Errorf("failed to allocate clusters: %v", err)
+		return fmt.Errorf("failed to rename file %s: %v", oldpath, err)
 	}
 
 	// write the directory entries to disk
@@ -804,6 +1243,142 @@ func (fs *FileSystem) Label() string {
 	return labelEntry.filenameShort + labelEntry.fileExtension
 }
 
+// UUID returns the volume serial number, formatted as XXXX-XXXX
+func (fs *FileSystem) UUID() string {
+	bpb := fs.bootSector.biosParameterBlock
+	if bpb == nil {
+		return ""
+	}
+	// the serial number is read big-endian, but is little-endian on disk, which is how it is displayed
+	serial := bits.ReverseBytes32(bpb.volumeSerialNumber)
+	return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+}
+
+// Usage returns the size of the filesystem, and the space in the free clusters
+func (fs *FileSystem) Usage() filesystem.Usage {
+	return filesystem.Usage{
+		Size: fs.size,
+		Free: int64(fs.freeClusterCount()) * int64(fs.bytesPerCluster),
+	}
+}
+
+// CodePage get the OEM code page that short names are read and written in
+func (fs *FileSystem) CodePage() CodePage {
+	return fs.codePage.orDefault()
+}
+
+// SetCodePage set the OEM code page that short names are read and written in, which has to be the one that the
+// systems using the filesystem expect, as it is not stored in the filesystem. Long filenames do not depend on it.
+// The default is CodePage437.
+func (fs *FileSystem) SetCodePage(cp CodePage) error {
+	if err := cp.validate(); err != nil {
+		return err
+	}
+	fs.codePage = cp.orDefault()
+	return nil
+}
+
+// NameNormalization get how long filenames are normalized when they are written and looked up
+func (fs *FileSystem) NameNormalization() filesystem.NameNormalization {
+	return fs.normalization
+}
+
+// SetNameNormalization set how long filenames are normalized: new names are written in n.Form, and names are
+// looked up in it, so that a file written by macOS in NFD is found by its NFC name, and the other way around.
+// As with SetCodePage, it is not stored in the filesystem. The default is filesystem.NormalizationNone, which
+// leaves names as they are.
+func (fs *FileSystem) SetNameNormalization(n filesystem.NameNormalization) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	fs.normalization = n
+	return nil
+}
+
+// IsDirty whether the filesystem is marked as not cleanly closed, either because it already was when it was read,
+// or because it was written to since it was last closed. Windows runs chkdsk on a filesystem that is marked so.
+// FAT12 has no such mark, so is never dirty.
+func (fs *FileSystem) IsDirty() bool {
+	return fs.dirty
+}
+
+// Close mark the filesystem as cleanly closed, after bringing the count of free clusters and the most recently
+// allocated cluster in the FS Information Sector up to date, so that chkdsk and fsck.fat find it consistent.
+// A filesystem that already was marked as not cleanly closed when it was read stays marked, so it still gets checked.
+// The filesystem can be used after Close, and is marked again on its next write.
+func (fs *FileSystem) Close() error {
+	if !fs.modified {
+		return nil
+	}
+	if fs.bootSector.biosParameterBlock.fsInformationSector != 0 {
+		fs.fsis.freeDataClustersCount = fs.freeClusterCount()
+		if err := fs.writeFsis(); err != nil {
+			return fmt.Errorf("failed to write the file system information sector: %w", err)
+		}
+	}
+	if !fs.dirtyWhenRead {
+		if err := fs.setDirty(false); err != nil {
+			return err
+		}
+	}
+	fs.modified = false
+	return nil
+}
+
+// markModified note that the filesystem is about to be written to, and mark it as not cleanly closed on disk
+// the first time
+func (fs *FileSystem) markModified() error {
+	fs.modified = true
+	return fs.setDirty(true)
+}
+
+// setDirty set or clear the mark in FAT[1] of both FATs that the filesystem was not cleanly closed
+func (fs *FileSystem) setDirty(dirty bool) error {
+	bit := fs.table.cleanShutdownBit()
+	if bit == 0 || dirty == fs.dirty {
+		return nil
+	}
+	if dirty {
+		fs.table.eocMarker &^= bit
+	} else {
+		fs.table.eocMarker |= bit
+	}
+	// only the first two entries of the FAT change
+	b := make([]byte, fs.table.entryBits()/4)
+	fs.table.putEntry(b, 0, fs.table.fatID)
+	fs.table.putEntry(b, 1, fs.table.eocMarker)
+
+	writableFile, err := fs.backend.Writable()
+	if err != nil {
+		return err
+	}
+	reservedSectors := fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.reservedSectors
+	fatPrimaryStart := int64(reservedSectors) * fs.sectorSize()
+	for _, offset := range []int64{fatPrimaryStart, fatPrimaryStart + int64(fs.table.size)} {
+		if err := fs.traceWrite(writableFile, TraceFatWrite, b, offset+fs.start, 0); err != nil {
+			return fmt.Errorf("unable to write clean shutdown flag to FAT: %w", err)
+		}
+	}
+	fs.dirty = dirty
+	return nil
+}
+
+// dataClusters how many clusters there are in the data region, which can be fewer than the FAT has entries for
+func (fs *FileSystem) dataClusters() uint32 {
+	return uint32((fs.size - int64(fs.dataStart)) / int64(fs.bytesPerCluster))
+}
+
+// freeClusterCount how many of the clusters in the data region are free
+func (fs *FileSystem) freeClusterCount() uint32 {
+	var free uint32
+	for i := uint32(2); i < min(fs.table.maxCluster, fs.dataClusters()+2) && int(i) < len(fs.table.clusters); i++ {
+		if fs.table.clusters[i] == fs.table.unusedMarker {
+			free++
+		}
+	}
+	return free
+}
+
 // SetLabel changes the filesystem label
 func (fs *FileSystem) SetLabel(volumeLabel string) error {
 	if volumeLabel == "" {
@@ -859,8 +1434,15 @@ func (fs *FileSystem) SetLabel(volumeLabel string) error {
 	return nil
 }
 
-// read directory entries for a given cluster
-func (fs *FileSystem) getClusterList(firstCluster uint32) ([]uint32, error) {
+// getClusterList get the chain of clusters that starts at firstCluster from the FAT
+func (fs *FileSystem) getClusterList(firstCluster uint32) (clusterList []uint32, err error) {
+	if fs.tracer != nil {
+		defer func(start time.Time) {
+			reservedSectors := fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.reservedSectors
+			offset := int64(reservedSectors)*fs.sectorSize() + int64(firstCluster)*int64(fs.table.entryBits())/8
+			fs.trace(TraceEvent{Op: TraceFatRead, Offset: fs.start + offset, Cluster: firstCluster, Clusters: clusterList, Err: err}, start)
+		}(time.Now())
+	}
 	// first, get the chain of clusters
 	complete := false
 	cluster := firstCluster
@@ -870,7 +1452,7 @@ func (fs *FileSystem) getClusterList(firstCluster uint32) ([]uint32, error) {
 		return nil, fmt.Errorf("invalid start cluster: %d", cluster)
 	}
 
-	clusterList := make([]uint32, 0, 5)
+	clusterList = make([]uint32, 0, 5)
 	for !complete {
 		// save the current cluster
 		clusterList = append(clusterList, cluster)
@@ -892,6 +1474,25 @@ func (fs *FileSystem) getClusterList(firstCluster uint32) ([]uint32, error) {
 
 // read directory entries for a given cluster
 func (fs *FileSystem) readDirectory(dir *Directory) ([]*directoryEntry, error) {
+	b, err := fs.readDirectoryBytes(dir)
+	if err != nil {
+		return nil, err
+	}
+	// get the directory
+	if err := dir.entriesFromBytes(b, fs.codePage); err != nil {
+		return nil, err
+	}
+	return dir.entries, nil
+}
+
+// readDirectoryBytes read the raw bytes of a directory, from the fixed root directory region on FAT12 and FAT16,
+// else from its chain of clusters
+func (fs *FileSystem) readDirectoryBytes(dir *Directory) ([]byte, error) {
+	if offset, size := fs.rootDirRegion(); size > 0 && dir.clusterLocation == fs.table.rootDirCluster {
+		b := make([]byte, size)
+		_ = fs.traceRead(TraceDirRead, b, fs.start+offset, 0)
+		return b, nil
+	}
 	clusterList, err := fs.getClusterList(dir.clusterLocation)
 	if err != nil {
 		return nil, fmt.Errorf("could not read cluster list: %w", err)
@@ -905,30 +1506,70 @@ func (fs *FileSystem) readDirectory(dir *Directory) ([]*directoryEntry, error) {
 		// length of cluster in bytes
 		tmpb := make([]byte, fs.bytesPerCluster)
 		// read the entire cluster
-		_, _ = fs.backend.ReadAt(tmpb, clusterStart)
+		_ = fs.traceRead(TraceDirRead, tmpb, clusterStart, cluster)
 		b = append(b, tmpb...)
 	}
-	// get the directory
-	if err := dir.entriesFromBytes(b); err != nil {
-		return nil, err
-	}
-	return dir.entries, nil
+	return b, nil
 }
 
-// make a subdirectory
+// mkSubdir make a subdirectory in a directory. The entries . and .. are written to the cluster of the new
+// directory before the FAT is, and the entry for it is only added to parent after that, for the caller to write.
 func (fs *FileSystem) mkSubdir(parent *Directory, name string) (*directoryEntry, error) {
-	// get a cluster chain for the file
-	clusters, err := fs.allocateSpace(1, 0)
+	name = fs.normalization.Normalize(name)
+	// get a cluster chain for the directory
+	a, err := fs.allocate(1, 0)
 	if err != nil {
-		return nil, fmt.Errorf("could not allocate disk space for file %s: %w", name, err)
+		return nil, fmt.Errorf("could not allocate disk space for directory %s: %w", name, err)
 	}
-	// create a directory entry for the file
-	return parent.createEntry(name, clusters[0], true)
+	// create a directory entry for the directory
+	subdirEntry, err := parent.createEntry(name, a.clusters[0], true, fs.codePage)
+	if err != nil {
+		fs.rollback(a)
+		return nil, err
+	}
+	parent.modifyTime = subdirEntry.createTime
+	// make a basic entry for the new subdir
+	parentDirectoryCluster := parent.clusterLocation
+	if parentDirectoryCluster == fs.table.rootDirCluster {
+		// references to the root directory (cluster 2 in FAT32) must be stored as 0
+		parentDirectoryCluster = 0
+	}
+	dir := &Directory{
+		directoryEntry: directoryEntry{clusterLocation: subdirEntry.clusterLocation},
+		entries: []*directoryEntry{
+			{
+				filenameShort:   ".",
+				isSubdirectory:  true,
+				clusterLocation: subdirEntry.clusterLocation,
+				createTime:      subdirEntry.createTime,
+				modifyTime:      subdirEntry.modifyTime,
+				accessTime:      subdirEntry.accessTime,
+			},
+			{
+				filenameShort:   "..",
+				isSubdirectory:  true,
+				clusterLocation: parentDirectoryCluster,
+				createTime:      parent.createTime,
+				modifyTime:      parent.modifyTime,
+				accessTime:      parent.accessTime,
+			},
+		},
+	}
+	// write the new directory entries to disk, and only then link its cluster
+	if err := fs.writeDirectoryEntries(dir); err == nil {
+		err = fs.commit(a)
+	}
+	if err != nil {
+		parent.entries = parent.entries[:len(parent.entries)-1]
+		fs.rollback(a)
+		return nil, fmt.Errorf("error writing new directory entries to disk: %w", err)
+	}
+	return subdirEntry, nil
 }
 
 func (fs *FileSystem) writeDirectoryEntries(dir *Directory) error {
 	// we need to save the entries of the parent
-	b, err := dir.entriesToBytes(fs.bytesPerCluster)
+	b, err := dir.entriesToBytes(fs.bytesPerCluster, fs.codePage)
 	if err != nil {
 		return fmt.Errorf("could not create a valid byte stream for a FAT32 Entries: %w", err)
 	}
@@ -937,46 +1578,77 @@ func (fs *FileSystem) writeDirectoryEntries(dir *Directory) error {
 	if err != nil {
 		return err
 	}
-	// now have to expand with zeros to the a multiple of cluster lengths
-	// how many clusters do we need, how many do we have?
+	if err := fs.markModified(); err != nil {
+		return err
+	}
+	// the root directory of FAT12 and FAT16 has a fixed size, and cannot grow
+	if offset, size := fs.rootDirRegion(); size > 0 && dir.clusterLocation == fs.table.rootDirCluster {
+		b, err := dir.entriesToBytes(int(size), fs.codePage)
+		if err != nil {
+			return fmt.Errorf("could not create a valid byte stream for root directory entries: %w", err)
+		}
+		if int64(len(b)) > size {
+			return fmt.Errorf("root directory is full, it can hold at most %d entries", size/int64(bytesPerSlot))
+		}
+		if err := fs.traceWrite(writableFile, TraceDirWrite, b, fs.start+offset, 0); err != nil {
+			return fmt.Errorf("error writing root directory entries: %w", err)
+		}
+		return nil
+	}
+	// the directory may need more clusters, or fewer, than it has
 	clusterList, err := fs.getClusterList(dir.clusterLocation)
 	if err != nil {
 		return fmt.Errorf("unable to get clusters for directory: %w", err)
 	}
-
-	if len(b) > len(clusterList)*fs.bytesPerCluster {
-		clusters, err := fs.allocateSpace(uint64(len(b)), clusterList[0])
-		if err != nil {
-			return fmt.Errorf("unable to allocate space for directory entries: %w", err)
+	had := len(clusterList)
+	a, err := fs.allocate(uint64(len(b)), dir.clusterLocation)
+	if err != nil {
+		return fmt.Errorf("unable to allocate space for directory entries: %w", err)
+	}
+	clusterList = a.clusters
+	// write the clusters the directory did not have before, then link them into its chain, and only then write
+	// those it had, so that the entries of the directory on disk only ever lead to clusters that belong to it; a
+	// chain that is cut short is cut once the entries are written. See the package documentation.
+	writeClusters := func(clusters []uint32, first int) error {
+		for i, cluster := range clusters {
+			// bytes where the cluster starts
+			clusterStart := fs.start + int64(fs.dataStart) + int64(cluster-2)*int64(fs.bytesPerCluster)
+			bStart := (first + i) * fs.bytesPerCluster
+			if err := fs.traceWrite(writableFile, TraceDirWrite, b[bStart:bStart+fs.bytesPerCluster], clusterStart, cluster); err != nil {
+				return fmt.Errorf("error writing directory entries: %w", err)
+			}
 		}
-		clusterList = clusters
+		return nil
 	}
-	// now write everything out to the cluster list
-	// read the data from all of the cluster entries in the list
-	for i, cluster := range clusterList {
-		// bytes where the cluster starts
-		clusterStart := fs.start + int64(fs.dataStart) + int64(cluster-2)*int64(fs.bytesPerCluster)
-		bStart := i * fs.bytesPerCluster
-		written, err := writableFile.WriteAt(b[bStart:bStart+fs.bytesPerCluster], clusterStart)
-		if err != nil {
-			return fmt.Errorf("error writing directory entries: %w", err)
+	if len(clusterList) > had {
+		if err := writeClusters(clusterList[had:], had); err != nil {
+			fs.rollback(a)
+			return err
 		}
-		if written != fs.bytesPerCluster {
-			return fmt.Errorf("wrote %d bytes to cluster %d instead of expected %d", written, cluster, fs.bytesPerCluster)
+		if err := fs.commit(a); err != nil {
+			return fmt.Errorf("unable to allocate space for directory entries: %w", err)
 		}
 	}
+	if err := writeClusters(clusterList[:min(had, len(clusterList))], 0); err != nil {
+		fs.rollback(a)
+		return err
+	}
+	if err := fs.commit(a); err != nil {
+		return fmt.Errorf("unable to free space for directory entries: %w", err)
+	}
 	return nil
 }
 
 // mkFile make a file in a directory
 func (fs *FileSystem) mkFile(parent *Directory, name string) (*directoryEntry, error) {
+	name = fs.normalization.Normalize(name)
 	// get a cluster chain for the file
 	clusters, err := fs.allocateSpace(1, 0)
 	if err != nil {
 		return nil, fmt.Errorf("could not allocate disk space for directory %s: %w", name, err)
 	}
 	// create a directory entry for the file
-	return parent.createEntry(name, clusters[0], false)
+	return parent.createEntry(name, clusters[0], false, fs.codePage)
 }
 
 // mkLabel make a volume label in a directory
@@ -985,6 +1657,47 @@ func (fs *FileSystem) mkLabel(parent *Directory, name string) (*directoryEntry,
 	return parent.createVolumeLabel(name)
 }
 
+// findEntry find the entry of entries that name refers to, or nil if there is none. It matches either
+// the long filename, once both are normalized, or the short filename with its extension; with foldCase, either
+// regardless of case. Where more than one entry matches, the normalization settles which.
+func (fs *FileSystem) findEntry(entries []*directoryEntry, name string, foldCase bool) (*directoryEntry, error) {
+	equal := func(a, b string) bool {
+		if foldCase {
+			return strings.EqualFold(a, b)
+		}
+		return a == b
+	}
+	normalized := fs.normalization.Normalize(name)
+	var (
+		matched []*directoryEntry
+		names   []string
+	)
+	for _, e := range entries {
+		// don't match volume label
+		if e.isVolumeLabel {
+			continue
+		}
+		shortName := e.filenameShort
+		if e.fileExtension != "" {
+			shortName += "." + e.fileExtension
+		}
+		switch {
+		case e.filenameLong != "" && (equal(e.filenameLong, name) || equal(fs.normalization.Normalize(e.filenameLong), normalized)):
+			names = append(names, e.filenameLong)
+		case equal(shortName, name):
+			names = append(names, shortName)
+		default:
+			continue
+		}
+		matched = append(matched, e)
+	}
+	i, err := fs.normalization.Resolve(name, names)
+	if i < 0 {
+		return nil, err
+	}
+	return matched[i], nil
+}
+
 // readDirWithMkdir - walks down a directory tree to the last entry
 // if it does not exist, it may or may not make it
 func (fs *FileSystem) readDirWithMkdir(p string, doMake bool) (*Directory, []*directoryEntry, error) {
@@ -1010,27 +1723,20 @@ func (fs *FileSystem) readDirWithMkdir(p string, doMake bool) (*Directory, []*di
 	for i, subp := range paths {
 		// do we have an entry whose name is the same as this name?
 		found := false
-		for _, e := range entries {
-			// don't match volume label
-			if e.isVolumeLabel {
-				continue
-			}
-			// if the filename does not match, continue
-			// match is determined by any one of:
-			// - long filename == provided name
-			// - uppercase(short filename) == uppercase(provided name)
-			if !strings.EqualFold(e.filenameLong, subp) && !strings.EqualFold(e.filenameShort, subp) {
-				continue
-			}
+		var e *directoryEntry
+		e, err = fs.findEntry(entries, subp, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not find %s: %w", "/"+strings.Join(paths[0:i+1], "/"), err)
+		}
+		if e != nil {
 			if !e.isSubdirectory {
 				return nil, nil, fmt.Errorf("cannot create directory at %s since it is a file", "/"+strings.Join(paths[0:i+1], "/"))
 			}
-			// the filename matches, and it is a subdirectory, so we can break after saving the cluster
+			// the filename matches, and it is a subdirectory, so save the cluster
 			found = true
 			currentDir = &Directory{
 				directoryEntry: *e,
 			}
-			break
 		}
 
 		// if not, either make it, retrieve its cluster and entries, and loop;
@@ -1042,39 +1748,6 @@ func (fs *FileSystem) readDirWithMkdir(p string, doMake bool) (*Directory, []*di
 				if err != nil {
 					return nil, nil, fmt.Errorf("failed to create subdirectory %s: %w", "/"+strings.Join(paths[0:i+1], "/"), err)
 				}
-				currentDir.modifyTime = subdirEntry.createTime
-				// make a basic entry for the new subdir
-				parentDirectoryCluster := currentDir.clusterLocation
-				if parentDirectoryCluster == 2 {
-					// references to the root directory (cluster 2) must be stored as 0
-					parentDirectoryCluster = 0
-				}
-				dir := &Directory{
-					directoryEntry: directoryEntry{clusterLocation: subdirEntry.clusterLocation},
-					entries: []*directoryEntry{
-						{
-							filenameShort:   ".",
-							isSubdirectory:  true,
-							clusterLocation: subdirEntry.clusterLocation,
-							createTime:      subdirEntry.createTime,
-							modifyTime:      subdirEntry.modifyTime,
-							accessTime:      subdirEntry.accessTime,
-						},
-						{
-							filenameShort:   "..",
-							isSubdirectory:  true,
-							clusterLocation: parentDirectoryCluster,
-							createTime:      currentDir.createTime,
-							modifyTime:      currentDir.modifyTime,
-							accessTime:      currentDir.accessTime,
-						},
-					},
-				}
-				// write the new directory entries to disk
-				err = fs.writeDirectoryEntries(dir)
-				if err != nil {
-					return nil, nil, fmt.Errorf("error writing new directory entries to disk: %w", err)
-				}
 				// write the parent directory entries to disk
 				err = fs.writeDirectoryEntries(currentDir)
 				if err != nil {
@@ -1098,20 +1771,102 @@ func (fs *FileSystem) readDirWithMkdir(p string, doMake bool) (*Directory, []*di
 	return currentDir, entries, nil
 }
 
-// allocateSpace ensure that a cluster chain exists to handle a file of a given size.
+// allocation a change to a cluster chain that is made to the FAT in memory, but not yet written to disk, so that
+// data can be written to new clusters before they are linked into a chain
+type allocation struct {
+	// clusters the whole chain, as changed, in order
+	clusters []uint32
+	// previous the entries of the FAT that were changed, as they were before; nil when nothing was changed, or once
+	// the change is committed
+	previous map[uint32]uint32
+	// lastAllocatedCluster and freeDataClustersCount the FSIS as it was before
+	lastAllocatedCluster, freeDataClustersCount uint32
+}
+
+// set change an entry of the FAT, remembering what it was
+func (a *allocation) set(t *table, cluster, val uint32) {
+	if a.previous == nil {
+		a.previous = map[uint32]uint32{}
+	}
+	if _, ok := a.previous[cluster]; !ok {
+		a.previous[cluster] = t.clusters[cluster]
+	}
+	t.clusters[cluster] = val
+}
+
+// freeChain free all of the clusters of the chain that starts at first, write the FAT, and discard the clusters
+func (fs *FileSystem) freeChain(first uint32) error {
+	clusters, err := fs.getClusterList(first)
+	if err != nil {
+		return fmt.Errorf("unable to get cluster list: %w", err)
+	}
+	if err := fs.markModified(); err != nil {
+		return err
+	}
+	a := &allocation{
+		lastAllocatedCluster:  fs.fsis.lastAllocatedCluster,
+		freeDataClustersCount: fs.fsis.freeDataClustersCount,
+	}
+	for _, cluster := range clusters {
+		a.set(&fs.table, cluster, fs.table.unusedMarker)
+	}
+	if fs.fsis.freeDataClustersCount != unknownFreeDataClusterCount {
+		fs.fsis.freeDataClustersCount += uint32(len(clusters))
+	}
+	if err := fs.commit(a); err != nil {
+		return err
+	}
+	fs.discardClusters(clusters)
+	return nil
+}
+
+// discardClusters tell the backend that clusters, which were freed, are no longer used, if it is a
+// backend.Discarder, so that the space they took on an SSD, a thin volume or a sparse image is freed too. It is
+// only a hint, so failing to discard them does not fail freeing them.
+func (fs *FileSystem) discardClusters(clusters []uint32) {
+	discarder, ok := fs.backend.(backend.Discarder)
+	if !ok {
+		return
+	}
+	for i := 0; i < len(clusters); {
+		// contiguous clusters are discarded together
+		j := i + 1
+		for j < len(clusters) && clusters[j] == clusters[j-1]+1 {
+			j++
+		}
+		start := fs.start + int64(fs.dataStart) + int64(clusters[i]-2)*int64(fs.bytesPerCluster)
+		_ = discarder.Discard(start, int64(j-i)*int64(fs.bytesPerCluster))
+		i = j
+	}
+}
+
+// allocateSpace ensure that a cluster chain exists to handle a file of a given size, and write the FAT with it
+// to disk. See allocate for the arguments.
+func (fs *FileSystem) allocateSpace(size uint64, previous uint32) ([]uint32, error) {
+	a, err := fs.allocate(size, previous)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.commit(a); err != nil {
+		return nil, err
+	}
+	return a.clusters, nil
+}
+
+// allocate ensure that a cluster chain exists to handle a file of a given size, in the FAT in memory only; commit
+// writes it to disk, and rollback undoes it.
 // arguments are file size in bytes and starting cluster of the chain
 // if starting is 0, then we are not (re)sizing an existing chain but creating a new one
 // returns the indexes of clusters to be used in order. If the new size is smaller than
 // the original size, will shrink the chain.
-func (fs *FileSystem) allocateSpace(size uint64, previous uint32) ([]uint32, error) {
+func (fs *FileSystem) allocate(size uint64, previous uint32) (*allocation, error) {
 	if previous > fs.table.maxCluster {
 		return nil, fmt.Errorf("invalid cluster chain at %d", previous)
 	}
 
 	var (
-		clusters             []uint32
-		err                  error
-		lastAllocatedCluster uint32
+		clusters []uint32
+		err      error
 	)
 	// 1- calculate how many clusters needed
 	// 2- see how many clusters already are allocated
@@ -1139,13 +1894,22 @@ func (fs *FileSystem) allocateSpace(size uint64, previous uint32) ([]uint32, err
 		previous = clusters[len(clusters)-1]
 	}
 
+	a := &allocation{
+		clusters:              clusters,
+		lastAllocatedCluster:  fs.fsis.lastAllocatedCluster,
+		freeDataClustersCount: fs.fsis.freeDataClustersCount,
+	}
 	// what if we do not need to change anything?
 	if extraClusterCount == 0 {
-		return clusters, nil
+		return a, nil
+	}
+	if err := fs.markModified(); err != nil {
+		return nil, err
 	}
 
-	// get a list of allocated clusters, so we can know which ones are unallocated and therefore allocatable
-	maxCluster := fs.table.maxCluster
+	// get a list of allocated clusters, so we can know which ones are unallocated and therefore allocatable;
+	// the FAT can have more entries than there are clusters in the data region
+	maxCluster := min(fs.table.maxCluster, fs.dataClusters()+2)
 
 	if extraClusterCount > 0 {
 		for i := uint32(2); i < maxCluster && len(allocated) < extraClusterCount; i++ {
@@ -1165,61 +1929,86 @@ func (fs *FileSystem) allocateSpace(size uint64, previous uint32) ([]uint32, err
 
 		// extend the chain and fill them in
 		if previous > 0 {
-			fs.table.clusters[previous] = allocated[0]
+			a.set(&fs.table, previous, allocated[0])
 		}
 		for i := 0; i < lastAlloc; i++ {
-			fs.table.clusters[allocated[i]] = allocated[i+1]
+			a.set(&fs.table, allocated[i], allocated[i+1])
 		}
-		fs.table.clusters[allocated[lastAlloc]] = fs.table.eocMarker
+		a.set(&fs.table, allocated[lastAlloc], fs.table.endOfChain())
 
 		// update the FSIS
-		lastAllocatedCluster = allocated[len(allocated)-1]
-	} else {
-		var (
-			lastAlloc   int
-			deallocated []uint32
-		)
-		toRemove := abs(extraClusterCount)
-		lastAlloc = len(clusters) - toRemove - 1
-		if lastAlloc < 0 {
-			lastAlloc = 0
+		fs.fsis.lastAllocatedCluster = allocated[len(allocated)-1]
+		if fs.fsis.freeDataClustersCount != unknownFreeDataClusterCount {
+			fs.fsis.freeDataClustersCount -= uint32(len(allocated))
 		}
-		deallocated = clusters[lastAlloc+1:]
+		a.clusters = append(clusters, allocated...)
+		return a, nil
+	}
 
-		if uint32(lastAlloc) > fs.table.maxCluster || clusters[lastAlloc] > fs.table.maxCluster {
-			return nil, fmt.Errorf("invalid cluster chain at %d", lastAlloc)
-		}
+	toRemove := abs(extraClusterCount)
+	lastAlloc := len(clusters) - toRemove - 1
+	if lastAlloc < 0 {
+		lastAlloc = 0
+	}
+	deallocated := clusters[lastAlloc+1:]
 
-		// mark last allocated one as EOC
-		fs.table.clusters[clusters[lastAlloc]] = fs.table.eocMarker
+	if uint32(lastAlloc) > fs.table.maxCluster || clusters[lastAlloc] > fs.table.maxCluster {
+		return nil, fmt.Errorf("invalid cluster chain at %d", lastAlloc)
+	}
 
-		// unmark all of the unused ones
-		lastAllocatedCluster = fs.fsis.lastAllocatedCluster
-		for _, cl := range deallocated {
-			if cl > fs.table.maxCluster {
-				return nil, fmt.Errorf("invalid cluster chain at %d", cl)
-			}
+	// mark last allocated one as EOC
+	a.set(&fs.table, clusters[lastAlloc], fs.table.endOfChain())
 
-			fs.table.clusters[cl] = fs.table.unusedMarker
-			if cl == lastAllocatedCluster {
-				lastAllocatedCluster--
-			}
+	// unmark all of the unused ones; the most recently allocated cluster is only a hint of where to look for
+	// free ones, so stays as it is
+	for _, cl := range deallocated {
+		if cl > fs.table.maxCluster {
+			fs.rollback(a)
+			return nil, fmt.Errorf("invalid cluster chain at %d", cl)
 		}
+		a.set(&fs.table, cl, fs.table.unusedMarker)
+	}
+	if fs.fsis.freeDataClustersCount != unknownFreeDataClusterCount {
+		fs.fsis.freeDataClustersCount += uint32(len(deallocated))
 	}
+	a.clusters = clusters[:lastAlloc+1]
+	return a, nil
+}
 
+// commit write the FSIS and FAT with a change made by allocate to disk, if it changed anything and is not yet
+// written
+func (fs *FileSystem) commit(a *allocation) error {
+	if a.previous == nil {
+		return nil
+	}
 	// update the FSIS
-	fs.fsis.lastAllocatedCluster = lastAllocatedCluster
 	if err := fs.writeFsis(); err != nil {
-		return nil, fmt.Errorf("failed to write the file system information sector: %w", err)
+		return fmt.Errorf("failed to write the file system information sector: %w", err)
 	}
 
 	// write the FAT tables
 	if err := fs.writeFat(); err != nil {
-		return nil, fmt.Errorf("failed to write the file allocation table: %w", err)
+		return fmt.Errorf("failed to write the file allocation table: %w", err)
 	}
+	if fs.tracer != nil {
+		fs.traceAllocation(a)
+	}
+	a.previous = nil
+	return nil
+}
 
-	// return all of the clusters
-	return append(clusters, allocated...), nil
+// rollback undo a change made by allocate that is not yet committed, e.g. because the data for the new clusters
+// could not be written
+func (fs *FileSystem) rollback(a *allocation) {
+	if a.previous == nil {
+		return
+	}
+	for cluster, val := range a.previous {
+		fs.table.clusters[cluster] = val
+	}
+	fs.fsis.lastAllocatedCluster = a.lastAllocatedCluster
+	fs.fsis.freeDataClustersCount = a.freeDataClustersCount
+	a.previous = nil
 }
 
 func abs(x int) int {
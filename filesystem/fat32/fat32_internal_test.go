@@ -368,3 +368,178 @@ func TestFat32ReadDirWithMkdir(t *testing.T) {
 		}
 	}
 }
+
+func TestFat32DirtyFlag(t *testing.T) {
+	// fat1 FAT[1] as it is in the first FAT on disk
+	fat1 := func(t *testing.T, f *os.File, fs *FileSystem) uint32 {
+		t.Helper()
+		b := make([]byte, fs.table.entryBits()/4)
+		reservedSectors := fs.bootSector.biosParameterBlock.dos331BPB.dos20BPB.reservedSectors
+		if _, err := f.ReadAt(b, int64(reservedSectors)*fs.sectorSize()); err != nil {
+			t.Fatalf("error reading FAT: %v", err)
+		}
+		return fs.table.entry(b, 1)
+	}
+	reread := func(t *testing.T, f *os.File, size int64) *FileSystem {
+		t.Helper()
+		fs, err := Read(file.New(f, false), size, 0, 512)
+		if err != nil {
+			t.Fatalf("error reading filesystem: %v", err)
+		}
+		return fs
+	}
+	tests := []struct {
+		fatType FatType
+		clean   uint32
+		dirty   uint32
+	}{
+		{FatType16, 0xffff, 0x7fff},
+		{FatType32, 0x0fffffff, 0x07ffffff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fatType.String(), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat32_dirty")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			size := int64(40 * MB)
+			fs, err := CreateWithType(file.New(f, false), size, 0, 512, "DIRTY", tt.fatType)
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if fs.IsDirty() || fat1(t, f, fs) != tt.clean {
+				t.Fatalf("new filesystem is dirty, FAT[1] %#x", fat1(t, f, fs))
+			}
+
+			// the first write marks the filesystem dirty, and new chains still end with a proper end of chain
+			fl, err := fs.OpenFile("/file.bin", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			if _, err := fl.Write(make([]byte, 3*fs.bytesPerCluster)); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+			if !fs.IsDirty() || fat1(t, f, fs) != tt.dirty {
+				t.Errorf("filesystem not dirty after writing, FAT[1] %#x", fat1(t, f, fs))
+			}
+			clusters, err := fl.(*File).GetClusterChain()
+			if err != nil {
+				t.Fatalf("error getting cluster chain: %v", err)
+			}
+			if last := fs.table.clusters[clusters[len(clusters)-1]]; last != tt.clean {
+				t.Errorf("chain ends with %#x instead of %#x", last, tt.clean)
+			}
+			if !reread(t, f, size).IsDirty() {
+				t.Errorf("filesystem read back is not dirty")
+			}
+
+			if err := fs.Close(); err != nil {
+				t.Fatalf("error closing filesystem: %v", err)
+			}
+			if fs.IsDirty() || fat1(t, f, fs) != tt.clean {
+				t.Errorf("filesystem dirty after Close, FAT[1] %#x", fat1(t, f, fs))
+			}
+			fs = reread(t, f, size)
+			if fs.IsDirty() {
+				t.Errorf("filesystem read back after Close is dirty")
+			}
+			if tt.fatType == FatType32 {
+				fsis := make([]byte, 512)
+				if _, err := f.ReadAt(fsis, int64(fs.bootSector.biosParameterBlock.fsInformationSector)*fs.sectorSize()); err != nil {
+					t.Fatalf("error reading FS Information Sector: %v", err)
+				}
+				onDisk, err := fsInformationSectorFromBytes(fsis)
+				if err != nil {
+					t.Fatalf("error parsing FS Information Sector: %v", err)
+				}
+				if free := uint32(fs.Usage().Free / int64(fs.bytesPerCluster)); onDisk.freeDataClustersCount != free {
+					t.Errorf("free clusters %d instead of %d", onDisk.freeDataClustersCount, free)
+				}
+				if onDisk.lastAllocatedCluster != clusters[len(clusters)-1] {
+					t.Errorf("last allocated cluster %d instead of %d", onDisk.lastAllocatedCluster, clusters[len(clusters)-1])
+				}
+			}
+
+			// a filesystem that was dirty when read stays dirty, so it still gets checked
+			if err := fs.setDirty(true); err != nil {
+				t.Fatalf("error marking filesystem dirty: %v", err)
+			}
+			fs = reread(t, f, size)
+			if err := fs.Remove("/file.bin"); err != nil {
+				t.Fatalf("error removing file: %v", err)
+			}
+			if err := fs.Close(); err != nil {
+				t.Fatalf("error closing filesystem: %v", err)
+			}
+			if !fs.IsDirty() || fat1(t, f, fs) != tt.dirty {
+				t.Errorf("filesystem that was dirty when read is clean after Close, FAT[1] %#x", fat1(t, f, fs))
+			}
+		})
+	}
+}
+
+func TestFat32CodePage(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "fat32_codepage")
+	if err != nil {
+		t.Fatalf("error creating tempfile: %v", err)
+	}
+	defer f.Close()
+	size := int64(40 * MB)
+	fs, err := Create(file.New(f, false), size, 0, 512, "CODEPAGE")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.SetCodePage(CodePage(1252)); err == nil {
+		t.Errorf("unsupported code page 1252 was accepted")
+	}
+	if err := fs.SetCodePage(CodePage932); err != nil {
+		t.Fatalf("error setting code page: %v", err)
+	}
+	// long names beyond ASCII, including one outside the Basic Multilingual Plane, which takes a surrogate pair
+	// that is split across 2 long filename entries
+	names := map[string]string{
+		"日本語のファイル名.txt": "日本語~1.TXT",
+		"日本語のテキスト.txt":  "日本語~2.TXT",
+		// Shift JIS has no É
+		"café.txt":         "CAF_.TXT",
+		"abcdefghijkl😀.md": "ABCDEF~1.MD",
+	}
+	for name := range names {
+		if _, err := fs.OpenFile("/"+name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("error creating file %s: %v", name, err)
+		}
+	}
+
+	for _, cp := range []CodePage{CodePage932, CodePage437} {
+		fs, err := Read(file.New(f, false), size, 0, 512)
+		if err != nil {
+			t.Fatalf("error reading filesystem: %v", err)
+		}
+		if err := fs.SetCodePage(cp); err != nil {
+			t.Fatalf("error setting code page: %v", err)
+		}
+		if err := fs.Check(false); err != nil {
+			t.Errorf("%v: unexpected problems: %v", cp, err)
+		}
+		_, entries, err := fs.readDirWithMkdir("/", false)
+		if err != nil {
+			t.Fatalf("error reading root directory: %v", err)
+		}
+		found := 0
+		for _, e := range entries {
+			shortName, ok := names[e.filenameLong]
+			if !ok {
+				continue
+			}
+			found++
+			// the long names do not depend on the code page, the short names do
+			if actual := e.filenameShort + "." + e.fileExtension; cp == CodePage932 && actual != shortName {
+				t.Errorf("%v: short name of %s is %s instead of %s", cp, e.filenameLong, actual, shortName)
+			}
+		}
+		if found != len(names) {
+			t.Errorf("%v: found %d of the %d long names", cp, found, len(names))
+		}
+	}
+}
@@ -7,22 +7,30 @@ package fat32_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	mathrandv2 "math/rand/v2"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/diskfs/go-diskfs"
 	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/faulty"
 	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/disk"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/diskfs/go-diskfs/testhelper"
 )
 
@@ -194,6 +202,7 @@ func TestFat32Create(t *testing.T) {
 	}{
 		{500, 6000, nil, fmt.Errorf("blocksize for FAT32 must be")},
 		{513, 6000, nil, fmt.Errorf("blocksize for FAT32 must be")},
+		{8192, 6000, nil, fmt.Errorf("blocksize for FAT32 must be")},
 		{512, fat32.Fat32MaxSize + 100000, nil, fmt.Errorf("requested size is larger than maximum allowed FAT32")},
 		{512, 0, nil, fmt.Errorf("requested size is smaller than minimum allowed FAT32")},
 		{512, 10000000, &fat32.FileSystem{}, nil},
@@ -295,6 +304,90 @@ func TestFat32Read(t *testing.T) {
 	})
 }
 
+// filesystems with sectors larger than 512 bytes must be created and read back with the same contents
+func TestFat32SectorSizes(t *testing.T) {
+	const size = 20 * fat32.MB
+	content := []byte("a file in a filesystem with large sectors\n")
+	for _, sectorSize := range []int64{512, 1024, 2048, 4096} {
+		t.Run(fmt.Sprintf("%d", sectorSize), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat32_sectors")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			if err := f.Truncate(size); err != nil {
+				t.Fatalf("error sizing tempfile: %v", err)
+			}
+			fs, err := fat32.Create(file.New(f, false), size, 0, sectorSize, "SECTORS")
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if err := fs.Mkdir("/foo"); err != nil {
+				t.Fatalf("error creating directory: %v", err)
+			}
+			out, err := fs.OpenFile("/foo/bar.txt", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("error creating file: %v", err)
+			}
+			if _, err := out.Write(content); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+
+			// the sector size comes from the boot sector, not from the blocksize
+			fs, err = fat32.Read(file.New(f, true), size, 0, 0)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			if label := fs.Label(); label != "SECTORS" {
+				t.Errorf("mismatched label, expected SECTORS got %q", label)
+			}
+			in, err := fs.OpenFile("/foo/bar.txt", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("error opening file: %v", err)
+			}
+			b, err := io.ReadAll(in)
+			if err != nil {
+				t.Fatalf("error reading file: %v", err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("mismatched contents, expected %q got %q", content, b)
+			}
+		})
+	}
+}
+
+// images made by mkfs.vfat with 1024 and 2048-byte sectors must be readable
+func TestFat32ReadSectorSizeFixtures(t *testing.T) {
+	for _, fixture := range []string{fat32.Fat32File1K, fat32.Fat32File2K} {
+		t.Run(path.Base(fixture), func(t *testing.T) {
+			f, err := os.Open(fixture)
+			if err != nil {
+				t.Fatalf("error opening fixture: %v", err)
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatalf("error getting fixture size: %v", err)
+			}
+			fs, err := fat32.Read(file.New(f, true), fi.Size(), 0, 0)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			in, err := fs.OpenFile("/foo/CORTO1.TXT", os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("error opening file: %v", err)
+			}
+			b, err := io.ReadAll(in)
+			if err != nil {
+				t.Fatalf("error reading file: %v", err)
+			}
+			if expected := "Tenemos un archivo corto\n"; string(b) != expected {
+				t.Errorf("mismatched contents, expected %q got %q", expected, b)
+			}
+		})
+	}
+}
+
 func TestFat32ReadDir(t *testing.T) {
 	//nolint:thelper // this is not a helper function
 	runTest := func(t *testing.T, pre, post int64) {
@@ -1001,6 +1094,53 @@ func TestFat32MkdirCases(t *testing.T) {
 	}
 }
 
+func TestFat32PathLimits(t *testing.T) {
+	b, err := mem.New(10 * fat32.MB)
+	if err != nil {
+		t.Fatalf("error creating backend: %v", err)
+	}
+	fs, err := fat32.Create(b, 10*fat32.MB, 0, 512, "")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	longName := "/" + strings.Repeat("a", 256)
+	// 26 levels of 9 characters with their separators, and then a name of 25 with its own, is 1 past the limit of 259
+	deepDir := strings.Repeat("/abcdefgh", 26)
+	deepFile := deepDir + "/" + strings.Repeat("f", 25)
+	if err := fs.Mkdir(deepDir); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	if _, err := fs.OpenFile(deepFile[:len(deepFile)-1], os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatalf("unexpected error creating file of 259 characters: %v", err)
+	}
+	tests := []struct {
+		name     string
+		fn       func() error
+		expected error
+	}{
+		{"create long name", func() error { _, err := fs.OpenFile(longName, os.O_CREATE|os.O_RDWR); return err }, fat32.ErrNameTooLong},
+		{"open long name", func() error { _, err := fs.OpenFile(longName, os.O_RDONLY); return err }, fat32.ErrNameTooLong},
+		{"mkdir long name", func() error { return fs.Mkdir(longName + "/sub") }, fat32.ErrNameTooLong},
+		{"rename to long name", func() error { return fs.Rename(deepFile[:len(deepFile)-1], deepDir+longName) }, fat32.ErrNameTooLong},
+		{"create long path", func() error { _, err := fs.OpenFile(deepFile, os.O_CREATE|os.O_RDWR); return err }, fat32.ErrPathTooLong},
+		{"mkdir long path", func() error { return fs.Mkdir(deepFile) }, fat32.ErrPathTooLong},
+		{"rename to long path", func() error { return fs.Rename(deepFile[:len(deepFile)-1], deepFile) }, fat32.ErrPathTooLong},
+	}
+	for _, tt := range tests {
+		if err := tt.fn(); !errors.Is(err, tt.expected) {
+			t.Errorf("%s: error %v instead of %v", tt.name, err, tt.expected)
+		}
+	}
+	// nothing was created by the calls that failed
+	infos, err := fs.ReadDir(deepDir)
+	if err != nil {
+		t.Fatalf("unexpected error reading directory: %v", err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("directory has %d entries instead of 3", len(infos))
+	}
+}
+
 func Test83Lowercase(t *testing.T) {
 	// get a temporary working file
 	f, err := tmpFat32(true, 0, 0)
@@ -1082,6 +1222,90 @@ func TestOpenFileCaseInsensitive(t *testing.T) {
 	}
 }
 
+func TestNameNormalization(t *testing.T) {
+	// the same name, composed and decomposed
+	const (
+		nfc = "caf\u00e9.txt"
+		nfd = "cafe\u0301.txt"
+	)
+	b, err := mem.New(10 * fat32.MB)
+	if err != nil {
+		t.Fatalf("error creating backend: %v", err)
+	}
+	fs, err := fat32.Create(b, 10*fat32.MB, 0, 512, "NORMALIZE")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.Normalization(7)}); err == nil {
+		t.Errorf("setting an unknown normalization did not fail")
+	}
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.NormalizationNFC}); err != nil {
+		t.Fatalf("error setting normalization: %v", err)
+	}
+	// written in NFC, whatever it is created as
+	if err := fs.Mkdir("/cafe\u0301"); err != nil {
+		t.Fatalf("error making directory: %v", err)
+	}
+	if err := testMkFile(fs, "/cafe\u0301/"+nfd, 10); err != nil {
+		t.Fatalf("error making file: %v", err)
+	}
+	infos, err := fs.ReadDir("/caf\u00e9")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	if !slices.Contains(names, nfc) {
+		t.Errorf("directory has %q, expected %q", names, nfc)
+	}
+	// found by either name
+	for _, p := range []string{"/caf\u00e9/" + nfc, "/cafe\u0301/" + nfd, "/CAFE\u0301/" + strings.ToUpper(nfd)} {
+		f, err := fs.OpenFile(p, os.O_RDONLY)
+		if err != nil {
+			t.Errorf("error opening %q: %v", p, err)
+			continue
+		}
+		f.Close()
+	}
+	if err := fs.Rename("/caf\u00e9/"+nfd, "/caf\u00e9/other.txt"); err != nil {
+		t.Errorf("error renaming: %v", err)
+	}
+	if err := fs.Remove("/caf\u00e9/other.txt"); err != nil {
+		t.Errorf("error removing: %v", err)
+	}
+
+	// both forms written as they are, as an older tool would
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{}); err != nil {
+		t.Fatalf("error setting normalization: %v", err)
+	}
+	for i, name := range []string{nfc, nfd} {
+		if err := testMkFile(fs, "/"+name, i+1); err != nil {
+			t.Fatalf("error making file %q: %v", name, err)
+		}
+	}
+	// the one with the same bytes is opened, or, strictly, neither
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.NormalizationNFC}); err != nil {
+		t.Fatalf("error setting normalization: %v", err)
+	}
+	for i, name := range []string{nfc, nfd} {
+		f, err := fs.OpenFile("/"+name, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %q: %v", name, err)
+		}
+		if data, err := io.ReadAll(f); err != nil || len(data) != i+1 {
+			t.Errorf("opening %q read %d bytes, expected %d, error %v", name, len(data), i+1, err)
+		}
+	}
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.NormalizationNFC, Strict: true}); err != nil {
+		t.Fatalf("error setting normalization: %v", err)
+	}
+	if _, err := fs.OpenFile("/"+nfd, os.O_RDONLY); !errors.Is(err, filesystem.ErrAmbiguousName) {
+		t.Errorf("opening an ambiguous name gave error %v, expected %v", err, filesystem.ErrAmbiguousName)
+	}
+}
+
 func testMkFile(fs filesystem.FileSystem, p string, size int) error {
 	rw, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
 	if err != nil {
@@ -1519,3 +1743,739 @@ func Test_Remove(t *testing.T) {
 		})
 	}
 }
+
+// discardRecorder a backend that records the ranges it is told to discard, without discarding them
+type discardRecorder struct {
+	backend.Storage
+	discarded [][2]int64
+}
+
+func (d *discardRecorder) Discard(off, length int64) error {
+	d.discarded = append(d.discarded, [2]int64{off, length})
+	return nil
+}
+
+func TestRemoveDiscards(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "fat32_discard")
+	if err != nil {
+		t.Fatalf("error creating tempfile: %v", err)
+	}
+	defer f.Close()
+	b := &discardRecorder{Storage: file.New(f, false)}
+	fs, err := fat32.Create(b, 10*fat32.MB, 0, 512, "DISCARD")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	content := make([]byte, 100000)
+	_, _ = rand.Read(content)
+	rw, err := fs.OpenFile("/file.bin", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if _, err := rw.Write(content); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if len(b.discarded) != 0 {
+		t.Errorf("writing discarded %v", b.discarded)
+	}
+
+	// what was discarded, which is still there to read, is the content of the file, and the rest of its last cluster
+	if err := fs.Remove("/file.bin"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	var discarded []byte
+	for _, r := range b.discarded {
+		d := make([]byte, r[1])
+		if _, err := f.ReadAt(d, r[0]); err != nil {
+			t.Fatalf("error reading discarded range: %v", err)
+		}
+		discarded = append(discarded, d...)
+	}
+	if int64(len(discarded)) > int64(len(content))+fat32.MB || len(discarded) < len(content) || !bytes.Equal(discarded[:len(content)], content) {
+		t.Errorf("discarded %v instead of the clusters of the file", b.discarded)
+	}
+
+	b.discarded = nil
+	if err := fs.Remove("/dir"); err != nil {
+		t.Fatalf("error removing directory: %v", err)
+	}
+	if len(b.discarded) == 0 {
+		t.Errorf("removing a directory discarded nothing")
+	}
+}
+
+func TestFatTypeForSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		fatType  fat32.FatType
+		partType mbr.Type
+	}{
+		{1440 * fat32.KB, fat32.FatType12, mbr.Fat12},
+		{8400 * 512, fat32.FatType12, mbr.Fat12},
+		{8401 * 512, fat32.FatType16, mbr.Fat16},
+		{16 * fat32.MB, fat32.FatType16, mbr.Fat16},
+		{32 * fat32.MB, fat32.FatType16, mbr.Fat16bLBA},
+		{512 * fat32.MB, fat32.FatType16, mbr.Fat16bLBA},
+		{512*fat32.MB + 512, fat32.FatType32, mbr.Fat32LBA},
+		{10 * fat32.GB, fat32.FatType32, mbr.Fat32LBA},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.size), func(t *testing.T) {
+			fatType := fat32.FatTypeForSize(tt.size)
+			if fatType != tt.fatType {
+				t.Errorf("mismatched FAT type, actual %v expected %v", fatType, tt.fatType)
+			}
+			partType := fat32.PartitionTypeForSize(tt.size)
+			if partType != tt.partType {
+				t.Errorf("mismatched partition type, actual %#x expected %#x", partType, tt.partType)
+			}
+		})
+	}
+}
+
+// FAT12 and FAT16 filesystems must be created with the requested type and read back with the same contents
+func TestFat32CreateWithType(t *testing.T) {
+	tests := []struct {
+		size       int64
+		sectorSize int64
+		fatType    fat32.FatType
+		expected   fat32.FatType
+		err        string
+	}{
+		{1440 * fat32.KB, 512, fat32.FatType12, fat32.FatType12, ""},
+		{4 * fat32.MB, 512, 0, fat32.FatType12, ""},
+		{16 * fat32.MB, 512, fat32.FatType12, fat32.FatType12, ""},
+		{16 * fat32.MB, 512, 0, fat32.FatType16, ""},
+		{30 * fat32.MB, 4096, fat32.FatType16, fat32.FatType16, ""},
+		{100 * fat32.MB, 512, fat32.FatType16, fat32.FatType16, ""},
+		{20 * fat32.MB, 512, fat32.FatType32, fat32.FatType32, ""},
+		{1 * fat32.MB, 512, fat32.FatType16, 0, "requested size of 2048 sectors cannot be laid out as FAT16"},
+		{10 * fat32.GB, 512, fat32.FatType16, 0, "requested size of 20971520 sectors cannot be laid out as FAT16"},
+		{10 * fat32.MB, 512, 24, 0, "invalid FAT type 24"},
+	}
+	content := make([]byte, 50000)
+	_, _ = rand.Read(content)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %d %d", tt.size, tt.sectorSize, int(tt.fatType)), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat_type")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			if err := f.Truncate(tt.size); err != nil {
+				t.Fatalf("error sizing tempfile: %v", err)
+			}
+			fs, err := fat32.CreateWithType(file.New(f, false), tt.size, 0, tt.sectorSize, "SMALL", tt.fatType)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("mismatched error, expected %q got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			if fs.FatType() != tt.expected {
+				t.Errorf("created FAT type %v instead of %v", fs.FatType(), tt.expected)
+			}
+			if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+				t.Fatalf("error creating directory: %v", err)
+			}
+			for _, p := range []string{"/EFI/BOOT/BOOTX64.EFI", "/a long file name in the root.txt"} {
+				out, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("error creating file %s: %v", p, err)
+				}
+				if _, err := out.Write(content); err != nil {
+					t.Fatalf("error writing file %s: %v", p, err)
+				}
+			}
+			usage := fs.Usage()
+
+			fs, err = fat32.Read(file.New(f, true), tt.size, 0, 0)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			if fs.FatType() != tt.expected {
+				t.Errorf("read FAT type %v instead of %v", fs.FatType(), tt.expected)
+			}
+			if label := fs.Label(); label != "SMALL" {
+				t.Errorf("mismatched label, expected SMALL got %q", label)
+			}
+			if fs.Usage() != usage {
+				t.Errorf("mismatched usage, expected %+v got %+v", usage, fs.Usage())
+			}
+			entries, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("error reading root directory: %v", err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("root directory has %d entries instead of 2", len(entries))
+			}
+			for _, p := range []string{"/EFI/BOOT/BOOTX64.EFI", "/a long file name in the root.txt"} {
+				in, err := fs.OpenFile(p, os.O_RDONLY)
+				if err != nil {
+					t.Fatalf("error opening file %s: %v", p, err)
+				}
+				b, err := io.ReadAll(in)
+				if err != nil {
+					t.Fatalf("error reading file %s: %v", p, err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Errorf("mismatched contents of %s", p)
+				}
+			}
+		})
+	}
+
+	t.Run("full root directory", func(t *testing.T) {
+		const size = 1440 * fat32.KB
+		f, err := os.CreateTemp(t.TempDir(), "fat_type")
+		if err != nil {
+			t.Fatalf("error creating tempfile: %v", err)
+		}
+		defer f.Close()
+		if err := f.Truncate(size); err != nil {
+			t.Fatalf("error sizing tempfile: %v", err)
+		}
+		fs, err := fat32.CreateWithType(file.New(f, false), size, 0, 512, "", fat32.FatType12)
+		if err != nil {
+			t.Fatalf("error creating filesystem: %v", err)
+		}
+		// the label takes one of the 512 entries, and one is left empty
+		for i := 0; i < 510; i++ {
+			if err := fs.Mkdir(fmt.Sprintf("/D%d", i)); err != nil {
+				t.Fatalf("error creating directory %d: %v", i, err)
+			}
+		}
+		if err := fs.Mkdir("/ONEMORE"); err == nil {
+			t.Errorf("creating a directory in a full root directory did not return an error")
+		}
+	})
+}
+
+func TestFat32CreateWithParams(t *testing.T) {
+	tests := []struct {
+		size        int64
+		sectorSize  int64
+		fatType     fat32.FatType
+		clusterSize int64
+		expected    int64
+		err         string
+	}{
+		// the defaults of Microsoft's format
+		{40 * fat32.MB, 512, fat32.FatType32, 0, 512, ""},
+		{100 * fat32.MB, 512, fat32.FatType32, 0, 1 * fat32.KB, ""},
+		{200 * fat32.MB, 512, fat32.FatType32, 0, 2 * fat32.KB, ""},
+		{1 * fat32.GB, 512, fat32.FatType32, 0, 4 * fat32.KB, ""},
+		{12 * fat32.GB, 512, 0, 0, 8 * fat32.KB, ""},
+		{20 * fat32.GB, 512, 0, 0, 16 * fat32.KB, ""},
+		{40 * fat32.GB, 512, 0, 0, 32 * fat32.KB, ""},
+		{200 * fat32.MB, 4096, fat32.FatType32, 0, 4 * fat32.KB, ""},
+		{16 * fat32.MB, 512, fat32.FatType16, 0, 512, ""},
+		{100 * fat32.MB, 512, fat32.FatType16, 0, 2 * fat32.KB, ""},
+		{300 * fat32.MB, 512, fat32.FatType16, 0, 8 * fat32.KB, ""},
+		// overrides
+		{1 * fat32.GB, 512, fat32.FatType32, 512, 512, ""},
+		{100 * fat32.MB, 4096, fat32.FatType32, 16 * fat32.KB, 16 * fat32.KB, ""},
+		{100 * fat32.MB, 512, fat32.FatType16, 4 * fat32.KB, 4 * fat32.KB, ""},
+		{1 * fat32.GB, 512, fat32.FatType32, 3 * fat32.KB, 0, "invalid cluster size 3072"},
+		{1 * fat32.GB, 4096, fat32.FatType32, 2 * fat32.KB, 0, "invalid cluster size 2048"},
+		{1 * fat32.GB, 512, fat32.FatType32, 128 * fat32.KB, 0, "invalid cluster size 131072"},
+		{100 * fat32.MB, 512, fat32.FatType16, 512, 0, "requested size of 204800 sectors cannot be laid out as FAT16 with clusters of 512 bytes"},
+		{200 * fat32.GB, 512, fat32.FatType32, 512, 0, "requested size 214748364800 cannot be laid out as FAT32 with clusters of 512 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d %d %d %d", tt.size, tt.sectorSize, int(tt.fatType), tt.clusterSize), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "fat_params")
+			if err != nil {
+				t.Fatalf("error creating tempfile: %v", err)
+			}
+			defer f.Close()
+			if err := f.Truncate(tt.size); err != nil {
+				t.Fatalf("error sizing tempfile: %v", err)
+			}
+			fs, err := fat32.CreateWithParams(file.New(f, false), tt.size, 0, tt.sectorSize, &fat32.Params{FatType: tt.fatType, ClusterSize: tt.clusterSize})
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("mismatched error, expected %q got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error creating filesystem: %v", err)
+			}
+			info := fs.Info()
+			if info.ClusterSize != tt.expected {
+				t.Errorf("created clusters of %d bytes instead of %d", info.ClusterSize, tt.expected)
+			}
+			if info.SectorSize != tt.sectorSize || info.FatCount != 2 {
+				t.Errorf("created %d-byte sectors and %d FATs instead of %d and 2", info.SectorSize, info.FatCount, tt.sectorSize)
+			}
+			if end := info.DataStart + int64(info.Clusters)*info.ClusterSize; end > tt.size || tt.size-end >= info.ClusterSize {
+				t.Errorf("%d clusters from %d end at %d, not within a cluster of the size %d", info.Clusters, info.DataStart, end, tt.size)
+			}
+			if fs.FatType() == fat32.FatType32 && info.RootDirEntries != 0 || fs.FatType() != fat32.FatType32 && info.RootDirEntries == 0 {
+				t.Errorf("%s has %d root directory entries", fs.FatType(), info.RootDirEntries)
+			}
+
+			fs, err = fat32.Read(file.New(f, true), tt.size, 0, 0)
+			if err != nil {
+				t.Fatalf("error reading filesystem: %v", err)
+			}
+			if fs.Info() != info {
+				t.Errorf("mismatched info, expected %v got %v", info, fs.Info())
+			}
+		})
+	}
+}
+
+func TestCreateContext(t *testing.T) {
+	// FATs of several MB each, which are written a part at a time
+	const size = 4 * fat32.GB
+	create := func(t *testing.T, ctx context.Context, progress func(written, total int64)) (*fat32.FileSystem, error) {
+		t.Helper()
+		f, err := os.Create(filepath.Join(t.TempDir(), "fat32.img"))
+		if err != nil {
+			t.Fatalf("error creating image: %v", err)
+		}
+		t.Cleanup(func() { f.Close() })
+		if err := f.Truncate(size); err != nil {
+			t.Fatalf("error sizing image: %v", err)
+		}
+		return fat32.CreateContext(ctx, file.New(f, false), size, 0, 512, &fat32.Params{VolumeLabel: "PROGRESS", Progress: progress})
+	}
+
+	var calls, last, lastTotal int64
+	fs, err := create(t, context.Background(), func(written, total int64) {
+		if written <= last || written > total || (lastTotal != 0 && total != lastTotal) {
+			t.Errorf("progress went from %d of %d to %d of %d", last, lastTotal, written, total)
+		}
+		calls++
+		last, lastTotal = written, total
+	})
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	info := fs.Info()
+	if fats := int64(info.FatCount*info.SectorsPerFat) * info.SectorSize; last != fats || lastTotal != fats {
+		t.Errorf("progress ended at %d of %d instead of %d", last, lastTotal, fats)
+	}
+	if calls < 4 {
+		t.Errorf("progress was reported %d times, not for each part of the FATs", calls)
+	}
+	if err := fs.Check(false); err != nil {
+		t.Errorf("created filesystem is not consistent: %v", err)
+	}
+	if fs.Label() != "PROGRESS" {
+		t.Errorf("label is %q instead of %q", fs.Label(), "PROGRESS")
+	}
+
+	// cancelled part way through writing the FATs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls = 0
+	if _, err := create(t, ctx, func(_, _ int64) {
+		calls++
+		cancel()
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled create returned %v instead of %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("progress was reported %d times after cancelling", calls)
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	manifest := filesystem.Manifest{
+		{Path: "/EFI/BOOT", Mode: os.ModeDir},
+		{Path: "/EFI/BOOT/BOOTX64.EFI", Size: 1234567},
+		{Path: "/empty"},
+		{Path: "/a rather long file name that needs several slots.txt", Size: 512},
+	}
+	for i := 0; i < 40; i++ {
+		manifest = append(manifest, filesystem.ManifestEntry{Path: fmt.Sprintf("/data/sub/file-%02d.dat", i), Size: int64(i) * 3000})
+	}
+	size, err := fat32.EstimateSize(manifest)
+	if err != nil {
+		t.Fatalf("error estimating size: %v", err)
+	}
+	// the overhead is the tables, directories and partial clusters, which should be small
+	var dataSize int64
+	for _, e := range manifest {
+		dataSize += e.Size
+	}
+	if size < dataSize || size > dataSize+128*fat32.KB {
+		t.Errorf("estimated size %d out of range for %d bytes of data", size, dataSize)
+	}
+
+	// the image must not grow beyond the estimate when everything is written
+	tmpImgPath := filepath.Join(t.TempDir(), "fat32_estimate")
+	b, err := file.CreateFromPath(tmpImgPath, size)
+	if err != nil {
+		t.Fatalf("error creating image: %v", err)
+	}
+	defer b.Close()
+	fs, err := fat32.Create(b, size, 0, 512, "")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	for _, e := range manifest {
+		if e.Mode.IsDir() {
+			if err := fs.Mkdir(e.Path); err != nil {
+				t.Fatalf("error creating directory %s: %v", e.Path, err)
+			}
+			continue
+		}
+		if err := fs.Mkdir(path.Dir(e.Path)); err != nil {
+			t.Fatalf("error creating directory %s: %v", path.Dir(e.Path), err)
+		}
+		if err := testMkFile(fs, e.Path, int(e.Size)); err != nil {
+			t.Fatalf("error creating file %s: %v", e.Path, err)
+		}
+	}
+	info, err := os.Stat(tmpImgPath)
+	if err != nil {
+		t.Fatalf("error getting image info: %v", err)
+	}
+	if info.Size() != size {
+		t.Errorf("image grew to %d bytes beyond estimated %d", info.Size(), size)
+	}
+
+	// symlinks cannot be stored
+	if _, err := fat32.EstimateSize(filesystem.Manifest{{Path: "/link", Size: 4, Mode: os.ModeSymlink}}); err == nil {
+		t.Errorf("estimate with a symlink did not return an error")
+	}
+}
+
+func TestAttributesAndTimes(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "fat32_attrs")
+	if err != nil {
+		t.Fatalf("error creating tempfile: %v", err)
+	}
+	defer f.Close()
+	size := int64(10 * fat32.MB)
+	fs, err := fat32.Create(file.New(f, false), size, 0, 512, "ATTRS")
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	if err := fs.Mkdir("/EFI/BOOT"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	if err := testMkFile(fs, "/EFI/BOOT/BOOTX64.EFI", 1000); err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	epoch := time.Date(2020, time.February, 29, 13, 14, 16, 0, time.UTC)
+	for _, p := range []string{"/EFI", "/EFI/BOOT", "/EFI/BOOT/BOOTX64.EFI"} {
+		if err := fs.Chtimes(p, epoch, epoch); err != nil {
+			t.Fatalf("error setting times of %s: %v", p, err)
+		}
+	}
+	if err := fs.SetAttrs("/EFI/BOOT/bootx64.efi", fat32.AttrReadOnly|fat32.AttrHidden|fat32.AttrSystem); err != nil {
+		t.Fatalf("error setting attributes: %v", err)
+	}
+	if err := fs.SetAttrs("/EFI/BOOT", fat32.AttrHidden); err != nil {
+		t.Fatalf("error setting attributes of directory: %v", err)
+	}
+	// a zero time leaves the time as it is
+	if err := fs.Chtimes("/EFI/BOOT", time.Time{}, time.Time{}); err != nil {
+		t.Fatalf("error setting zero times: %v", err)
+	}
+	if err := fs.SetAttrs("/EFI", fat32.Attributes(0x10)); err == nil {
+		t.Errorf("setting the directory attribute did not return an error")
+	}
+	if err := fs.SetAttrs("/missing", fat32.AttrHidden); err == nil {
+		t.Errorf("setting attributes of a missing file did not return an error")
+	}
+
+	// read it back from disk
+	fs, err = fat32.Read(file.New(f, false), size, 0, 512)
+	if err != nil {
+		t.Fatalf("error reading filesystem: %v", err)
+	}
+	tests := []struct {
+		dir   string
+		name  string
+		attrs fat32.Attributes
+	}{
+		{"/", "EFI", 0},
+		{"/EFI", "BOOT", fat32.AttrHidden},
+		{"/EFI/BOOT", "BOOTX64.EFI", fat32.AttrReadOnly | fat32.AttrHidden | fat32.AttrSystem},
+	}
+	for _, tt := range tests {
+		infos, err := fs.ReadDir(tt.dir)
+		if err != nil {
+			t.Fatalf("error reading directory %s: %v", tt.dir, err)
+		}
+		var found bool
+		for _, info := range infos {
+			if info.Name() != tt.name {
+				continue
+			}
+			found = true
+			if !info.ModTime().Equal(epoch) {
+				t.Errorf("%s has modification time %v instead of %v", tt.name, info.ModTime(), epoch)
+			}
+			if attrs := info.(fat32.FileInfo).Attributes(); attrs != tt.attrs {
+				t.Errorf("%s has attributes %v instead of %v", tt.name, attrs, tt.attrs)
+			}
+		}
+		if !found {
+			t.Errorf("did not find %s in %s", tt.name, tt.dir)
+		}
+	}
+}
+
+// crashingStorage a faulty.Storage that crashes before a given write: from it on, every write fails, as if the
+// power were lost. Each write before it reaches the storage whole.
+type crashingStorage struct {
+	*faulty.Storage
+	writes, crashAt int
+}
+
+func (s *crashingStorage) Writable() (backend.WritableFile, error) {
+	if _, err := s.Storage.Writable(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crashingStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.writes++
+	if s.writes == s.crashAt {
+		s.Inject(faulty.Fault{Kind: faulty.WriteError})
+	}
+	return s.Storage.WriteAt(p, off)
+}
+
+func TestWriteOrderingCrash(t *testing.T) {
+	// a file whose clusters hold what looks like a directory entry, for a file GHOST.TXT at cluster 50, which
+	// a directory that gets its clusters once it is removed would have, were it to be linked before it is written
+	ghost := make([]byte, 32)
+	copy(ghost, "GHOST   TXT")
+	ghost[11] = 0x20
+	binary.LittleEndian.PutUint16(ghost[26:28], 50)
+	binary.LittleEndian.PutUint32(ghost[28:32], 4096)
+	ghost = bytes.Repeat(append(ghost, make([]byte, 512-32)...), 64)
+
+	// run the operations, stopping at the first that fails, once the filesystem is created
+	run := func(fs *fat32.FileSystem) error {
+		if err := fs.Mkdir("/dir"); err != nil {
+			return err
+		}
+		f, err := fs.OpenFile("/ghost.bin", os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(ghost); err != nil {
+			return err
+		}
+		if err := fs.Remove("/ghost.bin"); err != nil {
+			return err
+		}
+		// enough files that the directory needs more clusters
+		for i := 0; i < 20; i++ {
+			f, err := fs.OpenFile(fmt.Sprintf("/dir/file%02d.txt", i), os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write([]byte(fmt.Sprintf("file %d\n", i))); err != nil {
+				return err
+			}
+		}
+		// from the end, so that the directory needs fewer clusters, without moving the entries left in it
+		for i := 19; i >= 5; i-- {
+			if err := fs.Remove(fmt.Sprintf("/dir/file%02d.txt", i)); err != nil {
+				return err
+			}
+		}
+		if err := fs.Mkdir("/dir/sub/deeper"); err != nil {
+			return err
+		}
+		return fs.Close()
+	}
+
+	for _, fatType := range []fat32.FatType{fat32.FatType12, fat32.FatType16, fat32.FatType32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			// as small as each can be, with clusters of a single sector, as the FAT is written so often
+			sizes := map[fat32.FatType]int64{
+				fat32.FatType12: 1440 * fat32.KB,
+				fat32.FatType16: 16 * fat32.MB,
+				fat32.FatType32: 20 * fat32.MB,
+			}
+			size := sizes[fatType]
+			create := func(crashAt int) (*crashingStorage, *fat32.FileSystem) {
+				b, err := mem.New(size)
+				if err != nil {
+					t.Fatalf("unable to create buffer: %v", err)
+				}
+				s := &crashingStorage{Storage: faulty.New(b)}
+				fs, err := fat32.CreateWithType(s, size, 0, 512, "CRASH", fatType)
+				if err != nil {
+					t.Fatalf("error creating filesystem: %v", err)
+				}
+				s.writes, s.crashAt = 0, crashAt
+				return s, fs
+			}
+			s, fs := create(0)
+			if err := run(fs); err != nil {
+				t.Fatalf("unexpected error without a crash: %v", err)
+			}
+			if err := fs.Check(false); err != nil {
+				t.Fatalf("unexpected problems without a crash: %v", err)
+			}
+			writes := s.writes
+
+			for crashAt := 1; crashAt <= writes; crashAt++ {
+				s, fs := create(crashAt)
+				if err := run(fs); err == nil {
+					t.Fatalf("no error with a crash before write %d", crashAt)
+				}
+				s.Reset()
+				fs, err := fat32.Read(s, size, 0, 512)
+				if err != nil {
+					t.Fatalf("error reading filesystem after a crash before write %d: %v", crashAt, err)
+				}
+				// lost chains, chains longer than their files need, and copies of the FAT that differ, are to be
+				// expected, but nothing else
+				err = fs.Check(false)
+				if err == nil {
+					continue
+				}
+				for _, problem := range err.(interface{ Unwrap() []error }).Unwrap() {
+					if !strings.HasPrefix(problem.Error(), "lost chain") && problem.Error() != "the copies of the FAT differ" &&
+						!strings.Contains(problem.Error(), " clusters, but its chain has ") {
+						t.Errorf("crash before write %d of %d: %v", crashAt, writes, problem)
+					}
+				}
+				if err := fs.Check(true); err != nil {
+					t.Errorf("unexpected problems repairing after a crash before write %d: %v", crashAt, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTracer(t *testing.T) {
+	const (
+		size  = 16 * fat32.MB
+		start = 64 * fat32.KB
+	)
+	b, err := mem.New(start + size)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := fat32.CreateWithType(b, size, start, 512, "TRACE", fat32.FatType16)
+	if err != nil {
+		t.Fatalf("error creating filesystem: %v", err)
+	}
+	var events []fat32.TraceEvent
+	metrics := &fat32.Metrics{}
+	fs.SetTracer(func(e fat32.TraceEvent) {
+		e.Clusters = slices.Clone(e.Clusters)
+		events = append(events, e)
+		metrics.Trace(e)
+	})
+	// the events of each kind since the last call, and the clusters of them
+	since := 0
+	next := func(op fat32.TraceOp) (found []fat32.TraceEvent, clusters []uint32) {
+		for _, e := range events[since:] {
+			if e.Op == op {
+				found = append(found, e)
+				clusters = append(clusters, e.Clusters...)
+			}
+		}
+		return found, clusters
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 150)
+	f, err := fs.OpenFile("/file.bin", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	chain, err := f.(*fat32.File).GetClusterChain()
+	if err != nil {
+		t.Fatalf("error getting clusters of file: %v", err)
+	}
+	if _, allocated := next(fat32.TraceAllocate); !slices.Equal(allocated, chain) {
+		t.Errorf("allocated clusters %v instead of %v", allocated, chain)
+	}
+	writes, _ := next(fat32.TraceDataWrite)
+	if len(writes) != len(chain) {
+		t.Fatalf("%d data writes instead of %d", len(writes), len(chain))
+	}
+	for i, e := range writes {
+		if e.Cluster != chain[i] || e.Err != nil {
+			t.Errorf("data write to cluster %d with error %v instead of %d", e.Cluster, e.Err, chain[i])
+		}
+		// the offset is where the data is on the backend
+		got := make([]byte, e.Length)
+		if _, err := b.ReadAt(got, e.Offset); err != nil || !bytes.Equal(got, content[i*512:i*512+e.Length]) {
+			t.Errorf("data write of %d bytes at %#x does not match the data there", e.Length, e.Offset)
+		}
+	}
+	// the fixed root directory of FAT16 is before the clusters
+	dirWrites, _ := next(fat32.TraceDirWrite)
+	if len(dirWrites) == 0 || dirWrites[0].Cluster != 0 || dirWrites[0].Offset <= start || dirWrites[0].Offset >= writes[0].Offset {
+		t.Errorf("directory writes %v instead of to the root directory", dirWrites)
+	}
+	if fatWrites, _ := next(fat32.TraceFatWrite); len(fatWrites) == 0 {
+		t.Error("no FAT writes")
+	}
+
+	since = len(events)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("error seeking: %v", err)
+	}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes that do not match the %d written", len(got), len(content))
+	}
+	reads, _ := next(fat32.TraceDataRead)
+	read := 0
+	for _, e := range reads {
+		read += e.Length
+	}
+	if read != len(content) {
+		t.Errorf("data reads of %d bytes instead of %d", read, len(content))
+	}
+	if fatReads, _ := next(fat32.TraceFatRead); len(fatReads) == 0 || !slices.Equal(fatReads[0].Clusters, chain) {
+		t.Errorf("FAT reads %v instead of one of the chain %v", fatReads, chain)
+	}
+
+	since = len(events)
+	if err := fs.Remove("/file.bin"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if _, freed := next(fat32.TraceFree); !slices.Equal(freed, chain) {
+		t.Errorf("freed clusters %v instead of %v", freed, chain)
+	}
+
+	m := metrics.Get(fat32.TraceDataWrite)
+	if m.Count != int64(len(chain)) || m.Bytes != int64(len(content)) || m.Errors != 0 {
+		t.Errorf("data write metrics %+v instead of %d writes of %d bytes", m, len(chain), len(content))
+	}
+	metrics.Reset()
+	if m := metrics.Get(fat32.TraceDataWrite); m.Count != 0 {
+		t.Errorf("data write metrics %+v after reset", m)
+	}
+
+	// without a tracer, nothing is traced
+	fs.SetTracer(nil)
+	since = len(events)
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatalf("error making directory: %v", err)
+	}
+	if len(events) != since {
+		t.Errorf("%d events without a tracer", len(events)-since)
+	}
+}
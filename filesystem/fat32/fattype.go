@@ -0,0 +1,108 @@
+package fat32
+
+import (
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// FatType is the variant of FAT, named for the width in bits of each entry in the allocation table
+type FatType int
+
+const (
+	// FatType12 is FAT12, used for floppies and very small volumes
+	FatType12 FatType = 12
+	// FatType16 is FAT16, used for small volumes up to 512MB
+	FatType16 FatType = 16
+	// FatType32 is FAT32, used for everything larger
+	FatType32 FatType = 32
+)
+
+/*
+Thresholds follow the Microsoft defaults in fatgen103.pdf, which format.exe uses when
+picking the FAT variant for a volume of a given size, all in 512-byte sectors:
+
+	<= 8400 sectors (4.1MB)      FAT12 - DskTableFAT16 rejects anything this small
+	<= 1048576 sectors (512MB)   FAT16
+	 > 1048576 sectors           FAT32
+
+MBR partition types for FAT16 depend on whether the volume is under 32MB (65536 sectors), which
+is the limit of the original FAT16 type 0x04. Since go-diskfs only uses LBA addressing, larger
+volumes get the LBA variants.
+*/
+const (
+	fat12MaxSectors      int64 = 8400
+	fat16MaxSectors      int64 = 1048576
+	fat16SmallMaxSectors int64 = 65536
+)
+
+/*
+The variant on disk is not chosen by size, though, but by the count of data clusters, which is all that
+any FAT driver looks at for FAT12 and FAT16:
+
+	< 4085 clusters     FAT12
+	< 65525 clusters    FAT16
+
+FAT32 is marked instead by 0 sectors per FAT in the DOS 2.0 BPB, so is not limited to 65525 or more clusters.
+*/
+const (
+	fat12MaxClusters uint32 = 4084
+	fat16MaxClusters uint32 = 65524
+)
+
+func (t FatType) String() string {
+	switch t {
+	case FatType12:
+		return "FAT12"
+	case FatType16:
+		return "FAT16"
+	case FatType32:
+		return "FAT32"
+	default:
+		return fmt.Sprintf("unknown FAT type %d", int(t))
+	}
+}
+
+// fatTypeForClusters the variant of a FAT12 or FAT16 filesystem with the given count of data clusters
+func fatTypeForClusters(clusters uint32) FatType {
+	if clusters <= fat12MaxClusters {
+		return FatType12
+	}
+	return FatType16
+}
+
+// FatTypeForSize returns the FAT variant that Microsoft's format would choose for a volume of size bytes.
+func FatTypeForSize(size int64) FatType {
+	sectors := size / int64(SectorSize512)
+	switch {
+	case sectors <= fat12MaxSectors:
+		return FatType12
+	case sectors <= fat16MaxSectors:
+		return FatType16
+	default:
+		return FatType32
+	}
+}
+
+// MBRType returns the MBR partition type byte that matches this FAT variant for a partition of size bytes.
+// Bootloaders and some firmware check that byte against the actual variant, so it must be kept in sync with
+// the filesystem created in the partition.
+func (t FatType) MBRType(size int64) mbr.Type {
+	switch t {
+	case FatType12:
+		return mbr.Fat12
+	case FatType16:
+		if size/int64(SectorSize512) < fat16SmallMaxSectors {
+			return mbr.Fat16
+		}
+		return mbr.Fat16bLBA
+	default:
+		return mbr.Fat32LBA
+	}
+}
+
+// PartitionTypeForSize returns the MBR partition type byte for a FAT partition of size bytes, using the
+// FAT variant selected by FatTypeForSize.
+func PartitionTypeForSize(size int64) mbr.Type {
+	return FatTypeForSize(size).MBRType(size)
+}
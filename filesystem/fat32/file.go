@@ -96,7 +96,6 @@ func (fl *File) Read(b []byte) (int, error) {
 	start := int(fs.dataStart)
 	size := int(fl.fileSize) - int(fl.offset)
 	maxRead := size
-	file := fs.backend
 	clusters, err := fs.getClusterList(fl.clusterLocation)
 	if err != nil {
 		return totalRead, fmt.Errorf("unable to get list of clusters for file: %v", err)
@@ -123,28 +122,22 @@ func (fl *File) Read(b []byte) (int, error) {
 		remainder := fl.offset % int64(bytesPerCluster)
 		if remainder != 0 {
 			offset := int64(start) + int64(lastCluster-2)*int64(bytesPerCluster) + remainder
-			toRead := int64(bytesPerCluster) - remainder
-			if toRead > int64(len(b)) {
-				toRead = int64(len(b))
-			}
-			_, _ = file.ReadAt(b[0:toRead], offset+fs.start)
+			toRead := min(int64(bytesPerCluster)-remainder, int64(maxRead))
+			_ = fs.traceRead(TraceDataRead, b[0:toRead], offset+fs.start, lastCluster)
 			totalRead += int(toRead)
 			clusterIndex++
 		}
 	}
 
-	for i := clusterIndex; i < len(clusters); i++ {
+	for i := clusterIndex; i < len(clusters) && totalRead < maxRead; i++ {
 		left := maxRead - totalRead
 		toRead := bytesPerCluster
 		if toRead > left {
 			toRead = left
 		}
 		offset := int64(start) + int64(clusters[i]-2)*int64(bytesPerCluster)
-		_, _ = file.ReadAt(b[totalRead:totalRead+toRead], offset+fs.start)
+		_ = fs.traceRead(TraceDataRead, b[totalRead:totalRead+toRead], offset+fs.start, clusters[i])
 		totalRead += toRead
-		if totalRead >= maxRead {
-			break
-		}
 	}
 
 	fl.offset += int64(totalRead)
@@ -177,6 +170,9 @@ func (fl *File) Write(p []byte) (int, error) {
 	if !fl.isReadWrite {
 		return totalWritten, filesystem.ErrReadonlyFilesystem
 	}
+	if err := fs.markModified(); err != nil {
+		return totalWritten, err
+	}
 	// what is the new file size?
 	writeSize := len(p)
 	oldSize := int64(fl.fileSize)
@@ -184,16 +180,14 @@ func (fl *File) Write(p []byte) (int, error) {
 	if newSize < oldSize {
 		newSize = oldSize
 	}
-	// 1- ensure we have space and clusters
-	clusters, err := fs.allocateSpace(uint64(newSize), fl.clusterLocation)
+	// 1- ensure we have space and clusters; the FAT is only written once the data is in them, see the package
+	// documentation
+	a, err := fs.allocate(uint64(newSize), fl.clusterLocation)
 	if err != nil {
 		return 0x00, fmt.Errorf("unable to allocate clusters for file: %v", err)
 	}
+	clusters := a.clusters
 
-	// update the directory entry size for the file
-	if oldSize != newSize {
-		fl.fileSize = uint32(newSize)
-	}
 	// write the content for the file
 	bytesPerCluster := fl.filesystem.bytesPerCluster
 	start := int(fl.filesystem.dataStart)
@@ -212,8 +206,8 @@ func (fl *File) Write(p []byte) (int, error) {
 			if toWrite > int64(len(p)) {
 				toWrite = int64(len(p))
 			}
-			_, err := writableFile.WriteAt(p[0:toWrite], offset+fs.start)
-			if err != nil {
+			if err := fs.traceWrite(writableFile, TraceDataWrite, p[0:toWrite], offset+fs.start, lastCluster); err != nil {
+				fs.rollback(a)
 				return totalWritten, fmt.Errorf("unable to write to file: %v", err)
 			}
 			totalWritten += int(toWrite)
@@ -223,21 +217,33 @@ func (fl *File) Write(p []byte) (int, error) {
 
 	for i := clusterIndex; i < len(clusters); i++ {
 		left := len(p) - totalWritten
+		// the rest of the clusters are only those of the data after what is written
+		if left == 0 {
+			break
+		}
 		toWrite := bytesPerCluster
 		if toWrite > left {
 			toWrite = left
 		}
 		offset := int64(start) + int64(clusters[i]-2)*int64(bytesPerCluster)
-		_, err := writableFile.WriteAt(p[totalWritten:totalWritten+toWrite], offset+fs.start)
-		if err != nil {
+		if err := fs.traceWrite(writableFile, TraceDataWrite, p[totalWritten:totalWritten+toWrite], offset+fs.start, clusters[i]); err != nil {
+			fs.rollback(a)
 			return totalWritten, fmt.Errorf("unable to write to file: %v", err)
 		}
 		totalWritten += toWrite
 	}
 
+	// 2- link the clusters into the chain of the file
+	if err := fs.commit(a); err != nil {
+		return totalWritten, fmt.Errorf("unable to allocate clusters for file: %v", err)
+	}
+
 	fl.offset += int64(totalWritten)
 
-	// update the parent that we have changed the file size
+	// 3- update the parent that we have changed the file size
+	if oldSize != newSize {
+		fl.fileSize = uint32(newSize)
+	}
 	err = fs.writeDirectoryEntries(fl.parent)
 	if err != nil {
 		return 0, fmt.Errorf("error writing directory entries to disk: %v", err)
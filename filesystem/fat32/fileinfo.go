@@ -14,6 +14,7 @@ type FileInfo struct {
 	shortName string
 	size      int64
 	isDir     bool
+	attrs     Attributes
 }
 
 // IsDir abbreviation for Mode().IsDir()
@@ -69,3 +70,10 @@ func (fi FileInfo) Size() int64 {
 func (fi FileInfo) Sys() interface{} {
 	return nil
 }
+
+// Attributes the read-only, hidden, system and archive attributes of the file
+//
+//nolint:gocritic // we need this to comply with fs.FileInfo
+func (fi FileInfo) Attributes() Attributes {
+	return fi.attrs
+}
@@ -13,7 +13,7 @@ const msDosBootSectorSignature uint16 = 0x55aa
 type msDosBootSector struct {
 	jumpInstruction    [3]byte    // JumpInstruction is the instruction set to jump to for booting
 	oemName            string     // OEMName is the 8-byte OEM Name
-	biosParameterBlock *dos71EBPB // BIOSParameterBlock is the FAT32 Extended BIOS Parameter Block
+	biosParameterBlock *dos71EBPB // BIOSParameterBlock is the Extended BIOS Parameter Block, see dos40bpb.go for FAT12 and FAT16
 	bootCode           []byte     // BootCode represents the actual boot code
 }
 
@@ -40,10 +40,22 @@ func msDosBootSectorFromBytes(b []byte) (*msDosBootSector, error) {
 	copy(bs.jumpInstruction[:], b[0:3])
 	// extract the OEM name
 	bs.oemName = string(b[3:11])
-	// extract the EBPB and its size
-	bpb, bpbSize, err := dos71EBPBFromBytes(b[11:90])
-	if err != nil {
-		return nil, fmt.Errorf("could not read FAT32 BIOS Parameter Block from boot sector: %v", err)
+	// extract the EBPB and its size; only FAT12 and FAT16 have the sectors per FAT in the DOS 2.0 BPB
+	var (
+		bpb     *dos71EBPB
+		bpbSize int
+		err     error
+	)
+	if binary.LittleEndian.Uint16(b[22:24]) != 0 {
+		bpb, bpbSize, err = dos40EBPBFromBytes(b[11:62])
+		if err != nil {
+			return nil, fmt.Errorf("could not read FAT12/FAT16 BIOS Parameter Block from boot sector: %v", err)
+		}
+	} else {
+		bpb, bpbSize, err = dos71EBPBFromBytes(b[11:90])
+		if err != nil {
+			return nil, fmt.Errorf("could not read FAT32 BIOS Parameter Block from boot sector: %v", err)
+		}
 	}
 	bs.biosParameterBlock = bpb
 
@@ -81,9 +93,17 @@ func (m *msDosBootSector) toBytes() ([]byte, error) {
 	copy(b[3:11], oemName)
 
 	// bytes for the EBPB
-	bpbBytes, err := m.biosParameterBlock.toBytes()
+	var (
+		bpbBytes []byte
+		err      error
+	)
+	if m.biosParameterBlock.dos331BPB.dos20BPB.sectorsPerFat != 0 {
+		bpbBytes, err = m.biosParameterBlock.dos40Bytes()
+	} else {
+		bpbBytes, err = m.biosParameterBlock.toBytes()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error getting FAT32 EBPB: %v", err)
+		return nil, fmt.Errorf("error getting EBPB: %v", err)
 	}
 	copy(b[11:], bpbBytes)
 	bpbLen := len(bpbBytes)
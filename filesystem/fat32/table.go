@@ -5,8 +5,9 @@ import (
 	"slices"
 )
 
-// table a FAT32 table
+// table a FAT12, FAT16 or FAT32 table
 type table struct {
+	fatType        FatType // fatType is the width of the entries, FAT32 if unset
 	fatID          uint32
 	eocMarker      uint32
 	unusedMarker   uint32
@@ -23,7 +24,8 @@ func (t *table) equal(a *table) bool {
 	if t == nil && a == nil {
 		return true
 	}
-	return t.fatID == a.fatID &&
+	return t.entryBits() == a.entryBits() &&
+		t.fatID == a.fatID &&
 		t.eocMarker == a.eocMarker &&
 		t.rootDirCluster == a.rootDirCluster &&
 		t.size == a.size &&
@@ -33,53 +35,162 @@ func (t *table) equal(a *table) bool {
 
 /*
   when reading from disk, remember that *any* of the following is a valid eocMarker:
-  0x?ffffff8 - 0x?fffffff
+  0x?ffffff8 - 0x?fffffff for FAT32, 0xfff8 - 0xffff for FAT16 and 0xff8 - 0xfff for FAT12
 */
 
-func tableFromBytes(b []byte) *table {
-	maxCluster := uint32(len(b) / 4)
-
+func tableFromBytes(b []byte, fatType FatType) *table {
 	t := table{
-		fatID:          binary.LittleEndian.Uint32(b[0:4]),
-		eocMarker:      binary.LittleEndian.Uint32(b[4:8]),
-		size:           uint32(len(b)),
-		clusters:       make([]uint32, maxCluster+1),
-		maxCluster:     maxCluster,
-		rootDirCluster: 2, // always 2 for FAT32
+		fatType: fatType,
+		size:    uint32(len(b)),
+	}
+	maxCluster := uint32(len(b)) * 8 / t.entryBits()
+	t.maxCluster = maxCluster
+	t.clusters = make([]uint32, maxCluster+1)
+	t.fatID = t.entry(b, 0)
+	t.eocMarker = t.entry(b, 1)
+	// FAT12 and FAT16 have their root directory outside of the clusters, for FAT32 it always is at 2
+	if t.entryBits() == 32 {
+		t.rootDirCluster = 2
 	}
 	// just need to map the clusters in
 	for i := uint32(2); i < t.maxCluster; i++ {
-		bStart := i * 4
-		bEnd := bStart + 4
-		val := binary.LittleEndian.Uint32(b[bStart:bEnd])
 		// 0 indicates an empty cluster, so we can ignore
-		if val != 0 {
+		if val := t.entry(b, i); val != 0 {
 			t.clusters[i] = val
 		}
 	}
 	return &t
 }
 
-// bytes returns a FAT32 table as bytes ready to be written to disk
+// bytes returns a FAT table as bytes ready to be written to disk
 func (t *table) bytes() []byte {
 	b := make([]byte, t.size)
+	t.bytesAt(b, 0)
+	return b
+}
 
-	// FAT ID and fixed values
-	binary.LittleEndian.PutUint32(b[0:4], t.fatID)
-	// End-of-Cluster marker
-	binary.LittleEndian.PutUint32(b[4:8], t.eocMarker)
-	// now just clusters
-	numClusters := t.maxCluster
-	for i := uint32(2); i < numClusters; i++ {
-		bStart := i * 4
-		bEnd := bStart + 4
+// bytesAt fill b with the part of the FAT table that starts at byte off of it, as it is written to disk, so that
+// a large table can be written a part at a time. off must be at the start of an entry, and for FAT12, of a pair of
+// entries, which take 3 bytes.
+func (t *table) bytesAt(b []byte, off uint32) {
+	clear(b)
+	bits := uint64(t.entryBits())
+	first := uint32(uint64(off) * 8 / bits)
+	end := min(uint32((uint64(off)+uint64(len(b)))*8/bits), t.maxCluster)
+	for i := first; i < end; i++ {
+		// FAT ID and fixed values, End-of-Cluster marker, then just clusters
 		val := t.clusters[i]
-		binary.LittleEndian.PutUint32(b[bStart:bEnd], val)
+		switch i {
+		case 0:
+			val = t.fatID
+		case 1:
+			val = t.eocMarker
+		}
+		t.putEntry(b, i-first, val)
 	}
+}
 
-	return b
+// entryBits the width in bits of each entry in the table
+func (t *table) entryBits() uint32 {
+	switch t.fatType {
+	case FatType12:
+		return 12
+	case FatType16:
+		return 16
+	default:
+		return 32
+	}
+}
+
+// entry read entry i of the table from its bytes on disk
+func (t *table) entry(b []byte, i uint32) uint32 {
+	switch t.entryBits() {
+	case 12:
+		// two entries are packed into every 3 bytes, the even one in the low 12 bits
+		offset := i * 3 / 2
+		val := uint32(binary.LittleEndian.Uint16(b[offset : offset+2]))
+		if i%2 == 1 {
+			return val >> 4
+		}
+		return val & 0xfff
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(b[i*2 : i*2+2]))
+	default:
+		return binary.LittleEndian.Uint32(b[i*4 : i*4+4])
+	}
+}
+
+// putEntry write entry i of the table to its bytes on disk
+func (t *table) putEntry(b []byte, i, val uint32) {
+	switch t.entryBits() {
+	case 12:
+		offset := i * 3 / 2
+		packed := uint32(binary.LittleEndian.Uint16(b[offset : offset+2]))
+		if i%2 == 1 {
+			packed = packed&0x000f | (val&0xfff)<<4
+		} else {
+			packed = packed&0xf000 | val&0xfff
+		}
+		binary.LittleEndian.PutUint16(b[offset:offset+2], uint16(packed))
+	case 16:
+		binary.LittleEndian.PutUint16(b[i*2:i*2+2], uint16(val))
+	default:
+		binary.LittleEndian.PutUint32(b[i*4:i*4+4], val)
+	}
+}
+
+// truncate limit the table to the clusters that exist on disk; the FAT12 and FAT16 tables are rounded
+// up to whole sectors, so have more entries than there are clusters
+func (t *table) truncate(dataClusters uint32) {
+	if maxCluster := dataClusters + 2; maxCluster < t.maxCluster {
+		t.maxCluster = maxCluster
+		t.clusters = t.clusters[:maxCluster+1]
+	}
+}
+
+// endOfChain the value that marks the last cluster of a chain
+func (t *table) endOfChain() uint32 {
+	switch t.entryBits() {
+	case 12:
+		return 0xfff
+	case 16:
+		return 0xffff
+	default:
+		return 0x0fffffff
+	}
+}
+
+// cleanShutdownBit the bit of FAT[1] that is set while the filesystem is cleanly closed, and clear while it is in
+// use, so that a filesystem that was not closed can be checked. FAT12 has none.
+func (t *table) cleanShutdownBit() uint32 {
+	switch t.entryBits() {
+	case 16:
+		return 0x8000
+	case 32:
+		return 0x08000000
+	default:
+		return 0
+	}
+}
+
+// isDirty whether FAT[1] says that the filesystem was not cleanly closed
+func (t *table) isDirty() bool {
+	bit := t.cleanShutdownBit()
+	return bit != 0 && t.eocMarker&bit == 0
 }
 
 func (t *table) isEoc(cluster uint32) bool {
-	return cluster&0xFFFFFF8 == 0xFFFFFF8
+	switch t.entryBits() {
+	case 12:
+		return cluster >= 0xff8
+	case 16:
+		return cluster >= 0xfff8
+	default:
+		return cluster&0xFFFFFF8 == 0xFFFFFF8
+	}
+}
+
+// badCluster the value that marks a cluster as bad, so that it is never allocated
+func (t *table) badCluster() uint32 {
+	return t.endOfChain() - 8
 }
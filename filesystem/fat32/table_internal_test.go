@@ -32,7 +32,7 @@ func TestFat32TableFromBytes(t *testing.T) {
 			t.Fatalf("error reading test fixture data from %s: %v", Fat32File, err)
 		}
 		b := input[fsInfo.firstFAT : fsInfo.firstFAT+fsInfo.sectorsPerFAT*fsInfo.bytesPerSector]
-		result := tableFromBytes(b)
+		result := tableFromBytes(b, FatType32)
 		if result == nil {
 			t.Fatalf("returned FAT32 Table was nil unexpectedly")
 		}
@@ -91,3 +91,62 @@ func TestFat32TableIsEoc(t *testing.T) {
 		}
 	}
 }
+
+func TestTableEntryWidths(t *testing.T) {
+	tests := []struct {
+		fatType FatType
+		size    uint32
+		entries map[uint32]uint32
+		bytes   []byte
+	}{
+		// two 12-bit entries share the middle byte of every three
+		{FatType12, 9, map[uint32]uint32{2: 0x123, 3: 0xfff, 4: 0x005}, []byte{0xf8, 0xff, 0xff, 0x23, 0xf1, 0xff, 0x05, 0x00, 0x00}},
+		{FatType16, 12, map[uint32]uint32{2: 0x1234, 3: 0xffff, 4: 0x0005}, []byte{0xf8, 0xff, 0xff, 0xff, 0x34, 0x12, 0xff, 0xff, 0x05, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fatType.String(), func(t *testing.T) {
+			tab := tableFromBytes(tt.bytes, tt.fatType)
+			if tab.maxCluster != tt.size*8/uint32(tt.fatType) {
+				t.Errorf("mismatched maxCluster %d", tab.maxCluster)
+			}
+			for i, val := range tt.entries {
+				if tab.clusters[i] != val {
+					t.Errorf("cluster %d: actual %#x expected %#x", i, tab.clusters[i], val)
+				}
+			}
+			if !tab.isEoc(tab.eocMarker) || tab.isEoc(tt.entries[2]) {
+				t.Errorf("mismatched end of chain detection for %#x", tab.eocMarker)
+			}
+			if b := tab.bytes(); !bytes.Equal(b, tt.bytes) {
+				t.Errorf("mismatched bytes, actual % x expected % x", b, tt.bytes)
+			}
+		})
+	}
+}
+
+func TestTableBytesAt(t *testing.T) {
+	for _, fatType := range []FatType{FatType12, FatType16, FatType32} {
+		t.Run(fatType.String(), func(t *testing.T) {
+			// a table that does not end on a whole part, with every entry different
+			const size = 600
+			tab := &table{fatType: fatType, fatID: 0xff8, eocMarker: 0xfff, size: size}
+			tab.maxCluster = size * 8 / tab.entryBits()
+			tab.clusters = make([]uint32, tab.maxCluster+1)
+			for i := range tab.clusters {
+				tab.clusters[i] = uint32(i) * 7 & (1<<tab.entryBits() - 1)
+			}
+			expected := tab.bytes()
+			for _, partSize := range []uint32{12, 48, 96} {
+				var actual []byte
+				for off := uint32(0); off < size; off += partSize {
+					part := make([]byte, min(partSize, size-off))
+					tab.bytesAt(part, off)
+					actual = append(actual, part...)
+				}
+				if !bytes.Equal(actual, expected) {
+					t.Errorf("table in parts of %d bytes did not match the whole table", partSize)
+				}
+			}
+		})
+	}
+}
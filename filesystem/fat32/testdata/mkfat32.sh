@@ -38,6 +38,14 @@ until [ $i -gt 75 ]; do mmd -i /data/fat32.img ::/foo/dir${i}; i=$(( $i+1 )); do
 
 fatlabel /data/fat32.img go-diskfs
 
+# images with larger logical sectors
+for sectorsize in 1024 2048; do
+  dd if=/dev/zero of=/data/fat32-${sectorsize}.img bs=1M count=10
+  mkfs.vfat -v -F 32 -S ${sectorsize} /data/fat32-${sectorsize}.img
+  mmd -i /data/fat32-${sectorsize}.img ::/foo
+  mcopy -i /data/fat32-${sectorsize}.img /CORTO1.TXT ::/foo/
+done
+
 # now get the information we need to build the testdata
 
 # root dir info
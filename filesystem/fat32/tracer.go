@@ -0,0 +1,217 @@
+package fat32
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// TraceOp the kind of operation that a Tracer is told about
+type TraceOp int
+
+const (
+	// TraceFatRead a cluster chain was looked up in the FAT. The FAT is read from disk once, by Read, and kept in
+	// memory, so this is every walk of a chain in it, which is where a corrupt FAT shows.
+	TraceFatRead TraceOp = iota
+	// TraceFatWrite a copy of the FAT, or a part of one, as a large FAT is written a part at a time, or of its first
+	// two entries with the mark of a clean shutdown, was written
+	TraceFatWrite
+	// TraceFsisWrite the FS Information Sector, or its backup, was written
+	TraceFsisWrite
+	// TraceAllocate clusters were allocated, as written to the FAT
+	TraceAllocate
+	// TraceFree clusters were freed, as written to the FAT
+	TraceFree
+	// TraceDirRead a cluster of a directory, or the fixed root directory of FAT12 and FAT16, was read
+	TraceDirRead
+	// TraceDirWrite a cluster of a directory, or the fixed root directory of FAT12 and FAT16, was written with
+	// its entries
+	TraceDirWrite
+	// TraceDataRead data of a file was read from a cluster
+	TraceDataRead
+	// TraceDataWrite data of a file was written to a cluster
+	TraceDataWrite
+)
+
+// String the name of the operation, as in a log
+func (op TraceOp) String() string {
+	switch op {
+	case TraceFatRead:
+		return "fat-read"
+	case TraceFatWrite:
+		return "fat-write"
+	case TraceFsisWrite:
+		return "fsis-write"
+	case TraceAllocate:
+		return "allocate"
+	case TraceFree:
+		return "free"
+	case TraceDirRead:
+		return "dir-read"
+	case TraceDirWrite:
+		return "dir-write"
+	case TraceDataRead:
+		return "data-read"
+	case TraceDataWrite:
+		return "data-write"
+	default:
+		return fmt.Sprintf("TraceOp(%d)", int(op))
+	}
+}
+
+// TraceEvent a single operation of a filesystem, as given to a Tracer
+type TraceEvent struct {
+	Op TraceOp
+	// Offset where the operation read or wrote on the backend, in bytes, which includes the start of the
+	// filesystem, so is where to look in the image. For TraceFatRead, it is the entry of the first cluster of the
+	// chain in the first FAT; for TraceAllocate and TraceFree, 0.
+	Offset int64
+	// Length how many bytes were read or written; 0 for TraceFatRead, TraceAllocate and TraceFree
+	Length int
+	// Cluster the cluster that was read or written, or the first cluster of the chain for TraceFatRead; 0 for the
+	// FAT, the FS Information Sector and the fixed root directory of FAT12 and FAT16
+	Cluster uint32
+	// Clusters the chain for TraceFatRead, as far as it was valid, and the clusters allocated or freed for
+	// TraceAllocate and TraceFree
+	Clusters []uint32
+	// Duration how long the operation took
+	Duration time.Duration
+	// Err the error of the operation, if it failed
+	Err error
+}
+
+// String describe the event in a single line, as for a log
+func (e TraceEvent) String() string {
+	s := e.Op.String()
+	switch e.Op {
+	case TraceFatRead:
+		s += fmt.Sprintf(" chain of cluster %d at %#x: %d clusters", e.Cluster, e.Offset, len(e.Clusters))
+	case TraceAllocate, TraceFree:
+		s += fmt.Sprintf(" %d clusters %v", len(e.Clusters), e.Clusters)
+	default:
+		s += fmt.Sprintf(" %d bytes at %#x", e.Length, e.Offset)
+		if e.Cluster != 0 {
+			s += fmt.Sprintf(" (cluster %d)", e.Cluster)
+		}
+	}
+	s += fmt.Sprintf(" in %v", e.Duration)
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// Tracer is called, synchronously, after each operation of a filesystem, see SetTracer. It must not use the
+// filesystem, and must not keep e.Clusters, which can be changed after it returns.
+type Tracer func(e TraceEvent)
+
+// SetTracer set a function to be called after each read and write of the FAT, the FS Information Sector,
+// directories and the data of files, and after each allocation and freeing of clusters, e.g. to find where an
+// image gets corrupted, or to collect metrics with a Metrics. A nil tracer turns tracing off, which is the default.
+func (fs *FileSystem) SetTracer(t Tracer) {
+	fs.tracer = t
+}
+
+// trace tell the tracer, if there is one, about an operation that started at start
+func (fs *FileSystem) trace(e TraceEvent, start time.Time) {
+	if fs.tracer == nil {
+		return
+	}
+	e.Duration = time.Since(start)
+	fs.tracer(e)
+}
+
+// traceRead read b from the backend at offset, and trace it
+func (fs *FileSystem) traceRead(op TraceOp, b []byte, offset int64, cluster uint32) error {
+	start := time.Now()
+	n, err := fs.backend.ReadAt(b, offset)
+	fs.trace(TraceEvent{Op: op, Offset: offset, Length: n, Cluster: cluster, Err: err}, start)
+	return err
+}
+
+// traceWrite write b to the backend at offset, and trace it
+func (fs *FileSystem) traceWrite(w backend.WritableFile, op TraceOp, b []byte, offset int64, cluster uint32) error {
+	start := time.Now()
+	n, err := w.WriteAt(b, offset)
+	if err == nil && n != len(b) {
+		err = fmt.Errorf("wrote %d bytes instead of expected %d", n, len(b))
+	}
+	fs.trace(TraceEvent{Op: op, Offset: offset, Length: n, Cluster: cluster, Err: err}, start)
+	return err
+}
+
+// traceAllocation trace the clusters that an allocation, just committed, allocated and freed
+func (fs *FileSystem) traceAllocation(a *allocation) {
+	var allocated, freed []uint32
+	for cluster, previous := range a.previous {
+		switch current := fs.table.clusters[cluster]; {
+		case previous == fs.table.unusedMarker && current != fs.table.unusedMarker:
+			allocated = append(allocated, cluster)
+		case previous != fs.table.unusedMarker && current == fs.table.unusedMarker:
+			freed = append(freed, cluster)
+		}
+	}
+	if len(allocated) > 0 {
+		slices.Sort(allocated)
+		fs.trace(TraceEvent{Op: TraceAllocate, Clusters: allocated}, time.Now())
+	}
+	if len(freed) > 0 {
+		slices.Sort(freed)
+		fs.trace(TraceEvent{Op: TraceFree, Clusters: freed}, time.Now())
+	}
+}
+
+// OpMetrics the totals of one kind of operation
+type OpMetrics struct {
+	Count    int64
+	Errors   int64
+	Bytes    int64
+	Clusters int64
+	Duration time.Duration
+}
+
+// Metrics totals of the operations of a filesystem, by kind, collected by its Trace method as a Tracer, e.g.
+//
+//	m := &fat32.Metrics{}
+//	fs.SetTracer(m.Trace)
+//
+// It is safe to read while the filesystem is used in another goroutine.
+type Metrics struct {
+	mu  sync.Mutex
+	ops map[TraceOp]OpMetrics
+}
+
+// Trace add an operation to the totals; it is a Tracer
+func (m *Metrics) Trace(e TraceEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ops == nil {
+		m.ops = map[TraceOp]OpMetrics{}
+	}
+	o := m.ops[e.Op]
+	o.Count++
+	if e.Err != nil {
+		o.Errors++
+	}
+	o.Bytes += int64(e.Length)
+	o.Clusters += int64(len(e.Clusters))
+	o.Duration += e.Duration
+	m.ops[e.Op] = o
+}
+
+// Get the totals of one kind of operation
+func (m *Metrics) Get(op TraceOp) OpMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ops[op]
+}
+
+// Reset set all of the totals back to 0
+func (m *Metrics) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.ops)
+}
@@ -2,7 +2,9 @@ package fat32
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+	"unicode/utf16"
 )
 
 const (
@@ -18,6 +20,43 @@ const (
 	Fat32MaxSize int64 = 2198754099200
 )
 
+const (
+	// maxLongFilenameLength maximum length of a long filename, in UTF-16 code units
+	maxLongFilenameLength = 255
+	// maxPathLength maximum length of a path from the root, in UTF-16 code units with a separator before each
+	// name, that can be created, as Windows holds it in MAX_PATH of 260 with its terminating null
+	maxPathLength = 259
+)
+
+var (
+	// ErrNameTooLong a name in a path is longer than the 255 UTF-16 code units that a long filename can hold
+	ErrNameTooLong = errors.New("name too long")
+	// ErrPathTooLong a path that would be created is longer than the 259 UTF-16 code units that Windows can
+	// open, which is also what limits how deeply directories can be nested
+	ErrPathTooLong = errors.New("path too long")
+)
+
+// checkPath check that every name in the path p fits in a long filename, and, if it is to be created, that the whole
+// path is no longer than Windows can open, so that a path that FAT32 cannot hold fails before anything is written
+func checkPath(p string, create bool) error {
+	paths, err := splitPath(p)
+	if err != nil {
+		return err
+	}
+	length := 0
+	for _, name := range paths {
+		n := len(utf16.Encode([]rune(name)))
+		if n > maxLongFilenameLength {
+			return fmt.Errorf("name %s in %s is %d characters, longer than the maximum of %d: %w", name, p, n, maxLongFilenameLength, ErrNameTooLong)
+		}
+		length += 1 + n
+	}
+	if create && length > maxPathLength {
+		return fmt.Errorf("path %s is %d characters with %d levels of directories, longer than the maximum of %d: %w", p, length, len(paths)-1, maxPathLength, ErrPathTooLong)
+	}
+	return nil
+}
+
 func universalizePath(p string) (string, error) {
 	// globalize the separator
 	ps := strings.ReplaceAll(p, "\\", "/")
@@ -4,7 +4,9 @@ package filesystem
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"time"
 )
 
 var (
@@ -48,6 +50,82 @@ type FileSystem interface {
 	SetLabel(label string) error
 }
 
+// UsageReporter a FileSystem that can tell what it is and how much space it has, as all of those of
+// this module do
+type UsageReporter interface {
+	// UUID get the unique identifier of the filesystem, in the same form as blkid reports it,
+	// or "" if the filesystem has none.
+	UUID() string
+	// Usage get the size of the filesystem and how much of it is free
+	Usage() Usage
+}
+
+// TimesChanger a FileSystem that can change the times of its files
+type TimesChanger interface {
+	// Chtimes changes the access and modification times of the named file, as os.Chtimes does.
+	// A zero time.Time leaves that time unchanged.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// LinkReader a FileSystem that can read the targets of its symbolic links
+type LinkReader interface {
+	// Readlink returns the target of the named symbolic link.
+	Readlink(name string) (string, error)
+}
+
+// Chtimes changes the access and modification times of the named file in fs, if fs is a TimesChanger,
+// otherwise it returns an error wrapping ErrNotSupported
+func Chtimes(fs FileSystem, name string, atime, mtime time.Time) error {
+	c, ok := fs.(TimesChanger)
+	if !ok {
+		return fmt.Errorf("cannot change times of %s: %w", name, ErrNotSupported)
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+// Readlink returns the target of the named symbolic link in fs, if fs is a LinkReader,
+// otherwise it returns an error wrapping ErrNotSupported
+func Readlink(fs FileSystem, name string) (string, error) {
+	l, ok := fs.(LinkReader)
+	if !ok {
+		return "", fmt.Errorf("cannot read symbolic link %s: %w", name, ErrNotSupported)
+	}
+	return l.Readlink(name)
+}
+
+// ownerInfo the uid and gid that the FileInfo of several filesystems report, either itself or from Sys()
+type ownerInfo interface {
+	UID() uint32
+	GID() uint32
+}
+
+// Owner returns the uid and gid of the file that info describes, and whether the filesystem reports them at all,
+// as several do, in the FileInfo itself or in what its Sys() returns
+func Owner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	o, ok := info.(ownerInfo)
+	if !ok {
+		o, ok = info.Sys().(ownerInfo)
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	return o.UID(), o.GID(), true
+}
+
+// IsUnsupported reports whether err, from setting an attribute of a file such as its owner, mode or times, means
+// only that the filesystem does not keep that attribute, as FAT32 keeps no owner, so that it can be left out
+func IsUnsupported(err error) bool {
+	return errors.Is(err, ErrNotSupported) || errors.Is(err, ErrNotImplemented)
+}
+
+// Usage is how much space a filesystem has, and how much of it is free
+type Usage struct {
+	// Size is the total size of the filesystem in bytes, including its own metadata
+	Size int64
+	// Free is how many bytes are available for new files and directories
+	Free int64
+}
+
 // Type represents the type of disk this is
 type Type int
 
@@ -60,4 +138,40 @@ const (
 	TypeSquashfs
 	// TypeExt4 is an ext4 compatible filesystem
 	TypeExt4
+	// TypeExFAT is an exFAT filesystem
+	TypeExFAT
+	// TypeUDF is a UDF filesystem
+	TypeUDF
+	// TypeXFS is an XFS filesystem
+	TypeXFS
+	// TypeNTFS is an NTFS filesystem
+	TypeNTFS
+	// TypeErofs is an EROFS filesystem
+	TypeErofs
 )
+
+// String returns the name of the filesystem type, as used by blkid and mount
+func (t Type) String() string {
+	switch t {
+	case TypeFat32:
+		return "vfat"
+	case TypeISO9660:
+		return "iso9660"
+	case TypeSquashfs:
+		return "squashfs"
+	case TypeExt4:
+		return "ext4"
+	case TypeExFAT:
+		return "exfat"
+	case TypeUDF:
+		return "udf"
+	case TypeXFS:
+		return "xfs"
+	case TypeNTFS:
+		return "ntfs"
+	case TypeErofs:
+		return "erofs"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
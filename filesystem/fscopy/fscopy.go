@@ -0,0 +1,289 @@
+// Package fscopy copies whole directory trees between the local filesystem and a filesystem.FileSystem,
+// keeping the mode, ownership, symlinks and modification times of what it copies where the filesystem supports them.
+package fscopy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// Progress is called after each file, directory or symlink is copied, with its path in the filesystem,
+// and the total number of bytes of file contents copied so far
+type Progress func(p string, copied int64)
+
+type copyOpts struct {
+	progress Progress
+}
+
+// Opt func that process CopyTreeIn and CopyTreeOut options
+type Opt func(o *copyOpts) error
+
+// WithProgress calls progress after each entry that is copied
+func WithProgress(progress Progress) Opt {
+	return func(o *copyOpts) error {
+		o.progress = progress
+		return nil
+	}
+}
+
+// dirAttributes the mode and modification time of a directory, which are set only once everything in it
+// has been copied, so that copying its contents neither changes the time nor is refused by a read-only mode
+type dirAttributes struct {
+	path    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func parseOpts(opts []Opt) (*copyOpts, error) {
+	o := &copyOpts{progress: func(string, int64) {}}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// CopyTreeIn copy everything under the directory srcDir on the local filesystem into the root of fs, creating
+// directories, files and symlinks, and then setting their mode, uid and gid, and modification time. Attributes
+// that fs does not support, such as ownership on FAT32, are left out. Symlinks are copied as they are, not followed,
+// and the root of fs itself is not changed. Device files, fifos and sockets cannot be copied and are an error.
+func CopyTreeIn(fs filesystem.FileSystem, srcDir string, opts ...Opt) error {
+	o, err := parseOpts(opts)
+	if err != nil {
+		return err
+	}
+	var (
+		copied int64
+		dirs   []dirAttributes
+	)
+	err = filepath.WalkDir(srcDir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		dst := "/" + filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := fs.Mkdir(dst); err != nil {
+				return fmt.Errorf("could not create directory %s: %w", dst, err)
+			}
+			dirs = append(dirs, dirAttributes{path: dst, mode: mode, modTime: info.ModTime()})
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return fmt.Errorf("could not read symlink %s: %w", p, err)
+			}
+			if err := fs.Symlink(target, dst); err != nil {
+				return fmt.Errorf("could not create symlink %s: %w", dst, err)
+			}
+		case mode.IsRegular():
+			n, err := copyFileIn(fs, p, dst)
+			copied += n
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot copy %s: unsupported file type %v", p, mode.Type())
+		}
+		if uid, gid, ok := hostOwner(info); ok {
+			if err := fs.Chown(dst, uid, gid); err != nil && !filesystem.IsUnsupported(err) {
+				return fmt.Errorf("could not change owner of %s: %w", dst, err)
+			}
+		}
+		// the mode and times of a symlink are those of its target, which is copied on its own
+		if !mode.IsDir() && mode&os.ModeSymlink == 0 {
+			if err := setAttributesIn(fs, dst, mode, info.ModTime()); err != nil {
+				return err
+			}
+		}
+		o.progress(dst, copied)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setAttributesIn(fs, dirs[i].path, dirs[i].mode, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFileIn(fs filesystem.FileSystem, src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(dst, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %w", dst, err)
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return n, fmt.Errorf("could not copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return n, fmt.Errorf("could not close %s: %w", dst, err)
+	}
+	return n, nil
+}
+
+func setAttributesIn(fs filesystem.FileSystem, p string, mode os.FileMode, modTime time.Time) error {
+	if err := fs.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil && !filesystem.IsUnsupported(err) {
+		return fmt.Errorf("could not change mode of %s: %w", p, err)
+	}
+	if err := filesystem.Chtimes(fs, p, time.Time{}, modTime); err != nil && !filesystem.IsUnsupported(err) {
+		return fmt.Errorf("could not change times of %s: %w", p, err)
+	}
+	return nil
+}
+
+// CopyTreeOut copy everything in fs into the directory dstDir on the local filesystem, which is created if it does
+// not exist, and then set the mode and modification time of what it creates, and its uid and gid where fs records
+// them. Changing the owner is skipped where the local filesystem does not permit it, as for anyone but root.
+// Symlinks are created as they are, not followed. Device files, fifos and sockets cannot be copied and are an error.
+func CopyTreeOut(fs filesystem.FileSystem, dstDir string, opts ...Opt) error {
+	o, err := parseOpts(opts)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return fmt.Errorf("could not create directory %s: %w", dstDir, err)
+	}
+	var (
+		copied int64
+		dirs   []dirAttributes
+	)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		infos, err := fs.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("could not read directory %s: %w", dir, err)
+		}
+		for _, info := range infos {
+			if info.Name() == "." || info.Name() == ".." {
+				continue
+			}
+			src := path.Join(dir, info.Name())
+			dst := filepath.Join(dstDir, filepath.FromSlash(src))
+			mode := info.Mode()
+			switch {
+			case info.IsDir():
+				if err := os.Mkdir(dst, 0o755); err != nil {
+					return fmt.Errorf("could not create directory %s: %w", dst, err)
+				}
+				dirs = append(dirs, dirAttributes{path: dst, mode: mode, modTime: info.ModTime()})
+			case mode&os.ModeSymlink != 0:
+				target, err := filesystem.Readlink(fs, src)
+				if err != nil {
+					return fmt.Errorf("could not read symlink %s: %w", src, err)
+				}
+				if err := os.Symlink(target, dst); err != nil {
+					return fmt.Errorf("could not create symlink %s: %w", dst, err)
+				}
+			case mode.IsRegular():
+				n, err := copyFileOut(fs, src, dst)
+				copied += n
+				if err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("cannot copy %s: unsupported file type %v", src, mode.Type())
+			}
+			if err := setOwnerOut(info, dst); err != nil {
+				return err
+			}
+			if !info.IsDir() && mode&os.ModeSymlink == 0 {
+				if err := setAttributesOut(dst, mode, info.ModTime()); err != nil {
+					return err
+				}
+			}
+			o.progress(src, copied)
+			if info.IsDir() {
+				if err := walk(src); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setAttributesOut(dirs[i].path, dirs[i].mode, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFileOut(fs filesystem.FileSystem, src, dst string) (int64, error) {
+	in, err := fs.OpenFile(src, os.O_RDONLY)
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s: %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %w", dst, err)
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		_ = out.Close()
+		return n, fmt.Errorf("could not copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return n, fmt.Errorf("could not close %s: %w", dst, err)
+	}
+	return n, nil
+}
+
+func setOwnerOut(info os.FileInfo, dst string) error {
+	uid, gid, ok := filesystem.Owner(info)
+	if !ok {
+		return nil
+	}
+	err := os.Lchown(dst, int(uid), int(gid))
+	if err != nil && !errors.Is(err, iofs.ErrPermission) && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("could not change owner of %s: %w", dst, err)
+	}
+	return nil
+}
+
+// setAttributesOut set the mode and modification time of p. Filesystems that keep no permissions, such as FAT32,
+// report none at all, so a mode without any leaves those that p was created with.
+func setAttributesOut(p string, mode os.FileMode, modTime time.Time) error {
+	if mode.Perm() != 0 {
+		if err := os.Chmod(p, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return fmt.Errorf("could not change mode of %s: %w", p, err)
+		}
+	}
+	if err := os.Chtimes(p, time.Time{}, modTime); err != nil {
+		return fmt.Errorf("could not change times of %s: %w", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package fscopy_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+	"github.com/diskfs/go-diskfs/filesystem/fscopy"
+)
+
+func TestCopyTree(t *testing.T) {
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	src := t.TempDir()
+	contents := bytes.Repeat([]byte("go-diskfs"), 1000)
+	if err := os.MkdirAll(filepath.Join(src, "dir", "sub"), 0o755); err != nil {
+		t.Fatalf("unable to create source directories: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dir", "sub", "file.dat"), contents, 0o600); err != nil {
+		t.Fatalf("unable to create source file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "top.txt"), []byte("top"), 0o640); err != nil {
+		t.Fatalf("unable to create source file: %v", err)
+	}
+	if err := os.Symlink("dir/sub/file.dat", filepath.Join(src, "link")); err != nil {
+		t.Fatalf("unable to create source symlink: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(src, "dir"), 0o700); err != nil {
+		t.Fatalf("unable to change mode of source directory: %v", err)
+	}
+	for _, p := range []string{"top.txt", "dir/sub/file.dat", "dir/sub", "dir"} {
+		if err := os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatalf("unable to change times of %s: %v", p, err)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "ext4.img"))
+	if err != nil {
+		t.Fatalf("unable to create image file: %v", err)
+	}
+	defer f.Close()
+	fs, err := ext4.Create(file.New(f, false), 20*1024*1024, 0, 512, &ext4.Params{})
+	if err != nil {
+		t.Fatalf("unable to create filesystem: %v", err)
+	}
+
+	var (
+		copiedIn []string
+		total    int64
+	)
+	err = fscopy.CopyTreeIn(fs, src, fscopy.WithProgress(func(p string, copied int64) {
+		copiedIn = append(copiedIn, p)
+		total = copied
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error copying in: %v", err)
+	}
+	if len(copiedIn) != 5 {
+		t.Errorf("progress reported %d entries instead of 5: %v", len(copiedIn), copiedIn)
+	}
+	if expected := int64(len(contents) + len("top")); total != expected {
+		t.Errorf("progress reported %d bytes copied instead of %d", total, expected)
+	}
+	target, err := fs.Readlink("/link")
+	if err != nil || target != "dir/sub/file.dat" {
+		t.Errorf("symlink links to %q, error %v", target, err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "out")
+	if err := fscopy.CopyTreeOut(fs, dst); err != nil {
+		t.Fatalf("unexpected error copying out: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "dir", "sub", "file.dat"))
+	if err != nil {
+		t.Fatalf("unable to read copied file: %v", err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Errorf("copied file has different contents")
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "dir/sub/file.dat" {
+		t.Errorf("copied symlink links to %q, error %v", target, err)
+	}
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{"top.txt", 0o640},
+		{"dir", os.ModeDir | 0o700},
+		{"dir/sub", os.ModeDir | 0o755},
+		{"dir/sub/file.dat", 0o600},
+	}
+	for _, tt := range tests {
+		fi, err := os.Lstat(filepath.Join(dst, tt.path))
+		if err != nil {
+			t.Errorf("unable to stat %s: %v", tt.path, err)
+			continue
+		}
+		if fi.Mode() != tt.mode {
+			t.Errorf("%s has mode %v instead of %v", tt.path, fi.Mode(), tt.mode)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s has modification time %v instead of %v", tt.path, fi.ModTime(), mtime)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package fscopy
+
+import (
+	"os"
+	"syscall"
+)
+
+// hostOwner the uid and gid of a file on the local filesystem
+func hostOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	if stat, isStat := fi.Sys().(*syscall.Stat_t); isStat {
+		return int(stat.Uid), int(stat.Gid), true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package fscopy
+
+import "os"
+
+// hostOwner the uid and gid of a file on the local filesystem, which Windows does not have
+func hostOwner(_ os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
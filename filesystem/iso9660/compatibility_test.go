@@ -3,6 +3,7 @@ package iso9660
 import (
 	"os"
 	"testing"
+	"testing/fstest"
 
 	"github.com/diskfs/go-diskfs/backend/file"
 	"github.com/diskfs/go-diskfs/filesystem"
@@ -22,14 +23,14 @@ func TestISO9660FSCompatibility(t *testing.T) {
 	}
 
 	fs := filesystem.FS(isofs)
-	entries, err := fs.ReadDir("/")
+	entries, err := fs.ReadDir(".")
 	if err != nil {
 		t.Fatalf("cannot read /: %s", err)
 	}
 	if len(entries) != 5 {
 		t.Fatalf("should be 5 entries in iso fs")
 	}
-	testfile, err := fs.Open("/README.MD")
+	testfile, err := fs.Open("README.MD")
 	if err != nil {
 		t.Fatalf("test file: %s", err)
 	}
@@ -40,4 +41,7 @@ func TestISO9660FSCompatibility(t *testing.T) {
 	if stat.Size() != 7 {
 		t.Fatalf("size bad: %d", stat.Size())
 	}
+	if err := fstest.TestFS(fs, "README.MD"); err != nil {
+		t.Errorf("not a valid fs.FS: %v", err)
+	}
 }
@@ -22,7 +22,8 @@ func (d *Directory) entriesToBytes(ceBlockLocations []uint32) ([][]byte, error)
 	ceBlocks := make([][]byte, 0)
 	blocksize := int(d.filesystem.blocksize)
 	for _, de := range d.entries {
-		b2, err := de.toBytes(false, ceBlockLocations)
+		// each entry takes its continuation areas from the blocks not already used by those before it
+		b2, err := de.toBytes(false, ceBlockLocations[len(ceBlocks):])
 		if err != nil {
 			return nil, err
 		}
@@ -36,8 +37,12 @@ func (d *Directory) entriesToBytes(ceBlockLocations []uint32) ([][]byte, error)
 			b = append(b, make([]byte, left)...)
 		}
 		b = append(b, recBytes...)
-		if len(b2) > 1 {
-			ceBlocks = append(ceBlocks, b2[1:]...)
+		// continuation areas each start a block of their own, so pad them to whole blocks
+		for _, ce := range b2[1:] {
+			if pad := len(ce) % blocksize; pad != 0 {
+				ce = append(ce, make([]byte, blocksize-pad)...)
+			}
+			ceBlocks = append(ceBlocks, ce)
 		}
 	}
 	// in the end, must pad to exact blocks
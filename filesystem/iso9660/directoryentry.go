@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,6 +15,7 @@ import (
 const (
 	directoryEntryMinSize uint8 = 34  // min size is all the required fields (33 bytes) plus 1 byte for the filename
 	directoryEntryMaxSize int   = 254 // max size allowed
+	maxFileVersion              = 32767
 )
 
 // directoryEntry is a single directory entry
@@ -385,7 +387,11 @@ func (de *directoryEntry) getLocation(p string) (location, size uint32, err erro
 		if err != nil {
 			return 0, 0, fmt.Errorf("could not parse directory: %v", err)
 		}
-		// find the entry among the children that has the desired name
+		// find the entries among the children that have the desired name, once normalized
+		var (
+			matches []*directoryEntry
+			names   []string
+		)
 		for _, entry := range dirEntries {
 			// do we have an alternate name?
 			// only care if not self or parent entry
@@ -405,42 +411,50 @@ func (de *directoryEntry) getLocation(p string) (location, size uint32, err erro
 					}
 				}
 			}
-			if checkFilename == current {
-				if len(parts) > 1 {
-					// just dig down further - what if it looks like a file, but is a relocated directory?
-					if !entry.isSubdirectory && de.filesystem.suspEnabled && !entry.isSelf && !entry.isParent {
-						for _, e := range de.filesystem.suspExtensions {
-							location2 := e.GetDirectoryLocation(entry)
-							if location2 != 0 {
-								// need to get the directory entry for the child
-								dirb := make([]byte, de.filesystem.blocksize)
-								n, err2 := de.filesystem.backend.ReadAt(dirb, int64(location2)*de.filesystem.blocksize)
-								if err2 != nil {
-									return 0, 0, fmt.Errorf("could not read bytes of relocated directory %s from block %d: %v", checkFilename, location2, err2)
-								}
-								if n != len(dirb) {
-									return 0, 0, fmt.Errorf("read %d bytes instead of expected %d for relocated directory %s from block %d: %v", n, len(dirb), checkFilename, location2, err)
-								}
-								// get the size of the actual directory entry
-								size2 := dirb[0]
-								entry, err2 = parseDirEntry(dirb[:size2], de.filesystem)
-								if err2 != nil {
-									return 0, 0, fmt.Errorf("error converting bytes to a directory entry for relocated directory %s from block %d: %v", checkFilename, location2, err2)
-								}
-								break
+			if de.filesystem.normalization.Equal(checkFilename, current) {
+				matches = append(matches, entry)
+				names = append(names, checkFilename)
+			}
+		}
+		i, err := de.filesystem.normalization.Resolve(current, names)
+		if err != nil {
+			return 0, 0, fmt.Errorf("could not find %s: %w", current, err)
+		}
+		if i >= 0 {
+			entry, checkFilename := matches[i], names[i]
+			if len(parts) > 1 {
+				// just dig down further - what if it looks like a file, but is a relocated directory?
+				if !entry.isSubdirectory && de.filesystem.suspEnabled && !entry.isSelf && !entry.isParent {
+					for _, e := range de.filesystem.suspExtensions {
+						location2 := e.GetDirectoryLocation(entry)
+						if location2 != 0 {
+							// need to get the directory entry for the child
+							dirb := make([]byte, de.filesystem.blocksize)
+							n, err2 := de.filesystem.backend.ReadAt(dirb, int64(location2)*de.filesystem.blocksize)
+							if err2 != nil {
+								return 0, 0, fmt.Errorf("could not read bytes of relocated directory %s from block %d: %v", checkFilename, location2, err2)
+							}
+							if n != len(dirb) {
+								return 0, 0, fmt.Errorf("read %d bytes instead of expected %d for relocated directory %s from block %d: %v", n, len(dirb), checkFilename, location2, err)
+							}
+							// get the size of the actual directory entry
+							size2 := dirb[0]
+							entry, err2 = parseDirEntry(dirb[:size2], de.filesystem)
+							if err2 != nil {
+								return 0, 0, fmt.Errorf("error converting bytes to a directory entry for relocated directory %s from block %d: %v", checkFilename, location2, err2)
 							}
+							break
 						}
 					}
-					location, size, err = entry.getLocation(path.Join(parts[1:]...))
-					if err != nil {
-						return 0, 0, fmt.Errorf("could not get location: %v", err)
-					}
-				} else {
-					// this is the final one, we found it, keep it
-					location = entry.location
-					size = entry.size
 				}
-				break
+				location, size, err = entry.getLocation(path.Join(parts[1:]...))
+				if err != nil {
+					return 0, 0, fmt.Errorf("could not get location: %v", err)
+				}
+			} else {
+				// this is the final one, we found it, keep it
+				location = entry.location
+				size = entry.size
 			}
 		}
 	}
@@ -450,32 +464,88 @@ func (de *directoryEntry) getLocation(p string) (location, size uint32, err erro
 
 // Name() string       // base name of the file
 func (de *directoryEntry) Name() string {
-	name := de.filename
+	// check if we have an extension that overrides it
+	if name, ok := de.alternateName(); ok {
+		return name
+	}
+	if de.IsDir() || de.filesystem.fileVersions == KeepFileVersions {
+		return de.filename
+	}
+	return trimFileIdentifier(de.filename)
+}
+
+// alternateName the name that an extension, such as Rock Ridge, gives the entry instead of its file identifier
+func (de *directoryEntry) alternateName() (string, bool) {
+	var (
+		name string
+		ok   bool
+	)
 	if de.filesystem.suspEnabled {
 		for _, e := range de.filesystem.suspExtensions {
 			filename, err := e.GetFilename(de)
-			switch {
-			case err != nil:
+			if err != nil {
 				continue
-			default:
-				name = filename
-				//nolint:gosimple // redundant break, but we want this explicit
-				break
 			}
+			name, ok = filename, true
 		}
 	}
-	// check if we have an extension that overrides it
-	// filenames should have the ';1' stripped off, as well as the leading or trailing '.'
-	if !de.IsDir() {
-		name = strings.TrimSuffix(name, ";1")
-		name = strings.TrimSuffix(name, ".")
-		name = strings.TrimPrefix(name, ".")
+	return name, ok
+}
+
+// version the version number of the file identifier of the entry, or 0 if it has none
+func (de *directoryEntry) version() int {
+	if de.IsDir() {
+		return 0
 	}
-	return name
+	_, version := splitFileVersion(de.filename)
+	return version
+}
+
+// matchName whether name, a name asked for, is that of the entry. The version number of a file identifier
+// may be left out of name, or given, whether the names of the filesystem have version numbers or not.
+func (de *directoryEntry) matchName(name string) bool {
+	if _, ok := de.alternateName(); ok || de.IsDir() {
+		return de.filesystem.normalization.Equal(de.Name(), name)
+	}
+	identifier, version := splitFileVersion(de.filename)
+	base, wantVersion := splitFileVersion(name)
+	if wantVersion == 0 {
+		return trimFileIdentifier(identifier) == trimFileIdentifier(name)
+	}
+	// only one version number
+	if _, v := splitFileVersion(base); v != 0 {
+		return false
+	}
+	return wantVersion == version && trimFileIdentifier(identifier) == trimFileIdentifier(base)
+}
+
+// splitFileVersion split a file identifier into its name and extension, and its version number, ECMA-119 7.5.1,
+// e.g. "README.TXT;1" into "README.TXT" and 1; the version is 0 if it has none
+func splitFileVersion(identifier string) (name string, version int) {
+	i := strings.LastIndexByte(identifier, ';')
+	if i < 0 {
+		return identifier, 0
+	}
+	version, err := strconv.Atoi(identifier[i+1:])
+	if err != nil || version < 1 || version > maxFileVersion {
+		return identifier, 0
+	}
+	return identifier[:i], version
+}
+
+// trimFileIdentifier the name of a file from its identifier, without the version number, nor the '.' that an
+// identifier without an extension has
+func trimFileIdentifier(identifier string) string {
+	name, _ := splitFileVersion(identifier)
+	name = strings.TrimSuffix(name, ".")
+	return strings.TrimPrefix(name, ".")
 }
 
 // Size() int64        // length in bytes for regular files; system-dependent for others
 func (de *directoryEntry) Size() int64 {
+	if sf, ok := de.sparseFile(); ok {
+		return int64(sf.size())
+	}
 	return int64(de.size)
 }
 
@@ -500,7 +570,12 @@ func (de *directoryEntry) ReadLink() (string, bool) {
 }
 
 // ModTime() time.Time // modification time
+//
+// the modification time that Rock Ridge records, if it does, else the recording time of the directory entry
 func (de *directoryEntry) ModTime() time.Time {
+	if ts := de.timestamps(); ts != nil && !ts.Modify.IsZero() {
+		return ts.Modify
+	}
 	return de.creation
 }
 
@@ -510,7 +585,22 @@ func (de *directoryEntry) IsDir() bool {
 }
 
 // Sys() interface{}   // underlying data source (can return nil)
+//
+// the *Timestamps of the entry, if it has Rock Ridge timestamps, else nil
 func (de *directoryEntry) Sys() interface{} {
+	if ts := de.timestamps(); ts != nil {
+		return ts
+	}
+	return nil
+}
+
+// timestamps the times in the Rock Ridge TF entry of the directory entry, or nil if it has none
+func (de *directoryEntry) timestamps() *Timestamps {
+	for _, ext := range de.extensions {
+		if tf, ok := ext.(rockRidgeTimestamps); ok {
+			return tf.timestamps()
+		}
+	}
 	return nil
 }
 
@@ -558,20 +648,26 @@ func validateFilename(s string, isDir, suspExtension bool) error {
 	return err
 }
 
+// filename patterns, compiled once rather than for every name that is checked
+var (
+	isoDirnameRegexp   = regexp.MustCompile("^[A-Z0-9_]{1,30}$")
+	isoFilenameRegexp  = regexp.MustCompile("^[A-Z0-9_]+(.[A-Z0-9_]*)?(;1)?$")
+	suspFilenameRegexp = regexp.MustCompile(`^[^\x00/]*$`)
+)
+
 // validateISOFilename validates a filename that is plain ISO9660-compliant (levels 2 & 3)
 func validateISOFilename(s string, isDir bool) error {
 	var err error
 	// all allowed up to 30 characters, of A-Z,0-9,_
 	if isDir {
-		re := regexp.MustCompile("^[A-Z0-9_]{1,30}$")
-		if !re.MatchString(s) {
+		if !isoDirnameRegexp.MatchString(s) {
 			err = fmt.Errorf("directory name must be of up to 30 characters from A-Z0-9_")
 		}
 	} else {
-		// filename also allowed an optional '.' plus up to 3 characters of A-Z,0-9,_, plus must have ";1"
-		re := regexp.MustCompile("^[A-Z0-9_]+(.[A-Z0-9_]*)?;1$")
+		// filename also allowed an optional '.' plus up to 3 characters of A-Z,0-9,_, plus ";1" unless version
+		// numbers are left out
 		switch {
-		case !re.MatchString(s):
+		case !isoFilenameRegexp.MatchString(s):
 			err = fmt.Errorf("file name must be of characters from A-Z0-9_, followed by an optional '.' and an extension of the same characters")
 		case len(strings.ReplaceAll(s, ".", "")) > 30:
 			err = fmt.Errorf("file name must be at most 30 characters, not including the separator '.'")
@@ -584,11 +680,10 @@ func validateISOFilename(s string, isDir bool) error {
 func validateSUSPFilename(s string, _ bool) error {
 	var err error
 	// all allowed up to 255 characters of any kind, except null (0x0) and '/'
-	re := regexp.MustCompile(`^[^\x00/]*$`)
 	switch {
 	case len(s) > 255:
 		err = fmt.Errorf("filename must be at most 255 characters")
-	case !re.MatchString(s):
+	case !suspFilenameRegexp.MatchString(s):
 		err = fmt.Errorf("filename must not include / or null characters")
 	}
 	return err
@@ -738,6 +738,49 @@ func TestDirectoryEntryUCaseValid(t *testing.T) {
 	}
 }
 
+func TestDirectoryEntryFileVersions(t *testing.T) {
+	tests := []struct {
+		filename string
+		isDir    bool
+		strip    string
+		version  int
+		matches  []string
+		differs  []string
+	}{
+		{"README.TXT;1", false, "README.TXT", 1, []string{"README.TXT", "README.TXT;1"}, []string{"README.TXT;2", "README", "README.TXT;1;1"}},
+		{"README.TXT;12", false, "README.TXT", 12, []string{"README.TXT", "README.TXT;12"}, []string{"README.TXT;1"}},
+		{"NOEXT.;1", false, "NOEXT", 1, []string{"NOEXT", "NOEXT.", "NOEXT.;1", "NOEXT;1"}, []string{"NOEXT;2"}},
+		{"NOVERSION.TXT", false, "NOVERSION.TXT", 0, []string{"NOVERSION.TXT"}, []string{"NOVERSION.TXT;1"}},
+		{"A;B", false, "A;B", 0, []string{"A;B"}, []string{"A"}},
+		{"DIR", true, "DIR", 0, []string{"DIR"}, []string{"DIR;1"}},
+	}
+	for _, tt := range tests {
+		for _, versions := range []FileVersions{StripFileVersions, KeepFileVersions} {
+			de := &directoryEntry{filename: tt.filename, isSubdirectory: tt.isDir, filesystem: &FileSystem{fileVersions: versions}}
+			name := tt.strip
+			if versions == KeepFileVersions {
+				name = tt.filename
+			}
+			if de.Name() != name {
+				t.Errorf("%s with %v: name %q instead of %q", tt.filename, versions, de.Name(), name)
+			}
+			if de.version() != tt.version {
+				t.Errorf("%s: version %d instead of %d", tt.filename, de.version(), tt.version)
+			}
+			for _, m := range tt.matches {
+				if !de.matchName(m) {
+					t.Errorf("%s with %v: does not match %q", tt.filename, versions, m)
+				}
+			}
+			for _, m := range tt.differs {
+				if de.matchName(m) {
+					t.Errorf("%s with %v: matches %q", tt.filename, versions, m)
+				}
+			}
+		}
+	}
+}
+
 func TestDirectoryEntryParseDirEntries(t *testing.T) {
 	fs := &FileSystem{blocksize: 2048, suspEnabled: true, suspExtensions: []suspExtension{getRockRidgeExtension("RRIP_1991A")}}
 	validDe, _, b, byteMap, err := getRockRidgeDirectoryEntries(fs, false)
@@ -509,12 +509,16 @@ var suspExtensionParser = map[string]func([]byte) (directoryEntrySystemUseExtens
 func parseDirectoryEntryExtensions(b []byte, handlers []suspExtension) ([]directoryEntrySystemUseExtension, error) {
 	// and now for extensions in the system use area
 	entries := make([]directoryEntrySystemUseExtension, 0)
-	lastEntryBySignature := map[string]directoryEntrySystemUseExtension{}
+	partsBySignature := map[string][]directoryEntrySystemUseExtension{}
+	continuedSignatures := make([]string, 0)
 	// minimum size of 4 bytes for any SUSP entry
 	for i := 0; i+4 < len(b); {
 		// get the indicator
 		signature := string(b[i : i+2])
 		size := b[i+2]
+		if size < 4 || i+int(size) > len(b) {
+			return nil, fmt.Errorf("invalid %s extension size %d at byte position %d of %d", signature, size, i, len(b))
+		}
 		suspBytes := b[i : i+int(size)]
 		var (
 			entry directoryEntrySystemUseExtension
@@ -541,18 +545,35 @@ func parseDirectoryEntryExtensions(b []byte, handlers []suspExtension) ([]direct
 				entry = parseSystemUseExtensionRaw(suspBytes)
 			}
 		}
-		// we now have the entry - see if there was a prior continuable one
-		if last, ok := lastEntryBySignature[signature]; ok {
-			entry = last.Merge([]directoryEntrySystemUseExtension{entry})
-			if entry.Continuable() {
-				lastEntryBySignature[signature] = entry
-			} else {
-				delete(lastEntryBySignature, signature)
+		i += int(size)
+		// we now have the entry - hold it back while it continues, and merge it into the first of its parts when it ends
+		parts, continuing := partsBySignature[signature]
+		if entry.Continuable() {
+			if !continuing {
+				continuedSignatures = append(continuedSignatures, signature)
 			}
+			partsBySignature[signature] = append(parts, entry)
+			continue
+		}
+		if continuing {
+			delete(partsBySignature, signature)
+			entry = parts[0].Merge(append(parts[1:], entry))
 		}
-
 		entries = append(entries, entry)
-		i += int(size)
 	}
-	return entries, nil
+	// anything still continuing at the end is merged as far as it goes, ahead of any continuation area pointer
+	var ce []directoryEntrySystemUseExtension
+	if len(entries) > 0 {
+		if _, ok := entries[len(entries)-1].(directoryEntrySystemUseContinuation); ok {
+			ce = entries[len(entries)-1:]
+			entries = entries[:len(entries)-1]
+		}
+	}
+	for _, signature := range continuedSignatures {
+		if parts, ok := partsBySignature[signature]; ok {
+			delete(partsBySignature, signature)
+			entries = append(entries, parts[0].Merge(parts[1:]))
+		}
+	}
+	return append(entries, ce...), nil
 }
@@ -0,0 +1,634 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+/*
+	A DVD-Video image is a UDF 1.02 bridge: players read only the UDF side, which sees the same files as
+	the ISO9660 side, in the same sectors. It is laid out as mkisofs -dvd-video does:
+
+	- 16-17 ISO9660 primary volume descriptor and terminator
+	- 18-20 the rest of the volume recognition sequence, BEA01, NSR02 and TEA01
+	- 32 and 48 the main and reserve UDF volume descriptor sequences
+	- 64 the logical volume integrity sequence
+	- 256 the first anchor volume descriptor pointer
+	- 257 the partition, which runs to the end of the files: the file set descriptor, the file entries and
+	  directories of UDF, then the directories and path tables of ISO9660, then the files, those of VIDEO_TS first
+	  and each of them starting on a 32 KiB boundary
+	- the last sector, the second anchor volume descriptor pointer
+*/
+
+const (
+	// dvdVideoDirectory the directory at the root of a DVD-Video image that has the video
+	dvdVideoDirectory = "VIDEO_TS"
+	// dvdVideoAlignment the blocks of 2 KiB that each file of VIDEO_TS starts on a multiple of, an ECC block of 32 KiB
+	dvdVideoAlignment = 16
+	udfBlocksize      = 2048
+	// sectors of the volume recognition sequence, the volume descriptor sequences and the integrity sequence
+	udfBEASector          = dataStartSector + 2
+	udfMainVDSSector      = 32
+	udfReserveVDSSector   = 48
+	udfVDSSectors         = 16
+	udfIntegritySector    = 64
+	udfAnchorSector       = 256
+	udfPartitionStart     = udfAnchorSector + 1
+	udfDescriptorTagSize  = 16
+	udfFileEntrySize      = 176
+	udfFIDFixedSize       = 38
+	udfShortADSize        = 8
+	udfTagVersion         = 2
+	udfFirstUniqueID      = 16
+	udfFileTypeDirectory  = 4
+	udfFileTypeRegular    = 5
+	udfFIDDirectory       = 1 << 1
+	udfFIDParent          = 1 << 3
+	udfMaxNameLength      = 255
+	udfMaxExtentLength    = 0x3fffffff &^ (udfBlocksize - 1)
+	udfDomainIdentifier   = "*OSTA UDF Compliant"
+	udfLVInfoIdentifier   = "*UDF LV Info"
+	udfPartitionContents  = "+NSR02"
+	udfCharsetIdentifier  = "OSTA Compressed Unicode"
+	udfImplementationName = "*go-diskfs"
+)
+
+// tag identifiers of the UDF descriptors, ECMA-167 3/7.2.1 and 4/7.2.1
+const (
+	udfTagPrimaryVolumeDescriptor           uint16 = 1
+	udfTagAnchorVolumeDescriptorPointer     uint16 = 2
+	udfTagImplementationUseVolumeDescriptor uint16 = 4
+	udfTagPartitionDescriptor               uint16 = 5
+	udfTagLogicalVolumeDescriptor           uint16 = 6
+	udfTagUnallocatedSpaceDescriptor        uint16 = 7
+	udfTagTerminatingDescriptor             uint16 = 8
+	udfTagLogicalVolumeIntegrityDescriptor  uint16 = 9
+	udfTagFileSetDescriptor                 uint16 = 256
+	udfTagFileIdentifierDescriptor          uint16 = 257
+	udfTagFileEntry                         uint16 = 261
+)
+
+var (
+	// udfRevision UDF 1.02, as the suffix of the identifiers that give the revision
+	udfRevision = []byte{0x02, 0x01}
+	// dvdVideoTitleSetFile the files of a video title set, VTS_nn_m, of which m is 0 for the IFO and BUP, and 1-9
+	// for the VOBs of the titles
+	dvdVideoTitleSetFile = regexp.MustCompile(`^VTS_([0-9]{2})_([0-9])\.(IFO|VOB|BUP)$`)
+)
+
+// validateDVDVideo check the other options and the blocksize can be used for a DVD-Video image
+func validateDVDVideo(options FinalizeOptions, blocksize int) error {
+	switch {
+	case blocksize != udfBlocksize:
+		return fmt.Errorf("DVD-Video image must have a blocksize of %d, not %d", udfBlocksize, blocksize)
+	case options.ElTorito != nil:
+		return fmt.Errorf("DVD-Video image cannot be bootable with El Torito")
+	case options.Hybrid != nil:
+		return fmt.Errorf("DVD-Video image cannot have hybrid partition tables")
+	case options.SparseFiles:
+		return fmt.Errorf("DVD-Video image cannot have sparse files, as UDF reads every file from its blocks")
+	}
+	return nil
+}
+
+// dvdVideoOrder the files with those in VIDEO_TS moved to the front, in the order a player reads them: the video
+// manager, VIDEO_TS.IFO, .VOB and .BUP, then each title set, VTS_nn_0.IFO, its VOBs, and VTS_nn_0.BUP, then
+// anything else. The rest keep their order. It also returns how many files there are in VIDEO_TS.
+func dvdVideoOrder(root *finalizeFileInfo, files []*finalizeFileInfo) ([]*finalizeFileInfo, int, error) {
+	var videoTS *finalizeFileInfo
+	for _, e := range root.children {
+		if e.name == dvdVideoDirectory && e.IsDir() {
+			videoTS = e
+		}
+	}
+	if videoTS == nil {
+		return nil, 0, fmt.Errorf("DVD-Video image must have a directory %s at its root", dvdVideoDirectory)
+	}
+	var video, rest []*finalizeFileInfo
+	for _, e := range files {
+		if e.parent == videoTS {
+			video = append(video, e)
+		} else {
+			rest = append(rest, e)
+		}
+	}
+	slices.SortStableFunc(video, func(a, b *finalizeFileInfo) int {
+		return slices.Compare(dvdVideoRank(a.name), dvdVideoRank(b.name))
+	})
+	return append(video, rest...), len(video), nil
+}
+
+// dvdVideoRank where a file of VIDEO_TS goes, as title set and place within it; the video manager is title set 0,
+// and any other file comes after all title sets
+func dvdVideoRank(name string) []int {
+	extensions := map[string]int{"IFO": 0, "VOB": 1, "BUP": 11}
+	switch name {
+	case "VIDEO_TS.IFO", "VIDEO_TS.VOB", "VIDEO_TS.BUP":
+		return []int{0, extensions[name[len(name)-3:]]}
+	}
+	m := dvdVideoTitleSetFile.FindStringSubmatch(name)
+	if m == nil {
+		return []int{100, 0}
+	}
+	set, _ := strconv.Atoi(m[1])
+	part, _ := strconv.Atoi(m[2])
+	if m[3] == "VOB" {
+		return []int{set, 1 + part}
+	}
+	return []int{set, extensions[m[3]]}
+}
+
+// udfEntry a file or directory of the UDF side of a bridge image, with the file entry that describes it and, for a
+// directory, its file identifier descriptors, each in logical blocks of the partition
+type udfEntry struct {
+	fi       *finalizeFileInfo
+	parent   *udfEntry
+	children []*udfEntry
+	// icb the block of the file entry
+	icb uint32
+	// fids the first block of the file identifier descriptors of a directory, and fidsSize their size in bytes
+	fids     uint32
+	fidsSize int
+	uniqueID uint64
+}
+
+// udfBridge the UDF side of a bridge image
+type udfBridge struct {
+	root    *udfEntry
+	entries []*udfEntry
+	// metadataBlocks the blocks at the start of the partition that the file set descriptor, the file entries and
+	// the directories take
+	metadataBlocks  uint32
+	partitionLength uint32
+	// anchor the sector of the second anchor volume descriptor pointer
+	anchor       uint32
+	files, dirs  uint32
+	nextUniqueID uint64
+	// gaps the ranges of sectors between files, from where one ends to where the next starts, to fill with zeroes
+	gaps [][2]uint32
+}
+
+// newUDFBridge lay out the file entries and directories of UDF for the tree under root. It must be called before
+// any directories are relocated for ISO9660, as UDF has the tree as it is.
+func newUDFBridge(root *finalizeFileInfo) (*udfBridge, error) {
+	b := &udfBridge{nextUniqueID: udfFirstUniqueID}
+	var err error
+	b.root, err = b.add(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.root.parent = b.root
+	// the file set descriptor and its terminating descriptor, then a file entry for each, followed by its
+	// file identifiers if it is a directory
+	location := uint32(2)
+	for _, e := range b.entries {
+		e.icb = location
+		location++
+		if e.fi.IsDir() {
+			e.fids = location
+			location += calculateBlocks(int64(e.fidsSize), udfBlocksize)
+		}
+	}
+	b.metadataBlocks = location
+	return b, nil
+}
+
+// add add an entry for fi and everything in it, with the root, which is its own parent, getting unique ID 0
+func (b *udfBridge) add(fi *finalizeFileInfo, parent *udfEntry) (*udfEntry, error) {
+	e := &udfEntry{fi: fi, parent: parent}
+	if parent != nil {
+		e.uniqueID = b.nextUniqueID
+		b.nextUniqueID++
+	}
+	b.entries = append(b.entries, e)
+	if !fi.IsDir() {
+		if !fi.mode.IsRegular() {
+			return nil, fmt.Errorf("DVD-Video image can only have regular files and directories, not %s of mode %v", fi.path, fi.mode)
+		}
+		b.files++
+		return e, nil
+	}
+	b.dirs++
+	e.fidsSize = udfFIDSize(0)
+	children := slices.Clone(fi.children)
+	slices.SortFunc(children, func(a, b *finalizeFileInfo) int {
+		return strings.Compare(a.name, b.name)
+	})
+	for _, c := range children {
+		name := udfCharacters(c.name)
+		if len(name) > udfMaxNameLength {
+			return nil, fmt.Errorf("name of %s is %d bytes in UDF, more than the maximum of %d", c.path, len(name), udfMaxNameLength)
+		}
+		e.fidsSize += udfFIDSize(len(name))
+		child, err := b.add(c, e)
+		if err != nil {
+			return nil, err
+		}
+		e.children = append(e.children, child)
+	}
+	return e, nil
+}
+
+// finish end the partition, and the image, with the files ending at location, adding the sector for the second
+// anchor; it returns the location after the anchor
+func (b *udfBridge) finish(location uint32) uint32 {
+	b.partitionLength = location - udfPartitionStart
+	b.anchor = location
+	return location + 1
+}
+
+// align move the location of a file of VIDEO_TS up to the next 32 KiB boundary, noting the gap left
+func (b *udfBridge) align(location uint32) uint32 {
+	aligned := (location + dvdVideoAlignment - 1) / dvdVideoAlignment * dvdVideoAlignment
+	if aligned > location {
+		b.gaps = append(b.gaps, [2]uint32{location, aligned})
+	}
+	return aligned
+}
+
+// write write the rest of the volume recognition sequence, the volume descriptors, the integrity descriptor,
+// the anchors, and the file set, file entries and directories of the partition, once the files have their
+// locations
+func (b *udfBridge) write(f backend.WritableFile, volumeIdentifier string, now time.Time) error {
+	zeroes := make([]byte, udfBlocksize*dvdVideoAlignment)
+	// the sectors from the volume recognition sequence up to the partition are mostly unused, and gaps are left
+	// between the files of VIDEO_TS
+	gaps := append([][2]uint32{{udfBEASector, udfPartitionStart}}, b.gaps...)
+	for _, g := range gaps {
+		for sector := g[0]; sector < g[1]; sector += dvdVideoAlignment {
+			n := min(g[1]-sector, dvdVideoAlignment)
+			if _, err := f.WriteAt(zeroes[:n*udfBlocksize], int64(sector)*udfBlocksize); err != nil {
+				return fmt.Errorf("could not write zeroes to sectors %d-%d: %v", sector, sector+n-1, err)
+			}
+		}
+	}
+
+	sectors := map[uint32][]byte{}
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		// structure type 0, the identifier, and structure version 1, ECMA-167 2/9.1
+		d := make([]byte, udfBlocksize)
+		copy(d[1:6], id)
+		d[6] = 1
+		sectors[udfBEASector+uint32(i)] = d
+	}
+	// the volume set identifier starts with 16 hexadecimal digits, which are unique, as UDF 2.2.2.5 asks
+	volumeSet := fmt.Sprintf("%016x%s", now.UnixNano(), volumeIdentifier)
+	for _, start := range []uint32{udfMainVDSSector, udfReserveVDSSector} {
+		vds := []struct {
+			id uint16
+			d  []byte
+		}{
+			{udfTagPrimaryVolumeDescriptor, udfPrimaryVolumeDescriptor(volumeIdentifier, volumeSet, now)},
+			{udfTagImplementationUseVolumeDescriptor, udfImplementationUseVolumeDescriptor(volumeIdentifier)},
+			{udfTagPartitionDescriptor, udfPartitionDescriptor(b.partitionLength)},
+			{udfTagLogicalVolumeDescriptor, udfLogicalVolumeDescriptor(volumeIdentifier)},
+			{udfTagUnallocatedSpaceDescriptor, make([]byte, 24)},
+			{udfTagTerminatingDescriptor, make([]byte, 512)},
+		}
+		for i, v := range vds {
+			// the volume descriptor sequence number, which the terminating descriptor does not have
+			if v.id != udfTagTerminatingDescriptor {
+				binary.LittleEndian.PutUint32(v.d[16:20], uint32(i))
+			}
+			udfTag(v.d, v.id, start+uint32(i))
+			sectors[start+uint32(i)] = v.d
+		}
+	}
+	lvid := b.logicalVolumeIntegrityDescriptor(now)
+	udfTag(lvid, udfTagLogicalVolumeIntegrityDescriptor, udfIntegritySector)
+	sectors[udfIntegritySector] = lvid
+	td := make([]byte, 512)
+	udfTag(td, udfTagTerminatingDescriptor, udfIntegritySector+1)
+	sectors[udfIntegritySector+1] = td
+	for _, sector := range []uint32{udfAnchorSector, b.anchor} {
+		avdp := make([]byte, 512)
+		binary.LittleEndian.PutUint32(avdp[16:20], udfVDSSectors*udfBlocksize)
+		binary.LittleEndian.PutUint32(avdp[20:24], udfMainVDSSector)
+		binary.LittleEndian.PutUint32(avdp[24:28], udfVDSSectors*udfBlocksize)
+		binary.LittleEndian.PutUint32(avdp[28:32], udfReserveVDSSector)
+		udfTag(avdp, udfTagAnchorVolumeDescriptorPointer, sector)
+		sectors[sector] = avdp
+	}
+	for sector, d := range sectors {
+		if _, err := f.WriteAt(d, int64(sector)*udfBlocksize); err != nil {
+			return fmt.Errorf("could not write UDF descriptor to sector %d: %v", sector, err)
+		}
+	}
+
+	// the partition is written in one go, as it is a few blocks for each file
+	partition := make([]byte, int(b.metadataBlocks)*udfBlocksize)
+	fsd := b.fileSetDescriptor(volumeIdentifier, now)
+	udfTag(fsd, udfTagFileSetDescriptor, 0)
+	copy(partition, fsd)
+	td = make([]byte, 512)
+	udfTag(td, udfTagTerminatingDescriptor, 1)
+	copy(partition[udfBlocksize:], td)
+	for _, e := range b.entries {
+		fe, err := e.fileEntry()
+		if err != nil {
+			return err
+		}
+		copy(partition[int(e.icb)*udfBlocksize:], fe)
+		if e.fi.IsDir() {
+			copy(partition[int(e.fids)*udfBlocksize:], e.fileIdentifiers())
+		}
+	}
+	if _, err := f.WriteAt(partition, udfPartitionStart*udfBlocksize); err != nil {
+		return fmt.Errorf("could not write UDF file entries and directories: %v", err)
+	}
+	return nil
+}
+
+// udfPrimaryVolumeDescriptor the primary volume descriptor, ECMA-167 3/10.1, without its tag
+func udfPrimaryVolumeDescriptor(volumeIdentifier, volumeSet string, now time.Time) []byte {
+	d := make([]byte, 512)
+	udfDString(d[24:56], volumeIdentifier)
+	// one volume in the set, at interchange level 2, as UDF 2.2.2 asks
+	binary.LittleEndian.PutUint16(d[56:58], 1)
+	binary.LittleEndian.PutUint16(d[58:60], 1)
+	binary.LittleEndian.PutUint16(d[60:62], 2)
+	binary.LittleEndian.PutUint16(d[62:64], 2)
+	binary.LittleEndian.PutUint32(d[64:68], 1)
+	binary.LittleEndian.PutUint32(d[68:72], 1)
+	udfDString(d[72:200], volumeSet)
+	udfCharspec(d[200:264])
+	udfCharspec(d[264:328])
+	udfTimestamp(d[376:388], now)
+	udfRegid(d[388:420], udfImplementationName, nil)
+	return d
+}
+
+// udfImplementationUseVolumeDescriptor the implementation use volume descriptor of UDF 2.2.7, which has the
+// logical volume information, without its tag
+func udfImplementationUseVolumeDescriptor(volumeIdentifier string) []byte {
+	d := make([]byte, 512)
+	udfRegid(d[20:52], udfLVInfoIdentifier, udfRevision)
+	udfCharspec(d[52:116])
+	udfDString(d[116:244], volumeIdentifier)
+	udfRegid(d[352:384], udfImplementationName, nil)
+	return d
+}
+
+// udfPartitionDescriptor the partition descriptor, ECMA-167 3/10.5, of a read-only partition, without its tag
+func udfPartitionDescriptor(length uint32) []byte {
+	d := make([]byte, 512)
+	// allocated, partition number 0
+	binary.LittleEndian.PutUint16(d[20:22], 1)
+	udfRegid(d[24:56], udfPartitionContents, nil)
+	binary.LittleEndian.PutUint32(d[184:188], 1)
+	binary.LittleEndian.PutUint32(d[188:192], udfPartitionStart)
+	binary.LittleEndian.PutUint32(d[192:196], length)
+	udfRegid(d[196:228], udfImplementationName, nil)
+	return d
+}
+
+// udfLogicalVolumeDescriptor the logical volume descriptor, ECMA-167 3/10.6, with a type 1 partition map of
+// partition 0, without its tag
+func udfLogicalVolumeDescriptor(volumeIdentifier string) []byte {
+	d := make([]byte, 446)
+	udfCharspec(d[20:84])
+	udfDString(d[84:212], volumeIdentifier)
+	binary.LittleEndian.PutUint32(d[212:216], udfBlocksize)
+	udfRegid(d[216:248], udfDomainIdentifier, udfRevision)
+	// the file set descriptor is the first block of the partition
+	binary.LittleEndian.PutUint32(d[248:252], udfBlocksize)
+	binary.LittleEndian.PutUint32(d[264:268], 6)
+	binary.LittleEndian.PutUint32(d[268:272], 1)
+	udfRegid(d[272:304], udfImplementationName, nil)
+	binary.LittleEndian.PutUint32(d[432:436], 2*udfBlocksize)
+	binary.LittleEndian.PutUint32(d[436:440], udfIntegritySector)
+	d[440], d[441] = 1, 6
+	binary.LittleEndian.PutUint16(d[442:444], 1)
+	return d
+}
+
+// logicalVolumeIntegrityDescriptor the logical volume integrity descriptor, ECMA-167 3/10.10, of a closed volume
+// with no free space, without its tag
+func (b *udfBridge) logicalVolumeIntegrityDescriptor(now time.Time) []byte {
+	d := make([]byte, 134)
+	udfTimestamp(d[16:28], now)
+	binary.LittleEndian.PutUint32(d[28:32], 1)
+	binary.LittleEndian.PutUint64(d[40:48], b.nextUniqueID)
+	binary.LittleEndian.PutUint32(d[72:76], 1)
+	binary.LittleEndian.PutUint32(d[76:80], 46)
+	binary.LittleEndian.PutUint32(d[84:88], b.partitionLength)
+	// the implementation use of UDF 2.2.6.4
+	udfRegid(d[88:120], udfImplementationName, nil)
+	binary.LittleEndian.PutUint32(d[120:124], b.files)
+	binary.LittleEndian.PutUint32(d[124:128], b.dirs)
+	for _, off := range []int{128, 130, 132} {
+		copy(d[off:off+2], udfRevision)
+	}
+	return d
+}
+
+// fileSetDescriptor the file set descriptor, ECMA-167 4/14.1, without its tag
+func (b *udfBridge) fileSetDescriptor(volumeIdentifier string, now time.Time) []byte {
+	d := make([]byte, 512)
+	udfTimestamp(d[16:28], now)
+	binary.LittleEndian.PutUint16(d[28:30], 3)
+	binary.LittleEndian.PutUint16(d[30:32], 3)
+	binary.LittleEndian.PutUint32(d[32:36], 1)
+	binary.LittleEndian.PutUint32(d[36:40], 1)
+	udfCharspec(d[48:112])
+	udfDString(d[112:240], volumeIdentifier)
+	udfCharspec(d[240:304])
+	udfDString(d[304:336], volumeIdentifier)
+	udfLongAD(d[400:416], udfBlocksize, b.root.icb)
+	udfRegid(d[416:448], udfDomainIdentifier, udfRevision)
+	return d
+}
+
+// fileEntry the file entry, ECMA-167 4/14.9, of the file or directory, tagged
+func (e *udfEntry) fileEntry() ([]byte, error) {
+	fi := e.fi
+	var (
+		fileType byte = udfFileTypeRegular
+		size          = fi.size
+		location      = fi.location - udfPartitionStart
+		blocks        = fi.blocks
+		links         = 1
+	)
+	if fi.IsDir() {
+		fileType, size, location = udfFileTypeDirectory, int64(e.fidsSize), e.fids
+		blocks = calculateBlocks(size, udfBlocksize)
+		// a directory is linked to from its parent and from each directory in it
+		for _, c := range e.children {
+			if c.fi.IsDir() {
+				links++
+			}
+		}
+	}
+	// the data of each is in a single run of blocks, in as many extents as it takes
+	var ads []byte
+	for off := int64(0); off < size; off += udfMaxExtentLength {
+		ad := make([]byte, udfShortADSize)
+		binary.LittleEndian.PutUint32(ad[0:4], uint32(min(size-off, udfMaxExtentLength)))
+		binary.LittleEndian.PutUint32(ad[4:8], location+uint32(off/udfBlocksize))
+		ads = append(ads, ad...)
+	}
+	if udfFileEntrySize+len(ads) > udfBlocksize {
+		return nil, fmt.Errorf("%s of %d bytes is too large for the allocation descriptors of a UDF file entry", fi.path, size)
+	}
+	d := make([]byte, udfFileEntrySize+len(ads))
+	// the ICB tag, ECMA-167 4/14.6, of a direct entry with short allocation descriptors
+	binary.LittleEndian.PutUint16(d[20:22], 4)
+	binary.LittleEndian.PutUint16(d[24:26], 1)
+	d[27] = fileType
+	binary.LittleEndian.PutUint32(d[36:40], fi.uid)
+	binary.LittleEndian.PutUint32(d[40:44], fi.gid)
+	binary.LittleEndian.PutUint32(d[44:48], udfPermissions(fi.mode))
+	binary.LittleEndian.PutUint16(d[48:50], uint16(links))
+	binary.LittleEndian.PutUint64(d[56:64], uint64(size))
+	binary.LittleEndian.PutUint64(d[64:72], uint64(blocks))
+	udfTimestamp(d[72:84], fi.accessTime)
+	udfTimestamp(d[84:96], fi.modTime)
+	udfTimestamp(d[96:108], fi.changeTime)
+	binary.LittleEndian.PutUint32(d[108:112], 1)
+	udfRegid(d[128:160], udfImplementationName, nil)
+	binary.LittleEndian.PutUint64(d[160:168], e.uniqueID)
+	binary.LittleEndian.PutUint32(d[172:176], uint32(len(ads)))
+	copy(d[udfFileEntrySize:], ads)
+	udfTag(d, udfTagFileEntry, e.icb)
+	return d, nil
+}
+
+// fileIdentifiers the file identifier descriptors, ECMA-167 4/14.4, of a directory, tagged, starting with that of
+// its parent
+func (e *udfEntry) fileIdentifiers() []byte {
+	b := make([]byte, 0, e.fidsSize)
+	add := func(c *udfEntry, characteristics byte, name []byte) {
+		d := make([]byte, udfFIDSize(len(name)))
+		binary.LittleEndian.PutUint16(d[16:18], 1)
+		if c.fi.IsDir() {
+			characteristics |= udfFIDDirectory
+		}
+		d[18], d[19] = characteristics, byte(len(name))
+		udfLongAD(d[20:36], udfBlocksize, c.icb)
+		copy(d[udfFIDFixedSize:], name)
+		udfTag(d, udfTagFileIdentifierDescriptor, e.fids+uint32(len(b)/udfBlocksize))
+		b = append(b, d...)
+	}
+	add(e.parent, udfFIDParent, nil)
+	for _, c := range e.children {
+		add(c, 0, udfCharacters(c.fi.name))
+	}
+	return b
+}
+
+// udfFIDSize the size of a file identifier descriptor with a name of n bytes, padded to a multiple of 4
+func udfFIDSize(n int) int {
+	return (udfFIDFixedSize + n + 3) / 4 * 4
+}
+
+// udfTag fill in the tag, ECMA-167 3/7.2, at the start of the descriptor d, whose CRC covers all of it
+func udfTag(d []byte, id uint16, location uint32) {
+	binary.LittleEndian.PutUint16(d[0:2], id)
+	binary.LittleEndian.PutUint16(d[2:4], udfTagVersion)
+	binary.LittleEndian.PutUint16(d[8:10], udfCRC(d[udfDescriptorTagSize:]))
+	binary.LittleEndian.PutUint16(d[10:12], uint16(len(d)-udfDescriptorTagSize))
+	binary.LittleEndian.PutUint32(d[12:16], location)
+	var sum byte
+	for i := 0; i < udfDescriptorTagSize; i++ {
+		if i != 4 {
+			sum += d[i]
+		}
+	}
+	d[4] = sum
+}
+
+// udfCRC the CRC of a descriptor, CRC-ITU-T with the polynomial x^16 + x^12 + x^5 + 1 and an initial value of 0,
+// ECMA-167 1/7.2.6
+func udfCRC(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// udfCharacters encode s as OSTA compressed unicode, UDF 2.1.1: a byte for each character if they all fit in one,
+// else 2 bytes in big-endian UTF-16
+func udfCharacters(s string) []byte {
+	runes := []rune(s)
+	if !slices.ContainsFunc(runes, func(r rune) bool { return r > 0xff }) {
+		b := []byte{8}
+		for _, r := range runes {
+			b = append(b, byte(r))
+		}
+		return b
+	}
+	b := []byte{16}
+	for _, u := range utf16.Encode(runes) {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// udfDString fill in a fixed size field of characters, whose last byte is how many of its bytes are used,
+// cutting s short if it does not fit
+func udfDString(b []byte, s string) {
+	if s == "" {
+		return
+	}
+	c := udfCharacters(s)
+	// whole characters only, of 1 or 2 bytes each after the compression ID
+	width := int(c[0]) / 8
+	for len(c) > len(b)-1 {
+		c = c[:len(c)-width]
+	}
+	copy(b, c)
+	b[len(b)-1] = byte(len(c))
+}
+
+// udfCharspec fill in the character set, UDF 2.1.2, of OSTA compressed unicode
+func udfCharspec(b []byte) {
+	b[0] = 0
+	copy(b[1:], udfCharsetIdentifier)
+}
+
+// udfRegid fill in an entity identifier, ECMA-167 1/7.4, with its identifier suffix
+func udfRegid(b []byte, id string, suffix []byte) {
+	copy(b[1:24], id)
+	copy(b[24:32], suffix)
+}
+
+// udfLongAD fill in a long allocation descriptor, ECMA-167 4/14.14.2, of a recorded extent in partition 0
+func udfLongAD(b []byte, length, block uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], length)
+	binary.LittleEndian.PutUint32(b[4:8], block)
+}
+
+// udfTimestamp fill in a timestamp, ECMA-167 1/7.3, in UTC
+func udfTimestamp(b []byte, t time.Time) {
+	t = t.UTC()
+	// local time, with a time zone 0 minutes from UTC
+	binary.LittleEndian.PutUint16(b[0:2], 1<<12)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(t.Year()))
+	b[4], b[5], b[6], b[7], b[8] = byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second())
+	ns := t.Nanosecond()
+	b[9], b[10], b[11] = byte(ns/10_000_000), byte(ns/100_000%100), byte(ns/1_000%100)
+}
+
+// udfPermissions the permissions of a file entry, ECMA-167 4/14.9.5, from those of the file: execute, write and
+// read, in the same bits as for the file, in 5 bits each for others, group and owner
+func udfPermissions(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	return perm&0o7 | perm>>3&0o7<<5 | perm>>6&0o7<<10
+}
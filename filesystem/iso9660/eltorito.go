@@ -4,8 +4,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
 	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/diskfs/go-diskfs/util"
 )
@@ -14,6 +16,9 @@ import (
 const (
 	elToritoSector        = 0x11
 	elToritoDefaultBlocks = 4
+	// elToritoSectorSize the size of the emulated sectors in which boot images are counted, also that of
+	// the MBR of a hybrid image
+	elToritoSectorSize = 512
 )
 
 // Platform target booting system for a bootable iso
@@ -55,9 +60,13 @@ type ElTorito struct {
 	BootCatalog string
 	// HideBootCatalog if the boot catalog should be hidden in the file system. Defaults to false
 	HideBootCatalog bool
-	// Entries list of ElToritoEntry boot entries
+	// Entries list of ElToritoEntry boot entries. The first is the default entry, which firmware that does
+	// not look further boots. For an image that boots on both BIOS and UEFI, as xorriso makes with
+	// -eltorito-alt-boot, give the BIOS entry first and then the EFI one, whose BootFile is a FAT image with
+	// the EFI loader in EFI/BOOT.
 	Entries []*ElToritoEntry
-	// Platform supported platform
+	// Platform supported platform, only used when there are no Entries, as otherwise the catalog takes its
+	// platform from that of the default entry
 	Platform Platform
 }
 
@@ -84,20 +93,35 @@ type ElToritoEntry struct {
 func (et *ElTorito) generateCatalog() []byte {
 	b := make([]byte, 0)
 	b = append(b, et.validationEntry()...)
-	for i, e := range et.Entries {
-		// only subsequent entries have a header, not the first
-		if i != 0 {
-			b = append(b, e.headerBytes(i == len(et.Entries)-1, 1)...)
+	if len(et.Entries) == 0 {
+		return b
+	}
+	// the default entry has no header, and takes its platform from the validation entry
+	b = append(b, et.Entries[0].entryBytes()...)
+	// each subsequent run of entries for the same platform is a section, with a header giving how many there are
+	rest := et.Entries[1:]
+	for len(rest) > 0 {
+		count := 1
+		for count < len(rest) && rest[count].Platform == rest[0].Platform {
+			count++
+		}
+		b = append(b, rest[0].headerBytes(count == len(rest), uint16(count))...)
+		for _, e := range rest[:count] {
+			b = append(b, e.entryBytes()...)
 		}
-		b = append(b, e.entryBytes()...)
+		rest = rest[count:]
 	}
 	return b
 }
 
 func (et *ElTorito) validationEntry() []byte {
+	platform := et.Platform
+	if len(et.Entries) > 0 {
+		platform = et.Entries[0].Platform
+	}
 	b := make([]byte, 0x20)
 	b[0] = 1
-	b[1] = byte(et.Platform)
+	b[1] = byte(platform)
 	copy(b[4:0x1c], util.AppNameVersion)
 	b[0x1e] = 0x55
 	b[0x1f] = 0xaa
@@ -127,9 +151,14 @@ func (e *ElToritoEntry) headerBytes(last bool, entries uint16) []byte {
 func (e *ElToritoEntry) entryBytes() []byte {
 	blocks := e.LoadSize
 	if blocks == 0 {
-		blocks = uint16(e.size / 512)
-		if e.size%512 > 1 {
-			blocks++
+		sectors := e.size / elToritoSectorSize
+		if e.size%elToritoSectorSize > 0 {
+			sectors++
+		}
+		// an EFI image is often too big to count its sectors, in which case UEFI firmware takes 0 to mean
+		// the image runs to the end of the disk, and finds the size of the FAT filesystem in it
+		if sectors <= math.MaxUint16 {
+			blocks = uint16(sectors)
 		}
 	}
 	b := make([]byte, 0x20)
@@ -183,3 +212,159 @@ func (e *ElToritoEntry) generateBootTable(pvdSector uint32, p string) ([]byte, e
 	binary.LittleEndian.PutUint32(b[12:16], checksum)
 	return b, nil
 }
+
+// readElToritoEntries read the entries of the boot catalog at the given sector, with their platform,
+// location and size as in the catalog
+func (fsm *FileSystem) readElToritoEntries(sector uint32) ([]*ElToritoEntry, error) {
+	const entrySize = 0x20
+	var (
+		b        []byte
+		location = fsm.start + int64(sector)*fsm.blocksize
+	)
+	// entry returns the catalog entry at index i, reading more of the catalog when needed
+	entry := func(i int) ([]byte, error) {
+		for (i+1)*entrySize > len(b) {
+			more := make([]byte, fsm.blocksize)
+			read, err := fsm.backend.ReadAt(more, location+int64(len(b)))
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("unable to read boot catalog: %v", err)
+			}
+			if read != len(more) {
+				return nil, fmt.Errorf("read %d bytes instead of expected %d of boot catalog", read, len(more))
+			}
+			b = append(b, more...)
+		}
+		return b[i*entrySize : (i+1)*entrySize], nil
+	}
+
+	validation, err := entry(0)
+	if err != nil {
+		return nil, err
+	}
+	checksum := uint16(0)
+	for i := 0; i < len(validation); i += 2 {
+		checksum += binary.LittleEndian.Uint16(validation[i : i+2])
+	}
+	if validation[0] != 1 || validation[0x1e] != 0x55 || validation[0x1f] != 0xaa || checksum != 0 {
+		return nil, fmt.Errorf("invalid boot catalog validation entry")
+	}
+	parse := func(platform Platform, e []byte) *ElToritoEntry {
+		return &ElToritoEntry{
+			Platform:    platform,
+			Emulation:   Emulation(e[1] & 0x0f),
+			LoadSegment: binary.LittleEndian.Uint16(e[2:4]),
+			SystemType:  mbr.Type(e[4]),
+			LoadSize:    binary.LittleEndian.Uint16(e[6:8]),
+			size:        uint32(binary.LittleEndian.Uint16(e[6:8])) * elToritoSectorSize,
+			location:    binary.LittleEndian.Uint32(e[8:12]),
+		}
+	}
+	// the initial entry takes its platform from the validation entry
+	initial, err := entry(1)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*ElToritoEntry{parse(Platform(validation[1]), initial)}
+
+	// then any sections, each a header followed by its entries, until the final header
+	for i, final := 2, false; !final; {
+		header, err := entry(i)
+		if err != nil {
+			return nil, err
+		}
+		i++
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		final = header[0] == 0x91
+		platform := Platform(header[1])
+		for count := binary.LittleEndian.Uint16(header[2:4]); count > 0; count-- {
+			e, err := entry(i)
+			if err != nil {
+				return nil, err
+			}
+			i++
+			entries = append(entries, parse(platform, e))
+			// skip any selection criteria extensions that follow the entry
+			for {
+				ext, err := entry(i)
+				if err != nil {
+					return nil, err
+				}
+				if ext[0] != 0x44 {
+					break
+				}
+				i++
+			}
+		}
+	}
+	return entries, nil
+}
+
+// OpenEFIBootImage open the EFI system partition of a bootable image as a FAT filesystem, e.g. to edit
+// the grub.cfg in it when remastering an installer image. It is the image of the first El Torito boot
+// entry for EFI, else, for a hybrid image that starts at the beginning of the disk, an EFI system
+// partition in its MBR, as xorriso appends with -append_partition.
+//
+// The filesystem is opened on the same storage as the ISO, so it can only be changed if that is writable,
+// and as the image is in place, changes to it are changes to the ISO.
+func (fsm *FileSystem) OpenEFIBootImage() (*fat32.FileSystem, error) {
+	if fsm.workspace != "" {
+		return nil, fmt.Errorf("cannot open the EFI boot image of a filesystem in a workspace")
+	}
+	var start, size int64
+	for _, vd := range fsm.volumes.descriptors {
+		boot, ok := vd.(*bootVolumeDescriptor)
+		if !ok {
+			continue
+		}
+		entries, err := fsm.readElToritoEntries(boot.location)
+		if err != nil {
+			return nil, fmt.Errorf("error reading El Torito boot catalog: %v", err)
+		}
+		// the initial entry takes its platform from the validation entry, which is not always right,
+		// so it is only used if no section is for EFI
+		for _, e := range append(entries[1:], entries[0]) {
+			if e.Platform == EFI {
+				start = fsm.start + int64(e.location)*fsm.blocksize
+				break
+			}
+		}
+	}
+	if start == 0 && fsm.start == 0 {
+		table, err := mbr.Read(fsm.backend, elToritoSectorSize, elToritoSectorSize)
+		// an ISO that is not also a disk image has no partition table
+		if err == nil {
+			for _, p := range table.Partitions {
+				if p != nil && p.Type == mbr.EFISystem {
+					start, size = p.GetStart(), p.GetSize()
+					break
+				}
+			}
+		}
+	}
+	if start == 0 {
+		return nil, fmt.Errorf("no EFI boot image found")
+	}
+	// the El Torito entry often does not have the size of the image, so take it from its boot sector
+	if size == 0 {
+		bs := make([]byte, elToritoSectorSize)
+		read, err := fsm.backend.ReadAt(bs, start)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("unable to read EFI boot image boot sector at %d: %v", start, err)
+		}
+		if read != len(bs) {
+			return nil, fmt.Errorf("read %d bytes instead of expected %d of EFI boot image boot sector", read, len(bs))
+		}
+		sectors := int64(binary.LittleEndian.Uint16(bs[0x13:0x15]))
+		if sectors == 0 {
+			sectors = int64(binary.LittleEndian.Uint32(bs[0x20:0x24]))
+		}
+		size = sectors * int64(binary.LittleEndian.Uint16(bs[0x0b:0x0d]))
+	}
+	fs, err := fat32.Read(fsm.backend, size, start, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading EFI boot image at %d: %v", start, err)
+	}
+	return fs, nil
+}
@@ -2,8 +2,10 @@ package iso9660
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/diskfs/go-diskfs/util"
 )
@@ -40,6 +42,45 @@ func TestElToritoGenerateCatalog(t *testing.T) {
 	}
 }
 
+func TestElToritoGenerateCatalogSections(t *testing.T) {
+	// BIOS and UEFI, as xorriso makes with -eltorito-alt-boot
+	et := &ElTorito{
+		Entries: []*ElToritoEntry{
+			{Platform: BIOS, Emulation: NoEmulation, BootFile: "/isolinux.bin", LoadSize: 4, size: 2048, location: 100},
+			{Platform: EFI, Emulation: NoEmulation, BootFile: "/efi.img", size: 2880 * 512, location: 200},
+			{Platform: EFI, Emulation: NoEmulation, BootFile: "/big.img", size: 64 * 1024 * 1024, location: 300},
+		},
+	}
+	b := et.generateCatalog()
+	if len(b) != 5*0x20 {
+		t.Fatalf("catalog is %d bytes instead of %d", len(b), 5*0x20)
+	}
+	// the validation entry has the platform of the default entry, not that of ElTorito
+	if !bytes.Equal(b[0:0x20], et.validationEntry()) || b[1] != byte(BIOS) {
+		t.Errorf("mismatched validation entry % x", b[0:0x20])
+	}
+	// the EFI entries are in a single, final, section
+	if expected := et.Entries[1].headerBytes(true, 2); !bytes.Equal(b[0x40:0x60], expected) {
+		t.Errorf("mismatched section header, actual then expected\n% x\n% x\n", b[0x40:0x60], expected)
+	}
+	// the second EFI image is too big for its sectors to be counted
+	for i, sectors := range []uint16{4, 2880, 0} {
+		e := b[0x20:0x40]
+		if i > 0 {
+			e = b[0x40+i*0x20 : 0x60+i*0x20]
+		}
+		if actual := binary.LittleEndian.Uint16(e[6:8]); actual != sectors {
+			t.Errorf("entry %d: %d sectors instead of %d", i, actual, sectors)
+		}
+	}
+
+	// ElTorito.Platform is only used when there are no entries
+	et = &ElTorito{Platform: EFI}
+	if b := et.generateCatalog(); len(b) != 0x20 || b[1] != byte(EFI) {
+		t.Errorf("mismatched catalog with no entries % x", b)
+	}
+}
+
 func TestElToritoValidationEntry(t *testing.T) {
 	et := &ElTorito{
 		BootCatalog:     "/boot.cat",
@@ -113,3 +154,59 @@ func TestElToritoEntryBytes(t *testing.T) {
 		t.Errorf("Mismatched bytes, actual then expected\n% x\n% x\n", b, expected)
 	}
 }
+
+func TestElToritoReadEntries(t *testing.T) {
+	et := &ElTorito{
+		Platform: BIOS,
+		Entries: []*ElToritoEntry{
+			{Platform: BIOS, Emulation: NoEmulation, LoadSegment: 0x7c0, SystemType: mbr.Linux, LoadSize: 4, location: 100},
+			{Platform: PPC, Emulation: HardDiskEmulation, SystemType: mbr.Fat16, size: 2048, location: 200},
+		},
+	}
+	efi := &ElToritoEntry{Platform: EFI, Emulation: NoEmulation, SystemType: mbr.EFISystem, size: 512 * 100, location: 300}
+	catalog := et.generateCatalog()
+	// a final section with an entry followed by a selection criteria extension, then another entry
+	catalog = append(catalog, efi.headerBytes(true, 2)...)
+	catalog = append(catalog, efi.entryBytes()...)
+	extension := make([]byte, 0x20)
+	extension[0] = 0x44
+	catalog = append(catalog, extension...)
+	catalog = append(catalog, efi.entryBytes()...)
+	// mark the earlier section as not the last
+	catalog[0x40] = 0x90
+
+	b, err := mem.New(8 * 2048)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	if _, err := b.WriteAt(catalog, 3*2048); err != nil {
+		t.Fatalf("unable to write catalog: %v", err)
+	}
+	fs := &FileSystem{backend: b, blocksize: 2048}
+	entries, err := fs.readElToritoEntries(3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []*ElToritoEntry{
+		{Platform: BIOS, Emulation: NoEmulation, LoadSegment: 0x7c0, SystemType: mbr.Linux, LoadSize: 4, size: 2048, location: 100},
+		{Platform: PPC, Emulation: HardDiskEmulation, SystemType: mbr.Fat16, LoadSize: 4, size: 2048, location: 200},
+		{Platform: EFI, Emulation: NoEmulation, SystemType: mbr.EFISystem, LoadSize: 100, size: 512 * 100, location: 300},
+		{Platform: EFI, Emulation: NoEmulation, SystemType: mbr.EFISystem, LoadSize: 100, size: 512 * 100, location: 300},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("read %d entries instead of %d", len(entries), len(expected))
+	}
+	for i, e := range entries {
+		if *e != *expected[i] {
+			t.Errorf("entry %d is %+v instead of %+v", i, *e, *expected[i])
+		}
+	}
+
+	// a broken validation entry
+	if _, err := b.WriteAt([]byte{0xff}, 3*2048+4); err != nil {
+		t.Fatalf("unable to write catalog: %v", err)
+	}
+	if _, err := fs.readElToritoEntries(3); err == nil {
+		t.Errorf("no error reading catalog with bad checksum")
+	}
+}
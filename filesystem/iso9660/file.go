@@ -31,6 +31,9 @@ func (fl *File) Read(b []byte) (int, error) {
 	// we have the DirectoryEntry, so we can get the starting location and size
 	// since iso9660 files are contiguous, we only need the starting location and size
 	//   to get the entire file
+	if sf, ok := fl.sparseFile(); ok {
+		return fl.readSparse(b, sf)
+	}
 	fs := fl.filesystem
 	size := int(fl.size) - int(fl.offset)
 	location := int(fl.location)
@@ -80,7 +83,7 @@ func (fl *File) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekStart:
 		newOffset = offset
 	case io.SeekEnd:
-		newOffset = int64(fl.size) + offset
+		newOffset = fl.Size() + offset
 	case io.SeekCurrent:
 		newOffset = fl.offset + offset
 	}
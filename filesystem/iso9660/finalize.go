@@ -1,6 +1,7 @@
 package iso9660
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/fs"
@@ -8,11 +9,13 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/util"
 	"github.com/djherbis/times"
 )
@@ -21,8 +24,13 @@ const (
 	dataStartSector         = 16
 	defaultVolumeIdentifier = "ISOIMAGE"
 	elToritoBootTableOffset = 8
+	// finalizeBufferSize how much Finalize holds in memory at once when writing directories, path tables and files
+	finalizeBufferSize = int(1024 * KB)
 )
 
+// invalidISOCharsRegexp characters that may not be in an ISO9660 name
+var invalidISOCharsRegexp = regexp.MustCompile("[^A-Z0-9_]")
+
 // FinalizeOptions options to pass to finalize
 type FinalizeOptions struct {
 	// RockRidge enable Rock Ridge extensions
@@ -33,6 +41,48 @@ type FinalizeOptions struct {
 	ElTorito *ElTorito
 	// VolumeIdentifier custom volume name, defaults to "ISOIMAGE"
 	VolumeIdentifier string
+	// SparseFiles store files with whole blocks of zeroes as Rock Ridge sparse files, so that those blocks
+	// take no space in the image. Only used with RockRidge. Readers without Rock Ridge see the sparse file tables
+	// instead of the contents of such files.
+	SparseFiles bool
+	// Exclude leave paths out of the image, like mkisofs -m, given as path.Match patterns. A pattern with no slash
+	// is matched against the name of every file and directory, any other pattern against the whole path in
+	// the image, relative to its root. Excluding a directory excludes everything in it.
+	Exclude []string
+	// Include keep paths in the image even if they are excluded, given as patterns like those of Exclude.
+	// Including a path in an excluded directory also includes its parent directories, but none of their
+	// other contents.
+	Include []string
+	// Rewrite place files and directories somewhere else in the image than where they are in the workspace,
+	// or add them from outside the workspace, like mkisofs -graft-points. The first rule whose Source is
+	// a path or one of its parent directories applies to it.
+	Rewrite []RewriteRule
+	// Hybrid write partition tables in the system area as well, so that the image also boots when written
+	// to a USB stick, using the El Torito boot images
+	Hybrid *Hybrid
+	// OmitVersionNumbers write file identifiers without the version number ";1", like mkisofs -N. ECMA-119
+	// requires it, but it means nothing on a data disc, and Linux, Windows and macOS all read files without it.
+	OmitVersionNumbers bool
+	// NameNormalization the Unicode normalization form to write Rock Ridge names in, e.g. NFC for a tree made on
+	// macOS, which writes names in NFD, to be read on Linux. In Strict mode, two names in a directory that are the
+	// same once normalized are an error, filesystem.ErrAmbiguousName; otherwise both are written as they are.
+	// Defaults to filesystem.NormalizationNone, i.e. names are written as they are.
+	NameNormalization filesystem.NameNormalization
+	// DVDVideo write a DVD-Video image, like mkisofs -dvd-video: a UDF 1.02 bridge, which DVD players read, with the
+	// files of VIDEO_TS first, in the order players read them, each starting on a 32 KiB boundary. The workspace
+	// must have a directory VIDEO_TS at its root, and only regular files and directories. It cannot be used with
+	// ElTorito, Hybrid or SparseFiles, and needs a blocksize of 2048.
+	DVDVideo bool
+}
+
+// RewriteRule places a file or directory, with everything in it, at a path in the image
+type RewriteRule struct {
+	// Source the file or directory to place. A relative path is one in the workspace, which is moved to
+	// Target, while an absolute path is one anywhere on the host, which is added at Target.
+	Source string
+	// Target the path in the image, relative to its root. Any of its parent directories that are not
+	// in the workspace are created.
+	Target string
 }
 
 // finalizeFileInfo is a file info useful for finalization
@@ -49,6 +99,7 @@ type FinalizeOptions struct {
 //
 //	AccessTime() time.Time
 //	ChangeTime() time.Time
+//	CreateTime() time.Time
 //	Nlink() uint32         // number of hardlinks, if supported
 //	Uid()   uint32         // uid, if supported
 //	Gid()   uint32         // gid, if supported
@@ -56,9 +107,11 @@ type FinalizeOptions struct {
 //nolint:structcheck // keep unused members so that we can know their references
 type finalizeFileInfo struct {
 	path               string
+	source             string // where the file is on the host, empty for directories that only exist in the image
 	target             string
 	shortname          string
 	extension          string
+	omitVersion        bool // write the file identifier without its version number
 	location           uint32
 	blocks             uint32 // blocks for the directory itself and its entries
 	continuationBlocks uint32 // blocks for CE entries
@@ -70,6 +123,7 @@ type finalizeFileInfo struct {
 	modTime            time.Time
 	accessTime         time.Time
 	changeTime         time.Time
+	createTime         time.Time
 	isDir              bool
 	isRoot             bool
 	bytes              [][]byte
@@ -86,11 +140,14 @@ type finalizeFileInfo struct {
 	// then this content is used, rather than anything on disk.
 	content []byte
 	serial  uint64
+	// sparse if the file is written as a Rock Ridge sparse file, how it is laid out
+	sparse *sparseLayout
 }
 
 func finalizeFileInfoFromFile(p, fullPath string, fi fs.FileInfo) (*finalizeFileInfo, error) {
 	isRoot := p == "."
-	name := fi.Name()
+	// the name in the image, which can differ from that on the host
+	name := path.Base(p)
 	shortname, _ := calculateShortnameExtension(name)
 
 	if isRoot {
@@ -102,25 +159,35 @@ func finalizeFileInfoFromFile(p, fullPath string, fi fs.FileInfo) (*finalizeFile
 		return nil, fmt.Errorf("could not get times information for %s: %w", fullPath, err)
 	}
 	mode := fi.Mode()
+	size := fi.Size()
 	var target string
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 		target, err = os.Readlink(fullPath)
 		if err != nil {
 			return nil, fmt.Errorf("unable to read link for %s: %w", fullPath, err)
 		}
+		// a symlink has no data, only the target that Rock Ridge records for it
+		size = 0
 	}
 	nlink, uid, gid := statt(fi)
+	// not every host records when a file was created, in which case it is taken to be when it was last modified
+	createTime := fi.ModTime()
+	if t.HasBirthTime() {
+		createTime = t.BirthTime()
+	}
 
 	return &finalizeFileInfo{
 		path:       p,
+		source:     fullPath,
 		name:       name,
 		isDir:      fi.IsDir(),
 		isRoot:     isRoot,
 		modTime:    fi.ModTime(),
 		accessTime: t.AccessTime(),
 		changeTime: t.ChangeTime(),
+		createTime: createTime,
 		mode:       mode,
-		size:       fi.Size(),
+		size:       size,
 		shortname:  shortname,
 		linkTarget: target,
 		uid:        uid,
@@ -132,7 +199,11 @@ func finalizeFileInfoFromFile(p, fullPath string, fi fs.FileInfo) (*finalizeFile
 func (fi *finalizeFileInfo) Name() string {
 	// we are using plain iso9660 (without extensions), so just shortname possibly with extension
 	ret := fi.shortname
-	if !fi.isDir {
+	switch {
+	case fi.isDir:
+	case fi.omitVersion:
+		ret = fmt.Sprintf("%s.%s", fi.shortname, fi.extension)
+	default:
 		ret = fmt.Sprintf("%s.%s;1", fi.shortname, fi.extension)
 	}
 	// shortname already is ucased
@@ -168,6 +239,9 @@ func (fi *finalizeFileInfo) AccessTime() time.Time {
 func (fi *finalizeFileInfo) ChangeTime() time.Time {
 	return fi.changeTime
 }
+func (fi *finalizeFileInfo) CreateTime() time.Time {
+	return fi.createTime
+}
 func (fi *finalizeFileInfo) LinkTarget() string {
 	return fi.linkTarget
 }
@@ -182,10 +256,15 @@ func (fi *finalizeFileInfo) GID() uint32 {
 }
 
 func (fi *finalizeFileInfo) toDirectoryEntry(fsm *FileSystem, isSelf, isParent bool) (*directoryEntry, error) {
+	size := uint32(fi.Size())
+	// the extent of a sparse file holds only its tables and the blocks that are not zeroes
+	if fi.sparse != nil {
+		size = fi.sparse.blocks() * uint32(fsm.blocksize)
+	}
 	de := &directoryEntry{
 		extAttrSize:              0,
 		location:                 fi.location,
-		size:                     uint32(fi.Size()),
+		size:                     size,
 		creation:                 fi.ModTime(),
 		isHidden:                 false,
 		isSubdirectory:           fi.IsDir(),
@@ -424,6 +503,10 @@ func (fi *finalizeFileInfo) addChild(entry *finalizeFileInfo) {
 
 // Finalize finalize a read-only filesystem by writing it out to a read-only format
 //
+// Files are copied from the workspace to the image a buffer at a time and closed as soon as they are copied, and
+// directory records and path tables are written through the same buffer, so the memory Finalize uses grows
+// with the number of files and directories, not with their size.
+//
 //nolint:gocyclo // this finalize function is complex and needs to be. We might be better off refactoring it to multiple functions, but it does not buy all that much.
 func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 	if fsm.workspace == "" {
@@ -481,16 +564,310 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 		return fmt.Errorf("only wrote %d bytes instead of expected %d to system area", n, len(b))
 	}
 
+	l, err := fsm.layout(options)
+	if err != nil {
+		return err
+	}
+	root, dirs, files, catEntry := l.root, l.dirs, l.files, l.catEntry
+	pathTableSize := l.pathTableSize
+	pathTableLLocation, pathTableMLocation := l.pathTableLLocation, l.pathTableMLocation
+
+	volIdentifier := defaultVolumeIdentifier
+	if options.VolumeIdentifier != "" {
+		volIdentifier = options.VolumeIdentifier
+	}
+
+	// everything from here is written in the order of its location, through a single buffer, so memory does not
+	// grow with the size of the files, nor with that of the directories and path tables
+	w := newSequentialWriter(f, finalizeBufferSize)
+
+	// now we can write each one out - dirs first then files
+	for _, e := range dirs {
+		if err := w.seek(int64(e.location) * int64(blocksize)); err != nil {
+			return fmt.Errorf("could not write directories: %v", err)
+		}
+		var d *Directory
+		d, err = e.toDirectory(fsm)
+		if err != nil {
+			return fmt.Errorf("unable to convert entry to directory: %v", err)
+		}
+		// Directory.toBytes() always returns whole blocks
+		// get the continuation entry locations
+		ceLocations := make([]uint32, 0)
+		ceLocationStart := e.location + e.blocks
+		for i := 0; i < int(e.continuationBlocks); i++ {
+			ceLocations = append(ceLocations, ceLocationStart+uint32(i))
+		}
+		var p [][]byte
+		p, err = d.entriesToBytes(ceLocations)
+		if err != nil {
+			return fmt.Errorf("could not convert directory to bytes: %v", err)
+		}
+		for _, block := range p {
+			if _, err := w.Write(block); err != nil {
+				return fmt.Errorf("could not write directory %s: %v", e.path, err)
+			}
+		}
+	}
+
+	// now write out the path tables, L & M
+	if err := w.seek(int64(pathTableLLocation) * int64(blocksize)); err != nil {
+		return fmt.Errorf("could not write directories: %v", err)
+	}
+	if err := l.pathTable.write(w, binary.LittleEndian); err != nil {
+		return fmt.Errorf("could not write L path table: %v", err)
+	}
+	if err := w.seek(int64(pathTableMLocation) * int64(blocksize)); err != nil {
+		return fmt.Errorf("could not write L path table: %v", err)
+	}
+	if err := l.pathTable.write(w, binary.BigEndian); err != nil {
+		return fmt.Errorf("could not write M path table: %v", err)
+	}
+	if err := w.flush(); err != nil {
+		return fmt.Errorf("could not write path tables: %v", err)
+	}
+
+	// file data is copied straight across, a buffer at a time
+	buf := w.buf[:cap(w.buf)]
+	for _, e := range files {
+		if err := fsm.writeFinalizeFile(f, e, buf); err != nil {
+			return err
+		}
+	}
+
+	totalSize := l.totalBlocks
+	location := uint32(dataStartSector)
+	// create and write the primary volume descriptor, supplementary and boot, and volume descriptor set terminator
+	now := time.Now()
+	rootDE, err := root.toDirectoryEntry(fsm, true, false)
+	if err != nil {
+		return fmt.Errorf("could not convert root entry for primary volume descriptor to dirEntry: %v", err)
+	}
+
+	pvd := &primaryVolumeDescriptor{
+		systemIdentifier:           "",
+		volumeIdentifier:           volIdentifier,
+		volumeSize:                 totalSize,
+		setSize:                    1,
+		sequenceNumber:             1,
+		blocksize:                  uint16(fsm.blocksize),
+		pathTableSize:              uint32(pathTableSize),
+		pathTableLLocation:         pathTableLLocation,
+		pathTableLOptionalLocation: 0,
+		pathTableMLocation:         pathTableMLocation,
+		pathTableMOptionalLocation: 0,
+		volumeSetIdentifier:        "",
+		publisherIdentifier:        "",
+		preparerIdentifier:         util.AppNameVersion,
+		applicationIdentifier:      "",
+		copyrightFile:              "", // 37 bytes
+		abstractFile:               "", // 37 bytes
+		bibliographicFile:          "", // 37 bytes
+		creation:                   now,
+		modification:               now,
+		expiration:                 now,
+		effective:                  now,
+		rootDirectoryEntry:         rootDE,
+	}
+	b = pvd.toBytes()
+	_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
+	location++
+
+	// do we have a boot sector?
+	if options.ElTorito != nil {
+		bvd := &bootVolumeDescriptor{location: catEntry.location}
+		b = bvd.toBytes()
+		_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
+		location++
+	}
+	terminator := &terminatorVolumeDescriptor{}
+	b = terminator.toBytes()
+	_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
+
+	if options.Hybrid != nil {
+		if err := options.Hybrid.write(f, options.ElTorito, fsm.blocksize, int64(totalSize)*fsm.blocksize); err != nil {
+			return fmt.Errorf("could not write hybrid partition tables: %v", err)
+		}
+	}
+	if l.udf != nil {
+		if err := l.udf.write(f, volIdentifier, now); err != nil {
+			return fmt.Errorf("could not write UDF bridge: %v", err)
+		}
+	}
+
+	_ = os.RemoveAll(fsm.workspace)
+
+	// finish by setting as finalized
+	fsm.workspace = ""
+	return nil
+}
+
+// writeFinalizeFile copy a file from the workspace to its location in the image, padding its last block with
+// zeroes, using buf to copy through
+func (fsm *FileSystem) writeFinalizeFile(f backend.WritableFile, e *finalizeFileInfo, buf []byte) error {
+	var (
+		copied           int
+		bootTableMinSize int
+		blocksize        = int(fsm.blocksize)
+		writeAt          = int64(e.location) * int64(blocksize)
+	)
+	if e.content != nil {
+		if _, err := f.WriteAt(e.content, writeAt); err != nil {
+			return fmt.Errorf("failed to write content of %s to disk: %v", e.path, err)
+		}
+		return padBlock(f, writeAt, len(e.content), blocksize, buf)
+	}
+
+	if e.mode&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	// each file is closed as soon as it is copied, so that a large tree does not run out of file descriptors
+	from, err := os.Open(e.source)
+	if err != nil {
+		return fmt.Errorf("failed to open file for reading %s: %v", e.path, err)
+	}
+	defer from.Close()
+
+	switch {
+	case e.sparse != nil:
+		if err := e.sparse.write(from, f, e.location, blocksize); err != nil {
+			return fmt.Errorf("failed to write sparse file %s to disk: %v", e.path, err)
+		}
+		return nil
+	case e.elToritoEntry != nil && e.elToritoEntry.BootTable:
+		// copy first 8 bytes, then insert the El Torito Boot Information Table, then the rest
+		var count int
+
+		// first 8 bytes
+		count, err = copyFileData(from, f, 0, writeAt, elToritoBootTableOffset, buf)
+		if err != nil {
+			return fmt.Errorf("failed to copy first bytes 0-8 of boot file to disk %s: %v", e.path, err)
+		}
+		copied += count
+		// insert El Torito Boot Information Table
+		bootTable, err := e.elToritoEntry.generateBootTable(dataStartSector, e.source)
+		if err != nil {
+			return fmt.Errorf("failed to generate boot table for %s: %v", e.path, err)
+		}
+		count, err = f.WriteAt(bootTable, writeAt+elToritoBootTableOffset)
+		if err != nil {
+			return fmt.Errorf("failed to write 56 byte boot table to disk %s: %v", e.path, err)
+		}
+		copied += count
+		// file with boot table file must be a minimum of boot table size and the offset
+		bootTableMinSize = count
+		// remainder of file
+		count, err = copyFileData(from, f, 64, writeAt+64, 0, buf)
+		if err != nil {
+			return fmt.Errorf("failed to copy bytes 64 to end of boot file to disk %s: %v", e.path, err)
+		}
+		copied += count
+	default:
+		copied, err = copyFileData(from, f, 0, writeAt, 0, buf)
+		if err != nil {
+			return fmt.Errorf("failed to copy file to disk %s: %v", e.path, err)
+		}
+	}
+	targetSize := e.Size()
+	if targetSize < int64(bootTableMinSize) {
+		targetSize = int64(bootTableMinSize)
+	}
+	if copied != int(targetSize) {
+		return fmt.Errorf("error copying file %s to disk, copied %d bytes, expected %d", e.path, copied, targetSize)
+	}
+	return padBlock(f, writeAt, copied, blocksize, buf)
+}
+
+// padBlock fill in the rest of the last block of a file of size bytes at writeAt, if it is partial, with zeroes
+// from buf
+func padBlock(f backend.WritableFile, writeAt int64, size, blocksize int, buf []byte) error {
+	if size%blocksize == 0 {
+		return nil
+	}
+	zeroes := buf[:blocksize-size%blocksize]
+	clear(zeroes)
+	if _, err := f.WriteAt(zeroes, writeAt+int64(size)); err != nil {
+		return fmt.Errorf("could not pad last block: %v", err)
+	}
+	return nil
+}
+
+// EstimateSize returns the size in bytes of the image that Finalize would write, given the current contents
+// of the workspace and the same options, so that the backing storage can be sized before calling Finalize.
+func (fsm *FileSystem) EstimateSize(options FinalizeOptions) (int64, error) {
+	if fsm.workspace == "" {
+		return 0, fmt.Errorf("cannot estimate the size of an already finalized filesystem")
+	}
+	// Finalize enables the extensions for Rock Ridge, but estimating should leave the filesystem as it was
+	if options.RockRidge {
+		suspEnabled, suspExtensions := fsm.suspEnabled, fsm.suspExtensions
+		defer func() {
+			fsm.suspEnabled, fsm.suspExtensions = suspEnabled, suspExtensions
+		}()
+		fsm.suspEnabled = true
+		fsm.suspExtensions = append(slices.Clone(fsm.suspExtensions), getRockRidgeExtension(rockRidge112))
+	}
+	l, err := fsm.layout(options)
+	if err != nil {
+		return 0, err
+	}
+	return int64(l.totalBlocks) * fsm.blocksize, nil
+}
+
+// finalizeLayout where every directory, path table and file goes in the image, calculated before anything is written
+type finalizeLayout struct {
+	root               *finalizeFileInfo
+	dirs               []*finalizeFileInfo
+	files              []*finalizeFileInfo
+	catEntry           *finalizeFileInfo
+	pathTable          *pathTable
+	pathTableSize      int
+	pathTableLLocation uint32
+	pathTableMLocation uint32
+	// udf the UDF side of a bridge image, if any
+	udf *udfBridge
+	// totalBlocks the size of the whole image in blocks
+	totalBlocks uint32
+}
+
+// layout walk the workspace and assign a location to everything that is to be written
+func (fsm *FileSystem) layout(options FinalizeOptions) (*finalizeLayout, error) {
+	blocksize := int(fsm.blocksize)
+
+	if options.Hybrid != nil {
+		if err := options.Hybrid.validate(options.ElTorito); err != nil {
+			return nil, err
+		}
+	}
+	if options.DVDVideo {
+		if err := validateDVDVideo(options, blocksize); err != nil {
+			return nil, err
+		}
+	}
+
 	// 3- build out file tree
-	fileList, dirList, err := walkTree(fsm.Workspace())
+	fileList, dirList, err := walkTree(fsm.Workspace(), options)
 	if err != nil {
-		return fmt.Errorf("error walking tree: %v", err)
+		return nil, fmt.Errorf("error walking tree: %v", err)
+	}
+
+	if err := normalizeNames(dirList, options.NameNormalization); err != nil {
+		return nil, err
 	}
 
 	// starting point
 	root := dirList["."]
 	root.addProperties(1)
 
+	// UDF has the tree as it is, so is laid out before any directories are relocated
+	var udf *udfBridge
+	if options.DVDVideo {
+		if udf, err = newUDFBridge(root); err != nil {
+			return nil, err
+		}
+	}
+
 	// if we need to relocate directories, must do them here, before finalizing order and sizes
 	// do not bother if enabled DeepDirectories, i.e. non-ISO9660 compliant
 	if !options.DeepDirectories {
@@ -505,21 +882,22 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 			var relocateFiles []*finalizeFileInfo
 			relocateFiles, dirList, err = handler.Relocate(dirList)
 			if err != nil {
-				return fmt.Errorf("unable to use extension %s to relocate directories from depth > 8: %v", handler.ID(), err)
+				return nil, fmt.Errorf("unable to use extension %s to relocate directories from depth > 8: %v", handler.ID(), err)
 			}
 			fileList = append(fileList, relocateFiles...)
 		}
 		// check if there are any deeper than 9
 		for _, e := range dirList {
 			if e.depth > 8 {
-				return fmt.Errorf("directory %s deeper than 8 deep and DeepDirectories override not enabled", e.path)
+				return nil, fmt.Errorf("directory %s deeper than 8 deep and DeepDirectories override not enabled", e.path)
 			}
 		}
 	}
 
-	// convert sizes to required blocks for files
+	// convert sizes to required blocks for files, and settle their identifiers
 	for _, e := range fileList {
 		e.blocks = calculateBlocks(e.size, fsm.blocksize)
+		e.omitVersion = options.OmitVersionNumbers
 	}
 
 	// we now have list of all of the files and directories and their properties, as well as children of every directory
@@ -528,6 +906,13 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 	dirs = append(dirs, root)
 	subdirs, files := root.collapseAndSortChildren()
 	dirs = append(dirs, subdirs...)
+	// the files of VIDEO_TS go first, and are aligned
+	var aligned int
+	if udf != nil {
+		if files, aligned, err = dvdVideoOrder(root, files); err != nil {
+			return nil, err
+		}
+	}
 
 	// calculate the sizes and locations of the directories from the flat list and assign blocks
 	rootLocation := uint32(dataStartSector + 2)
@@ -535,6 +920,10 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 	if options.ElTorito != nil {
 		rootLocation++
 	}
+	// for UDF, after its file entries and directories at the start of its partition
+	if udf != nil {
+		rootLocation = udfPartitionStart + udf.metadataBlocks
+	}
 	location := rootLocation
 
 	var (
@@ -557,16 +946,18 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 		catSize := int64(len(bootcat))
 		now := time.Now()
 		catEntry = &finalizeFileInfo{
-			content:    bootcat,
-			size:       catSize,
-			path:       catname,
-			name:       path.Base(catname),
-			shortname:  shortname,
-			extension:  extension,
-			blocks:     calculateBlocks(catSize, fsm.blocksize),
-			modTime:    now,
-			accessTime: now,
-			changeTime: now,
+			content:     bootcat,
+			size:        catSize,
+			path:        catname,
+			name:        path.Base(catname),
+			shortname:   shortname,
+			extension:   extension,
+			blocks:      calculateBlocks(catSize, fsm.blocksize),
+			modTime:     now,
+			accessTime:  now,
+			changeTime:  now,
+			createTime:  now,
+			omitVersion: options.OmitVersionNumbers,
 		}
 		// make it the first file
 		files = append([]*finalizeFileInfo{catEntry}, files...)
@@ -576,7 +967,7 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 			var parent *finalizeFileInfo
 			parent, err = root.findEntry(path.Dir(catname))
 			if err != nil {
-				return fmt.Errorf("error finding parent for boot catalog %s: %v", catname, err)
+				return nil, fmt.Errorf("error finding parent for boot catalog %s: %v", catname, err)
 			}
 			parent.addChild(catEntry)
 		}
@@ -584,7 +975,7 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 			var parent, child *finalizeFileInfo
 			parent, err = root.findEntry(path.Dir(e.BootFile))
 			if err != nil {
-				return fmt.Errorf("error finding parent for boot image file %s: %v", e.BootFile, err)
+				return nil, fmt.Errorf("error finding parent for boot image file %s: %v", e.BootFile, err)
 			}
 			// did we ask to hide any image files?
 			if e.HideBootFile {
@@ -592,11 +983,11 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 			} else {
 				child, err = parent.findEntry(path.Base(e.BootFile))
 				if err != nil {
-					return fmt.Errorf("unable to find image child %s: %v", e.BootFile, err)
+					return nil, fmt.Errorf("unable to find image child %s: %v", e.BootFile, err)
 				}
 			}
 			if child == nil {
-				return fmt.Errorf("unable to find image child %s: %v", e.BootFile, err)
+				return nil, fmt.Errorf("unable to find image child %s: %v", e.BootFile, err)
 			}
 			// save the child so we can add location late
 			e.size = uint32(child.size)
@@ -604,12 +995,28 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 		}
 	}
 
+	// sparse files change both the blocks of the files and the size of their directory entries
+	if options.RockRidge && options.SparseFiles {
+		for _, e := range files {
+			if e.content != nil || e.elToritoEntry != nil {
+				continue
+			}
+			e.sparse, err = newSparseLayout(e.source, e.size, blocksize)
+			if err != nil {
+				return nil, fmt.Errorf("could not check %s for sparse blocks: %v", e.path, err)
+			}
+			if e.sparse != nil {
+				e.blocks = e.sparse.blocks()
+			}
+		}
+	}
+
 	var size, ceBlocks int
 	for _, dir := range dirs {
 		dir.location = location
 		size, ceBlocks, err = dir.calculateDirectorySize(fsm)
 		if err != nil {
-			return fmt.Errorf("unable to calculate size of directory for %s: %v", dir.path, err)
+			return nil, fmt.Errorf("unable to calculate size of directory for %s: %v", dir.path, err)
 		}
 		dir.size = int64(size)
 		dir.blocks = calculateBlocks(int64(size), int64(blocksize))
@@ -623,10 +1030,8 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 	// create the pathtables (L & M)
 	// with the list of directories, we can make a path table
 	pathTable := createPathTable(dirs)
-	// how big is the path table? we will take LSB for now, because they are the same size
-	pathTableLBytes := pathTable.toLBytes()
-	pathTableMBytes := pathTable.toMBytes()
-	pathTableSize := len(pathTableLBytes)
+	// the L and M tables are the same size; they are written a record at a time, so only their size is needed here
+	pathTableSize := pathTable.size()
 	pathTableBlocks := uint32(pathTableSize / blocksize)
 	if pathTableSize%blocksize > 0 {
 		pathTableBlocks++
@@ -637,13 +1042,10 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 	pathTableMLocation := location
 	location += pathTableBlocks
 
-	// if we asked for ElTorito, need to generate the boot catalog and save it
-	volIdentifier := defaultVolumeIdentifier
-	if options.VolumeIdentifier != "" {
-		volIdentifier = options.VolumeIdentifier
-	}
-
-	for _, e := range files {
+	for i, e := range files {
+		if i < aligned {
+			location = udf.align(location)
+		}
 		e.location = location
 		location += e.blocks
 		if e.elToritoEntry != nil {
@@ -657,172 +1059,35 @@ func (fsm *FileSystem) Finalize(options FinalizeOptions) error {
 		catEntry.content = bootcat
 	}
 
-	// now we can write each one out - dirs first then files
-	for _, e := range dirs {
-		writeAt := int64(e.location) * int64(blocksize)
-		var d *Directory
-		d, err = e.toDirectory(fsm)
-		if err != nil {
-			return fmt.Errorf("unable to convert entry to directory: %v", err)
-		}
-		// Directory.toBytes() always returns whole blocks
-		// get the continuation entry locations
-		ceLocations := make([]uint32, 0)
-		ceLocationStart := e.location + e.blocks
-		for i := 0; i < int(e.continuationBlocks); i++ {
-			ceLocations = append(ceLocations, ceLocationStart+uint32(i))
-		}
-		var p [][]byte
-		p, err = d.entriesToBytes(ceLocations)
-		if err != nil {
-			return fmt.Errorf("could not convert directory to bytes: %v", err)
-		}
-		for i, e := range p {
-			_, _ = f.WriteAt(e, writeAt+int64(i*blocksize))
-		}
+	// the secondary GPT of a hybrid image goes after everything else, as does the second anchor of UDF
+	if options.Hybrid != nil {
+		location += options.Hybrid.reservedBlocks(blocksize)
 	}
-
-	// now write out the path tables, L & M
-	writeAt := int64(pathTableLLocation) * int64(blocksize)
-	_, _ = f.WriteAt(pathTableLBytes, writeAt)
-	writeAt = int64(pathTableMLocation) * int64(blocksize)
-	_, _ = f.WriteAt(pathTableMBytes, writeAt)
-
-	var closeFiles []*os.File
-	defer func() {
-		for _, f := range closeFiles {
-			f.Close()
-		}
-	}()
-	for _, e := range files {
-		var (
-			from             *os.File
-			copied           int
-			bootTableMinSize int
-		)
-		writeAt := int64(e.location) * int64(blocksize)
-		if e.content == nil {
-			// for file, just copy the data across
-			from, err = os.Open(path.Join(fsm.workspace, e.path))
-			if err != nil {
-				return fmt.Errorf("failed to open file for reading %s: %v", e.path, err)
-			}
-			closeFiles = append(closeFiles, from)
-			if e.elToritoEntry != nil && e.elToritoEntry.BootTable {
-				// copy first 8 bytes, then insert the El Torito Boot Information Table, then the rest
-				var count int
-
-				// first 8 bytes
-				count, err = copyFileData(from, f, 0, writeAt, elToritoBootTableOffset)
-				if err != nil {
-					return fmt.Errorf("failed to copy first bytes 0-8 of boot file to disk %s: %v", e.path, err)
-				}
-				copied += count
-				// insert El Torito Boot Information Table
-				bootTable, err := e.elToritoEntry.generateBootTable(dataStartSector, path.Join(fsm.workspace, e.path))
-				if err != nil {
-					return fmt.Errorf("failed to generate boot table for %s: %v", e.path, err)
-				}
-				count, err = f.WriteAt(bootTable, writeAt+elToritoBootTableOffset)
-				if err != nil {
-					return fmt.Errorf("failed to write 56 byte boot table to disk %s: %v", e.path, err)
-				}
-				copied += count
-				// file with boot table file must be a minimum of boot table size and the offset
-				bootTableMinSize = count
-				// remainder of file
-				count, err = copyFileData(from, f, 64, writeAt+64, 0)
-				if err != nil {
-					return fmt.Errorf("failed to copy bytes 64 to end of boot file to disk %s: %v", e.path, err)
-				}
-				copied += count
-			} else {
-				copied, err = copyFileData(from, f, 0, writeAt, 0)
-				if err != nil {
-					return fmt.Errorf("failed to copy file to disk %s: %v", e.path, err)
-				}
-			}
-			targetSize := e.Size()
-			if targetSize < int64(bootTableMinSize) {
-				targetSize = int64(bootTableMinSize)
-			}
-			if copied != int(targetSize) {
-				return fmt.Errorf("error copying file %s to disk, copied %d bytes, expected %d", e.path, copied, targetSize)
-			}
-		} else {
-			copied = len(e.content)
-			if _, err = f.WriteAt(e.content, writeAt); err != nil {
-				return fmt.Errorf("failed to write content of %s to disk: %v", e.path, err)
-			}
-		}
-		// fill in
-		left := blocksize - (copied % blocksize)
-		if left > 0 {
-			b2 := make([]byte, left)
-			_, _ = f.WriteAt(b2, writeAt+int64(copied))
-		}
+	if udf != nil {
+		location = udf.finish(location)
 	}
 
-	totalSize := location
-	location = dataStartSector
-	// create and write the primary volume descriptor, supplementary and boot, and volume descriptor set terminator
-	now := time.Now()
-	rootDE, err := root.toDirectoryEntry(fsm, true, false)
-	if err != nil {
-		return fmt.Errorf("could not convert root entry for primary volume descriptor to dirEntry: %v", err)
-	}
-
-	pvd := &primaryVolumeDescriptor{
-		systemIdentifier:           "",
-		volumeIdentifier:           volIdentifier,
-		volumeSize:                 totalSize,
-		setSize:                    1,
-		sequenceNumber:             1,
-		blocksize:                  uint16(fsm.blocksize),
-		pathTableSize:              uint32(pathTableSize),
-		pathTableLLocation:         pathTableLLocation,
-		pathTableLOptionalLocation: 0,
-		pathTableMLocation:         pathTableMLocation,
-		pathTableMOptionalLocation: 0,
-		volumeSetIdentifier:        "",
-		publisherIdentifier:        "",
-		preparerIdentifier:         util.AppNameVersion,
-		applicationIdentifier:      "",
-		copyrightFile:              "", // 37 bytes
-		abstractFile:               "", // 37 bytes
-		bibliographicFile:          "", // 37 bytes
-		creation:                   now,
-		modification:               now,
-		expiration:                 now,
-		effective:                  now,
-		rootDirectoryEntry:         rootDE,
-	}
-	b = pvd.toBytes()
-	_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
-	location++
-
-	// do we have a boot sector?
-	if options.ElTorito != nil {
-		bvd := &bootVolumeDescriptor{location: catEntry.location}
-		b = bvd.toBytes()
-		_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
-		location++
-	}
-	terminator := &terminatorVolumeDescriptor{}
-	b = terminator.toBytes()
-	_, _ = f.WriteAt(b, int64(location)*int64(blocksize))
-
-	_ = os.RemoveAll(fsm.workspace)
-
-	// finish by setting as finalized
-	fsm.workspace = ""
-	return nil
+	return &finalizeLayout{
+		root:               root,
+		dirs:               dirs,
+		files:              files,
+		catEntry:           catEntry,
+		pathTable:          pathTable,
+		pathTableSize:      pathTableSize,
+		pathTableLLocation: pathTableLLocation,
+		pathTableMLocation: pathTableMLocation,
+		udf:                udf,
+		totalBlocks:        location,
+	}, nil
 }
 
 // copyFileData copy data from file `from` at offset `fromOffset` to file `to` at offset `toOffset`.
-// Copies `size` bytes. If `size` is 0, copies as many bytes as it can.
-func copyFileData(from backend.File, to backend.WritableFile, fromOffset, toOffset int64, size int) (int, error) {
-	buf := make([]byte, 2048)
+// Copies `size` bytes. If `size` is 0, copies as many bytes as it can. It copies through buf, or a buffer of its
+// own if buf is nil.
+func copyFileData(from backend.File, to backend.WritableFile, fromOffset, toOffset int64, size int, buf []byte) (int, error) {
+	if buf == nil {
+		buf = make([]byte, finalizeBufferSize)
+	}
 	copied := 0
 	for {
 		n, err := from.ReadAt(buf, fromOffset+int64(copied))
@@ -846,6 +1111,63 @@ func copyFileData(from backend.File, to backend.WritableFile, fromOffset, toOffs
 	return copied, nil
 }
 
+// sequentialWriter buffer writes to a file that are mostly in order, so that many small directory records and
+// path table entries go out in a few large writes. Writing anywhere but after what is in the buffer flushes it first.
+type sequentialWriter struct {
+	f      backend.WritableFile
+	buf    []byte
+	offset int64
+}
+
+func newSequentialWriter(f backend.WritableFile, size int) *sequentialWriter {
+	return &sequentialWriter{f: f, buf: make([]byte, 0, size)}
+}
+
+// seek move to offset for the next write, writing out the buffer unless offset follows on from it
+func (w *sequentialWriter) seek(offset int64) error {
+	if offset == w.offset+int64(len(w.buf)) {
+		return nil
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.offset = offset
+	return nil
+}
+
+func (w *sequentialWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+n]
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush write out what is in the buffer
+func (w *sequentialWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.f.WriteAt(w.buf, w.offset)
+	if err == nil && n != len(w.buf) {
+		err = fmt.Errorf("wrote %d bytes instead of %d", n, len(w.buf))
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %d bytes at %d: %w", len(w.buf), w.offset, err)
+	}
+	w.offset += int64(n)
+	w.buf = w.buf[:0]
+	return nil
+}
+
 // sort path table entries
 func sortFinalizeFileInfoPathTable(left, right *finalizeFileInfo) bool {
 	switch {
@@ -912,61 +1234,271 @@ func createPathTable(fi []*finalizeFileInfo) *pathTable {
 	}
 }
 
-func walkTree(workspace string) ([]*finalizeFileInfo, map[string]*finalizeFileInfo, error) {
-	var (
-		dirList  = make(map[string]*finalizeFileInfo)
-		fileList = make([]*finalizeFileInfo, 0)
-		entry    *finalizeFileInfo
-		serial   uint64
-	)
-	err := filepath.WalkDir(workspace, func(actualPath string, d fs.DirEntry, err error) error {
+func walkTree(workspace string, options FinalizeOptions) ([]*finalizeFileInfo, map[string]*finalizeFileInfo, error) {
+	t, err := newTreeBuilder(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.walk(workspace, ".", true); err != nil {
+		return nil, nil, err
+	}
+	// add everything that comes from outside the workspace
+	for _, r := range t.rewrite {
+		if !filepath.IsAbs(r.Source) {
+			continue
+		}
+		if err := t.walk(r.Source, r.Target, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	return t.fileList, t.dirList, nil
+}
+
+// treeBuilder builds the tree of files and directories in the image from the workspace, applying the filters
+// and rewrite rules
+type treeBuilder struct {
+	exclude  []string
+	include  []string
+	rewrite  []RewriteRule
+	dirList  map[string]*finalizeFileInfo
+	fileList []*finalizeFileInfo
+	// paths every path in the image, to catch two files in the same place
+	paths map[string]bool
+	// excluded directories that are excluded, by their path in the image, which still are added if something
+	// in them is included
+	excluded map[string]*finalizeFileInfo
+	// created directories that only exist in the image, as parents of rewrite targets
+	created map[string]bool
+	serial  uint64
+}
+
+func newTreeBuilder(options FinalizeOptions) (*treeBuilder, error) {
+	for _, pattern := range append(slices.Clone(options.Exclude), options.Include...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	rewrite := make([]RewriteRule, 0, len(options.Rewrite))
+	for _, r := range options.Rewrite {
+		if r.Source == "" {
+			return nil, fmt.Errorf("rewrite rule to %q has no source", r.Target)
+		}
+		source := r.Source
+		if !filepath.IsAbs(source) {
+			source = path.Clean(filepath.ToSlash(source))
+			if source == "." || source == ".." || strings.HasPrefix(source, "../") {
+				return nil, fmt.Errorf("rewrite rule source %q is not a file or directory in the workspace", r.Source)
+			}
+		}
+		rewrite = append(rewrite, RewriteRule{
+			Source: source,
+			Target: path.Clean("/" + filepath.ToSlash(r.Target))[1:],
+		})
+		if rewrite[len(rewrite)-1].Target == "" {
+			rewrite[len(rewrite)-1].Target = "."
+		}
+	}
+	return &treeBuilder{
+		exclude:  options.Exclude,
+		include:  options.Include,
+		rewrite:  rewrite,
+		dirList:  make(map[string]*finalizeFileInfo),
+		paths:    make(map[string]bool),
+		excluded: make(map[string]*finalizeFileInfo),
+		created:  make(map[string]bool),
+	}, nil
+}
+
+// walk add everything in root on the host to the tree, at target in the image. In the workspace,
+// the relative rewrite rules move things elsewhere.
+func (t *treeBuilder) walk(root, target string, isWorkspace bool) error {
+	return filepath.WalkDir(root, func(actualPath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("error walking path %s: %v", actualPath, err)
 		}
-		fp := strings.TrimPrefix(actualPath, workspace)
-		fp = strings.TrimPrefix(fp, string(filepath.Separator))
-		if fp == "" {
-			fp = "."
+		rel, err := filepath.Rel(root, actualPath)
+		if err != nil {
+			return fmt.Errorf("could not get path of %s in %s: %v", actualPath, root, err)
+		}
+		p := path.Join(target, filepath.ToSlash(rel))
+		if isWorkspace {
+			p = t.rewritePath(p)
 		}
-		name := d.Name()
-		_, extension := calculateShortnameExtension(name)
-
 		fi, err := d.Info()
 		if err != nil {
-			return fmt.Errorf("could not get file info for %s: %v", fp, err)
+			return fmt.Errorf("could not get file info for %s: %v", rel, err)
 		}
-		entry, err = finalizeFileInfoFromFile(fp, actualPath, fi)
-		if err != nil {
-			return err
+		return t.add(p, actualPath, fi)
+	})
+}
+
+// rewritePath get where a path in the workspace goes in the image
+func (t *treeBuilder) rewritePath(p string) string {
+	for _, r := range t.rewrite {
+		if filepath.IsAbs(r.Source) {
+			continue
+		}
+		if p == r.Source {
+			return r.Target
+		}
+		if rest, ok := strings.CutPrefix(p, r.Source+"/"); ok {
+			return path.Join(r.Target, rest)
 		}
-		entry.serial = serial
-		serial++
+	}
+	return p
+}
 
-		// we will have to save it as its parent
-		parentDir := filepath.Dir(fp)
-		parentDirInfo := dirList[parentDir]
+// matches if a path in the image matches any of the patterns
+func matches(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
 
-		if fi.IsDir() {
+// add add a file or directory on the host to the tree, at path p in the image, unless it is excluded
+func (t *treeBuilder) add(p, actualPath string, fi fs.FileInfo) error {
+	entry, err := finalizeFileInfoFromFile(p, actualPath, fi)
+	if err != nil {
+		return err
+	}
+	entry.serial = t.serial
+	t.serial++
+
+	if p != "." && !matches(t.include, p) {
+		_, parentExcluded := t.excluded[path.Dir(p)]
+		if parentExcluded || matches(t.exclude, p) {
+			if !fi.IsDir() {
+				return nil
+			}
+			// nothing in it can be included, so do not bother looking
+			if len(t.include) == 0 {
+				return fs.SkipDir
+			}
 			entry.children = make([]*finalizeFileInfo, 0, 20)
-			dirList[fp] = entry
-			if !entry.isRoot {
-				parentDirInfo.children = append(parentDirInfo.children, entry)
-				dirList[parentDir] = parentDirInfo
+			t.excluded[p] = entry
+			return nil
+		}
+	}
+
+	if fi.IsDir() {
+		if existing, ok := t.dirList[p]; ok {
+			// it already is in the image, as a parent of something placed in it
+			if t.created[p] {
+				children := existing.children
+				*existing = *entry
+				existing.children = children
+				delete(t.created, p)
 			}
-		} else {
-			// calculate blocks
-			entry.size = fi.Size()
-			entry.extension = extension
-			parentDirInfo.children = append(parentDirInfo.children, entry)
-			dirList[parentDir] = parentDirInfo
-			fileList = append(fileList, entry)
+			return nil
 		}
+		entry.children = make([]*finalizeFileInfo, 0, 20)
+		return t.addEntry(entry)
+	}
+	_, entry.extension = calculateShortnameExtension(entry.name)
+	return t.addEntry(entry)
+}
+
+// addEntry add an entry to its parent directory in the tree, adding the parent first if it is not there
+func (t *treeBuilder) addEntry(entry *finalizeFileInfo) error {
+	p := entry.path
+	if t.paths[p] {
+		return fmt.Errorf("more than one file or directory at %s in the image", p)
+	}
+	t.paths[p] = true
+	if entry.isDir {
+		t.dirList[p] = entry
+	} else {
+		t.fileList = append(t.fileList, entry)
+	}
+	if entry.isRoot {
 		return nil
-	})
+	}
+	parent, err := t.parent(path.Dir(p))
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
-	return fileList, dirList, nil
+	parent.children = append(parent.children, entry)
+	return nil
+}
+
+// parent get the directory at path p in the image, adding it if it is not there yet
+func (t *treeBuilder) parent(p string) (*finalizeFileInfo, error) {
+	if dir, ok := t.dirList[p]; ok {
+		return dir, nil
+	}
+	// an excluded directory with something included in it, or one only in the image
+	dir, ok := t.excluded[p]
+	if !ok {
+		now := time.Now()
+		dir = &finalizeFileInfo{
+			path:       p,
+			name:       path.Base(p),
+			isDir:      true,
+			isRoot:     p == ".",
+			mode:       os.ModeDir | 0o755,
+			modTime:    now,
+			accessTime: now,
+			changeTime: now,
+			createTime: now,
+			nlink:      2,
+			children:   make([]*finalizeFileInfo, 0, 20),
+			serial:     t.serial,
+		}
+		dir.shortname, _ = calculateShortnameExtension(dir.name)
+		t.serial++
+		t.created[p] = true
+	}
+	if err := t.addEntry(dir); err != nil {
+		return nil, err
+	}
+	return dir, nil
+}
+
+// normalizeNames put the names of everything in the tree in the normalization form of n, along with the identifiers
+// made from them. Two names in a directory that are the same once normalized are an error in strict mode, and
+// otherwise are left as they are.
+func normalizeNames(dirList map[string]*finalizeFileInfo, n filesystem.NameNormalization) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	if n.Form == filesystem.NormalizationNone {
+		return nil
+	}
+	dirs := make([]string, 0, len(dirList))
+	for p := range dirList {
+		dirs = append(dirs, p)
+	}
+	sort.Strings(dirs)
+	for _, p := range dirs {
+		dir := dirList[p]
+		count := make(map[string]int, len(dir.children))
+		for _, child := range dir.children {
+			count[n.Normalize(child.name)]++
+		}
+		for _, child := range dir.children {
+			normalized := n.Normalize(child.name)
+			if count[normalized] > 1 {
+				if n.Strict {
+					return fmt.Errorf("%d names in %s are %q once normalized: %w", count[normalized], path.Join("/", p), normalized, filesystem.ErrAmbiguousName)
+				}
+				continue
+			}
+			child.name = normalized
+			shortname, extension := calculateShortnameExtension(normalized)
+			child.shortname = shortname
+			if !child.isDir {
+				child.extension = extension
+			}
+		}
+	}
+	return nil
 }
 
 func calculateBlocks(size, blocksize int64) uint32 {
@@ -989,9 +1521,8 @@ func calculateShortnameExtension(name string) (shortname, extension string) {
 	extension = strings.ToUpper(extension)
 
 	// replace illegal characters in shortname and extension with _
-	re := regexp.MustCompile("[^A-Z0-9_]")
-	shortname = re.ReplaceAllString(shortname, "_")
-	extension = re.ReplaceAllString(extension, "_")
+	shortname = invalidISOCharsRegexp.ReplaceAllString(shortname, "_")
+	extension = invalidISOCharsRegexp.ReplaceAllString(extension, "_")
 
 	return shortname, extension
 }
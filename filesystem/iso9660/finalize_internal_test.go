@@ -38,7 +38,7 @@ func TestCopyFileData(t *testing.T) {
 	}
 	defer os.Remove(from.Name()) // clean up
 
-	copied, err := copyFileData(from, to, 0, 0, 0)
+	copied, err := copyFileData(from, to, 0, 0, 0, nil)
 	if err != nil {
 		t.Fatal("error copying data from/to", err)
 	}
@@ -68,6 +68,48 @@ func TestCopyFileData(t *testing.T) {
 	}
 }
 
+func TestSequentialWriter(t *testing.T) {
+	to, err := os.CreateTemp("", "iso9660_finalize_test_to")
+	if err != nil {
+		t.Fatal("error creating 'to' tmpfile", err)
+	}
+	defer os.Remove(to.Name())
+	defer to.Close()
+
+	// a buffer smaller than some writes, with writes that follow on and ones that do not
+	w := newSequentialWriter(to, 16)
+	writes := []struct {
+		offset int64
+		data   string
+	}{
+		{0, "abc"},
+		{3, "defghijklmnopqrstuvwxyz"},
+		{40, "0123"},
+		{100, "x"},
+		{101, "yz"},
+	}
+	want := make([]byte, 103)
+	for _, wr := range writes {
+		if err := w.seek(wr.offset); err != nil {
+			t.Fatalf("error seeking to %d: %v", wr.offset, err)
+		}
+		if _, err := w.Write([]byte(wr.data)); err != nil {
+			t.Fatalf("error writing at %d: %v", wr.offset, err)
+		}
+		copy(want[wr.offset:], wr.data)
+	}
+	if err := w.flush(); err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	b, err := io.ReadAll(to)
+	if err != nil {
+		t.Fatalf("error reading 'to' tmpfile: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("wrote %q instead of %q", b, want)
+	}
+}
+
 func TestSortFinalizeFileInfoPathTable(t *testing.T) {
 	tests := []struct {
 		left  *finalizeFileInfo
@@ -3,16 +3,26 @@ package iso9660_test
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
 	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/diskfs/go-diskfs/filesystem/udf"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/diskfs/go-diskfs/testhelper"
 )
@@ -99,6 +109,285 @@ func TestFinalizeElTorito(t *testing.T) {
 	}
 }
 
+// test opening the EFI boot image of an iso, from El Torito and from an appended partition
+func TestFinalizeOpenEFIBootImage(t *testing.T) {
+	// a FAT image with a grub.cfg to edit
+	efiBackend, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	efi, err := fat32.CreateWithType(efiBackend, 4*1024*1024, 0, 512, "EFI", fat32.FatType12)
+	if err != nil {
+		t.Fatalf("Failed to fat32.Create: %v", err)
+	}
+	if err := efi.Mkdir("/EFI/BOOT"); err != nil {
+		t.Fatalf("Failed to fat32.Mkdir: %v", err)
+	}
+	grubCfg, err := efi.OpenFile("/EFI/BOOT/GRUB.CFG", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to fat32.OpenFile: %v", err)
+	}
+	if _, err := grubCfg.Write([]byte("set timeout=5\n")); err != nil {
+		t.Fatalf("error writing grub.cfg: %v", err)
+	}
+	efiImage := make([]byte, 4*1024*1024)
+	if _, err := efiBackend.ReadAt(efiImage, 0); err != nil {
+		t.Fatalf("error reading FAT image: %v", err)
+	}
+
+	// checkEFI checks the grub.cfg in the EFI boot image of an iso, changes it, and checks the change is in the iso
+	checkEFI := func(t *testing.T, f *os.File) {
+		fs, err := iso9660.Read(file.New(f, false), 0, 0, 2048)
+		if err != nil {
+			t.Fatalf("error reading the tmpfile as iso: %v", err)
+		}
+		efi, err := fs.OpenEFIBootImage()
+		if err != nil {
+			t.Fatalf("unexpected error opening EFI boot image: %v", err)
+		}
+		grubCfg, err := efi.OpenFile("/EFI/BOOT/GRUB.CFG", os.O_RDWR)
+		if err != nil {
+			t.Fatalf("unable to open grub.cfg: %v", err)
+		}
+		if data, err := io.ReadAll(grubCfg); err != nil || string(data) != "set timeout=5\n" {
+			t.Fatalf("grub.cfg has %q, error %v", data, err)
+		}
+		if _, err := grubCfg.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("unable to seek grub.cfg: %v", err)
+		}
+		if _, err := grubCfg.Write([]byte("set timeout=0\n")); err != nil {
+			t.Fatalf("error changing grub.cfg: %v", err)
+		}
+		// reread it all from the iso
+		fs, err = iso9660.Read(file.New(f, true), 0, 0, 2048)
+		if err != nil {
+			t.Fatalf("error rereading the tmpfile as iso: %v", err)
+		}
+		if efi, err = fs.OpenEFIBootImage(); err != nil {
+			t.Fatalf("unexpected error reopening EFI boot image: %v", err)
+		}
+		if grubCfg, err = efi.OpenFile("/EFI/BOOT/GRUB.CFG", os.O_RDONLY); err != nil {
+			t.Fatalf("unable to reopen grub.cfg: %v", err)
+		}
+		if data, err := io.ReadAll(grubCfg); err != nil || string(data) != "set timeout=0\n" {
+			t.Errorf("changed grub.cfg has %q, error %v", data, err)
+		}
+	}
+
+	// createISO creates an iso with the given files, and El Torito options
+	createISO := func(t *testing.T, files map[string][]byte, elTorito *iso9660.ElTorito) *os.File {
+		f, err := os.CreateTemp("", "iso_finalize_test")
+		if err != nil {
+			t.Fatalf("Failed to create tmpfile: %v", err)
+		}
+		t.Cleanup(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+		fs, err := iso9660.Create(file.New(f, false), 0, 0, 2048, "")
+		if err != nil {
+			t.Fatalf("Failed to iso9660.Create: %v", err)
+		}
+		for filename, data := range files {
+			isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+			}
+			if _, err := isofile.Write(data); err != nil {
+				t.Fatalf("error writing %s: %v", filename, err)
+			}
+		}
+		if err := fs.Finalize(iso9660.FinalizeOptions{ElTorito: elTorito}); err != nil {
+			t.Fatalf("unexpected error fs.Finalize(): %v", err)
+		}
+		return f
+	}
+
+	t.Run("El Torito", func(t *testing.T) {
+		bios := make([]byte, 4096)
+		_, _ = rand.Read(bios)
+		f := createISO(t, map[string][]byte{"/BIOS.IMG": bios, "/EFI.IMG": efiImage}, &iso9660.ElTorito{
+			BootCatalog: "/BOOT.CAT",
+			Platform:    iso9660.EFI,
+			Entries: []*iso9660.ElToritoEntry{
+				{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/BIOS.IMG", LoadSize: 4},
+				{Platform: iso9660.EFI, Emulation: iso9660.NoEmulation, BootFile: "/EFI.IMG"},
+			},
+		})
+		checkEFI(t, f)
+	})
+
+	t.Run("appended partition", func(t *testing.T) {
+		f := createISO(t, map[string][]byte{"/README": []byte("readme")}, nil)
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatalf("unable to stat iso: %v", err)
+		}
+		start := (info.Size() + 2047) / 2048 * 2048
+		if _, err := f.WriteAt(efiImage, start); err != nil {
+			t.Fatalf("unable to append EFI image: %v", err)
+		}
+		table := &mbr.Table{
+			LogicalSectorSize:  512,
+			PhysicalSectorSize: 512,
+			Partitions: []*mbr.Partition{
+				{Type: mbr.EFISystem, Start: uint32(start / 512), Size: uint32(len(efiImage) / 512)},
+			},
+		}
+		if err := table.Write(f, start+int64(len(efiImage))); err != nil {
+			t.Fatalf("unable to write partition table: %v", err)
+		}
+		checkEFI(t, f)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		f := createISO(t, map[string][]byte{"/README": []byte("readme")}, nil)
+		fs, err := iso9660.Read(file.New(f, true), 0, 0, 2048)
+		if err != nil {
+			t.Fatalf("error reading the tmpfile as iso: %v", err)
+		}
+		if _, err := fs.OpenEFIBootImage(); err == nil {
+			t.Errorf("no error opening missing EFI boot image")
+		}
+	})
+}
+
+// test creating an iso with the partition tables to boot it from a USB stick
+func TestFinalizeHybrid(t *testing.T) {
+	bios := make([]byte, 4096)
+	_, _ = rand.Read(bios)
+	efi := make([]byte, 1024*1024+100)
+	_, _ = rand.Read(efi)
+	bootCode := bytes.Repeat([]byte{0xfa}, 432)
+	elTorito := func() *iso9660.ElTorito {
+		return &iso9660.ElTorito{
+			BootCatalog: "/BOOT.CAT",
+			Entries: []*iso9660.ElToritoEntry{
+				{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/BIOS.IMG", LoadSize: 4},
+				{Platform: iso9660.EFI, Emulation: iso9660.NoEmulation, BootFile: "/EFI.IMG"},
+			},
+		}
+	}
+
+	// finalize creates an iso with the boot images and the given options, and returns it with the size it was estimated to be
+	finalize := func(t *testing.T, options iso9660.FinalizeOptions) (*os.File, int64, error) {
+		f, err := os.CreateTemp("", "iso_finalize_test")
+		if err != nil {
+			t.Fatalf("Failed to create tmpfile: %v", err)
+		}
+		t.Cleanup(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+		fs, err := iso9660.Create(file.New(f, false), 0, 0, 2048, "")
+		if err != nil {
+			t.Fatalf("Failed to iso9660.Create: %v", err)
+		}
+		for filename, data := range map[string][]byte{"/BIOS.IMG": bios, "/EFI.IMG": efi} {
+			isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+			}
+			if _, err := isofile.Write(data); err != nil {
+				t.Fatalf("error writing %s: %v", filename, err)
+			}
+		}
+		size, err := fs.EstimateSize(options)
+		if err != nil {
+			return f, 0, err
+		}
+		return f, size, fs.Finalize(options)
+	}
+
+	t.Run("MBR and GPT", func(t *testing.T) {
+		f, size, err := finalize(t, iso9660.FinalizeOptions{
+			ElTorito: elTorito(),
+			Hybrid:   &iso9660.Hybrid{BootCode: bootCode, GPT: true},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error fs.Finalize(): %v", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatalf("unable to stat iso: %v", err)
+		}
+		if info.Size() != size {
+			t.Errorf("iso is %d bytes, but was estimated to be %d", info.Size(), size)
+		}
+
+		// the boot code, followed by the sector of the BIOS boot image
+		mbrBytes := make([]byte, 512)
+		if _, err := f.ReadAt(mbrBytes, 0); err != nil {
+			t.Fatalf("unable to read MBR: %v", err)
+		}
+		if !bytes.Equal(mbrBytes[:432], bootCode) {
+			t.Errorf("mismatched boot code")
+		}
+		biosSector := binary.LittleEndian.Uint64(mbrBytes[432:440])
+		b := make([]byte, len(bios))
+		if _, err := f.ReadAt(b, int64(biosSector)*512); err != nil || !bytes.Equal(b, bios) {
+			t.Errorf("BIOS boot image is not at sector %d, error %v", biosSector, err)
+		}
+
+		table, err := mbr.Read(file.New(f, true), 512, 512)
+		if err != nil {
+			t.Fatalf("unable to read MBR: %v", err)
+		}
+		if len(table.Partitions) < 2 {
+			t.Fatalf("MBR has %d partitions instead of 2", len(table.Partitions))
+		}
+		whole, esp := table.Partitions[0], table.Partitions[1]
+		if !whole.Bootable || whole.Start != 0 || int64(whole.Size)*512 != size {
+			t.Errorf("first partition %+v does not hold the whole image of %d bytes", whole, size)
+		}
+		expectedSectors := uint32(len(efi)+511) / 512
+		if esp.Type != mbr.EFISystem || esp.Size != expectedSectors {
+			t.Errorf("second partition %+v is not the EFI boot image of %d sectors", esp, expectedSectors)
+		}
+		b = make([]byte, len(efi))
+		if _, err := f.ReadAt(b, int64(esp.Start)*512); err != nil || !bytes.Equal(b, efi) {
+			t.Errorf("EFI boot image is not at sector %d, error %v", esp.Start, err)
+		}
+
+		gptTable, err := gpt.Read(file.New(f, true), 512, 512)
+		if err != nil {
+			t.Fatalf("unable to read GPT: %v", err)
+		}
+		if err := gptTable.Verify(file.New(f, true), uint64(size)); err != nil {
+			t.Errorf("invalid GPT: %v", err)
+		}
+		if len(gptTable.Partitions) < 1 {
+			t.Fatalf("GPT has no partitions")
+		}
+		if p := gptTable.Partitions[0]; p.Type != gpt.EFISystemPartition || p.Start != uint64(esp.Start) || p.End != uint64(esp.Start+esp.Size-1) {
+			t.Errorf("GPT partition %+v is not the EFI boot image", p)
+		}
+
+		// and it still is an iso
+		if _, err := iso9660.Read(file.New(f, true), 0, 0, 2048); err != nil {
+			t.Errorf("error reading the tmpfile as iso: %v", err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			elTorito *iso9660.ElTorito
+			hybrid   *iso9660.Hybrid
+		}{
+			{"no El Torito", nil, &iso9660.Hybrid{}},
+			{"boot code too big", elTorito(), &iso9660.Hybrid{BootCode: make([]byte, 440)}},
+			{"boot code without BIOS", &iso9660.ElTorito{Entries: elTorito().Entries[1:]}, &iso9660.Hybrid{BootCode: bootCode}},
+			{"GPT without EFI", &iso9660.ElTorito{Entries: elTorito().Entries[:1]}, &iso9660.Hybrid{GPT: true}},
+		}
+		for _, tt := range tests {
+			if _, _, err := finalize(t, iso9660.FinalizeOptions{ElTorito: tt.elTorito, Hybrid: tt.hybrid}); err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		}
+	})
+}
+
 // full test - create some files, finalize, check the output
 //
 //nolint:gocyclo // we really do not care about the cyclomatic complexity of a test function. Maybe someday we will improve it.
@@ -546,3 +835,705 @@ func validateElTorito(t *testing.T, f *os.File) {
 	}
 	// what sector should it be in?
 }
+
+func TestFinalizeEstimateSize(t *testing.T) {
+	blocksize := int64(2048)
+	tests := []struct {
+		name    string
+		options iso9660.FinalizeOptions
+	}{
+		{"plain", iso9660.FinalizeOptions{}},
+		{"rock ridge", iso9660.FinalizeOptions{RockRidge: true}},
+		{"el torito", iso9660.FinalizeOptions{ElTorito: &iso9660.ElTorito{
+			BootCatalog: "/BOOT.CAT",
+			Entries: []*iso9660.ElToritoEntry{
+				{Platform: iso9660.BIOS, Emulation: iso9660.NoEmulation, BootFile: "/BOOT.IMG", LoadSize: 4},
+			},
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "iso_finalize_test")
+			if err != nil {
+				t.Fatalf("Failed to create tmpfile: %v", err)
+			}
+			defer os.Remove(f.Name())
+
+			b := file.New(f, false)
+			fs, err := iso9660.Create(b, 0, 0, blocksize, "")
+			if err != nil {
+				t.Fatalf("Failed to iso9660.Create: %v", err)
+			}
+			for _, dir := range []string{"/foo", "/bar/baz"} {
+				if err := fs.Mkdir(dir); err != nil {
+					t.Fatalf("Failed to iso9660.Mkdir(%s): %v", dir, err)
+				}
+			}
+			// sizes that are partial, exact and empty blocks, with the exact one last
+			files := map[string]int{"/BOOT.IMG": 4096, "/foo/a": 100, "/foo/empty": 0, "/zz": 3 * int(blocksize)}
+			for filename, size := range files {
+				isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+				}
+				data := make([]byte, size)
+				_, _ = rand.Read(data)
+				if _, err := isofile.Write(data); err != nil {
+					t.Fatalf("Failed to write %s: %v", filename, err)
+				}
+			}
+
+			estimate, err := fs.EstimateSize(tt.options)
+			if err != nil {
+				t.Fatalf("unexpected error estimating size: %v", err)
+			}
+			if err := fs.Finalize(tt.options); err != nil {
+				t.Fatalf("unexpected error finalizing: %v", err)
+			}
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatalf("unable to stat image: %v", err)
+			}
+			if info.Size() != estimate {
+				t.Errorf("mismatched size, estimate %d actual %d", estimate, info.Size())
+			}
+		})
+	}
+}
+
+func TestFinalizeSparseFiles(t *testing.T) {
+	blocksize := int64(2048)
+	f, err := os.CreateTemp("", "iso_finalize_test")
+	if err != nil {
+		t.Fatalf("Failed to create tmpfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	b := file.New(f, false)
+	fs, err := iso9660.Create(b, 0, 0, blocksize, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	// a file with data at its start, in its middle and in a partial last block, one of only zeroes,
+	// and one too small to be worth storing as sparse
+	sparse := make([]byte, 3*1024*1024+100)
+	for _, offset := range []int{0, 1024*1024 + 10, len(sparse) - 50} {
+		_, _ = rand.Read(sparse[offset : offset+50])
+	}
+	files := map[string][]byte{
+		"/sparse.img": sparse,
+		"/zeroes.img": make([]byte, 1024*1024),
+		"/small.txt":  []byte("not sparse\n"),
+	}
+	for filename, data := range files {
+		isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+		}
+		if _, err := isofile.Write(data); err != nil {
+			t.Fatalf("Failed to write %s: %v", filename, err)
+		}
+	}
+	options := iso9660.FinalizeOptions{RockRidge: true, SparseFiles: true}
+	estimate, err := fs.EstimateSize(options)
+	if err != nil {
+		t.Fatalf("unexpected error estimating size: %v", err)
+	}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("unable to stat image: %v", err)
+	}
+	if info.Size() != estimate {
+		t.Errorf("mismatched size, estimate %d actual %d", estimate, info.Size())
+	}
+	if info.Size() > 100*blocksize {
+		t.Errorf("image of %d bytes is too large, sparse files were not used", info.Size())
+	}
+
+	fs, err = iso9660.Read(b, info.Size(), 0, blocksize)
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("unable to read root directory: %v", err)
+	}
+	for _, fi := range entries {
+		if data, ok := files["/"+fi.Name()]; ok && fi.Size() != int64(len(data)) {
+			t.Errorf("%s: mismatched size, expected %d actual %d", fi.Name(), len(data), fi.Size())
+		}
+	}
+	for filename, data := range files {
+		isofile, err := fs.OpenFile(filename, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", filename, err)
+		}
+		read, err := io.ReadAll(isofile)
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", filename, err)
+		}
+		if !bytes.Equal(read, data) {
+			t.Errorf("%s: mismatched contents", filename)
+		}
+	}
+}
+
+func TestFinalizeFilterRewrite(t *testing.T) {
+	blocksize := int64(2048)
+	f, err := os.CreateTemp("", "iso_finalize_test")
+	if err != nil {
+		t.Fatalf("Failed to create tmpfile: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	b := file.New(f, false)
+	fs, err := iso9660.Create(b, 0, 0, blocksize, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	for _, filename := range []string{"/keep.txt", "/skip.log", "/logs/a.log", "/logs/keep.log", "/src/a.txt", "/src/b/c.txt"} {
+		if err := fs.Mkdir(filepath.Dir(filename)); err != nil {
+			t.Fatalf("Failed to iso9660.Mkdir(%s): %v", filepath.Dir(filename), err)
+		}
+		isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+		}
+		if _, err := isofile.Write([]byte(filename)); err != nil {
+			t.Fatalf("Failed to write %s: %v", filename, err)
+		}
+	}
+	// a directory from outside the workspace
+	graft := t.TempDir()
+	if err := os.WriteFile(filepath.Join(graft, "extra.txt"), []byte("/extra.txt"), 0o644); err != nil {
+		t.Fatalf("Failed to write file to graft: %v", err)
+	}
+
+	options := iso9660.FinalizeOptions{
+		RockRidge: true,
+		Exclude:   []string{"*.log"},
+		Include:   []string{"logs/keep.log"},
+		Rewrite: []iso9660.RewriteRule{
+			{Source: "src", Target: "data/source"},
+			{Source: graft, Target: "/data/graft"},
+		},
+	}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("unable to stat image: %v", err)
+	}
+	fs, err = iso9660.Read(b, info.Size(), 0, blocksize)
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+
+	// every file in the image, with the path it had in the workspace as its content
+	expected := map[string]string{
+		"/keep.txt":             "/keep.txt",
+		"/logs/keep.log":        "/logs/keep.log",
+		"/data/source/a.txt":    "/src/a.txt",
+		"/data/source/b/c.txt":  "/src/b/c.txt",
+		"/data/graft/extra.txt": "/extra.txt",
+	}
+	found := map[string]string{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("unable to read directory %s: %v", dir, err)
+		}
+		for _, fi := range entries {
+			p := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				walk(p)
+				continue
+			}
+			isofile, err := fs.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", p, err)
+			}
+			data, err := io.ReadAll(isofile)
+			if err != nil {
+				t.Fatalf("unable to read %s: %v", p, err)
+			}
+			found[p] = string(data)
+		}
+	}
+	walk("/")
+	if len(found) != len(expected) {
+		t.Errorf("mismatched files, expected %v actual %v", expected, found)
+	}
+	for p, data := range expected {
+		if found[p] != data {
+			t.Errorf("%s: mismatched contents, expected %q actual %q", p, data, found[p])
+		}
+	}
+}
+
+func TestFinalizeFileVersions(t *testing.T) {
+	for _, omit := range []bool{false, true} {
+		t.Run(fmt.Sprintf("omit %v", omit), func(t *testing.T) {
+			b, err := mem.New(5 * 1024 * 1024)
+			if err != nil {
+				t.Fatalf("unable to create buffer: %v", err)
+			}
+			fs, err := iso9660.Create(b, 0, 0, 2048, "")
+			if err != nil {
+				t.Fatalf("Failed to iso9660.Create: %v", err)
+			}
+			for _, filename := range []string{"/README.TXT", "/DIR/NOEXT"} {
+				if err := fs.Mkdir(filepath.Dir(filename)); err != nil {
+					t.Fatalf("Failed to iso9660.Mkdir(%s): %v", filepath.Dir(filename), err)
+				}
+				isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+				}
+				if _, err := isofile.Write([]byte(filename)); err != nil {
+					t.Fatalf("Failed to write %s: %v", filename, err)
+				}
+			}
+			if err := fs.Finalize(iso9660.FinalizeOptions{OmitVersionNumbers: omit}); err != nil {
+				t.Fatalf("unexpected error finalizing: %v", err)
+			}
+			fs, err = iso9660.Read(b, 0, 0, 2048)
+			if err != nil {
+				t.Fatalf("error reading the finalized image: %v", err)
+			}
+
+			// names as they are, and without version numbers
+			identifiers := map[string]string{"/README.TXT": "README.TXT;1", "/DIR/NOEXT": "NOEXT.;1"}
+			if omit {
+				identifiers = map[string]string{"/README.TXT": "README.TXT", "/DIR/NOEXT": "NOEXT."}
+			}
+			for _, versions := range []iso9660.FileVersions{iso9660.StripFileVersions, iso9660.KeepFileVersions} {
+				fs.SetFileVersions(versions)
+				for filename, identifier := range identifiers {
+					want := filepath.Base(filename)
+					if versions == iso9660.KeepFileVersions {
+						want = identifier
+					}
+					entries, err := fs.ReadDir(filepath.Dir(filename))
+					if err != nil {
+						t.Fatalf("unable to read directory of %s: %v", filename, err)
+					}
+					var names []string
+					for _, e := range entries {
+						if !e.IsDir() {
+							names = append(names, e.Name())
+						}
+					}
+					if len(names) != 1 || names[0] != want {
+						t.Errorf("names %v instead of %s", names, want)
+					}
+					// opened by either name
+					for _, p := range []string{filename, filepath.Join(filepath.Dir(filename), identifier)} {
+						isofile, err := fs.OpenFile(p, os.O_RDONLY)
+						if err != nil {
+							t.Fatalf("unable to open %s: %v", p, err)
+						}
+						data, err := io.ReadAll(isofile)
+						if err != nil {
+							t.Fatalf("unable to read %s: %v", p, err)
+						}
+						if string(data) != filename {
+							t.Errorf("%s: mismatched contents, expected %q actual %q", p, filename, data)
+						}
+					}
+				}
+			}
+			if !omit {
+				if _, err := fs.OpenFile("/README.TXT;2", os.O_RDONLY); err == nil {
+					t.Errorf("no error opening a version that does not exist")
+				}
+			}
+		})
+	}
+}
+
+func TestFinalizeNameNormalization(t *testing.T) {
+	// decomposed, as written on macOS
+	const (
+		nfdDir  = "cafe\u0301"
+		nfdFile = "a\u0308.txt"
+	)
+	b, err := mem.New(5 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := iso9660.Create(b, 0, 0, 2048, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	if err := fs.Mkdir("/" + nfdDir); err != nil {
+		t.Fatalf("Failed to iso9660.Mkdir: %v", err)
+	}
+	isofile, err := fs.OpenFile("/"+nfdDir+"/"+nfdFile, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to iso9660.OpenFile: %v", err)
+	}
+	if _, err := isofile.Write([]byte(nfdFile)); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	options := iso9660.FinalizeOptions{RockRidge: true, NameNormalization: filesystem.NameNormalization{Form: filesystem.NormalizationNFC}}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	fs, err = iso9660.Read(b, 0, 0, 2048)
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+	entries, err := fs.ReadDir("/caf\u00e9")
+	if err != nil {
+		t.Fatalf("unable to read directory by its composed name: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) != 1 || names[0] != "\u00e4.txt" {
+		t.Errorf("names %q instead of the composed %q", names, "\u00e4.txt")
+	}
+	p := "/" + nfdDir + "/" + nfdFile
+	if _, err := fs.OpenFile(p, os.O_RDONLY); err == nil {
+		t.Errorf("opened %q by its decomposed name without normalization", p)
+	}
+	if err := fs.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.NormalizationNFD}); err != nil {
+		t.Fatalf("unable to set normalization: %v", err)
+	}
+	isofile, err = fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unable to open %q: %v", p, err)
+	}
+	if data, err := io.ReadAll(isofile); err != nil || string(data) != nfdFile {
+		t.Errorf("mismatched contents of %q, got %q expected %q, error %v", p, data, nfdFile, err)
+	}
+
+	// both forms of a name in a directory
+	fs, err = iso9660.Create(b, 0, 0, 2048, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	for _, name := range []string{nfdFile, "\u00e4.txt"} {
+		if _, err := fs.OpenFile("/"+name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Failed to iso9660.OpenFile: %v", err)
+		}
+	}
+	options.NameNormalization.Strict = true
+	if err := fs.Finalize(options); !errors.Is(err, filesystem.ErrAmbiguousName) {
+		t.Errorf("finalizing ambiguous names strictly gave error %v, expected %v", err, filesystem.ErrAmbiguousName)
+	}
+}
+
+func TestFinalizeAttributes(t *testing.T) {
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	b, err := mem.New(5 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := iso9660.Create(b, 0, 0, 2048, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	if _, err := fs.OpenFile("/file.txt", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatalf("Failed to iso9660.OpenFile: %v", err)
+	}
+	if err := fs.Symlink("file.txt", "/link"); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	// too long for one directory record, so the target goes in continuation areas
+	longTarget := "/" + strings.Repeat("directory/", 40) + "file"
+	if err := fs.Symlink(longTarget, "/long"); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := fs.Chmod("/file.txt", 0o600); err != nil {
+		t.Fatalf("unable to change mode: %v", err)
+	}
+	if err := fs.Chtimes("/file.txt", mtime, mtime); err != nil {
+		t.Fatalf("unable to change times: %v", err)
+	}
+	if target, err := fs.Readlink("/link"); err != nil || target != "file.txt" {
+		t.Errorf("workspace symlink links to %q, error %v", target, err)
+	}
+	if err := fs.Finalize(iso9660.FinalizeOptions{RockRidge: true}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+
+	fs, err = iso9660.Read(b, 0, 0, 2048)
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+	if target, err := fs.Readlink("/link"); err != nil || target != "file.txt" {
+		t.Errorf("symlink links to %q, error %v", target, err)
+	}
+	if target, err := fs.Readlink("/long"); err != nil || target != longTarget {
+		t.Errorf("long symlink links to %q, error %v", target, err)
+	}
+	if _, err := fs.Readlink("/file.txt"); err == nil {
+		t.Errorf("no error reading link of a file that is not one")
+	}
+	if _, err := fs.Readlink("/missing"); err == nil {
+		t.Errorf("no error reading link of a missing file")
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("unable to read root directory: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() == "file.txt" && !e.ModTime().Equal(mtime) {
+			t.Errorf("file modified at %v instead of %v", e.ModTime(), mtime)
+		}
+	}
+	for name, err := range map[string]error{
+		"Symlink": fs.Symlink("file.txt", "/other"),
+		"Chmod":   fs.Chmod("/file.txt", 0o644),
+		"Chown":   fs.Chown("/file.txt", 0, 0),
+		"Chtimes": fs.Chtimes("/file.txt", mtime, mtime),
+	} {
+		if !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s returned %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+}
+
+func TestFinalizeBoundedMemory(t *testing.T) {
+	const (
+		size     = 64 * 1024 * 1024
+		maxAlloc = 16 * 1024 * 1024
+		dirs     = 50
+	)
+	f, err := os.CreateTemp("", "iso_finalize_test")
+	if err != nil {
+		t.Fatalf("Failed to create tmpfile: %v", err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	fs, err := iso9660.Create(file.New(f, false), 0, 0, 2048, "")
+	if err != nil {
+		t.Fatalf("Failed to iso9660.Create: %v", err)
+	}
+	isofile, err := fs.OpenFile("/LARGE.DAT", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to iso9660.OpenFile: %v", err)
+	}
+	chunk := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for written := 0; written < size; written += len(chunk) {
+		if _, err := isofile.Write(chunk); err != nil {
+			t.Fatalf("error writing large file: %v", err)
+		}
+	}
+	// enough small files that they would run out of descriptors if they were all held open
+	for i := 0; i < dirs; i++ {
+		dir := fmt.Sprintf("/DIR%d", i)
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatalf("Failed to iso9660.Mkdir(%s): %v", dir, err)
+		}
+		for j := 0; j < 50; j++ {
+			filename := fmt.Sprintf("%s/FILE%d.TXT", dir, j)
+			isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+			}
+			if _, err := isofile.Write([]byte(filename)); err != nil {
+				t.Fatalf("error writing %s: %v", filename, err)
+			}
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := fs.Finalize(iso9660.FinalizeOptions{}); err != nil {
+		t.Fatalf("unexpected error fs.Finalize(): %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > maxAlloc {
+		t.Errorf("finalizing a %d byte file allocated %d bytes, more than %d", size, alloc, maxAlloc)
+	}
+
+	fs, err = iso9660.Read(file.New(f, true), 0, 0, 2048)
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+	isofile, err = fs.OpenFile("/LARGE.DAT", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening large file: %v", err)
+	}
+	b := make([]byte, len(chunk))
+	for read := 0; read < size; read += len(b) {
+		if _, err := io.ReadFull(isofile, b); err != nil {
+			t.Fatalf("error reading large file at %d: %v", read, err)
+		}
+		if !bytes.Equal(b, chunk) {
+			t.Fatalf("large file differs at %d", read)
+		}
+	}
+	infos, err := fs.ReadDir(fmt.Sprintf("/DIR%d", dirs-1))
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	if len(infos) != 50 {
+		t.Errorf("%d entries instead of 50", len(infos))
+	}
+}
+
+func TestFinalizeDVDVideo(t *testing.T) {
+	blocksize := int64(2048)
+	// in the order they should be in the image, which is not that of their names
+	videoFiles := []string{
+		"VIDEO_TS.IFO", "VIDEO_TS.VOB", "VIDEO_TS.BUP",
+		"VTS_01_0.IFO", "VTS_01_1.VOB", "VTS_01_2.VOB", "VTS_01_0.BUP",
+		"VTS_02_0.IFO", "VTS_02_1.VOB", "VTS_02_0.BUP",
+	}
+	contents := map[string][]byte{"/Extras/Making of.txt": []byte("behind the scenes")}
+	for i, name := range videoFiles {
+		// sizes that are partial and whole blocks
+		data := make([]byte, 1000+i*int(blocksize))
+		_, _ = rand.Read(data)
+		contents["/VIDEO_TS/"+name] = data
+	}
+	create := func(t *testing.T, dirs ...string) (*iso9660.FileSystem, *mem.Buffer) {
+		t.Helper()
+		b, err := mem.New(5 * 1024 * 1024)
+		if err != nil {
+			t.Fatalf("unable to create buffer: %v", err)
+		}
+		fs, err := iso9660.Create(b, 0, 0, blocksize, "")
+		if err != nil {
+			t.Fatalf("Failed to iso9660.Create: %v", err)
+		}
+		for _, dir := range dirs {
+			if err := fs.Mkdir(dir); err != nil {
+				t.Fatalf("Failed to iso9660.Mkdir(%s): %v", dir, err)
+			}
+		}
+		return fs, b
+	}
+
+	t.Run("bridge", func(t *testing.T) {
+		fs, b := create(t, "/VIDEO_TS", "/AUDIO_TS", "/Extras")
+		for filename, data := range contents {
+			isofile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Failed to iso9660.OpenFile(%s): %v", filename, err)
+			}
+			if _, err := isofile.Write(data); err != nil {
+				t.Fatalf("Failed to write %s: %v", filename, err)
+			}
+		}
+		options := iso9660.FinalizeOptions{DVDVideo: true, RockRidge: true, VolumeIdentifier: "MOVIE"}
+		size, err := fs.EstimateSize(options)
+		if err != nil {
+			t.Fatalf("unexpected error estimating size: %v", err)
+		}
+		if err := fs.Finalize(options); err != nil {
+			t.Fatalf("unexpected error finalizing: %v", err)
+		}
+
+		// the ISO9660 side, with the files of VIDEO_TS first, in order, and aligned
+		isoFS, err := iso9660.Read(b, size, 0, blocksize)
+		if err != nil {
+			t.Fatalf("error reading the finalized image as ISO9660: %v", err)
+		}
+		var last uint32
+		for filename, data := range contents {
+			isofile, err := isoFS.OpenFile(filename, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open %s as ISO9660: %v", filename, err)
+			}
+			read, err := io.ReadAll(isofile)
+			if err != nil {
+				t.Fatalf("unable to read %s as ISO9660: %v", filename, err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("%s: mismatched contents as ISO9660", filename)
+			}
+		}
+		for _, name := range videoFiles {
+			isofile, err := isoFS.OpenFile("/VIDEO_TS/"+name, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open %s as ISO9660: %v", name, err)
+			}
+			location := isofile.(*iso9660.File).Location()
+			if location%16 != 0 {
+				t.Errorf("%s at sector %d, not on a 32 KiB boundary", name, location)
+			}
+			if location <= last {
+				t.Errorf("%s at sector %d, not after the file before it at %d", name, location, last)
+			}
+			last = location
+		}
+		extra, err := isoFS.OpenFile("/Extras/Making of.txt", os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("unable to open extra file as ISO9660: %v", err)
+		}
+		if location := extra.(*iso9660.File).Location(); location <= last {
+			t.Errorf("file outside VIDEO_TS at sector %d, before the last of VIDEO_TS at %d", location, last)
+		}
+
+		// the UDF side, which has the same files in the same sectors
+		udfFS, err := udf.Read(b, size, 0, blocksize)
+		if err != nil {
+			t.Fatalf("error reading the finalized image as UDF: %v", err)
+		}
+		if label := udfFS.Label(); label != "MOVIE" {
+			t.Errorf("UDF label %q instead of MOVIE", label)
+		}
+		entries, err := udfFS.ReadDir("/")
+		if err != nil {
+			t.Fatalf("unable to read UDF root: %v", err)
+		}
+		var names []string
+		for _, e := range entries {
+			if !e.IsDir() {
+				t.Errorf("%s in UDF root is not a directory", e.Name())
+			}
+			names = append(names, e.Name())
+		}
+		if want := []string{"AUDIO_TS", "Extras", "VIDEO_TS"}; !slices.Equal(names, want) {
+			t.Errorf("UDF root has %v instead of %v", names, want)
+		}
+		for filename, data := range contents {
+			udfFile, err := udfFS.OpenFile(filename, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open %s as UDF: %v", filename, err)
+			}
+			read, err := io.ReadAll(udfFile)
+			if err != nil {
+				t.Fatalf("unable to read %s as UDF: %v", filename, err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("%s: mismatched contents as UDF", filename)
+			}
+		}
+	})
+
+	tests := []struct {
+		name    string
+		dirs    []string
+		options iso9660.FinalizeOptions
+		err     string
+	}{
+		{"no VIDEO_TS", []string{"/AUDIO_TS"}, iso9660.FinalizeOptions{DVDVideo: true}, "must have a directory VIDEO_TS"},
+		{"sparse files", []string{"/VIDEO_TS"}, iso9660.FinalizeOptions{DVDVideo: true, RockRidge: true, SparseFiles: true}, "cannot have sparse files"},
+		{"el torito", []string{"/VIDEO_TS"}, iso9660.FinalizeOptions{DVDVideo: true, ElTorito: &iso9660.ElTorito{}}, "cannot be bootable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, _ := create(t, tt.dirs...)
+			err := fs.Finalize(tt.options)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
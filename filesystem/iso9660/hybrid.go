@@ -0,0 +1,130 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+const (
+	// hybridBootCodeSize the most MBR boot code there can be, as it is followed by the location of the BIOS boot image
+	hybridBootCodeSize = 432
+	// hybridPartitionType the MBR partition type of the partition that holds the whole image, as isohybrid uses
+	hybridPartitionType mbr.Type = 0x17
+	// hybridGPTSectors the sectors the secondary GPT takes at the end of the image, its header and a partition
+	// array of 128 entries of 128 bytes
+	hybridGPTSectors = 1 + 128*128/elToritoSectorSize
+)
+
+// Hybrid partition tables to write in the system area of an image, so that it also boots when written to a USB
+// stick or hard disk, like isohybrid -u or xorriso -isohybrid-mbr. The MBR has a bootable partition that holds the
+// whole image and, if there is an El Torito entry for EFI, a partition for its boot image, which UEFI firmware
+// boots from.
+type Hybrid struct {
+	// BootCode the MBR boot code, at most 432 bytes, e.g. isohdpfx.bin of syslinux. It is given the location of the
+	// boot image of the first El Torito entry for BIOS, which it loads. Leave empty for an image that only boots
+	// with UEFI.
+	BootCode []byte
+	// GPT also write a GPT with a partition for the EFI boot image, for firmware that looks for one there. It
+	// takes some space at the end of the image for its secondary header and partition array.
+	GPT bool
+}
+
+// entries the first El Torito entry for BIOS and the first for EFI, either of which may be nil
+func (h *Hybrid) entries(et *ElTorito) (bios, efi *ElToritoEntry) {
+	if et == nil {
+		return nil, nil
+	}
+	for _, e := range et.Entries {
+		switch {
+		case e.Platform == BIOS && bios == nil:
+			bios = e
+		case e.Platform == EFI && efi == nil:
+			efi = e
+		}
+	}
+	return bios, efi
+}
+
+// validate check the hybrid options can be used with the El Torito options
+func (h *Hybrid) validate(et *ElTorito) error {
+	bios, efi := h.entries(et)
+	if len(h.BootCode) > hybridBootCodeSize {
+		return fmt.Errorf("MBR boot code is %d bytes, more than the maximum of %d", len(h.BootCode), hybridBootCodeSize)
+	}
+	if len(h.BootCode) > 0 && bios == nil {
+		return fmt.Errorf("MBR boot code needs an El Torito entry for BIOS to load")
+	}
+	if h.GPT && efi == nil {
+		return fmt.Errorf("GPT needs an El Torito entry for EFI")
+	}
+	if bios == nil && efi == nil {
+		return fmt.Errorf("hybrid image needs an El Torito entry for BIOS or EFI to boot")
+	}
+	return nil
+}
+
+// reservedBlocks how many blocks to leave at the end of the image for the secondary GPT
+func (h *Hybrid) reservedBlocks(blocksize int) uint32 {
+	if !h.GPT {
+		return 0
+	}
+	return calculateBlocks(hybridGPTSectors*elToritoSectorSize, int64(blocksize))
+}
+
+// write write the MBR and any GPT of an image of the given size, once the El Torito entries have their locations
+func (h *Hybrid) write(f backend.WritableFile, et *ElTorito, blocksize int64, size int64) error {
+	bios, efi := h.entries(et)
+	// El Torito locations are in blocks, partitions in 512-byte sectors
+	sectorsPerBlock := uint32(blocksize / elToritoSectorSize)
+
+	if len(h.BootCode) > 0 {
+		if _, err := f.WriteAt(h.BootCode, 0); err != nil {
+			return fmt.Errorf("could not write MBR boot code: %v", err)
+		}
+		// the boot code finds the BIOS boot image by its location, as a 64-bit sector right after the code
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(bios.location*sectorsPerBlock))
+		if _, err := f.WriteAt(b, hybridBootCodeSize); err != nil {
+			return fmt.Errorf("could not write location of BIOS boot image to MBR: %v", err)
+		}
+	}
+
+	table := &mbr.Table{
+		LogicalSectorSize:  elToritoSectorSize,
+		PhysicalSectorSize: elToritoSectorSize,
+		Partitions: []*mbr.Partition{
+			{Bootable: true, Type: hybridPartitionType, Start: 0, Size: uint32(size / elToritoSectorSize)},
+		},
+	}
+	var efiStart, efiSectors uint32
+	if efi != nil {
+		efiStart = efi.location * sectorsPerBlock
+		efiSectors = (efi.size + elToritoSectorSize - 1) / elToritoSectorSize
+		if efiSectors == 0 {
+			return fmt.Errorf("EFI boot image %s is empty", efi.BootFile)
+		}
+		table.Partitions = append(table.Partitions, &mbr.Partition{Type: mbr.EFISystem, Start: efiStart, Size: efiSectors})
+	}
+	if err := table.Write(f, size); err != nil {
+		return fmt.Errorf("could not write MBR: %v", err)
+	}
+
+	if h.GPT {
+		// there is no protective MBR, as the MBR has the partitions to boot with BIOS
+		gptTable := &gpt.Table{
+			LogicalSectorSize:  elToritoSectorSize,
+			PhysicalSectorSize: elToritoSectorSize,
+			Partitions: []*gpt.Partition{
+				{Start: uint64(efiStart), End: uint64(efiStart + efiSectors - 1), Type: gpt.EFISystemPartition, Name: "ISOHybrid"},
+			},
+		}
+		if err := gptTable.Write(f, size); err != nil {
+			return fmt.Errorf("could not write GPT: %v", err)
+		}
+	}
+	return nil
+}
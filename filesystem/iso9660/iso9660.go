@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
+	"time"
 
 	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/filesystem"
@@ -31,8 +33,25 @@ type FileSystem struct {
 	suspEnabled    bool  // is the SUSP in use?
 	suspSkip       uint8 // how many bytes to skip in each directory record
 	suspExtensions []suspExtension
+	fileVersions   FileVersions
+	// normalization how names are normalized when they are looked up, see SetNameNormalization
+	normalization filesystem.NameNormalization
 }
 
+// FileVersions how the names of files read from an image treat the version number that ISO9660 ends each file
+// identifier with, such as the ";1" of "README.TXT;1". Names that Rock Ridge gives files have none.
+type FileVersions int
+
+const (
+	// StripFileVersions leave version numbers, and the '.' of a file identifier without an extension, out of
+	// names, so "README.TXT;1" is "README.TXT". Where a directory has several versions of a file, only the latest
+	// is listed. This is the default.
+	StripFileVersions FileVersions = iota
+	// KeepFileVersions name files by their file identifiers as they are, so "README.TXT;1" is "README.TXT;1", and
+	// every version of a file is listed
+	KeepFileVersions
+)
+
 // Equal compare if two filesystems are equal
 func (fsm *FileSystem) Equal(a *FileSystem) bool {
 	localMatch := fsm.backend == a.backend && fsm.size == a.size
@@ -283,7 +302,12 @@ func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error)
 }
 
 // interface guard
-var _ filesystem.FileSystem = (*FileSystem)(nil)
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
 
 // Type returns the type code for the filesystem. Always returns filesystem.TypeFat32
 func (fsm *FileSystem) Type() filesystem.Type {
@@ -323,33 +347,78 @@ func (fsm *FileSystem) Link(_, _ string) error {
 	return filesystem.ErrNotSupported
 }
 
-// creates a symbolic link named linkpath which contains the string target.
-//
-//nolint:revive // parameters will be used eventually
+// Symlink creates a symbolic link in the workspace named newpath, which contains the string oldpath.
+// It is only written to the image with Rock Ridge.
 func (fsm *FileSystem) Symlink(oldpath, newpath string) error {
-	// Rock Ridge has symlink support
-	// https://en.wikipedia.org/wiki/ISO_9660#Rock_Ridge
-	return filesystem.ErrNotImplemented
+	if fsm.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Symlink(oldpath, path.Join(fsm.workspace, newpath))
 }
 
-// Chmod changes the mode of the named file to mode. If the file is a symbolic link,
-// it changes the mode of the link's target.
-//
-//nolint:revive // parameters will be used eventually
+// Chmod changes the mode of the named file in the workspace to mode. If the file is a symbolic link,
+// it changes the mode of the link's target. The mode is only written to the image with Rock Ridge.
 func (fsm *FileSystem) Chmod(name string, mode os.FileMode) error {
-	// Rock Ridge has UNIX-style file modes support
-	// https://en.wikipedia.org/wiki/ISO_9660#Rock_Ridge
-	return filesystem.ErrNotImplemented
+	if fsm.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Chmod(path.Join(fsm.workspace, name), mode)
 }
 
-// Chown changes the numeric uid and gid of the named file. If the file is a symbolic link,
-// it changes the uid and gid of the link's target. A uid or gid of -1 means to not change that value
-//
-//nolint:revive // parameters will be used eventually
+// Chown changes the numeric uid and gid of the named file in the workspace, which needs the privileges to do so
+// on the host. A symbolic link itself is changed, rather than its target. A uid or gid of -1 means to not change
+// that value. The owner is only written to the image with Rock Ridge.
 func (fsm *FileSystem) Chown(name string, uid, gid int) error {
-	// Rock Ridge has user ids and group ids support
-	// https://en.wikipedia.org/wiki/ISO_9660#Rock_Ridge
-	return filesystem.ErrNotImplemented
+	if fsm.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Lchown(path.Join(fsm.workspace, name), uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file in the workspace, as os.Chtimes does.
+// A zero time.Time leaves that time unchanged. Only Rock Ridge keeps both times in the image; without it,
+// the modification time is the recording time of the directory entry.
+func (fsm *FileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	if fsm.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	return os.Chtimes(path.Join(fsm.workspace, name), atime, mtime)
+}
+
+// Readlink returns the target of the named symbolic link, from the workspace if there is one, else the
+// Rock Ridge entry for it in the image
+func (fsm *FileSystem) Readlink(name string) (string, error) {
+	if fsm.workspace != "" {
+		return os.Readlink(path.Join(fsm.workspace, name))
+	}
+	dir := path.Dir(name)
+	filename := path.Base(name)
+	entries, err := fsm.readDirectory(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not read directory entries for %s", dir)
+	}
+	var (
+		matches []*directoryEntry
+		names   []string
+	)
+	for _, e := range entries {
+		if !e.isSelf && !e.isParent && e.matchName(filename) {
+			matches = append(matches, e)
+			names = append(names, e.Name())
+		}
+	}
+	i, err := fsm.normalization.Resolve(filename, names)
+	if err != nil {
+		return "", fmt.Errorf("could not read symlink %s: %w", name, err)
+	}
+	if i < 0 {
+		return "", fmt.Errorf("target file %s does not exist", name)
+	}
+	target, ok := matches[i].ReadLink()
+	if !ok {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	return target, nil
 }
 
 // ReadDir return the contents of a given directory in a given filesystem.
@@ -381,11 +450,21 @@ func (fsm *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
 			return nil, fmt.Errorf("error reading directory %s: %v", p, err)
 		}
 		fi = make([]os.FileInfo, 0, len(dirEntries))
+		// where names have no version numbers, only list the latest version of each file
+		latest := make(map[string]int)
 		for _, entry := range dirEntries {
 			// ignore any entry that is current directory or parent
 			if entry.isSelf || entry.isParent {
 				continue
 			}
+			name := entry.Name()
+			if i, ok := latest[name]; ok && fsm.fileVersions == StripFileVersions {
+				if entry.version() > fi[i].(*directoryEntry).version() {
+					fi[i] = entry
+				}
+				continue
+			}
+			latest[name] = len(fi)
 			fi = append(fi, entry)
 		}
 	}
@@ -424,18 +503,40 @@ func (fsm *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		if err != nil {
 			return nil, fmt.Errorf("could not read directory entries for %s", dir)
 		}
-		// we now know that the directory exists, see if the file exists
-		var targetEntry *directoryEntry
+		// we now know that the directory exists, see if the file exists, in its latest version if the name
+		// does not say which
+		// of the names that match once normalized, the versions of each
+		var (
+			names    []string
+			versions [][]*directoryEntry
+		)
 		for _, e := range entries {
-			eName := e.Name()
+			if e.isSelf || e.isParent || !e.matchName(filename) {
+				continue
+			}
 			// cannot do anything with directories
-			if eName == filename && e.IsDir() {
+			if e.IsDir() {
 				return nil, fmt.Errorf("cannot open directory %s as file", p)
 			}
-			if eName == filename {
-				// if we got this far, we have found the file
-				targetEntry = e
-				break
+			name, _ := splitFileVersion(e.Name())
+			i := slices.Index(names, name)
+			if i < 0 {
+				names = append(names, name)
+				versions = append(versions, nil)
+				i = len(names) - 1
+			}
+			versions[i] = append(versions[i], e)
+		}
+		i, err := fsm.normalization.Resolve(filename, names)
+		if err != nil {
+			return nil, fmt.Errorf("could not open %s: %w", p, err)
+		}
+		var targetEntry *directoryEntry
+		if i >= 0 {
+			for _, e := range versions[i] {
+				if targetEntry == nil || e.version() > targetEntry.version() {
+					targetEntry = e
+				}
 			}
 		}
 
@@ -557,6 +658,47 @@ func (fsm *FileSystem) Label() string {
 	return fsm.volumes.primary.volumeIdentifier
 }
 
+// UUID returns the creation time of the volume, formatted as YYYY-MM-DD-HH-mm-ss-cc, which is
+// how blkid identifies ISO9660 filesystems
+func (fsm *FileSystem) UUID() string {
+	if fsm.volumes.primary == nil {
+		return ""
+	}
+	t := fsm.volumes.primary.creation.UTC()
+	return fmt.Sprintf("%s-%02d", t.Format("2006-01-02-15-04-05"), t.Nanosecond()/10000000)
+}
+
+// Usage returns the size of the volume. It is read-only, so none of it is free.
+func (fsm *FileSystem) Usage() filesystem.Usage {
+	if fsm.volumes.primary == nil {
+		return filesystem.Usage{}
+	}
+	return filesystem.Usage{Size: int64(fsm.volumes.primary.volumeSize) * int64(fsm.volumes.primary.blocksize)}
+}
+
+// SetFileVersions set how the names of files treat their version numbers. Either way, a file can be opened by its
+// name with or without its version number; without it, the latest version is opened.
+func (fsm *FileSystem) SetFileVersions(v FileVersions) {
+	fsm.fileVersions = v
+}
+
+// NameNormalization get how names in the image are normalized when they are looked up
+func (fsm *FileSystem) NameNormalization() filesystem.NameNormalization {
+	return fsm.normalization
+}
+
+// SetNameNormalization set how the Rock Ridge names of files are normalized when they are looked up, so that a name
+// finds a file whether either was written composed or decomposed, as in an image made on macOS and read on Linux.
+// To normalize the names written by Finalize, use FinalizeOptions.NameNormalization.
+// The default is filesystem.NormalizationNone.
+func (fsm *FileSystem) SetNameNormalization(n filesystem.NameNormalization) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	fsm.normalization = n
+	return nil
+}
+
 func (fsm *FileSystem) SetLabel(string) error {
 	return fmt.Errorf("ISO9660 filesystem is read-only")
 }
@@ -2,6 +2,7 @@ package iso9660
 
 import (
 	"encoding/binary"
+	"io"
 )
 
 // pathTable represents an on-iso path table
@@ -43,49 +44,56 @@ func (pt *pathTable) names() []string {
 }
 
 func (pt *pathTable) toLBytes() []byte {
-	b := make([]byte, 0)
+	b := make([]byte, 0, pt.size())
 	for _, e := range pt.records {
-		name := []byte(e.dirname)
-		nameSize := len(name)
-		size := 8 + uint16(nameSize)
-		if nameSize%2 != 0 {
-			size++
-		}
-
-		b2 := make([]byte, size)
-		b2[0] = uint8(nameSize)
-		b2[1] = e.extAttrLength
-		binary.LittleEndian.PutUint32(b2[2:6], e.location)
-		binary.LittleEndian.PutUint16(b2[6:8], e.parentIndex)
-		copy(b2[8:8+nameSize], name)
-		if nameSize%2 != 0 {
-			b2[8+nameSize] = 0
-		}
-		b = append(b, b2...)
+		b = e.appendTo(b, binary.LittleEndian)
 	}
 	return b
 }
 func (pt *pathTable) toMBytes() []byte {
-	b := make([]byte, 0)
+	b := make([]byte, 0, pt.size())
 	for _, e := range pt.records {
-		name := []byte(e.dirname)
-		nameSize := len(name)
-		size := 8 + uint16(nameSize)
-		if nameSize%2 != 0 {
-			size++
-		}
+		b = e.appendTo(b, binary.BigEndian)
+	}
+	return b
+}
 
-		b2 := make([]byte, size)
-		b2[0] = uint8(nameSize)
-		b2[1] = e.extAttrLength
-		binary.BigEndian.PutUint32(b2[2:6], e.location)
-		binary.BigEndian.PutUint16(b2[6:8], e.parentIndex)
-		copy(b2[8:8+nameSize], name)
-		if nameSize%2 != 0 {
-			b2[8+nameSize] = 0
+// size the size of the path table in bytes, which is the same for the L and M tables
+func (pt *pathTable) size() int {
+	size := 0
+	for _, e := range pt.records {
+		size += e.recordSize()
+	}
+	return size
+}
+
+// write write the path table a record at a time, in little-endian order for the L table or big-endian for the
+// M table, so that not all of it has to be in memory at once
+func (pt *pathTable) write(w io.Writer, order binary.ByteOrder) error {
+	var b []byte
+	for _, e := range pt.records {
+		b = e.appendTo(b[:0], order)
+		if _, err := w.Write(b); err != nil {
+			return err
 		}
-		b = append(b, b2...)
 	}
+	return nil
+}
+
+// recordSize the size of the record of the entry, padded to an even number of bytes
+func (e *pathTableEntry) recordSize() int {
+	return 8 + len(e.dirname) + len(e.dirname)%2
+}
+
+func (e *pathTableEntry) appendTo(b []byte, order binary.ByteOrder) []byte {
+	start := len(b)
+	b = append(b, make([]byte, e.recordSize())...)
+	r := b[start:]
+	r[0] = uint8(len(e.dirname))
+	r[1] = e.extAttrLength
+	order.PutUint32(r[2:6], e.location)
+	order.PutUint16(r[6:8], e.parentIndex)
+	copy(r[8:], e.dirname)
 	return b
 }
 
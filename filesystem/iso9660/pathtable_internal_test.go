@@ -2,6 +2,7 @@ package iso9660
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"testing"
@@ -88,6 +89,28 @@ func TestPathTableToMBytes(t *testing.T) {
 	}
 }
 
+func TestPathTableWrite(t *testing.T) {
+	validTable, _, _, _ := get9660PathTable()
+	for _, tt := range []struct {
+		order binary.ByteOrder
+		want  []byte
+	}{
+		{binary.LittleEndian, validTable.toLBytes()},
+		{binary.BigEndian, validTable.toMBytes()},
+	} {
+		var buf bytes.Buffer
+		if err := validTable.write(&buf, tt.order); err != nil {
+			t.Fatalf("unexpected error writing %v path table: %v", tt.order, err)
+		}
+		if !bytes.Equal(buf.Bytes(), tt.want) {
+			t.Errorf("%v path table written differs from its bytes", tt.order)
+		}
+		if validTable.size() != len(tt.want) {
+			t.Errorf("size %d instead of %d", validTable.size(), len(tt.want))
+		}
+	}
+}
+
 func TestPathTableGetLocation(t *testing.T) {
 	//nolint:dogsled // we do not care about too many underbar here
 	table, _, _, _ := get9660PathTable()
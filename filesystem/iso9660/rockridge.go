@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -111,10 +112,17 @@ func (r *rockRidgeExtension) GetFileExtensions(ffi *finalizeFileInfo, isSelf, is
 	})
 	// TF
 	tf := rockRidgeTimestamps{longForm: false, stamps: []rockRidgeTimestamp{
+		{timestampType: rockRidgeTimestampCreation, time: ffi.CreateTime()},
 		{timestampType: rockRidgeTimestampModify, time: mtime},
 		{timestampType: rockRidgeTimestampAccess, time: ffi.AccessTime()},
 		{timestampType: rockRidgeTimestampAttribute, time: ffi.ChangeTime()},
 	}}
+	// the short form only has years from 1900 to 2155, so use the long one for any time outside of those
+	for _, stamp := range tf.stamps {
+		if year := stamp.time.Year(); year < 1900 || year > 2155 {
+			tf.longForm = true
+		}
+	}
 
 	ret = append(ret, tf)
 	// NM
@@ -126,6 +134,10 @@ func (r *rockRidgeExtension) GetFileExtensions(ffi *finalizeFileInfo, isSelf, is
 		// need the target if it is a symlink
 		ret = append(ret, rockRidgeSymlink{continued: false, name: ffi.LinkTarget()})
 	}
+	// SF
+	if ffi.sparse != nil {
+		ret = append(ret, ffi.sparse.extension())
+	}
 
 	return ret, nil
 }
@@ -488,6 +500,14 @@ func (r *rockRidgeExtension) parsePosixDeviceNumber(b []byte) (directoryEntrySys
 	}, nil
 }
 
+// flags of a component of a symlink in an SL entry, RRIP 4.1.3.1
+const (
+	rockRidgeSymlinkContinue byte = 0x1
+	rockRidgeSymlinkCurrent  byte = 0x2
+	rockRidgeSymlinkParent   byte = 0x4
+	rockRidgeSymlinkRoot     byte = 0x8
+)
+
 // rockRidgeSymlink
 // a symlink can be greater than the 254 max size of a SUSP extension, so it may continue across multiple extension entries
 // a rockRidgeSymlink can represent the individual components, or an entire set merged together
@@ -531,16 +551,17 @@ func (d rockRidgeSymlink) Bytes() []byte {
 	cBytes := make([][]byte, 0)
 	if root {
 		// component flag, component len, component of path
-		cBytes = append(cBytes, []byte{0x08, 0x0})
+		cBytes = append(cBytes, []byte{rockRidgeSymlinkRoot, 0x0})
 	}
 	for _, e := range components {
 		switch e {
 		case "..":
-			cBytes = append(cBytes, []byte{0x4, 0x0})
+			cBytes = append(cBytes, []byte{rockRidgeSymlinkParent, 0x0})
 		case ".":
-			cBytes = append(cBytes, []byte{0x2, 0x0})
+			cBytes = append(cBytes, []byte{rockRidgeSymlinkCurrent, 0x0})
 		default:
-			cBytes = append(cBytes, []byte{0x0, byte(len(e))}, []byte(e))
+			// the header and the name of a component stay together in one record
+			cBytes = append(cBytes, append([]byte{0x0, byte(len(e))}, e...))
 		}
 	}
 	// we now have cBytes, which is all of the component parts
@@ -580,9 +601,14 @@ func (d rockRidgeSymlink) Bytes() []byte {
 func (d rockRidgeSymlink) Continuable() bool {
 	return d.continued
 }
+
+// Merge the target with those of the entries it continues in, each of which starts at a new component
 func (d rockRidgeSymlink) Merge(links []directoryEntrySystemUseExtension) directoryEntrySystemUseExtension {
 	for _, e := range links {
 		if l, ok := e.(rockRidgeSymlink); ok {
+			if d.name != "" && !strings.HasSuffix(d.name, "/") {
+				d.name += "/"
+			}
 			d.name += l.name
 		}
 	}
@@ -603,22 +629,36 @@ func (r *rockRidgeExtension) parseSymlink(b []byte) (directoryEntrySystemUseExte
 	}
 	continued := b[4] == 1
 	name := ""
+	// whether the last component goes on in the next one, rather than being separated from it by a "/"
+	joined := false
 	for i := 5; i < len(b); {
 		// make it easier to work with
 		b2 := b[i:]
+		if len(b2) < 2 || len(b2) < 2+int(b2[1]) {
+			//nolint:stylecheck // "Rock Ridge" is a proper noun
+			return nil, fmt.Errorf("Rock Ridge SL extension has a component that runs past its end at byte %d", i)
+		}
 		// find out how many bytes we will read
 		flags := b2[0]
 		size := b2[1]
+		var component string
 		switch {
-		case flags&0x1 == 0x1:
-			name += "."
-		case flags&0x2 == 0x2:
-			name += ".."
-		case flags&0x3 == 0x3:
-			name = "/"
-		case size > 0:
-			name += "/" + string(b2[2:2+size])
+		case flags&rockRidgeSymlinkRoot != 0:
+			name, joined = "/", false
+			i += 2 + int(size)
+			continue
+		case flags&rockRidgeSymlinkParent != 0:
+			component = ".."
+		case flags&rockRidgeSymlinkCurrent != 0:
+			component = "."
+		default:
+			component = string(b2[2 : 2+size])
 		}
+		if name != "" && !joined && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		name += component
+		joined = flags&rockRidgeSymlinkContinue != 0
 
 		i += 2 + int(size)
 	}
@@ -889,18 +929,25 @@ func (r *rockRidgeExtension) parseTimestamps(b []byte) (directoryEntrySystemUseE
 		if flags&tf == 0 {
 			continue
 		}
+		if len(tfBytes) < entryLength {
+			//nolint:stylecheck // "Rock Ridge" is a proper noun
+			return nil, fmt.Errorf("Rock Ridge TF extension has flags %#x for more timestamps than its %d bytes", flags, len(b))
+		}
 		timeBytes := tfBytes[:entryLength]
 		tfBytes = tfBytes[entryLength:]
 		var (
 			t   time.Time
 			err error
 		)
-		if longForm {
+		switch {
+		case unspecifiedTimestamp(timeBytes, longForm):
+			// ECMA-119 8.4.26.1 and 9.1.5, a timestamp that is all zeros is not specified
+		case longForm:
 			t, err = decBytesToTime(timeBytes)
 			if err != nil {
 				return nil, fmt.Errorf("could not process timestamp %d bytes to long form bytes: %v % x", tf, err, timeBytes)
 			}
-		} else {
+		default:
 			t = bytesToTime(timeBytes)
 		}
 		entry := rockRidgeTimestamp{
@@ -916,6 +963,58 @@ func (r *rockRidgeExtension) parseTimestamps(b []byte) (directoryEntrySystemUseE
 	}, nil
 }
 
+// unspecifiedTimestamp whether a timestamp in the short or the long form is all zeros, the digits of the latter
+// being the character '0', which means that it is not specified
+func unspecifiedTimestamp(b []byte, longForm bool) bool {
+	digits, zero := b[:6], byte(0)
+	if longForm {
+		digits, zero = b[:16], '0'
+	}
+	for _, c := range digits {
+		if c != zero {
+			return false
+		}
+	}
+	return true
+}
+
+// Timestamps the times that a Rock Ridge TF entry records for a file or directory, which Sys() of its
+// os.FileInfo returns. A time that the entry does not record is the zero time. Each time is in the time zone that
+// it was recorded in, and has centiseconds if it was recorded in the long form.
+type Timestamps struct {
+	Creation   time.Time
+	Modify     time.Time
+	Access     time.Time
+	Attributes time.Time
+	Backup     time.Time
+	Expiration time.Time
+	Effective  time.Time
+}
+
+// timestamps the times that the TF entry records, by type
+func (d rockRidgeTimestamps) timestamps() *Timestamps {
+	ts := &Timestamps{}
+	for _, stamp := range d.stamps {
+		switch stamp.timestampType {
+		case rockRidgeTimestampCreation:
+			ts.Creation = stamp.time
+		case rockRidgeTimestampModify:
+			ts.Modify = stamp.time
+		case rockRidgeTimestampAccess:
+			ts.Access = stamp.time
+		case rockRidgeTimestampAttribute:
+			ts.Attributes = stamp.time
+		case rockRidgeTimestampBackup:
+			ts.Backup = stamp.time
+		case rockRidgeTimestampExpiration:
+			ts.Expiration = stamp.time
+		case rockRidgeTimestampEffective:
+			ts.Effective = stamp.time
+		}
+	}
+	return ts
+}
+
 // rockRidgeSparseFile
 type rockRidgeSparseFile struct {
 	length     int
@@ -979,7 +1078,7 @@ func (r *rockRidgeExtension) parseSparseFile(b []byte) (directoryEntrySystemUseE
 		//nolint:stylecheck // "Rock Ridge" is a proper noun
 		return nil, fmt.Errorf("Rock Ridge SF extension must be version 1, was %d", version)
 	}
-	sf := &rockRidgeSparseFile{
+	sf := rockRidgeSparseFile{
 		high:   binary.LittleEndian.Uint32(b[4:8]),
 		length: targetSize,
 	}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -72,8 +73,9 @@ func TestRockRidgeSymlinkMerge(t *testing.T) {
 		continuation []directoryEntrySystemUseExtension
 		result       rockRidgeSymlink
 	}{
-		{rockRidgeSymlink{name: "/a/b", continued: true}, []directoryEntrySystemUseExtension{rockRidgeSymlink{name: "/c/d", continued: true}, rockRidgeSymlink{name: "/e/f", continued: false}}, rockRidgeSymlink{name: "/a/b/c/d/e/f", continued: false}},
-		{rockRidgeSymlink{name: "/a/b", continued: true}, []directoryEntrySystemUseExtension{rockRidgeSymlink{name: "/c/d", continued: false}}, rockRidgeSymlink{name: "/a/b/c/d", continued: false}},
+		{rockRidgeSymlink{name: "/a/b", continued: true}, []directoryEntrySystemUseExtension{rockRidgeSymlink{name: "c/d", continued: true}, rockRidgeSymlink{name: "e/f", continued: false}}, rockRidgeSymlink{name: "/a/b/c/d/e/f", continued: false}},
+		{rockRidgeSymlink{name: "/a/b", continued: true}, []directoryEntrySystemUseExtension{rockRidgeSymlink{name: "c/d", continued: false}}, rockRidgeSymlink{name: "/a/b/c/d", continued: false}},
+		{rockRidgeSymlink{name: "/", continued: true}, []directoryEntrySystemUseExtension{rockRidgeSymlink{name: "a", continued: false}}, rockRidgeSymlink{name: "/a", continued: false}},
 		{rockRidgeSymlink{name: "/a/b", continued: false}, nil, rockRidgeSymlink{name: "/a/b", continued: false}},
 	}
 	for _, tt := range tests {
@@ -84,6 +86,48 @@ func TestRockRidgeSymlinkMerge(t *testing.T) {
 	}
 }
 
+func TestRockRidgeSymlinkParse(t *testing.T) {
+	rr := &rockRidgeExtension{}
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"absolute", "/a/b/c"},
+		{"relative", "file.txt"},
+		{"parent and current", "../x/./y"},
+		{"long", strings.Repeat("directory/", 40) + "file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := rockRidgeSymlink{name: tt.target}.Bytes()
+			var records []directoryEntrySystemUseExtension
+			for len(b) > 0 {
+				ext, err := rr.parseSymlink(b[:b[2]])
+				if err != nil {
+					t.Fatalf("unexpected error parsing: %v", err)
+				}
+				records = append(records, ext)
+				b = b[b[2]:]
+			}
+			if got := records[0].(rockRidgeSymlink).Merge(records[1:]).(rockRidgeSymlink).name; got != tt.target {
+				t.Errorf("target %q instead of %q", got, tt.target)
+			}
+		})
+	}
+	// a component that goes on in the next one, as other tools write long names
+	b := []byte{'S', 'L', 15, 1, 0, rockRidgeSymlinkContinue, 3, 'a', 'b', 'c', 0, 3, 'd', 'e', 'f'}
+	ext, err := rr.parseSymlink(b)
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %v", err)
+	}
+	if got := ext.(rockRidgeSymlink).name; got != "abcdef" {
+		t.Errorf("target %q instead of %q", got, "abcdef")
+	}
+	if _, err := rr.parseSymlink([]byte{'S', 'L', 8, 1, 0, 0, 5, 'a'}); err == nil {
+		t.Errorf("no error parsing a component that runs past the end")
+	}
+}
+
 func TestRockRidgeNameMerge(t *testing.T) {
 	tests := []struct {
 		first        rockRidgeName
@@ -123,6 +167,94 @@ func TestRockRidgeSortTimestamp(t *testing.T) {
 	}
 }
 
+func TestRockRidgeTimestamps(t *testing.T) {
+	rr := getRockRidgeExtension(rockRidge112)
+	india := time.FixedZone("iso", 330*60)
+	pacific := time.FixedZone("iso", -8*60*60)
+	tests := []struct {
+		name     string
+		stamps   rockRidgeTimestamps
+		expected Timestamps
+	}{
+		{"short form", rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+			{timestampType: rockRidgeTimestampCreation, time: time.Date(2001, 2, 3, 4, 5, 6, 0, india)},
+			{timestampType: rockRidgeTimestampModify, time: time.Date(2011, 2, 3, 4, 5, 6, 0, india)},
+			{timestampType: rockRidgeTimestampAccess, time: time.Date(2021, 2, 3, 4, 5, 6, 0, pacific)},
+			{timestampType: rockRidgeTimestampAttribute, time: time.Date(2022, 2, 3, 4, 5, 6, 0, time.UTC)},
+			{timestampType: rockRidgeTimestampBackup, time: time.Date(2023, 2, 3, 4, 5, 6, 0, time.UTC)},
+		}}, Timestamps{
+			Creation:   time.Date(2001, 2, 3, 4, 5, 6, 0, india),
+			Modify:     time.Date(2011, 2, 3, 4, 5, 6, 0, india),
+			Access:     time.Date(2021, 2, 3, 4, 5, 6, 0, pacific),
+			Attributes: time.Date(2022, 2, 3, 4, 5, 6, 0, time.UTC),
+			Backup:     time.Date(2023, 2, 3, 4, 5, 6, 0, time.UTC),
+		}},
+		{"long form", rockRidgeTimestamps{longForm: true, stamps: []rockRidgeTimestamp{
+			{timestampType: rockRidgeTimestampModify, time: time.Date(2200, 12, 31, 23, 59, 58, 120000000, pacific)},
+			{timestampType: rockRidgeTimestampEffective, time: time.Date(1850, 1, 1, 0, 0, 0, 0, india)},
+		}}, Timestamps{
+			Modify:    time.Date(2200, 12, 31, 23, 59, 58, 120000000, pacific),
+			Effective: time.Date(1850, 1, 1, 0, 0, 0, 0, india),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ext, err := rr.parseTimestamps(tt.stamps.Bytes())
+			if err != nil {
+				t.Fatalf("unexpected error parsing timestamps: %v", err)
+			}
+			de := &directoryEntry{extensions: []directoryEntrySystemUseExtension{ext}}
+			ts, ok := de.Sys().(*Timestamps)
+			if !ok {
+				t.Fatalf("Sys() returned %T instead of *Timestamps", de.Sys())
+			}
+			for _, c := range []struct {
+				name             string
+				actual, expected time.Time
+			}{
+				{"creation", ts.Creation, tt.expected.Creation},
+				{"modify", ts.Modify, tt.expected.Modify},
+				{"access", ts.Access, tt.expected.Access},
+				{"attributes", ts.Attributes, tt.expected.Attributes},
+				{"backup", ts.Backup, tt.expected.Backup},
+				{"expiration", ts.Expiration, tt.expected.Expiration},
+				{"effective", ts.Effective, tt.expected.Effective},
+			} {
+				_, actualOffset := c.actual.Zone()
+				_, expectedOffset := c.expected.Zone()
+				if !c.actual.Equal(c.expected) || actualOffset != expectedOffset {
+					t.Errorf("%s time %v instead of %v", c.name, c.actual, c.expected)
+				}
+			}
+			if !de.ModTime().Equal(tt.expected.Modify) {
+				t.Errorf("ModTime() %v instead of %v", de.ModTime(), tt.expected.Modify)
+			}
+		})
+	}
+	t.Run("unspecified", func(t *testing.T) {
+		b := []byte{'T', 'F', 5 + 7 + 17, 1, rockRidgeTimestampModify | rockRidgeTimestampAccess}
+		b = append(b, make([]byte, 7)...)
+		if _, err := rr.parseTimestamps(b[:5+7]); err == nil {
+			t.Fatalf("no error parsing TF with fewer bytes than its length")
+		}
+		b[2] = 5 + 2*7
+		b = append(b, make([]byte, 7)...)
+		ext, err := rr.parseTimestamps(b)
+		if err != nil {
+			t.Fatalf("unexpected error parsing timestamps: %v", err)
+		}
+		if ts := ext.(rockRidgeTimestamps).timestamps(); !ts.Modify.IsZero() || !ts.Access.IsZero() {
+			t.Errorf("timestamps %v and %v instead of zero", ts.Modify, ts.Access)
+		}
+	})
+	t.Run("no timestamps", func(t *testing.T) {
+		de := &directoryEntry{}
+		if sys := de.Sys(); sys != nil {
+			t.Errorf("Sys() returned %v instead of nil for an entry without timestamps", sys)
+		}
+	})
+}
+
 func TestGetExtensions(t *testing.T) {
 	// create an extension object and test files
 	rr := getRockRidgeExtension(rockRidge112)
@@ -172,6 +304,7 @@ func TestGetExtensions(t *testing.T) {
 		{"regular01", false, false, []directoryEntrySystemUseExtension{
 			rockRidgePosixAttributes{mode: 0o764, linkCount: 1, uid: uid, gid: gid, length: pxLength},
 			rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+				{timestampType: rockRidgeTimestampCreation, time: now},
 				{timestampType: rockRidgeTimestampModify, time: now},
 				{timestampType: rockRidgeTimestampAccess, time: now},
 				{timestampType: rockRidgeTimestampAttribute, time: now},
@@ -193,6 +326,7 @@ func TestGetExtensions(t *testing.T) {
 		{"directory02", false, false, []directoryEntrySystemUseExtension{
 			rockRidgePosixAttributes{mode: 0o754 | os.ModeDir, linkCount: 2, uid: uid, gid: gid, length: pxLength},
 			rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+				{timestampType: rockRidgeTimestampCreation, time: now},
 				{timestampType: rockRidgeTimestampModify, time: now},
 				{timestampType: rockRidgeTimestampAccess, time: now},
 				{timestampType: rockRidgeTimestampAttribute, time: now},
@@ -213,6 +347,7 @@ func TestGetExtensions(t *testing.T) {
 		{"symlink03", false, false, []directoryEntrySystemUseExtension{
 			rockRidgePosixAttributes{mode: symMode | os.ModeSymlink, linkCount: 1, uid: uid, gid: gid, length: pxLength},
 			rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+				{timestampType: rockRidgeTimestampCreation, time: now},
 				{timestampType: rockRidgeTimestampModify, time: now},
 				{timestampType: rockRidgeTimestampAccess, time: now},
 				{timestampType: rockRidgeTimestampAttribute, time: now},
@@ -231,6 +366,7 @@ func TestGetExtensions(t *testing.T) {
 		{"directoryparent", false, true, []directoryEntrySystemUseExtension{
 			rockRidgePosixAttributes{mode: 0o754 | os.ModeDir, linkCount: 2, uid: uid, gid: gid, length: pxLength},
 			rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+				{timestampType: rockRidgeTimestampCreation, time: now},
 				{timestampType: rockRidgeTimestampModify, time: now},
 				{timestampType: rockRidgeTimestampAccess, time: now},
 				{timestampType: rockRidgeTimestampAttribute, time: now},
@@ -246,6 +382,7 @@ func TestGetExtensions(t *testing.T) {
 		{"directoryself", true, false, []directoryEntrySystemUseExtension{
 			rockRidgePosixAttributes{mode: 0o754 | os.ModeDir, linkCount: 2, uid: uid, gid: gid, length: pxLength},
 			rockRidgeTimestamps{stamps: []rockRidgeTimestamp{
+				{timestampType: rockRidgeTimestampCreation, time: now},
 				{timestampType: rockRidgeTimestampModify, time: now},
 				{timestampType: rockRidgeTimestampAccess, time: now},
 				{timestampType: rockRidgeTimestampAttribute, time: now},
@@ -0,0 +1,239 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	A Rock Ridge sparse file, marked by an SF entry, does not store its data directly in its extent. Instead,
+	the extent begins with a sparse file table, which maps each logical block of the file to where it is stored.
+
+	Each table fills one logical block, and is an array of 32-bit little-endian entries. The SF entry gives the
+	depth of the tables: in a table at the last level, each entry is the location of one logical block of file data;
+	in the levels above it, each entry is the location of the table below it. An entry with sparseFileTableEmpty set
+	covers only zeroes, so nothing is stored for it, neither data nor tables. The root table is the first logical
+	block of the extent.
+
+	For the 12-byte SF entry of RRIP 1.10, which has no depth, the depth is 1.
+*/
+
+// sparseFileTableEmpty set in a sparse file table entry whose blocks all are zeroes
+const sparseFileTableEmpty uint32 = 0x80000000
+
+// size the size of the file that the sparse file holds, rather than of its extent
+func (d rockRidgeSparseFile) size() uint64 {
+	if d.length == 21 {
+		return uint64(d.high)<<32 | uint64(d.low)
+	}
+	return uint64(d.high)
+}
+
+// depth the number of levels of sparse file tables
+func (d rockRidgeSparseFile) depth() uint8 {
+	if d.length != 21 || d.tableDepth == 0 {
+		return 1
+	}
+	return d.tableDepth
+}
+
+// sparseFile get the Rock Ridge SF entry of a directory entry, if it has one
+func (de *directoryEntry) sparseFile() (rockRidgeSparseFile, bool) {
+	for _, ext := range de.extensions {
+		if sf, ok := ext.(rockRidgeSparseFile); ok {
+			return sf, true
+		}
+	}
+	return rockRidgeSparseFile{}, false
+}
+
+// sparseBlockLocation find the location of a block of a sparse file whose root table is at location root.
+// Returns 0 if the block is all zeroes.
+func (fsm *FileSystem) sparseBlockLocation(root uint32, depth uint8, fileBlock uint64) (uint32, error) {
+	entries := uint64(fsm.blocksize / 4)
+	// how many blocks of the file each entry in the root table covers
+	span := uint64(1)
+	for i := uint8(1); i < depth; i++ {
+		span *= entries
+	}
+	if fileBlock/span >= entries {
+		return 0, fmt.Errorf("block %d is beyond what a sparse file table of depth %d can hold", fileBlock, depth)
+	}
+	location := root
+	b := make([]byte, 4)
+	for ; span > 0; span /= entries {
+		index := fileBlock / span
+		fileBlock %= span
+		if _, err := fsm.backend.ReadAt(b, int64(location)*fsm.blocksize+int64(index)*4); err != nil {
+			return 0, fmt.Errorf("could not read sparse file table at block %d: %v", location, err)
+		}
+		location = binary.LittleEndian.Uint32(b)
+		if location&sparseFileTableEmpty != 0 {
+			return 0, nil
+		}
+	}
+	return location, nil
+}
+
+// readSparse read from a sparse file, filling in zeroes for the blocks that are not stored
+func (fl *File) readSparse(b []byte, sf rockRidgeSparseFile) (int, error) {
+	fs := fl.filesystem
+	size := int64(sf.size())
+	if fl.offset >= size {
+		return 0, io.EOF
+	}
+	if left := size - fl.offset; int64(len(b)) > left {
+		b = b[:left]
+	}
+	read := 0
+	for read < len(b) {
+		fileBlock := uint64(fl.offset / fs.blocksize)
+		inBlock := fl.offset % fs.blocksize
+		n := int(fs.blocksize - inBlock)
+		if n > len(b)-read {
+			n = len(b) - read
+		}
+		location, err := fs.sparseBlockLocation(fl.location, sf.depth(), fileBlock)
+		if err != nil {
+			return read, err
+		}
+		chunk := b[read : read+n]
+		if location == 0 {
+			clear(chunk)
+		} else if _, err := fs.backend.ReadAt(chunk, int64(location)*fs.blocksize+inBlock); err != nil && err != io.EOF {
+			return read, err
+		}
+		read += n
+		fl.offset += int64(n)
+	}
+	var retErr error
+	if fl.offset >= size {
+		retErr = io.EOF
+	}
+	return read, retErr
+}
+
+// sparseLayout how a file written as a Rock Ridge sparse file is laid out in its extent:
+// all of its tables, then each block of data that is not all zeroes, in order
+type sparseLayout struct {
+	// size of the file itself
+	size  int64
+	depth uint8
+	// dataBlocks the blocks of the file that are stored, in order
+	dataBlocks  []uint64
+	tableBlocks uint32
+}
+
+// newSparseLayout check which blocks of the file at p are all zeroes, and if storing it as a sparse file would
+// take fewer blocks than storing it as it is, return how to lay it out. Otherwise, returns nil.
+func newSparseLayout(p string, size int64, blocksize int) (*sparseLayout, error) {
+	blocks := uint64(calculateBlocks(size, int64(blocksize)))
+	if blocks == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", p, err)
+	}
+	defer f.Close()
+
+	s := &sparseLayout{size: size, depth: 1}
+	entries := uint64(blocksize / 4)
+	for span := entries; span < blocks; span *= entries {
+		s.depth++
+	}
+	b := make([]byte, blocksize)
+	zeroes := make([]byte, blocksize)
+	for block := uint64(0); block < blocks; block++ {
+		n, err := f.ReadAt(b, int64(block)*int64(blocksize))
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not read %s: %v", p, err)
+		}
+		if !bytes.Equal(b[:n], zeroes[:n]) {
+			s.dataBlocks = append(s.dataBlocks, block)
+		}
+	}
+	s.tableBlocks = uint32(len(s.tables(0, blocksize)))
+	if uint64(s.blocks()) >= blocks {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// blocks how many blocks the extent of the sparse file uses
+func (s *sparseLayout) blocks() uint32 {
+	return s.tableBlocks + uint32(len(s.dataBlocks))
+}
+
+// tables build the sparse file tables for an extent starting at location, in the order they are written
+func (s *sparseLayout) tables(location uint32, blocksize int) [][]byte {
+	entries := uint64(blocksize / 4)
+	span := uint64(1)
+	for i := uint8(0); i < s.depth; i++ {
+		span *= entries
+	}
+	var (
+		tables       [][]byte
+		next         int
+		dataLocation = location + s.tableBlocks
+		build        func(first, span uint64)
+	)
+	build = func(first, span uint64) {
+		table := make([]byte, blocksize)
+		tables = append(tables, table)
+		childSpan := span / entries
+		for i := uint64(0); i < entries; i++ {
+			start := first + i*childSpan
+			entry := sparseFileTableEmpty
+			if next < len(s.dataBlocks) && s.dataBlocks[next] < start+childSpan {
+				if childSpan == 1 {
+					entry = dataLocation + uint32(next)
+					next++
+				} else {
+					// the table below this entry is written right after this one
+					entry = location + uint32(len(tables))
+					build(start, childSpan)
+				}
+			}
+			binary.LittleEndian.PutUint32(table[i*4:i*4+4], entry)
+		}
+	}
+	build(0, span)
+	return tables
+}
+
+// extension the Rock Ridge SF entry for the sparse file
+func (s *sparseLayout) extension() rockRidgeSparseFile {
+	return rockRidgeSparseFile{
+		length:     21,
+		high:       uint32(uint64(s.size) >> 32),
+		low:        uint32(uint64(s.size)),
+		tableDepth: s.depth,
+	}
+}
+
+// write the tables and data blocks of the sparse file to its extent at location
+func (s *sparseLayout) write(from io.ReaderAt, to io.WriterAt, location uint32, blocksize int) error {
+	writeAt := int64(location) * int64(blocksize)
+	for _, table := range s.tables(location, blocksize) {
+		if _, err := to.WriteAt(table, writeAt); err != nil {
+			return err
+		}
+		writeAt += int64(blocksize)
+	}
+	b := make([]byte, blocksize)
+	for _, block := range s.dataBlocks {
+		clear(b)
+		if _, err := from.ReadAt(b, int64(block)*int64(blocksize)); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := to.WriteAt(b, writeAt); err != nil {
+			return err
+		}
+		writeAt += int64(blocksize)
+	}
+	return nil
+}
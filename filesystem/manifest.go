@@ -0,0 +1,248 @@
+package filesystem
+
+import (
+	"crypto"
+	// register the default digest algorithm, so that crypto.SHA256 is always available
+	_ "crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestEntry a single file, directory or symlink that is to be placed in a filesystem
+type ManifestEntry struct {
+	// Path is the path of the entry inside the filesystem, e.g. /boot/vmlinuz
+	Path string
+	// Size is the size of a file in bytes, or the length of the target of a symlink. It is ignored for directories.
+	Size int64
+	// Mode is the mode of the entry. Only the type bits are used, so 0 is a regular file.
+	Mode iofs.FileMode
+	// Digest is the hex encoded digest of the contents of a file, when the manifest is built by ManifestFromFS.
+	// It is empty for directories and symlinks, and is not needed to estimate sizes.
+	Digest string
+}
+
+// Manifest the list of everything that is to be placed in a filesystem, which is all that is needed
+// to estimate the size of the filesystem before creating it
+type Manifest []ManifestEntry
+
+// ManifestFromDir build a manifest of everything under the directory dir on the local filesystem,
+// with dir as the root of the filesystem
+func ManifestFromDir(dir string) (Manifest, error) {
+	var m Manifest
+	err := filepath.WalkDir(dir, func(p string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{Path: "/" + filepath.ToSlash(rel), Mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entry.Size = int64(len(target))
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+		}
+		m = append(m, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to build manifest from %s: %w", dir, err)
+	}
+	return m, nil
+}
+
+// Directories group the entries of the manifest by the directory that holds them, keyed by the cleaned path
+// of the directory, with the root as "/". Parent directories that are not themselves in the manifest are
+// added, so that every directory has a key, including empty ones and the root. Entries are sorted by path.
+func (m Manifest) Directories() map[string][]ManifestEntry {
+	dirs := map[string][]ManifestEntry{"/": nil}
+	seen := map[string]bool{"/": true}
+	var add func(e ManifestEntry)
+	add = func(e ManifestEntry) {
+		if seen[e.Path] {
+			return
+		}
+		seen[e.Path] = true
+		parent := path.Dir(e.Path)
+		if !seen[parent] {
+			add(ManifestEntry{Path: parent, Mode: iofs.ModeDir})
+		}
+		dirs[parent] = append(dirs[parent], e)
+		if e.Mode.IsDir() {
+			if _, ok := dirs[e.Path]; !ok {
+				dirs[e.Path] = nil
+			}
+		}
+	}
+	for _, e := range m {
+		e.Path = path.Clean("/" + strings.TrimPrefix(filepath.ToSlash(e.Path), "/"))
+		if e.Path == "/" {
+			continue
+		}
+		add(e)
+	}
+	for _, entries := range dirs {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	}
+	return dirs
+}
+
+// ManifestFromFS build a manifest of everything under the directory root of the filesystem fs, with root as the
+// root of the manifest, and the digest of the contents of every file, using the hash algo, e.g. crypto.SHA256.
+// The entries are sorted by path, so that manifests of two images with the same contents are equal, whatever
+// the order of the entries in their directories. Any algorithm other than crypto.SHA256 has to be linked into
+// the binary, e.g. by importing crypto/sha512.
+func ManifestFromFS(fs FileSystem, root string, algo crypto.Hash) (Manifest, error) {
+	if !algo.Available() {
+		return nil, fmt.Errorf("digest algorithm %v is not available", algo)
+	}
+	root = path.Clean("/" + root)
+	var m Manifest
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		infos, err := fs.ReadDir(path.Join(root, dir))
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if info.Name() == "." || info.Name() == ".." {
+				continue
+			}
+			p := path.Join(dir, info.Name())
+			entry := ManifestEntry{Path: p, Mode: info.Mode().Type()}
+			if info.IsDir() {
+				entry.Mode |= iofs.ModeDir
+			}
+			switch {
+			case entry.Mode.IsDir():
+				m = append(m, entry)
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			case entry.Mode.IsRegular():
+				entry.Size = info.Size()
+				if entry.Digest, err = fileDigest(fs, path.Join(root, p), algo); err != nil {
+					return err
+				}
+			default:
+				entry.Size = info.Size()
+			}
+			m = append(m, entry)
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, fmt.Errorf("unable to build manifest from %s: %w", root, err)
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].Path < m[j].Path })
+	return m, nil
+}
+
+// fileDigest the hex encoded digest of the contents of the file at p in fs
+func fileDigest(fs FileSystem, p string, algo crypto.Hash) (string, error) {
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s: %w", p, err)
+	}
+	defer f.Close()
+	h := algo.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not read %s: %w", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyManifest check that the directory root of the filesystem fs holds exactly what the manifest m says,
+// with the digests using the hash algo that m was built with. It returns all of the differences found, joined,
+// or nil if there are none.
+func VerifyManifest(fs FileSystem, root string, m Manifest, algo crypto.Hash) error {
+	actual, err := ManifestFromFS(fs, root, algo)
+	if err != nil {
+		return err
+	}
+	return m.Diff(actual)
+}
+
+// Diff compare the manifest with other, e.g. of two builds of the same image that should be reproducible.
+// It returns every entry that is only in one of them, or differs in type, size or digest, joined, or nil
+// if they are the same.
+func (m Manifest) Diff(other Manifest) error {
+	byPath := func(m Manifest) map[string]ManifestEntry {
+		entries := make(map[string]ManifestEntry, len(m))
+		for _, e := range m {
+			entries[path.Clean("/"+strings.TrimPrefix(filepath.ToSlash(e.Path), "/"))] = e
+		}
+		return entries
+	}
+	expected, actual := byPath(m), byPath(other)
+	paths := make([]string, 0, len(expected)+len(actual))
+	for p := range expected {
+		paths = append(paths, p)
+	}
+	for p := range actual {
+		if _, ok := expected[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var errs []error
+	for _, p := range paths {
+		e, inExpected := expected[p]
+		a, inActual := actual[p]
+		switch {
+		case !inActual:
+			errs = append(errs, fmt.Errorf("%s is missing", p))
+		case !inExpected:
+			errs = append(errs, fmt.Errorf("%s is not expected", p))
+		case e.Mode.Type() != a.Mode.Type():
+			errs = append(errs, fmt.Errorf("%s has type %v instead of %v", p, a.Mode.Type(), e.Mode.Type()))
+		case e.Mode.IsDir():
+			// directories have no size or digest to compare
+		case e.Size != a.Size:
+			errs = append(errs, fmt.Errorf("%s has size %d instead of %d", p, a.Size, e.Size))
+		case e.Digest != a.Digest:
+			errs = append(errs, fmt.Errorf("%s has digest %s instead of %s", p, a.Digest, e.Digest))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WriteTo write the digests of the files in the manifest to w, one per line, in the format of sha256sum and its
+// siblings, so that they can be checked with sha256sum -c against the extracted image, or diffed as text
+func (m Manifest) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, e := range m {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		n, err := fmt.Fprintf(w, "%s  %s\n", e.Digest, strings.TrimPrefix(e.Path, "/"))
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
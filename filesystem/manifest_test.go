@@ -0,0 +1,87 @@
+package filesystem_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+func TestManifestFromFS(t *testing.T) {
+	fs := createFat32(t, "MANIFEST")
+	if err := fs.Mkdir("/boot/efi"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	contents := map[string][]byte{
+		"/boot/efi/grub.cfg": []byte("set timeout=5\n"),
+		"/boot/vmlinuz":      bytes.Repeat([]byte{0xaa}, 100000),
+		"/empty":             {},
+	}
+	for p, b := range contents {
+		rw, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("error creating file %s: %v", p, err)
+		}
+		if _, err := rw.Write(b); err != nil {
+			t.Fatalf("error writing file %s: %v", p, err)
+		}
+	}
+
+	m, err := filesystem.ManifestFromFS(fs, "/", crypto.SHA256)
+	if err != nil {
+		t.Fatalf("error building manifest: %v", err)
+	}
+	paths := make([]string, 0, len(m))
+	for _, e := range m {
+		paths = append(paths, e.Path)
+		if b, ok := contents[e.Path]; ok {
+			sum := sha256.Sum256(b)
+			if e.Digest != hex.EncodeToString(sum[:]) || e.Size != int64(len(b)) {
+				t.Errorf("%s has digest %s and size %d instead of %x and %d", e.Path, e.Digest, e.Size, sum, len(b))
+			}
+		}
+	}
+	expected := []string{"/boot", "/boot/efi", "/boot/efi/grub.cfg", "/boot/vmlinuz", "/empty"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Errorf("manifest has paths %v instead of %v", paths, expected)
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("error writing manifest: %v", err)
+	}
+	if !strings.Contains(buf.String(), "  boot/efi/grub.cfg\n") || strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("unexpected sha256sum output:\n%s", buf.String())
+	}
+
+	// a subdirectory is the root of its own manifest
+	sub, err := filesystem.ManifestFromFS(fs, "/boot", crypto.SHA256)
+	if err != nil {
+		t.Fatalf("error building manifest of subdirectory: %v", err)
+	}
+	if len(sub) != 3 || sub[0].Path != "/efi" {
+		t.Errorf("unexpected manifest of subdirectory %v", sub)
+	}
+
+	if err := filesystem.VerifyManifest(fs, "/", m, crypto.SHA256); err != nil {
+		t.Errorf("unexpected error verifying unchanged filesystem: %v", err)
+	}
+	rw, err := fs.OpenFile("/boot/efi/grub.cfg", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	if _, err := rw.Write([]byte("SET")); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := fs.Remove("/empty"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	err = filesystem.VerifyManifest(fs, "/", m, crypto.SHA256)
+	if err == nil || !strings.Contains(err.Error(), "/boot/efi/grub.cfg has digest") || !strings.Contains(err.Error(), "/empty is missing") {
+		t.Errorf("unexpected error verifying changed filesystem: %v", err)
+	}
+}
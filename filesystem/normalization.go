@@ -0,0 +1,95 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrAmbiguousName is returned in strict mode when a name matches more than one entry of a directory once
+// they are normalized, or when a name would be added to a directory that already has one that it matches
+var ErrAmbiguousName = errors.New("name is ambiguous once normalized")
+
+// Normalization the Unicode normalization form that names are put in
+type Normalization int
+
+const (
+	// NormalizationNone names are kept and compared as the bytes they are
+	NormalizationNone Normalization = iota
+	// NormalizationNFC names are composed, as Linux and Windows mostly write them
+	NormalizationNFC
+	// NormalizationNFD names are decomposed, as macOS writes them
+	NormalizationNFD
+)
+
+func (n Normalization) String() string {
+	switch n {
+	case NormalizationNone:
+		return "none"
+	case NormalizationNFC:
+		return "NFC"
+	case NormalizationNFD:
+		return "NFD"
+	default:
+		return fmt.Sprintf("Normalization(%d)", int(n))
+	}
+}
+
+// NameNormalization how a filesystem normalizes the names that it writes, and the names that it is asked to
+// look up, so that a name matches an entry whether either was written composed or decomposed.
+//
+// Names are written in Form; on lookup, the name asked for and those of the entries are both put in Form before
+// they are compared. Where more than one entry matches, the one with the very same bytes as the name asked for is
+// used, or else the first; with Strict, that is an error, ErrAmbiguousName, instead, as is writing a name that
+// matches one already there.
+type NameNormalization struct {
+	Form   Normalization
+	Strict bool
+}
+
+// Validate whether the normalization is one that is known
+func (n NameNormalization) Validate() error {
+	switch n.Form {
+	case NormalizationNone, NormalizationNFC, NormalizationNFD:
+		return nil
+	default:
+		return fmt.Errorf("unknown name normalization %v", n.Form)
+	}
+}
+
+// Normalize put name in the normalization form, or return it as is for NormalizationNone
+func (n NameNormalization) Normalize(name string) string {
+	switch n.Form {
+	case NormalizationNFC:
+		return norm.NFC.String(name)
+	case NormalizationNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+// Equal whether the names a and b are the same once normalized
+func (n NameNormalization) Equal(a, b string) bool {
+	return a == b || n.Normalize(a) == n.Normalize(b)
+}
+
+// Resolve choose which of matches, the names of the entries that matched name once normalized, is the one that
+// name refers to, and return its index, or -1 if there are none
+func (n NameNormalization) Resolve(name string, matches []string) (int, error) {
+	switch {
+	case len(matches) == 0:
+		return -1, nil
+	case len(matches) == 1:
+		return 0, nil
+	case n.Strict:
+		return -1, fmt.Errorf("%q matches %d entries: %w", name, len(matches), ErrAmbiguousName)
+	}
+	for i, m := range matches {
+		if m == name {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,94 @@
+package ntfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+const (
+	bootSectorSize = 512
+	// oemID what the boot sector of every NTFS filesystem has right after its jump instruction
+	oemID = "NTFS    "
+	// bootSignature what every boot sector ends in
+	bootSignature = 0xaa55
+	// maxClusterSize the largest cluster that Windows can make, of 2MiB
+	maxClusterSize = 2 * 1024 * 1024
+)
+
+// errNotNTFS the filesystem does not start with an NTFS boot sector
+var errNotNTFS = errors.New("not an NTFS filesystem")
+
+// bootSector the parts of the boot sector, with its BIOS parameter block, needed to read the filesystem
+type bootSector struct {
+	bytesPerSector uint32
+	clusterSize    uint32
+	totalSectors   uint64
+	mftCluster     uint64
+	// recordSize the size of each record of the MFT
+	recordSize uint32
+	// indexBlockSize the size of each block of a directory index, although each index also records its own
+	indexBlockSize uint32
+	serial         uint64
+}
+
+// sizeInClusters the size of records of the MFT and index blocks, which is in clusters if positive, and otherwise
+// a power of 2 bytes, for when they are smaller than a cluster
+func sizeInClusters(v int8, clusterSize uint32) uint32 {
+	if v > 0 {
+		return uint32(v) * clusterSize
+	}
+	if v < -31 {
+		return 0
+	}
+	return 1 << uint(-v)
+}
+
+// validSize whether n is a power of 2 within min and max
+func validSize(n, minimum, maximum uint32) bool {
+	return bits.OnesCount32(n) == 1 && n >= minimum && n <= maximum
+}
+
+// parseBootSector parse the boot sector of an NTFS filesystem
+func parseBootSector(b []byte) (*bootSector, error) {
+	if len(b) < bootSectorSize {
+		return nil, fmt.Errorf("boot sector of %d bytes instead of %d", len(b), bootSectorSize)
+	}
+	if string(b[3:11]) != oemID {
+		return nil, errNotNTFS
+	}
+	if signature := binary.LittleEndian.Uint16(b[510:512]); signature != bootSignature {
+		return nil, fmt.Errorf("boot sector has signature %#04x instead of %#04x", signature, bootSignature)
+	}
+	bs := &bootSector{
+		bytesPerSector: uint32(binary.LittleEndian.Uint16(b[0x0b:0x0d])),
+		totalSectors:   binary.LittleEndian.Uint64(b[0x28:0x30]),
+		mftCluster:     binary.LittleEndian.Uint64(b[0x30:0x38]),
+		serial:         binary.LittleEndian.Uint64(b[0x48:0x50]),
+	}
+	if !validSize(bs.bytesPerSector, 256, 4096) {
+		return nil, fmt.Errorf("invalid sector size %d", bs.bytesPerSector)
+	}
+	// more than 128 sectors per cluster are given as a negative power of 2
+	sectorsPerCluster := uint32(b[0x0d])
+	if sectorsPerCluster > 0x80 {
+		sectorsPerCluster = 1 << (256 - sectorsPerCluster)
+	}
+	bs.clusterSize = sectorsPerCluster * bs.bytesPerSector
+	if !validSize(bs.clusterSize, bs.bytesPerSector, maxClusterSize) {
+		return nil, fmt.Errorf("invalid cluster size of %d sectors of %d bytes", sectorsPerCluster, bs.bytesPerSector)
+	}
+	bs.recordSize = sizeInClusters(int8(b[0x40]), bs.clusterSize)
+	if !validSize(bs.recordSize, fixupStride*2, maxClusterSize) {
+		return nil, fmt.Errorf("invalid MFT record size %d", bs.recordSize)
+	}
+	bs.indexBlockSize = sizeInClusters(int8(b[0x44]), bs.clusterSize)
+	if !validSize(bs.indexBlockSize, fixupStride*2, maxClusterSize) {
+		return nil, fmt.Errorf("invalid index block size %d", bs.indexBlockSize)
+	}
+	if bs.totalSectors == 0 || bs.mftCluster == 0 {
+		return nil, errors.New("boot sector has no size or location of the MFT")
+	}
+	return bs, nil
+}
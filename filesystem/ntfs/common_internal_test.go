@@ -0,0 +1,522 @@
+package ntfs
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+const (
+	imgFile        = "testdata/dist/ntfs.img"
+	randomDataFile = "testdata/dist/random.dat"
+)
+
+// TestMain sets up the test environment and runs the tests
+func TestMain(m *testing.M) {
+	// Check and generate the image made by mkntfs if necessary
+	if err := testhelper.BuildImage(imgFile); err != nil {
+		println("error generating test artifacts for ntfs", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// the geometry of the test image: 511 clusters of 1024 bytes, in sectors of 512, and a last sector with the backup
+// of the boot sector, with records of the MFT and index blocks of a cluster each
+const (
+	testSectorSize     = 512
+	testClusterSize    = 1024
+	testRecordSize     = 1024
+	testIndexBlockSize = 1024
+	testClusters       = 511
+	testLabel          = "testntfs"
+	testSerial         = 0x1a2b3c4d5e6f7081
+	testUUID           = "1A2B3C4D5E6F7081"
+	// testUsedClusters the clusters in use in the bitmap
+	testUsedClusters = 175
+	// testSequence the sequence number of every record
+	testSequence = 1
+)
+
+// the records of the test image, besides the ones of NTFS itself
+const (
+	testResidentRecord   = 16 // /resident.txt, also /dir/b, with its data in its record
+	testFragmentedRecord = 17 // /fragmented.dat, with a sparse run and less initialized than its size
+	testDirRecord        = 18 // /dir, with an index of 2 levels
+	testEmptyRecord      = 19 // /dir/a, empty
+	testSymlinkRecord    = 20 // /dir/m, a relative symbolic link
+	testJunctionRecord   = 21 // /dir/x, a junction
+	testListRecord       = 22 // /dir/y, with its data in the extension records after it
+	testCompressedRecord = 25 // /compressed.dat
+	testWofRecord        = 26 // /wof.dat, a file that Windows compressed itself
+)
+
+var (
+	testResidentContent = []byte("hello ntfs\n")
+	testFragmentedSize  = 5*testClusterSize - 100
+	testFragmentedInit  = 4*testClusterSize + 604
+	testListSize        = 3*testClusterSize - 10
+	testCreateTime      = time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+	testModTime         = time.Date(2024, 2, 3, 4, 5, 6, 700, time.UTC)
+	testChangeTime      = time.Date(2024, 3, 4, 5, 6, 7, 800, time.UTC)
+	testAccessTime      = time.Date(2024, 4, 5, 6, 7, 8, 900, time.UTC)
+)
+
+// testImage an NTFS image under construction
+type testImage struct {
+	b []byte
+}
+
+// cluster a cluster of the image
+func (im *testImage) cluster(n int) []byte {
+	return im.b[n*testClusterSize : (n+1)*testClusterSize]
+}
+
+// testRecordCluster where a record is, in the 2 runs of the MFT: records 0 to 19 at cluster 4, and the rest at 40
+func testRecordCluster(number int) int {
+	if number < 20 {
+		return 4 + number
+	}
+	return 40 + number - 20
+}
+
+// testFileContent the content of a cluster of a file, which differs for each one
+func testFileContent(n int) []byte {
+	b := make([]byte, testClusterSize)
+	for i := range b {
+		b[i] = byte(n*7 + i/3)
+	}
+	return b
+}
+
+func testName(name string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(name)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func testAlign(n int) int {
+	return (n + 7) &^ 7
+}
+
+func testFiletime(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100 + filetimeEpoch)
+}
+
+// testFixups replace the last 2 bytes of each 512 with the update sequence number, keeping them in the array
+func testFixups(b []byte, usaOffset int) {
+	usn := []byte{0x2a, 0x00}
+	binary.LittleEndian.PutUint16(b[4:6], uint16(usaOffset))
+	binary.LittleEndian.PutUint16(b[6:8], uint16(len(b)/fixupStride+1))
+	copy(b[usaOffset:], usn)
+	for i := 1; i <= len(b)/fixupStride; i++ {
+		end := i * fixupStride
+		copy(b[usaOffset+2*i:], b[end-2:end])
+		copy(b[end-2:end], usn)
+	}
+}
+
+// record write a record of the MFT with the given attributes
+func (im *testImage) record(number int, flags uint16, base uint64, attrs ...[]byte) {
+	b := im.cluster(testRecordCluster(number))
+	copy(b, recordMagic)
+	binary.LittleEndian.PutUint16(b[0x10:0x12], testSequence)
+	binary.LittleEndian.PutUint16(b[0x14:0x16], 0x38)
+	binary.LittleEndian.PutUint16(b[0x16:0x18], flags|recordInUse)
+	off := 0x38
+	for _, a := range attrs {
+		off += copy(b[off:], a)
+	}
+	binary.LittleEndian.PutUint32(b[off:], attrEnd)
+	binary.LittleEndian.PutUint32(b[0x18:0x1c], uint32(off+8))
+	binary.LittleEndian.PutUint32(b[0x1c:0x20], testRecordSize)
+	binary.LittleEndian.PutUint64(b[0x20:0x28], base)
+	binary.LittleEndian.PutUint32(b[0x2c:0x30], uint32(number))
+	testFixups(b, recordHeaderSize)
+}
+
+func testResident(typ uint32, name string, value []byte) []byte {
+	nameBytes := testName(name)
+	valueOffset := testAlign(24 + len(nameBytes))
+	b := make([]byte, testAlign(valueOffset+len(value)))
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)))
+	b[9] = byte(len(nameBytes) / 2)
+	binary.LittleEndian.PutUint16(b[10:12], 24)
+	binary.LittleEndian.PutUint32(b[16:20], uint32(len(value)))
+	binary.LittleEndian.PutUint16(b[20:22], uint16(valueOffset))
+	copy(b[24:], nameBytes)
+	copy(b[valueOffset:], value)
+	return b
+}
+
+// testRun a run of clusters, which is sparse if lcn is negative
+type testRun struct {
+	length, lcn int64
+}
+
+// testInt the fewest bytes that hold v, signed or not
+func testInt(v int64, signed bool) []byte {
+	var b []byte
+	for {
+		b = append(b, byte(v))
+		v >>= 8
+		top := b[len(b)-1]&0x80 != 0
+		if (v == 0 && (!signed || !top)) || (signed && v == -1 && top) {
+			return b
+		}
+	}
+}
+
+func testNonResident(typ uint32, name string, flags uint16, startVCN uint64, size, initialized int, runs ...testRun) []byte {
+	var (
+		rb       []byte
+		lcn      int64
+		clusters int64
+	)
+	for _, r := range runs {
+		length := testInt(r.length, false)
+		clusters += r.length
+		if r.lcn < 0 {
+			rb = append(rb, byte(len(length)))
+			rb = append(rb, length...)
+			continue
+		}
+		offset := testInt(r.lcn-lcn, true)
+		lcn = r.lcn
+		rb = append(rb, byte(len(offset)<<4|len(length)))
+		rb = append(rb, length...)
+		rb = append(rb, offset...)
+	}
+	rb = append(rb, 0)
+	nameBytes := testName(name)
+	runsOffset := testAlign(64 + len(nameBytes))
+	b := make([]byte, testAlign(runsOffset+len(rb)))
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)))
+	b[8] = 1
+	b[9] = byte(len(nameBytes) / 2)
+	binary.LittleEndian.PutUint16(b[10:12], 64)
+	binary.LittleEndian.PutUint16(b[12:14], flags)
+	binary.LittleEndian.PutUint64(b[16:24], startVCN)
+	binary.LittleEndian.PutUint64(b[24:32], startVCN+uint64(clusters)-1)
+	binary.LittleEndian.PutUint16(b[32:34], uint16(runsOffset))
+	if startVCN == 0 {
+		binary.LittleEndian.PutUint64(b[40:48], uint64(clusters)*testClusterSize)
+		binary.LittleEndian.PutUint64(b[48:56], uint64(size))
+		binary.LittleEndian.PutUint64(b[56:64], uint64(initialized))
+	}
+	copy(b[64:], nameBytes)
+	copy(b[runsOffset:], rb)
+	return b
+}
+
+func testStandardInformation(attrs Attributes) []byte {
+	b := make([]byte, 72)
+	for i, t := range []time.Time{testCreateTime, testModTime, testChangeTime, testAccessTime} {
+		binary.LittleEndian.PutUint64(b[8*i:], testFiletime(t))
+	}
+	binary.LittleEndian.PutUint32(b[0x20:0x24], uint32(attrs))
+	return testResident(attrStandardInformation, "", b)
+}
+
+// testFileName the value of a $FILE_NAME attribute, which is also the key of an index entry
+func testFileName(parent uint64, name string, namespace byte) []byte {
+	nameBytes := testName(name)
+	b := make([]byte, fileNameHeaderSize+len(nameBytes))
+	binary.LittleEndian.PutUint64(b[0:8], testRef(parent))
+	b[0x40] = byte(len(nameBytes) / 2)
+	b[0x41] = namespace
+	copy(b[fileNameHeaderSize:], nameBytes)
+	return b
+}
+
+// testRef the file reference of a record
+func testRef(number uint64) uint64 {
+	return testSequence<<48 | number
+}
+
+// testIndexEntry an entry of an index, for a name, or if key is nil, the last one of a node, below which there
+// are the entries in the index block subnode, if it is not negative
+func testIndexEntry(number uint64, key []byte, subnode int64) []byte {
+	length := testAlign(indexEntryHeaderSize + len(key))
+	var flags uint16
+	if key == nil {
+		flags |= indexEntryLast
+	}
+	if subnode >= 0 {
+		flags |= indexEntrySubnode
+		length += 8
+	}
+	b := make([]byte, length)
+	if key != nil {
+		binary.LittleEndian.PutUint64(b[0:8], testRef(number))
+	}
+	binary.LittleEndian.PutUint16(b[8:10], uint16(length))
+	binary.LittleEndian.PutUint16(b[10:12], uint16(len(key)))
+	binary.LittleEndian.PutUint16(b[12:14], flags)
+	copy(b[indexEntryHeaderSize:], key)
+	if subnode >= 0 {
+		binary.LittleEndian.PutUint64(b[length-8:], uint64(subnode))
+	}
+	return b
+}
+
+func testIndexNode(entriesOffset, allocated int, entries ...[]byte) []byte {
+	b := make([]byte, entriesOffset)
+	for _, e := range entries {
+		b = append(b, e...)
+	}
+	binary.LittleEndian.PutUint32(b[0:4], uint32(entriesOffset))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(max(allocated, len(b))))
+	return b
+}
+
+// testIndexRoot an $INDEX_ROOT attribute of a directory
+func testIndexRoot(entries ...[]byte) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:4], attrFileName)
+	binary.LittleEndian.PutUint32(b[4:8], 1)
+	binary.LittleEndian.PutUint32(b[8:12], testIndexBlockSize)
+	b[12] = 1
+	b = append(b, testIndexNode(indexNodeHeaderSize, 0, entries...)...)
+	return testResident(attrIndexRoot, indexName, b)
+}
+
+// indexBlock write an index block into a cluster
+func (im *testImage) indexBlock(cluster int, vcn uint64, entries ...[]byte) {
+	b := im.cluster(cluster)
+	copy(b, indexMagic)
+	binary.LittleEndian.PutUint64(b[0x10:0x18], vcn)
+	copy(b[indexBlockHeaderSize:], testIndexNode(0x28, testIndexBlockSize-indexBlockHeaderSize, entries...))
+	testFixups(b, 0x28)
+}
+
+// testReparsePoint a reparse point that is a link; a symbolic link has flags, and a junction does not
+func testReparsePoint(tag uint32, substitute, print string, flags uint32) []byte {
+	sub, pr := testName(substitute), testName(print)
+	var data []byte
+	for _, n := range []int{0, len(sub), len(sub), len(pr)} {
+		data = binary.LittleEndian.AppendUint16(data, uint16(n))
+	}
+	if tag == reparseTagSymlink {
+		data = binary.LittleEndian.AppendUint32(data, flags)
+	}
+	data = append(data, sub...)
+	data = append(data, pr...)
+	b := binary.LittleEndian.AppendUint32(nil, tag)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	b = append(b, 0, 0)
+	return testResident(attrReparsePoint, "", append(b, data...))
+}
+
+// testAttributeListEntry an entry of an attribute list, for an attribute in the given record
+func testAttributeListEntry(typ uint32, startVCN, number uint64) []byte {
+	b := make([]byte, 0x20)
+	binary.LittleEndian.PutUint32(b[0:4], typ)
+	binary.LittleEndian.PutUint16(b[4:6], 0x20)
+	b[7] = 0x1a
+	binary.LittleEndian.PutUint64(b[0x08:0x10], startVCN)
+	binary.LittleEndian.PutUint64(b[0x10:0x18], testRef(number))
+	return b
+}
+
+// testNTFSImage create the test image
+func testNTFSImage(t *testing.T) []byte {
+	t.Helper()
+	im := &testImage{b: make([]byte, (testClusters+1)*testClusterSize)}
+
+	// the boot sector, with the backup of it after the end of the filesystem, which is not read
+	b := im.b[:bootSectorSize]
+	copy(b[3:11], oemID)
+	binary.LittleEndian.PutUint16(b[0x0b:0x0d], testSectorSize)
+	b[0x0d] = testClusterSize / testSectorSize
+	binary.LittleEndian.PutUint64(b[0x28:0x30], uint64(len(im.b)/testSectorSize-1))
+	binary.LittleEndian.PutUint64(b[0x30:0x38], 4)
+	binary.LittleEndian.PutUint64(b[0x38:0x40], 2)
+	// the size of a record as a power of 2, and of an index block in clusters
+	b[0x40] = 0xf6
+	b[0x44] = 1
+	binary.LittleEndian.PutUint64(b[0x48:0x50], testSerial)
+	binary.LittleEndian.PutUint16(b[510:512], bootSignature)
+	copy(im.b[len(im.b)-testSectorSize:], b)
+
+	// the files of NTFS itself
+	im.record(recordMFT, 0, 0,
+		testStandardInformation(AttrHidden|AttrSystem),
+		testResident(attrFileName, "", testFileName(recordRoot, "$MFT", 3)),
+		testNonResident(attrData, "", 0, 0, 32*testRecordSize, 32*testRecordSize, testRun{20, 4}, testRun{12, 40}),
+	)
+	volumeInfo := make([]byte, 12)
+	volumeInfo[8], volumeInfo[9] = 3, 1
+	im.record(recordVolume, 0, 0,
+		testStandardInformation(AttrHidden|AttrSystem),
+		testResident(attrVolumeName, "", testName(testLabel)),
+		testResident(attrVolumeInformation, "", volumeInfo),
+	)
+	im.record(recordBitmap, 0, 0,
+		testStandardInformation(AttrHidden|AttrSystem),
+		testNonResident(attrData, "", 0, 0, 64, 64, testRun{1, 30}),
+	)
+	bitmap := im.cluster(30)
+	for _, r := range []testRun{{4, 0}, {20, 4}, {1, 30}, {12, 40}, {1, 60}, {2, 62}, {128, 100}, {2, 300}, {1, 320}, {2, 340}, {1, 350}, {1, 360}} {
+		for c := r.lcn; c < r.lcn+r.length; c++ {
+			bitmap[c/8] |= 1 << (c % 8)
+		}
+	}
+	im.record(recordUpcase, 0, 0,
+		testStandardInformation(AttrHidden|AttrSystem),
+		testNonResident(attrData, "", 0, 0, 2*upcaseTableSize, 2*upcaseTableSize, testRun{128, 100}),
+	)
+	for i := 0; i < upcaseTableSize; i++ {
+		u := uint16(i)
+		if r := unicode.ToUpper(rune(i)); r < upcaseTableSize && !utf16.IsSurrogate(r) {
+			u = uint16(r)
+		}
+		binary.LittleEndian.PutUint16(im.b[100*testClusterSize+2*i:], u)
+	}
+
+	// the root directory, with its entries in an index block below its root, including the files of NTFS
+	// itself, and the short name of /resident.txt
+	im.record(recordRoot, recordIsDirectory, 0,
+		testStandardInformation(AttrHidden|AttrSystem),
+		testResident(attrFileName, "", testFileName(recordRoot, ".", 3)),
+		testIndexRoot(testIndexEntry(0, nil, 0)),
+		testNonResident(attrIndexAllocation, indexName, 0, 0, testIndexBlockSize, testIndexBlockSize, testRun{1, 60}),
+	)
+	im.indexBlock(60, 0,
+		testIndexEntry(recordMFT, testFileName(recordRoot, "$MFT", 3), -1),
+		testIndexEntry(recordRoot, testFileName(recordRoot, ".", 3), -1),
+		testIndexEntry(testCompressedRecord, testFileName(recordRoot, "compressed.dat", 3), -1),
+		testIndexEntry(testDirRecord, testFileName(recordRoot, "dir", 3), -1),
+		testIndexEntry(testFragmentedRecord, testFileName(recordRoot, "fragmented.dat", 3), -1),
+		testIndexEntry(testResidentRecord, testFileName(recordRoot, "resident.txt", 1), -1),
+		testIndexEntry(testResidentRecord, testFileName(recordRoot, "RESIDE~1.TXT", 2), -1),
+		testIndexEntry(testWofRecord, testFileName(recordRoot, "wof.dat", 3), -1),
+		testIndexEntry(0, nil, -1),
+	)
+
+	// a read-only file with its data in its record, and 2 names besides its short one
+	im.record(testResidentRecord, 0, 0,
+		testStandardInformation(AttrReadOnly|AttrArchive),
+		testResident(attrFileName, "", testFileName(recordRoot, "resident.txt", 1)),
+		testResident(attrFileName, "", testFileName(recordRoot, "RESIDE~1.TXT", 2)),
+		testResident(attrFileName, "", testFileName(testDirRecord, "b", 0)),
+		testResident(attrData, "", testResidentContent),
+	)
+
+	// a file of 5 clusters, of which 2 are written, then 2 sparse, then 1 of which only part was written
+	im.record(testFragmentedRecord, 0, 0,
+		testStandardInformation(AttrSparse),
+		testResident(attrFileName, "", testFileName(recordRoot, "fragmented.dat", 3)),
+		testNonResident(attrData, "", 0, 0, testFragmentedSize, testFragmentedInit, testRun{2, 300}, testRun{2, -1}, testRun{1, 320}),
+	)
+	copy(im.cluster(300), testFileContent(0))
+	copy(im.cluster(301), testFileContent(1))
+	copy(im.cluster(320), testFileContent(4))
+
+	// a directory with a root of 1 entry, and 2 index blocks, one below it and one below the last entry
+	im.record(testDirRecord, recordIsDirectory, 0,
+		testStandardInformation(0),
+		testResident(attrFileName, "", testFileName(recordRoot, "dir", 3)),
+		testIndexRoot(
+			testIndexEntry(testSymlinkRecord, testFileName(testDirRecord, "m", 3), 0),
+			testIndexEntry(0, nil, 1),
+		),
+		testNonResident(attrIndexAllocation, indexName, 0, 0, 2*testIndexBlockSize, 2*testIndexBlockSize, testRun{2, 62}),
+	)
+	im.indexBlock(62, 0,
+		testIndexEntry(testEmptyRecord, testFileName(testDirRecord, "a", 3), -1),
+		testIndexEntry(testResidentRecord, testFileName(testDirRecord, "b", 0), -1),
+		testIndexEntry(0, nil, -1),
+	)
+	im.indexBlock(63, 1,
+		testIndexEntry(testJunctionRecord, testFileName(testDirRecord, "x", 3), -1),
+		testIndexEntry(testListRecord, testFileName(testDirRecord, "y", 3), -1),
+		testIndexEntry(0, nil, -1),
+	)
+	im.record(testEmptyRecord, 0, 0,
+		testStandardInformation(AttrArchive),
+		testResident(attrFileName, "", testFileName(testDirRecord, "a", 3)),
+		testResident(attrData, "", nil),
+	)
+
+	// a symbolic link to a file, and a junction to a directory that is not there
+	im.record(testSymlinkRecord, 0, 0,
+		testStandardInformation(AttrArchive|AttrReparsePoint),
+		testResident(attrFileName, "", testFileName(testDirRecord, "m", 3)),
+		testResident(attrData, "", nil),
+		testReparsePoint(reparseTagSymlink, `..\resident.txt`, `..\resident.txt`, 1),
+	)
+	im.record(testJunctionRecord, recordIsDirectory, 0,
+		testStandardInformation(AttrReparsePoint),
+		testResident(attrFileName, "", testFileName(testDirRecord, "x", 3)),
+		testIndexRoot(testIndexEntry(0, nil, -1)),
+		testReparsePoint(reparseTagMountPoint, `\??\C:\Users`, "", 0),
+	)
+
+	// a file with its data in 2 extension records, each with a segment of it
+	var list []byte
+	list = append(list, testAttributeListEntry(attrStandardInformation, 0, testListRecord)...)
+	list = append(list, testAttributeListEntry(attrFileName, 0, testListRecord)...)
+	list = append(list, testAttributeListEntry(attrData, 0, testListRecord+1)...)
+	list = append(list, testAttributeListEntry(attrData, 2, testListRecord+2)...)
+	im.record(testListRecord, 0, 0,
+		testStandardInformation(AttrArchive),
+		testResident(attrAttributeList, "", list),
+		testResident(attrFileName, "", testFileName(testDirRecord, "y", 3)),
+	)
+	im.record(testListRecord+1, 0, testRef(testListRecord),
+		testNonResident(attrData, "", 0, 0, testListSize, testListSize, testRun{2, 340}),
+	)
+	im.record(testListRecord+2, 0, testRef(testListRecord),
+		testNonResident(attrData, "", 0, 2, 0, 0, testRun{1, 350}),
+	)
+	copy(im.cluster(340), testFileContent(0))
+	copy(im.cluster(341), testFileContent(1))
+	copy(im.cluster(350), testFileContent(2))
+
+	// files whose data cannot be read
+	im.record(testCompressedRecord, 0, 0,
+		testStandardInformation(AttrCompressed),
+		testResident(attrFileName, "", testFileName(recordRoot, "compressed.dat", 3)),
+		testNonResident(attrData, "", attrFlagCompressed&1, 0, 100, 100, testRun{1, 360}),
+	)
+	wof := binary.LittleEndian.AppendUint32(nil, 0x80000017)
+	wof = append(wof, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0)
+	im.record(testWofRecord, 0, 0,
+		testStandardInformation(AttrArchive|AttrSparse|AttrReparsePoint),
+		testResident(attrFileName, "", testFileName(recordRoot, "wof.dat", 3)),
+		testResident(attrData, "", nil),
+		testResident(attrReparsePoint, "", wof),
+	)
+	return im.b
+}
+
+// testNTFS read the test image, as it is or after modify changes it
+func testNTFS(t *testing.T, modify func([]byte)) (*FileSystem, error) {
+	t.Helper()
+	b := testNTFSImage(t)
+	if modify != nil {
+		modify(b)
+	}
+	return Read(testStorage(t, b), int64(len(b)), 0, 512)
+}
+
+func testStorage(t *testing.T, b []byte) *mem.Buffer {
+	t.Helper()
+	storage, err := mem.NewFromBytes(b, true)
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+	return storage
+}
@@ -0,0 +1,232 @@
+package ntfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// indexName the name of the index attributes of a directory, which index the file names in it
+	indexName = "$I30"
+	// indexNodeHeaderSize the size of the header of a node of an index, before its entries
+	indexNodeHeaderSize = 16
+	// indexBlockHeaderSize where the node header is in an index block
+	indexBlockHeaderSize = 0x18
+	// indexEntryHeaderSize the size of an index entry before its key
+	indexEntryHeaderSize = 16
+	// fileNameHeaderSize the size of a $FILE_NAME attribute before the name itself
+	fileNameHeaderSize = 0x42
+)
+
+// flags of an index entry
+const (
+	indexEntrySubnode uint16 = 0x0001
+	indexEntryLast    uint16 = 0x0002
+)
+
+// namespaceDOS the namespace of the short names that Windows makes for names that are not valid in DOS
+const namespaceDOS = 2
+
+// reparse point tags of links
+const (
+	reparseTagMountPoint uint32 = 0xa0000003
+	reparseTagSymlink    uint32 = 0xa000000c
+)
+
+// filetimeEpoch the number of 100ns intervals from 1601, when Windows times start, to 1970
+const filetimeEpoch = 116444736000000000
+
+// directoryEntry an entry of the index of a directory, which is the file reference of a file and a name of it
+type directoryEntry struct {
+	ref  uint64
+	name string
+}
+
+// fileName the parts of a $FILE_NAME attribute, which is also the key of an index entry, that are needed
+type fileName struct {
+	namespace byte
+	name      string
+}
+
+// parseFileName parse a $FILE_NAME attribute
+func parseFileName(b []byte) (*fileName, error) {
+	if len(b) < fileNameHeaderSize {
+		return nil, fmt.Errorf("file name of %d bytes", len(b))
+	}
+	length := int(b[0x40])
+	if fileNameHeaderSize+2*length > len(b) {
+		return nil, fmt.Errorf("file name of %d characters does not fit in %d bytes", length, len(b))
+	}
+	return &fileName{
+		namespace: b[0x41],
+		name:      decodeName(b[fileNameHeaderSize : fileNameHeaderSize+2*length]),
+	}, nil
+}
+
+// parseFiletime convert a Windows time, in 100ns intervals since 1601, into a time
+func parseFiletime(b []byte) time.Time {
+	t := int64(binary.LittleEndian.Uint64(b)) - filetimeEpoch
+	return time.Unix(t/1e7, t%1e7*100).UTC()
+}
+
+// readDirectory read all of the entries in the index of a directory, in order, except for the short names of DOS,
+// as the long names of those files are in the index too
+func (fs *FileSystem) readDirectory(dir *record) ([]*directoryEntry, error) {
+	root := dir.attribute(attrIndexRoot, indexName)
+	if root == nil || !root.resident {
+		return nil, errors.New("directory has no index")
+	}
+	if len(root.value) < 0x10+indexNodeHeaderSize {
+		return nil, fmt.Errorf("index root of %d bytes", len(root.value))
+	}
+	if typ := binary.LittleEndian.Uint32(root.value[0:4]); typ != attrFileName {
+		return nil, fmt.Errorf("index of attribute type %#x instead of file names", typ)
+	}
+	w := &indexWalker{
+		fs:         fs,
+		allocation: dir.attribute(attrIndexAllocation, indexName),
+		blockSize:  binary.LittleEndian.Uint32(root.value[8:12]),
+		visited:    map[uint64]bool{},
+	}
+	if !validSize(w.blockSize, fixupStride*2, maxClusterSize) {
+		return nil, fmt.Errorf("invalid index block size %d", w.blockSize)
+	}
+	// index blocks are numbered in clusters, or in 512 byte units if they are smaller than a cluster
+	w.vcnSize = fs.boot.clusterSize
+	if w.blockSize < w.vcnSize {
+		w.vcnSize = fixupStride
+	}
+	if err := w.walk(root.value[0x10:]); err != nil {
+		return nil, err
+	}
+	return w.entries, nil
+}
+
+// indexWalker walks through the nodes of the B+tree of an index, collecting its entries in order
+type indexWalker struct {
+	fs         *FileSystem
+	allocation *attribute
+	blockSize  uint32
+	vcnSize    uint32
+	visited    map[uint64]bool
+	entries    []*directoryEntry
+}
+
+// walk go through a node of the index, starting with its header, and the nodes below it, in order
+func (w *indexWalker) walk(node []byte) error {
+	entriesOffset := int(binary.LittleEndian.Uint32(node[0:4]))
+	used := int(binary.LittleEndian.Uint32(node[4:8]))
+	if used > len(node) || entriesOffset < indexNodeHeaderSize || entriesOffset > used {
+		return fmt.Errorf("index node has entries from %d to %d of %d bytes", entriesOffset, used, len(node))
+	}
+	for off := entriesOffset; ; {
+		if off+indexEntryHeaderSize > used {
+			return errors.New("index node has no last entry")
+		}
+		e := node[off:]
+		length := int(binary.LittleEndian.Uint16(e[8:10]))
+		keyLength := int(binary.LittleEndian.Uint16(e[10:12]))
+		flags := binary.LittleEndian.Uint16(e[12:14])
+		if length < indexEntryHeaderSize || length%8 != 0 || off+length > used || indexEntryHeaderSize+keyLength > length {
+			return fmt.Errorf("index entry at %d has invalid length %d", off, length)
+		}
+		// the entries below an entry come before it
+		if flags&indexEntrySubnode != 0 {
+			if length < indexEntryHeaderSize+8 {
+				return fmt.Errorf("index entry at %d has no room for its subnode", off)
+			}
+			if err := w.walkBlock(binary.LittleEndian.Uint64(e[length-8 : length])); err != nil {
+				return err
+			}
+		}
+		if flags&indexEntryLast != 0 {
+			return nil
+		}
+		name, err := parseFileName(e[indexEntryHeaderSize : indexEntryHeaderSize+keyLength])
+		if err != nil {
+			return fmt.Errorf("index entry at %d: %w", off, err)
+		}
+		if name.namespace != namespaceDOS {
+			w.entries = append(w.entries, &directoryEntry{
+				ref:  binary.LittleEndian.Uint64(e[0:8]),
+				name: name.name,
+			})
+		}
+		off += length
+	}
+}
+
+// walkBlock go through the index block with the given number and the nodes below it
+func (w *indexWalker) walkBlock(vcn uint64) error {
+	if w.allocation == nil {
+		return errors.New("index has no blocks for its subnodes")
+	}
+	if w.visited[vcn] {
+		return fmt.Errorf("index block %d is in the index more than once", vcn)
+	}
+	w.visited[vcn] = true
+	off := int64(vcn) * int64(w.vcnSize)
+	if off < 0 || off+int64(w.blockSize) > w.allocation.dataSize() {
+		return fmt.Errorf("index block %d is beyond the end of the index", vcn)
+	}
+	b := make([]byte, w.blockSize)
+	if err := w.fs.readRange(w.allocation, b, off); err != nil {
+		return fmt.Errorf("could not read index block %d: %w", vcn, err)
+	}
+	if err := applyFixups(b, indexMagic); err != nil {
+		return fmt.Errorf("index block %d: %w", vcn, err)
+	}
+	if n := binary.LittleEndian.Uint64(b[0x10:0x18]); n != vcn {
+		return fmt.Errorf("index block %d has number %d", vcn, n)
+	}
+	if err := w.walk(b[indexBlockHeaderSize:]); err != nil {
+		return fmt.Errorf("index block %d: %w", vcn, err)
+	}
+	return nil
+}
+
+// readReparsePoint read the tag of a reparse point, and for symbolic links and junctions, their target as a
+// Windows path
+func (fs *FileSystem) readReparsePoint(a *attribute) (tag uint32, target string, err error) {
+	b, err := fs.readValue(a)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(b) < 8 {
+		return 0, "", fmt.Errorf("reparse point of %d bytes", len(b))
+	}
+	tag = binary.LittleEndian.Uint32(b[0:4])
+	var buffer int
+	switch tag {
+	case reparseTagSymlink:
+		buffer = 20
+	case reparseTagMountPoint:
+		buffer = 16
+	default:
+		return tag, "", nil
+	}
+	if len(b) < buffer {
+		return 0, "", fmt.Errorf("link of %d bytes", len(b))
+	}
+	name := func(offset, length uint16) (string, error) {
+		start, end := buffer+int(offset), buffer+int(offset)+int(length)
+		if end > len(b) {
+			return "", fmt.Errorf("link target of %d bytes at %d is beyond its end", length, offset)
+		}
+		return decodeName(b[start:end]), nil
+	}
+	// the print name is the target as the user gave it; the substitute name is how Windows finds it
+	if target, err = name(binary.LittleEndian.Uint16(b[12:14]), binary.LittleEndian.Uint16(b[14:16])); err != nil {
+		return 0, "", err
+	}
+	if target == "" {
+		if target, err = name(binary.LittleEndian.Uint16(b[8:10]), binary.LittleEndian.Uint16(b[10:12])); err != nil {
+			return 0, "", err
+		}
+		target = strings.TrimPrefix(target, `\??\`)
+	}
+	return tag, target, nil
+}
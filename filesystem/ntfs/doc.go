@@ -0,0 +1,17 @@
+// Package ntfs provides support for reading NTFS filesystems, the filesystem of Windows.
+// references:
+//
+//	https://github.com/libyal/libfsntfs/blob/main/documentation/New%20Technologies%20File%20System%20(NTFS).asciidoc
+//	https://flatcap.github.io/linux-ntfs/ntfs/
+//	https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/fs/ntfs3/ntfs.h
+//
+// It reads NTFS 3.0 and 3.1, which every version of Windows since 2000 makes, such as the images that packer and
+// cloudbase-init build. The master file table (MFT) is read through its own data runs, so it can be fragmented, and
+// files whose attributes do not fit in a single record of the MFT are put together from their attribute lists.
+// Directories are read from their index trees, whether the index fits in its root or needs index blocks.
+//
+// Only the unnamed data stream of a file is read, not alternate data streams. Files that NTFS compressed or encrypted
+// cannot be read, nor can reparse points other than symbolic links and junctions, whose targets are given as Windows
+// paths. As in ntfs-3g, the files of NTFS itself, such as $MFT, are not listed in the root directory. It cannot write
+// NTFS; to make an image that has to be NTFS, build it elsewhere.
+package ntfs
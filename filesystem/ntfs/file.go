@@ -0,0 +1,66 @@
+package ntfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// File represents a single file in an NTFS filesystem
+type File struct {
+	// data the unnamed data stream of the file
+	data       *attribute
+	filesystem *FileSystem
+	offset     int64
+	closed     bool
+}
+
+// Read reads up to len(b) bytes from the File.
+// It returns the number of bytes read and any error encountered.
+// At end of file, Read returns 0, io.EOF
+// reads from the last known offset in the file from last read
+// use Seek() to set at a particular point
+func (fl *File) Read(b []byte) (int, error) {
+	if fl == nil || fl.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := fl.filesystem.readAt(fl.data, b, fl.offset)
+	fl.offset += int64(n)
+	return n, err
+}
+
+// Write writes len(b) bytes to the File.
+//
+//	NTFS is read-only, so this returns an error
+func (fl *File) Write(_ []byte) (int, error) {
+	return 0, filesystem.ErrReadonlyFilesystem
+}
+
+// Seek set the offset to a particular point in the file
+func (fl *File) Seek(offset int64, whence int) (int64, error) {
+	if fl == nil || fl.closed {
+		return 0, os.ErrClosed
+	}
+	newOffset := int64(0)
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekEnd:
+		newOffset = fl.data.dataSize() + offset
+	case io.SeekCurrent:
+		newOffset = fl.offset + offset
+	}
+	if newOffset < 0 {
+		return fl.offset, fmt.Errorf("cannot set offset %d before start of file", offset)
+	}
+	fl.offset = newOffset
+	return fl.offset, nil
+}
+
+// Close close the file
+func (fl *File) Close() error {
+	fl.closed = true
+	return nil
+}
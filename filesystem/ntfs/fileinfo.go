@@ -0,0 +1,174 @@
+package ntfs
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Attributes the Windows attributes of a file or directory
+type Attributes uint32
+
+const (
+	// AttrReadOnly the file must not be written or removed
+	AttrReadOnly Attributes = 0x0001
+	// AttrHidden the file is not listed by default
+	AttrHidden Attributes = 0x0002
+	// AttrSystem the file belongs to the operating system
+	AttrSystem Attributes = 0x0004
+	// AttrArchive the file was changed since it was last backed up
+	AttrArchive Attributes = 0x0020
+	// AttrSparse the file has ranges without clusters, which read as zeros
+	AttrSparse Attributes = 0x0200
+	// AttrReparsePoint the file is a reparse point, such as a symbolic link or junction
+	AttrReparsePoint Attributes = 0x0400
+	// AttrCompressed the data of the file is compressed
+	AttrCompressed Attributes = 0x0800
+	// AttrEncrypted the data of the file is encrypted
+	AttrEncrypted Attributes = 0x4000
+)
+
+// standardInformationSize the size of the $STANDARD_INFORMATION attribute up to the attributes of the file
+const standardInformationSize = 0x24
+
+// FileInfo represents the information for an individual file
+// it fulfills os.FileInfo interface
+type FileInfo struct {
+	modTime    time.Time
+	mode       os.FileMode
+	name       string
+	size       int64
+	attributes Attributes
+	linkTarget string
+	record     uint64
+	hardLinks  uint32
+	accessTime time.Time
+	changeTime time.Time
+	createTime time.Time
+}
+
+// newFileInfo create the FileInfo for a file with the given name, from its record
+func (fs *FileSystem) newFileInfo(r *record, name string) (*FileInfo, error) {
+	fi := &FileInfo{
+		name:   name,
+		record: r.number,
+	}
+	if si := r.attribute(attrStandardInformation, ""); si != nil && si.resident && len(si.value) >= standardInformationSize {
+		fi.createTime = parseFiletime(si.value[0x00:0x08])
+		fi.modTime = parseFiletime(si.value[0x08:0x10])
+		fi.changeTime = parseFiletime(si.value[0x10:0x18])
+		fi.accessTime = parseFiletime(si.value[0x18:0x20])
+		fi.attributes = Attributes(binary.LittleEndian.Uint32(si.value[0x20:0x24]))
+	}
+	// as ntfs-3g does, the short names of DOS do not count as links
+	for _, a := range r.attributes {
+		if a.typ != attrFileName || !a.resident {
+			continue
+		}
+		if fn, err := parseFileName(a.value); err == nil && fn.namespace != namespaceDOS {
+			fi.hardLinks++
+		}
+	}
+	switch {
+	case r.isDir():
+		fi.mode = os.ModeDir | 0o755
+		// the size of a directory is that of its index, as ntfs-3g has it
+		if alloc := r.attribute(attrIndexAllocation, indexName); alloc != nil {
+			fi.size = alloc.dataSize()
+		} else if root := r.attribute(attrIndexRoot, indexName); root != nil {
+			fi.size = root.dataSize()
+		}
+	case fi.attributes&AttrReadOnly != 0:
+		fi.mode = 0o444
+	default:
+		fi.mode = 0o644
+	}
+	if data := r.attribute(attrData, ""); data != nil && !r.isDir() {
+		fi.size = data.dataSize()
+	}
+	if reparse := r.attribute(attrReparsePoint, ""); reparse != nil {
+		tag, target, err := fs.readReparsePoint(reparse)
+		if err != nil {
+			return nil, err
+		}
+		if tag == reparseTagSymlink || tag == reparseTagMountPoint {
+			fi.mode = os.ModeSymlink | 0o777
+			fi.linkTarget = target
+			fi.size = int64(len(target))
+		}
+	}
+	return fi, nil
+}
+
+// IsDir abbreviation for Mode().IsDir()
+func (fi *FileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+// ModTime modification time
+func (fi *FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// Mode returns file mode. Directories are 0755 and files 0644, or 0444 if they are read-only, as NTFS has
+// access control lists rather than permissions. Symbolic links and junctions are both symbolic links.
+func (fi *FileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// Name base name of the file
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+// Size length in bytes for regular files
+func (fi *FileInfo) Size() int64 {
+	return fi.size
+}
+
+// Sys underlying data source, which is the *FileInfo itself, for its Windows attributes, link target and the rest
+// of the metadata in its record
+func (fi *FileInfo) Sys() interface{} {
+	return fi
+}
+
+// Attributes get the Windows attributes of the file
+func (fi *FileInfo) Attributes() Attributes {
+	return fi.attributes
+}
+
+// Readlink returns the target of a symbolic link or junction, as a Windows path, such as C:\Users or ..\file.txt.
+//
+// If this entry is not a symbolic link then it will return fs.ErrNotExist
+func (fi *FileInfo) Readlink() (string, error) {
+	if fi.mode&os.ModeSymlink == 0 {
+		return "", fs.ErrNotExist
+	}
+	return fi.linkTarget, nil
+}
+
+// Inode get the number of the record of the file in the MFT, which ntfs-3g gives as its inode number
+func (fi *FileInfo) Inode() uint64 {
+	return fi.record
+}
+
+// Nlink get the number of hard links to the file
+func (fi *FileInfo) Nlink() uint64 {
+	return uint64(fi.hardLinks)
+}
+
+// AccessTime get the time the file was last accessed, to 100ns
+func (fi *FileInfo) AccessTime() time.Time {
+	return fi.accessTime
+}
+
+// ChangeTime get the time the record of the file was last changed, to 100ns
+func (fi *FileInfo) ChangeTime() time.Time {
+	return fi.changeTime
+}
+
+// CreateTime get the time the file was created, to 100ns
+func (fi *FileInfo) CreateTime() time.Time {
+	return fi.createTime
+}
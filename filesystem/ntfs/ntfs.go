@@ -0,0 +1,553 @@
+package ntfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// FileSystem implements the FileSystem interface
+type FileSystem struct {
+	backend backend.Storage
+	size    int64
+	start   int64
+	boot    *bootSector
+	// mft the data of the MFT itself, through which every record is read
+	mft    *attribute
+	upcase upcaseTable
+	label  string
+	// free the free clusters, from the bitmap of clusters in use
+	free uint64
+}
+
+// Equal compare if two filesystems are equal
+func (fs *FileSystem) Equal(a *FileSystem) bool {
+	return fs.backend == a.backend && fs.size == a.size && fs.start == a.start
+}
+
+// Read reads an NTFS filesystem from the given storage. size is the size of the filesystem in bytes, and start
+// where it starts. The sizes of sectors and clusters of NTFS are in its boot sector, so the last argument, the block
+// size of the disk, is ignored.
+//
+// Only reading is supported.
+func Read(b backend.Storage, size, start, _ int64) (*FileSystem, error) {
+	fs := &FileSystem{
+		backend: b,
+		size:    size,
+		start:   start,
+	}
+	sector, err := fs.readBytes(0, bootSectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read boot sector: %w", err)
+	}
+	if fs.boot, err = parseBootSector(sector); err != nil {
+		return nil, err
+	}
+	if fsSize := fs.boot.totalSectors * uint64(fs.boot.bytesPerSector); fsSize > uint64(size) {
+		return nil, fmt.Errorf("filesystem of %d sectors of %d bytes is larger than %d bytes", fs.boot.totalSectors, fs.boot.bytesPerSector, size)
+	}
+	if err := fs.readMFT(); err != nil {
+		return nil, fmt.Errorf("could not read MFT: %w", err)
+	}
+	if err := fs.readVolume(); err != nil {
+		return nil, err
+	}
+	if err := fs.readUpcase(); err != nil {
+		return nil, fmt.Errorf("could not read up-case table: %w", err)
+	}
+	if err := fs.readBitmap(); err != nil {
+		return nil, fmt.Errorf("could not read cluster bitmap: %w", err)
+	}
+	root, err := fs.readFile(recordRoot)
+	if err != nil {
+		return nil, fmt.Errorf("could not read root directory: %w", err)
+	}
+	if !root.isDir() {
+		return nil, errors.New("root directory is not a directory")
+	}
+	return fs, nil
+}
+
+// readBytes read count bytes at the given offset in the filesystem
+func (fs *FileSystem) readBytes(off int64, count int) ([]byte, error) {
+	if off < 0 || off+int64(count) > fs.size {
+		return nil, fmt.Errorf("%d bytes at %d are beyond the end of the filesystem", count, off)
+	}
+	b := make([]byte, count)
+	if _, err := fs.backend.ReadAt(b, fs.start+off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readMFT find the data of the MFT, from its own record, which is its first one
+func (fs *FileSystem) readMFT() error {
+	recordSize := int(fs.boot.recordSize)
+	b, err := fs.readBytes(int64(fs.boot.mftCluster)*int64(fs.boot.clusterSize), recordSize)
+	if err != nil {
+		return err
+	}
+	r, err := parseRecord(b, recordMFT)
+	if err != nil {
+		return fmt.Errorf("record %d: %w", recordMFT, err)
+	}
+	// the first part of the data, in the record itself, is enough to read any records that hold the rest of it
+	for _, a := range r.attributes {
+		if a.typ == attrData && a.name == "" && !a.resident && a.startVCN == 0 {
+			fs.mft = a
+		}
+	}
+	if fs.mft == nil {
+		return errors.New("MFT has no data")
+	}
+	if r.attribute(attrAttributeList, "") != nil {
+		if r, err = fs.readFile(recordMFT); err != nil {
+			return err
+		}
+		fs.mft = r.attribute(attrData, "")
+	}
+	if fs.mft.dataSize() < int64(recordFirstUser*recordSize) {
+		return fmt.Errorf("MFT of %d bytes is too small", fs.mft.dataSize())
+	}
+	return nil
+}
+
+// readVolume read the version and the label of the filesystem, from the $Volume file
+func (fs *FileSystem) readVolume() error {
+	r, err := fs.readFile(recordVolume)
+	if err != nil {
+		return fmt.Errorf("could not read volume information: %w", err)
+	}
+	info := r.attribute(attrVolumeInformation, "")
+	if info == nil || !info.resident || len(info.value) < 12 {
+		return errors.New("volume has no version")
+	}
+	if major, minor := info.value[8], info.value[9]; major != 3 {
+		return fmt.Errorf("NTFS version %d.%d is not supported", major, minor)
+	}
+	if name := r.attribute(attrVolumeName, ""); name != nil && name.resident {
+		fs.label = decodeName(name.value)
+	}
+	return nil
+}
+
+// readUpcase read the table that names are made upper case with to compare them, from the $UpCase file
+func (fs *FileSystem) readUpcase() error {
+	r, err := fs.readFile(recordUpcase)
+	if err != nil {
+		return err
+	}
+	data := r.attribute(attrData, "")
+	if data == nil || data.dataSize() != 2*upcaseTableSize {
+		return errors.New("up-case table has the wrong size")
+	}
+	b, err := fs.readValue(data)
+	if err != nil {
+		return err
+	}
+	fs.upcase = make(upcaseTable, upcaseTableSize)
+	for i := range fs.upcase {
+		fs.upcase[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return nil
+}
+
+// readBitmap count the free clusters, from the $Bitmap file
+func (fs *FileSystem) readBitmap() error {
+	r, err := fs.readFile(recordBitmap)
+	if err != nil {
+		return err
+	}
+	data := r.attribute(attrData, "")
+	clusters := fs.clusters()
+	if data == nil || uint64(data.dataSize())*8 < clusters {
+		return fmt.Errorf("bitmap is too small for %d clusters", clusters)
+	}
+	b, err := fs.readValue(data)
+	if err != nil {
+		return err
+	}
+	var used uint64
+	for _, c := range b[:clusters/8] {
+		used += uint64(bits.OnesCount8(c))
+	}
+	for i := clusters / 8 * 8; i < clusters; i++ {
+		used += uint64(b[i/8] >> (i % 8) & 1)
+	}
+	fs.free = clusters - used
+	return nil
+}
+
+// clusters the number of clusters in the filesystem
+func (fs *FileSystem) clusters() uint64 {
+	return fs.boot.totalSectors * uint64(fs.boot.bytesPerSector) / uint64(fs.boot.clusterSize)
+}
+
+// readRange read the value of an attribute at the given offset, to fill b. Sparse runs, and anything past how much
+// of the value was written, read as zeros.
+func (fs *FileSystem) readRange(a *attribute, b []byte, off int64) error {
+	clear(b)
+	if a.resident {
+		if off < int64(len(a.value)) {
+			copy(b, a.value[off:])
+		}
+		return nil
+	}
+	switch {
+	case a.flags&attrFlagCompressed != 0:
+		return errors.New("compressed data is not supported")
+	case a.flags&attrFlagEncrypted != 0:
+		return errors.New("encrypted data is not supported")
+	}
+	clusterSize := int64(fs.boot.clusterSize)
+	end := min(off+int64(len(b)), int64(a.initializedSize))
+	if end <= off {
+		return nil
+	}
+	if end > int64(a.lastVCN+1)*clusterSize {
+		return fmt.Errorf("data to %d is beyond the end of its runs", end)
+	}
+	for _, r := range a.runs {
+		rStart, rEnd := int64(r.vcn)*clusterSize, int64(r.vcn+r.length)*clusterSize
+		if r.sparse || rEnd <= off || rStart >= end {
+			continue
+		}
+		from, to := max(off, rStart), min(end, rEnd)
+		diskOff := int64(r.lcn)*clusterSize + from - rStart
+		if diskOff+to-from > fs.size {
+			return fmt.Errorf("cluster %d is beyond the end of the filesystem", r.lcn)
+		}
+		if _, err := fs.backend.ReadAt(b[from-off:to-off], fs.start+diskOff); err != nil {
+			return fmt.Errorf("could not read cluster %d: %w", r.lcn, err)
+		}
+	}
+	return nil
+}
+
+// readAt read the value of an attribute at the given offset, as io.ReaderAt does
+func (fs *FileSystem) readAt(a *attribute, b []byte, off int64) (int, error) {
+	size := a.dataSize()
+	if off >= size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(b)), size-off)
+	if err := fs.readRange(a, b[:want], off); err != nil {
+		return 0, err
+	}
+	if int(want) < len(b) {
+		return int(want), io.EOF
+	}
+	return int(want), nil
+}
+
+// readValue read the whole value of an attribute
+func (fs *FileSystem) readValue(a *attribute) ([]byte, error) {
+	if a.resident {
+		return a.value, nil
+	}
+	if a.size > uint64(fs.size) {
+		return nil, fmt.Errorf("attribute of %d bytes is larger than the filesystem", a.size)
+	}
+	b := make([]byte, a.size)
+	if err := fs.readRange(a, b, 0); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readRecord read a single record of the MFT
+func (fs *FileSystem) readRecord(number uint64) (*record, error) {
+	recordSize := int64(fs.boot.recordSize)
+	off := int64(number) * recordSize
+	if number > refNumberMask || off+recordSize > fs.mft.dataSize() {
+		return nil, fmt.Errorf("record %d is beyond the end of the MFT", number)
+	}
+	b := make([]byte, recordSize)
+	if err := fs.readRange(fs.mft, b, off); err != nil {
+		return nil, fmt.Errorf("could not read record %d: %w", number, err)
+	}
+	r, err := parseRecord(b, number)
+	if err != nil {
+		return nil, fmt.Errorf("record %d: %w", number, err)
+	}
+	return r, nil
+}
+
+// readFile read the record of a file, given its file reference, with all of its attributes, including any in
+// extension records. If the reference has a sequence number, it must be that of the record.
+func (fs *FileSystem) readFile(ref uint64) (*record, error) {
+	number, sequence := ref&refNumberMask, uint16(ref>>48)
+	r, err := fs.readRecord(number)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case r.flags&recordInUse == 0:
+		return nil, fmt.Errorf("record %d is not in use", number)
+	case sequence != 0 && r.sequence != sequence:
+		return nil, fmt.Errorf("record %d has sequence number %d instead of %d", number, r.sequence, sequence)
+	case r.base != 0:
+		return nil, fmt.Errorf("record %d is an extension of record %d", number, r.base&refNumberMask)
+	}
+	if list := r.attribute(attrAttributeList, ""); list != nil {
+		b, err := fs.readValue(list)
+		if err != nil {
+			return nil, fmt.Errorf("could not read attribute list of record %d: %w", number, err)
+		}
+		// each entry of the list says which record an attribute is in; read each of the others once
+		read := map[uint64]bool{number: true}
+		for off := 0; off < len(b); {
+			if off+0x1a > len(b) {
+				return nil, fmt.Errorf("attribute list of record %d has a partial entry at %d", number, off)
+			}
+			length := int(binary.LittleEndian.Uint16(b[off+4 : off+6]))
+			if length < 0x1a || off+length > len(b) {
+				return nil, fmt.Errorf("attribute list of record %d has an entry of invalid length %d at %d", number, length, off)
+			}
+			n := binary.LittleEndian.Uint64(b[off+0x10:off+0x18]) & refNumberMask
+			off += length
+			if read[n] {
+				continue
+			}
+			read[n] = true
+			ext, err := fs.readRecord(n)
+			if err != nil {
+				return nil, err
+			}
+			if ext.flags&recordInUse == 0 || ext.base&refNumberMask != number {
+				return nil, fmt.Errorf("record %d is not an extension of record %d", n, number)
+			}
+			r.attributes = append(r.attributes, ext.attributes...)
+		}
+	}
+	if r.attributes, err = mergeAttributes(r.attributes); err != nil {
+		return nil, fmt.Errorf("record %d: %w", number, err)
+	}
+	return r, nil
+}
+
+// interface guard
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
+
+// Type returns the type code for the filesystem. Always returns filesystem.TypeNTFS
+func (fs *FileSystem) Type() filesystem.Type {
+	return filesystem.TypeNTFS
+}
+
+// Mkdir make a directory. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Mkdir(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Mknod make a special file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Mknod(_ string, _ uint32, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Link make a hard link. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Link(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Symlink make a symbolic link. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Symlink(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chmod change the mode of a file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Chmod(_ string, _ os.FileMode) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chown change the owner of a file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Chown(_ string, _, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chtimes change the times of a file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Chtimes(_ string, _, _ time.Time) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Rename rename a file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Rename(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Remove remove a file. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) Remove(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// SetLabel change the label. NTFS is read-only, so it always returns an error
+func (fs *FileSystem) SetLabel(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// ReadDir return the contents of a given directory in a given filesystem.
+//
+// Returns a slice of os.FileInfo with all of the entries in the directory, in the order of the index of the
+// directory, which is that of their names in upper case. Each name of a file with more than one is an entry of its
+// own, except for the short names that Windows makes for names that are not valid in DOS.
+//
+// Will return an error if the directory does not exist or is a regular file and not a directory
+func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	dir, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	entries, err := fs.readDirectory(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", p, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, de := range entries {
+		// the files of NTFS itself are in the root directory, as is the root directory as ".", but are not listed
+		if de.ref&refNumberMask < recordFirstUser {
+			continue
+		}
+		r, err := fs.readFile(de.ref)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path.Join(p, de.name), err)
+		}
+		fi, err := fs.newFileInfo(r, de.name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path.Join(p, de.name), err)
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+// Stat return os.FileInfo about a file or directory. Its Sys() returns the *FileInfo itself, which also gives
+// its Windows attributes, timestamps and the rest of its metadata.
+func (fs *FileSystem) Stat(p string) (os.FileInfo, error) {
+	r, name, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	return fs.newFileInfo(r, name)
+}
+
+// Readlink returns the target of the named symbolic link or junction, as a Windows path, as FileInfo.Readlink does
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	r, base, err := fs.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := fs.newFileInfo(r, base)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", name, err)
+	}
+	target, err := fi.Readlink()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	return target, nil
+}
+
+// OpenFile returns a reader for the data of a file in the filesystem. As NTFS is read-only, flag must be
+// os.O_RDONLY.
+func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_EXCL) != 0 {
+		return nil, filesystem.ErrReadonlyFilesystem
+	}
+	r, _, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if r.isDir() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	// the data of other reparse points, such as files that Windows compressed itself, is somewhere else
+	if reparse := r.attribute(attrReparsePoint, ""); reparse != nil {
+		tag, _, err := fs.readReparsePoint(reparse)
+		if err != nil {
+			return nil, fmt.Errorf("could not read reparse point of %s: %w", p, err)
+		}
+		return nil, fmt.Errorf("cannot open %s, a reparse point with tag %#08x", p, tag)
+	}
+	data := r.attribute(attrData, "")
+	if data == nil {
+		return nil, fmt.Errorf("%s has no data", p)
+	}
+	if !data.resident && data.flags&(attrFlagCompressed|attrFlagEncrypted) != 0 {
+		return nil, fmt.Errorf("cannot open %s, whose data is compressed or encrypted", p)
+	}
+	return &File{data: data, filesystem: fs}, nil
+}
+
+// lookup the record of a file or directory by its path, and the name it has in its directory. Names are compared
+// in upper case, as Windows does, but a name that matches exactly is preferred, as there can be more than one
+// name that differs only in case.
+func (fs *FileSystem) lookup(p string) (*record, string, error) {
+	r, err := fs.readFile(recordRoot)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not read root directory: %w", err)
+	}
+	walked, name := "/", "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !r.isDir() {
+			return nil, "", fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := fs.readDirectory(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read directory %s: %w", walked, err)
+		}
+		walked = path.Join(walked, part)
+		var found *directoryEntry
+		for _, de := range entries {
+			if de.name == part {
+				found = de
+				break
+			}
+			if found == nil && fs.upcase.equal(de.name, part) {
+				found = de
+			}
+		}
+		if found == nil {
+			return nil, "", fmt.Errorf("%s does not exist", walked)
+		}
+		if r, err = fs.readFile(found.ref); err != nil {
+			return nil, "", fmt.Errorf("could not read %s: %w", walked, err)
+		}
+		name = found.name
+	}
+	return r, name, nil
+}
+
+// Label the label of the filesystem, from its $Volume file
+func (fs *FileSystem) Label() string {
+	return fs.label
+}
+
+// UUID the serial number of the filesystem, in the same form as blkid reports it
+func (fs *FileSystem) UUID() string {
+	return fmt.Sprintf("%016X", fs.boot.serial)
+}
+
+// Usage the size of the filesystem, and the free space in its bitmap of clusters
+func (fs *FileSystem) Usage() filesystem.Usage {
+	clusterSize := int64(fs.boot.clusterSize)
+	return filesystem.Usage{Size: int64(fs.clusters()) * clusterSize, Free: int64(fs.free) * clusterSize}
+}
@@ -0,0 +1,414 @@
+package ntfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+// testRecordOffset where a record of the MFT is in the test image
+func testRecordOffset(number int) int {
+	return testRecordCluster(number) * testClusterSize
+}
+
+func TestRead(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		fs, err := testNTFS(t, nil)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if fs.Type() != filesystem.TypeNTFS {
+			t.Errorf("type %v instead of %v", fs.Type(), filesystem.TypeNTFS)
+		}
+		if label := fs.Label(); label != testLabel {
+			t.Errorf("label %q instead of %q", label, testLabel)
+		}
+		if uuid := fs.UUID(); uuid != testUUID {
+			t.Errorf("UUID %q instead of %q", uuid, testUUID)
+		}
+		usage := fs.Usage()
+		if usage.Size != testClusters*testClusterSize || usage.Free != (testClusters-testUsedClusters)*testClusterSize {
+			t.Errorf("usage %+v instead of size %d and free %d", usage, testClusters*testClusterSize, (testClusters-testUsedClusters)*testClusterSize)
+		}
+	})
+	t.Run("not NTFS", func(t *testing.T) {
+		_, err := testNTFS(t, func(b []byte) {
+			copy(b[3:11], "EXFAT   ")
+		})
+		if !errors.Is(err, errNotNTFS) {
+			t.Errorf("error %v instead of %v", err, errNotNTFS)
+		}
+	})
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		err    string
+	}{
+		{"boot signature", func(b []byte) { b[510] = 0 }, "boot sector has signature"},
+		{"cluster size", func(b []byte) { b[0x0d] = 3 }, "invalid cluster size"},
+		{"too small", func(b []byte) {
+			binary.LittleEndian.PutUint64(b[0x28:0x30], uint64(len(b)/testSectorSize+1))
+		}, "is larger than"},
+		{"MFT torn", func(b []byte) { b[testRecordOffset(recordMFT)+fixupStride-1] ^= 0xff }, "not written whole"},
+		{"MFT signature", func(b []byte) { copy(b[testRecordOffset(recordMFT):], "BAAD") }, "invalid signature"},
+		{"version", func(b []byte) {
+			// the major version, in the value of the volume information after the volume name
+			off := testRecordOffset(recordVolume)
+			i := bytes.Index(b[off:off+testRecordSize], []byte{0, 0, 0, 0, 0, 0, 0, 0, 3, 1})
+			b[off+i+8] = 1
+		}, "NTFS version 1.1 is not supported"},
+		{"root not in use", func(b []byte) {
+			b[testRecordOffset(recordRoot)+0x16] = 0
+		}, "record 5 is not in use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testNTFS(t, tt.modify)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	fs, err := testNTFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	tests := []struct {
+		path  string
+		names []string
+		err   string
+	}{
+		{"/", []string{"compressed.dat", "dir", "fragmented.dat", "resident.txt", "wof.dat"}, ""},
+		{"/dir", []string{"a", "b", "m", "x", "y"}, ""},
+		{"/DIR/", []string{"a", "b", "m", "x", "y"}, ""},
+		{"/dir/x", nil, ""},
+		{"/resident.txt", nil, "not a directory"},
+		{"/missing", nil, "does not exist"},
+		{"/resident.txt/x", nil, "/resident.txt is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			infos, err := fs.ReadDir(tt.path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v instead of one with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			names := make([]string, 0, len(infos))
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("entries %v instead of %v", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	fs, err := testNTFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	tests := []struct {
+		path   string
+		name   string
+		mode   os.FileMode
+		size   int64
+		attrs  Attributes
+		record uint64
+		links  uint64
+		target string
+	}{
+		{"/", "/", os.ModeDir | 0o755, testIndexBlockSize, AttrHidden | AttrSystem, recordRoot, 1, ""},
+		{"/Resident.TXT", "resident.txt", 0o444, int64(len(testResidentContent)), AttrReadOnly | AttrArchive, testResidentRecord, 2, ""},
+		{"/dir/b", "b", 0o444, int64(len(testResidentContent)), AttrReadOnly | AttrArchive, testResidentRecord, 2, ""},
+		{"/fragmented.dat", "fragmented.dat", 0o644, int64(testFragmentedSize), AttrSparse, testFragmentedRecord, 1, ""},
+		{"/dir", "dir", os.ModeDir | 0o755, 2 * testIndexBlockSize, 0, testDirRecord, 1, ""},
+		{"/dir/y", "y", 0o644, int64(testListSize), AttrArchive, testListRecord, 1, ""},
+		{"/dir/m", "m", os.ModeSymlink | 0o777, int64(len(`..\resident.txt`)), AttrArchive | AttrReparsePoint, testSymlinkRecord, 1, `..\resident.txt`},
+		{"/dir/x", "x", os.ModeSymlink | 0o777, int64(len(`C:\Users`)), AttrReparsePoint, testJunctionRecord, 1, `C:\Users`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			info, err := fs.Stat(tt.path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			fi := info.Sys().(*FileInfo)
+			if fi.Name() != tt.name || fi.Mode() != tt.mode || fi.Size() != tt.size || fi.Attributes() != tt.attrs {
+				t.Errorf("name %q, mode %v, size %d and attributes %#x instead of %q, %v, %d and %#x", fi.Name(), fi.Mode(), fi.Size(), fi.Attributes(), tt.name, tt.mode, tt.size, tt.attrs)
+			}
+			if fi.Inode() != tt.record || fi.Nlink() != tt.links {
+				t.Errorf("record %d with %d links instead of %d with %d", fi.Inode(), fi.Nlink(), tt.record, tt.links)
+			}
+			if !fi.CreateTime().Equal(testCreateTime) || !fi.ModTime().Equal(testModTime) || !fi.ChangeTime().Equal(testChangeTime) || !fi.AccessTime().Equal(testAccessTime) {
+				t.Errorf("times %v, %v, %v and %v instead of %v, %v, %v and %v", fi.CreateTime(), fi.ModTime(), fi.ChangeTime(), fi.AccessTime(), testCreateTime, testModTime, testChangeTime, testAccessTime)
+			}
+			target, err := fi.Readlink()
+			switch {
+			case tt.target == "" && !errors.Is(err, os.ErrNotExist):
+				t.Errorf("error %v instead of %v reading link", err, os.ErrNotExist)
+			case tt.target != "" && (err != nil || target != tt.target):
+				t.Errorf("link to %q with error %v instead of %q", target, err, tt.target)
+			}
+			target, err = fs.Readlink(tt.path)
+			switch {
+			case tt.target == "" && err == nil:
+				t.Errorf("no error reading link of a file that is not one")
+			case tt.target != "" && (err != nil || target != tt.target):
+				t.Errorf("filesystem gave link to %q with error %v instead of %q", target, err, tt.target)
+			}
+		})
+	}
+	if _, err := fs.Stat("/dir/missing"); err == nil || !strings.Contains(err.Error(), "/dir/missing does not exist") {
+		t.Errorf("error %v instead of one that the file does not exist", err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	fs, err := testNTFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	fragmented := make([]byte, testFragmentedSize)
+	copy(fragmented, testFileContent(0))
+	copy(fragmented[testClusterSize:], testFileContent(1))
+	copy(fragmented[4*testClusterSize:testFragmentedInit], testFileContent(4))
+	var list []byte
+	for i := range 3 {
+		list = append(list, testFileContent(i)...)
+	}
+	list = list[:testListSize]
+
+	tests := []struct {
+		path    string
+		content []byte
+	}{
+		{"/resident.txt", testResidentContent},
+		{"/dir/a", []byte{}},
+		{"/fragmented.dat", fragmented},
+		{"/dir/y", list},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unexpected error opening: %v", err)
+			}
+			b, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if !bytes.Equal(b, tt.content) {
+				t.Errorf("read %d bytes that do not match the %d expected", len(b), len(tt.content))
+			}
+			// read from the middle of the file, across runs
+			if len(tt.content) > 2*testClusterSize+10 {
+				if _, err := f.Seek(testClusterSize+10, io.SeekStart); err != nil {
+					t.Fatalf("unexpected error seeking: %v", err)
+				}
+				b = make([]byte, testClusterSize)
+				n, err := f.Read(b)
+				if err != nil || !bytes.Equal(b[:n], tt.content[testClusterSize+10:testClusterSize+10+n]) || n != len(b) {
+					t.Errorf("read %d bytes with error %v that do not match", n, err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Errorf("unexpected error closing: %v", err)
+			}
+			if _, err := f.Read(b); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("error %v instead of %v reading after close", err, os.ErrClosed)
+			}
+		})
+	}
+
+	errorTests := []struct {
+		path string
+		flag int
+		err  string
+	}{
+		{"/dir", os.O_RDONLY, "cannot open directory"},
+		{"/compressed.dat", os.O_RDONLY, "compressed or encrypted"},
+		{"/wof.dat", os.O_RDONLY, "reparse point with tag 0x80000017"},
+		{"/dir/m", os.O_RDONLY, "reparse point with tag 0xa000000c"},
+		{"/missing", os.O_RDONLY, "does not exist"},
+		{"/resident.txt", os.O_RDWR, "read-only filesystem"},
+		{"/new", os.O_CREATE, "read-only filesystem"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := fs.OpenFile(tt.path, tt.flag)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		read   func(fs *FileSystem) error
+		err    string
+	}{
+		{"torn record", func(b []byte) {
+			b[testRecordOffset(testFragmentedRecord)+2*fixupStride-1] ^= 0xff
+		}, func(fs *FileSystem) error {
+			_, err := fs.OpenFile("/fragmented.dat", os.O_RDONLY)
+			return err
+		}, "record 17: update sequence number of sector 1 does not match"},
+		{"record number", func(b []byte) {
+			b[testRecordOffset(testFragmentedRecord)+0x2c] = 99
+		}, func(fs *FileSystem) error {
+			_, err := fs.Stat("/fragmented.dat")
+			return err
+		}, "record has number 99"},
+		{"index block signature", func(b []byte) {
+			copy(b[63*testClusterSize:], "BAAD")
+		}, func(fs *FileSystem) error {
+			_, err := fs.ReadDir("/dir")
+			return err
+		}, "index block 1: invalid signature"},
+		{"index block loop", func(b []byte) {
+			// the index block below the last entry in the root of /dir, which is also below the one before it
+			off := testRecordOffset(testDirRecord)
+			i := bytes.Index(b[off:off+testRecordSize], []byte{0x18, 0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0})
+			b[off+i+8] = 0
+		}, func(fs *FileSystem) error {
+			_, err := fs.ReadDir("/dir")
+			return err
+		}, "index block 0 is in the index more than once"},
+		{"stale reference", func(b []byte) {
+			// the sequence number of /fragmented.dat
+			b[testRecordOffset(testFragmentedRecord)+0x10] = 2
+		}, func(fs *FileSystem) error {
+			_, err := fs.ReadDir("/")
+			return err
+		}, "record 17 has sequence number 2 instead of 1"},
+		{"extension of another record", func(b []byte) {
+			b[testRecordOffset(testListRecord+2)+0x20] = testFragmentedRecord
+		}, func(fs *FileSystem) error {
+			_, err := fs.OpenFile("/dir/y", os.O_RDONLY)
+			return err
+		}, "record 24 is not an extension of record 22"},
+		{"missing segment", func(b []byte) {
+			// the first VCN of the second segment of the data of /dir/y
+			off := testRecordOffset(testListRecord + 2)
+			b[off+0x38+16] = 3
+			b[off+0x38+24] = 3
+		}, func(fs *FileSystem) error {
+			_, err := fs.OpenFile("/dir/y", os.O_RDONLY)
+			return err
+		}, "has a segment at cluster 3 after one that ends at 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := testNTFS(t, tt.modify)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if err := tt.read(fs); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	fs, err := testNTFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	for name, err := range map[string]error{
+		"Mkdir":    fs.Mkdir("/x"),
+		"Mknod":    fs.Mknod("/x", 0, 0),
+		"Link":     fs.Link("/resident.txt", "/x"),
+		"Symlink":  fs.Symlink("/resident.txt", "/x"),
+		"Chmod":    fs.Chmod("/resident.txt", 0o600),
+		"Chown":    fs.Chown("/resident.txt", 1, 1),
+		"Chtimes":  fs.Chtimes("/resident.txt", time.Time{}, time.Time{}),
+		"Rename":   fs.Rename("/resident.txt", "/x"),
+		"Remove":   fs.Remove("/resident.txt"),
+		"SetLabel": fs.SetLabel("x"),
+	} {
+		if !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s: error %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+	f, err := fs.OpenFile("/resident.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("error %v instead of %v writing", err, filesystem.ErrReadonlyFilesystem)
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	fs := testhelper.ReadImage(t, imgFile, Read)
+	if label := fs.Label(); label != "diskfs" {
+		t.Errorf("label %q instead of %q", label, "diskfs")
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	for _, name := range []string{"shortfile.txt", "foo", "random.dat"} {
+		if !found[name] {
+			t.Errorf("root directory does not have %s", name)
+		}
+	}
+	entries, err = fs.ReadDir("/foo")
+	if err != nil {
+		t.Fatalf("error reading /foo: %v", err)
+	}
+	if len(entries) != 1001 {
+		t.Errorf("/foo has %d entries instead of 1001", len(entries))
+	}
+
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("error reading random data file %s: %v", randomDataFile, err)
+	}
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{"/shortfile.txt", []byte("This is a short file\n")},
+		{"/foo/subdirfile.txt", []byte("This is a subdir file\n")},
+		{"/random.dat", randomData},
+	} {
+		f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", tt.path, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", tt.path, err)
+		}
+		if !bytes.Equal(b, tt.content) {
+			t.Errorf("%s has %d bytes that do not match the %d expected", tt.path, len(b), len(tt.content))
+		}
+	}
+}
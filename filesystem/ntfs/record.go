@@ -0,0 +1,343 @@
+package ntfs
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"unicode/utf16"
+)
+
+const (
+	recordMagic = "FILE"
+	indexMagic  = "INDX"
+	// fixupStride the update sequence of a multi-sector record protects the last 2 bytes of every 512 bytes of it,
+	// whatever the size of a sector
+	fixupStride = 512
+	// recordHeaderSize the size of the header of a record of the MFT in NTFS 3.1, which has the number of the record
+	recordHeaderSize = 0x30
+	// refNumberMask the bits of a file reference that are the number of its record; the rest are its sequence number
+	refNumberMask = 1<<48 - 1
+)
+
+// flags of a record of the MFT
+const (
+	recordInUse       uint16 = 0x0001
+	recordIsDirectory uint16 = 0x0002
+)
+
+// the records of the MFT for the files of NTFS itself
+const (
+	recordMFT    = 0
+	recordVolume = 3
+	recordRoot   = 5
+	recordBitmap = 6
+	recordUpcase = 10
+	// recordFirstUser the first record that is not for a file of NTFS itself
+	recordFirstUser = 16
+)
+
+// attribute types
+const (
+	attrStandardInformation uint32 = 0x10
+	attrAttributeList       uint32 = 0x20
+	attrFileName            uint32 = 0x30
+	attrVolumeName          uint32 = 0x60
+	attrVolumeInformation   uint32 = 0x70
+	attrData                uint32 = 0x80
+	attrIndexRoot           uint32 = 0x90
+	attrIndexAllocation     uint32 = 0xa0
+	attrReparsePoint        uint32 = 0xc0
+	attrEnd                 uint32 = 0xffffffff
+)
+
+// flags of an attribute
+const (
+	attrFlagCompressed uint16 = 0x00ff
+	attrFlagEncrypted  uint16 = 0x4000
+)
+
+// record a record of the MFT, with the attributes of its file
+type record struct {
+	number   uint64
+	sequence uint16
+	flags    uint16
+	// base the file reference of the base record, if this is an extension record holding more of its attributes
+	base       uint64
+	attributes []*attribute
+}
+
+// attribute an attribute of a file. The value of a resident one is in the record; otherwise, it is in runs of clusters.
+type attribute struct {
+	typ      uint32
+	name     string
+	flags    uint16
+	resident bool
+	value    []byte
+	// the clusters of a non-resident attribute, starting from startVCN, the virtual cluster number in the value
+	startVCN uint64
+	lastVCN  uint64
+	runs     []run
+	// size and initializedSize the size of the value of a non-resident attribute, and how much of it was written,
+	// beyond which it reads as zeros. They are only in the attribute record with startVCN 0.
+	size            uint64
+	initializedSize uint64
+}
+
+// run a run of clusters of a non-resident attribute; a sparse run has no clusters on disk, and reads as zeros
+type run struct {
+	vcn    uint64
+	lcn    uint64
+	length uint64
+	sparse bool
+}
+
+// dataSize the size of the value of the attribute
+func (a *attribute) dataSize() int64 {
+	if a.resident {
+		return int64(len(a.value))
+	}
+	return int64(a.size)
+}
+
+// attribute the first attribute of the record of the given type and name
+func (r *record) attribute(typ uint32, name string) *attribute {
+	for _, a := range r.attributes {
+		if a.typ == typ && a.name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// isDir whether the record is of a directory, which has an index of file names
+func (r *record) isDir() bool {
+	return r.flags&recordIsDirectory != 0
+}
+
+// decodeName decode a name in UTF-16, as NTFS stores them
+func decodeName(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// applyFixups check that a multi-sector record with the given signature was written whole, from the update sequence
+// number at the end of each 512 bytes of it, and put back the bytes that those numbers replaced
+func applyFixups(b []byte, magic string) error {
+	if string(b[0:4]) != magic {
+		return fmt.Errorf("invalid signature %q instead of %q", b[0:4], magic)
+	}
+	usaOffset := int(binary.LittleEndian.Uint16(b[4:6]))
+	usaCount := int(binary.LittleEndian.Uint16(b[6:8]))
+	if usaCount != len(b)/fixupStride+1 || usaOffset%2 != 0 || usaOffset < 8 || usaOffset+2*usaCount > fixupStride-2 {
+		return fmt.Errorf("invalid update sequence of %d at %d", usaCount, usaOffset)
+	}
+	usn := b[usaOffset : usaOffset+2]
+	for i := 1; i < usaCount; i++ {
+		end := i * fixupStride
+		if !bytes.Equal(b[end-2:end], usn) {
+			return fmt.Errorf("update sequence number of sector %d does not match, it was not written whole", i-1)
+		}
+		copy(b[end-2:end], b[usaOffset+2*i:usaOffset+2*i+2])
+	}
+	return nil
+}
+
+// parseRecord parse the given record of the MFT
+func parseRecord(b []byte, number uint64) (*record, error) {
+	if err := applyFixups(b, recordMagic); err != nil {
+		return nil, err
+	}
+	r := &record{
+		number:   number,
+		sequence: binary.LittleEndian.Uint16(b[0x10:0x12]),
+		flags:    binary.LittleEndian.Uint16(b[0x16:0x18]),
+		base:     binary.LittleEndian.Uint64(b[0x20:0x28]),
+	}
+	attrsOffset := int(binary.LittleEndian.Uint16(b[0x14:0x16]))
+	used := int(binary.LittleEndian.Uint32(b[0x18:0x1c]))
+	if used > len(b) || attrsOffset >= used {
+		return nil, fmt.Errorf("record uses %d bytes from %d of %d", used, attrsOffset, len(b))
+	}
+	// NTFS 3.1 has the number of the record in its header, right before its update sequence
+	if binary.LittleEndian.Uint16(b[4:6]) >= recordHeaderSize {
+		if n := uint64(binary.LittleEndian.Uint32(b[0x2c:0x30])); n != number {
+			return nil, fmt.Errorf("record has number %d", n)
+		}
+	}
+	for off := attrsOffset; ; {
+		if off+4 > used {
+			return nil, fmt.Errorf("attributes at %d run past the end of the record", off)
+		}
+		if binary.LittleEndian.Uint32(b[off:off+4]) == attrEnd {
+			break
+		}
+		if off+16 > used {
+			return nil, fmt.Errorf("attribute at %d runs past the end of the record", off)
+		}
+		length := int(binary.LittleEndian.Uint32(b[off+4 : off+8]))
+		if length < 16 || length%8 != 0 || off+length > used {
+			return nil, fmt.Errorf("attribute at %d has invalid length %d", off, length)
+		}
+		a, err := parseAttribute(b[off : off+length])
+		if err != nil {
+			return nil, fmt.Errorf("attribute at %d: %w", off, err)
+		}
+		r.attributes = append(r.attributes, a)
+		off += length
+	}
+	return r, nil
+}
+
+// parseAttribute parse an attribute, with its header
+func parseAttribute(b []byte) (*attribute, error) {
+	a := &attribute{
+		typ:      binary.LittleEndian.Uint32(b[0:4]),
+		resident: b[8] == 0,
+		flags:    binary.LittleEndian.Uint16(b[12:14]),
+	}
+	nameLength, nameOffset := int(b[9]), int(binary.LittleEndian.Uint16(b[10:12]))
+	if nameOffset+2*nameLength > len(b) {
+		return nil, fmt.Errorf("name of %d characters at %d is beyond the end of the attribute", nameLength, nameOffset)
+	}
+	a.name = decodeName(b[nameOffset : nameOffset+2*nameLength])
+	if a.resident {
+		if len(b) < 24 {
+			return nil, fmt.Errorf("resident attribute of %d bytes", len(b))
+		}
+		valueLength := int(binary.LittleEndian.Uint32(b[16:20]))
+		valueOffset := int(binary.LittleEndian.Uint16(b[20:22]))
+		if valueOffset+valueLength > len(b) {
+			return nil, fmt.Errorf("value of %d bytes at %d is beyond the end of the attribute", valueLength, valueOffset)
+		}
+		a.value = b[valueOffset : valueOffset+valueLength]
+		return a, nil
+	}
+	if len(b) < 64 {
+		return nil, fmt.Errorf("non-resident attribute of %d bytes", len(b))
+	}
+	a.startVCN = binary.LittleEndian.Uint64(b[16:24])
+	a.lastVCN = binary.LittleEndian.Uint64(b[24:32])
+	a.size = binary.LittleEndian.Uint64(b[48:56])
+	a.initializedSize = binary.LittleEndian.Uint64(b[56:64])
+	runsOffset := int(binary.LittleEndian.Uint16(b[32:34]))
+	if runsOffset < 64 || runsOffset > len(b) {
+		return nil, fmt.Errorf("data runs at %d are beyond the end of the attribute", runsOffset)
+	}
+	runs, err := parseRuns(b[runsOffset:], a.startVCN)
+	if err != nil {
+		return nil, err
+	}
+	// an attribute without clusters, which is empty, has a last VCN of -1
+	if end := a.startVCN + totalLength(runs); end != a.lastVCN+1 {
+		return nil, fmt.Errorf("data runs end at cluster %d instead of %d", end, a.lastVCN+1)
+	}
+	a.runs = runs
+	return a, nil
+}
+
+// totalLength the number of clusters in the runs
+func totalLength(runs []run) uint64 {
+	var n uint64
+	for _, r := range runs {
+		n += r.length
+	}
+	return n
+}
+
+// parseRuns parse the mapping pairs of a non-resident attribute, each of which has the length of a run and where it
+// starts, relative to the start of the one before it
+func parseRuns(b []byte, vcn uint64) ([]run, error) {
+	var (
+		runs []run
+		lcn  int64
+	)
+	for i := 0; ; {
+		if i >= len(b) {
+			return nil, fmt.Errorf("data runs have no end")
+		}
+		if b[i] == 0 {
+			return runs, nil
+		}
+		lengthSize, offsetSize := int(b[i]&0x0f), int(b[i]>>4)
+		i++
+		if lengthSize == 0 || lengthSize > 8 || offsetSize > 8 || i+lengthSize+offsetSize > len(b) {
+			return nil, fmt.Errorf("invalid data run header %#02x", b[i-1])
+		}
+		var length uint64
+		for j := lengthSize - 1; j >= 0; j-- {
+			length = length<<8 | uint64(b[i+j])
+		}
+		i += lengthSize
+		r := run{vcn: vcn, length: length}
+		// a run without an offset is sparse
+		if offsetSize == 0 {
+			r.sparse = true
+		} else {
+			// the offset is signed, so sign extend from its most significant byte
+			delta := int64(int8(b[i+offsetSize-1]))
+			for j := offsetSize - 2; j >= 0; j-- {
+				delta = delta<<8 | int64(b[i+j])
+			}
+			lcn += delta
+			if lcn < 0 {
+				return nil, fmt.Errorf("data run starts at cluster %d", lcn)
+			}
+			r.lcn = uint64(lcn)
+		}
+		i += offsetSize
+		runs = append(runs, r)
+		vcn += length
+	}
+}
+
+// mergeAttributes put together the records of each non-resident attribute, which has its runs split among records
+// when they do not all fit in one
+func mergeAttributes(attrs []*attribute) ([]*attribute, error) {
+	type key struct {
+		typ  uint32
+		name string
+	}
+	var (
+		merged   []*attribute
+		segments = map[key][]*attribute{}
+	)
+	for _, a := range attrs {
+		if a.resident {
+			merged = append(merged, a)
+			continue
+		}
+		k := key{a.typ, a.name}
+		if _, ok := segments[k]; !ok {
+			merged = append(merged, a)
+		}
+		segments[k] = append(segments[k], a)
+	}
+	for i, a := range merged {
+		if a.resident {
+			continue
+		}
+		segs := segments[key{a.typ, a.name}]
+		slices.SortFunc(segs, func(x, y *attribute) int {
+			return cmp.Compare(x.startVCN, y.startVCN)
+		})
+		if segs[0].startVCN != 0 {
+			return nil, fmt.Errorf("attribute %#x %q does not start at cluster 0", a.typ, a.name)
+		}
+		whole := *segs[0]
+		whole.runs = slices.Clone(whole.runs)
+		for _, seg := range segs[1:] {
+			if seg.startVCN != whole.lastVCN+1 {
+				return nil, fmt.Errorf("attribute %#x %q has a segment at cluster %d after one that ends at %d", a.typ, a.name, seg.startVCN, whole.lastVCN)
+			}
+			whole.runs = append(whole.runs, seg.runs...)
+			whole.lastVCN = seg.lastVCN
+		}
+		merged[i] = &whole
+	}
+	return merged, nil
+}
@@ -0,0 +1,24 @@
+#!/bin/sh
+set -e
+mkdir -p dist
+cat << "EOF" | docker run -i --rm -v $PWD/dist:/data -w /data --privileged alpine:3.20
+set -e
+set -x
+apk --update add ntfs-3g ntfs-3g-progs
+dd if=/dev/zero of=ntfs.img bs=1M count=20
+mkntfs --force --quick --label diskfs ntfs.img
+ntfs-3g ntfs.img /mnt
+cd /mnt
+mkdir foo
+echo "This is a short file" > shortfile.txt
+echo "This is a subdir file" > foo/subdirfile.txt
+# enough entries that the index of /foo needs index blocks
+set +x
+i=0; until [ $i -ge 1000 ]; do touch foo/file${i}; i=$(( $i+1 )); done
+set -x
+# a file with known content
+dd if=/dev/random of=/data/random.dat bs=1024 count=20
+cp /data/random.dat random.dat
+cd /data
+umount /mnt
+EOF
@@ -0,0 +1,23 @@
+package ntfs
+
+import "unicode/utf16"
+
+// upcaseTableSize the number of UTF-16 code units that the up-case table maps
+const upcaseTableSize = 1 << 16
+
+// upcaseTable maps every UTF-16 code unit to its upper case, which is what NTFS compares and sorts names with
+type upcaseTable []uint16
+
+// equal whether two names are the same in upper case
+func (t upcaseTable) equal(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	if len(ua) != len(ub) {
+		return false
+	}
+	for i := range ua {
+		if t[ua[i]] != t[ub[i]] {
+			return false
+		}
+	}
+	return true
+}
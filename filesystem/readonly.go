@@ -0,0 +1,142 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// openWriteFlags the flags of OpenFile that would change a file, or create one
+const openWriteFlags = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC | os.O_EXCL
+
+// readOnlyFS a FileSystem that rejects every call that would change it
+type readOnlyFS struct {
+	fs FileSystem
+}
+
+// ReadOnly wrap fs so that every call that would change it, including opening a file with any of the flags
+// for writing, and writing to a file that was opened, fails with ErrReadonlyFilesystem, while the rest are
+// passed through to fs. It is meant for passing a filesystem, e.g. of a golden image, to code that must not
+// change it, however the filesystem itself was opened. Beyond the methods of FileSystem, the wrapper has those of
+// UsageReporter and LinkReader, passed through where fs has them, and of TimesChanger, which fails; any other
+// methods of fs are not available from it.
+func ReadOnly(fs FileSystem) FileSystem {
+	if ro, ok := fs.(*readOnlyFS); ok {
+		return ro
+	}
+	return &readOnlyFS{fs: fs}
+}
+
+func (r *readOnlyFS) Type() Type {
+	return r.fs.Type()
+}
+
+func (r *readOnlyFS) Mkdir(string) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Mknod(string, uint32, int) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Link(string, string) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Symlink(string, string) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Chmod(string, os.FileMode) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Chown(string, int, int) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Chtimes(string, time.Time, time.Time) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Readlink(name string) (string, error) {
+	return Readlink(r.fs, name)
+}
+
+func (r *readOnlyFS) ReadDir(pathname string) ([]os.FileInfo, error) {
+	return r.fs.ReadDir(pathname)
+}
+
+func (r *readOnlyFS) OpenFile(pathname string, flag int) (File, error) {
+	if flag&openWriteFlags != 0 {
+		return nil, ErrReadonlyFilesystem
+	}
+	f, err := r.fs.OpenFile(pathname, flag)
+	if err != nil {
+		return nil, err
+	}
+	// keep ReadAt for those that use it when the file has it
+	if ra, ok := f.(io.ReaderAt); ok {
+		return &readOnlyFileAt{readOnlyFile: readOnlyFile{f}, ra: ra}, nil
+	}
+	return &readOnlyFile{f}, nil
+}
+
+func (r *readOnlyFS) Rename(string, string) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Remove(string) error {
+	return ErrReadonlyFilesystem
+}
+
+func (r *readOnlyFS) Label() string {
+	return r.fs.Label()
+}
+
+func (r *readOnlyFS) SetLabel(string) error {
+	return ErrReadonlyFilesystem
+}
+
+// UUID the UUID of the wrapped filesystem, if it is a UsageReporter, else ""
+func (r *readOnlyFS) UUID() string {
+	uuid, _ := identity(r.fs)
+	return uuid
+}
+
+// Usage the usage of the wrapped filesystem, if it is a UsageReporter, else none
+func (r *readOnlyFS) Usage() Usage {
+	_, usage := identity(r.fs)
+	return usage
+}
+
+// readOnlyFile a File of a read-only filesystem, which rejects writes
+type readOnlyFile struct {
+	f File
+}
+
+func (f *readOnlyFile) Read(b []byte) (int, error) {
+	return f.f.Read(b)
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *readOnlyFile) Write([]byte) (int, error) {
+	return 0, ErrReadonlyFilesystem
+}
+
+func (f *readOnlyFile) Close() error {
+	return f.f.Close()
+}
+
+// readOnlyFileAt a readOnlyFile of a File that also reads at an offset
+type readOnlyFileAt struct {
+	readOnlyFile
+	ra io.ReaderAt
+}
+
+func (f *readOnlyFileAt) ReadAt(b []byte, off int64) (int, error) {
+	return f.ra.ReadAt(b, off)
+}
@@ -0,0 +1,88 @@
+package filesystem_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+func TestReadOnly(t *testing.T) {
+	fs := createFat32(t, "GOLDEN")
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	content := []byte("golden content")
+	rw, err := fs.OpenFile("/dir/file.txt", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if _, err := rw.Write(content); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	ro := filesystem.ReadOnly(fs)
+	if filesystem.ReadOnly(ro) != ro {
+		t.Errorf("wrapping a read-only filesystem again wrapped it twice")
+	}
+	if ro.Type() != filesystem.TypeFat32 || ro.Label() != fs.Label() || ro.(filesystem.UsageReporter).UUID() != fs.UUID() ||
+		ro.(filesystem.UsageReporter).Usage() != fs.Usage() {
+		t.Errorf("read-only filesystem did not pass through its metadata")
+	}
+	for name, call := range map[string]func() error{
+		"Mkdir":    func() error { return ro.Mkdir("/other") },
+		"Mknod":    func() error { return ro.Mknod("/node", 0o644, 0) },
+		"Link":     func() error { return ro.Link("/dir/file.txt", "/link") },
+		"Symlink":  func() error { return ro.Symlink("/dir/file.txt", "/symlink") },
+		"Chmod":    func() error { return ro.Chmod("/dir/file.txt", 0o600) },
+		"Chown":    func() error { return ro.Chown("/dir/file.txt", 1, 1) },
+		"Chtimes":  func() error { return filesystem.Chtimes(ro, "/dir/file.txt", time.Now(), time.Now()) },
+		"Rename":   func() error { return ro.Rename("/dir/file.txt", "/moved.txt") },
+		"Remove":   func() error { return ro.Remove("/dir/file.txt") },
+		"SetLabel": func() error { return ro.SetLabel("CHANGED") },
+	} {
+		if err := call(); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s returned %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_CREATE, os.O_RDONLY | os.O_TRUNC, os.O_RDONLY | os.O_APPEND} {
+		if _, err := ro.OpenFile("/dir/file.txt", flag); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("OpenFile with flag %#x returned %v instead of %v", flag, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+
+	roFile, err := ro.OpenFile("/dir/file.txt", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer roFile.Close()
+	if _, err := roFile.Write([]byte("changed")); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("write to file returned %v instead of %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+	read, err := io.ReadAll(roFile)
+	if err != nil {
+		t.Fatalf("error reading file: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Errorf("read %q instead of %q", read, content)
+	}
+	expected, err := fs.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	entries, err := ro.ReadDir("/dir")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	if len(entries) != len(expected) || !slices.ContainsFunc(entries, func(e os.FileInfo) bool { return e.Name() == "file.txt" }) {
+		t.Errorf("read-only filesystem did not list the directory")
+	}
+	if fs.Label() != "GOLDEN" {
+		t.Errorf("label of filesystem changed to %q", fs.Label())
+	}
+}
@@ -0,0 +1,164 @@
+package filesystem
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// snapshotVersion the version of the format of a snapshot, which changes whenever a field of Snapshot or
+// SnapshotEntry does, so that a cached snapshot from an older version is not read as if it were current
+const snapshotVersion = 1
+
+// SnapshotEntry a single entry of a directory in a snapshot, with the metadata that ReadDir returns for it
+type SnapshotEntry struct {
+	Name    string        `json:"name"`
+	Size    int64         `json:"size"`
+	Mode    iofs.FileMode `json:"mode"`
+	ModTime time.Time     `json:"modTime"`
+}
+
+// Snapshot the directory structure of a filesystem and the metadata of everything in it, which can be saved with
+// Encode, or as JSON, and loaded again, e.g. by a service that lists the contents of the same large read-only image
+// every time it starts, so that it does not have to parse the metadata of the image each time. It only holds what
+// ReadDir returns, not the contents of any file, nor the filesystem specific Sys() of each entry.
+type Snapshot struct {
+	Version int    `json:"version"`
+	Type    Type   `json:"type"`
+	Label   string `json:"label"`
+	UUID    string `json:"uuid"`
+	Usage   Usage  `json:"usage"`
+	// Directories the entries of every directory, sorted by name, keyed by the cleaned path of the directory,
+	// with the root of the snapshot as "/"
+	Directories map[string][]SnapshotEntry `json:"directories"`
+}
+
+// TakeSnapshot read the directory structure of everything under the directory root of the filesystem fs, with
+// root as the root of the snapshot
+func TakeSnapshot(fs FileSystem, root string) (*Snapshot, error) {
+	root = path.Clean("/" + root)
+	s := &Snapshot{
+		Version:     snapshotVersion,
+		Type:        fs.Type(),
+		Label:       fs.Label(),
+		Directories: map[string][]SnapshotEntry{},
+	}
+	s.UUID, s.Usage = identity(fs)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		infos, err := fs.ReadDir(path.Join(root, dir))
+		if err != nil {
+			return err
+		}
+		entries := make([]SnapshotEntry, 0, len(infos))
+		for _, info := range infos {
+			if info.Name() == "." || info.Name() == ".." {
+				continue
+			}
+			mode := info.Mode()
+			if info.IsDir() {
+				mode |= iofs.ModeDir
+			}
+			entries = append(entries, SnapshotEntry{Name: info.Name(), Size: info.Size(), Mode: mode, ModTime: info.ModTime()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+		s.Directories[dir] = entries
+		for _, e := range entries {
+			if e.Mode.IsDir() {
+				if err := walk(path.Join(dir, e.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, fmt.Errorf("unable to take snapshot of %s: %w", root, err)
+	}
+	return s, nil
+}
+
+// Encode write the snapshot to w in the compact binary format of encoding/gob, to be read again with ReadSnapshot
+func (s *Snapshot) Encode(w io.Writer) error {
+	if err := gob.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("unable to encode snapshot: %w", err)
+	}
+	return nil
+}
+
+// ReadSnapshot read a snapshot that was written with Encode
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var s Snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("unable to decode snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot has version %d instead of %d", s.Version, snapshotVersion)
+	}
+	return &s, nil
+}
+
+// Matches whether the snapshot is likely to be of the filesystem fs as it is now, by comparing its type, label,
+// UUID and usage. It does not read any directory, so it does not notice a change that keeps the same usage, such as
+// a rename; it is meant to catch a cached snapshot of a different image, not changes to an image.
+func (s *Snapshot) Matches(fs FileSystem) bool {
+	uuid, usage := identity(fs)
+	return s.Type == fs.Type() && s.Label == fs.Label() && s.UUID == uuid && s.Usage == usage
+}
+
+// identity the UUID and usage of fs, if it is a UsageReporter, else none
+func identity(fs FileSystem) (string, Usage) {
+	if u, ok := fs.(UsageReporter); ok {
+		return u.UUID(), u.Usage()
+	}
+	return "", Usage{}
+}
+
+// ReadDir read the contents of a directory in the snapshot, as ReadDir of the filesystem returned them when the
+// snapshot was taken, except that they are sorted by name, and do not include . and ..
+func (s *Snapshot) ReadDir(pathname string) ([]os.FileInfo, error) {
+	entries, ok := s.Directories[path.Clean("/"+pathname)]
+	if !ok {
+		return nil, &iofs.PathError{Op: "readdir", Path: pathname, Err: iofs.ErrNotExist}
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, snapshotFileInfo{e})
+	}
+	return infos, nil
+}
+
+// Stat get the metadata of anything in the snapshot. Names are matched exactly, even if the filesystem itself
+// ignores their case.
+func (s *Snapshot) Stat(pathname string) (os.FileInfo, error) {
+	p := path.Clean("/" + pathname)
+	if p == "/" {
+		if _, ok := s.Directories[p]; ok {
+			return snapshotFileInfo{SnapshotEntry{Name: "/", Mode: iofs.ModeDir}}, nil
+		}
+	}
+	entries := s.Directories[path.Dir(p)]
+	name := path.Base(p)
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name >= name })
+	if i == len(entries) || entries[i].Name != name {
+		return nil, &iofs.PathError{Op: "stat", Path: pathname, Err: iofs.ErrNotExist}
+	}
+	return snapshotFileInfo{entries[i]}, nil
+}
+
+// snapshotFileInfo an entry of a snapshot as an os.FileInfo
+type snapshotFileInfo struct {
+	entry SnapshotEntry
+}
+
+func (fi snapshotFileInfo) Name() string       { return fi.entry.Name }
+func (fi snapshotFileInfo) Size() int64        { return fi.entry.Size }
+func (fi snapshotFileInfo) Mode() os.FileMode  { return fi.entry.Mode }
+func (fi snapshotFileInfo) ModTime() time.Time { return fi.entry.ModTime }
+func (fi snapshotFileInfo) IsDir() bool        { return fi.entry.Mode.IsDir() }
+func (fi snapshotFileInfo) Sys() any           { return nil }
@@ -0,0 +1,101 @@
+package filesystem_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+func TestSnapshot(t *testing.T) {
+	fs := createFat32(t, "SNAPSHOT")
+	if err := fs.Mkdir("/boot/efi"); err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	for p, size := range map[string]int{"/boot/efi/grub.cfg": 14, "/boot/vmlinuz": 100000} {
+		rw, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("error creating file %s: %v", p, err)
+		}
+		if _, err := rw.Write(make([]byte, size)); err != nil {
+			t.Fatalf("error writing file %s: %v", p, err)
+		}
+	}
+
+	snapshot, err := filesystem.TakeSnapshot(fs, "/")
+	if err != nil {
+		t.Fatalf("error taking snapshot: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := snapshot.Encode(&buf); err != nil {
+		t.Fatalf("error encoding snapshot: %v", err)
+	}
+	loaded, err := filesystem.ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("error reading snapshot: %v", err)
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("error marshaling snapshot: %v", err)
+	}
+	var fromJSON filesystem.Snapshot
+	if err := json.Unmarshal(b, &fromJSON); err != nil {
+		t.Fatalf("error unmarshaling snapshot: %v", err)
+	}
+
+	for _, s := range []*filesystem.Snapshot{loaded, &fromJSON} {
+		if !s.Matches(fs) {
+			t.Errorf("snapshot does not match the filesystem it was taken of")
+		}
+		for _, dir := range []string{"/", "/boot", "/boot/efi"} {
+			expected, err := fs.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("error reading directory %s: %v", dir, err)
+			}
+			actual, err := s.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("error reading directory %s of snapshot: %v", dir, err)
+			}
+			// the snapshot leaves out . and ..
+			expected = slices.DeleteFunc(expected, func(e os.FileInfo) bool { return e.Name() == "." || e.Name() == ".." })
+			if len(actual) != len(expected) {
+				t.Errorf("directory %s of snapshot has %d entries instead of %d", dir, len(actual), len(expected))
+				continue
+			}
+			for _, e := range expected {
+				a, err := s.Stat(path.Join(dir, e.Name()))
+				if err != nil {
+					t.Errorf("error getting %s of snapshot: %v", e.Name(), err)
+					continue
+				}
+				if a.Name() != e.Name() || a.Size() != e.Size() || a.IsDir() != e.IsDir() || !a.ModTime().Equal(e.ModTime()) {
+					t.Errorf("%s of snapshot is %s, size %d, directory %v, modified %v instead of %s, %d, %v, %v", e.Name(), a.Name(), a.Size(), a.IsDir(), a.ModTime(), e.Name(), e.Size(), e.IsDir(), e.ModTime())
+				}
+			}
+		}
+		if fi, err := s.Stat("/"); err != nil || !fi.IsDir() {
+			t.Errorf("root of snapshot is not a directory: %v", err)
+		}
+		if _, err := s.ReadDir("/missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("reading missing directory of snapshot returned %v instead of not existing", err)
+		}
+		if _, err := s.Stat("/boot/missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("getting missing file of snapshot returned %v instead of not existing", err)
+		}
+	}
+
+	if err := fs.Remove("/boot/efi/grub.cfg"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if loaded.Matches(fs) {
+		t.Errorf("snapshot still matches the filesystem after it changed")
+	}
+	if _, err := filesystem.ReadSnapshot(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Errorf("reading invalid snapshot did not return an error")
+	}
+}
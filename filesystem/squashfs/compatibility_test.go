@@ -0,0 +1,52 @@
+package squashfs
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+func TestSquashfsFSCompatibility(t *testing.T) {
+	f, err := os.Open(Squashfsfile)
+	if err != nil {
+		t.Fatalf("Failed to read squashfs testfile: %v", err)
+	}
+	defer f.Close()
+
+	b := file.New(f, true)
+	sqs, err := Read(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("squashfs read: %s", err)
+	}
+
+	fsys := filesystem.FS(sqs)
+	// goodlink links to README.md, and is read through
+	readme, err := fs.ReadFile(fsys, "README.md")
+	if err != nil {
+		t.Fatalf("cannot read README.md: %v", err)
+	}
+	link, err := fs.ReadFile(fsys, "goodlink")
+	if err != nil {
+		t.Fatalf("cannot read through symlink: %v", err)
+	}
+	if !bytes.Equal(link, readme) {
+		t.Errorf("reading through symlink gave different contents")
+	}
+	if _, err := fs.Stat(fsys, "emptylink"); err == nil {
+		t.Errorf("no error for a symlink to a file that does not exist")
+	}
+
+	// the whole image has emptylink, which cannot be opened, as with os.DirFS, so check a directory without it
+	sub, err := fs.Sub(fsys, "a")
+	if err != nil {
+		t.Fatalf("cannot get sub filesystem: %v", err)
+	}
+	if err := fstest.TestFS(sub, "b/c/d"); err != nil {
+		t.Errorf("not a valid fs.FS: %v", err)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
+	"github.com/diskfs/go-diskfs/filesystem/squashfs/lzo"
 	"github.com/klauspost/compress/zstd"
 	lz4 "github.com/pierrec/lz4/v4"
 	"github.com/ulikunitz/xz"
@@ -22,6 +24,16 @@ type Compressor interface {
 	flavour() compression
 }
 
+// anySet whether any of the flags in m is set
+func anySet[K comparable](m map[K]bool) bool {
+	for _, set := range m {
+		if set {
+			return true
+		}
+	}
+	return false
+}
+
 // CompressorLzma lzma compression
 type CompressorLzma struct {
 }
@@ -133,7 +145,12 @@ func (c *CompressorGzip) loadOptions(b []byte) error {
 	c.Strategies = strategies
 	return nil
 }
+
+// optionsBytes the gzip options, which are left out if none is set
 func (c *CompressorGzip) optionsBytes() []byte {
+	if c.CompressionLevel == 0 && c.WindowSize == 0 && !anySet(c.Strategies) {
+		return nil
+	}
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint32(b[0:4], c.CompressionLevel)
 	binary.LittleEndian.PutUint16(b[4:6], c.WindowSize)
@@ -214,7 +231,12 @@ func (c *CompressorXz) loadOptions(b []byte) error {
 	c.ExecutableFilters = filters
 	return nil
 }
+
+// optionsBytes the xz options, which are left out if none is set
 func (c *CompressorXz) optionsBytes() []byte {
+	if c.DictionarySize == 0 && !anySet(c.ExecutableFilters) {
+		return nil
+	}
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint32(b[0:4], c.DictionarySize)
 	var flags uint32
@@ -240,31 +262,57 @@ const (
 	lz4version1 uint32 = 1
 )
 
-// CompressorLz4 lz4 compression
+// CompressorLz4 lz4 compression, of each block on its own in the lz4 block format, as mksquashfs does
 type CompressorLz4 struct {
-	version uint32
-	flags   map[lz4Flag]bool
+	// HighCompression compress with the slower lz4hc, which compresses more
+	HighCompression bool
 }
 
 func (c *CompressorLz4) compress(in []byte) ([]byte, error) {
-	var b bytes.Buffer
-	lz := lz4.NewWriter(&b)
-	if _, err := lz.Write(in); err != nil {
-		return nil, err
+	out := make([]byte, lz4.CompressBlockBound(len(in)))
+	var (
+		n   int
+		err error
+	)
+	if c.HighCompression {
+		n, err = lz4.CompressBlockHC(in, out, lz4.Level9, nil, nil)
+	} else {
+		n, err = lz4.CompressBlock(in, out, nil)
 	}
-	if err := lz.Close(); err != nil {
-		return nil, err
+	if err != nil {
+		return nil, fmt.Errorf("error compressing: %v", err)
 	}
-	return b.Bytes(), nil
+	if n == 0 {
+		// incompressible, which the block format holds as one run of literals
+		return lz4Literals(in), nil
+	}
+	return out[:n], nil
 }
+
+// lz4Literals the lz4 block that holds in as literals
+func lz4Literals(in []byte) []byte {
+	out := make([]byte, 0, len(in)+len(in)/255+16)
+	if len(in) < 15 {
+		out = append(out, byte(len(in))<<4)
+	} else {
+		out = append(out, 0xf0)
+		n := len(in) - 15
+		for ; n >= 255; n -= 255 {
+			out = append(out, 255)
+		}
+		out = append(out, byte(n))
+	}
+	return append(out, in...)
+}
+
 func (c *CompressorLz4) decompress(in []byte) ([]byte, error) {
-	b := bytes.NewReader(in)
-	lz := lz4.NewReader(b)
-	p, err := io.ReadAll(lz)
+	// the block does not say how large it is uncompressed, but no block is larger than the largest block size
+	out := make([]byte, maxBlocksize)
+	n, err := lz4.UncompressBlock(in, out)
 	if err != nil {
 		return nil, fmt.Errorf("error decompressing: %v", err)
 	}
-	return p, nil
+	return out[:n], nil
 }
 func (c *CompressorLz4) loadOptions(b []byte) error {
 	expected := 8
@@ -275,25 +323,21 @@ func (c *CompressorLz4) loadOptions(b []byte) error {
 	if version != lz4version1 {
 		return fmt.Errorf("compressed with lz4 version %d, only support %d", version, lz4version1)
 	}
-	c.version = version
-	flagMap := map[lz4Flag]bool{}
 	flags := binary.LittleEndian.Uint32(b[4:8])
-	for _, f := range []lz4Flag{lz4HighCompression} {
-		if flags&uint32(f) == uint32(f) {
-			flagMap[f] = true
-		}
+	if flags&^uint32(lz4HighCompression) != 0 {
+		return fmt.Errorf("unknown lz4 flags %#x", flags)
 	}
-	c.flags = flagMap
+	c.HighCompression = flags&uint32(lz4HighCompression) != 0
 	return nil
 }
+
+// optionsBytes the lz4 options, which mksquashfs always writes, and the kernel requires
 func (c *CompressorLz4) optionsBytes() []byte {
 	b := make([]byte, 8)
-	binary.LittleEndian.PutUint32(b[0:4], c.version)
+	binary.LittleEndian.PutUint32(b[0:4], lz4version1)
 	var flags uint32
-	for _, f := range []lz4Flag{lz4HighCompression} {
-		if c.flags[f] {
-			flags |= uint32(f)
-		}
+	if c.HighCompression {
+		flags |= uint32(lz4HighCompression)
 	}
 	binary.LittleEndian.PutUint32(b[4:8], flags)
 	return b
@@ -304,12 +348,14 @@ func (c *CompressorLz4) flavour() compression {
 
 // CompressorZstd zstd compression
 type CompressorZstd struct {
-	level uint32
+	// CompressionLevel from 1 to 22; 0 is the default of mksquashfs, 15
+	CompressionLevel uint32
 }
 
 const (
-	zstdMinLevel uint32 = 1
-	zstdMaxLevel uint32 = 22
+	zstdMinLevel     uint32 = 1
+	zstdMaxLevel     uint32 = 22
+	zstdDefaultLevel uint32 = 15
 )
 
 func (c *CompressorZstd) loadOptions(b []byte) error {
@@ -319,35 +365,45 @@ func (c *CompressorZstd) loadOptions(b []byte) error {
 	}
 	level := binary.LittleEndian.Uint32(b[0:4])
 	if level < zstdMinLevel || level > zstdMaxLevel {
-		return fmt.Errorf("zstd compression level requested %d, must be at least %d and not more thann %d", level, zstdMinLevel, zstdMaxLevel)
+		return fmt.Errorf("zstd compression level requested %d, must be at least %d and not more than %d", level, zstdMinLevel, zstdMaxLevel)
 	}
-	c.level = level
+	c.CompressionLevel = level
 	return nil
 }
+
+// optionsBytes the zstd options, which are left out for the default level, as mksquashfs does
 func (c *CompressorZstd) optionsBytes() []byte {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b[0:4], c.level)
-	return b
+	if level := c.level(); level != zstdDefaultLevel {
+		return binary.LittleEndian.AppendUint32(nil, level)
+	}
+	return nil
 }
 func (c *CompressorZstd) flavour() compression {
 	return compressionZstd
 }
+
+// level the compression level, with the default for 0
+func (c *CompressorZstd) level() uint32 {
+	if c.CompressionLevel == 0 {
+		return zstdDefaultLevel
+	}
+	return c.CompressionLevel
+}
 func (c *CompressorZstd) compress(in []byte) ([]byte, error) {
-	var b bytes.Buffer
-	z, err := zstd.NewWriter(&b)
+	if level := c.level(); level < zstdMinLevel || level > zstdMaxLevel {
+		return nil, fmt.Errorf("zstd compression level %d, must be at least %d and not more than %d", level, zstdMinLevel, zstdMaxLevel)
+	}
+	z, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(int(c.level()))), zstd.WithEncoderConcurrency(1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd compressor: %w", err)
 	}
-	if _, err := z.Write(in); err != nil {
-		return nil, err
-	}
-	if err := z.Close(); err != nil {
-		return nil, err
-	}
-	return b.Bytes(), nil
+	defer z.Close()
+	// a single frame that holds its size, with a window no larger than the block, as the kernel only
+	// has room to decompress that
+	return z.EncodeAll(in, nil), nil
 }
 func (c *CompressorZstd) decompress(in []byte) ([]byte, error) {
-	z, err := zstd.NewReader(nil)
+	z, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zstd decompressor: %w", err)
 	}
@@ -359,6 +415,125 @@ func (c *CompressorZstd) decompress(in []byte) ([]byte, error) {
 	return p, nil
 }
 
+// lzo algorithms that mksquashfs can use
+type lzoAlgorithm uint32
+
+const (
+	lzoAlgorithm1x1   lzoAlgorithm = 0
+	lzoAlgorithm1x999 lzoAlgorithm = 4
+)
+
+const (
+	lzoDefaultLevel uint32 = 8
+	lzoMaxLevel     uint32 = 9
+)
+
+// CompressorLzo lzo compression. Every lzo algorithm gives data in the same format, which is all that reading
+// needs, so images are written as with the default of mksquashfs, LZO1X-999 at level 8, whatever the compression.
+type CompressorLzo struct {
+	// algorithm and level in the options of an image that was read, if any
+	algorithm lzoAlgorithm
+	level     uint32
+}
+
+func (c *CompressorLzo) compress(in []byte) ([]byte, error) {
+	return lzo.Compress(in), nil
+}
+func (c *CompressorLzo) decompress(in []byte) ([]byte, error) {
+	p, err := lzo.Decompress(in, int(maxBlocksize))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing: %v", err)
+	}
+	return p, nil
+}
+func (c *CompressorLzo) loadOptions(b []byte) error {
+	expected := 8
+	if len(b) != expected {
+		return fmt.Errorf("cannot parse lzo options, received %d bytes expected %d", len(b), expected)
+	}
+	algorithm := lzoAlgorithm(binary.LittleEndian.Uint32(b[0:4]))
+	level := binary.LittleEndian.Uint32(b[4:8])
+	switch {
+	case algorithm > lzoAlgorithm1x999:
+		return fmt.Errorf("unknown lzo algorithm %d", algorithm)
+	case algorithm == lzoAlgorithm1x999 && (level < 1 || level > lzoMaxLevel):
+		return fmt.Errorf("lzo compression level %d, must be at least 1 and not more than %d", level, lzoMaxLevel)
+	case algorithm != lzoAlgorithm1x999 && level != 0:
+		return fmt.Errorf("lzo compression level %d, only LZO1X-999 has levels", level)
+	}
+	c.algorithm = algorithm
+	c.level = level
+	return nil
+}
+
+// optionsBytes the lzo options, which are left out for the defaults, as mksquashfs does
+func (c *CompressorLzo) optionsBytes() []byte {
+	if (c.algorithm == lzoAlgorithm1x1 && c.level == 0) || (c.algorithm == lzoAlgorithm1x999 && c.level == lzoDefaultLevel) {
+		return nil
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(c.algorithm))
+	binary.LittleEndian.PutUint32(b[4:8], c.level)
+	return b
+}
+func (c *CompressorLzo) flavour() compression {
+	return compressionLzo
+}
+
+// Decompressor decompresses blocks compressed with one type of compression. The pure Go decompressors of
+// this package are used by default; use RegisterDecompressor to replace one of them, e.g. with zlib-ng or
+// libdeflate through cgo, or with a hardware accelerator.
+//
+// A Decompressor may be called from more than one goroutine at once, so must be safe for concurrent use.
+type Decompressor interface {
+	// Decompress return the uncompressed contents of a single compressed block
+	Decompress(in []byte) ([]byte, error)
+}
+
+// DecompressorFunc an ordinary function that is a Decompressor
+type DecompressorFunc func(in []byte) ([]byte, error)
+
+// Decompress call f(in)
+func (f DecompressorFunc) Decompress(in []byte) ([]byte, error) {
+	return f(in)
+}
+
+var (
+	decompressorsLock sync.RWMutex
+	decompressors     = map[compression]Decompressor{}
+)
+
+// RegisterDecompressor use d to decompress filesystems compressed the same way as c, e.g. pass
+// &CompressorGzip{} for gzip. It applies to filesystems read after it is called. Passing a nil d
+// goes back to the default decompressor.
+// For gzip, d is given a zlib stream, as that is how squashfs stores it.
+func RegisterDecompressor(c Compressor, d Decompressor) {
+	decompressorsLock.Lock()
+	defer decompressorsLock.Unlock()
+	if d == nil {
+		delete(decompressors, c.flavour())
+		return
+	}
+	decompressors[c.flavour()] = d
+}
+
+// registeredDecompressor the Decompressor registered for a type of compression, if any
+func registeredDecompressor(flavour compression) Decompressor {
+	decompressorsLock.RLock()
+	defer decompressorsLock.RUnlock()
+	return decompressors[flavour]
+}
+
+// pluggableCompressor a Compressor whose decompression is replaced by a registered Decompressor
+type pluggableCompressor struct {
+	Compressor
+	decompressor Decompressor
+}
+
+func (c *pluggableCompressor) decompress(in []byte) ([]byte, error) {
+	return c.decompressor.Decompress(in)
+}
+
 func newCompressor(flavour compression) (Compressor, error) {
 	var c Compressor
 	switch flavour {
@@ -369,7 +544,7 @@ func newCompressor(flavour compression) (Compressor, error) {
 	case compressionLzma:
 		c = &CompressorLzma{}
 	case compressionLzo:
-		return nil, fmt.Errorf("LZO compression not yet supported")
+		c = &CompressorLzo{}
 	case compressionXz:
 		c = &CompressorXz{}
 	case compressionLz4:
@@ -379,5 +554,8 @@ func newCompressor(flavour compression) (Compressor, error) {
 	default:
 		return nil, fmt.Errorf("unknown compression type: %d", flavour)
 	}
+	if d := registeredDecompressor(flavour); c != nil && d != nil {
+		c = &pluggableCompressor{Compressor: c, decompressor: d}
+	}
 	return c, nil
 }
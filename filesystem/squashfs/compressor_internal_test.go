@@ -16,7 +16,7 @@ func TestNewCompressor(t *testing.T) {
 	}{
 		{compressionGzip, &CompressorGzip{}, nil},
 		{compressionLzma, &CompressorLzma{}, nil},
-		{compressionLzo, nil, fmt.Errorf("LZO compression not yet supported")},
+		{compressionLzo, &CompressorLzo{}, nil},
 		{compressionXz, &CompressorXz{}, nil},
 		{compressionLz4, &CompressorLz4{}, nil},
 		{compressionZstd, &CompressorZstd{}, nil},
@@ -138,20 +138,14 @@ func TestCompressionXz(t *testing.T) {
 	testCompressAndDecompress(t, &c, compressed)
 }
 func TestCompressionLz4(t *testing.T) {
-	compressed := []byte{
-		0x04, 0x22, 0x4d, 0x18, 0x64, 0x40, 0xa7, 0x64, 0x00, 0x00, 0x80, 0xde,
-		0xc9, 0x4e, 0xd0, 0xef, 0x19, 0xdb, 0x0a, 0x6a, 0x35, 0x26, 0x61, 0x86,
-		0x2d, 0xa0, 0x42, 0x18, 0xa8, 0x89, 0xe9, 0xc4, 0x7b, 0x1a, 0xc7, 0x85,
-		0x8e, 0xd6, 0x36, 0xd6, 0x83, 0x84, 0x21, 0xf4, 0x06, 0x38, 0x07, 0x7b,
-		0x33, 0x3f, 0x72, 0x4c, 0xae, 0xcd, 0xfd, 0xa0, 0xb0, 0x71, 0x2f, 0x64,
-		0x62, 0x62, 0x2f, 0xc3, 0x5f, 0xa1, 0x21, 0xc6, 0xbf, 0x2c, 0x39, 0xef,
-		0x56, 0x23, 0x61, 0xb0, 0x98, 0x84, 0xcd, 0x24, 0xc4, 0xbf, 0x30, 0xae,
-		0xd9, 0x9e, 0xb0, 0x7b, 0xc5, 0xa3, 0x8d, 0xf7, 0x4f, 0xb8, 0xdd, 0x7b,
-		0x77, 0xb6, 0x8c, 0x5a, 0x10, 0xa4, 0xce, 0xc2, 0x0a, 0x3d, 0x51, 0x23,
-		0x8c, 0x10, 0x1a, 0x00, 0x00, 0x00, 0x00, 0x0c, 0xda, 0x4b, 0x2b,
-	}
-	c := CompressorLz4{}
-	testCompressAndDecompress(t, &c, compressed)
+	// the block format squashfs uses, rather than the frame format; 100 bytes that do not compress are all literals
+	compressed := append([]byte{0xf0, 0x55}, testCompressUncompressed...)
+	t.Run("default", func(t *testing.T) {
+		testCompressAndDecompress(t, &CompressorLz4{}, compressed)
+	})
+	t.Run("high compression", func(t *testing.T) {
+		testCompressAndDecompress(t, &CompressorLz4{HighCompression: true}, compressed)
+	})
 }
 func TestCompressionZstd(t *testing.T) {
 	compressed := []byte{
@@ -169,3 +163,61 @@ func TestCompressionZstd(t *testing.T) {
 	c := CompressorZstd{}
 	testCompressAndDecompress(t, &c, compressed)
 }
+func TestCompressionLzo(t *testing.T) {
+	// a single run of 100 literals, then the end of stream marker
+	compressed := append(append([]byte{17 + 100}, testCompressUncompressed...), 17, 0, 0)
+	c := CompressorLzo{}
+	testCompressAndDecompress(t, &c, compressed)
+}
+
+func TestCompressorOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Compressor
+		b       []byte
+		loaded  Compressor
+		loadErr bool
+	}{
+		{"lz4", &CompressorLz4{}, []byte{1, 0, 0, 0, 0, 0, 0, 0}, &CompressorLz4{}, false},
+		{"lz4 high compression", &CompressorLz4{HighCompression: true}, []byte{1, 0, 0, 0, 1, 0, 0, 0}, &CompressorLz4{HighCompression: true}, false},
+		{"lz4 legacy version", nil, []byte{0, 0, 0, 0, 0, 0, 0, 0}, &CompressorLz4{}, true},
+		{"lz4 unknown flags", nil, []byte{1, 0, 0, 0, 2, 0, 0, 0}, &CompressorLz4{}, true},
+		{"zstd default", &CompressorZstd{}, nil, nil, false},
+		{"zstd explicit default", &CompressorZstd{CompressionLevel: zstdDefaultLevel}, nil, nil, false},
+		{"zstd level", &CompressorZstd{CompressionLevel: 3}, []byte{3, 0, 0, 0}, &CompressorZstd{CompressionLevel: 3}, false},
+		{"zstd level too high", nil, []byte{23, 0, 0, 0}, &CompressorZstd{}, true},
+		{"zstd short", nil, []byte{3, 0}, &CompressorZstd{}, true},
+		{"lzo default", &CompressorLzo{}, nil, nil, false},
+		{"lzo 1x-999 level 9", nil, []byte{4, 0, 0, 0, 9, 0, 0, 0}, &CompressorLzo{algorithm: lzoAlgorithm1x999, level: 9}, false},
+		{"lzo 1x-1", nil, []byte{0, 0, 0, 0, 0, 0, 0, 0}, &CompressorLzo{algorithm: lzoAlgorithm1x1}, false},
+		{"lzo unknown algorithm", nil, []byte{5, 0, 0, 0, 0, 0, 0, 0}, &CompressorLzo{}, true},
+		{"lzo level without 1x-999", nil, []byte{0, 0, 0, 0, 3, 0, 0, 0}, &CompressorLzo{}, true},
+		{"gzip default", &CompressorGzip{}, nil, nil, false},
+		{"xz default", &CompressorXz{}, nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.c != nil {
+				if b := tt.c.optionsBytes(); !bytes.Equal(b, tt.b) {
+					t.Errorf("options % x instead of % x", b, tt.b)
+				}
+			}
+			if tt.loaded == nil {
+				return
+			}
+			c, err := newCompressor(tt.loaded.flavour())
+			if err != nil {
+				t.Fatalf("unexpected error creating compressor: %v", err)
+			}
+			err = c.loadOptions(tt.b)
+			switch {
+			case tt.loadErr && err == nil:
+				t.Errorf("no error loading options % x", tt.b)
+			case !tt.loadErr && err != nil:
+				t.Errorf("unexpected error loading options: %v", err)
+			case !tt.loadErr && !reflect.DeepEqual(c, tt.loaded):
+				t.Errorf("loaded %#v instead of %#v", c, tt.loaded)
+			}
+		})
+	}
+}
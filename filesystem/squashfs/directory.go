@@ -3,6 +3,7 @@ package squashfs
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 )
 
 const (
@@ -17,8 +18,7 @@ const (
 // directory may be composed of one or more of these "directory", depending
 // on how many headers it requires
 type directory struct {
-	inodeIndex uint32
-	entries    []*directoryEntryRaw
+	entries []*directoryEntryRaw
 }
 
 type directoryEntryRaw struct {
@@ -84,7 +84,7 @@ func parseDirectory(b []byte) (*directory, error) {
 	}, nil
 }
 
-func (d *directory) toBytes(in uint32) []byte {
+func (d *directory) toBytes() []byte {
 	// need to group these into chunks that would share a header
 	var (
 		b      []byte
@@ -95,12 +95,15 @@ func (d *directory) toBytes(in uint32) []byte {
 		// we need a new header if one of the following:
 		// - we don't have one yet
 		// - inode block changes
-		// - inode offset > +/- 32k from the inode in the header,
-		if group == nil || group.header.startBlock != e.startBlock {
+		// - inode number is more than +/- 32k from the inode in the header
+		// - the header already has the maximum number of entries
+		if group == nil || group.header.startBlock != e.startBlock || group.header.count == maxDirEntries ||
+			int64(e.inodeNumber)-int64(group.header.inode) > math.MaxInt16 ||
+			int64(e.inodeNumber)-int64(group.header.inode) < math.MinInt16 {
 			group = &directoryEntryGroup{
 				header: &directoryHeader{
 					startBlock: e.startBlock,
-					inode:      in,
+					inode:      e.inodeNumber,
 				},
 			}
 			groups = append(groups, group)
@@ -112,7 +115,7 @@ func (d *directory) toBytes(in uint32) []byte {
 	for _, group := range groups {
 		b = append(b, group.header.toBytes()...)
 		for _, e := range group.entries {
-			b = append(b, e.toBytes(in)...)
+			b = append(b, e.toBytes(group.header.inode)...)
 		}
 	}
 	return b
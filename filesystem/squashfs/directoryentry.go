@@ -130,6 +130,14 @@ func (d *directoryEntry) GID() uint32 {
 	return d.gid
 }
 
+// Inode get the inode number of file, as taken by FileSystem.OpenInode
+func (d *directoryEntry) Inode() uint64 {
+	if d.inode == nil {
+		return 0
+	}
+	return uint64(d.inode.index())
+}
+
 // Xattrs get extended attributes of file
 func (d *directoryEntry) Xattrs() map[string]string {
 	return d.xattrs
@@ -4,4 +4,9 @@
 //	https://www.kernel.org/doc/Documentation/filesystems/squashfs.txt
 //	https://dr-emann.github.io/squashfs/
 //	https://elinux.org/images/3/32/Squashfs-elce.pdf
+//
+// Finalize compresses data and fragment blocks with FinalizeOptions.Workers goroutines at once, but lays
+// them out in the order of the files, so the image does not depend on the number of workers or on which
+// finishes first. With FinalizeOptions.ModTime set as well, the same contents and options give the same
+// image byte for byte.
 package squashfs
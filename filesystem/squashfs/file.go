@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/diskfs/go-diskfs/filesystem"
 )
@@ -13,14 +14,18 @@ import (
 //	it is NOT used when working in a workspace, where we just use the underlying OS
 //	note that the inode for a file can be the basicFile or extendedFile. We just use extendedFile to
 //	include all of the data
+//
+// File implements io.ReaderAt, which reads without the offset that Read and Seek share, and so can be used
+// from several goroutines at once, e.g. to fetch chunks of a file in parallel.
 type File struct {
 	*extendedFile
 	isReadWrite   bool
 	isAppend      bool
 	offset        int64
 	filesystem    *FileSystem
-	blockLocation int64  // the position of the last block decompressed
-	block         []byte // the actual last block decompressed
+	mu            sync.Mutex // guards the last block decompressed, which concurrent ReadAt calls share
+	blockLocation int64      // the position of the last block decompressed
+	block         []byte     // the actual last block decompressed
 }
 
 // Read reads up to len(b) bytes from the File.
@@ -32,6 +37,25 @@ func (fl *File) Read(b []byte) (int, error) {
 	if fl == nil || fl.filesystem == nil {
 		return 0, os.ErrClosed
 	}
+	n, err := fl.readAt(b, fl.offset)
+	fl.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(b) bytes from the File starting at byte offset off, as io.ReaderAt does.
+// It neither uses nor changes the offset of Read and Seek, and is safe to call concurrently.
+func (fl *File) ReadAt(b []byte, off int64) (int, error) {
+	if fl == nil || fl.filesystem == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("cannot read at offset %d before start of file", off)
+	}
+	return fl.readAt(b, off)
+}
+
+// readAt reads up to len(b) bytes from offset in the file, returning io.EOF once it reaches the end of it
+func (fl *File) readAt(b []byte, offset int64) (int, error) {
 	// squashfs files are *mostly* contiguous, we only need the starting location and size for whole blocks
 	// if there are fragments, we need the location of those as well
 
@@ -46,7 +70,7 @@ func (fl *File) Read(b []byte) (int, error) {
 	//      e.g. if starting block is at position 10245, then we want blocks 27,28,29 from the disk
 	// 5- read in and uncompress the necessary blocks
 	fs := fl.filesystem
-	size := fl.size() - fl.offset
+	size := fl.size() - offset
 	location := int64(fl.startBlock)
 	maxRead := len(b)
 
@@ -54,6 +78,9 @@ func (fl *File) Read(b []byte) (int, error) {
 	if size <= 0 {
 		return 0, io.EOF
 	}
+	if maxRead == 0 {
+		return 0, nil
+	}
 
 	// we stop when we hit the lesser of
 	//   1- len(b)
@@ -62,10 +89,10 @@ func (fl *File) Read(b []byte) (int, error) {
 		maxRead = int(size)
 	}
 
-	// just read the requested number of bytes and change our offset
+	// just read the requested number of bytes
 	// figure out which block number has the bytes we are looking for
-	startBlock := int(fl.offset / fs.blocksize)
-	endBlock := int((fl.offset + int64(maxRead) - 1) / fs.blocksize)
+	startBlock := int(offset / fs.blocksize)
+	endBlock := int((offset + int64(maxRead) - 1) / fs.blocksize)
 
 	// do we end in fragment territory?
 	fragments := false
@@ -75,13 +102,13 @@ func (fl *File) Read(b []byte) (int, error) {
 	}
 
 	read := 0
-	offsetEnd := fl.offset + int64(maxRead)
+	offsetEnd := offset + int64(maxRead)
 	pos := int64(0)
 
 	// send input to b, clipping as appropriate
 	outputBlock := func(input []byte) {
 		inputSize := int64(len(input))
-		start := fl.offset - pos
+		start := offset - pos
 		end := offsetEnd - pos
 		if start >= 0 && start < inputSize {
 			if end > inputSize {
@@ -89,7 +116,7 @@ func (fl *File) Read(b []byte) (int, error) {
 			}
 			n := copy(b[read:], input[start:end])
 			read += n
-			fl.offset += int64(n)
+			offset += int64(n)
 		}
 	}
 
@@ -103,19 +130,21 @@ func (fl *File) Read(b []byte) (int, error) {
 			if int64(block.size) > fs.blocksize {
 				return read, fmt.Errorf("unexpected block.size=%d > fs.blocksize=%d", block.size, fs.blocksize)
 			}
-			var input []byte
-			if fl.blockLocation == location && fl.block != nil {
-				// Read last block from cache
-				input = fl.block
-			} else {
+			fl.mu.Lock()
+			input := fl.block
+			cached := fl.blockLocation == location && input != nil
+			fl.mu.Unlock()
+			if !cached {
 				var err error
 				input, err = fs.readBlock(location, block.compressed, block.size)
 				if err != nil {
 					return read, fmt.Errorf("error reading data block %d from squashfs: %v", i, err)
 				}
 				// Cache the last block
+				fl.mu.Lock()
 				fl.blockLocation = location
 				fl.block = input
+				fl.mu.Unlock()
 			}
 			outputBlock(input)
 		}
@@ -136,7 +165,7 @@ func (fl *File) Read(b []byte) (int, error) {
 		outputBlock(input)
 	}
 	var retErr error
-	if fl.offset >= fl.size() {
+	if offset >= fl.size() {
 		retErr = io.EOF
 	} else if read == 0 {
 		retErr = fmt.Errorf("internal error: read no bytes")
@@ -163,7 +192,7 @@ func (fl *File) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekStart:
 		newOffset = offset
 	case io.SeekEnd:
-		newOffset = fl.size() - offset
+		newOffset = fl.size() + offset
 	case io.SeekCurrent:
 		newOffset = fl.offset + offset
 	}
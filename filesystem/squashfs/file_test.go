@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/filesystem/squashfs"
 	"github.com/diskfs/go-diskfs/testhelper"
 )
@@ -88,6 +91,98 @@ func TestFileRead(t *testing.T) {
 	})
 }
 
+func TestFileReadAt(t *testing.T) {
+	blocksize := 4096
+	// whole blocks and a fragment
+	content := []byte(testRandomString(5*blocksize + 100))
+	b, err := mem.New(1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, int64(blocksize))
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	f, err := fs.OpenFile("/file.dat", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	fs, err = squashfs.Read(b, 0, 0, int64(blocksize))
+	if err != nil {
+		t.Fatalf("error reading the finalized image: %v", err)
+	}
+	f, err = fs.OpenFile("/file.dat", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("squashfs file is not an io.ReaderAt")
+	}
+
+	// ReadAt does not move the offset that Read uses
+	if _, err := f.Seek(10, io.SeekStart); err != nil {
+		t.Fatalf("error seeking: %v", err)
+	}
+	buf := make([]byte, 50)
+	if _, err := ra.ReadAt(buf, int64(3*blocksize)); err != nil {
+		t.Fatalf("error reading at offset: %v", err)
+	}
+	if !bytes.Equal(buf, content[3*blocksize:3*blocksize+50]) {
+		t.Errorf("mismatched content reading at offset")
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatalf("error reading: %v", err)
+	}
+	if !bytes.Equal(buf, content[10:60]) {
+		t.Errorf("Read did not continue from the offset set by Seek")
+	}
+
+	// past the end
+	n, err := ra.ReadAt(buf, int64(len(content)-20))
+	if n != 20 || err != io.EOF {
+		t.Errorf("read %d bytes with error %v at the end instead of 20 and io.EOF", n, err)
+	}
+	if _, err := ra.ReadAt(buf, -1); err == nil {
+		t.Errorf("no error reading at a negative offset")
+	}
+
+	// chunks of the file read concurrently, in no particular order, across blocks and the fragment
+	chunk := 1000
+	var wg sync.WaitGroup
+	errs := make(chan error, len(content)/chunk+1)
+	for off := 0; off < len(content); off += chunk {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			end := off + chunk
+			if end > len(content) {
+				end = len(content)
+			}
+			p := make([]byte, end-off)
+			n, err := ra.ReadAt(p, int64(off))
+			if err != nil && (err != io.EOF || end != len(content)) {
+				errs <- fmt.Errorf("reading %d bytes at %d: %v", len(p), off, err)
+				return
+			}
+			if n != len(p) || !bytes.Equal(p, content[off:end]) {
+				errs <- fmt.Errorf("mismatched content of %d bytes at %d", len(p), off)
+			}
+		}(off)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 func TestFileWrite(t *testing.T) {
 	// pretty simple: never should be able to write as it is a read-only filesystem
 	f := &squashfs.File{}
@@ -110,8 +205,11 @@ func TestFileSeek(t *testing.T) {
 	}{
 		{100, io.SeekStart, 100, nil},
 		{100, io.SeekCurrent, 100, nil},
-		{50, io.SeekEnd, 150, nil},
-		{250, io.SeekEnd, 0, fmt.Errorf("cannot set offset %d before start of file", 250)},
+		// past the end, which was taken as counting back from it
+		{50, io.SeekEnd, 250, nil},
+		{250, io.SeekEnd, 450, nil},
+		{-50, io.SeekEnd, 150, nil},
+		{-250, io.SeekEnd, 0, fmt.Errorf("cannot set offset %d before start of file", -250)},
 	}
 
 	for i, tt := range tests {
@@ -5,16 +5,24 @@ import (
 	"fmt"
 	"io"
 	iofs "io/fs"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/pkg/xattr"
 )
 
+// padSize the image is padded to a multiple of this, unless FinalizeOptions.NoPad is set, so that it
+// can be used as a block device
+const padSize int64 = 4096
+
 type fileType uint8
 
 const (
@@ -53,6 +61,42 @@ type FinalizeOptions struct {
 	FileUID *uint32
 	// FileGID set all files to be owned by the GID provided, default is to leave as in filesystem
 	FileGID *uint32
+	// Source the filesystem whose contents to write out, instead of the workspace, e.g. an ext4 partition
+	// to convert to squashfs. Files are streamed from it without being extracted to the host first.
+	// Block and char devices cannot be copied from another filesystem.
+	Source filesystem.FileSystem
+	// GraftPoints add files and directories from anywhere on the host to the image, each at a path of
+	// its own, so that the image can be assembled from several places without copying them into the
+	// workspace first. A directory grafted where there already is one has its contents merged into it.
+	// Cannot be used with Source.
+	GraftPoints []GraftPoint
+	// Workers how many data and fragment blocks to compress at once, each in a goroutine of its own. Defaults to
+	// the number of CPUs; 1 compresses one block at a time. Blocks are laid out in the order of the files and
+	// of the data in them, not in the order they finish compressing, so the image is byte for byte the same
+	// whatever the number of workers.
+	Workers int
+	// PseudoFiles files to add to the image, or change in it, as mksquashfs does with pseudo file definitions, in
+	// order, once everything else is in the tree. ParsePseudoFiles reads them in the format of mksquashfs -pf.
+	// Cannot be used with FromTar.
+	PseudoFiles []PseudoFile
+	// ModTime the time the image is made, kept in the superblock and given to directories that Finalize makes
+	// up, such as the root of a Source and the parents of graft targets, and to pseudo files. Defaults to now;
+	// set it, e.g. from SOURCE_DATE_EPOCH, for the same contents to give the same image byte for byte each time.
+	ModTime time.Time
+	// NameNormalization the Unicode normalization form to write names in, e.g. NFC for a tree made on macOS,
+	// which writes names in NFD, to be read on Linux. In Strict mode, two names in a directory that are the
+	// same once normalized are an error, filesystem.ErrAmbiguousName; otherwise both are written as they are.
+	// Defaults to filesystem.NormalizationNone, i.e. names are written as they are.
+	NameNormalization filesystem.NameNormalization
+}
+
+// GraftPoint places a file or directory on the host, with everything in it, at a path in the image
+type GraftPoint struct {
+	// Source the file or directory on the host
+	Source string
+	// Target the path in the image, relative to its root. Any of its parent directories that are not
+	// in the workspace are created.
+	Target string
 }
 
 // Finalize finalize a read-only filesystem by writing it out to a read-only format
@@ -90,32 +134,89 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 	if err != nil {
 		return err
 	}
+	if _, err := fs.finalize(f, options); err != nil {
+		return err
+	}
+
+	// finish by setting as finalized
+	fs.workspace = ""
+	return nil
+}
+
+// EstimateSize returns the size in bytes of the image that Finalize would write, given the current contents
+// of the workspace and the same options, so that the backing storage can be sized before calling Finalize.
+// As the size depends on how well everything compresses, this does all of the work of Finalize, including
+// the compression, but discards the output.
+func (fs *FileSystem) EstimateSize(options FinalizeOptions) (int64, error) {
+	if fs.workspace == "" {
+		return 0, fmt.Errorf("cannot estimate the size of an already finalized filesystem")
+	}
+	return fs.finalize(discardWriter{}, options)
+}
+
+// discardWriter an io.WriterAt that discards everything written to it
+type discardWriter struct{}
+
+func (discardWriter) WriteAt(p []byte, _ int64) (int, error) {
+	return len(p), nil
+}
+
+// finalize write the filesystem in the workspace out to f, returning the size of the image in bytes
+func (fs *FileSystem) finalize(f io.WriterAt, options FinalizeOptions) (int64, error) {
+	modTime := finalizeModTime(options)
+	var src finalizeSource = newHostSource(fs.workspace, options.GraftPoints, modTime)
+	if fs.overlay != nil {
+		if options.Source != nil {
+			return 0, fmt.Errorf("cannot use a source filesystem with an overlay")
+		}
+		src = newOverlaySource(fs, options.GraftPoints, modTime)
+	}
+	if options.Source != nil {
+		if len(options.GraftPoints) > 0 {
+			return 0, fmt.Errorf("cannot use graft points with a source filesystem")
+		}
+		src = newFilesystemSource(options.Source, modTime)
+	}
+	if len(fs.setXattrs) > 0 {
+		src = &xattrSource{finalizeSource: src, xattrs: fs.setXattrs}
+		options.Xattrs = true
+	}
+	return writeImage(f, src, int(fs.blocksize), options, modTime)
+}
+
+// finalizeModTime the time the image is made, from the options, or now
+func finalizeModTime(options FinalizeOptions) time.Time {
+	if options.ModTime.IsZero() {
+		return time.Now()
+	}
+	return options.ModTime
+}
 
-	blocksize := int(fs.blocksize)
+// writeImage write an image of the files of src out to f, returning the size of the image in bytes
+func writeImage(f io.WriterAt, src finalizeSource, blocksize int, options FinalizeOptions, modTime time.Time) (int64, error) {
 	comp := compressionNone
 	if options.Compression != nil {
 		comp = options.Compression.flavour()
 	}
 
-	// build out file and directory tree
-	// this returns a slice of *finalizeFileInfo, each of which represents a directory
-	// or file
-	fileList, err := walkTree(fs.Workspace())
-	if err != nil {
-		return fmt.Errorf("error walking tree: %v", err)
-	}
-
 	// location holds where we are writing in our file
 	var (
-		location int64
-		b        []byte
+		location          int64
+		compressorOptions bool
 	)
 	location += superblockSize
+	// any compressor options follow the superblock as a metadata block, which is never compressed
 	if options.Compression != nil {
-		b = options.Compression.optionsBytes()
-		if len(b) > 0 {
-			_, _ = f.WriteAt(b, location)
+		if opts := options.Compression.optionsBytes(); len(opts) > 0 {
+			b, err := metadataBlock(opts, nil)
+			if err != nil {
+				return 0, fmt.Errorf("error creating compressor options block: %v", err)
+			}
+			if _, err := f.WriteAt(b, location); err != nil {
+				return 0, fmt.Errorf("failed to write compressor options: %v", err)
+			}
 			location += int64(len(b))
+			compressorOptions = true
 		}
 	}
 
@@ -125,23 +226,62 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 		compressor = nil
 	}
 
-	// write file data blocks
-	//
-	dataWritten, err := writeDataBlocks(fileList, f, fs.workspace, blocksize, compressor, location)
-	if err != nil {
-		return fmt.Errorf("error writing file data blocks: %v", err)
+	workers := options.Workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
 	}
-	location += int64(dataWritten)
+	var (
+		fileList           []*finalizeFileInfo
+		fragmentBlocks     []fragmentBlock
+		fragmentBlockStart int64
+		err                error
+	)
+	if len(options.PseudoFiles) > 0 {
+		src = newPseudoSource(src, options.PseudoFiles, modTime)
+	}
+	if s, ok := src.(streamedSource); ok {
+		// the tree, the file data blocks and the fragment blocks all come from a single pass over the stream,
+		// with the fragment blocks among the data blocks
+		var written int64
+		fragmentBlockStart = location
+		fileList, fragmentBlocks, written, err = s.stream(f, blocksize, options, workers, location)
+		if err != nil {
+			return 0, fmt.Errorf("error writing file data and fragment blocks: %v", err)
+		}
+		location += written
+	} else {
+		// build out file and directory tree
+		// this returns a slice of *finalizeFileInfo, each of which represents a directory
+		// or file
+		fileList, err = src.walk()
+		if err != nil {
+			return 0, fmt.Errorf("error walking tree: %v", err)
+		}
 
-	//
-	// write file fragments
-	//
-	fragmentBlockStart := location
-	fragmentBlocks, fragsWritten, err := writeFragmentBlocks(fileList, f, fs.workspace, blocksize, options, fragmentBlockStart)
+		// write file data blocks
+		//
+		dataWritten, err := writeDataBlocks(fileList, f, src, blocksize, compressor, workers, location)
+		if err != nil {
+			return 0, fmt.Errorf("error writing file data blocks: %v", err)
+		}
+		location += int64(dataWritten)
+
+		//
+		// write file fragments
+		//
+		fragmentBlockStart = location
+		var fragsWritten int64
+		fragmentBlocks, fragsWritten, err = writeFragmentBlocks(fileList, f, src, blocksize, options, workers, fragmentBlockStart)
+		if err != nil {
+			return 0, fmt.Errorf("error writing file fragment blocks: %v", err)
+		}
+		location += fragsWritten
+	}
+
+	fileList, err = normalizeNames(fileList, options.NameNormalization)
 	if err != nil {
-		return fmt.Errorf("error writing file fragment blocks: %v", err)
+		return 0, err
 	}
-	location += fragsWritten
 
 	// extract extended attributes, and save them for later; these are written at the very end
 	// this must be done *before* creating inodes, as inodes reference these
@@ -167,23 +307,21 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 	// - size of the directory table entries for this directory, all of it. Thus,
 	//   you have to have converted it all to bytes to get the information.
 	//
-	// The only possible way to do this is to run one, then the other, then
-	// modify them. Until you generate both, you just don't know.
+	// The way out is the order: mksquashfs, like us, adds each directory to the tables only
+	// after everything in it. By the time a directory's entries are added, the inodes they point
+	// to are already in the inode table, and by the time its own inode is added, its entries
+	// are already in the directory table. Since each table is built a metadata block at a time,
+	// the compressed position of every block before the current one is known.
 	//
 	// Something that eases it a bit is that the block index in directory inodes
 	// is from the start of the directory table, rather than start of archive.
 	//
 	// Order of execution:
 	// 1. Write the file (not directory) data and fragments to disk.
-	// 2. Create inodes for the files. We cannot write them yet because we need to
-	//    add the directory entries before compression.
-	// 3. Convert the directories to a directory table. And no, we cannot just
-	//    calculate it based on the directory size, since some directories have
-	//    one header, some have multiple, so the size of each directory, even
-	//    given the number of files, can change.
-	// 4. Create inodes for the directories and write them to disk
-	// 5. Update the directory entries based on the inodes.
-	// 6. Write directory table to disk
+	// 2. Create inodes for everything.
+	// 3. Walk the tree depth first, adding the inodes of the files in each directory,
+	//    then its entries to the directory table, then its own inode.
+	// 4. Write the inode table, then the directory table, to disk.
 	//
 	// if storing the inodes and directory table entirely in memory becomes
 	// burdensome, use temporary scratch disk space to cache data in flight
@@ -194,40 +332,34 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 	// build up a table of uids/gids we can store later
 	idtable := map[uint32]uint16{}
 	// get the inodes in order as a slice
-	if err := createInodes(fileList, idtable, options); err != nil {
-		return fmt.Errorf("error creating file inodes: %v", err)
+	if err := createInodes(fileList, src, idtable, options); err != nil {
+		return 0, fmt.Errorf("error creating file inodes: %v", err)
 	}
 
-	// convert the inodes to data, while keeping track of where each
-	// one is, so we can update the directory entries
-	updateInodeLocations(fileList)
-
-	// create the directory table. We already have every inode and its position,
-	// so we do not need to dip back into the inodes. The only changes will be
-	// the block/offset references into the directory table, but those sizes do
-	// not change. However, we will have to break out the headers, so this is not
-	// completely finalized yet.
-	directories := createDirectories(fileList[0])
-
-	// create the final version of the directory table by creating the headers
-	// and entries.
-	populateDirectoryLocations(directories)
-
-	if err := updateInodesFromDirectories(directories); err != nil {
-		return fmt.Errorf("error updating inodes with final directory data: %v", err)
+	// build the inode and directory tables. Each directory is done after everything in it, so that
+	// its entries can point to the inodes of its contents, and its own inode to its entries, at the
+	// positions they have in the tables once compressed.
+	tables := &metadataTables{
+		inodes:      metadataTable{compressor: compressor},
+		directories: metadataTable{compressor: compressor},
+	}
+	if err := tables.addDirectory(fileList[0], uint32(len(fileList)+1)); err != nil {
+		return 0, fmt.Errorf("error building inode and directory tables: %v", err)
 	}
 
 	// write the inodes to the file
-	inodesWritten, inodeTableLocation, err := writeInodes(fileList, f, compressor, location)
+	inodeTableLocation := uint64(location)
+	inodesWritten, err := tables.inodes.writeTo(f, location)
 	if err != nil {
-		return fmt.Errorf("error writing inode data blocks: %v", err)
+		return 0, fmt.Errorf("error writing inode data blocks: %v", err)
 	}
 	location += int64(inodesWritten)
 
 	// write directory data
-	dirsWritten, dirTableLocation, err := writeDirectories(directories, f, compressor, location)
+	dirTableLocation := uint64(location)
+	dirsWritten, err := tables.directories.writeTo(f, location)
 	if err != nil {
-		return fmt.Errorf("error writing directory data blocks: %v", err)
+		return 0, fmt.Errorf("error writing directory data blocks: %v", err)
 	}
 	location += int64(dirsWritten)
 
@@ -266,14 +398,13 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 				- symlink, IPC, block/char device, hardlink
 		- deduplicate values in xattrs
 		- utilize options to: not add xattrs; not compress things; etc.
-		- blockPosition calculations appear to be off
 
 	*/
 
 	// write the fragment table and its index
 	fragmentTableWritten, fragmentTableLocation, err := writeFragmentTable(fragmentBlocks, fragmentBlockStart, f, compressor, location)
 	if err != nil {
-		return fmt.Errorf("error writing fragment table: %v", err)
+		return 0, fmt.Errorf("error writing fragment table: %v", err)
 	}
 	location += int64(fragmentTableWritten)
 
@@ -285,7 +416,7 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 	if !options.NonExportable {
 		exportTableWritten, exportTableLocation, err = writeExportTable(fileList, f, compressor, location)
 		if err != nil {
-			return fmt.Errorf("error writing export table: %v", err)
+			return 0, fmt.Errorf("error writing export table: %v", err)
 		}
 		location += int64(exportTableWritten)
 	}
@@ -293,7 +424,7 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 	// write the uidgid table
 	idTableWritten, idTableLocation, err := writeIDTable(idtable, f, compressor, location)
 	if err != nil {
-		return fmt.Errorf("error writing uidgid table: %v", err)
+		return 0, fmt.Errorf("error writing uidgid table: %v", err)
 	}
 	location += int64(idTableWritten)
 
@@ -305,7 +436,7 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 		var xAttrsWritten int
 		xAttrsWritten, xAttrsLocation, err = writeXattrs(xattrs, f, compressor, location)
 		if err != nil {
-			return fmt.Errorf("error writing xattrs table: %v", err)
+			return 0, fmt.Errorf("error writing xattrs table: %v", err)
 		}
 		location += int64(xAttrsWritten)
 	}
@@ -327,7 +458,7 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 		inodes:              uint32(len(fileList)),
 		xattrTableStart:     xAttrsLocation,
 		fragmentCount:       uint32(len(fragmentBlocks)),
-		modTime:             time.Now(),
+		modTime:             modTime,
 		size:                uint64(location),
 		versionMajor:        4,
 		versionMinor:        0,
@@ -346,168 +477,226 @@ func (fs *FileSystem) Finalize(options FinalizeOptions) error {
 			noFragments:           options.NoFragments,
 			noXattrs:              !options.Xattrs,
 			exportable:            !options.NonExportable,
+			compressorOptions:     compressorOptions,
 		},
 	}
 
 	// write the superblock
 	sbBytes := sb.toBytes()
 	if _, err := f.WriteAt(sbBytes, 0); err != nil {
-		return fmt.Errorf("failed to write superblock: %v", err)
+		return 0, fmt.Errorf("failed to write superblock: %v", err)
 	}
 
-	// finish by setting as finalized
-	fs.workspace = ""
-	return nil
+	// pad to a multiple of 4K; the superblock size does not include the padding
+	if !options.NoPad && location%padSize != 0 {
+		pad := padSize - location%padSize
+		if _, err := f.WriteAt(make([]byte, pad), location); err != nil {
+			return 0, fmt.Errorf("failed to pad filesystem: %v", err)
+		}
+		location += pad
+	}
+	return location, nil
 }
 
-func copyFileData(from backend.File, to backend.WritableFile, fromOffset, toOffset, blocksize int64, c Compressor) (raw, compressed int, blocks []*blockData, err error) {
-	buf := make([]byte, blocksize)
-	blocks = make([]*blockData, 0)
-	for {
-		n, err := from.ReadAt(buf, fromOffset+int64(raw))
-		if err != nil && err != io.EOF {
-			return raw, compressed, nil, err
+// walkTree walks the tree and returns a slice of files and directories.
+// We do files and directories differently, since they need to be processed
+// differently on disk (file data and fragments vs directory table), and
+// because the inode data is different.
+// The first entry in the return always will be the root, and every directory comes before its contents,
+// which are in name order. Anything grafted is added at its target, and the host path of every entry
+// is returned, by its path in the tree.
+func walkTree(workspace string, grafts []GraftPoint, modTime time.Time) ([]*finalizeFileInfo, map[string]string, error) {
+	t := &treeWalker{
+		modTime:     modTime,
+		dirMap:      make(map[string]*finalizeFileInfo),
+		actualPaths: make(map[string]string),
+		created:     make(map[string]bool),
+	}
+	if err := t.walk(workspace, "."); err != nil {
+		return nil, nil, err
+	}
+	for _, g := range grafts {
+		if g.Source == "" {
+			return nil, nil, fmt.Errorf("graft point at %q has no source", g.Target)
 		}
-		if n != len(buf) {
-			break
+		target := path.Clean("/" + filepath.ToSlash(g.Target))[1:]
+		if target == "" {
+			target = "."
 		}
-		raw += len(buf)
+		if err := t.walk(g.Source, target); err != nil {
+			return nil, nil, fmt.Errorf("could not graft %s at %s: %w", g.Source, g.Target, err)
+		}
+	}
 
-		// compress the block if needed
-		isCompressed := false
-		if c != nil {
-			out, err := c.compress(buf)
-			if err != nil {
-				return 0, 0, nil, fmt.Errorf("error compressing block: %v", err)
+	return flattenTree(t.dirMap["."], len(t.actualPaths)), t.actualPaths, nil
+}
+
+// normalizeNames put the names of everything in the tree of fileList in the normalization form of n. Two names in
+// a directory that are the same once normalized are an error in strict mode, and otherwise are left as they are.
+// As that may change the order of the names in a directory, the tree is listed again, in the order of flattenTree.
+func normalizeNames(fileList []*finalizeFileInfo, n filesystem.NameNormalization) ([]*finalizeFileInfo, error) {
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	if n.Form == filesystem.NormalizationNone || len(fileList) == 0 {
+		return fileList, nil
+	}
+	for _, dir := range fileList {
+		count := make(map[string]int, len(dir.children))
+		for _, child := range dir.children {
+			count[n.Normalize(child.name)]++
+		}
+		for _, child := range dir.children {
+			normalized := n.Normalize(child.name)
+			if count[normalized] == 1 {
+				child.name = normalized
+				continue
 			}
-			if len(out) < len(buf) {
-				isCompressed = true
-				buf = out
+			if n.Strict {
+				return nil, fmt.Errorf("%d names in %s are %q once normalized: %w", count[normalized], path.Join("/", dir.path), normalized, filesystem.ErrAmbiguousName)
 			}
 		}
-		blocks = append(blocks, &blockData{size: uint32(len(buf)), compressed: isCompressed})
-		if _, err := to.WriteAt(buf[:n], toOffset+int64(compressed)); err != nil {
-			return raw, compressed, blocks, err
-		}
-		compressed += len(buf)
 	}
-	return raw, compressed, blocks, nil
+	return flattenTree(fileList[0], len(fileList)), nil
 }
 
-// finalizeFragment write fragment data out to the archive, compressing if relevant.
-// Returns the total amount written, whether compressed, and any error.
-func finalizeFragment(buf []byte, to backend.WritableFile, toOffset int64, c Compressor) (raw int, compressed bool, err error) {
-	// compress the block if needed
-	if c != nil {
-		out, err := c.compress(buf)
-		if err != nil {
-			return 0, compressed, fmt.Errorf("error compressing fragment block: %v", err)
-		}
-		if len(out) < len(buf) {
-			buf = out
-			compressed = true
+// flattenTree list everything in the tree under root, with root first, and every directory before its contents,
+// which are in name order
+func flattenTree(root *finalizeFileInfo, count int) []*finalizeFileInfo {
+	fileList := make([]*finalizeFileInfo, 0, count)
+	var flatten func(entry *finalizeFileInfo)
+	flatten = func(entry *finalizeFileInfo) {
+		fileList = append(fileList, entry)
+		sort.Slice(entry.children, func(i, j int) bool { return entry.children[i].name < entry.children[j].name })
+		for _, child := range entry.children {
+			flatten(child)
 		}
 	}
-	if _, err := to.WriteAt(buf, toOffset); err != nil {
-		return 0, compressed, err
-	}
-	return len(buf), compressed, nil
+	flatten(root)
+	return fileList
 }
 
-// walkTree walks the tree and returns a slice of files and directories.
-// We do files and directories differently, since they need to be processed
-// differently on disk (file data and fragments vs directory table), and
-// because the inode data is different.
-// The first entry in the return always will be the root
-func walkTree(workspace string) ([]*finalizeFileInfo, error) {
-	dirMap := make(map[string]*finalizeFileInfo)
-	fileList := make([]*finalizeFileInfo, 0)
-	var entry *finalizeFileInfo
-	err := filepath.WalkDir(workspace, func(actualPath string, d iofs.DirEntry, err error) error {
+// treeWalker builds the tree of files and directories from the host
+type treeWalker struct {
+	dirMap map[string]*finalizeFileInfo
+	// actualPaths where on the host each path in the tree is
+	actualPaths map[string]string
+	// created directories that are not on the host, as parents of graft targets
+	created map[string]bool
+	// modTime of the directories that are created
+	modTime time.Time
+}
+
+// walk add everything in root on the host to the tree, at target
+func (t *treeWalker) walk(root, target string) error {
+	return filepath.WalkDir(root, func(actualPath string, d iofs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		fp := strings.TrimPrefix(actualPath, workspace)
-		fp = strings.TrimPrefix(fp, string(filepath.Separator))
-		if fp == "" {
-			fp = "."
+		rel, err := filepath.Rel(root, actualPath)
+		if err != nil {
+			return fmt.Errorf("could not get path of %s in %s: %v", actualPath, root, err)
 		}
-		isRoot := fp == "."
-		name := d.Name()
+		fp := path.Join(target, filepath.ToSlash(rel))
 		fi, err := d.Info()
 		if err != nil {
 			return fmt.Errorf("could not get file info for %s: %v", fp, err)
 		}
-		m := fi.Mode()
-		var fType fileType
-		switch {
-		case m&os.ModeSocket == os.ModeSocket:
-			fType = fileSocket
-		case m&os.ModeSymlink == os.ModeSymlink:
-			fType = fileSymlink
-		case m&os.ModeNamedPipe == os.ModeNamedPipe:
-			fType = fileFifo
-		case m&os.ModeDir == os.ModeDir:
-			fType = fileDirectory
-		case m&os.ModeDevice == os.ModeDevice && m&os.ModeCharDevice == os.ModeCharDevice:
-			fType = fileChar
-		case m&os.ModeDevice == os.ModeDevice && m&os.ModeCharDevice != os.ModeCharDevice:
-			fType = fileBlock
-		default:
-			fType = fileRegular
-		}
-		xattrNames, err := xattr.List(actualPath)
+		return t.add(fp, actualPath, fi)
+	})
+}
+
+// add add a file or directory on the host to the tree, at path fp
+func (t *treeWalker) add(fp, actualPath string, fi iofs.FileInfo) error {
+	m := fi.Mode()
+	// those of a symlink itself, not of its target, which may not even be on the host
+	xattrNames, err := xattr.LList(actualPath)
+	if err != nil {
+		return fmt.Errorf("unable to list xattrs for %s: %v", fp, err)
+	}
+	xattrs := map[string]string{}
+	for _, name := range xattrNames {
+		val, err := xattr.LGet(actualPath, name)
 		if err != nil {
-			return fmt.Errorf("unable to list xattrs for %s: %v", fp, err)
-		}
-		xattrs := map[string]string{}
-		for _, name := range xattrNames {
-			val, err := xattr.Get(fp, name)
-			if err != nil {
-				return fmt.Errorf("unable to get xattr %s for %s: %v", name, fp, err)
-			}
-			xattrs[name] = string(val)
-		}
-		nlink, uid, gid := getFileProperties(fi)
-
-		entry = &finalizeFileInfo{
-			path:     fp,
-			name:     name,
-			isDir:    fi.IsDir(),
-			isRoot:   isRoot,
-			modTime:  fi.ModTime(),
-			mode:     m,
-			fileType: fType,
-			size:     fi.Size(),
-			xattrs:   xattrs,
-			uid:      uid,
-			gid:      gid,
-			links:    nlink,
-		}
-
-		// we will have to save it as its parent
-		parentDir := filepath.Dir(fp)
-		parentDirInfo := dirMap[parentDir]
-
-		if fi.IsDir() {
-			entry.children = make([]*finalizeFileInfo, 0, 20)
-			dirMap[fp] = entry
-		} else {
-			// calculate blocks
-			entry.size = fi.Size()
-		}
-		if !isRoot {
-			parentDirInfo.children = append(parentDirInfo.children, entry)
-			dirMap[parentDir] = parentDirInfo
-		}
-		fileList = append(fileList, entry)
+			return fmt.Errorf("unable to get xattr %s for %s: %v", name, fp, err)
+		}
+		xattrs[name] = string(val)
+	}
+	nlink, uid, gid := getFileProperties(fi)
+
+	entry := &finalizeFileInfo{
+		path:     fp,
+		name:     path.Base(fp),
+		isDir:    fi.IsDir(),
+		isRoot:   fp == ".",
+		modTime:  fi.ModTime(),
+		mode:     m,
+		fileType: modeFileType(m),
+		size:     fi.Size(),
+		xattrs:   xattrs,
+		uid:      uid,
+		gid:      gid,
+		links:    nlink,
+	}
+
+	if existing, ok := t.dirMap[fp]; ok && fi.IsDir() {
+		// a directory that already is in the tree, in the workspace or as the parent of a graft target,
+		// which keeps its own properties if it has them
+		if t.created[fp] {
+			children := existing.children
+			*existing = *entry
+			existing.children = children
+			delete(t.created, fp)
+		}
+		t.actualPaths[fp] = actualPath
 		return nil
-	})
+	}
+	if _, ok := t.actualPaths[fp]; ok || t.dirMap[fp] != nil {
+		return fmt.Errorf("more than one file or directory at %s", fp)
+	}
+	if fi.IsDir() {
+		entry.children = make([]*finalizeFileInfo, 0, 20)
+		t.dirMap[fp] = entry
+	}
+	t.actualPaths[fp] = actualPath
+	if entry.isRoot {
+		return nil
+	}
+	parent, err := t.parent(path.Dir(fp))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	parent.children = append(parent.children, entry)
+	return nil
+}
 
-	return fileList, nil
+// parent get the directory at path fp in the tree, creating it if it is not there yet
+func (t *treeWalker) parent(fp string) (*finalizeFileInfo, error) {
+	if dir, ok := t.dirMap[fp]; ok {
+		return dir, nil
+	}
+	if _, ok := t.actualPaths[fp]; ok {
+		return nil, fmt.Errorf("%s is not a directory", fp)
+	}
+	dir := &finalizeFileInfo{
+		path:     fp,
+		name:     path.Base(fp),
+		isDir:    true,
+		modTime:  t.modTime,
+		mode:     os.ModeDir | 0o755,
+		fileType: fileDirectory,
+		xattrs:   map[string]string{},
+		links:    2,
+		children: make([]*finalizeFileInfo, 0, 20),
+	}
+	t.dirMap[fp] = dir
+	t.created[fp] = true
+	grandparent, err := t.parent(path.Dir(fp))
+	if err != nil {
+		return nil, err
+	}
+	grandparent.children = append(grandparent.children, dir)
+	return dir, nil
 }
 
 func getTableIdx(m map[uint32]uint16, index uint32) uint16 {
@@ -521,37 +710,25 @@ func getTableIdx(m map[uint32]uint16, index uint32) uint16 {
 	return m[index]
 }
 
-func writeFileDataBlocks(e *finalizeFileInfo, to backend.WritableFile, ws string, startBlock uint64, blocksize int, compressor Compressor, location int64) (blockCount, compressed int, err error) {
-	from, err := os.Open(path.Join(ws, e.path))
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to open file for reading %s: %v", e.path, err)
-	}
-	defer from.Close()
-	raw, compressed, blocks, err := copyFileData(from, to, 0, location, int64(blocksize), compressor)
+func writeMetadataBlock(buf []byte, to io.WriterAt, c Compressor, location int64) (int, error) {
+	b, err := metadataBlock(buf, c)
 	if err != nil {
-		return 0, 0, fmt.Errorf("error copying file %s: %v", e.Name(), err)
+		return 0, err
 	}
-	if raw%blocksize != 0 {
-		return 0, 0, fmt.Errorf("copying file %s copied %d which is not a multiple of blocksize %d", e.Name(), raw, blocksize)
+	if _, err := to.WriteAt(b, location); err != nil {
+		return 0, err
 	}
-	// save the information we need for usage later in inodes to find the file data
-	e.dataLocation = location
-	e.blocks = blocks
-	e.startBlock = startBlock
-
-	// how many blocks did we write?
-	blockCount = raw / blocksize
-
-	return blockCount, compressed, nil
+	return len(b), nil
 }
 
-func writeMetadataBlock(buf []byte, to backend.WritableFile, c Compressor, location int64) (int, error) {
+// metadataBlock convert up to 8KB of metadata to a block, with its header, compressing if relevant
+func metadataBlock(buf []byte, c Compressor) ([]byte, error) {
 	// compress the block if needed
 	isCompressed := false
 	if c != nil {
 		out, err := c.compress(buf)
 		if err != nil {
-			return 0, fmt.Errorf("error compressing block: %v", err)
+			return nil, fmt.Errorf("error compressing block: %v", err)
 		}
 		if len(out) < len(buf) {
 			isCompressed = true
@@ -564,61 +741,229 @@ func writeMetadataBlock(buf []byte, to backend.WritableFile, c Compressor, locat
 	if !isCompressed {
 		size |= 1 << 15
 	}
-	header := make([]byte, 2)
+	header := make([]byte, 2, 2+len(buf))
 	binary.LittleEndian.PutUint16(header, size)
-	buf = append(header, buf...)
-	if _, err := to.WriteAt(buf, location); err != nil {
-		return 0, err
+	return append(header, buf...), nil
+}
+
+// dataBlock a full block of the data of a file, or a fragment block, to be compressed by one of the workers
+// of compressInOrder; or, with no data, the start of the data of a file
+type dataBlock struct {
+	file       *finalizeFileInfo
+	data       []byte
+	compressed bool
+	// raw the block is written as it is, without being compressed
+	raw bool
+	err error
+	// done is closed once the block is compressed, or failed to be
+	done chan struct{}
+}
+
+// compress the block with c, if it is not nil and the block gets smaller
+func (b *dataBlock) compress(c Compressor) {
+	defer close(b.done)
+	if c == nil || b.data == nil || b.raw {
+		return
+	}
+	out, err := c.compress(b.data)
+	if err != nil {
+		b.err = fmt.Errorf("error compressing block: %v", err)
+		return
+	}
+	if len(out) < len(b.data) {
+		b.compressed = true
+		b.data = out
+	}
+}
+
+// compressInOrder compress blocks with workers goroutines at once. produce runs in a goroutine of its own and passes
+// each block to emit, which returns false once produce should stop. consume gets every block back, once it is
+// compressed, in the order it was emitted rather than the order it finished in, so what it writes is the same
+// whatever the number of workers. A block with no data, with an error, or that is raw, is passed to consume as it is.
+// Stops at the first error from consume, and returns it once produce and the workers are done.
+func compressInOrder(compressor Compressor, workers int, produce func(emit func(b *dataBlock) bool), consume func(b *dataBlock) error) error {
+	workers = max(workers, 1)
+	work := make(chan *dataBlock, workers)
+	// ordered the blocks in the order they are emitted, and so consumed; its size bounds how many are held at once
+	ordered := make(chan *dataBlock, 2*workers)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range work {
+				b.compress(compressor)
+			}
+		}()
+	}
+	send := func(ch chan<- *dataBlock, b *dataBlock) bool {
+		select {
+		case ch <- b:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	emit := func(b *dataBlock) bool {
+		b.done = make(chan struct{})
+		if b.data == nil || b.err != nil || b.raw {
+			close(b.done)
+			return send(ordered, b)
+		}
+		return send(ordered, b) && send(work, b)
 	}
-	return len(buf), nil
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		produce(emit)
+	}()
+
+	var err error
+	for b := range ordered {
+		<-b.done
+		if err = consume(b); err != nil {
+			// produce stops, and then the workers once they have the blocks already emitted
+			close(stop)
+			break
+		}
+	}
+	wg.Wait()
+	return err
 }
 
-func writeDataBlocks(fileList []*finalizeFileInfo, f backend.WritableFile, ws string, blocksize int, compressor Compressor, location int64) (int, error) {
-	allBlocks := 0
+// writeDataBlocks write the full blocks of data of every regular file out to f, starting at location, with
+// workers goroutines compressing blocks at once. The partial block at the end of a file is left for the
+// fragments. Returns the total written.
+func writeDataBlocks(fileList []*finalizeFileInfo, f io.WriterAt, src finalizeSource, blocksize int, compressor Compressor, workers int, location int64) (int, error) {
 	allWritten := 0
+	err := compressInOrder(compressor, workers, func(emit func(b *dataBlock) bool) {
+		readDataBlocks(fileList, src, blocksize, compressor, emit)
+	}, func(b *dataBlock) error {
+		e := b.file
+		if b.err != nil {
+			return fmt.Errorf("error writing data for %s to file: %v", e.path, b.err)
+		}
+		if b.data == nil {
+			// save the information we need for usage later in inodes to find the file data
+			e.dataLocation = location + int64(allWritten)
+			e.startBlock = uint64(e.dataLocation)
+			e.blocks = make([]*blockData, 0)
+			return nil
+		}
+		if _, err := f.WriteAt(b.data, location+int64(allWritten)); err != nil {
+			return fmt.Errorf("error writing data for %s to file: %v", e.path, err)
+		}
+		e.blocks = append(e.blocks, &blockData{size: uint32(len(b.data)), compressed: b.compressed})
+		allWritten += len(b.data)
+		return nil
+	})
+	return allWritten, err
+}
+
+// readDataBlocks read the full blocks of every regular file and emit them, each file preceded by a block with
+// no data to mark its start. A file that cannot be read is emitted as a block with an error, after which no
+// more are read. The blocks of a file in another squashfs image with the same block size are taken from it
+// as they are stored, where they can be written with compressor as they are.
+func readDataBlocks(fileList []*finalizeFileInfo, src finalizeSource, blocksize int, compressor Compressor, emit func(b *dataBlock) bool) {
+	rawSource, _ := src.(rawFileSource)
 	for _, e := range fileList {
 		// only copy data for normal files
 		if e.fileType != fileRegular {
 			continue
 		}
-
-		blocks, written, err := writeFileDataBlocks(e, f, ws, uint64(allBlocks), blocksize, compressor, location)
+		if !emit(&dataBlock{file: e}) {
+			return
+		}
+		if rawSource != nil {
+			if raw := rawSource.rawFile(e.path); raw != nil && int(raw.fs.superblock.blocksize) == blocksize {
+				for i := 0; i < int(e.Size()/int64(blocksize)); i++ {
+					b, err := raw.dataBlock(i, compressor)
+					if err != nil {
+						emit(&dataBlock{file: e, err: fmt.Errorf("error copying file %s: %v", e.Name(), err)})
+						return
+					}
+					b.file = e
+					if !emit(b) {
+						return
+					}
+				}
+				continue
+			}
+		}
+		from, err := src.open(e.path)
 		if err != nil {
-			return allWritten, fmt.Errorf("error writing data for %s to file: %v", e.path, err)
+			emit(&dataBlock{file: e, err: fmt.Errorf("failed to open file for reading %s: %v", e.path, err)})
+			return
+		}
+		for offset := int64(0); ; offset += int64(blocksize) {
+			buf := make([]byte, blocksize)
+			n, err := from.ReadAt(buf, offset)
+			if err != nil && err != io.EOF {
+				_ = from.Close()
+				emit(&dataBlock{file: e, err: fmt.Errorf("error copying file %s: %v", e.Name(), err)})
+				return
+			}
+			if n != len(buf) {
+				break
+			}
+			if !emit(&dataBlock{file: e, data: buf}) {
+				_ = from.Close()
+				return
+			}
 		}
-		allBlocks += blocks
-		allWritten += written
+		_ = from.Close()
 	}
-	return allWritten, nil
 }
 
-// writeFragmentBlocks writes all of the fragment blocks to the archive. Returns slice of blocks written, the total bytes written, any error
-func writeFragmentBlocks(fileList []*finalizeFileInfo, f backend.WritableFile, ws string, blocksize int, options FinalizeOptions, location int64) ([]fragmentBlock, int64, error) {
+// writeFragmentBlocks writes all of the fragment blocks to the archive, with workers goroutines compressing
+// blocks at once. Returns slice of blocks written, the total bytes written, any error
+func writeFragmentBlocks(fileList []*finalizeFileInfo, f io.WriterAt, src finalizeSource, blocksize int, options FinalizeOptions, workers int, location int64) ([]fragmentBlock, int64, error) {
 	compressor := options.Compression
 	if options.NoCompressFragments {
 		compressor = nil
 	}
-	fragmentData := make([]byte, 0)
 	var (
-		allWritten         int64
-		fragmentBlockIndex uint32
-		fragmentBlocks     []fragmentBlock
+		allWritten     int64
+		fragmentBlocks []fragmentBlock
 	)
-	fileCloseList := make([]*os.File, 0)
-	defer func() {
-		for _, f := range fileCloseList {
-			f.Close()
+	err := compressInOrder(compressor, workers, func(emit func(b *dataBlock) bool) {
+		readFragmentBlocks(fileList, src, blocksize, emit)
+	}, func(b *dataBlock) error {
+		if b.err != nil {
+			return b.err
 		}
-	}()
+		if _, err := f.WriteAt(b.data, location); err != nil {
+			return fmt.Errorf("error writing fragment block %d: %v", len(fragmentBlocks), err)
+		}
+		fragmentBlocks = append(fragmentBlocks, fragmentBlock{
+			size:       uint32(len(b.data)),
+			compressed: b.compressed,
+			location:   location,
+		})
+		location += int64(len(b.data))
+		allWritten += int64(len(b.data))
+		return nil
+	})
+	if err != nil {
+		return fragmentBlocks, 0, err
+	}
+	return fragmentBlocks, allWritten, nil
+}
+
+// readFragmentBlocks pack the partial block at the end of every regular file into fragment blocks, recording
+// where in them each file's is, and emit each block once it is full. A file that cannot be read is emitted as
+// a block with an error, after which no more are read.
+func readFragmentBlocks(fileList []*finalizeFileInfo, src finalizeSource, blocksize int, emit func(b *dataBlock) bool) {
+	var (
+		fragmentData       []byte
+		fragmentBlockIndex uint32
+	)
 	for _, e := range fileList {
 		// only copy data for regular files
 		if e.fileType != fileRegular {
 			continue
 		}
-		var (
-			written int64
-			err     error
-		)
 
 		// how much is there to put in a fragment?
 		remainder := e.Size() % int64(blocksize)
@@ -628,18 +973,13 @@ func writeFragmentBlocks(fileList []*finalizeFileInfo, f backend.WritableFile, w
 
 		// would adding this data cause us to write?
 		if len(fragmentData)+int(remainder) > blocksize {
-			written, compressed, err := finalizeFragment(fragmentData, f, location, compressor)
-			if err != nil {
-				return fragmentBlocks, 0, fmt.Errorf("error writing fragment block %d: %v", fragmentBlockIndex, err)
+			if !emit(&dataBlock{data: fragmentData}) {
+				return
 			}
-			fragmentBlocks = append(fragmentBlocks, fragmentBlock{
-				size:       uint32(written),
-				compressed: compressed,
-				location:   location,
-			})
-			// increment as all writes will be to next block block
+			// increment as all writes will be to next block block; the one emitted is still being compressed,
+			// so it cannot be reused
 			fragmentBlockIndex++
-			fragmentData = fragmentData[:blocksize]
+			fragmentData = make([]byte, 0, blocksize)
 		}
 
 		e.fragment = &fragmentRef{
@@ -647,120 +987,35 @@ func writeFragmentBlocks(fileList []*finalizeFileInfo, f backend.WritableFile, w
 			offset: uint32(len(fragmentData)),
 		}
 		// save the fragment data from the file
-
-		from, err := os.Open(path.Join(ws, e.path))
+		from, err := src.open(e.path)
 		if err != nil {
-			return fragmentBlocks, 0, fmt.Errorf("failed to open file for reading %s: %v", e.path, err)
+			emit(&dataBlock{file: e, err: fmt.Errorf("failed to open file for reading %s: %v", e.path, err)})
+			return
 		}
-		fileCloseList = append(fileCloseList, from)
 		buf := make([]byte, remainder)
 		n, err := from.ReadAt(buf, e.Size()-remainder)
+		_ = from.Close()
 		if err != nil && err != io.EOF {
-			return fragmentBlocks, 0, fmt.Errorf("error reading final %d bytes from file %s: %v", remainder, e.Name(), err)
+			emit(&dataBlock{file: e, err: fmt.Errorf("error reading final %d bytes from file %s: %v", remainder, e.Name(), err)})
+			return
 		}
 		if n != len(buf) {
-			return fragmentBlocks, 0, fmt.Errorf("failed reading final %d bytes from file %s, only read %d", remainder, e.Name(), n)
+			emit(&dataBlock{file: e, err: fmt.Errorf("failed reading final %d bytes from file %s, only read %d", remainder, e.Name(), n)})
+			return
 		}
-		from.Close()
 		fragmentData = append(fragmentData, buf...)
-
-		allWritten += written
-		if written > 0 {
-			fragmentBlockIndex++
-		}
 	}
 
-	// write remaining fragment data
+	// emit remaining fragment data
 	if len(fragmentData) > 0 {
-		written, compressed, err := finalizeFragment(fragmentData, f, location, compressor)
-		if err != nil {
-			return fragmentBlocks, 0, fmt.Errorf("error writing fragment block %d: %v", fragmentBlockIndex, err)
-		}
-		fragmentBlocks = append(fragmentBlocks, fragmentBlock{
-			size:       uint32(written),
-			compressed: compressed,
-			location:   location,
-		})
-		// increment as all writes will be to next block block
-		allWritten += int64(written)
-	}
-	return fragmentBlocks, allWritten, nil
-}
-
-func writeInodes(files []*finalizeFileInfo, f backend.WritableFile, compressor Compressor, location int64) (inodesWritten int, finalLocation uint64, err error) {
-	var (
-		buf             []byte
-		maxSize         = int(metadataBlockSize)
-		initialLocation = location
-	)
-	for _, e := range files {
-		// keep writing until we run out, or we hit 8KB
-		buf = append(buf, e.inode.toBytes()...)
-		if len(buf) > maxSize {
-			written, err := writeMetadataBlock(buf[:maxSize], f, compressor, location)
-			if err != nil {
-				return inodesWritten, 0, err
-			}
-			// count all we have written
-			inodesWritten += written
-			// increment for next write
-			location += int64(written)
-			// truncate all except what we wrote
-			buf = buf[maxSize:]
-		}
-	}
-	// was there anything left?
-	if len(buf) > 0 {
-		written, err := writeMetadataBlock(buf, f, compressor, location)
-		if err != nil {
-			return inodesWritten, 0, err
-		}
-		inodesWritten += written
-	}
-	return inodesWritten, uint64(initialLocation), nil
-}
-
-// writeDirectories write all directories out to disk. Assumes it already has been optimized.
-func writeDirectories(dirs []*finalizeFileInfo, f backend.WritableFile, compressor Compressor, location int64) (directoriesWritten int, finalLocation uint64, err error) {
-	var (
-		buf             []byte
-		maxSize         = int(metadataBlockSize)
-		initialLocation = location
-	)
-	for i, d := range dirs {
-		if d.directory == nil {
-			return 0, 0, fmt.Errorf("empty directory info for position %d", i)
-		}
-		// keep writing until we run out, or we hit metadata maxSize of 8KB
-		buf = append(buf, d.directory.toBytes(d.directory.inodeIndex)...)
-		if len(buf) > maxSize {
-			written, err := writeMetadataBlock(buf[:maxSize], f, compressor, location)
-			if err != nil {
-				return directoriesWritten, 0, err
-			}
-			// count all we have written
-			directoriesWritten += written
-			// increment for next write
-			location += int64(written)
-			// truncate all except what we wrote
-			buf = buf[maxSize:]
-		}
-	}
-	// was there anything left?
-	if len(buf) > 0 {
-		written, err := writeMetadataBlock(buf, f, compressor, location)
-		if err != nil {
-			return directoriesWritten, 0, err
-		}
-		directoriesWritten += written
+		emit(&dataBlock{data: fragmentData})
 	}
-	return directoriesWritten, uint64(initialLocation), nil
 }
 
 // writeFragmentTable write the fragment table
 //
 //nolint:unparam,unused,revive // this does not use fragmentBlocksStart yet, but only because we have not yet added support
-func writeFragmentTable(fragmentBlocks []fragmentBlock, fragmentBlocksStart int64, f backend.WritableFile, compressor Compressor, location int64) (fragmentsWritten int, finalLocation uint64, err error) {
+func writeFragmentTable(fragmentBlocks []fragmentBlock, fragmentBlocksStart int64, f io.WriterAt, compressor Compressor, location int64) (fragmentsWritten int, finalLocation uint64, err error) {
 	// now write the actual fragment table entries
 	var (
 		indexEntries []uint64
@@ -822,7 +1077,7 @@ func writeFragmentTable(fragmentBlocks []fragmentBlock, fragmentBlocksStart int6
 }
 
 // writeExportTable write the export table at the given location.
-func writeExportTable(files []*finalizeFileInfo, f backend.WritableFile, compressor Compressor, location int64) (entriesWritten int, finalLocation uint64, err error) {
+func writeExportTable(files []*finalizeFileInfo, f io.WriterAt, compressor Compressor, location int64) (entriesWritten int, finalLocation uint64, err error) {
 	var (
 		maxSize = int(metadataBlockSize)
 	)
@@ -840,8 +1095,8 @@ func writeExportTable(files []*finalizeFileInfo, f backend.WritableFile, compres
 	)
 	for _, e := range files {
 		entry := make([]byte, 8)
-		binary.LittleEndian.PutUint32(entry[2:6], e.inodeLocation.block)
-		binary.LittleEndian.PutUint16(entry[6:8], e.inodeLocation.offset)
+		ref := inodeRef{block: e.inodeLocation.block, offset: e.inodeLocation.offset}
+		binary.LittleEndian.PutUint64(entry, ref.toUint64())
 		buf = append(buf, entry...)
 		if len(buf) >= maxSize {
 			written, err := writeMetadataBlock(buf[:maxSize], f, compressor, location)
@@ -882,7 +1137,7 @@ func writeExportTable(files []*finalizeFileInfo, f backend.WritableFile, compres
 }
 
 // writeIDTable write the uidgid table at the given location.
-func writeIDTable(idtable map[uint32]uint16, f backend.WritableFile, compressor Compressor, location int64) (entriesWritten int, finalLocation uint64, err error) {
+func writeIDTable(idtable map[uint32]uint16, f io.WriterAt, compressor Compressor, location int64) (entriesWritten int, finalLocation uint64, err error) {
 	var (
 		maxSize = int(metadataBlockSize)
 	)
@@ -942,12 +1197,13 @@ func writeIDTable(idtable map[uint32]uint16, f backend.WritableFile, compressor
 }
 
 // writeXattrs write the xattrs and its lookup table at the given location.
-func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor Compressor, location int64) (xattrsWritten int, finalLocation uint64, err error) {
+func writeXattrs(xattrs []map[string]string, f io.WriterAt, compressor Compressor, location int64) (xattrsWritten int, finalLocation uint64, err error) {
 	var (
 		maxSize     = int(metadataBlockSize)
 		offset      int
 		lookupTable []byte
 		buf         []byte
+		start       = location
 	)
 
 	// each entry in the xattrs slice is a unique key-value map. It may be referenced by one or more inodes.
@@ -955,7 +1211,14 @@ func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor
 	for _, m := range xattrs {
 		// process one xattr key-value map
 		var single []byte
-		for k, v := range m {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		// in order, so that the same attributes are written the same each time
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := m[k]
 			// convert it to the proper type
 			// the entry
 			prefix, name, err := xAttrKeyConvert(k)
@@ -964,7 +1227,7 @@ func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor
 			}
 			b := make([]byte, 4)
 			binary.LittleEndian.PutUint16(b[0:2], prefix)
-			binary.LittleEndian.PutUint16(b[2:4], uint16(len(k)))
+			binary.LittleEndian.PutUint16(b[2:4], uint16(len(name)))
 			b = append(b, []byte(name)...)
 			single = append(single, b...)
 
@@ -975,10 +1238,9 @@ func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor
 		}
 		// add the index
 		b := make([]byte, 16)
-		// bits 16:48 (uint32) hold the block position
-		binary.LittleEndian.PutUint32(b[2:6], uint32(xattrsWritten))
-		// bits 48:64 (uint16) hold the offset in the uncompressed block
-		binary.LittleEndian.PutUint16(b[6:8], uint16(offset))
+		// bits 16:64 hold the position of the metadata block from the start of the xattrs,
+		// and bits 0:16 the offset in the uncompressed block
+		binary.LittleEndian.PutUint64(b[0:8], uint64(xattrsWritten)<<16|uint64(offset))
 		// bytes 8:12 (uint32) hold the number of pairs
 		binary.LittleEndian.PutUint32(b[8:12], uint32(len(m)))
 		// bytes 12:16 (uint32) hold the size of the entire map for this inode
@@ -1017,21 +1279,8 @@ func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor
 	var indexEntries []uint64
 
 	// write the lookupTable - this too is stored as metadata blocks
-	var i int
-	for i = 0; i < len(lookupTable); i += maxSize {
-		written, err := writeMetadataBlock(lookupTable[i*maxSize:i*maxSize+maxSize], f, compressor, location)
-		if err != nil {
-			return xattrsWritten, 0, err
-		}
-		indexEntries = append(indexEntries, uint64(location))
-		// count all we have written
-		xattrsWritten += written
-		location += int64(written)
-	}
-	// was there any left?
-	remainder := len(lookupTable) % maxSize
-	if remainder > 0 {
-		written, err := writeMetadataBlock(lookupTable[remainder:], f, compressor, location)
+	for i := 0; i < len(lookupTable); i += maxSize {
+		written, err := writeMetadataBlock(lookupTable[i:min(i+maxSize, len(lookupTable))], f, compressor, location)
 		if err != nil {
 			return xattrsWritten, 0, err
 		}
@@ -1040,14 +1289,12 @@ func writeXattrs(xattrs []map[string]string, f backend.WritableFile, compressor
 		xattrsWritten += written
 		location += int64(written)
 	}
-	// finally, we need the ID table
-	b := make([]byte, 16+8*len(indexEntries))
-	binary.LittleEndian.PutUint64(b[0:8], uint64(location))
-	binary.LittleEndian.PutUint32(b[8:12], uint32(len(lookupTable)))
+	// finally, we need the ID table: where the xattrs start, how many there are, and the lookup table blocks
+	b := make([]byte, 16, 16+8*len(indexEntries))
+	binary.LittleEndian.PutUint64(b[0:8], uint64(start))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(xattrs)))
 	for _, e := range indexEntries {
-		b2 := make([]byte, 8)
-		binary.LittleEndian.PutUint64(b2, e)
-		b = append(b, b2...)
+		b = binary.LittleEndian.AppendUint64(b, e)
 	}
 
 	// just write it out
@@ -1080,7 +1327,7 @@ func xAttrKeyConvert(key string) (prefixID uint16, prefix string, err error) {
 }
 
 // createInodes create an inode of appropriate type for each file, and attach it to the finalizeFileInfo
-func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, options FinalizeOptions) error {
+func createInodes(fileList []*finalizeFileInfo, src finalizeSource, idtable map[uint32]uint16, options FinalizeOptions) error {
 	// get the inodes
 	var inodeIndex uint32 = 1
 
@@ -1109,6 +1356,8 @@ func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, optio
 					blockSizes: e.blocks,
 					links:      e.links,
 					xAttrIndex: e.xAttrIndex,
+					// no fragment unless there is one
+					fragmentBlockIndex: noFragmentFlag,
 				}
 				if e.fragment != nil {
 					ef.fragmentBlockIndex = e.fragment.block
@@ -1122,6 +1371,8 @@ func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, optio
 					startBlock: uint32(e.startBlock),
 					fileSize:   uint32(e.Size()),
 					blockSizes: e.blocks,
+					// no fragment unless there is one
+					fragmentBlockIndex: noFragmentFlag,
 				}
 				if e.fragment != nil {
 					bf.fragmentBlockIndex = e.fragment.block
@@ -1139,7 +1390,7 @@ func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, optio
 				- it has extended attributes
 				- it has hard links
 			*/
-			target, err := os.Readlink(e.path)
+			target, err := src.readlink(e.path)
 			if err != nil {
 				return fmt.Errorf("unable to read target for symlink at %s: %v", e.path, err)
 			}
@@ -1183,7 +1434,7 @@ func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, optio
 				inodeT = inodeBasicDirectory
 			}
 		case fileBlock:
-			major, minor, err := getDeviceNumbers(e.path)
+			major, minor, err := src.deviceNumbers(e.path)
 			if err != nil {
 				return fmt.Errorf("unable to read major/minor device numbers for block device at %s: %v", e.path, err)
 			}
@@ -1208,7 +1459,7 @@ func createInodes(fileList []*finalizeFileInfo, idtable map[uint32]uint16, optio
 				inodeT = inodeBasicBlock
 			}
 		case fileChar:
-			major, minor, err := getDeviceNumbers(e.path)
+			major, minor, err := src.deviceNumbers(e.path)
 			if err != nil {
 				return fmt.Errorf("unable to read major/minor device numbers for char device at %s: %v", e.path, err)
 			}
@@ -1336,6 +1587,8 @@ func hashStringMap(m map[string]string) string {
 	for k, v := range m {
 		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
 	}
+	// maps are not ranged over in order, but the same one must make the same hash
+	sort.Strings(pairs)
 	return strings.Join(pairs, ";")
 }
 
@@ -1355,18 +1608,73 @@ type blockPosition struct {
 	size   int
 }
 
-// createDirectories append directory structure to every finalizeFileInfo that is a directory.
-// Returns a slice pointing to all finalizeFileInfo that are directories and have been populated.
-func createDirectories(e *finalizeFileInfo) []*finalizeFileInfo {
+// metadataTable a table of metadata blocks, such as the inode or directory table, built up in memory.
+// Anything added to it is referenced by the position of the start of its block from the start of the
+// table, which depends on how well each earlier block compressed, and its offset in the uncompressed block.
+type metadataTable struct {
+	compressor Compressor
+	blocks     []byte // complete blocks, as they are written out
+	buf        []byte // the current block, not yet complete
+}
+
+// position where the next thing added will be
+func (m *metadataTable) position() blockPosition {
+	return blockPosition{block: uint32(len(m.blocks)), offset: uint16(len(m.buf))}
+}
+
+func (m *metadataTable) add(b []byte) error {
+	m.buf = append(m.buf, b...)
+	for len(m.buf) >= int(metadataBlockSize) {
+		block, err := metadataBlock(m.buf[:metadataBlockSize], m.compressor)
+		if err != nil {
+			return err
+		}
+		m.blocks = append(m.blocks, block...)
+		m.buf = m.buf[metadataBlockSize:]
+	}
+	return nil
+}
+
+// writeTo write the whole table, including any incomplete last block, returning how much was written
+func (m *metadataTable) writeTo(f io.WriterAt, location int64) (int, error) {
+	b := m.blocks
+	if len(m.buf) > 0 {
+		block, err := metadataBlock(m.buf, m.compressor)
+		if err != nil {
+			return 0, err
+		}
+		b = append(b, block...)
+	}
+	return f.WriteAt(b, location)
+}
+
+// metadataTables the inode and directory tables, which refer to each other
+type metadataTables struct {
+	inodes      metadataTable
+	directories metadataTable
+}
+
+// addDirectory add the inodes of everything in the directory, then its entries, then its own inode.
+// parent is the inode number of the directory containing it, which for the root is one more than the
+// number of inodes.
+func (t *metadataTables) addDirectory(d *finalizeFileInfo, parent uint32) error {
 	var (
-		dirs    = make([]*finalizeFileInfo, 0)
-		entries = make([]*directoryEntryRaw, 0)
+		entries = make([]*directoryEntryRaw, 0, len(d.children))
+		subdirs uint32
 	)
-	// go through each entry, and create a directory structure for it
-	// we will cycle through each directory, creating an entry for it
-	// and its children. A second pass will split into headers
-	for _, child := range e.children {
-		blockPos := child.inodeLocation
+	for _, child := range d.children {
+		if child.IsDir() {
+			subdirs++
+			if err := t.addDirectory(child, d.inode.index()); err != nil {
+				return err
+			}
+		} else {
+			child.inodeLocation = t.inodes.position()
+			if err := t.inodes.add(child.inode.toBytes()); err != nil {
+				return err
+			}
+		}
+		// the directory table always uses the basic inode types
 		var iType inodeType
 		switch child.fileType {
 		case fileRegular:
@@ -1384,100 +1692,48 @@ func createDirectories(e *finalizeFileInfo) []*finalizeFileInfo {
 		case fileSocket:
 			iType = inodeBasicSocket
 		}
-		entry := &directoryEntryRaw{
+		entries = append(entries, &directoryEntryRaw{
 			name:           child.Name(),
 			isSubdirectory: child.IsDir(),
-			startBlock:     blockPos.block,
-			offset:         blockPos.offset,
+			startBlock:     child.inodeLocation.block,
+			offset:         child.inodeLocation.offset,
 			inodeType:      iType,
 			inodeNumber:    child.inode.index(),
-			// we do not yet know the inodeNumber, which is an offset from the one in the header
-			// it will be filled in later
-		}
-		// set the inode type. It doesn't use extended, just the basic ones.
-		entries = append(entries, entry)
-	}
-	e.directory = &directory{
-		entries: entries,
-	}
-	dirs = append(dirs, e)
-	// do children in a separate loop, so that we get all of the children lined up
-	for _, child := range e.children {
-		if child.IsDir() {
-			dirs = append(dirs, createDirectories(child)...)
-		}
-	}
-	return dirs
-}
-
-// updateInodeLocations update each inode with where it will be on disk
-// i.e. the inode block, and the offset into the block
-func updateInodeLocations(files []*finalizeFileInfo) {
-	var pos int64
-
-	// get block position for each inode
-	for _, f := range files {
-		b := f.inode.toBytes()
-		block, offset := uint32(pos/metadataBlockSize), uint16(pos%metadataBlockSize)
-		blockPos := block * (standardMetadataBlocksize + 2)
-		f.inodeLocation = blockPosition{
-			block:  blockPos,
-			offset: offset,
-			size:   len(b),
-		}
-		pos += int64(len(b))
+		})
 	}
-}
 
-// populateDirectoryLocations get a map of each directory index and where it will be
-// on disk i.e. the directory block, and the offset into the block
-func populateDirectoryLocations(directories []*finalizeFileInfo) {
-	// keeps our reference
-	pos := 0
-
-	// get block position for each inode
-	for _, d := range directories {
-		// we start without knowing the inode block/number
-		// in any case, this func is just here to give us sizes and therefore
-		// locations inside the directory metadata blocks, not actual writable
-		// bytes
-		if d.directory == nil {
-			continue
-		}
-		b := d.directory.toBytes(0)
-		d.directoryLocation = blockPosition{
-			block:  uint32(pos / int(metadataBlockSize)),
-			offset: uint16(pos % int(metadataBlockSize)),
-			size:   len(b),
-		}
-		pos += len(b)
+	d.directory = &directory{entries: entries}
+	b := d.directory.toBytes()
+	d.directoryLocation = t.directories.position()
+	d.directoryLocation.size = len(b)
+	if err := t.directories.add(b); err != nil {
+		return err
 	}
-}
 
-// updateInodesFromDirectories update the blockPosition for each directory
-// inode.
-func updateInodesFromDirectories(files []*finalizeFileInfo) error {
-	// go through each directory, find its inode, and update it with the
-	// correct block and offset
-	for i, d := range files {
-		if d.directory == nil {
-			return fmt.Errorf("file at index %d missing directory information", i)
-		}
-		index := d.directory.inodeIndex
-		in := d.inode
-		inBody := in.getBody()
-		switch dir := inBody.(type) {
-		case *basicDirectory:
-			dir.startBlock = d.directoryLocation.block
-			dir.offset = d.directoryLocation.offset
-			dir.fileSize = uint16(d.directoryLocation.size)
-		case *extendedDirectory:
-			dir.startBlock = d.directoryLocation.block
-			dir.offset = d.directoryLocation.offset
-			dir.fileSize = uint32(d.directoryLocation.size)
-		default:
-			return fmt.Errorf("inode at index %d from directory at index %d was unexpected type", index, i)
-		}
+	// the size of a directory includes the 3 bytes of the implied . and .. entries
+	size := uint32(len(b) + 3)
+	if _, ok := d.inode.getBody().(*basicDirectory); ok && size > math.MaxUint16 {
+		// too big for a basic directory
+		header := d.inode.getHeader()
+		header.inodeType = inodeExtendedDirectory
+		d.inode = &inodeImpl{header: header, body: &extendedDirectory{xAttrIndex: noXattrInodeFlag}}
+	}
+	switch dir := d.inode.getBody().(type) {
+	case *basicDirectory:
+		dir.startBlock = d.directoryLocation.block
+		dir.offset = d.directoryLocation.offset
+		dir.fileSize = uint16(size)
+		dir.links = subdirs + 2
+		dir.parentInodeIndex = parent
+	case *extendedDirectory:
+		dir.startBlock = d.directoryLocation.block
+		dir.offset = d.directoryLocation.offset
+		dir.fileSize = size
+		dir.links = subdirs + 2
+		dir.parentInodeIndex = parent
+	default:
+		return fmt.Errorf("inode for directory %s was unexpected type %T", d.path, dir)
 	}
-	return nil
+	d.inodeLocation = t.inodes.position()
+	return t.inodes.add(d.inode.toBytes())
 }
@@ -3,12 +3,19 @@ package squashfs_test
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/filesystem/squashfs"
 	"github.com/diskfs/go-diskfs/testhelper"
@@ -189,3 +196,782 @@ func validateSquashfs(t *testing.T, f *os.File) {
 		t.Log(outString)
 	}
 }
+
+func TestFinalizeEstimateSize(t *testing.T) {
+	blocksize := int64(4096)
+	tests := []struct {
+		name    string
+		options squashfs.FinalizeOptions
+	}{
+		{"uncompressed", squashfs.FinalizeOptions{}},
+		{"gzip", squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}}},
+		{"no fragments", squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}, NoFragments: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "squashfs_finalize_test")
+			if err != nil {
+				t.Fatalf("Failed to create tmpfile: %v", err)
+			}
+			defer os.Remove(f.Name())
+
+			b := file.New(f, false)
+			fs, err := squashfs.Create(b, 0, 0, blocksize)
+			if err != nil {
+				t.Fatalf("Failed to squashfs.Create: %v", err)
+			}
+			if err := fs.Mkdir("/FOO"); err != nil {
+				t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+			}
+			// a mix of random data, which does not compress, and text, which does
+			random := make([]byte, 3*blocksize+100)
+			_, _ = rand.Read(random)
+			files := map[string][]byte{
+				"/RANDOM":    random,
+				"/FOO/TEXT":  bytes.Repeat([]byte("compressible "), 2000),
+				"/FOO/SMALL": []byte("small\n"),
+				"/FOO/EMPTY": nil,
+				"/README.MD": []byte("readme\n"),
+			}
+			for filename, data := range files {
+				sqsfile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("Failed to squashfs.OpenFile(%s): %v", filename, err)
+				}
+				if _, err := sqsfile.Write(data); err != nil {
+					t.Fatalf("error writing to %s: %v", filename, err)
+				}
+			}
+
+			estimate, err := fs.EstimateSize(tt.options)
+			if err != nil {
+				t.Fatalf("unexpected error estimating size: %v", err)
+			}
+			if fs.Workspace() == "" {
+				t.Fatalf("estimating size finalized the filesystem")
+			}
+			if err := fs.Finalize(tt.options); err != nil {
+				t.Fatalf("unexpected error finalizing: %v", err)
+			}
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatalf("unable to stat image: %v", err)
+			}
+			if info.Size() != estimate {
+				t.Errorf("mismatched size, estimate %d actual %d", estimate, info.Size())
+			}
+		})
+	}
+}
+
+func TestFinalizeFromSource(t *testing.T) {
+	f, err := os.Open(squashfs.Squashfsfile)
+	if err != nil {
+		t.Fatalf("unable to open test image: %v", err)
+	}
+	defer f.Close()
+	src, err := squashfs.Read(file.New(f, true), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read test image: %v", err)
+	}
+
+	b, err := mem.New(20 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}, Xattrs: true, Source: src}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	dst, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read finalized image: %v", err)
+	}
+	compareTrees(t, src, dst, "/")
+}
+
+// compareTrees check that everything in a directory of one filesystem is the same in another
+//
+//nolint:thelper // this is not a helper function
+func compareTrees(t *testing.T, a, b *squashfs.FileSystem, dir string) {
+	aEntries, err := a.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unable to read source directory %s: %v", dir, err)
+	}
+	bEntries, err := b.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unable to read directory %s: %v", dir, err)
+	}
+	if len(aEntries) != len(bEntries) {
+		t.Fatalf("directory %s has %d entries instead of %d", dir, len(bEntries), len(aEntries))
+	}
+	names := map[string]os.FileInfo{}
+	for _, e := range bEntries {
+		names[e.Name()] = e
+	}
+	for _, ae := range aEntries {
+		p := path.Join(dir, ae.Name())
+		be, ok := names[ae.Name()]
+		if !ok {
+			t.Errorf("missing %s", p)
+			continue
+		}
+		aStat, bStat := ae.Sys().(squashfs.FileStat), be.Sys().(squashfs.FileStat)
+		// directory sizes depend on how the directory table is laid out, so only files need match
+		if ae.Mode() != be.Mode() || (!ae.IsDir() && ae.Size() != be.Size()) || !ae.ModTime().Equal(be.ModTime()) ||
+			aStat.UID() != bStat.UID() || aStat.GID() != bStat.GID() || !reflect.DeepEqual(aStat.Xattrs(), bStat.Xattrs()) {
+			t.Errorf("mismatched %s, mode %v size %d time %v owner %d:%d xattrs %v, expected %v %d %v %d:%d %v", p,
+				be.Mode(), be.Size(), be.ModTime(), bStat.UID(), bStat.GID(), bStat.Xattrs(),
+				ae.Mode(), ae.Size(), ae.ModTime(), aStat.UID(), aStat.GID(), aStat.Xattrs())
+		}
+		switch {
+		case ae.IsDir():
+			compareTrees(t, a, b, p)
+		case ae.Mode()&os.ModeSymlink != 0:
+			aTarget, _ := aStat.Readlink()
+			bTarget, err := bStat.Readlink()
+			if err != nil || aTarget != bTarget {
+				t.Errorf("mismatched symlink %s, target %q expected %q, error %v", p, bTarget, aTarget, err)
+			}
+		case ae.Mode().IsRegular():
+			aFile, err := a.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open source file %s: %v", p, err)
+			}
+			bFile, err := b.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open file %s: %v", p, err)
+			}
+			aData, _ := io.ReadAll(aFile)
+			bData, err := io.ReadAll(bFile)
+			if err != nil || !bytes.Equal(aData, bData) {
+				t.Errorf("mismatched contents of %s, error %v", p, err)
+			}
+		}
+	}
+}
+
+func TestFinalizeGraftPoints(t *testing.T) {
+	// a directory and a single file on the host, outside of the workspace
+	hostDir := t.TempDir()
+	if err := os.MkdirAll(path.Join(hostDir, "sub"), 0o755); err != nil {
+		t.Fatalf("unable to create host directory: %v", err)
+	}
+	hostFiles := map[string]string{
+		"a.txt":     "grafted a\n",
+		"sub/b.txt": "grafted b\n",
+	}
+	for name, data := range hostFiles {
+		if err := os.WriteFile(path.Join(hostDir, name), []byte(data), 0o644); err != nil {
+			t.Fatalf("unable to write host file: %v", err)
+		}
+	}
+	hostFile := path.Join(t.TempDir(), "single.conf")
+	if err := os.WriteFile(hostFile, []byte("single\n"), 0o600); err != nil {
+		t.Fatalf("unable to write host file: %v", err)
+	}
+
+	b, err := mem.New(20 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	if err := fs.Mkdir("/etc"); err != nil {
+		t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+	}
+	sqsfile, err := fs.OpenFile("/etc/hosts", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+	}
+	if _, err := sqsfile.Write([]byte("workspace\n")); err != nil {
+		t.Fatalf("error writing to file: %v", err)
+	}
+	options := squashfs.FinalizeOptions{
+		GraftPoints: []squashfs.GraftPoint{
+			{Source: hostDir, Target: "/opt/data"},
+			{Source: hostFile, Target: "/etc/app/single.conf"},
+			// merged with the directory in the workspace
+			{Source: hostDir, Target: "/etc"},
+		},
+	}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+
+	dst, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read finalized image: %v", err)
+	}
+	expected := map[string]string{
+		"/etc/hosts":           "workspace\n",
+		"/etc/a.txt":           "grafted a\n",
+		"/etc/sub/b.txt":       "grafted b\n",
+		"/etc/app/single.conf": "single\n",
+		"/opt/data/a.txt":      "grafted a\n",
+		"/opt/data/sub/b.txt":  "grafted b\n",
+	}
+	for p, data := range expected {
+		f, err := dst.OpenFile(p, os.O_RDONLY)
+		if err != nil {
+			t.Errorf("unable to open %s: %v", p, err)
+			continue
+		}
+		b, err := io.ReadAll(f)
+		if err != nil || string(b) != data {
+			t.Errorf("mismatched contents of %s, got %q expected %q, error %v", p, b, data, err)
+		}
+	}
+	entries, err := dst.ReadDir("/etc")
+	if err != nil {
+		t.Fatalf("unable to read /etc: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// in name order, as squashfs requires
+	if want := []string{"a.txt", "app", "hosts", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("mismatched entries of /etc, got %v expected %v", names, want)
+	}
+
+	// two files in the same place
+	fs, err = squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	options.GraftPoints = []squashfs.GraftPoint{{Source: hostFile, Target: "/x"}, {Source: hostFile, Target: "/x"}}
+	if err := fs.Finalize(options); err == nil {
+		t.Errorf("expected error grafting two files at the same path")
+	}
+}
+
+func TestFinalizeNameNormalization(t *testing.T) {
+	// decomposed, as written on macOS
+	const (
+		nfdDir  = "cafe\u0301"
+		nfdFile = "a\u0308.txt"
+	)
+	b, err := mem.New(1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	if err := fs.Mkdir("/" + nfdDir); err != nil {
+		t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+	}
+	for _, name := range []string{nfdFile, "b.txt"} {
+		f, err := fs.OpenFile(path.Join("/", nfdDir, name), os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+		}
+		if _, err := f.Write([]byte(name)); err != nil {
+			t.Fatalf("error writing to file: %v", err)
+		}
+	}
+	options := squashfs.FinalizeOptions{NameNormalization: filesystem.NameNormalization{Form: filesystem.NormalizationNFC}}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+
+	dst, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read finalized image: %v", err)
+	}
+	entries, err := dst.ReadDir("/caf\u00e9")
+	if err != nil {
+		t.Fatalf("unable to read directory by its composed name: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// composed, and in the order of the composed names
+	if want := []string{"b.txt", "\u00e4.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("mismatched entries, got %q expected %q", names, want)
+	}
+	p := path.Join("/", nfdDir, nfdFile)
+	if _, err := dst.OpenFile(p, os.O_RDONLY); err == nil {
+		t.Errorf("opened %q by its decomposed name without normalization", p)
+	}
+	if err := dst.SetNameNormalization(filesystem.NameNormalization{Form: filesystem.NormalizationNFD}); err != nil {
+		t.Fatalf("unable to set normalization: %v", err)
+	}
+	f, err := dst.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unable to open %q: %v", p, err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != nfdFile {
+		t.Errorf("mismatched contents of %q, got %q expected %q, error %v", p, data, nfdFile, err)
+	}
+
+	// both forms of a name in a directory
+	for _, strict := range []bool{false, true} {
+		fs, err = squashfs.Create(b, 0, 0, 4096)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.Create: %v", err)
+		}
+		for _, name := range []string{nfdFile, "\u00e4.txt"} {
+			if _, err := fs.OpenFile("/"+name, os.O_CREATE|os.O_RDWR); err != nil {
+				t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+			}
+		}
+		options.NameNormalization.Strict = strict
+		err = fs.Finalize(options)
+		switch {
+		case strict && !errors.Is(err, filesystem.ErrAmbiguousName):
+			t.Errorf("finalizing ambiguous names strictly gave error %v, expected %v", err, filesystem.ErrAmbiguousName)
+		case !strict && err != nil:
+			t.Errorf("unexpected error finalizing ambiguous names: %v", err)
+		}
+	}
+}
+
+func TestFinalizeWorkers(t *testing.T) {
+	blocksize := int64(4096)
+	// a source image with many blocks, some of which compress and some of which do not, and tails that do not
+	// fit in one fragment block
+	srcBackend, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(srcBackend, 0, 0, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		random := make([]byte, 20*blocksize+int64(i)*500+1)
+		_, _ = rand.Read(random)
+		files := map[string][]byte{
+			fmt.Sprintf("/random%d", i): random,
+			fmt.Sprintf("/text%d", i):   bytes.Repeat([]byte(fmt.Sprintf("compressible %d ", i)), 5000),
+		}
+		for filename, data := range files {
+			sqsfile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("Failed to squashfs.OpenFile(%s): %v", filename, err)
+			}
+			if _, err := sqsfile.Write(data); err != nil {
+				t.Fatalf("error writing to %s: %v", filename, err)
+			}
+		}
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{Workers: 1}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	src, err := squashfs.Read(srcBackend, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read source image: %v", err)
+	}
+
+	// the same contents give the same image byte for byte, whatever the number of workers
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var images [][]byte
+	for _, workers := range []int{1, 4, 16} {
+		b, err := mem.New(4 * 1024 * 1024)
+		if err != nil {
+			t.Fatalf("unable to create buffer: %v", err)
+		}
+		fs, err := squashfs.Create(b, 0, 0, blocksize)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.Create: %v", err)
+		}
+		if err := fs.Finalize(squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}, Source: src, Workers: workers, ModTime: modTime}); err != nil {
+			t.Fatalf("unexpected error finalizing with %d workers: %v", workers, err)
+		}
+		dst, err := squashfs.Read(b, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("unable to read image finalized with %d workers: %v", workers, err)
+		}
+		compareTrees(t, src, dst, "/")
+		image := make([]byte, 4*1024*1024)
+		if _, err := b.ReadAt(image, 0); err != nil {
+			t.Fatalf("unable to read image: %v", err)
+		}
+		images = append(images, image)
+	}
+	for i := 1; i < len(images); i++ {
+		if !bytes.Equal(images[0], images[i]) {
+			t.Errorf("image %d differs from the image finalized with 1 worker", i)
+		}
+	}
+}
+
+func TestFinalizeCompression(t *testing.T) {
+	blocksize := int64(4096)
+	srcBackend, err := mem.New(1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(srcBackend, 0, 0, blocksize)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	random := make([]byte, 10*blocksize+100)
+	_, _ = rand.Read(random)
+	files := map[string][]byte{
+		"/random": random,
+		"/text":   bytes.Repeat([]byte("compressible "), 5000),
+		"/small":  []byte("a small file in a fragment"),
+	}
+	for filename, data := range files {
+		sqsfile, err := fs.OpenFile(filename, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.OpenFile(%s): %v", filename, err)
+		}
+		if _, err := sqsfile.Write(data); err != nil {
+			t.Fatalf("error writing to %s: %v", filename, err)
+		}
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	src, err := squashfs.Read(srcBackend, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read source image: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		compression squashfs.Compressor
+		options     bool
+	}{
+		{"zstd", &squashfs.CompressorZstd{}, false},
+		{"zstd level", &squashfs.CompressorZstd{CompressionLevel: 3}, true},
+		{"lz4", &squashfs.CompressorLz4{}, true},
+		{"lz4 high compression", &squashfs.CompressorLz4{HighCompression: true}, true},
+		{"lzo", &squashfs.CompressorLzo{}, false},
+		{"xz dictionary size", &squashfs.CompressorXz{DictionarySize: 8192}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := mem.New(1024 * 1024)
+			if err != nil {
+				t.Fatalf("unable to create buffer: %v", err)
+			}
+			fs, err := squashfs.Create(b, 0, 0, blocksize)
+			if err != nil {
+				t.Fatalf("Failed to squashfs.Create: %v", err)
+			}
+			if err := fs.Finalize(squashfs.FinalizeOptions{Compression: tt.compression, Source: src}); err != nil {
+				t.Fatalf("unexpected error finalizing: %v", err)
+			}
+			// the superblock flags say whether the compressor options follow it
+			flags := make([]byte, 2)
+			if _, err := b.ReadAt(flags, 24); err != nil {
+				t.Fatalf("unable to read superblock flags: %v", err)
+			}
+			if options := binary.LittleEndian.Uint16(flags)&0x0400 != 0; options != tt.options {
+				t.Errorf("compressor options flag %v instead of %v", options, tt.options)
+			}
+			dst, err := squashfs.Read(b, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("unable to read image: %v", err)
+			}
+			compareTrees(t, src, dst, "/")
+		})
+	}
+}
+
+func TestFinalizeExportTable(t *testing.T) {
+	for _, nonExportable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("non-exportable %v", nonExportable), func(t *testing.T) {
+			b, err := mem.New(4 * 1024 * 1024)
+			if err != nil {
+				t.Fatalf("unable to create buffer: %v", err)
+			}
+			fs, err := squashfs.Create(b, 0, 0, 4096)
+			if err != nil {
+				t.Fatalf("Failed to squashfs.Create: %v", err)
+			}
+			// more than fit in a single metadata block of the export table
+			for i := 0; i < 1500; i++ {
+				dir := fmt.Sprintf("/dir%d", i%10)
+				if err := fs.Mkdir(dir); err != nil {
+					t.Fatalf("Failed to squashfs.Mkdir(%s): %v", dir, err)
+				}
+				f, err := fs.OpenFile(fmt.Sprintf("%s/file%d", dir, i), os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+				}
+				if _, err := f.Write([]byte(fmt.Sprintf("contents of file %d", i))); err != nil {
+					t.Fatalf("error writing file %d: %v", i, err)
+				}
+			}
+			if err := fs.Finalize(squashfs.FinalizeOptions{NonExportable: nonExportable}); err != nil {
+				t.Fatalf("unexpected error finalizing: %v", err)
+			}
+			fs, err = squashfs.Read(b, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("unable to read image: %v", err)
+			}
+			dirs, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("unable to read root directory: %v", err)
+			}
+			if nonExportable {
+				if _, err := fs.OpenInode(dirs[0].Sys().(squashfs.FileStat).Inode()); err == nil {
+					t.Errorf("no error opening inode without an export table")
+				}
+				return
+			}
+			seen := map[uint64]bool{}
+			for _, dir := range dirs {
+				stat := dir.Sys().(squashfs.FileStat)
+				if in, err := fs.OpenInode(stat.Inode()); err != nil || !in.IsDir() {
+					t.Fatalf("unable to open directory %s by inode %d: %v", dir.Name(), stat.Inode(), err)
+				}
+				files, err := fs.ReadDir("/" + dir.Name())
+				if err != nil {
+					t.Fatalf("unable to read directory %s: %v", dir.Name(), err)
+				}
+				for _, fi := range files {
+					inode := fi.Sys().(squashfs.FileStat).Inode()
+					seen[inode] = true
+					in, err := fs.OpenInode(inode)
+					if err != nil {
+						t.Fatalf("unable to open inode %d for %s: %v", inode, fi.Name(), err)
+					}
+					f, err := in.Open()
+					if err != nil {
+						t.Fatalf("unable to open inode %d for reading: %v", inode, err)
+					}
+					data, err := io.ReadAll(f)
+					if err != nil {
+						t.Fatalf("unable to read inode %d: %v", inode, err)
+					}
+					if expected := "contents of " + strings.Replace(fi.Name(), "file", "file ", 1); string(data) != expected {
+						t.Errorf("inode %d for %s has contents %q", inode, fi.Name(), data)
+					}
+				}
+			}
+			if len(seen) != 1500 {
+				t.Errorf("%d distinct inodes instead of 1500", len(seen))
+			}
+		})
+	}
+}
+
+func TestFinalizePseudoFiles(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh to run the command of a pseudo file")
+	}
+	definitions, err := squashfs.ParsePseudoFiles(strings.NewReader(`# a comment, and an empty line
+
+dev d 755 0 0
+dev/console c 600 0 5 5 1
+dev/sda b 660 0 6 8 0
+dev/log i 666 0 0
+run p 644 0 0
+"etc/host name" f 644 0 0 echo myhost
+etc/sh\ link s 777 0 0 /bin/busybox sh
+etc/hosts m 600 10 20
+`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing pseudo files: %v", err)
+	}
+	if len(definitions) != 8 || definitions[5].Path != "etc/host name" || definitions[6].Path != "etc/sh link" ||
+		definitions[6].Target != "/bin/busybox sh" || definitions[1].Major != 5 || definitions[1].Minor != 1 {
+		t.Errorf("unexpected pseudo files %+v", definitions)
+	}
+	for _, invalid := range []string{
+		"dev x 755 0 0",
+		"dev d 855 0 0",
+		"dev d 755 root 0",
+		"dev/null c 666 0 0 1",
+		"dev d 755 0 0 extra",
+		"link s 777 0 0",
+		`"unterminated d 755 0 0`,
+	} {
+		if _, err := squashfs.ParsePseudoFiles(strings.NewReader(invalid)); err == nil {
+			t.Errorf("no error parsing invalid pseudo file %q", invalid)
+		}
+	}
+
+	b, err := mem.New(20 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	if err := fs.Mkdir("/etc"); err != nil {
+		t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+	}
+	if _, err := fs.OpenFile("/etc/hosts", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{PseudoFiles: definitions}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+
+	dst, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read finalized image: %v", err)
+	}
+	expected := map[string]struct {
+		mode     os.FileMode
+		uid, gid uint32
+	}{
+		"/dev":           {os.ModeDir | 0o755, 0, 0},
+		"/dev/console":   {os.ModeDevice | os.ModeCharDevice | 0o600, 0, 5},
+		"/dev/sda":       {os.ModeDevice | 0o660, 0, 6},
+		"/dev/log":       {os.ModeSocket | 0o666, 0, 0},
+		"/run":           {os.ModeNamedPipe | 0o644, 0, 0},
+		"/etc/host name": {0o644, 0, 0},
+		"/etc/sh link":   {os.ModeSymlink | 0o777, 0, 0},
+		"/etc/hosts":     {0o600, 10, 20},
+	}
+	for p, e := range expected {
+		entries, err := dst.ReadDir(path.Dir(p))
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", path.Dir(p), err)
+		}
+		var found os.FileInfo
+		for _, entry := range entries {
+			if entry.Name() == path.Base(p) {
+				found = entry
+			}
+		}
+		if found == nil {
+			t.Errorf("%s is not in the image", p)
+			continue
+		}
+		stat := found.Sys().(squashfs.FileStat)
+		if found.Mode() != e.mode || stat.UID() != e.uid || stat.GID() != e.gid {
+			t.Errorf("%s has mode %v, owner %d:%d instead of %v, %d:%d", p, found.Mode(), stat.UID(), stat.GID(), e.mode, e.uid, e.gid)
+		}
+		if p == "/etc/sh link" {
+			if target, err := stat.Readlink(); err != nil || target != "/bin/busybox sh" {
+				t.Errorf("symlink has target %q instead of /bin/busybox sh, error %v", target, err)
+			}
+		}
+	}
+	f, err := dst.OpenFile("/etc/host name", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unable to open generated file: %v", err)
+	}
+	if content, err := io.ReadAll(f); err != nil || string(content) != "myhost\n" {
+		t.Errorf("generated file has %q instead of the output of its command, error %v", content, err)
+	}
+
+	for _, invalid := range []squashfs.PseudoFile{
+		{Path: "/missing/file", Type: squashfs.PseudoFifo},
+		{Path: "/etc", Type: squashfs.PseudoDirectory},
+		{Path: "/missing", Type: squashfs.PseudoModify},
+		{Path: "/fails", Type: squashfs.PseudoRegularFile, Command: "exit 1"},
+	} {
+		fs, err := squashfs.Create(b, 0, 0, 4096)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.Create: %v", err)
+		}
+		if err := fs.Mkdir("/etc"); err != nil {
+			t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+		}
+		if err := fs.Finalize(squashfs.FinalizeOptions{PseudoFiles: []squashfs.PseudoFile{invalid}}); err == nil {
+			t.Errorf("no error finalizing with invalid pseudo file %+v", invalid)
+		}
+	}
+}
+
+func TestFinalizeSetxattr(t *testing.T) {
+	b, err := mem.New(20 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	for _, p := range []string{"/bin", "/etc"} {
+		if err := fs.Mkdir(p); err != nil {
+			t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+		}
+	}
+	for _, p := range []string{"/bin/ping", "/etc/shadow", "/etc/hosts"} {
+		if _, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+		}
+	}
+	// CAP_NET_RAW, effective and permitted, as setcap cap_net_raw+ep does
+	capability := []byte{0, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	label := []byte("system_u:object_r:shadow_t:s0\x00")
+	for _, x := range []struct {
+		path, name string
+		value      []byte
+	}{
+		{"/bin/ping", "security.capability", capability},
+		{"/etc/shadow", "security.selinux", label},
+		{"/etc/shadow", "user.comment", []byte("removed")},
+		{"/etc/hosts", "security.selinux", []byte("system_u:object_r:net_conf_t:s0\x00")},
+		{"/", "security.selinux", []byte("system_u:object_r:root_t:s0\x00")},
+	} {
+		if err := fs.Setxattr(x.path, x.name, x.value); err != nil {
+			t.Fatalf("unexpected error setting %s of %s: %v", x.name, x.path, err)
+		}
+	}
+	if err := fs.Removexattr("/etc/shadow", "user.comment"); err != nil {
+		t.Fatalf("unexpected error removing xattr: %v", err)
+	}
+	if err := fs.Setxattr("/etc/hosts", "system.posix_acl_access", nil); err == nil {
+		t.Errorf("no error setting xattr in a namespace squashfs cannot keep")
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	if err := fs.Setxattr("/etc/hosts", "user.comment", nil); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("setting xattr of finalized filesystem returned %v instead of %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+
+	dst, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read finalized image: %v", err)
+	}
+	// the names are read back without their namespaces
+	for p, expected := range map[string]map[string]string{
+		"/bin/ping":   {"capability": string(capability)},
+		"/etc/shadow": {"selinux": string(label)},
+		"/etc/hosts":  {"selinux": "system_u:object_r:net_conf_t:s0\x00"},
+		"/bin":        {},
+	} {
+		entries, err := dst.ReadDir(path.Dir(p))
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", path.Dir(p), err)
+		}
+		var found os.FileInfo
+		for _, entry := range entries {
+			if entry.Name() == path.Base(p) {
+				found = entry
+			}
+		}
+		if found == nil {
+			t.Errorf("%s is not in the image", p)
+			continue
+		}
+		if xattrs := found.Sys().(squashfs.FileStat).Xattrs(); !squashfs.CompareEqualMapStringString(xattrs, expected) {
+			t.Errorf("%s has xattrs %q instead of %q", p, xattrs, expected)
+		}
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		fs, err := squashfs.Create(b, 0, 0, 4096)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.Create: %v", err)
+		}
+		if err := fs.Setxattr("/etc/missing", "security.selinux", label); err != nil {
+			t.Fatalf("unexpected error setting xattr: %v", err)
+		}
+		if err := fs.Finalize(squashfs.FinalizeOptions{}); err == nil {
+			t.Errorf("no error finalizing with xattrs of a missing file")
+		}
+	})
+}
@@ -6,6 +6,7 @@ package squashfs
 
 import (
 	"os"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -19,10 +20,11 @@ func getDeviceNumbers(path string) (major, minor uint32, err error) {
 	return uint32(stat.Rdev / 256), uint32(stat.Rdev % 256), nil
 }
 
+// getFileProperties the owner of a file in the workspace, which os.Lstat gives as a *syscall.Stat_t. Its link
+// count is left at 0, as Finalize does not share inodes between hard links, and counts those of directories itself.
 func getFileProperties(fi os.FileInfo) (links, uid, gid uint32) {
 	if sys := fi.Sys(); sys != nil {
-		if stat, ok := sys.(*unix.Stat_t); ok {
-			links = uint32(stat.Nlink)
+		if stat, ok := sys.(*syscall.Stat_t); ok {
 			uid = stat.Uid
 			gid = stat.Gid
 		}
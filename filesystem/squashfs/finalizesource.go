@@ -0,0 +1,362 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// finalizeSource is the tree of files that Finalize writes out, either the workspace
+// or another filesystem. Paths are relative to the root of the tree, e.g. "etc/hosts".
+type finalizeSource interface {
+	// walk returns every file and directory in the tree, with the root first and every
+	// directory before its contents
+	walk() ([]*finalizeFileInfo, error)
+	// open a regular file for reading its contents
+	open(p string) (readerAtCloser, error)
+	// readlink get the target of a symlink
+	readlink(p string) (string, error)
+	// deviceNumbers get the major and minor numbers of a block or char device
+	deviceNumbers(p string) (major, minor uint32, err error)
+}
+
+type readerAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// hostSource the files on the host: those in the workspace directory, plus any grafted in from elsewhere
+type hostSource struct {
+	workspace string
+	grafts    []GraftPoint
+	// actualPaths where on the host each path in the tree is, once it has been walked
+	actualPaths map[string]string
+	// modTime of the parents of graft targets that are not on the host
+	modTime time.Time
+}
+
+func newHostSource(workspace string, grafts []GraftPoint, modTime time.Time) *hostSource {
+	return &hostSource{workspace: workspace, grafts: grafts, modTime: modTime}
+}
+
+func (h *hostSource) walk() ([]*finalizeFileInfo, error) {
+	fileList, actualPaths, err := walkTree(h.workspace, h.grafts, h.modTime)
+	if err != nil {
+		return nil, err
+	}
+	h.actualPaths = actualPaths
+	return fileList, nil
+}
+
+// actualPath where on the host a path in the tree is
+func (h *hostSource) actualPath(p string) string {
+	if actual, ok := h.actualPaths[p]; ok {
+		return actual
+	}
+	return filepath.Join(h.workspace, p)
+}
+
+func (h *hostSource) open(p string) (readerAtCloser, error) {
+	return os.Open(h.actualPath(p))
+}
+
+func (h *hostSource) readlink(p string) (string, error) {
+	return os.Readlink(h.actualPath(p))
+}
+
+func (h *hostSource) deviceNumbers(p string) (major, minor uint32, err error) {
+	return getDeviceNumbers(h.actualPath(p))
+}
+
+// filesystemSource the files in another filesystem, such as an ext4 partition, which are streamed
+// across without being extracted to the host first
+type filesystemSource struct {
+	fs    filesystem.FileSystem
+	infos map[string]os.FileInfo
+	// modTime of the root directory, which has no entry to take it from
+	modTime time.Time
+}
+
+func newFilesystemSource(fs filesystem.FileSystem, modTime time.Time) *filesystemSource {
+	return &filesystemSource{fs: fs, infos: map[string]os.FileInfo{}, modTime: modTime}
+}
+
+func (s *filesystemSource) walk() ([]*finalizeFileInfo, error) {
+	root := &finalizeFileInfo{
+		path:     ".",
+		isDir:    true,
+		isRoot:   true,
+		modTime:  s.modTime,
+		mode:     os.ModeDir | 0o755,
+		fileType: fileDirectory,
+		children: make([]*finalizeFileInfo, 0, 20),
+	}
+	fileList := []*finalizeFileInfo{root}
+	if err := s.walkDir(root, &fileList); err != nil {
+		return nil, err
+	}
+	return fileList, nil
+}
+
+// walkDir add the contents of the directory to the list, in name order, depth first
+func (s *filesystemSource) walkDir(dir *finalizeFileInfo, fileList *[]*finalizeFileInfo) error {
+	entries, err := s.fs.ReadDir(s.fullPath(dir.path))
+	if err != nil {
+		return fmt.Errorf("could not read directory %s: %v", s.fullPath(dir.path), err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, fi := range entries {
+		name := fi.Name()
+		if name == "." || name == ".." {
+			continue
+		}
+		fp := name
+		if !dir.isRoot {
+			fp = path.Join(dir.path, name)
+		}
+		s.infos[fp] = fi
+		links, uid, gid := sourceFileProperties(fi)
+		entry := &finalizeFileInfo{
+			path:     fp,
+			name:     name,
+			isDir:    fi.IsDir(),
+			modTime:  fi.ModTime(),
+			mode:     fi.Mode(),
+			fileType: modeFileType(fi.Mode()),
+			size:     fi.Size(),
+			xattrs:   sourceXattrs(fi),
+			uid:      uid,
+			gid:      gid,
+			links:    links,
+		}
+		dir.children = append(dir.children, entry)
+		*fileList = append(*fileList, entry)
+		if fi.IsDir() {
+			entry.children = make([]*finalizeFileInfo, 0, 20)
+			if err := s.walkDir(entry, fileList); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *filesystemSource) fullPath(p string) string {
+	return path.Join("/", p)
+}
+
+func (s *filesystemSource) open(p string) (readerAtCloser, error) {
+	f, err := s.fs.OpenFile(s.fullPath(p), os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := f.(readerAtCloser); ok {
+		return r, nil
+	}
+	return seekReaderAt{f}, nil
+}
+
+func (s *filesystemSource) readlink(p string) (string, error) {
+	if l, ok := s.infos[p].Sys().(interface{ Readlink() (string, error) }); ok {
+		return l.Readlink()
+	}
+	return filesystem.Readlink(s.fs, s.fullPath(p))
+}
+
+func (s *filesystemSource) deviceNumbers(p string) (major, minor uint32, err error) {
+	// only another squashfs image has them
+	e, ok := s.infos[p].(*directoryEntry)
+	if !ok {
+		return 0, 0, errors.New("source filesystem cannot read device numbers")
+	}
+	switch body := e.inode.getBody().(type) {
+	case *basicDevice:
+		return body.major, body.minor, nil
+	case *extendedDevice:
+		return body.major, body.minor, nil
+	default:
+		return 0, 0, fmt.Errorf("%s is not a device, but %T", p, body)
+	}
+}
+
+func (s *filesystemSource) rawFile(p string) *rawFile {
+	e, ok := s.infos[p].(*directoryEntry)
+	if !ok {
+		return nil
+	}
+	switch body := e.inode.getBody().(type) {
+	case *basicFile:
+		ext := body.toExtended()
+		return &rawFile{fs: e.fs, extendedFile: &ext}
+	case *extendedFile:
+		return &rawFile{fs: e.fs, extendedFile: body}
+	default:
+		return nil
+	}
+}
+
+// rawFileSource a finalizeSource with files that can be in another squashfs image, whose data blocks can then
+// be copied to the new one as they are, without being decompressed and compressed again
+type rawFileSource interface {
+	// rawFile the regular file at p as it is in a squashfs image, or nil if it is not in one
+	rawFile(p string) *rawFile
+}
+
+// rawFile a regular file in a squashfs image
+type rawFile struct {
+	fs *FileSystem
+	*extendedFile
+}
+
+// dataBlock the i-th full block of the file. It is as it is stored in the image, to be written as it is, if an image
+// with compressor c can have it, otherwise it is read as any other block to be compressed.
+func (r *rawFile) dataBlock(i int, c Compressor) (*dataBlock, error) {
+	location := int64(r.startBlock)
+	for _, b := range r.blockSizes[:i] {
+		location += int64(b.size)
+	}
+	block := r.blockSizes[i]
+	from := r.fs.compressor
+	same := (from == nil && c == nil) || (from != nil && c != nil && from.flavour() == c.flavour())
+	// a block can be stored compressed only for the same compressor, but uncompressed for any that could not
+	// compress it either, as well as for none
+	reusable := block.size > 0 && (same || (!block.compressed && c == nil))
+	if !reusable {
+		data, err := r.fs.readBlock(location, block.compressed, block.size)
+		if err != nil {
+			return nil, err
+		}
+		return &dataBlock{data: data}, nil
+	}
+	data := make([]byte, block.size)
+	n, err := r.fs.backend.ReadAt(data, location)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error reading block at %d: %v", location, err)
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("read %d bytes of block at %d instead of %d", n, location, len(data))
+	}
+	return &dataBlock{data: data, compressed: block.compressed, raw: true}, nil
+}
+
+// xattrSource the files of another source, with the extended attributes given with Setxattr and Removexattr
+type xattrSource struct {
+	finalizeSource
+	// xattrs to set, or remove where they are nil, by path and name
+	xattrs map[string]map[string][]byte
+}
+
+func (s *xattrSource) walk() ([]*finalizeFileInfo, error) {
+	fileList, err := s.finalizeSource.walk()
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*finalizeFileInfo, len(fileList))
+	for _, fi := range fileList {
+		byPath[fi.path] = fi
+	}
+	paths := make([]string, 0, len(s.xattrs))
+	for p := range s.xattrs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fi, ok := byPath[p]
+		if !ok {
+			return nil, fmt.Errorf("cannot set extended attributes of %s: %w", path.Join("/", p), os.ErrNotExist)
+		}
+		xattrs := make(map[string]string, len(fi.xattrs)+len(s.xattrs[p]))
+		for k, v := range fi.xattrs {
+			xattrs[k] = v
+		}
+		for k, v := range s.xattrs[p] {
+			if v == nil {
+				delete(xattrs, k)
+				continue
+			}
+			xattrs[k] = string(v)
+		}
+		fi.xattrs = xattrs
+	}
+	return fileList, nil
+}
+
+func (s *xattrSource) rawFile(p string) *rawFile {
+	if raw, ok := s.finalizeSource.(rawFileSource); ok {
+		return raw.rawFile(p)
+	}
+	return nil
+}
+
+// sourceFileProperties get the link count and owner of a file in another filesystem, if it has them,
+// otherwise a single link owned by root
+func sourceFileProperties(fi os.FileInfo) (links, uid, gid uint32) {
+	if o, ok := fi.Sys().(interface {
+		UID() uint32
+		GID() uint32
+	}); ok {
+		return 1, o.UID(), o.GID()
+	}
+	links, uid, gid = getFileProperties(fi)
+	return max(links, 1), uid, gid
+}
+
+// sourceXattrs get the extended attributes of a file in another filesystem, if it has them
+func sourceXattrs(fi os.FileInfo) map[string]string {
+	xattrs := map[string]string{}
+	if x, ok := fi.Sys().(interface{ Xattrs() map[string]string }); ok {
+		for k, v := range x.Xattrs() {
+			// some filesystems, squashfs among them, report keys without the namespace,
+			// which for anything set by users is always user
+			if !strings.Contains(k, ".") {
+				k = "user." + k
+			}
+			xattrs[k] = v
+		}
+	}
+	return xattrs
+}
+
+// modeFileType the type of file for the mode bits
+func modeFileType(m os.FileMode) fileType {
+	switch {
+	case m&os.ModeSocket == os.ModeSocket:
+		return fileSocket
+	case m&os.ModeSymlink == os.ModeSymlink:
+		return fileSymlink
+	case m&os.ModeNamedPipe == os.ModeNamedPipe:
+		return fileFifo
+	case m&os.ModeDir == os.ModeDir:
+		return fileDirectory
+	case m&os.ModeDevice == os.ModeDevice && m&os.ModeCharDevice == os.ModeCharDevice:
+		return fileChar
+	case m&os.ModeDevice == os.ModeDevice && m&os.ModeCharDevice != os.ModeCharDevice:
+		return fileBlock
+	default:
+		return fileRegular
+	}
+}
+
+// seekReaderAt an io.ReaderAt for a file that can only seek and read
+type seekReaderAt struct {
+	filesystem.File
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.File, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -11,6 +11,9 @@ const (
 	fragmentEntrySize       = 16
 )
 
+// noFragmentFlag the fragment block index of a file with no fragment, as all of its data is in full blocks
+const noFragmentFlag uint32 = 0xffffffff
+
 type fragmentEntry struct {
 	start      uint64
 	size       uint32
@@ -0,0 +1,360 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// paxXattrPrefix the prefix of the PAX records that hold extended attributes, as GNU tar and most others write them
+const paxXattrPrefix = "SCHILY.xattr."
+
+// FromTar build a squashfs image at the start of b from the tar stream r, with the default block size, in a single
+// pass. The data of each file is compressed and written out as it is read, so nothing is staged on disk; only the
+// tree of files, and the ends of files waiting to fill a fragment block, are held in memory. This makes it suited
+// to converting large container layers.
+//
+// Every file type that squashfs has is copied, along with hard links, which share the data of the file they link
+// to, and extended attributes from PAX records, if options.Xattrs is set. Directories that are in the stream only
+// as the parents of other files are created with mode 0755, owned by root, at options.ModTime. As when extracting
+// a tar stream, a later entry for the same path replaces an earlier one, whose data still takes up space in the
+// image. options.Source, options.GraftPoints and options.PseudoFiles cannot be used.
+func FromTar(r io.Reader, b backend.Storage, options FinalizeOptions) error {
+	if options.Source != nil || len(options.GraftPoints) > 0 || len(options.PseudoFiles) > 0 {
+		return errors.New("cannot use a source filesystem, graft points or pseudo files with a tar stream")
+	}
+	f, err := b.Writable()
+	if err != nil {
+		return err
+	}
+	modTime := finalizeModTime(options)
+	_, err = writeImage(f, newTarSource(r, modTime), int(defaultBlockSize), options, modTime)
+	return err
+}
+
+// streamedSource a finalizeSource that can only be read once, in an order of its own, such as a tar stream. Rather
+// than being walked and then read, it is streamed once, writing the data and fragment blocks of its files as it goes.
+type streamedSource interface {
+	finalizeSource
+	// stream read the whole source, writing the data blocks of every regular file, with the fragment blocks among
+	// them, out to f from location, with workers goroutines compressing blocks at once. Returns the tree, as walk
+	// would, the fragment blocks and the total written.
+	stream(f io.WriterAt, blocksize int, options FinalizeOptions, workers int, location int64) ([]*finalizeFileInfo, []fragmentBlock, int64, error)
+}
+
+// tarSource the files in a tar stream
+type tarSource struct {
+	r *tar.Reader
+	// modTime of the directories that are not in the stream, but are the parents of files that are
+	modTime time.Time
+	// entries everything read so far, by path
+	entries map[string]*finalizeFileInfo
+	// targets of symlinks, and devices the major and minor numbers of block and char devices, by path
+	targets map[string]string
+	devices map[string][2]uint32
+	// hardLinks the hard links, in the order they were read, to be given the data of their targets once written
+	hardLinks []hardLink
+	fileList  []*finalizeFileInfo
+}
+
+// hardLink a hard link in a tar stream, and the entry it links to
+type hardLink struct {
+	entry, target *finalizeFileInfo
+}
+
+func newTarSource(r io.Reader, modTime time.Time) *tarSource {
+	root := &finalizeFileInfo{
+		path:     ".",
+		isDir:    true,
+		isRoot:   true,
+		modTime:  modTime,
+		mode:     os.ModeDir | 0o755,
+		fileType: fileDirectory,
+		xattrs:   map[string]string{},
+		links:    1,
+		children: make([]*finalizeFileInfo, 0, 20),
+	}
+	return &tarSource{
+		r:       tar.NewReader(r),
+		modTime: modTime,
+		entries: map[string]*finalizeFileInfo{".": root},
+		targets: map[string]string{},
+		devices: map[string][2]uint32{},
+	}
+}
+
+func (t *tarSource) stream(f io.WriterAt, blocksize int, options FinalizeOptions, workers int, location int64) ([]*finalizeFileInfo, []fragmentBlock, int64, error) {
+	var (
+		written        int64
+		fragmentBlocks []fragmentBlock
+	)
+	err := compressInOrder(options.Compression, workers, func(emit func(b *dataBlock) bool) {
+		t.read(blocksize, options, emit)
+	}, func(b *dataBlock) error {
+		e := b.file
+		switch {
+		case b.err != nil:
+			return b.err
+		case e == nil:
+			fragmentBlocks = append(fragmentBlocks, fragmentBlock{
+				size:       uint32(len(b.data)),
+				compressed: b.compressed,
+				location:   location + written,
+			})
+		case b.data == nil:
+			// save the information we need for usage later in inodes to find the file data
+			e.dataLocation = location + written
+			e.startBlock = uint64(e.dataLocation)
+			e.blocks = make([]*blockData, 0)
+			return nil
+		default:
+			e.blocks = append(e.blocks, &blockData{size: uint32(len(b.data)), compressed: b.compressed})
+		}
+		if _, err := f.WriteAt(b.data, location+written); err != nil {
+			return fmt.Errorf("error writing block to file: %v", err)
+		}
+		written += int64(len(b.data))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// the data of every file is written, so hard links can share it
+	for _, l := range t.hardLinks {
+		p, name := l.entry.path, l.entry.name
+		*l.entry = *l.target
+		l.entry.path, l.entry.name = p, name
+		if target, ok := t.targets[l.target.path]; ok {
+			t.targets[p] = target
+		}
+		if device, ok := t.devices[l.target.path]; ok {
+			t.devices[p] = device
+		}
+	}
+	t.fileList = flattenTree(t.entries["."], len(t.entries))
+	return t.fileList, fragmentBlocks, written, nil
+}
+
+// read read every entry of the stream into the tree, and emit the data of every regular file: a block with no data
+// to mark its start, then its full blocks. The partial block at the end of each file goes into fragment blocks,
+// which are emitted, with no file, once full. Any error is emitted as a block, after which nothing more is read.
+func (t *tarSource) read(blocksize int, options FinalizeOptions, emit func(b *dataBlock) bool) {
+	var (
+		fragmentData       []byte
+		fragmentBlockIndex uint32
+	)
+	for {
+		hdr, err := t.r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			emit(&dataBlock{err: fmt.Errorf("error reading tar stream: %v", err)})
+			return
+		}
+		e, err := t.add(hdr)
+		if err != nil {
+			emit(&dataBlock{err: err})
+			return
+		}
+		// only regular files have data
+		if e == nil {
+			continue
+		}
+		if !emit(&dataBlock{file: e}) {
+			return
+		}
+		for remaining := e.size; remaining > 0; {
+			buf := make([]byte, min(remaining, int64(blocksize)))
+			if _, err := io.ReadFull(t.r, buf); err != nil {
+				emit(&dataBlock{file: e, err: fmt.Errorf("error reading %s from tar stream: %v", e.path, err)})
+				return
+			}
+			remaining -= int64(len(buf))
+			if len(buf) == blocksize {
+				if !emit(&dataBlock{file: e, data: buf, raw: options.NoCompressData}) {
+					return
+				}
+				continue
+			}
+
+			// would adding this data cause us to write?
+			if len(fragmentData)+len(buf) > blocksize {
+				if !emit(&dataBlock{data: fragmentData, raw: options.NoCompressFragments}) {
+					return
+				}
+				// the block emitted still is being compressed, so cannot be reused
+				fragmentBlockIndex++
+				fragmentData = make([]byte, 0, blocksize)
+			}
+			e.fragment = &fragmentRef{
+				block:  fragmentBlockIndex,
+				offset: uint32(len(fragmentData)),
+			}
+			fragmentData = append(fragmentData, buf...)
+		}
+	}
+
+	// emit remaining fragment data
+	if len(fragmentData) > 0 {
+		emit(&dataBlock{data: fragmentData, raw: options.NoCompressFragments})
+	}
+}
+
+// add add the entry hdr of the stream to the tree. Returns it if it is a regular file whose data follows in the
+// stream, else nil.
+func (t *tarSource) add(hdr *tar.Header) (*finalizeFileInfo, error) {
+	fp := path.Clean("/" + hdr.Name)[1:]
+	if fp == "" {
+		fp = "."
+	}
+	var target *finalizeFileInfo
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+	case tar.TypeLink:
+		linkname := path.Clean("/" + hdr.Linkname)[1:]
+		target = t.entries[linkname]
+		switch {
+		case target == nil:
+			return nil, fmt.Errorf("hard link %s to %s, which is not before it in the tar stream", fp, hdr.Linkname)
+		case target.isDir:
+			return nil, fmt.Errorf("hard link %s to directory %s", fp, hdr.Linkname)
+		}
+	default:
+		// nothing squashfs can hold
+		return nil, nil
+	}
+
+	xattrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+		}
+	}
+	fi := hdr.FileInfo()
+	entry := &finalizeFileInfo{
+		path:     fp,
+		name:     path.Base(fp),
+		isDir:    fi.IsDir(),
+		isRoot:   fp == ".",
+		modTime:  hdr.ModTime,
+		mode:     fi.Mode(),
+		fileType: modeFileType(fi.Mode()),
+		xattrs:   xattrs,
+		uid:      uint32(hdr.Uid),
+		gid:      uint32(hdr.Gid),
+		links:    1,
+	}
+	if entry.fileType == fileRegular {
+		entry.size = hdr.Size
+	}
+
+	if existing, ok := t.entries[fp]; ok {
+		switch {
+		case existing.isDir && entry.isDir:
+			// a directory that already is in the tree, as the parent of what came before it, or more than once
+			children := existing.children
+			*existing = *entry
+			existing.children = children
+			return nil, nil
+		case existing.isDir:
+			return nil, fmt.Errorf("cannot replace directory %s with a file in the tar stream", fp)
+		}
+	}
+	parent, err := t.parent(path.Dir(fp))
+	if err != nil {
+		return nil, err
+	}
+	if existing, ok := t.entries[fp]; ok {
+		// the earlier entry could still have its data being written, so is replaced rather than changed
+		for i, child := range parent.children {
+			if child == existing {
+				parent.children[i] = entry
+			}
+		}
+		delete(t.targets, fp)
+		delete(t.devices, fp)
+	} else {
+		parent.children = append(parent.children, entry)
+	}
+	t.entries[fp] = entry
+
+	switch {
+	case target != nil:
+		t.hardLinks = append(t.hardLinks, hardLink{entry: entry, target: target})
+		return nil, nil
+	case entry.isDir:
+		entry.children = make([]*finalizeFileInfo, 0, 20)
+	case entry.fileType == fileSymlink:
+		t.targets[fp] = hdr.Linkname
+	case entry.fileType == fileBlock || entry.fileType == fileChar:
+		t.devices[fp] = [2]uint32{uint32(hdr.Devmajor), uint32(hdr.Devminor)}
+	case entry.fileType == fileRegular:
+		return entry, nil
+	}
+	return nil, nil
+}
+
+// parent get the directory at path fp in the tree, creating it if it is not there yet
+func (t *tarSource) parent(fp string) (*finalizeFileInfo, error) {
+	if dir, ok := t.entries[fp]; ok {
+		if !dir.isDir {
+			return nil, fmt.Errorf("%s is not a directory", fp)
+		}
+		return dir, nil
+	}
+	dir := &finalizeFileInfo{
+		path:     fp,
+		name:     path.Base(fp),
+		isDir:    true,
+		modTime:  t.modTime,
+		mode:     os.ModeDir | 0o755,
+		fileType: fileDirectory,
+		xattrs:   map[string]string{},
+		links:    1,
+		children: make([]*finalizeFileInfo, 0, 20),
+	}
+	grandparent, err := t.parent(path.Dir(fp))
+	if err != nil {
+		return nil, err
+	}
+	grandparent.children = append(grandparent.children, dir)
+	t.entries[fp] = dir
+	return dir, nil
+}
+
+// walk the tree that was read, once the stream has been
+func (t *tarSource) walk() ([]*finalizeFileInfo, error) {
+	if t.fileList == nil {
+		return nil, errors.New("a tar stream must be streamed to read its tree")
+	}
+	return t.fileList, nil
+}
+
+func (t *tarSource) open(p string) (readerAtCloser, error) {
+	return nil, fmt.Errorf("cannot reopen %s, as the tar stream can only be read once", p)
+}
+
+func (t *tarSource) readlink(p string) (string, error) {
+	target, ok := t.targets[p]
+	if !ok {
+		return "", fmt.Errorf("%s is not a symlink in the tar stream", p)
+	}
+	return target, nil
+}
+
+func (t *tarSource) deviceNumbers(p string) (major, minor uint32, err error) {
+	device, ok := t.devices[p]
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not a device in the tar stream", p)
+	}
+	return device[0], device[1], nil
+}
@@ -0,0 +1,170 @@
+package squashfs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+)
+
+func TestFromTar(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileTime := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	large := make([]byte, 3*128*1024+1000)
+	_, _ = rand.Read(large)
+	text := bytes.Repeat([]byte("compressible "), 30000)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		hdr  tar.Header
+		data []byte
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o750, ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "./etc/", Mode: 0o755, ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "./etc/hosts", Mode: 0o644, ModTime: fileTime, Uid: 10, Gid: 20}, []byte("127.0.0.1 localhost\n")},
+		// no entry for usr or usr/lib, which are made up
+		{tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/large", Mode: 0o600, ModTime: fileTime}, large},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "usr/lib/text", Mode: 0o644, ModTime: fileTime}, text},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "empty", Mode: 0o644, ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/localhost", Linkname: "hosts", Mode: 0o777, ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeLink, Name: "usr/lib/linked", Linkname: "./usr/lib/large", ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0o600, ModTime: fileTime}, nil},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "xattrs", Mode: 0o644, ModTime: fileTime, PAXRecords: map[string]string{"SCHILY.xattr.user.key": "value"}}, []byte("x")},
+		// a later entry replaces an earlier one
+		{tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o640, ModTime: fileTime}, []byte("replaced\n")},
+	}
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.data))
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatalf("error writing tar header for %s: %v", e.hdr.Name, err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatalf("error writing tar data for %s: %v", e.hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("error closing tar stream: %v", err)
+	}
+
+	b, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	if err := squashfs.FromTar(&buf, b, squashfs.FinalizeOptions{Compression: &squashfs.CompressorGzip{}, ModTime: modTime, Xattrs: true, Workers: 4}); err != nil {
+		t.Fatalf("unexpected error converting tar stream: %v", err)
+	}
+	fs, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+
+	expected := []struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+		data    []byte
+		uid     uint32
+		target  string
+		xattrs  map[string]string
+	}{
+		{path: "/etc", mode: os.ModeDir | 0o755, modTime: fileTime},
+		{path: "/etc/hosts", mode: 0o640, modTime: fileTime, data: []byte("replaced\n")},
+		{path: "/etc/localhost", mode: os.ModeSymlink | 0o777, modTime: fileTime, target: "hosts"},
+		{path: "/usr", mode: os.ModeDir | 0o755, modTime: modTime},
+		{path: "/usr/lib", mode: os.ModeDir | 0o755, modTime: modTime},
+		{path: "/usr/lib/large", mode: 0o600, modTime: fileTime, data: large},
+		{path: "/usr/lib/text", mode: 0o644, modTime: fileTime, data: text},
+		{path: "/usr/lib/linked", mode: 0o600, modTime: fileTime, data: large},
+		{path: "/empty", mode: 0o644, modTime: fileTime, data: []byte{}},
+		{path: "/fifo", mode: os.ModeNamedPipe | 0o600, modTime: fileTime},
+		// squashfs reports keys without the user namespace
+		{path: "/xattrs", mode: 0o644, modTime: fileTime, data: []byte("x"), xattrs: map[string]string{"key": "value"}},
+	}
+	for _, e := range expected {
+		t.Run(e.path, func(t *testing.T) {
+			dir, name := path.Split(e.path)
+			infos, err := fs.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("unable to read directory %s: %v", dir, err)
+			}
+			var fi os.FileInfo
+			for _, info := range infos {
+				if info.Name() == name {
+					fi = info
+				}
+			}
+			if fi == nil {
+				t.Fatalf("%s is missing", e.path)
+			}
+			stat := fi.Sys().(squashfs.FileStat)
+			if fi.Mode() != e.mode || !fi.ModTime().Equal(e.modTime) || stat.UID() != e.uid {
+				t.Errorf("mode %v, time %v, owner %d instead of %v, %v, %d", fi.Mode(), fi.ModTime(), stat.UID(), e.mode, e.modTime, e.uid)
+			}
+			if e.xattrs != nil && !reflect.DeepEqual(stat.Xattrs(), e.xattrs) {
+				t.Errorf("xattrs %v instead of %v", stat.Xattrs(), e.xattrs)
+			}
+			if e.target != "" {
+				if target, err := stat.Readlink(); err != nil || target != e.target {
+					t.Errorf("target %q instead of %q, error %v", target, e.target, err)
+				}
+			}
+			if e.data == nil {
+				return
+			}
+			f, err := fs.OpenFile(e.path, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unable to open file: %v", err)
+			}
+			data, err := io.ReadAll(f)
+			if err != nil || !bytes.Equal(data, e.data) {
+				t.Errorf("mismatched contents, %d bytes instead of %d, error %v", len(data), len(e.data), err)
+			}
+		})
+	}
+	root, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("unable to read root directory: %v", err)
+	}
+	if len(root) != 5 {
+		t.Errorf("root directory has %d entries instead of 5", len(root))
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			entries []tar.Header
+		}{
+			{"hard link to a later file", []tar.Header{{Typeflag: tar.TypeLink, Name: "a", Linkname: "b"}, {Typeflag: tar.TypeReg, Name: "b"}}},
+			{"file under a file", []tar.Header{{Typeflag: tar.TypeReg, Name: "a"}, {Typeflag: tar.TypeReg, Name: "a/b"}}},
+			{"directory replaced by a file", []tar.Header{{Typeflag: tar.TypeDir, Name: "a/"}, {Typeflag: tar.TypeReg, Name: "a"}}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				for i := range tt.entries {
+					if err := tw.WriteHeader(&tt.entries[i]); err != nil {
+						t.Fatalf("error writing tar header: %v", err)
+					}
+				}
+				_ = tw.Close()
+				b, err := mem.New(1024 * 1024)
+				if err != nil {
+					t.Fatalf("unable to create buffer: %v", err)
+				}
+				if err := squashfs.FromTar(&buf, b, squashfs.FinalizeOptions{}); err == nil {
+					t.Errorf("no error converting tar stream")
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,273 @@
+// Package lzo implements the LZO1X compressed format, as squashfs and the Linux kernel use it: a bare stream of
+// literal runs and matches that ends with an end of stream marker, with no header or checksum.
+//
+// Every LZO1X compressor, from the fast LZO1X-1 to the slow LZO1X-999, gives a stream in the same format, which
+// Decompress reads. Compress is a greedy compressor much like LZO1X-1.
+package lzo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// the most distant match that each kind of instruction can refer to
+	m2MaxOffset = 0x0800
+	m3MaxOffset = 0x4000
+	m4MaxOffset = 0xbfff
+	// the longest match that each kind of instruction holds without an extended length
+	m2MaxLen = 8
+	m3MaxLen = 33
+	m4MaxLen = 9
+	// the first byte of each kind of instruction
+	m3Marker = 32
+	m4Marker = 16
+
+	minMatch = 4
+	hashBits = 14
+)
+
+var errTruncated = errors.New("lzo stream is truncated")
+
+// Compress compress in into an LZO1X stream
+func Compress(in []byte) []byte {
+	out := make([]byte, 0, len(in)+len(in)/16+64+3)
+	var table [1 << hashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+	hash := func(p int) uint32 {
+		return (binary.LittleEndian.Uint32(in[p:]) * 0x1e35a7bd) >> (32 - hashBits)
+	}
+
+	// literals start where the literals not yet written start
+	literals := 0
+	for ip := 0; ip+minMatch <= len(in); {
+		h := hash(ip)
+		candidate := int(table[h])
+		table[h] = int32(ip)
+		offset := ip - candidate
+		if candidate < 0 || offset > m4MaxOffset || binary.LittleEndian.Uint32(in[candidate:]) != binary.LittleEndian.Uint32(in[ip:]) {
+			ip++
+			continue
+		}
+		length := minMatch
+		for ip+length < len(in) && in[candidate+length] == in[ip+length] {
+			length++
+		}
+		out = appendLiterals(out, in[literals:ip])
+		out = appendMatch(out, offset, length)
+		ip += length
+		literals = ip
+	}
+	out = appendLiterals(out, in[literals:])
+	// the end of stream marker is a distant match with no distance
+	return append(out, m4Marker|1, 0, 0)
+}
+
+// appendLiterals append a run of literals to out. A short run after a match is held in the low bits of the match.
+func appendLiterals(out, literals []byte) []byte {
+	t := len(literals)
+	switch {
+	case t == 0:
+		return out
+	case len(out) == 0 && t <= 238:
+		out = append(out, byte(17+t))
+	case t <= 3:
+		out[len(out)-2] |= byte(t)
+	case t <= 18:
+		out = append(out, byte(t-3))
+	default:
+		out = append(out, 0)
+		out = appendExtendedLength(out, t-18)
+	}
+	return append(out, literals...)
+}
+
+// appendMatch append a match of length bytes, offset bytes back, to out
+func appendMatch(out []byte, offset, length int) []byte {
+	switch {
+	case length <= m2MaxLen && offset <= m2MaxOffset:
+		offset--
+		return append(out, byte((length-1)<<5|(offset&7)<<2), byte(offset>>3))
+	case offset <= m3MaxOffset:
+		offset--
+		if length <= m3MaxLen {
+			out = append(out, byte(m3Marker|(length-2)))
+		} else {
+			out = append(out, m3Marker)
+			out = appendExtendedLength(out, length-m3MaxLen)
+		}
+	default:
+		offset -= 0x4000
+		high := byte((offset >> 11) & 8)
+		if length <= m4MaxLen {
+			out = append(out, m4Marker|high|byte(length-2))
+		} else {
+			out = append(out, m4Marker|high)
+			out = appendExtendedLength(out, length-m4MaxLen)
+		}
+	}
+	return append(out, byte(offset<<2), byte(offset>>6))
+}
+
+// appendExtendedLength append a length too long for its instruction, as a zero byte for each 255 of it
+func appendExtendedLength(out []byte, n int) []byte {
+	for n > 255 {
+		out = append(out, 0)
+		n -= 255
+	}
+	return append(out, byte(n))
+}
+
+// Decompress decompress the LZO1X stream in, which must hold exactly one stream. The size of the data it
+// holds is not known up front; if it is more than maxSize, that is an error.
+func Decompress(in []byte, maxSize int) ([]byte, error) {
+	out := make([]byte, 0, min(maxSize, 4*len(in)))
+	ip := 0
+	next := func() (byte, error) {
+		if ip >= len(in) {
+			return 0, errTruncated
+		}
+		ip++
+		return in[ip-1], nil
+	}
+	extendedLength := func(base int) (int, error) {
+		n := base
+		for {
+			b, err := next()
+			if err != nil {
+				return 0, err
+			}
+			if b != 0 {
+				return n + int(b), nil
+			}
+			n += 255
+			if n > maxSize {
+				return 0, fmt.Errorf("lzo length beyond the maximum size of %d", maxSize)
+			}
+		}
+	}
+	copyLiterals := func(n int) error {
+		if ip+n > len(in) {
+			return errTruncated
+		}
+		if len(out)+n > maxSize {
+			return fmt.Errorf("lzo stream holds more than the maximum size of %d", maxSize)
+		}
+		out = append(out, in[ip:ip+n]...)
+		ip += n
+		return nil
+	}
+	copyMatch := func(distance, n int) error {
+		if distance <= 0 || distance > len(out) {
+			return fmt.Errorf("lzo match %d bytes back, but only %d are decompressed", distance, len(out))
+		}
+		if len(out)+n > maxSize {
+			return fmt.Errorf("lzo stream holds more than the maximum size of %d", maxSize)
+		}
+		// matches can overlap what they add, so copy one byte at a time
+		from := len(out) - distance
+		for i := 0; i < n; i++ {
+			out = append(out, out[from+i])
+		}
+		return nil
+	}
+
+	if len(in) == 0 {
+		return nil, errTruncated
+	}
+	// state how many literals the last instruction had after it, with 4 for a run of 4 or more
+	state := 0
+	if in[0] > 17 {
+		ip++
+		t := int(in[0]) - 17
+		if err := copyLiterals(t); err != nil {
+			return nil, err
+		}
+		state = min(t, 4)
+	}
+	for {
+		t, err := next()
+		if err != nil {
+			return nil, err
+		}
+		var distance, length int
+		switch {
+		case t < 16 && state == 0:
+			// a run of literals
+			n := int(t) + 3
+			if t == 0 {
+				if n, err = extendedLength(15 + 3); err != nil {
+					return nil, err
+				}
+			}
+			if err := copyLiterals(n); err != nil {
+				return nil, err
+			}
+			state = 4
+			continue
+		case t < 16:
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			distance = 1 + int(t>>2) + int(b)<<2
+			length = 2
+			if state == 4 {
+				distance += m2MaxOffset
+				length = 3
+			}
+		case t >= 64:
+			b, err := next()
+			if err != nil {
+				return nil, err
+			}
+			distance = 1 + int((t>>2)&7) + int(b)<<3
+			length = int(t>>5) + 1
+		case t >= 32:
+			length = int(t&31) + 2
+			if length == 2 {
+				if length, err = extendedLength(31 + 2); err != nil {
+					return nil, err
+				}
+			}
+			if ip+2 > len(in) {
+				return nil, errTruncated
+			}
+			distance = 1 + int(binary.LittleEndian.Uint16(in[ip:])>>2)
+			ip += 2
+		default:
+			length = int(t&7) + 2
+			if length == 2 {
+				if length, err = extendedLength(7 + 2); err != nil {
+					return nil, err
+				}
+			}
+			if ip+2 > len(in) {
+				return nil, errTruncated
+			}
+			distance = int(t&8)<<11 + int(binary.LittleEndian.Uint16(in[ip:])>>2)
+			ip += 2
+			if distance == 0 {
+				if length != 3 {
+					return nil, fmt.Errorf("invalid lzo end of stream marker")
+				}
+				if ip != len(in) {
+					return nil, fmt.Errorf("%d bytes after the end of the lzo stream", len(in)-ip)
+				}
+				return out, nil
+			}
+			distance += 0x4000
+		}
+		if err := copyMatch(distance, length); err != nil {
+			return nil, err
+		}
+		// the low bits of the last byte but one of the match are how many literals follow it
+		state = int(in[ip-2] & 3)
+		if err := copyLiterals(state); err != nil {
+			return nil, err
+		}
+	}
+}
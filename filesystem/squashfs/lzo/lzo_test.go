@@ -0,0 +1,92 @@
+package lzo
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressDecompress(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	r.Read(random)
+	// text with matches near and far, and long runs that need extended lengths
+	var mixed []byte
+	for i := 0; len(mixed) < 200000; i++ {
+		switch i % 4 {
+		case 0:
+			mixed = append(mixed, []byte("the quick brown fox jumps over the lazy dog ")...)
+		case 1:
+			mixed = append(mixed, random[i*37%len(random):i*37%len(random)+300]...)
+		case 2:
+			mixed = append(mixed, bytes.Repeat([]byte{byte(i)}, i%700)...)
+		case 3:
+			// something from well over 16K back
+			if len(mixed) > 40000 {
+				mixed = append(mixed, mixed[len(mixed)-40000:len(mixed)-39000]...)
+			}
+		}
+	}
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{'a'}},
+		{"short", []byte("abc")},
+		{"literals only", random[:1000]},
+		{"long literal run", random},
+		{"zeros", make([]byte, 70000)},
+		{"mixed", mixed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := Compress(tt.in)
+			out, err := Decompress(compressed, len(tt.in))
+			if err != nil {
+				t.Fatalf("unexpected error decompressing: %v", err)
+			}
+			if !bytes.Equal(out, tt.in) {
+				t.Errorf("decompressed %d bytes do not match the %d compressed", len(out), len(tt.in))
+			}
+		})
+	}
+	if compressed := Compress(mixed); len(compressed) >= len(mixed)/2 {
+		t.Errorf("compressed %d bytes to %d", len(mixed), len(compressed))
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		expected []byte
+		maxSize  int
+		err      bool
+	}{
+		// a literal, then a 2-byte match 1 back, which only follows 1 to 3 literals
+		{"short match", []byte{18, 'a', 0x00, 0x00, 17, 0, 0}, []byte("aaa"), 10, false},
+		// 4 literals, then a match of 4 back and 4 long with 2 literals after it
+		{"match with literals", []byte{21, 'a', 'b', 'c', 'd', 0x6e, 0x00, 'e', 'f', 17, 0, 0}, []byte("abcdabcdef"), 10, false},
+		// a run of 19 literals has an extended length
+		{"extended literal run", append(append([]byte{0, 1}, bytes.Repeat([]byte{'x'}, 19)...), 17, 0, 0), bytes.Repeat([]byte{'x'}, 19), 20, false},
+		{"empty", nil, nil, 10, true},
+		{"no end marker", []byte{21, 'a', 'b', 'c', 'd'}, nil, 10, true},
+		{"match before the start", []byte{18, 'a', 0x04, 0x00, 17, 0, 0}, nil, 10, true},
+		{"beyond the maximum size", []byte{21, 'a', 'b', 'c', 'd', 17, 0, 0}, nil, 3, true},
+		{"data after the end marker", []byte{18, 'a', 17, 0, 0, 0}, nil, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Decompress(tt.in, tt.maxSize)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("no error, decompressed %q", out)
+			case !tt.err && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case !tt.err && !bytes.Equal(out, tt.expected):
+				t.Errorf("decompressed %q instead of %q", out, tt.expected)
+			}
+		})
+	}
+}
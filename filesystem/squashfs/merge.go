@@ -0,0 +1,161 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// MergeConflict what Merge does with a path that is in both images, other than a directory in both, whose contents
+// are always merged
+type MergeConflict int
+
+const (
+	// MergeConflictError fail the merge
+	MergeConflictError MergeConflict = iota
+	// MergeConflictUpper take what is in the upper image, with everything in it, in place of what is in the lower one
+	MergeConflictUpper
+	// MergeConflictLower keep what is in the lower image
+	MergeConflictLower
+)
+
+// Merge write a new image to b with the files of both lower and upper, as if upper were laid over lower, e.g. to
+// combine the layers of a firmware build. A directory that is in both has the contents of both, and the owner, mode
+// and extended attributes of that in upper, unless conflict is MergeConflictLower; conflict also decides what
+// happens with anything else that is in both.
+//
+// The new image has the block size of lower. Unless options.Compression is set, it also has its compressor. The
+// data blocks of files are copied across as they are, without being decompressed and compressed again, from an
+// image with the same block size and compressor; only the ends of files, which are packed into fragment blocks
+// anew, are always compressed again. options.Source and options.GraftPoints cannot be used.
+func Merge(lower, upper *FileSystem, b backend.Storage, conflict MergeConflict, options FinalizeOptions) error {
+	if options.Source != nil || len(options.GraftPoints) > 0 {
+		return errors.New("cannot use a source filesystem or graft points with a merge")
+	}
+	if lower.workspace != "" || upper.workspace != "" {
+		return errors.New("cannot merge a filesystem that is not finalized")
+	}
+	if options.Compression == nil {
+		options.Compression = lower.compressor
+	}
+	f, err := b.Writable()
+	if err != nil {
+		return err
+	}
+	modTime := finalizeModTime(options)
+	src := &mergeSource{
+		lower:     newFilesystemSource(lower, modTime),
+		upper:     newFilesystemSource(upper, modTime),
+		root:      upper,
+		conflict:  conflict,
+		fromUpper: map[string]bool{},
+	}
+	if conflict == MergeConflictLower {
+		src.root = lower
+	}
+	_, err = writeImage(f, src, int(lower.superblock.blocksize), options, modTime)
+	return err
+}
+
+// mergeSource the files of two images, one laid over the other
+type mergeSource struct {
+	lower, upper *filesystemSource
+	// root the image whose root directory has the properties for that of the new one
+	root     *FileSystem
+	conflict MergeConflict
+	// fromUpper paths whose contents are read from the upper image
+	fromUpper map[string]bool
+}
+
+func (m *mergeSource) walk() ([]*finalizeFileInfo, error) {
+	lower, err := m.lower.walk()
+	if err != nil {
+		return nil, fmt.Errorf("error walking lower image: %v", err)
+	}
+	upper, err := m.upper.walk()
+	if err != nil {
+		return nil, fmt.Errorf("error walking upper image: %v", err)
+	}
+	// the root is in both, so takes its properties as any other directory would
+	root, err := m.root.rootEntry()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read root directory of image: %v", err)
+	}
+	lower[0].mode = root.Mode()
+	lower[0].uid, lower[0].gid = root.UID(), root.GID()
+	lower[0].modTime = root.ModTime()
+	lower[0].xattrs = sourceXattrs(root)
+	if err := m.merge(lower[0], upper[0]); err != nil {
+		return nil, err
+	}
+	return flattenTree(lower[0], len(lower)+len(upper)), nil
+}
+
+// merge add what is in the upper directory to the lower one
+func (m *mergeSource) merge(lower, upper *finalizeFileInfo) error {
+	byName := make(map[string]int, len(lower.children))
+	for i, child := range lower.children {
+		byName[child.name] = i
+	}
+	for _, child := range upper.children {
+		i, ok := byName[child.name]
+		if !ok {
+			m.addUpper(child)
+			lower.children = append(lower.children, child)
+			continue
+		}
+		existing := lower.children[i]
+		if existing.isDir && child.isDir {
+			if m.conflict != MergeConflictLower {
+				existing.mode, existing.uid, existing.gid = child.mode, child.uid, child.gid
+				existing.modTime, existing.xattrs = child.modTime, child.xattrs
+			}
+			if err := m.merge(existing, child); err != nil {
+				return err
+			}
+			continue
+		}
+		switch m.conflict {
+		case MergeConflictUpper:
+			m.addUpper(child)
+			lower.children[i] = child
+		case MergeConflictLower:
+		default:
+			return fmt.Errorf("/%s is in both images", child.path)
+		}
+	}
+	return nil
+}
+
+// addUpper take a file or directory, and everything in it, from the upper image
+func (m *mergeSource) addUpper(fi *finalizeFileInfo) {
+	m.fromUpper[fi.path] = true
+	for _, child := range fi.children {
+		m.addUpper(child)
+	}
+}
+
+// source the image whose contents are at p
+func (m *mergeSource) source(p string) *filesystemSource {
+	if m.fromUpper[p] {
+		return m.upper
+	}
+	return m.lower
+}
+
+func (m *mergeSource) open(p string) (readerAtCloser, error) {
+	return m.source(p).open(p)
+}
+
+func (m *mergeSource) readlink(p string) (string, error) {
+	return m.source(p).readlink(p)
+}
+
+func (m *mergeSource) deviceNumbers(p string) (major, minor uint32, err error) {
+	return m.source(p).deviceNumbers(p)
+}
+
+func (m *mergeSource) rawFile(p string) *rawFile {
+	return m.source(p).rawFile(p)
+}
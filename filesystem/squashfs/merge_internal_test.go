@@ -0,0 +1,100 @@
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+)
+
+func TestMergeReusesBlocks(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 5*4096+100; i++ {
+		data = fmt.Appendf(data, "line %d of a file that compresses differently at each level\n", i*i%977)
+	}
+	// image make an image with a single file, compressed with c, returning it and the raw bytes of the file's first block
+	image := func(name string, c Compressor) (*FileSystem, []byte) {
+		t.Helper()
+		b, err := mem.New(1024 * 1024)
+		if err != nil {
+			t.Fatalf("unable to create buffer: %v", err)
+		}
+		fs, err := Create(b, 0, 0, 4096)
+		if err != nil {
+			t.Fatalf("Failed to Create: %v", err)
+		}
+		f, err := fs.OpenFile("/"+name, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to OpenFile: %v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("error writing: %v", err)
+		}
+		if err := fs.Finalize(FinalizeOptions{Compression: c}); err != nil {
+			t.Fatalf("unexpected error finalizing: %v", err)
+		}
+		fs, err = Read(b, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("unable to read image: %v", err)
+		}
+		return fs, testFirstBlock(t, fs, "/", name)
+	}
+
+	lower, lowerBlock := image("lower", &CompressorZstd{CompressionLevel: 19})
+	upper, upperBlock := image("upper", &CompressorGzip{CompressionLevel: 9})
+
+	b, err := mem.New(1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	c := &CompressorZstd{CompressionLevel: 1}
+	if err := Merge(lower, upper, b, MergeConflictError, FinalizeOptions{Compression: c}); err != nil {
+		t.Fatalf("unexpected error merging: %v", err)
+	}
+	fs, err := Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read merged image: %v", err)
+	}
+	// compressed again, the block would not be the same
+	recompressed, err := c.compress(data[:4096])
+	if err != nil {
+		t.Fatalf("unable to compress: %v", err)
+	}
+	if bytes.Equal(recompressed, lowerBlock) {
+		t.Fatalf("block is the same at both compression levels")
+	}
+	// the block compressed with the same compressor is copied as it is, but not that with another one
+	if block := testFirstBlock(t, fs, "/", "lower"); !bytes.Equal(block, lowerBlock) {
+		t.Errorf("block of file in lower image was not copied as it is")
+	}
+	if block := testFirstBlock(t, fs, "/", "upper"); bytes.Equal(block, upperBlock) {
+		t.Errorf("block of file compressed with gzip was copied as it is")
+	}
+}
+
+// testFirstBlock the first data block of a file, as it is stored in the image
+func testFirstBlock(t *testing.T, fs *FileSystem, dir, name string) []byte {
+	t.Helper()
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unable to read directory %s: %v", dir, err)
+	}
+	for _, e := range entries {
+		if e.Name() != name {
+			continue
+		}
+		raw := (&filesystemSource{infos: map[string]os.FileInfo{name: e}}).rawFile(name)
+		if raw == nil || len(raw.blockSizes) == 0 {
+			t.Fatalf("%s has no data blocks", name)
+		}
+		b := make([]byte, raw.blockSizes[0].size)
+		if _, err := fs.backend.ReadAt(b, int64(raw.startBlock)); err != nil {
+			t.Fatalf("unable to read block of %s: %v", name, err)
+		}
+		return b
+	}
+	t.Fatalf("%s not found in %s", name, dir)
+	return nil
+}
@@ -0,0 +1,143 @@
+package squashfs_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+)
+
+// testMergeImage make an image with the given files, and the directories they are in, owned by owner
+func testMergeImage(t *testing.T, files map[string]string, owner uint32) *squashfs.FileSystem {
+	t.Helper()
+	b, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	for p, data := range files {
+		if err := fs.Mkdir(path.Dir(p)); err != nil {
+			t.Fatalf("Failed to squashfs.Mkdir(%s): %v", path.Dir(p), err)
+		}
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.OpenFile(%s): %v", p, err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatalf("error writing %s: %v", p, err)
+		}
+	}
+	options := squashfs.FinalizeOptions{
+		Compression: &squashfs.CompressorGzip{},
+		FileUID:     &owner,
+		FileGID:     &owner,
+		ModTime:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := fs.Finalize(options); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	fs, err = squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+	return fs
+}
+
+func TestMerge(t *testing.T) {
+	firmware := string(bytes.Repeat([]byte("firmware blob that spans several blocks "), 1000))
+	lowerFiles := map[string]string{
+		"/etc/hosts":        "127.0.0.1 localhost\n",
+		"/etc/version":      "1.0\n",
+		"/lib/firmware/fw1": firmware,
+	}
+	upperFiles := map[string]string{
+		"/etc/version":      "2.0\n",
+		"/etc/app.conf":     "debug=false\n",
+		"/lib/firmware/fw2": firmware[:9000],
+		"/opt/app/bin/app":  "app\n",
+	}
+
+	tests := []struct {
+		name     string
+		conflict squashfs.MergeConflict
+		version  string
+		owner    uint32
+	}{
+		{"error", squashfs.MergeConflictError, "", 0},
+		{"upper", squashfs.MergeConflictUpper, "2.0\n", 2000},
+		{"lower", squashfs.MergeConflictLower, "1.0\n", 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lower := testMergeImage(t, lowerFiles, 1000)
+			upper := testMergeImage(t, upperFiles, 2000)
+			b, err := mem.New(4 * 1024 * 1024)
+			if err != nil {
+				t.Fatalf("unable to create buffer: %v", err)
+			}
+			err = squashfs.Merge(lower, upper, b, tt.conflict, squashfs.FinalizeOptions{})
+			if tt.version == "" {
+				if err == nil {
+					t.Fatalf("no error merging images with a file in both")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error merging: %v", err)
+			}
+			fs, err := squashfs.Read(b, 0, 0, 0)
+			if err != nil {
+				t.Fatalf("unable to read merged image: %v", err)
+			}
+
+			expected := map[string]string{
+				"/etc/hosts":        lowerFiles["/etc/hosts"],
+				"/etc/version":      tt.version,
+				"/etc/app.conf":     upperFiles["/etc/app.conf"],
+				"/lib/firmware/fw1": firmware,
+				"/lib/firmware/fw2": upperFiles["/lib/firmware/fw2"],
+				"/opt/app/bin/app":  upperFiles["/opt/app/bin/app"],
+			}
+			for p, data := range expected {
+				f, err := fs.OpenFile(p, os.O_RDONLY)
+				if err != nil {
+					t.Errorf("unable to open %s: %v", p, err)
+					continue
+				}
+				if got, err := io.ReadAll(f); err != nil || string(got) != data {
+					t.Errorf("%s has %d bytes instead of %d, error %v", p, len(got), len(data), err)
+				}
+			}
+			// directories that are in both take their owner from the image that wins conflicts
+			for _, p := range []string{"/etc", "/lib", "/lib/firmware"} {
+				entries, err := fs.ReadDir(path.Dir(p))
+				if err != nil {
+					t.Fatalf("unable to read directory %s: %v", path.Dir(p), err)
+				}
+				for _, fi := range entries {
+					if fi.Name() != path.Base(p) {
+						continue
+					}
+					if uid := fi.Sys().(squashfs.FileStat).UID(); uid != tt.owner {
+						t.Errorf("%s is owned by %d instead of %d", p, uid, tt.owner)
+					}
+				}
+			}
+			entries, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("unable to read root directory: %v", err)
+			}
+			if len(entries) != 3 {
+				t.Errorf("root directory has %d entries instead of 3", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package squashfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// mapping a read-only memory mapping of the file that the filesystem is in, see SetMmap
+type mapping struct {
+	mu sync.RWMutex
+	// data the mapped filesystem, from its start; nil when it is not mapped
+	data []byte
+	// unmap releases the mapping
+	unmap func() error
+}
+
+// SetMmap set whether data blocks and fragments are read through a read-only memory mapping of the file or block
+// device that the image is in, rather than with ReadAt on the backend. Compressed blocks are then decompressed
+// straight from the mapping, without first being copied into a buffer, which makes random reads from a large image
+// much faster.
+//
+// It returns an error, and keeps reading from the backend, if the backend is not a local file, see
+// backend.Storage.Sys, or if memory mappings are not supported on the platform. If the file shrinks while it is
+// mapped, reads from what is no longer there fall back to the backend rather than crashing. Call SetMmap(false)
+// to release the mapping once the filesystem is no longer used. The default is not to map.
+func (fs *FileSystem) SetMmap(enable bool) error {
+	m := &fs.mmap
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !enable {
+		if m.data == nil {
+			return nil
+		}
+		m.data = nil
+		return m.unmap()
+	}
+	if m.data != nil {
+		return nil
+	}
+	if fs.workspace != "" {
+		return errors.New("cannot map a filesystem that is being built in a workspace")
+	}
+	f, err := fs.backend.Sys()
+	if err != nil {
+		return fmt.Errorf("cannot map backend: %w", err)
+	}
+	data, unmap, err := mmapFile(f, fs.start, fs.size)
+	if err != nil {
+		return fmt.Errorf("could not map %s: %w", f.Name(), err)
+	}
+	m.data, m.unmap = data, unmap
+	return nil
+}
+
+// readData read size bytes at location, decompressing them if compressed, for what, which errors name. With a
+// mapping of the backend, see SetMmap, they are decompressed straight from it.
+func (fs *FileSystem) readData(location int64, size int, compressed bool, what string) ([]byte, error) {
+	if compressed && fs.compressor == nil {
+		return nil, fmt.Errorf("%s compressed but do not have valid compressor", what)
+	}
+	if data, ok, err := fs.readMapped(location, size, compressed); ok {
+		return data, err
+	}
+	b := make([]byte, size)
+	read, err := fs.backend.ReadAt(b, location)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read %s: %v", what, err)
+	}
+	if read != size {
+		return nil, fmt.Errorf("read %d bytes instead of expected %d for %s", read, size, what)
+	}
+	if !compressed {
+		return b, nil
+	}
+	data, err := fs.compressor.decompress(b)
+	if err != nil {
+		return nil, fmt.Errorf("decompress error: %v", err)
+	}
+	return data, nil
+}
+
+// readMapped read as readData does, from the mapping of the backend. ok is false if there is no mapping, if it
+// does not hold all of the bytes, or if they could not be read from it because the file shrank, for the caller
+// to read them from the backend instead.
+//
+// Reading a page of the mapping that the file no longer has raises SIGBUS, which would crash the program. To
+// recover from it, readMapped turns on debug.SetPanicOnFault while it reads, so that the fault is a panic instead,
+// with a runtime.Error that has the faulting address. The setting is per goroutine, and the previous one is put
+// back when readMapped returns. The deferred recover, which runs first, handles only such faults, and passes
+// any other panic on. Nothing that readMapped reads from the mapping before the fault is returned, so a fault
+// while decompressing leaves no partial data.
+func (fs *FileSystem) readMapped(location int64, size int, compressed bool) (data []byte, ok bool, err error) {
+	m := &fs.mmap
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.data == nil || location < 0 || location+int64(size) > int64(len(m.data)) {
+		return nil, false, nil
+	}
+	// a page that is no longer backed by the file faults, which with this is a panic that can be recovered from,
+	// rather than a crash
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, fault := r.(interface{ Addr() uintptr }); !fault {
+				panic(r)
+			}
+			data, ok, err = nil, false, nil
+		}
+	}()
+	b := m.data[location : location+int64(size)]
+	if !compressed {
+		// the block may be kept, as in the cache, after the mapping is gone
+		return bytes.Clone(b), true, nil
+	}
+	data, err = fs.compressor.decompress(b)
+	if err != nil {
+		return nil, true, fmt.Errorf("decompress error: %v", err)
+	}
+	return data, true, nil
+}
@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package squashfs
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on this platform
+func mmapFile(_ *os.File, _, _ int64) (data []byte, unmap func() error, err error) {
+	return nil, nil, errors.New("memory mapping is not supported on this platform")
+}
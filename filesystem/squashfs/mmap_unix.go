@@ -0,0 +1,39 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile map the size bytes at start in f read-only, or as many of them as a regular file has
+func mmapFile(f *os.File, start, size int64) (data []byte, unmap func() error, err error) {
+	end := start + size
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	// pages past the end of a file cannot be read, so the mapping stops there; a block device has no size here
+	if info.Mode().IsRegular() && (size <= 0 || end > info.Size()) {
+		end = info.Size()
+	}
+	if end <= start {
+		return nil, nil, errors.New("nothing to map")
+	}
+	// a mapping is indexed by int, so one of more than 2GiB cannot be made on a 32-bit platform, where the
+	// filesystem is then read from the backend
+	if end > math.MaxInt {
+		return nil, nil, fmt.Errorf("%d bytes are more than can be mapped on this platform", end)
+	}
+	// the mapping starts at the beginning of the file, as its offset would have to be a multiple of the page size
+	raw, err := unix.Mmap(int(f.Fd()), 0, int(end), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw[start:], func() error { return unix.Munmap(raw) }, nil
+}
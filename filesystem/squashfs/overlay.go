@@ -0,0 +1,583 @@
+package squashfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// overlay the read-only image under a filesystem opened with Overlay, and what has been removed from it
+type overlay struct {
+	lower *FileSystem
+	// hidden paths in lower that have been removed or replaced, along with everything under them
+	hidden map[string]bool
+	// origin the path in lower that each path in the workspace was copied up from, so that it can keep
+	// its properties there, even when it has since been moved
+	origin map[string]string
+	// chmodded and chowned the paths in lower, as in origin, of what has had its mode or owner changed
+	// since it was copied up, and so keeps the one in the workspace
+	chmodded map[string]bool
+	chowned  map[string]bool
+}
+
+// Overlay open a writable view of an existing image, as a filesystem in a workspace like one from Create,
+// whose contents start out as those of the image. Changes are made in the workspace, copying files and
+// directories up from the image as they are changed, and the image itself is never written. Finalize
+// writes the merged tree out to b as a new image, reading the unchanged files from the image, so the
+// image must remain open until then, and b must not be the storage the image is on.
+//
+// Files and directories that are changed keep the mode and owner they have in the image, unless Chmod or Chown
+// changes them. If the provided blocksize
+// is 0, it will use that of the image.
+func Overlay(lower *FileSystem, b backend.Storage, size, start, blocksize int64) (*FileSystem, error) {
+	if lower == nil || lower.workspace != "" || lower.superblock == nil {
+		return nil, fmt.Errorf("can only overlay a filesystem opened with Read")
+	}
+	if blocksize == 0 {
+		blocksize = lower.blocksize
+	}
+	fs, err := Create(b, size, start, blocksize)
+	if err != nil {
+		return nil, err
+	}
+	// the workspace is the root directory, which is always there
+	root, err := lower.rootEntry()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read root directory of image: %v", err)
+	}
+	if err := os.Chmod(fs.workspace, root.Mode().Perm()|0o700); err != nil {
+		return nil, fmt.Errorf("could not set mode of workspace: %v", err)
+	}
+	if err := os.Chtimes(fs.workspace, root.ModTime(), root.ModTime()); err != nil {
+		return nil, fmt.Errorf("could not set times of workspace: %v", err)
+	}
+	fs.overlay = &overlay{
+		lower:    lower,
+		hidden:   map[string]bool{},
+		origin:   map[string]string{},
+		chmodded: map[string]bool{},
+		chowned:  map[string]bool{},
+	}
+	return fs, nil
+}
+
+// rootEntry the root directory, as a directoryEntry
+func (fs *FileSystem) rootEntry() (*directoryEntry, error) {
+	return fs.newDirectoryEntry("", true, fs.rootDir)
+}
+
+// overlayPath the path relative to the root, as used for the workspace and in hidden, e.g. "etc/hosts",
+// or "" for the root itself
+func overlayPath(p string) string {
+	return path.Clean("/" + p)[1:]
+}
+
+// upperPath where a path is in the workspace
+func (fs *FileSystem) upperPath(p string) string {
+	return filepath.Join(fs.workspace, filepath.FromSlash(p))
+}
+
+// lowerVisible whether a path in the image can still be seen, as neither it nor any of its parents has
+// been removed or replaced
+func (o *overlay) lowerVisible(p string) bool {
+	for ; p != "" && p != "."; p = path.Dir(p) {
+		if o.hidden[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerStat get a path in the image, if it is there and visible
+func (o *overlay) lowerStat(p string) (*directoryEntry, error) {
+	if p == "" {
+		return o.lower.rootEntry()
+	}
+	if !o.lowerVisible(p) {
+		return nil, os.ErrNotExist
+	}
+	entries, err := o.lower.readDirectory(path.Dir("/" + p))
+	if err != nil {
+		// a parent is not there, or is not a directory
+		return nil, os.ErrNotExist
+	}
+	name := path.Base(p)
+	for _, e := range entries {
+		if e.Name() == name {
+			return e, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// overlayStat get a path in the workspace, or else in the image
+func (fs *FileSystem) overlayStat(p string) (os.FileInfo, error) {
+	fi, err := os.Lstat(fs.upperPath(p))
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return fi, err
+	}
+	e, err := fs.overlay.lowerStat(p)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// copyUp copy a file, directory or symlink from the image into the workspace, along with its parents,
+// unless it already is there. A directory is copied without its contents, which are still taken from the image.
+func (fs *FileSystem) copyUp(p string) error {
+	full := fs.upperPath(p)
+	if _, err := os.Lstat(full); err == nil {
+		return nil
+	}
+	e, err := fs.overlay.lowerStat(p)
+	if err != nil {
+		return fmt.Errorf("could not find %s: %w", p, err)
+	}
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+	if err := fs.copyUp(parent); err != nil {
+		return err
+	}
+	// adding to the parent changes its time, which copying up should not
+	parentInfo, err := os.Stat(fs.upperPath(parent))
+	if err != nil {
+		return fmt.Errorf("could not get info for %s: %v", parent, err)
+	}
+
+	mode := e.Mode()
+	switch {
+	case mode.IsDir():
+		if err := os.Mkdir(full, mode.Perm()|0o700); err != nil {
+			return fmt.Errorf("could not copy directory %s: %v", p, err)
+		}
+	case mode.IsRegular():
+		if err := fs.copyUpFile(e, full); err != nil {
+			return fmt.Errorf("could not copy file %s: %v", p, err)
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := e.Readlink()
+		if err != nil {
+			return fmt.Errorf("could not read symlink %s: %v", p, err)
+		}
+		if err := os.Symlink(target, full); err != nil {
+			return fmt.Errorf("could not copy symlink %s: %v", p, err)
+		}
+	default:
+		return fmt.Errorf("cannot copy %s of type %v into the workspace", p, mode.Type())
+	}
+	if mode&os.ModeSymlink == 0 {
+		if err := os.Chtimes(full, e.ModTime(), e.ModTime()); err != nil {
+			return fmt.Errorf("could not set times of %s: %v", p, err)
+		}
+	}
+	if err := os.Chtimes(fs.upperPath(parent), parentInfo.ModTime(), parentInfo.ModTime()); err != nil {
+		return fmt.Errorf("could not set times of %s: %v", parent, err)
+	}
+	fs.overlay.origin[p] = p
+	return nil
+}
+
+// copyUpFile copy the contents of a file in the image to the workspace
+func (fs *FileSystem) copyUpFile(e *directoryEntry, full string) error {
+	in, err := e.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(full, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyUpTree copy a file or directory into the workspace, with everything under it
+func (fs *FileSystem) copyUpTree(p string) error {
+	if err := fs.copyUp(p); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(fs.upperPath(p))
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+	entries, err := fs.overlayReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := fs.copyUpTree(path.Join(p, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlaySymlink make a symlink at p with the target target, copying up the directory it is made in
+func (fs *FileSystem) overlaySymlink(target, p string) error {
+	if _, err := fs.overlayStat(p); err == nil {
+		return fmt.Errorf("cannot create symlink %s: file exists", p)
+	}
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+	if pi, err := fs.overlayStat(parent); err != nil || !pi.IsDir() {
+		return fmt.Errorf("symlink %s has no directory to be created in", p)
+	}
+	if err := fs.copyUp(parent); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, fs.upperPath(p)); err != nil {
+		return fmt.Errorf("could not create symlink %s: %v", p, err)
+	}
+	return nil
+}
+
+// overlayChange copy up a file or directory, and change it in the workspace with change, which is given
+// where it is there. If it came from the image, it is recorded in changed, if that is not nil.
+func (fs *FileSystem) overlayChange(p string, changed map[string]bool, change func(full string) error) error {
+	if err := fs.copyUp(p); err != nil {
+		return err
+	}
+	if err := change(fs.upperPath(p)); err != nil {
+		return err
+	}
+	// the root is always there, and so never copied up
+	if origin, ok := fs.overlay.origin[p]; changed != nil && (ok || p == "") {
+		changed[origin] = true
+	}
+	return nil
+}
+
+// overlayReadDir list a directory, with what is in the workspace in place of what is in the image
+func (fs *FileSystem) overlayReadDir(p string) ([]os.FileInfo, error) {
+	fi, err := fs.overlayStat(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", p, err)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("could not read directory %s: not a directory", p)
+	}
+	byName := map[string]os.FileInfo{}
+	// nothing from the image under a directory in the workspace that replaced one there
+	if fs.overlay.lowerVisible(p) {
+		if lower, err := fs.overlay.lowerStat(p); err == nil && lower.IsDir() {
+			entries, err := fs.overlay.lower.readDirectory("/" + p)
+			if err != nil {
+				return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+			}
+			for _, e := range entries {
+				if !fs.overlay.hidden[path.Join(p, e.Name())] {
+					byName[e.Name()] = e
+				}
+			}
+		}
+	}
+	upper, err := os.ReadDir(fs.upperPath(p))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+	}
+	for _, e := range upper {
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %v", p, err)
+		}
+		byName[e.Name()] = info
+	}
+	fis := make([]os.FileInfo, 0, len(byName))
+	for _, fi := range byName {
+		fis = append(fis, fi)
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// overlayOpenFile open a file from the workspace, or from the image if it is only there and is only to be
+// read, copying it up otherwise
+func (fs *FileSystem) overlayOpenFile(p string, flag int, writeMode bool) (filesystem.File, error) {
+	fi, err := fs.overlayStat(p)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, fmt.Errorf("target file %s already exists", p)
+	case err == nil && !writeMode:
+		if e, ok := fi.(*directoryEntry); ok {
+			return e.Open()
+		}
+	case err == nil:
+		if err := fs.copyUp(p); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE != 0:
+		parent := path.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+		if pi, err := fs.overlayStat(parent); err != nil || !pi.IsDir() {
+			return nil, fmt.Errorf("target file %s has no directory to be created in", p)
+		}
+		if err := fs.copyUp(parent); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("target file %s does not exist: %w", p, err)
+	}
+	f, err := os.OpenFile(fs.upperPath(p), flag, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", p, err)
+	}
+	return f, nil
+}
+
+// overlayMkdir make a directory and any parents, copying up whichever of them are in the image
+func (fs *FileSystem) overlayMkdir(p string) error {
+	if p == "" {
+		return nil
+	}
+	if fi, err := fs.overlayStat(p); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("could not create directory %s: file exists", p)
+		}
+		return nil
+	}
+	parent := path.Dir(p)
+	if parent == "." {
+		parent = ""
+	}
+	if err := fs.overlayMkdir(parent); err != nil {
+		return err
+	}
+	if err := fs.copyUp(parent); err != nil {
+		return err
+	}
+	if err := os.Mkdir(fs.upperPath(p), 0o755); err != nil {
+		return fmt.Errorf("could not create directory %s: %v", p, err)
+	}
+	return nil
+}
+
+// overlayRemove remove a file or empty directory, hiding it if it is in the image
+func (fs *FileSystem) overlayRemove(p string) error {
+	if p == "" {
+		return fmt.Errorf("cannot remove the root directory")
+	}
+	fi, err := fs.overlayStat(p)
+	if err != nil {
+		return fmt.Errorf("could not remove %s: %w", p, err)
+	}
+	if fi.IsDir() {
+		entries, err := fs.overlayReadDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("could not remove %s: directory not empty", p)
+		}
+	}
+	if err := os.Remove(fs.upperPath(p)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not remove %s: %v", p, err)
+	}
+	if _, err := fs.overlay.lowerStat(p); err == nil {
+		fs.overlay.hidden[p] = true
+	}
+	delete(fs.overlay.origin, p)
+	return nil
+}
+
+// overlayRename move a file or directory, which is copied up along with everything in it
+func (fs *FileSystem) overlayRename(oldpath, newpath string) error {
+	if oldpath == "" || newpath == "" {
+		return fmt.Errorf("cannot rename the root directory")
+	}
+	if oldpath == newpath {
+		return nil
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return fmt.Errorf("cannot move %s into itself", oldpath)
+	}
+	oldInfo, err := fs.overlayStat(oldpath)
+	if err != nil {
+		return fmt.Errorf("could not rename %s: %w", oldpath, err)
+	}
+	parent := path.Dir(newpath)
+	if parent == "." {
+		parent = ""
+	}
+	if pi, err := fs.overlayStat(parent); err != nil || !pi.IsDir() {
+		return fmt.Errorf("could not rename %s to %s: no directory to move it to", oldpath, newpath)
+	}
+	// whatever is at the new path is replaced, if it can be
+	if newInfo, err := fs.overlayStat(newpath); err == nil {
+		if newInfo.IsDir() != oldInfo.IsDir() {
+			return fmt.Errorf("could not rename %s to %s: one is a directory and the other is not", oldpath, newpath)
+		}
+		if err := fs.overlayRemove(newpath); err != nil {
+			return err
+		}
+	}
+	if err := fs.copyUpTree(oldpath); err != nil {
+		return err
+	}
+	if err := fs.copyUp(parent); err != nil {
+		return err
+	}
+	if err := os.Rename(fs.upperPath(oldpath), fs.upperPath(newpath)); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", oldpath, newpath, err)
+	}
+	if _, err := fs.overlay.lowerStat(oldpath); err == nil {
+		fs.overlay.hidden[oldpath] = true
+	}
+	for p, origin := range fs.overlay.origin {
+		if p == oldpath || strings.HasPrefix(p, oldpath+"/") {
+			delete(fs.overlay.origin, p)
+			fs.overlay.origin[newpath+strings.TrimPrefix(p, oldpath)] = origin
+		}
+	}
+	return nil
+}
+
+// overlaySource the files of the workspace, in place of those of the image under it
+type overlaySource struct {
+	upper   *hostSource
+	lower   *filesystemSource
+	overlay *overlay
+	// fromLower paths whose contents are read from the image
+	fromLower map[string]bool
+}
+
+func newOverlaySource(fs *FileSystem, grafts []GraftPoint, modTime time.Time) *overlaySource {
+	return &overlaySource{
+		upper:     newHostSource(fs.workspace, grafts, modTime),
+		lower:     newFilesystemSource(fs.overlay.lower, modTime),
+		overlay:   fs.overlay,
+		fromLower: map[string]bool{},
+	}
+}
+
+func (o *overlaySource) walk() ([]*finalizeFileInfo, error) {
+	upper, err := o.upper.walk()
+	if err != nil {
+		return nil, err
+	}
+	lower, err := o.lower.walk()
+	if err != nil {
+		return nil, fmt.Errorf("error walking image: %v", err)
+	}
+	root, err := o.overlay.lower.rootEntry()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read root directory of image: %v", err)
+	}
+	// what is copied up from the image keeps its extended attributes, and, unless Chown or Chmod changed
+	// them, its owner and mode, rather than those of the copy in the workspace
+	lowerByPath := make(map[string]*finalizeFileInfo, len(lower))
+	for _, fi := range lower {
+		lowerByPath[fi.path] = fi
+	}
+	for _, fi := range upper[1:] {
+		origin := o.overlay.origin[fi.path]
+		if from, ok := lowerByPath[origin]; ok && from.fileType == fi.fileType {
+			if !o.overlay.chowned[origin] {
+				fi.uid, fi.gid = from.uid, from.gid
+			}
+			if !o.overlay.chmodded[origin] {
+				fi.mode = from.mode
+			}
+			if fi.xattrs == nil {
+				fi.xattrs = map[string]string{}
+			}
+			for k, v := range from.xattrs {
+				if _, ok := fi.xattrs[k]; !ok {
+					fi.xattrs[k] = v
+				}
+			}
+		}
+	}
+	o.merge(upper[0], lower[0])
+	if !o.overlay.chmodded[""] {
+		upper[0].mode = root.Mode()
+	}
+	if !o.overlay.chowned[""] {
+		upper[0].uid, upper[0].gid = root.UID(), root.GID()
+	}
+	return flattenTree(upper[0], len(upper)+len(lower)), nil
+}
+
+// merge add what is in the image to what is in the workspace at the same path, which takes precedence
+func (o *overlaySource) merge(upper, lower *finalizeFileInfo) {
+	if !upper.isDir || !lower.isDir {
+		return
+	}
+	byName := make(map[string]*finalizeFileInfo, len(upper.children))
+	for _, child := range upper.children {
+		byName[child.name] = child
+	}
+	for _, child := range lower.children {
+		if o.overlay.hidden[child.path] {
+			continue
+		}
+		if existing, ok := byName[child.name]; ok {
+			o.merge(existing, child)
+			continue
+		}
+		o.addLower(child)
+		upper.children = append(upper.children, child)
+	}
+}
+
+// addLower take a file or directory, and everything in it that is still there, from the image
+func (o *overlaySource) addLower(fi *finalizeFileInfo) {
+	o.fromLower[fi.path] = true
+	children := fi.children[:0]
+	for _, child := range fi.children {
+		if !o.overlay.hidden[child.path] {
+			o.addLower(child)
+			children = append(children, child)
+		}
+	}
+	fi.children = children
+}
+
+func (o *overlaySource) open(p string) (readerAtCloser, error) {
+	if o.fromLower[p] {
+		return o.lower.open(p)
+	}
+	return o.upper.open(p)
+}
+
+func (o *overlaySource) readlink(p string) (string, error) {
+	if o.fromLower[p] {
+		return o.lower.readlink(p)
+	}
+	return o.upper.readlink(p)
+}
+
+func (o *overlaySource) deviceNumbers(p string) (major, minor uint32, err error) {
+	if o.fromLower[p] {
+		return o.lower.deviceNumbers(p)
+	}
+	return o.upper.deviceNumbers(p)
+}
+
+func (o *overlaySource) rawFile(p string) *rawFile {
+	if o.fromLower[p] {
+		return o.lower.rawFile(p)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package squashfs_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/filesystem/squashfs"
+)
+
+func TestOverlay(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tool := bytes.Repeat([]byte("a tool that spans several blocks "), 1000)
+
+	// the image to edit
+	lowerBackend, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(lowerBackend, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	for _, dir := range []string{"/etc", "/usr/bin", "/usr/share/doc", "/var/lib"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatalf("Failed to squashfs.Mkdir(%s): %v", dir, err)
+		}
+	}
+	for p, data := range map[string][]byte{
+		"/etc/hosts":            []byte("127.0.0.1 localhost\n"),
+		"/etc/passwd":           []byte("root:x:0:0::/root:/bin/sh\n"),
+		"/usr/bin/tool":         tool,
+		"/usr/share/doc/README": []byte("read me\n"),
+		"/var/lib/state":        []byte("state\n"),
+	} {
+		f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("Failed to squashfs.OpenFile(%s): %v", p, err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("error writing %s: %v", p, err)
+		}
+	}
+	if err := os.Symlink("hosts", path.Join(fs.Workspace(), "etc/link")); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	owner := uint32(1234)
+	if err := fs.Finalize(squashfs.FinalizeOptions{FileUID: &owner, FileGID: &owner, ModTime: modTime}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	lower, err := squashfs.Read(lowerBackend, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+
+	b, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err = squashfs.Overlay(lower, b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening overlay: %v", err)
+	}
+
+	readFile := func(p string) string {
+		t.Helper()
+		f, err := fs.OpenFile(p, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", p, err)
+		}
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("unable to read %s: %v", p, err)
+		}
+		return string(data)
+	}
+	writeFile := func(p string, flag int, data string) {
+		t.Helper()
+		f, err := fs.OpenFile(p, flag)
+		if err != nil {
+			t.Fatalf("unable to open %s for writing: %v", p, err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatalf("unable to write %s: %v", p, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unable to close %s: %v", p, err)
+		}
+	}
+	names := func(p string) []string {
+		t.Helper()
+		fis, err := fs.ReadDir(p)
+		if err != nil {
+			t.Fatalf("unable to read directory %s: %v", p, err)
+		}
+		var n []string
+		for _, fi := range fis {
+			n = append(n, fi.Name())
+		}
+		return n
+	}
+
+	// the image shows through until it is changed
+	if got := readFile("/etc/hosts"); got != "127.0.0.1 localhost\n" {
+		t.Errorf("read %q from image", got)
+	}
+	writeFile("/etc/hosts", os.O_RDWR|os.O_TRUNC, "10.0.0.1 server\n")
+	writeFile("/etc/passwd", os.O_WRONLY|os.O_APPEND, "user:x:1000:1000::/home/user:/bin/sh\n")
+	writeFile("/etc/new.conf", os.O_RDWR|os.O_CREATE, "new\n")
+	if got := readFile("/etc/hosts"); got != "10.0.0.1 server\n" {
+		t.Errorf("read %q after change", got)
+	}
+	if got, expected := names("/etc"), []string{"hosts", "link", "new.conf", "passwd"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("/etc has %v instead of %v", got, expected)
+	}
+	if _, err := fs.OpenFile("/etc/new.conf", os.O_RDWR|os.O_CREATE|os.O_EXCL); err == nil {
+		t.Errorf("no error creating existing file exclusively")
+	}
+
+	// removing from the image
+	if err := fs.Remove("/usr/share"); err == nil {
+		t.Errorf("no error removing directory that is not empty")
+	}
+	for _, p := range []string{"/usr/share/doc/README", "/usr/share/doc", "/usr/share"} {
+		if err := fs.Remove(p); err != nil {
+			t.Fatalf("unable to remove %s: %v", p, err)
+		}
+	}
+	if _, err := fs.OpenFile("/usr/share/doc/README", os.O_RDONLY); err == nil {
+		t.Errorf("no error opening removed file")
+	}
+	// a directory removed and made again does not have what was in the image
+	if err := fs.Remove("/var/lib/state"); err != nil {
+		t.Fatalf("unable to remove: %v", err)
+	}
+	if err := fs.Remove("/var/lib"); err != nil {
+		t.Fatalf("unable to remove: %v", err)
+	}
+	if err := fs.Mkdir("/var/lib/new"); err != nil {
+		t.Fatalf("unable to make directory: %v", err)
+	}
+	if got, expected := names("/var/lib"), []string{"new"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("/var/lib has %v instead of %v", got, expected)
+	}
+	if err := fs.Rename("/usr/bin", "/usr/sbin"); err != nil {
+		t.Fatalf("unable to rename: %v", err)
+	}
+	if err := fs.Mkdir("/etc/hosts/dir"); err == nil {
+		t.Errorf("no error making directory under a file")
+	}
+
+	if err := fs.Finalize(squashfs.FinalizeOptions{ModTime: modTime}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	fs, err = squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read merged image: %v", err)
+	}
+
+	expected := map[string]struct {
+		data  string
+		owner uint32
+		dir   bool
+	}{
+		"/etc":           {dir: true, owner: owner},
+		"/etc/hosts":     {data: "10.0.0.1 server\n", owner: owner},
+		"/etc/passwd":    {data: "root:x:0:0::/root:/bin/sh\nuser:x:1000:1000::/home/user:/bin/sh\n", owner: owner},
+		"/etc/new.conf":  {data: "new\n", owner: uint32(os.Getuid())},
+		"/etc/link":      {owner: owner},
+		"/usr":           {dir: true, owner: owner},
+		"/usr/sbin":      {dir: true, owner: owner},
+		"/usr/sbin/tool": {data: string(tool), owner: owner},
+		"/var":           {dir: true, owner: owner},
+		"/var/lib":       {dir: true, owner: uint32(os.Getuid())},
+		"/var/lib/new":   {dir: true, owner: uint32(os.Getuid())},
+	}
+	found := map[string]bool{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		fis, err := fs.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("unable to read directory %s: %v", dir, err)
+		}
+		for _, fi := range fis {
+			p := path.Join(dir, fi.Name())
+			found[p] = true
+			e, ok := expected[p]
+			if !ok {
+				t.Errorf("unexpected %s", p)
+				continue
+			}
+			if stat := fi.Sys().(squashfs.FileStat); stat.UID() != e.owner || fi.IsDir() != e.dir {
+				t.Errorf("%s is owned by %d, directory %v, instead of %d, %v", p, stat.UID(), fi.IsDir(), e.owner, e.dir)
+			}
+			switch {
+			case fi.IsDir():
+				walk(p)
+			case fi.Mode()&os.ModeSymlink != 0:
+				if target, err := fi.Sys().(squashfs.FileStat).Readlink(); err != nil || target != "hosts" {
+					t.Errorf("%s links to %q, error %v", p, target, err)
+				}
+			default:
+				f, err := fs.OpenFile(p, os.O_RDONLY)
+				if err != nil {
+					t.Fatalf("unable to open %s: %v", p, err)
+				}
+				if data, err := io.ReadAll(f); err != nil || string(data) != e.data {
+					t.Errorf("%s has %d bytes instead of %d, error %v", p, len(data), len(e.data), err)
+				}
+			}
+		}
+	}
+	walk("/")
+	for p := range expected {
+		if !found[p] {
+			t.Errorf("%s is missing", p)
+		}
+	}
+}
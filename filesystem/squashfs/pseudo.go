@@ -0,0 +1,357 @@
+package squashfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PseudoFileType the type of a pseudo file definition, the letter that mksquashfs uses for it
+type PseudoFileType byte
+
+const (
+	// PseudoDirectory a directory
+	PseudoDirectory PseudoFileType = 'd'
+	// PseudoRegularFile a regular file, whose contents are the output of Command
+	PseudoRegularFile PseudoFileType = 'f'
+	// PseudoSymlink a symlink to Target
+	PseudoSymlink PseudoFileType = 's'
+	// PseudoBlockDevice a block device with the numbers Major and Minor
+	PseudoBlockDevice PseudoFileType = 'b'
+	// PseudoCharDevice a char device with the numbers Major and Minor
+	PseudoCharDevice PseudoFileType = 'c'
+	// PseudoFifo a named pipe
+	PseudoFifo PseudoFileType = 'p'
+	// PseudoSocket a socket
+	PseudoSocket PseudoFileType = 'i'
+	// PseudoModify change the mode and owner of a file that already is in the image
+	PseudoModify PseudoFileType = 'm'
+)
+
+// PseudoFile a pseudo file definition, as mksquashfs takes with -p and -pf: a file that is added to the image, or
+// changed in it, as Finalize writes it out, without being in the workspace. Device nodes can be added this way
+// without the privileges needed to create them on the host.
+type PseudoFile struct {
+	// Path the path of the file in the image, relative to its root. Its parent must already be in the image, or be
+	// defined by an earlier pseudo file, and, unless Type is PseudoModify, the path itself must not be.
+	Path string
+	Type PseudoFileType
+	// Mode the permission bits of the file, which may include os.ModeSetuid, os.ModeSetgid and os.ModeSticky
+	Mode os.FileMode
+	UID  uint32
+	GID  uint32
+	// Major and Minor the numbers of a block or char device
+	Major uint32
+	Minor uint32
+	// Target the target of a symlink
+	Target string
+	// Command a shell command, run with /bin/sh -c, whose output is the contents of a regular file. It is run
+	// each time the image is written, including by EstimateSize.
+	Command string
+}
+
+// ParsePseudoFiles read pseudo file definitions in the format of the file that mksquashfs takes with -pf, one per
+// line, e.g.
+//
+//	dev d 755 0 0
+//	dev/console c 600 0 0 5 1
+//	etc/hostname f 644 0 0 echo myhost
+//	bin/sh s 777 0 0 busybox
+//	etc/shadow m 600 0 0
+//
+// The mode is in octal, and the uid and gid are numbers. A path with spaces in it is quoted, or has them escaped
+// with a backslash. Empty lines, and those that start with #, are skipped.
+func ParsePseudoFiles(r io.Reader) ([]PseudoFile, error) {
+	var definitions []PseudoFile
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p, err := parsePseudoFile(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pseudo file definition on line %d: %v", line, err)
+		}
+		definitions = append(definitions, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pseudo file definitions: %v", err)
+	}
+	return definitions, nil
+}
+
+// parsePseudoFile parse a single pseudo file definition
+func parsePseudoFile(text string) (PseudoFile, error) {
+	var p PseudoFile
+	name, rest, err := pseudoFileName(text)
+	if err != nil {
+		return p, err
+	}
+	p.Path = name
+	// the type, mode, uid and gid, followed by whatever the type has after them
+	fields, rest := splitFields(rest, 4)
+	if len(fields) < 4 {
+		return p, fmt.Errorf("expected a type, mode, uid and gid after the path %q", name)
+	}
+	if len(fields[0]) != 1 {
+		return p, fmt.Errorf("unknown type %q", fields[0])
+	}
+	p.Type = PseudoFileType(fields[0][0])
+	mode, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil || mode > 0o7777 {
+		return p, fmt.Errorf("invalid octal mode %q", fields[1])
+	}
+	p.Mode = os.FileMode(mode & 0o777)
+	for bit, flag := range map[uint64]os.FileMode{0o4000: os.ModeSetuid, 0o2000: os.ModeSetgid, 0o1000: os.ModeSticky} {
+		if mode&bit != 0 {
+			p.Mode |= flag
+		}
+	}
+	ids := make([]uint32, 2)
+	for i, s := range fields[2:4] {
+		id, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid uid or gid %q", s)
+		}
+		ids[i] = uint32(id)
+	}
+	p.UID, p.GID = ids[0], ids[1]
+
+	switch p.Type {
+	case PseudoDirectory, PseudoFifo, PseudoSocket, PseudoModify:
+		if rest != "" {
+			return p, fmt.Errorf("unexpected %q after the gid", rest)
+		}
+	case PseudoBlockDevice, PseudoCharDevice:
+		numbers, extra := splitFields(rest, 2)
+		if len(numbers) != 2 || extra != "" {
+			return p, fmt.Errorf("expected the major and minor numbers of the device after the gid")
+		}
+		major, err := strconv.ParseUint(numbers[0], 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid major number %q", numbers[0])
+		}
+		minor, err := strconv.ParseUint(numbers[1], 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("invalid minor number %q", numbers[1])
+		}
+		p.Major, p.Minor = uint32(major), uint32(minor)
+	case PseudoSymlink:
+		if rest == "" {
+			return p, fmt.Errorf("expected the target of the symlink after the gid")
+		}
+		p.Target = rest
+	case PseudoRegularFile:
+		if rest == "" {
+			return p, fmt.Errorf("expected the command that gives the contents of the file after the gid")
+		}
+		p.Command = rest
+	default:
+		return p, fmt.Errorf("unknown type %q", fields[0])
+	}
+	return p, nil
+}
+
+// pseudoFileName split the path at the start of a pseudo file definition from the rest of it. The path is quoted,
+// or ends at the first space, and a backslash escapes the character after it either way.
+func pseudoFileName(text string) (name, rest string, err error) {
+	var (
+		b      strings.Builder
+		quoted = strings.HasPrefix(text, `"`)
+		i      = 0
+	)
+	if quoted {
+		i++
+	}
+	for ; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text):
+			i++
+			b.WriteByte(text[i])
+			continue
+		case quoted && c == '"':
+			return b.String(), strings.TrimSpace(text[i+1:]), nil
+		case !quoted && (c == ' ' || c == '\t'):
+			return b.String(), strings.TrimSpace(text[i:]), nil
+		}
+		b.WriteByte(c)
+	}
+	if quoted {
+		return "", "", fmt.Errorf("unterminated quote in path")
+	}
+	return b.String(), "", nil
+}
+
+// splitFields split the first n fields separated by spaces off s, returning them and the rest of s
+func splitFields(s string, n int) (fields []string, rest string) {
+	rest = strings.TrimSpace(s)
+	for len(fields) < n && rest != "" {
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		fields = append(fields, rest[:end])
+		rest = strings.TrimSpace(rest[end:])
+	}
+	return fields, rest
+}
+
+// pseudoSource the files of another source, with pseudo files added to them, or changed by them
+type pseudoSource struct {
+	finalizeSource
+	definitions []PseudoFile
+	// contents of regular files, targets of symlinks, and device numbers, of the pseudo files, by path
+	contents map[string][]byte
+	targets  map[string]string
+	devices  map[string][2]uint32
+	// modTime of the pseudo files
+	modTime time.Time
+}
+
+func newPseudoSource(src finalizeSource, definitions []PseudoFile, modTime time.Time) *pseudoSource {
+	return &pseudoSource{
+		finalizeSource: src,
+		definitions:    definitions,
+		contents:       map[string][]byte{},
+		targets:        map[string]string{},
+		devices:        map[string][2]uint32{},
+		modTime:        modTime,
+	}
+}
+
+func (s *pseudoSource) walk() ([]*finalizeFileInfo, error) {
+	fileList, err := s.finalizeSource.walk()
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*finalizeFileInfo, len(fileList)+len(s.definitions))
+	for _, fi := range fileList {
+		byPath[fi.path] = fi
+	}
+	for _, d := range s.definitions {
+		if err := s.add(d, byPath); err != nil {
+			return nil, fmt.Errorf("invalid pseudo file %s: %v", d.Path, err)
+		}
+	}
+	return flattenTree(fileList[0], len(byPath)), nil
+}
+
+// add add or change the file that d defines in the tree, whose entries are in byPath
+func (s *pseudoSource) add(d PseudoFile, byPath map[string]*finalizeFileInfo) error {
+	fp := path.Clean("/" + d.Path)[1:]
+	if fp == "" {
+		fp = "."
+	}
+	perm := d.Mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	existing := byPath[fp]
+	if d.Type == PseudoModify {
+		if existing == nil {
+			return fmt.Errorf("there is no such file to change")
+		}
+		existing.mode = existing.mode.Type() | perm
+		existing.uid, existing.gid = d.UID, d.GID
+		return nil
+	}
+	if existing != nil {
+		return fmt.Errorf("there already is a file at that path")
+	}
+	parent := byPath[path.Dir(fp)]
+	if parent == nil || !parent.isDir {
+		return fmt.Errorf("parent directory %s is not in the image", path.Dir(fp))
+	}
+
+	var mode os.FileMode
+	switch d.Type {
+	case PseudoDirectory:
+		mode = os.ModeDir
+	case PseudoRegularFile:
+		out, err := exec.Command("/bin/sh", "-c", d.Command).Output()
+		if err != nil {
+			return fmt.Errorf("error running %q: %v", d.Command, err)
+		}
+		s.contents[fp] = out
+	case PseudoSymlink:
+		mode = os.ModeSymlink
+		s.targets[fp] = d.Target
+	case PseudoBlockDevice:
+		mode = os.ModeDevice
+		s.devices[fp] = [2]uint32{d.Major, d.Minor}
+	case PseudoCharDevice:
+		mode = os.ModeDevice | os.ModeCharDevice
+		s.devices[fp] = [2]uint32{d.Major, d.Minor}
+	case PseudoFifo:
+		mode = os.ModeNamedPipe
+	case PseudoSocket:
+		mode = os.ModeSocket
+	default:
+		return fmt.Errorf("unknown type %q", rune(d.Type))
+	}
+	entry := &finalizeFileInfo{
+		path:     fp,
+		name:     path.Base(fp),
+		isDir:    d.Type == PseudoDirectory,
+		modTime:  s.modTime,
+		mode:     mode | perm,
+		fileType: modeFileType(mode),
+		size:     int64(len(s.contents[fp])),
+		xattrs:   map[string]string{},
+		uid:      d.UID,
+		gid:      d.GID,
+		links:    1,
+	}
+	if entry.isDir {
+		entry.children = make([]*finalizeFileInfo, 0, 20)
+	}
+	parent.children = append(parent.children, entry)
+	byPath[fp] = entry
+	return nil
+}
+
+func (s *pseudoSource) open(p string) (readerAtCloser, error) {
+	if content, ok := s.contents[p]; ok {
+		return nopCloserReaderAt{bytes.NewReader(content)}, nil
+	}
+	return s.finalizeSource.open(p)
+}
+
+func (s *pseudoSource) readlink(p string) (string, error) {
+	if target, ok := s.targets[p]; ok {
+		return target, nil
+	}
+	return s.finalizeSource.readlink(p)
+}
+
+func (s *pseudoSource) deviceNumbers(p string) (major, minor uint32, err error) {
+	if device, ok := s.devices[p]; ok {
+		return device[0], device[1], nil
+	}
+	return s.finalizeSource.deviceNumbers(p)
+}
+
+func (s *pseudoSource) rawFile(p string) *rawFile {
+	if _, ok := s.contents[p]; ok {
+		return nil
+	}
+	if raw, ok := s.finalizeSource.(rawFileSource); ok {
+		return raw.rawFile(p)
+	}
+	return nil
+}
+
+// nopCloserReaderAt an io.ReaderAt with a Close that does nothing
+type nopCloserReaderAt struct {
+	io.ReaderAt
+}
+
+func (nopCloserReaderAt) Close() error {
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"math"
 	"os"
 	"path"
+	"time"
 
 	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/filesystem"
@@ -34,6 +35,26 @@ type FileSystem struct {
 	xattrs     *xAttrTable
 	rootDir    inode
 	cache      *lru
+	// overlay the image under the workspace, for a filesystem opened with Overlay
+	overlay *overlay
+	// normalization how names are normalized when they are looked up, see SetNameNormalization
+	normalization filesystem.NameNormalization
+	// mmap the mapping of the backend that blocks are read from, see SetMmap
+	mmap mapping
+	// setXattrs the extended attributes given with Setxattr, by path and name, for Finalize to write out;
+	// a nil value is one removed with Removexattr
+	setXattrs map[string]map[string][]byte
+}
+
+// offsetStorage a backend.Storage for a filesystem that does not start at the beginning of it,
+// such as one in a partition, so that reads can use locations from the start of the filesystem
+type offsetStorage struct {
+	backend.Storage
+	start int64
+}
+
+func (o offsetStorage) ReadAt(p []byte, off int64) (int, error) {
+	return o.Storage.ReadAt(p, off+o.start)
 }
 
 // Equal compare if two filesystems are equal
@@ -48,6 +69,19 @@ func (fs *FileSystem) Label() string {
 	return ""
 }
 
+// UUID return the filesystem UUID. squashfs has none, so this is always empty.
+func (fs *FileSystem) UUID() string {
+	return ""
+}
+
+// Usage returns the size of the filesystem. It is read-only, so none of it is free.
+func (fs *FileSystem) Usage() filesystem.Usage {
+	if fs.superblock == nil {
+		return filesystem.Usage{}
+	}
+	return filesystem.Usage{Size: int64(fs.superblock.size)}
+}
+
 func (fs *FileSystem) SetLabel(string) error {
 	return filesystem.ErrReadonlyFilesystem
 }
@@ -177,11 +211,21 @@ func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error)
 		return nil, fmt.Errorf("error parsing superblock: %v", err)
 	}
 
+	// every location in squashfs is from the start of the filesystem
+	if start != 0 {
+		b = offsetStorage{Storage: b, start: start}
+	}
+
 	// create the compressor function we will use
 	compress, err := newCompressor(s.compression)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create compressor: %v", err)
 	}
+	if s.compressorOptions && compress != nil {
+		if err := readCompressorOptions(b, compress); err != nil {
+			return nil, fmt.Errorf("error reading compressor options: %v", err)
+		}
+	}
 
 	// load fragments
 	fragments, err := readFragmentTable(s, b, compress)
@@ -230,7 +274,12 @@ func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error)
 }
 
 // interface guard
-var _ filesystem.FileSystem = (*FileSystem)(nil)
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
 
 // Type returns the type code for the filesystem. Always returns filesystem.TypeFat32
 func (fs *FileSystem) Type() filesystem.Type {
@@ -261,6 +310,23 @@ func (fs *FileSystem) GetCacheSize() int {
 	return fs.cache.maxBlocks * int(fs.blocksize)
 }
 
+// NameNormalization get how names in the image are normalized when they are looked up
+func (fs *FileSystem) NameNormalization() filesystem.NameNormalization {
+	return fs.normalization
+}
+
+// SetNameNormalization set how names are normalized when they are looked up in the image, so that a name
+// finds an entry whether either was written composed or decomposed, as in an image made on macOS and read on
+// Linux. It does not change the names that ReadDir returns. To normalize the names written by Finalize, use
+// FinalizeOptions.NameNormalization. The default is filesystem.NormalizationNone.
+func (fs *FileSystem) SetNameNormalization(n filesystem.NameNormalization) error {
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	fs.normalization = n
+	return nil
+}
+
 // Mkdir make a directory at the given path. It is equivalent to `mkdir -p`, i.e. idempotent, in that:
 //
 // * It will make the entire tree path if it does not exist
@@ -271,6 +337,9 @@ func (fs *FileSystem) Mkdir(p string) error {
 	if fs.workspace == "" {
 		return filesystem.ErrReadonlyFilesystem
 	}
+	if fs.overlay != nil {
+		return fs.overlayMkdir(overlayPath(p))
+	}
 	err := os.MkdirAll(path.Join(fs.workspace, p), 0o755)
 	if err != nil {
 		return fmt.Errorf("could not create directory %s: %v", p, err)
@@ -297,30 +366,133 @@ func (fs *FileSystem) Link(oldpath, newpath string) error {
 	return filesystem.ErrNotImplemented
 }
 
-// creates a symbolic link named linkpath which contains the string target.
-//
-//nolint:revive // parameters will be used eventually
+// Symlink creates a symbolic link in the workspace named newpath, which contains the string oldpath
 func (fs *FileSystem) Symlink(oldpath, newpath string) error {
-	// https://dr-emann.github.io/squashfs/squashfs.html#_symbolic_links
-	return filesystem.ErrNotImplemented
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if fs.overlay != nil {
+		return fs.overlaySymlink(oldpath, overlayPath(newpath))
+	}
+	return os.Symlink(oldpath, path.Join(fs.workspace, newpath))
 }
 
-// Chmod changes the mode of the named file to mode. If the file is a symbolic link,
+// Chmod changes the mode of the named file in the workspace to mode. If the file is a symbolic link,
 // it changes the mode of the link's target.
-//
-//nolint:revive // parameters will be used eventually
 func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
-	// https://dr-emann.github.io/squashfs/squashfs.html#_common_inode_header
-	return filesystem.ErrNotImplemented
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if fs.overlay != nil {
+		return fs.overlayChange(overlayPath(name), fs.overlay.chmodded, func(full string) error {
+			return os.Chmod(full, mode)
+		})
+	}
+	return os.Chmod(path.Join(fs.workspace, name), mode)
 }
 
-// Chown changes the numeric uid and gid of the named file. If the file is a symbolic link,
-// it changes the uid and gid of the link's target. A uid or gid of -1 means to not change that value
-//
-//nolint:revive // parameters will be used eventually
+// Chown changes the numeric uid and gid of the named file in the workspace, which needs the privileges to do so
+// on the host; FinalizeOptions.FileUID and FileGID set the owner of every file without them. A symbolic link
+// itself is changed, rather than its target. A uid or gid of -1 means to not change that value
 func (fs *FileSystem) Chown(name string, uid, gid int) error {
-	// https://dr-emann.github.io/squashfs/squashfs.html#_id_table
-	return filesystem.ErrNotImplemented
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if fs.overlay != nil {
+		return fs.overlayChange(overlayPath(name), fs.overlay.chowned, func(full string) error {
+			return os.Lchown(full, uid, gid)
+		})
+	}
+	return os.Lchown(path.Join(fs.workspace, name), uid, gid)
+}
+
+// Chtimes changes the access and modification times of the named file in the workspace, as os.Chtimes does.
+// A zero time.Time leaves that time unchanged. Squashfs keeps only the modification time, to the second.
+func (fs *FileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if fs.overlay != nil {
+		return fs.overlayChange(overlayPath(name), nil, func(full string) error {
+			return os.Chtimes(full, atime, mtime)
+		})
+	}
+	return os.Chtimes(path.Join(fs.workspace, name), atime, mtime)
+}
+
+// Setxattr set the extended attribute name, with its namespace prefix, e.g. security.capability or
+// security.selinux, of the file at p to value, for Finalize to write out, in place of any the file has on the
+// host or in its source. Only the user, trusted and security namespaces can be kept in squashfs. The file need
+// not be there yet, but must be once the tree is put together by Finalize, from the workspace, the graft points
+// or FinalizeOptions.Source, else Finalize fails. The attributes set are written out whether or not
+// FinalizeOptions.Xattrs is set.
+func (fs *FileSystem) Setxattr(p, name string, value []byte) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	if _, _, err := xAttrKeyConvert(name); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	fs.changeXattr(p, name, value)
+	return nil
+}
+
+// Removexattr remove the extended attribute name from the file at p, whether it was set with Setxattr or the
+// file has it on the host or in its source, so that Finalize does not write it out
+func (fs *FileSystem) Removexattr(p, name string) error {
+	if fs.workspace == "" {
+		return filesystem.ErrReadonlyFilesystem
+	}
+	fs.changeXattr(p, name, nil)
+	return nil
+}
+
+// changeXattr record an extended attribute to set, or, if value is nil, to remove, for Finalize
+func (fs *FileSystem) changeXattr(p, name string, value []byte) {
+	fp := overlayPath(p)
+	if fp == "" {
+		fp = "."
+	}
+	if fs.setXattrs == nil {
+		fs.setXattrs = map[string]map[string][]byte{}
+	}
+	if fs.setXattrs[fp] == nil {
+		fs.setXattrs[fp] = map[string][]byte{}
+	}
+	fs.setXattrs[fp][name] = value
+}
+
+// Readlink returns the target of the named symbolic link, from the workspace if there is one, else the image
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	switch {
+	case fs.workspace != "" && fs.overlay != nil:
+		fi, err := fs.overlayStat(overlayPath(name))
+		if err != nil {
+			return "", err
+		}
+		if e, ok := fi.(*directoryEntry); ok {
+			return e.Readlink()
+		}
+		return os.Readlink(fs.upperPath(overlayPath(name)))
+	case fs.workspace != "":
+		return os.Readlink(path.Join(fs.workspace, name))
+	}
+	dir := path.Dir(name)
+	entries, err := fs.readDirectory(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not read directory entries for %s", dir)
+	}
+	e, err := fs.findEntry(entries, path.Base(name))
+	if err != nil {
+		return "", fmt.Errorf("could not read symlink %s: %w", name, err)
+	}
+	if e == nil {
+		return "", fmt.Errorf("target file %s does not exist", name)
+	}
+	return e.Readlink()
 }
 
 // ReadDir return the contents of a given directory in a given filesystem.
@@ -332,6 +504,9 @@ func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
 	var fi []os.FileInfo
 	// non-workspace: read from squashfs
 	// workspace: read from regular filesystem
+	if fs.workspace != "" && fs.overlay != nil {
+		return fs.overlayReadDir(overlayPath(p))
+	}
 	if fs.workspace != "" {
 		fullPath := path.Join(fs.workspace, p)
 		// read the entries
@@ -393,18 +568,13 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 			return nil, fmt.Errorf("could not read directory entries for %s", dir)
 		}
 		// we now know that the directory exists, see if the file exists
-		var targetEntry *directoryEntry
-		for _, e := range entries {
-			eName := e.Name()
-			// cannot do anything with directories
-			if eName == filename && e.IsDir() {
-				return nil, fmt.Errorf("cannot open directory %s as file", p)
-			}
-			if eName == filename {
-				// if we got this far, we have found the file
-				targetEntry = e
-				break
-			}
+		targetEntry, err := fs.findEntry(entries, filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not open %s: %w", p, err)
+		}
+		// cannot do anything with directories
+		if targetEntry != nil && targetEntry.IsDir() {
+			return nil, fmt.Errorf("cannot open directory %s as file", p)
 		}
 
 		// see if the file exists
@@ -416,6 +586,11 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if fs.overlay != nil {
+		f, err = fs.overlayOpenFile(overlayPath(p), flag, writeMode)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		f, err = os.OpenFile(path.Join(fs.workspace, p), flag, 0o644)
 		if err != nil {
@@ -431,6 +606,9 @@ func (fs *FileSystem) Rename(oldpath, newpath string) error {
 	if fs.workspace == "" {
 		return filesystem.ErrReadonlyFilesystem
 	}
+	if fs.overlay != nil {
+		return fs.overlayRename(overlayPath(oldpath), overlayPath(newpath))
+	}
 	return os.Rename(path.Join(fs.workspace, oldpath), path.Join(fs.workspace, newpath))
 }
 
@@ -438,9 +616,31 @@ func (fs *FileSystem) Remove(p string) error {
 	if fs.workspace == "" {
 		return filesystem.ErrReadonlyFilesystem
 	}
+	if fs.overlay != nil {
+		return fs.overlayRemove(overlayPath(p))
+	}
 	return os.Remove(path.Join(fs.workspace, p))
 }
 
+// findEntry the entry of entries that name refers to once normalized, or nil if there is none
+func (fs *FileSystem) findEntry(entries []*directoryEntry, name string) (*directoryEntry, error) {
+	var (
+		matches []*directoryEntry
+		names   []string
+	)
+	for _, e := range entries {
+		if eName := e.Name(); fs.normalization.Equal(eName, name) {
+			matches = append(matches, e)
+			names = append(names, eName)
+		}
+	}
+	i, err := fs.normalization.Resolve(name, names)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	return matches[i], nil
+}
+
 // readDirectory - read directory entry on squashfs only (not workspace)
 func (fs *FileSystem) readDirectory(p string) ([]*directoryEntry, error) {
 	// use the root inode to find the location of the root direectory in the table
@@ -452,36 +652,12 @@ func (fs *FileSystem) readDirectory(p string) ([]*directoryEntry, error) {
 }
 
 func (fs *FileSystem) getDirectoryEntries(p string, in inode) ([]*directoryEntry, error) {
-	var (
-		block  uint32
-		offset uint16
-		size   int
-	)
-
 	// break path down into parts and levels
 	parts := splitPath(p)
 
-	iType := in.inodeType()
-	body := in.getBody()
-	//nolint:exhaustive // we only are looking for directory types here
-	switch iType {
-	case inodeBasicDirectory:
-		dir, _ := body.(*basicDirectory)
-		block = dir.startBlock
-		offset = dir.offset
-		size = int(dir.fileSize)
-	case inodeExtendedDirectory:
-		dir, _ := body.(*extendedDirectory)
-		block = dir.startBlock
-		offset = dir.offset
-		size = int(dir.fileSize)
-	default:
-		return nil, fmt.Errorf("inode is of type %d, neither basic nor extended directory", iType)
-	}
-	// read the directory data from the directory table
-	dir, err := fs.getDirectory(block, offset, size)
+	dir, err := fs.getInodeDirectory(in)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read directory from table: %v", err)
+		return nil, err
 	}
 	entriesRaw := dir.entries
 	var entries []*directoryEntry
@@ -496,29 +672,40 @@ func (fs *FileSystem) getDirectoryEntries(p string, in inode) ([]*directoryEntry
 
 	// it is not, so dig down one level
 	// find the entry among the children that has the desired name
+	var (
+		matches []*directoryEntryRaw
+		names   []string
+	)
 	for _, entry := range entriesRaw {
-		// only care if not self or parent entry
-		checkFilename := entry.name
-		if checkFilename == parts[0] {
-			// read the inode for this entry
-			inode, err := fs.getInode(entry.startBlock, entry.offset, entry.inodeType)
-			if err != nil {
-				return nil, fmt.Errorf("error finding inode for %s: %v", p, err)
-			}
-
-			childPath := ""
-			if len(parts) > 1 {
-				childPath = path.Join(parts[1:]...)
-			}
-			entries, err = fs.getDirectoryEntries(childPath, inode)
-			if err != nil {
-				return nil, fmt.Errorf("could not get entries: %v", err)
-			}
-			return entries, nil
+		if fs.normalization.Equal(entry.name, parts[0]) {
+			matches = append(matches, entry)
+			names = append(names, entry.name)
 		}
 	}
-	// if we made it here, we were not looking for this directory, but did not find it among our children
-	return nil, fmt.Errorf("could not find path %s", p)
+	i, err := fs.normalization.Resolve(parts[0], names)
+	if err != nil {
+		return nil, fmt.Errorf("could not find path %s: %w", p, err)
+	}
+	if i < 0 {
+		// if we made it here, we were not looking for this directory, but did not find it among our children
+		return nil, fmt.Errorf("could not find path %s", p)
+	}
+	entry := matches[i]
+	// read the inode for this entry
+	inode, err := fs.getInode(entry.startBlock, entry.offset, entry.inodeType)
+	if err != nil {
+		return nil, fmt.Errorf("error finding inode for %s: %v", p, err)
+	}
+
+	childPath := ""
+	if len(parts) > 1 {
+		childPath = path.Join(parts[1:]...)
+	}
+	entries, err = fs.getDirectoryEntries(childPath, inode)
+	if err != nil {
+		return nil, fmt.Errorf("could not get entries: %v", err)
+	}
+	return entries, nil
 }
 
 func (fs *FileSystem) hydrateDirectoryEntries(entries []*directoryEntryRaw) ([]*directoryEntry, error) {
@@ -529,31 +716,93 @@ func (fs *FileSystem) hydrateDirectoryEntries(entries []*directoryEntryRaw) ([]*
 		if err != nil {
 			return nil, fmt.Errorf("error finding inode for %s: %v", e.name, err)
 		}
-		body, header := in.getBody(), in.getHeader()
-		xattrIndex, has := body.xattrIndex()
-		xattrs := map[string]string{}
-		if has && xattrIndex != noXattrInodeFlag {
-			xattrs, err = fs.xattrs.find(int(xattrIndex))
-			if err != nil {
-				return nil, fmt.Errorf("error reading xattrs for %s: %v", e.name, err)
-			}
+		entry, err := fs.newDirectoryEntry(e.name, e.isSubdirectory, in)
+		if err != nil {
+			return nil, fmt.Errorf("error reading xattrs for %s: %v", e.name, err)
 		}
-		fullEntries = append(fullEntries, &directoryEntry{
-			fs:             fs,
-			isSubdirectory: e.isSubdirectory,
-			name:           e.name,
-			size:           body.size(),
-			modTime:        header.modTime,
-			mode:           header.mode,
-			inode:          in,
-			uid:            fs.uidsGids[header.uidIdx],
-			gid:            fs.uidsGids[header.gidIdx],
-			xattrs:         xattrs,
-		})
+		fullEntries = append(fullEntries, entry)
 	}
 	return fullEntries, nil
 }
 
+// newDirectoryEntry fill in a directoryEntry from its inode
+func (fs *FileSystem) newDirectoryEntry(name string, isSubdirectory bool, in inode) (*directoryEntry, error) {
+	body, header := in.getBody(), in.getHeader()
+	xattrIndex, has := body.xattrIndex()
+	xattrs := map[string]string{}
+	if has && xattrIndex != noXattrInodeFlag {
+		var err error
+		xattrs, err = fs.xattrs.find(int(xattrIndex))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &directoryEntry{
+		fs:             fs,
+		isSubdirectory: isSubdirectory,
+		name:           name,
+		size:           body.size(),
+		modTime:        header.modTime,
+		mode:           header.mode,
+		inode:          in,
+		uid:            fs.uidsGids[header.uidIdx],
+		gid:            fs.uidsGids[header.gidIdx],
+		xattrs:         xattrs,
+	}, nil
+}
+
+// OpenInode returns the file with the given inode number, for those that refer to files by number
+// rather than by path, such as an NFS server. As an inode can be reached by more than one path, the
+// returned FileStat has no name. Use its Open() to read the contents of a regular file.
+//
+// This needs the export table, which Finalize writes unless FinalizeOptions.NonExportable is set.
+func (fs *FileSystem) OpenInode(inode uint64) (FileStat, error) {
+	if fs.workspace != "" {
+		return nil, fmt.Errorf("cannot look up inodes in a workspace")
+	}
+	if !fs.superblock.exportable {
+		return nil, fmt.Errorf("filesystem has no export table")
+	}
+	if inode == 0 || inode > uint64(fs.superblock.inodes) {
+		return nil, fmt.Errorf("inode %d outside of range 1-%d", inode, fs.superblock.inodes)
+	}
+	// the export table is an array of inode references, starting with inode 1, in metadata blocks
+	// whose locations are in the index at the start of the table
+	position := (inode - 1) * 8
+	b := make([]byte, 8)
+	index := int64(fs.superblock.exportTableStart) + int64(position/uint64(metadataBlockSize))*8
+	read, err := fs.backend.ReadAt(b, index)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read export table index at %d: %v", index, err)
+	}
+	if read != len(b) {
+		return nil, fmt.Errorf("read %d bytes instead of expected %d for export table index", read, len(b))
+	}
+	block, _, err := fs.readMetaBlock(fs.backend, fs.compressor, int64(binary.LittleEndian.Uint64(b)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading export table block for inode %d: %v", inode, err)
+	}
+	offset := position % uint64(metadataBlockSize)
+	if uint64(len(block)) < offset+8 {
+		return nil, fmt.Errorf("export table block for inode %d is only %d bytes", inode, len(block))
+	}
+	ref := parseRootInode(binary.LittleEndian.Uint64(block[offset : offset+8]))
+	// the type is in the header, so start with the smallest
+	in, err := fs.getInode(ref.block, ref.offset, inodeBasicFifo)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inode %d: %v", inode, err)
+	}
+	if uint64(in.index()) != inode {
+		return nil, fmt.Errorf("export table entry for inode %d refers to inode %d", inode, in.index())
+	}
+	iType := in.inodeType()
+	entry, err := fs.newDirectoryEntry("", iType == inodeBasicDirectory || iType == inodeExtendedDirectory, in)
+	if err != nil {
+		return nil, fmt.Errorf("error reading xattrs for inode %d: %v", inode, err)
+	}
+	return entry, nil
+}
+
 // getInode read a single inode, given the block offset, and the offset in the
 // block when uncompressed. This may require two reads, one to get the header and discover the type,
 // and then another to read the rest. Some inodes even have a variable length, which complicates it
@@ -606,6 +855,38 @@ func (fs *FileSystem) getInode(blockOffset uint32, byteOffset uint16, iType inod
 	}, nil
 }
 
+// getInodeDirectory read the directory of a directory inode from the directory table
+func (fs *FileSystem) getInodeDirectory(in inode) (*directory, error) {
+	var (
+		block  uint32
+		offset uint16
+		size   int
+	)
+	iType := in.inodeType()
+	body := in.getBody()
+	//nolint:exhaustive // we only are looking for directory types here
+	switch iType {
+	case inodeBasicDirectory:
+		dir, _ := body.(*basicDirectory)
+		block = dir.startBlock
+		offset = dir.offset
+		size = int(dir.fileSize)
+	case inodeExtendedDirectory:
+		dir, _ := body.(*extendedDirectory)
+		block = dir.startBlock
+		offset = dir.offset
+		size = int(dir.fileSize)
+	default:
+		return nil, fmt.Errorf("inode is of type %d, neither basic nor extended directory", iType)
+	}
+	// read the directory data from the directory table
+	dir, err := fs.getDirectory(block, offset, size)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory from table: %v", err)
+	}
+	return dir, nil
+}
+
 // getDirectory read a single directory, given the block offset, and the offset in the
 // block when uncompressed.
 func (fs *FileSystem) getDirectory(blockOffset uint32, byteOffset uint16, size int) (*directory, error) {
@@ -627,21 +908,7 @@ func (fs *FileSystem) readBlock(location int64, compressed bool, size uint32) ([
 	if size == 0 {
 		return make([]byte, fs.superblock.blocksize), nil
 	}
-	b := make([]byte, size)
-	read, err := fs.backend.ReadAt(b, location)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("error reading block %d: %v", location, err)
-	}
-	if read != int(size) {
-		return nil, fmt.Errorf("read %d bytes instead of expected %d", read, size)
-	}
-	if compressed {
-		b, err = fs.compressor.decompress(b)
-		if err != nil {
-			return nil, fmt.Errorf("decompress error: %v", err)
-		}
-	}
-	return b, nil
+	return fs.readData(location, int(size), compressed, fmt.Sprintf("block %d", location))
 }
 
 func (fs *FileSystem) readFragment(index, offset uint32, fragmentSize int64) ([]byte, error) {
@@ -655,27 +922,11 @@ func (fs *FileSystem) readFragment(index, offset uint32, fragmentSize int64) ([]
 	fragmentInfo := fs.fragments[index]
 	pos := int64(fragmentInfo.start)
 	data, _, err := fs.cache.get(pos, func() (data []byte, size uint16, err error) {
-		// figure out the size of the compressed block and if it is compressed
-		b := make([]byte, fragmentInfo.size)
-		read, err := fs.backend.ReadAt(b, pos)
-		if err != nil && err != io.EOF {
-			return nil, 0, fmt.Errorf("unable to read fragment block %d: %v", index, err)
+		if fragmentInfo.compressed && fs.compressor == nil {
+			return nil, 0, fmt.Errorf("fragment compressed but do not have valid compressor")
 		}
-		if read != len(b) {
-			return nil, 0, fmt.Errorf("read %d instead of expected %d bytes for fragment block %d", read, len(b), index)
-		}
-
-		data = b
-		if fragmentInfo.compressed {
-			if fs.compressor == nil {
-				return nil, 0, fmt.Errorf("fragment compressed but do not have valid compressor")
-			}
-			data, err = fs.compressor.decompress(b)
-			if err != nil {
-				return nil, 0, fmt.Errorf("decompress error: %v", err)
-			}
-		}
-		return data, 0, nil
+		data, err = fs.readData(pos, int(fragmentInfo.size), fragmentInfo.compressed, fmt.Sprintf("fragment block %d", index))
+		return data, 0, err
 	})
 	if err != nil {
 		return nil, err
@@ -698,6 +949,34 @@ func validateBlocksize(blocksize int64) error {
 	return nil
 }
 
+// readCompressorOptions read the compressor options, which follow the superblock as a metadata block, and load
+// them into c
+func readCompressorOptions(file backend.File, c Compressor) error {
+	b := make([]byte, 2)
+	if _, err := file.ReadAt(b, superblockSize); err != nil && err != io.EOF {
+		return fmt.Errorf("unable to read compressor options header: %v", err)
+	}
+	size, compressed, err := getMetadataSize(b)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	read, err := file.ReadAt(data, superblockSize+2)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("unable to read compressor options: %v", err)
+	}
+	if read != len(data) {
+		return fmt.Errorf("read %d bytes instead of expected %d for compressor options", read, len(data))
+	}
+	// mksquashfs never compresses them, but the format allows it
+	if compressed {
+		if data, err = c.decompress(data); err != nil {
+			return fmt.Errorf("decompress error: %v", err)
+		}
+	}
+	return c.loadOptions(data)
+}
+
 func readFragmentTable(s *superblock, file backend.File, c Compressor) ([]*fragmentEntry, error) {
 	// get the first level index, which is just the pointers to the fragment table metadata blocks
 	blockCount := s.fragmentCount / 512
@@ -2,18 +2,26 @@ package squashfs_test
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
 	"crypto/md5" //nolint:gosec // MD5 is still fine for detecting file corruptions
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	stdfs "io/fs"
+	"math"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/diskfs/go-diskfs/backend"
 	"github.com/diskfs/go-diskfs/backend/file"
+	"github.com/diskfs/go-diskfs/backend/mem"
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/filesystem/squashfs"
 )
@@ -291,6 +299,40 @@ func TestSquashfsOpenFile(t *testing.T) {
 	})
 }
 
+// a registered Decompressor must be used in place of the default one
+func TestSquashfsRegisterDecompressor(t *testing.T) {
+	var calls atomic.Int64
+	squashfs.RegisterDecompressor(&squashfs.CompressorGzip{}, squashfs.DecompressorFunc(func(in []byte) ([]byte, error) {
+		calls.Add(1)
+		r, err := zlib.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}))
+	defer squashfs.RegisterDecompressor(&squashfs.CompressorGzip{}, nil)
+
+	fs, err := getValidSquashfsFSReadOnly()
+	if err != nil {
+		t.Fatalf("Failed to get read-only squashfs filesystem: %v", err)
+	}
+	fh, err := fs.OpenFile("/foo/filename_10", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unexpected error opening file: %v", err)
+	}
+	b, err := io.ReadAll(fh)
+	if err != nil {
+		t.Fatalf("unexpected error reading file: %v", err)
+	}
+	if string(b) != "filename_10\n" {
+		t.Errorf("mismatched contents, got %q", b)
+	}
+	if calls.Load() == 0 {
+		t.Errorf("registered decompressor was never called")
+	}
+}
+
 // Test the Open method on the directory entry
 func TestSquashfsOpen(t *testing.T) {
 	fs, err := getValidSquashfsFSReadOnly()
@@ -342,6 +384,60 @@ func TestSquashfsOpen(t *testing.T) {
 	}
 }
 
+func TestSquashfsOpenInode(t *testing.T) {
+	fs, err := getValidSquashfsFSReadOnly()
+	if err != nil {
+		t.Fatalf("Failed to get read-only squashfs filesystem: %v", err)
+	}
+	fis, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Failed to list squashfs filesystem: %v", err)
+	}
+	for _, fi := range fis {
+		stat := fi.Sys().(squashfs.FileStat)
+		got, err := fs.OpenInode(stat.Inode())
+		if err != nil {
+			t.Errorf("Failed to open inode %d for %s: %v", stat.Inode(), fi.Name(), err)
+			continue
+		}
+		if got.Inode() != stat.Inode() || got.Mode() != fi.Mode() || got.Size() != fi.Size() || got.IsDir() != fi.IsDir() || !got.ModTime().Equal(fi.ModTime()) {
+			t.Errorf("inode %d is %v %d bytes, instead of %v %d bytes as %s", got.Inode(), got.Mode(), got.Size(), fi.Mode(), fi.Size(), fi.Name())
+		}
+		if got.Name() != "" {
+			t.Errorf("inode %d has name %q", got.Inode(), got.Name())
+		}
+	}
+
+	fh, err := fs.OpenFile("/README.md", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	want, _ := io.ReadAll(fh)
+	var readme squashfs.FileStat
+	for _, fi := range fis {
+		if fi.Name() == "README.md" {
+			readme = fi.Sys().(squashfs.FileStat)
+		}
+	}
+	in, err := fs.OpenInode(readme.Inode())
+	if err != nil {
+		t.Fatalf("Failed to open inode: %v", err)
+	}
+	fh, err = in.Open()
+	if err != nil {
+		t.Fatalf("Failed to open file by inode: %v", err)
+	}
+	if got, _ := io.ReadAll(fh); !bytes.Equal(got, want) {
+		t.Errorf("read %q by inode instead of %q", got, want)
+	}
+
+	for _, inode := range []uint64{0, 1 << 40} {
+		if _, err := fs.OpenInode(inode); err == nil {
+			t.Errorf("no error opening inode %d", inode)
+		}
+	}
+}
+
 func TestSquashfsRead(t *testing.T) {
 	tests := []struct {
 		blocksize  int64
@@ -563,7 +659,8 @@ func testReadFile(t *testing.T, fs *squashfs.FileSystem, test readTest, blockSiz
 }
 
 // Check that we can read some specially crafted files
-func TestSquashfsReadFile(t *testing.T) {
+// readTests the files in the read test image, from its check file
+func readTests(t *testing.T) []readTest {
 	var tests []readTest
 
 	// read the check files in creating the tests
@@ -591,6 +688,11 @@ func TestSquashfsReadFile(t *testing.T) {
 	if err := scanner.Err(); err != nil {
 		t.Fatal(err)
 	}
+	return tests
+}
+
+func TestSquashfsReadFile(t *testing.T) {
+	tests := readTests(t)
 
 	// Open the squash file
 	f, err := os.Open(squashfs.SquashfsReadTestFile)
@@ -641,6 +743,120 @@ func TestSquashfsReadFile(t *testing.T) {
 	}
 }
 
+func TestSquashfsMmap(t *testing.T) {
+	// a copy, which is truncated below
+	image, err := os.ReadFile(squashfs.SquashfsReadTestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(t.TempDir(), "read_test.sqs")
+	if err := os.WriteFile(p, image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fs, err := squashfs.Read(file.New(f, true), int64(len(image)), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// so that every read goes to the mapping
+	fs.SetCacheSize(0)
+	if err := fs.SetMmap(true); err != nil {
+		t.Fatalf("unable to map image: %v", err)
+	}
+	tests := readTests(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testReadFile(t, fs, test, 0)
+		})
+	}
+
+	// reading what is no longer in the file falls back to the backend, which cannot read it either. The files are
+	// opened first, as their inodes are not read through the mapping.
+	var handles []filesystem.File
+	for _, test := range tests {
+		fh, err := fs.OpenFile(test.p, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fh.Close()
+		handles = append(handles, fh)
+	}
+	if err := f.Truncate(int64(len(image) / 4)); err != nil {
+		t.Fatal(err)
+	}
+	var failed bool
+	for _, fh := range handles {
+		if _, err := io.ReadAll(fh); err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Errorf("expected errors reading files from a truncated image")
+	}
+	if err := fs.SetMmap(false); err != nil {
+		t.Errorf("unable to unmap image: %v", err)
+	}
+
+	b, err := mem.NewFromBytes(image, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err = squashfs.Read(b, int64(len(image)), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetMmap(true); !errors.Is(err, backend.ErrNotSuitable) {
+		t.Errorf("expected ErrNotSuitable mapping a memory backend, got %v", err)
+	}
+}
+
+func TestSquashfsMmapTooLarge(t *testing.T) {
+	// the image at the start of a sparse file of just over 4GiB, more than can be mapped on a 32-bit platform, whose
+	// size as an int there would wrap around to 1MiB
+	const size = 1<<32 + 1<<20
+	image, err := os.ReadFile(squashfs.SquashfsReadTestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := path.Join(t.TempDir(), "large.sqs")
+	if err := os.WriteFile(p, image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(p, size); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fs, err := squashfs.Read(file.New(f, true), size, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetCacheSize(0)
+	err = fs.SetMmap(true)
+	switch {
+	case math.MaxInt < size && err == nil:
+		t.Errorf("mapped %d bytes, more than an int can index", int64(size))
+	case math.MaxInt >= size && err != nil:
+		t.Fatalf("unable to map image: %v", err)
+	}
+	// either way, the files read the same
+	for _, test := range readTests(t) {
+		t.Run(test.name, func(t *testing.T) {
+			testReadFile(t, fs, test, 0)
+		})
+	}
+	if err := fs.SetMmap(false); err != nil {
+		t.Errorf("unable to unmap image: %v", err)
+	}
+}
+
 func TestSquashfsCreate(t *testing.T) {
 	tests := []struct {
 		blocksize int64
@@ -769,3 +985,124 @@ func TestSquashfsReadDirCornerCases(t *testing.T) {
 func TestFinalize(t *testing.T) {
 
 }
+
+func TestSquashfsAttributes(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	b, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err := squashfs.Create(b, 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.Create: %v", err)
+	}
+	if err := fs.Mkdir("/bin"); err != nil {
+		t.Fatalf("Failed to squashfs.Mkdir: %v", err)
+	}
+	f, err := fs.OpenFile("/bin/busybox", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Failed to squashfs.OpenFile: %v", err)
+	}
+	if _, err := f.Write([]byte("busybox")); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if err := fs.Symlink("busybox", "/bin/sh"); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if err := fs.Chmod("/bin/busybox", 0o750); err != nil {
+		t.Fatalf("unable to change mode: %v", err)
+	}
+	if err := fs.Chtimes("/bin/busybox", time.Time{}, mtime); err != nil {
+		t.Fatalf("unable to change times: %v", err)
+	}
+	uid := os.Getuid()
+	if uid == 0 {
+		// only root can give a file away
+		uid = 1234
+	}
+	if err := fs.Chown("/bin/busybox", uid, -1); err != nil {
+		t.Fatalf("unable to change owner: %v", err)
+	}
+	if target, err := fs.Readlink("/bin/sh"); err != nil || target != "busybox" {
+		t.Errorf("workspace symlink links to %q, error %v", target, err)
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{ModTime: modTime}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+
+	check := func(fs *squashfs.FileSystem, p string, mode os.FileMode, mtime time.Time, owner int) {
+		t.Helper()
+		fis, err := fs.ReadDir(path.Dir(p))
+		if err != nil {
+			t.Fatalf("unable to read directory %s: %v", path.Dir(p), err)
+		}
+		for _, fi := range fis {
+			if fi.Name() != path.Base(p) {
+				continue
+			}
+			if stat := fi.Sys().(squashfs.FileStat); fi.Mode() != mode || !fi.ModTime().Equal(mtime) || stat.UID() != uint32(owner) {
+				t.Errorf("%s has mode %v, time %v and owner %d instead of %v, %v and %d", p, fi.Mode(), fi.ModTime(), stat.UID(), mode, mtime, owner)
+			}
+			return
+		}
+		t.Errorf("%s is missing", p)
+	}
+	lower, err := squashfs.Read(b, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+	check(lower, "/bin/busybox", 0o750, mtime, uid)
+	if target, err := lower.Readlink("/bin/sh"); err != nil || target != "busybox" {
+		t.Errorf("symlink links to %q, error %v", target, err)
+	}
+	if _, err := lower.Readlink("/bin/busybox"); err == nil {
+		t.Errorf("no error reading link of a file that is not one")
+	}
+	for name, err := range map[string]error{
+		"Symlink": lower.Symlink("busybox", "/bin/ash"),
+		"Chmod":   lower.Chmod("/bin/busybox", 0o755),
+		"Chown":   lower.Chown("/bin/busybox", 0, 0),
+		"Chtimes": lower.Chtimes("/bin/busybox", mtime, mtime),
+	} {
+		if !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s returned %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+
+	// in an overlay, what is changed is copied up from the image
+	overlayBackend, err := mem.New(4 * 1024 * 1024)
+	if err != nil {
+		t.Fatalf("unable to create buffer: %v", err)
+	}
+	fs, err = squashfs.Overlay(lower, overlayBackend, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening overlay: %v", err)
+	}
+	if target, err := fs.Readlink("/bin/sh"); err != nil || target != "busybox" {
+		t.Errorf("symlink in image links to %q, error %v", target, err)
+	}
+	if err := fs.Chmod("/bin/busybox", 0o700); err != nil {
+		t.Fatalf("unable to change mode: %v", err)
+	}
+	if err := fs.Symlink("busybox", "/bin/sh"); err == nil {
+		t.Errorf("no error creating symlink that is already in the image")
+	}
+	if err := fs.Symlink("/bin/busybox", "/bin/ash"); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	if target, err := fs.Readlink("/bin/ash"); err != nil || target != "/bin/busybox" {
+		t.Errorf("new symlink links to %q, error %v", target, err)
+	}
+	if err := fs.Finalize(squashfs.FinalizeOptions{ModTime: modTime}); err != nil {
+		t.Fatalf("unexpected error finalizing: %v", err)
+	}
+	fs, err = squashfs.Read(overlayBackend, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read merged image: %v", err)
+	}
+	check(fs, "/bin/busybox", 0o700, mtime, uid)
+	if target, err := fs.Readlink("/bin/ash"); err != nil || target != "/bin/busybox" {
+		t.Errorf("merged symlink links to %q, error %v", target, err)
+	}
+}
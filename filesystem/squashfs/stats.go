@@ -0,0 +1,280 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// StoredSize the size of some part of an image as it is stored, and what it is when uncompressed
+type StoredSize struct {
+	Stored       int64 // bytes in the image
+	Uncompressed int64 // bytes once uncompressed
+}
+
+// Ratio the compression ratio, the uncompressed size divided by the stored size, or 0 if nothing is stored
+func (s StoredSize) Ratio() float64 {
+	if s.Stored == 0 {
+		return 0
+	}
+	return float64(s.Uncompressed) / float64(s.Stored)
+}
+
+func (s *StoredSize) add(stored, uncompressed int64) {
+	s.Stored += stored
+	s.Uncompressed += uncompressed
+}
+
+// Stats statistics of how the data of an image is stored, like those of unsquashfs -stat, to track how efficient
+// an image is
+type Stats struct {
+	BlockSize   int64  // size of a data block
+	Compression string // compression of the data and metadata, as mksquashfs names it
+	Size        int64  // bytes used by the image
+	Inodes      uint32 // number of inodes
+	Files       int    // regular files, each counted once however many hard links it has
+	// DataBlocks the full data blocks of files that are stored, not counting those of duplicate files nor sparse ones
+	DataBlocks int
+	// SparseBlocks blocks of files that are all zeroes, and so are not stored
+	SparseBlocks int
+	// Data the data blocks of files
+	Data StoredSize
+	// FragmentBlocks the blocks holding the ends of files that are smaller than a block
+	FragmentBlocks int
+	// FragmentedFiles files that end in a fragment, not counting duplicates
+	FragmentedFiles int
+	// Fragments the fragment blocks; the uncompressed size is that of the ends of files in them
+	Fragments StoredSize
+	// DuplicateFiles files whose data is that of another file, stored only once
+	DuplicateFiles int
+	// DuplicateBytes the size of the duplicate files, which take no space of their own
+	DuplicateBytes int64
+	// tables of metadata, each with its index, if the image has it
+	InodeTable     StoredSize
+	DirectoryTable StoredSize
+	FragmentTable  StoredSize
+	ExportTable    StoredSize
+	IDTable        StoredSize
+	XattrTable     StoredSize
+}
+
+// Stats read the statistics of how the data of the image is stored. It reads every inode and table in the image,
+// but none of the data. It only works on an image that was read, not one that is being created.
+func (fs *FileSystem) Stats() (*Stats, error) {
+	if fs.workspace != "" {
+		return nil, fmt.Errorf("cannot get statistics of a filesystem in a workspace")
+	}
+	s := fs.superblock
+	stats := &Stats{
+		BlockSize: fs.blocksize,
+		Size:      int64(s.size),
+		Inodes:    s.inodes,
+	}
+	stats.Compression = s.compression.String()
+	if err := fs.dataStats(stats); err != nil {
+		return nil, err
+	}
+	if err := fs.tableStats(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// dataStats fill in the statistics of the data of files, walking every directory from the root
+func (fs *FileSystem) dataStats(stats *Stats) error {
+	var (
+		seen = map[uint32]bool{fs.rootDir.index(): true}
+		// the first data block of every file with any, and the fragment and offset of every file end, to find
+		// the duplicates that share them
+		blocks = map[uint64]bool{}
+		tails  = map[[2]uint32]bool{}
+		walk   func(dir inode) error
+	)
+	walk = func(dir inode) error {
+		d, err := fs.getInodeDirectory(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range d.entries {
+			in, err := fs.getInode(e.startBlock, e.offset, e.inodeType)
+			if err != nil {
+				return fmt.Errorf("error reading inode of %s: %v", e.name, err)
+			}
+			if seen[in.index()] {
+				continue
+			}
+			seen[in.index()] = true
+			var file extendedFile
+			//nolint:exhaustive // only directories and files matter
+			switch in.inodeType() {
+			case inodeBasicDirectory, inodeExtendedDirectory:
+				if err := walk(in); err != nil {
+					return err
+				}
+				continue
+			case inodeBasicFile:
+				file = in.getBody().(*basicFile).toExtended()
+			case inodeExtendedFile:
+				file = *in.getBody().(*extendedFile)
+			default:
+				continue
+			}
+			stats.Files++
+
+			hasTail := file.fragmentBlockIndex != noFragmentFlag && file.fileSize%uint64(fs.blocksize) != 0
+			tail := [2]uint32{file.fragmentBlockIndex, file.fragmentOffset}
+			hasBlocks := false
+			for _, b := range file.blockSizes {
+				hasBlocks = hasBlocks || b.size != 0
+			}
+			// a file all of whose data is shared with one before it is a duplicate
+			if (hasBlocks || hasTail) && (!hasBlocks || blocks[file.startBlock]) && (!hasTail || tails[tail]) {
+				stats.DuplicateFiles++
+				stats.DuplicateBytes += int64(file.fileSize)
+				continue
+			}
+			if hasBlocks {
+				blocks[file.startBlock] = true
+			}
+			for i, b := range file.blockSizes {
+				if b.size == 0 {
+					stats.SparseBlocks++
+					continue
+				}
+				stats.DataBlocks++
+				stats.Data.add(int64(b.size), min(fs.blocksize, int64(file.fileSize)-int64(i)*fs.blocksize))
+			}
+			if hasTail {
+				tails[tail] = true
+				stats.FragmentedFiles++
+				stats.Fragments.Uncompressed += int64(file.fileSize % uint64(fs.blocksize))
+			}
+		}
+		return nil
+	}
+	if err := walk(fs.rootDir); err != nil {
+		return err
+	}
+	stats.FragmentBlocks = len(fs.fragments)
+	for _, f := range fs.fragments {
+		stats.Fragments.Stored += int64(f.size)
+	}
+	return nil
+}
+
+// tableStats fill in the sizes of the tables of metadata
+func (fs *FileSystem) tableStats(stats *Stats) error {
+	s := fs.superblock
+	// where each table after the directory table starts, the first of which is where the directory table ends
+	dirEnd := int64(s.size)
+	ends := func(location int64) {
+		if location > int64(s.directoryTableStart) && location < dirEnd {
+			dirEnd = location
+		}
+	}
+
+	// tables that are metadata blocks followed by an index of where they are, which is where the table starts
+	type indexedTable struct {
+		name   string
+		start  uint64
+		blocks uint64
+		table  *StoredSize
+	}
+	indexed := []indexedTable{
+		{"fragment", s.fragmentTableStart, (uint64(s.fragmentCount)*16 + uint64(metadataBlockSize) - 1) / uint64(metadataBlockSize), &stats.FragmentTable},
+		{"id", s.idTableStart, (uint64(s.idCount)*4 + uint64(metadataBlockSize) - 1) / uint64(metadataBlockSize), &stats.IDTable},
+	}
+	if s.exportable {
+		indexed = append(indexed, indexedTable{"export", s.exportTableStart, (uint64(s.inodes)*8 + uint64(metadataBlockSize) - 1) / uint64(metadataBlockSize), &stats.ExportTable})
+	}
+	for _, t := range indexed {
+		if t.blocks == 0 {
+			continue
+		}
+		ends(int64(t.start))
+		locations, err := fs.readTableIndex(int64(t.start), int(t.blocks))
+		if err != nil {
+			return fmt.Errorf("error reading %s table index: %v", t.name, err)
+		}
+		t.table.add(int64(len(locations))*8, int64(len(locations))*8)
+		for _, location := range locations {
+			ends(location)
+			stored, uncompressed, err := fs.metadataSize(location, location+1)
+			if err != nil {
+				return fmt.Errorf("error reading %s table: %v", t.name, err)
+			}
+			t.table.add(stored, uncompressed)
+		}
+	}
+
+	if !s.noXattrs && s.xattrTableStart != 0xffff_ffff_ffff_ffff && fs.xattrs != nil {
+		ends(int64(s.xattrTableStart))
+		b := make([]byte, xAttrHeaderSize)
+		if _, err := fs.backend.ReadAt(b, int64(s.xattrTableStart)); err != nil && err != io.EOF {
+			return fmt.Errorf("error reading xattr table header: %v", err)
+		}
+		dataStart := int64(binary.LittleEndian.Uint64(b[0:8]))
+		count := uint64(binary.LittleEndian.Uint32(b[8:12]))
+		ends(dataStart)
+		locations, err := fs.readTableIndex(int64(s.xattrTableStart)+int64(xAttrHeaderSize), int((count*uint64(xAttrIDEntrySize)+uint64(metadataBlockSize)-1)/uint64(metadataBlockSize)))
+		if err != nil {
+			return fmt.Errorf("error reading xattr table index: %v", err)
+		}
+		header := int64(xAttrHeaderSize) + int64(len(locations))*8
+		stats.XattrTable.add(header, header)
+		// the xattrs themselves run up to the first block of their ids, which are followed by the index
+		stored, uncompressed, err := fs.metadataSize(dataStart, locations[0])
+		if err != nil {
+			return fmt.Errorf("error reading xattr table: %v", err)
+		}
+		stats.XattrTable.add(stored, uncompressed)
+		stored, uncompressed, err = fs.metadataSize(locations[0], int64(s.xattrTableStart))
+		if err != nil {
+			return fmt.Errorf("error reading xattr table: %v", err)
+		}
+		stats.XattrTable.add(stored, uncompressed)
+	}
+
+	stored, uncompressed, err := fs.metadataSize(int64(s.inodeTableStart), int64(s.directoryTableStart))
+	if err != nil {
+		return fmt.Errorf("error reading inode table: %v", err)
+	}
+	stats.InodeTable.add(stored, uncompressed)
+	stored, uncompressed, err = fs.metadataSize(int64(s.directoryTableStart), dirEnd)
+	if err != nil {
+		return fmt.Errorf("error reading directory table: %v", err)
+	}
+	stats.DirectoryTable.add(stored, uncompressed)
+	return nil
+}
+
+// readTableIndex read the index of a table, the locations of its count metadata blocks
+func (fs *FileSystem) readTableIndex(location int64, count int) ([]int64, error) {
+	b := make([]byte, 8*count)
+	read, err := fs.backend.ReadAt(b, location)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read index at %d: %v", location, err)
+	}
+	if read != len(b) {
+		return nil, fmt.Errorf("read %d bytes instead of expected %d of index at %d", read, len(b), location)
+	}
+	locations := make([]int64, count)
+	for i := range locations {
+		locations[i] = int64(binary.LittleEndian.Uint64(b[i*8 : i*8+8]))
+	}
+	return locations, nil
+}
+
+// metadataSize the stored and uncompressed sizes of the metadata blocks from start, up to end
+func (fs *FileSystem) metadataSize(start, end int64) (stored, uncompressed int64, err error) {
+	for location := start; location < end; {
+		data, size, err := fs.readMetaBlock(fs.backend, fs.compressor, location)
+		if err != nil {
+			return stored, uncompressed, err
+		}
+		stored += int64(size)
+		uncompressed += int64(len(data))
+		location += int64(size)
+	}
+	return stored, uncompressed, nil
+}
@@ -0,0 +1,131 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// statsTotal the bytes of the image that the statistics account for
+func statsTotal(s *Stats) int64 {
+	total := int64(superblockSize) + s.Data.Stored + s.Fragments.Stored
+	for _, t := range []StoredSize{s.InodeTable, s.DirectoryTable, s.FragmentTable, s.ExportTable, s.IDTable, s.XattrTable} {
+		total += t.Stored
+	}
+	return total
+}
+
+func TestStats(t *testing.T) {
+	f, err := os.Open(Squashfsfile)
+	if err != nil {
+		t.Fatalf("Failed to read squashfs testfile %s: %v", Squashfsfile, err)
+	}
+	defer f.Close()
+	fs, err := Read(file.New(f, true), 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("error reading squashfs: %v", err)
+	}
+	stats, err := fs.Stats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Compression != "gzip" || stats.BlockSize != 128*KB || stats.Inodes != 515 {
+		t.Errorf("compression %s, block size %d and %d inodes instead of gzip, %d and 515", stats.Compression, stats.BlockSize, stats.Inodes, 128*KB)
+	}
+	// every byte of the image is in one of them
+	if total := statsTotal(stats); total != stats.Size {
+		t.Errorf("statistics account for %d bytes instead of the size of the image %d", total, stats.Size)
+	}
+	if stats.Files != 505 || stats.FragmentedFiles != 503 || stats.FragmentBlocks != 1 {
+		t.Errorf("%d files, %d of them in %d fragment blocks, instead of 505, 503 and 1", stats.Files, stats.FragmentedFiles, stats.FragmentBlocks)
+	}
+	if stats.DataBlocks+stats.SparseBlocks != 80 || stats.Data.Uncompressed != int64(stats.DataBlocks)*128*KB {
+		t.Errorf("%d data blocks and %d sparse with %d bytes uncompressed, instead of 80 full blocks", stats.DataBlocks, stats.SparseBlocks, stats.Data.Uncompressed)
+	}
+	if ratio := stats.InodeTable.Ratio(); ratio <= 1 {
+		t.Errorf("inode table has compression ratio %f, not more than 1", ratio)
+	}
+	if ratio := (StoredSize{}).Ratio(); ratio != 0 {
+		t.Errorf("empty size has compression ratio %f instead of 0", ratio)
+	}
+}
+
+func TestStatsDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.CreateTemp(dir, "squashfs_stats")
+	if err != nil {
+		t.Fatalf("Failed to create tmpfile: %v", err)
+	}
+	defer f.Close()
+	fs, err := Create(file.New(f, false), 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("Failed to create squashfs: %v", err)
+	}
+	content := bytes.Repeat([]byte("duplicate"), 1000)
+	for _, name := range []string{"/a", "/b"} {
+		fl, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+		if _, err := fl.Write(content); err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+	if err := fs.Finalize(FinalizeOptions{NoCompressInodes: true}); err != nil {
+		t.Fatalf("error finalizing: %v", err)
+	}
+
+	fs, err = Read(file.New(f, false), 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("error reading squashfs: %v", err)
+	}
+	stats, err := fs.Stats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Files != 2 || stats.DuplicateFiles != 0 {
+		t.Errorf("%d files and %d duplicates instead of 2 and none", stats.Files, stats.DuplicateFiles)
+	}
+	if total := statsTotal(stats); total != stats.Size {
+		t.Errorf("statistics account for %d bytes instead of the size of the image %d", total, stats.Size)
+	}
+
+	// point /b at the data of /a, as mksquashfs does with duplicate files
+	root, err := fs.getInodeDirectory(fs.rootDir)
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	bodies := map[string]int64{}
+	for _, e := range root.entries {
+		// the inodes are uncompressed, and all in the first metadata block
+		bodies[e.name] = int64(fs.superblock.inodeTableStart) + 2 + int64(e.offset) + inodeHeaderSize
+	}
+	a := make([]byte, 16)
+	if _, err := f.ReadAt(a, bodies["a"]); err != nil {
+		t.Fatalf("error reading inode: %v", err)
+	}
+	if _, err := f.WriteAt(a, bodies["b"]); err != nil {
+		t.Fatalf("error writing inode: %v", err)
+	}
+
+	fs, err = Read(file.New(f, false), 0, 0, 4096)
+	if err != nil {
+		t.Fatalf("error reading squashfs: %v", err)
+	}
+	stats, err = fs.Stats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Files != 2 || stats.DuplicateFiles != 1 || stats.DuplicateBytes != int64(len(content)) {
+		t.Errorf("%d files and %d duplicates of %d bytes instead of 2 and 1 of %d", stats.Files, stats.DuplicateFiles, stats.DuplicateBytes, len(content))
+	}
+	if stats.FragmentedFiles != 1 || stats.Fragments.Uncompressed != int64(len(content))%fs.blocksize {
+		t.Errorf("%d files end in fragments of %d bytes instead of 1 of %d", stats.FragmentedFiles, stats.Fragments.Uncompressed, int64(len(content))%fs.blocksize)
+	}
+	if binary.LittleEndian.Uint32(a[4:8]) == noFragmentFlag {
+		t.Errorf("file is not in a fragment")
+	}
+}
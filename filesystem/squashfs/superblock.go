@@ -25,6 +25,27 @@ const (
 	compressionZstd compression = 6
 )
 
+// String the name of the compression, as mksquashfs names it
+func (c compression) String() string {
+	switch c {
+	case compressionNone:
+		return "none"
+	case compressionGzip:
+		return "gzip"
+	case compressionLzma:
+		return "lzma"
+	case compressionLzo:
+		return "lzo"
+	case compressionXz:
+		return "xz"
+	case compressionLz4:
+		return "lz4"
+	case compressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(c))
+}
+
 const (
 	superblockSize = 96
 )
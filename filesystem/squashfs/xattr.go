@@ -73,8 +73,8 @@ func (x *xAttrTable) find(pos int) (map[string]string, error) {
 		val := string(b[valStart : valStart+valSize])
 		xattrs[key] = val
 
-		// increment the position pointer
-		ptr += valStart + valSize
+		// move on to the next pair
+		ptr = valStart + valSize
 	}
 	return xattrs, nil
 }
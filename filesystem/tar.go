@@ -0,0 +1,300 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// the bits of the mode of a tar header, as in archive/tar, which does not export them
+const (
+	tarModeSetuid = 0o4000
+	tarModeSetgid = 0o2000
+	tarModeSticky = 0o1000
+)
+
+// the types of file in the mode that Mknod takes, as in mknod(2)
+const (
+	mknodFifo      = 0o010000
+	mknodCharacter = 0o020000
+	mknodBlock     = 0o060000
+)
+
+// deviceInfo the major and minor numbers that the FileInfo of a filesystem reports for devices
+type deviceInfo interface {
+	Device() (major, minor uint32)
+}
+
+// tarDir a directory read from a tar stream, whose mode and times are set only once everything in it is written
+type tarDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+// WriteTar write everything in the filesystem fs to w as a tar stream, with the mode, modification time and, where
+// fs records them, the uid and gid of every entry, the targets of symlinks, and the numbers of devices. Entries are
+// named relative to the root, e.g. etc/hosts, and written in the order that ReadDir returns them, with every
+// directory before its contents. Hard links are written as separate files, and sockets are left out, as tar does.
+// Filesystems that keep no permissions, such as FAT32, are written with 0755 for directories and 0644 for files.
+func WriteTar(fs FileSystem, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		infos, err := fs.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("could not read directory %s: %w", dir, err)
+		}
+		for _, info := range infos {
+			if info.Name() == "." || info.Name() == ".." {
+				continue
+			}
+			p := path.Join(dir, info.Name())
+			hdr, err := tarHeader(fs, p, info)
+			if err != nil {
+				return err
+			}
+			if hdr == nil {
+				continue
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("could not write tar header for %s: %w", p, err)
+			}
+			switch hdr.Typeflag {
+			case tar.TypeReg:
+				if err := writeTarFile(fs, p, tw); err != nil {
+					return err
+				}
+			case tar.TypeDir:
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not finish tar stream: %w", err)
+	}
+	return nil
+}
+
+// tarHeader the header for the entry p of fs, or nil for one that tar leaves out
+func tarHeader(fs FileSystem, p string, info os.FileInfo) (*tar.Header, error) {
+	mode := info.Mode()
+	hdr := &tar.Header{
+		Name:    strings.TrimPrefix(p, "/"),
+		Mode:    int64(mode.Perm()),
+		ModTime: info.ModTime(),
+	}
+	switch {
+	case info.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o755
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := Readlink(fs, p)
+		if err != nil {
+			return nil, fmt.Errorf("could not read symlink %s: %w", p, err)
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = target
+	case mode&os.ModeSocket != 0:
+		return nil, nil
+	case mode&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+	case mode&os.ModeDevice != 0:
+		d, ok := info.(deviceInfo)
+		if !ok {
+			if d, ok = info.Sys().(deviceInfo); !ok {
+				return nil, fmt.Errorf("cannot write device %s: the filesystem does not report its numbers", p)
+			}
+		}
+		hdr.Typeflag = tar.TypeBlock
+		if mode&os.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		}
+		major, minor := d.Device()
+		hdr.Devmajor, hdr.Devminor = int64(major), int64(minor)
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = info.Size()
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+	}
+	if mode&os.ModeSetuid != 0 {
+		hdr.Mode |= tarModeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		hdr.Mode |= tarModeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		hdr.Mode |= tarModeSticky
+	}
+	if uid, gid, ok := Owner(info); ok {
+		hdr.Uid, hdr.Gid = int(uid), int(gid)
+	}
+	return hdr, nil
+}
+
+func writeTarFile(fs FileSystem, p string, tw *tar.Writer) error {
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", p, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("could not write %s to tar stream: %w", p, err)
+	}
+	return nil
+}
+
+// ReadTar extract the tar stream r into the root of the filesystem fs, creating directories, files, symlinks, hard
+// links, devices and fifos, and then setting the mode, uid and gid, and modification time of each. Attributes that fs
+// does not support, such as ownership on FAT32, are left out; a hard link where fs has none is a copy of its target.
+// Directories that are in the stream only as the parents of other entries are created as Mkdir creates them. Names are
+// kept within fs, so ../etc/passwd is extracted to /etc/passwd. The root itself is not changed.
+func ReadTar(fs FileSystem, r io.Reader) error {
+	tr := tar.NewReader(r)
+	created := map[string]bool{"/": true}
+	var dirs []tarDir
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read tar stream: %w", err)
+		}
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+		if parent := path.Dir(p); !created[parent] {
+			if err := fs.Mkdir(parent); err != nil {
+				return fmt.Errorf("could not create directory %s: %w", parent, err)
+			}
+			for d := parent; !created[d]; d = path.Dir(d) {
+				created[d] = true
+			}
+		}
+		attributes := true
+		//nolint:staticcheck // TypeRegA is deprecated, but older archives still have it
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := fs.Mkdir(p); err != nil {
+				return fmt.Errorf("could not create directory %s: %w", p, err)
+			}
+			created[p] = true
+			dirs = append(dirs, tarDir{path: p, hdr: hdr})
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			if err := readTarFile(fs, p, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := fs.Symlink(hdr.Linkname, p); err != nil {
+				return fmt.Errorf("could not create symlink %s: %w", p, err)
+			}
+			// the mode and owner of a symlink are those of its target
+			attributes = false
+		case tar.TypeLink:
+			target := path.Clean("/" + hdr.Linkname)
+			err := fs.Link(target, p)
+			if IsUnsupported(err) {
+				err = copyTarLink(fs, target, p)
+			}
+			if err != nil {
+				return fmt.Errorf("could not link %s to %s: %w", p, target, err)
+			}
+			// a link shares the attributes of its target, which are already set
+			attributes = false
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(mknodFifo)
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				mode = mknodCharacter
+			case tar.TypeBlock:
+				mode = mknodBlock
+			}
+			if err := fs.Mknod(p, mode|uint32(hdr.Mode&0o7777), linuxDevice(hdr.Devmajor, hdr.Devminor)); err != nil {
+				return fmt.Errorf("could not create %s: %w", p, err)
+			}
+		default:
+			return fmt.Errorf("cannot extract %s: unsupported tar entry type %q", p, hdr.Typeflag)
+		}
+		if attributes {
+			if err := setTarAttributes(fs, p, hdr); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTarAttributes(fs, dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readTarFile(fs FileSystem, p string, r io.Reader) error {
+	f, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", p, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not write %s: %w", p, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close %s: %w", p, err)
+	}
+	return nil
+}
+
+// copyTarLink copy the contents of target to p, for a hard link in a filesystem that has none
+func copyTarLink(fs FileSystem, target, p string) error {
+	f, err := fs.OpenFile(target, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readTarFile(fs, p, f)
+}
+
+// linuxDevice the Linux dev_t of a device, as Mknod takes it
+func linuxDevice(major, minor int64) int {
+	return int((major&0xfffff000)<<32 | (major&0xfff)<<8 | (minor&0xffffff00)<<12 | minor&0xff)
+}
+
+func setTarAttributes(fs FileSystem, p string, hdr *tar.Header) error {
+	if err := fs.Chown(p, hdr.Uid, hdr.Gid); err != nil && !IsUnsupported(err) {
+		return fmt.Errorf("could not change owner of %s: %w", p, err)
+	}
+	mode := os.FileMode(hdr.Mode).Perm()
+	if hdr.Mode&tarModeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if hdr.Mode&tarModeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if hdr.Mode&tarModeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	if err := fs.Chmod(p, mode); err != nil && !IsUnsupported(err) {
+		return fmt.Errorf("could not change mode of %s: %w", p, err)
+	}
+	if err := Chtimes(fs, p, time.Time{}, hdr.ModTime); err != nil && !IsUnsupported(err) {
+		return fmt.Errorf("could not change times of %s: %w", p, err)
+	}
+	return nil
+}
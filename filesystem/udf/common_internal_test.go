@@ -0,0 +1,311 @@
+package udf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+const (
+	imgFile        = "testdata/dist/udf.img"
+	randomDataFile = "testdata/dist/random.dat"
+)
+
+// TestMain sets up the test environment and runs the tests
+func TestMain(m *testing.M) {
+	// Check and generate the image made by mkudffs if necessary
+	if err := testhelper.BuildImage(imgFile); err != nil {
+		println("error generating test artifacts for udf", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// the layout of the test image, in sectors of testBlocksize bytes
+const (
+	testBlocksize       = 2048
+	testMainVDS         = 32
+	testReserveVDS      = 48
+	testIntegrity       = 64
+	testPartitionStart  = 257
+	testPartitionLength = 64
+	testSectors         = testPartitionStart + testPartitionLength + 1
+	testFreeBlocks      = 40
+	testLabel           = "TESTVOLUME"
+	testVolumeSet       = "4e2d7f1c9a8b6e50 test set"
+)
+
+// testImage a UDF image under construction
+type testImage struct {
+	b []byte
+}
+
+func (im *testImage) sector(n int) []byte {
+	return im.b[n*testBlocksize : (n+1)*testBlocksize]
+}
+
+func (im *testImage) block(n int) []byte {
+	return im.sector(testPartitionStart + n)
+}
+
+// testTag fill in the tag of the descriptor d, which is length bytes long
+func testTag(d []byte, id uint16, location uint32, length int) {
+	binary.LittleEndian.PutUint16(d[0:2], id)
+	binary.LittleEndian.PutUint16(d[2:4], 2)
+	binary.LittleEndian.PutUint16(d[8:10], crcITU(d[descriptorTagSize:length]))
+	binary.LittleEndian.PutUint16(d[10:12], uint16(length-descriptorTagSize))
+	binary.LittleEndian.PutUint32(d[12:16], location)
+	var sum byte
+	for i := 0; i < descriptorTagSize; i++ {
+		if i != 4 {
+			sum += d[i]
+		}
+	}
+	d[4] = sum
+}
+
+// testDString a field of size bytes with s in 8-bit characters
+func testDString(s string, size int) []byte {
+	b := make([]byte, size)
+	b[0] = compressionID8
+	n := copy(b[1:size-1], s)
+	b[size-1] = byte(n + 1)
+	return b
+}
+
+// testCharacters s in 16-bit characters
+func testCharacters(s string) []byte {
+	b := []byte{compressionID16}
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.BigEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+func testShortAD(kind, length, block uint32) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, kind<<extentTypeShift|length)
+	return binary.LittleEndian.AppendUint32(b, block)
+}
+
+func testLongAD(kind, length, block uint32) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, kind<<extentTypeShift|length)
+	b = binary.LittleEndian.AppendUint32(b, block)
+	// partition reference number 0, and implementation use
+	return append(b, make([]byte, 8)...)
+}
+
+// testFID a file identifier descriptor, padded to 4 bytes, with the padding in its CRC as mkudffs writes it
+func testFID(name []byte, characteristics byte, block uint32) []byte {
+	d := make([]byte, (fileIdentifierDescriptorFixedSize+len(name)+3)&^3)
+	binary.LittleEndian.PutUint16(d[16:18], 1)
+	d[18] = characteristics
+	d[19] = byte(len(name))
+	copy(d[20:36], testLongAD(extentRecorded, testBlocksize, block))
+	copy(d[fileIdentifierDescriptorFixedSize:], name)
+	testTag(d, tagFileIdentifierDescriptor, 0, len(d))
+	return d
+}
+
+// testDirectory the data of a directory: its parent, then the entries
+func testDirectory(parent uint32, entries ...[]byte) []byte {
+	b := testFID(nil, fileCharacteristicDirectory|fileCharacteristicParent, parent)
+	for _, e := range entries {
+		b = append(b, e...)
+	}
+	return b
+}
+
+// testFileEntry write a file entry, or an extended one, to a block of the partition
+func (im *testImage) testFileEntry(block int, fileType byte, extended bool, size int, adType uint16, ads []byte) {
+	d := im.block(block)
+	fixed, timesAt := fileEntryFixedSize, 72
+	id := tagFileEntry
+	if extended {
+		fixed, timesAt, id = extendedFileEntryFixedSize, 80, tagExtendedFileEntry
+	}
+	binary.LittleEndian.PutUint16(d[20:22], icbStrategyDirect)
+	d[27] = fileType
+	binary.LittleEndian.PutUint16(d[34:36], adType)
+	binary.LittleEndian.PutUint32(d[36:40], 1000)
+	binary.LittleEndian.PutUint32(d[40:44], 100)
+	// rwx for the owner, r-x for group and other, and may be deleted by the owner
+	binary.LittleEndian.PutUint32(d[44:48], (4|1)|(4|1)<<5|(16|4|2|1)<<10)
+	binary.LittleEndian.PutUint16(d[48:50], 1)
+	binary.LittleEndian.PutUint64(d[56:64], uint64(size))
+	// modified 2024-02-29 13:14:15.5 at UTC+1
+	mod := d[timesAt+timestampSize:]
+	binary.LittleEndian.PutUint16(mod[0:2], 1<<12|60)
+	binary.LittleEndian.PutUint16(mod[2:4], 2024)
+	copy(mod[4:10], []byte{2, 29, 13, 14, 15, 50})
+	binary.LittleEndian.PutUint32(d[fixed-4:fixed], uint32(len(ads)))
+	copy(d[fixed:], ads)
+	testTag(d, id, uint32(block), fixed+len(ads))
+}
+
+// testContent the data of a test file
+func testContent(name string, size int) []byte {
+	return bytes.Repeat([]byte(name+"\n"), size/(len(name)+1)+1)[:size]
+}
+
+// testFiles what the test image has in each file, by path
+var testFiles = map[string][]byte{
+	"/embedded":     []byte("data in the file entry itself"),
+	"/long.bin":     testContent("long", 100),
+	"/efe.txt":      testContent("extended", 50),
+	"/dir/nested":   []byte("nested data"),
+	"/ünï€.txt":     []byte("sixteen bit name"),
+	"/chained":      testContent("chained", testBlocksize+10),
+	"/sparse.txt":   append(append(testContent("first", testBlocksize), make([]byte, 1000)...), testContent("last", 500)...),
+	"/dir/sub/deep": testContent("deep", 3*testBlocksize),
+}
+
+// testUDFImage a UDF image, in the layout that mkudffs gives a DVD: a file set with files of every kind of allocation
+func testUDFImage(t *testing.T) []byte {
+	t.Helper()
+	im := &testImage{b: make([]byte, testSectors*testBlocksize)}
+
+	// volume recognition sequence
+	for i, id := range []string{"BEA01", "NSR02", "TEA01"} {
+		d := im.b[volumeRecognitionStart+i*volumeRecognitionDescriptorSize:]
+		copy(d[1:6], id)
+		d[6] = 1
+	}
+
+	// volume descriptor sequence, and its reserve
+	for _, vds := range []int{testMainVDS, testReserveVDS} {
+		pvd := im.sector(vds)
+		copy(pvd[volumeIdentifierOffset:], testDString("PRIMARY", volumeIdentifierLength))
+		copy(pvd[volumeSetIdentifierOffset:], testDString(testVolumeSet, volumeSetIdentifierLength))
+		testTag(pvd, tagPrimaryVolumeDescriptor, uint32(vds), 512)
+
+		pd := im.sector(vds + 1)
+		binary.LittleEndian.PutUint16(pd[22:24], 7)
+		copy(pd[25:], "+NSR02")
+		binary.LittleEndian.PutUint32(pd[188:192], testPartitionStart)
+		binary.LittleEndian.PutUint32(pd[192:196], testPartitionLength)
+		testTag(pd, tagPartitionDescriptor, uint32(vds+1), 512)
+
+		lvd := im.sector(vds + 2)
+		copy(lvd[logicalVolumeIdentifierOffset:], testDString(testLabel, logicalVolumeIdentifierLength))
+		binary.LittleEndian.PutUint32(lvd[212:216], testBlocksize)
+		copy(lvd[248:264], testLongAD(extentRecorded, testBlocksize, 0))
+		binary.LittleEndian.PutUint32(lvd[264:268], partitionMapType1Length)
+		binary.LittleEndian.PutUint32(lvd[268:272], 1)
+		binary.LittleEndian.PutUint32(lvd[432:436], testBlocksize)
+		binary.LittleEndian.PutUint32(lvd[436:440], testIntegrity)
+		copy(lvd[440:446], []byte{partitionMapType1, partitionMapType1Length, 1, 0, 7, 0})
+		testTag(lvd, tagLogicalVolumeDescriptor, uint32(vds+2), 446)
+
+		testTag(im.sector(vds+3), tagTerminatingDescriptor, uint32(vds+3), 512)
+	}
+
+	lvid := im.sector(testIntegrity)
+	binary.LittleEndian.PutUint32(lvid[72:76], 1)
+	binary.LittleEndian.PutUint32(lvid[80:84], testFreeBlocks)
+	binary.LittleEndian.PutUint32(lvid[84:88], testPartitionLength)
+	testTag(lvid, tagLogicalVolumeIntegrityDescriptor, testIntegrity, 88)
+
+	// anchors, at sector 256 and in the last sector
+	for _, sector := range []int{anchorSector, testSectors - 1} {
+		avdp := im.sector(sector)
+		binary.LittleEndian.PutUint32(avdp[16:20], 4*testBlocksize)
+		binary.LittleEndian.PutUint32(avdp[20:24], testMainVDS)
+		binary.LittleEndian.PutUint32(avdp[24:28], 4*testBlocksize)
+		binary.LittleEndian.PutUint32(avdp[28:32], testReserveVDS)
+		testTag(avdp, tagAnchorVolumeDescriptorPointer, uint32(sector), 512)
+	}
+
+	// the file set, with the root directory in block 1
+	fsd := im.block(0)
+	copy(fsd[fileSetDescriptorRootICBOffset:], testLongAD(extentRecorded, testBlocksize, 1))
+	testTag(fsd, tagFileSetDescriptor, 0, 512)
+
+	root := testDirectory(1,
+		testFID([]byte("\x08embedded"), 0, 3),
+		testFID([]byte("\x08long.bin"), 0, 4),
+		testFID([]byte("\x08efe.txt"), 0, 5),
+		testFID([]byte("\x08dir"), fileCharacteristicDirectory, 6),
+		testFID([]byte("\x08deleted"), fileCharacteristicDeleted, 4),
+		testFID(testCharacters("ünï€.txt"), 0, 8),
+		testFID([]byte("\x08chained"), 0, 9),
+		testFID([]byte("\x08sparse.txt"), 0, 12),
+		testFID([]byte("\x08link"), 0, 13),
+	)
+	im.testFileEntry(1, fileTypeDirectory, false, len(root), icbAllocationShort, testShortAD(extentRecorded, uint32(len(root)), 2))
+	copy(im.block(2), root)
+
+	im.testFileEntry(3, fileTypeRegular, false, len(testFiles["/embedded"]), icbAllocationEmbedded, testFiles["/embedded"])
+	im.testFileEntry(4, fileTypeRegular, false, 100, icbAllocationLong, testLongAD(extentRecorded, 100, 20))
+	copy(im.block(20), testFiles["/long.bin"])
+	im.testFileEntry(5, fileTypeRegular, true, 50, icbAllocationShort, testShortAD(extentRecorded, 50, 21))
+	copy(im.block(21), testFiles["/efe.txt"])
+
+	// a directory embedded in its file entry, with a subdirectory in an extended file entry
+	dir := testDirectory(1, testFID([]byte("\x08nested"), 0, 7), testFID([]byte("\x08sub"), fileCharacteristicDirectory, 14))
+	im.testFileEntry(6, fileTypeDirectory, false, len(dir), icbAllocationEmbedded, dir)
+	im.testFileEntry(7, fileTypeRegular, false, len(testFiles["/dir/nested"]), icbAllocationEmbedded, testFiles["/dir/nested"])
+	sub := testDirectory(6, testFID(testCharacters("deep"), 0, 16))
+	im.testFileEntry(14, fileTypeDirectory, true, len(sub), icbAllocationLong, testLongAD(extentRecorded, uint32(len(sub)), 15))
+	copy(im.block(15), sub)
+	im.testFileEntry(16, fileTypeRegular, false, 3*testBlocksize, icbAllocationShort, testShortAD(extentRecorded, 3*testBlocksize, 30))
+	copy(im.b[(testPartitionStart+30)*testBlocksize:], testFiles["/dir/sub/deep"])
+
+	im.testFileEntry(8, fileTypeRegular, false, len(testFiles["/ünï€.txt"]), icbAllocationEmbedded, testFiles["/ünï€.txt"])
+
+	// allocation descriptors that go on in an allocation extent descriptor
+	chained := testFiles["/chained"]
+	im.testFileEntry(9, fileTypeRegular, false, len(chained), icbAllocationShort, append(
+		testShortAD(extentRecorded, testBlocksize, 22),
+		testShortAD(extentNextAllocationDescriptors, testBlocksize, 10)...))
+	aed := im.block(10)
+	next := testShortAD(extentRecorded, 10, 23)
+	binary.LittleEndian.PutUint32(aed[20:24], uint32(len(next)))
+	copy(aed[allocationExtentDescriptorFixedSize:], next)
+	testTag(aed, tagAllocationExtentDescriptor, 10, allocationExtentDescriptorFixedSize+len(next))
+	copy(im.block(22), chained[:testBlocksize])
+	copy(im.block(23), chained[testBlocksize:])
+
+	// an extent that is allocated but not recorded reads as zeros
+	sparse := testFiles["/sparse.txt"]
+	im.testFileEntry(12, fileTypeRegular, false, len(sparse), icbAllocationShort, bytes.Join([][]byte{
+		testShortAD(extentRecorded, testBlocksize, 24),
+		testShortAD(extentNotRecorded, 1000, 25),
+		testShortAD(extentRecorded, 500, 26),
+	}, nil))
+	copy(im.block(24), sparse[:testBlocksize])
+	copy(im.block(25), bytes.Repeat([]byte{0xff}, testBlocksize))
+	copy(im.block(26), sparse[testBlocksize+1000:])
+
+	// ../dir/sub
+	target := bytes.Join([][]byte{
+		{pathComponentParent, 0, 0, 0},
+		{pathComponentName, 4, 0, 0, compressionID8, 'd', 'i', 'r'},
+		{pathComponentName, 4, 0, 0, compressionID8, 's', 'u', 'b'},
+	}, nil)
+	im.testFileEntry(13, fileTypeSymlink, false, len(target), icbAllocationEmbedded, target)
+	return im.b
+}
+
+// testUDF read the test image, as it is or after modify changes it
+func testUDF(t *testing.T, modify func([]byte)) (*FileSystem, error) {
+	t.Helper()
+	b := testUDFImage(t)
+	if modify != nil {
+		modify(b)
+	}
+	return Read(testStorage(t, b), int64(len(b)), 0, 0)
+}
+
+func testStorage(t *testing.T, b []byte) *mem.Buffer {
+	t.Helper()
+	storage, err := mem.NewFromBytes(b, true)
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+	return storage
+}
@@ -0,0 +1,247 @@
+package udf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// tag identifiers of the descriptors, ECMA-167 3/7.2.1 and 4/7.2.1
+const (
+	tagPrimaryVolumeDescriptor           uint16 = 1
+	tagAnchorVolumeDescriptorPointer     uint16 = 2
+	tagVolumeDescriptorPointer           uint16 = 3
+	tagImplementationUseVolumeDescriptor uint16 = 4
+	tagPartitionDescriptor               uint16 = 5
+	tagLogicalVolumeDescriptor           uint16 = 6
+	tagUnallocatedSpaceDescriptor        uint16 = 7
+	tagTerminatingDescriptor             uint16 = 8
+	tagLogicalVolumeIntegrityDescriptor  uint16 = 9
+	tagFileSetDescriptor                 uint16 = 256
+	tagFileIdentifierDescriptor          uint16 = 257
+	tagAllocationExtentDescriptor        uint16 = 258
+	tagFileEntry                         uint16 = 261
+	tagExtendedFileEntry                 uint16 = 266
+	descriptorTagSize                           = 16
+	anchorSector                                = 256
+	volumeRecognitionStart                      = 32768
+	volumeRecognitionDescriptorSize             = 2048
+	maxVolumeDescriptors                        = 64
+	unspecifiedTimezone                  int16  = -2047
+	compressionID8                       byte   = 8
+	compressionID16                      byte   = 16
+	compressionID8Deleted                byte   = 254
+	compressionID16Deleted               byte   = 255
+	extentLengthMask                     uint32 = 0x3fffffff
+	extentTypeShift                             = 30
+	extentRecorded                       uint32 = 0
+	extentNotRecorded                    uint32 = 1
+	extentNotAllocated                   uint32 = 2
+	extentNextAllocationDescriptors      uint32 = 3
+	noFreeSpaceInformation               uint32 = 0xffffffff
+	partitionMapType1                    byte   = 1
+	partitionMapType1Length                     = 6
+	fileSetDescriptorRootICBOffset              = 400
+	logicalVolumeIdentifierOffset               = 84
+	logicalVolumeIdentifierLength               = 128
+	volumeSetIdentifierOffset                   = 72
+	volumeSetIdentifierLength                   = 128
+	volumeIdentifierOffset                      = 24
+	volumeIdentifierLength                      = 32
+	longADSize                                  = 16
+	shortADSize                                 = 8
+	extendedADSize                              = 20
+	timestampSize                               = 12
+	fileIdentifierDescriptorFixedSize           = 38
+	fileEntryFixedSize                          = 176
+	extendedFileEntryFixedSize                  = 216
+	allocationExtentDescriptorFixedSize         = 24
+	icbStrategyDirect                    uint16 = 4
+	icbFlagsAllocationMask               uint16 = 7
+	icbAllocationShort                   uint16 = 0
+	icbAllocationLong                    uint16 = 1
+	icbAllocationExtended                uint16 = 2
+	icbAllocationEmbedded                uint16 = 3
+	fileCharacteristicHidden             byte   = 1 << 0
+	fileCharacteristicDirectory          byte   = 1 << 1
+	fileCharacteristicDeleted            byte   = 1 << 2
+	fileCharacteristicParent             byte   = 1 << 3
+)
+
+// descriptorTag the tag at the start of every descriptor, ECMA-167 3/7.2
+type descriptorTag struct {
+	id       uint16
+	version  uint16
+	serial   uint16
+	crcLen   uint16
+	location uint32
+}
+
+// parseDescriptorTag parse the tag at the start of b, checking its checksum and the CRC of the descriptor it
+// starts, which must be all of b. Where the descriptor was read from is for the caller to check against the
+// location in the tag.
+func parseDescriptorTag(b []byte) (*descriptorTag, error) {
+	if len(b) < descriptorTagSize {
+		return nil, fmt.Errorf("descriptor of %d bytes is too short for its tag", len(b))
+	}
+	var sum byte
+	for i := 0; i < descriptorTagSize; i++ {
+		if i != 4 {
+			sum += b[i]
+		}
+	}
+	if sum != b[4] {
+		return nil, fmt.Errorf("descriptor tag has checksum %d instead of %d", b[4], sum)
+	}
+	t := &descriptorTag{
+		id:       binary.LittleEndian.Uint16(b[0:2]),
+		version:  binary.LittleEndian.Uint16(b[2:4]),
+		serial:   binary.LittleEndian.Uint16(b[6:8]),
+		crcLen:   binary.LittleEndian.Uint16(b[10:12]),
+		location: binary.LittleEndian.Uint32(b[12:16]),
+	}
+	if int(t.crcLen) > len(b)-descriptorTagSize {
+		return nil, fmt.Errorf("descriptor with tag %d has CRC over %d bytes, more than the %d there are", t.id, t.crcLen, len(b)-descriptorTagSize)
+	}
+	if crc := crcITU(b[descriptorTagSize : descriptorTagSize+int(t.crcLen)]); crc != binary.LittleEndian.Uint16(b[8:10]) {
+		return nil, fmt.Errorf("descriptor with tag %d has CRC %#04x instead of %#04x", t.id, binary.LittleEndian.Uint16(b[8:10]), crc)
+	}
+	return t, nil
+}
+
+// crcITU the CRC of the descriptors, CRC-ITU-T with the polynomial x^16 + x^12 + x^5 + 1 and an initial value
+// of 0, ECMA-167 1/7.2.6
+func crcITU(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// extentAD an extent of sectors, ECMA-167 3/7.1
+type extentAD struct {
+	length   uint32
+	location uint32
+}
+
+func parseExtentAD(b []byte) extentAD {
+	return extentAD{
+		length:   binary.LittleEndian.Uint32(b[0:4]),
+		location: binary.LittleEndian.Uint32(b[4:8]),
+	}
+}
+
+// extent an extent of logical blocks in a partition, from a short, long or extended allocation descriptor,
+// ECMA-167 4/14.14
+type extent struct {
+	// kind whether the extent is recorded, only allocated, or neither, or leads to more allocation descriptors
+	kind      uint32
+	length    uint32
+	block     uint32
+	partition uint16
+}
+
+// parseLongAD parse a long allocation descriptor, which can be in any partition
+func parseLongAD(b []byte) extent {
+	l := binary.LittleEndian.Uint32(b[0:4])
+	return extent{
+		kind:      l >> extentTypeShift,
+		length:    l & extentLengthMask,
+		block:     binary.LittleEndian.Uint32(b[4:8]),
+		partition: binary.LittleEndian.Uint16(b[8:10]),
+	}
+}
+
+// parseShortAD parse a short allocation descriptor, which is in the same partition as the descriptor that has it
+func parseShortAD(b []byte, partition uint16) extent {
+	l := binary.LittleEndian.Uint32(b[0:4])
+	return extent{
+		kind:      l >> extentTypeShift,
+		length:    l & extentLengthMask,
+		block:     binary.LittleEndian.Uint32(b[4:8]),
+		partition: partition,
+	}
+}
+
+// parseExtendedAD parse an extended allocation descriptor; of its lengths, only that of the extent matters to
+// reading it
+func parseExtendedAD(b []byte) extent {
+	l := binary.LittleEndian.Uint32(b[0:4])
+	return extent{
+		kind:      l >> extentTypeShift,
+		length:    l & extentLengthMask,
+		block:     binary.LittleEndian.Uint32(b[12:16]),
+		partition: binary.LittleEndian.Uint16(b[16:18]),
+	}
+}
+
+// parseTimestamp parse a timestamp, ECMA-167 1/7.3, in its own time zone, or UTC if it has none
+func parseTimestamp(b []byte) time.Time {
+	typeAndZone := binary.LittleEndian.Uint16(b[0:2])
+	// the time zone is a 12-bit signed count of minutes from UTC
+	zone := int16(typeAndZone<<4) >> 4
+	loc := time.UTC
+	if typeAndZone>>12 == 1 && zone != unspecifiedTimezone {
+		loc = time.FixedZone("", int(zone)*60)
+	}
+	year := int(int16(binary.LittleEndian.Uint16(b[2:4])))
+	if year == 0 && b[4] == 0 {
+		return time.Time{}
+	}
+	nsec := int(b[9])*10_000_000 + int(b[10])*100_000 + int(b[11])*1_000
+	return time.Date(year, time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), nsec, loc)
+}
+
+// decodeCharacters decode OSTA compressed unicode, UDF 2.1.1: the first byte says whether every character is a
+// byte, or 2 bytes in big-endian UTF-16
+func decodeCharacters(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", nil
+	}
+	switch b[0] {
+	case compressionID8, compressionID8Deleted:
+		runes := make([]rune, 0, len(b)-1)
+		for _, c := range b[1:] {
+			runes = append(runes, rune(c))
+		}
+		return string(runes), nil
+	case compressionID16, compressionID16Deleted:
+		if len(b)%2 != 1 {
+			return "", fmt.Errorf("16-bit characters of %d bytes are not whole", len(b)-1)
+		}
+		u := make([]uint16, 0, len(b)/2)
+		for i := 1; i+1 < len(b); i += 2 {
+			u = append(u, binary.BigEndian.Uint16(b[i:i+2]))
+		}
+		return string(utf16.Decode(u)), nil
+	default:
+		return "", fmt.Errorf("unknown compression ID %d of characters", b[0])
+	}
+}
+
+// decodeDString decode a fixed size field of characters, whose last byte is how many of its bytes are used
+func decodeDString(b []byte) string {
+	n := int(b[len(b)-1])
+	if n == 0 || n > len(b)-1 {
+		return ""
+	}
+	s, err := decodeCharacters(b[:n])
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(s, "\x00")
+}
+
+// errNotUDF the storage has no UDF volume
+var errNotUDF = errors.New("no UDF volume recognition sequence")
@@ -0,0 +1,98 @@
+package udf
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRCITU(t *testing.T) {
+	// the check value of CRC-16/XMODEM, which ECMA-167 calls CRC-ITU
+	if crc := crcITU([]byte("123456789")); crc != 0x31c3 {
+		t.Errorf("CRC %#04x instead of %#04x", crc, 0x31c3)
+	}
+}
+
+func TestParseDescriptorTag(t *testing.T) {
+	valid := func() []byte {
+		b := make([]byte, 512)
+		copy(b[16:], "some contents")
+		testTag(b, tagTerminatingDescriptor, 35, 512)
+		return b
+	}
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    string
+	}{
+		{"valid", func(b []byte) []byte { return b }, ""},
+		{"checksum", func(b []byte) []byte { b[4]++; return b }, "checksum"},
+		{"CRC", func(b []byte) []byte { b[20]++; return b }, "CRC"},
+		{"CRC length", func(b []byte) []byte { return b[:400] }, "more than"},
+		{"short", func(b []byte) []byte { return b[:10] }, "too short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag, err := parseDescriptorTag(tt.modify(valid()))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v instead of one with %q", err, tt.err)
+			case tt.err == "" && (tag.id != tagTerminatingDescriptor || tag.location != 35):
+				t.Errorf("tag %+v instead of id %d at 35", tag, tagTerminatingDescriptor)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		want time.Time
+	}{
+		{"local time at UTC-5", []byte{0xd4, 0x1e, 0xe8, 0x07, 12, 31, 23, 59, 58, 1, 2, 3}, time.Date(2024, 12, 31, 23, 59, 58, 10_203_000, time.FixedZone("", -5*3600))},
+		{"unspecified zone", []byte{0x01, 0x18, 0xd0, 0x07, 1, 2, 3, 4, 5, 0, 0, 0}, time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"zero", make([]byte, 12), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTimestamp(tt.b); !got.Equal(tt.want) {
+				t.Errorf("time %v instead of %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCharacters(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		want string
+		err  bool
+	}{
+		{[]byte("\x08caf\xe9"), "café", false},
+		{testCharacters("日本語.txt"), "日本語.txt", false},
+		{[]byte{compressionID16, 0, 'a', 0}, "", true},
+		{[]byte{1, 'a'}, "", true},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		got, err := decodeCharacters(tt.b)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v", tt.b, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: %q instead of %q", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeDString(t *testing.T) {
+	if s := decodeDString(testDString("LABEL", 32)); s != "LABEL" {
+		t.Errorf("%q instead of %q", s, "LABEL")
+	}
+	if s := decodeDString(make([]byte, 32)); s != "" {
+		t.Errorf("%q instead of empty", s)
+	}
+}
@@ -0,0 +1,67 @@
+package udf
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// directoryEntry a file identifier descriptor, ECMA-167 4/14.4: the name of a file in a directory, and where its
+// file entry is
+type directoryEntry struct {
+	name            string
+	characteristics byte
+	icb             extent
+}
+
+// readDirectory read the entries of a directory, without those of deleted files or of its parent
+func (fs *FileSystem) readDirectory(dir *fileEntry) ([]*directoryEntry, error) {
+	b, err := fs.readAll(dir)
+	if err != nil {
+		return nil, err
+	}
+	return parseDirectoryEntries(b)
+}
+
+// parseDirectoryEntries parse the file identifier descriptors that make up the data of a directory
+func parseDirectoryEntries(b []byte) ([]*directoryEntry, error) {
+	var entries []*directoryEntry
+	for off := 0; off < len(b); {
+		if len(b)-off < fileIdentifierDescriptorFixedSize {
+			return nil, fmt.Errorf("file identifier descriptor at %d has only %d bytes", off, len(b)-off)
+		}
+		d := b[off:]
+		identifierLength := int(d[19])
+		implementationUseLength := int(binary.LittleEndian.Uint16(d[36:38]))
+		length := fileIdentifierDescriptorFixedSize + implementationUseLength + identifierLength
+		if length > len(d) {
+			return nil, fmt.Errorf("file identifier descriptor at %d of %d bytes goes past the end of the directory", off, length)
+		}
+		// each is padded to a multiple of 4 bytes, which its CRC covers, as mkudffs and Linux write it, though
+		// some writers leave the padding out of the CRC; the padding of the last one may be missing
+		padded := min((length+3)&^3, len(d))
+		t, err := parseDescriptorTag(d[:padded])
+		if err != nil {
+			return nil, fmt.Errorf("invalid file identifier descriptor at %d: %w", off, err)
+		}
+		if t.id != tagFileIdentifierDescriptor {
+			return nil, fmt.Errorf("descriptor with tag %d at %d is not a file identifier descriptor", t.id, off)
+		}
+		off += padded
+
+		characteristics := d[18]
+		if characteristics&(fileCharacteristicDeleted|fileCharacteristicParent) != 0 {
+			continue
+		}
+		identifierStart := fileIdentifierDescriptorFixedSize + implementationUseLength
+		name, err := decodeCharacters(d[identifierStart : identifierStart+identifierLength])
+		if err != nil {
+			return nil, fmt.Errorf("invalid name in file identifier descriptor at %d: %w", off, err)
+		}
+		entries = append(entries, &directoryEntry{
+			name:            name,
+			characteristics: characteristics,
+			icb:             parseLongAD(d[20:36]),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,11 @@
+// Package udf provides support for reading UDF filesystems, the Universal Disk Format of DVDs, Blu-ray discs and
+// the installer images of many operating systems, which often are UDF bridge images that are ISO9660 as well.
+// references:
+//
+//	https://www.ecma-international.org/publications-and-standards/standards/ecma-167/
+//	http://www.osta.org/specs/pdf/udf260.pdf
+//
+// It reads UDF 1.02 to 2.01, and later versions as long as they do not keep their metadata in a partition of its
+// own, as UDF 2.50 and later do on some media. It cannot write UDF; to make an image that has to be read as UDF,
+// build it elsewhere.
+package udf
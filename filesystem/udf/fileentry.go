@@ -0,0 +1,264 @@
+package udf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// file types of an ICB, ECMA-167 4/14.6.6
+const (
+	fileTypeDirectory       byte = 4
+	fileTypeRegular         byte = 5
+	fileTypeBlockDevice     byte = 6
+	fileTypeCharDevice      byte = 7
+	fileTypeFIFO            byte = 9
+	fileTypeSocket          byte = 10
+	fileTypeSymlink         byte = 12
+	fileTypeStreamDirectory byte = 13
+)
+
+// types of path component, ECMA-167 4/14.16.1
+const (
+	pathComponentRoot      byte = 1
+	pathComponentFileSet   byte = 2
+	pathComponentParent    byte = 3
+	pathComponentCurrent   byte = 4
+	pathComponentName      byte = 5
+	pathComponentFixedSize      = 4
+)
+
+// maxAllocationExtents how many allocation extent descriptors a file may have, so that a loop of them cannot go on
+// forever
+const maxAllocationExtents = 4096
+
+// fileEntry a file entry, ECMA-167 4/14.9, or extended file entry, 4/14.17: the inode of a file or directory
+type fileEntry struct {
+	fileType    byte
+	uid         uint32
+	gid         uint32
+	permissions uint32
+	linkCount   uint16
+	size        uint64
+	accessTime  time.Time
+	modTime     time.Time
+	// extents where the data is; if the data is in the entry itself, embedded has it instead
+	extents  []extent
+	embedded []byte
+}
+
+func (e *fileEntry) isDir() bool {
+	return e.fileType == fileTypeDirectory || e.fileType == fileTypeStreamDirectory
+}
+
+// readFileEntry read the file entry that an ICB points to, and all of its allocation descriptors
+func (fs *FileSystem) readFileEntry(icb extent) (*fileEntry, error) {
+	b, t, err := fs.readBlock(icb.partition, icb.block)
+	if err != nil {
+		return nil, err
+	}
+	var fixed, timesAt int
+	switch t.id {
+	case tagFileEntry:
+		fixed, timesAt = fileEntryFixedSize, 72
+	case tagExtendedFileEntry:
+		fixed, timesAt = extendedFileEntryFixedSize, 80
+	default:
+		return nil, fmt.Errorf("descriptor with tag %d in block %d is not a file entry", t.id, icb.block)
+	}
+	// the ICB tag, ECMA-167 4/14.6
+	if strategy := binary.LittleEndian.Uint16(b[20:22]); strategy != icbStrategyDirect {
+		return nil, fmt.Errorf("file entry in block %d has ICB strategy %d; only %d is supported", icb.block, strategy, icbStrategyDirect)
+	}
+	e := &fileEntry{
+		fileType:    b[27],
+		uid:         binary.LittleEndian.Uint32(b[36:40]),
+		gid:         binary.LittleEndian.Uint32(b[40:44]),
+		permissions: binary.LittleEndian.Uint32(b[44:48]),
+		linkCount:   binary.LittleEndian.Uint16(b[48:50]),
+		size:        binary.LittleEndian.Uint64(b[56:64]),
+		accessTime:  parseTimestamp(b[timesAt : timesAt+timestampSize]),
+		modTime:     parseTimestamp(b[timesAt+timestampSize : timesAt+2*timestampSize]),
+	}
+	flags := binary.LittleEndian.Uint16(b[34:36])
+	eaLength := binary.LittleEndian.Uint32(b[fixed-8 : fixed-4])
+	adLength := binary.LittleEndian.Uint32(b[fixed-4 : fixed])
+	if uint64(fixed)+uint64(eaLength)+uint64(adLength) > uint64(len(b)) {
+		return nil, fmt.Errorf("file entry in block %d has %d bytes of extended attributes and %d of allocation descriptors, more than fit", icb.block, eaLength, adLength)
+	}
+	ads := b[fixed+int(eaLength) : fixed+int(eaLength)+int(adLength)]
+
+	adType := flags & icbFlagsAllocationMask
+	if adType == icbAllocationEmbedded {
+		if e.size > uint64(len(ads)) {
+			return nil, fmt.Errorf("file entry in block %d has %d bytes embedded, fewer than its size %d", icb.block, len(ads), e.size)
+		}
+		e.embedded = ads[:e.size]
+		return e, nil
+	}
+	if err := fs.readAllocationDescriptors(e, ads, adType, icb.partition); err != nil {
+		return nil, fmt.Errorf("file entry in block %d: %w", icb.block, err)
+	}
+	return e, nil
+}
+
+// readAllocationDescriptors parse the allocation descriptors of a file entry into its extents, following any that
+// lead on to allocation extent descriptors, ECMA-167 4/14.5
+func (fs *FileSystem) readAllocationDescriptors(e *fileEntry, ads []byte, adType, partition uint16) error {
+	var (
+		size  int
+		parse func([]byte) extent
+	)
+	switch adType {
+	case icbAllocationShort:
+		size, parse = shortADSize, func(b []byte) extent { return parseShortAD(b, partition) }
+	case icbAllocationLong:
+		size, parse = longADSize, parseLongAD
+	case icbAllocationExtended:
+		size, parse = extendedADSize, parseExtendedAD
+	default:
+		return fmt.Errorf("unknown type %d of allocation descriptors", adType)
+	}
+	for n := 0; ; {
+		var next *extent
+		for ; len(ads) >= size; ads = ads[size:] {
+			x := parse(ads[:size])
+			// a descriptor of length 0 ends them
+			if x.length == 0 {
+				break
+			}
+			if x.kind == extentNextAllocationDescriptors {
+				next = &x
+				break
+			}
+			e.extents = append(e.extents, x)
+		}
+		if next == nil {
+			return nil
+		}
+		if n++; n > maxAllocationExtents {
+			return fmt.Errorf("more than %d allocation extent descriptors", maxAllocationExtents)
+		}
+		b, t, err := fs.readBlock(next.partition, next.block)
+		if err != nil {
+			return fmt.Errorf("could not read allocation extent descriptor: %w", err)
+		}
+		if t.id != tagAllocationExtentDescriptor {
+			return fmt.Errorf("descriptor with tag %d in block %d is not an allocation extent descriptor", t.id, next.block)
+		}
+		l := binary.LittleEndian.Uint32(b[20:24])
+		if allocationExtentDescriptorFixedSize+int(l) > len(b) {
+			return fmt.Errorf("allocation extent descriptor in block %d has %d bytes of descriptors, more than fit", next.block, l)
+		}
+		ads = b[allocationExtentDescriptorFixedSize : allocationExtentDescriptorFixedSize+int(l)]
+		// short descriptors in it are in its own partition
+		partition = next.partition
+	}
+}
+
+// readAt read the data of a file entry at the given offset, as io.ReaderAt does; what is in an extent that is not
+// recorded reads as zeros
+func (fs *FileSystem) readAt(e *fileEntry, b []byte, off int64) (int, error) {
+	if off >= int64(e.size) {
+		return 0, io.EOF
+	}
+	want := len(b)
+	if remaining := int64(e.size) - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+	if e.embedded != nil {
+		n := copy(b[:want], e.embedded[off:])
+		if n < len(b) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	var (
+		n     int
+		start int64
+	)
+	for _, x := range e.extents {
+		end := start + int64(x.length)
+		if n >= want {
+			break
+		}
+		if off+int64(n) >= end {
+			start = end
+			continue
+		}
+		from := off + int64(n) - start
+		count := min(int64(want-n), int64(x.length)-from)
+		p := b[n : n+int(count)]
+		if x.kind == extentRecorded {
+			sector, err := fs.sector(x.partition, x.block)
+			if err != nil {
+				return n, err
+			}
+			if _, err := fs.backend.ReadAt(p, fs.start+int64(sector)*fs.blocksize+from); err != nil {
+				return n, fmt.Errorf("could not read block %d of partition %d: %w", x.block, x.partition, err)
+			}
+		} else {
+			clear(p)
+		}
+		n += int(count)
+		start = end
+	}
+	if n < want {
+		return n, fmt.Errorf("extents of file end after %d bytes, before its size %d", off+int64(n), e.size)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAll read all of the data of a file entry
+func (fs *FileSystem) readAll(e *fileEntry) ([]byte, error) {
+	b := make([]byte, e.size)
+	if _, err := fs.readAt(e, b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseSymlinkTarget the target of a symlink from its data, which is a series of path components, ECMA-167
+// 4/14.16: a target that starts at the root, whether of the medium or of the file set, is absolute
+func parseSymlinkTarget(b []byte) (string, error) {
+	var (
+		parts    []string
+		absolute bool
+	)
+	for len(b) > 0 {
+		if len(b) < pathComponentFixedSize {
+			return "", fmt.Errorf("path component of %d bytes is shorter than %d", len(b), pathComponentFixedSize)
+		}
+		n := pathComponentFixedSize + int(b[1])
+		if n > len(b) {
+			return "", fmt.Errorf("path component of %d bytes is longer than the %d remaining", n, len(b))
+		}
+		switch b[0] {
+		case pathComponentRoot, pathComponentFileSet:
+			parts, absolute = nil, true
+		case pathComponentParent:
+			parts = append(parts, "..")
+		case pathComponentCurrent:
+			parts = append(parts, ".")
+		case pathComponentName:
+			name, err := decodeCharacters(b[pathComponentFixedSize:n])
+			if err != nil {
+				return "", fmt.Errorf("could not decode path component: %w", err)
+			}
+			parts = append(parts, name)
+		default:
+			return "", fmt.Errorf("unknown path component type %d", b[0])
+		}
+		b = b[n:]
+	}
+	target := strings.Join(parts, "/")
+	if absolute {
+		target = "/" + target
+	}
+	return target, nil
+}
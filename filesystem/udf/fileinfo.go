@@ -0,0 +1,83 @@
+package udf
+
+import (
+	"os"
+	"time"
+)
+
+// FileInfo the os.FileInfo of a file or directory in a UDF filesystem
+type FileInfo struct {
+	name  string
+	entry *fileEntry
+}
+
+func newFileInfo(name string, e *fileEntry) *FileInfo {
+	return &FileInfo{name: name, entry: e}
+}
+
+// Name string       // base name of the file
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+// Size int64        // length in bytes for regular files; system-dependent for others
+func (fi *FileInfo) Size() int64 {
+	return int64(fi.entry.size)
+}
+
+// Mode FileMode     // file mode bits
+//
+// UDF has 5 bits of permissions for each of other, group and owner, ECMA-167 4/14.9.5, of which the lowest 3 are
+// execute, write and read as in unix, and the other 2 whether the attributes may be changed and whether the file
+// may be deleted, which have no equivalent
+func (fi *FileInfo) Mode() os.FileMode {
+	var mode os.FileMode
+	for i := 0; i < 3; i++ {
+		mode |= os.FileMode(fi.entry.permissions>>(5*i)&7) << (3 * i)
+	}
+	switch fi.entry.fileType {
+	case fileTypeDirectory, fileTypeStreamDirectory:
+		mode |= os.ModeDir
+	case fileTypeSymlink:
+		mode |= os.ModeSymlink
+	case fileTypeBlockDevice:
+		mode |= os.ModeDevice
+	case fileTypeCharDevice:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case fileTypeFIFO:
+		mode |= os.ModeNamedPipe
+	case fileTypeSocket:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+// ModTime time.Time // modification time
+func (fi *FileInfo) ModTime() time.Time {
+	return fi.entry.modTime
+}
+
+// IsDir bool        // abbreviation for Mode().IsDir()
+func (fi *FileInfo) IsDir() bool {
+	return fi.entry.isDir()
+}
+
+// Sys interface{}   // underlying data source (can return nil)
+func (fi *FileInfo) Sys() interface{} {
+	return fi
+}
+
+// UID get uid of file
+func (fi *FileInfo) UID() uint32 {
+	return fi.entry.uid
+}
+
+// GID get gid of file
+func (fi *FileInfo) GID() uint32 {
+	return fi.entry.gid
+}
+
+// AccessTime the time the file was last accessed
+func (fi *FileInfo) AccessTime() time.Time {
+	return fi.entry.accessTime
+}
@@ -0,0 +1,26 @@
+#!/bin/sh
+set -e
+mkdir -p dist
+cat << "EOF" | docker run -i --rm -v $PWD/dist:/data -w /data --privileged alpine:3.20
+set -e
+set -x
+apk --update add udftools
+dd if=/dev/zero of=udf.img bs=1M count=20
+# UDF 2.01 for a hard disk, with 512 byte blocks and a type 1 partition map
+mkudffs --media-type=hd --udfrev=0x0201 --blocksize=512 --label=diskfs udf.img
+mount -t udf udf.img /mnt
+cd /mnt
+mkdir foo
+echo "This is a short file" > shortfile.txt
+echo "This is a subdir file" > foo/subdirfile.txt
+# enough entries that /foo takes many blocks
+set +x
+i=0; until [ $i -ge 1000 ]; do touch foo/file${i}; i=$(( $i+1 )); done
+set -x
+# a file with known content
+dd if=/dev/random of=/data/random.dat bs=1024 count=20
+cp /data/random.dat random.dat
+ln -s random.dat symlink.dat
+cd /data
+umount /mnt
+EOF
@@ -0,0 +1,514 @@
+package udf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// FileSystem implements the FileSystem interface
+type FileSystem struct {
+	backend   backend.Storage
+	size      int64
+	start     int64
+	blocksize int64
+	// partitions the first sector of each partition, by partition reference number, i.e. its index in the
+	// partition maps of the logical volume
+	partitions []uint32
+	// label the logical volume identifier, volumeSet the volume set identifier
+	label, volumeSet string
+	root             extent
+	// free the free space in the partitions, in bytes, or -1 if the volume does not say
+	free int64
+}
+
+// partitionDescriptor the parts of a partition descriptor, ECMA-167 3/10.5, needed to find the partition
+type partitionDescriptor struct {
+	number uint16
+	start  uint32
+	length uint32
+}
+
+// Equal compare if two filesystems are equal
+func (fs *FileSystem) Equal(a *FileSystem) bool {
+	return fs.backend == a.backend && fs.size == a.size && fs.start == a.start && fs.blocksize == a.blocksize
+}
+
+// Read reads a UDF filesystem, as on DVDs, Blu-ray discs and the installer images of many operating systems,
+// from the given storage. size is the size of the filesystem in bytes, start where it starts, and blocksize its
+// sector size, which also is its logical block size; if 0, each of 2048, 512 and 4096 is tried.
+//
+// Only reading is supported, and only of partitions with a type 1 partition map, as every volume of UDF 1.02 to
+// 2.01 that is not on rewritable or write-once media has. Volumes of later versions of UDF that keep their
+// metadata in a partition of its own, as UDF 2.50 does, cannot be read.
+func Read(b backend.Storage, size, start, blocksize int64) (*FileSystem, error) {
+	var blocksizes []int64
+	switch blocksize {
+	case 0:
+		blocksizes = []int64{2048, 512, 4096}
+	case 512, 1024, 2048, 4096:
+		blocksizes = []int64{blocksize}
+	default:
+		return nil, fmt.Errorf("blocksize for UDF must be one of 512, 1024, 2048 or 4096, not %d", blocksize)
+	}
+	if err := readVolumeRecognition(b, start, size); err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, bs := range blocksizes {
+		fs := &FileSystem{
+			backend:   b,
+			size:      size,
+			start:     start,
+			blocksize: bs,
+			free:      -1,
+		}
+		err := fs.readVolume()
+		if err == nil {
+			return fs, nil
+		}
+		errs = append(errs, fmt.Errorf("with blocksize %d: %w", bs, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// readVolumeRecognition check that the volume recognition sequence, ECMA-167 2/8, has an NSR descriptor, which
+// says that the volume is UDF, or some other filesystem of ECMA-167
+func readVolumeRecognition(b backend.Storage, start, size int64) error {
+	d := make([]byte, volumeRecognitionDescriptorSize)
+	for off := int64(volumeRecognitionStart); off+volumeRecognitionDescriptorSize <= size; off += volumeRecognitionDescriptorSize {
+		if _, err := b.ReadAt(d, start+off); err != nil {
+			return fmt.Errorf("could not read volume recognition sequence: %w", err)
+		}
+		// the structure type is 0 in all of them, but that of ISO9660 volume descriptors, which come first in a
+		// UDF bridge image
+		switch id := string(d[1:6]); id {
+		case "NSR02", "NSR03":
+			return nil
+		case "BEA01", "TEA01", "CD001", "CDW02", "BOOT2":
+		default:
+			return errNotUDF
+		}
+	}
+	return errNotUDF
+}
+
+// readSectors read count sectors starting at the given sector of the volume
+func (fs *FileSystem) readSectors(sector uint32, count int) ([]byte, error) {
+	b := make([]byte, count*int(fs.blocksize))
+	off := int64(sector) * fs.blocksize
+	if off+int64(len(b)) > fs.size {
+		return nil, fmt.Errorf("sectors %d to %d are beyond the end of the volume", sector, int64(sector)+int64(count)-1)
+	}
+	if _, err := fs.backend.ReadAt(b, fs.start+off); err != nil {
+		return nil, fmt.Errorf("could not read sector %d: %w", sector, err)
+	}
+	return b, nil
+}
+
+// readDescriptor read the descriptor in the given sector, checking its tag
+func (fs *FileSystem) readDescriptor(sector uint32) ([]byte, *descriptorTag, error) {
+	b, err := fs.readSectors(sector, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := parseDescriptorTag(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid descriptor in sector %d: %w", sector, err)
+	}
+	if t.location != sector {
+		return nil, nil, fmt.Errorf("descriptor in sector %d says it is in sector %d", sector, t.location)
+	}
+	return b, t, nil
+}
+
+// readVolume read the anchor, the volume descriptors it leads to, and the file set descriptor
+func (fs *FileSystem) readVolume() error {
+	// the anchor is in sector 256, and may also be in the last sector, or 256 sectors before it
+	last := uint32(fs.size/fs.blocksize) - 1
+	var (
+		anchor []byte
+		err    error
+	)
+	for _, sector := range []uint32{anchorSector, last, last - anchorSector} {
+		var t *descriptorTag
+		anchor, t, err = fs.readDescriptor(sector)
+		if err == nil && t.id != tagAnchorVolumeDescriptorPointer {
+			err = fmt.Errorf("descriptor in sector %d has tag %d instead of anchor %d", sector, t.id, tagAnchorVolumeDescriptorPointer)
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("no anchor volume descriptor pointer: %w", err)
+	}
+	// the main volume descriptor sequence, or else the reserve one
+	main, reserve := parseExtentAD(anchor[16:24]), parseExtentAD(anchor[24:32])
+	if err := fs.readVolumeDescriptors(main); err != nil {
+		if reserveErr := fs.readVolumeDescriptors(reserve); reserveErr != nil {
+			return fmt.Errorf("could not read main volume descriptor sequence: %v, nor reserve one: %v", err, reserveErr)
+		}
+	}
+	return nil
+}
+
+// readVolumeDescriptors read the volume descriptor sequence in the extent, and the file set descriptor of the
+// logical volume in it
+func (fs *FileSystem) readVolumeDescriptors(e extentAD) error {
+	var (
+		primary []byte
+		logical []byte
+		parts   = map[uint16]partitionDescriptor{}
+	)
+	sector, end := e.location, e.location+e.length/uint32(fs.blocksize)
+	for n := 0; sector < end; sector++ {
+		if n++; n > maxVolumeDescriptors {
+			return fmt.Errorf("volume descriptor sequence has more than %d descriptors", maxVolumeDescriptors)
+		}
+		b, t, err := fs.readDescriptor(sector)
+		if err != nil {
+			return err
+		}
+		switch t.id {
+		case tagPrimaryVolumeDescriptor:
+			primary = b
+		case tagPartitionDescriptor:
+			pd := partitionDescriptor{
+				number: binary.LittleEndian.Uint16(b[22:24]),
+				start:  binary.LittleEndian.Uint32(b[188:192]),
+				length: binary.LittleEndian.Uint32(b[192:196]),
+			}
+			parts[pd.number] = pd
+		case tagLogicalVolumeDescriptor:
+			logical = b
+		case tagVolumeDescriptorPointer:
+			// the sequence goes on elsewhere
+			next := parseExtentAD(b[20:28])
+			sector, end = next.location-1, next.location+next.length/uint32(fs.blocksize)
+		case tagTerminatingDescriptor:
+			sector = end
+		case tagImplementationUseVolumeDescriptor, tagUnallocatedSpaceDescriptor:
+		default:
+			return fmt.Errorf("unexpected descriptor with tag %d in volume descriptor sequence", t.id)
+		}
+	}
+	if primary == nil || logical == nil {
+		return errors.New("volume descriptor sequence has no primary or no logical volume descriptor")
+	}
+	if bs := binary.LittleEndian.Uint32(logical[212:216]); int64(bs) != fs.blocksize {
+		return fmt.Errorf("logical block size %d is not the sector size %d", bs, fs.blocksize)
+	}
+	if err := fs.readPartitionMaps(logical, parts); err != nil {
+		return err
+	}
+	fs.label = decodeDString(logical[logicalVolumeIdentifierOffset : logicalVolumeIdentifierOffset+logicalVolumeIdentifierLength])
+	if fs.label == "" {
+		fs.label = decodeDString(primary[volumeIdentifierOffset : volumeIdentifierOffset+volumeIdentifierLength])
+	}
+	fs.volumeSet = decodeDString(primary[volumeSetIdentifierOffset : volumeSetIdentifierOffset+volumeSetIdentifierLength])
+	fs.readIntegrity(parseExtentAD(logical[432:440]))
+
+	// the file set descriptor is where the logical volume descriptor says, and has the root directory
+	fsdExtent := parseLongAD(logical[248:264])
+	fsd, t, err := fs.readBlock(fsdExtent.partition, fsdExtent.block)
+	if err != nil {
+		return fmt.Errorf("could not read file set descriptor: %w", err)
+	}
+	if t.id != tagFileSetDescriptor {
+		return fmt.Errorf("descriptor with tag %d instead of file set descriptor", t.id)
+	}
+	fs.root = parseLongAD(fsd[fileSetDescriptorRootICBOffset : fileSetDescriptorRootICBOffset+longADSize])
+	return nil
+}
+
+// readPartitionMaps find where each partition of the logical volume starts
+func (fs *FileSystem) readPartitionMaps(logical []byte, parts map[uint16]partitionDescriptor) error {
+	tableLength := binary.LittleEndian.Uint32(logical[264:268])
+	count := binary.LittleEndian.Uint32(logical[268:272])
+	if 440+int(tableLength) > len(logical) {
+		return fmt.Errorf("partition maps of %d bytes do not fit in the logical volume descriptor", tableLength)
+	}
+	maps := logical[440 : 440+tableLength]
+	for i := uint32(0); i < count; i++ {
+		if len(maps) < 2 || int(maps[1]) > len(maps) || maps[1] < 2 {
+			return fmt.Errorf("partition map %d is not whole", i)
+		}
+		mapType, mapLength := maps[0], maps[1]
+		if mapType != partitionMapType1 {
+			return fmt.Errorf("partition map %d is of type %d; only type 1 is supported", i, mapType)
+		}
+		if mapLength != partitionMapType1Length {
+			return fmt.Errorf("partition map %d of type 1 has length %d instead of %d", i, mapLength, partitionMapType1Length)
+		}
+		number := binary.LittleEndian.Uint16(maps[4:6])
+		pd, ok := parts[number]
+		if !ok {
+			return fmt.Errorf("partition map %d is for partition %d, which has no partition descriptor", i, number)
+		}
+		fs.partitions = append(fs.partitions, pd.start)
+		maps = maps[mapLength:]
+	}
+	if len(fs.partitions) == 0 {
+		return errors.New("logical volume has no partitions")
+	}
+	return nil
+}
+
+// readIntegrity read the free space of the logical volume from the last of its integrity descriptors, if it has
+// any; it says nothing else that reading the volume needs
+func (fs *FileSystem) readIntegrity(e extentAD) {
+	for n := 0; e.length > 0 && n < maxVolumeDescriptors; n++ {
+		b, t, err := fs.readDescriptor(e.location)
+		if err != nil || t.id != tagLogicalVolumeIntegrityDescriptor {
+			return
+		}
+		if binary.LittleEndian.Uint32(b[72:76]) > 0 {
+			if free := binary.LittleEndian.Uint32(b[80:84]); free != noFreeSpaceInformation {
+				fs.free = int64(free) * fs.blocksize
+			}
+		}
+		next := parseExtentAD(b[32:40])
+		if next.length == 0 {
+			e.length -= uint32(fs.blocksize)
+			e.location++
+			continue
+		}
+		e = next
+	}
+}
+
+// readBlock read the descriptor in a logical block of a partition
+func (fs *FileSystem) readBlock(partition uint16, block uint32) ([]byte, *descriptorTag, error) {
+	sector, err := fs.sector(partition, block)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := fs.readSectors(sector, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := parseDescriptorTag(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid descriptor in block %d of partition %d: %w", block, partition, err)
+	}
+	// the location in the tag of a descriptor in a partition is its logical block
+	if t.location != block {
+		return nil, nil, fmt.Errorf("descriptor in block %d of partition %d says it is in block %d", block, partition, t.location)
+	}
+	return b, t, nil
+}
+
+// sector the sector of the volume that a logical block of a partition is in
+func (fs *FileSystem) sector(partition uint16, block uint32) (uint32, error) {
+	if int(partition) >= len(fs.partitions) {
+		return 0, fmt.Errorf("no partition with reference number %d", partition)
+	}
+	return fs.partitions[partition] + block, nil
+}
+
+// interface guard
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
+
+// Type returns the type code for the filesystem. Always returns filesystem.TypeUDF
+func (fs *FileSystem) Type() filesystem.Type {
+	return filesystem.TypeUDF
+}
+
+// Mkdir make a directory. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Mkdir(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Mknod make a special file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Mknod(_ string, _ uint32, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Link make a hard link. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Link(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Symlink make a symbolic link. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Symlink(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chmod change the mode of a file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Chmod(_ string, _ os.FileMode) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chown change the owner of a file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Chown(_ string, _, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chtimes change the times of a file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Chtimes(_ string, _, _ time.Time) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Rename rename a file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Rename(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Remove remove a file. UDF is read-only, so it always returns an error
+func (fs *FileSystem) Remove(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// SetLabel change the label. UDF is read-only, so it always returns an error
+func (fs *FileSystem) SetLabel(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// ReadDir return the contents of a given directory in a given filesystem.
+//
+// Returns a slice of os.FileInfo with all of the entries in the directory.
+//
+// Will return an error if the directory does not exist or is a regular file and not a directory
+func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	dir, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	entries, err := fs.readDirectory(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", p, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, de := range entries {
+		e, err := fs.readFileEntry(de.icb)
+		if err != nil {
+			return nil, fmt.Errorf("could not read entry for %s: %w", path.Join(p, de.name), err)
+		}
+		infos = append(infos, newFileInfo(de.name, e))
+	}
+	return infos, nil
+}
+
+// Readlink returns the target of the named symbolic link
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	e, err := fs.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if e.fileType != fileTypeSymlink {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	b, err := fs.readAll(e)
+	if err != nil {
+		return "", fmt.Errorf("could not read symlink %s: %w", name, err)
+	}
+	target, err := parseSymlinkTarget(b)
+	if err != nil {
+		return "", fmt.Errorf("could not read symlink %s: %w", name, err)
+	}
+	return target, nil
+}
+
+// OpenFile returns a reader for a file in the filesystem. As UDF is read-only, flag must be os.O_RDONLY.
+func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_EXCL) != 0 {
+		return nil, filesystem.ErrReadonlyFilesystem
+	}
+	e, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.isDir() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	return &File{fileEntry: e, filesystem: fs}, nil
+}
+
+// lookup the entry of a file or directory by its path; names are compared exactly, as UDF does
+func (fs *FileSystem) lookup(p string) (*fileEntry, error) {
+	e, err := fs.readFileEntry(fs.root)
+	if err != nil {
+		return nil, fmt.Errorf("could not read root directory: %w", err)
+	}
+	walked := "/"
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !e.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := fs.readDirectory(e)
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %w", walked, err)
+		}
+		walked = path.Join(walked, name)
+		var found *directoryEntry
+		for _, de := range entries {
+			if de.name == name {
+				found = de
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s does not exist", walked)
+		}
+		if e, err = fs.readFileEntry(found.icb); err != nil {
+			return nil, fmt.Errorf("could not read entry for %s: %w", walked, err)
+		}
+	}
+	return e, nil
+}
+
+// Label the logical volume identifier, which is what blkid reports as the label, or else the volume identifier
+func (fs *FileSystem) Label() string {
+	return fs.label
+}
+
+// UUID the identifier of the volume, from the start of its volume set identifier, in the same form as blkid
+// reports it: the first 16 characters if they all are hexadecimal digits, else the first 8 if they are, else the
+// first 8 bytes in hexadecimal
+func (fs *FileSystem) UUID() string {
+	id := []byte(fs.volumeSet)
+	hexDigits := 0
+	for hexDigits < len(id) && hexDigits < 16 && isHexDigit(id[hexDigits]) {
+		hexDigits++
+	}
+	switch {
+	case hexDigits == 16:
+		return strings.ToLower(string(id[:16]))
+	case hexDigits >= 8:
+		return strings.ToLower(string(id[:8]))
+	case len(id) == 0:
+		return ""
+	default:
+		return hex.EncodeToString(id[:min(8, len(id))])
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return bytes.IndexByte([]byte("0123456789abcdefABCDEF"), c) >= 0
+}
+
+// Usage the size of the filesystem, and the free space that its integrity descriptor records, if any
+func (fs *FileSystem) Usage() filesystem.Usage {
+	return filesystem.Usage{Size: fs.size, Free: max(0, fs.free)}
+}
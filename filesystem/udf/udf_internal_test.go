@@ -0,0 +1,399 @@
+package udf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+func TestRead(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		fs, err := testUDF(t, nil)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if fs.Type() != filesystem.TypeUDF {
+			t.Errorf("type %v instead of %v", fs.Type(), filesystem.TypeUDF)
+		}
+		if fs.blocksize != testBlocksize {
+			t.Errorf("blocksize %d instead of %d", fs.blocksize, testBlocksize)
+		}
+		if label := fs.Label(); label != testLabel {
+			t.Errorf("label %q instead of %q", label, testLabel)
+		}
+		if uuid := fs.UUID(); uuid != "4e2d7f1c9a8b6e50" {
+			t.Errorf("UUID %q instead of %q", uuid, "4e2d7f1c9a8b6e50")
+		}
+		usage := fs.Usage()
+		if usage.Size != testSectors*testBlocksize || usage.Free != testFreeBlocks*testBlocksize {
+			t.Errorf("usage %+v instead of size %d and free %d", usage, testSectors*testBlocksize, testFreeBlocks*testBlocksize)
+		}
+	})
+	t.Run("not UDF", func(t *testing.T) {
+		_, err := testUDF(t, func(b []byte) {
+			copy(b[volumeRecognitionStart+volumeRecognitionDescriptorSize+1:], "CD001")
+		})
+		if !errors.Is(err, errNotUDF) {
+			t.Errorf("error %v instead of %v", err, errNotUDF)
+		}
+	})
+	t.Run("anchor in last sector", func(t *testing.T) {
+		fs, err := testUDF(t, func(b []byte) {
+			clear(b[anchorSector*testBlocksize : (anchorSector+1)*testBlocksize])
+		})
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if label := fs.Label(); label != testLabel {
+			t.Errorf("label %q instead of %q", label, testLabel)
+		}
+	})
+	t.Run("reserve volume descriptors", func(t *testing.T) {
+		fs, err := testUDF(t, func(b []byte) {
+			// a bad CRC in the logical volume descriptor of the main sequence
+			b[(testMainVDS+2)*testBlocksize+100] ^= 0xff
+		})
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if label := fs.Label(); label != testLabel {
+			t.Errorf("label %q instead of %q", label, testLabel)
+		}
+	})
+	t.Run("no anchor", func(t *testing.T) {
+		_, err := testUDF(t, func(b []byte) {
+			clear(b[anchorSector*testBlocksize : (anchorSector+1)*testBlocksize])
+			clear(b[len(b)-testBlocksize:])
+		})
+		if err == nil || !strings.Contains(err.Error(), "no anchor") {
+			t.Errorf("error %v instead of one about the anchor", err)
+		}
+	})
+	t.Run("wrong blocksize", func(t *testing.T) {
+		storage := testStorage(t, testUDFImage(t))
+		if _, err := Read(storage, testSectors*testBlocksize, 0, 512); err == nil {
+			t.Errorf("no error reading with blocksize 512")
+		}
+		if _, err := Read(storage, testSectors*testBlocksize, 0, 1000); err == nil {
+			t.Errorf("no error reading with blocksize 1000")
+		}
+	})
+}
+
+func TestReadDir(t *testing.T) {
+	fs, err := testUDF(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	tests := []struct {
+		path  string
+		names []string
+		err   string
+	}{
+		{"/", []string{"chained", "dir", "efe.txt", "embedded", "link", "long.bin", "sparse.txt", "ünï€.txt"}, ""},
+		{"/dir", []string{"nested", "sub"}, ""},
+		{"/dir/sub/", []string{"deep"}, ""},
+		{"/deleted", nil, "does not exist"},
+		{"/long.bin", nil, "not a directory"},
+		{"/long.bin/x", nil, "not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			infos, err := fs.ReadDir(tt.path)
+			switch {
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v instead of one with %q", err, tt.err)
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var names []string
+			for _, fi := range infos {
+				names = append(names, fi.Name())
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("entries %v instead of %v", names, tt.names)
+			}
+		})
+	}
+
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	modTime := time.Date(2024, 2, 29, 13, 14, 15, 500_000_000, time.FixedZone("", 3600))
+	for _, fi := range infos {
+		var mode os.FileMode = 0o755
+		switch fi.Name() {
+		case "dir":
+			mode |= os.ModeDir
+		case "link":
+			mode |= os.ModeSymlink
+		}
+		if fi.Mode() != mode {
+			t.Errorf("%s has mode %v instead of %v", fi.Name(), fi.Mode(), mode)
+		}
+		if fi.IsDir() != (fi.Name() == "dir") {
+			t.Errorf("%s is a directory: %v", fi.Name(), fi.IsDir())
+		}
+		if !fi.ModTime().Equal(modTime) {
+			t.Errorf("%s modified at %v instead of %v", fi.Name(), fi.ModTime(), modTime)
+		}
+		if content, ok := testFiles["/"+fi.Name()]; ok && fi.Size() != int64(len(content)) {
+			t.Errorf("%s has size %d instead of %d", fi.Name(), fi.Size(), len(content))
+		}
+		if sys, ok := fi.Sys().(*FileInfo); !ok || sys.UID() != 1000 || sys.GID() != 100 {
+			t.Errorf("%s does not have uid 1000 and gid 100", fi.Name())
+		}
+	}
+}
+
+func TestParseDirectoryEntries(t *testing.T) {
+	// a descriptor whose CRC leaves out its padding, as some writers make it
+	unpadded := make([]byte, fileIdentifierDescriptorFixedSize+3)
+	unpadded[19] = 3
+	copy(unpadded[20:36], testLongAD(extentRecorded, testBlocksize, 5))
+	copy(unpadded[fileIdentifierDescriptorFixedSize:], "\x08ab")
+	testTag(unpadded, tagFileIdentifierDescriptor, 0, len(unpadded))
+	unpadded = append(unpadded, 0, 0, 0)
+	// the last one may not be padded at all
+	last := testFID([]byte("\x08bc"), 0, 6)[:fileIdentifierDescriptorFixedSize+3]
+	testTag(last, tagFileIdentifierDescriptor, 0, len(last))
+
+	entries, err := parseDirectoryEntries(bytes.Join([][]byte{testDirectory(1), unpadded, testFID([]byte("\x08b"), 0, 7), last}, nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, fmt.Sprintf("%s@%d", e.name, e.icb.block))
+	}
+	if strings.Join(names, ",") != "ab@5,b@7,bc@6" {
+		t.Errorf("entries %v instead of ab@5, b@7 and bc@6", names)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	fs, err := testUDF(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	for p, content := range testFiles {
+		t.Run(p, func(t *testing.T) {
+			f, err := fs.OpenFile(p, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unexpected error opening: %v", err)
+			}
+			b, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("content %q instead of %q", b, content)
+			}
+			// a read that spans extents, from the middle
+			if len(content) > 10 {
+				off := int64(len(content) / 3)
+				if _, err := f.Seek(off, io.SeekStart); err != nil {
+					t.Fatalf("unexpected error seeking: %v", err)
+				}
+				// filled, so that zeros have to be read
+				b := bytes.Repeat([]byte{0xff}, len(content)/2)
+				if _, err := io.ReadFull(f, b); err != nil {
+					t.Fatalf("unexpected error reading at %d: %v", off, err)
+				}
+				if !bytes.Equal(b, content[off:off+int64(len(b))]) {
+					t.Errorf("content at %d differs", off)
+				}
+			}
+			if _, err := f.Write([]byte("x")); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+				t.Errorf("error %v writing instead of %v", err, filesystem.ErrReadonlyFilesystem)
+			}
+			if err := f.Close(); err != nil {
+				t.Errorf("unexpected error closing: %v", err)
+			}
+			if _, err := f.Read(b); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("error %v reading closed file instead of %v", err, os.ErrClosed)
+			}
+		})
+	}
+	t.Run("errors", func(t *testing.T) {
+		if _, err := fs.OpenFile("/long.bin", os.O_RDWR); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("error %v opening for writing instead of %v", err, filesystem.ErrReadonlyFilesystem)
+		}
+		if _, err := fs.OpenFile("/dir", os.O_RDONLY); err == nil {
+			t.Errorf("no error opening directory")
+		}
+		if _, err := fs.OpenFile("/missing", os.O_RDONLY); err == nil {
+			t.Errorf("no error opening missing file")
+		}
+	})
+}
+
+func TestReadlink(t *testing.T) {
+	fs, err := testUDF(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if target, err := fs.Readlink("/link"); err != nil || target != "../dir/sub" {
+		t.Errorf("target %q and error %v instead of %q", target, err, "../dir/sub")
+	}
+	if _, err := fs.Readlink("/long.bin"); err == nil || !strings.Contains(err.Error(), "not a symbolic link") {
+		t.Errorf("error %v instead of one that the file is not a symbolic link", err)
+	}
+
+	tests := []struct {
+		name   string
+		b      []byte
+		target string
+		err    string
+	}{
+		{"absolute", []byte{pathComponentFileSet, 0, 0, 0, pathComponentName, 2, 0, 0, compressionID8, 'a', pathComponentCurrent, 0, 0, 0}, "/a/.", ""},
+		{"root after a name", []byte{pathComponentName, 2, 0, 0, compressionID8, 'a', pathComponentRoot, 0, 0, 0}, "/", ""},
+		{"16-bit name", append([]byte{pathComponentName, 5, 0, 0}, testCharacters("€€")...), "€€", ""},
+		{"short", []byte{pathComponentName, 0}, "", "shorter"},
+		{"long", []byte{pathComponentName, 9, 0, 0, compressionID8}, "", "longer"},
+		{"unknown type", []byte{7, 0, 0, 0}, "", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := parseSymlinkTarget(tt.b)
+			switch {
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v instead of one with %q", err, tt.err)
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case target != tt.target:
+				t.Errorf("target %q instead of %q", target, tt.target)
+			}
+		})
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	fs, err := testUDF(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	for name, err := range map[string]error{
+		"Mkdir":    fs.Mkdir("/new"),
+		"Mknod":    fs.Mknod("/new", 0, 0),
+		"Link":     fs.Link("/long.bin", "/new"),
+		"Symlink":  fs.Symlink("/long.bin", "/new"),
+		"Chmod":    fs.Chmod("/long.bin", 0o600),
+		"Chown":    fs.Chown("/long.bin", 0, 0),
+		"Chtimes":  fs.Chtimes("/long.bin", time.Time{}, time.Time{}),
+		"Rename":   fs.Rename("/long.bin", "/new"),
+		"Remove":   fs.Remove("/long.bin"),
+		"SetLabel": fs.SetLabel("new"),
+	} {
+		if !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s returned %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+}
+
+func TestUUID(t *testing.T) {
+	tests := []struct {
+		volumeSet string
+		uuid      string
+	}{
+		{"4E2D7F1C9A8B6E50rest", "4e2d7f1c9a8b6e50"},
+		{"4e2d7f1cLinux", "4e2d7f1c"},
+		{"Linux UDF", "4c696e7578205544"},
+		{"ab", "6162"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		fs := &FileSystem{volumeSet: tt.volumeSet}
+		if uuid := fs.UUID(); uuid != tt.uuid {
+			t.Errorf("volume set %q gave UUID %q instead of %q", tt.volumeSet, uuid, tt.uuid)
+		}
+	}
+}
+
+func TestReadAllocationExtentLoop(t *testing.T) {
+	fs, err := testUDF(t, func(b []byte) {
+		// make the allocation extent descriptor of /chained lead to itself
+		aed := b[(testPartitionStart+10)*testBlocksize:]
+		ad := testShortAD(extentNextAllocationDescriptors, testBlocksize, 10)
+		binary.LittleEndian.PutUint32(aed[20:24], uint32(len(ad)))
+		copy(aed[allocationExtentDescriptorFixedSize:], ad)
+		testTag(aed, tagAllocationExtentDescriptor, 10, allocationExtentDescriptorFixedSize+len(ad))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if _, err := fs.OpenFile("/chained", os.O_RDONLY); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("error %v instead of one about too many allocation extent descriptors", err)
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	fs := testhelper.ReadImage(t, imgFile, Read)
+	if label := fs.Label(); label != "diskfs" {
+		t.Errorf("label %q instead of %q", label, "diskfs")
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	for _, name := range []string{"shortfile.txt", "foo", "random.dat", "symlink.dat"} {
+		if !found[name] {
+			t.Errorf("root directory does not have %s", name)
+		}
+	}
+	entries, err = fs.ReadDir("/foo")
+	if err != nil {
+		t.Fatalf("error reading /foo: %v", err)
+	}
+	if len(entries) != 1001 {
+		t.Errorf("/foo has %d entries instead of 1001", len(entries))
+	}
+
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("error reading random data file %s: %v", randomDataFile, err)
+	}
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{"/shortfile.txt", []byte("This is a short file\n")},
+		{"/foo/subdirfile.txt", []byte("This is a subdir file\n")},
+		{"/random.dat", randomData},
+	} {
+		f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", tt.path, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", tt.path, err)
+		}
+		if !bytes.Equal(b, tt.content) {
+			t.Errorf("%s has %d bytes that do not match the %d expected", tt.path, len(b), len(tt.content))
+		}
+	}
+	target, err := fs.Readlink("/symlink.dat")
+	if err != nil {
+		t.Fatalf("error reading link: %v", err)
+	}
+	if target != "random.dat" {
+		t.Errorf("link target %q instead of %q", target, "random.dat")
+	}
+}
@@ -0,0 +1,336 @@
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend/mem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+const (
+	imgFile        = "testdata/dist/xfs.img"
+	randomDataFile = "testdata/dist/random.dat"
+)
+
+// TestMain sets up the test environment and runs the tests
+func TestMain(m *testing.M) {
+	// Check and generate the image made by mkfs.xfs if necessary
+	if err := testhelper.BuildImage(imgFile); err != nil {
+		println("error generating test artifacts for xfs", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// the geometry of the test image: 2 allocation groups of 64 blocks of 1024 bytes, with 2 inodes of 512 bytes in
+// each block
+const (
+	testBlockSize  = 1024
+	testSectorSize = 512
+	testInodeSize  = 512
+	testAGBlocks   = 64
+	testAGCount    = 2
+	testLabel      = "testxfs"
+	testUUID       = "5d4c3b2a-1f0e-4d9c-8b7a-695847362514"
+	// testFreeBlocks the free blocks that the AGFs record, in both allocation groups
+	testFreeBlocks = 24 + 50
+)
+
+// the inodes of the test image; inode numbers are the allocation group, the block in it, and the inode in the block
+const (
+	testRootInode     = 8  // / in short form
+	testExtentsInode  = 9  // /extents, with a hole and an unwritten extent
+	testBlockDirInode = 10 // /blockdir, in a single directory block
+	testLeafDirInode  = 11 // /leafdir, with 2 data blocks and a leaf
+	testLinkInode     = 12 // /link, a symlink with its target in its inode
+	testLongLinkInode = 13 // /longlink, a symlink with its target in 2 blocks
+	testBtreeInode    = 14 // /btree, a file with its extents in a B+tree
+	testDeviceInode   = 15 // /dev, a char device
+	testAG1Inode      = 1<<7 | 4<<1
+)
+
+var (
+	testExtentsSize = 5000
+	testBtreeSize   = 2 * testBlockSize
+	testAG1Content  = []byte("hello xfs\n")
+	testLongTarget  = bytes.Repeat([]byte("x/"), 500)
+)
+
+// testImage an XFS image under construction
+type testImage struct {
+	b []byte
+}
+
+// block a block of the image, by allocation group and block in it
+func (im *testImage) block(ag, n int) []byte {
+	off := (ag*testAGBlocks + n) * testBlockSize
+	return im.b[off : off+testBlockSize]
+}
+
+// testDaddr the disk address of a block, in 512-byte units, as metadata blocks record where they are
+func testDaddr(ag, n int) uint64 {
+	return uint64((ag*testAGBlocks + n) * testBlockSize / basicBlockSize)
+}
+
+// testFSB the filesystem block number of a block
+func testFSB(ag, n int) uint64 {
+	return uint64(ag)<<6 | uint64(n)
+}
+
+// testCRC set the checksum at offset in b
+func testCRC(b []byte, offset int) {
+	clear(b[offset : offset+4])
+	binary.LittleEndian.PutUint32(b[offset:], crc32.Checksum(b, crc32c))
+}
+
+func testExtent(offset, block, count uint64, unwritten bool) []byte {
+	l0 := offset<<9 | block>>43
+	if unwritten {
+		l0 |= 1 << 63
+	}
+	b := binary.BigEndian.AppendUint64(nil, l0)
+	return binary.BigEndian.AppendUint64(b, block<<21|count)
+}
+
+// testFileContent the contents of block n of a test file
+func testFileContent(n int) []byte {
+	return bytes.Repeat([]byte{byte('a' + n)}, testBlockSize)
+}
+
+// inode write an inode and its checksum, with the given data fork
+func (im *testImage) inode(ino uint64, mode uint16, format byte, size int, bigtime bool, fork []byte) []byte {
+	ag, agbno, index := int(ino>>7), int(ino>>1&0x3f), int(ino&1)
+	b := im.block(ag, agbno)[index*testInodeSize : (index+1)*testInodeSize]
+	binary.BigEndian.PutUint16(b[0:2], inodeMagic)
+	binary.BigEndian.PutUint16(b[2:4], mode)
+	b[4] = inodeVersion3
+	b[5] = format
+	binary.BigEndian.PutUint32(b[8:12], 1000)
+	binary.BigEndian.PutUint32(b[12:16], 100)
+	binary.BigEndian.PutUint32(b[16:20], 1)
+	for _, off := range []int{32, 40, 48, 144} {
+		if bigtime {
+			binary.BigEndian.PutUint64(b[off:], uint64(1700000000+bigtimeEpochOffset)*1e9+5)
+		} else {
+			binary.BigEndian.PutUint32(b[off:], 1600000000)
+			binary.BigEndian.PutUint32(b[off+4:], 7)
+		}
+	}
+	binary.BigEndian.PutUint64(b[56:64], uint64(size))
+	if bigtime {
+		binary.BigEndian.PutUint64(b[120:128], inodeFlag2Bigtime)
+	}
+	binary.BigEndian.PutUint64(b[152:160], ino)
+	if format == formatExtents {
+		binary.BigEndian.PutUint32(b[76:80], uint32(len(fork)/bmbtRecordSize))
+	}
+	copy(b[inodeCoreSize:], fork)
+	testCRC(b, inodeCRCOffset)
+	return b
+}
+
+// testDirEntry a directory entry at pos in a directory block
+func testDirEntry(pos int, ino uint64, name string, ftype byte) []byte {
+	length := (8 + 1 + len(name) + 1 + 2 + 7) / 8 * 8
+	b := make([]byte, length)
+	binary.BigEndian.PutUint64(b[0:8], ino)
+	b[8] = byte(len(name))
+	copy(b[9:], name)
+	b[9+len(name)] = ftype
+	binary.BigEndian.PutUint16(b[length-2:], uint16(pos))
+	return b
+}
+
+// testFreeEntry unused space of length bytes at pos in a directory block
+func testFreeEntry(pos, length int) []byte {
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b[0:2], dirFreeTag)
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	binary.BigEndian.PutUint16(b[length-2:], uint16(pos))
+	return b
+}
+
+// dirBlock write a directory block with the given entries, which are followed by unused space up to end
+func (im *testImage) dirBlock(ag, n int, magic uint32, owner uint64, end int, entries ...[]byte) []byte {
+	b := im.block(ag, n)
+	binary.BigEndian.PutUint32(b[0:4], magic)
+	binary.BigEndian.PutUint64(b[8:16], testDaddr(ag, n))
+	binary.BigEndian.PutUint64(b[40:48], owner)
+	pos := dirHeaderSize
+	for _, e := range entries {
+		pos += copy(b[pos:], e)
+	}
+	if pos < end {
+		copy(b[pos:], testFreeEntry(pos, end-pos))
+	}
+	return b
+}
+
+// testXFSImage create the test image
+func testXFSImage(t *testing.T) []byte {
+	t.Helper()
+	im := &testImage{b: make([]byte, testAGCount*testAGBlocks*testBlockSize)}
+
+	// the superblock, which is also at the start of the second allocation group, and the AG headers
+	for ag := 0; ag < testAGCount; ag++ {
+		sb := im.block(ag, 0)[:testSectorSize]
+		binary.BigEndian.PutUint32(sb[0:4], superblockMagic)
+		binary.BigEndian.PutUint32(sb[4:8], testBlockSize)
+		binary.BigEndian.PutUint64(sb[8:16], testAGCount*testAGBlocks)
+		copy(sb[32:48], []byte{0x5d, 0x4c, 0x3b, 0x2a, 0x1f, 0x0e, 0x4d, 0x9c, 0x8b, 0x7a, 0x69, 0x58, 0x47, 0x36, 0x25, 0x14})
+		binary.BigEndian.PutUint64(sb[56:64], testRootInode)
+		binary.BigEndian.PutUint32(sb[84:88], testAGBlocks)
+		binary.BigEndian.PutUint32(sb[88:92], testAGCount)
+		binary.BigEndian.PutUint16(sb[100:102], 0xb4a5)
+		binary.BigEndian.PutUint16(sb[102:104], testSectorSize)
+		binary.BigEndian.PutUint16(sb[104:106], testInodeSize)
+		binary.BigEndian.PutUint16(sb[106:108], testBlockSize/testInodeSize)
+		copy(sb[108:120], testLabel)
+		sb[120], sb[121], sb[122], sb[123], sb[124] = 10, 9, 9, 1, 6
+		binary.BigEndian.PutUint32(sb[216:220], incompatFtype|incompatBigtime)
+		testCRC(sb, superblockCRCOffset)
+
+		agf := im.block(ag, 0)[testSectorSize : testSectorSize+agfSize]
+		binary.BigEndian.PutUint32(agf[0:4], agfMagic)
+		binary.BigEndian.PutUint32(agf[4:8], 1)
+		binary.BigEndian.PutUint32(agf[8:12], uint32(ag))
+		binary.BigEndian.PutUint32(agf[12:16], testAGBlocks)
+		if ag == 0 {
+			binary.BigEndian.PutUint32(agf[48:52], 4)
+			binary.BigEndian.PutUint32(agf[52:56], 20)
+		} else {
+			binary.BigEndian.PutUint32(agf[52:56], 50)
+		}
+		testCRC(agf, agfCRCOffset)
+
+		agi := im.block(ag, 1)[:agiSize]
+		binary.BigEndian.PutUint32(agi[0:4], agiMagic)
+		binary.BigEndian.PutUint32(agi[4:8], 1)
+		binary.BigEndian.PutUint32(agi[8:12], uint32(ag))
+		testCRC(agi, agiCRCOffset)
+	}
+
+	// the root directory, in short form, with ftype in each entry
+	root := []byte{7, 0, 0, 0, 0, testRootInode}
+	for _, e := range []struct {
+		name  string
+		ino   uint32
+		ftype byte
+	}{
+		{"extents", testExtentsInode, 1},
+		{"blockdir", testBlockDirInode, 2},
+		{"leafdir", testLeafDirInode, 2},
+		{"link", testLinkInode, 7},
+		{"longlink", testLongLinkInode, 7},
+		{"btree", testBtreeInode, 1},
+		{"dev", testDeviceInode, 3},
+	} {
+		root = append(root, byte(len(e.name)), 0, 0)
+		root = append(root, e.name...)
+		root = append(root, e.ftype)
+		root = binary.BigEndian.AppendUint32(root, e.ino)
+	}
+	im.inode(testRootInode, modeDirectory|0o755, formatLocal, len(root), false, root)
+
+	// a file of 5 blocks: 2 written, a hole, 1 unwritten and 1 written
+	var fork []byte
+	fork = append(fork, testExtent(0, testFSB(0, 10), 2, false)...)
+	fork = append(fork, testExtent(3, testFSB(0, 12), 1, true)...)
+	fork = append(fork, testExtent(4, testFSB(0, 13), 1, false)...)
+	im.inode(testExtentsInode, modeRegular|0o644, formatExtents, testExtentsSize, true, fork)
+	for n, block := range map[int]int{0: 10, 1: 11, 4: 13} {
+		copy(im.block(0, block), testFileContent(n))
+	}
+	// the unwritten extent has whatever was there before
+	copy(im.block(0, 12), testFileContent(9))
+
+	// a directory in a single block, with its leaf of 3 entries at the end
+	im.inode(testBlockDirInode, modeDirectory|0o755, formatExtents, testBlockSize, false, testExtent(0, testFSB(0, 16), 1, false))
+	leafStart := testBlockSize - dirBlockTailSize - 3*dirLeafEntrySize
+	b := im.dirBlock(0, 16, dirBlockMagic, testBlockDirInode, leafStart,
+		testDirEntry(64, testBlockDirInode, ".", 2),
+		testDirEntry(80, testRootInode, "..", 2),
+		testFreeEntry(96, 16),
+		testDirEntry(112, testAG1Inode, "inag1", 1),
+	)
+	binary.BigEndian.PutUint32(b[testBlockSize-dirBlockTailSize:], 3)
+	testCRC(b, dirCRCOffset)
+	b = im.block(1, 10)
+	copy(b, testAG1Content)
+	im.inode(testAG1Inode, modeRegular|0o600, formatExtents, len(testAG1Content), false, testExtent(0, testFSB(1, 10), 1, false))
+
+	// a directory with 2 data blocks, and a leaf block after them that is not read
+	fork = testExtent(0, testFSB(0, 17), 2, false)
+	fork = append(fork, testExtent(dirLeafOffset/testBlockSize, testFSB(0, 19), 1, false)...)
+	im.inode(testLeafDirInode, modeDirectory|0o700, formatExtents, 2*testBlockSize, false, fork)
+	b = im.dirBlock(0, 17, dirDataMagic, testLeafDirInode, testBlockSize,
+		testDirEntry(64, testLeafDirInode, ".", 2),
+		testDirEntry(80, testRootInode, "..", 2),
+		testDirEntry(96, testExtentsInode, "a", 1),
+	)
+	testCRC(b, dirCRCOffset)
+	b = im.dirBlock(0, 18, dirDataMagic, testLeafDirInode, testBlockSize,
+		testDirEntry(64, testBtreeInode, "b", 1),
+	)
+	testCRC(b, dirCRCOffset)
+	copy(im.block(0, 19), "not a data block")
+
+	// symlinks, with the target in the inode, and in 2 blocks of their own
+	im.inode(testLinkInode, modeSymlink|0o777, formatLocal, len("extents"), false, []byte("extents"))
+	im.inode(testLongLinkInode, modeSymlink|0o777, formatExtents, len(testLongTarget), false, testExtent(0, testFSB(0, 20), 2, false))
+	for i, part := range [][]byte{testLongTarget[:testBlockSize-symlinkHeaderSize], testLongTarget[testBlockSize-symlinkHeaderSize:]} {
+		b = im.block(0, 20+i)
+		binary.BigEndian.PutUint32(b[0:4], symlinkMagic)
+		binary.BigEndian.PutUint32(b[4:8], uint32(i*(testBlockSize-symlinkHeaderSize)))
+		binary.BigEndian.PutUint32(b[8:12], uint32(len(part)))
+		binary.BigEndian.PutUint64(b[32:40], testLongLinkInode)
+		binary.BigEndian.PutUint64(b[40:48], testDaddr(0, 20+i))
+		copy(b[symlinkHeaderSize:], part)
+		testCRC(b, symlinkCRCOffset)
+	}
+
+	// a file whose extents are in a leaf block of a B+tree, whose root is in the inode
+	maxrecs := (testInodeSize - inodeCoreSize - bmbtRootHeaderSize) / (bmbtKeySize + bmbtPointerSize)
+	fork = make([]byte, testInodeSize-inodeCoreSize)
+	binary.BigEndian.PutUint16(fork[0:2], 1)
+	binary.BigEndian.PutUint16(fork[2:4], 1)
+	binary.BigEndian.PutUint64(fork[bmbtRootHeaderSize+maxrecs*bmbtKeySize:], testFSB(0, 22))
+	im.inode(testBtreeInode, modeRegular|0o644, formatBtree, testBtreeSize, false, fork)
+	b = im.block(0, 22)
+	binary.BigEndian.PutUint32(b[0:4], bmbtMagic)
+	binary.BigEndian.PutUint16(b[6:8], 2)
+	binary.BigEndian.PutUint64(b[24:32], testDaddr(0, 22))
+	binary.BigEndian.PutUint64(b[56:64], testBtreeInode)
+	copy(b[bmbtBlockHeader:], testExtent(0, testFSB(0, 24), 1, false))
+	copy(b[bmbtBlockHeader+bmbtRecordSize:], testExtent(1, testFSB(0, 30), 1, false))
+	testCRC(b, bmbtCRCOffset)
+	copy(im.block(0, 24), testFileContent(0))
+	copy(im.block(0, 30), testFileContent(1))
+
+	// a char device, 5:1
+	im.inode(testDeviceInode, modeCharDevice|0o600, formatDevice, 0, false, binary.BigEndian.AppendUint32(nil, 5<<18|1))
+	return im.b
+}
+
+// testXFS read the test image, as it is or after modify changes it
+func testXFS(t *testing.T, modify func([]byte)) (*FileSystem, error) {
+	t.Helper()
+	b := testXFSImage(t)
+	if modify != nil {
+		modify(b)
+	}
+	return Read(testStorage(t, b), int64(len(b)), 0, 512)
+}
+
+func testStorage(t *testing.T, b []byte) *mem.Buffer {
+	t.Helper()
+	storage, err := mem.NewFromBytes(b, true)
+	if err != nil {
+		t.Fatalf("unable to create storage: %v", err)
+	}
+	return storage
+}
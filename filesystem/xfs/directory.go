@@ -0,0 +1,186 @@
+package xfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	dirBlockMagic      = 0x58444233 // XDB3, a directory whose entries and leaf are in a single block
+	dirDataMagic       = 0x58444433 // XDD3, a block of entries of a directory with a leaf of its own
+	dirHeaderSize      = 64
+	dirCRCOffset       = 4
+	dirBlockTailSize   = 8
+	dirLeafEntrySize   = 8
+	dirFreeTag         = 0xffff
+	dirEntryAlign      = 8
+	symlinkMagic       = 0x58534c4d // XSLM
+	symlinkHeaderSize  = 56
+	symlinkCRCOffset   = 12
+	symlinkMaxLength   = 1024
+	shortformEntryBase = 3
+	// dirLeafOffset the offset in a directory after which are its leaf and free space blocks, rather than entries
+	dirLeafOffset = 1 << 35
+)
+
+// directoryEntry an entry in a directory
+type directoryEntry struct {
+	name  string
+	inode uint64
+}
+
+// readDirectory read the entries of a directory, without . and ..
+func (fs *FileSystem) readDirectory(dir *inode) ([]*directoryEntry, error) {
+	if dir.format == formatLocal {
+		return fs.parseShortform(dir.local)
+	}
+	blockSize := uint64(fs.sb.blockSize)
+	dirBlockSize := fs.sb.dirBlockSize()
+	// the directory blocks with entries in them, which are whole directory blocks of one or more filesystem blocks
+	var (
+		entries []*directoryEntry
+		seen    = map[uint64]bool{}
+		b       = make([]byte, dirBlockSize)
+	)
+	for _, x := range dir.extents {
+		for blk := x.offset; blk < x.offset+x.count && blk*blockSize < dirLeafOffset; blk++ {
+			off := blk * blockSize / uint64(dirBlockSize) * uint64(dirBlockSize)
+			if seen[off] {
+				continue
+			}
+			seen[off] = true
+			if err := fs.readRange(dir, b, int64(off)); err != nil {
+				return nil, err
+			}
+			blockEntries, err := fs.parseDirectoryBlock(dir, b)
+			if err != nil {
+				return nil, fmt.Errorf("invalid directory block at offset %d: %w", off, err)
+			}
+			entries = append(entries, blockEntries...)
+		}
+	}
+	return entries, nil
+}
+
+// parseShortform parse a directory whose entries are in its inode, struct xfs_dir2_sf_hdr
+func (fs *FileSystem) parseShortform(b []byte) ([]*directoryEntry, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("short form directory of %d bytes is too short", len(b))
+	}
+	// all inode numbers are 8 bytes if any of them needs to be
+	count, inodeSize := int(b[0]), 4
+	if b[1] > 0 {
+		inodeSize = 8
+	}
+	// the header has the parent directory, which is .., and the entries do not have . either
+	pos := 2 + inodeSize
+	entries := make([]*directoryEntry, 0, count)
+	for i := 0; i < count; i++ {
+		if pos >= len(b) {
+			return nil, fmt.Errorf("short form directory entry %d is beyond its end", i)
+		}
+		nameLen := int(b[pos])
+		end := pos + shortformEntryBase + nameLen + inodeSize
+		if fs.sb.ftype() {
+			end++
+		}
+		if nameLen == 0 || end > len(b) {
+			return nil, fmt.Errorf("short form directory entry %d is invalid", i)
+		}
+		e := &directoryEntry{name: string(b[pos+shortformEntryBase : pos+shortformEntryBase+nameLen])}
+		if inodeSize == 8 {
+			e.inode = binary.BigEndian.Uint64(b[end-8 : end])
+		} else {
+			e.inode = uint64(binary.BigEndian.Uint32(b[end-4 : end]))
+		}
+		entries = append(entries, e)
+		pos = end
+	}
+	return entries, nil
+}
+
+// parseDirectoryBlock parse a directory block with entries in it, which is either the only block of the directory,
+// with its leaf at the end, or one of its data blocks
+func (fs *FileSystem) parseDirectoryBlock(dir *inode, b []byte) ([]*directoryEntry, error) {
+	end := len(b)
+	switch binary.BigEndian.Uint32(b[0:4]) {
+	case dirBlockMagic:
+		// the tail at the end has the count of leaf entries that are before it
+		leafCount := int(binary.BigEndian.Uint32(b[len(b)-dirBlockTailSize:]))
+		end = len(b) - dirBlockTailSize - leafCount*dirLeafEntrySize
+		if end < dirHeaderSize {
+			return nil, fmt.Errorf("directory block has %d leaf entries, more than fit in it", leafCount)
+		}
+	case dirDataMagic:
+	default:
+		return nil, fmt.Errorf("invalid magic")
+	}
+	if !checksum(b, dirCRCOffset) {
+		return nil, fmt.Errorf("checksum does not match")
+	}
+	if owner := binary.BigEndian.Uint64(b[40:48]); owner != dir.number {
+		return nil, fmt.Errorf("block belongs to inode %d", owner)
+	}
+	var entries []*directoryEntry
+	for pos := dirHeaderSize; pos < end; {
+		if binary.BigEndian.Uint16(b[pos:pos+2]) == dirFreeTag {
+			length := int(binary.BigEndian.Uint16(b[pos+2 : pos+4]))
+			if length == 0 || length%dirEntryAlign != 0 || pos+length > end {
+				return nil, fmt.Errorf("unused space at %d has invalid length %d", pos, length)
+			}
+			pos += length
+			continue
+		}
+		if pos+9 > end {
+			return nil, fmt.Errorf("entry at %d is beyond the end of the entries", pos)
+		}
+		nameLen := int(b[pos+8])
+		length := 8 + 1 + nameLen + 2
+		if fs.sb.ftype() {
+			length++
+		}
+		length = (length + dirEntryAlign - 1) / dirEntryAlign * dirEntryAlign
+		if nameLen == 0 || pos+length > end {
+			return nil, fmt.Errorf("entry at %d is invalid", pos)
+		}
+		name := string(b[pos+9 : pos+9+nameLen])
+		if name != "." && name != ".." {
+			entries = append(entries, &directoryEntry{name: name, inode: binary.BigEndian.Uint64(b[pos : pos+8])})
+		}
+		pos += length
+	}
+	return entries, nil
+}
+
+// readlink read the target of a symlink, which is either in its inode, or in blocks of its own
+func (fs *FileSystem) readlink(in *inode) (string, error) {
+	if in.size > symlinkMaxLength {
+		return "", fmt.Errorf("symlink target of %d bytes is longer than %d", in.size, symlinkMaxLength)
+	}
+	if in.format == formatLocal {
+		return string(in.local), nil
+	}
+	var (
+		target    []byte
+		blockSize = int(fs.sb.blockSize)
+		b         = make([]byte, blockSize)
+	)
+	for blk := 0; int64(len(target)) < in.size; blk++ {
+		if err := fs.readRange(in, b, int64(blk*blockSize)); err != nil {
+			return "", err
+		}
+		count := int(binary.BigEndian.Uint32(b[8:12]))
+		switch {
+		case binary.BigEndian.Uint32(b[0:4]) != symlinkMagic:
+			return "", fmt.Errorf("symlink block %d has invalid magic", blk)
+		case !checksum(b, symlinkCRCOffset):
+			return "", fmt.Errorf("symlink block %d has a checksum that does not match", blk)
+		case binary.BigEndian.Uint64(b[32:40]) != in.number:
+			return "", fmt.Errorf("symlink block %d belongs to inode %d", blk, binary.BigEndian.Uint64(b[32:40]))
+		case int(binary.BigEndian.Uint32(b[4:8])) != len(target) || count > blockSize-symlinkHeaderSize || count == 0:
+			return "", fmt.Errorf("symlink block %d has an invalid part of the target", blk)
+		}
+		target = append(target, b[symlinkHeaderSize:symlinkHeaderSize+count]...)
+	}
+	return string(target[:in.size]), nil
+}
@@ -0,0 +1,12 @@
+// Package xfs provides support for reading XFS filesystems, the default filesystem of RHEL and its derivatives.
+// references:
+//
+//	https://www.kernel.org/doc/html/latest/filesystems/xfs/xfs-online-fsck-design.html
+//	https://git.kernel.org/pub/scm/fs/xfs/xfs-documentation.git/tree/design/XFS_Filesystem_Structure
+//	https://git.kernel.org/pub/scm/linux/kernel/git/torvalds/linux.git/tree/fs/xfs/libxfs/xfs_format.h
+//
+// It reads version 5 filesystems, which mkfs.xfs has made by default since xfsprogs 3.2.3, with metadata checksums,
+// which are verified as each piece of metadata is read. Files and directories in any of the formats of the data fork
+// of an inode can be read: local, extents and B+tree. Realtime files and version 4 filesystems cannot be read. It
+// cannot write XFS; to make an image that has to be XFS, build it elsewhere.
+package xfs
@@ -0,0 +1,132 @@
+package xfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// FileInfo represents the information for an individual file
+// it fulfills os.FileInfo interface
+type FileInfo struct {
+	modTime    time.Time
+	mode       os.FileMode
+	name       string
+	size       int64
+	uid        uint32
+	gid        uint32
+	linkTarget string
+	inode      uint64
+	hardLinks  uint32
+	accessTime time.Time
+	changeTime time.Time
+	createTime time.Time
+	blocks     uint64
+}
+
+// newFileInfo create the FileInfo for a file with the given name, from its inode
+func (fs *FileSystem) newFileInfo(in *inode, name string) (*FileInfo, error) {
+	fi := &FileInfo{
+		modTime:    in.modifyTime,
+		mode:       in.fileMode(),
+		name:       name,
+		size:       in.size,
+		uid:        in.uid,
+		gid:        in.gid,
+		inode:      in.number,
+		hardLinks:  in.nlink,
+		accessTime: in.accessTime,
+		changeTime: in.changeTime,
+		createTime: in.createTime,
+		blocks:     in.blocks * uint64(fs.sb.blockSize/basicBlockSize),
+	}
+	if in.isSymlink() {
+		target, err := fs.readlink(in)
+		if err != nil {
+			return nil, err
+		}
+		fi.linkTarget = target
+	}
+	return fi, nil
+}
+
+// IsDir abbreviation for Mode().IsDir()
+func (fi *FileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+// ModTime modification time
+func (fi *FileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+// Mode returns file mode
+func (fi *FileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+// Name base name of the file
+func (fi *FileInfo) Name() string {
+	return fi.name
+}
+
+// Size length in bytes for regular files
+func (fi *FileInfo) Size() int64 {
+	return fi.size
+}
+
+// Sys underlying data source, which is the *FileInfo itself, for its owner, symlink target
+// and the rest of the metadata in its inode
+func (fi *FileInfo) Sys() interface{} {
+	return fi
+}
+
+// UID get uid of file
+func (fi *FileInfo) UID() uint32 {
+	return fi.uid
+}
+
+// GID get gid of file
+func (fi *FileInfo) GID() uint32 {
+	return fi.gid
+}
+
+// Readlink returns the destination of the symbolic link if this entry is a symbolic link.
+//
+// If this entry is not a symbolic link then it will return fs.ErrNotExist
+func (fi *FileInfo) Readlink() (string, error) {
+	if fi.mode&os.ModeSymlink == 0 {
+		return "", fs.ErrNotExist
+	}
+	return fi.linkTarget, nil
+}
+
+// Inode get the number of the inode of the file
+func (fi *FileInfo) Inode() uint64 {
+	return fi.inode
+}
+
+// Nlink get the number of hard links to the file
+func (fi *FileInfo) Nlink() uint64 {
+	return uint64(fi.hardLinks)
+}
+
+// AccessTime get the time the file was last accessed, to the nanosecond
+func (fi *FileInfo) AccessTime() time.Time {
+	return fi.accessTime
+}
+
+// ChangeTime get the time the inode of the file was last changed, to the nanosecond
+func (fi *FileInfo) ChangeTime() time.Time {
+	return fi.changeTime
+}
+
+// CreateTime get the time the file was created, to the nanosecond
+func (fi *FileInfo) CreateTime() time.Time {
+	return fi.createTime
+}
+
+// Blocks get the number of 512-byte blocks the file uses, including its B+tree, as in stat
+func (fi *FileInfo) Blocks() uint64 {
+	return fi.blocks
+}
@@ -0,0 +1,357 @@
+package xfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	inodeMagic = 0x494e // IN
+	// inodeCoreSize the size of the core of a version 3 inode, struct xfs_dinode, after which its data fork starts
+	inodeCoreSize      = 176
+	inodeCRCOffset     = 100
+	inodeVersion3      = 3
+	bmbtMagic          = 0x424d4133 // BMA3
+	bmbtBlockHeader    = 72
+	bmbtCRCOffset      = 64
+	bmbtRecordSize     = 16
+	bmbtKeySize        = 8
+	bmbtPointerSize    = 8
+	bmbtRootHeaderSize = 4
+	// bmbtMaxLevels more levels than a B+tree of extents can have, to stop at one that is corrupt
+	bmbtMaxLevels = 9
+	// basicBlockSize the unit of the disk addresses in metadata blocks, which say where they are
+	basicBlockSize = 512
+)
+
+// formats of the data fork of an inode
+const (
+	formatDevice  = 0
+	formatLocal   = 1
+	formatExtents = 2
+	formatBtree   = 3
+)
+
+const (
+	inodeFlagRealtime  = 1 << 0
+	inodeFlag2Bigtime  = 1 << 3
+	inodeFlag2Nrext64  = 1 << 4
+	bigtimeEpochOffset = 1 << 31
+)
+
+// types of file in the mode of an inode, as in stat(2)
+const (
+	modeTypeMask   = 0o170000
+	modeFifo       = 0o010000
+	modeCharDevice = 0o020000
+	modeDirectory  = 0o040000
+	modeBlockDev   = 0o060000
+	modeRegular    = 0o100000
+	modeSymlink    = 0o120000
+	modeSocket     = 0o140000
+)
+
+// extent a run of contiguous blocks of a file, struct xfs_bmbt_irec
+type extent struct {
+	// offset the block of the file where the extent starts
+	offset uint64
+	// block the filesystem block where the extent starts
+	block uint64
+	count uint64
+	// unwritten whether the blocks are allocated but not written, and so read as zeros
+	unwritten bool
+}
+
+// inode the parts of an inode needed to read its file
+type inode struct {
+	number     uint64
+	mode       uint16
+	format     uint8
+	uid        uint32
+	gid        uint32
+	nlink      uint32
+	size       int64
+	blocks     uint64
+	accessTime time.Time
+	modifyTime time.Time
+	changeTime time.Time
+	createTime time.Time
+	flags      uint16
+	// local the data fork of an inode in local format, which has the data itself
+	local []byte
+	// extents of an inode in extents or B+tree format, sorted by offset
+	extents []extent
+}
+
+func (in *inode) isDir() bool {
+	return in.mode&modeTypeMask == modeDirectory
+}
+
+func (in *inode) isSymlink() bool {
+	return in.mode&modeTypeMask == modeSymlink
+}
+
+// fileMode the type and permissions of the file as an os.FileMode
+func (in *inode) fileMode() os.FileMode {
+	mode := os.FileMode(in.mode & 0o777)
+	if in.mode&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if in.mode&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if in.mode&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	switch in.mode & modeTypeMask {
+	case modeDirectory:
+		mode |= os.ModeDir
+	case modeSymlink:
+		mode |= os.ModeSymlink
+	case modeBlockDev:
+		mode |= os.ModeDevice
+	case modeCharDevice:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case modeFifo:
+		mode |= os.ModeNamedPipe
+	case modeSocket:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+// parseTimestamp parse a timestamp of an inode, which is either seconds and nanoseconds since the unix epoch, or,
+// with big timestamps, nanoseconds since the earliest time that the former can have
+func parseTimestamp(b []byte, bigtime bool) time.Time {
+	if bigtime {
+		ns := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(ns/1e9)-bigtimeEpochOffset, int64(ns%1e9))
+	}
+	return time.Unix(int64(int32(binary.BigEndian.Uint32(b[0:4]))), int64(binary.BigEndian.Uint32(b[4:8])))
+}
+
+// parseExtent parse a packed extent record, struct xfs_bmbt_rec
+func parseExtent(b []byte) extent {
+	l0, l1 := binary.BigEndian.Uint64(b[0:8]), binary.BigEndian.Uint64(b[8:16])
+	return extent{
+		unwritten: l0>>63 != 0,
+		offset:    (l0 & (1<<63 - 1)) >> 9,
+		block:     (l0&0x1ff)<<43 | l1>>21,
+		count:     l1 & (1<<21 - 1),
+	}
+}
+
+// inodeOffset where an inode is, in bytes from the start of the filesystem
+func (fs *FileSystem) inodeOffset(ino uint64) (int64, error) {
+	sb := fs.sb
+	agno := ino >> (sb.agBlockLog + sb.inodesPerLog)
+	agbno := ino >> sb.inodesPerLog & (1<<sb.agBlockLog - 1)
+	if agno >= uint64(sb.agCount) || agbno >= uint64(sb.agBlocks) {
+		return 0, fmt.Errorf("inode %d is beyond the end of the filesystem", ino)
+	}
+	index := ino & (1<<sb.inodesPerLog - 1)
+	return (int64(agno)*int64(sb.agBlocks)+int64(agbno))*int64(sb.blockSize) + int64(index)*int64(sb.inodeSize), nil
+}
+
+// blockOffset where a filesystem block is, in bytes from the start of the filesystem. The number of a filesystem
+// block has the allocation group in its high bits, and the block in the group in the low agBlockLog bits.
+func (fs *FileSystem) blockOffset(fsb uint64) (int64, error) {
+	sb := fs.sb
+	agno, agbno := fsb>>sb.agBlockLog, fsb&(1<<sb.agBlockLog-1)
+	if agno >= uint64(sb.agCount) || agbno >= uint64(sb.agBlocks) {
+		return 0, fmt.Errorf("block %d is beyond the end of the filesystem", fsb)
+	}
+	return (int64(agno)*int64(sb.agBlocks) + int64(agbno)) * int64(sb.blockSize), nil
+}
+
+// readInode read the inode with the given number, checking its checksum
+func (fs *FileSystem) readInode(ino uint64) (*inode, error) {
+	off, err := fs.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.readBytes(off, int(fs.sb.inodeSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d: %w", ino, err)
+	}
+	switch {
+	case binary.BigEndian.Uint16(b[0:2]) != inodeMagic:
+		return nil, fmt.Errorf("inode %d has invalid magic", ino)
+	case b[4] != inodeVersion3:
+		return nil, fmt.Errorf("inode %d has version %d instead of %d", ino, b[4], inodeVersion3)
+	case !checksum(b, inodeCRCOffset):
+		return nil, fmt.Errorf("inode %d has a checksum that does not match", ino)
+	case binary.BigEndian.Uint64(b[152:160]) != ino:
+		return nil, fmt.Errorf("inode %d says it is inode %d", ino, binary.BigEndian.Uint64(b[152:160]))
+	}
+	flags2 := binary.BigEndian.Uint64(b[120:128])
+	bigtime := flags2&inodeFlag2Bigtime != 0
+	in := &inode{
+		number:     ino,
+		mode:       binary.BigEndian.Uint16(b[2:4]),
+		format:     b[5],
+		uid:        binary.BigEndian.Uint32(b[8:12]),
+		gid:        binary.BigEndian.Uint32(b[12:16]),
+		nlink:      binary.BigEndian.Uint32(b[16:20]),
+		accessTime: parseTimestamp(b[32:40], bigtime),
+		modifyTime: parseTimestamp(b[40:48], bigtime),
+		changeTime: parseTimestamp(b[48:56], bigtime),
+		size:       int64(binary.BigEndian.Uint64(b[56:64])),
+		blocks:     binary.BigEndian.Uint64(b[64:72]),
+		flags:      binary.BigEndian.Uint16(b[90:92]),
+		createTime: parseTimestamp(b[144:152], bigtime),
+	}
+	if in.size < 0 {
+		return nil, fmt.Errorf("inode %d has invalid size", ino)
+	}
+	// the data fork is followed by the attribute fork, if the inode has one
+	fork := b[inodeCoreSize:]
+	if forkOffset := int(b[82]) * 8; forkOffset > 0 {
+		if forkOffset > len(fork) {
+			return nil, fmt.Errorf("inode %d has attribute fork beyond its end", ino)
+		}
+		fork = fork[:forkOffset]
+	}
+	switch in.format {
+	case formatDevice:
+	case formatLocal:
+		if in.size > int64(len(fork)) {
+			return nil, fmt.Errorf("inode %d has %d bytes of local data, more than fit in it", ino, in.size)
+		}
+		in.local = fork[:in.size]
+	case formatExtents:
+		count := uint64(binary.BigEndian.Uint32(b[76:80]))
+		if flags2&inodeFlag2Nrext64 != 0 {
+			count = binary.BigEndian.Uint64(b[24:32])
+		}
+		if count > uint64(len(fork)/bmbtRecordSize) {
+			return nil, fmt.Errorf("inode %d has %d extents, more than fit in it", ino, count)
+		}
+		for i := 0; i < int(count); i++ {
+			in.extents = append(in.extents, parseExtent(fork[i*bmbtRecordSize:]))
+		}
+	case formatBtree:
+		if err := fs.readBmbtRoot(in, fork); err != nil {
+			return nil, fmt.Errorf("could not read extents of inode %d: %w", ino, err)
+		}
+	default:
+		return nil, fmt.Errorf("inode %d has unknown format %d", ino, in.format)
+	}
+	return in, nil
+}
+
+// readBmbtRoot read the extents of an inode in B+tree format, whose root is in its data fork
+func (fs *FileSystem) readBmbtRoot(in *inode, fork []byte) error {
+	level := binary.BigEndian.Uint16(fork[0:2])
+	numrecs := int(binary.BigEndian.Uint16(fork[2:4]))
+	maxrecs := (len(fork) - bmbtRootHeaderSize) / (bmbtKeySize + bmbtPointerSize)
+	if level == 0 || level > bmbtMaxLevels || numrecs > maxrecs {
+		return fmt.Errorf("invalid B+tree root with level %d and %d records", level, numrecs)
+	}
+	pointers := fork[bmbtRootHeaderSize+maxrecs*bmbtKeySize:]
+	for i := 0; i < numrecs; i++ {
+		if err := fs.readBmbtBlock(in, binary.BigEndian.Uint64(pointers[i*bmbtPointerSize:]), level-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBmbtBlock read the extents in a block of the B+tree of an inode, and those in the blocks under it
+func (fs *FileSystem) readBmbtBlock(in *inode, fsb uint64, level uint16) error {
+	off, err := fs.blockOffset(fsb)
+	if err != nil {
+		return err
+	}
+	b, err := fs.readBytes(off, int(fs.sb.blockSize))
+	if err != nil {
+		return fmt.Errorf("could not read B+tree block %d: %w", fsb, err)
+	}
+	switch {
+	case binary.BigEndian.Uint32(b[0:4]) != bmbtMagic:
+		return fmt.Errorf("B+tree block %d has invalid magic", fsb)
+	case !checksum(b, bmbtCRCOffset):
+		return fmt.Errorf("B+tree block %d has a checksum that does not match", fsb)
+	case binary.BigEndian.Uint64(b[24:32]) != uint64(off/basicBlockSize):
+		return fmt.Errorf("B+tree block %d says it is elsewhere", fsb)
+	case binary.BigEndian.Uint64(b[56:64]) != in.number:
+		return fmt.Errorf("B+tree block %d belongs to inode %d", fsb, binary.BigEndian.Uint64(b[56:64]))
+	case binary.BigEndian.Uint16(b[4:6]) != level:
+		return fmt.Errorf("B+tree block %d has level %d instead of %d", fsb, binary.BigEndian.Uint16(b[4:6]), level)
+	}
+	numrecs := int(binary.BigEndian.Uint16(b[6:8]))
+	if level == 0 {
+		if numrecs > (len(b)-bmbtBlockHeader)/bmbtRecordSize {
+			return fmt.Errorf("B+tree block %d has %d records, more than fit in it", fsb, numrecs)
+		}
+		for i := 0; i < numrecs; i++ {
+			in.extents = append(in.extents, parseExtent(b[bmbtBlockHeader+i*bmbtRecordSize:]))
+		}
+		return nil
+	}
+	maxrecs := (len(b) - bmbtBlockHeader) / (bmbtKeySize + bmbtPointerSize)
+	if numrecs > maxrecs {
+		return fmt.Errorf("B+tree block %d has %d records, more than fit in it", fsb, numrecs)
+	}
+	pointers := b[bmbtBlockHeader+maxrecs*bmbtKeySize:]
+	for i := 0; i < numrecs; i++ {
+		if err := fs.readBmbtBlock(in, binary.BigEndian.Uint64(pointers[i*bmbtPointerSize:]), level-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRange read the data of an inode at the given offset, whether or not it is before the end of the file;
+// whatever is in no extent, or in one that is unwritten, reads as zeros
+func (fs *FileSystem) readRange(in *inode, b []byte, off int64) error {
+	if in.format == formatLocal {
+		clear(b)
+		if off < int64(len(in.local)) {
+			copy(b, in.local[off:])
+		}
+		return nil
+	}
+	if in.flags&inodeFlagRealtime != 0 {
+		return errors.New("files on the realtime device are not supported")
+	}
+	clear(b)
+	blockSize := int64(fs.sb.blockSize)
+	end := off + int64(len(b))
+	for _, x := range in.extents {
+		xStart, xEnd := int64(x.offset)*blockSize, int64(x.offset+x.count)*blockSize
+		if x.unwritten || xEnd <= off || xStart >= end {
+			continue
+		}
+		from, to := max(off, xStart), min(end, xEnd)
+		diskOff, err := fs.blockOffset(x.block)
+		if err != nil {
+			return err
+		}
+		// the blocks of an extent are contiguous within its allocation group
+		diskOff += from - xStart
+		if _, err := fs.backend.ReadAt(b[from-off:to-off], fs.start+diskOff); err != nil {
+			return fmt.Errorf("could not read block %d: %w", x.block, err)
+		}
+	}
+	return nil
+}
+
+// readAt read the data of a file at the given offset, as io.ReaderAt does
+func (fs *FileSystem) readAt(in *inode, b []byte, off int64) (int, error) {
+	if off >= in.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(b)), in.size-off)
+	if err := fs.readRange(in, b[:want], off); err != nil {
+		return 0, err
+	}
+	if int(want) < len(b) {
+		return int(want), io.EOF
+	}
+	return int(want), nil
+}
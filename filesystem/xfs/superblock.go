@@ -0,0 +1,162 @@
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+)
+
+const (
+	superblockMagic = 0x58465342 // XFSB
+	agfMagic        = 0x58414746 // XAGF
+	agiMagic        = 0x58414749 // XAGI
+	// superblockSize the bytes of the superblock that are read, which are followed by zeroes to the end of the sector
+	superblockSize = 264
+	// superblockCRCOffset where the checksum of the superblock is in it
+	superblockCRCOffset = 224
+	agfCRCOffset        = 216
+	agiCRCOffset        = 312
+	agfSize             = 224
+	agiSize             = 344
+	// versionMask the bits of the version number that are the version itself, rather than feature flags
+	versionMask = 0xf
+	version5    = 5
+)
+
+// incompatible features, those that change the format in a way that a reader has to know about
+const (
+	incompatFtype       = 1 << 0
+	incompatSparseInode = 1 << 1
+	incompatMetaUUID    = 1 << 2
+	incompatBigtime     = 1 << 3
+	incompatNeedsRepair = 1 << 4
+	incompatNrext64     = 1 << 5
+	incompatExchange    = 1 << 6
+	incompatParent      = 1 << 7
+	// incompatSupported the incompatible features that do not stop files and directories from being read
+	incompatSupported = incompatFtype | incompatSparseInode | incompatMetaUUID | incompatBigtime | incompatNrext64 |
+		incompatExchange | incompatParent
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// errNotXFS the filesystem does not start with an XFS superblock
+var errNotXFS = errors.New("not an XFS filesystem")
+
+// superblock the parts of the superblock, struct xfs_dsb, needed to read the filesystem
+type superblock struct {
+	blockSize    uint32
+	dataBlocks   uint64
+	uuid         uuid.UUID
+	rootInode    uint64
+	agBlocks     uint32
+	agCount      uint32
+	sectorSize   uint16
+	inodeSize    uint16
+	label        string
+	agBlockLog   uint8
+	inodesPerLog uint8
+	dirBlockLog  uint8
+	incompat     uint32
+}
+
+// checksum whether the checksum at offset in b, which is stored little-endian, is the crc32c of b with it zeroed,
+// as every piece of metadata of a version 5 filesystem has
+func checksum(b []byte, offset int) bool {
+	stored := binary.LittleEndian.Uint32(b[offset : offset+4])
+	crc := crc32.Update(0, crc32c, b[:offset])
+	crc = crc32.Update(crc, crc32c, []byte{0, 0, 0, 0})
+	crc = crc32.Update(crc, crc32c, b[offset+4:])
+	return crc == stored
+}
+
+// parseSuperblock parse the superblock in the first sector of the filesystem, b
+func parseSuperblock(b []byte) (*superblock, error) {
+	if len(b) < superblockSize || binary.BigEndian.Uint32(b[0:4]) != superblockMagic {
+		return nil, errNotXFS
+	}
+	version := binary.BigEndian.Uint16(b[100:102])
+	if version&versionMask != version5 {
+		return nil, fmt.Errorf("XFS version %d is not supported, only version %d", version&versionMask, version5)
+	}
+	sb := &superblock{
+		blockSize:    binary.BigEndian.Uint32(b[4:8]),
+		dataBlocks:   binary.BigEndian.Uint64(b[8:16]),
+		rootInode:    binary.BigEndian.Uint64(b[56:64]),
+		agBlocks:     binary.BigEndian.Uint32(b[84:88]),
+		agCount:      binary.BigEndian.Uint32(b[88:92]),
+		sectorSize:   binary.BigEndian.Uint16(b[102:104]),
+		inodeSize:    binary.BigEndian.Uint16(b[104:106]),
+		label:        string(bytes.TrimRight(b[108:120], "\x00")),
+		agBlockLog:   b[124],
+		inodesPerLog: b[123],
+		dirBlockLog:  b[192],
+		incompat:     binary.BigEndian.Uint32(b[216:220]),
+	}
+	copy(sb.uuid[:], b[32:48])
+	if int(sb.sectorSize) > len(b) || sb.sectorSize < 512 {
+		return nil, fmt.Errorf("invalid sector size %d", sb.sectorSize)
+	}
+	if !checksum(b[:sb.sectorSize], superblockCRCOffset) {
+		return nil, errors.New("superblock checksum does not match")
+	}
+	switch {
+	case sb.blockSize < 512 || sb.blockSize > 65536 || sb.blockSize&(sb.blockSize-1) != 0:
+		return nil, fmt.Errorf("invalid block size %d", sb.blockSize)
+	case sb.inodeSize < inodeCoreSize || uint32(sb.inodeSize) > sb.blockSize || uint32(sb.inodeSize)<<sb.inodesPerLog != sb.blockSize:
+		return nil, fmt.Errorf("invalid inode size %d for block size %d", sb.inodeSize, sb.blockSize)
+	case sb.agCount == 0 || sb.agBlocks == 0 || uint64(1)<<sb.agBlockLog < uint64(sb.agBlocks) || sb.agBlockLog > 31:
+		return nil, fmt.Errorf("invalid allocation groups, %d of %d blocks", sb.agCount, sb.agBlocks)
+	case sb.dirBlockLog > 16:
+		return nil, fmt.Errorf("invalid directory block size of 2^%d blocks", sb.dirBlockLog)
+	}
+	if unknown := sb.incompat &^ incompatSupported; unknown != 0 {
+		return nil, fmt.Errorf("filesystem has incompatible features %#x that are not supported", unknown)
+	}
+	return sb, nil
+}
+
+// ftype whether directory entries have the type of the file
+func (sb *superblock) ftype() bool {
+	return sb.incompat&incompatFtype != 0
+}
+
+// dirBlockSize the size of a directory block in bytes
+func (sb *superblock) dirBlockSize() int {
+	return int(sb.blockSize) << sb.dirBlockLog
+}
+
+// readAGHeaders read the free space and inode headers of every allocation group, checking their checksums, and
+// sum the free blocks that they record
+func (fs *FileSystem) readAGHeaders() error {
+	sectorSize := int64(fs.sb.sectorSize)
+	var free uint64
+	for ag := uint32(0); ag < fs.sb.agCount; ag++ {
+		start := int64(ag) * int64(fs.sb.agBlocks) * int64(fs.sb.blockSize)
+		// the superblock, the AGF and the AGI are the first sectors of the allocation group
+		b, err := fs.readBytes(start+sectorSize, 2*int(sectorSize))
+		if err != nil {
+			return fmt.Errorf("could not read headers of allocation group %d: %w", ag, err)
+		}
+		agf, agi := b[:sectorSize], b[sectorSize:]
+		switch {
+		case binary.BigEndian.Uint32(agf[0:4]) != agfMagic || binary.BigEndian.Uint32(agf[8:12]) != ag:
+			return fmt.Errorf("allocation group %d has no free space header", ag)
+		case !checksum(agf[:agfSize], agfCRCOffset):
+			return fmt.Errorf("free space header of allocation group %d has a checksum that does not match", ag)
+		case binary.BigEndian.Uint32(agi[0:4]) != agiMagic || binary.BigEndian.Uint32(agi[8:12]) != ag:
+			return fmt.Errorf("allocation group %d has no inode header", ag)
+		case !checksum(agi[:agiSize], agiCRCOffset):
+			return fmt.Errorf("inode header of allocation group %d has a checksum that does not match", ag)
+		}
+		// free blocks, blocks on the free list, and blocks of the free space B+trees beyond their roots
+		free += uint64(binary.BigEndian.Uint32(agf[52:56])) + uint64(binary.BigEndian.Uint32(agf[48:52])) +
+			uint64(binary.BigEndian.Uint32(agf[60:64]))
+	}
+	fs.free = free
+	return nil
+}
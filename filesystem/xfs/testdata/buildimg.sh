@@ -0,0 +1,26 @@
+#!/bin/sh
+set -e
+mkdir -p dist
+cat << "EOF" | docker run -i --rm -v $PWD/dist:/data -w /data --privileged alpine:3.20
+set -e
+set -x
+apk --update add xfsprogs
+# mkfs.xfs will not make a filesystem smaller than 300MB
+dd if=/dev/zero of=xfs.img bs=1M count=300
+mkfs.xfs -L diskfs xfs.img
+mount xfs.img /mnt
+cd /mnt
+mkdir foo
+echo "This is a short file" > shortfile.txt
+echo "This is a subdir file" > foo/subdirfile.txt
+# enough entries that /foo needs a directory in node form, with leaf blocks
+set +x
+i=0; until [ $i -ge 1000 ]; do touch foo/file${i}; i=$(( $i+1 )); done
+set -x
+# a file with known content
+dd if=/dev/random of=/data/random.dat bs=1024 count=20
+cp /data/random.dat random.dat
+ln -s random.dat symlink.dat
+cd /data
+umount /mnt
+EOF
@@ -0,0 +1,256 @@
+package xfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// FileSystem implements the FileSystem interface
+type FileSystem struct {
+	backend backend.Storage
+	size    int64
+	start   int64
+	sb      *superblock
+	// free the free blocks in all of the allocation groups
+	free uint64
+}
+
+// Equal compare if two filesystems are equal
+func (fs *FileSystem) Equal(a *FileSystem) bool {
+	return fs.backend == a.backend && fs.size == a.size && fs.start == a.start
+}
+
+// Read reads an XFS filesystem from the given storage. size is the size of the filesystem in bytes, and start
+// where it starts. The block size and sector size of XFS are in its superblock, so the last argument, the block
+// size of the disk, is ignored.
+//
+// Only reading is supported, and only of version 5 filesystems, whose metadata has checksums.
+func Read(b backend.Storage, size, start, _ int64) (*FileSystem, error) {
+	fs := &FileSystem{
+		backend: b,
+		size:    size,
+		start:   start,
+	}
+	sector, err := fs.readBytes(0, superblockSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read superblock: %w", err)
+	}
+	if binary.BigEndian.Uint32(sector[0:4]) != superblockMagic {
+		return nil, errNotXFS
+	}
+	// the checksum of the superblock covers the whole of its sector
+	if sectorSize := int(binary.BigEndian.Uint16(sector[102:104])); sectorSize > superblockSize {
+		if sector, err = fs.readBytes(0, sectorSize); err != nil {
+			return nil, fmt.Errorf("could not read superblock: %w", err)
+		}
+	}
+	if fs.sb, err = parseSuperblock(sector); err != nil {
+		return nil, err
+	}
+	if blocks := int64(fs.sb.dataBlocks); blocks <= 0 || blocks*int64(fs.sb.blockSize) > size {
+		return nil, fmt.Errorf("filesystem of %d blocks of %d bytes is larger than %d bytes", fs.sb.dataBlocks, fs.sb.blockSize, size)
+	}
+	if err := fs.readAGHeaders(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// readBytes read count bytes at the given offset in the filesystem
+func (fs *FileSystem) readBytes(off int64, count int) ([]byte, error) {
+	if off < 0 || off+int64(count) > fs.size {
+		return nil, fmt.Errorf("%d bytes at %d are beyond the end of the filesystem", count, off)
+	}
+	b := make([]byte, count)
+	if _, err := fs.backend.ReadAt(b, fs.start+off); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// interface guard
+var (
+	_ filesystem.FileSystem    = (*FileSystem)(nil)
+	_ filesystem.UsageReporter = (*FileSystem)(nil)
+	_ filesystem.TimesChanger  = (*FileSystem)(nil)
+	_ filesystem.LinkReader    = (*FileSystem)(nil)
+)
+
+// Type returns the type code for the filesystem. Always returns filesystem.TypeXFS
+func (fs *FileSystem) Type() filesystem.Type {
+	return filesystem.TypeXFS
+}
+
+// Mkdir make a directory. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Mkdir(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Mknod make a special file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Mknod(_ string, _ uint32, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Link make a hard link. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Link(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Symlink make a symbolic link. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Symlink(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chmod change the mode of a file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Chmod(_ string, _ os.FileMode) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chown change the owner of a file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Chown(_ string, _, _ int) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Chtimes change the times of a file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Chtimes(_ string, _, _ time.Time) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Rename rename a file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Rename(_, _ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// Remove remove a file. XFS is read-only, so it always returns an error
+func (fs *FileSystem) Remove(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// SetLabel change the label. XFS is read-only, so it always returns an error
+func (fs *FileSystem) SetLabel(_ string) error {
+	return filesystem.ErrReadonlyFilesystem
+}
+
+// ReadDir return the contents of a given directory in a given filesystem.
+//
+// Returns a slice of os.FileInfo with all of the entries in the directory.
+//
+// Will return an error if the directory does not exist or is a regular file and not a directory
+func (fs *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	dir, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	entries, err := fs.readDirectory(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory %s: %w", p, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, de := range entries {
+		in, err := fs.readInode(de.inode)
+		if err != nil {
+			return nil, fmt.Errorf("could not read inode for %s: %w", path.Join(p, de.name), err)
+		}
+		fi, err := fs.newFileInfo(in, de.name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", path.Join(p, de.name), err)
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+// Readlink returns the target of the named symbolic link
+func (fs *FileSystem) Readlink(name string) (string, error) {
+	in, err := fs.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	fi, err := fs.newFileInfo(in, path.Base(name))
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %w", name, err)
+	}
+	target, err := fi.Readlink()
+	if err != nil {
+		return "", fmt.Errorf("%s is not a symbolic link", name)
+	}
+	return target, nil
+}
+
+// OpenFile returns a reader for a file in the filesystem. As XFS is read-only, flag must be os.O_RDONLY.
+func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_EXCL) != 0 {
+		return nil, filesystem.ErrReadonlyFilesystem
+	}
+	in, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if in.isDir() {
+		return nil, fmt.Errorf("cannot open directory %s as file", p)
+	}
+	return &File{inode: in, filesystem: fs}, nil
+}
+
+// lookup the inode of a file or directory by its path; names are compared exactly, as XFS does unless it was
+// made with ASCII case folding
+func (fs *FileSystem) lookup(p string) (*inode, error) {
+	in, err := fs.readInode(fs.sb.rootInode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read root directory: %w", err)
+	}
+	walked := "/"
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !in.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := fs.readDirectory(in)
+		if err != nil {
+			return nil, fmt.Errorf("could not read directory %s: %w", walked, err)
+		}
+		walked = path.Join(walked, name)
+		var found *directoryEntry
+		for _, de := range entries {
+			if de.name == name {
+				found = de
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s does not exist", walked)
+		}
+		if in, err = fs.readInode(found.inode); err != nil {
+			return nil, fmt.Errorf("could not read inode for %s: %w", walked, err)
+		}
+	}
+	return in, nil
+}
+
+// Label the label of the filesystem, as xfs_admin -L sets it
+func (fs *FileSystem) Label() string {
+	return fs.sb.label
+}
+
+// UUID the identifier of the filesystem, in the same form as blkid reports it
+func (fs *FileSystem) UUID() string {
+	return fs.sb.uuid.String()
+}
+
+// Usage the size of the filesystem, and the free space that its allocation groups record
+func (fs *FileSystem) Usage() filesystem.Usage {
+	blockSize := int64(fs.sb.blockSize)
+	return filesystem.Usage{Size: int64(fs.sb.dataBlocks) * blockSize, Free: int64(fs.free) * blockSize}
+}
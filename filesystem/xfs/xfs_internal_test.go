@@ -0,0 +1,405 @@
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/testhelper"
+)
+
+func TestRead(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		fs, err := testXFS(t, nil)
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if fs.Type() != filesystem.TypeXFS {
+			t.Errorf("type %v instead of %v", fs.Type(), filesystem.TypeXFS)
+		}
+		if label := fs.Label(); label != testLabel {
+			t.Errorf("label %q instead of %q", label, testLabel)
+		}
+		if uuid := fs.UUID(); uuid != testUUID {
+			t.Errorf("UUID %q instead of %q", uuid, testUUID)
+		}
+		usage := fs.Usage()
+		if usage.Size != testAGCount*testAGBlocks*testBlockSize || usage.Free != testFreeBlocks*testBlockSize {
+			t.Errorf("usage %+v instead of size %d and free %d", usage, testAGCount*testAGBlocks*testBlockSize, testFreeBlocks*testBlockSize)
+		}
+	})
+	t.Run("not XFS", func(t *testing.T) {
+		_, err := testXFS(t, func(b []byte) {
+			copy(b, "EXT4")
+		})
+		if !errors.Is(err, errNotXFS) {
+			t.Errorf("error %v instead of %v", err, errNotXFS)
+		}
+	})
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		err    string
+	}{
+		{"version 4", func(b []byte) {
+			binary.BigEndian.PutUint16(b[100:102], 0xb4a4)
+			testCRC(b[:testSectorSize], superblockCRCOffset)
+		}, "version 4"},
+		{"superblock checksum", func(b []byte) { b[109] ^= 0xff }, "superblock checksum"},
+		{"incompatible feature", func(b []byte) {
+			binary.BigEndian.PutUint32(b[216:220], incompatFtype|incompatNeedsRepair)
+			testCRC(b[:testSectorSize], superblockCRCOffset)
+		}, "incompatible features 0x10"},
+		{"free space header checksum", func(b []byte) {
+			b[testAGBlocks*testBlockSize+testSectorSize+52] ^= 0xff
+		}, "free space header of allocation group 1"},
+		{"inode header", func(b []byte) {
+			clear(b[testBlockSize : testBlockSize+4])
+		}, "allocation group 0 has no inode header"},
+		{"too small", func(b []byte) {
+			binary.BigEndian.PutUint64(b[8:16], testAGCount*testAGBlocks+1)
+			testCRC(b[:testSectorSize], superblockCRCOffset)
+		}, "is larger than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testXFS(t, tt.modify)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	fs, err := testXFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	tests := []struct {
+		path  string
+		names []string
+		err   string
+	}{
+		{"/", []string{"blockdir", "btree", "dev", "extents", "leafdir", "link", "longlink"}, ""},
+		{"/blockdir", []string{"inag1"}, ""},
+		{"/leafdir/", []string{"a", "b"}, ""},
+		{"/blockdir/../leafdir", []string{"a", "b"}, ""},
+		{"/extents", nil, "not a directory"},
+		{"/missing", nil, "does not exist"},
+		{"/extents/x", nil, "/extents is not a directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			infos, err := fs.ReadDir(tt.path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v instead of one with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			names := make([]string, 0, len(infos))
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Errorf("entries %v instead of %v", names, tt.names)
+			}
+		})
+	}
+}
+
+func TestFileInfo(t *testing.T) {
+	fs, err := testXFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("unexpected error reading root directory: %v", err)
+	}
+	byName := map[string]*FileInfo{}
+	for _, info := range infos {
+		byName[info.Name()] = info.Sys().(*FileInfo)
+	}
+	tests := []struct {
+		name   string
+		mode   os.FileMode
+		size   int64
+		target string
+		inode  uint64
+	}{
+		{"extents", 0o644, int64(testExtentsSize), "", testExtentsInode},
+		{"blockdir", os.ModeDir | 0o755, testBlockSize, "", testBlockDirInode},
+		{"leafdir", os.ModeDir | 0o700, 2 * testBlockSize, "", testLeafDirInode},
+		{"link", os.ModeSymlink | 0o777, 7, "extents", testLinkInode},
+		{"longlink", os.ModeSymlink | 0o777, int64(len(testLongTarget)), string(testLongTarget), testLongLinkInode},
+		{"btree", 0o644, int64(testBtreeSize), "", testBtreeInode},
+		{"dev", os.ModeDevice | os.ModeCharDevice | 0o600, 0, "", testDeviceInode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := byName[tt.name]
+			if fi == nil {
+				t.Fatalf("no entry for %s", tt.name)
+			}
+			if fi.Mode() != tt.mode || fi.IsDir() != tt.mode.IsDir() {
+				t.Errorf("mode %v instead of %v", fi.Mode(), tt.mode)
+			}
+			if fi.Size() != tt.size {
+				t.Errorf("size %d instead of %d", fi.Size(), tt.size)
+			}
+			if fi.Inode() != tt.inode {
+				t.Errorf("inode %d instead of %d", fi.Inode(), tt.inode)
+			}
+			if fi.UID() != 1000 || fi.GID() != 100 || fi.Nlink() != 1 {
+				t.Errorf("uid %d, gid %d and nlink %d instead of 1000, 100 and 1", fi.UID(), fi.GID(), fi.Nlink())
+			}
+			target, err := fi.Readlink()
+			switch {
+			case tt.target == "" && !errors.Is(err, os.ErrNotExist):
+				t.Errorf("error %v instead of %v reading link of a file that is not one", err, os.ErrNotExist)
+			case tt.target != "" && (err != nil || target != tt.target):
+				t.Errorf("target %q and error %v instead of %q", target, err, tt.target)
+			}
+			target, err = fs.Readlink("/" + tt.name)
+			switch {
+			case tt.target == "" && err == nil:
+				t.Errorf("no error reading link of a file that is not one")
+			case tt.target != "" && (err != nil || target != tt.target):
+				t.Errorf("filesystem gave target %q and error %v instead of %q", target, err, tt.target)
+			}
+		})
+	}
+	t.Run("timestamps", func(t *testing.T) {
+		big, classic := byName["extents"], byName["btree"]
+		if want := time.Unix(1700000000, 5); !big.ModTime().Equal(want) || !big.CreateTime().Equal(want) {
+			t.Errorf("big timestamps %v and %v instead of %v", big.ModTime(), big.CreateTime(), want)
+		}
+		if want := time.Unix(1600000000, 7); !classic.AccessTime().Equal(want) || !classic.ChangeTime().Equal(want) {
+			t.Errorf("timestamps %v and %v instead of %v", classic.AccessTime(), classic.ChangeTime(), want)
+		}
+	})
+}
+
+func TestOpenFile(t *testing.T) {
+	fs, err := testXFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	var extents []byte
+	for n := 0; n < 5; n++ {
+		if n == 2 || n == 3 {
+			// a hole, and an unwritten extent
+			extents = append(extents, make([]byte, testBlockSize)...)
+			continue
+		}
+		extents = append(extents, testFileContent(n)...)
+	}
+	tests := []struct {
+		path    string
+		content []byte
+	}{
+		{"/extents", extents[:testExtentsSize]},
+		{"/btree", append(testFileContent(0), testFileContent(1)...)},
+		{"/blockdir/inag1", testAG1Content},
+		{"/leafdir/b", append(testFileContent(0), testFileContent(1)...)},
+		{"/dev", []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("unexpected error opening: %v", err)
+			}
+			b, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if !bytes.Equal(b, tt.content) {
+				t.Errorf("read %d bytes that do not match the %d expected", len(b), len(tt.content))
+			}
+		})
+	}
+	t.Run("seek", func(t *testing.T) {
+		f, err := fs.OpenFile("/extents", os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("unexpected error opening: %v", err)
+		}
+		if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+			t.Fatalf("unexpected error seeking: %v", err)
+		}
+		b := make([]byte, 20)
+		n, err := f.Read(b)
+		if n != 10 || err != io.EOF || !bytes.Equal(b[:n], extents[testExtentsSize-10:testExtentsSize]) {
+			t.Errorf("read %d bytes %q with error %v at end of file", n, b[:n], err)
+		}
+		if _, err := f.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("no error seeking before start of file")
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("unexpected error closing: %v", err)
+		}
+		if _, err := f.Read(b); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("error %v instead of %v reading closed file", err, os.ErrClosed)
+		}
+	})
+	t.Run("directory", func(t *testing.T) {
+		if _, err := fs.OpenFile("/leafdir", os.O_RDONLY); err == nil {
+			t.Errorf("no error opening directory as file")
+		}
+	})
+	t.Run("realtime", func(t *testing.T) {
+		in, err := fs.readInode(testAG1Inode)
+		if err != nil {
+			t.Fatalf("unexpected error reading inode: %v", err)
+		}
+		in.flags |= inodeFlagRealtime
+		if _, err := (&File{inode: in, filesystem: fs}).Read(make([]byte, 10)); err == nil {
+			t.Errorf("no error reading file on the realtime device")
+		}
+	})
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		path   string
+		err    string
+	}{
+		{"inode checksum", func(b []byte) { b[4*testBlockSize+inodeCoreSize+testInodeSize] ^= 0xff }, "/extents", "checksum"},
+		{"inode number", func(b []byte) {
+			in := b[7*testBlockSize : 7*testBlockSize+testInodeSize]
+			binary.BigEndian.PutUint64(in[152:160], 99)
+			testCRC(in, inodeCRCOffset)
+		}, "/btree", "says it is inode 99"},
+		{"B+tree checksum", func(b []byte) { b[22*testBlockSize+bmbtBlockHeader] ^= 0xff }, "/btree", "checksum"},
+		{"directory block checksum", func(b []byte) { b[18*testBlockSize+dirHeaderSize+9] ^= 0xff }, "/leafdir/b", "checksum"},
+		{"directory block owner", func(b []byte) {
+			dir := b[16*testBlockSize : 17*testBlockSize]
+			binary.BigEndian.PutUint64(dir[40:48], testLeafDirInode)
+			testCRC(dir, dirCRCOffset)
+		}, "/blockdir/inag1", "belongs to inode 11"},
+		{"symlink block checksum", func(b []byte) { b[21*testBlockSize+symlinkHeaderSize] ^= 0xff }, "/longlink", "checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := testXFS(t, tt.modify)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			_, err = fs.OpenFile(tt.path, os.O_RDONLY)
+			if err == nil {
+				// a symlink is read with the directory that it is in
+				_, err = fs.ReadDir("/")
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v instead of one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadonly(t *testing.T) {
+	fs, err := testXFS(t, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	for name, err := range map[string]error{
+		"Mkdir":    fs.Mkdir("/new"),
+		"Mknod":    fs.Mknod("/new", 0, 0),
+		"Link":     fs.Link("/extents", "/new"),
+		"Symlink":  fs.Symlink("/extents", "/new"),
+		"Chmod":    fs.Chmod("/extents", 0o600),
+		"Chown":    fs.Chown("/extents", 0, 0),
+		"Chtimes":  fs.Chtimes("/extents", time.Time{}, time.Time{}),
+		"Rename":   fs.Rename("/extents", "/new"),
+		"Remove":   fs.Remove("/extents"),
+		"SetLabel": fs.SetLabel("new"),
+	} {
+		if !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+			t.Errorf("%s returned %v instead of %v", name, err, filesystem.ErrReadonlyFilesystem)
+		}
+	}
+	if _, err := fs.OpenFile("/extents", os.O_RDWR); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("OpenFile for writing returned %v instead of %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+	f, err := fs.OpenFile("/extents", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("unexpected error opening: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); !errors.Is(err, filesystem.ErrReadonlyFilesystem) {
+		t.Errorf("Write returned %v instead of %v", err, filesystem.ErrReadonlyFilesystem)
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	fs := testhelper.ReadImage(t, imgFile, Read)
+	if label := fs.Label(); label != "diskfs" {
+		t.Errorf("label %q instead of %q", label, "diskfs")
+	}
+	entries, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatalf("error reading root directory: %v", err)
+	}
+	found := map[string]bool{}
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	for _, name := range []string{"shortfile.txt", "foo", "random.dat", "symlink.dat"} {
+		if !found[name] {
+			t.Errorf("root directory does not have %s", name)
+		}
+	}
+	entries, err = fs.ReadDir("/foo")
+	if err != nil {
+		t.Fatalf("error reading /foo: %v", err)
+	}
+	if len(entries) != 1001 {
+		t.Errorf("/foo has %d entries instead of 1001", len(entries))
+	}
+
+	randomData, err := os.ReadFile(randomDataFile)
+	if err != nil {
+		t.Fatalf("error reading random data file %s: %v", randomDataFile, err)
+	}
+	for _, tt := range []struct {
+		path    string
+		content []byte
+	}{
+		{"/shortfile.txt", []byte("This is a short file\n")},
+		{"/foo/subdirfile.txt", []byte("This is a subdir file\n")},
+		{"/random.dat", randomData},
+	} {
+		f, err := fs.OpenFile(tt.path, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", tt.path, err)
+		}
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("error reading %s: %v", tt.path, err)
+		}
+		if !bytes.Equal(b, tt.content) {
+			t.Errorf("%s has %d bytes that do not match the %d expected", tt.path, len(b), len(tt.content))
+		}
+	}
+	target, err := fs.Readlink("/symlink.dat")
+	if err != nil {
+		t.Fatalf("error reading link: %v", err)
+	}
+	if target != "random.dat" {
+		t.Errorf("link target %q instead of %q", target, "random.dat")
+	}
+}
@@ -0,0 +1,83 @@
+package diskfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/disk/formats/qcow2"
+	"github.com/diskfs/go-diskfs/disk/formats/vhdx"
+	"github.com/diskfs/go-diskfs/disk/formats/vmdk"
+)
+
+// formatDetect the format used by Open and OpenBackend unless WithFormat is given: sniff it from the image
+const formatDetect Format = -1
+
+// magic numbers of the image container formats, at the start of the image
+var (
+	vmdkSparseMagic = []byte("KDMV")
+	vhdxMagic       = []byte("vhdxfile")
+	qcow2Magic      = []byte("QFI\xfb")
+	// vhdMagic the cookie of the footer of a VHD, of which a dynamic or differencing VHD has a copy at the start
+	vhdMagic = []byte("conectix")
+)
+
+// DetectFormat sniff the format of the image in b by the magic numbers of the image container formats.
+// An image that has none of them is FormatRaw, as is a fixed VHD, which is a raw disk followed by a footer.
+// A dynamic VHD is not supported, and returns an error rather than being taken as a raw disk, which it is not;
+// use WithFormat(FormatRaw) to open such an image as raw anyway. An image that starts with a vmdk descriptor is
+// FormatRaw, as that may as well be what was written to the start of a raw disk.
+func DetectFormat(b backend.Storage) (Format, error) {
+	header := make([]byte, 512)
+	n, err := b.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return FormatRaw, fmt.Errorf("could not read image header: %w", err)
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, vmdkSparseMagic):
+		// monolithic sparse and streamOptimized images share the header, and vmdk.New tells them apart
+		return FormatVMDK, nil
+	case bytes.HasPrefix(header, vhdxMagic):
+		return FormatVHDX, nil
+	case bytes.HasPrefix(header, qcow2Magic):
+		return FormatQCOW2, nil
+	case bytes.HasPrefix(header, vhdMagic):
+		return FormatRaw, errors.New("dynamic VHD images are not supported, use WithFormat(FormatRaw) to open it as a raw disk")
+	}
+	return FormatRaw, nil
+}
+
+// openFormat the backend that translates the image in b of the format given by opt, or of the format sniffed
+// from it for formatDetect, to the disk it holds. Backing files are only followed for a format that was given.
+func openFormat(b backend.Storage, opt *openOpts) (backend.Storage, error) {
+	format := opt.format
+	if opt.backingFiles && format != FormatQCOW2 {
+		return nil, errors.New("WithBackingFiles requires WithFormat(FormatQCOW2)")
+	}
+	if format == formatDetect {
+		// a block device is a disk, whatever the guest has written to the start of it
+		if info, err := b.Stat(); err == nil && info.Mode()&os.ModeDevice != 0 {
+			return b, nil
+		}
+		var err error
+		if format, err = DetectFormat(b); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case FormatRaw:
+		return b, nil
+	case FormatVMDK, FormatVMDKStreamOptimized:
+		return vmdk.New(b)
+	case FormatVHDX:
+		return vhdx.New(b)
+	case FormatQCOW2:
+		return qcow2.New(b, qcow2.WithBackingFiles(opt.backingFiles))
+	default:
+		return nil, fmt.Errorf("unsupported image format %v", format)
+	}
+}
@@ -13,7 +13,9 @@ require (
 	github.com/pkg/xattr v0.4.9
 	github.com/sirupsen/logrus v1.9.4-0.20230606125235-dd1b4c2e81af
 	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/crypto v0.22.0
 	golang.org/x/sys v0.19.0
+	golang.org/x/text v0.14.0
 )
 
 require github.com/stretchr/testify v1.7.1 // indirect
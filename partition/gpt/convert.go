@@ -0,0 +1,169 @@
+package gpt
+
+import (
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// mbrTypes the MBR partition type of a GPT partition type when converting to an MBR; any other type is Linux
+var mbrTypes = map[Type]mbr.Type{
+	EFISystemPartition: mbr.EFISystem,
+	// FAT32, as that is what the boot partitions of boards that need an MBR are
+	MicrosoftBasicData: mbr.Fat32LBA,
+	LinuxSwap:          mbr.LinuxSwap,
+	LinuxLVM:           mbr.LinuxLVM,
+	AppleHFS:           mbr.HFS,
+	AppleUFS:           mbr.MacOSXUFS,
+	AppleBoot:          mbr.MacOSXBoot,
+}
+
+// gptTypes the GPT partition type of an MBR partition type when converting from an MBR; any other type is Linux
+// filesystem, as gdisk does
+var gptTypes = map[mbr.Type]Type{
+	mbr.EFISystem:  EFISystemPartition,
+	mbr.Fat12:      MicrosoftBasicData,
+	mbr.Fat16:      MicrosoftBasicData,
+	mbr.Fat16b:     MicrosoftBasicData,
+	mbr.Fat16bLBA:  MicrosoftBasicData,
+	mbr.Fat32CHS:   MicrosoftBasicData,
+	mbr.Fat32LBA:   MicrosoftBasicData,
+	mbr.NTFS:       MicrosoftBasicData,
+	mbr.LinuxSwap:  LinuxSwap,
+	mbr.LinuxLVM:   LinuxLVM,
+	mbr.Linux:      LinuxFilesystem,
+	mbr.HFS:        AppleHFS,
+	mbr.MacOSXUFS:  AppleUFS,
+	mbr.MacOSXBoot: AppleBoot,
+}
+
+// toMBR the MBR partition entry of the partition, with the type from mbrTypes, and marked bootable if it has
+// the LegacyBIOSBootable attribute
+func (p *Partition) toMBR() *mbr.Partition {
+	mbrType, ok := mbrTypes[p.Type]
+	if !ok {
+		mbrType = mbr.Linux
+	}
+	return &mbr.Partition{
+		Bootable: p.Attributes&LegacyBIOSBootable != 0,
+		Type:     mbrType,
+		Start:    uint32(p.Start),
+		Size:     uint32(p.End - p.Start + 1),
+	}
+}
+
+// FromMBR convert an MBR partition table to a GPT, as gdisk does. Each partition keeps its number, start and size,
+// gets the GPT type that matches its MBR type, or Linux filesystem if there is none, and the LegacyBIOSBootable
+// attribute if it is bootable. Extended partitions cannot be converted, nor can an MBR that protects a GPT.
+// The table is new, so writing it gives the disk and each partition a random GUID, and a protective MBR in place
+// of the MBR; the partitions must leave room for the GPT, which takes the first and last sectors of the disk.
+func FromMBR(m *mbr.Table) (*Table, error) {
+	t := &Table{
+		LogicalSectorSize:  m.LogicalSectorSize,
+		PhysicalSectorSize: m.PhysicalSectorSize,
+		ProtectiveMBR:      true,
+	}
+	if t.LogicalSectorSize == 0 {
+		t.LogicalSectorSize = logicalSectorSize
+	}
+	if t.PhysicalSectorSize == 0 {
+		t.PhysicalSectorSize = physicalSectorSize
+	}
+	used := 0
+	for i, p := range m.Partitions {
+		switch p.Type {
+		case mbr.Empty:
+			t.Partitions = append(t.Partitions, &Partition{Type: Unused})
+			continue
+		case mbr.ExtendedCHS, mbr.ExtendedLBA, mbr.LinuxExtended:
+			return nil, fmt.Errorf("partition %d is an extended partition, which cannot be converted to GPT", i+1)
+		case mbr.GPTProtective:
+			return nil, fmt.Errorf("partition %d protects a GPT, so the disk already has one", i+1)
+		}
+		gptType, ok := gptTypes[p.Type]
+		if !ok {
+			gptType = LinuxFilesystem
+		}
+		var attributes uint64
+		if p.Bootable {
+			attributes = LegacyBIOSBootable
+		}
+		t.Partitions = append(t.Partitions, &Partition{
+			Start:      uint64(p.Start),
+			End:        uint64(p.Start) + uint64(p.Size) - 1,
+			Size:       uint64(p.Size) * uint64(t.LogicalSectorSize),
+			Type:       gptType,
+			Attributes: attributes,
+		})
+		used = len(t.Partitions)
+	}
+	// leave out the empty entries after the last partition
+	t.Partitions = t.Partitions[:used]
+	return t, nil
+}
+
+// ToMBR convert the GPT to an MBR partition table. Each partition keeps its number, start and size, and is
+// marked bootable if it has the LegacyBIOSBootable attribute. Its MBR type follows its GPT type: EFI system is 0xef,
+// Microsoft basic data is FAT32 0x0c, Linux swap and LVM are 0x82 and 0x8e, the Apple types are those of HFS, UFS
+// and boot, and anything else is Linux 0x83. Only the first 4 partitions can be converted, and only if each is
+// within the first 2^32 sectors; the partition GUIDs, names and other attributes are lost.
+// Writing the table only writes the MBR; the GPT has to be erased with Erase, or it is still found first.
+func (t *Table) ToMBR() (*mbr.Table, error) {
+	m := &mbr.Table{
+		LogicalSectorSize:  t.LogicalSectorSize,
+		PhysicalSectorSize: t.PhysicalSectorSize,
+	}
+	entries := make([]*mbr.Partition, 4)
+	used := 0
+	for i, p := range t.Partitions {
+		if p.Type == Unused {
+			continue
+		}
+		// a partition read from disk keeps the number of its entry, which the partitions before it may not fill
+		if p.raw != nil {
+			i = p.raw.slot
+		}
+		if i >= len(entries) {
+			return nil, fmt.Errorf("partition %d cannot be converted, as an MBR only has %d", i+1, len(entries))
+		}
+		if p.End > 0xffffffff {
+			return nil, fmt.Errorf("partition %d ends at sector %d, which is too far into the disk for an MBR", i+1, p.End)
+		}
+		entries[i] = p.toMBR()
+		used = max(used, i+1)
+	}
+	for _, p := range entries[:used] {
+		if p == nil {
+			p = &mbr.Partition{Type: mbr.Empty}
+		}
+		m.Partitions = append(m.Partitions, p)
+	}
+	return m, nil
+}
+
+// Erase zero the primary and secondary GPT headers and partition arrays on f, e.g. after converting the table to an
+// MBR with ToMBR, so that the disk is no longer found to have a GPT. The MBR is left as it is, so write one after.
+// The table must have been read from f, or written to it.
+func (t *Table) Erase(f backend.WritableFile) error {
+	if !t.initialized {
+		return fmt.Errorf("table has not been read or written, so where it is on disk is unknown")
+	}
+	sectorSize := int64(t.LogicalSectorSize)
+	// the primary header followed by its array, and the secondary array followed by its header
+	regions := [][2]uint64{
+		{t.primaryHeader, t.partitionArraySector(true) + t.partitionArraySectors()},
+		{t.partitionArraySector(false), t.secondaryHeader + 1},
+	}
+	for _, r := range regions {
+		b := make([]byte, int64(r[1]-r[0])*sectorSize)
+		written, err := f.WriteAt(b, int64(r[0])*sectorSize)
+		if err != nil {
+			return fmt.Errorf("error erasing GPT at sector %d: %v", r[0], err)
+		}
+		if written != len(b) {
+			return fmt.Errorf("erased %d bytes of GPT at sector %d instead of %d", written, r[0], len(b))
+		}
+	}
+	return nil
+}
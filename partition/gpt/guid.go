@@ -0,0 +1,72 @@
+package gpt
+
+import (
+	"fmt"
+	"strings"
+
+	uuid "github.com/google/uuid"
+)
+
+// diskGUIDRole the role from which DeriveGUIDs derives the GUID of the disk itself
+const diskGUIDRole = "disk"
+
+// MachineNamespace the namespace for DeriveGUID of a machine, from its ID as in /etc/machine-id: 32 hex digits,
+// with or without dashes, and with or without a trailing newline
+func MachineNamespace(machineID string) (uuid.UUID, error) {
+	ns, err := uuid.Parse(strings.TrimSpace(machineID))
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid machine ID %q: %v", machineID, err)
+	}
+	return ns, nil
+}
+
+// DeriveGUID a GUID derived from namespace and role, as a version 5 UUID: the same every time for the same
+// namespace and role, and different for any other. With a namespace for each machine, e.g. from MachineNamespace,
+// and a role for each partition, e.g. "root" or "esp", every machine gets the same GUIDs each time its disk is
+// partitioned, and no two machines get the same ones. It is upper case, as Read returns GUIDs.
+func DeriveGUID(namespace uuid.UUID, role string) string {
+	return strings.ToUpper(uuid.NewSHA1(namespace, []byte(role)).String())
+}
+
+// DeriveGUIDs set the GUID of the table and of each partition that are left blank to those that DeriveGUID derives
+// from namespace, in place of random ones. The role of the table is "disk", and that of a partition is its Name,
+// or, for a partition without one, its Type and how many partitions of that type come before it, e.g.
+// "C12A7328-F81F-11D2-BA4B-00A0C93EC93B:0" for the first EFI System partition. GUIDs that are already set are kept.
+// It is an error for two partitions left blank to have the same role, or one to have that of a table left blank,
+// as they would get the same GUID; nothing is changed then.
+func (t *Table) DeriveGUIDs(namespace uuid.UUID) error {
+	roles := map[string]int{}
+	ofType := map[Type]int{}
+	derived := make([]string, len(t.Partitions))
+	for i, p := range t.Partitions {
+		if p == nil || p.Type == Unused {
+			continue
+		}
+		role := p.Name
+		if role == "" {
+			typ := Type(strings.ToUpper(string(p.Type)))
+			role = fmt.Sprintf("%s:%d", typ, ofType[typ])
+			ofType[typ]++
+		}
+		if p.GUID != "" {
+			continue
+		}
+		if role == diskGUIDRole && t.GUID == "" {
+			return fmt.Errorf("partition %d would have the same GUID as the disk, as it has the role %q", i+1, role)
+		}
+		if other, ok := roles[role]; ok {
+			return fmt.Errorf("partitions %d and %d would have the same GUID, as both have the role %q", other+1, i+1, role)
+		}
+		roles[role] = i
+		derived[i] = DeriveGUID(namespace, role)
+	}
+	if t.GUID == "" {
+		t.GUID = DeriveGUID(namespace, diskGUIDRole)
+	}
+	for i, guid := range derived {
+		if guid != "" {
+			t.Partitions[i].GUID = guid
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package gpt
+
+import (
+	"fmt"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// LegacyBIOSBootable the attribute of a partition that legacy BIOS may boot, which is the bootable flag of its
+// entry in a hybrid MBR
+const LegacyBIOSBootable uint64 = 1 << 2
+
+// hybridMaxPartitions how many GPT partitions a hybrid MBR can hold, leaving a slot for the protective partition
+const hybridMaxPartitions = 3
+
+// WriteHybridMBR write a hybrid MBR to f in place of the protective MBR, for firmware that
+// only reads the MBR, such as that of some ARM boards and older BIOSes. Its first slots have the partitions
+// partNums, counted from 1, in that order, of which there may be up to 3, and the slot after them has a partition
+// of type 0xee that covers the GPT, from sector 1 to the sector before the first of them. Each partition must be
+// within the first 2^32 sectors. Its MBR type and bootable flag are those that ToMBR gives it.
+//
+// Write the table first; the GPT itself does not change, and the boot code and disk signature of the MBR are kept.
+// ProtectiveMBR is unset, so that a later Write does not replace the hybrid MBR with a protective one.
+func (t *Table) WriteHybridMBR(f backend.WritableFile, partNums []int) error {
+	if len(partNums) == 0 || len(partNums) > hybridMaxPartitions {
+		return fmt.Errorf("a hybrid MBR must have between 1 and %d partitions, not %d", hybridMaxPartitions, len(partNums))
+	}
+	table := &mbr.Table{
+		LogicalSectorSize:  t.LogicalSectorSize,
+		PhysicalSectorSize: t.PhysicalSectorSize,
+	}
+	first := uint64(0)
+	seen := map[int]bool{}
+	for _, partNum := range partNums {
+		if seen[partNum] {
+			return fmt.Errorf("partition %d is in the hybrid MBR more than once", partNum)
+		}
+		seen[partNum] = true
+		p, err := t.partition(partNum)
+		if err != nil {
+			return err
+		}
+		if p.End > 0xffffffff {
+			return fmt.Errorf("partition %d ends at sector %d, which is too far into the disk for an MBR", partNum, p.End)
+		}
+		table.Partitions = append(table.Partitions, p.toMBR())
+		if first == 0 || p.Start < first {
+			first = p.Start
+		}
+	}
+	table.Partitions = append(table.Partitions, &mbr.Partition{
+		Type:  mbr.GPTProtective,
+		Start: gptHeaderSector,
+		Size:  uint32(first - gptHeaderSector),
+	})
+	if err := table.Write(f, int64(t.TotalSize())); err != nil {
+		return fmt.Errorf("error writing hybrid MBR: %w", err)
+	}
+	t.ProtectiveMBR = false
+	return nil
+}
@@ -0,0 +1,212 @@
+package gpt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Region a range of sectors on the disk that no partition uses
+type Region struct {
+	Start uint64 // first sector of the region
+	End   uint64 // last sector of the region
+	Size  uint64 // size of the region in bytes
+}
+
+// FreeRegions list the ranges of usable sectors that no partition uses, in order. Each region starts on a
+// physical sector boundary, so that a partition can be created at its start; a gap too small for that is left out.
+func (t *Table) FreeRegions() ([]Region, error) {
+	if err := t.checkLayout(); err != nil {
+		return nil, err
+	}
+	var regions []Region
+	add := func(start, end uint64) {
+		start = t.alignSector(start)
+		if start > end {
+			return
+		}
+		regions = append(regions, Region{Start: start, End: end, Size: (end - start + 1) * uint64(t.LogicalSectorSize)})
+	}
+	next := t.firstDataSector
+	for _, p := range t.usedPartitions(nil) {
+		if p.Start > next {
+			add(next, p.Start-1)
+		}
+		if p.End+1 > next {
+			next = p.End + 1
+		}
+	}
+	if next <= t.lastDataSector {
+		add(next, t.lastDataSector)
+	}
+	return regions, nil
+}
+
+// ResizePartition change the size of partition partNum, counted from 1, to size bytes, keeping its start. A size
+// of 0 grows it to fill all of the free space after it. The size must be a multiple of the logical sector size,
+// and the partition may not grow into the next one or past the last usable sector.
+//
+// Only the table changes; Write it to rewrite the partition array and both headers. Growing or shrinking the
+// filesystem in the partition is up to the caller.
+func (t *Table) ResizePartition(partNum int, size uint64) error {
+	p, err := t.partition(partNum)
+	if err != nil {
+		return err
+	}
+	logical := uint64(t.LogicalSectorSize)
+	if size%logical != 0 {
+		return fmt.Errorf("size %d is not a multiple of the logical sector size %d", size, logical)
+	}
+	// the last sector the partition may reach
+	limit := t.lastDataSector
+	for _, other := range t.usedPartitions(p) {
+		if other.Start > p.Start && other.Start-1 < limit {
+			limit = other.Start - 1
+		}
+	}
+	end := limit
+	if size > 0 {
+		end = p.Start + size/logical - 1
+	}
+	switch {
+	case end < p.Start:
+		return fmt.Errorf("partition %d cannot have size %d", partNum, size)
+	case end > limit && limit == t.lastDataSector:
+		return fmt.Errorf("partition %d would end at sector %d, after the last usable sector %d", partNum, end, t.lastDataSector)
+	case end > limit:
+		return fmt.Errorf("partition %d would end at sector %d, overlapping the partition that starts at sector %d", partNum, end, limit+1)
+	}
+	p.End = end
+	p.Size = (end - p.Start + 1) * logical
+	return nil
+}
+
+// MovePartition move partition partNum, counted from 1, to start at sector start, keeping its size. The start
+// must be on a physical sector boundary, and the partition may not overlap another one or go outside the usable
+// sectors.
+//
+// Only the table changes; Write it to rewrite the partition array and both headers. The contents of the
+// partition are not moved, so the caller must copy them from the old location to the new one.
+func (t *Table) MovePartition(partNum int, start uint64) error {
+	p, err := t.partition(partNum)
+	if err != nil {
+		return err
+	}
+	if t.alignSector(start) != start {
+		return fmt.Errorf("sector %d is not aligned to the physical sector size %d", start, t.PhysicalSectorSize)
+	}
+	end := start + p.End - p.Start
+	switch {
+	case start < t.firstDataSector:
+		return fmt.Errorf("partition %d would start at sector %d, before the first usable sector %d", partNum, start, t.firstDataSector)
+	case end > t.lastDataSector:
+		return fmt.Errorf("partition %d would end at sector %d, after the last usable sector %d", partNum, end, t.lastDataSector)
+	}
+	for _, other := range t.usedPartitions(p) {
+		if start <= other.End && end >= other.Start {
+			return fmt.Errorf("partition %d at sectors %d-%d would overlap the partition at sectors %d-%d", partNum, start, end, other.Start, other.End)
+		}
+	}
+	p.Start, p.End = start, end
+	return nil
+}
+
+// PartitionEntries the number of entries in the partition array, which is the most partitions the table can hold
+func (t *Table) PartitionEntries() int {
+	if t.partitionArraySize == 0 {
+		return defaultPartitionEntries
+	}
+	return t.partitionArraySize
+}
+
+// SetPartitionEntries change the number of entries in the partition array from the usual 128, which is also the
+// minimum that the UEFI specification requires, though firmware and tools accept fewer. The first and last usable
+// sectors move with the ends of both copies of the array, and the first one stays aligned to the physical sector
+// size. It returns an error if a partition would overlap either copy of the array, or if the table has more
+// partitions than count.
+//
+// On a new table, call it before Write. On a table read from disk, only the table changes; Write it to rewrite the
+// partition arrays and both headers.
+func (t *Table) SetPartitionEntries(count int) error {
+	if count < 1 {
+		return fmt.Errorf("invalid number of partition entries %d, must be at least 1", count)
+	}
+	if len(t.Partitions) > count {
+		return fmt.Errorf("table has %d partitions, more than %d entries", len(t.Partitions), count)
+	}
+	if t.partitionEntrySize == 0 {
+		t.partitionEntrySize = PartitionEntrySize
+	}
+	if !t.initialized {
+		// the usable sectors follow from it when the table is initialized for a disk
+		t.partitionArraySize = count
+		return nil
+	}
+	if err := t.checkLayout(); err != nil {
+		return err
+	}
+	old := t.partitionArraySize
+	t.partitionArraySize = count
+	partSectors := t.partitionArraySectors()
+	first := t.alignSector(t.primaryHeader + 1 + partSectors)
+	if t.secondaryHeader < partSectors+1 || t.secondaryHeader-partSectors-1 < first {
+		t.partitionArraySize = old
+		return fmt.Errorf("disk is too small for %d partition entries", count)
+	}
+	last := t.secondaryHeader - partSectors - 1
+	for i, p := range t.Partitions {
+		if p.Type != Unused && (p.Start < first || p.End > last) {
+			t.partitionArraySize = old
+			return fmt.Errorf("partition %d at sectors %d-%d is outside the usable sectors %d-%d with %d partition entries", i+1, p.Start, p.End, first, last, count)
+		}
+	}
+	t.firstDataSector, t.lastDataSector = first, last
+	return nil
+}
+
+// checkLayout make sure that the usable sectors of the table are known, which they are once it has been read from
+// disk or written to one
+func (t *Table) checkLayout() error {
+	if t.LogicalSectorSize == 0 || t.lastDataSector == 0 {
+		return fmt.Errorf("table is not initialized")
+	}
+	return nil
+}
+
+// partition the partition partNum, counted from 1, if it is in use and has its sectors set
+func (t *Table) partition(partNum int) (*Partition, error) {
+	if err := t.checkLayout(); err != nil {
+		return nil, err
+	}
+	if partNum < 1 || partNum > len(t.Partitions) {
+		return nil, fmt.Errorf("invalid partition number %d, table has %d partitions", partNum, len(t.Partitions))
+	}
+	p := t.Partitions[partNum-1]
+	switch {
+	case p.Type == Unused:
+		return nil, fmt.Errorf("partition %d is unused", partNum)
+	case p.End < p.Start:
+		return nil, fmt.Errorf("partition %d ends at sector %d, before its start %d", partNum, p.End, p.Start)
+	}
+	return p, nil
+}
+
+// usedPartitions the partitions in use other than except, in order of their start
+func (t *Table) usedPartitions(except *Partition) []*Partition {
+	used := make([]*Partition, 0, len(t.Partitions))
+	for _, p := range t.Partitions {
+		if p.Type != Unused && p != except {
+			used = append(used, p)
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
+	return used
+}
+
+// alignSector round sector up to the next physical sector boundary
+func (t *Table) alignSector(sector uint64) uint64 {
+	per := uint64(1)
+	if t.PhysicalSectorSize > t.LogicalSectorSize {
+		per = uint64(t.PhysicalSectorSize / t.LogicalSectorSize)
+	}
+	return (sector + per - 1) / per * per
+}
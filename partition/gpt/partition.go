@@ -13,7 +13,7 @@ import (
 	uuid "github.com/google/uuid"
 )
 
-// PartitionEntrySize fixed size of a GPT partition entry
+// PartitionEntrySize size of a GPT partition entry as written; an entry read from disk may be larger by a power of 2
 const PartitionEntrySize = 128
 
 var zeroUUIDBytes = make([]byte, 16)
@@ -29,6 +29,43 @@ type Partition struct {
 	Attributes         uint64 // Attributes flags
 	logicalSectorSize  int
 	physicalSectorSize int
+	// raw the entry as read from disk, which a table with PreserveBytes writes back
+	raw *partitionEntryRaw
+}
+
+// partitionEntryRaw an entry of the partition array as read from disk, with where it was in the array and
+// the partition it was read as, so that only the fields that have changed since are written over it
+type partitionEntryRaw struct {
+	b    []byte
+	slot int
+	read Partition
+}
+
+// merge the bytes of the entry as read from disk, with the fields that have changed since taken from fresh,
+// the entry as it would be written from scratch
+func (r *partitionEntryRaw) merge(p *Partition, fresh []byte) []byte {
+	if p.Type == Unused {
+		return fresh
+	}
+	b := bytes.Clone(r.b)
+	fields := []struct {
+		changed    bool
+		start, end int
+	}{
+		{p.Type != r.read.Type, 0, 16},
+		{p.GUID != r.read.GUID, 16, 32},
+		{p.Start != r.read.Start, 32, 40},
+		{p.End != r.read.End, 40, 48},
+		{p.Attributes != r.read.Attributes, 48, 56},
+		// the name is written whole, padding and all, as the padding after a shorter name is not kept
+		{p.Name != r.read.Name, 56, PartitionEntrySize},
+	}
+	for _, f := range fields {
+		if f.changed {
+			copy(b[f.start:f.end], fresh[f.start:f.end])
+		}
+	}
+	return b
 }
 
 func reverseSlice(s interface{}) {
@@ -289,7 +326,13 @@ func (p *Partition) sectorSizes() (physical, logical int) {
 }
 
 func (p *Partition) Equal(o *Partition) bool {
-	return p != nil && o != nil && *p == *o
+	if p == nil || o == nil {
+		return false
+	}
+	// what was read from disk does not matter, only what the partition is
+	a, b := *p, *o
+	a.raw, b.raw = nil, nil
+	return a == b
 }
 
 // UUID returns the partitions UUID
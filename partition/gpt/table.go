@@ -17,6 +17,11 @@ const (
 	mbrPartitionEntriesStart = 446
 	mbrPartitionEntriesCount = 4
 	mbrpartitionEntrySize    = 16
+	// defaultPartitionEntries the number of entries in the partition array of a new table
+	defaultPartitionEntries = 128
+	// maxPartitionArraySize a limit on the size of a partition array read from disk, far above what any tool writes,
+	// so that a corrupt header cannot make Read allocate gigabytes
+	maxPartitionArraySize = 16 * 1024 * 1024
 	// just defaults
 	physicalSectorSize = 512
 	logicalSectorSize  = 512
@@ -39,6 +44,15 @@ type Table struct {
 	firstDataSector        uint64       // LBA of first data sector
 	lastDataSector         uint64       // LBA of last data sector
 	initialized            bool
+	// PreserveBytes write back what was read from disk for anything that has not changed since, for firmware
+	// that is picky about the exact bytes: the reserved bytes at the end of the primary header, the padding of
+	// partition names, empty entries of the partition array that are not all zeroes, and the CHS values of the
+	// protective MBR. Each partition read from disk also stays in the same entry of the partition array, with
+	// any new partitions in the first free ones. Only has an effect on a table that was read from disk.
+	PreserveBytes bool
+	rawHeader     []byte // primary header as read from disk
+	rawArray      []byte // partition array as read from disk
+	rawMBR        []byte // protective MBR as read from disk, from its partition entries to its end
 }
 
 func getEfiSignature() []byte {
@@ -88,19 +102,20 @@ func (t *Table) initTable(size int64) {
 		t.GUID = guid.String()
 	}
 	if t.partitionArraySize == 0 {
-		t.partitionArraySize = 128
+		t.partitionArraySize = defaultPartitionEntries
 	}
 	if t.partitionEntrySize == 0 {
-		t.partitionEntrySize = 128
+		t.partitionEntrySize = PartitionEntrySize
 	}
 
 	// how many sectors on the disk?
 	diskSectors := uint64(size) / uint64(t.LogicalSectorSize)
 	// how many sectors used for partition entries?
-	partSectors := uint64(t.partitionArraySize) * uint64(t.partitionEntrySize) / uint64(t.LogicalSectorSize)
+	partSectors := t.partitionArraySectors()
 
+	// the first usable sector is aligned to the physical sector, which some tools expect of a 512e disk
 	if t.firstDataSector == 0 {
-		t.firstDataSector = 2 + partSectors
+		t.firstDataSector = t.alignSector(2 + partSectors)
 	}
 
 	if t.secondaryHeader == 0 {
@@ -148,7 +163,7 @@ func comparePartitionArray(p1, p2 []*Partition) bool {
 		if p.Type == Unused && p2[i].Type == Unused {
 			continue
 		}
-		if *p != *p2[i] {
+		if !p.Equal(p2[i]) {
 			matches = false
 			break
 		}
@@ -199,7 +214,20 @@ func (t *Table) partitionArraySector(primary bool) uint64 {
 	if primary {
 		return t.primaryHeader + 1
 	}
-	return t.secondaryHeader - uint64(t.partitionArraySize)*uint64(t.partitionEntrySize)/uint64(t.LogicalSectorSize)
+	return t.secondaryHeader - t.partitionArraySectors()
+}
+
+// partitionArraySectors how many sectors each copy of the partition array takes, including a partial last sector
+// when the entries do not fill it
+func (t *Table) partitionArraySectors() uint64 {
+	logical := uint64(t.LogicalSectorSize)
+	return (uint64(t.partitionArraySize)*uint64(t.partitionEntrySize) + logical - 1) / logical
+}
+
+// protectiveMBRSectors the size in sectors of the partition of the protective MBR, which covers the whole disk
+// after the MBR, or as much of it as fits in 32 bits
+func (t *Table) protectiveMBRSectors() uint32 {
+	return uint32(min(t.secondaryHeader, 0xffffffff))
 }
 
 func (t *Table) generateProtectiveMBR() []byte {
@@ -217,7 +245,7 @@ func (t *Table) generateProtectiveMBR() []byte {
 	// start LBA 1
 	binary.LittleEndian.PutUint32(parts[8:12], 1)
 	// end LBA last omne on disk
-	binary.LittleEndian.PutUint32(parts[12:16], uint32(t.secondaryHeader))
+	binary.LittleEndian.PutUint32(parts[12:16], t.protectiveMBRSectors())
 	return b
 }
 
@@ -240,19 +268,61 @@ func (t *Table) toPartitionArrayBytes() ([]byte, error) {
 	// generate the partition bytes
 	partSize := t.partitionEntrySize * uint32(t.partitionArraySize)
 	bpart := make([]byte, partSize)
+	preserve := t.PreserveBytes && len(t.rawArray) == len(bpart)
+	// the entries of the partitions read from disk, which keep their own
+	owners := map[int]*Partition{}
+	if preserve {
+		copy(bpart, t.rawArray)
+		// the partitions read from disk are written again below, if they still are in the table
+		for slotStart := 0; slotStart+int(t.partitionEntrySize) <= len(bpart); slotStart += int(t.partitionEntrySize) {
+			if !bytes.Equal(bpart[slotStart:slotStart+16], zeroUUIDBytes) {
+				copy(bpart[slotStart:slotStart+int(t.partitionEntrySize)], make([]byte, t.partitionEntrySize))
+			}
+		}
+		for _, p := range t.Partitions {
+			if p.raw != nil && owners[p.raw.slot] == nil {
+				owners[p.raw.slot] = p
+			}
+		}
+	}
+	nextFree := 0
 	for i, p := range t.Partitions {
 		// write the primary partition entry
 		b2, err := p.toBytes()
 		if err != nil {
 			return nil, fmt.Errorf("error preparing partition entry %d for writing to disk: %v", i, err)
 		}
-		slotStart := i * int(t.partitionEntrySize)
+		slot := i
+		if preserve {
+			if p.raw != nil && owners[p.raw.slot] == p {
+				slot = p.raw.slot
+				b2 = p.raw.merge(p, b2)
+			} else {
+				for owners[nextFree] != nil {
+					nextFree++
+				}
+				slot = nextFree
+				owners[slot] = p
+			}
+			if slot >= t.partitionArraySize {
+				return nil, fmt.Errorf("no free entry in the partition array of %d entries for partition %d", t.partitionArraySize, i)
+			}
+		}
+		slotStart := slot * int(t.partitionEntrySize)
 		slotEnd := slotStart + int(t.partitionEntrySize)
 		copy(bpart[slotStart:slotEnd], b2)
 	}
 	return bpart, nil
 }
 
+// preservedProtectiveMBR the protective MBR from its partition entries to its end as read from disk, with the
+// start and size of its partition taken from generated, the protective MBR as it would be written from scratch
+func (t *Table) preservedProtectiveMBR(generated []byte) []byte {
+	b := bytes.Clone(t.rawMBR)
+	copy(b[8:16], generated[8:16])
+	return b
+}
+
 // toGPTBytes write just the gpt header to bytes
 func (t *Table) toGPTBytes(primary bool) ([]byte, error) {
 	b := make([]byte, t.LogicalSectorSize)
@@ -300,7 +370,7 @@ func (t *Table) toGPTBytes(primary bool) ([]byte, error) {
 	// how many entries?
 	binary.LittleEndian.PutUint32(b[80:84], uint32(t.partitionArraySize))
 	// how big is a single entry?
-	binary.LittleEndian.PutUint32(b[84:88], 0x80)
+	binary.LittleEndian.PutUint32(b[84:88], t.partitionEntrySize)
 
 	// we need a CRC/zlib of the partition entries, so we do those first, then append the bytes
 	bpart, err := t.toPartitionArrayBytes()
@@ -314,10 +384,13 @@ func (t *Table) toGPTBytes(primary bool) ([]byte, error) {
 	checksum = crc32.ChecksumIEEE(b[0:92])
 	binary.LittleEndian.PutUint32(b[16:20], checksum)
 
-	// zeroes to the end of the sector
+	// zeroes to the end of the sector, or whatever was there if preserving it, which the checksum does not cover
 	for i := 92; i < t.LogicalSectorSize; i++ {
 		b[i] = 0x00
 	}
+	if primary && t.PreserveBytes && len(t.rawHeader) == len(b) {
+		copy(b[92:], t.rawHeader[92:])
+	}
 
 	return b, nil
 }
@@ -333,8 +406,8 @@ func readPartitionArrayBytes(b []byte, entrySize, logicalSectorSize, physicalSec
 	parts := make([]*Partition, 0)
 	for i, c := 0, b; len(c) >= entrySize; c, i = c[entrySize:], i+1 {
 		bpart := c[:entrySize]
-		// write the primary partition entry
-		p, err := partitionFromBytes(bpart, logicalSectorSize, physicalSectorSize)
+		// write the primary partition entry; anything in a larger entry after the fields is kept in raw
+		p, err := partitionFromBytes(bpart[:PartitionEntrySize], logicalSectorSize, physicalSectorSize)
 		if err != nil {
 			return nil, fmt.Errorf("error reading partition entry %d: %v", i, err)
 		}
@@ -343,6 +416,7 @@ func readPartitionArrayBytes(b []byte, entrySize, logicalSectorSize, physicalSec
 		}
 		// augment partition information
 		p.Size = (p.End - p.Start + 1) * uint64(logicalSectorSize)
+		p.raw = &partitionEntryRaw{b: bytes.Clone(bpart), slot: i, read: *p}
 		parts = append(parts, p)
 	}
 	return parts, nil
@@ -385,6 +459,13 @@ func readGPTHeader(b []byte) (*Table, error) {
 	if !bytes.Equal(efiZeroes, getEfiZeroes()) {
 		return nil, fmt.Errorf("invalid EFI Header, expected zeroes, got %v", efiZeroes)
 	}
+	// entries are 128 bytes, or 128 times a power of 2, and there may be any number of them
+	if partitionEntrySize < PartitionEntrySize || partitionEntrySize&(partitionEntrySize-1) != 0 {
+		return nil, fmt.Errorf("invalid partition entry size %d, must be %d times a power of 2", partitionEntrySize, PartitionEntrySize)
+	}
+	if arraySize := uint64(partitionEntryCount) * uint64(partitionEntrySize); arraySize > maxPartitionArraySize {
+		return nil, fmt.Errorf("partition array of %d entries of %d bytes is larger than the maximum %d bytes", partitionEntryCount, partitionEntrySize, maxPartitionArraySize)
+	}
 	// get the checksum
 	checksum := crc32.ChecksumIEEE(gpt[0:92])
 	if efiHeaderCrc != checksum {
@@ -424,7 +505,7 @@ func tableHeaderFromBytes(b []byte, logicalBlockSize, physicalBlockSize int, ski
 	}
 
 	// potential protective MBR is at LBA0
-	table.ProtectiveMBR = readProtectiveMBR(b[:logicalBlockSize], uint32(table.secondaryHeader))
+	table.ProtectiveMBR = readProtectiveMBR(b[:logicalBlockSize], table.protectiveMBRSectors())
 	table.LogicalSectorSize = logicalBlockSize
 	table.PhysicalSectorSize = physicalBlockSize
 	table.initialized = true
@@ -448,10 +529,14 @@ func tableFromBytes(b []byte, logicalBlockSize, physicalBlockSize int) (*Table,
 	}
 
 	// potential protective MBR is at LBA0
-	table.ProtectiveMBR = readProtectiveMBR(b[:logicalBlockSize], uint32(table.secondaryHeader))
+	table.ProtectiveMBR = readProtectiveMBR(b[:logicalBlockSize], table.protectiveMBRSectors())
 	table.LogicalSectorSize = logicalBlockSize
 	table.PhysicalSectorSize = physicalBlockSize
 	table.initialized = true
+	table.rawHeader = bytes.Clone(gpt[:logicalBlockSize])
+	if table.ProtectiveMBR {
+		table.rawMBR = bytes.Clone(b[mbrPartitionEntriesStart:512])
+	}
 
 	return table, nil
 }
@@ -463,10 +548,12 @@ func (t *Table) Type() string {
 
 // Write writes a GPT to disk
 // Must be passed the backend.WritableFile to which to write and the size of the disk
+//
+// The table is checked with Validate before anything is written. Use Diff first to see what would change.
 func (t *Table) Write(f backend.WritableFile, size int64) error {
-	// it is possible that we are given a basic new table that we need to initialize
-	if !t.initialized {
-		t.initTable(size)
+	// it is possible that we are given a basic new table that we need to initialize, which validate does
+	if err := t.validate(size); err != nil {
+		return fmt.Errorf("invalid GPT: %w", err)
 	}
 
 	// write the protectiveMBR if any
@@ -479,6 +566,9 @@ func (t *Table) Write(f backend.WritableFile, size int64) error {
 	if t.ProtectiveMBR {
 		fullMBR := t.generateProtectiveMBR()
 		protectiveMBR := fullMBR[mbrPartitionEntriesStart:]
+		if t.PreserveBytes && t.rawMBR != nil {
+			protectiveMBR = t.preservedProtectiveMBR(protectiveMBR)
+		}
 		written, err = f.WriteAt(protectiveMBR, mbrPartitionEntriesStart)
 		if err != nil {
 			return fmt.Errorf("error writing protective MBR to disk: %v", err)
@@ -575,6 +665,7 @@ func Read(f backend.File, logicalBlockSize, physicalBlockSize int) (*Table, erro
 		return nil, fmt.Errorf("error parsing partition data: %w", err)
 	}
 	gptTable.Partitions = parts
+	gptTable.rawArray = b
 	// get the partition table
 	return gptTable, nil
 }
@@ -619,8 +710,7 @@ func (t *Table) Verify(f backend.File, diskSize uint64) error {
 	if t.firstDataSector != secondaryTable.firstDataSector {
 		return fmt.Errorf("error comparing GPT headers expected =>  %d / actual => %d", t.firstDataSector, secondaryTable.firstDataSector)
 	}
-	partSectors := uint64(t.partitionArraySize) * uint64(t.partitionEntrySize) / uint64(t.LogicalSectorSize)
-	lastDataSector := t.secondaryHeader - partSectors - 1
+	lastDataSector := t.secondaryHeader - t.partitionArraySectors() - 1
 	if t.lastDataSector != lastDataSector {
 		return fmt.Errorf("error comparing GPT secondary headers expected =>  %d / actual => %d", t.lastDataSector, lastDataSector)
 	}
@@ -628,20 +718,51 @@ func (t *Table) Verify(f backend.File, diskSize uint64) error {
 }
 
 // Repair will attempt to evaluate the headers fix the header location and re-write the primary and secondary header
+//
+// It moves the secondary header and partition array to the end of a disk of diskSize bytes, for instance after
+// the disk image was grown, and moves the last usable sector with them. It returns an error if diskSize is not a
+// multiple of the logical sector size, or if the disk is too small for the partitions. Only the table changes;
+// Write it, or use RelocateBackup, to rewrite both headers with their new CRCs.
 func (t *Table) Repair(diskSize uint64) error {
 	if t.LogicalSectorSize == 0 {
 		// Avoid divide by zero panic.
 		return fmt.Errorf("table is not initialized")
 	}
+	logical := uint64(t.LogicalSectorSize)
+	if diskSize%logical != 0 {
+		return fmt.Errorf("disk size %d is not a multiple of the logical sector size %d", diskSize, logical)
+	}
 
-	partSectors := uint64(t.partitionArraySize) * uint64(t.partitionEntrySize) / uint64(t.LogicalSectorSize)
+	partSectors := t.partitionArraySectors()
+	diskSectors := diskSize / logical
+	if diskSectors < t.firstDataSector+partSectors+2 {
+		return fmt.Errorf("disk of %d sectors is too small for the partition array and secondary header after the first usable sector %d", diskSectors, t.firstDataSector)
+	}
+	secondaryHeader := diskSectors - 1
+	lastDataSector := secondaryHeader - partSectors - 1
+	for i, p := range t.Partitions {
+		if p.Type != Unused && p.End > lastDataSector {
+			return fmt.Errorf("partition %d ends at sector %d, after the last usable sector %d of a disk of %d bytes", i+1, p.End, lastDataSector, diskSize)
+		}
+	}
 
-	t.secondaryHeader = (diskSize / uint64(t.LogicalSectorSize)) - 1
-	t.lastDataSector = t.secondaryHeader - partSectors - 1
+	t.secondaryHeader = secondaryHeader
+	t.lastDataSector = lastDataSector
 
 	return nil
 }
 
+// RelocateBackup move the secondary header and partition array to the end of f, a disk of diskSize bytes, as
+// growpart or sgdisk -e do after a disk image was grown. It calls Repair, and then Write, which rewrites the
+// protective MBR, both headers with their new CRCs, and both copies of the partition array. The old secondary
+// header is left where it was, now in the usable space of the disk.
+func (t *Table) RelocateBackup(f backend.WritableFile, diskSize int64) error {
+	if err := t.Repair(uint64(diskSize)); err != nil {
+		return err
+	}
+	return t.Write(f, diskSize)
+}
+
 // TotalSize returns the total size of the GPT in bytes.
 //
 // This is counted from the start of the MBR to the end of the secondary
@@ -650,6 +771,12 @@ func (t *Table) TotalSize() uint64 {
 	return (t.secondaryHeader + gptHeaderSector) * uint64(t.LogicalSectorSize)
 }
 
+// FirstDataSector returns the first sector that a partition may use, after the primary partition array
+func (t *Table) FirstDataSector() uint64 {
+	return t.firstDataSector
+}
+
+// LastDataSector returns the last sector that a partition may use, before the secondary partition array
 func (t *Table) LastDataSector() uint64 {
 	return t.lastDataSector
 }
@@ -664,7 +791,7 @@ func (t *Table) Resize(size uint64) {
 	// how many sectors on the disk?
 	diskSectors := size / uint64(t.LogicalSectorSize)
 	// how many sectors used for partition entries?
-	partSectors := uint64(t.partitionArraySize) * uint64(t.partitionEntrySize) / uint64(t.LogicalSectorSize)
+	partSectors := t.partitionArraySectors()
 
 	t.secondaryHeader = diskSectors - 1
 	t.lastDataSector = t.secondaryHeader - 1 - partSectors
@@ -270,7 +270,7 @@ func TestRepairVerify(t *testing.T) {
 		Partitions: []*Partition{
 			{
 				Start: 2048,
-				End:   sizeBefore,
+				End:   sizeBefore/512 - 34, // last usable sector, before the secondary array and header
 				Type:  LinuxFilesystem,
 			},
 		},
@@ -315,3 +315,91 @@ func TestRepairVerify(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTablePartitionEntries(t *testing.T) {
+	const size = 10 * 1024 * 1024
+	tests := []struct {
+		count, entrySize int
+		arraySectors     uint64
+	}{
+		{128, 128, 32},
+		// fewer entries than fill a sector, and not a whole number of sectors
+		{4, 128, 1},
+		{56, 128, 14},
+		{5, 128, 2},
+		// larger entries, as the specification allows
+		{128, 256, 64},
+		{300, 128, 75},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d entries of %d bytes", tt.count, tt.entrySize), func(t *testing.T) {
+			f, err := os.CreateTemp(t.TempDir(), "gpt_entries")
+			if err != nil {
+				t.Fatalf("unable to create tempfile: %v", err)
+			}
+			defer f.Close()
+			if err := f.Truncate(size); err != nil {
+				t.Fatalf("unable to size file: %v", err)
+			}
+			table := &Table{
+				partitionArraySize: tt.count,
+				partitionEntrySize: uint32(tt.entrySize),
+				ProtectiveMBR:      true,
+				Partitions: []*Partition{
+					{Start: 2048, End: 4095, Type: LinuxFilesystem, Name: "first"},
+					{Start: 4096, Size: 1024 * 1024, Type: LinuxFilesystem, Name: "second"},
+				},
+			}
+			if err := table.Write(f, size); err != nil {
+				t.Fatalf("error writing table: %v", err)
+			}
+			if table.firstDataSector != 2+tt.arraySectors || table.lastDataSector != size/512-2-tt.arraySectors {
+				t.Errorf("usable sectors %d-%d instead of %d-%d", table.firstDataSector, table.lastDataSector, 2+tt.arraySectors, size/512-2-tt.arraySectors)
+			}
+
+			read, err := Read(f, 512, 512)
+			if err != nil {
+				t.Fatalf("error reading table: %v", err)
+			}
+			if read.partitionArraySize != tt.count || read.partitionEntrySize != uint32(tt.entrySize) {
+				t.Errorf("read %d entries of %d bytes instead of %d of %d", read.partitionArraySize, read.partitionEntrySize, tt.count, tt.entrySize)
+			}
+			if len(read.Partitions) != 2 || read.Partitions[1].Name != "second" || read.Partitions[1].End != 4096+2047 {
+				t.Errorf("mismatched partitions read back")
+			}
+			if err := read.Verify(f, size); err != nil {
+				t.Errorf("error verifying table: %v", err)
+			}
+			if err := f.Truncate(2 * size); err != nil {
+				t.Fatalf("unable to grow file: %v", err)
+			}
+			if err := read.RelocateBackup(f, 2*size); err != nil {
+				t.Fatalf("error relocating secondary header: %v", err)
+			}
+			read, err = Read(f, 512, 512)
+			if err != nil {
+				t.Fatalf("error reading table: %v", err)
+			}
+			if err := read.Verify(f, 2*size); err != nil {
+				t.Errorf("error verifying relocated table: %v", err)
+			}
+			if read.partitionArraySize != tt.count || read.lastDataSector != 2*size/512-2-tt.arraySectors {
+				t.Errorf("relocated table has %d entries and last usable sector %d instead of %d and %d", read.partitionArraySize, read.lastDataSector, tt.count, 2*size/512-2-tt.arraySectors)
+			}
+		})
+	}
+
+	t.Run("invalid entry size", func(t *testing.T) {
+		for _, entrySize := range []uint32{64, 192} {
+			table := GetValidTable()
+			table.partitionEntrySize = entrySize
+			b, err := table.toGPTBytes(true)
+			if err != nil {
+				t.Fatalf("error converting header to bytes: %v", err)
+			}
+			if _, err := readGPTHeader(b); err == nil || !strings.Contains(err.Error(), "invalid partition entry size") {
+				t.Errorf("entry size %d: mismatched error %v", entrySize, err)
+			}
+		}
+	})
+}
@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
@@ -15,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/diskfs/go-diskfs/testhelper"
 )
 
@@ -544,3 +547,825 @@ func TestExpandPartition(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTableValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions []*gpt.Partition
+		physical   int
+		size       int64
+		err        string
+	}{
+		{"valid", []*gpt.Partition{{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem}, {Start: 4096, End: 8191, Type: gpt.LinuxFilesystem}}, 512, tenMB, ""},
+		{"before first usable sector", []*gpt.Partition{{Start: 10, End: 4095, Type: gpt.LinuxFilesystem}}, 512, tenMB, "before the first usable sector"},
+		{"past last usable sector", []*gpt.Partition{{Start: 2048, End: tenMB / 512, Type: gpt.LinuxFilesystem}}, 512, tenMB, "after the last usable sector"},
+		{"overlap", []*gpt.Partition{{Start: 4096, End: 8191, Type: gpt.LinuxFilesystem}, {Start: 2048, End: 4096, Type: gpt.LinuxFilesystem}}, 512, tenMB, "overlaps partition"},
+		{"unaligned", []*gpt.Partition{{Start: 2049, End: 4095, Type: gpt.LinuxFilesystem}}, 4096, tenMB, "not aligned"},
+		{"disk too small", nil, 512, 1024, "too small for a GPT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &gpt.Table{Partitions: tt.partitions, PhysicalSectorSize: tt.physical, ProtectiveMBR: true}
+			err := table.Validate(tt.size)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && err == nil:
+				t.Errorf("returned nil error instead of %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("error %q does not contain %q", err.Error(), tt.err)
+			}
+		})
+	}
+	t.Run("does not fill in the table", func(t *testing.T) {
+		table := &gpt.Table{Partitions: []*gpt.Partition{{Start: 2048, Size: 1024 * 1024, Type: gpt.LinuxFilesystem}}}
+		if err := table.Validate(tenMB); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if table.GUID != "" || table.Partitions[0].GUID != "" || table.Partitions[0].End != 0 {
+			t.Errorf("validate filled in the table: GUID %q, partition GUID %q, end %d", table.GUID, table.Partitions[0].GUID, table.Partitions[0].End)
+		}
+	})
+	t.Run("legacy alignment read from disk", func(t *testing.T) {
+		f, err := tmpDisk("", tenMB)
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		legacy := &gpt.Table{Partitions: []*gpt.Partition{{Start: 63, End: 4095, Type: gpt.LinuxFilesystem}}, ProtectiveMBR: true}
+		if err := legacy.Write(f, tenMB); err != nil {
+			t.Fatalf("error writing table: %v", err)
+		}
+		// the same disk, seen as having 4K physical sectors
+		table, err := gpt.Read(f, 512, 4096)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		table.Partitions[0].Name = "renamed"
+		if err := table.Write(f, tenMB); err != nil {
+			t.Errorf("unexpected error writing back unaligned partition that did not move: %v", err)
+		}
+		table.Partitions = append(table.Partitions, &gpt.Partition{Start: 4097, End: 8191, Type: gpt.LinuxFilesystem})
+		if err := table.Validate(tenMB); err == nil || !strings.Contains(err.Error(), "not aligned") {
+			t.Errorf("new unaligned partition returned error %v", err)
+		}
+		table.Partitions = table.Partitions[:1]
+		table.Partitions[0].Start, table.Partitions[0].Size = 65, 0
+		if err := table.Validate(tenMB); err == nil || !strings.Contains(err.Error(), "not aligned") {
+			t.Errorf("moved unaligned partition returned error %v", err)
+		}
+	})
+	t.Run("write refuses invalid table", func(t *testing.T) {
+		table := &gpt.Table{Partitions: []*gpt.Partition{{Start: 2048, End: tenMB / 512, Type: gpt.LinuxFilesystem}}}
+		f := &testhelper.FileImpl{
+			//nolint:revive // b is unused, but we keep it here for the consistent io.Writer signatire
+			Writer: func(b []byte, offset int64) (int, error) {
+				t.Fatalf("wrote to disk at %d despite invalid table", offset)
+				return 0, nil
+			},
+		}
+		if err := table.Write(f, tenMB); err == nil {
+			t.Errorf("returned nil error for invalid table")
+		}
+	})
+}
+
+func TestTableFreeRegions(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions []*gpt.Partition
+		physical   int
+		regions    []gpt.Region
+	}{
+		{"empty", nil, 512, []gpt.Region{{Start: 34, End: 20446, Size: (20446 - 34 + 1) * 512}}},
+		{"gaps", []*gpt.Partition{
+			{Start: 4096, End: 8191, Type: gpt.LinuxFilesystem},
+			{Type: gpt.Unused},
+			{Start: 2048, End: 4095, Type: gpt.EFISystemPartition},
+			{Start: 10000, End: 20446, Type: gpt.LinuxFilesystem},
+		}, 512, []gpt.Region{{Start: 34, End: 2047, Size: (2047 - 34 + 1) * 512}, {Start: 8192, End: 9999, Size: (9999 - 8192 + 1) * 512}}},
+		{"aligned", []*gpt.Partition{
+			{Start: 2048, End: 4099, Type: gpt.LinuxFilesystem},
+			{Start: 4104, End: 8191, Type: gpt.LinuxFilesystem},
+		}, 4096, []gpt.Region{{Start: 40, End: 2047, Size: (2047 - 40 + 1) * 512}, {Start: 8192, End: 20446, Size: (20446 - 8192 + 1) * 512}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &gpt.Table{Partitions: tt.partitions, PhysicalSectorSize: tt.physical, ProtectiveMBR: true}
+			writeTable(t, table, tenMB)
+			regions, err := table.FreeRegions()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fmt.Sprint(regions) != fmt.Sprint(tt.regions) {
+				t.Errorf("regions %v instead of %v", regions, tt.regions)
+			}
+		})
+	}
+	if _, err := (&gpt.Table{}).FreeRegions(); err == nil {
+		t.Errorf("no error for uninitialized table")
+	}
+}
+
+func TestTableResizePartition(t *testing.T) {
+	tests := []struct {
+		name    string
+		partNum int
+		size    uint64
+		end     uint64
+		err     string
+	}{
+		{"grow", 1, 4096 * 512, 6143, ""},
+		{"shrink", 1, 1024 * 512, 3071, ""},
+		{"fill", 1, 0, 8191, ""},
+		{"fill to end", 2, 0, 20446, ""},
+		{"overlap", 1, 8192 * 512, 0, "overlapping"},
+		{"past end", 2, tenMB, 0, "after the last usable sector"},
+		{"unaligned size", 1, 1000, 0, "not a multiple"},
+		{"unused", 3, 512, 0, "unused"},
+		{"no such partition", 4, 512, 0, "invalid partition number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &gpt.Table{Partitions: []*gpt.Partition{
+				{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem},
+				{Start: 8192, End: 10239, Type: gpt.LinuxFilesystem},
+				{Type: gpt.Unused},
+			}, ProtectiveMBR: true}
+			writeTable(t, table, tenMB)
+			err := table.ResizePartition(tt.partNum, tt.size)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v instead of one with %q", err, tt.err)
+			case tt.err != "":
+				return
+			}
+			p := table.Partitions[tt.partNum-1]
+			if p.End != tt.end || p.Size != (p.End-p.Start+1)*512 {
+				t.Errorf("partition ends at %d with size %d instead of ending at %d", p.End, p.Size, tt.end)
+			}
+			if err := table.Validate(tenMB); err != nil {
+				t.Errorf("resized table is not valid: %v", err)
+			}
+		})
+	}
+}
+
+func TestTableMovePartition(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    uint64
+		physical int
+		err      string
+	}{
+		{"forward", 12288, 512, ""},
+		{"back", 34, 512, ""},
+		{"overlap", 7000, 512, "overlap"},
+		{"before first usable sector", 20, 512, "before the first usable sector"},
+		{"past end", 20000, 512, "after the last usable sector"},
+		{"unaligned", 12289, 4096, "not aligned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &gpt.Table{Partitions: []*gpt.Partition{
+				{Start: 2048, End: 4095, Type: gpt.LinuxFilesystem},
+				{Start: 8192, End: 10239, Type: gpt.LinuxFilesystem},
+			}, PhysicalSectorSize: tt.physical, ProtectiveMBR: true}
+			writeTable(t, table, tenMB)
+			err := table.MovePartition(1, tt.start)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v instead of one with %q", err, tt.err)
+			case tt.err != "":
+				return
+			}
+			p := table.Partitions[0]
+			if p.Start != tt.start || p.End != tt.start+2047 || p.Size != 2048*512 {
+				t.Errorf("partition at %d-%d with size %d instead of %d-%d", p.Start, p.End, p.Size, tt.start, tt.start+2047)
+			}
+		})
+	}
+}
+
+func TestTableResizePartitionWrite(t *testing.T) {
+	f, err := tmpDisk(gptFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("error getting size of disk: %v", err)
+	}
+	table, err := gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table: %v", err)
+	}
+	if err := table.ResizePartition(1, 0); err != nil {
+		t.Fatalf("unexpected error resizing: %v", err)
+	}
+	if err := table.MovePartition(1, 4096); err == nil {
+		t.Fatalf("no error moving partition that fills the disk")
+	}
+	if err := table.Write(f, fi.Size()); err != nil {
+		t.Fatalf("error writing table: %v", err)
+	}
+	// both the primary and backup headers must be rewritten with the new partition array
+	table, err = gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table back: %v", err)
+	}
+	if err := table.Verify(f, uint64(fi.Size())); err != nil {
+		t.Errorf("error verifying table: %v", err)
+	}
+	if p := table.Partitions[0]; p.End != table.LastDataSector() {
+		t.Errorf("partition ends at %d instead of last usable sector %d", p.End, table.LastDataSector())
+	}
+	regions, err := table.FreeRegions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(regions) != 1 || regions[0].End != 2047 {
+		t.Errorf("free regions %v instead of only the one before the partition", regions)
+	}
+}
+
+func TestTableRelocateBackup(t *testing.T) {
+	f, err := tmpDisk(gptFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("error getting size of disk: %v", err)
+	}
+	// grow the image, as for a cloud disk, leaving the secondary header where it was
+	size := fi.Size() + tenMB
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("error growing disk: %v", err)
+	}
+	table, err := gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table: %v", err)
+	}
+	if err := table.Verify(f, uint64(size)); err == nil {
+		t.Fatalf("no error verifying table with secondary header before the end of the disk")
+	}
+	if err := table.Repair(uint64(size) - 100); err == nil {
+		t.Errorf("no error repairing with a size that is not a multiple of the sector size")
+	}
+	if err := table.Repair(64 * 512); err == nil {
+		t.Errorf("no error repairing with a disk too small for the partitions")
+	}
+	if err := table.RelocateBackup(f, size); err != nil {
+		t.Fatalf("error relocating secondary header: %v", err)
+	}
+
+	table, err = gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table back: %v", err)
+	}
+	if err := table.Verify(f, uint64(size)); err != nil {
+		t.Errorf("error verifying table: %v", err)
+	}
+	if !table.ProtectiveMBR {
+		t.Errorf("protective MBR does not cover the grown disk")
+	}
+	if last := uint64(size)/512 - 34; table.LastDataSector() != last {
+		t.Errorf("last usable sector %d instead of %d", table.LastDataSector(), last)
+	}
+	// the secondary header must be valid, with its partition array where it says
+	b := make([]byte, 512)
+	if _, err := f.ReadAt(b, size-512); err != nil {
+		t.Fatalf("error reading secondary header: %v", err)
+	}
+	if !bytes.Equal(b[0:8], []byte("EFI PART")) {
+		t.Fatalf("no secondary header at the end of the disk")
+	}
+	headerCRC := binary.LittleEndian.Uint32(b[16:20])
+	binary.LittleEndian.PutUint32(b[16:20], 0)
+	if crc := crc32.ChecksumIEEE(b[0:92]); crc != headerCRC {
+		t.Errorf("secondary header has CRC %x instead of %x", headerCRC, crc)
+	}
+	array := make([]byte, 128*128)
+	if _, err := f.ReadAt(array, int64(binary.LittleEndian.Uint64(b[72:80]))*512); err != nil {
+		t.Fatalf("error reading secondary partition array: %v", err)
+	}
+	if crc := crc32.ChecksumIEEE(array); crc != binary.LittleEndian.Uint32(b[88:92]) {
+		t.Errorf("secondary partition array has CRC %x instead of %x", crc, binary.LittleEndian.Uint32(b[88:92]))
+	}
+}
+
+func TestTableSetPartitionEntries(t *testing.T) {
+	t.Run("new table", func(t *testing.T) {
+		tests := []struct {
+			physical, entries int
+			first             uint64
+		}{
+			{512, 0, 34},
+			// aligned to the physical sector
+			{4096, 0, 40},
+			{512, 256, 66},
+			{512, 16, 6},
+			{4096, 16, 8},
+		}
+		for _, tt := range tests {
+			f, err := os.CreateTemp(t.TempDir(), "gpt_entries")
+			if err != nil {
+				t.Fatalf("error creating disk: %v", err)
+			}
+			defer f.Close()
+			table := &gpt.Table{
+				LogicalSectorSize:  512,
+				PhysicalSectorSize: tt.physical,
+				ProtectiveMBR:      true,
+				Partitions:         []*gpt.Partition{{Start: 2048, Size: 1024 * 1024, Type: gpt.LinuxFilesystem}},
+			}
+			if tt.entries != 0 {
+				if err := table.SetPartitionEntries(tt.entries); err != nil {
+					t.Fatalf("unexpected error setting %d entries: %v", tt.entries, err)
+				}
+			}
+			if err := table.Write(f, tenMB); err != nil {
+				t.Fatalf("error writing table: %v", err)
+			}
+			read, err := gpt.Read(f, 512, tt.physical)
+			if err != nil {
+				t.Fatalf("error reading table: %v", err)
+			}
+			entries := 128
+			if tt.entries != 0 {
+				entries = tt.entries
+			}
+			last := uint64(tenMB/512) - 2 - uint64(entries*128+511)/512
+			if read.PartitionEntries() != entries || read.FirstDataSector() != tt.first || read.LastDataSector() != last {
+				t.Errorf("physical %d: %d entries with usable sectors %d-%d instead of %d with %d-%d", tt.physical, read.PartitionEntries(), read.FirstDataSector(), read.LastDataSector(), entries, tt.first, last)
+			}
+		}
+	})
+
+	t.Run("table read from disk", func(t *testing.T) {
+		f, err := tmpDisk(gptFile, 0)
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("error getting size of disk: %v", err)
+		}
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		if err := table.SetPartitionEntries(0); err == nil {
+			t.Errorf("no error setting no partition entries")
+		}
+		// an array that would run into the first partition, at sector 2048
+		if err := table.SetPartitionEntries(10000); err == nil {
+			t.Errorf("no error setting a partition array that overlaps a partition")
+		}
+		if table.PartitionEntries() != 128 || table.FirstDataSector() != 34 {
+			t.Errorf("failed change left %d entries and first usable sector %d", table.PartitionEntries(), table.FirstDataSector())
+		}
+		if err := table.SetPartitionEntries(1024); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := table.Write(f, fi.Size()); err != nil {
+			t.Fatalf("error writing table: %v", err)
+		}
+		table, err = gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table back: %v", err)
+		}
+		if err := table.Verify(f, uint64(fi.Size())); err != nil {
+			t.Errorf("error verifying table: %v", err)
+		}
+		if last := uint64(fi.Size())/512 - 2 - 256; table.PartitionEntries() != 1024 || table.FirstDataSector() != 258 || table.LastDataSector() != last {
+			t.Errorf("%d entries with usable sectors %d-%d instead of 1024 with 258-%d", table.PartitionEntries(), table.FirstDataSector(), table.LastDataSector(), last)
+		}
+	})
+}
+
+func TestTableConvertMBR(t *testing.T) {
+	m := &mbr.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		Partitions: []*mbr.Partition{
+			{Type: mbr.EFISystem, Start: 2048, Size: 2048},
+			{Type: mbr.Empty},
+			{Bootable: true, Type: mbr.NTFS, Start: 4096, Size: 2048},
+			{Type: mbr.Type(0x42), Start: 6144, Size: 2048},
+		},
+	}
+	table, err := gpt.FromMBR(m)
+	if err != nil {
+		t.Fatalf("error converting MBR: %v", err)
+	}
+	expected := []struct {
+		gptType    gpt.Type
+		attributes uint64
+		start, end uint64
+	}{
+		{gpt.EFISystemPartition, 0, 2048, 4095},
+		{gpt.Unused, 0, 0, 0},
+		{gpt.MicrosoftBasicData, gpt.LegacyBIOSBootable, 4096, 6143},
+		{gpt.LinuxFilesystem, 0, 6144, 8191},
+	}
+	if len(table.Partitions) != len(expected) {
+		t.Fatalf("converted table has %d partitions instead of %d", len(table.Partitions), len(expected))
+	}
+	for i, e := range expected {
+		p := table.Partitions[i]
+		if p.Type != e.gptType || p.Attributes != e.attributes || p.Start != e.start || p.End != e.end {
+			t.Errorf("partition %d has type %s, attributes %#x, sectors %d-%d instead of %s, %#x, %d-%d", i+1, p.Type, p.Attributes, p.Start, p.End, e.gptType, e.attributes, e.start, e.end)
+		}
+	}
+
+	back, err := table.ToMBR()
+	if err != nil {
+		t.Fatalf("error converting back to MBR: %v", err)
+	}
+	// the types without a GPT equivalent are Linux, and NTFS is basic data, which is FAT32
+	m.Partitions[2].Type = mbr.Fat32LBA
+	m.Partitions[3].Type = mbr.Linux
+	if !back.Equal(m) {
+		t.Errorf("converting back gave partitions %v instead of %v", back.Partitions, m.Partitions)
+	}
+
+	for _, p := range []*mbr.Partition{{Type: mbr.ExtendedLBA, Start: 2048, Size: 2048}, {Type: mbr.GPTProtective, Start: 1, Size: 20479}} {
+		if _, err := gpt.FromMBR(&mbr.Table{Partitions: []*mbr.Partition{p}}); err == nil {
+			t.Errorf("no error converting MBR with partition of type %#x", p.Type)
+		}
+	}
+	table.Partitions = append(table.Partitions, &gpt.Partition{Start: 8192, End: 10239, Type: gpt.LinuxFilesystem})
+	if _, err := table.ToMBR(); err == nil {
+		t.Errorf("no error converting GPT with a fifth partition")
+	}
+	table.Partitions = []*gpt.Partition{{Start: 2048, End: 1 << 32, Type: gpt.LinuxFilesystem}}
+	if _, err := table.ToMBR(); err == nil {
+		t.Errorf("no error converting GPT with a partition past 2^32 sectors")
+	}
+}
+
+func TestTableErase(t *testing.T) {
+	f, err := tmpDisk(gptFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := (&gpt.Table{}).Erase(f); err == nil {
+		t.Errorf("no error erasing table that was not read")
+	}
+	table, err := gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table: %v", err)
+	}
+	if err := table.Erase(f); err != nil {
+		t.Fatalf("error erasing table: %v", err)
+	}
+	if _, err := gpt.Read(f, 512, 512); err == nil {
+		t.Errorf("table could still be read after it was erased")
+	}
+	// the backup header is gone too
+	b := make([]byte, 512)
+	if _, err := f.ReadAt(b, int64(table.TotalSize())-512); err != nil {
+		t.Fatalf("error reading backup header: %v", err)
+	}
+	if !bytes.Equal(b, make([]byte, 512)) {
+		t.Errorf("backup header was not erased")
+	}
+}
+
+func TestTableWriteHybridMBR(t *testing.T) {
+	f, err := tmpDisk("", tenMB)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// boot code, which the hybrid MBR keeps
+	bootCode := bytes.Repeat([]byte{0x90}, 440)
+	if _, err := f.WriteAt(bootCode, 0); err != nil {
+		t.Fatalf("error writing boot code: %v", err)
+	}
+	table := &gpt.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		ProtectiveMBR:      true,
+		Partitions: []*gpt.Partition{
+			{Start: 2048, Size: 2 * 1024 * 1024, Type: gpt.EFISystemPartition},
+			{Start: 8192, Size: 2 * 1024 * 1024, Type: gpt.MicrosoftBasicData, Attributes: gpt.LegacyBIOSBootable},
+			{Start: 12288, Size: 1024 * 1024, Type: gpt.LinuxFilesystem},
+			{Start: 14336, Size: 1024 * 1024, Type: gpt.LinuxFilesystem},
+		},
+	}
+	if err := table.Write(f, tenMB); err != nil {
+		t.Fatalf("error writing table: %v", err)
+	}
+	for _, partNums := range [][]int{nil, {1, 2, 3, 4}, {1, 1}, {5}} {
+		if err := table.WriteHybridMBR(f, partNums); err == nil {
+			t.Errorf("no error writing hybrid MBR with partitions %v", partNums)
+		}
+	}
+	if err := table.WriteHybridMBR(f, []int{2, 3}); err != nil {
+		t.Fatalf("error writing hybrid MBR: %v", err)
+	}
+	if table.ProtectiveMBR {
+		t.Errorf("table still has a protective MBR")
+	}
+	// rewriting the GPT must keep the hybrid MBR
+	if err := table.Write(f, tenMB); err != nil {
+		t.Fatalf("error writing table again: %v", err)
+	}
+
+	b := make([]byte, 512)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading MBR: %v", err)
+	}
+	if !bytes.Equal(b[:440], bootCode) {
+		t.Errorf("boot code was not kept")
+	}
+	expected := []struct {
+		bootable    bool
+		mbrType     byte
+		start, size uint32
+	}{
+		{true, 0x0c, 8192, 4096},
+		{false, 0x83, 12288, 2048},
+		{false, 0xee, 1, 8191},
+		{false, 0, 0, 0},
+	}
+	for i, e := range expected {
+		entry := b[446+16*i : 446+16*(i+1)]
+		bootable := entry[0] == 0x80
+		start, size := binary.LittleEndian.Uint32(entry[8:12]), binary.LittleEndian.Uint32(entry[12:16])
+		if bootable != e.bootable || entry[4] != e.mbrType || start != e.start || size != e.size {
+			t.Errorf("MBR entry %d is bootable %v, type %#x, sectors %d+%d instead of %v, %#x, %d+%d", i, bootable, entry[4], start, size, e.bootable, e.mbrType, e.start, e.size)
+		}
+	}
+
+	read, err := gpt.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table back: %v", err)
+	}
+	if read.ProtectiveMBR || len(read.Partitions) != 4 {
+		t.Errorf("read back table with protective MBR %v and %d partitions", read.ProtectiveMBR, len(read.Partitions))
+	}
+}
+
+// writeTable write the table to a disk of size bytes that keeps nothing, which fills in its layout
+func writeTable(t *testing.T, table *gpt.Table, size int64) {
+	t.Helper()
+	f := &testhelper.FileImpl{
+		Writer: func(b []byte, _ int64) (int, error) {
+			return len(b), nil
+		},
+	}
+	if err := table.Write(f, size); err != nil {
+		t.Fatalf("unexpected error writing table: %v", err)
+	}
+}
+
+func TestTableDiff(t *testing.T) {
+	f, err := tmpDisk(gptFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("error getting size of disk: %v", err)
+	}
+	size := fi.Size()
+
+	t.Run("unchanged", func(t *testing.T) {
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		diff, err := table.Diff(f, size)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff != "" {
+			t.Errorf("unexpected diff for unchanged table:\n%s", diff)
+		}
+	})
+	t.Run("changed", func(t *testing.T) {
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		table.Partitions[0].Expand(8)
+		table.Partitions[0].Name = "renamed"
+		table.Partitions = append(table.Partitions, &gpt.Partition{Start: 8192, End: 10239, Type: gpt.LinuxSwap})
+		diff, err := table.Diff(f, size)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, expected := range []string{
+			"partition 1: end sector changed from 3048 to 3056\n",
+			"partition 1: name changed from \"EFI System\" to \"renamed\"\n",
+			"partition 2: added sectors 8192-10239",
+		} {
+			if !strings.Contains(diff, expected) {
+				t.Errorf("diff does not contain %q:\n%s", expected, diff)
+			}
+		}
+		// a dry run must not change the disk
+		onDisk, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		if len(onDisk.Partitions) != 1 || onDisk.Partitions[0].End != 3048 {
+			t.Errorf("diff changed the table on disk")
+		}
+	})
+	t.Run("no table on disk", func(t *testing.T) {
+		empty, err := tmpDisk("", tenMB)
+		if err != nil {
+			t.Fatalf("error creating disk: %v", err)
+		}
+		defer os.Remove(empty.Name())
+		defer empty.Close()
+		diff, err := gpt.GetValidTable().Diff(empty, tenMB)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(diff, "no valid GPT on disk") || !strings.Contains(diff, "partition 1: added") {
+			t.Errorf("unexpected diff for empty disk:\n%s", diff)
+		}
+	})
+}
+
+func TestTablePreserveBytes(t *testing.T) {
+	f, err := tmpDisk(gptFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("error getting size of disk: %v", err)
+	}
+	size := fi.Size()
+
+	// MBR, primary header and primary partition array
+	b := make([]byte, 34*512)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading disk: %v", err)
+	}
+	header, array := b[512:1024], b[1024:1024+128*128]
+	// CHS values in the protective MBR
+	copy(b[446+5:446+8], []byte{0xfe, 0xff, 0xff})
+	// reserved bytes at the end of the header, which its checksum does not cover
+	for i := 92; i < len(header); i++ {
+		header[i] = 0xa5
+	}
+	// the partition in the 4th entry instead of the 1st, with something after the end of its name
+	copy(array[3*128:4*128], array[0:128])
+	copy(array[0:128], make([]byte, 128))
+	array[3*128+100] = 0x7f
+	// an empty entry that is not all zeroes
+	array[5*128+40] = 0x11
+	binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(array))
+	copy(header[16:20], make([]byte, 4))
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:92]))
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatalf("error writing disk: %v", err)
+	}
+
+	readBack := func() []byte {
+		b2 := make([]byte, len(b))
+		if _, err := f.ReadAt(b2, 0); err != nil {
+			t.Fatalf("error reading disk: %v", err)
+		}
+		return b2
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		table.PreserveBytes = true
+		if err := table.Write(f, size); err != nil {
+			t.Fatalf("error writing table: %v", err)
+		}
+		if b2 := readBack(); !bytes.Equal(b, b2) {
+			t.Errorf("table written back is not the same as the one read")
+		}
+	})
+	t.Run("changed", func(t *testing.T) {
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		table.PreserveBytes = true
+		table.Partitions[0].Attributes = 1
+		table.Partitions = append(table.Partitions, &gpt.Partition{Start: 8192, End: 10239, Type: gpt.LinuxSwap})
+		if err := table.Write(f, size); err != nil {
+			t.Fatalf("error writing table: %v", err)
+		}
+		b2 := readBack()
+		header2, array2 := b2[512:1024], b2[1024:1024+128*128]
+		if !bytes.Equal(header[92:], header2[92:]) {
+			t.Errorf("reserved bytes of header not preserved")
+		}
+		if !bytes.Equal(b[446:512], b2[446:512]) {
+			t.Errorf("protective MBR not preserved")
+		}
+		// only the attributes of the existing partition change, and the new one goes in the first free entry
+		expected := bytes.Clone(array[3*128 : 4*128])
+		binary.LittleEndian.PutUint64(expected[48:56], 1)
+		if !bytes.Equal(expected, array2[3*128:4*128]) {
+			t.Errorf("mismatched entry of changed partition, got %v expected %v", array2[3*128:4*128], expected)
+		}
+		if binary.LittleEndian.Uint64(array2[32:40]) != 8192 {
+			t.Errorf("new partition is not in the first entry")
+		}
+		if !bytes.Equal(array[5*128:6*128], array2[5*128:6*128]) {
+			t.Errorf("empty entry not preserved")
+		}
+	})
+	t.Run("not preserved", func(t *testing.T) {
+		table, err := gpt.Read(f, 512, 512)
+		if err != nil {
+			t.Fatalf("error reading table: %v", err)
+		}
+		if err := table.Write(f, size); err != nil {
+			t.Fatalf("error writing table: %v", err)
+		}
+		b2 := readBack()
+		if !bytes.Equal(b2[512+92:1024], make([]byte, 512-92)) {
+			t.Errorf("reserved bytes of header not cleared")
+		}
+	})
+}
+
+func TestTableDeriveGUIDs(t *testing.T) {
+	ns, err := gpt.MachineNamespace("0123456789abcdef0123456789abcdef\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := gpt.MachineNamespace("not a machine id"); err == nil {
+		t.Errorf("no error for an invalid machine ID")
+	}
+	// the same as Python's uuid.uuid5 derives
+	if guid := gpt.DeriveGUID(ns, "root"); guid != "2E5B3E81-9E02-5E22-8A4A-91B5A84101D0" {
+		t.Errorf("derived GUID %s instead of 2E5B3E81-9E02-5E22-8A4A-91B5A84101D0", guid)
+	}
+
+	explicit := "43E51892-3273-42F7-BCDA-B43B80CDFC48"
+	table := &gpt.Table{
+		Partitions: []*gpt.Partition{
+			{Type: gpt.EFISystemPartition},
+			{Type: gpt.EFISystemPartition},
+			{Type: gpt.LinuxRootX86_64, Name: "root"},
+			{Type: gpt.LinuxHome, Name: "root", GUID: explicit},
+		},
+	}
+	if err := table.DeriveGUIDs(ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"3F25B205-CA65-55C4-B799-C29756AC2084",
+		"FBD56608-C91C-57D2-85FF-6005D2413276",
+		"2E5B3E81-9E02-5E22-8A4A-91B5A84101D0",
+		explicit,
+	}
+	for i, p := range table.Partitions {
+		if p.GUID != expected[i] {
+			t.Errorf("partition %d has GUID %s instead of %s", i+1, p.GUID, expected[i])
+		}
+	}
+	if table.GUID != "8C26C5AC-2EEE-53E1-A297-982D1E716302" {
+		t.Errorf("disk has GUID %s instead of 8C26C5AC-2EEE-53E1-A297-982D1E716302", table.GUID)
+	}
+
+	for _, partitions := range [][]*gpt.Partition{
+		{{Type: gpt.LinuxFilesystem, Name: "data"}, {Type: gpt.LinuxHome, Name: "data"}},
+		{{Type: gpt.LinuxFilesystem, Name: "disk"}},
+	} {
+		table := &gpt.Table{Partitions: partitions}
+		if err := table.DeriveGUIDs(ns); err == nil {
+			t.Errorf("no error for partitions that would have the same GUID")
+		}
+		if table.GUID != "" || partitions[0].GUID != "" {
+			t.Errorf("GUIDs were set despite the error")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package gpt
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/backend"
+)
+
+// Validate check that the table is consistent and fits a disk of size bytes, exactly as Write will lay it out,
+// without writing anything. Write calls it before touching the disk, so a table that fails here is never written.
+//
+// It checks:
+//   - the headers and both partition arrays fit on the disk, with the usable sectors between them
+//   - every partition starts and ends within the usable sectors
+//   - every partition that is new, or has moved since it was read from disk, starts on a physical sector boundary,
+//     so that a table with a legacy layout, such as a partition at sector 63 on a 4K disk, can still be written back
+//   - no two partitions overlap
+//   - the CRCs of the headers and of the partition array are correct as they will be written
+//
+// It works on a copy of the table, so anything left blank, such as the GUIDs and the start and end of each
+// partition, is not filled in as Write does.
+func (t *Table) Validate(size int64) error {
+	_, err := t.validated(size)
+	return err
+}
+
+// validated a copy of the table, filled in as Write would and validated
+func (t *Table) validated(size int64) (*Table, error) {
+	c := t.clone()
+	if err := c.validate(size); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// clone a copy of the table that can be changed without changing it or its partitions
+func (t *Table) clone() *Table {
+	c := *t
+	c.Partitions = make([]*Partition, len(t.Partitions))
+	for i, p := range t.Partitions {
+		pc := *p
+		c.Partitions[i] = &pc
+	}
+	return &c
+}
+
+// moved whether the partition is new, or starts somewhere else than it did when read from disk
+func (p *Partition) moved() bool {
+	return p.raw == nil || p.Start != p.raw.read.Start
+}
+
+// validate check the table as Validate does, filling it in as Write does
+func (t *Table) validate(size int64) error {
+	if !t.initialized {
+		t.initTable(size)
+	}
+	logical, physical := uint64(t.LogicalSectorSize), uint64(t.PhysicalSectorSize)
+	if logical == 0 || physical == 0 {
+		return fmt.Errorf("sector sizes must be set, logical %d physical %d", logical, physical)
+	}
+	if physical%logical != 0 {
+		return fmt.Errorf("physical sector size %d is not a multiple of logical sector size %d", physical, logical)
+	}
+
+	// layout of the headers and partition arrays
+	diskSectors := uint64(size) / logical
+	partSectors := t.partitionArraySectors()
+	// MBR, both headers and both partition arrays
+	if minSectors := 3 + 2*partSectors; diskSectors < minSectors {
+		return fmt.Errorf("disk has %d sectors, too small for a GPT, which needs at least %d", diskSectors, minSectors)
+	}
+	if t.secondaryHeader >= diskSectors {
+		return fmt.Errorf("secondary header at sector %d is past the end of the disk, which has %d sectors", t.secondaryHeader, diskSectors)
+	}
+	if len(t.Partitions) > t.partitionArraySize {
+		return fmt.Errorf("table has %d partitions, more than the %d entries in the partition array", len(t.Partitions), t.partitionArraySize)
+	}
+	primaryArrayEnd := t.partitionArraySector(true) + partSectors - 1
+	secondaryArrayStart := t.partitionArraySector(false)
+	switch {
+	case t.firstDataSector <= primaryArrayEnd:
+		return fmt.Errorf("first usable sector %d is inside the primary partition array, which ends at sector %d", t.firstDataSector, primaryArrayEnd)
+	case t.lastDataSector >= secondaryArrayStart:
+		return fmt.Errorf("last usable sector %d is inside the secondary partition array, which starts at sector %d", t.lastDataSector, secondaryArrayStart)
+	case t.firstDataSector > t.lastDataSector:
+		return fmt.Errorf("first usable sector %d is after last usable sector %d", t.firstDataSector, t.lastDataSector)
+	}
+
+	// the partition array fills in the start and end of each partition, so it must come before checking them
+	partitionArray, err := t.toPartitionArrayBytes()
+	if err != nil {
+		return fmt.Errorf("error converting partition array to bytes: %v", err)
+	}
+	used := make([]*Partition, 0, len(t.Partitions))
+	for i, p := range t.Partitions {
+		if p.Type == Unused {
+			continue
+		}
+		switch {
+		case p.Start < t.firstDataSector:
+			return fmt.Errorf("partition %d starts at sector %d, before the first usable sector %d", i+1, p.Start, t.firstDataSector)
+		case p.End > t.lastDataSector:
+			return fmt.Errorf("partition %d ends at sector %d, after the last usable sector %d", i+1, p.End, t.lastDataSector)
+		case (p.Start*logical)%physical != 0 && p.moved():
+			return fmt.Errorf("partition %d starts at sector %d, which is not aligned to the physical sector size %d", i+1, p.Start, physical)
+		}
+		used = append(used, p)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].Start < used[j].Start })
+	for i := 1; i < len(used); i++ {
+		if used[i].Start <= used[i-1].End {
+			return fmt.Errorf("partition %q at sectors %d-%d overlaps partition %q at sectors %d-%d", used[i-1].GUID, used[i-1].Start, used[i-1].End, used[i].GUID, used[i].Start, used[i].End)
+		}
+	}
+
+	// read back both headers as they will be written, which checks their own CRCs
+	checksum := crc32.ChecksumIEEE(partitionArray)
+	for _, primary := range []bool{true, false} {
+		b, err := t.toGPTBytes(primary)
+		if err != nil {
+			return fmt.Errorf("error converting GPT header to byte array: %v", err)
+		}
+		header, err := readGPTHeader(b)
+		if err != nil {
+			return fmt.Errorf("GPT header is not valid: %v", err)
+		}
+		if header.partitionEntryChecksum != checksum {
+			return fmt.Errorf("GPT header has partition array checksum %x instead of %x", header.partitionEntryChecksum, checksum)
+		}
+		if header.partitionFirstLBA != t.partitionArraySector(primary) {
+			return fmt.Errorf("GPT header has partition array at sector %d instead of %d", header.partitionFirstLBA, t.partitionArraySector(primary))
+		}
+	}
+	return nil
+}
+
+// Diff describe what writing the table to f, a disk of size bytes, would change in the GPT already on it, one
+// change per line. It writes nothing, so it can be used as a dry run to catch a destructive mistake before
+// calling Write. It returns an empty string if nothing would change.
+//
+// The table is validated first, exactly as Write does, and an invalid table is an error. If f does not have a valid
+// GPT, the diff says so, and lists every partition in the table as added.
+func (t *Table) Diff(f backend.File, size int64) (string, error) {
+	// compare the table as it would be written, without filling in the table itself
+	t, err := t.validated(size)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	existing, err := Read(f, t.LogicalSectorSize, t.PhysicalSectorSize)
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("no valid GPT on disk: %v", err))
+		existing = &Table{}
+	} else {
+		changed := func(field string, old, new interface{}) {
+			if old != new {
+				lines = append(lines, fmt.Sprintf("%s: changed from %v to %v", field, old, new))
+			}
+		}
+		changed("disk GUID", existing.GUID, strings.ToUpper(t.GUID))
+		changed("protective MBR", existing.ProtectiveMBR, t.ProtectiveMBR)
+		changed("secondary header sector", existing.secondaryHeader, t.secondaryHeader)
+		changed("first usable sector", existing.firstDataSector, t.firstDataSector)
+		changed("last usable sector", existing.lastDataSector, t.lastDataSector)
+		changed("partition array entries", existing.partitionArraySize, t.partitionArraySize)
+	}
+
+	var current []*Partition
+	for _, p := range t.Partitions {
+		if p.Type != Unused {
+			current = append(current, p)
+		}
+	}
+	count := len(current)
+	if len(existing.Partitions) > count {
+		count = len(existing.Partitions)
+	}
+	for i := 0; i < count; i++ {
+		var old, p *Partition
+		if i < len(existing.Partitions) {
+			old = existing.Partitions[i]
+		}
+		if i < len(current) {
+			p = current[i]
+		}
+		switch {
+		case old == nil:
+			lines = append(lines, fmt.Sprintf("partition %d: added %s", i+1, p.describe()))
+		case p == nil:
+			lines = append(lines, fmt.Sprintf("partition %d: removed %s", i+1, old.describe()))
+		default:
+			changed := func(field string, from, to interface{}) {
+				if from != to {
+					lines = append(lines, fmt.Sprintf("partition %d: %s changed from %v to %v", i+1, field, from, to))
+				}
+			}
+			changed("start sector", old.Start, p.Start)
+			changed("end sector", old.End, p.End)
+			changed("type", old.Type, Type(strings.ToUpper(string(p.Type))))
+			changed("GUID", old.GUID, p.GUID)
+			changed("name", fmt.Sprintf("%q", old.Name), fmt.Sprintf("%q", p.Name))
+			changed("attributes", fmt.Sprintf("%#x", old.Attributes), fmt.Sprintf("%#x", p.Attributes))
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// describe a partition in a single line
+func (p *Partition) describe() string {
+	return fmt.Sprintf("sectors %d-%d, type %s, GUID %s, name %q", p.Start, p.End, p.Type, p.GUID, p.Name)
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/diskfs/go-diskfs/partition/part"
 )
 
-// Table represents an MBR partition table to be applied to a disk or read from a disk
+// Table represents an MBR partition table to be applied to a disk or read from a disk.
+// Every byte of the partition entries is kept in the Partitions, and Write only writes the entries and the
+// signature, so a table read from disk is written back exactly as it was, except for what has been changed.
 type Table struct {
 	Partitions         []*Partition
 	LogicalSectorSize  int // logical size of a sector
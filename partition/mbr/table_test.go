@@ -422,3 +422,36 @@ func TestWritePartitionContents(t *testing.T) {
 		t.Log(b2)
 	}
 }
+
+func TestTableWriteUnchanged(t *testing.T) {
+	f, err := tmpDisk(mbrFile, 0)
+	if err != nil {
+		t.Fatalf("error creating disk: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	b := make([]byte, 512)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("error reading disk: %v", err)
+	}
+	// odd CHS values, and an empty entry that is not all zeroes, all of which are kept
+	copy(b[446+1:446+4], []byte{0xfe, 0xff, 0xff})
+	b[446+3*16+8] = 0x42
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatalf("error writing disk: %v", err)
+	}
+	table, err := mbr.Read(f, 512, 512)
+	if err != nil {
+		t.Fatalf("error reading table: %v", err)
+	}
+	if err := table.Write(f, 0); err != nil {
+		t.Fatalf("error writing table: %v", err)
+	}
+	b2 := make([]byte, 512)
+	if _, err := f.ReadAt(b2, 0); err != nil {
+		t.Fatalf("error reading disk: %v", err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Errorf("table written back is not the same as the one read")
+	}
+}
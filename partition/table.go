@@ -14,3 +14,13 @@ type Table interface {
 	Verify(f backend.File, diskSize uint64) error
 	UUID() string
 }
+
+// Type the type of a partition table, as the Type method of a Table reports it
+type Type string
+
+const (
+	// TypeMBR an MBR partition table, mbr.Table
+	TypeMBR Type = "mbr"
+	// TypeGPT a GUID partition table, gpt.Table
+	TypeGPT Type = "gpt"
+)
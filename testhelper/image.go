@@ -0,0 +1,44 @@
+package testhelper
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/backend"
+	"github.com/diskfs/go-diskfs/backend/file"
+)
+
+// BuildImage run testdata/buildimg.sh of the package under test, which makes an image with the tools of its
+// filesystem, and anything else its tests need, unless the image img already exists. It is for TestMain, which
+// should exit if it fails, as the tests cannot run without the image.
+func BuildImage(img string) error {
+	if _, err := os.Stat(img); !os.IsNotExist(err) {
+		return nil
+	}
+	cmd := exec.Command("sh", "buildimg.sh")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Dir = "testdata"
+	return cmd.Run()
+}
+
+// ReadImage open the image img read-only and read the filesystem that fills it with read, the Read of the package
+// under test, failing the test if either cannot be done. The image is closed when the test ends.
+func ReadImage[T any](t *testing.T, img string, read func(b backend.Storage, size, start, blocksize int64) (T, error)) T {
+	t.Helper()
+	f, err := os.Open(img)
+	if err != nil {
+		t.Fatalf("error opening %s: %v", img, err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("error getting info of %s: %v", img, err)
+	}
+	fs, err := read(file.New(f, true), info.Size(), 0, 0)
+	if err != nil {
+		t.Fatalf("error reading %s: %v", img, err)
+	}
+	return fs
+}
@@ -83,27 +83,28 @@ func (bm *Bitmap) Set(location int) error {
 }
 
 // FirstFree returns the first free bit in the bitmap
-// Begins at start, so if you want to find the first free bit, pass start=1.
+// Begins at start, so if you want to find the first free bit, pass start=0.
 // Returns -1 if none found.
 func (bm *Bitmap) FirstFree(start int) int {
-	var location = -1
-	candidates := bm.bits[start/8:]
-	for i, b := range candidates {
+	if start < 0 {
+		start = 0
+	}
+	for i := start / 8; i < len(bm.bits); i++ {
+		b := bm.bits[i]
 		// if all used, continue to next byte
 		if b&0xff == 0xff {
 			continue
 		}
 		// not all used, so find first bit set to 0
 		for j := uint8(0); j < 8; j++ {
+			location := 8*i + int(j)
 			mask := byte(0x1) << j
-			if b&mask != mask {
-				location = 8*i + int(j)
-				break
+			if location >= start && b&mask != mask {
+				return location
 			}
 		}
-		break
 	}
-	return location
+	return -1
 }
 
 // FirstSet returns location of first set bit in the bitmap